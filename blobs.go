@@ -29,6 +29,14 @@ var (
 	// ErrBlobInvalidLength returned when the blob has an expected length on
 	// commit, meaning mismatched with the descriptor or an invalid value.
 	ErrBlobInvalidLength = errors.New("blob invalid length")
+
+	// ErrBlobChunkOverlap returned when a chunk of an upload overlaps the
+	// data already written or another chunk held for it.
+	ErrBlobChunkOverlap = errors.New("blob chunk overlaps uploaded data")
+
+	// ErrBlobTooManyChunks returned when a chunk of an upload is sent ahead
+	// of the data before it while too many chunks are held for it already.
+	ErrBlobTooManyChunks = errors.New("too many blob chunks held")
 )
 
 // ErrBlobInvalidDigest returned when digest check fails.
@@ -80,6 +88,10 @@ type Descriptor struct {
 	// This should only be used when referring to a manifest.
 	Platform *v1.Platform `json:"platform,omitempty"`
 
+	// ArtifactType is the type of an artifact when the descriptor points to
+	// an artifact manifest, as reported by the referrers API.
+	ArtifactType string `json:"artifactType,omitempty"`
+
 	// NOTE: Before adding a field here, please ensure that all
 	// other options have been exhausted. Much of the type relationships
 	// depend on the simplicity of this type.
@@ -209,6 +221,9 @@ type CreateOptions struct {
 		// Stat allows to pass precalculated descriptor to link and return.
 		// Blob access check will be skipped if set.
 		Stat *Descriptor
+		// Fallback links the blob from any repository of the registry
+		// when it cannot be mounted from the source repository.
+		Fallback bool
 	}
 }
 
@@ -248,6 +263,27 @@ type BlobWriter interface {
 	Cancel(ctx context.Context) error
 }
 
+// BlobChunkWriter is implemented by the blob writers accepting the chunks of
+// an upload out of order.
+type BlobChunkWriter interface {
+	// WriteChunk writes the length bytes of r at offset. A chunk beyond the
+	// data written so far is held until the data before it is written, and
+	// the chunks held are written as soon as they follow the data.
+	// ErrBlobChunkOverlap is returned if the chunk overlaps the data
+	// written or a chunk held, and ErrBlobTooManyChunks if the chunk would
+	// be held while too many are already.
+	WriteChunk(ctx context.Context, offset, length int64, r io.Reader) error
+}
+
+// BlobDigester is implemented by the blob writers hashing the data as it is
+// written, so that its digest can be checked before the upload is committed.
+type BlobDigester interface {
+	// Digest returns the digest of the data written so far, with the given
+	// algorithm. ErrUnsupported is returned if the digest is not available
+	// with this algorithm, or if the hash state of the upload was lost.
+	Digest(ctx context.Context, algorithm digest.Algorithm) (digest.Digest, error)
+}
+
 // BlobService combines the operations to access, read and write blobs. This
 // can be used to describe remote blob services.
 type BlobService interface {
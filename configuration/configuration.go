@@ -6,7 +6,9 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"path"
 	"reflect"
+	"regexp"
 	"strings"
 	"time"
 )
@@ -29,6 +31,10 @@ type Configuration struct {
 			Disabled bool `yaml:"disabled,omitempty"`
 		} `yaml:"accesslog,omitempty"`
 
+		// AuditLog configures the structured audit log, which records one
+		// JSON object per API request.
+		AuditLog AuditLog `yaml:"auditlog,omitempty"`
+
 		// Level is the granularity at which registry operations are logged.
 		Level Loglevel `yaml:"level,omitempty"`
 
@@ -63,6 +69,9 @@ type Configuration struct {
 	// Reporting is the configuration for error reporting
 	Reporting Reporting `yaml:"reporting,omitempty"`
 
+	// Tracing configures the export of OpenTelemetry traces.
+	Tracing Tracing `yaml:"tracing,omitempty"`
+
 	// HTTP contains configuration parameters for the registry's http
 	// interface.
 	HTTP struct {
@@ -89,6 +98,12 @@ type Configuration struct {
 		// receives a stop signal
 		DrainTimeout time.Duration `yaml:"draintimeout,omitempty"`
 
+		// TrustedProxies lists the addresses or CIDR ranges of the reverse
+		// proxies whose X-Forwarded-For and X-Real-Ip headers identify the
+		// clients of the rate limits and upload caps. The headers of other
+		// peers are ignored.
+		TrustedProxies []string `yaml:"trustedproxies,omitempty"`
+
 		// TLS instructs the http server to listen with a TLS configuration.
 		// This only support simple tls configuration with a cert and key.
 		// Mostly, this is useful for testing situations or simple deployments
@@ -151,11 +166,38 @@ type Configuration struct {
 			} `yaml:"prometheus,omitempty"`
 		} `yaml:"debug,omitempty"`
 
+		// Admin configures the administration routes, served below
+		// /admin to clients authorized by the auth configuration.
+		Admin struct {
+			Enabled bool `yaml:"enabled,omitempty"`
+			// Stats configures the statistics served by the admin
+			// routes.
+			Stats AdminStats `yaml:"stats,omitempty"`
+		} `yaml:"admin,omitempty"`
+
+		// CacheControl configures the Cache-Control header set on blob
+		// responses served by the registry.
+		CacheControl CacheControl `yaml:"cachecontrol,omitempty"`
+
+		// Timeouts configures the timeouts of the client connections.
+		Timeouts HTTPTimeouts `yaml:"timeouts,omitempty"`
+
+		// Limits configures the limits of the client connections and
+		// requests.
+		Limits HTTPLimits `yaml:"limits,omitempty"`
+
+		// Compression configures the compression of the API responses.
+		Compression HTTPCompression `yaml:"compression,omitempty"`
+
 		// HTTP2 configuration options
 		HTTP2 struct {
 			// Specifies whether the registry should disallow clients attempting
 			// to connect via http2. If set to true, only http/1.1 is supported.
 			Disabled bool `yaml:"disabled,omitempty"`
+
+			// MaxConcurrentStreams limits the number of requests served at
+			// once on each http2 connection. Defaults to 250.
+			MaxConcurrentStreams uint32 `yaml:"maxconcurrentstreams,omitempty"`
 		} `yaml:"http2,omitempty"`
 	} `yaml:"http,omitempty"`
 
@@ -168,10 +210,30 @@ type Configuration struct {
 		// Addr specifies the the redis instance available to the application.
 		Addr string `yaml:"addr,omitempty"`
 
+		// Addrs specifies the Sentinel instances when MasterName is set, or
+		// the seed nodes of a Cluster when Cluster is enabled.
+		Addrs []string `yaml:"addrs,omitempty"`
+
+		// MasterName specifies the name of the master monitored by the
+		// Sentinel instances listed in Addrs.
+		MasterName string `yaml:"mastername,omitempty"`
+
+		// Cluster specifies whether Addrs are the nodes of a Redis Cluster.
+		Cluster bool `yaml:"cluster,omitempty"`
+
+		// Username string to use when making a connection.
+		Username string `yaml:"username,omitempty"`
+
 		// Password string to use when making a connection.
 		Password string `yaml:"password,omitempty"`
 
+		// SentinelUsername and SentinelPassword are used to authenticate to
+		// the Sentinel instances, which may differ from the redis ones.
+		SentinelUsername string `yaml:"sentinelusername,omitempty"`
+		SentinelPassword string `yaml:"sentinelpassword,omitempty"`
+
 		// DB specifies the database to connect to on the redis instance.
+		// It is not supported by Redis Cluster.
 		DB int `yaml:"db,omitempty"`
 
 		// TLS configures settings for redis in-transit encryption
@@ -202,6 +264,13 @@ type Configuration struct {
 
 	Proxy Proxy `yaml:"proxy,omitempty"`
 
+	// HTTPClient configures the outbound HTTP connections of the pull
+	// through cache and of the notification endpoints.
+	HTTPClient HTTPClient `yaml:"httpclient,omitempty"`
+
+	// Catalog configures the catalog API
+	Catalog Catalog `yaml:"catalog,omitempty"`
+
 	// Compatibility is used for configurations of working with older or deprecated features.
 	Compatibility struct {
 		// Schema1 configures how schema1 manifests will be handled
@@ -211,6 +280,14 @@ type Configuration struct {
 			TrustKey string `yaml:"signingkeyfile,omitempty"`
 			// Enabled determines if schema1 manifests should be pullable
 			Enabled bool `yaml:"enabled,omitempty"`
+			// Conversion is what is served to the clients not supporting
+			// schema2 fetching a schema2 manifest or a manifest list by
+			// tag, "convert" to convert it to schema1 on the fly, the
+			// default, or "reject" to reject the request with Message.
+			Conversion string `yaml:"conversion,omitempty"`
+			// Message guides the users of the rejected clients to
+			// upgrade them.
+			Message string `yaml:"message,omitempty"`
 		} `yaml:"schema1,omitempty"`
 	} `yaml:"compatibility,omitempty"`
 
@@ -232,6 +309,9 @@ type Configuration struct {
 				// that URLs in pushed manifests must not match.
 				Deny []string `yaml:"deny,omitempty"`
 			} `yaml:"urls,omitempty"`
+			// Validators lists the registered manifest validators pushed
+			// manifests must pass, in order.
+			Validators []ManifestValidator `yaml:"validators,omitempty"`
 		} `yaml:"manifests,omitempty"`
 	} `yaml:"validation,omitempty"`
 
@@ -246,7 +326,66 @@ type Configuration struct {
 			// the class in authorized resources.
 			Classes []string `yaml:"classes"`
 		} `yaml:"repository,omitempty"`
+
+		// Mount configures cross repository blob mounts
+		Mount struct {
+			// Fallback mounts blobs missing from the source repository
+			// when any repository of the registry has them, rather than
+			// requiring the client to upload them. As clients can then
+			// mount the blobs of repositories they are not allowed to
+			// pull from, it requires AllowUnauthorizedSource.
+			Fallback bool `yaml:"fallback,omitempty"`
+
+			// AllowUnauthorizedSource acknowledges that the fallback
+			// exposes all the blobs of the registry, and also falls back
+			// when the client lacks pull access to the source
+			// repository. Clients can then mount any blob of the registry
+			// they know the digest of.
+			AllowUnauthorizedSource bool `yaml:"allowunauthorizedsource,omitempty"`
+		} `yaml:"mount,omitempty"`
+
+		// Upload configures the chunked blob uploads
+		Upload struct {
+			// OutOfOrderChunks accepts the chunks of an upload sent ahead
+			// of the data before them, holding them in the storage until
+			// it is written, rather than rejecting them.
+			OutOfOrderChunks bool `yaml:"outoforderchunks,omitempty"`
+
+			// MaxConcurrentPerRepository caps the upload sessions of a
+			// repository open at once. Unlimited if zero.
+			MaxConcurrentPerRepository int `yaml:"maxconcurrentperrepository,omitempty"`
+
+			// MaxConcurrentPerClient caps the upload sessions of a client,
+			// the authenticated user or the address of anonymous clients,
+			// open at once. Unlimited if zero.
+			MaxConcurrentPerClient int `yaml:"maxconcurrentperclient,omitempty"`
+
+			// SessionIdleTimeout is the time without request after which
+			// an upload session stops being counted against the caps.
+			// Defaults to 10 minutes.
+			SessionIdleTimeout time.Duration `yaml:"sessionidletimeout,omitempty"`
+		} `yaml:"upload,omitempty"`
+
+		// Namespaces configures the settings shared by the repositories of
+		// a namespace. Nested namespaces inherit the settings they do not
+		// set from their parent.
+		Namespaces []Namespace `yaml:"namespaces,omitempty"`
 	} `yaml:"policy,omitempty"`
+
+	// RateLimit configures the rate limits of the API requests.
+	RateLimit RateLimit `yaml:"ratelimit,omitempty"`
+
+	// Replication configures the mirroring of the pushed content to remote
+	// registries.
+	Replication Replication `yaml:"replication,omitempty"`
+
+	// TokenServer configures the built-in token server, issuing the tokens
+	// of the token authentication.
+	TokenServer TokenServer `yaml:"tokenserver,omitempty"`
+
+	// Tenancy configures the tenants served by the registry, whose content
+	// is isolated in distinct root directories of the storage.
+	Tenancy Tenancy `yaml:"tenancy,omitempty"`
 }
 
 // LogHook is composed of hook Level and Type.
@@ -267,6 +406,195 @@ type LogHook struct {
 	MailOptions MailOptions `yaml:"options,omitempty"`
 }
 
+// RateLimit configures the rate limits of the API requests.
+type RateLimit struct {
+	// Limits lists the token bucket limits applied to the requests. A
+	// request exceeding any of the limits it is subject to is rejected.
+	Limits []RateLimitRule `yaml:"limits,omitempty"`
+}
+
+// RateLimitRule configures a token bucket limit of the API requests.
+type RateLimitRule struct {
+	// Class restricts the limit to a class of requests: "pull", "push" or
+	// "catalog". The limit applies to all requests if empty.
+	Class string `yaml:"class,omitempty"`
+
+	// Key is what the requests are counted by: "ip", the client address,
+	// "user", the authenticated user or the address of anonymous clients,
+	// or "repository".
+	Key string `yaml:"key"`
+
+	// Rate is the number of requests allowed per second.
+	Rate float64 `yaml:"rate"`
+
+	// Burst is the number of requests allowed at once. Defaults to Rate,
+	// rounded up.
+	Burst int `yaml:"burst,omitempty"`
+}
+
+// Namespace configures the settings of the repositories whose name starts
+// with the name of the namespace, such as team-a/app for team-a.
+type Namespace struct {
+	// Name is the name of the namespace, a repository name prefix ending
+	// at a path component. The namespace also applies to the repository
+	// of the same name.
+	Name string `yaml:"name"`
+
+	NamespaceSettings `yaml:",inline"`
+}
+
+// NamespaceSettings are the settings of a namespace. Unset settings are
+// inherited from the parent namespaces.
+type NamespaceSettings struct {
+	// ImmutableTags rejects the pushes moving an existing tag to another
+	// manifest, and the deletion of tagged content.
+	ImmutableTags *bool `yaml:"immutabletags,omitempty"`
+
+	// Actions are the actions allowed on the repositories, among pull,
+	// push, delete and purge, whatever the access controller grants.
+	Actions []string `yaml:"actions,omitempty"`
+
+	// MaxBlobSize is the maximum size of the blobs uploaded to each
+	// repository, in bytes. Zero is unlimited.
+	MaxBlobSize *int64 `yaml:"maxblobsize,omitempty"`
+
+	// MaxTags is the maximum number of tags of each repository. Zero is
+	// unlimited.
+	MaxTags *int `yaml:"maxtags,omitempty"`
+
+	// Schema1Conversion overrides the conversion of the compatibility
+	// schema1 settings, "convert" or "reject".
+	Schema1Conversion string `yaml:"schema1conversion,omitempty"`
+}
+
+// Tenancy configures the tenants of the registry. The requests are served
+// from the root directory of the tenant named by the claim of their token,
+// or of the tenant whose prefix their repository name starts with, and from
+// the root directory of the storage otherwise.
+type Tenancy struct {
+	// Claim is the token claim naming the tenant of the client, if any.
+	Claim string `yaml:"claim,omitempty"`
+
+	// Tenants are the tenants of the registry.
+	Tenants []Tenant `yaml:"tenants,omitempty"`
+}
+
+// Tenant configures a tenant of the registry.
+type Tenant struct {
+	// Name is the name of the tenant, as set in the tenancy claim of the
+	// tokens.
+	Name string `yaml:"name"`
+
+	// Prefix is the repository name prefix, ending at a path component,
+	// of the repositories of the tenant. The tenant is then resolved from
+	// the repository name of the requests without a tenancy claim.
+	Prefix string `yaml:"prefix,omitempty"`
+
+	// RootDirectory is the directory of the storage holding the content of
+	// the tenant, outside of the root directory of the other tenants and of
+	// the content of the default tenant.
+	RootDirectory string `yaml:"rootdirectory"`
+}
+
+// Replication configures the mirroring of the manifests pushed to the
+// registry, along with the blobs they reference, to remote registries.
+type Replication struct {
+	// Remotes are the registries the pushed content is mirrored to.
+	Remotes []ReplicationRemote `yaml:"remotes,omitempty"`
+
+	// RetryInterval is the interval between attempts to mirror the pushes
+	// buffered while a remote registry is unreachable.
+	RetryInterval time.Duration `yaml:"retryinterval,omitempty"`
+}
+
+// ReplicationRemote configures a registry the pushed content is mirrored to.
+type ReplicationRemote struct {
+	// Name identifies the remote in the logs and the storage of its queue
+	// of pushes.
+	Name string `yaml:"name"`
+
+	// URL is the URL of the remote registry.
+	URL string `yaml:"url"`
+
+	// Username and Password authenticate with the remote registry.
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+
+	// Include are patterns of the repositories mirrored to the remote,
+	// either globs such as prod/*, or anchored regular expressions prefixed
+	// with regexp:. All repositories are mirrored if empty.
+	Include []string `yaml:"include,omitempty"`
+
+	// Exclude are patterns of the repositories not mirrored to the remote,
+	// even though they are included.
+	Exclude []string `yaml:"exclude,omitempty"`
+
+	// Disabled stops mirroring to the remote.
+	Disabled bool `yaml:"disabled,omitempty"`
+}
+
+// TokenServer configures the built-in token server, which issues the bearer
+// tokens of the token authentication to the users granted access by an ACL.
+type TokenServer struct {
+	// Enabled serves the token server along with the registry, on Path.
+	Enabled bool `yaml:"enabled,omitempty"`
+
+	// Path is the path of the token endpoint. Defaults to /auth/token.
+	Path string `yaml:"path,omitempty"`
+
+	// Addr is the address the token server listens on when run on its own,
+	// with the token-server command.
+	Addr string `yaml:"addr,omitempty"`
+
+	// Issuer is the issuer of the tokens, which must match the issuer of
+	// the token auth configuration.
+	Issuer string `yaml:"issuer"`
+
+	// Certificate and Key are the PEM files of the certificate and private
+	// key signing the tokens. The certificate must be part of the
+	// rootcertbundle of the token auth configuration.
+	Certificate string `yaml:"certificate"`
+	Key         string `yaml:"key"`
+
+	// Expiration is how long the tokens are valid for. Defaults to 5m.
+	Expiration time.Duration `yaml:"expiration,omitempty"`
+
+	// HTPasswd is the path of an htpasswd file of bcrypt hashed passwords.
+	HTPasswd string `yaml:"htpasswd,omitempty"`
+
+	// Users maps user names to their bcrypt hashed password.
+	Users map[string]string `yaml:"users,omitempty"`
+
+	// ACL is the path of the file of the access control list granting the
+	// users access to the repositories.
+	ACL string `yaml:"acl"`
+}
+
+// AuditLog configures the structured audit log of the API requests.
+type AuditLog struct {
+	// Enabled enables the audit log.
+	Enabled bool `yaml:"enabled,omitempty"`
+
+	// Sink is where the records are written: "stdout", "file" or "syslog".
+	// Defaults to stdout.
+	Sink string `yaml:"sink,omitempty"`
+
+	// Path is the file the records are appended to with the file sink.
+	Path string `yaml:"path,omitempty"`
+
+	// Syslog configures the syslog sink.
+	Syslog struct {
+		// Network and Address locate the syslog daemon, such as udp and
+		// localhost:514. The local daemon is used when unset.
+		Network string `yaml:"network,omitempty"`
+		Address string `yaml:"address,omitempty"`
+
+		// Tag is the tag of the syslog messages. Defaults to the process
+		// name.
+		Tag string `yaml:"tag,omitempty"`
+	} `yaml:"syslog,omitempty"`
+}
+
 // MailOptions provides the configuration sections to user, for specific handler.
 type MailOptions struct {
 	SMTP struct {
@@ -349,9 +677,35 @@ type Health struct {
 		// Threshold is the number of times a check must fail to trigger an
 		// unhealthy state
 		Threshold int `yaml:"threshold,omitempty"`
+		// Probe configures an active check writing, reading and deleting a
+		// canary object
+		Probe StorageDriverProbe `yaml:"probe,omitempty"`
 	} `yaml:"storagedriver,omitempty"`
 }
 
+// StorageDriverProbe configures a health check writing a canary object to
+// the storage driver, reading it back and deleting it.
+type StorageDriverProbe struct {
+	// Enabled turns on the probe
+	Enabled bool `yaml:"enabled,omitempty"`
+	// Directory is the path of the directory of the canary objects
+	Directory string `yaml:"directory,omitempty"`
+	// Interval is the duration in between probes
+	Interval time.Duration `yaml:"interval,omitempty"`
+	// Timeout is the duration a probe may take before it fails
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// Threshold is the number of times a probe must fail to trigger an
+	// unhealthy state
+	Threshold int `yaml:"threshold,omitempty"`
+}
+
+// AdminStats configures the background indexer computing the statistics
+// of the registry served by the admin routes.
+type AdminStats struct {
+	// Interval is the duration in between computations, one hour if zero
+	Interval time.Duration `yaml:"interval,omitempty"`
+}
+
 // v0_1Configuration is a Version 0.1 Configuration struct
 // This is currently aliased to Configuration, as it is the current version
 type v0_1Configuration Configuration
@@ -427,6 +781,12 @@ func (storage Storage) Type() string {
 			// allow configuration of delete
 		case "redirect":
 			// allow configuration of redirect
+		case "compression":
+			// allow configuration of pre-compressed blob variants
+		case "blobserver":
+			// allow configuration of the serving of blobs
+		case "lock":
+			// allow configuration of locking
 		default:
 			storageType = append(storageType, k)
 		}
@@ -468,6 +828,12 @@ func (storage *Storage) UnmarshalYAML(unmarshal func(interface{}) error) error {
 					// allow configuration of delete
 				case "redirect":
 					// allow configuration of redirect
+				case "compression":
+					// allow configuration of pre-compressed blob variants
+				case "blobserver":
+					// allow configuration of the serving of blobs
+				case "lock":
+					// allow configuration of locking
 				default:
 					types = append(types, k)
 				}
@@ -560,28 +926,283 @@ func (auth Auth) MarshalYAML() (interface{}, error) {
 	return map[string]Parameters(auth), nil
 }
 
+// HTTPTimeouts configures the timeouts of the client connections. Unset
+// timeouts are disabled.
+type HTTPTimeouts struct {
+	// ReadHeader is the time allowed to read the headers of a request.
+	ReadHeader time.Duration `yaml:"readheader,omitempty"`
+
+	// Read is the time allowed to read a whole request, including its body.
+	Read time.Duration `yaml:"read,omitempty"`
+
+	// Write is the time allowed to write a response, from the end of the
+	// headers of the request.
+	Write time.Duration `yaml:"write,omitempty"`
+
+	// Idle is the time a keep-alive connection waits for the next request.
+	// Defaults to Read.
+	Idle time.Duration `yaml:"idle,omitempty"`
+
+	// Classes overrides the read and write timeouts for a class of
+	// requests: "pull", "push" or "catalog". They do not apply to http2
+	// requests, which share their connection.
+	Classes map[string]HTTPClassTimeouts `yaml:"classes,omitempty"`
+}
+
+// HTTPClassTimeouts overrides the timeouts of a class of requests. Unset
+// timeouts are those of the connection.
+type HTTPClassTimeouts struct {
+	// Read is the time allowed to read the request, including its body,
+	// from the routing of the request.
+	Read time.Duration `yaml:"read,omitempty"`
+
+	// Write is the time allowed to write the response, from the routing of
+	// the request.
+	Write time.Duration `yaml:"write,omitempty"`
+}
+
+// HTTPLimits configures the limits of the client connections and requests.
+type HTTPLimits struct {
+	// MaxConnections is the number of client connections served at once.
+	// Further connections wait to be accepted. Unlimited if zero.
+	MaxConnections int `yaml:"maxconnections,omitempty"`
+
+	// MaxManifestSize is the maximum size, in bytes, of the body of a
+	// manifest PUT request. Defaults to 4MiB.
+	MaxManifestSize int64 `yaml:"maxmanifestsize,omitempty"`
+}
+
+// HTTPCompression configures the compression of the API responses, such as
+// manifests and tag lists, for the clients accepting it. Blobs are never
+// compressed.
+type HTTPCompression struct {
+	// Enabled compresses the API responses.
+	Enabled bool `yaml:"enabled,omitempty"`
+
+	// Encodings are the content codings of the compressed responses, gzip
+	// or zstd, in order of preference. Defaults to zstd and gzip.
+	Encodings []string `yaml:"encodings,omitempty"`
+
+	// MinSize is the size, in bytes, below which responses are sent
+	// uncompressed. Defaults to 1024.
+	MinSize int `yaml:"minsize,omitempty"`
+
+	// ContentTypes are the media types of the compressed responses, which
+	// may contain wildcards. Defaults to the JSON media types.
+	ContentTypes []string `yaml:"contenttypes,omitempty"`
+}
+
+// CacheControl configures the Cache-Control header set on blob responses.
+// Blobs are content addressable, so they are cached for a year by default.
+type CacheControl struct {
+	// MaxAge is the max-age directive. Defaults to one year when unset.
+	MaxAge time.Duration `yaml:"maxage,omitempty"`
+
+	// Immutable adds the immutable directive.
+	Immutable bool `yaml:"immutable,omitempty"`
+
+	// NoStore replaces all directives with no-store.
+	NoStore bool `yaml:"nostore,omitempty"`
+
+	// MediaTypes overrides the policy for blobs of the given media types.
+	MediaTypes map[string]CacheControlPolicy `yaml:"mediatypes,omitempty"`
+}
+
+// CacheControlPolicy configures the Cache-Control header set on responses
+// for blobs of a media type.
+type CacheControlPolicy struct {
+	// MaxAge is the max-age directive. Defaults to the registry wide
+	// max-age when unset.
+	MaxAge time.Duration `yaml:"maxage,omitempty"`
+
+	// Immutable adds the immutable directive.
+	Immutable bool `yaml:"immutable,omitempty"`
+
+	// NoStore replaces all directives with no-store.
+	NoStore bool `yaml:"nostore,omitempty"`
+}
+
 // Notifications configures multiple http endpoints.
 type Notifications struct {
 	// EventConfig is the configuration for the event format that is sent to each Endpoint.
 	EventConfig Events `yaml:"events,omitempty"`
-	// Endpoints is a list of http configurations for endpoints that
-	// respond to webhook notifications. In the future, we may allow other
-	// kinds of endpoints, such as external queues.
+	// Endpoints is a list of configurations for endpoints that respond to
+	// notifications, either http webhooks, Kafka topics or NATS subjects.
 	Endpoints []Endpoint `yaml:"endpoints,omitempty"`
+	// Stream configures the event stream served to the API clients.
+	Stream EventStream `yaml:"stream,omitempty"`
+}
+
+// EventStream configures the /v2/_events extension endpoint, which streams
+// the registry events to the API clients as server-sent events.
+type EventStream struct {
+	// Enabled serves the event stream.
+	Enabled bool `yaml:"enabled,omitempty"`
+
+	// Backlog is the number of events held for a client while they are
+	// being sent. The events received once it is full are dropped for the
+	// client. Defaults to 100.
+	Backlog int `yaml:"backlog,omitempty"`
+
+	// Heartbeat is the interval of the comments sent to the clients to keep
+	// their connection open while there are no events. Defaults to 30s.
+	Heartbeat time.Duration `yaml:"heartbeat,omitempty"`
 }
 
-// Endpoint describes the configuration of an http webhook notification
-// endpoint.
+// Endpoint describes the configuration of a notification endpoint, an http
+// webhook by default.
 type Endpoint struct {
-	Name              string        `yaml:"name"`              // identifies the endpoint in the registry instance.
-	Disabled          bool          `yaml:"disabled"`          // disables the endpoint
-	URL               string        `yaml:"url"`               // post url for the endpoint.
-	Headers           http.Header   `yaml:"headers"`           // static headers that should be added to all requests
-	Timeout           time.Duration `yaml:"timeout"`           // HTTP timeout
-	Threshold         int           `yaml:"threshold"`         // circuit breaker threshold before backing off on failure
-	Backoff           time.Duration `yaml:"backoff"`           // backoff duration
-	IgnoredMediaTypes []string      `yaml:"ignoredmediatypes"` // target media types to ignore
-	Ignore            Ignore        `yaml:"ignore"`            // ignore event types
+	Name              string        `yaml:"name"`                  // identifies the endpoint in the registry instance.
+	Disabled          bool          `yaml:"disabled"`              // disables the endpoint
+	Type              string        `yaml:"type,omitempty"`        // type of the endpoint, http, kafka or nats
+	URL               string        `yaml:"url"`                   // post url for the endpoint.
+	Headers           http.Header   `yaml:"headers"`               // static headers that should be added to all requests
+	Timeout           time.Duration `yaml:"timeout"`               // HTTP, Kafka produce or NATS publish timeout
+	Threshold         int           `yaml:"threshold"`             // circuit breaker threshold before backing off on failure
+	Backoff           time.Duration `yaml:"backoff"`               // backoff duration
+	MaxBackoff        time.Duration `yaml:"maxbackoff,omitempty"`  // enables exponential backoff up to this duration
+	MaxRetries        int           `yaml:"maxretries,omitempty"`  // retries before giving up on an event
+	DeadLetter        DeadLetter    `yaml:"deadletter,omitempty"`  // receives the events given up on
+	IgnoredMediaTypes []string      `yaml:"ignoredmediatypes"`     // target media types to ignore
+	Ignore            Ignore        `yaml:"ignore"`                // ignore event types
+	Filter            Filter        `yaml:"filter,omitempty"`      // select published events
+	Kafka             KafkaEndpoint `yaml:"kafka,omitempty"`       // configures kafka endpoints
+	Nats              NatsEndpoint  `yaml:"nats,omitempty"`        // configures nats endpoints
+	Format            string        `yaml:"format,omitempty"`      // format of the events, envelope or cloudevents
+	CloudEvents       CloudEvents   `yaml:"cloudevents,omitempty"` // configures the cloudevents format
+	Signing           Signing       `yaml:"signing,omitempty"`     // signs the payloads of http endpoints
+	Include           EventInclude  `yaml:"include,omitempty"`     // details of the pushed manifests included in events
+}
+
+// EventInclude configures the details of the pushed manifests included in
+// the push events published to an endpoint, so that its consumers need not
+// fetch them from the registry.
+type EventInclude struct {
+	// Payload includes the body of the pushed manifests.
+	Payload bool `yaml:"payload,omitempty"`
+
+	// Platforms includes the manifests referenced by the pushed image
+	// indexes, with their platform.
+	Platforms bool `yaml:"platforms,omitempty"`
+}
+
+// Signing configures the signature of the payloads posted to HTTP endpoints,
+// with which the receivers authenticate the events.
+type Signing struct {
+	// Secret is the key of the HMAC-SHA256 signature of the payloads. The
+	// payloads are not signed if it is empty.
+	Secret string `yaml:"secret,omitempty"`
+
+	// Header is the header carrying the signature, X-Registry-Signature-256
+	// by default.
+	Header string `yaml:"header,omitempty"`
+}
+
+// CloudEvents configures the notification endpoints publishing events in the
+// CloudEvents 1.0 format.
+type CloudEvents struct {
+	// Mode is either structured, the default, where the event and its
+	// attributes are encoded together in the body of the message, or binary,
+	// where the attributes are carried by the headers of the message and the
+	// body holds the event alone.
+	Mode string `yaml:"mode,omitempty"`
+
+	// Source overrides the source attribute of the events, which is
+	// otherwise derived from the host the registry is accessed with.
+	Source string `yaml:"source,omitempty"`
+}
+
+// DeadLetter configures where the events a notification endpoint gave up on
+// are written, so that they are not lost. At most one of File and URL may be
+// set.
+type DeadLetter struct {
+	// File is the path of a file the events are appended to, one envelope
+	// per line.
+	File string `yaml:"file,omitempty"`
+
+	// URL is a secondary endpoint the events are posted to, once.
+	URL string `yaml:"url,omitempty"`
+
+	// Headers are added to the requests posted to URL.
+	Headers http.Header `yaml:"headers,omitempty"`
+}
+
+// KafkaEndpoint configures a notification endpoint producing events to a
+// Kafka topic.
+type KafkaEndpoint struct {
+	// Brokers lists the addresses of the brokers used to bootstrap the
+	// connection to the cluster.
+	Brokers []string `yaml:"brokers"`
+
+	// Topic is the topic events are produced to.
+	Topic string `yaml:"topic"`
+
+	// PartitionKey selects the key of the produced messages, which
+	// determines their partition. It is either repository, the default,
+	// so that the events of a repository are ordered, or none.
+	PartitionKey string `yaml:"partitionkey,omitempty"`
+
+	// TLS configures the connection to the brokers.
+	TLS EndpointTLS `yaml:"tls,omitempty"`
+
+	// SASL configures the authentication to the brokers.
+	SASL struct {
+		// Mechanism is one of plain, scram-sha-256 or scram-sha-512.
+		Mechanism string `yaml:"mechanism,omitempty"`
+		Username  string `yaml:"username,omitempty"`
+		Password  string `yaml:"password,omitempty"`
+	} `yaml:"sasl,omitempty"`
+}
+
+// NatsEndpoint configures a notification endpoint publishing events to NATS
+// subjects, optionally stored by a JetStream stream.
+type NatsEndpoint struct {
+	// URLs lists the addresses of the servers, such as nats://host:4222,
+	// tried in order until one accepts the connection.
+	URLs []string `yaml:"urls"`
+
+	// Subject is the template of the subject events are published to, such
+	// as registry.{{.Action}}.{{.Repository}}. The slashes of the repository
+	// name are replaced by dots.
+	Subject string `yaml:"subject"`
+
+	// JetStream waits for the acknowledgement of the stream storing the
+	// subject, so that events are only considered delivered once stored.
+	JetStream bool `yaml:"jetstream,omitempty"`
+
+	// Stream is the name of the stream expected to store the events, if
+	// set, with JetStream.
+	Stream string `yaml:"stream,omitempty"`
+
+	// TLS configures the connection to the servers, which is also upgraded
+	// to TLS when the server requires it.
+	TLS EndpointTLS `yaml:"tls,omitempty"`
+
+	// Username and Password, or Token, authenticate to the servers.
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	Token    string `yaml:"token,omitempty"`
+
+	// Credentials is the path of a credentials file holding the JWT and the
+	// NKey seed of the user, for servers using decentralized authentication.
+	Credentials string `yaml:"credentials,omitempty"`
+}
+
+// EndpointTLS configures the TLS connections of the notification endpoints
+// to their brokers or servers.
+type EndpointTLS struct {
+	Enabled bool `yaml:"enabled,omitempty"`
+
+	// CA is the path of the PEM encoded certificate authority used to
+	// verify the servers, the system roots are used otherwise.
+	CA string `yaml:"ca,omitempty"`
+
+	// Certificate and Key are the paths of the PEM encoded client
+	// certificate and key, for servers requiring client authentication.
+	Certificate string `yaml:"certificate,omitempty"`
+	Key         string `yaml:"key,omitempty"`
+
+	InsecureSkipVerify bool `yaml:"insecureskipverify,omitempty"`
 }
 
 // Events configures notification events.
@@ -589,12 +1210,112 @@ type Events struct {
 	IncludeReferences bool `yaml:"includereferences"` // include reference data in manifest events
 }
 
-//Ignore configures mediaTypes and actions of the event, that it won't be propagated
+// Ignore configures mediaTypes and actions of the event, that it won't be propagated
 type Ignore struct {
 	MediaTypes []string `yaml:"mediatypes"` // target media types to ignore
 	Actions    []string `yaml:"actions"`    // ignore action types
 }
 
+// RegexpPatternPrefix prefixes the repository patterns of a Filter which are
+// regular expressions rather than globs.
+const RegexpPatternPrefix = "regexp:"
+
+// Filter selects the events published to an endpoint. An event is published
+// if it matches each of the set criteria.
+type Filter struct {
+	// Repositories are patterns of the repositories, either globs such as
+	// prod/*, or anchored regular expressions prefixed with regexp:.
+	Repositories []string `yaml:"repositories,omitempty"`
+	Actions      []string `yaml:"actions,omitempty"`    // actions to publish
+	MediaTypes   []string `yaml:"mediatypes,omitempty"` // target media types to publish
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface
+// Unmarshals a Filter, validating its repository patterns
+func (filter *Filter) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plainFilter Filter
+	var f plainFilter
+	if err := unmarshal(&f); err != nil {
+		return err
+	}
+
+	for _, pattern := range f.Repositories {
+		if err := ValidateRepositoryPattern(pattern); err != nil {
+			return err
+		}
+	}
+
+	*filter = Filter(f)
+	return nil
+}
+
+// ValidateRepositoryPattern returns an error if pattern is neither a valid
+// glob nor a valid regular expression prefixed with regexp:.
+func ValidateRepositoryPattern(pattern string) error {
+	_, err := NewRepositoryMatcher(pattern)
+	return err
+}
+
+// RepositoryMatcher matches names against a repository pattern, either a
+// glob such as prod/*, or an anchored regular expression prefixed with
+// regexp:, compiled once.
+type RepositoryMatcher struct {
+	glob string
+	re   *regexp.Regexp
+}
+
+// NewRepositoryMatcher compiles the repository pattern.
+func NewRepositoryMatcher(pattern string) (*RepositoryMatcher, error) {
+	if !strings.HasPrefix(pattern, RegexpPatternPrefix) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid repository pattern %q: %v", pattern, err)
+		}
+		return &RepositoryMatcher{glob: pattern}, nil
+	}
+
+	re, err := regexp.Compile("^(?:" + strings.TrimPrefix(pattern, RegexpPatternPrefix) + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid repository pattern %q: %v", pattern, err)
+	}
+	return &RepositoryMatcher{re: re}, nil
+}
+
+// Match returns whether the name matches the pattern.
+func (m *RepositoryMatcher) Match(name string) bool {
+	if m.re != nil {
+		return m.re.MatchString(name)
+	}
+	ok, _ := path.Match(m.glob, name)
+	return ok
+}
+
+// RepositoryMatchers match names against any of a list of repository
+// patterns.
+type RepositoryMatchers []*RepositoryMatcher
+
+// NewRepositoryMatchers compiles the repository patterns.
+func NewRepositoryMatchers(patterns []string) (RepositoryMatchers, error) {
+	matchers := make(RepositoryMatchers, 0, len(patterns))
+	for _, pattern := range patterns {
+		m, err := NewRepositoryMatcher(pattern)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+	return matchers, nil
+}
+
+// MatchAny returns whether the name matches any of the patterns.
+func (ms RepositoryMatchers) MatchAny(name string) bool {
+	for _, m := range ms {
+		if m.Match(name) {
+			return true
+		}
+	}
+	return false
+}
+
 // Reporting defines error reporting methods.
 type Reporting struct {
 	// Bugsnag configures error reporting for Bugsnag (bugsnag.com).
@@ -624,6 +1345,26 @@ type NewRelicReporting struct {
 	Verbose bool `yaml:"verbose,omitempty"`
 }
 
+// Tracing configures the export of OpenTelemetry traces to an OTLP
+// collector. Tracing is disabled unless an endpoint is set.
+type Tracing struct {
+	// Endpoint is the host and port of the collector receiving traces over
+	// OTLP/HTTP, such as localhost:4318.
+	Endpoint string `yaml:"endpoint,omitempty"`
+	// Insecure disables TLS when connecting to the collector.
+	Insecure bool `yaml:"insecure,omitempty"`
+	// Headers are sent along with every export request, for instance to
+	// authenticate against the collector.
+	Headers map[string]string `yaml:"headers,omitempty"`
+	// ServiceName is the name of the service the spans are reported for.
+	// Defaults to registry.
+	ServiceName string `yaml:"servicename,omitempty"`
+	// SamplingRatio is the fraction of the traces started by the registry
+	// to sample, between 0 and 1. Requests that are part of a trace sampled
+	// by the caller are always sampled. Defaults to 1 when unset.
+	SamplingRatio float64 `yaml:"samplingratio,omitempty"`
+}
+
 // Middleware configures named middlewares to be applied at injection points.
 type Middleware struct {
 	// Name the middleware registers itself as
@@ -634,9 +1375,20 @@ type Middleware struct {
 	Options Parameters `yaml:"options"`
 }
 
+// ManifestValidator configures a manifest validator
+type ManifestValidator struct {
+	// Name the validator registers itself as
+	Name string `yaml:"name"`
+	// Flag to disable the validator easily
+	Disabled bool `yaml:"disabled,omitempty"`
+	// Map of parameters that will be passed to the validator's initialization function
+	Options Parameters `yaml:"options"`
+}
+
 // Proxy configures the registry as a pull through cache
 type Proxy struct {
-	// RemoteURL is the URL of the remote registry
+	// RemoteURL is the URL of the remote registry, serving the repositories
+	// none of the Remotes is routed
 	RemoteURL string `yaml:"remoteurl"`
 
 	// Username of the hub user
@@ -644,6 +1396,117 @@ type Proxy struct {
 
 	// Password of the hub user
 	Password string `yaml:"password"`
+
+	// Remotes are remote registries the repositories are routed to by the
+	// prefix of their name, in order.
+	Remotes []ProxyRemote `yaml:"remotes,omitempty"`
+
+	// PushThrough configures the forwarding of the content pushed to the
+	// cache to the remote registry
+	PushThrough PushThrough `yaml:"pushthrough,omitempty"`
+
+	// MaxSize is the number of bytes of cached content above which the
+	// least recently pulled blobs and manifests are evicted before their
+	// TTL expires. 0 disables the limit.
+	MaxSize int64 `yaml:"maxsize,omitempty"`
+
+	// NegativeCacheTTL is how long the manifests and tags the remote
+	// registry did not find are reported as unknown without requesting it
+	// again. 0 disables the negative cache.
+	NegativeCacheTTL time.Duration `yaml:"negativecachettl,omitempty"`
+}
+
+// Enabled returns whether the registry is configured as a pull through
+// cache.
+func (proxy Proxy) Enabled() bool {
+	return proxy.RemoteURL != "" || len(proxy.Remotes) > 0
+}
+
+// HTTPClient configures the outbound HTTP connections of the registry. The
+// unset settings keep the values of the default Go transport.
+type HTTPClient struct {
+	// Dialer configures how connections are established.
+	Dialer struct {
+		// Network restricts the connections to IPv4 with tcp4, or to IPv6
+		// with tcp6. Defaults to tcp, using both.
+		Network string `yaml:"network,omitempty"`
+
+		// FallbackDelay is how long an IPv6 connection to a dual-stack host
+		// is attempted before falling back to IPv4. A negative delay
+		// disables the fallback.
+		FallbackDelay time.Duration `yaml:"fallbackdelay,omitempty"`
+
+		// Timeout is the maximum time to establish a connection.
+		Timeout time.Duration `yaml:"timeout,omitempty"`
+
+		// KeepAlive is the interval of the TCP keep-alive probes.
+		KeepAlive time.Duration `yaml:"keepalive,omitempty"`
+	} `yaml:"dialer,omitempty"`
+
+	// Proxy is the URL of the HTTP proxy the requests go through. Defaults
+	// to the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+	Proxy string `yaml:"proxy,omitempty"`
+
+	// TLS configures the TLS connections.
+	TLS struct {
+		// RootCAs are the files of the CA bundles trusted along with the
+		// ones of the system.
+		RootCAs []string `yaml:"rootcas,omitempty"`
+
+		// MinimumTLS is the minimum TLS version, tls1.2 or tls1.3.
+		MinimumTLS string `yaml:"minimumtls,omitempty"`
+	} `yaml:"tls,omitempty"`
+
+	// TLSHandshakeTimeout is the maximum time of the TLS handshakes.
+	TLSHandshakeTimeout time.Duration `yaml:"tlshandshaketimeout,omitempty"`
+
+	// ResponseHeaderTimeout is the maximum time to wait for the headers of
+	// a response once the request is written.
+	ResponseHeaderTimeout time.Duration `yaml:"responseheadertimeout,omitempty"`
+
+	// IdleConnTimeout is how long idle connections are kept open.
+	IdleConnTimeout time.Duration `yaml:"idleconntimeout,omitempty"`
+}
+
+// ProxyRemote configures a remote registry of a pull through cache, serving
+// the repositories of a prefix.
+type ProxyRemote struct {
+	// Prefix routes the repositories whose name starts with the prefix
+	// followed by a slash to the remote, such as docker.io for
+	// docker.io/library/nginx. The prefix is removed from the name of the
+	// repositories on the remote.
+	Prefix string `yaml:"prefix"`
+
+	// RemoteURL is the URL of the remote registry
+	RemoteURL string `yaml:"remoteurl"`
+
+	// Username and Password authenticate with the remote registry
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+}
+
+// Catalog configures the catalog API
+type Catalog struct {
+	// Index maintains an index of the repositories, which the catalog API
+	// lists instead of walking the storage
+	Index CatalogIndex `yaml:"index,omitempty"`
+}
+
+// CatalogIndex configures the index of the repositories
+type CatalogIndex struct {
+	// Enabled maintains the index
+	Enabled bool `yaml:"enabled,omitempty"`
+}
+
+// PushThrough configures a pull through cache to accept pushes, which are
+// stored locally and forwarded to the remote registry
+type PushThrough struct {
+	// Enabled accepts pushes to the cache
+	Enabled bool `yaml:"enabled,omitempty"`
+
+	// RetryInterval is the interval between attempts to forward the pushes
+	// buffered while the remote registry is unreachable
+	RetryInterval time.Duration `yaml:"retryinterval,omitempty"`
 }
 
 // Parse parses an input configuration yaml document into a Configuration struct
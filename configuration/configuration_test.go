@@ -2,6 +2,7 @@ package configuration
 
 import (
 	"bytes"
+	"fmt"
 	"net/http"
 	"os"
 	"reflect"
@@ -23,6 +24,7 @@ var configStruct = Configuration{
 		AccessLog struct {
 			Disabled bool `yaml:"disabled,omitempty"`
 		} `yaml:"accesslog,omitempty"`
+		AuditLog  AuditLog               `yaml:"auditlog,omitempty"`
 		Level     Loglevel               `yaml:"level,omitempty"`
 		Formatter string                 `yaml:"formatter,omitempty"`
 		Fields    map[string]interface{} `yaml:"fields,omitempty"`
@@ -71,14 +73,15 @@ var configStruct = Configuration{
 		},
 	},
 	HTTP: struct {
-		Addr         string        `yaml:"addr,omitempty"`
-		Net          string        `yaml:"net,omitempty"`
-		Host         string        `yaml:"host,omitempty"`
-		Prefix       string        `yaml:"prefix,omitempty"`
-		Secret       string        `yaml:"secret,omitempty"`
-		RelativeURLs bool          `yaml:"relativeurls,omitempty"`
-		DrainTimeout time.Duration `yaml:"draintimeout,omitempty"`
-		TLS          struct {
+		Addr           string        `yaml:"addr,omitempty"`
+		Net            string        `yaml:"net,omitempty"`
+		Host           string        `yaml:"host,omitempty"`
+		Prefix         string        `yaml:"prefix,omitempty"`
+		Secret         string        `yaml:"secret,omitempty"`
+		RelativeURLs   bool          `yaml:"relativeurls,omitempty"`
+		DrainTimeout   time.Duration `yaml:"draintimeout,omitempty"`
+		TrustedProxies []string      `yaml:"trustedproxies,omitempty"`
+		TLS            struct {
 			Certificate  string   `yaml:"certificate,omitempty"`
 			Key          string   `yaml:"key,omitempty"`
 			ClientCAs    []string `yaml:"clientcas,omitempty"`
@@ -98,8 +101,17 @@ var configStruct = Configuration{
 				Path    string `yaml:"path,omitempty"`
 			} `yaml:"prometheus,omitempty"`
 		} `yaml:"debug,omitempty"`
-		HTTP2 struct {
-			Disabled bool `yaml:"disabled,omitempty"`
+		Admin struct {
+			Enabled bool       `yaml:"enabled,omitempty"`
+			Stats   AdminStats `yaml:"stats,omitempty"`
+		} `yaml:"admin,omitempty"`
+		CacheControl CacheControl    `yaml:"cachecontrol,omitempty"`
+		Timeouts     HTTPTimeouts    `yaml:"timeouts,omitempty"`
+		Limits       HTTPLimits      `yaml:"limits,omitempty"`
+		Compression  HTTPCompression `yaml:"compression,omitempty"`
+		HTTP2        struct {
+			Disabled             bool   `yaml:"disabled,omitempty"`
+			MaxConcurrentStreams uint32 `yaml:"maxconcurrentstreams,omitempty"`
 		} `yaml:"http2,omitempty"`
 	}{
 		TLS: struct {
@@ -120,7 +132,8 @@ var configStruct = Configuration{
 			"X-Content-Type-Options": []string{"nosniff"},
 		},
 		HTTP2: struct {
-			Disabled bool `yaml:"disabled,omitempty"`
+			Disabled             bool   `yaml:"disabled,omitempty"`
+			MaxConcurrentStreams uint32 `yaml:"maxconcurrentstreams,omitempty"`
 		}{
 			Disabled: false,
 		},
@@ -242,6 +255,57 @@ func (suite *ConfigSuite) TestParseInmemory(c *C) {
 	c.Assert(config, DeepEquals, suite.expectedConfig)
 }
 
+// TestParseCacheControl validates that the blob Cache-Control configuration
+// can be parsed, including media type overrides
+func (suite *ConfigSuite) TestParseCacheControl(c *C) {
+	yml := `
+version: 0.1
+storage: inmemory
+http:
+  cachecontrol:
+    maxage: 24h
+    immutable: true
+    mediatypes:
+      application/octet-stream:
+        nostore: true
+`
+	config, err := Parse(bytes.NewReader([]byte(yml)))
+	c.Assert(err, IsNil)
+	c.Assert(config.HTTP.CacheControl, DeepEquals, CacheControl{
+		MaxAge:    24 * time.Hour,
+		Immutable: true,
+		MediaTypes: map[string]CacheControlPolicy{
+			"application/octet-stream": {NoStore: true},
+		},
+	})
+}
+
+// TestParseRedisSentinel validates that a redis Sentinel configuration can be
+// parsed
+func (suite *ConfigSuite) TestParseRedisSentinel(c *C) {
+	yml := `
+version: 0.1
+storage: inmemory
+redis:
+  addrs: [sentinel1:26379, sentinel2:26379]
+  mastername: mymaster
+  username: user
+  password: secret
+  sentinelpassword: sentinelsecret
+  tls:
+    enabled: true
+`
+	config, err := Parse(bytes.NewReader([]byte(yml)))
+	c.Assert(err, IsNil)
+	c.Assert(config.Redis.Addrs, DeepEquals, []string{"sentinel1:26379", "sentinel2:26379"})
+	c.Assert(config.Redis.MasterName, Equals, "mymaster")
+	c.Assert(config.Redis.Username, Equals, "user")
+	c.Assert(config.Redis.Password, Equals, "secret")
+	c.Assert(config.Redis.SentinelPassword, Equals, "sentinelsecret")
+	c.Assert(config.Redis.TLS.Enabled, Equals, true)
+	c.Assert(config.Redis.Cluster, Equals, false)
+}
+
 // TestParseIncomplete validates that an incomplete yaml configuration cannot
 // be parsed without providing environment variables to fill in the missing
 // components.
@@ -363,6 +427,36 @@ func (suite *ConfigSuite) TestParseInvalidLoglevel(c *C) {
 
 }
 
+// TestParseInvalidFilter validates that the parser will fail to parse a
+// configuration if a repository pattern of an endpoint filter is malformed
+func (suite *ConfigSuite) TestParseInvalidFilter(c *C) {
+	configYaml := "version: 0.1\nstorage: inmemory\nnotifications:\n  endpoints:\n    - name: prod\n      filter:\n        repositories: [%s]\n"
+
+	config, err := Parse(bytes.NewReader([]byte(fmt.Sprintf(configYaml, `"prod/*", "regexp:^team-[a-z]+/.*$"`))))
+	c.Assert(err, IsNil)
+	c.Assert(config.Notifications.Endpoints[0].Filter.Repositories, DeepEquals, []string{"prod/*", "regexp:^team-[a-z]+/.*$"})
+
+	_, err = Parse(bytes.NewReader([]byte(fmt.Sprintf(configYaml, `"prod/["`))))
+	c.Assert(err, NotNil)
+
+	_, err = Parse(bytes.NewReader([]byte(fmt.Sprintf(configYaml, `"regexp:prod/("`))))
+	c.Assert(err, NotNil)
+}
+
+// TestRepositoryMatchers validates that the repository patterns match
+// the names with globs, or anchored regular expressions
+func (suite *ConfigSuite) TestRepositoryMatchers(c *C) {
+	matchers, err := NewRepositoryMatchers([]string{"prod/*", "regexp:team-[a-z]+/.*"})
+	c.Assert(err, IsNil)
+	c.Assert(matchers.MatchAny("prod/app"), Equals, true)
+	c.Assert(matchers.MatchAny("prod/app/sub"), Equals, false)
+	c.Assert(matchers.MatchAny("team-a/app/sub"), Equals, true)
+	c.Assert(matchers.MatchAny("other/team-a/app"), Equals, false)
+
+	_, err = NewRepositoryMatchers([]string{"prod/*", "regexp:prod/("})
+	c.Assert(err, NotNil)
+}
+
 // TestParseWithDifferentEnvReporting validates that environment variables
 // properly override reporting parameters
 func (suite *ConfigSuite) TestParseWithDifferentEnvReporting(c *C) {
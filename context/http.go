@@ -64,6 +64,33 @@ func RemoteIP(r *http.Request) string {
 	return addr
 }
 
+type clientIPKey struct{}
+
+// WithClientIP places the IP address of the client of the request on the
+// context. It is the address resolved by the application, which only reads
+// the proxy headers sent by the proxies it trusts.
+func WithClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, clientIPKey{}, ip)
+}
+
+// ClientIP returns the IP address of the client placed on the context with
+// WithClientIP. Without one, it is the address of the peer of the request in
+// the context: unlike RemoteIP, it never trusts the proxy headers, which any
+// client may set.
+func ClientIP(ctx context.Context) string {
+	if ip, ok := ctx.Value(clientIPKey{}).(string); ok && ip != "" {
+		return ip
+	}
+	r, err := GetRequest(ctx)
+	if err != nil {
+		return ""
+	}
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return ip
+	}
+	return r.RemoteAddr
+}
+
 // WithRequest places the request on the context. The context of the request
 // is assigned a unique id, available at "http.request.id". The request itself
 // is available at "http.request". Other common attributes are available under
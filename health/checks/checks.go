@@ -1,6 +1,9 @@
 package checks
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
 	"errors"
 	"fmt"
 	"net"
@@ -11,6 +14,7 @@ import (
 	"time"
 
 	"github.com/distribution/distribution/v3/health"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
 )
 
 // FileChecker checks the existence of a file and returns an error
@@ -71,3 +75,36 @@ func TCPChecker(addr string, timeout time.Duration) health.Checker {
 		return nil
 	})
 }
+
+// StorageDriverChecker writes a canary object with random content at path,
+// reads it back and deletes it, failing if any of these operations fails or
+// takes longer than timeout.
+func StorageDriverChecker(ctx context.Context, driver storagedriver.StorageDriver, path string, timeout time.Duration) health.Checker {
+	return health.CheckFunc(func() error {
+		checkCtx := ctx
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			checkCtx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
+		content := make([]byte, 64)
+		if _, err := rand.Read(content); err != nil {
+			return err
+		}
+		if err := driver.PutContent(checkCtx, path, content); err != nil {
+			return fmt.Errorf("failed to write canary object %s: %v", path, err)
+		}
+		read, err := driver.GetContent(checkCtx, path)
+		if err != nil {
+			return fmt.Errorf("failed to read canary object %s: %v", path, err)
+		}
+		if !bytes.Equal(read, content) {
+			return fmt.Errorf("canary object %s was read with unexpected content", path)
+		}
+		if err := driver.Delete(checkCtx, path); err != nil {
+			return fmt.Errorf("failed to delete canary object %s: %v", path, err)
+		}
+		return nil
+	})
+}
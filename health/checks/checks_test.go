@@ -1,7 +1,13 @@
 package checks
 
 import (
+	"context"
+	"errors"
 	"testing"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
 )
 
 func TestFileChecker(t *testing.T) {
@@ -23,3 +29,47 @@ func TestHTTPChecker(t *testing.T) {
 		t.Errorf("Google at Portugal was expected as exists, error:%v", err)
 	}
 }
+
+type readOnlyDriver struct {
+	storagedriver.StorageDriver
+}
+
+func (d readOnlyDriver) PutContent(ctx context.Context, path string, content []byte) error {
+	return errors.New("read-only")
+}
+
+// contextDriver fails the writes made with a done context.
+type contextDriver struct {
+	storagedriver.StorageDriver
+}
+
+func (d contextDriver) PutContent(ctx context.Context, path string, content []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return d.StorageDriver.PutContent(ctx, path, content)
+}
+
+func TestStorageDriverChecker(t *testing.T) {
+	ctx := context.Background()
+	driver := inmemory.New()
+
+	if err := StorageDriverChecker(ctx, driver, "/health/canary", time.Second).Check(); err != nil {
+		t.Errorf("unexpected error probing the storage driver: %v", err)
+	}
+	if _, err := driver.Stat(ctx, "/health/canary"); err == nil {
+		t.Errorf("expected the canary object to be deleted")
+	}
+
+	if err := StorageDriverChecker(ctx, readOnlyDriver{driver}, "/health/canary", time.Second).Check(); err == nil {
+		t.Errorf("expected an error probing a read-only storage driver")
+	}
+
+	// the timeout of a check does not carry over to the next ones
+	checker := StorageDriverChecker(ctx, contextDriver{driver}, "/health/canary", time.Second)
+	for i := 0; i < 2; i++ {
+		if err := checker.Check(); err != nil {
+			t.Errorf("unexpected error probing the storage driver, check %d: %v", i, err)
+		}
+	}
+}
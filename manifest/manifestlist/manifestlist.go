@@ -119,8 +119,18 @@ type ManifestDescriptor struct {
 type ManifestList struct {
 	manifest.Versioned
 
+	// ArtifactType is the IANA media type of the artifact this OCI index
+	// describes.
+	ArtifactType string `json:"artifactType,omitempty"`
+
 	// Manifests references a list of manifests
 	Manifests []ManifestDescriptor `json:"manifests"`
+
+	// Subject references another manifest this OCI index refers to.
+	Subject *distribution.Descriptor `json:"subject,omitempty"`
+
+	// Annotations contains arbitrary metadata for the OCI index.
+	Annotations map[string]string `json:"annotations,omitempty"`
 }
 
 // References returns the distribution descriptors for the referenced image
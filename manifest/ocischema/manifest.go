@@ -44,6 +44,10 @@ func init() {
 type Manifest struct {
 	manifest.Versioned
 
+	// ArtifactType is the IANA media type of the artifact this manifest
+	// describes, when it differs from the config media type.
+	ArtifactType string `json:"artifactType,omitempty"`
+
 	// Config references the image configuration as a blob.
 	Config distribution.Descriptor `json:"config"`
 
@@ -51,6 +55,10 @@ type Manifest struct {
 	// configuration.
 	Layers []distribution.Descriptor `json:"layers"`
 
+	// Subject references another manifest this manifest refers to, such as
+	// the image a signature or SBOM is attached to.
+	Subject *distribution.Descriptor `json:"subject,omitempty"`
+
 	// Annotations contains arbitrary metadata for the image manifest.
 	Annotations map[string]string `json:"annotations,omitempty"`
 }
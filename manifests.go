@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"mime"
+	"time"
 
 	"github.com/opencontainers/go-digest"
 )
@@ -69,6 +70,33 @@ type ManifestEnumerator interface {
 	Enumerate(ctx context.Context, ingester func(digest.Digest) error) error
 }
 
+// ManifestReferrers enables listing the manifests which declare a given
+// manifest as their subject
+type ManifestReferrers interface {
+	// Referrers returns the descriptors of the manifests referring to
+	// subject. If artifactType is not empty, only referrers of that
+	// artifact type are returned.
+	Referrers(ctx context.Context, subject digest.Digest, artifactType string) ([]Descriptor, error)
+}
+
+// UntaggedManifest is a manifest of a repository which no tag references.
+type UntaggedManifest struct {
+	Digest    digest.Digest `json:"digest"`
+	MediaType string        `json:"mediaType,omitempty"`
+	// Subject is the digest of the subject manifest of a referrer.
+	Subject digest.Digest `json:"subject,omitempty"`
+	// Created is the time the manifest was pushed.
+	Created time.Time `json:"created"`
+}
+
+// UntaggedManifestLister enables listing the manifests which no tag
+// references
+type UntaggedManifestLister interface {
+	// Untagged returns the manifests which are neither tagged nor
+	// referenced by a tagged manifest, in the order of their digests.
+	Untagged(ctx context.Context) ([]UntaggedManifest, error)
+}
+
 // Describable is an interface for descriptors
 type Describable interface {
 	Descriptor() Descriptor
@@ -61,6 +61,7 @@ func (b *bridge) ManifestPushed(repo reference.Named, sm distribution.Manifest,
 	if err != nil {
 		return err
 	}
+	manifestEvent.manifest = sm
 
 	for _, option := range options {
 		if opt, ok := option.(distribution.WithTagOption); ok {
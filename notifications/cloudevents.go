@@ -0,0 +1,168 @@
+package notifications
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	events "github.com/docker/go-events"
+)
+
+// Formats of the events published to an endpoint.
+const (
+	FormatEnvelope    = "envelope"
+	FormatCloudEvents = "cloudevents"
+)
+
+// Modes of the CloudEvents format.
+const (
+	CloudEventsModeStructured = "structured"
+	CloudEventsModeBinary     = "binary"
+)
+
+const (
+	// CloudEventsMediaType is the media type of the events in the
+	// structured mode of the CloudEvents format.
+	CloudEventsMediaType = "application/cloudevents+json"
+
+	// CloudEventsTypePrefix prefixes the action of an event to form the
+	// type of the CloudEvent, such as io.github.distribution.push.
+	CloudEventsTypePrefix = "io.github.distribution."
+
+	cloudEventsSpecVersion = "1.0"
+)
+
+// CloudEvent is an event in the CloudEvents 1.0 format, as encoded in the
+// structured mode. The registry event is the data of the CloudEvent.
+type CloudEvent struct {
+	SpecVersion     string    `json:"specversion"`
+	ID              string    `json:"id"`
+	Source          string    `json:"source"`
+	Type            string    `json:"type"`
+	Subject         string    `json:"subject,omitempty"`
+	Time            time.Time `json:"time"`
+	DataContentType string    `json:"datacontenttype"`
+	Data            Event     `json:"data"`
+}
+
+// CheckFormat returns an error if format, with the CloudEvents config if it
+// applies, is not a supported format of the events of an endpoint.
+func CheckFormat(format string, config configuration.CloudEvents) error {
+	switch format {
+	case "", FormatEnvelope:
+		return nil
+	case FormatCloudEvents:
+	default:
+		return fmt.Errorf("unsupported event format %q", format)
+	}
+
+	switch config.Mode {
+	case "", CloudEventsModeStructured, CloudEventsModeBinary:
+		return nil
+	}
+	return fmt.Errorf("unsupported cloudevents mode %q", config.Mode)
+}
+
+// cloudEventsEncoder encodes events in the CloudEvents format.
+type cloudEventsEncoder struct {
+	binary bool
+	source string
+}
+
+// newCloudEventsEncoder returns the encoder of the events of an endpoint
+// configured with format, or nil if it uses the envelope format.
+func newCloudEventsEncoder(format string, config configuration.CloudEvents) *cloudEventsEncoder {
+	if format != FormatCloudEvents {
+		return nil
+	}
+	return &cloudEventsEncoder{
+		binary: config.Mode == CloudEventsModeBinary,
+		source: config.Source,
+	}
+}
+
+// cloudEventMessage is an event encoded in the CloudEvents format. The
+// attributes are only set in binary mode, and are carried by the headers of
+// the message, which the protocol bindings prefix with ce- or ce_.
+type cloudEventMessage struct {
+	contentType string
+	attributes  map[string]string
+	body        []byte
+}
+
+func (ce *cloudEventsEncoder) encode(event events.Event) (cloudEventMessage, error) {
+	e, ok := event.(Event)
+	if !ok {
+		return cloudEventMessage{}, fmt.Errorf("unsupported event %T", event)
+	}
+
+	cloudEvent := CloudEvent{
+		SpecVersion:     cloudEventsSpecVersion,
+		ID:              e.ID,
+		Source:          ce.eventSource(e),
+		Type:            CloudEventsTypePrefix + e.Action,
+		Subject:         eventSubject(e),
+		Time:            e.Timestamp,
+		DataContentType: "application/json",
+		Data:            e,
+	}
+
+	if !ce.binary {
+		p, err := json.Marshal(cloudEvent)
+		if err != nil {
+			return cloudEventMessage{}, err
+		}
+		return cloudEventMessage{
+			contentType: CloudEventsMediaType,
+			body:        p,
+		}, nil
+	}
+
+	p, err := json.Marshal(e)
+	if err != nil {
+		return cloudEventMessage{}, err
+	}
+	attributes := map[string]string{
+		"specversion": cloudEvent.SpecVersion,
+		"id":          cloudEvent.ID,
+		"source":      cloudEvent.Source,
+		"type":        cloudEvent.Type,
+	}
+	if cloudEvent.Subject != "" {
+		attributes["subject"] = cloudEvent.Subject
+	}
+	if !cloudEvent.Time.IsZero() {
+		attributes["time"] = cloudEvent.Time.Format(time.RFC3339Nano)
+	}
+	return cloudEventMessage{
+		contentType: cloudEvent.DataContentType,
+		attributes:  attributes,
+		body:        p,
+	}, nil
+}
+
+// eventSource returns the source attribute of the event, a URI reference to
+// the registry the event occurred on.
+func (ce *cloudEventsEncoder) eventSource(e Event) string {
+	switch {
+	case ce.source != "":
+		return ce.source
+	case e.Request.Host != "":
+		return "//" + e.Request.Host
+	}
+	return "//" + e.Source.Addr
+}
+
+// eventSubject returns the subject attribute of the event, the reference of
+// its target.
+func eventSubject(e Event) string {
+	subject := e.Target.Repository
+	if e.Target.Tag != "" {
+		subject += ":" + e.Target.Tag
+	}
+	if e.Target.Digest != "" {
+		subject += "@" + e.Target.Digest.String()
+	}
+	return subject
+}
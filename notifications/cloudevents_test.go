@@ -0,0 +1,137 @@
+package notifications
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/manifest/schema1"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestCheckFormat(t *testing.T) {
+	for _, tc := range []struct {
+		format string
+		mode   string
+		valid  bool
+	}{
+		{format: "", valid: true},
+		{format: FormatEnvelope, valid: true},
+		{format: FormatCloudEvents, valid: true},
+		{format: FormatCloudEvents, mode: CloudEventsModeStructured, valid: true},
+		{format: FormatCloudEvents, mode: CloudEventsModeBinary, valid: true},
+		{format: FormatCloudEvents, mode: "batch"},
+		{format: "xml"},
+	} {
+		err := CheckFormat(tc.format, configuration.CloudEvents{Mode: tc.mode})
+		if (err == nil) != tc.valid {
+			t.Errorf("unexpected result checking format %q, mode %q: %v", tc.format, tc.mode, err)
+		}
+	}
+}
+
+func TestHTTPSinkCloudEvents(t *testing.T) {
+	type request struct {
+		header http.Header
+		body   []byte
+	}
+	requests := make(chan request, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- request{header: r.Header, body: body}
+	}))
+	defer server.Close()
+
+	event := createTestEvent("push", "library/test", schema1.MediaTypeSignedManifest)
+	event.Target.Tag = "latest"
+	event.Target.Digest = digest.FromString("manifest")
+	event.Request.Host = "registry.example.com"
+	subject := "library/test:latest@" + event.Target.Digest.String()
+
+	// structured mode
+	sink := newHTTPSink(server.URL, 0, nil, nil)
+	sink.cloudEvents = newCloudEventsEncoder(FormatCloudEvents, configuration.CloudEvents{})
+	if err := sink.Write(event); err != nil {
+		t.Fatalf("unexpected error writing event: %v", err)
+	}
+	req := <-requests
+	if ct := req.header.Get("Content-Type"); ct != CloudEventsMediaType {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+	var ce CloudEvent
+	if err := json.Unmarshal(req.body, &ce); err != nil {
+		t.Fatalf("error decoding cloudevent: %v", err)
+	}
+	if ce.SpecVersion != "1.0" || ce.ID != event.ID || ce.Type != "io.github.distribution.push" ||
+		ce.Source != "//registry.example.com" || ce.Subject != subject || !ce.Time.Equal(event.Timestamp) ||
+		ce.DataContentType != "application/json" || ce.Data.Target.Repository != "library/test" {
+		t.Fatalf("unexpected cloudevent %+v", ce)
+	}
+
+	// binary mode
+	sink = newHTTPSink(server.URL, 0, nil, nil)
+	sink.cloudEvents = newCloudEventsEncoder(FormatCloudEvents, configuration.CloudEvents{
+		Mode:   CloudEventsModeBinary,
+		Source: "https://registry.example.com/prod",
+	})
+	if err := sink.Write(event); err != nil {
+		t.Fatalf("unexpected error writing event: %v", err)
+	}
+	req = <-requests
+	for name, expected := range map[string]string{
+		"Content-Type":   "application/json",
+		"Ce-Specversion": "1.0",
+		"Ce-Id":          event.ID,
+		"Ce-Source":      "https://registry.example.com/prod",
+		"Ce-Type":        "io.github.distribution.push",
+		"Ce-Subject":     subject,
+		"Ce-Time":        event.Timestamp.Format(time.RFC3339Nano),
+	} {
+		if value := req.header.Get(name); value != expected {
+			t.Errorf("unexpected header %s: %q, expected %q", name, value, expected)
+		}
+	}
+	var data Event
+	if err := json.Unmarshal(req.body, &data); err != nil {
+		t.Fatalf("error decoding event: %v", err)
+	}
+	if data.ID != event.ID || data.Target.Digest != event.Target.Digest {
+		t.Fatalf("unexpected event %+v", data)
+	}
+}
+
+func TestKafkaSinkCloudEvents(t *testing.T) {
+	writer := &testKafkaWriter{}
+	sink := newKafkaSink(writer, "events", "", time.Second)
+	sink.cloudEvents = newCloudEventsEncoder(FormatCloudEvents, configuration.CloudEvents{Mode: CloudEventsModeBinary})
+
+	event := createTestEvent("delete", "library/test", schema1.MediaTypeSignedManifest)
+	event.Source.Addr = "registry-1:5000"
+	if err := sink.Write(event); err != nil {
+		t.Fatalf("unexpected error writing event: %v", err)
+	}
+
+	if len(writer.messages) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(writer.messages))
+	}
+	headers := make(map[string]string)
+	for _, header := range writer.messages[0].Headers {
+		headers[header.Key] = string(header.Value)
+	}
+	for name, expected := range map[string]string{
+		"content-type":   "application/json",
+		"ce_specversion": "1.0",
+		"ce_id":          event.ID,
+		"ce_source":      "//registry-1:5000",
+		"ce_type":        "io.github.distribution.delete",
+		"ce_subject":     "library/test",
+	} {
+		if headers[name] != expected {
+			t.Errorf("unexpected header %s: %q, expected %q", name, headers[name], expected)
+		}
+	}
+}
@@ -1,7 +1,12 @@
 package notifications
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"net/http"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/distribution/distribution/v3/configuration"
@@ -15,9 +20,17 @@ type EndpointConfig struct {
 	Timeout           time.Duration
 	Threshold         int
 	Backoff           time.Duration
+	MaxBackoff        time.Duration
+	MaxRetries        int
+	DeadLetter        configuration.DeadLetter
 	IgnoredMediaTypes []string
 	Transport         *http.Transport `json:"-"`
 	Ignore            configuration.Ignore
+	Filter            configuration.Filter
+	Format            string
+	CloudEvents       configuration.CloudEvents
+	Signing           configuration.Signing
+	Include           configuration.EventInclude
 }
 
 // defaults set any zero-valued fields to a reasonable default.
@@ -62,18 +75,120 @@ func NewEndpoint(name, url string, config EndpointConfig) *Endpoint {
 	endpoint.metrics = newSafeMetrics(name)
 
 	// Configures the inmemory queue, retry, http pipeline.
-	endpoint.Sink = newHTTPSink(
+	sink := newHTTPSink(
 		endpoint.url, endpoint.Timeout, endpoint.Headers,
 		endpoint.Transport, endpoint.metrics.httpStatusListener())
-	endpoint.Sink = events.NewRetryingSink(endpoint.Sink, events.NewBreaker(endpoint.Threshold, endpoint.Backoff))
-	endpoint.Sink = newEventQueue(endpoint.Sink, endpoint.metrics.eventQueueListener())
-	mediaTypes := append(config.Ignore.MediaTypes, config.IgnoredMediaTypes...)
-	endpoint.Sink = newIgnoredSink(endpoint.Sink, mediaTypes, config.Ignore.Actions)
+	sink.cloudEvents = newCloudEventsEncoder(endpoint.Format, endpoint.CloudEvents)
+	sink.signing = endpoint.Signing
+	endpoint.pipeline(sink)
 
 	register(&endpoint)
 	return &endpoint
 }
 
+// NewKafkaEndpoint returns a running endpoint producing events to a kafka
+// topic, ready to receive events. The Headers, Transport and Signing of config
+// are not used.
+func NewKafkaEndpoint(name string, kafkaConfig configuration.KafkaEndpoint, config EndpointConfig) (*Endpoint, error) {
+	var endpoint Endpoint
+	endpoint.name = name
+	endpoint.url = "kafka://" + strings.Join(kafkaConfig.Brokers, ",") + "/" + kafkaConfig.Topic
+	endpoint.EndpointConfig = config
+	endpoint.defaults()
+
+	writer, err := newKafkaWriter(kafkaConfig, endpoint.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	endpoint.metrics = newSafeMetrics(name)
+
+	// Configures the inmemory queue, retry, kafka pipeline.
+	sink := newKafkaSink(
+		writer, kafkaConfig.Topic, kafkaConfig.PartitionKey,
+		endpoint.Timeout, endpoint.metrics.kafkaStatusListener())
+	sink.cloudEvents = newCloudEventsEncoder(endpoint.Format, endpoint.CloudEvents)
+	endpoint.pipeline(sink)
+
+	register(&endpoint)
+	return &endpoint, nil
+}
+
+// NewNatsEndpoint returns a running endpoint publishing events to NATS
+// subjects, ready to receive events. The Headers, Transport and Signing of
+// config are not used.
+func NewNatsEndpoint(name string, natsConfig configuration.NatsEndpoint, config EndpointConfig) (*Endpoint, error) {
+	var endpoint Endpoint
+	endpoint.name = name
+	endpoint.url = strings.Join(natsConfig.URLs, ",") + "/" + natsConfig.Subject
+	endpoint.EndpointConfig = config
+	endpoint.defaults()
+	endpoint.metrics = newSafeMetrics(name)
+
+	publisher, err := newNatsPublisher(natsConfig, endpoint.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// Configures the inmemory queue, retry, nats pipeline.
+	sink, err := newNatsSink(publisher, natsConfig.Subject, endpoint.Timeout, endpoint.metrics.natsStatusListener())
+	if err != nil {
+		publisher.close()
+		return nil, err
+	}
+	sink.cloudEvents = newCloudEventsEncoder(endpoint.Format, endpoint.CloudEvents)
+	endpoint.pipeline(sink)
+
+	register(&endpoint)
+	return &endpoint, nil
+}
+
+// Close flushes the events queued by the endpoint, delivering them or giving
+// up according to its retry policy, and closes it.
+func (e *Endpoint) Close() error {
+	unregister(e)
+	return e.Sink.Close()
+}
+
+// pipeline wraps sink with the retry, queue and filtering stages of the
+// endpoint. Events are filtered before they are queued, so that ignored
+// events do not hold back the others.
+func (e *Endpoint) pipeline(sink events.Sink) {
+	e.Sink = newRetryingSink(sink, e.retryStrategy(), e.MaxRetries, e.deadLetterSink(), e.metrics.retryListener())
+	e.Sink = newEventQueue(e.Sink, e.metrics.eventQueueListener())
+	e.Sink = newIncludeSink(e.Sink, e.Include)
+	mediaTypes := append(e.Ignore.MediaTypes, e.IgnoredMediaTypes...)
+	e.Sink = newIgnoredSink(e.Sink, mediaTypes, e.Ignore.Actions)
+	e.Sink = newFilterSink(e.Sink, e.Filter)
+}
+
+// retryStrategy returns the circuit breaker backing off for Backoff after
+// Threshold failures, or an exponential backoff with jitter, growing from
+// Backoff up to MaxBackoff, if the latter is set.
+func (e *Endpoint) retryStrategy() events.RetryStrategy {
+	if e.MaxBackoff > 0 {
+		return events.NewExponentialBackoff(events.ExponentialBackoffConfig{
+			Base:   e.Backoff,
+			Factor: e.Backoff,
+			Max:    e.MaxBackoff,
+		})
+	}
+	return events.NewBreaker(e.Threshold, e.Backoff)
+}
+
+// deadLetterSink returns the sink receiving the events the endpoint gave up
+// on, or nil if they are dropped.
+func (e *Endpoint) deadLetterSink() events.Sink {
+	switch {
+	case e.DeadLetter.File != "":
+		return newFileSink(e.DeadLetter.File)
+	case e.DeadLetter.URL != "":
+		sink := newHTTPSink(e.DeadLetter.URL, e.Timeout, e.DeadLetter.Headers, e.Transport)
+		sink.signing = e.Signing
+		return sink
+	}
+	return nil
+}
+
 // Name returns the name of the endpoint, generally used for debugging.
 func (e *Endpoint) Name() string {
 	return e.name
@@ -96,3 +211,35 @@ func (e *Endpoint) ReadMetrics(em *EndpointMetrics) {
 		em.Statuses[k] = v
 	}
 }
+
+// endpointTLSConfig returns the TLS configuration of the connections of an
+// endpoint of the given type.
+func endpointTLSConfig(endpointType string, config configuration.EndpointTLS) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+
+	if config.CA != "" {
+		ca, err := os.ReadFile(config.CA)
+		if err != nil {
+			return nil, fmt.Errorf("%s: failed to read CA: %v", endpointType, err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("%s: could not add CA %s", endpointType, config.CA)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.Certificate != "" || config.Key != "" {
+		cert, err := tls.LoadX509KeyPair(config.Certificate, config.Key)
+		if err != nil {
+			return nil, fmt.Errorf("%s: failed to load client certificate: %v", endpointType, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
@@ -1,6 +1,7 @@
 package notifications
 
 import (
+	"encoding/json"
 	"fmt"
 	"time"
 
@@ -75,6 +76,14 @@ type Event struct {
 
 		// References provides the references descriptors.
 		References []distribution.Descriptor `json:"references,omitempty"`
+
+		// Payload is the body of a pushed manifest, if the endpoint includes
+		// it.
+		Payload json.RawMessage `json:"payload,omitempty"`
+
+		// Platforms are the manifests referenced by a pushed image index,
+		// with their platform, if the endpoint includes them.
+		Platforms []distribution.Descriptor `json:"platforms,omitempty"`
 	} `json:"target,omitempty"`
 
 	// Request covers the request that generated the event.
@@ -88,6 +97,10 @@ type Event struct {
 	// differently, while the actor "initiates" the event, the source
 	// "generates" it.
 	Source SourceRecord `json:"source,omitempty"`
+
+	// manifest is the pushed manifest, from which the endpoints include its
+	// payload and platforms in the target.
+	manifest distribution.Manifest
 }
 
 // ActorRecord specifies the agent that initiated the event. For most
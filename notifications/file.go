@@ -0,0 +1,71 @@
+package notifications
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	events "github.com/docker/go-events"
+)
+
+// fileSink appends each event to a file, as an envelope encoded on a single
+// line. It is used as dead letter sink, to keep the events an endpoint could
+// not be notified of.
+type fileSink struct {
+	path string
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// newFileSink returns a sink appending events to the file at path, which is
+// created if it does not exist.
+func newFileSink(path string) *fileSink {
+	return &fileSink{path: path}
+}
+
+// Write appends the event to the file. The file is opened on every write so
+// that it can be rotated.
+func (fs *fileSink) Write(event events.Event) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.closed {
+		return ErrSinkClosed
+	}
+
+	p, err := json.Marshal(Envelope{
+		Events: []events.Event{event},
+	})
+	if err != nil {
+		return fmt.Errorf("%v: error marshaling event envelope: %v", fs, err)
+	}
+
+	f, err := os.OpenFile(fs.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("%v: error opening file: %v", fs, err)
+	}
+	if _, err := f.Write(append(p, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("%v: error writing event: %v", fs, err)
+	}
+	return f.Close()
+}
+
+// Close the sink.
+func (fs *fileSink) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.closed {
+		return fmt.Errorf("filesink: already closed")
+	}
+
+	fs.closed = true
+	return nil
+}
+
+func (fs *fileSink) String() string {
+	return fmt.Sprintf("fileSink{%s}", fs.path)
+}
@@ -8,6 +8,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/distribution/distribution/v3/configuration"
 	events "github.com/docker/go-events"
 )
 
@@ -22,8 +23,12 @@ type httpSink struct {
 	client    *http.Client
 	listeners []httpStatusListener
 
-	// TODO(stevvooe): Allow one to configure the media type accepted by this
-	// sink and choose the serialization based on that.
+	// cloudEvents encodes the events in the CloudEvents format, they are
+	// wrapped in an envelope if nil.
+	cloudEvents *cloudEventsEncoder
+
+	// signing signs the payloads, if it has a secret.
+	signing configuration.Signing
 }
 
 // newHTTPSink returns an unreliable, single-flight http sink. Wrap in other
@@ -64,24 +69,19 @@ func (hs *httpSink) Write(event events.Event) error {
 		return ErrSinkClosed
 	}
 
-	envelope := Envelope{
-		Events: []events.Event{event},
-	}
-
 	// TODO(stevvooe): It is not ideal to keep re-encoding the request body on
 	// retry but we are going to do it to keep the code simple. It is likely
 	// we could change the event struct to manage its own buffer.
 
-	p, err := json.MarshalIndent(envelope, "", "   ")
+	req, err := hs.newRequest(event)
 	if err != nil {
 		for _, listener := range hs.listeners {
 			listener.err(err, event)
 		}
-		return fmt.Errorf("%v: error marshaling event envelope: %v", hs, err)
+		return fmt.Errorf("%v: error marshaling event: %v", hs, err)
 	}
 
-	body := bytes.NewReader(p)
-	resp, err := hs.client.Post(hs.url, EventsMediaType, body)
+	resp, err := hs.client.Do(req)
 	if err != nil {
 		for _, listener := range hs.listeners {
 			listener.err(err, event)
@@ -112,6 +112,56 @@ func (hs *httpSink) Write(event events.Event) error {
 	}
 }
 
+// newRequest returns the request posting the event, either wrapped in an
+// envelope or as a CloudEvent.
+func (hs *httpSink) newRequest(event events.Event) (*http.Request, error) {
+	if hs.cloudEvents == nil {
+		p, err := json.MarshalIndent(Envelope{
+			Events: []events.Event{event},
+		}, "", "   ")
+		if err != nil {
+			return nil, err
+		}
+
+		req, err := http.NewRequest(http.MethodPost, hs.url, bytes.NewReader(p))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", EventsMediaType)
+		hs.sign(req, p)
+		return req, nil
+	}
+
+	msg, err := hs.cloudEvents.encode(event)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, hs.url, bytes.NewReader(msg.body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", msg.contentType)
+	for name, value := range msg.attributes {
+		req.Header.Set("ce-"+name, value)
+	}
+	hs.sign(req, msg.body)
+	return req, nil
+}
+
+// sign sets the signature of the body of a request, if the sink signs its
+// payloads.
+func (hs *httpSink) sign(req *http.Request, body []byte) {
+	if hs.signing.Secret == "" {
+		return
+	}
+	header := hs.signing.Header
+	if header == "" {
+		header = DefaultSignatureHeader
+	}
+	req.Header.Set(header, Sign([]byte(hs.signing.Secret), body))
+}
+
 // Close the endpoint
 func (hs *httpSink) Close() error {
 	hs.mu.Lock()
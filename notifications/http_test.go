@@ -4,6 +4,7 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
 	"mime"
 	"net"
 	"net/http"
@@ -13,6 +14,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/distribution/distribution/v3/configuration"
 	"github.com/distribution/distribution/v3/manifest/schema1"
 	events "github.com/docker/go-events"
 )
@@ -200,6 +202,54 @@ func TestHTTPSink(t *testing.T) {
 
 }
 
+// TestHTTPSinkSigning checks that the payloads are signed with the secret of
+// the endpoint, in the configured header.
+func TestHTTPSinkSigning(t *testing.T) {
+	secret := []byte("asecret")
+	var signatures []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("error reading request body: %v", err)
+		}
+		for _, header := range []string{DefaultSignatureHeader, "X-Signature"} {
+			if signature := r.Header.Get(header); signature != "" {
+				if !VerifySignature(secret, body, signature) {
+					t.Errorf("invalid signature in %s: %q", header, signature)
+				}
+				signatures = append(signatures, header)
+			}
+		}
+	}))
+	defer server.Close()
+
+	event := createTestEvent("push", "library/test", schema1.MediaTypeSignedManifest)
+	for _, tc := range []struct {
+		signing configuration.Signing
+		format  string
+	}{
+		{},
+		{signing: configuration.Signing{Secret: string(secret)}},
+		{signing: configuration.Signing{Secret: string(secret), Header: "X-Signature"}},
+		{signing: configuration.Signing{Secret: string(secret)}, format: FormatCloudEvents},
+	} {
+		sink := newHTTPSink(server.URL, 0, nil, nil)
+		sink.signing = tc.signing
+		sink.cloudEvents = newCloudEventsEncoder(tc.format, configuration.CloudEvents{})
+		if err := sink.Write(event); err != nil {
+			t.Fatalf("unexpected error writing event: %v", err)
+		}
+	}
+
+	expected := []string{DefaultSignatureHeader, "X-Signature", DefaultSignatureHeader}
+	if !reflect.DeepEqual(signatures, expected) {
+		t.Errorf("unexpected signatures: %v != %v", signatures, expected)
+	}
+	if VerifySignature([]byte("another"), []byte("payload"), Sign(secret, []byte("payload"))) {
+		t.Error("signature verified with another secret")
+	}
+}
+
 func createTestEvent(action, repo, typ string) Event {
 	event := createEvent(action)
 
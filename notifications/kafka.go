@@ -0,0 +1,226 @@
+package notifications
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	events "github.com/docker/go-events"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+// Partition keys supported by the kafka sink.
+const (
+	kafkaPartitionKeyRepository = "repository"
+	kafkaPartitionKeyNone       = "none"
+)
+
+// kafkaWriter produces messages to a kafka topic. It is implemented by
+// *kafka.Writer.
+type kafkaWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// kafkaStatusListener is called on the outcomes of producing notifications.
+type kafkaStatusListener interface {
+	success(event events.Event)
+	err(err error, event events.Event)
+}
+
+// kafkaSink implements a single-flight notification endpoint producing each
+// event to a kafka topic. Like the http sink, it only makes one attempt at
+// producing an event, reliability should be provided by the caller.
+type kafkaSink struct {
+	writer       kafkaWriter
+	topic        string
+	partitionKey string
+	timeout      time.Duration
+
+	mu        sync.Mutex
+	closed    bool
+	listeners []kafkaStatusListener
+
+	// cloudEvents encodes the events in the CloudEvents format, they are
+	// wrapped in an envelope if nil.
+	cloudEvents *cloudEventsEncoder
+}
+
+// newKafkaSink returns an unreliable, single-flight kafka sink. Wrap in other
+// sinks for increased reliability.
+func newKafkaSink(writer kafkaWriter, topic, partitionKey string, timeout time.Duration, listeners ...kafkaStatusListener) *kafkaSink {
+	return &kafkaSink{
+		writer:       writer,
+		topic:        topic,
+		partitionKey: partitionKey,
+		timeout:      timeout,
+		listeners:    listeners,
+	}
+}
+
+// Write produces the event to the topic, returning an error if it fails. It
+// is the caller's responsibility to retry on error.
+func (ks *kafkaSink) Write(event events.Event) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.closed {
+		return ErrSinkClosed
+	}
+
+	msg, err := ks.newMessage(event)
+	if err != nil {
+		for _, listener := range ks.listeners {
+			listener.err(err, event)
+		}
+		return fmt.Errorf("%v: error marshaling event: %v", ks, err)
+	}
+	if e, ok := event.(Event); ok && ks.partitionKey != kafkaPartitionKeyNone {
+		msg.Key = []byte(e.Target.Repository)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ks.timeout)
+	defer cancel()
+
+	if err := ks.writer.WriteMessages(ctx, msg); err != nil {
+		for _, listener := range ks.listeners {
+			listener.err(err, event)
+		}
+		return fmt.Errorf("%v: error producing event: %v", ks, err)
+	}
+
+	for _, listener := range ks.listeners {
+		listener.success(event)
+	}
+	return nil
+}
+
+// newMessage returns the message of the event, either wrapped in an envelope
+// or as a CloudEvent.
+func (ks *kafkaSink) newMessage(event events.Event) (kafka.Message, error) {
+	if ks.cloudEvents == nil {
+		// Events are wrapped in an envelope, so consumers can share the
+		// decoding of http notifications.
+		p, err := json.Marshal(Envelope{
+			Events: []events.Event{event},
+		})
+		if err != nil {
+			return kafka.Message{}, err
+		}
+
+		return kafka.Message{
+			Value: p,
+			Headers: []kafka.Header{
+				{Key: "Content-Type", Value: []byte(EventsMediaType)},
+			},
+		}, nil
+	}
+
+	ce, err := ks.cloudEvents.encode(event)
+	if err != nil {
+		return kafka.Message{}, err
+	}
+
+	// the kafka binding of CloudEvents names the header in lower case
+	msg := kafka.Message{
+		Value: ce.body,
+		Headers: []kafka.Header{
+			{Key: "content-type", Value: []byte(ce.contentType)},
+		},
+	}
+	for name, value := range ce.attributes {
+		msg.Headers = append(msg.Headers, kafka.Header{Key: "ce_" + name, Value: []byte(value)})
+	}
+	return msg, nil
+}
+
+// Close the endpoint
+func (ks *kafkaSink) Close() error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.closed {
+		return fmt.Errorf("kafkasink: already closed")
+	}
+
+	ks.closed = true
+	return ks.writer.Close()
+}
+
+func (ks *kafkaSink) String() string {
+	return fmt.Sprintf("kafkaSink{%s}", ks.topic)
+}
+
+// newKafkaWriter returns a writer producing messages to the topic of the
+// kafka endpoint configuration.
+func newKafkaWriter(config configuration.KafkaEndpoint, timeout time.Duration) (*kafka.Writer, error) {
+	if len(config.Brokers) == 0 {
+		return nil, fmt.Errorf("kafka: no brokers configured")
+	}
+	if config.Topic == "" {
+		return nil, fmt.Errorf("kafka: no topic configured")
+	}
+
+	switch config.PartitionKey {
+	case "", kafkaPartitionKeyRepository, kafkaPartitionKeyNone:
+	default:
+		return nil, fmt.Errorf("kafka: unsupported partition key %q", config.PartitionKey)
+	}
+
+	transport := &kafka.Transport{
+		DialTimeout: timeout,
+	}
+
+	if config.TLS.Enabled {
+		tlsConfig, err := endpointTLSConfig("kafka", config.TLS)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLS = tlsConfig
+	}
+
+	if config.SASL.Mechanism != "" {
+		mechanism, err := kafkaSASLMechanism(config)
+		if err != nil {
+			return nil, err
+		}
+		transport.SASL = mechanism
+	}
+
+	return &kafka.Writer{
+		Addr:  kafka.TCP(config.Brokers...),
+		Topic: config.Topic,
+		// Messages with the same key, the repository name by default, are
+		// produced to the same partition.
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+		// Retries are handled by the endpoint, and events are produced
+		// one at a time.
+		MaxAttempts:  1,
+		BatchSize:    1,
+		WriteTimeout: timeout,
+		Transport:    transport,
+	}, nil
+}
+
+func kafkaSASLMechanism(config configuration.KafkaEndpoint) (sasl.Mechanism, error) {
+	switch strings.ToLower(config.SASL.Mechanism) {
+	case "plain":
+		return plain.Mechanism{
+			Username: config.SASL.Username,
+			Password: config.SASL.Password,
+		}, nil
+	case "scram-sha-256":
+		return scram.Mechanism(scram.SHA256, config.SASL.Username, config.SASL.Password)
+	case "scram-sha-512":
+		return scram.Mechanism(scram.SHA512, config.SASL.Username, config.SASL.Password)
+	}
+	return nil, fmt.Errorf("kafka: unsupported SASL mechanism %q", config.SASL.Mechanism)
+}
@@ -0,0 +1,120 @@
+package notifications
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/manifest/schema1"
+	"github.com/segmentio/kafka-go"
+)
+
+// testKafkaWriter records the messages written to it, failing if err is set.
+type testKafkaWriter struct {
+	messages []kafka.Message
+	err      error
+	closed   bool
+}
+
+func (tkw *testKafkaWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	if tkw.err != nil {
+		return tkw.err
+	}
+	tkw.messages = append(tkw.messages, msgs...)
+	return nil
+}
+
+func (tkw *testKafkaWriter) Close() error {
+	tkw.closed = true
+	return nil
+}
+
+func TestKafkaSink(t *testing.T) {
+	writer := &testKafkaWriter{}
+	metrics := newSafeMetrics("kafka")
+	sink := newKafkaSink(writer, "events", "", time.Second, metrics.kafkaStatusListener())
+
+	event := createTestEvent("push", "library/test", schema1.MediaTypeSignedManifest)
+	if err := sink.Write(event); err != nil {
+		t.Fatalf("unexpected error writing event: %v", err)
+	}
+
+	if len(writer.messages) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(writer.messages))
+	}
+	msg := writer.messages[0]
+	if string(msg.Key) != "library/test" {
+		t.Fatalf("unexpected message key %q", msg.Key)
+	}
+	if len(msg.Headers) != 1 || msg.Headers[0].Key != "Content-Type" || string(msg.Headers[0].Value) != EventsMediaType {
+		t.Fatalf("unexpected message headers %v", msg.Headers)
+	}
+
+	var envelope struct {
+		Events []Event `json:"events"`
+	}
+	if err := json.Unmarshal(msg.Value, &envelope); err != nil {
+		t.Fatalf("error decoding message: %v", err)
+	}
+	if len(envelope.Events) != 1 || envelope.Events[0].ID != event.ID {
+		t.Fatalf("unexpected events %v", envelope.Events)
+	}
+
+	writer.err = errors.New("broker unavailable")
+	if err := sink.Write(event); err == nil {
+		t.Fatalf("expected error writing event to unavailable broker")
+	}
+
+	if metrics.Successes != 1 || metrics.Errors != 1 {
+		t.Fatalf("unexpected metrics %+v", metrics.EndpointMetrics)
+	}
+
+	checkClose(t, sink)
+	if !writer.closed {
+		t.Fatalf("writer was not closed")
+	}
+}
+
+func TestKafkaSinkNoPartitionKey(t *testing.T) {
+	writer := &testKafkaWriter{}
+	sink := newKafkaSink(writer, "events", kafkaPartitionKeyNone, time.Second)
+
+	if err := sink.Write(createTestEvent("push", "library/test", schema1.MediaTypeSignedManifest)); err != nil {
+		t.Fatalf("unexpected error writing event: %v", err)
+	}
+
+	if len(writer.messages) != 1 || writer.messages[0].Key != nil {
+		t.Fatalf("unexpected messages %v", writer.messages)
+	}
+}
+
+func TestNewKafkaWriterInvalid(t *testing.T) {
+	valid := configuration.KafkaEndpoint{
+		Brokers: []string{"localhost:9092"},
+		Topic:   "events",
+	}
+	if _, err := newKafkaWriter(valid, time.Second); err != nil {
+		t.Fatalf("unexpected error creating writer: %v", err)
+	}
+
+	noBrokers := valid
+	noBrokers.Brokers = nil
+
+	noTopic := valid
+	noTopic.Topic = ""
+
+	badPartitionKey := valid
+	badPartitionKey.PartitionKey = "tag"
+
+	badMechanism := valid
+	badMechanism.SASL.Mechanism = "gssapi"
+
+	for _, config := range []configuration.KafkaEndpoint{noBrokers, noTopic, badPartitionKey, badMechanism} {
+		if _, err := newKafkaWriter(config, time.Second); err == nil {
+			t.Fatalf("expected error creating writer for %+v", config)
+		}
+	}
+}
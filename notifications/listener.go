@@ -2,6 +2,7 @@ package notifications
 
 import (
 	"context"
+	"io"
 	"net/http"
 
 	"github.com/distribution/distribution/v3"
@@ -125,6 +126,24 @@ func (msl *manifestServiceListener) Put(ctx context.Context, sm distribution.Man
 	return dgst, err
 }
 
+// Referrers forwards to the underlying manifest service, if it supports
+// listing referrers.
+func (msl *manifestServiceListener) Referrers(ctx context.Context, subject digest.Digest, artifactType string) ([]distribution.Descriptor, error) {
+	if referrers, ok := msl.ManifestService.(distribution.ManifestReferrers); ok {
+		return referrers.Referrers(ctx, subject, artifactType)
+	}
+	return nil, distribution.ErrUnsupported
+}
+
+// Untagged forwards to the underlying manifest service, if it supports
+// listing the untagged manifests.
+func (msl *manifestServiceListener) Untagged(ctx context.Context) ([]distribution.UntaggedManifest, error) {
+	if lister, ok := msl.ManifestService.(distribution.UntaggedManifestLister); ok {
+		return lister.Untagged(ctx)
+	}
+	return nil, distribution.ErrUnsupported
+}
+
 type blobServiceListener struct {
 	distribution.BlobStore
 	parent *repositoryListener
@@ -239,6 +258,24 @@ func (bwl *blobWriterListener) Commit(ctx context.Context, desc distribution.Des
 	return committed, err
 }
 
+// WriteChunk forwards to the underlying blob writer, if it accepts the
+// chunks out of order.
+func (bwl *blobWriterListener) WriteChunk(ctx context.Context, offset, length int64, r io.Reader) error {
+	if cw, ok := bwl.BlobWriter.(distribution.BlobChunkWriter); ok {
+		return cw.WriteChunk(ctx, offset, length, r)
+	}
+	return distribution.ErrUnsupported
+}
+
+// Digest forwards to the underlying blob writer, if it hashes the data as
+// it is written.
+func (bwl *blobWriterListener) Digest(ctx context.Context, algorithm digest.Algorithm) (digest.Digest, error) {
+	if d, ok := bwl.BlobWriter.(distribution.BlobDigester); ok {
+		return d.Digest(ctx, algorithm)
+	}
+	return "", distribution.ErrUnsupported
+}
+
 type tagServiceListener struct {
 	distribution.TagService
 	parent *repositoryListener
@@ -251,6 +288,32 @@ func (rl *repositoryListener) Tags(ctx context.Context) distribution.TagService
 	}
 }
 
+// History forwards to the underlying tag service, if it keeps the history
+// of the tags.
+func (tagSL *tagServiceListener) History(ctx context.Context, tag string) ([]distribution.TagEvent, error) {
+	if history, ok := tagSL.TagService.(distribution.TagHistoryProvider); ok {
+		return history.History(ctx, tag)
+	}
+	return nil, distribution.ErrUnsupported
+}
+
+// TagIf forwards to the underlying tag service, if it tags conditionally.
+func (tagSL *tagServiceListener) TagIf(ctx context.Context, tag string, desc distribution.Descriptor, check func(current digest.Digest) error) error {
+	if tagger, ok := tagSL.TagService.(distribution.TagConditionalTagger); ok {
+		return tagger.TagIf(ctx, tag, desc, check)
+	}
+	return distribution.ErrUnsupported
+}
+
+// ManifestDigests forwards to the underlying tag service, if it indexes the
+// revisions of the tags.
+func (tagSL *tagServiceListener) ManifestDigests(ctx context.Context, tag string) ([]digest.Digest, error) {
+	if md, ok := tagSL.TagService.(distribution.TagManifestsProvider); ok {
+		return md.ManifestDigests(ctx, tag)
+	}
+	return nil, distribution.ErrUnsupported
+}
+
 func (tagSL *tagServiceListener) Untag(ctx context.Context, tag string) error {
 	if err := tagSL.TagService.Untag(ctx, tag); err != nil {
 		return err
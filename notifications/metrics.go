@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"sync"
+	"time"
 
 	prometheus "github.com/distribution/distribution/v3/metrics"
 	events "github.com/docker/go-events"
@@ -18,18 +19,25 @@ var (
 	pendingGauge = prometheus.NotificationsNamespace.NewLabeledGauge("pending", "The gauge of pending events in queue", metrics.Total, "endpoint")
 	// statusCounter counts the total notification call per each status code
 	statusCounter = prometheus.NotificationsNamespace.NewLabeledCounter("status", "The number of status code", "code", "endpoint")
+	// retriesCounter counts the attempts to deliver events which are retried
+	retriesCounter = prometheus.NotificationsNamespace.NewLabeledCounter("retries", "The number of retried deliveries", "endpoint")
+	// deliveryTimer measures the time taken to deliver events, retries included
+	deliveryTimer = prometheus.NotificationsNamespace.NewLabeledTimer("delivery", "The number of seconds taken to deliver an event, retries included", "endpoint")
 )
 
 // EndpointMetrics track various actions taken by the endpoint, typically by
 // number of events. The goal of this to export it via expvar but we may find
 // some other future solution to be better.
 type EndpointMetrics struct {
-	Pending   int            // events pending in queue
-	Events    int            // total events incoming
-	Successes int            // total events written successfully
-	Failures  int            // total events failed
-	Errors    int            // total events errored
-	Statuses  map[string]int // status code histogram, per call event
+	Pending      int            // events pending in queue
+	Events       int            // total events incoming
+	Successes    int            // total events written successfully
+	Failures     int            // total events failed
+	Errors       int            // total events errored
+	Retries      int            // total deliveries retried
+	DeadLettered int            // total events written to the dead letter sink
+	Dropped      int            // total events given up on and lost
+	Statuses     map[string]int // status code histogram, per call event
 }
 
 // safeMetrics guards the metrics implementation with a lock and provides a
@@ -56,6 +64,22 @@ func (sm *safeMetrics) httpStatusListener() httpStatusListener {
 	}
 }
 
+// kafkaStatusListener returns the listener for the kafka sink that updates
+// the relevant counters.
+func (sm *safeMetrics) kafkaStatusListener() kafkaStatusListener {
+	return &endpointMetricsKafkaStatusListener{
+		safeMetrics: sm,
+	}
+}
+
+// natsStatusListener returns the listener for the nats sink that updates
+// the relevant counters, which are the same as those of the kafka sink.
+func (sm *safeMetrics) natsStatusListener() natsStatusListener {
+	return &endpointMetricsKafkaStatusListener{
+		safeMetrics: sm,
+	}
+}
+
 // eventQueueListener returns a listener that maintains queue related counters.
 func (sm *safeMetrics) eventQueueListener() eventQueueListener {
 	return &endpointMetricsEventQueueListener{
@@ -63,6 +87,14 @@ func (sm *safeMetrics) eventQueueListener() eventQueueListener {
 	}
 }
 
+// retryListener returns a listener that counts the retried deliveries and
+// the events the endpoint gave up on, and measures the delivery latency.
+func (sm *safeMetrics) retryListener() retryListener {
+	return &endpointMetricsRetryListener{
+		safeMetrics: sm,
+	}
+}
+
 // endpointMetricsHTTPStatusListener increments counters related to http sinks
 // for the relevant events.
 type endpointMetricsHTTPStatusListener struct {
@@ -99,6 +131,67 @@ func (emsl *endpointMetricsHTTPStatusListener) err(err error, event events.Event
 	eventsCounter.WithValues("Errors", emsl.EndpointName).Inc(1)
 }
 
+// endpointMetricsKafkaStatusListener increments counters related to kafka
+// and nats sinks for the relevant events.
+type endpointMetricsKafkaStatusListener struct {
+	*safeMetrics
+}
+
+var _ kafkaStatusListener = &endpointMetricsKafkaStatusListener{}
+var _ natsStatusListener = &endpointMetricsKafkaStatusListener{}
+
+func (emksl *endpointMetricsKafkaStatusListener) success(event events.Event) {
+	emksl.safeMetrics.Lock()
+	defer emksl.safeMetrics.Unlock()
+	emksl.Successes++
+
+	eventsCounter.WithValues("Successes", emksl.EndpointName).Inc(1)
+}
+
+func (emksl *endpointMetricsKafkaStatusListener) err(err error, event events.Event) {
+	emksl.safeMetrics.Lock()
+	defer emksl.safeMetrics.Unlock()
+	emksl.Errors++
+
+	eventsCounter.WithValues("Errors", emksl.EndpointName).Inc(1)
+}
+
+// endpointMetricsRetryListener increments counters related to the retries
+// of the retrying sink and the events it gave up on.
+type endpointMetricsRetryListener struct {
+	*safeMetrics
+}
+
+var _ retryListener = &endpointMetricsRetryListener{}
+
+func (emrl *endpointMetricsRetryListener) delivered(event events.Event, latency time.Duration) {
+	deliveryTimer.WithValues(emrl.EndpointName).Update(latency)
+}
+
+func (emrl *endpointMetricsRetryListener) retried(event events.Event, err error) {
+	emrl.safeMetrics.Lock()
+	defer emrl.safeMetrics.Unlock()
+	emrl.Retries++
+
+	retriesCounter.WithValues(emrl.EndpointName).Inc(1)
+}
+
+func (emrl *endpointMetricsRetryListener) deadLettered(event events.Event) {
+	emrl.safeMetrics.Lock()
+	defer emrl.safeMetrics.Unlock()
+	emrl.DeadLettered++
+
+	eventsCounter.WithValues("DeadLettered", emrl.EndpointName).Inc(1)
+}
+
+func (emrl *endpointMetricsRetryListener) dropped(event events.Event) {
+	emrl.safeMetrics.Lock()
+	defer emrl.safeMetrics.Unlock()
+	emrl.Dropped++
+
+	eventsCounter.WithValues("Dropped", emrl.EndpointName).Inc(1)
+}
+
 // endpointMetricsEventQueueListener maintains the incoming events counter and
 // the queues pending count.
 type endpointMetricsEventQueueListener struct {
@@ -137,6 +230,19 @@ func register(e *Endpoint) {
 	endpoints.registered = append(endpoints.registered, e)
 }
 
+// unregister removes the endpoint from expvar, once it is closed.
+func unregister(e *Endpoint) {
+	endpoints.mu.Lock()
+	defer endpoints.mu.Unlock()
+
+	for i, v := range endpoints.registered {
+		if v == e {
+			endpoints.registered = append(endpoints.registered[:i], endpoints.registered[i+1:]...)
+			return
+		}
+	}
+}
+
 func init() {
 	// NOTE(stevvooe): Setup registry metrics structure to report to expvar.
 	// Ideally, we do more metrics through logging but we need some nice
@@ -4,6 +4,11 @@ import (
 	"encoding/json"
 	"expvar"
 	"testing"
+	"time"
+
+	events "github.com/docker/go-events"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 )
 
 func TestMetricsExpvar(t *testing.T) {
@@ -26,3 +31,105 @@ func TestMetricsExpvar(t *testing.T) {
 		t.Logf("expected one-element []interface{}, got %#v", v)
 	}
 }
+
+// blockingSink blocks the writes until it is released.
+type blockingSink struct {
+	events.Sink
+	release chan struct{}
+}
+
+func (bs *blockingSink) Write(event events.Event) error {
+	<-bs.release
+	return bs.Sink.Write(event)
+}
+
+// gatherEndpointMetric returns the prometheus metric of the family name for
+// the endpoint, if any.
+func gatherEndpointMetric(t *testing.T, name, endpoint string) *dto.Metric {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("unexpected error gathering metrics: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "endpoint" && label.GetValue() == endpoint {
+					return metric
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func TestMetricsPrometheus(t *testing.T) {
+	const (
+		endpoint = "prometheus-test"
+		nevents  = 3
+	)
+	var ts testSink
+	sink := &blockingSink{Sink: &ts, release: make(chan struct{})}
+	metrics := newSafeMetrics(endpoint)
+	rs := newRetryingSink(sink, events.NewBreaker(1, time.Millisecond), 0, nil, metrics.retryListener())
+	eq := newEventQueue(rs, metrics.eventQueueListener())
+
+	// the prometheus metrics are global, they are compared to their values
+	// before the test
+	gauge := func() float64 {
+		return gatherEndpointMetric(t, "registry_notifications_pending_total", endpoint).GetGauge().GetValue()
+	}
+	histogram := func() *dto.Histogram {
+		return gatherEndpointMetric(t, "registry_notifications_delivery_seconds", endpoint).GetHistogram()
+	}
+	pendingBefore := gauge()
+	samplesBefore, sumBefore := histogram().GetSampleCount(), histogram().GetSampleSum()
+
+	checkPending := func(expected int) {
+		t.Helper()
+		metrics.Lock()
+		pending := metrics.Pending
+		metrics.Unlock()
+		if pending != expected {
+			t.Fatalf("unexpected pending events: %d != %d", pending, expected)
+		}
+		if pending := gauge() - pendingBefore; pending != float64(expected) {
+			t.Fatalf("unexpected pending gauge: %v != %d", pending, expected)
+		}
+	}
+
+	// the events are buffered while the sink is wedged
+	for i := 0; i < nevents; i++ {
+		if err := eq.Write(createTestEvent("push", "library/test", "blob")); err != nil {
+			t.Fatalf("error writing event: %v", err)
+		}
+	}
+	checkPending(nevents)
+	if samples := histogram().GetSampleCount(); samples != samplesBefore {
+		t.Fatalf("unexpected delivery latency before any delivery: %d samples", samples-samplesBefore)
+	}
+
+	// and delivered once it recovers
+	time.Sleep(10 * time.Millisecond)
+	close(sink.release)
+	checkClose(t, eq)
+	checkPending(0)
+
+	ts.mu.Lock()
+	count := ts.count
+	ts.mu.Unlock()
+	if count != nevents {
+		t.Fatalf("events did not make it to the sink: %d != %d", count, nevents)
+	}
+
+	if samples := histogram().GetSampleCount() - samplesBefore; samples != nevents {
+		t.Fatalf("unexpected delivery latency samples: %d != %d", samples, nevents)
+	}
+	// the first event waited for the sink to recover
+	if sum := histogram().GetSampleSum() - sumBefore; sum < (10 * time.Millisecond).Seconds() {
+		t.Fatalf("unexpected delivery latency: %fs", sum)
+	}
+}
@@ -0,0 +1,213 @@
+package notifications
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	events "github.com/docker/go-events"
+)
+
+// natsMessage is a message published by the nats sink.
+type natsMessage struct {
+	subject string
+	headers [][2]string
+	data    []byte
+
+	// id is the id of the event, used by JetStream streams to discard the
+	// duplicates of retried events.
+	id string
+}
+
+// natsPublisher publishes messages to NATS. It is implemented on top of
+// github.com/nats-io/nats.go in nats_client.go.
+type natsPublisher interface {
+	publish(ctx context.Context, msg natsMessage) error
+	close()
+}
+
+// natsStatusListener is called on the outcomes of publishing notifications.
+type natsStatusListener interface {
+	success(event events.Event)
+	err(err error, event events.Event)
+}
+
+// natsSubjectData are the fields of the subject templates of the nats sink.
+type natsSubjectData struct {
+	// Repository is the name of the repository, with its slashes replaced
+	// by dots, so that subscribers may match namespaces with wildcards.
+	Repository string
+	Action     string
+	MediaType  string
+	Tag        string
+}
+
+// natsSink implements a single-flight notification endpoint publishing each
+// event to a NATS subject. With JetStream, an event is only delivered once
+// the stream storing the subject acknowledged it. Like the http sink, it only
+// makes one attempt at publishing an event, reliability should be provided
+// by the caller.
+type natsSink struct {
+	publisher natsPublisher
+	subject   *template.Template
+	timeout   time.Duration
+
+	mu        sync.Mutex
+	closed    bool
+	listeners []natsStatusListener
+
+	// cloudEvents encodes the events in the CloudEvents format, they are
+	// wrapped in an envelope if nil.
+	cloudEvents *cloudEventsEncoder
+}
+
+// newNatsSink returns an unreliable, single-flight nats sink publishing to
+// the subjects rendered from the subject template. Wrap in other sinks for
+// increased reliability.
+func newNatsSink(publisher natsPublisher, subject string, timeout time.Duration, listeners ...natsStatusListener) (*natsSink, error) {
+	if subject == "" {
+		return nil, fmt.Errorf("nats: no subject configured")
+	}
+	tmpl, err := template.New("subject").Option("missingkey=error").Parse(subject)
+	if err != nil {
+		return nil, fmt.Errorf("nats: invalid subject: %v", err)
+	}
+
+	return &natsSink{
+		publisher: publisher,
+		subject:   tmpl,
+		timeout:   timeout,
+		listeners: listeners,
+	}, nil
+}
+
+// Write publishes the event to its subject, returning an error if it fails.
+// It is the caller's responsibility to retry on error.
+func (ns *natsSink) Write(event events.Event) error {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	if ns.closed {
+		return ErrSinkClosed
+	}
+
+	if err := ns.write(event); err != nil {
+		for _, listener := range ns.listeners {
+			listener.err(err, event)
+		}
+		return fmt.Errorf("%v: %v", ns, err)
+	}
+
+	for _, listener := range ns.listeners {
+		listener.success(event)
+	}
+	return nil
+}
+
+func (ns *natsSink) write(event events.Event) error {
+	subject, err := ns.subjectOf(event)
+	if err != nil {
+		return err
+	}
+	headers, payload, err := ns.newMessage(event)
+	if err != nil {
+		return fmt.Errorf("error marshaling event: %v", err)
+	}
+	msg := natsMessage{subject: subject, headers: headers, data: payload}
+	if e, ok := event.(Event); ok {
+		msg.id = e.ID
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ns.timeout)
+	defer cancel()
+
+	if err := ns.publisher.publish(ctx, msg); err != nil {
+		return fmt.Errorf("error publishing event: %v", err)
+	}
+	return nil
+}
+
+// subjectOf returns the subject the event is published to.
+func (ns *natsSink) subjectOf(event events.Event) (string, error) {
+	var data natsSubjectData
+	if e, ok := event.(Event); ok {
+		data = natsSubjectData{
+			Repository: strings.ReplaceAll(e.Target.Repository, "/", "."),
+			Action:     e.Action,
+			MediaType:  e.Target.MediaType,
+			Tag:        e.Target.Tag,
+		}
+	}
+
+	var buf strings.Builder
+	if err := ns.subject.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("error rendering subject: %v", err)
+	}
+	subject := buf.String()
+	if !validNatsSubject(subject) {
+		return "", fmt.Errorf("invalid subject %q", subject)
+	}
+	return subject, nil
+}
+
+// validNatsSubject returns whether the subject may be published to: made of
+// non-empty tokens separated by dots, without whitespace or wildcards.
+func validNatsSubject(subject string) bool {
+	if subject == "" || strings.ContainsAny(subject, " \t\r\n") {
+		return false
+	}
+	for _, token := range strings.Split(subject, ".") {
+		if token == "" || token == "*" || token == ">" {
+			return false
+		}
+	}
+	return true
+}
+
+// newMessage returns the headers and payload of the message of the event,
+// either wrapped in an envelope or as a CloudEvent.
+func (ns *natsSink) newMessage(event events.Event) ([][2]string, []byte, error) {
+	if ns.cloudEvents == nil {
+		// Events are wrapped in an envelope, so consumers can share the
+		// decoding of http notifications.
+		p, err := json.Marshal(Envelope{
+			Events: []events.Event{event},
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		return [][2]string{{"Content-Type", EventsMediaType}}, p, nil
+	}
+
+	ce, err := ns.cloudEvents.encode(event)
+	if err != nil {
+		return nil, nil, err
+	}
+	headers := [][2]string{{"content-type", ce.contentType}}
+	for name, value := range ce.attributes {
+		headers = append(headers, [2]string{"ce-" + name, value})
+	}
+	return headers, ce.body, nil
+}
+
+// Close the endpoint
+func (ns *natsSink) Close() error {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	if ns.closed {
+		return fmt.Errorf("natssink: already closed")
+	}
+
+	ns.closed = true
+	ns.publisher.close()
+	return nil
+}
+
+func (ns *natsSink) String() string {
+	return fmt.Sprintf("natsSink{%s}", ns.subject.Root.String())
+}
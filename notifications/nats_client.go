@@ -0,0 +1,108 @@
+package notifications
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/version"
+	"github.com/nats-io/nats.go"
+)
+
+// natsClient publishes messages with a nats.go connection, which reconnects
+// to the servers in the background.
+type natsClient struct {
+	conn   *nats.Conn
+	js     nats.JetStreamContext
+	stream string
+}
+
+// newNatsPublisher connects to the servers of config. With JetStream, the
+// messages are published to the streams storing their subjects.
+func newNatsPublisher(config configuration.NatsEndpoint, timeout time.Duration) (natsPublisher, error) {
+	if len(config.URLs) == 0 {
+		return nil, fmt.Errorf("nats: no urls configured")
+	}
+	for _, u := range config.URLs {
+		if !strings.HasPrefix(u, "nats://") && !strings.HasPrefix(u, "tls://") {
+			return nil, fmt.Errorf("nats: unsupported url %q", u)
+		}
+	}
+
+	options := []nats.Option{
+		nats.Name("registry/" + version.Version),
+		nats.Timeout(timeout),
+		// the servers are tried in the configured order
+		nats.DontRandomize(),
+		// the servers may be unreachable when the registry starts
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+	}
+	if config.TLS.Enabled {
+		tlsConfig, err := endpointTLSConfig("nats", config.TLS)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, nats.Secure(tlsConfig))
+	}
+	if config.Username != "" {
+		options = append(options, nats.UserInfo(config.Username, config.Password))
+	}
+	if config.Token != "" {
+		options = append(options, nats.Token(config.Token))
+	}
+	if config.Credentials != "" {
+		options = append(options, nats.UserCredentials(config.Credentials))
+	}
+
+	conn, err := nats.Connect(strings.Join(config.URLs, ","), options...)
+	if err != nil {
+		return nil, fmt.Errorf("nats: %v", err)
+	}
+
+	client := &natsClient{conn: conn, stream: config.Stream}
+	if config.JetStream {
+		client.js, err = conn.JetStream()
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("nats: %v", err)
+		}
+	}
+	return client, nil
+}
+
+// publish publishes the message and waits for the server to process it, or
+// for the acknowledgement of the stream with JetStream.
+func (nc *natsClient) publish(ctx context.Context, msg natsMessage) error {
+	m := nats.NewMsg(msg.subject)
+	m.Data = msg.data
+	for _, header := range msg.headers {
+		m.Header.Add(header[0], header[1])
+	}
+
+	if nc.js == nil {
+		if err := nc.conn.PublishMsg(m); err != nil {
+			return err
+		}
+		// the server answers the flush once it processed the message,
+		// reporting errors such as permission violations before
+		return nc.conn.FlushWithContext(ctx)
+	}
+
+	options := []nats.PubOpt{nats.Context(ctx)}
+	if msg.id != "" {
+		// the stream discards the duplicates of retried events
+		options = append(options, nats.MsgId(msg.id))
+	}
+	if nc.stream != "" {
+		options = append(options, nats.ExpectStream(nc.stream))
+	}
+	_, err := nc.js.PublishMsg(m, options...)
+	return err
+}
+
+func (nc *natsClient) close() {
+	nc.conn.Close()
+}
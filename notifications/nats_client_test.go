@@ -0,0 +1,362 @@
+package notifications
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/manifest/schema1"
+	"github.com/nats-io/nkeys"
+)
+
+// testNatsServer speaks enough of the NATS protocol for clients to connect,
+// authenticate and publish messages, which it sends to its messages channel.
+type testNatsServer struct {
+	listener net.Listener
+	tls      *tls.Config
+	nonce    string
+	messages chan natsMessage
+
+	// the credentials of the clients, either a user and password, a token
+	// or the public key of a user signing the nonce
+	user, password string
+	token          string
+	userKey        string
+}
+
+func newTestNatsServer(t *testing.T, tlsConfig *tls.Config) *testNatsServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	s := &testNatsServer{
+		listener: listener,
+		tls:      tlsConfig,
+		nonce:    "cmVnaXN0cnk",
+		messages: make(chan natsMessage, 10),
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return s
+}
+
+func (s *testNatsServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *testNatsServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	info, _ := json.Marshal(map[string]interface{}{
+		"server_id":    "test",
+		"version":      "2.8.4",
+		"proto":        1,
+		"headers":      true,
+		"max_payload":  1 << 20,
+		"tls_required": s.tls != nil,
+		"nonce":        s.nonce,
+	})
+	fmt.Fprintf(conn, "INFO %s\r\n", info)
+	if s.tls != nil {
+		tlsConn := tls.Server(conn, s.tls)
+		if err := tlsConn.Handshake(); err != nil {
+			return
+		}
+		conn = tlsConn
+	}
+
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "CONNECT":
+			if !s.authorized(strings.TrimSpace(line[len("CONNECT"):])) {
+				fmt.Fprint(conn, "-ERR 'Authorization Violation'\r\n")
+				return
+			}
+		case "PING":
+			fmt.Fprint(conn, "PONG\r\n")
+		case "HPUB":
+			// HPUB <subject> [reply-to] <header size> <total size>
+			if len(fields) < 4 {
+				return
+			}
+			headerSize, _ := strconv.Atoi(fields[len(fields)-2])
+			totalSize, _ := strconv.Atoi(fields[len(fields)-1])
+			p := make([]byte, totalSize+2)
+			if _, err := io.ReadFull(r, p); err != nil || headerSize > totalSize {
+				return
+			}
+			s.messages <- natsMessage{
+				subject: fields[1],
+				headers: parseTestNatsHeaders(p[:headerSize]),
+				data:    p[headerSize:totalSize],
+			}
+		}
+	}
+}
+
+// authorized returns whether the CONNECT options carry the credentials of
+// the server.
+func (s *testNatsServer) authorized(options string) bool {
+	var connect struct {
+		User  string `json:"user"`
+		Pass  string `json:"pass"`
+		Token string `json:"auth_token"`
+		JWT   string `json:"jwt"`
+		Sig   string `json:"sig"`
+	}
+	if err := json.Unmarshal([]byte(options), &connect); err != nil {
+		return false
+	}
+
+	switch {
+	case s.user != "":
+		return connect.User == s.user && connect.Pass == s.password
+	case s.token != "":
+		return connect.Token == s.token
+	case s.userKey != "":
+		sig, err := base64.RawURLEncoding.DecodeString(connect.Sig)
+		if err != nil || connect.JWT == "" {
+			return false
+		}
+		kp, err := nkeys.FromPublicKey(s.userKey)
+		if err != nil {
+			return false
+		}
+		return kp.Verify([]byte(s.nonce), sig) == nil
+	}
+	return true
+}
+
+func parseTestNatsHeaders(p []byte) [][2]string {
+	var headers [][2]string
+	// the first line is the version, NATS/1.0
+	for _, line := range strings.Split(string(p), "\r\n")[1:] {
+		if name, value, ok := strings.Cut(line, ":"); ok {
+			headers = append(headers, [2]string{name, strings.TrimSpace(value)})
+		}
+	}
+	return headers
+}
+
+// writeTestNatsCertificate writes a self signed certificate of 127.0.0.1 to
+// dir, returning its path and the tls configuration of a server using it.
+func writeTestNatsCertificate(t *testing.T, dir string) (string, *tls.Config) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{Organization: []string{"notifications_test"}},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("error creating certificate: %v", err)
+	}
+
+	certPath := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("error writing certificate: %v", err)
+	}
+	return certPath, &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: priv}},
+	}
+}
+
+// writeTestNatsCredentials writes a credentials file of a new user to dir,
+// returning its path and the public key of the user.
+func writeTestNatsCredentials(t *testing.T, dir string) (string, string) {
+	kp, err := nkeys.CreateUser()
+	if err != nil {
+		t.Fatalf("error creating user: %v", err)
+	}
+	seed, err := kp.Seed()
+	if err != nil {
+		t.Fatalf("error reading seed: %v", err)
+	}
+	public, err := kp.PublicKey()
+	if err != nil {
+		t.Fatalf("error reading public key: %v", err)
+	}
+
+	// the server does not verify the JWT, only the signature of the nonce
+	creds := fmt.Sprintf(`-----BEGIN NATS USER JWT-----
+eyJ0eXAiOiJKV1QiLCJhbGciOiJlZDI1NTE5LW5rZXkifQ.e30.c2ln
+------END NATS USER JWT------
+
+-----BEGIN USER NKEY SEED-----
+%s
+------END USER NKEY SEED------
+`, seed)
+	credsPath := filepath.Join(dir, "user.creds")
+	if err := os.WriteFile(credsPath, []byte(creds), 0o600); err != nil {
+		t.Fatalf("error writing credentials: %v", err)
+	}
+	return credsPath, public
+}
+
+func TestNatsClient(t *testing.T) {
+	dir := t.TempDir()
+	caPath, serverTLS := writeTestNatsCertificate(t, dir)
+	credsPath, userKey := writeTestNatsCredentials(t, dir)
+
+	for _, tc := range []struct {
+		name   string
+		tls    bool
+		server func(s *testNatsServer)
+		config func(addr string) configuration.NatsEndpoint
+	}{
+		{
+			name:   "user",
+			server: func(s *testNatsServer) { s.user, s.password = "registry", "secret" },
+			config: func(addr string) configuration.NatsEndpoint {
+				return configuration.NatsEndpoint{URLs: []string{"nats://" + addr}, Username: "registry", Password: "secret"}
+			},
+		},
+		{
+			name:   "tls",
+			tls:    true,
+			server: func(s *testNatsServer) { s.token = "token" },
+			config: func(addr string) configuration.NatsEndpoint {
+				return configuration.NatsEndpoint{
+					URLs:  []string{"tls://" + addr},
+					TLS:   configuration.EndpointTLS{Enabled: true, CA: caPath},
+					Token: "token",
+				}
+			},
+		},
+		{
+			name:   "credentials",
+			server: func(s *testNatsServer) { s.userKey = userKey },
+			config: func(addr string) configuration.NatsEndpoint {
+				return configuration.NatsEndpoint{URLs: []string{"nats://" + addr}, Credentials: credsPath}
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var tlsConfig *tls.Config
+			if tc.tls {
+				tlsConfig = serverTLS
+			}
+			server := newTestNatsServer(t, tlsConfig)
+			tc.server(server)
+
+			publisher, err := newNatsPublisher(tc.config(server.addr()), 5*time.Second)
+			if err != nil {
+				t.Fatalf("unexpected error connecting: %v", err)
+			}
+			sink, err := newNatsSink(publisher, "registry.{{.Repository}}.{{.Action}}", 5*time.Second)
+			if err != nil {
+				t.Fatalf("unexpected error creating sink: %v", err)
+			}
+			defer sink.Close()
+
+			event := createTestEvent("push", "library/test", schema1.MediaTypeSignedManifest)
+			if err := sink.Write(event); err != nil {
+				t.Fatalf("unexpected error writing event: %v", err)
+			}
+
+			var msg natsMessage
+			select {
+			case msg = <-server.messages:
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for the message")
+			}
+			if msg.subject != "registry.library.test.push" {
+				t.Fatalf("unexpected subject %q", msg.subject)
+			}
+			if len(msg.headers) != 1 || msg.headers[0] != [2]string{"Content-Type", EventsMediaType} {
+				t.Fatalf("unexpected message headers %v", msg.headers)
+			}
+			var envelope struct {
+				Events []Event `json:"events"`
+			}
+			if err := json.Unmarshal(bytes.TrimSpace(msg.data), &envelope); err != nil {
+				t.Fatalf("error decoding message: %v", err)
+			}
+			if len(envelope.Events) != 1 || envelope.Events[0].ID != event.ID {
+				t.Fatalf("unexpected events %v", envelope.Events)
+			}
+		})
+	}
+}
+
+func TestNatsClientUnauthorized(t *testing.T) {
+	server := newTestNatsServer(t, nil)
+	server.user, server.password = "registry", "secret"
+
+	config := configuration.NatsEndpoint{URLs: []string{"nats://" + server.addr()}, Username: "registry", Password: "wrong"}
+	publisher, err := newNatsPublisher(config, time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error connecting: %v", err)
+	}
+	sink, err := newNatsSink(publisher, "registry.{{.Repository}}", time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error creating sink: %v", err)
+	}
+	defer sink.Close()
+
+	if err := sink.Write(createTestEvent("push", "library/test", schema1.MediaTypeSignedManifest)); err == nil {
+		t.Fatal("expected error publishing with wrong credentials")
+	}
+	select {
+	case msg := <-server.messages:
+		t.Fatalf("unexpected message %v", msg)
+	default:
+	}
+}
+
+func TestNewNatsPublisherInvalid(t *testing.T) {
+	for _, config := range []configuration.NatsEndpoint{
+		{},
+		{URLs: []string{"http://127.0.0.1:4222"}},
+		{URLs: []string{"nats://127.0.0.1:4222"}, TLS: configuration.EndpointTLS{Enabled: true, CA: "/does/not/exist"}},
+	} {
+		if _, err := newNatsPublisher(config, time.Second); err == nil {
+			t.Fatalf("expected error with config %+v", config)
+		}
+	}
+}
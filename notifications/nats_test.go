@@ -0,0 +1,116 @@
+package notifications
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/manifest/schema1"
+)
+
+// testNatsPublisher records the messages published to it, failing if err is
+// set.
+type testNatsPublisher struct {
+	messages []natsMessage
+	err      error
+	closed   bool
+}
+
+func (tnp *testNatsPublisher) publish(ctx context.Context, msg natsMessage) error {
+	if tnp.err != nil {
+		return tnp.err
+	}
+	tnp.messages = append(tnp.messages, msg)
+	return nil
+}
+
+func (tnp *testNatsPublisher) close() {
+	tnp.closed = true
+}
+
+func TestNatsSink(t *testing.T) {
+	publisher := &testNatsPublisher{}
+	metrics := newSafeMetrics("nats")
+	sink, err := newNatsSink(publisher, "registry.{{.Repository}}.{{.Action}}", time.Second, metrics.natsStatusListener())
+	if err != nil {
+		t.Fatalf("unexpected error creating sink: %v", err)
+	}
+
+	event := createTestEvent("push", "library/test", schema1.MediaTypeSignedManifest)
+	if err := sink.Write(event); err != nil {
+		t.Fatalf("unexpected error writing event: %v", err)
+	}
+
+	if len(publisher.messages) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(publisher.messages))
+	}
+	msg := publisher.messages[0]
+	if msg.subject != "registry.library.test.push" {
+		t.Fatalf("unexpected subject %q", msg.subject)
+	}
+	if msg.id != event.ID {
+		t.Fatalf("unexpected message id %q, expected %q", msg.id, event.ID)
+	}
+	if len(msg.headers) != 1 || msg.headers[0] != [2]string{"Content-Type", EventsMediaType} {
+		t.Fatalf("unexpected message headers %v", msg.headers)
+	}
+	var envelope struct {
+		Events []Event `json:"events"`
+	}
+	if err := json.Unmarshal(msg.data, &envelope); err != nil {
+		t.Fatalf("error decoding message: %v", err)
+	}
+	if len(envelope.Events) != 1 || envelope.Events[0].ID != event.ID {
+		t.Fatalf("unexpected events %v", envelope.Events)
+	}
+
+	publisher.err = errors.New("nats: no responders available for request")
+	if err := sink.Write(event); err == nil {
+		t.Fatal("expected error publishing event")
+	}
+
+	if metrics.Successes != 1 || metrics.Errors != 1 {
+		t.Fatalf("unexpected metrics %+v", metrics.EndpointMetrics)
+	}
+	checkClose(t, sink)
+	if !publisher.closed {
+		t.Fatal("expected publisher to be closed")
+	}
+}
+
+func TestNatsSinkSubjects(t *testing.T) {
+	for _, subject := range []string{"", "registry.{{.Repository"} {
+		if _, err := newNatsSink(&testNatsPublisher{}, subject, time.Second); err == nil {
+			t.Errorf("expected error creating sink with subject %q", subject)
+		}
+	}
+
+	// the rendered subjects are checked before publishing
+	publisher := &testNatsPublisher{}
+	sink, err := newNatsSink(publisher, "registry.{{.Tag}}", time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error creating sink: %v", err)
+	}
+	if err := sink.Write(createTestEvent("push", "library/test", schema1.MediaTypeSignedManifest)); err == nil {
+		t.Fatal("expected error publishing to an empty token")
+	}
+	if len(publisher.messages) != 0 {
+		t.Fatalf("unexpected messages %v", publisher.messages)
+	}
+
+	for subject, valid := range map[string]bool{
+		"registry.library.test": true,
+		"registry":              true,
+		"":                      false,
+		"registry..test":        false,
+		"registry.*":            false,
+		"registry.>":            false,
+		"registry.a b":          false,
+	} {
+		if validNatsSubject(subject) != valid {
+			t.Errorf("expected subject %q to be valid: %t", subject, valid)
+		}
+	}
+}
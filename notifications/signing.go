@@ -0,0 +1,29 @@
+package notifications
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// DefaultSignatureHeader is the header carrying the signatures of the
+// payloads posted to the endpoints, when none is configured.
+const DefaultSignatureHeader = "X-Registry-Signature-256"
+
+// signaturePrefix prefixes the signatures with their algorithm.
+const signaturePrefix = "sha256="
+
+// Sign returns the signature of a payload posted to an endpoint: the hex
+// encoded HMAC-SHA256 of the payload keyed with secret, prefixed with
+// "sha256=", as the signatures of GitHub webhooks.
+func Sign(secret, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignature reports whether signature is the signature of payload
+// with secret. The signatures are compared in constant time.
+func VerifySignature(secret, payload []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, payload)), []byte(signature))
+}
@@ -4,7 +4,9 @@ import (
 	"container/list"
 	"fmt"
 	"sync"
+	"time"
 
+	"github.com/distribution/distribution/v3/configuration"
 	events "github.com/docker/go-events"
 	"github.com/sirupsen/logrus"
 )
@@ -119,6 +121,123 @@ func (eq *eventQueue) next() events.Event {
 	return block
 }
 
+// retryListener is notified of the outcome of the attempts of the retrying
+// sink to deliver an event.
+type retryListener interface {
+	delivered(event events.Event, latency time.Duration)
+	retried(event events.Event, err error)
+	deadLettered(event events.Event)
+	dropped(event events.Event)
+}
+
+// retryingSink retries writes to a sink, backing off on failure according to
+// a retry strategy. Unlike events.RetryingSink, it gives up on an event
+// after a number of retries, or once closed, and hands it over to a dead
+// letter sink rather than dropping it.
+type retryingSink struct {
+	sink       events.Sink
+	strategy   events.RetryStrategy
+	maxRetries int
+	deadLetter events.Sink
+	listeners  []retryListener
+	closed     chan struct{}
+	once       sync.Once
+}
+
+// newRetryingSink returns a sink retrying writes to sink. If maxRetries is
+// positive, events still failing after as many retries are written to
+// deadLetter, or dropped if it is nil.
+func newRetryingSink(sink events.Sink, strategy events.RetryStrategy, maxRetries int, deadLetter events.Sink, listeners ...retryListener) *retryingSink {
+	return &retryingSink{
+		sink:       sink,
+		strategy:   strategy,
+		maxRetries: maxRetries,
+		deadLetter: deadLetter,
+		listeners:  listeners,
+		closed:     make(chan struct{}),
+	}
+}
+
+// Write attempts to flush the event to the downstream sink until it
+// succeeds, the retries are exhausted or the sink is closed.
+func (rs *retryingSink) Write(event events.Event) error {
+	start := time.Now()
+	for retries := 0; ; retries++ {
+		select {
+		case <-rs.closed:
+			return rs.giveUp(event, ErrSinkClosed)
+		default:
+		}
+
+		if backoff := rs.strategy.Proceed(event); backoff > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-rs.closed:
+				return rs.giveUp(event, ErrSinkClosed)
+			}
+		}
+
+		err := rs.sink.Write(event)
+		if err == nil {
+			rs.strategy.Success(event)
+			for _, listener := range rs.listeners {
+				listener.delivered(event, time.Since(start))
+			}
+			return nil
+		}
+		if err == ErrSinkClosed || err == events.ErrSinkClosed {
+			return rs.giveUp(event, err)
+		}
+
+		if rs.strategy.Failure(event, err) || (rs.maxRetries > 0 && retries >= rs.maxRetries) {
+			return rs.giveUp(event, err)
+		}
+		logrus.WithError(err).Errorf("retryingsink: error writing event, retrying")
+		for _, listener := range rs.listeners {
+			listener.retried(event, err)
+		}
+	}
+}
+
+// giveUp writes the event to the dead letter sink, if any. It returns the
+// error which made the sink give up if the event is lost.
+func (rs *retryingSink) giveUp(event events.Event, cause error) error {
+	if rs.deadLetter != nil {
+		err := rs.deadLetter.Write(event)
+		if err == nil {
+			logrus.WithError(cause).Warnf("retryingsink: wrote event to dead letter sink %v", rs.deadLetter)
+			for _, listener := range rs.listeners {
+				listener.deadLettered(event)
+			}
+			return nil
+		}
+		logrus.WithError(err).Errorf("retryingsink: error writing event to dead letter sink %v", rs.deadLetter)
+	}
+
+	logrus.WithError(cause).Errorf("retryingsink: dropped event")
+	for _, listener := range rs.listeners {
+		listener.dropped(event)
+	}
+	return cause
+}
+
+// Close closes the sink and the dead letter sink. The downstream sink is
+// left open.
+func (rs *retryingSink) Close() error {
+	var err error
+	rs.once.Do(func() {
+		close(rs.closed)
+		if rs.deadLetter != nil {
+			err = rs.deadLetter.Close()
+		}
+	})
+	return err
+}
+
+func (rs *retryingSink) String() string {
+	return fmt.Sprintf("retryingSink{%v}", rs.sink)
+}
+
 // ignoredSink discards events with ignored target media types and actions.
 // passes the rest along.
 type ignoredSink struct {
@@ -162,3 +281,98 @@ func (imts *ignoredSink) Write(event events.Event) error {
 func (imts *ignoredSink) Close() error {
 	return nil
 }
+
+// filterSink passes along the events matching a filter and discards the
+// rest.
+type filterSink struct {
+	events.Sink
+	repositories configuration.RepositoryMatchers
+	actions      map[string]bool
+	mediaTypes   map[string]bool
+}
+
+func newFilterSink(sink events.Sink, filter configuration.Filter) events.Sink {
+	if len(filter.Repositories) == 0 && len(filter.Actions) == 0 && len(filter.MediaTypes) == 0 {
+		return sink
+	}
+
+	fs := &filterSink{Sink: sink}
+	for _, pattern := range filter.Repositories {
+		// patterns are validated when parsing the configuration
+		m, err := configuration.NewRepositoryMatcher(pattern)
+		if err != nil {
+			logrus.Errorf("filter: ignoring %v", err)
+			continue
+		}
+		fs.repositories = append(fs.repositories, m)
+	}
+	if len(filter.Actions) > 0 {
+		fs.actions = make(map[string]bool)
+		for _, action := range filter.Actions {
+			fs.actions[action] = true
+		}
+	}
+	if len(filter.MediaTypes) > 0 {
+		fs.mediaTypes = make(map[string]bool)
+		for _, mediaType := range filter.MediaTypes {
+			fs.mediaTypes[mediaType] = true
+		}
+	}
+	return fs
+}
+
+// Write passes along the events matching the filter and discards the rest.
+func (fs *filterSink) Write(event events.Event) error {
+	e := event.(Event)
+	if fs.actions != nil && !fs.actions[e.Action] {
+		return nil
+	}
+	if fs.mediaTypes != nil && !fs.mediaTypes[e.Target.MediaType] {
+		return nil
+	}
+	if len(fs.repositories) > 0 && !fs.repositories.MatchAny(e.Target.Repository) {
+		return nil
+	}
+
+	return fs.Sink.Write(event)
+}
+
+// includeSink includes the details of the pushed manifests in the push
+// events, before passing them along.
+type includeSink struct {
+	events.Sink
+	include configuration.EventInclude
+}
+
+func newIncludeSink(sink events.Sink, include configuration.EventInclude) events.Sink {
+	if !include.Payload && !include.Platforms {
+		return sink
+	}
+	return &includeSink{Sink: sink, include: include}
+}
+
+// Write includes the payload and platforms of the pushed manifest of the
+// event in its target, as configured.
+func (is *includeSink) Write(event events.Event) error {
+	e := event.(Event)
+	if e.manifest == nil {
+		return is.Sink.Write(event)
+	}
+
+	if is.include.Payload {
+		_, payload, err := e.manifest.Payload()
+		if err != nil {
+			return err
+		}
+		e.Target.Payload = payload
+	}
+	if is.include.Platforms {
+		// only the manifests referenced by indexes have a platform
+		for _, desc := range e.manifest.References() {
+			if desc.Platform != nil {
+				e.Target.Platforms = append(e.Target.Platforms, desc)
+			}
+		}
+	}
+	return is.Sink.Write(e)
+}
@@ -1,11 +1,21 @@
 package notifications
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
 	events "github.com/docker/go-events"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 
 	"github.com/sirupsen/logrus"
 
@@ -122,6 +132,192 @@ func TestIgnoredSink(t *testing.T) {
 	}
 }
 
+func TestFilterSink(t *testing.T) {
+	prodPush := createTestEvent("push", "prod/app", "manifest")
+	prodPull := createTestEvent("pull", "prod/app", "manifest")
+	nestedPush := createTestEvent("push", "prod/team/app", "blob")
+	devPush := createTestEvent("push", "dev/app", "manifest")
+
+	type testcase struct {
+		filter   configuration.Filter
+		expected []events.Event
+	}
+
+	cases := []testcase{
+		{configuration.Filter{}, []events.Event{prodPush, prodPull, nestedPush, devPush}},
+		{configuration.Filter{Actions: []string{"push"}}, []events.Event{prodPush, nestedPush, devPush}},
+		{configuration.Filter{MediaTypes: []string{"manifest"}}, []events.Event{prodPush, prodPull, devPush}},
+		{configuration.Filter{Repositories: []string{"prod/*"}}, []events.Event{prodPush, prodPull}},
+		{configuration.Filter{Repositories: []string{"prod/*"}, Actions: []string{"push"}}, []events.Event{prodPush}},
+		{configuration.Filter{Repositories: []string{"regexp:prod/.*"}}, []events.Event{prodPush, prodPull, nestedPush}},
+		{configuration.Filter{Repositories: []string{"regexp:app", "dev/*"}}, []events.Event{devPush}},
+	}
+
+	for _, c := range cases {
+		var written []events.Event
+		for _, event := range []events.Event{prodPush, prodPull, nestedPush, devPush} {
+			ts := &testSink{}
+			s := newFilterSink(ts, c.filter)
+
+			if err := s.Write(event); err != nil {
+				t.Fatalf("error writing event: %v", err)
+			}
+
+			ts.mu.Lock()
+			if ts.event != nil {
+				written = append(written, ts.event)
+			}
+			ts.mu.Unlock()
+		}
+
+		if !reflect.DeepEqual(written, c.expected) {
+			t.Fatalf("unexpected events for filter %v: %#v != %#v", c.filter, written, c.expected)
+		}
+	}
+}
+
+func TestIncludeSink(t *testing.T) {
+	index, err := manifestlist.FromDescriptorsWithMediaType([]manifestlist.ManifestDescriptor{
+		{
+			Descriptor: distribution.Descriptor{MediaType: v1.MediaTypeImageManifest, Digest: digest.FromString("amd64"), Size: 100},
+			Platform:   manifestlist.PlatformSpec{OS: "linux", Architecture: "amd64"},
+		},
+		{
+			Descriptor: distribution.Descriptor{MediaType: v1.MediaTypeImageManifest, Digest: digest.FromString("arm64"), Size: 100},
+			Platform:   manifestlist.PlatformSpec{OS: "linux", Architecture: "arm64", Variant: "v8"},
+		},
+	}, v1.MediaTypeImageIndex)
+	if err != nil {
+		t.Fatalf("error creating index: %v", err)
+	}
+	_, payload, err := index.Payload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	push := createTestEvent("push", "foo/bar", v1.MediaTypeImageIndex)
+	push.manifest = index
+
+	write := func(include configuration.EventInclude, event Event) Event {
+		ts := &testSink{}
+		if err := newIncludeSink(ts, include).Write(event); err != nil {
+			t.Fatalf("error writing event: %v", err)
+		}
+		return ts.event.(Event)
+	}
+
+	written := write(configuration.EventInclude{}, push)
+	if written.Target.Payload != nil || written.Target.Platforms != nil {
+		t.Fatalf("unexpected details included by default: %+v", written.Target)
+	}
+
+	written = write(configuration.EventInclude{Payload: true, Platforms: true}, push)
+	if string(written.Target.Payload) != string(payload) {
+		t.Fatalf("unexpected payload: %s", written.Target.Payload)
+	}
+	if len(written.Target.Platforms) != 2 || written.Target.Platforms[1].Platform.Architecture != "arm64" || written.Target.Platforms[1].Platform.Variant != "v8" {
+		t.Fatalf("unexpected platforms: %+v", written.Target.Platforms)
+	}
+	// the payload is embedded as json
+	encoded, err := json.Marshal(written)
+	if err != nil {
+		t.Fatalf("error encoding event: %v", err)
+	}
+	if !strings.Contains(string(encoded), `"payload":{"schemaVersion":2`) {
+		t.Fatalf("unexpected encoded event: %s", encoded)
+	}
+
+	// the other events are passed along untouched
+	pull := createTestEvent("pull", "foo/bar", v1.MediaTypeImageIndex)
+	if written := write(configuration.EventInclude{Payload: true, Platforms: true}, pull); !reflect.DeepEqual(written, pull) {
+		t.Fatalf("unexpected event: %+v", written)
+	}
+}
+
+func TestRetryingSink(t *testing.T) {
+	event := createTestEvent("push", "library/test", "blob")
+	strategy := func() events.RetryStrategy {
+		return events.NewExponentialBackoff(events.ExponentialBackoffConfig{
+			Base:   time.Millisecond,
+			Factor: time.Millisecond,
+			Max:    5 * time.Millisecond,
+		})
+	}
+
+	// recovering before the retries are exhausted
+	fs := &failingSink{failures: 2}
+	metrics := newSafeMetrics("")
+	rs := newRetryingSink(fs, strategy(), 3, nil, metrics.retryListener())
+	if err := rs.Write(event); err != nil {
+		t.Fatalf("unexpected error writing event: %v", err)
+	}
+	if fs.attempts != 3 || fs.count != 1 {
+		t.Fatalf("unexpected writes: %d attempts, %d events", fs.attempts, fs.count)
+	}
+
+	// written to the dead letter file once the retries are exhausted
+	deadLetter := filepath.Join(t.TempDir(), "deadletter")
+	fs = &failingSink{failures: 10}
+	rs = newRetryingSink(fs, strategy(), 3, newFileSink(deadLetter), metrics.retryListener())
+	if err := rs.Write(event); err != nil {
+		t.Fatalf("unexpected error writing event: %v", err)
+	}
+	if fs.attempts != 4 || fs.count != 0 {
+		t.Fatalf("unexpected writes: %d attempts, %d events", fs.attempts, fs.count)
+	}
+
+	p, err := ioutil.ReadFile(deadLetter)
+	if err != nil {
+		t.Fatalf("error reading dead letter file: %v", err)
+	}
+	var envelope Envelope
+	if err := json.Unmarshal(p, &envelope); err != nil {
+		t.Fatalf("error decoding dead letter file: %v", err)
+	}
+	if len(envelope.Events) != 1 || !strings.HasSuffix(string(p), "\n") {
+		t.Fatalf("unexpected dead letter file content: %q", p)
+	}
+	if envelope.Events[0].(map[string]interface{})["id"] != event.ID {
+		t.Fatalf("unexpected dead lettered event: %v", envelope.Events[0])
+	}
+
+	// dropped without dead letter sink
+	rs = newRetryingSink(&failingSink{failures: 10}, strategy(), 1, nil, metrics.retryListener())
+	if err := rs.Write(event); err == nil {
+		t.Fatalf("expected an error writing a dropped event")
+	}
+
+	// closing gives up on the pending events
+	rs = newRetryingSink(&failingSink{failures: 10}, events.NewBreaker(1, time.Hour), 0, nil, metrics.retryListener())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		rs.Close()
+	}()
+	if err := rs.Write(event); err != ErrSinkClosed {
+		t.Fatalf("unexpected error writing event to closed sink: %v", err)
+	}
+
+	metrics.Lock()
+	defer metrics.Unlock()
+	if metrics.DeadLettered != 1 || metrics.Dropped != 2 || metrics.Retries != 7 {
+		t.Fatalf("unexpected metrics: %d dead lettered, %d dropped, %d retries", metrics.DeadLettered, metrics.Dropped, metrics.Retries)
+	}
+}
+
+// failingSink fails the first writes.
+type failingSink struct {
+	testSink
+	failures int
+	attempts int
+}
+
+func (fs *failingSink) Write(event events.Event) error {
+	fs.attempts++
+	if fs.attempts <= fs.failures {
+		return fmt.Errorf("failing write %d", fs.attempts)
+	}
+	return fs.testSink.Write(event)
+}
+
 type testSink struct {
 	event  events.Event
 	count  int
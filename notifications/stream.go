@@ -0,0 +1,150 @@
+package notifications
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/distribution/distribution/v3/configuration"
+	events "github.com/docker/go-events"
+)
+
+// defaultStreamBacklog is the number of events held for a subscriber of a
+// stream when none is configured.
+const defaultStreamBacklog = 100
+
+// Stream is a sink fanning the events out to the subscribers of the
+// registry event stream. Writes never block: the events a subscriber is too
+// slow to receive once its backlog is full are dropped for it, and it is
+// told so.
+type Stream struct {
+	backlog int
+
+	mu          sync.Mutex
+	subscribers map[*Subscription]events.Sink
+	closed      bool
+}
+
+// NewStream returns a stream holding up to backlog events for each of its
+// subscribers, or a default number if backlog is not positive.
+func NewStream(backlog int) *Stream {
+	if backlog <= 0 {
+		backlog = defaultStreamBacklog
+	}
+	return &Stream{
+		backlog:     backlog,
+		subscribers: make(map[*Subscription]events.Sink),
+	}
+}
+
+// Subscribe returns a subscription to the events matching filter, which
+// must be closed once done with.
+func (s *Stream) Subscribe(filter configuration.Filter) (*Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, ErrSinkClosed
+	}
+
+	sub := &Subscription{
+		stream:  s,
+		events:  make(chan Event, s.backlog),
+		dropped: make(chan struct{}, 1),
+	}
+	s.subscribers[sub] = newFilterSink(subscriptionSink{sub}, filter)
+	return sub, nil
+}
+
+// Write passes the event to each of the subscribers it matches.
+func (s *Stream) Write(event events.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrSinkClosed
+	}
+
+	for _, sink := range s.subscribers {
+		if err := sink.Write(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close the stream, ending all of its subscriptions.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return fmt.Errorf("stream: already closed")
+	}
+
+	s.closed = true
+	for sub := range s.subscribers {
+		close(sub.events)
+		delete(s.subscribers, sub)
+	}
+	return nil
+}
+
+func (s *Stream) unsubscribe(sub *Subscription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.subscribers[sub]; ok {
+		close(sub.events)
+		delete(s.subscribers, sub)
+	}
+}
+
+func (s *Stream) String() string {
+	return fmt.Sprintf("stream{backlog: %d}", s.backlog)
+}
+
+// Subscription receives the events of a stream matching its filter.
+type Subscription struct {
+	stream  *Stream
+	events  chan Event
+	dropped chan struct{}
+}
+
+// Events returns the channel the events are received on, which is closed
+// when the subscription or the stream is.
+func (sub *Subscription) Events() <-chan Event {
+	return sub.events
+}
+
+// Dropped returns a channel receiving a value when events were dropped
+// because the backlog of the subscription was full.
+func (sub *Subscription) Dropped() <-chan struct{} {
+	return sub.dropped
+}
+
+// Close ends the subscription.
+func (sub *Subscription) Close() {
+	sub.stream.unsubscribe(sub)
+}
+
+// subscriptionSink queues the events on a subscription, dropping them when
+// its backlog is full.
+type subscriptionSink struct {
+	sub *Subscription
+}
+
+func (ss subscriptionSink) Write(event events.Event) error {
+	select {
+	case ss.sub.events <- event.(Event):
+	default:
+		select {
+		case ss.sub.dropped <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (ss subscriptionSink) Close() error {
+	return nil
+}
@@ -0,0 +1,78 @@
+package notifications
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/distribution/distribution/v3/configuration"
+)
+
+func TestStream(t *testing.T) {
+	prodPush := createTestEvent("push", "prod/app", "manifest")
+	prodPull := createTestEvent("pull", "prod/app", "manifest")
+	devPush := createTestEvent("push", "dev/app", "manifest")
+
+	s := NewStream(2)
+	all, err := s.Subscribe(configuration.Filter{})
+	if err != nil {
+		t.Fatalf("error subscribing: %v", err)
+	}
+	prod, err := s.Subscribe(configuration.Filter{Repositories: []string{"prod/*"}, Actions: []string{"push"}})
+	if err != nil {
+		t.Fatalf("error subscribing: %v", err)
+	}
+
+	for _, event := range []Event{prodPush, prodPull, devPush} {
+		if err := s.Write(event); err != nil {
+			t.Fatalf("error writing event: %v", err)
+		}
+	}
+
+	// the backlog of two events is exceeded for the first subscriber
+	expected := []Event{prodPush, prodPull}
+	for _, e := range expected {
+		if received := <-all.Events(); !reflect.DeepEqual(received, e) {
+			t.Fatalf("unexpected event: %#v != %#v", received, e)
+		}
+	}
+	select {
+	case <-all.Dropped():
+	default:
+		t.Fatalf("expected events to be dropped")
+	}
+
+	if received := <-prod.Events(); !reflect.DeepEqual(received, prodPush) {
+		t.Fatalf("unexpected event: %#v != %#v", received, prodPush)
+	}
+	select {
+	case <-prod.Dropped():
+		t.Fatalf("unexpected dropped events")
+	default:
+	}
+
+	prod.Close()
+	if _, ok := <-prod.Events(); ok {
+		t.Fatalf("expected the events of a closed subscription to be closed")
+	}
+	if err := s.Write(prodPush); err != nil {
+		t.Fatalf("error writing event: %v", err)
+	}
+	if received := <-all.Events(); !reflect.DeepEqual(received, prodPush) {
+		t.Fatalf("unexpected event: %#v != %#v", received, prodPush)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("error closing stream: %v", err)
+	}
+	if _, ok := <-all.Events(); ok {
+		t.Fatalf("expected the events of a closed stream to be closed")
+	}
+	// closing a subscription of a closed stream is a no-op
+	all.Close()
+	if err := s.Write(prodPush); err != ErrSinkClosed {
+		t.Fatalf("expected %v writing to a closed stream, got %v", ErrSinkClosed, err)
+	}
+	if _, err := s.Subscribe(configuration.Filter{}); err != ErrSinkClosed {
+		t.Fatalf("expected %v subscribing to a closed stream, got %v", ErrSinkClosed, err)
+	}
+}
@@ -2,8 +2,10 @@ package distribution
 
 import (
 	"context"
+	"time"
 
 	"github.com/distribution/distribution/v3/reference"
+	"github.com/opencontainers/go-digest"
 )
 
 // Scope defines the set of items that match a namespace.
@@ -54,6 +56,109 @@ type RepositoryEnumerator interface {
 	Enumerate(ctx context.Context, ingester func(string) error) error
 }
 
+// RepositoryCatalog lists repositories from an index of the registry, which
+// is cheaper than enumerating them
+type RepositoryCatalog interface {
+	// ListRepositories returns up to n repositories sorted after last whose
+	// names start with prefix. err is set to io.EOF if there are no more
+	// repositories to list, and to ErrUnsupported if the registry has no
+	// index.
+	ListRepositories(ctx context.Context, prefix, last string, n int) (repos []string, err error)
+
+	// CountRepositories returns the number of repositories whose names start
+	// with prefix. err is set to ErrUnsupported if the registry has no index.
+	CountRepositories(ctx context.Context, prefix string) (int, error)
+}
+
+// RepositoryActivity reports the activity of the repositories from the
+// index of the registry.
+type RepositoryActivity interface {
+	// LastPush returns the time of the last manifest push to the named
+	// repository, or the zero time if it is unknown. err is set to
+	// ErrUnsupported if the registry has no index.
+	LastPush(ctx context.Context, name string) (time.Time, error)
+}
+
+// Kinds of the entries of the trash of a repository.
+const (
+	TrashEntryManifest = "manifest"
+	TrashEntryTag      = "tag"
+	TrashEntryBlob     = "blob"
+)
+
+// TrashEntry is a manifest, tag or blob soft deleted from a repository.
+type TrashEntry struct {
+	// ID identifies the entry in the trash of the repository.
+	ID string `json:"id"`
+
+	// Kind is the kind of the deleted object, one of TrashEntryManifest,
+	// TrashEntryTag or TrashEntryBlob.
+	Kind string `json:"kind"`
+
+	// Digest is the digest of the deleted manifest or blob, or of the
+	// manifest the deleted tag pointed to.
+	Digest digest.Digest `json:"digest"`
+
+	// Tag is the deleted tag.
+	Tag string `json:"tag,omitempty"`
+
+	// Tags are the tags deleted along with a manifest.
+	Tags []string `json:"tags,omitempty"`
+
+	// Actor is the name of the user who deleted the object, if
+	// authenticated.
+	Actor string `json:"actor,omitempty"`
+
+	// DeletedAt is the time of the deletion.
+	DeletedAt time.Time `json:"deletedAt"`
+
+	// ExpiresAt is the time after which the entry is purged by the garbage
+	// collection, along with the content only it references.
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// RepositoryTrash provides access to the manifests, tags and blobs soft
+// deleted from a repository, which may be restored until they expire.
+type RepositoryTrash interface {
+	// Trash returns the entries of the trash of the repository, from the
+	// oldest to the most recent one. err is set to ErrUnsupported if soft
+	// deletion is not enabled.
+	Trash(ctx context.Context) ([]TrashEntry, error)
+
+	// Restore restores the deleted object and removes the entry from the
+	// trash. err is set to ErrTrashEntryUnknown if there is no such entry,
+	// or to ErrBlobUnknown if its content was already removed.
+	Restore(ctx context.Context, id string) error
+
+	// Purge removes the entry from the trash, leaving the content only it
+	// references to the next garbage collection.
+	Purge(ctx context.Context, id string) error
+}
+
+// RepositoryFreezer freezes repositories. The content of a frozen repository
+// can be pulled, but nothing can be pushed to nor deleted from it.
+type RepositoryFreezer interface {
+	// Frozen reports whether the repository is frozen.
+	Frozen(ctx context.Context) (bool, error)
+
+	// SetFrozen freezes or unfreezes the repository.
+	SetFrozen(ctx context.Context, frozen bool) error
+}
+
+// RepositoryRenamer renames repositories, moving their content rather than
+// copying it.
+type RepositoryRenamer interface {
+	// Rename moves the manifests, tags and layer links of the repository
+	// from to the repository to. err is set to ErrRepositoryUnknown if from
+	// does not exist, or to ErrRepositoryExists if to does. If aliasTTL is
+	// positive, from remains an alias of to for that duration.
+	Rename(ctx context.Context, from, to reference.Named, aliasTTL time.Duration) error
+
+	// Alias returns the repository name is an alias of, or nil if name is
+	// not an alias or its alias expired.
+	Alias(ctx context.Context, name reference.Named) (reference.Named, error)
+}
+
 // RepositoryRemover removes given repository
 type RepositoryRemover interface {
 	Remove(ctx context.Context, name reference.Named) error
@@ -0,0 +1,82 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/distribution/distribution/v3/registry/client/auth"
+	"github.com/distribution/distribution/v3/registry/client/auth/challenge"
+)
+
+// adminCredentials are the credentials of the admin of the registry.
+type adminCredentials struct {
+	username, password string
+}
+
+func (c adminCredentials) Basic(*url.URL) (string, string) {
+	return c.username, c.password
+}
+
+func (c adminCredentials) RefreshToken(*url.URL, string) string {
+	return ""
+}
+
+func (c adminCredentials) SetRefreshToken(*url.URL, string, string) {}
+
+// adminRequest sends a request to the admin route at path of the registry at
+// registryURL, authenticating as its admin when challenged.
+func adminRequest(ctx context.Context, registryURL string, creds adminCredentials, method, path string, body []byte) (*http.Response, error) {
+	adminURL := strings.TrimSuffix(registryURL, "/") + path
+	newRequest := func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, method, adminURL, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		return req, nil
+	}
+
+	req, err := newRequest()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+
+	// the admin routes are challenged like the v2 API, with the admin scope
+	// for token authentication
+	handlers := []auth.AuthenticationHandler{
+		auth.NewTokenHandlerWithOptions(auth.TokenHandlerOptions{
+			Transport:   http.DefaultTransport,
+			Credentials: creds,
+			Scopes:      []auth.Scope{auth.RegistryScope{Name: "admin", Actions: []string{"*"}}},
+		}),
+		auth.NewBasicHandler(creds),
+	}
+	challenges := challenge.ResponseChallenges(resp)
+	resp.Body.Close()
+
+	if req, err = newRequest(); err != nil {
+		return nil, err
+	}
+	for _, handler := range handlers {
+		for _, c := range challenges {
+			if strings.EqualFold(c.Scheme, handler.Scheme()) {
+				if err := handler.AuthorizeRequest(req, c.Parameters); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return http.DefaultClient.Do(req)
+}
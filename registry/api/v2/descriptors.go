@@ -88,6 +88,13 @@ var (
 		Format:      "<digest>",
 	}
 
+	ifNoneMatchHeader = ParameterDescriptor{
+		Name:        "If-None-Match",
+		Type:        "string",
+		Description: "Entity tags of the manifests the client already has, the quoted digests of the `Etag` headers of previous responses.",
+		Format:      `"<digest>", ...`,
+	}
+
 	linkHeader = ParameterDescriptor{
 		Name:        "Link",
 		Type:        "link",
@@ -112,6 +119,43 @@ var (
 		},
 	}
 
+	// tagsPaginationParameters differ from paginationParameters in that all
+	// the tags are returned when n is not present.
+	tagsPaginationParameters = []ParameterDescriptor{
+		{
+			Name:        "n",
+			Type:        "integer",
+			Description: "Limit the number of entries in each response. It not present, all entries will be returned.",
+			Format:      "<integer>",
+			Required:    false,
+		},
+		paginationParameters[1],
+	}
+
+	catalogIndexParameters = []ParameterDescriptor{
+		{
+			Name:        "n",
+			Type:        "integer",
+			Description: "Limit the number of entries in each response. It not present, 100 entries will be returned. With 0, only the total is returned.",
+			Format:      "<integer>",
+			Required:    false,
+		},
+		{
+			Name:        "prefix",
+			Type:        "string",
+			Description: "Only list the repositories whose name starts with prefix.",
+			Format:      "<string>",
+			Required:    false,
+		},
+		{
+			Name:        "token",
+			Type:        "string",
+			Description: "Pagination token of the `Link` header of the previous response, carrying the position of the next page and the total of the first one.",
+			Format:      "<string>",
+			Required:    false,
+		},
+	}
+
 	unauthorizedResponseDescriptor = ResponseDescriptor{
 		Name:        "Authentication Required",
 		StatusCode:  http.StatusUnauthorized,
@@ -214,7 +258,7 @@ const (
 }`
 
 	errorsBody = `{
-	"errors:" [
+	"errors": [
 	    {
             "code": <error code>,
             "message": "<error message>",
@@ -463,7 +507,7 @@ var routeDescriptors = []RouteDescriptor{
 						Name:            "Tags Paginated",
 						Description:     "Return a portion of the tags for the specified repository.",
 						PathParameters:  []ParameterDescriptor{nameParameterDescriptor},
-						QueryParameters: paginationParameters,
+						QueryParameters: tagsPaginationParameters,
 						Successes: []ResponseDescriptor{
 							{
 								StatusCode:  http.StatusOK,
@@ -485,6 +529,184 @@ var routeDescriptors = []RouteDescriptor{
         <tag>,
         ...
     ],
+}`,
+								},
+							},
+						},
+						Failures: []ResponseDescriptor{
+							{
+								Name:        "Invalid pagination number",
+								Description: "The received parameter n was invalid in some way, as described by the error code. The client should resolve the issue and retry the request.",
+								StatusCode:  http.StatusBadRequest,
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+								ErrorCodes: []errcode.ErrorCode{
+									ErrorCodePaginationNumberInvalid,
+								},
+							},
+							unauthorizedResponseDescriptor,
+							repositoryNotFoundResponseDescriptor,
+							deniedResponseDescriptor,
+							tooManyRequestsDescriptor,
+						},
+					},
+				},
+			},
+		},
+	},
+	{
+		Name:        RouteNameTagHistory,
+		Path:        "/v2/{name:" + reference.NameRegexp.String() + "}/_tags/history",
+		Entity:      "Tag History",
+		Description: "Retrieve the history of the tags, an extension of the registry.",
+		Methods: []MethodDescriptor{
+			{
+				Method:      "GET",
+				Description: "Fetch, for the tags under the repository identified by `name`, their current manifest, the manifests they pointed to before and the log of their changes.",
+				Requests: []RequestDescriptor{
+					{
+						Name:        "Tag History",
+						Description: "Return the history of the tags of the repository, or of a single tag, including a deleted one.",
+						Headers: []ParameterDescriptor{
+							hostHeader,
+							authHeader,
+						},
+						PathParameters: []ParameterDescriptor{
+							nameParameterDescriptor,
+						},
+						QueryParameters: append([]ParameterDescriptor{
+							{
+								Name:        "tag",
+								Type:        "query",
+								Format:      "<tag>",
+								Required:    false,
+								Description: "Only return the history of the given tag. Pagination parameters are ignored.",
+							},
+						}, paginationParameters...),
+						Successes: []ResponseDescriptor{
+							{
+								StatusCode:  http.StatusOK,
+								Description: "The history of the tags, in the order of their names. Previous digests are listed from the most recent one, events from the oldest one.",
+								Headers: []ParameterDescriptor{
+									{
+										Name:        "Content-Length",
+										Type:        "integer",
+										Description: "Length of the JSON response body.",
+										Format:      "<length>",
+									},
+									linkHeader,
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format: `{
+    "name": <name>,
+    "tags": [
+        {
+            "tag": <tag>,
+            "digest": <digest>,
+            "previous": [<digest>, ...],
+            "lastModified": <timestamp>,
+            "events": [
+                {
+                    "action": "tag" | "untag",
+                    "digest": <digest>,
+                    "previous": <digest>,
+                    "actor": <user name>,
+                    "timestamp": <timestamp>
+                },
+                ...
+            ]
+        },
+        ...
+    ]
+}`,
+								},
+							},
+						},
+						Failures: []ResponseDescriptor{
+							{
+								Name:        "Invalid pagination number",
+								Description: "The received parameter n was invalid in some way, as described by the error code. The client should resolve the issue and retry the request.",
+								StatusCode:  http.StatusBadRequest,
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+								ErrorCodes: []errcode.ErrorCode{
+									ErrorCodePaginationNumberInvalid,
+								},
+							},
+							{
+								Name:        "Unknown Tag",
+								Description: "The tag requested with the `tag` parameter is not known to the repository and has no history.",
+								StatusCode:  http.StatusNotFound,
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+								ErrorCodes: []errcode.ErrorCode{
+									ErrorCodeManifestUnknown,
+								},
+							},
+							unauthorizedResponseDescriptor,
+							repositoryNotFoundResponseDescriptor,
+							deniedResponseDescriptor,
+							tooManyRequestsDescriptor,
+						},
+					},
+				},
+			},
+		},
+	},
+	{
+		Name:        RouteNameUntagged,
+		Path:        "/v2/{name:" + reference.NameRegexp.String() + "}/_manifests/untagged",
+		Entity:      "Untagged Manifests",
+		Description: "List the manifests no tag references, an extension of the registry.",
+		Methods: []MethodDescriptor{
+			{
+				Method:      "GET",
+				Description: "Fetch the manifests of the repository identified by `name` which are neither tagged nor referenced by a tagged manifest, with the time they were pushed.",
+				Requests: []RequestDescriptor{
+					{
+						Name:        "Untagged Manifests",
+						Description: "Return the untagged manifests of the repository, in the order of their digests.",
+						Headers: []ParameterDescriptor{
+							hostHeader,
+							authHeader,
+						},
+						PathParameters: []ParameterDescriptor{
+							nameParameterDescriptor,
+						},
+						QueryParameters: paginationParameters,
+						Successes: []ResponseDescriptor{
+							{
+								StatusCode:  http.StatusOK,
+								Description: "The untagged manifests of the repository, in the order of their digests.",
+								Headers: []ParameterDescriptor{
+									{
+										Name:        "Content-Length",
+										Type:        "integer",
+										Description: "Length of the JSON response body.",
+										Format:      "<length>",
+									},
+									linkHeader,
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format: `{
+    "name": <name>,
+    "manifests": [
+        {
+            "digest": <digest>,
+            "mediaType": <media type>,
+            "subject": <digest>,
+            "created": <timestamp>
+        },
+        ...
+    ]
 }`,
 								},
 							},
@@ -526,6 +748,7 @@ var routeDescriptors = []RouteDescriptor{
 						Headers: []ParameterDescriptor{
 							hostHeader,
 							authHeader,
+							ifNoneMatchHeader,
 						},
 						PathParameters: []ParameterDescriptor{
 							nameParameterDescriptor,
@@ -543,6 +766,18 @@ var routeDescriptors = []RouteDescriptor{
 									Format:      manifestBody,
 								},
 							},
+							{
+								Description: "The manifest identified by `name` and `reference` matches the `If-None-Match` header, the client already has it.",
+								StatusCode:  http.StatusNotModified,
+								Headers: []ParameterDescriptor{
+									{
+										Name:        "Etag",
+										Type:        "string",
+										Description: "The quoted digest of the manifest.",
+										Format:      `"<digest>"`,
+									},
+								},
+							},
 						},
 						Failures: []ResponseDescriptor{
 							{
@@ -573,6 +808,18 @@ var routeDescriptors = []RouteDescriptor{
 						Headers: []ParameterDescriptor{
 							hostHeader,
 							authHeader,
+							{
+								Name:        "If-Match",
+								Type:        "string",
+								Description: "When `reference` is a tag, only put the manifest if the tag references one of the manifests with the given entity tags, or exists with `*`.",
+								Format:      `"<digest>", ...`,
+							},
+							{
+								Name:        "If-None-Match",
+								Type:        "string",
+								Description: "When `reference` is a tag, only put the manifest if the tag does not reference one of the manifests with the given entity tags, or does not exist with `*`.",
+								Format:      `"<digest>", ...`,
+							},
 						},
 						PathParameters: []ParameterDescriptor{
 							nameParameterDescriptor,
@@ -629,7 +876,7 @@ var routeDescriptors = []RouteDescriptor{
 								Body: BodyDescriptor{
 									ContentType: "application/json",
 									Format: `{
-    "errors:" [{
+    "errors": [{
             "code": "BLOB_UNKNOWN",
             "message": "blob unknown to registry",
             "detail": {
@@ -641,6 +888,18 @@ var routeDescriptors = []RouteDescriptor{
 }`,
 								},
 							},
+							{
+								Name:        "Precondition Failed",
+								Description: "The tag does not reference the manifest expected by the `If-Match` header, or references a manifest excluded by the `If-None-Match` header, it was likely updated concurrently. The client should fetch the tag again before retrying.",
+								StatusCode:  http.StatusPreconditionFailed,
+								ErrorCodes: []errcode.ErrorCode{
+									ErrorCodePreconditionFailed,
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+							},
 							{
 								Name:        "Not allowed",
 								Description: "Manifest put is not allowed because the registry is configured as a pull-through cache or for some other reason",
@@ -651,6 +910,83 @@ var routeDescriptors = []RouteDescriptor{
 							},
 						},
 					},
+					{
+						Name:        "Mount Manifest",
+						Description: "Mount the manifest identified by the `mount` parameter from another repository, along with the blobs and manifests it references, and tag it if `reference` is a tag. The manifest is copied server-side, without the client pulling and pushing its content.",
+						Headers: []ParameterDescriptor{
+							hostHeader,
+							authHeader,
+							contentLengthZeroHeader,
+						},
+						PathParameters: []ParameterDescriptor{
+							nameParameterDescriptor,
+							referenceParameterDescriptor,
+						},
+						QueryParameters: []ParameterDescriptor{
+							{
+								Name:        "mount",
+								Type:        "query",
+								Format:      "<digest>",
+								Regexp:      digest.DigestRegexp,
+								Description: `Digest of the manifest to mount from the source repository. It must match the reference, if it is a digest.`,
+							},
+							{
+								Name:        "from",
+								Type:        "query",
+								Format:      "<repository name>",
+								Regexp:      reference.NameRegexp,
+								Description: `Name of the source repository.`,
+							},
+						},
+						Successes: []ResponseDescriptor{
+							{
+								Description: "The manifest has been mounted in the repository and is available at the provided location.",
+								StatusCode:  http.StatusCreated,
+								Headers: []ParameterDescriptor{
+									{
+										Name:        "Location",
+										Type:        "url",
+										Description: "The canonical location url of the mounted manifest.",
+										Format:      "<url>",
+									},
+									contentLengthZeroHeader,
+									digestHeader,
+								},
+							},
+						},
+						Failures: []ResponseDescriptor{
+							{
+								Name:       "Invalid Name or Digest",
+								StatusCode: http.StatusBadRequest,
+								ErrorCodes: []errcode.ErrorCode{
+									ErrorCodeDigestInvalid,
+									ErrorCodeNameInvalid,
+									ErrorCodeTagInvalid,
+									ErrorCodeManifestBlobUnknown,
+								},
+							},
+							{
+								Name:        "Unknown Manifest",
+								Description: "The manifest is not in the source repository.",
+								StatusCode:  http.StatusNotFound,
+								ErrorCodes: []errcode.ErrorCode{
+									ErrorCodeManifestUnknown,
+								},
+							},
+							{
+								Name:        "Not allowed",
+								Description: "Manifest mount is not allowed because the registry is configured as a pull-through cache or for some other reason",
+								StatusCode:  http.StatusMethodNotAllowed,
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeUnsupported,
+								},
+							},
+							unauthorizedResponseDescriptor,
+							repositoryNotFoundResponseDescriptor,
+							deniedResponseDescriptor,
+							tooManyRequestsDescriptor,
+						},
+					},
 				},
 			},
 			{
@@ -717,6 +1053,97 @@ var routeDescriptors = []RouteDescriptor{
 		},
 	},
 
+	{
+		Name:        RouteNameReferrers,
+		Path:        "/v2/{name:" + reference.NameRegexp.String() + "}/referrers/{digest:" + digest.DigestRegexp.String() + "}",
+		Entity:      "Referrers",
+		Description: "Retrieve the manifests referring to the manifest identified by `name` and `digest` through their `subject` field.",
+		Methods: []MethodDescriptor{
+			{
+				Method:      "GET",
+				Description: "Fetch an image index listing the manifests which declare the manifest identified by `digest` as their subject.",
+				Requests: []RequestDescriptor{
+					{
+						Name:        "Referrers",
+						Description: "Return all referrers of the manifest. An empty index is returned if there are none.",
+						Headers: []ParameterDescriptor{
+							hostHeader,
+							authHeader,
+						},
+						PathParameters: []ParameterDescriptor{
+							nameParameterDescriptor,
+							digestPathParameter,
+						},
+						QueryParameters: []ParameterDescriptor{
+							{
+								Name:        "artifactType",
+								Type:        "query",
+								Format:      "<media type>",
+								Required:    false,
+								Description: "Only return referrers of the given artifact type.",
+							},
+						},
+						Successes: []ResponseDescriptor{
+							{
+								StatusCode:  http.StatusOK,
+								Description: "An image index of the referrers of the manifest.",
+								Headers: []ParameterDescriptor{
+									{
+										Name:        "Content-Length",
+										Type:        "integer",
+										Description: "Length of the JSON response body.",
+										Format:      "<length>",
+									},
+									{
+										Name:        "OCI-Filters-Applied",
+										Type:        "string",
+										Description: "Set to `artifactType` when the results were filtered by artifact type.",
+										Format:      "artifactType",
+									},
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/vnd.oci.image.index.v1+json",
+									Format: `{
+    "schemaVersion": 2,
+    "mediaType": "application/vnd.oci.image.index.v1+json",
+    "manifests": [
+        {
+            "mediaType": <media type>,
+            "size": <size>,
+            "digest": <digest>,
+            "artifactType": <artifact type>,
+            "annotations": <annotations>
+        },
+        ...
+    ]
+}`,
+								},
+							},
+						},
+						Failures: []ResponseDescriptor{
+							{
+								Name:        "Invalid Digest",
+								Description: "The provided digest was invalid.",
+								StatusCode:  http.StatusBadRequest,
+								ErrorCodes: []errcode.ErrorCode{
+									ErrorCodeDigestInvalid,
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+							},
+							unauthorizedResponseDescriptor,
+							repositoryNotFoundResponseDescriptor,
+							deniedResponseDescriptor,
+							tooManyRequestsDescriptor,
+						},
+					},
+				},
+			},
+		},
+	},
+
 	{
 		Name:        RouteNameBlob,
 		Path:        "/v2/{name:" + reference.NameRegexp.String() + "}/blobs/{digest:" + digest.DigestRegexp.String() + "}",
@@ -888,52 +1315,135 @@ var routeDescriptors = []RouteDescriptor{
 						},
 						PathParameters: []ParameterDescriptor{
 							nameParameterDescriptor,
-							digestPathParameter,
+							digestPathParameter,
+						},
+						Successes: []ResponseDescriptor{
+							{
+								StatusCode: http.StatusAccepted,
+								Headers: []ParameterDescriptor{
+									{
+										Name:        "Content-Length",
+										Type:        "integer",
+										Description: "0",
+										Format:      "0",
+									},
+									digestHeader,
+								},
+							},
+						},
+						Failures: []ResponseDescriptor{
+							{
+								Name:       "Invalid Name or Digest",
+								StatusCode: http.StatusBadRequest,
+								ErrorCodes: []errcode.ErrorCode{
+									ErrorCodeDigestInvalid,
+									ErrorCodeNameInvalid,
+								},
+							},
+							{
+								Description: "The blob, identified by `name` and `digest`, is unknown to the registry.",
+								StatusCode:  http.StatusNotFound,
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+								ErrorCodes: []errcode.ErrorCode{
+									ErrorCodeNameUnknown,
+									ErrorCodeBlobUnknown,
+								},
+							},
+							{
+								Description: "Blob delete is not allowed because the registry is configured as a pull-through cache or `delete` has been disabled",
+								StatusCode:  http.StatusMethodNotAllowed,
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeUnsupported,
+								},
+							},
+							unauthorizedResponseDescriptor,
+							repositoryNotFoundResponseDescriptor,
+							deniedResponseDescriptor,
+							tooManyRequestsDescriptor,
+						},
+					},
+				},
+			},
+
+			// TODO(stevvooe): We may want to add a PUT request here to
+			// kickoff an upload of a blob, integrated with the blob upload
+			// API.
+		},
+	},
+
+	{
+		Name:        RouteNameBlobsExist,
+		Path:        "/v2/{name:" + reference.NameRegexp.String() + "}/_blobs/exist",
+		Entity:      "Blobs Existence",
+		Description: "Check the existence of several blobs at once, an extension of the registry.",
+		Methods: []MethodDescriptor{
+			{
+				Method:      "POST",
+				Description: "Check which blobs of a list of digests exist in the repository identified by `name`, with their size, as many `HEAD` requests on the blobs would.",
+				Requests: []RequestDescriptor{
+					{
+						Name:        "Blobs Existence",
+						Description: "Check the existence of the blobs of the digests, at most 1000 of them.",
+						Headers: []ParameterDescriptor{
+							hostHeader,
+							authHeader,
+						},
+						PathParameters: []ParameterDescriptor{
+							nameParameterDescriptor,
+						},
+						Body: BodyDescriptor{
+							ContentType: "application/json",
+							Format: `{
+    "digests": [
+        <digest>,
+        ...
+    ]
+}`,
 						},
 						Successes: []ResponseDescriptor{
 							{
-								StatusCode: http.StatusAccepted,
+								StatusCode:  http.StatusOK,
+								Description: "The blobs of the digests which exist in the repository, in the order of the request. The digests of the missing blobs are omitted.",
 								Headers: []ParameterDescriptor{
 									{
 										Name:        "Content-Length",
 										Type:        "integer",
-										Description: "0",
-										Format:      "0",
+										Description: "Length of the JSON response body.",
+										Format:      "<length>",
 									},
-									digestHeader,
-								},
-							},
-						},
-						Failures: []ResponseDescriptor{
-							{
-								Name:       "Invalid Name or Digest",
-								StatusCode: http.StatusBadRequest,
-								ErrorCodes: []errcode.ErrorCode{
-									ErrorCodeDigestInvalid,
-									ErrorCodeNameInvalid,
 								},
-							},
-							{
-								Description: "The blob, identified by `name` and `digest`, is unknown to the registry.",
-								StatusCode:  http.StatusNotFound,
 								Body: BodyDescriptor{
 									ContentType: "application/json",
-									Format:      errorsBody,
-								},
-								ErrorCodes: []errcode.ErrorCode{
-									ErrorCodeNameUnknown,
-									ErrorCodeBlobUnknown,
+									Format: `{
+    "blobs": [
+        {
+            "digest": <digest>,
+            "size": <size>
+        },
+        ...
+    ]
+}`,
 								},
 							},
+						},
+						Failures: []ResponseDescriptor{
 							{
-								Description: "Blob delete is not allowed because the registry is configured as a pull-through cache or `delete` has been disabled",
-								StatusCode:  http.StatusMethodNotAllowed,
+								Name:        "Invalid Digest",
+								Description: "The body is not a valid list of digests, or lists more than 1000 of them.",
+								StatusCode:  http.StatusBadRequest,
 								Body: BodyDescriptor{
 									ContentType: "application/json",
 									Format:      errorsBody,
 								},
 								ErrorCodes: []errcode.ErrorCode{
-									errcode.ErrorCodeUnsupported,
+									ErrorCodeDigestInvalid,
 								},
 							},
 							unauthorizedResponseDescriptor,
@@ -944,10 +1454,6 @@ var routeDescriptors = []RouteDescriptor{
 					},
 				},
 			},
-
-			// TODO(stevvooe): We may want to add a PUT request here to
-			// kickoff an upload of a blob, integrated with the blob upload
-			// API.
 		},
 	},
 
@@ -963,7 +1469,7 @@ var routeDescriptors = []RouteDescriptor{
 				Requests: []RequestDescriptor{
 					{
 						Name:        "Initiate Monolithic Blob Upload",
-						Description: "Upload a blob identified by the `digest` parameter in single request. This upload will not be resumable unless a recoverable error is returned.",
+						Description: "Upload a blob identified by the `digest` parameter in single request. This upload will not be resumable unless a recoverable error is returned. If the repository already has the blob, the upload completes without reading the request body.",
 						Headers: []ParameterDescriptor{
 							hostHeader,
 							authHeader,
@@ -1364,8 +1870,30 @@ var routeDescriptors = []RouteDescriptor{
 								},
 							},
 							{
-								Description: "The `Content-Range` specification cannot be accepted, either because it does not overlap with the current progress or it is invalid.",
+								Description: "The `Content-Range` specification cannot be accepted, either because it is invalid, overlaps the data uploaded or a chunk held, leaves a gap after the data uploaded while out of order chunks are not accepted, or would be held while too many chunks are. The current progress is available in the range header, from which the client can resume the upload.",
 								StatusCode:  http.StatusRequestedRangeNotSatisfiable,
+								Headers: []ParameterDescriptor{
+									{
+										Name:        "Location",
+										Type:        "url",
+										Format:      "/v2/<name>/blobs/uploads/<uuid>",
+										Description: "The location of the upload. Clients should assume this changes after each request. Clients should use the contents verbatim to complete the upload, adding parameters where required.",
+									},
+									{
+										Name:        "Range",
+										Type:        "header",
+										Format:      "0-<offset>",
+										Description: "Range indicating the current progress of the upload.",
+									},
+									dockerUploadUUIDHeader,
+								},
+								ErrorCodes: []errcode.ErrorCode{
+									ErrorCodeRangeInvalid,
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
 							},
 							unauthorizedResponseDescriptor,
 							repositoryNotFoundResponseDescriptor,
@@ -1591,6 +2119,251 @@ var routeDescriptors = []RouteDescriptor{
 							},
 						},
 					},
+					{
+						Name:            "Catalog Fetch Indexed",
+						Description:     "Return the specified portion of the repositories whose name starts with prefix, along with their total number. Only available when the registry maintains a catalog index.",
+						QueryParameters: catalogIndexParameters,
+						Successes: []ResponseDescriptor{
+							{
+								StatusCode: http.StatusOK,
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format: `{
+	"repositories": [
+		<name>,
+		...
+	],
+	"total": <total number of repositories starting with prefix>
+}`,
+								},
+								Headers: []ParameterDescriptor{
+									{
+										Name:        "Content-Length",
+										Type:        "integer",
+										Description: "Length of the JSON response body.",
+										Format:      "<length>",
+									},
+									linkHeader,
+								},
+							},
+						},
+						Failures: []ResponseDescriptor{
+							{
+								Name:        "Invalid pagination",
+								Description: "The pagination token is invalid.",
+								StatusCode:  http.StatusBadRequest,
+								ErrorCodes: []errcode.ErrorCode{
+									ErrorCodePaginationTokenInvalid,
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	},
+	{
+		Name:        RouteNameCatalogActivity,
+		Path:        "/v2/_catalog/_activity",
+		Entity:      "Catalog Activity",
+		Description: "List the repositories of the registry with the time of their last push, an extension of the registry available when it maintains a catalog index.",
+		Methods: []MethodDescriptor{
+			{
+				Method:      "GET",
+				Description: "Retrieve a sorted, json list of repositories available in the registry, with the time of their last manifest push.",
+				Requests: []RequestDescriptor{
+					{
+						Name:            "Catalog Activity Fetch",
+						Description:     "Return the specified portion of the repositories whose name starts with prefix, with the time of their last push and their total number. The time of the last push is omitted for the repositories not pushed since the catalog index was built.",
+						QueryParameters: catalogIndexParameters,
+						Successes: []ResponseDescriptor{
+							{
+								StatusCode: http.StatusOK,
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format: `{
+	"repositories": [
+		{
+			"name": <name>,
+			"lastPush": "<RFC 3339 timestamp>"
+		},
+		...
+	],
+	"total": <total number of repositories starting with prefix>
+}`,
+								},
+								Headers: []ParameterDescriptor{
+									{
+										Name:        "Content-Length",
+										Type:        "integer",
+										Description: "Length of the JSON response body.",
+										Format:      "<length>",
+									},
+									linkHeader,
+								},
+							},
+						},
+						Failures: []ResponseDescriptor{
+							{
+								Name:        "Invalid pagination",
+								Description: "The pagination token is invalid.",
+								StatusCode:  http.StatusBadRequest,
+								ErrorCodes: []errcode.ErrorCode{
+									ErrorCodePaginationTokenInvalid,
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+							},
+							{
+								Name:        "Unsupported",
+								Description: "The registry does not maintain a catalog index.",
+								StatusCode:  http.StatusMethodNotAllowed,
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeUnsupported,
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	},
+	{
+		Name:        RouteNameEvents,
+		Path:        "/v2/_events",
+		Entity:      "Events",
+		Description: "Stream the events of the registry, an extension of the registry available when the event stream is enabled.",
+		Methods: []MethodDescriptor{
+			{
+				Method:      "GET",
+				Description: "Stream the registry events as server-sent events, as they occur.",
+				Requests: []RequestDescriptor{
+					{
+						Name:        "Events Stream",
+						Description: "Stream the events matching the filters. Each event is sent with its id and its action as the event type, and its JSON encoding as data. Comments are sent periodically to keep the connection open, as well as a `dropped` event when events were dropped because the client did not receive them fast enough. The response never ends unless the registry shuts down, which clients should handle by reconnecting.",
+						QueryParameters: []ParameterDescriptor{
+							{
+								Name:        "repository",
+								Type:        "string",
+								Description: "Only stream the events of the repositories matching the pattern, either a glob such as `prod/*` or a regular expression prefixed with `regexp:`. May be repeated to match several patterns.",
+								Format:      "<pattern>",
+								Required:    false,
+							},
+							{
+								Name:        "action",
+								Type:        "string",
+								Description: "Only stream the events with the action, such as `push`, `pull` or `delete`. May be repeated to match several actions.",
+								Format:      "<action>",
+								Required:    false,
+							},
+						},
+						Successes: []ResponseDescriptor{
+							{
+								StatusCode: http.StatusOK,
+								Body: BodyDescriptor{
+									ContentType: "text/event-stream",
+									Format: `id: <event id>
+event: <action>
+data: <event>
+
+...`,
+								},
+							},
+						},
+						Failures: []ResponseDescriptor{
+							{
+								Name:        "Invalid pattern",
+								Description: "A repository pattern is invalid.",
+								StatusCode:  http.StatusBadRequest,
+								ErrorCodes: []errcode.ErrorCode{
+									ErrorCodeNameInvalid,
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+							},
+							unauthorizedResponseDescriptor,
+							{
+								Name:        "Unsupported",
+								Description: "The event stream is not enabled.",
+								StatusCode:  http.StatusMethodNotAllowed,
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeUnsupported,
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	},
+	// The repository route matches any repository name, which may contain
+	// slashes, so it must be registered after all other routes.
+	{
+		Name:        RouteNameRepository,
+		Path:        "/v2/{name:" + reference.NameRegexp.String() + "}",
+		Entity:      "Repository",
+		Description: "Delete an entire repository identified by `name`.",
+		Methods: []MethodDescriptor{
+			{
+				Method:      "DELETE",
+				Description: "Delete the repository identified by `name`, including its manifests, tags, layer links and uploads. Blobs are reclaimed by garbage collection.",
+				Requests: []RequestDescriptor{
+					{
+						Headers: []ParameterDescriptor{
+							hostHeader,
+							authHeader,
+						},
+						PathParameters: []ParameterDescriptor{
+							nameParameterDescriptor,
+						},
+						Successes: []ResponseDescriptor{
+							{
+								StatusCode: http.StatusAccepted,
+							},
+						},
+						Failures: []ResponseDescriptor{
+							{
+								Name:        "Invalid Name",
+								Description: "The specified `name` was invalid.",
+								StatusCode:  http.StatusBadRequest,
+								ErrorCodes: []errcode.ErrorCode{
+									ErrorCodeNameInvalid,
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+							},
+							unauthorizedResponseDescriptor,
+							repositoryNotFoundResponseDescriptor,
+							deniedResponseDescriptor,
+							tooManyRequestsDescriptor,
+							{
+								Name:        "Not allowed",
+								Description: "Repository delete is not allowed because the registry is configured as a pull-through cache, `repositories` deletion has not been enabled, or soft deletion is enabled.",
+								StatusCode:  http.StatusMethodNotAllowed,
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeUnsupported,
+								},
+							},
+						},
+					},
 				},
 			},
 		},
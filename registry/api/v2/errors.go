@@ -154,4 +154,36 @@ var (
 		to return) is not an integer, or "n" is negative.`,
 		HTTPStatusCode: http.StatusBadRequest,
 	})
+
+	// ErrorCodePaginationTokenInvalid is returned when the `token` parameter
+	// is not a token returned in a pagination link.
+	ErrorCodePaginationTokenInvalid = errcode.Register(errGroup, errcode.ErrorDescriptor{
+		Value:   "PAGINATION_TOKEN_INVALID",
+		Message: "invalid pagination token",
+		Description: `Returned when the "token" parameter is not a
+		pagination token returned in a "Link" header.`,
+		HTTPStatusCode: http.StatusBadRequest,
+	})
+
+	// ErrorCodeRepositoryFrozen is returned when pushing to or deleting from
+	// a frozen repository.
+	ErrorCodeRepositoryFrozen = errcode.Register(errGroup, errcode.ErrorDescriptor{
+		Value:   "REPOSITORY_FROZEN",
+		Message: "repository is frozen",
+		Description: `Returned when content is pushed to or deleted from a
+		repository frozen by an administrator, whose content can only be
+		pulled.`,
+		HTTPStatusCode: http.StatusForbidden,
+	})
+
+	// ErrorCodePreconditionFailed is returned when the conditional headers
+	// of a manifest PUT by tag do not match the manifest the tag references.
+	ErrorCodePreconditionFailed = errcode.Register(errGroup, errcode.ErrorDescriptor{
+		Value:   "PRECONDITION_FAILED",
+		Message: "precondition failed",
+		Description: `Returned when a manifest is put by tag with an
+		"If-Match" header not matching the manifest the tag references, or
+		an "If-None-Match" header matching it.`,
+		HTTPStatusCode: http.StatusPreconditionFailed,
+	})
 )
@@ -1,6 +1,7 @@
 package v2
 
 import (
+	"net/http"
 	"sync"
 
 	"github.com/gorilla/mux"
@@ -12,10 +13,17 @@ const (
 	RouteNameBase            = "base"
 	RouteNameManifest        = "manifest"
 	RouteNameTags            = "tags"
+	RouteNameTagHistory      = "tag-history"
+	RouteNameUntagged        = "untagged"
 	RouteNameBlob            = "blob"
+	RouteNameBlobsExist      = "blobs-exist"
 	RouteNameBlobUpload      = "blob-upload"
 	RouteNameBlobUploadChunk = "blob-upload-chunk"
 	RouteNameCatalog         = "catalog"
+	RouteNameCatalogActivity = "catalog-activity"
+	RouteNameEvents          = "events"
+	RouteNameReferrers       = "referrers"
+	RouteNameRepository      = "repository"
 )
 
 var (
@@ -45,7 +53,16 @@ func RouterWithPrefix(prefix string) *mux.Router {
 	router.StrictSlash(true)
 
 	for _, descriptor := range routeDescriptors {
-		router.Path(descriptor.Path).Name(descriptor.Name)
+		route := router.Path(descriptor.Path).Name(descriptor.Name)
+		if descriptor.Name == RouteNameRepository {
+			// The path of the repository route matches every path below a
+			// repository, so it only matches the deletions of repositories:
+			// the other requests to unknown paths are not found, rather
+			// than not allowed.
+			route.MatcherFunc(func(r *http.Request, rm *mux.RouteMatch) bool {
+				return r.Method == http.MethodDelete
+			})
+		}
 	}
 
 	return rootRouter
@@ -15,6 +15,7 @@ import (
 )
 
 type routeTestCase struct {
+	Method      string
 	RequestURI  string
 	ExpectedURI string
 	Vars        map[string]string
@@ -87,6 +88,35 @@ func TestRouter(t *testing.T) {
 				"name": "docker.com/foo/bar/baz",
 			},
 		},
+		{
+			RouteName:  RouteNameTagHistory,
+			RequestURI: "/v2/foo/bar/_tags/history",
+			Vars: map[string]string{
+				"name": "foo/bar",
+			},
+		},
+		{
+			RouteName:  RouteNameUntagged,
+			RequestURI: "/v2/foo/bar/_manifests/untagged",
+			Vars: map[string]string{
+				"name": "foo/bar",
+			},
+		},
+		{
+			RouteName:  RouteNameBlobsExist,
+			RequestURI: "/v2/foo/bar/_blobs/exist",
+			Vars: map[string]string{
+				"name": "foo/bar",
+			},
+		},
+		{
+			RouteName:  RouteNameReferrers,
+			RequestURI: "/v2/foo/bar/referrers/sha256:abcdef0919234",
+			Vars: map[string]string{
+				"name":   "foo/bar",
+				"digest": "sha256:abcdef0919234",
+			},
+		},
 		{
 			RouteName:  RouteNameBlob,
 			RequestURI: "/v2/foo/bar/blobs/sha256:abcdef0919234",
@@ -170,6 +200,31 @@ func TestRouter(t *testing.T) {
 				"reference": "tag",
 			},
 		},
+		{
+			Method:     http.MethodDelete,
+			RouteName:  RouteNameRepository,
+			RequestURI: "/v2/foo/bar",
+			Vars: map[string]string{
+				"name": "foo/bar",
+			},
+		},
+		{
+			// A repository named like a route suffix still resolves to
+			// the repository route when no other route matches.
+			Method:     http.MethodDelete,
+			RouteName:  RouteNameRepository,
+			RequestURI: "/v2/foo/bar/tags",
+			Vars: map[string]string{
+				"name": "foo/bar/tags",
+			},
+		},
+		{
+			// The other requests to unknown paths below a repository are
+			// not found.
+			RouteName:  RouteNameRepository,
+			RequestURI: "/v2/foo/bar/tags",
+			StatusCode: http.StatusNotFound,
+		},
 	}
 
 	checkTestRouter(t, testCases, "", true)
@@ -236,6 +291,7 @@ func checkTestRouter(t *testing.T, testCases []routeTestCase, prefix string, dee
 
 	testHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		testCase := routeTestCase{
+			Method:     r.Method,
 			RequestURI: r.RequestURI,
 			Vars:       mux.Vars(r),
 			RouteName:  mux.CurrentRoute(r).GetName(),
@@ -264,10 +320,17 @@ func checkTestRouter(t *testing.T, testCases []routeTestCase, prefix string, dee
 
 		u := server.URL + testcase.RequestURI
 
-		resp, err := http.Get(u)
+		if testcase.Method == "" {
+			testcase.Method = http.MethodGet
+		}
+		req, err := http.NewRequest(testcase.Method, u, nil)
+		if err != nil {
+			t.Fatalf("error creating request: %v", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
 
 		if err != nil {
-			t.Fatalf("error issuing get request: %v", err)
+			t.Fatalf("error issuing %s request: %v", testcase.Method, err)
 		}
 
 		if testcase.StatusCode == 0 {
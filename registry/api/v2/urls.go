@@ -127,6 +127,32 @@ func (ub *URLBuilder) BuildCatalogURL(values ...url.Values) (string, error) {
 	return appendValuesURL(catalogURL, values...).String(), nil
 }
 
+// BuildCatalogActivityURL constructs a url to list the repositories with the
+// time of their last push, including any url values.
+func (ub *URLBuilder) BuildCatalogActivityURL(values ...url.Values) (string, error) {
+	route := ub.cloneRoute(RouteNameCatalogActivity)
+
+	catalogActivityURL, err := route.URL()
+	if err != nil {
+		return "", err
+	}
+
+	return appendValuesURL(catalogActivityURL, values...).String(), nil
+}
+
+// BuildEventsURL constructs a url to stream the registry events, including
+// any url values.
+func (ub *URLBuilder) BuildEventsURL(values ...url.Values) (string, error) {
+	route := ub.cloneRoute(RouteNameEvents)
+
+	eventsURL, err := route.URL()
+	if err != nil {
+		return "", err
+	}
+
+	return appendValuesURL(eventsURL, values...).String(), nil
+}
+
 // BuildTagsURL constructs a url to list the tags in the named repository.
 func (ub *URLBuilder) BuildTagsURL(name reference.Named, values ...url.Values) (string, error) {
 	route := ub.cloneRoute(RouteNameTags)
@@ -139,6 +165,44 @@ func (ub *URLBuilder) BuildTagsURL(name reference.Named, values ...url.Values) (
 	return appendValuesURL(tagsURL, values...).String(), nil
 }
 
+// BuildTagHistoryURL constructs a url for the history of the tags of the
+// repository identified by name, including any url values.
+func (ub *URLBuilder) BuildTagHistoryURL(name reference.Named, values ...url.Values) (string, error) {
+	route := ub.cloneRoute(RouteNameTagHistory)
+
+	tagHistoryURL, err := route.URL("name", name.Name())
+	if err != nil {
+		return "", err
+	}
+
+	return appendValuesURL(tagHistoryURL, values...).String(), nil
+}
+
+// BuildUntaggedURL constructs a url for the untagged manifests of the
+// repository identified by name, including any url values.
+func (ub *URLBuilder) BuildUntaggedURL(name reference.Named, values ...url.Values) (string, error) {
+	route := ub.cloneRoute(RouteNameUntagged)
+
+	untaggedURL, err := route.URL("name", name.Name())
+	if err != nil {
+		return "", err
+	}
+
+	return appendValuesURL(untaggedURL, values...).String(), nil
+}
+
+// BuildRepositoryURL constructs a url for the repository identified by name.
+func (ub *URLBuilder) BuildRepositoryURL(name reference.Named) (string, error) {
+	route := ub.cloneRoute(RouteNameRepository)
+
+	repositoryURL, err := route.URL("name", name.Name())
+	if err != nil {
+		return "", err
+	}
+
+	return repositoryURL.String(), nil
+}
+
 // BuildManifestURL constructs a url for the manifest identified by name and
 // reference. The argument reference may be either a tag or digest.
 func (ub *URLBuilder) BuildManifestURL(ref reference.Named) (string, error) {
@@ -174,6 +238,32 @@ func (ub *URLBuilder) BuildBlobURL(ref reference.Canonical) (string, error) {
 	return layerURL.String(), nil
 }
 
+// BuildBlobsExistURL constructs the url checking the existence of several
+// blobs of the repository identified by name.
+func (ub *URLBuilder) BuildBlobsExistURL(name reference.Named) (string, error) {
+	route := ub.cloneRoute(RouteNameBlobsExist)
+
+	blobsExistURL, err := route.URL("name", name.Name())
+	if err != nil {
+		return "", err
+	}
+
+	return blobsExistURL.String(), nil
+}
+
+// BuildReferrersURL constructs a url for the referrers of the manifest
+// identified by name and digest, including any url values.
+func (ub *URLBuilder) BuildReferrersURL(ref reference.Canonical, values ...url.Values) (string, error) {
+	route := ub.cloneRoute(RouteNameReferrers)
+
+	referrersURL, err := route.URL("name", ref.Name(), "digest", ref.Digest().String())
+	if err != nil {
+		return "", err
+	}
+
+	return appendValuesURL(referrersURL, values...).String(), nil
+}
+
 // BuildBlobUploadURL constructs a url to begin a blob upload in the
 // repository identified by name.
 func (ub *URLBuilder) BuildBlobUploadURL(name reference.Named, values ...url.Values) (string, error) {
@@ -54,6 +54,42 @@ func makeURLBuilderTestCases(urlBuilder *URLBuilder) []urlBuilderTestCase {
 				})
 			},
 		},
+		{
+			description:  "test tag history url",
+			expectedPath: "/v2/foo/bar/_tags/history?tag=prod",
+			expectedErr:  nil,
+			build: func() (string, error) {
+				return urlBuilder.BuildTagHistoryURL(fooBarRef, url.Values{
+					"tag": []string{"prod"},
+				})
+			},
+		},
+		{
+			description:  "test untagged url",
+			expectedPath: "/v2/foo/bar/_manifests/untagged?n=10",
+			expectedErr:  nil,
+			build: func() (string, error) {
+				return urlBuilder.BuildUntaggedURL(fooBarRef, url.Values{
+					"n": []string{"10"},
+				})
+			},
+		},
+		{
+			description:  "test blobs exist url",
+			expectedPath: "/v2/foo/bar/_blobs/exist",
+			expectedErr:  nil,
+			build: func() (string, error) {
+				return urlBuilder.BuildBlobsExistURL(fooBarRef)
+			},
+		},
+		{
+			description:  "test repository url",
+			expectedPath: "/v2/foo/bar",
+			expectedErr:  nil,
+			build: func() (string, error) {
+				return urlBuilder.BuildRepositoryURL(fooBarRef)
+			},
+		},
 		{
 			description:  "test manifest url tagged ref",
 			expectedPath: "/v2/foo/bar/manifests/tag",
@@ -80,6 +116,17 @@ func makeURLBuilderTestCases(urlBuilder *URLBuilder) []urlBuilderTestCase {
 				return urlBuilder.BuildBlobURL(ref)
 			},
 		},
+		{
+			description:  "build referrers url",
+			expectedPath: "/v2/foo/bar/referrers/sha256:3b3692957d439ac1928219a83fac91e7bf96c153725526874673ae1f2023f8d5?artifactType=application%2Fexample",
+			expectedErr:  nil,
+			build: func() (string, error) {
+				ref, _ := reference.WithDigest(fooBarRef, "sha256:3b3692957d439ac1928219a83fac91e7bf96c153725526874673ae1f2023f8d5")
+				return urlBuilder.BuildReferrersURL(ref, url.Values{
+					"artifactType": []string{"application/example"},
+				})
+			},
+		},
 		{
 			description:  "build blob upload url",
 			expectedPath: "/v2/foo/bar/blobs/uploads/",
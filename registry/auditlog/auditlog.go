@@ -0,0 +1,150 @@
+// Package auditlog writes a structured record of each API request served by
+// the registry, suitable for auditing who did what to which repository.
+package auditlog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+)
+
+// Actions recorded for the API requests.
+const (
+	ActionPull    = "pull"
+	ActionPush    = "push"
+	ActionMount   = "mount"
+	ActionDelete  = "delete"
+	ActionList    = "list"
+	ActionCatalog = "catalog"
+	ActionPing    = "ping"
+)
+
+// Record describes an API request and its outcome.
+type Record struct {
+	// Time is when the request was received.
+	Time time.Time `json:"time"`
+
+	// CorrelationID identifies the request across the logs of the
+	// registry, including the storage driver logs. It is the value of the
+	// X-Correlation-ID header when set by the client, the request id
+	// otherwise.
+	CorrelationID string `json:"correlationId"`
+
+	// RequestID uniquely identifies the request.
+	RequestID string `json:"requestId"`
+
+	Actor ActorRecord `json:"actor"`
+
+	// Action is what the request does, such as pull or push. It is empty
+	// for requests which do not match an API route.
+	Action string `json:"action,omitempty"`
+
+	// Method and Route are the HTTP method and API route of the request.
+	Method string `json:"method"`
+	Route  string `json:"route,omitempty"`
+
+	Repository string `json:"repository,omitempty"`
+	Tag        string `json:"tag,omitempty"`
+	Digest     string `json:"digest,omitempty"`
+
+	// Status is the HTTP status code of the response.
+	Status int `json:"status"`
+
+	// BytesIn and BytesOut count the bytes of the request and response
+	// bodies.
+	BytesIn  int64 `json:"bytesIn"`
+	BytesOut int64 `json:"bytesOut"`
+
+	// Duration is how long the request took, in milliseconds.
+	Duration int64 `json:"durationMs"`
+
+	// Errors lists the codes of the API errors returned, if any.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// ActorRecord identifies the client who made the request.
+type ActorRecord struct {
+	// Name is the name of the authenticated user, if any.
+	Name      string `json:"name,omitempty"`
+	Addr      string `json:"addr,omitempty"`
+	UserAgent string `json:"userAgent,omitempty"`
+}
+
+// Logger writes audit records to a sink, one JSON object per line.
+type Logger struct {
+	mu sync.Mutex
+	w  io.Writer
+	c  io.Closer
+}
+
+// New creates a Logger writing to the sink of the configuration.
+func New(config configuration.AuditLog) (*Logger, error) {
+	switch config.Sink {
+	case "", "stdout":
+		return &Logger{w: os.Stdout}, nil
+	case "file":
+		if config.Path == "" {
+			return nil, fmt.Errorf("auditlog: no path configured for the file sink")
+		}
+		f, err := os.OpenFile(config.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return nil, fmt.Errorf("auditlog: %v", err)
+		}
+		return &Logger{w: f, c: f}, nil
+	case "syslog":
+		w, err := newSyslogWriter(config.Syslog.Network, config.Syslog.Address, config.Syslog.Tag)
+		if err != nil {
+			return nil, fmt.Errorf("auditlog: %v", err)
+		}
+		return &Logger{w: w, c: w}, nil
+	default:
+		return nil, fmt.Errorf("auditlog: unknown sink %q", config.Sink)
+	}
+}
+
+// NewLogger creates a Logger writing to w.
+func NewLogger(w io.Writer) *Logger {
+	return &Logger{w: w}
+}
+
+// Log writes the record r.
+func (l *Logger) Log(r *Record) error {
+	p, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	p = append(p, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.w.Write(p)
+	return err
+}
+
+// Close closes the sink of the logger.
+func (l *Logger) Close() error {
+	if l.c == nil {
+		return nil
+	}
+	return l.c.Close()
+}
+
+type recordKey struct{}
+
+// WithRecord returns a context holding r, for the handlers to complete it.
+func WithRecord(ctx context.Context, r *Record) context.Context {
+	return context.WithValue(ctx, recordKey{}, r)
+}
+
+// GetRecord returns the record of the request of ctx, or nil when the
+// request is not audited.
+func GetRecord(ctx context.Context) *Record {
+	r, _ := ctx.Value(recordKey{}).(*Record)
+	return r
+}
@@ -0,0 +1,79 @@
+package auditlog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/distribution/distribution/v3/configuration"
+)
+
+func TestLoggerWritesJSONLines(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(&buf)
+
+	records := []Record{
+		{CorrelationID: "a", Action: ActionPull, Repository: "foo/bar", Tag: "latest", Status: 200},
+		{CorrelationID: "b", Action: ActionPush, Repository: "foo/bar", Digest: "sha256:abc", Status: 201, BytesIn: 42},
+	}
+	for i := range records {
+		if err := logger.Log(&records[i]); err != nil {
+			t.Fatalf("unexpected error logging: %v", err)
+		}
+	}
+
+	scanner := bufio.NewScanner(&buf)
+	var i int
+	for ; scanner.Scan(); i++ {
+		var r Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("invalid record %q: %v", scanner.Text(), err)
+		}
+		if r.CorrelationID != records[i].CorrelationID || r.Action != records[i].Action || r.BytesIn != records[i].BytesIn {
+			t.Errorf("unexpected record %+v, expected %+v", r, records[i])
+		}
+	}
+	if i != len(records) {
+		t.Fatalf("expected %d records, got %d", len(records), i)
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	logger, err := New(configuration.AuditLog{Enabled: true, Sink: "file", Path: path})
+	if err != nil {
+		t.Fatalf("unexpected error creating logger: %v", err)
+	}
+	if err := logger.Log(&Record{Action: ActionDelete, Status: 202}); err != nil {
+		t.Fatalf("unexpected error logging: %v", err)
+	}
+	if err := logger.Close(); err != nil {
+		t.Fatalf("unexpected error closing logger: %v", err)
+	}
+
+	p, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error reading log: %v", err)
+	}
+	var r Record
+	if err := json.Unmarshal(p, &r); err != nil {
+		t.Fatalf("invalid record %q: %v", p, err)
+	}
+	if r.Action != ActionDelete || r.Status != 202 {
+		t.Errorf("unexpected record %+v", r)
+	}
+}
+
+func TestInvalidSinks(t *testing.T) {
+	for _, config := range []configuration.AuditLog{
+		{Enabled: true, Sink: "file"},
+		{Enabled: true, Sink: "kafka"},
+	} {
+		if _, err := New(config); err == nil {
+			t.Errorf("expected an error for %+v", config)
+		}
+	}
+}
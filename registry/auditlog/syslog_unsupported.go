@@ -0,0 +1,13 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package auditlog
+
+import (
+	"errors"
+	"io"
+)
+
+func newSyslogWriter(network, address, tag string) (io.WriteCloser, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
@@ -0,0 +1,138 @@
+// Package acl provides the access control lists of the token server, and an
+// authentication scheme authenticating the users of an htpasswd file with
+// basic auth, like the htpasswd one, and granting each of them the access to
+// the repositories an ACL file allows them.
+//
+// This authentication method MUST be used under TLS, as simple token-replay attack is possible.
+package acl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/distribution/distribution/v3/registry/auth/htpasswd"
+)
+
+// errAccessDenied is the error of the challenge of the users denied access
+// by the ACL.
+var errAccessDenied = errors.New("access denied by the acl")
+
+type accessController struct {
+	realm    string
+	htpasswd auth.AccessController
+
+	path    string
+	mu      sync.Mutex
+	modtime time.Time
+	acl     ACL
+}
+
+var (
+	_ auth.AccessController = &accessController{}
+	_ auth.Reloader         = &accessController{}
+)
+
+func newAccessController(options map[string]interface{}) (auth.AccessController, error) {
+	aclOpt, present := options["acl"]
+	path, ok := aclOpt.(string)
+	if !present || !ok {
+		return nil, fmt.Errorf(`"acl" must be set for acl access controller`)
+	}
+
+	// the other options are those of the htpasswd access controller
+	htpasswdOptions := make(map[string]interface{}, len(options))
+	for k, v := range options {
+		if k != "acl" {
+			htpasswdOptions[k] = v
+		}
+	}
+	htpasswd, err := auth.GetAccessController("htpasswd", htpasswdOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	ac := &accessController{
+		realm:    options["realm"].(string),
+		htpasswd: htpasswd,
+		path:     path,
+	}
+	if err := ac.reloadACL(); err != nil {
+		return nil, err
+	}
+	return ac, nil
+}
+
+func (ac *accessController) Authorized(ctx context.Context, accessRecords ...auth.Access) (context.Context, error) {
+	// the ACL grants the access, including to the admin routes, the
+	// htpasswd access controller only authenticates the user
+	ctx, err := ac.htpasswd.Authorized(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	username := dcontext.GetStringValue(ctx, auth.UserNameKey)
+	if granted := ac.currentACL().Filter(username, accessRecords); len(granted) < len(accessRecords) {
+		dcontext.GetLogger(ctx).Errorf("user %q denied access by the acl: granted %v of %v", username, granted, accessRecords)
+		return nil, htpasswd.NewChallenge(ac.realm, errAccessDenied)
+	}
+	return ctx, nil
+}
+
+// currentACL returns the ACL, parsed again when the file was modified. The
+// previous ACL is kept if the modified file is invalid.
+func (ac *accessController) currentACL() ACL {
+	if fstat, err := os.Stat(ac.path); err == nil {
+		ac.mu.Lock()
+		modified := !ac.modtime.Equal(fstat.ModTime())
+		ac.mu.Unlock()
+		if modified {
+			if err := ac.reloadACL(); err != nil {
+				dcontext.GetLogger(context.Background()).Errorf("error reloading acl file %s, keeping the previous acl: %v", ac.path, err)
+			}
+		}
+	}
+
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	return ac.acl
+}
+
+// Reload parses the htpasswd and the ACL files again.
+func (ac *accessController) Reload() error {
+	if reloader, ok := ac.htpasswd.(auth.Reloader); ok {
+		if err := reloader.Reload(); err != nil {
+			return err
+		}
+	}
+	return ac.reloadACL()
+}
+
+func (ac *accessController) reloadACL() error {
+	fstat, err := os.Stat(ac.path)
+	if err != nil {
+		return err
+	}
+
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	// record the modification time even if the file is invalid, so that it
+	// is only parsed again once fixed
+	ac.modtime = fstat.ModTime()
+	acl, err := Load(ac.path)
+	if err != nil {
+		return err
+	}
+	ac.acl = acl
+	return nil
+}
+
+func init() {
+	auth.Register("acl", auth.InitFunc(newAccessController))
+}
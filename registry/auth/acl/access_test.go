@@ -0,0 +1,96 @@
+package acl
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/auth"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestACLAccessController(t *testing.T) {
+	var htpasswd string
+	for _, user := range []string{"alice", "carol"} {
+		hash, err := bcrypt.GenerateFromPassword([]byte(user+"-password"), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		htpasswd += user + ":" + string(hash) + "\n"
+	}
+
+	accessController, err := newAccessController(map[string]interface{}{
+		"realm": "test-realm",
+		"path":  writeFile(t, "htpasswd", htpasswd),
+		"acl":   writeACL(t, testACL),
+	})
+	if err != nil {
+		t.Fatalf("error creating access controller: %v", err)
+	}
+
+	var requested []auth.Access
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithRequest(context.Background(), r)
+		if _, err := accessController.Authorized(ctx, requested...); err != nil {
+			if challenge, ok := err.(auth.Challenge); ok {
+				challenge.SetHeaders(r, w)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			t.Errorf("unexpected error authorizing request: %v", err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	for _, tc := range []struct {
+		user     string
+		password string
+		access   []auth.Access
+		expected int
+	}{
+		{access: repositoryAccess("team/app", "pull"), expected: http.StatusUnauthorized},
+		{user: "alice", password: "wrong", access: repositoryAccess("team/app", "pull"), expected: http.StatusUnauthorized},
+		{user: "alice", password: "alice-password", access: repositoryAccess("alice/app", "pull", "push"), expected: http.StatusNoContent},
+		{user: "alice", password: "alice-password", access: repositoryAccess("other/app", "pull"), expected: http.StatusNoContent},
+		{user: "alice", password: "alice-password", access: repositoryAccess("other/app", "pull", "push"), expected: http.StatusUnauthorized},
+		{user: "carol", password: "carol-password", access: repositoryAccess("private/app", "pull"), expected: http.StatusUnauthorized},
+	} {
+		requested = tc.access
+		req, err := http.NewRequest("GET", server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.user != "" {
+			req.SetBasicAuth(tc.user, tc.password)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error during GET: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.expected {
+			t.Errorf("user %q requesting %v: unexpected status %d != %d", tc.user, tc.access, resp.StatusCode, tc.expected)
+		}
+		if resp.StatusCode == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") != `Basic realm="test-realm"` {
+			t.Errorf("unexpected challenge %q", resp.Header.Get("WWW-Authenticate"))
+		}
+	}
+}
+
+func TestACLAccessControllerOptions(t *testing.T) {
+	if _, err := newAccessController(map[string]interface{}{
+		"realm": "test-realm",
+		"path":  writeFile(t, "htpasswd", ""),
+	}); err == nil {
+		t.Fatal("expected an error without acl")
+	}
+	if _, err := newAccessController(map[string]interface{}{
+		"realm": "test-realm",
+		"path":  writeFile(t, "htpasswd", ""),
+		"acl":   writeACL(t, `- account: alice`),
+	}); err == nil {
+		t.Fatal("expected an error with an invalid acl")
+	}
+}
@@ -0,0 +1,166 @@
+package acl
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/registry/auth"
+	"gopkg.in/yaml.v2"
+)
+
+// accountPlaceholder is replaced, in the names of the ACL entries, by the
+// name of the account requesting access.
+const accountPlaceholder = "${account}"
+
+// Entry grants an account access to the resources matching a name.
+type Entry struct {
+	// Account is the pattern of the accounts granted access. The empty
+	// account is the anonymous one, which is only matched by an empty
+	// pattern.
+	Account string `yaml:"account"`
+
+	// Type is the type of the resources, repository or registry. Defaults
+	// to repository.
+	Type string `yaml:"type,omitempty"`
+
+	// Name is the pattern of the names of the resources, in which
+	// ${account} is replaced by the name of the account.
+	Name string `yaml:"name"`
+
+	// Actions are the actions granted, such as pull, push or delete, or *
+	// for all actions. An entry without actions denies access.
+	Actions []string `yaml:"actions"`
+
+	account *configuration.RepositoryMatcher
+	name    *configuration.RepositoryMatcher
+	// names caches the matchers of the names depending on the account, by
+	// account.
+	names *sync.Map
+}
+
+// ACL is an access control list. The access to a resource is granted by the
+// first entry matching the account and the resource, if any. The patterns of
+// the entries are compiled when the list is loaded.
+type ACL []Entry
+
+// Load reads the ACL file at path, a YAML list of entries.
+func Load(path string) (ACL, error) {
+	p, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries ACL
+	if err := yaml.UnmarshalStrict(p, &entries); err != nil {
+		return nil, fmt.Errorf("invalid acl file %s: %v", path, err)
+	}
+	for i, entry := range entries {
+		if entry.Name == "" {
+			return nil, fmt.Errorf("invalid acl entry %d: name is required", i)
+		}
+		switch entry.Type {
+		case "", "repository", "registry":
+		default:
+			return nil, fmt.Errorf("invalid acl entry %d: unsupported type %q", i, entry.Type)
+		}
+		if err := entries[i].compile(); err != nil {
+			return nil, fmt.Errorf("invalid acl entry %d: %v", i, err)
+		}
+	}
+	return entries, nil
+}
+
+// compile compiles the patterns of the entry. The name is compiled for each
+// account if it depends on it.
+func (entry *Entry) compile() error {
+	var err error
+	if entry.Account != "" {
+		if entry.account, err = configuration.NewRepositoryMatcher(entry.Account); err != nil {
+			return err
+		}
+	}
+	if !strings.Contains(entry.Name, accountPlaceholder) {
+		entry.name, err = configuration.NewRepositoryMatcher(entry.Name)
+		return err
+	}
+	entry.names = &sync.Map{}
+	_, err = configuration.NewRepositoryMatcher(strings.ReplaceAll(entry.Name, accountPlaceholder, "account"))
+	return err
+}
+
+// nameMatcher returns the matcher of the names of the resources the entry
+// grants the account access to.
+func (entry Entry) nameMatcher(account string) *configuration.RepositoryMatcher {
+	if entry.names == nil {
+		return entry.name
+	}
+	if m, ok := entry.names.Load(account); ok {
+		return m.(*configuration.RepositoryMatcher)
+	}
+
+	var name string
+	if strings.HasPrefix(entry.Name, configuration.RegexpPatternPrefix) {
+		name = strings.ReplaceAll(entry.Name, accountPlaceholder, regexp.QuoteMeta(account))
+	} else {
+		name = strings.ReplaceAll(entry.Name, accountPlaceholder, globEscaper.Replace(account))
+	}
+	m, err := configuration.NewRepositoryMatcher(name)
+	if err != nil {
+		// the account can not make a valid pattern invalid once quoted
+		return nil
+	}
+	entry.names.Store(account, m)
+	return m
+}
+
+// globEscaper quotes the special characters of globs.
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`)
+
+// actions returns the actions the account is granted on the resource.
+func (a ACL) actions(account string, resource auth.Resource) []string {
+	for _, entry := range a {
+		if entry.matches(account, resource) {
+			return entry.Actions
+		}
+	}
+	return nil
+}
+
+// Filter returns the accesses of requested which the account is granted.
+func (a ACL) Filter(account string, requested []auth.Access) []auth.Access {
+	granted := make([]auth.Access, 0, len(requested))
+	for _, access := range requested {
+		for _, action := range a.actions(account, access.Resource) {
+			if action == "*" || action == access.Action {
+				granted = append(granted, access)
+				break
+			}
+		}
+	}
+	return granted
+}
+
+func (entry Entry) matches(account string, resource auth.Resource) bool {
+	resourceType := entry.Type
+	if resourceType == "" {
+		resourceType = "repository"
+	}
+	if resourceType != resource.Type {
+		return false
+	}
+
+	if account == "" || entry.Account == "" {
+		if account != entry.Account {
+			return false
+		}
+	} else if !entry.account.Match(account) {
+		return false
+	}
+
+	m := entry.nameMatcher(account)
+	return m != nil && m.Match(resource.Name)
+}
@@ -0,0 +1,127 @@
+package acl
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/distribution/distribution/v3/registry/auth"
+)
+
+const testACL = `
+- account: admin
+  name: "regexp:.*"
+  actions: ["*"]
+- account: "*"
+  name: "${account}/*"
+  actions: [pull, push, delete]
+- account: "*"
+  name: private/*
+  actions: []
+- account: "*"
+  name: "*/*"
+  actions: [pull]
+- account: ""
+  name: public/*
+  actions: [pull]
+- account: admin
+  type: registry
+  name: catalog
+  actions: ["*"]
+`
+
+func writeFile(t *testing.T, name, content string) string {
+	p := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func writeACL(t *testing.T, content string) string {
+	return writeFile(t, "acl.yml", content)
+}
+
+func repositoryAccess(name string, actions ...string) []auth.Access {
+	var access []auth.Access
+	for _, action := range actions {
+		access = append(access, auth.Access{
+			Resource: auth.Resource{Type: "repository", Name: name},
+			Action:   action,
+		})
+	}
+	return access
+}
+
+func TestACL(t *testing.T) {
+	list, err := Load(writeACL(t, testACL))
+	if err != nil {
+		t.Fatalf("unexpected error loading acl: %v", err)
+	}
+
+	catalog := auth.Access{Resource: auth.Resource{Type: "registry", Name: "catalog"}, Action: "*"}
+
+	for _, tc := range []struct {
+		account   string
+		requested []auth.Access
+		granted   []auth.Access
+	}{
+		{
+			account:   "admin",
+			requested: append(repositoryAccess("private/app", "pull", "push"), catalog),
+			granted:   append(repositoryAccess("private/app", "pull", "push"), catalog),
+		},
+		{
+			account:   "alice",
+			requested: repositoryAccess("alice/app", "pull", "push", "delete"),
+			granted:   repositoryAccess("alice/app", "pull", "push", "delete"),
+		},
+		{
+			account:   "alice",
+			requested: append(repositoryAccess("bob/app", "pull", "push"), catalog),
+			granted:   repositoryAccess("bob/app", "pull"),
+		},
+		{
+			// the account is quoted in the names of the entries
+			account:   "*",
+			requested: repositoryAccess("bob/app", "pull", "push"),
+			granted:   repositoryAccess("bob/app", "pull"),
+		},
+		{
+			// denied by the first matching entry
+			account:   "alice",
+			requested: repositoryAccess("private/app", "pull"),
+			granted:   []auth.Access{},
+		},
+		{
+			account:   "",
+			requested: repositoryAccess("public/app", "pull", "push"),
+			granted:   repositoryAccess("public/app", "pull"),
+		},
+		{
+			account:   "",
+			requested: repositoryAccess("alice/app", "pull"),
+			granted:   []auth.Access{},
+		},
+	} {
+		granted := list.Filter(tc.account, tc.requested)
+		if !reflect.DeepEqual(granted, tc.granted) {
+			t.Errorf("account %q: expected %v to be granted, got %v", tc.account, tc.granted, granted)
+		}
+	}
+}
+
+func TestInvalidACL(t *testing.T) {
+	for _, content := range []string{
+		`- account: alice`,
+		`- {account: alice, name: "[", actions: [pull]}`,
+		`- {account: alice, name: "regexp:(", actions: [pull]}`,
+		`- {account: alice, type: blob, name: foo, actions: [pull]}`,
+		`- {account: alice, name: foo, action: pull}`,
+	} {
+		if _, err := Load(writeACL(t, content)); err == nil {
+			t.Errorf("expected an error loading acl %q", content)
+		}
+	}
+}
@@ -61,6 +61,10 @@ var (
 // an autenticated/authorized client.
 type UserInfo struct {
 	Name string
+
+	// Claims are the claims of the credential of the user, such as those of
+	// a token, if the access controller reports them.
+	Claims map[string]interface{}
 }
 
 // Resource describes a resource by type and name.
@@ -111,6 +115,12 @@ type CredentialAuthenticator interface {
 	AuthenticateUser(username, password string) error
 }
 
+// Reloader is implemented by the access controllers which can reload their
+// credentials, when the configuration of the registry is reloaded.
+type Reloader interface {
+	Reload() error
+}
+
 // WithUser returns a context with the authorized user info.
 func WithUser(ctx context.Context, user UserInfo) context.Context {
 	return userInfoContext{
@@ -9,6 +9,7 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
@@ -22,15 +23,30 @@ import (
 	"github.com/distribution/distribution/v3/registry/auth"
 )
 
+// errAdminDenied is the error of the challenge of the users denied the
+// admin routes.
+var errAdminDenied = errors.New("not an admin")
+
 type accessController struct {
 	realm    string
 	path     string
 	modtime  time.Time
 	mu       sync.Mutex
 	htpasswd *htpasswd
+
+	// cacheTTL is how long verified credentials are cached.
+	cacheTTL time.Duration
+	// minCost is the minimum bcrypt cost of the accepted entries.
+	minCost int
+	// admins are the users granted the registry:admin scope.
+	admins map[string]bool
 }
 
-var _ auth.AccessController = &accessController{}
+var (
+	_ auth.AccessController        = &accessController{}
+	_ auth.CredentialAuthenticator = &accessController{}
+	_ auth.Reloader                = &accessController{}
+)
 
 func newAccessController(options map[string]interface{}) (auth.AccessController, error) {
 	realm, present := options["realm"]
@@ -43,10 +59,58 @@ func newAccessController(options map[string]interface{}) (auth.AccessController,
 	if !present || !ok {
 		return nil, fmt.Errorf(`"path" must be set for htpasswd access controller`)
 	}
-	if err := createHtpasswdFile(path); err != nil {
+
+	ac := &accessController{realm: realm.(string), path: path}
+	if cacheTTL, present := options["cachettl"]; present {
+		var err error
+		switch v := cacheTTL.(type) {
+		case string:
+			ac.cacheTTL, err = time.ParseDuration(v)
+		case int:
+			ac.cacheTTL = time.Duration(v) * time.Second
+		default:
+			err = fmt.Errorf("invalid type %T", cacheTTL)
+		}
+		if err != nil || ac.cacheTTL < 0 {
+			return nil, fmt.Errorf(`"cachettl" must be a duration for htpasswd access controller: %v`, cacheTTL)
+		}
+	}
+	if minCost, present := options["mincost"]; present {
+		cost, ok := minCost.(int)
+		if !ok || cost < 0 || cost > bcrypt.MaxCost {
+			return nil, fmt.Errorf(`"mincost" must be a bcrypt cost for htpasswd access controller: %v`, minCost)
+		}
+		ac.minCost = cost
+	}
+	if admins, present := options["admins"]; present {
+		var names []string
+		switch v := admins.(type) {
+		case []string:
+			names = v
+		case []interface{}:
+			for _, item := range v {
+				name, ok := item.(string)
+				if !ok {
+					return nil, fmt.Errorf(`"admins" must be a list of users for htpasswd access controller: %v`, admins)
+				}
+				names = append(names, name)
+			}
+		default:
+			return nil, fmt.Errorf(`"admins" must be a list of users for htpasswd access controller: %v`, admins)
+		}
+		ac.admins = make(map[string]bool, len(names))
+		for _, name := range names {
+			ac.admins[name] = true
+		}
+	}
+
+	if err := createHtpasswdFile(path, ac.minCost); err != nil {
+		return nil, err
+	}
+	if err := ac.Reload(); err != nil {
 		return nil, err
 	}
-	return &accessController{realm: realm.(string), path: path}, nil
+	return ac, nil
 }
 
 func (ac *accessController) Authorized(ctx context.Context, accessRecords ...auth.Access) (context.Context, error) {
@@ -63,43 +127,85 @@ func (ac *accessController) Authorized(ctx context.Context, accessRecords ...aut
 		}
 	}
 
-	// Dynamically parsing the latest account list
+	if err := ac.AuthenticateUser(username, password); err != nil {
+		dcontext.GetLogger(ctx).Errorf("error authenticating user %q: %v", username, err)
+		return nil, &challenge{
+			realm: ac.realm,
+			err:   auth.ErrAuthenticationFailure,
+		}
+	}
+
+	// every authenticated user is granted every scope, but the admin one
+	for _, access := range accessRecords {
+		if access.Type == "registry" && access.Name == "admin" && !ac.admins[username] {
+			dcontext.GetLogger(ctx).Errorf("user %q denied access to the admin routes", username)
+			return nil, &challenge{
+				realm: ac.realm,
+				err:   errAdminDenied,
+			}
+		}
+	}
+
+	return auth.WithUser(ctx, auth.UserInfo{Name: username}), nil
+}
+
+// AuthenticateUser checks a username and password against the htpasswd
+// file, which is parsed again when it was modified. The previous entries are
+// kept if the modified file is invalid.
+func (ac *accessController) AuthenticateUser(username, password string) error {
 	fstat, err := os.Stat(ac.path)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	lastModified := fstat.ModTime()
 	ac.mu.Lock()
-	if ac.htpasswd == nil || !ac.modtime.Equal(lastModified) {
-		ac.modtime = lastModified
-
-		f, err := os.Open(ac.path)
-		if err != nil {
-			ac.mu.Unlock()
-			return nil, err
-		}
-		defer f.Close()
-
-		h, err := newHTPasswd(f)
-		if err != nil {
-			ac.mu.Unlock()
-			return nil, err
+	modified := !ac.modtime.Equal(fstat.ModTime())
+	ac.mu.Unlock()
+	if modified {
+		if err := ac.Reload(); err != nil {
+			dcontext.GetLogger(context.Background()).Errorf("error reloading htpasswd file %s, keeping the previous entries: %v", ac.path, err)
 		}
-		ac.htpasswd = h
 	}
+
+	ac.mu.Lock()
 	localHTPasswd := ac.htpasswd
 	ac.mu.Unlock()
 
-	if err := localHTPasswd.authenticateUser(username, password); err != nil {
-		dcontext.GetLogger(ctx).Errorf("error authenticating user %q: %v", username, err)
-		return nil, &challenge{
-			realm: ac.realm,
-			err:   auth.ErrAuthenticationFailure,
-		}
+	return localHTPasswd.authenticateUser(username, password)
+}
+
+// Reload parses the htpasswd file again, dropping the cached credentials.
+func (ac *accessController) Reload() error {
+	f, err := os.Open(ac.path)
+	if err != nil {
+		return err
 	}
+	defer f.Close()
 
-	return auth.WithUser(ctx, auth.UserInfo{Name: username}), nil
+	fstat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	// record the modification time even if the file is invalid, so that it
+	// is only parsed again once fixed
+	ac.modtime = fstat.ModTime()
+	h, err := newHTPasswd(f, ac.minCost, ac.cacheTTL)
+	if err != nil {
+		return err
+	}
+	ac.htpasswd = h
+	return nil
+}
+
+// NewChallenge returns the basic challenge of the realm for a request failing
+// with err, for the access controllers authenticating the users of an
+// htpasswd file.
+func NewChallenge(realm string, err error) auth.Challenge {
+	return challenge{realm: realm, err: err}
 }
 
 // challenge implements the auth.Challenge interface.
@@ -120,7 +226,7 @@ func (ch challenge) Error() string {
 }
 
 // createHtpasswdFile creates and populates htpasswd file with a new user in case the file is missing
-func createHtpasswdFile(path string) error {
+func createHtpasswdFile(path string, minCost int) error {
 	if f, err := os.Open(path); err == nil {
 		f.Close()
 		return nil
@@ -141,7 +247,11 @@ func createHtpasswdFile(path string) error {
 		return err
 	}
 	pass := base64.RawURLEncoding.EncodeToString(secretBytes[:])
-	encryptedPass, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+	cost := bcrypt.DefaultCost
+	if minCost > cost {
+		cost = minCost
+	}
+	encryptedPass, err := bcrypt.GenerateFromPassword([]byte(pass), cost)
 	if err != nil {
 		return err
 	}
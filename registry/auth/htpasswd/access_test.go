@@ -6,10 +6,13 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/distribution/distribution/v3/context"
 	"github.com/distribution/distribution/v3/registry/auth"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestBasicAccessController(t *testing.T) {
@@ -160,3 +163,144 @@ func TestCreateHtpasswdFile(t *testing.T) {
 		t.Fatalf("failed to find default user in file %s", string(content))
 	}
 }
+
+func TestReloadHtpasswdFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	writeHtpasswd := func(content string, modtime time.Time) {
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modtime, modtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entry := func(username, password string, cost int) string {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return username + ":" + string(hash) + "\n"
+	}
+
+	start := time.Now().Add(-time.Hour)
+	writeHtpasswd(entry("bilbo", "baggins", bcrypt.MinCost)+entry("frodo", "baggins", bcrypt.MinCost+1), start)
+
+	ac, err := newAccessController(map[string]interface{}{
+		"realm":    "The-Shire",
+		"path":     path,
+		"cachettl": "1m",
+		"mincost":  bcrypt.MinCost + 1,
+	})
+	if err != nil {
+		t.Fatalf("error creating access controller: %v", err)
+	}
+	authenticator := ac.(auth.CredentialAuthenticator)
+
+	if err := authenticator.AuthenticateUser("bilbo", "baggins"); err != auth.ErrAuthenticationFailure {
+		t.Fatalf("expected the entry below the minimum cost to be ignored, got %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := authenticator.AuthenticateUser("frodo", "baggins"); err != nil {
+			t.Fatalf("unexpected error authenticating user: %v", err)
+		}
+	}
+	if len(ac.(*accessController).htpasswd.verified) != 1 {
+		t.Fatalf("expected the verified credentials to be cached")
+	}
+	if err := authenticator.AuthenticateUser("frodo", "gamgee"); err != auth.ErrAuthenticationFailure {
+		t.Fatalf("expected a wrong password to be rejected, got %v", err)
+	}
+
+	// the modified file is loaded again, dropping the cache
+	writeHtpasswd(entry("frodo", "gamgee", bcrypt.MinCost+1), start.Add(time.Minute))
+	if err := authenticator.AuthenticateUser("frodo", "baggins"); err != auth.ErrAuthenticationFailure {
+		t.Fatalf("expected the previous password to be rejected, got %v", err)
+	}
+	if err := authenticator.AuthenticateUser("frodo", "gamgee"); err != nil {
+		t.Fatalf("unexpected error authenticating user: %v", err)
+	}
+
+	// an invalid file is ignored
+	writeHtpasswd("invalid entry", start.Add(2*time.Minute))
+	if err := authenticator.AuthenticateUser("frodo", "gamgee"); err != nil {
+		t.Fatalf("unexpected error authenticating user with an invalid file: %v", err)
+	}
+
+	// the file is loaded again on reload, even if its modification time
+	// did not change
+	writeHtpasswd(entry("sam", "gamgee", bcrypt.MinCost+1), start.Add(2*time.Minute))
+	if err := authenticator.AuthenticateUser("sam", "gamgee"); err != auth.ErrAuthenticationFailure {
+		t.Fatalf("expected the file not to be loaded again, got %v", err)
+	}
+	if err := ac.(auth.Reloader).Reload(); err != nil {
+		t.Fatalf("unexpected error reloading: %v", err)
+	}
+	if err := authenticator.AuthenticateUser("sam", "gamgee"); err != nil {
+		t.Fatalf("unexpected error authenticating user: %v", err)
+	}
+}
+
+func TestAdminAccess(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	content := `frodo:$2y$05$926C3y10Quzn/LnqQH86VOEVh/18T6RnLaS.khre96jLNL/7e.K5W
+MiShil:$2y$05$0oHgwMehvoe8iAWS8I.7l.KoECXrwVaC16RPfaSCU5eVTFrATuMI2`
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	admin := auth.Access{Resource: auth.Resource{Type: "registry", Name: "admin"}, Action: "*"}
+	pull := auth.Access{Resource: auth.Resource{Type: "repository", Name: "foo/bar"}, Action: "pull"}
+	for _, test := range []struct {
+		admins   interface{}
+		user     string
+		password string
+		access   []auth.Access
+		granted  bool
+	}{
+		// the admin routes require an explicit list of admins
+		{admins: nil, user: "frodo", password: "baggins", access: []auth.Access{admin}, granted: false},
+		{admins: nil, user: "frodo", password: "baggins", access: []auth.Access{pull}, granted: true},
+		{admins: []interface{}{"frodo"}, user: "frodo", password: "baggins", access: []auth.Access{admin}, granted: true},
+		{admins: []interface{}{"frodo"}, user: "MiShil", password: "새주", access: []auth.Access{admin}, granted: false},
+		{admins: []interface{}{"frodo"}, user: "MiShil", password: "새주", access: []auth.Access{pull}, granted: true},
+	} {
+		options := map[string]interface{}{"realm": "The-Shire", "path": path}
+		if test.admins != nil {
+			options["admins"] = test.admins
+		}
+		ac, err := newAccessController(options)
+		if err != nil {
+			t.Fatalf("unexpected error creating access controller: %v", err)
+		}
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.SetBasicAuth(test.user, test.password)
+		_, err = ac.Authorized(context.WithRequest(context.Background(), req), test.access...)
+		if test.granted && err != nil {
+			t.Errorf("unexpected error authorizing %s for %v with admins %v: %v", test.user, test.access, test.admins, err)
+		}
+		if !test.granted {
+			if _, ok := err.(auth.Challenge); !ok {
+				t.Errorf("expected a challenge authorizing %s for %v with admins %v, got %v", test.user, test.access, test.admins, err)
+			}
+		}
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	for _, options := range []map[string]interface{}{
+		{"path": path},
+		{"realm": "The-Shire"},
+		{"realm": "The-Shire", "path": path, "cachettl": "forever"},
+		{"realm": "The-Shire", "path": path, "cachettl": -1},
+		{"realm": "The-Shire", "path": path, "mincost": "high"},
+		{"realm": "The-Shire", "path": path, "mincost": bcrypt.MaxCost + 1},
+		{"realm": "The-Shire", "path": path, "admins": "frodo"},
+		{"realm": "The-Shire", "path": path, "admins": []interface{}{1}},
+	} {
+		if _, err := newAccessController(options); err == nil {
+			t.Errorf("expected an error with options %v", options)
+		}
+	}
+}
@@ -2,10 +2,17 @@ package htpasswd
 
 import (
 	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"strings"
+	"sync"
+	"time"
 
+	dcontext "github.com/distribution/distribution/v3/context"
 	"github.com/distribution/distribution/v3/registry/auth"
 
 	"golang.org/x/crypto/bcrypt"
@@ -15,16 +22,48 @@ import (
 // it. Only bcrypt hash entries are supported.
 type htpasswd struct {
 	entries map[string][]byte // maps username to password byte slice.
+
+	// verified caches the credentials verified for cacheTTL, as a keyed
+	// hash of the password, so that bcrypt is not run on every request.
+	cacheTTL time.Duration
+	key      []byte
+	mu       sync.Mutex
+	verified map[string]verifiedCredential
+}
+
+type verifiedCredential struct {
+	mac     []byte
+	expires time.Time
 }
 
-// newHTPasswd parses the reader and returns an htpasswd or an error.
-func newHTPasswd(rd io.Reader) (*htpasswd, error) {
+// newHTPasswd parses the reader and returns an htpasswd or an error. The
+// entries which are not bcrypt hashes of at least minCost are ignored.
+func newHTPasswd(rd io.Reader, minCost int, cacheTTL time.Duration) (*htpasswd, error) {
 	entries, err := parseHTPasswd(rd)
 	if err != nil {
 		return nil, err
 	}
 
-	return &htpasswd{entries: entries}, nil
+	for username, credentials := range entries {
+		cost, err := bcrypt.Cost(credentials)
+		if err != nil {
+			dcontext.GetLogger(context.Background()).Warnf("htpasswd: ignoring entry of user %q, which is not a bcrypt hash", username)
+			delete(entries, username)
+		} else if cost < minCost {
+			dcontext.GetLogger(context.Background()).Warnf("htpasswd: ignoring entry of user %q, whose bcrypt cost %d is lower than %d", username, cost, minCost)
+			delete(entries, username)
+		}
+	}
+
+	h := &htpasswd{entries: entries, cacheTTL: cacheTTL}
+	if cacheTTL > 0 {
+		h.key = make([]byte, 32)
+		if _, err := rand.Read(h.key); err != nil {
+			return nil, err
+		}
+		h.verified = make(map[string]verifiedCredential)
+	}
+	return h, nil
 }
 
 // AuthenticateUser checks a given user:password credential against the
@@ -38,14 +77,54 @@ func (htpasswd *htpasswd) authenticateUser(username string, password string) err
 		return auth.ErrAuthenticationFailure
 	}
 
+	if htpasswd.cached(username, password) {
+		return nil
+	}
+
 	err := bcrypt.CompareHashAndPassword(credentials, []byte(password))
 	if err != nil {
 		return auth.ErrAuthenticationFailure
 	}
 
+	htpasswd.cache(username, password)
 	return nil
 }
 
+// cached returns whether the credential was verified less than cacheTTL ago.
+func (htpasswd *htpasswd) cached(username, password string) bool {
+	if htpasswd.cacheTTL <= 0 {
+		return false
+	}
+
+	htpasswd.mu.Lock()
+	verified, ok := htpasswd.verified[username]
+	htpasswd.mu.Unlock()
+	if !ok || time.Now().After(verified.expires) {
+		return false
+	}
+	return hmac.Equal(verified.mac, htpasswd.mac(password))
+}
+
+// cache records the credential as verified.
+func (htpasswd *htpasswd) cache(username, password string) {
+	if htpasswd.cacheTTL <= 0 {
+		return
+	}
+
+	htpasswd.mu.Lock()
+	defer htpasswd.mu.Unlock()
+	htpasswd.verified[username] = verifiedCredential{
+		mac:     htpasswd.mac(password),
+		expires: time.Now().Add(htpasswd.cacheTTL),
+	}
+}
+
+func (htpasswd *htpasswd) mac(password string) []byte {
+	mac := hmac.New(sha256.New, htpasswd.key)
+	mac.Write([]byte(password))
+	return mac.Sum(nil)
+}
+
 // parseHTPasswd parses the contents of htpasswd. This will read all the
 // entries in the file, whether or not they are needed. An error is returned
 // if a syntax errors are encountered or if the reader fails.
@@ -11,6 +11,7 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	dcontext "github.com/distribution/distribution/v3/context"
 	"github.com/distribution/distribution/v3/registry/auth"
@@ -133,6 +134,7 @@ type accessController struct {
 	service      string
 	rootCerts    *x509.CertPool
 	trustedKeys  map[string]libtrust.PublicKey
+	jwks         *jwks
 }
 
 // tokenAccessOptions is a convenience type for handling
@@ -143,6 +145,8 @@ type tokenAccessOptions struct {
 	issuer         string
 	service        string
 	rootCertBundle string
+	jwks           string
+	jwksRefresh    time.Duration
 }
 
 // checkOptions gathers the necessary options
@@ -150,7 +154,7 @@ type tokenAccessOptions struct {
 func checkOptions(options map[string]interface{}) (tokenAccessOptions, error) {
 	var opts tokenAccessOptions
 
-	keys := []string{"realm", "issuer", "service", "rootcertbundle"}
+	keys := []string{"realm", "issuer", "service"}
 	vals := make([]string, 0, len(keys))
 	for _, key := range keys {
 		val, ok := options[key].(string)
@@ -160,7 +164,38 @@ func checkOptions(options map[string]interface{}) (tokenAccessOptions, error) {
 		vals = append(vals, val)
 	}
 
-	opts.realm, opts.issuer, opts.service, opts.rootCertBundle = vals[0], vals[1], vals[2], vals[3]
+	opts.realm, opts.issuer, opts.service = vals[0], vals[1], vals[2]
+
+	// the signing keys are trusted through their root certificates, or
+	// listed by the JWKS of the issuer
+	for key, val := range map[string]*string{
+		"rootcertbundle": &opts.rootCertBundle,
+		"jwks":           &opts.jwks,
+	} {
+		if v, ok := options[key]; ok {
+			if *val, ok = v.(string); !ok {
+				return opts, fmt.Errorf("token auth requires a valid option string: %q", key)
+			}
+		}
+	}
+	if opts.rootCertBundle == "" && opts.jwks == "" {
+		return opts, fmt.Errorf("token auth requires a valid option string: %q or %q", "rootcertbundle", "jwks")
+	}
+
+	if refresh, ok := options["jwksrefreshinterval"]; ok {
+		var err error
+		switch v := refresh.(type) {
+		case string:
+			opts.jwksRefresh, err = time.ParseDuration(v)
+		case int:
+			opts.jwksRefresh = time.Duration(v) * time.Second
+		default:
+			err = fmt.Errorf("invalid type %T", refresh)
+		}
+		if err != nil || opts.jwksRefresh < 0 {
+			return opts, fmt.Errorf("token auth requires a valid option duration: jwksrefreshinterval: %v", refresh)
+		}
+	}
 
 	autoRedirectVal, ok := options["autoredirect"]
 	if ok {
@@ -181,15 +216,37 @@ func newAccessController(options map[string]interface{}) (auth.AccessController,
 		return nil, err
 	}
 
-	fp, err := os.Open(config.rootCertBundle)
+	ac := &accessController{
+		realm:        config.realm,
+		autoRedirect: config.autoRedirect,
+		issuer:       config.issuer,
+		service:      config.service,
+		rootCerts:    x509.NewCertPool(),
+	}
+	if config.rootCertBundle != "" {
+		ac.rootCerts, ac.trustedKeys, err = loadRootCertBundle(config.rootCertBundle)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.jwks != "" {
+		ac.jwks = newJWKS(config.jwks, config.jwksRefresh)
+	}
+	return ac, nil
+}
+
+// loadRootCertBundle loads the root certificates of the token signing keys,
+// and their keys by key ID.
+func loadRootCertBundle(rootCertBundle string) (*x509.CertPool, map[string]libtrust.PublicKey, error) {
+	fp, err := os.Open(rootCertBundle)
 	if err != nil {
-		return nil, fmt.Errorf("unable to open token auth root certificate bundle file %q: %s", config.rootCertBundle, err)
+		return nil, nil, fmt.Errorf("unable to open token auth root certificate bundle file %q: %s", rootCertBundle, err)
 	}
 	defer fp.Close()
 
 	rawCertBundle, err := ioutil.ReadAll(fp)
 	if err != nil {
-		return nil, fmt.Errorf("unable to read token auth root certificate bundle file %q: %s", config.rootCertBundle, err)
+		return nil, nil, fmt.Errorf("unable to read token auth root certificate bundle file %q: %s", rootCertBundle, err)
 	}
 
 	var rootCerts []*x509.Certificate
@@ -198,7 +255,7 @@ func newAccessController(options map[string]interface{}) (auth.AccessController,
 		if pemBlock.Type == "CERTIFICATE" {
 			cert, err := x509.ParseCertificate(pemBlock.Bytes)
 			if err != nil {
-				return nil, fmt.Errorf("unable to parse token auth root certificate: %s", err)
+				return nil, nil, fmt.Errorf("unable to parse token auth root certificate: %s", err)
 			}
 
 			rootCerts = append(rootCerts, cert)
@@ -208,7 +265,7 @@ func newAccessController(options map[string]interface{}) (auth.AccessController,
 	}
 
 	if len(rootCerts) == 0 {
-		return nil, errors.New("token auth requires at least one token signing root certificate")
+		return nil, nil, errors.New("token auth requires at least one token signing root certificate")
 	}
 
 	rootPool := x509.NewCertPool()
@@ -217,19 +274,12 @@ func newAccessController(options map[string]interface{}) (auth.AccessController,
 		rootPool.AddCert(rootCert)
 		pubKey, err := libtrust.FromCryptoPublicKey(crypto.PublicKey(rootCert.PublicKey))
 		if err != nil {
-			return nil, fmt.Errorf("unable to get public key from token auth root certificate: %s", err)
+			return nil, nil, fmt.Errorf("unable to get public key from token auth root certificate: %s", err)
 		}
 		trustedKeys[pubKey.KeyID()] = pubKey
 	}
 
-	return &accessController{
-		realm:        config.realm,
-		autoRedirect: config.autoRedirect,
-		issuer:       config.issuer,
-		service:      config.service,
-		rootCerts:    rootPool,
-		trustedKeys:  trustedKeys,
-	}, nil
+	return rootPool, trustedKeys, nil
 }
 
 // Authorized handles checking whether the given request is authorized
@@ -269,6 +319,14 @@ func (ac *accessController) Authorized(ctx context.Context, accessItems ...auth.
 		TrustedKeys:       ac.trustedKeys,
 	}
 
+	// keys of the JWKS are looked up by the key ID of the token
+	keyID := token.Header.KeyID
+	if _, trusted := ac.trustedKeys[keyID]; !trusted && keyID != "" && ac.jwks != nil {
+		if key := ac.jwks.key(keyID); key != nil {
+			verifyOpts.TrustedKeys = map[string]libtrust.PublicKey{keyID: key}
+		}
+	}
+
 	if err = token.Verify(verifyOpts); err != nil {
 		challenge.err = err
 		return nil, challenge
@@ -284,7 +342,7 @@ func (ac *accessController) Authorized(ctx context.Context, accessItems ...auth.
 
 	ctx = auth.WithResources(ctx, token.resources())
 
-	return auth.WithUser(ctx, auth.UserInfo{Name: token.Claims.Subject}), nil
+	return auth.WithUser(ctx, auth.UserInfo{Name: token.Claims.Subject, Claims: token.Claims.Values}), nil
 }
 
 // init handles registering the token auth backend.
@@ -0,0 +1,159 @@
+package token
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/docker/libtrust"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultJWKSRefreshInterval is the interval the keys of a JWKS are
+	// fetched again on when none is configured.
+	defaultJWKSRefreshInterval = time.Hour
+
+	// jwksMinRefreshInterval is the minimum interval between the fetches of
+	// a JWKS triggered by tokens signed with unknown keys, so that they
+	// can't flood the issuer.
+	jwksMinRefreshInterval = 10 * time.Second
+
+	// maxJWKSSize is the maximum size of the JWKS documents read.
+	maxJWKSSize = 1 << 20
+)
+
+// jwks caches the signing keys of a JSON Web Key Set, served by the issuer of
+// the tokens, by key ID. The keys are fetched again once the refresh interval
+// elapsed, in the background, and when a token is signed by an unknown key, as
+// the issuer rotates its keys. If the issuer can't be reached, the keys
+// fetched last are kept.
+type jwks struct {
+	url             string
+	client          *http.Client
+	refreshInterval time.Duration
+
+	mu          sync.Mutex
+	keys        map[string]libtrust.PublicKey
+	refreshedAt time.Time
+	attemptedAt time.Time
+	refreshing  bool
+}
+
+func newJWKS(url string, refreshInterval time.Duration) *jwks {
+	if refreshInterval <= 0 {
+		refreshInterval = defaultJWKSRefreshInterval
+	}
+	j := &jwks{
+		url:             url,
+		client:          &http.Client{Timeout: 30 * time.Second},
+		refreshInterval: refreshInterval,
+		attemptedAt:     time.Now(),
+		refreshing:      true,
+	}
+	// the keys are fetched again on the first token if the issuer is down
+	j.refresh()
+	return j
+}
+
+// key returns the key of the key ID. Stale keys are refreshed in the
+// background, while unknown keys are looked up right away.
+func (j *jwks) key(keyID string) libtrust.PublicKey {
+	j.mu.Lock()
+	now := time.Now()
+	key, ok := j.keys[keyID]
+	fresh := now.Sub(j.refreshedAt) < j.refreshInterval
+	throttled := j.refreshing || now.Sub(j.attemptedAt) < jwksMinRefreshInterval
+	if (ok && fresh) || throttled {
+		j.mu.Unlock()
+		return key
+	}
+	j.refreshing = true
+	j.attemptedAt = now
+	j.mu.Unlock()
+
+	if ok {
+		go j.refresh()
+		return key
+	}
+
+	j.refresh()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.keys[keyID]
+}
+
+// refresh fetches the keys of the JWKS, keeping the previous ones on error.
+func (j *jwks) refresh() {
+	keys, err := j.fetch()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.refreshing = false
+	if err != nil {
+		log.Warnf("unable to fetch token signing keys from %s: %v", j.url, err)
+		return
+	}
+	j.keys = keys
+	j.refreshedAt = j.attemptedAt
+}
+
+func (j *jwks) fetch() (map[string]libtrust.PublicKey, error) {
+	resp, err := j.client.Get(j.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxJWKSSize))
+	if err != nil {
+		return nil, err
+	}
+	return parseJWKS(body)
+}
+
+// parseJWKS parses the signing keys of a JWKS by key ID. The key IDs of a
+// JWKS are opaque: keys are also indexed by their libtrust fingerprint, for
+// the tokens issued by the token server.
+func parseJWKS(data []byte) (map[string]libtrust.PublicKey, error) {
+	var set struct {
+		Keys []map[string]interface{} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %v", err)
+	}
+
+	keys := make(map[string]libtrust.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if use, ok := jwk["use"].(string); ok && use != "sig" {
+			continue
+		}
+		keyID, _ := jwk["kid"].(string)
+
+		// libtrust only accepts its own fingerprints as key IDs
+		delete(jwk, "kid")
+		raw, err := json.Marshal(jwk)
+		if err != nil {
+			return nil, err
+		}
+		key, err := libtrust.UnmarshalPublicKeyJWK(raw)
+		if err != nil {
+			// keys of unsupported types are not used to sign tokens
+			log.Debugf("skipping JWKS key %q: %v", keyID, err)
+			continue
+		}
+
+		if keyID != "" {
+			keys[keyID] = key
+		}
+		keys[key.KeyID()] = key
+	}
+	return keys, nil
+}
@@ -0,0 +1,201 @@
+package token
+
+import (
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/docker/libtrust"
+)
+
+// jwksServer serves the public keys of a JWKS with opaque key IDs.
+type jwksServer struct {
+	mu     sync.Mutex
+	keys   map[string]libtrust.PrivateKey
+	down   bool
+	served int
+}
+
+func (s *jwksServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.served++
+	if s.down {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	var set struct {
+		Keys []map[string]interface{} `json:"keys"`
+	}
+	for kid, key := range s.keys {
+		raw, _ := key.PublicKey().MarshalJSON()
+		var jwk map[string]interface{}
+		json.Unmarshal(raw, &jwk)
+		jwk["kid"] = kid
+		jwk["use"] = "sig"
+		set.Keys = append(set.Keys, jwk)
+	}
+	// encryption keys are not trusted
+	set.Keys = append(set.Keys, map[string]interface{}{"kty": "RSA", "use": "enc", "kid": "enc"})
+	json.NewEncoder(w).Encode(set)
+}
+
+func (s *jwksServer) set(f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f()
+}
+
+// makeKeyIDToken makes a token signed by key, identified by its key ID.
+func makeKeyIDToken(t *testing.T, key libtrust.PrivateKey, keyID, issuer, audience string, access []*ResourceActions) string {
+	t.Helper()
+	now := time.Now()
+	header, err := json.Marshal(&Header{Type: "JWT", SigningAlg: "RS256", KeyID: keyID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := json.Marshal(&ClaimSet{
+		Issuer:     issuer,
+		Subject:    "foo",
+		Audience:   audience,
+		Expiration: now.Add(5 * time.Minute).Unix(),
+		NotBefore:  now.Unix(),
+		IssuedAt:   now.Unix(),
+		Access:     access,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := joseBase64UrlEncode(header) + "." + joseBase64UrlEncode(claims)
+	sig, alg, err := key.Sign(strings.NewReader(payload), crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alg != "RS256" {
+		t.Fatalf("unexpected signing algorithm %s", alg)
+	}
+	return payload + "." + joseBase64UrlEncode(sig)
+}
+
+func TestAccessControllerJWKS(t *testing.T) {
+	keys := make([]libtrust.PrivateKey, 2)
+	for i := range keys {
+		key, err := libtrust.GenerateRSA2048PrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = key
+	}
+
+	js := &jwksServer{keys: map[string]libtrust.PrivateKey{"key-1": keys[0]}}
+	server := httptest.NewServer(js)
+	defer server.Close()
+
+	issuer := "test-issuer.example.com"
+	service := "test-service.example.com"
+	ac, err := newAccessController(map[string]interface{}{
+		"realm":               "https://auth.example.com/token/",
+		"issuer":              issuer,
+		"service":             service,
+		"jwks":                server.URL,
+		"jwksrefreshinterval": "1h",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	accessController := ac.(*accessController)
+
+	testAccess := auth.Access{
+		Resource: auth.Resource{Type: "repository", Name: "foo/bar"},
+		Action:   "pull",
+	}
+	access := []*ResourceActions{{Type: "repository", Name: "foo/bar", Actions: []string{"pull"}}}
+	authorized := func(token string) error {
+		req, err := http.NewRequest("GET", "http://example.com/v2/foo/bar/tags/list", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+		_, err = accessController.Authorized(context.WithRequest(context.Background(), req), testAccess)
+		return err
+	}
+	// expire the throttling of the fetches, and the keys if stale is set
+	expire := func(stale bool) {
+		accessController.jwks.mu.Lock()
+		defer accessController.jwks.mu.Unlock()
+		accessController.jwks.attemptedAt = time.Time{}
+		if stale {
+			accessController.jwks.refreshedAt = time.Time{}
+		}
+	}
+
+	if err := authorized(makeKeyIDToken(t, keys[0], "key-1", issuer, service, access)); err != nil {
+		t.Fatalf("unexpected error authorizing token of the JWKS: %v", err)
+	}
+	if err := authorized(makeKeyIDToken(t, keys[1], "key-1", issuer, service, access)); err == nil {
+		t.Fatal("expected an error authorizing token signed by another key")
+	}
+	if err := authorized(makeKeyIDToken(t, keys[0], "enc", issuer, service, access)); err == nil {
+		t.Fatal("expected an error authorizing token of an encryption key")
+	}
+
+	// the issuer rotates its keys: unknown keys are looked up right away,
+	// once the previous lookup is old enough
+	js.set(func() { js.keys["key-2"] = keys[1] })
+	token := makeKeyIDToken(t, keys[1], "key-2", issuer, service, access)
+	if err := authorized(token); err == nil {
+		t.Fatal("expected an error authorizing token of a rotated key before the lookups are allowed again")
+	}
+	expire(false)
+	if err := authorized(token); err != nil {
+		t.Fatalf("unexpected error authorizing token of a rotated key: %v", err)
+	}
+
+	// the keys are kept while the issuer is down
+	js.set(func() { js.down = true; js.served = 0 })
+	expire(true)
+	if err := authorized(makeKeyIDToken(t, keys[0], "key-1", issuer, service, access)); err != nil {
+		t.Fatalf("unexpected error authorizing token while the JWKS is down: %v", err)
+	}
+	// stale keys are refreshed in the background
+	for i := 0; ; i++ {
+		accessController.jwks.mu.Lock()
+		refreshing := accessController.jwks.refreshing
+		accessController.jwks.mu.Unlock()
+		if !refreshing {
+			break
+		}
+		if i == 100 {
+			t.Fatal("timeout waiting for the JWKS to be refreshed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	js.set(func() {
+		if js.served != 1 {
+			t.Fatalf("unexpected fetches of the JWKS: %d", js.served)
+		}
+	})
+	if err := authorized(token); err != nil {
+		t.Fatalf("unexpected error authorizing token while the JWKS is down: %v", err)
+	}
+}
+
+func TestAccessControllerRequiresKeys(t *testing.T) {
+	_, err := newAccessController(map[string]interface{}{
+		"realm":   "https://auth.example.com/token/",
+		"issuer":  "test-issuer.example.com",
+		"service": "test-service.example.com",
+	})
+	if err == nil {
+		t.Fatal("expected an error without root certificates nor JWKS")
+	}
+}
@@ -52,6 +52,10 @@ type ClaimSet struct {
 
 	// Private claims
 	Access []*ResourceActions `json:"access"`
+
+	// Values are all the claims of the token by name, including those the
+	// claim set has no field for.
+	Values map[string]interface{} `json:"-"`
 }
 
 // Header describes the header section of a JSON Web Token.
@@ -127,6 +131,9 @@ func NewToken(rawToken string) (*Token, error) {
 	if err = json.Unmarshal(claimsJSON, token.Claims); err != nil {
 		return nil, ErrMalformedToken
 	}
+	if err = json.Unmarshal(claimsJSON, &token.Claims.Values); err != nil {
+		return nil, ErrMalformedToken
+	}
 
 	return token, nil
 }
@@ -455,6 +455,9 @@ func TestAccessController(t *testing.T) {
 	if userInfo.Name != "foo" {
 		t.Fatalf("expected user name %q, got %q", "foo", userInfo.Name)
 	}
+	if userInfo.Claims["sub"] != "foo" {
+		t.Fatalf("expected the claims of the token, got %v", userInfo.Claims)
+	}
 
 	// 5. Supply a token with full admin rights, which is represented as "*".
 	token, err = makeTestToken(
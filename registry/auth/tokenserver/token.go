@@ -0,0 +1,218 @@
+package tokenserver
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/distribution/distribution/v3/registry/auth/token"
+	"github.com/docker/libtrust"
+)
+
+// signer signs the tokens with the key of a certificate, whose chain is
+// embedded in the tokens so that the registry can verify them against its
+// root certificate bundle.
+type signer struct {
+	key  libtrust.PrivateKey
+	alg  string
+	hash crypto.Hash
+	x5c  []string
+}
+
+// newSigner loads the certificate and private key signing the tokens from
+// PEM files.
+func newSigner(certFile, keyFile string) (*signer, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load the signing certificate: %v", err)
+	}
+
+	s := &signer{hash: crypto.SHA256}
+	switch k := cert.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+		s.alg = "RS256"
+	case *ecdsa.PrivateKey:
+		switch k.Curve.Params().BitSize {
+		case 256:
+			s.alg = "ES256"
+		case 384:
+			s.alg = "ES384"
+		case 521:
+			s.alg = "ES512"
+		}
+	}
+	if s.alg == "" {
+		return nil, fmt.Errorf("unsupported signing key type %T", cert.PrivateKey)
+	}
+
+	s.key, err = libtrust.FromCryptoPrivateKey(cert.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	for _, der := range cert.Certificate {
+		s.x5c = append(s.x5c, base64.StdEncoding.EncodeToString(der))
+	}
+	return s, nil
+}
+
+// createJWT creates and signs a JSON Web Token for the given subject and
+// audience with the granted access.
+func (s *signer) createJWT(issuer, subject, audience string, expiration time.Duration, grantedAccessList []auth.Access) (string, time.Time, error) {
+	// Make a set of access entries to put in the token's claimset.
+	resourceActionSets := make(map[auth.Resource]map[string]struct{}, len(grantedAccessList))
+	var resources []auth.Resource
+	for _, access := range grantedAccessList {
+		actionSet, exists := resourceActionSets[access.Resource]
+		if !exists {
+			actionSet = map[string]struct{}{}
+			resourceActionSets[access.Resource] = actionSet
+			resources = append(resources, access.Resource)
+		}
+		actionSet[access.Action] = struct{}{}
+	}
+
+	accessEntries := make([]*token.ResourceActions, 0, len(resourceActionSets))
+	for _, resource := range resources {
+		actions := make([]string, 0, len(resourceActionSets[resource]))
+		for action := range resourceActionSets[resource] {
+			actions = append(actions, action)
+		}
+
+		accessEntries = append(accessEntries, &token.ResourceActions{
+			Type:    resource.Type,
+			Class:   resource.Class,
+			Name:    resource.Name,
+			Actions: actions,
+		})
+	}
+
+	randomBytes := make([]byte, 15)
+	if _, err := io.ReadFull(rand.Reader, randomBytes); err != nil {
+		return "", time.Time{}, err
+	}
+
+	now := time.Now()
+	joseHeader := token.Header{
+		Type:       "JWT",
+		SigningAlg: s.alg,
+		X5c:        s.x5c,
+	}
+	claimSet := token.ClaimSet{
+		Issuer:     issuer,
+		Subject:    subject,
+		Audience:   audience,
+		Expiration: now.Add(expiration).Unix(),
+		NotBefore:  now.Unix(),
+		IssuedAt:   now.Unix(),
+		JWTID:      base64.URLEncoding.EncodeToString(randomBytes),
+
+		Access: accessEntries,
+	}
+
+	joseHeaderBytes, err := json.Marshal(joseHeader)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("unable to encode jose header: %s", err)
+	}
+	claimSetBytes, err := json.Marshal(claimSet)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("unable to encode claim set: %s", err)
+	}
+
+	encodingToSign := fmt.Sprintf("%s.%s", joseBase64Encode(joseHeaderBytes), joseBase64Encode(claimSetBytes))
+
+	signatureBytes, _, err := s.key.Sign(strings.NewReader(encodingToSign), s.hash)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("unable to sign jwt payload: %s", err)
+	}
+
+	return fmt.Sprintf("%s.%s", encodingToSign, joseBase64Encode(signatureBytes)), now, nil
+}
+
+func joseBase64Encode(data []byte) string {
+	return strings.TrimRight(base64.URLEncoding.EncodeToString(data), "=")
+}
+
+// resolveScopeSpecifiers converts a list of scope specifiers from a token
+// request's scope parameters into a list of standard access objects.
+func resolveScopeSpecifiers(ctx context.Context, scopeSpecs []string) []auth.Access {
+	requestedAccessSet := make(map[auth.Access]struct{}, 2*len(scopeSpecs))
+	requestedAccessList := make([]auth.Access, 0, len(scopeSpecs))
+
+	for _, scopeSpecifier := range scopeSpecs {
+		if scopeSpecifier == "" {
+			continue
+		}
+
+		// There should be 3 parts, separated by a `:` character. The name
+		// may itself contain a port, separated by a `:`.
+		typeEnd := strings.Index(scopeSpecifier, ":")
+		actionsStart := strings.LastIndex(scopeSpecifier, ":")
+		if typeEnd < 0 || typeEnd == actionsStart {
+			dcontext.GetLogger(ctx).Infof("ignoring unsupported scope format %s", scopeSpecifier)
+			continue
+		}
+
+		resourceType, resourceClass := splitResourceClass(scopeSpecifier[:typeEnd])
+		if resourceType == "" {
+			continue
+		}
+		resourceName := scopeSpecifier[typeEnd+1 : actionsStart]
+
+		// Actions should be a comma-separated list of actions.
+		for _, action := range strings.Split(scopeSpecifier[actionsStart+1:], ",") {
+			requestedAccess := auth.Access{
+				Resource: auth.Resource{
+					Type:  resourceType,
+					Class: resourceClass,
+					Name:  resourceName,
+				},
+				Action: action,
+			}
+
+			if _, ok := requestedAccessSet[requestedAccess]; !ok {
+				requestedAccessSet[requestedAccess] = struct{}{}
+				requestedAccessList = append(requestedAccessList, requestedAccess)
+			}
+		}
+	}
+
+	return requestedAccessList
+}
+
+var typeRegexp = regexp.MustCompile(`^([a-z0-9]+)(\([a-z0-9]+\))?$`)
+
+func splitResourceClass(t string) (string, string) {
+	matches := typeRegexp.FindStringSubmatch(t)
+	if len(matches) < 2 {
+		return "", ""
+	}
+	if len(matches) == 2 || len(matches[2]) < 2 {
+		return matches[1], ""
+	}
+	return matches[1], matches[2][1 : len(matches[2])-1]
+}
+
+// scopeList formats a list of access as a space separated list of scopes.
+func scopeList(access []auth.Access) string {
+	var scopes []string
+	for _, a := range access {
+		if a.Class != "" {
+			scopes = append(scopes, fmt.Sprintf("%s(%s):%s:%s", a.Type, a.Class, a.Name, a.Action))
+		} else {
+			scopes = append(scopes, fmt.Sprintf("%s:%s:%s", a.Type, a.Name, a.Action))
+		}
+	}
+	return strings.Join(scopes, " ")
+}
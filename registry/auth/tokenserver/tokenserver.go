@@ -0,0 +1,247 @@
+// Package tokenserver implements a token server issuing the bearer tokens of
+// the token authentication, as described in docs/spec/auth/token.md, to the
+// users of an htpasswd file or of the configuration. The access granted to
+// each user is defined by an ACL file.
+package tokenserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/distribution/distribution/v3/registry/auth/acl"
+	_ "github.com/distribution/distribution/v3/registry/auth/htpasswd" // register the htpasswd access controller
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// DefaultPath is the path of the token endpoint when not configured.
+	DefaultPath = "/auth/token"
+
+	defaultExpiration = 5 * time.Minute
+)
+
+// Server issues tokens granting the authenticated users the access the ACL
+// allows them.
+type Server struct {
+	issuer     string
+	expiration time.Duration
+	signer     *signer
+	users      map[string][]byte
+	htpasswd   auth.CredentialAuthenticator
+	acl        acl.ACL
+}
+
+var _ http.Handler = &Server{}
+
+// New creates a token server from its configuration.
+func New(config configuration.TokenServer) (*Server, error) {
+	if config.Issuer == "" {
+		return nil, fmt.Errorf("tokenserver: issuer is required")
+	}
+	if config.Certificate == "" || config.Key == "" {
+		return nil, fmt.Errorf("tokenserver: certificate and key are required")
+	}
+	if config.ACL == "" {
+		return nil, fmt.Errorf("tokenserver: acl is required")
+	}
+
+	s, err := newSigner(config.Certificate, config.Key)
+	if err != nil {
+		return nil, fmt.Errorf("tokenserver: %v", err)
+	}
+	list, err := acl.Load(config.ACL)
+	if err != nil {
+		return nil, fmt.Errorf("tokenserver: %v", err)
+	}
+
+	ts := &Server{
+		issuer:     config.Issuer,
+		expiration: config.Expiration,
+		signer:     s,
+		users:      make(map[string][]byte, len(config.Users)),
+		acl:        list,
+	}
+	if ts.expiration <= 0 {
+		ts.expiration = defaultExpiration
+	}
+	for name, hash := range config.Users {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("tokenserver: invalid bcrypt hash of user %q: %v", name, err)
+		}
+		ts.users[name] = []byte(hash)
+	}
+	if config.HTPasswd != "" {
+		ac, err := auth.GetAccessController("htpasswd", map[string]interface{}{
+			"realm": config.Issuer,
+			"path":  config.HTPasswd,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("tokenserver: %v", err)
+		}
+		ts.htpasswd = ac.(auth.CredentialAuthenticator)
+	}
+
+	return ts, nil
+}
+
+// ServeHTTP serves the token requests, with GET as the token
+// authentication, and POST as its OAuth2 flavour.
+func (ts *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := dcontext.WithRequest(r.Context(), r)
+	ctx = dcontext.WithLogger(ctx, dcontext.GetRequestLogger(ctx))
+
+	switch r.Method {
+	case http.MethodGet:
+		ts.getToken(ctx, w, r)
+	case http.MethodPost:
+		ts.postToken(ctx, w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		handleError(ctx, errcode.ErrorCodeUnsupported, w)
+	}
+}
+
+// authenticate checks the password of the user, against the users of the
+// configuration then the htpasswd file.
+func (ts *Server) authenticate(username, password string) error {
+	if hash, ok := ts.users[username]; ok {
+		if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil {
+			return auth.ErrAuthenticationFailure
+		}
+		return nil
+	}
+	if ts.htpasswd != nil {
+		return ts.htpasswd.AuthenticateUser(username, password)
+	}
+
+	// timing attack paranoia
+	bcrypt.CompareHashAndPassword([]byte{}, []byte(password))
+	return auth.ErrAuthenticationFailure
+}
+
+type getTokenResponse struct {
+	Token       string `json:"token"`
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+	IssuedAt    string `json:"issued_at"`
+}
+
+// getToken issues a token to the client authenticated with basic auth, or
+// to an anonymous client when no credentials are provided.
+func (ts *Server) getToken(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	var scopes []string
+	for _, scope := range params["scope"] {
+		scopes = append(scopes, strings.Fields(scope)...)
+	}
+
+	username, password, ok := r.BasicAuth()
+	if ok {
+		if err := ts.authenticate(username, password); err != nil {
+			dcontext.GetLogger(ctx).Errorf("error authenticating user %q: %v", username, err)
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", ts.issuer))
+			handleError(ctx, errcode.ErrorCodeUnauthorized.WithDetail("invalid credentials"), w)
+			return
+		}
+	}
+
+	token, scope, issuedAt, err := ts.issue(ctx, username, params.Get("service"), scopes)
+	if err != nil {
+		handleError(ctx, err, w)
+		return
+	}
+	dcontext.GetLogger(ctx).Infof("issued token to %q for %q", username, scope)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(getTokenResponse{
+		Token:       token,
+		AccessToken: token,
+		ExpiresIn:   int(ts.expiration.Seconds()),
+		IssuedAt:    issuedAt.UTC().Format(time.RFC3339),
+	})
+}
+
+type postTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	Scope       string `json:"scope,omitempty"`
+	ExpiresIn   int    `json:"expires_in"`
+	IssuedAt    string `json:"issued_at"`
+}
+
+// postToken issues a token with the password grant of OAuth2. Refresh tokens
+// are not supported.
+func (ts *Server) postToken(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	grantType := r.PostFormValue("grant_type")
+	if grantType == "" {
+		handleError(ctx, ErrorMissingRequiredField.WithDetail("missing grant_type value"), w)
+		return
+	}
+
+	service := r.PostFormValue("service")
+	if service == "" {
+		handleError(ctx, ErrorMissingRequiredField.WithDetail("missing service value"), w)
+		return
+	}
+
+	if grantType != "password" {
+		handleError(ctx, ErrorUnsupportedValue.WithDetail("unsupported grant_type value"), w)
+		return
+	}
+	if accessType := r.PostFormValue("access_type"); accessType == "offline" {
+		handleError(ctx, ErrorUnsupportedValue.WithDetail("refresh tokens are not supported"), w)
+		return
+	}
+
+	username := r.PostFormValue("username")
+	if username == "" {
+		handleError(ctx, ErrorMissingRequiredField.WithDetail("missing username value"), w)
+		return
+	}
+	if err := ts.authenticate(username, r.PostFormValue("password")); err != nil {
+		dcontext.GetLogger(ctx).Errorf("error authenticating user %q: %v", username, err)
+		handleError(ctx, errcode.ErrorCodeUnauthorized.WithDetail("invalid credentials"), w)
+		return
+	}
+
+	token, scope, issuedAt, err := ts.issue(ctx, username, service, strings.Fields(r.PostFormValue("scope")))
+	if err != nil {
+		handleError(ctx, err, w)
+		return
+	}
+	dcontext.GetLogger(ctx).Infof("issued token to %q for %q", username, scope)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(postTokenResponse{
+		AccessToken: token,
+		Scope:       scope,
+		ExpiresIn:   int(ts.expiration.Seconds()),
+		IssuedAt:    issuedAt.UTC().Format(time.RFC3339),
+	})
+}
+
+// issue creates a token for the account, an empty one being anonymous,
+// granting the access of the requested scopes allowed by the ACL. It returns
+// the scope of the access granted.
+func (ts *Server) issue(ctx context.Context, account, service string, scopes []string) (string, string, time.Time, error) {
+	granted := ts.acl.Filter(account, resolveScopeSpecifiers(ctx, scopes))
+	token, issuedAt, err := ts.signer.createJWT(ts.issuer, account, service, ts.expiration, granted)
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	return token, scopeList(granted), issuedAt, nil
+}
+
+func handleError(ctx context.Context, err error, w http.ResponseWriter) {
+	if serveErr := errcode.ServeJSON(w, err); serveErr != nil {
+		dcontext.GetLogger(ctx).Errorf("error sending error response: %v", serveErr)
+	}
+}
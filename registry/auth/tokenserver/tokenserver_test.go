@@ -0,0 +1,224 @@
+package tokenserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/auth"
+	_ "github.com/distribution/distribution/v3/registry/auth/token"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testACL = `
+- account: admin
+  name: "regexp:.*"
+  actions: ["*"]
+- account: "*"
+  name: "${account}/*"
+  actions: [pull, push, delete]
+- account: "*"
+  name: "*/*"
+  actions: [pull]
+- account: ""
+  name: public/*
+  actions: [pull]
+`
+
+func writeACL(t *testing.T, content string) string {
+	p := filepath.Join(t.TempDir(), "acl.yml")
+	if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func repositoryAccess(name string, actions ...string) []auth.Access {
+	var access []auth.Access
+	for _, action := range actions {
+		access = append(access, auth.Access{
+			Resource: auth.Resource{Type: "repository", Name: name},
+			Action:   action,
+		})
+	}
+	return access
+}
+
+// writeCertificate writes a self-signed certificate and its key to dir.
+func writeCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "token-signer"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestTokenServer(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCertificate(t, dir)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, err := New(configuration.TokenServer{
+		Issuer:      "test-issuer",
+		Certificate: certFile,
+		Key:         keyFile,
+		Users:       map[string]string{"alice": string(hash)},
+		ACL:         writeACL(t, testACL),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating token server: %v", err)
+	}
+	server := httptest.NewServer(ts)
+	defer server.Close()
+
+	accessController, err := auth.GetAccessController("token", map[string]interface{}{
+		"realm":          server.URL,
+		"issuer":         "test-issuer",
+		"service":        "registry",
+		"rootcertbundle": certFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// authorized checks the token against the token access controller of
+	// the registry
+	authorized := func(token string, access ...auth.Access) error {
+		req, _ := http.NewRequest(http.MethodGet, "/v2/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		_, err := accessController.Authorized(dcontext.WithRequest(dcontext.Background(), req), access...)
+		return err
+	}
+
+	// basic auth
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"?service=registry&scope=repository:alice/app:pull,push&scope=repository:bob/app:push", nil)
+	req.SetBasicAuth("alice", "secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+	var getResponse getTokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&getResponse); err != nil {
+		t.Fatal(err)
+	}
+	if err := authorized(getResponse.Token, repositoryAccess("alice/app", "pull", "push")...); err != nil {
+		t.Fatalf("expected the token to grant access: %v", err)
+	}
+	if err := authorized(getResponse.Token, repositoryAccess("bob/app", "push")...); err == nil {
+		t.Fatal("expected the token not to grant access")
+	}
+
+	// invalid credentials
+	req.SetBasicAuth("alice", "guess")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+
+	// password grant
+	resp, err = http.PostForm(server.URL, url.Values{
+		"grant_type": {"password"},
+		"service":    {"registry"},
+		"client_id":  {"test"},
+		"username":   {"alice"},
+		"password":   {"secret"},
+		"scope":      {"repository:bob/app:pull repository:bob/app:push"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+	var postResponse postTokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&postResponse); err != nil {
+		t.Fatal(err)
+	}
+	if postResponse.Scope != "repository:bob/app:pull" {
+		t.Fatalf("unexpected scope %q", postResponse.Scope)
+	}
+	if err := authorized(postResponse.AccessToken, repositoryAccess("bob/app", "pull")...); err != nil {
+		t.Fatalf("expected the token to grant access: %v", err)
+	}
+
+	// anonymous
+	resp, err = http.Get(server.URL + "?service=registry&scope=repository:public/app:pull")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&getResponse); err != nil {
+		t.Fatal(err)
+	}
+	if err := authorized(getResponse.Token, repositoryAccess("public/app", "pull")...); err != nil {
+		t.Fatalf("expected the token to grant access: %v", err)
+	}
+}
+
+func TestResolveScopeSpecifiers(t *testing.T) {
+	access := resolveScopeSpecifiers(dcontext.Background(), []string{
+		"repository:foo/bar:pull,push",
+		"repository(plugin):foo/baz:pull",
+		"registry:catalog:*",
+		"invalid",
+	})
+	scopes := scopeList(access)
+	expected := "repository:foo/bar:pull repository:foo/bar:push repository(plugin):foo/baz:pull registry:catalog:*"
+	if scopes != expected {
+		t.Fatalf("unexpected scopes %q", strings.Split(scopes, " "))
+	}
+}
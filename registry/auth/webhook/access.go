@@ -0,0 +1,336 @@
+// Package webhook provides an access controller delegating the authorization
+// of the requests to an external HTTP service, such as an Open Policy Agent
+// server, after authenticating the users with another access controller.
+//
+// The access requested by each request is posted to the service, which
+// allows or denies it. Its decisions are cached for a configurable duration.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/auth"
+)
+
+const (
+	// defaultTimeout is how long the authorizer is waited for by default.
+	defaultTimeout = 5 * time.Second
+	// maxCachedDecisions bounds the number of decisions cached, the expired
+	// ones being dropped when it is reached.
+	maxCachedDecisions = 10000
+)
+
+// errAccessDenied is the error of the challenge of the requests denied by
+// the authorizer.
+var errAccessDenied = errors.New("access denied by the authorizer")
+
+// Request is the body of the requests posted to the authorizer.
+type Request struct {
+	// Subject is the name of the user authenticated, empty for anonymous
+	// requests.
+	Subject string `json:"subject"`
+	// Access lists the access requested, all of which must be allowed.
+	Access []Access `json:"access"`
+	// ClientIP is the address of the client of the registry.
+	ClientIP string `json:"clientIP"`
+}
+
+// Access is an action requested on a resource.
+type Access struct {
+	Type   string `json:"type"`
+	Class  string `json:"class,omitempty"`
+	Name   string `json:"name"`
+	Action string `json:"action"`
+}
+
+// Response is the body of the responses of the authorizer.
+type Response struct {
+	// Allowed is whether all the access requested is allowed.
+	Allowed bool `json:"allowed"`
+	// Reason explains the decision, and is logged when access is denied.
+	Reason string `json:"reason,omitempty"`
+	// TTL is how long the decision may be cached, in seconds, overriding
+	// the decisionttl option when set.
+	TTL *int `json:"ttl,omitempty"`
+}
+
+type accessController struct {
+	realm         string
+	authenticator auth.AccessController
+
+	url         string
+	headers     http.Header
+	client      *http.Client
+	decisionTTL time.Duration
+
+	mu        sync.Mutex
+	decisions map[string]decision
+}
+
+// decision is a cached response of the authorizer.
+type decision struct {
+	allowed bool
+	reason  string
+	expires time.Time
+}
+
+var (
+	_ auth.AccessController = &accessController{}
+	_ auth.Reloader         = &accessController{}
+)
+
+func newAccessController(options map[string]interface{}) (auth.AccessController, error) {
+	urlOpt, present := options["url"]
+	authorizerURL, ok := urlOpt.(string)
+	if !present || !ok {
+		return nil, fmt.Errorf(`"url" must be set for webhook access controller`)
+	}
+	if u, err := url.Parse(authorizerURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf(`"url" must be an http or https URL for webhook access controller: %v`, authorizerURL)
+	}
+
+	ac := &accessController{
+		url:       authorizerURL,
+		headers:   make(http.Header),
+		client:    &http.Client{Timeout: defaultTimeout},
+		decisions: make(map[string]decision),
+	}
+	if realm, ok := options["realm"].(string); ok {
+		ac.realm = realm
+	}
+	if timeout, present := options["timeout"]; present {
+		d, err := parseDuration(timeout)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf(`"timeout" must be a duration for webhook access controller: %v`, timeout)
+		}
+		ac.client.Timeout = d
+	}
+	if decisionTTL, present := options["decisionttl"]; present {
+		d, err := parseDuration(decisionTTL)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf(`"decisionttl" must be a duration for webhook access controller: %v`, decisionTTL)
+		}
+		ac.decisionTTL = d
+	}
+	if headers, present := options["headers"]; present {
+		m, ok := headers.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf(`"headers" must be a map for webhook access controller: %v`, headers)
+		}
+		for k, v := range m {
+			ac.headers.Set(fmt.Sprint(k), fmt.Sprint(v))
+		}
+	}
+
+	// the other options are those of the access controller authenticating
+	// the users, if any
+	if name, present := options["authenticator"]; present {
+		authenticatorName, ok := name.(string)
+		if !ok {
+			return nil, fmt.Errorf(`"authenticator" must be the name of an access controller for webhook access controller: %v`, name)
+		}
+		authenticatorOptions := make(map[string]interface{}, len(options))
+		for k, v := range options {
+			switch k {
+			case "url", "timeout", "decisionttl", "headers", "authenticator":
+			default:
+				authenticatorOptions[k] = v
+			}
+		}
+		authenticator, err := auth.GetAccessController(authenticatorName, authenticatorOptions)
+		if err != nil {
+			return nil, err
+		}
+		ac.authenticator = authenticator
+	}
+	return ac, nil
+}
+
+func parseDuration(v interface{}) (time.Duration, error) {
+	switch v := v.(type) {
+	case string:
+		return time.ParseDuration(v)
+	case int:
+		return time.Duration(v) * time.Second, nil
+	default:
+		return 0, fmt.Errorf("invalid type %T", v)
+	}
+}
+
+func (ac *accessController) Authorized(ctx context.Context, accessRecords ...auth.Access) (context.Context, error) {
+	if _, err := dcontext.GetRequest(ctx); err != nil {
+		return nil, err
+	}
+	if ac.authenticator != nil {
+		// the challenges of the authenticator carry the access requested
+		var err error
+		if ctx, err = ac.authenticator.Authorized(ctx, accessRecords...); err != nil {
+			return nil, err
+		}
+	}
+	// the requests requiring no access, such as those of the base route,
+	// only require the users to be authenticated
+	if len(accessRecords) == 0 {
+		return ctx, nil
+	}
+
+	request := Request{
+		Subject:  dcontext.GetStringValue(ctx, auth.UserNameKey),
+		ClientIP: dcontext.ClientIP(ctx),
+	}
+	for _, access := range accessRecords {
+		request.Access = append(request.Access, Access{
+			Type:   access.Type,
+			Class:  access.Class,
+			Name:   access.Name,
+			Action: access.Action,
+		})
+	}
+
+	d, err := ac.decide(ctx, request)
+	if err != nil {
+		return nil, fmt.Errorf("error requesting the authorizer: %w", err)
+	}
+	if !d.allowed {
+		dcontext.GetLogger(ctx).Errorf("user %q denied access by the authorizer: %s", request.Subject, d.reason)
+		return nil, &challenge{
+			realm: ac.realm,
+			err:   errAccessDenied,
+		}
+	}
+	return ctx, nil
+}
+
+// decide returns the decision of the authorizer for request, cached if it
+// was requested recently.
+func (ac *accessController) decide(ctx context.Context, request Request) (decision, error) {
+	key := cacheKey(request)
+	now := time.Now()
+	ac.mu.Lock()
+	d, ok := ac.decisions[key]
+	ac.mu.Unlock()
+	if ok && now.Before(d.expires) {
+		return d, nil
+	}
+
+	response, err := ac.post(ctx, request)
+	if err != nil {
+		return decision{}, err
+	}
+	d = decision{allowed: response.Allowed, reason: response.Reason}
+	ttl := ac.decisionTTL
+	if response.TTL != nil {
+		ttl = time.Duration(*response.TTL) * time.Second
+	}
+	if ttl <= 0 {
+		return d, nil
+	}
+	d.expires = now.Add(ttl)
+
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if len(ac.decisions) >= maxCachedDecisions {
+		for k, cached := range ac.decisions {
+			if !now.Before(cached.expires) {
+				delete(ac.decisions, k)
+			}
+		}
+		if len(ac.decisions) >= maxCachedDecisions {
+			ac.decisions = make(map[string]decision)
+		}
+	}
+	ac.decisions[key] = d
+	return d, nil
+}
+
+// post posts request to the authorizer and returns its response.
+func (ac *accessController) post(ctx context.Context, request Request) (Response, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return Response{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ac.url, bytes.NewReader(body))
+	if err != nil {
+		return Response{}, err
+	}
+	for k, v := range ac.headers {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := ac.client.Do(req)
+	if err != nil {
+		return Response{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return Response{}, fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	var response Response
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return Response{}, fmt.Errorf("invalid response: %w", err)
+	}
+	return response, nil
+}
+
+// cacheKey identifies the decisions for the same subject, client and
+// access, whatever the order of the access records.
+func cacheKey(request Request) string {
+	access := make([]string, 0, len(request.Access))
+	for _, a := range request.Access {
+		access = append(access, strings.Join([]string{a.Type, a.Class, a.Name, a.Action}, "\x00"))
+	}
+	sort.Strings(access)
+	return strings.Join(append([]string{request.Subject, request.ClientIP}, access...), "\x01")
+}
+
+// Reload reloads the access controller authenticating the users, and drops
+// the decisions cached.
+func (ac *accessController) Reload() error {
+	if reloader, ok := ac.authenticator.(auth.Reloader); ok {
+		if err := reloader.Reload(); err != nil {
+			return err
+		}
+	}
+	ac.mu.Lock()
+	ac.decisions = make(map[string]decision)
+	ac.mu.Unlock()
+	return nil
+}
+
+// challenge implements the auth.Challenge interface.
+type challenge struct {
+	realm string
+	err   error
+}
+
+var _ auth.Challenge = challenge{}
+
+// SetHeaders sets the basic challenge header on the response, if a realm is
+// configured.
+func (ch challenge) SetHeaders(r *http.Request, w http.ResponseWriter) {
+	if ch.realm != "" {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", ch.realm))
+	}
+}
+
+func (ch challenge) Error() string {
+	return fmt.Sprintf("webhook authorization challenge for realm %q: %s", ch.realm, ch.err)
+}
+
+func init() {
+	auth.Register("webhook", auth.InitFunc(newAccessController))
+}
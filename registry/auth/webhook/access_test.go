@@ -0,0 +1,219 @@
+package webhook
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/auth"
+	_ "github.com/distribution/distribution/v3/registry/auth/silly" // register the silly access controller
+)
+
+func TestWebhookAccessController(t *testing.T) {
+	var requests int32
+	authorizer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.Header.Get("Authorization") != "Bearer authorizer-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var request Request
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("unexpected error decoding request: %v", err)
+		}
+		if request.ClientIP != "127.0.0.1" {
+			t.Errorf("unexpected client IP %q", request.ClientIP)
+		}
+		if request.Access[0].Name == "broken/app" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		response := Response{Allowed: request.Subject == "silly"}
+		for _, access := range request.Access {
+			if access.Action != "pull" {
+				response = Response{Reason: access.Action + " denied"}
+			}
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer authorizer.Close()
+
+	accessController, err := newAccessController(map[string]interface{}{
+		"url":           authorizer.URL,
+		"decisionttl":   "1m",
+		"headers":       map[interface{}]interface{}{"Authorization": "Bearer authorizer-token"},
+		"authenticator": "silly",
+		"realm":         "test-realm",
+		"service":       "test-service",
+	})
+	if err != nil {
+		t.Fatalf("error creating access controller: %v", err)
+	}
+
+	var requested []auth.Access
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithRequest(context.Background(), r)
+		if _, err := accessController.Authorized(ctx, requested...); err != nil {
+			if challenge, ok := err.(auth.Challenge); ok {
+				challenge.SetHeaders(r, w)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	for _, tc := range []struct {
+		authenticated bool
+		access        []auth.Access
+		expected      int
+		challenge     string
+		requests      int32
+	}{
+		// challenged by the authenticator
+		{access: repositoryAccess("team/app", "pull"), expected: http.StatusUnauthorized, challenge: `Bearer realm="test-realm",service="test-service",scope="repository:team/app:pull"`},
+		{authenticated: true, access: repositoryAccess("team/app", "pull"), expected: http.StatusNoContent, requests: 1},
+		// the decision is cached
+		{authenticated: true, access: repositoryAccess("team/app", "pull"), expected: http.StatusNoContent, requests: 1},
+		{authenticated: true, access: repositoryAccess("team/app", "pull", "push"), expected: http.StatusUnauthorized, challenge: `Basic realm="test-realm"`, requests: 2},
+		{authenticated: true, access: repositoryAccess("team/app", "push", "pull"), expected: http.StatusUnauthorized, challenge: `Basic realm="test-realm"`, requests: 2},
+		// the base route only requires authentication
+		{authenticated: true, expected: http.StatusNoContent, requests: 2},
+		// the errors of the authorizer deny access
+		{authenticated: true, access: repositoryAccess("broken/app", "pull"), expected: http.StatusBadRequest, requests: 3},
+	} {
+		requested = tc.access
+		req, err := http.NewRequest("GET", server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.authenticated {
+			req.Header.Set("Authorization", "Bearer token")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error during GET: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.expected {
+			t.Errorf("requesting %v: unexpected status %d != %d", tc.access, resp.StatusCode, tc.expected)
+		}
+		if challenge := resp.Header.Get("WWW-Authenticate"); challenge != tc.challenge {
+			t.Errorf("requesting %v: unexpected challenge %q", tc.access, challenge)
+		}
+		if n := atomic.LoadInt32(&requests); n != tc.requests {
+			t.Errorf("requesting %v: unexpected number of authorizer requests %d != %d", tc.access, n, tc.requests)
+		}
+	}
+
+	// the decisions are dropped on reload
+	if err := accessController.(auth.Reloader).Reload(); err != nil {
+		t.Fatalf("unexpected error reloading: %v", err)
+	}
+	requested = repositoryAccess("team/app", "pull")
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.Header.Set("Authorization", "Bearer token")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error during GET: %v", err)
+	}
+	resp.Body.Close()
+	if n := atomic.LoadInt32(&requests); resp.StatusCode != http.StatusNoContent || n != 4 {
+		t.Errorf("unexpected status %d and number of authorizer requests %d after reload", resp.StatusCode, n)
+	}
+}
+
+func TestWebhookAccessControllerClientIP(t *testing.T) {
+	var clientIP atomic.Value
+	authorizer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request Request
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("unexpected error decoding request: %v", err)
+		}
+		clientIP.Store(request.ClientIP)
+		json.NewEncoder(w).Encode(Response{Allowed: true})
+	}))
+	defer authorizer.Close()
+
+	accessController, err := newAccessController(map[string]interface{}{
+		"url":   authorizer.URL,
+		"realm": "test-realm",
+	})
+	if err != nil {
+		t.Fatalf("error creating access controller: %v", err)
+	}
+
+	var resolved string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithRequest(context.Background(), r)
+		if resolved != "" {
+			ctx = context.WithClientIP(ctx, resolved)
+		}
+		if _, err := accessController.Authorized(ctx, repositoryAccess("team/app", "pull")...); err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	for _, tc := range []struct {
+		resolved string
+		expected string
+	}{
+		// the proxy headers of the clients are ignored
+		{expected: "127.0.0.1"},
+		// the address resolved by the application from its trusted proxies
+		{resolved: "10.1.2.3", expected: "10.1.2.3"},
+	} {
+		resolved = tc.resolved
+		req, err := http.NewRequest("GET", server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Forwarded-For", "192.168.1.1")
+		req.Header.Set("X-Real-Ip", "192.168.1.1")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error during GET: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			t.Errorf("unexpected status %d", resp.StatusCode)
+		}
+		if ip := clientIP.Load(); ip != tc.expected {
+			t.Errorf("unexpected client IP %v != %s", ip, tc.expected)
+		}
+	}
+}
+
+func TestWebhookAccessControllerOptions(t *testing.T) {
+	for _, options := range []map[string]interface{}{
+		{},
+		{"url": "authorizer.example.com"},
+		{"url": "https://authorizer.example.com", "timeout": "soon"},
+		{"url": "https://authorizer.example.com", "decisionttl": "-1m"},
+		{"url": "https://authorizer.example.com", "authenticator": "unknown"},
+	} {
+		if _, err := newAccessController(options); err == nil {
+			t.Errorf("expected an error creating an access controller with %v", options)
+		}
+	}
+}
+
+func repositoryAccess(name string, actions ...string) []auth.Access {
+	var access []auth.Access
+	for _, action := range actions {
+		access = append(access, auth.Access{
+			Resource: auth.Resource{Type: "repository", Name: name},
+			Action:   action,
+		})
+	}
+	return access
+}
@@ -0,0 +1,53 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/registry/handlers"
+	rediscache "github.com/distribution/distribution/v3/registry/storage/cache/redis"
+)
+
+// purgeRegistryCache requests the registry at registryURL to purge its blob
+// descriptor cache, whichever its kind, authenticating as its admin when
+// challenged.
+func purgeRegistryCache(ctx context.Context, registryURL string, creds adminCredentials) error {
+	resp, err := adminRequest(ctx, registryURL, creds, http.MethodDelete, "/admin/cache", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// purgeRedisCache removes every entry of the redis blob descriptor cache of
+// the configuration. The inmemory cache lives in the serving registry, and
+// can only be purged by requesting it with purgeRegistryCache.
+func purgeRedisCache(ctx context.Context, config *configuration.Configuration) error {
+	cc := config.Storage["cache"]
+	kind, ok := cc["blobdescriptor"]
+	if !ok {
+		kind = cc["layerinfo"]
+	}
+	if kind != "redis" {
+		return errors.New("the blob descriptor cache is not stored in redis, purge it through a running registry with --url")
+	}
+	if config.Redis.Addr == "" && len(config.Redis.Addrs) == 0 {
+		return errors.New("redis configuration required to purge the blob descriptor cache")
+	}
+
+	client := handlers.NewRedisClient(config)
+	defer client.Close()
+
+	return rediscache.NewRedisBlobDescriptorCacheProvider(client).Purge(ctx)
+}
@@ -0,0 +1,91 @@
+package registry
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	rediscache "github.com/distribution/distribution/v3/registry/storage/cache/redis"
+	"github.com/opencontainers/go-digest"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestPurgeRegistryCache(t *testing.T) {
+	purged := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/prefix/admin/cache" || r.Method != http.MethodDelete {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if username, password, ok := r.BasicAuth(); !ok || username != "admin" || password != "secret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		purged = true
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	if err := purgeRegistryCache(context.Background(), server.URL+"/prefix/", adminCredentials{username: "admin", password: "secret"}); err != nil {
+		t.Fatalf("unexpected error purging the cache: %v", err)
+	}
+	if !purged {
+		t.Fatal("expected the cache to be purged")
+	}
+
+	if err := purgeRegistryCache(context.Background(), server.URL+"/prefix", adminCredentials{username: "admin"}); err == nil {
+		t.Fatal("expected an error with wrong credentials")
+	}
+	if err := purgeRegistryCache(context.Background(), server.URL, adminCredentials{username: "admin", password: "secret"}); err == nil {
+		t.Fatal("expected an error without a cache to purge")
+	}
+}
+
+func TestPurgeRedisCache(t *testing.T) {
+	ctx := context.Background()
+
+	config := &configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"cache":    configuration.Parameters{"blobdescriptor": "inmemory"},
+		},
+	}
+	if err := purgeRedisCache(ctx, config); err == nil {
+		t.Fatal("expected an error purging an inmemory cache from its configuration")
+	}
+
+	redisAddr := os.Getenv("TEST_REGISTRY_STORAGE_CACHE_REDIS_ADDR")
+	if redisAddr == "" {
+		t.Skip("please set TEST_REGISTRY_STORAGE_CACHE_REDIS_ADDR to test purging the cache of redis")
+	}
+	config.Storage["cache"] = configuration.Parameters{"blobdescriptor": "redis"}
+	config.Redis.Addr = redisAddr
+
+	pool := redis.NewClient(&redis.Options{Addr: redisAddr})
+	defer pool.Close()
+	provider := rediscache.NewRedisBlobDescriptorCacheProvider(pool)
+
+	dgst := digest.FromString("cached")
+	desc := distribution.Descriptor{Digest: dgst, Size: 6, MediaType: "application/octet-stream"}
+	scoped, err := provider.RepositoryScoped("foo/bar")
+	if err != nil {
+		t.Fatalf("unexpected error getting scoped cache: %v", err)
+	}
+	if err := scoped.SetDescriptor(ctx, dgst, desc); err != nil {
+		t.Fatalf("unexpected error setting descriptor: %v", err)
+	}
+
+	if err := purgeRedisCache(ctx, config); err != nil {
+		t.Fatalf("unexpected error purging the cache: %v", err)
+	}
+	for _, bs := range []distribution.BlobDescriptorService{provider, scoped} {
+		if _, err := bs.Stat(ctx, dgst); err != distribution.ErrBlobUnknown {
+			t.Fatalf("expected the descriptor to be purged, got %v", err)
+		}
+	}
+}
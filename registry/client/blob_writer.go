@@ -7,9 +7,13 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
 )
 
 type httpBlobUpload struct {
@@ -70,10 +74,35 @@ func (hbu *httpBlobUpload) ReadFrom(r io.Reader) (n int64, err error) {
 	return (end - start + 1), nil
 }
 
+// Write uploads p as a chunk of the blob. If the upload of the chunk fails
+// with a connection error or a server error, the offset the registry has
+// received is queried and the rest of the chunk is uploaded again from
+// there, up to maxUploadResumes times.
 func (hbu *httpBlobUpload) Write(p []byte) (n int, err error) {
+	start := hbu.offset
+	for resumes := 0; ; resumes++ {
+		err = hbu.writeChunk(p[hbu.offset-start:])
+		if err == nil || resumes >= maxUploadResumes || !hbu.resumable(err) {
+			return int(hbu.offset - start), err
+		}
+
+		offset, serr := hbu.status()
+		if serr != nil || offset < start || offset > start+int64(len(p)) {
+			// the upload cannot be resumed from the chunk
+			return int(hbu.offset - start), err
+		}
+		hbu.offset = offset
+	}
+}
+
+// maxUploadResumes is the maximum number of times the upload of a chunk is
+// resumed after a failure.
+const maxUploadResumes = 3
+
+func (hbu *httpBlobUpload) writeChunk(p []byte) error {
 	req, err := http.NewRequestWithContext(hbu.ctx, "PATCH", hbu.location, bytes.NewReader(p))
 	if err != nil {
-		return 0, err
+		return err
 	}
 	req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", hbu.offset, hbu.offset+int64(len(p)-1)))
 	req.Header.Set("Content-Length", fmt.Sprintf("%d", len(p)))
@@ -81,28 +110,91 @@ func (hbu *httpBlobUpload) Write(p []byte) (n int, err error) {
 
 	resp, err := hbu.client.Do(req)
 	if err != nil {
-		return 0, err
+		return err
 	}
+	defer resp.Body.Close()
 
 	if !SuccessStatus(resp.StatusCode) {
-		return 0, hbu.handleErrorResponse(resp)
+		return hbu.handleErrorResponse(resp)
 	}
 
 	hbu.uuid = resp.Header.Get("Docker-Upload-UUID")
 	hbu.location, err = sanitizeLocation(resp.Header.Get("Location"), hbu.location)
+	if err != nil {
+		return err
+	}
+	rng := resp.Header.Get("Range")
+	var start, end int64
+	if n, err := fmt.Sscanf(rng, "%d-%d", &start, &end); err != nil {
+		return err
+	} else if n != 2 || end < start {
+		return fmt.Errorf("bad range format: %s", rng)
+	}
+
+	// the registry returns the range of the whole upload, which must end
+	// with the chunk
+	if end+1 != hbu.offset+int64(len(p)) {
+		return fmt.Errorf("unexpected range after chunk %d-%d: %s", hbu.offset, hbu.offset+int64(len(p)-1), rng)
+	}
+	hbu.offset = end + 1
+	return nil
+}
+
+// resumable returns whether the upload may be resumed after the error,
+// which may be transient or due to a chunk partially received.
+func (hbu *httpBlobUpload) resumable(err error) bool {
+	switch err := err.(type) {
+	case *url.Error:
+		return hbu.ctx.Err() == nil
+	case *UnexpectedHTTPStatusError:
+		return strings.HasPrefix(err.Status, "5")
+	case *UnexpectedHTTPResponseError:
+		return err.StatusCode >= http.StatusInternalServerError
+	case errcode.Errors:
+		for _, e := range err {
+			if e, ok := e.(errcode.Error); ok && (e.Code == v2.ErrorCodeRangeInvalid || e.Code.Descriptor().HTTPStatusCode >= http.StatusInternalServerError) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// status returns the offset of the upload received by the registry.
+func (hbu *httpBlobUpload) status() (int64, error) {
+	req, err := http.NewRequestWithContext(hbu.ctx, "GET", hbu.location, nil)
 	if err != nil {
 		return 0, err
 	}
+
+	resp, err := hbu.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if !SuccessStatus(resp.StatusCode) {
+		return 0, hbu.handleErrorResponse(resp)
+	}
+
+	if location := resp.Header.Get("Location"); location != "" {
+		hbu.location, err = sanitizeLocation(location, hbu.location)
+		if err != nil {
+			return 0, err
+		}
+	}
 	rng := resp.Header.Get("Range")
-	var start, end int
+	var start, end int64
 	if n, err := fmt.Sscanf(rng, "%d-%d", &start, &end); err != nil {
 		return 0, err
-	} else if n != 2 || end < start {
+	} else if n != 2 || start != 0 || end < start {
 		return 0, fmt.Errorf("bad range format: %s", rng)
 	}
-
-	hbu.offset += int64(end - start + 1)
-	return (end - start + 1), nil
+	if end == 0 {
+		// the registry returns 0-0 for empty uploads
+		return 0, nil
+	}
+	return end + 1, nil
 }
 
 func (hbu *httpBlobUpload) Size() int64 {
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/distribution/distribution/v3"
@@ -497,3 +499,74 @@ func TestUploadWrite(t *testing.T) {
 		t.Fatalf("Unexpected response status: %s, expected %s", uploadErr.Status, expected)
 	}
 }
+
+func TestUploadWriteResume(t *testing.T) {
+	_, b := newRandomBlob(64)
+	locationPath := "/v2/test/upload/resume/uploads/testid"
+
+	var (
+		received []byte
+		patches  int
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			w.Header().Set("Location", locationPath)
+			w.Header().Set("Range", fmt.Sprintf("0-%d", len(received)-1))
+			w.WriteHeader(http.StatusNoContent)
+		case "PATCH":
+			patches++
+			var start, end int
+			if _, err := fmt.Sscanf(r.Header.Get("Content-Range"), "%d-%d", &start, &end); err != nil || start != len(received) {
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			if patches == 1 {
+				// the connection is lost after half of the chunk
+				received = append(received, body[:len(body)/2]...)
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			received = append(received, body...)
+			w.Header().Set("Location", locationPath)
+			w.Header().Set("Range", fmt.Sprintf("0-%d", len(received)-1))
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	defer server.Close()
+
+	blobUpload := &httpBlobUpload{
+		ctx:      context.Background(),
+		client:   &http.Client{},
+		location: server.URL + locationPath,
+	}
+
+	n, err := blobUpload.Write(b[:16])
+	if err != nil {
+		t.Fatalf("Error calling Write: %s", err)
+	}
+	if n != 16 {
+		t.Fatalf("Wrong length returned from Write: %d, expected 16", n)
+	}
+
+	n, err = blobUpload.Write(b[16:])
+	if err != nil {
+		t.Fatalf("Error calling Write: %s", err)
+	}
+	if n != 48 {
+		t.Fatalf("Wrong length returned from Write: %d, expected 48", n)
+	}
+
+	if patches != 3 {
+		t.Fatalf("Unexpected number of PATCH requests: %d, expected 3", patches)
+	}
+	if blobUpload.Size() != 64 {
+		t.Fatalf("Wrong size returned from Size: %d, expected 64", blobUpload.Size())
+	}
+	if !bytes.Equal(received, b) {
+		t.Fatal("Uploaded content does not match the written content")
+	}
+}
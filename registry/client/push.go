@@ -0,0 +1,141 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/distribution/distribution/v3"
+)
+
+// BlobSource is a blob to push with PushBlobs.
+type BlobSource struct {
+	// Descriptor is the descriptor of the blob, with its digest and size.
+	Descriptor distribution.Descriptor
+
+	// Open opens the content of the blob. It is not called if the blob
+	// already exists in the repository.
+	Open func() (io.ReadCloser, error)
+}
+
+// PushBlobs pushes the blobs to the blob store, concurrently with at most
+// concurrency workers, skipping the blobs which already exist. It returns
+// the descriptors of the blobs, in the order of the sources. The pushes
+// still in progress are canceled after the first error, which is returned.
+func PushBlobs(ctx context.Context, bs distribution.BlobStore, blobs []BlobSource, concurrency int) ([]distribution.Descriptor, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		descs = make([]distribution.Descriptor, len(blobs))
+		wg    sync.WaitGroup
+		once  sync.Once
+		err   error
+	)
+	indexes := make(chan int)
+	for i := 0; i < concurrency && i < len(blobs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				desc, perr := pushBlob(ctx, bs, blobs[index])
+				if perr != nil {
+					once.Do(func() {
+						err = perr
+						cancel()
+					})
+					continue
+				}
+				descs[index] = desc
+			}
+		}()
+	}
+
+loop:
+	for i := range blobs {
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	if err != nil {
+		return nil, err
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return descs, nil
+}
+
+// pushChunkSize is the size of the chunks of the blobs pushed by PushBlobs.
+const pushChunkSize = 8 << 20
+
+// pushBlob pushes the blob to the blob store, unless it already exists.
+func pushBlob(ctx context.Context, bs distribution.BlobStore, blob BlobSource) (distribution.Descriptor, error) {
+	if desc, err := bs.Stat(ctx, blob.Descriptor.Digest); err == nil {
+		return desc, nil
+	} else if err != distribution.ErrBlobUnknown {
+		return distribution.Descriptor{}, err
+	}
+
+	rc, err := blob.Open()
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+	defer rc.Close()
+
+	writer, err := bs.Create(ctx)
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+
+	n, err := copyChunks(writer, rc)
+	if err == nil && n != blob.Descriptor.Size {
+		err = fmt.Errorf("blob %s: copied %d bytes, expected %d", blob.Descriptor.Digest, n, blob.Descriptor.Size)
+	}
+	if err != nil {
+		writer.Cancel(ctx)
+		return distribution.Descriptor{}, err
+	}
+
+	desc, err := writer.Commit(ctx, blob.Descriptor)
+	if err != nil {
+		writer.Cancel(ctx)
+		return distribution.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+// copyChunks copies the content of r to the blob writer in chunks of
+// pushChunkSize bytes, so that the upload of each chunk can be resumed after
+// a failure.
+func copyChunks(w distribution.BlobWriter, r io.Reader) (int64, error) {
+	buf := make([]byte, pushChunkSize)
+	var written int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			nw, werr := w.Write(buf[:n])
+			written += int64(nw)
+			if werr != nil {
+				return written, werr
+			}
+		}
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			return written, nil
+		default:
+			return written, err
+		}
+	}
+}
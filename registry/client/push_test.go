@@ -0,0 +1,170 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/opencontainers/go-digest"
+)
+
+// memoryBlobStore is a blob store keeping the blobs in memory, tracking the
+// number of concurrent uploads.
+type memoryBlobStore struct {
+	distribution.BlobStore
+
+	mu            sync.Mutex
+	blobs         map[digest.Digest][]byte
+	uploads       int
+	maxUploads    int
+	created       int
+	uploadStarted chan struct{}
+	release       chan struct{}
+}
+
+func (bs *memoryBlobStore) Stat(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	p, ok := bs.blobs[dgst]
+	if !ok {
+		return distribution.Descriptor{}, distribution.ErrBlobUnknown
+	}
+	return distribution.Descriptor{Digest: dgst, Size: int64(len(p))}, nil
+}
+
+func (bs *memoryBlobStore) Create(ctx context.Context, options ...distribution.BlobCreateOption) (distribution.BlobWriter, error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.created++
+	bs.uploads++
+	if bs.uploads > bs.maxUploads {
+		bs.maxUploads = bs.uploads
+	}
+	return &memoryBlobWriter{store: bs}, nil
+}
+
+type memoryBlobWriter struct {
+	distribution.BlobWriter
+
+	store *memoryBlobStore
+	buf   bytes.Buffer
+}
+
+func (bw *memoryBlobWriter) Write(p []byte) (int, error) {
+	if bw.store.uploadStarted != nil {
+		bw.store.uploadStarted <- struct{}{}
+		<-bw.store.release
+	}
+	return bw.buf.Write(p)
+}
+
+func (bw *memoryBlobWriter) Commit(ctx context.Context, desc distribution.Descriptor) (distribution.Descriptor, error) {
+	bw.store.mu.Lock()
+	defer bw.store.mu.Unlock()
+	bw.store.uploads--
+	if digest.FromBytes(bw.buf.Bytes()) != desc.Digest {
+		return distribution.Descriptor{}, distribution.ErrBlobInvalidDigest{Digest: desc.Digest}
+	}
+	bw.store.blobs[desc.Digest] = bw.buf.Bytes()
+	return desc, nil
+}
+
+func (bw *memoryBlobWriter) Cancel(ctx context.Context) error {
+	bw.store.mu.Lock()
+	defer bw.store.mu.Unlock()
+	bw.store.uploads--
+	return nil
+}
+
+func blobSource(p []byte) BlobSource {
+	return BlobSource{
+		Descriptor: distribution.Descriptor{
+			Digest: digest.FromBytes(p),
+			Size:   int64(len(p)),
+		},
+		Open: func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(p)), nil
+		},
+	}
+}
+
+func TestPushBlobs(t *testing.T) {
+	ctx := context.Background()
+
+	_, existing := newRandomBlob(32)
+	bs := &memoryBlobStore{
+		blobs:         map[digest.Digest][]byte{digest.FromBytes(existing): existing},
+		uploadStarted: make(chan struct{}),
+		release:       make(chan struct{}),
+	}
+
+	var blobs []BlobSource
+	for i := 0; i < 5; i++ {
+		_, p := newRandomBlob(64)
+		blobs = append(blobs, blobSource(p))
+	}
+	blobs = append(blobs, blobSource(existing))
+
+	// let the uploads write once the maximum number of workers is busy
+	go func() {
+		for i := 0; i < 2; i++ {
+			<-bs.uploadStarted
+		}
+		bs.release <- struct{}{}
+		bs.release <- struct{}{}
+		for range bs.uploadStarted {
+			bs.release <- struct{}{}
+		}
+	}()
+
+	descs, err := PushBlobs(ctx, bs, blobs, 2)
+	close(bs.uploadStarted)
+	if err != nil {
+		t.Fatalf("unexpected error pushing blobs: %v", err)
+	}
+
+	if len(descs) != len(blobs) {
+		t.Fatalf("unexpected number of descriptors: %d, expected %d", len(descs), len(blobs))
+	}
+	for i, desc := range descs {
+		if desc.Digest != blobs[i].Descriptor.Digest {
+			t.Errorf("unexpected digest of descriptor %d: %s, expected %s", i, desc.Digest, blobs[i].Descriptor.Digest)
+		}
+		if _, ok := bs.blobs[desc.Digest]; !ok {
+			t.Errorf("blob %s was not pushed", desc.Digest)
+		}
+	}
+	if bs.created != 5 {
+		t.Errorf("unexpected number of uploads: %d, expected 5", bs.created)
+	}
+	if bs.maxUploads != 2 {
+		t.Errorf("unexpected number of concurrent uploads: %d, expected 2", bs.maxUploads)
+	}
+}
+
+func TestPushBlobsError(t *testing.T) {
+	ctx := context.Background()
+	bs := &memoryBlobStore{blobs: map[digest.Digest][]byte{}}
+
+	openErr := errors.New("cannot open blob")
+	var blobs []BlobSource
+	for i := 0; i < 5; i++ {
+		_, p := newRandomBlob(64)
+		blobs = append(blobs, blobSource(p))
+	}
+	blobs[2].Open = func() (io.ReadCloser, error) {
+		return nil, openErr
+	}
+
+	if _, err := PushBlobs(ctx, bs, blobs, 2); err != openErr {
+		t.Fatalf("unexpected error: %v, expected %v", err, openErr)
+	}
+	if bs.uploads != 0 {
+		t.Fatalf("%d uploads were not committed nor canceled", bs.uploads)
+	}
+}
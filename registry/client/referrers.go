@@ -0,0 +1,228 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// MediaTypeEmptyJSON is the media type of the empty JSON object used as the
+// config of the artifacts with no config of their own.
+const MediaTypeEmptyJSON = "application/vnd.oci.empty.v1+json"
+
+// emptyJSON is the content of the empty config of the artifacts.
+var emptyJSON = []byte("{}")
+
+// referrersIndex is the image index listing the referrers of a manifest,
+// returned by the referrers API or stored under the referrers tag of the
+// manifest.
+type referrersIndex struct {
+	manifest.Versioned
+
+	Manifests []distribution.Descriptor `json:"manifests"`
+}
+
+// References returns the referrers listed by the index.
+func (i referrersIndex) References() []distribution.Descriptor {
+	return i.Manifests
+}
+
+// Payload returns the index as an OCI image index.
+func (i referrersIndex) Payload() (string, []byte, error) {
+	i.SchemaVersion = 2
+	i.MediaType = v1.MediaTypeImageIndex
+	if i.Manifests == nil {
+		i.Manifests = []distribution.Descriptor{}
+	}
+	p, err := json.Marshal(i)
+	return v1.MediaTypeImageIndex, p, err
+}
+
+// filterReferrers returns the referrers of the artifact type, all of them
+// if artifactType is empty.
+func filterReferrers(referrers []distribution.Descriptor, artifactType string) []distribution.Descriptor {
+	if artifactType == "" {
+		return referrers
+	}
+	filtered := make([]distribution.Descriptor, 0, len(referrers))
+	for _, desc := range referrers {
+		if desc.ArtifactType == artifactType {
+			filtered = append(filtered, desc)
+		}
+	}
+	return filtered
+}
+
+// ReferrersTag returns the tag of the image index listing the referrers of
+// the manifest on registries not supporting the referrers API, following
+// the referrers tag schema of the OCI distribution specification.
+func ReferrersTag(subject digest.Digest) string {
+	algorithm, encoded := subject.Algorithm().String(), subject.Encoded()
+	if len(algorithm) > 32 {
+		algorithm = algorithm[:32]
+	}
+	if len(encoded) > 64 {
+		encoded = encoded[:64]
+	}
+	return algorithm + "-" + encoded
+}
+
+// referrersTagIndex returns the index of the referrers tag of the subject,
+// and whether it exists.
+func (ms *manifests) referrersTagIndex(ctx context.Context, subject digest.Digest) (referrersIndex, bool, error) {
+	var index referrersIndex
+	ref, err := reference.WithTag(ms.name, ReferrersTag(subject))
+	if err != nil {
+		return index, false, err
+	}
+	u, err := ms.ub.BuildManifestURL(ref)
+	if err != nil {
+		return index, false, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return index, false, err
+	}
+	req.Header.Set("Accept", v1.MediaTypeImageIndex)
+
+	resp, err := ms.client.Do(req)
+	if err != nil {
+		return index, false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return index, false, nil
+	} else if !SuccessStatus(resp.StatusCode) {
+		return index, false, HandleErrorResponse(resp)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&index); err != nil {
+		return index, false, err
+	}
+	return index, true, nil
+}
+
+// addReferrer adds the referrer to the index of the referrers tag of the
+// subject, unless it is already listed.
+func (ms *manifests) addReferrer(ctx context.Context, subject digest.Digest, referrer distribution.Descriptor) error {
+	index, _, err := ms.referrersTagIndex(ctx, subject)
+	if err != nil {
+		return err
+	}
+	for _, desc := range index.Manifests {
+		if desc.Digest == referrer.Digest {
+			return nil
+		}
+	}
+	index.Manifests = append(index.Manifests, referrer)
+	_, err = ms.Put(ctx, index, distribution.WithTag(ReferrersTag(subject)))
+	return err
+}
+
+// Artifact is an artifact attached to a manifest by AttachArtifact, such as
+// the SBOM or the signature of an image.
+type Artifact struct {
+	// ArtifactType is the media type of the artifact, such as
+	// application/spdx+json for an SPDX SBOM.
+	ArtifactType string
+
+	// Blobs are the blobs of the artifact, pushed as the layers of its
+	// manifest.
+	Blobs []BlobSource
+
+	// Annotations are the annotations of the manifest of the artifact.
+	Annotations map[string]string
+}
+
+// AttachArtifact pushes the artifact to the repository as an OCI image
+// manifest whose subject is the subject manifest, with an empty config, and
+// returns the descriptor of the manifest. The blobs of the artifact are
+// pushed with PushBlobs, with at most concurrency at once. When the
+// registry does not support the referrers API, the manifest is also added
+// to the referrers tag of the subject, so that Referrers lists it.
+func AttachArtifact(ctx context.Context, repo distribution.Repository, subject distribution.Descriptor, artifact Artifact, concurrency int) (distribution.Descriptor, error) {
+	if artifact.ArtifactType == "" {
+		return distribution.Descriptor{}, fmt.Errorf("artifact type missing")
+	}
+
+	bs := repo.Blobs(ctx)
+	blobs := append([]BlobSource{{
+		Descriptor: distribution.Descriptor{
+			MediaType: MediaTypeEmptyJSON,
+			Digest:    digest.FromBytes(emptyJSON),
+			Size:      int64(len(emptyJSON)),
+		},
+		Open: func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(emptyJSON)), nil
+		},
+	}}, artifact.Blobs...)
+	descs, err := PushBlobs(ctx, bs, blobs, concurrency)
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+
+	config := blobs[0].Descriptor
+	layers := make([]distribution.Descriptor, len(artifact.Blobs))
+	for i, blob := range artifact.Blobs {
+		layers[i] = blob.Descriptor
+		if layers[i].MediaType == "" {
+			layers[i].MediaType = descs[i+1].MediaType
+		}
+	}
+	subjectDesc := distribution.Descriptor{
+		MediaType: subject.MediaType,
+		Digest:    subject.Digest,
+		Size:      subject.Size,
+	}
+	m, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned:    ocischema.SchemaVersion,
+		ArtifactType: artifact.ArtifactType,
+		Config:       config,
+		Layers:       layers,
+		Subject:      &subjectDesc,
+		Annotations:  artifact.Annotations,
+	})
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+	mediaType, payload, err := m.Payload()
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+	desc := distribution.Descriptor{
+		MediaType:    mediaType,
+		ArtifactType: artifact.ArtifactType,
+		Digest:       digest.FromBytes(payload),
+		Size:         int64(len(payload)),
+		Annotations:  artifact.Annotations,
+	}
+
+	ms, err := repo.Manifests(ctx)
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+	var processed digest.Digest
+	if _, err := ms.Put(ctx, m, ReturnSubject(&processed)); err != nil {
+		return distribution.Descriptor{}, err
+	}
+
+	// the registries supporting the referrers API acknowledge the subject
+	if cms, ok := ms.(*manifests); ok && processed != subject.Digest {
+		if err := cms.addReferrer(ctx, subject.Digest, desc); err != nil {
+			return distribution.Descriptor{}, err
+		}
+	}
+	return desc, nil
+}
@@ -0,0 +1,140 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/testutil"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestReferrersTag(t *testing.T) {
+	for _, tc := range []struct {
+		subject  digest.Digest
+		expected string
+	}{
+		{
+			subject:  "sha256:" + digest.Digest(strings.Repeat("a", 64)),
+			expected: "sha256-" + strings.Repeat("a", 64),
+		},
+		{
+			subject:  "sha512:" + digest.Digest(strings.Repeat("b", 128)),
+			expected: "sha512-" + strings.Repeat("b", 64),
+		},
+	} {
+		if tag := ReferrersTag(tc.subject); tag != tc.expected {
+			t.Errorf("unexpected referrers tag of %s: %q != %q", tc.subject, tag, tc.expected)
+		}
+	}
+}
+
+func TestAttachArtifact(t *testing.T) {
+	subject := distribution.Descriptor{
+		MediaType: v1.MediaTypeImageManifest,
+		Digest:    digest.FromString("subject"),
+		Size:      42,
+	}
+	_, sbom := newRandomBlob(64)
+	artifact := Artifact{
+		ArtifactType: "application/spdx+json",
+		Blobs:        []BlobSource{blobSource(sbom)},
+		Annotations:  map[string]string{"org.example.generator": "test"},
+	}
+
+	layer := artifact.Blobs[0].Descriptor
+	layer.MediaType = "application/octet-stream"
+	expected, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned:    ocischema.SchemaVersion,
+		ArtifactType: artifact.ArtifactType,
+		Config: distribution.Descriptor{
+			MediaType: MediaTypeEmptyJSON,
+			Digest:    digest.FromBytes(emptyJSON),
+			Size:      int64(len(emptyJSON)),
+		},
+		Layers:      []distribution.Descriptor{layer},
+		Subject:     &subject,
+		Annotations: artifact.Annotations,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, payload, err := expected.Payload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dgst := digest.FromBytes(payload)
+	desc := distribution.Descriptor{
+		MediaType:    v1.MediaTypeImageManifest,
+		ArtifactType: artifact.ArtifactType,
+		Digest:       dgst,
+		Size:         int64(len(payload)),
+		Annotations:  artifact.Annotations,
+	}
+	_, index, err := referrersIndex{Manifests: []distribution.Descriptor{desc}}.Payload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, supported := range []bool{true, false} {
+		repo, _ := reference.WithName(fmt.Sprintf("test.example.com/repo/attach-%t", supported))
+
+		var m testutil.RequestResponseMap
+		addTestFetch(repo.Name(), digest.FromBytes(emptyJSON), emptyJSON, &m)
+		addTestFetch(repo.Name(), digest.FromBytes(sbom), sbom, &m)
+		headers := http.Header{
+			"Content-Length":        {"0"},
+			"Docker-Content-Digest": {dgst.String()},
+		}
+		if supported {
+			headers.Set("OCI-Subject", subject.Digest.String())
+		}
+		m = append(m, testutil.RequestResponseMapping{
+			Request: testutil.Request{
+				Method: "PUT",
+				Route:  "/v2/" + repo.Name() + "/manifests/" + dgst.String(),
+				Body:   payload,
+			},
+			Response: testutil.Response{
+				StatusCode: http.StatusCreated,
+				Headers:    headers,
+			},
+		})
+		if !supported {
+			m = append(m, testutil.RequestResponseMapping{
+				Request: testutil.Request{
+					Method: "PUT",
+					Route:  "/v2/" + repo.Name() + "/manifests/" + ReferrersTag(subject.Digest),
+					Body:   index,
+				},
+				Response: testutil.Response{
+					StatusCode: http.StatusCreated,
+					Headers: http.Header{
+						"Content-Length":        {"0"},
+						"Docker-Content-Digest": {digest.FromBytes(index).String()},
+					},
+				},
+			})
+		}
+
+		e, c := testServer(m)
+		r, err := NewRepository(repo, e, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		attached, err := AttachArtifact(context.Background(), r, subject, artifact, 2)
+		c()
+		if err != nil {
+			t.Fatalf("unexpected error attaching the artifact to %s: %v", repo, err)
+		}
+		if attached.Digest != dgst || attached.ArtifactType != artifact.ArtifactType {
+			t.Fatalf("unexpected descriptor of the artifact attached to %s: %v", repo, attached)
+		}
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"github.com/distribution/distribution/v3/registry/storage/cache"
 	"github.com/distribution/distribution/v3/registry/storage/cache/memory"
 	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 // Registry provides an interface for calling Repositories, which returns a catalog of repositories.
@@ -454,6 +455,20 @@ func (o contentDigestOption) Apply(ms distribution.ManifestService) error {
 	return nil
 }
 
+// ReturnSubject allows a client to set the digest of the subject of a
+// manifest successfully put, from the 'OCI-Subject' header. The registries
+// which do not set it do not list the manifest among the referrers of its
+// subject.
+func ReturnSubject(dgst *digest.Digest) distribution.ManifestServiceOption {
+	return subjectOption{dgst}
+}
+
+type subjectOption struct{ digest *digest.Digest }
+
+func (o subjectOption) Apply(ms distribution.ManifestService) error {
+	return nil
+}
+
 func (ms *manifests) Get(ctx context.Context, dgst digest.Digest, options ...distribution.ManifestServiceOption) (distribution.Manifest, error) {
 	var (
 		digestOrTag string
@@ -547,16 +562,20 @@ func (ms *manifests) Get(ctx context.Context, dgst digest.Digest, options ...dis
 func (ms *manifests) Put(ctx context.Context, m distribution.Manifest, options ...distribution.ManifestServiceOption) (digest.Digest, error) {
 	ref := ms.name
 	var tagged bool
+	var subjectDgst *digest.Digest
 
 	for _, option := range options {
-		if opt, ok := option.(distribution.WithTagOption); ok {
+		switch opt := option.(type) {
+		case distribution.WithTagOption:
 			var err error
 			ref, err = reference.WithTag(ref, opt.Tag)
 			if err != nil {
 				return "", err
 			}
 			tagged = true
-		} else {
+		case subjectOption:
+			subjectDgst = opt.digest
+		default:
 			err := option.Apply(ms)
 			if err != nil {
 				return "", err
@@ -604,6 +623,11 @@ func (ms *manifests) Put(ctx context.Context, m distribution.Manifest, options .
 		if err != nil {
 			return "", err
 		}
+		if subjectDgst != nil {
+			if subject, err := digest.Parse(resp.Header.Get("OCI-Subject")); err == nil {
+				*subjectDgst = subject
+			}
+		}
 
 		return dgst, nil
 	}
@@ -637,6 +661,60 @@ func (ms *manifests) Delete(ctx context.Context, dgst digest.Digest) error {
 	return HandleErrorResponse(resp)
 }
 
+// Referrers lists the manifests which declare the manifest identified by
+// subject as their subject, optionally filtered by artifactType. If the
+// registry does not support the referrers API, the referrers are read from
+// the referrers tag of the subject instead.
+func (ms *manifests) Referrers(ctx context.Context, subject digest.Digest, artifactType string) ([]distribution.Descriptor, error) {
+	ref, err := reference.WithDigest(ms.name, subject)
+	if err != nil {
+		return nil, err
+	}
+
+	var values []url.Values
+	if artifactType != "" {
+		values = append(values, url.Values{"artifactType": []string{artifactType}})
+	}
+
+	u, err := ms.ub.BuildReferrersURL(ref, values...)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", v1.MediaTypeImageIndex)
+
+	resp, err := ms.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		index, _, err := ms.referrersTagIndex(ctx, subject)
+		if err != nil {
+			return nil, err
+		}
+		return filterReferrers(index.Manifests, artifactType), nil
+	} else if !SuccessStatus(resp.StatusCode) {
+		return nil, HandleErrorResponse(resp)
+	}
+
+	var index referrersIndex
+	if err := json.NewDecoder(resp.Body).Decode(&index); err != nil {
+		return nil, err
+	}
+
+	// Registries are not required to apply the filter.
+	if resp.Header.Get("OCI-Filters-Applied") == "artifactType" {
+		return index.Manifests, nil
+	}
+	return filterReferrers(index.Manifests, artifactType), nil
+}
+
 // todo(richardscothern): Restore interface and implementation with merge of #1050
 /*func (ms *manifests) Enumerate(ctx context.Context, manifests []distribution.Manifest, last distribution.Manifest) (n int, err error) {
 	panic("not supported")
@@ -28,6 +28,7 @@ import (
 	"github.com/distribution/distribution/v3/uuid"
 	"github.com/docker/libtrust"
 	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 func testServer(rrm testutil.RequestResponseMap) (string, func()) {
@@ -1298,6 +1299,129 @@ func TestManifestDelete(t *testing.T) {
 	// TODO(dmcgowan): Check for specific unknown error
 }
 
+func TestManifestReferrers(t *testing.T) {
+	repo, _ := reference.WithName("test.example.com/repo/referrers")
+	subject := digest.FromString("subject")
+	unsupported := digest.FromString("unsupported")
+	fallback := digest.FromString("fallback")
+	signature := distribution.Descriptor{
+		MediaType:    v1.MediaTypeImageManifest,
+		ArtifactType: "application/vnd.example.signature",
+		Digest:       digest.FromString("signature"),
+		Size:         42,
+	}
+	sbom := distribution.Descriptor{
+		MediaType:    v1.MediaTypeImageManifest,
+		ArtifactType: "application/vnd.example.sbom",
+		Digest:       digest.FromString("sbom"),
+		Size:         42,
+	}
+	index, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     v1.MediaTypeImageIndex,
+		"manifests":     []distribution.Descriptor{signature, sbom},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var m testutil.RequestResponseMap
+	m = append(m, testutil.RequestResponseMapping{
+		Request: testutil.Request{
+			Method: "GET",
+			Route:  "/v2/" + repo.Name() + "/referrers/" + subject.String(),
+		},
+		Response: testutil.Response{
+			StatusCode: http.StatusOK,
+			Body:       index,
+			Headers: http.Header(map[string][]string{
+				"Content-Type": {v1.MediaTypeImageIndex},
+			}),
+		},
+	})
+	m = append(m, testutil.RequestResponseMapping{
+		Request: testutil.Request{
+			Method:      "GET",
+			Route:       "/v2/" + repo.Name() + "/referrers/" + subject.String(),
+			QueryParams: map[string][]string{"artifactType": {sbom.ArtifactType}},
+		},
+		Response: testutil.Response{
+			// the registry did not apply the filter
+			StatusCode: http.StatusOK,
+			Body:       index,
+			Headers: http.Header(map[string][]string{
+				"Content-Type": {v1.MediaTypeImageIndex},
+			}),
+		},
+	})
+
+	// the registry of the fallback subject does not support the referrers
+	// API, the referrers are listed by the referrers tag
+	m = append(m, testutil.RequestResponseMapping{
+		Request: testutil.Request{
+			Method: "GET",
+			Route:  "/v2/" + repo.Name() + "/manifests/" + ReferrersTag(fallback),
+		},
+		Response: testutil.Response{
+			StatusCode: http.StatusOK,
+			Body:       index,
+			Headers: http.Header(map[string][]string{
+				"Content-Type": {v1.MediaTypeImageIndex},
+			}),
+		},
+	})
+
+	e, c := testServer(m)
+	defer c()
+
+	r, err := NewRepository(repo, e, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	ms, err := r.Manifests(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	referrerService, ok := ms.(distribution.ManifestReferrers)
+	if !ok {
+		t.Fatal("manifest service does not implement distribution.ManifestReferrers")
+	}
+
+	referrers, err := referrerService.Referrers(ctx, subject, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(referrers) != 2 || referrers[0].Digest != signature.Digest || referrers[1].Digest != sbom.Digest {
+		t.Fatalf("unexpected referrers %v", referrers)
+	}
+
+	referrers, err = referrerService.Referrers(ctx, subject, sbom.ArtifactType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(referrers) != 1 || referrers[0].Digest != sbom.Digest {
+		t.Fatalf("unexpected filtered referrers %v", referrers)
+	}
+
+	referrers, err = referrerService.Referrers(ctx, fallback, sbom.ArtifactType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(referrers) != 1 || referrers[0].Digest != sbom.Digest {
+		t.Fatalf("unexpected referrers of the referrers tag %v", referrers)
+	}
+
+	referrers, err = referrerService.Referrers(ctx, unsupported, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(referrers) != 0 {
+		t.Fatalf("unexpected referrers without the referrers tag %v", referrers)
+	}
+}
+
 func TestManifestPut(t *testing.T) {
 	repo, _ := reference.WithName("test.example.com/repo/delete")
 	m1, dgst, _ := newRandomSchemaV1Manifest(repo, "other", 6)
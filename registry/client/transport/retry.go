@@ -0,0 +1,170 @@
+package transport
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy configures the retries of the requests failing with a
+// connection error or a server error.
+type RetryPolicy struct {
+	// MaxRetries is the maximum number of times a request is retried.
+	MaxRetries int
+
+	// Backoff is the delay before the first retry, doubled before each of
+	// the next ones. Defaults to 500 milliseconds.
+	Backoff time.Duration
+
+	// MaxBackoff caps the delay between two retries, including the one
+	// requested by the server with a Retry-After header. Defaults to 30
+	// seconds.
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy retries the requests three times.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries: 3,
+	Backoff:    500 * time.Millisecond,
+	MaxBackoff: 30 * time.Second,
+}
+
+// NewRetryTransport creates a new transport which retries the idempotent
+// requests failing with a connection error or a 5xx status code, following
+// the given policy. Requests with a body are only retried if it can be
+// replayed, that is if their GetBody function is set, as it is by
+// http.NewRequest for in-memory bodies.
+//
+// POST and PATCH requests are not retried: a failed blob upload chunk is
+// resumed by the blob writer from the offset the registry has received.
+func NewRetryTransport(base http.RoundTripper, policy RetryPolicy) http.RoundTripper {
+	if policy.Backoff <= 0 {
+		policy.Backoff = DefaultRetryPolicy.Backoff
+	}
+	if policy.MaxBackoff <= 0 {
+		policy.MaxBackoff = DefaultRetryPolicy.MaxBackoff
+	}
+	return &retryTransport{
+		Base:   base,
+		Policy: policy,
+	}
+}
+
+// retryTransport is an http.RoundTripper that retries the requests failing
+// with a connection error or a server error.
+type retryTransport struct {
+	Base   http.RoundTripper
+	Policy RetryPolicy
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !retryable(req) {
+		return t.base().RoundTrip(req)
+	}
+
+	backoff := t.Policy.Backoff
+	for attempt := 0; ; attempt++ {
+		r := req
+		if attempt > 0 && req.Body != nil && req.Body != http.NoBody {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r = req.Clone(req.Context())
+			r.Body = body
+		}
+
+		resp, err := t.base().RoundTrip(r)
+		if attempt >= t.Policy.MaxRetries || !shouldRetry(req, resp, err) {
+			return resp, err
+		}
+
+		delay := backoff
+		if resp != nil {
+			if after, ok := retryAfter(resp); ok {
+				delay = after
+			}
+			// drain the body so that the connection can be reused
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4<<10))
+			resp.Body.Close()
+		}
+		if delay > t.Policy.MaxBackoff {
+			delay = t.Policy.MaxBackoff
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+
+		backoff *= 2
+		if backoff > t.Policy.MaxBackoff {
+			backoff = t.Policy.MaxBackoff
+		}
+	}
+}
+
+// CancelRequest cancels an in-flight request by closing its connection.
+func (t *retryTransport) CancelRequest(req *http.Request) {
+	type canceler interface {
+		CancelRequest(*http.Request)
+	}
+	if cr, ok := t.base().(canceler); ok {
+		cr.CancelRequest(req)
+	}
+}
+
+func (t *retryTransport) base() http.RoundTripper {
+	if t.Base != nil {
+		return t.Base
+	}
+	return http.DefaultTransport
+}
+
+// retryable returns whether the request is idempotent and can be sent again.
+func retryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+	default:
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// shouldRetry returns whether the request failed with a connection error or
+// a server error, which may be transient.
+func shouldRetry(req *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		return req.Context().Err() == nil
+	}
+	switch resp.StatusCode {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryAfter returns the delay requested by the Retry-After header of the
+// response, if any.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	header := resp.Header.Get("Retry-After")
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		delay := time.Until(date)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+	return 0, false
+}
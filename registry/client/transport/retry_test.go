@@ -0,0 +1,114 @@
+package transport
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRetryTransport(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests int
+		failures int
+		bodies   []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		bodies = append(bodies, string(body))
+		if requests <= failures {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: NewRetryTransport(nil, RetryPolicy{
+			MaxRetries: 2,
+			Backoff:    time.Millisecond,
+		}),
+	}
+
+	for _, tc := range []struct {
+		method           string
+		failures         int
+		expectedStatus   int
+		expectedRequests int
+	}{
+		{method: http.MethodGet, failures: 0, expectedStatus: http.StatusOK, expectedRequests: 1},
+		{method: http.MethodGet, failures: 2, expectedStatus: http.StatusOK, expectedRequests: 3},
+		{method: http.MethodGet, failures: 3, expectedStatus: http.StatusServiceUnavailable, expectedRequests: 3},
+		{method: http.MethodPut, failures: 1, expectedStatus: http.StatusOK, expectedRequests: 2},
+		{method: http.MethodPatch, failures: 1, expectedStatus: http.StatusServiceUnavailable, expectedRequests: 1},
+		{method: http.MethodPost, failures: 1, expectedStatus: http.StatusServiceUnavailable, expectedRequests: 1},
+	} {
+		mu.Lock()
+		requests, failures, bodies = 0, tc.failures, nil
+		mu.Unlock()
+
+		req, err := http.NewRequest(tc.method, server.URL, bytes.NewReader([]byte("content")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tc.method, err)
+		}
+		resp.Body.Close()
+
+		mu.Lock()
+		if resp.StatusCode != tc.expectedStatus {
+			t.Errorf("%s with %d failures: unexpected status %d, expected %d", tc.method, tc.failures, resp.StatusCode, tc.expectedStatus)
+		}
+		if requests != tc.expectedRequests {
+			t.Errorf("%s with %d failures: unexpected number of requests %d, expected %d", tc.method, tc.failures, requests, tc.expectedRequests)
+		}
+		for _, body := range bodies {
+			if body != "content" {
+				t.Errorf("%s with %d failures: unexpected body %q", tc.method, tc.failures, body)
+			}
+		}
+		mu.Unlock()
+	}
+}
+
+func TestRetryTransportConnectionError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	url := server.URL
+	server.Close()
+
+	var attempts int
+	client := &http.Client{
+		Transport: NewRetryTransport(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			attempts++
+			return http.DefaultTransport.RoundTrip(req)
+		}), RetryPolicy{
+			MaxRetries: 2,
+			Backoff:    time.Millisecond,
+		}),
+	}
+
+	if _, err := client.Get(url); err == nil {
+		t.Fatal("expected a connection error")
+	}
+	if attempts != 3 {
+		t.Fatalf("unexpected number of attempts %d, expected 3", attempts)
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
@@ -0,0 +1,42 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/distribution/distribution/v3/registry/storage"
+)
+
+// writeFsckReport writes the problems found by a consistency check in the
+// text or json format. The text report has a line per problem, followed by
+// a summary.
+func writeFsckReport(w io.Writer, format string, report *storage.FsckReport) error {
+	switch format {
+	case "json":
+		if report.Problems == nil {
+			report.Problems = []storage.FsckProblem{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	case "text":
+		for _, p := range report.Problems {
+			line := fmt.Sprintf("%s %s", p.Kind, p.Path)
+			if p.Digest != "" {
+				line += " " + p.Digest.String()
+			}
+			if p.Repaired {
+				line += " (repaired)"
+			}
+			if _, err := fmt.Fprintln(w, line); err != nil {
+				return err
+			}
+		}
+		_, err := fmt.Fprintf(w, "%d problems found, %d repaired, %d blobs verified\n",
+			len(report.Problems), len(report.Problems)-report.Unrepaired(), report.VerifiedBlobs)
+		return err
+	default:
+		return fmt.Errorf("unsupported report format %q", format)
+	}
+}
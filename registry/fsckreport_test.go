@@ -0,0 +1,34 @@
+package registry
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/distribution/distribution/v3/registry/storage"
+)
+
+func TestWriteFsckReport(t *testing.T) {
+	report := &storage.FsckReport{
+		Problems: []storage.FsckProblem{
+			{Kind: storage.FsckDanglingTag, Repository: "foo/bar", Path: "/tags/latest/current/link", Digest: "sha256:aaaa", Tag: "latest", Repaired: true},
+			{Kind: storage.FsckOrphanedUpload, Repository: "foo/bar", Path: "/_uploads/id"},
+		},
+		VerifiedBlobs: 2,
+	}
+
+	var buf bytes.Buffer
+	if err := writeFsckReport(&buf, "text", report); err != nil {
+		t.Fatalf("unexpected error writing text report: %v", err)
+	}
+	expected := `dangling-tag /tags/latest/current/link sha256:aaaa (repaired)
+orphaned-upload /_uploads/id
+2 problems found, 1 repaired, 2 blobs verified
+`
+	if buf.String() != expected {
+		t.Errorf("unexpected text report:\n%s", buf.String())
+	}
+
+	if err := writeFsckReport(&buf, "yaml", report); err == nil {
+		t.Error("expected error writing unsupported format")
+	}
+}
@@ -0,0 +1,43 @@
+package registry
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/distribution/distribution/v3/registry/storage"
+)
+
+// writeGCReport writes the report of a garbage collection in the json or
+// csv format. The csv report has a row per manifest and blob, the
+// repositories of a blob being separated by spaces.
+func writeGCReport(w io.Writer, format string, report *storage.GCReport) error {
+	switch format {
+	case "json":
+		if report.Manifests == nil {
+			report.Manifests = []storage.GCReportManifest{}
+		}
+		if report.Blobs == nil {
+			report.Blobs = []storage.GCReportBlob{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"type", "repository", "digest", "size", "subject"})
+		for _, m := range report.Manifests {
+			cw.Write([]string{"manifest", m.Repository, m.Digest.String(), strconv.FormatInt(m.Size, 10), m.Subject.String()})
+		}
+		for _, b := range report.Blobs {
+			cw.Write([]string{"blob", strings.Join(b.Repositories, " "), b.Digest.String(), strconv.FormatInt(b.Size, 10), ""})
+		}
+		cw.Flush()
+		return cw.Error()
+	default:
+		return fmt.Errorf("unsupported report format %q", format)
+	}
+}
@@ -0,0 +1,51 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/distribution/distribution/v3/registry/storage"
+)
+
+func TestWriteGCReport(t *testing.T) {
+	report := &storage.GCReport{
+		Manifests: []storage.GCReportManifest{
+			{Repository: "foo/bar", Digest: "sha256:aaaa", Size: 100},
+		},
+		Blobs: []storage.GCReportBlob{
+			{Digest: "sha256:aaaa", Size: 100, Repositories: []string{"foo/bar", "foo/baz"}},
+			{Digest: "sha256:bbbb", Size: 200},
+		},
+		ReclaimableBytes: 300,
+	}
+
+	var buf bytes.Buffer
+	if err := writeGCReport(&buf, "csv", report); err != nil {
+		t.Fatalf("unexpected error writing csv report: %v", err)
+	}
+	expected := `type,repository,digest,size,subject
+manifest,foo/bar,sha256:aaaa,100,
+blob,foo/bar foo/baz,sha256:aaaa,100,
+blob,,sha256:bbbb,200,
+`
+	if buf.String() != expected {
+		t.Errorf("unexpected csv report:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	if err := writeGCReport(&buf, "json", report); err != nil {
+		t.Fatalf("unexpected error writing json report: %v", err)
+	}
+	var decoded storage.GCReport
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("unexpected error decoding json report: %v", err)
+	}
+	if decoded.ReclaimableBytes != 300 || len(decoded.Blobs) != 2 || len(decoded.Manifests) != 1 {
+		t.Errorf("unexpected json report: %s", buf.String())
+	}
+
+	if err := writeGCReport(&buf, "xml", report); err == nil {
+		t.Error("expected an error for an unsupported format")
+	}
+}
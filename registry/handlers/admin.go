@@ -0,0 +1,882 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/distribution/distribution/v3/registry/proxy"
+	"github.com/distribution/distribution/v3/registry/storage"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/gorilla/handlers"
+	"github.com/gorilla/mux"
+	"github.com/opencontainers/go-digest"
+)
+
+// Names of the admin routes. Admin routes are not part of the v2 API.
+const (
+	// routeNameAdminReadOnly is the name of the admin route switching the
+	// read-only maintenance mode.
+	routeNameAdminReadOnly = "admin-readonly"
+	// routeNameAdminGC is the name of the admin route running garbage
+	// collections.
+	routeNameAdminGC = "admin-gc"
+	// routeNameAdminTrash is the name of the admin route restoring soft
+	// deleted objects.
+	routeNameAdminTrash = "admin-trash"
+	// routeNameAdminFrozen is the name of the admin route freezing
+	// repositories.
+	routeNameAdminFrozen = "admin-frozen"
+	// routeNameAdminWarm is the name of the admin route warming the pull
+	// through cache.
+	routeNameAdminWarm = "admin-warm"
+	// routeNameAdminRename is the name of the admin route renaming
+	// repositories.
+	routeNameAdminRename = "admin-rename"
+	// routeNameAdminStats is the name of the admin route serving the
+	// statistics of the registry.
+	routeNameAdminStats = "admin-stats"
+	// routeNameAdminCache is the name of the admin route purging the blob
+	// descriptor cache.
+	routeNameAdminCache = "admin-cache"
+)
+
+// Paths of the admin routes, below the configured prefix.
+const (
+	adminReadOnlyPath = "/admin/readonly"
+	adminGCPath       = "/admin/gc"
+	adminTrashPath    = "/admin/trash"
+	adminFrozenPath   = "/admin/frozen"
+	adminWarmPath     = "/admin/warm"
+	adminRenamePath   = "/admin/rename"
+	adminStatsPath    = "/admin/stats"
+	adminCachePath    = "/admin/cache"
+)
+
+// isAdminRoute returns whether the route is one of the admin routes.
+func isAdminRoute(routeName string) bool {
+	switch routeName {
+	case routeNameAdminReadOnly, routeNameAdminGC, routeNameAdminTrash, routeNameAdminFrozen, routeNameAdminWarm, routeNameAdminRename, routeNameAdminStats, routeNameAdminCache:
+		return true
+	}
+	return false
+}
+
+// readOnlyMode is the body of the requests and responses of the read-only
+// admin route.
+type readOnlyMode struct {
+	Enabled bool `json:"enabled"`
+}
+
+// adminReadOnlyDispatcher reports the read-only maintenance mode on GET and
+// switches it on PUT. The mode can not be disabled while a garbage
+// collection started through the admin route is running.
+func adminReadOnlyDispatcher(ctx *Context, r *http.Request) http.Handler {
+	return handlers.MethodHandler{
+		"GET": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			serveReadOnlyMode(ctx, w)
+		}),
+		"PUT": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var mode readOnlyMode
+			if err := json.NewDecoder(r.Body).Decode(&mode); err != nil {
+				dcontext.GetLogger(ctx).Errorf("error decoding read-only mode: %v", err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			dcontext.GetLogger(ctx, auth.UserNameKey).Infof("switching read-only mode to %t", mode.Enabled)
+			if !ctx.App.switchReadOnly(mode.Enabled) {
+				http.Error(w, "read-only mode can not be disabled while a garbage collection is running", http.StatusConflict)
+				return
+			}
+			serveReadOnlyMode(ctx, w)
+		}),
+	}
+}
+
+func serveReadOnlyMode(ctx *Context, w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(readOnlyMode{Enabled: ctx.ReadOnly()}); err != nil {
+		dcontext.GetLogger(ctx).Errorf("error encoding read-only mode: %v", err)
+	}
+}
+
+// appendAdminAccessRecord adds the access record required by the admin
+// routes, if r is routed to one of them.
+func appendAdminAccessRecord(accessRecords []auth.Access, r *http.Request) []auth.Access {
+	if isAdminRoute(mux.CurrentRoute(r).GetName()) {
+		accessRecords = append(accessRecords, auth.Access{
+			Resource: auth.Resource{
+				Type: "registry",
+				Name: "admin",
+			},
+			Action: "*",
+		})
+	}
+	return accessRecords
+}
+
+// gcOptions are the options of a garbage collection started through the
+// admin route, matching the flags of the garbage-collect command.
+type gcOptions struct {
+	DryRun                  bool    `json:"dryRun"`
+	RemoveUntagged          bool    `json:"removeUntagged"`
+	RemoveOrphanedReferrers bool    `json:"removeOrphanedReferrers"`
+	Concurrency             int     `json:"concurrency,omitempty"`
+	RateLimit               float64 `json:"rateLimit,omitempty"`
+}
+
+// States of the garbage collections run through the admin route.
+const (
+	gcStateIdle      = "idle"
+	gcStateRunning   = "running"
+	gcStateCompleted = "completed"
+	gcStateFailed    = "failed"
+	gcStateCancelled = "cancelled"
+)
+
+// gcStatus is the body of the responses of the garbage collection admin
+// route, describing the last collection.
+type gcStatus struct {
+	State      string             `json:"state"`
+	Options    *gcOptions         `json:"options,omitempty"`
+	StartedAt  *time.Time         `json:"startedAt,omitempty"`
+	FinishedAt *time.Time         `json:"finishedAt,omitempty"`
+	Progress   storage.GCProgress `json:"progress"`
+	Error      string             `json:"error,omitempty"`
+}
+
+var (
+	// errGCRunning is returned when starting a garbage collection while
+	// another one is running.
+	errGCRunning = errors.New("a garbage collection is already running")
+	// errGCWritable is returned when starting a garbage collection while
+	// the registry is not in read-only mode.
+	errGCWritable = errors.New("garbage collection requires the registry to be in read-only mode")
+)
+
+// gcRunner runs the garbage collections started through the admin route.
+// The collections of each root directory, that is of each tenant, run one at
+// a time and are reported on their own, so that the collection of a tenant
+// does not block, nor show up to, the others.
+type gcRunner struct {
+	driver   storagedriver.StorageDriver
+	registry distribution.Namespace
+
+	// mu guards the runs of all the root directories, so that the
+	// read-only mode is switched atomically with regard to all of them.
+	mu   sync.Mutex
+	runs map[string]*gcRun
+}
+
+// gcRun is the last garbage collection of a root directory.
+type gcRun struct {
+	status   gcStatus
+	progress *storage.GCProgress
+	cancel   context.CancelFunc
+}
+
+func newGCRunner(driver storagedriver.StorageDriver, registry distribution.Namespace) *gcRunner {
+	return &gcRunner{
+		driver:   driver,
+		registry: registry,
+		runs:     make(map[string]*gcRun),
+	}
+}
+
+// start starts a garbage collection of the root directory of ctx in the
+// background, unless one is already running there or readOnly reports the
+// registry is not in read-only mode. The mode is checked with the lock held,
+// so that it is not disabled meanwhile.
+func (g *gcRunner) start(ctx context.Context, options gcOptions, readOnly func() bool) (gcStatus, error) {
+	root := storage.RootDirectory(ctx)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if run, ok := g.runs[root]; ok && run.status.State == gcStateRunning {
+		return run.current(), errGCRunning
+	}
+	if !readOnly() {
+		return g.current(root), errGCWritable
+	}
+
+	now := time.Now()
+	run := &gcRun{
+		status:   gcStatus{State: gcStateRunning, Options: &options, StartedAt: &now},
+		progress: &storage.GCProgress{},
+	}
+	ctx, run.cancel = context.WithCancel(ctx)
+	g.runs[root] = run
+
+	go func() {
+		err := storage.MarkAndSweep(ctx, g.driver, g.registry, storage.GCOpts{
+			DryRun:                  options.DryRun,
+			RemoveUntagged:          options.RemoveUntagged,
+			RemoveOrphanedReferrers: options.RemoveOrphanedReferrers,
+			Quiet:                   true,
+			Progress:                run.progress,
+			Concurrency:             options.Concurrency,
+			RateLimit:               options.RateLimit,
+		})
+
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		finished := time.Now()
+		run.status.FinishedAt = &finished
+		run.status.Progress = run.progress.Load()
+		switch {
+		case ctx.Err() != nil:
+			run.status.State = gcStateCancelled
+		case err != nil:
+			run.status.State = gcStateFailed
+			run.status.Error = err.Error()
+		default:
+			run.status.State = gcStateCompleted
+		}
+		run.cancel()
+		dcontext.GetLogger(ctx).Infof("garbage collection of %s %s: %+v", root, run.status.State, run.status.Progress)
+	}()
+
+	return run.current(), nil
+}
+
+// running reports whether a garbage collection is running in any root
+// directory. It must be called with the lock held.
+func (g *gcRunner) running() bool {
+	for _, run := range g.runs {
+		if run.status.State == gcStateRunning {
+			return true
+		}
+	}
+	return false
+}
+
+// stop cancels the garbage collection running in the root directory, if
+// any.
+func (g *gcRunner) stop(root string) (gcStatus, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	run, ok := g.runs[root]
+	if !ok || run.status.State != gcStateRunning {
+		return g.current(root), false
+	}
+	run.cancel()
+	return run.current(), true
+}
+
+// current returns the status of the last garbage collection of the root
+// directory. It must be called with the lock held.
+func (g *gcRunner) current(root string) gcStatus {
+	run, ok := g.runs[root]
+	if !ok {
+		return gcStatus{State: gcStateIdle}
+	}
+	return run.current()
+}
+
+// current returns the status of the garbage collection. It must be called
+// with the lock of the runner held.
+func (run *gcRun) current() gcStatus {
+	status := run.status
+	if status.State == gcStateRunning {
+		status.Progress = run.progress.Load()
+	}
+	return status
+}
+
+// adminGCDispatcher reports the status of the last garbage collection on
+// GET, starts one on POST and cancels it on DELETE. Garbage collections may
+// only be started while the registry is in read-only mode, as they would
+// otherwise remove the blobs of concurrent pushes. The garbage collections
+// cover the content of the tenant of the client, if any.
+func adminGCDispatcher(ctx *Context, r *http.Request) http.Handler {
+	root := storage.RootDirectory(ctx)
+	return handlers.MethodHandler{
+		"GET": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx.App.gc.mu.Lock()
+			status := ctx.App.gc.current(root)
+			ctx.App.gc.mu.Unlock()
+			serveGCStatus(ctx, w, http.StatusOK, status)
+		}),
+		"POST": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var options gcOptions
+			if r.ContentLength != 0 {
+				if err := json.NewDecoder(r.Body).Decode(&options); err != nil {
+					dcontext.GetLogger(ctx).Errorf("error decoding garbage collection options: %v", err)
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+			}
+			status, err := ctx.App.gc.start(storage.WithRootDirectory(ctx.App, root), options, ctx.ReadOnly)
+			switch err {
+			case nil:
+			case errGCWritable:
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			default:
+				serveGCStatus(ctx, w, http.StatusConflict, status)
+				return
+			}
+			dcontext.GetLogger(ctx, auth.UserNameKey).Infof("started garbage collection: %+v", options)
+			serveGCStatus(ctx, w, http.StatusAccepted, status)
+		}),
+		"DELETE": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			status, stopped := ctx.App.gc.stop(root)
+			if !stopped {
+				serveGCStatus(ctx, w, http.StatusConflict, status)
+				return
+			}
+			dcontext.GetLogger(ctx, auth.UserNameKey).Infof("cancelling garbage collection")
+			serveGCStatus(ctx, w, http.StatusAccepted, status)
+		}),
+	}
+}
+
+func serveGCStatus(ctx *Context, w http.ResponseWriter, code int, status gcStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		dcontext.GetLogger(ctx).Errorf("error encoding garbage collection status: %v", err)
+	}
+}
+
+// trashResponse is the body of the responses listing the trash of a
+// repository.
+type trashResponse struct {
+	Repository string                    `json:"repository"`
+	Entries    []distribution.TrashEntry `json:"entries"`
+}
+
+// adminTrashDispatcher lists the trash of the repository given by the
+// repository query parameter on GET, restores the entry given by the id
+// query parameter on POST and purges it on DELETE. Entries can only be
+// restored or purged while the registry is not in read-only mode.
+func adminTrashDispatcher(ctx *Context, r *http.Request) http.Handler {
+	mhandler := handlers.MethodHandler{
+		"GET": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			trash, name, ok := repositoryTrash(ctx, w, r)
+			if !ok {
+				return
+			}
+
+			entries, err := trash.Trash(ctx)
+			if err != nil {
+				dcontext.GetLogger(ctx).Errorf("error listing trash of %s: %v", name, err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if entries == nil {
+				entries = []distribution.TrashEntry{}
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(trashResponse{Repository: name, Entries: entries}); err != nil {
+				dcontext.GetLogger(ctx).Errorf("error encoding trash: %v", err)
+			}
+		}),
+	}
+
+	if !ctx.ReadOnly() {
+		mhandler["POST"] = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			trash, name, ok := repositoryTrash(ctx, w, r)
+			if !ok {
+				return
+			}
+
+			id := r.FormValue("id")
+			dcontext.GetLogger(ctx, auth.UserNameKey).Infof("restoring trash entry %s of %s", id, name)
+			serveTrashEntryResult(ctx, w, trash.Restore(ctx, id))
+		})
+		mhandler["DELETE"] = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			trash, name, ok := repositoryTrash(ctx, w, r)
+			if !ok {
+				return
+			}
+
+			id := r.FormValue("id")
+			dcontext.GetLogger(ctx, auth.UserNameKey).Infof("purging trash entry %s of %s", id, name)
+			serveTrashEntryResult(ctx, w, trash.Purge(ctx, id))
+		})
+	}
+
+	return mhandler
+}
+
+// repositoryTrash returns the trash of the repository given by the
+// repository query parameter, or writes an error response.
+func repositoryTrash(ctx *Context, w http.ResponseWriter, r *http.Request) (distribution.RepositoryTrash, string, bool) {
+	if ctx.App.trash == nil {
+		http.Error(w, "soft deletion is not enabled", http.StatusNotFound)
+		return nil, "", false
+	}
+
+	named, err := reference.WithName(r.FormValue("repository"))
+	if err != nil {
+		http.Error(w, "invalid repository name", http.StatusBadRequest)
+		return nil, "", false
+	}
+
+	repository, err := ctx.App.trash.Repository(ctx, named)
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("error resolving repository %s: %v", named.Name(), err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, "", false
+	}
+
+	trash, ok := repository.(distribution.RepositoryTrash)
+	if !ok {
+		http.Error(w, "soft deletion is not supported", http.StatusNotFound)
+		return nil, "", false
+	}
+	return trash, named.Name(), true
+}
+
+func serveTrashEntryResult(ctx *Context, w http.ResponseWriter, err error) {
+	switch err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case distribution.ErrTrashEntryUnknown:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case distribution.ErrBlobUnknown:
+		http.Error(w, "the content of the entry was garbage collected", http.StatusGone)
+	default:
+		dcontext.GetLogger(ctx).Errorf("error handling trash entry: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// frozenRepository is the body of the requests and responses of the frozen
+// admin route.
+type frozenRepository struct {
+	Repository string `json:"repository"`
+	Frozen     bool   `json:"frozen"`
+}
+
+// adminFrozenDispatcher reports whether the repository given by the
+// repository query parameter is frozen on GET and freezes or unfreezes it on
+// PUT. Repositories can only be frozen or unfrozen while the registry is not
+// in read-only mode.
+func adminFrozenDispatcher(ctx *Context, r *http.Request) http.Handler {
+	mhandler := handlers.MethodHandler{
+		"GET": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			freezer, name, ok := repositoryFreezer(ctx, w, r)
+			if !ok {
+				return
+			}
+			serveFrozenRepository(ctx, w, freezer, name)
+		}),
+	}
+
+	if !ctx.ReadOnly() {
+		mhandler["PUT"] = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			freezer, name, ok := repositoryFreezer(ctx, w, r)
+			if !ok {
+				return
+			}
+
+			var frozen frozenRepository
+			if err := json.NewDecoder(r.Body).Decode(&frozen); err != nil {
+				dcontext.GetLogger(ctx).Errorf("error decoding frozen state: %v", err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			dcontext.GetLogger(ctx, auth.UserNameKey).Infof("setting frozen state of %s to %t", name, frozen.Frozen)
+			if err := freezer.SetFrozen(ctx, frozen.Frozen); err != nil {
+				dcontext.GetLogger(ctx).Errorf("error setting frozen state of %s: %v", name, err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			serveFrozenRepository(ctx, w, freezer, name)
+		})
+	}
+
+	return mhandler
+}
+
+// repositoryFreezer returns the freezer of the repository given by the
+// repository query parameter, or writes an error response.
+func repositoryFreezer(ctx *Context, w http.ResponseWriter, r *http.Request) (distribution.RepositoryFreezer, string, bool) {
+	named, err := reference.WithName(r.FormValue("repository"))
+	if err != nil {
+		http.Error(w, "invalid repository name", http.StatusBadRequest)
+		return nil, "", false
+	}
+
+	repository, err := ctx.App.freezer.Repository(ctx, named)
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("error resolving repository %s: %v", named.Name(), err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, "", false
+	}
+
+	freezer, ok := repository.(distribution.RepositoryFreezer)
+	if !ok {
+		http.Error(w, "freezing repositories is not supported", http.StatusNotFound)
+		return nil, "", false
+	}
+	return freezer, named.Name(), true
+}
+
+func serveFrozenRepository(ctx *Context, w http.ResponseWriter, freezer distribution.RepositoryFreezer, name string) {
+	frozen, err := freezer.Frozen(ctx)
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("error reading frozen state of %s: %v", name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(frozenRepository{Repository: name, Frozen: frozen}); err != nil {
+		dcontext.GetLogger(ctx).Errorf("error encoding frozen state: %v", err)
+	}
+}
+
+// warmRequest is the body of the requests of the warm admin route.
+type warmRequest struct {
+	References []string `json:"references"`
+	// Concurrency is the number of blobs of an image fetched at once.
+	Concurrency int `json:"concurrency,omitempty"`
+}
+
+// warmResponse is the body of the responses of the warm admin route.
+type warmResponse struct {
+	Images []warmedImage `json:"images"`
+}
+
+// warmedImage describes the content of an image pulled through the cache,
+// or the error warming it.
+type warmedImage struct {
+	Reference    string        `json:"reference"`
+	Digest       digest.Digest `json:"digest,omitempty"`
+	Manifests    int           `json:"manifests"`
+	Blobs        int           `json:"blobs"`
+	FetchedBlobs int           `json:"fetchedBlobs"`
+	FetchedBytes int64         `json:"fetchedBytes"`
+	Error        string        `json:"error,omitempty"`
+}
+
+// adminWarmDispatcher pulls the manifests and blobs of the images of the
+// request through the cache on POST, so that mirrors can be primed before
+// the images are pulled. The images are warmed one after the other, the
+// failure of one not preventing the others from being warmed. The cache can
+// only be warmed while the registry is not in read-only mode.
+func adminWarmDispatcher(ctx *Context, r *http.Request) http.Handler {
+	mhandler := handlers.MethodHandler{}
+
+	if !ctx.ReadOnly() {
+		mhandler["POST"] = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !ctx.App.isCache {
+				http.Error(w, proxy.ErrNotPullThroughCache.Error(), http.StatusNotFound)
+				return
+			}
+
+			var request warmRequest
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				dcontext.GetLogger(ctx).Errorf("error decoding warm request: %v", err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			refs := make([]reference.Named, len(request.References))
+			for i, s := range request.References {
+				ref, err := reference.Parse(s)
+				if err == nil {
+					if named, ok := ref.(reference.Named); ok {
+						refs[i] = named
+						continue
+					}
+				}
+				http.Error(w, "invalid reference "+s, http.StatusBadRequest)
+				return
+			}
+
+			response := warmResponse{Images: make([]warmedImage, len(refs))}
+			for i, ref := range refs {
+				dcontext.GetLogger(ctx, auth.UserNameKey).Infof("warming %s", ref)
+				image := warmedImage{Reference: request.References[i]}
+				result, err := proxy.Warm(ctx, ctx.App.registry, ref, request.Concurrency)
+				if err != nil {
+					dcontext.GetLogger(ctx).Errorf("error warming %s: %v", ref, err)
+					image.Error = err.Error()
+				}
+				image.Digest = result.Digest
+				image.Manifests = result.Manifests
+				image.Blobs = result.Blobs
+				image.FetchedBlobs = result.FetchedBlobs
+				image.FetchedBytes = result.FetchedBytes
+				response.Images[i] = image
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(response); err != nil {
+				dcontext.GetLogger(ctx).Errorf("error encoding warm response: %v", err)
+			}
+		})
+	}
+
+	return mhandler
+}
+
+// renameRequest is the body of the requests of the rename admin route.
+type renameRequest struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	// AliasTTL is how long the requests to the old name are redirected to
+	// the new one, such as "24h". They are not redirected when empty.
+	AliasTTL string `json:"aliasTTL,omitempty"`
+}
+
+// adminRenameDispatcher renames the repository of the request on POST,
+// moving its manifests, tags and layer links to the new name. Repositories
+// can only be renamed while the registry is not in read-only mode.
+func adminRenameDispatcher(ctx *Context, r *http.Request) http.Handler {
+	mhandler := handlers.MethodHandler{}
+
+	if !ctx.ReadOnly() {
+		mhandler["POST"] = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ctx.App.renamer == nil {
+				http.Error(w, "renaming repositories is not supported", http.StatusNotFound)
+				return
+			}
+
+			var request renameRequest
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				dcontext.GetLogger(ctx).Errorf("error decoding rename request: %v", err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			from, err := reference.WithName(request.From)
+			if err != nil {
+				http.Error(w, "invalid repository name", http.StatusBadRequest)
+				return
+			}
+			to, err := reference.WithName(request.To)
+			if err != nil {
+				http.Error(w, "invalid repository name", http.StatusBadRequest)
+				return
+			}
+			var aliasTTL time.Duration
+			if request.AliasTTL != "" {
+				aliasTTL, err = time.ParseDuration(request.AliasTTL)
+				if err != nil || aliasTTL < 0 {
+					http.Error(w, "invalid alias TTL", http.StatusBadRequest)
+					return
+				}
+			}
+
+			dcontext.GetLogger(ctx, auth.UserNameKey).Infof("renaming %s to %s", from.Name(), to.Name())
+			switch err := ctx.App.renamer.Rename(ctx, from, to, aliasTTL); err.(type) {
+			case nil:
+				w.WriteHeader(http.StatusNoContent)
+			case distribution.ErrRepositoryUnknown:
+				http.Error(w, err.Error(), http.StatusNotFound)
+			case distribution.ErrRepositoryExists:
+				http.Error(w, err.Error(), http.StatusConflict)
+			default:
+				dcontext.GetLogger(ctx).Errorf("error renaming %s to %s: %v", from.Name(), to.Name(), err)
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		})
+	}
+
+	return mhandler
+}
+
+// adminCacheDispatcher purges the blob descriptor cache on DELETE, so that
+// the content removed by another process, such as the garbage-collect
+// command, is no longer described by the cache.
+func adminCacheDispatcher(ctx *Context, r *http.Request) http.Handler {
+	return handlers.MethodHandler{
+		"DELETE": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ctx.App.blobDescriptorCache == nil {
+				http.Error(w, "the blob descriptor cache is not enabled", http.StatusNotFound)
+				return
+			}
+
+			dcontext.GetLogger(ctx, auth.UserNameKey).Infof("purging the blob descriptor cache")
+			if err := ctx.App.blobDescriptorCache.Purge(ctx); err != nil {
+				dcontext.GetLogger(ctx).Errorf("error purging the blob descriptor cache: %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}),
+	}
+}
+
+// defaultStatsInterval is the interval in between the computations of the
+// statistics, if not configured.
+const defaultStatsInterval = time.Hour
+
+// statsStatus is the body of the responses of the statistics admin route.
+type statsStatus struct {
+	// Stats are the statistics of the last successful computation, if any.
+	Stats *storage.RegistryStats `json:"stats,omitempty"`
+	// ComputedAt is the time the statistics were computed at.
+	ComputedAt *time.Time `json:"computedAt,omitempty"`
+	// Computing is set while the statistics are being computed.
+	Computing bool `json:"computing"`
+	// Error is the error of the last computation, if it failed.
+	Error string `json:"error,omitempty"`
+}
+
+// statsIndexer computes the statistics of the registry in the background,
+// periodically or on demand, and keeps the last ones, so that they are
+// served without walking the storage. The statistics of each root directory,
+// that is of each tenant, are computed and served on their own, so that a
+// tenant only sees its own content.
+type statsIndexer struct {
+	driver   storagedriver.StorageDriver
+	registry distribution.Namespace
+	roots    []string
+	refresh  chan struct{}
+
+	mu       sync.Mutex
+	statuses map[string]*statsStatus
+	pending  map[string]struct{} // the root directories to refresh
+}
+
+func newStatsIndexer(driver storagedriver.StorageDriver, registry distribution.Namespace, roots []string) *statsIndexer {
+	cleaned := make([]string, 0, len(roots))
+	statuses := make(map[string]*statsStatus, len(roots))
+	for _, root := range roots {
+		// the root directories are those of the contexts of the requests
+		root = path.Clean("/" + root)
+		cleaned = append(cleaned, root)
+		statuses[root] = &statsStatus{}
+	}
+	return &statsIndexer{
+		driver:   driver,
+		registry: registry,
+		roots:    cleaned,
+		refresh:  make(chan struct{}, 1),
+		statuses: statuses,
+		pending:  make(map[string]struct{}),
+	}
+}
+
+// start computes the statistics of all the root directories at once, then
+// every interval, and those of a root directory when a refresh of it is
+// requested, until ctx is done.
+func (s *statsIndexer) start(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultStatsInterval
+	}
+
+	go func() {
+		roots := s.roots
+		for {
+			for _, root := range roots {
+				s.compute(storage.WithRootDirectory(ctx, root), root)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.refresh:
+				roots = s.refreshed()
+			case <-time.After(interval):
+				roots = s.roots
+			}
+		}
+	}()
+}
+
+// compute computes the statistics of the root directory of ctx.
+func (s *statsIndexer) compute(ctx context.Context, root string) {
+	log := dcontext.GetLoggerWithField(ctx, "rootdirectory", root)
+
+	s.mu.Lock()
+	status := s.statuses[root]
+	status.Computing = true
+	s.mu.Unlock()
+
+	started := time.Now()
+	stats, err := storage.ComputeStats(ctx, s.driver, s.registry)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status.Computing = false
+	if err != nil {
+		log.Errorf("computing registry statistics failed: %v", err)
+		status.Error = err.Error()
+	} else {
+		log.Infof("computed registry statistics in %s: %+v", time.Since(started), *stats)
+		status.Stats = stats
+		status.ComputedAt = &started
+		status.Error = ""
+	}
+}
+
+// requestRefresh requests the statistics of the root directory to be
+// computed again, once the running computation completes.
+func (s *statsIndexer) requestRefresh(root string) {
+	s.mu.Lock()
+	if _, ok := s.statuses[root]; ok {
+		s.pending[root] = struct{}{}
+	}
+	s.mu.Unlock()
+
+	select {
+	case s.refresh <- struct{}{}:
+	default:
+		// a refresh is already pending
+	}
+}
+
+// refreshed returns the root directories whose refresh was requested, in
+// order, and clears the requests.
+func (s *statsIndexer) refreshed() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var roots []string
+	for _, root := range s.roots {
+		if _, ok := s.pending[root]; ok {
+			roots = append(roots, root)
+		}
+	}
+	s.pending = make(map[string]struct{})
+	return roots
+}
+
+// current returns the status of the statistics of the root directory.
+func (s *statsIndexer) current(root string) statsStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if status, ok := s.statuses[root]; ok {
+		return *status
+	}
+	return statsStatus{}
+}
+
+// adminStatsDispatcher serves the last statistics of the registry on GET,
+// and requests them to be computed again on POST. With tenancy, they are the
+// statistics of the tenant of the client.
+func adminStatsDispatcher(ctx *Context, r *http.Request) http.Handler {
+	root := storage.RootDirectory(ctx)
+	return handlers.MethodHandler{
+		"GET": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			serveStatsStatus(ctx, w, http.StatusOK, ctx.App.stats.current(root))
+		}),
+		"POST": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			dcontext.GetLogger(ctx, auth.UserNameKey).Infof("refreshing registry statistics of %s", root)
+			ctx.App.stats.requestRefresh(root)
+			serveStatsStatus(ctx, w, http.StatusAccepted, ctx.App.stats.current(root))
+		}),
+	}
+}
+
+func serveStatsStatus(ctx *Context, w http.ResponseWriter, code int, status statsStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		dcontext.GetLogger(ctx).Errorf("error encoding registry statistics: %v", err)
+	}
+}
@@ -0,0 +1,751 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/reference"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/opencontainers/go-digest"
+)
+
+func readOnlyConfig(enabled bool) *configuration.Configuration {
+	config := &configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": nil,
+			"maintenance": configuration.Parameters{
+				"uploadpurging": map[interface{}]interface{}{
+					"enabled": false,
+				},
+				"readonly": map[interface{}]interface{}{
+					"enabled": enabled,
+				},
+			},
+		},
+		Auth: configuration.Auth{
+			"silly": {
+				"realm":   "realm-test",
+				"service": "service-test",
+			},
+		},
+	}
+	config.HTTP.Admin.Enabled = true
+	config.HTTP.Headers = headerConfig
+	return config
+}
+
+// TestAdminReadOnly switches the read-only maintenance mode through the
+// admin route.
+func TestAdminReadOnly(t *testing.T) {
+	app := NewApp(context.Background(), readOnlyConfig(true))
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	builder, err := v2.NewURLBuilderFromString(server.URL, false)
+	if err != nil {
+		t.Fatalf("error creating urlbuilder: %v", err)
+	}
+	imageName, _ := reference.WithName("foo/bar")
+	uploadURL, err := builder.BuildBlobUploadURL(imageName)
+	if err != nil {
+		t.Fatalf("unexpected error building layer upload url: %v", err)
+	}
+
+	do := func(method, url, body string, authorized bool) *http.Response {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("unexpected error creating request: %v", err)
+		}
+		if authorized {
+			req.Header.Set("Authorization", "Bearer sillytoken")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error issuing request: %v", err)
+		}
+		return resp
+	}
+	checkMode := func(resp *http.Response, expected bool) {
+		defer resp.Body.Close()
+		checkResponse(t, "read-only mode", resp, http.StatusOK)
+
+		var mode readOnlyMode
+		if err := json.NewDecoder(resp.Body).Decode(&mode); err != nil {
+			t.Fatalf("error decoding read-only mode: %v", err)
+		}
+		if mode.Enabled != expected {
+			t.Fatalf("unexpected read-only mode: %t != %t", mode.Enabled, expected)
+		}
+	}
+
+	adminURL := server.URL + adminReadOnlyPath
+
+	resp := do("GET", adminURL, "", false)
+	checkResponse(t, "anonymous read-only mode", resp, http.StatusUnauthorized)
+	resp.Body.Close()
+	if header := resp.Header.Get("WWW-Authenticate"); !strings.Contains(header, `scope="registry:admin:*"`) {
+		t.Fatalf("unexpected WWW-Authenticate header: %q", header)
+	}
+
+	checkMode(do("GET", adminURL, "", true), true)
+
+	resp = do("POST", uploadURL, "", true)
+	checkResponse(t, "starting push in read-only mode", resp, http.StatusMethodNotAllowed)
+	resp.Body.Close()
+
+	resp = do("PUT", adminURL, "{", true)
+	checkResponse(t, "switching read-only mode with an invalid body", resp, http.StatusBadRequest)
+	resp.Body.Close()
+
+	checkMode(do("PUT", adminURL, `{"enabled": false}`, true), false)
+
+	resp = do("POST", uploadURL, "", true)
+	checkResponse(t, "starting push in read-write mode", resp, http.StatusAccepted)
+	resp.Body.Close()
+
+	// the configuration reloaded on SIGHUP switches it back
+	if err := app.ReloadConfiguration(readOnlyConfig(true)); err != nil {
+		t.Fatalf("unexpected error reloading configuration: %v", err)
+	}
+	checkMode(do("GET", adminURL, "", true), true)
+
+	// the mode is kept while a garbage collection is running
+	app.gc.mu.Lock()
+	app.gc.runs["/"] = &gcRun{status: gcStatus{State: gcStateRunning}}
+	app.gc.mu.Unlock()
+	resp = do("PUT", adminURL, `{"enabled": false}`, true)
+	checkResponse(t, "disabling read-only mode during a garbage collection", resp, http.StatusConflict)
+	resp.Body.Close()
+	if err := app.ReloadConfiguration(readOnlyConfig(false)); err == nil {
+		t.Fatal("expected an error disabling read-only mode on reload during a garbage collection")
+	}
+	checkMode(do("GET", adminURL, "", true), true)
+}
+
+// TestAdminGC runs a garbage collection through the admin route.
+func TestAdminGC(t *testing.T) {
+	ctx := context.Background()
+	app := NewApp(ctx, readOnlyConfig(false))
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	// an unreferenced blob
+	imageName, _ := reference.WithName("foo/bar")
+	repository, err := app.registry.Repository(ctx, imageName)
+	if err != nil {
+		t.Fatalf("unexpected error getting repository: %v", err)
+	}
+	content := []byte("unreferenced")
+	if _, err := repository.Blobs(ctx).Put(ctx, "application/octet-stream", content); err != nil {
+		t.Fatalf("unexpected error putting blob: %v", err)
+	}
+
+	do := func(method, url, body string) *http.Response {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("unexpected error creating request: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer sillytoken")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error issuing request: %v", err)
+		}
+		return resp
+	}
+	checkStatus := func(resp *http.Response, code int, state string) gcStatus {
+		defer resp.Body.Close()
+		checkResponse(t, "garbage collection", resp, code)
+
+		var status gcStatus
+		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+			t.Fatalf("error decoding garbage collection status: %v", err)
+		}
+		if status.State != state {
+			t.Fatalf("unexpected garbage collection state: %q != %q", status.State, state)
+		}
+		return status
+	}
+
+	gcURL := server.URL + adminGCPath
+	checkStatus(do("GET", gcURL, ""), http.StatusOK, gcStateIdle)
+	checkStatus(do("DELETE", gcURL, ""), http.StatusConflict, gcStateIdle)
+
+	resp := do("POST", gcURL, "")
+	checkResponse(t, "garbage collection in read-write mode", resp, http.StatusConflict)
+	resp.Body.Close()
+
+	app.SetReadOnly(true)
+	resp = do("POST", gcURL, "{")
+	checkResponse(t, "garbage collection with an invalid body", resp, http.StatusBadRequest)
+	resp.Body.Close()
+
+	checkStatus(do("POST", gcURL, `{"dryRun": true}`), http.StatusAccepted, gcStateRunning)
+	var status gcStatus
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		resp := do("GET", gcURL, "")
+		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+			t.Fatalf("error decoding garbage collection status: %v", err)
+		}
+		resp.Body.Close()
+		if status.State != gcStateRunning {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the garbage collection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status.State != gcStateCompleted || status.Options == nil || !status.Options.DryRun || status.FinishedAt == nil {
+		t.Fatalf("unexpected garbage collection status: %+v", status)
+	}
+	if status.Progress.SweptBlobs != 1 || status.Progress.ReclaimedBytes != int64(len(content)) {
+		t.Fatalf("unexpected garbage collection progress: %+v", status.Progress)
+	}
+	if _, err := repository.Blobs(ctx).Stat(ctx, digest.FromBytes(content)); err != nil {
+		t.Fatalf("unexpected error getting blob after a dry run: %v", err)
+	}
+}
+
+// TestAdminGCRootDirectories checks that the garbage collections of the root
+// directories of the tenants run and are reported independently.
+func TestAdminGCRootDirectories(t *testing.T) {
+	ctx := context.Background()
+	app := NewApp(ctx, readOnlyConfig(true))
+	readOnly := func() bool { return true }
+
+	acme := storage.WithRootDirectory(ctx, "/tenants/acme")
+	other := storage.WithRootDirectory(ctx, "/tenants/other")
+	app.gc.mu.Lock()
+	app.gc.runs["/tenants/acme"] = &gcRun{status: gcStatus{State: gcStateRunning}, progress: &storage.GCProgress{}, cancel: func() {}}
+	app.gc.mu.Unlock()
+
+	if _, err := app.gc.start(acme, gcOptions{DryRun: true}, readOnly); err != errGCRunning {
+		t.Fatalf("expected the garbage collection of the tenant to be running, got %v", err)
+	}
+	if _, err := app.gc.start(other, gcOptions{DryRun: true}, readOnly); err != nil {
+		t.Fatalf("unexpected error starting the garbage collection of another tenant: %v", err)
+	}
+
+	app.gc.mu.Lock()
+	status := app.gc.current("/")
+	app.gc.mu.Unlock()
+	if status.State != gcStateIdle {
+		t.Fatalf("unexpected garbage collection state outside of the tenants: %q", status.State)
+	}
+
+	if _, stopped := app.gc.stop("/"); stopped {
+		t.Fatal("unexpected garbage collection stopped outside of the tenants")
+	}
+	if _, stopped := app.gc.stop("/tenants/acme"); !stopped {
+		t.Fatal("expected the garbage collection of the tenant to be stopped")
+	}
+}
+
+// TestAdminTrash lists and restores soft deleted manifests through the admin
+// route.
+func TestAdminTrash(t *testing.T) {
+	ctx := context.Background()
+	config := readOnlyConfig(false)
+	config.Storage["delete"] = configuration.Parameters{
+		"enabled": true,
+		"softdelete": map[interface{}]interface{}{
+			"enabled": true,
+		},
+	}
+	app := NewApp(ctx, config)
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	imageName, _ := reference.WithName("foo/bar")
+	repository, err := app.registry.Repository(ctx, imageName)
+	if err != nil {
+		t.Fatalf("unexpected error getting repository: %v", err)
+	}
+	content := []byte("deleted")
+	desc, err := repository.Blobs(ctx).Put(ctx, "application/octet-stream", content)
+	if err != nil {
+		t.Fatalf("unexpected error putting blob: %v", err)
+	}
+	if err := repository.Blobs(ctx).Delete(ctx, desc.Digest); err != nil {
+		t.Fatalf("unexpected error deleting blob: %v", err)
+	}
+
+	do := func(method, url string) *http.Response {
+		req, err := http.NewRequest(method, url, nil)
+		if err != nil {
+			t.Fatalf("unexpected error creating request: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer sillytoken")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error issuing request: %v", err)
+		}
+		return resp
+	}
+	list := func() trashResponse {
+		resp := do("GET", server.URL+adminTrashPath+"?repository=foo/bar")
+		defer resp.Body.Close()
+		checkResponse(t, "listing trash", resp, http.StatusOK)
+
+		var trash trashResponse
+		if err := json.NewDecoder(resp.Body).Decode(&trash); err != nil {
+			t.Fatalf("error decoding trash: %v", err)
+		}
+		return trash
+	}
+
+	resp := do("GET", server.URL+adminTrashPath+"?repository=Foo")
+	checkResponse(t, "listing trash of an invalid repository", resp, http.StatusBadRequest)
+	resp.Body.Close()
+
+	trash := list()
+	if trash.Repository != "foo/bar" || len(trash.Entries) != 1 || trash.Entries[0].Digest != desc.Digest {
+		t.Fatalf("unexpected trash: %+v", trash)
+	}
+	entryURL := server.URL + adminTrashPath + "?repository=foo/bar&id=" + trash.Entries[0].ID
+
+	app.SetReadOnly(true)
+	resp = do("POST", entryURL)
+	checkResponse(t, "restoring in read-only mode", resp, http.StatusMethodNotAllowed)
+	resp.Body.Close()
+	app.SetReadOnly(false)
+
+	resp = do("POST", entryURL)
+	checkResponse(t, "restoring trash entry", resp, http.StatusNoContent)
+	resp.Body.Close()
+	if _, err := repository.Blobs(ctx).Stat(ctx, desc.Digest); err != nil {
+		t.Fatalf("blob was not restored: %v", err)
+	}
+	if trash := list(); len(trash.Entries) != 0 {
+		t.Fatalf("unexpected trash after restore: %+v", trash)
+	}
+
+	resp = do("DELETE", entryURL)
+	checkResponse(t, "purging a restored entry", resp, http.StatusNotFound)
+	resp.Body.Close()
+}
+
+// TestAdminFrozen freezes a repository through the admin route, and checks
+// that it can be pulled but not pushed to.
+func TestAdminFrozen(t *testing.T) {
+	config := readOnlyConfig(false)
+	app := NewApp(context.Background(), config)
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	do := func(method, url string, body string) *http.Response {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("unexpected error creating request: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer sillytoken")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error issuing request: %v", err)
+		}
+		return resp
+	}
+	setFrozen := func(frozen bool) {
+		resp := do("PUT", server.URL+adminFrozenPath+"?repository=foo/bar", fmt.Sprintf(`{"frozen": %t}`, frozen))
+		defer resp.Body.Close()
+		checkResponse(t, "freezing repository", resp, http.StatusOK)
+
+		var state frozenRepository
+		if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+			t.Fatalf("error decoding frozen state: %v", err)
+		}
+		if state.Repository != "foo/bar" || state.Frozen != frozen {
+			t.Fatalf("unexpected frozen state: %+v", state)
+		}
+	}
+	uploadURL := server.URL + "/v2/foo/bar/blobs/uploads/"
+
+	resp := do("GET", server.URL+adminFrozenPath+"?repository=Foo", "")
+	checkResponse(t, "getting frozen state of an invalid repository", resp, http.StatusBadRequest)
+	resp.Body.Close()
+
+	setFrozen(true)
+	resp = do("POST", uploadURL, "")
+	checkResponse(t, "pushing to a frozen repository", resp, http.StatusForbidden)
+	checkBodyHasErrorCodes(t, "pushing to a frozen repository", resp, v2.ErrorCodeRepositoryFrozen)
+	resp.Body.Close()
+
+	resp = do("GET", server.URL+"/v2/foo/bar/tags/list", "")
+	checkResponse(t, "pulling from a frozen repository", resp, http.StatusNotFound)
+	checkBodyHasErrorCodes(t, "pulling from a frozen repository", resp, v2.ErrorCodeNameUnknown)
+	resp.Body.Close()
+
+	// repositories cannot be frozen nor unfrozen in read-only mode
+	app.SetReadOnly(true)
+	resp = do("PUT", server.URL+adminFrozenPath+"?repository=foo/bar", `{"frozen": false}`)
+	checkResponse(t, "unfreezing in read-only mode", resp, http.StatusMethodNotAllowed)
+	resp.Body.Close()
+	app.SetReadOnly(false)
+
+	setFrozen(false)
+	resp = do("POST", uploadURL, "")
+	checkResponse(t, "pushing to an unfrozen repository", resp, http.StatusAccepted)
+	resp.Body.Close()
+}
+
+// TestAdminWarm warms a pull through cache through the admin route.
+func TestAdminWarm(t *testing.T) {
+	truthConfig := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+	}
+	truthConfig.Compatibility.Schema1.Enabled = true
+	truthConfig.HTTP.Headers = headerConfig
+
+	truthEnv := newTestEnvWithConfig(t, &truthConfig)
+	defer truthEnv.Shutdown()
+	dgst := createRepository(truthEnv, t, "foo/bar", "latest")
+
+	config := readOnlyConfig(false)
+	config.Compatibility.Schema1.Enabled = true
+	config.Proxy.RemoteURL = truthEnv.server.URL
+	app := NewApp(context.Background(), config)
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	warm := func(body string, expected int) warmResponse {
+		req, err := http.NewRequest("POST", server.URL+adminWarmPath, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("unexpected error creating request: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer sillytoken")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error issuing request: %v", err)
+		}
+		defer resp.Body.Close()
+		checkResponse(t, "warming the cache", resp, expected)
+
+		var response warmResponse
+		if expected == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+				t.Fatalf("error decoding warm response: %v", err)
+			}
+		}
+		return response
+	}
+
+	response := warm(`{"references": ["foo/bar", "foo/unknown:latest"]}`, http.StatusOK)
+	if len(response.Images) != 2 {
+		t.Fatalf("unexpected warmed images: %+v", response.Images)
+	}
+	image := response.Images[0]
+	if image.Reference != "foo/bar" || image.Digest != dgst || image.Error != "" || image.Manifests != 1 || image.Blobs == 0 || image.FetchedBlobs != image.Blobs {
+		t.Fatalf("unexpected warmed image: %+v", image)
+	}
+	if response.Images[1].Error == "" {
+		t.Fatalf("expected an error warming an unknown image: %+v", response.Images[1])
+	}
+
+	// the cached blobs are not fetched again
+	response = warm(`{"references": ["foo/bar@`+dgst.String()+`"]}`, http.StatusOK)
+	if image := response.Images[0]; image.Digest != dgst || image.FetchedBlobs != 0 {
+		t.Fatalf("unexpected warmed image: %+v", image)
+	}
+
+	warm(`{"references": ["Foo/Bar"]}`, http.StatusBadRequest)
+
+	// the cache cannot be warmed in read-only mode
+	app.SetReadOnly(true)
+	warm(`{"references": ["foo/bar"]}`, http.StatusMethodNotAllowed)
+	app.SetReadOnly(false)
+
+	// nor a registry which is not a cache
+	server = httptest.NewServer(NewApp(context.Background(), readOnlyConfig(false)))
+	defer server.Close()
+	warm(`{"references": ["foo/bar"]}`, http.StatusNotFound)
+}
+
+// TestAdminRename renames a repository through the admin route, the old name
+// redirecting to the new one.
+func TestAdminRename(t *testing.T) {
+	ctx := context.Background()
+	app := NewApp(ctx, readOnlyConfig(false))
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	var dgst digest.Digest
+	for _, name := range []string{"foo/bar", "foo/taken"} {
+		named, _ := reference.WithName(name)
+		repository, err := app.registry.Repository(ctx, named)
+		if err != nil {
+			t.Fatalf("unexpected error getting repository: %v", err)
+		}
+		desc, err := repository.Blobs(ctx).Put(ctx, "application/octet-stream", []byte("renamed"))
+		if err != nil {
+			t.Fatalf("unexpected error putting blob: %v", err)
+		}
+		dgst = desc.Digest
+	}
+
+	// the redirects are not followed, so that they can be checked
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	do := func(method, url string, body string) *http.Response {
+		req, err := http.NewRequest(method, url, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("unexpected error creating request: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer sillytoken")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error issuing request: %v", err)
+		}
+		return resp
+	}
+	rename := func(body string, expected int) {
+		resp := do("POST", server.URL+adminRenamePath, body)
+		defer resp.Body.Close()
+		checkResponse(t, "renaming repository "+body, resp, expected)
+	}
+
+	rename(`{"from": "foo/bar", "to": "Foo/Baz"}`, http.StatusBadRequest)
+	rename(`{"from": "foo/bar", "to": "foo/baz", "aliasTTL": "soon"}`, http.StatusBadRequest)
+	rename(`{"from": "foo/unknown", "to": "foo/baz"}`, http.StatusNotFound)
+	rename(`{"from": "foo/bar", "to": "foo/taken"}`, http.StatusConflict)
+	rename(`{"from": "foo/bar", "to": "foo/baz", "aliasTTL": "1h"}`, http.StatusNoContent)
+
+	resp := do("HEAD", server.URL+"/v2/foo/baz/blobs/"+dgst.String(), "")
+	checkResponse(t, "checking renamed blob", resp, http.StatusOK)
+	resp.Body.Close()
+
+	// the old name is redirected to the new one
+	resp = do("HEAD", server.URL+"/v2/foo/bar/blobs/"+dgst.String(), "")
+	checkResponse(t, "checking blob of the old name", resp, http.StatusTemporaryRedirect)
+	if location := resp.Header.Get("Location"); location != "/v2/foo/baz/blobs/"+dgst.String() {
+		t.Fatalf("unexpected redirect location %q", location)
+	}
+	resp.Body.Close()
+
+	// but not for pushes
+	resp = do("POST", server.URL+"/v2/foo/bar/blobs/uploads/", "")
+	checkResponse(t, "pushing to the old name", resp, http.StatusAccepted)
+	resp.Body.Close()
+
+	// repositories cannot be renamed in read-only mode
+	app.SetReadOnly(true)
+	rename(`{"from": "foo/baz", "to": "foo/bar"}`, http.StatusMethodNotAllowed)
+	app.SetReadOnly(false)
+}
+
+// TestAdminStats computes the statistics of the registry in the background,
+// refreshed through the admin route.
+func TestAdminStats(t *testing.T) {
+	ctx := context.Background()
+	app := NewApp(ctx, readOnlyConfig(false))
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	do := func(method string) statsStatus {
+		req, err := http.NewRequest(method, server.URL+adminStatsPath, nil)
+		if err != nil {
+			t.Fatalf("unexpected error creating request: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer sillytoken")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error issuing request: %v", err)
+		}
+		defer resp.Body.Close()
+		expected := http.StatusOK
+		if method == "POST" {
+			expected = http.StatusAccepted
+		}
+		checkResponse(t, "registry statistics", resp, expected)
+
+		var status statsStatus
+		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+			t.Fatalf("error decoding registry statistics: %v", err)
+		}
+		return status
+	}
+
+	imageName, _ := reference.WithName("foo/bar")
+	repository, err := app.registry.Repository(ctx, imageName)
+	if err != nil {
+		t.Fatalf("unexpected error getting repository: %v", err)
+	}
+	content := []byte("counted")
+	if _, err := repository.Blobs(ctx).Put(ctx, "application/octet-stream", content); err != nil {
+		t.Fatalf("unexpected error putting blob: %v", err)
+	}
+
+	do("POST")
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		status := do("GET")
+		if status.Error != "" {
+			t.Fatalf("unexpected error computing registry statistics: %s", status.Error)
+		}
+		if status.Stats != nil && status.Stats.Blobs == 1 {
+			if status.ComputedAt == nil || status.Stats.DeduplicatedSize != int64(len(content)) {
+				t.Fatalf("unexpected registry statistics: %+v", status)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the registry statistics: %+v", status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestAdminStatsRootDirectories computes the statistics of each tenant on
+// their own, served to the clients of the tenant.
+func TestAdminStatsRootDirectories(t *testing.T) {
+	ctx := context.Background()
+	config := readOnlyConfig(false)
+	config.Tenancy.Tenants = []configuration.Tenant{
+		{Name: "acme", Prefix: "acme", RootDirectory: "/tenants/acme"},
+		{Name: "other", Prefix: "other", RootDirectory: "/tenants/other"},
+	}
+	app := NewApp(ctx, config)
+
+	// the admin route serves the statistics of the root directory of the
+	// tenant resolved by the dispatcher
+	do := func(root, method string) statsStatus {
+		t.Helper()
+		rootCtx := &Context{App: app, Context: storage.WithRootDirectory(ctx, root)}
+		req := httptest.NewRequest(method, adminStatsPath, nil)
+		w := httptest.NewRecorder()
+		adminStatsDispatcher(rootCtx, req).ServeHTTP(w, req)
+
+		var status statsStatus
+		if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+			t.Fatalf("error decoding registry statistics of %s: %v", root, err)
+		}
+		return status
+	}
+
+	imageName, _ := reference.WithName("foo/bar")
+	blobs := map[string]int{"/tenants/acme": 1, "/tenants/other": 2}
+	for root, count := range blobs {
+		rootCtx := storage.WithRootDirectory(ctx, root)
+		repository, err := app.registry.Repository(rootCtx, imageName)
+		if err != nil {
+			t.Fatalf("unexpected error getting repository: %v", err)
+		}
+		for i := 0; i < count; i++ {
+			content := []byte(fmt.Sprintf("%s %d", root, i))
+			if _, err := repository.Blobs(rootCtx).Put(rootCtx, "application/octet-stream", content); err != nil {
+				t.Fatalf("unexpected error putting blob: %v", err)
+			}
+		}
+		do(root, "POST")
+	}
+
+	for root, count := range blobs {
+		for deadline := time.Now().Add(10 * time.Second); ; {
+			status := do(root, "GET")
+			if status.Error != "" {
+				t.Fatalf("unexpected error computing registry statistics of %s: %s", root, status.Error)
+			}
+			if status.Stats != nil && status.Stats.Blobs == int64(count) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for the registry statistics of %s: %+v", root, status)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// the blobs of the tenants are not counted in the default root directory
+	requested := time.Now()
+	do("/", "POST")
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		status := do("/", "GET")
+		if status.ComputedAt != nil && !status.ComputedAt.Before(requested) {
+			if status.Stats == nil || status.Stats.Blobs != 0 {
+				t.Fatalf("unexpected registry statistics of the default root directory: %+v", status)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the registry statistics of the default root directory: %+v", status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestAdminCache purges the blob descriptor cache through the admin route.
+func TestAdminCache(t *testing.T) {
+	ctx := context.Background()
+	config := readOnlyConfig(false)
+	config.Storage["cache"] = configuration.Parameters{"blobdescriptor": "inmemory"}
+	app := NewApp(ctx, config)
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	purge := func(msg, serverURL string, expected int) {
+		t.Helper()
+		req, err := http.NewRequest("DELETE", serverURL+adminCachePath, nil)
+		if err != nil {
+			t.Fatalf("unexpected error creating request: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer sillytoken")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error issuing request: %v", err)
+		}
+		resp.Body.Close()
+		checkResponse(t, msg, resp, expected)
+	}
+
+	imageName, _ := reference.WithName("foo/bar")
+	repository, err := app.registry.Repository(ctx, imageName)
+	if err != nil {
+		t.Fatalf("unexpected error getting repository: %v", err)
+	}
+	desc, err := repository.Blobs(ctx).Put(ctx, "application/octet-stream", []byte("cached"))
+	if err != nil {
+		t.Fatalf("unexpected error putting blob: %v", err)
+	}
+	if _, err := repository.Blobs(ctx).Stat(ctx, desc.Digest); err != nil {
+		t.Fatalf("unexpected error statting blob: %v", err)
+	}
+	scoped, err := app.blobDescriptorCache.RepositoryScoped(imageName.Name())
+	if err != nil {
+		t.Fatalf("unexpected error getting scoped cache: %v", err)
+	}
+	for _, bs := range []distribution.BlobDescriptorService{app.blobDescriptorCache, scoped} {
+		if _, err := bs.Stat(ctx, desc.Digest); err != nil {
+			t.Fatalf("expected the descriptor to be cached: %v", err)
+		}
+	}
+
+	purge("purging the cache", server.URL, http.StatusNoContent)
+	for _, bs := range []distribution.BlobDescriptorService{app.blobDescriptorCache, scoped} {
+		if _, err := bs.Stat(ctx, desc.Digest); err != distribution.ErrBlobUnknown {
+			t.Fatalf("expected the descriptor to be purged, got %v", err)
+		}
+	}
+
+	// the blob itself is left alone
+	if _, err := repository.Blobs(ctx).Stat(ctx, desc.Digest); err != nil {
+		t.Fatalf("unexpected error statting blob after purge: %v", err)
+	}
+
+	// without a cache, there is nothing to purge
+	uncached := httptest.NewServer(NewApp(ctx, readOnlyConfig(false)))
+	defer uncached.Close()
+	purge("purging a registry without cache", uncached.URL, http.StatusNotFound)
+}
@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+)
+
+// aliasRedirected redirects the requests reading content unknown to a
+// repository renamed recently to the same content under its new name, and
+// returns whether the request was redirected. Only the failed requests are
+// checked, so that the others pay no extra lookup.
+func (app *App) aliasRedirected(ctx *Context, w http.ResponseWriter, r *http.Request) bool {
+	if app.renamer == nil || (r.Method != http.MethodGet && r.Method != http.MethodHead) || !app.nameRequired(r) {
+		return false
+	}
+	for _, err := range ctx.Errors {
+		var code errcode.ErrorCode
+		switch err := err.(type) {
+		case errcode.Error:
+			code = err.Code
+		case errcode.ErrorCode:
+			code = err
+		}
+		if code != v2.ErrorCodeNameUnknown && code != v2.ErrorCodeManifestUnknown && code != v2.ErrorCodeBlobUnknown {
+			return false
+		}
+	}
+
+	name, err := reference.WithName(getName(ctx))
+	if err != nil {
+		return false
+	}
+	target, err := app.renamer.Alias(ctx, name)
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("error reading alias of %s: %v", name.Name(), err)
+		return false
+	}
+	if target == nil {
+		return false
+	}
+
+	location := *r.URL
+	location.Path = strings.Replace(r.URL.Path, "/v2/"+name.Name()+"/", "/v2/"+target.Name()+"/", 1)
+	location.RawPath = ""
+	dcontext.GetLogger(ctx).Debugf("redirecting %s, renamed to %s", name.Name(), target.Name())
+	http.Redirect(w, r, location.String(), http.StatusTemporaryRedirect)
+	return true
+}
@@ -1,8 +1,11 @@
 package handlers
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -16,26 +19,34 @@ import (
 	"path"
 	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/configuration"
 	"github.com/distribution/distribution/v3/manifest"
 	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
 	"github.com/distribution/distribution/v3/manifest/schema1"
 	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/distribution/distribution/v3/notifications"
 	"github.com/distribution/distribution/v3/reference"
 	"github.com/distribution/distribution/v3/registry/api/errcode"
 	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/distribution/distribution/v3/registry/auth"
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/filesystem"
 	_ "github.com/distribution/distribution/v3/registry/storage/driver/testdriver"
+	"github.com/distribution/distribution/v3/registry/validation"
 	"github.com/distribution/distribution/v3/testutil"
 	"github.com/docker/libtrust"
 	"github.com/gorilla/handlers"
 	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 var headerConfig = http.Header{
@@ -196,6 +207,252 @@ func TestCatalogAPI(t *testing.T) {
 	}
 }
 
+// TestCatalogAPIIndexed tests the /v2/_catalog endpoint served from the
+// catalog index
+func TestCatalogAPIIndexed(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+	}
+	config.Catalog.Index.Enabled = true
+	config.Compatibility.Schema1.Enabled = true
+	config.HTTP.Headers = headerConfig
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	for _, image := range []string{"foo/aaaa", "foo/bbbb", "foo/cccc", "bar/aaaa"} {
+		createRepository(env, t, image, "sometag")
+	}
+
+	type catalog struct {
+		Repositories []string `json:"repositories"`
+		Total        *int     `json:"total"`
+	}
+	getCatalog := func(values url.Values) (catalog, string) {
+		catalogURL, err := env.builder.BuildCatalogURL(values)
+		if err != nil {
+			t.Fatalf("unexpected error building catalog url: %v", err)
+		}
+		resp, err := http.Get(catalogURL)
+		if err != nil {
+			t.Fatalf("unexpected error issuing request: %v", err)
+		}
+		defer resp.Body.Close()
+		checkResponse(t, "issuing catalog api check", resp, http.StatusOK)
+
+		var ctlg catalog
+		if err := json.NewDecoder(resp.Body).Decode(&ctlg); err != nil {
+			t.Fatalf("error decoding catalog: %v", err)
+		}
+		return ctlg, resp.Header.Get("Link")
+	}
+
+	ctlg, link := getCatalog(url.Values{"n": []string{"2"}, "prefix": []string{"foo/"}})
+	if !reflect.DeepEqual(ctlg.Repositories, []string{"foo/aaaa", "foo/bbbb"}) || ctlg.Total == nil || *ctlg.Total != 3 {
+		t.Fatalf("unexpected first page %v", ctlg)
+	}
+
+	re := regexp.MustCompile("<(/v2/_catalog.*)>; rel=\"next\"")
+	matches := re.FindStringSubmatch(link)
+	if len(matches) != 2 {
+		t.Fatalf("unexpected link %q", link)
+	}
+	linkURL, _ := url.Parse(matches[1])
+	if linkURL.Query().Get("token") == "" || linkURL.Query().Get("prefix") != "foo/" {
+		t.Fatalf("unexpected link %q", link)
+	}
+
+	// the total of the first page is carried by the token
+	createRepository(env, t, "foo/dddd", "sometag")
+	ctlg, link = getCatalog(linkURL.Query())
+	if !reflect.DeepEqual(ctlg.Repositories, []string{"foo/cccc", "foo/dddd"}) || ctlg.Total == nil || *ctlg.Total != 3 || link != "" {
+		t.Fatalf("unexpected last page %v, link %q", ctlg, link)
+	}
+
+	// only count the repositories
+	ctlg, link = getCatalog(url.Values{"n": []string{"0"}})
+	if len(ctlg.Repositories) != 0 || ctlg.Total == nil || *ctlg.Total != 5 || link != "" {
+		t.Fatalf("unexpected count %v, link %q", ctlg, link)
+	}
+
+	// the token is only valid for the prefix it was issued for
+	for _, values := range []url.Values{
+		{"token": []string{"not a token"}},
+		{"token": linkURL.Query()["token"], "prefix": []string{"bar/"}},
+	} {
+		catalogURL, err := env.builder.BuildCatalogURL(values)
+		if err != nil {
+			t.Fatalf("unexpected error building catalog url: %v", err)
+		}
+		resp, err := http.Get(catalogURL)
+		if err != nil {
+			t.Fatalf("unexpected error issuing request: %v", err)
+		}
+		defer resp.Body.Close()
+		checkBodyHasErrorCodes(t, "invalid pagination token", resp, v2.ErrorCodePaginationTokenInvalid)
+	}
+}
+
+// TestCatalogActivityAPI tests the /v2/_catalog/_activity endpoint
+func TestCatalogActivityAPI(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+	}
+	config.Catalog.Index.Enabled = true
+	config.Compatibility.Schema1.Enabled = true
+	config.HTTP.Headers = headerConfig
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	before := time.Now()
+	for _, image := range []string{"foo/aaaa", "foo/bbbb", "bar/aaaa"} {
+		createRepository(env, t, image, "sometag")
+	}
+
+	type activity struct {
+		Repositories []struct {
+			Name     string     `json:"name"`
+			LastPush *time.Time `json:"lastPush"`
+		} `json:"repositories"`
+		Total int `json:"total"`
+	}
+	activityURL, err := env.builder.BuildCatalogActivityURL(url.Values{"n": []string{"1"}, "prefix": []string{"foo/"}})
+	if err != nil {
+		t.Fatalf("unexpected error building catalog activity url: %v", err)
+	}
+	resp, err := http.Get(activityURL)
+	if err != nil {
+		t.Fatalf("unexpected error issuing request: %v", err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, "issuing catalog activity api check", resp, http.StatusOK)
+
+	var act activity
+	if err := json.NewDecoder(resp.Body).Decode(&act); err != nil {
+		t.Fatalf("error decoding catalog activity: %v", err)
+	}
+	if act.Total != 2 || len(act.Repositories) != 1 || act.Repositories[0].Name != "foo/aaaa" {
+		t.Fatalf("unexpected catalog activity %v", act)
+	}
+	if lastPush := act.Repositories[0].LastPush; lastPush == nil || lastPush.Before(before) || lastPush.After(time.Now()) {
+		t.Fatalf("unexpected last push %v, expected after %v", lastPush, before)
+	}
+	if link := resp.Header.Get("Link"); !strings.HasPrefix(link, "</v2/_catalog/_activity?") || !strings.Contains(link, "token=") {
+		t.Fatalf("unexpected link %q", link)
+	}
+
+	// the activity is only available with the catalog index
+	noIndexEnv := newTestEnv(t, false)
+	defer noIndexEnv.Shutdown()
+
+	activityURL, err = noIndexEnv.builder.BuildCatalogActivityURL()
+	if err != nil {
+		t.Fatalf("unexpected error building catalog activity url: %v", err)
+	}
+	resp, err = http.Get(activityURL)
+	if err != nil {
+		t.Fatalf("unexpected error issuing request: %v", err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, "catalog activity without index", resp, http.StatusMethodNotAllowed)
+	checkBodyHasErrorCodes(t, "catalog activity without index", resp, errcode.ErrorCodeUnsupported)
+}
+
+func TestEventsAPI(t *testing.T) {
+	env := newTestEnv(t, false)
+	eventsURL, err := env.builder.BuildEventsURL()
+	checkErr(t, err, "building events url")
+	resp, err := http.Get(eventsURL)
+	checkErr(t, err, "streaming events")
+	resp.Body.Close()
+	checkResponse(t, "streaming disabled events", resp, http.StatusMethodNotAllowed)
+	env.Shutdown()
+
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+	}
+	config.Compatibility.Schema1.Enabled = true
+	config.HTTP.Headers = headerConfig
+	config.Notifications.Stream.Enabled = true
+	config.Notifications.Stream.Heartbeat = 10 * time.Millisecond
+	env = newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	invalidURL, err := env.builder.BuildEventsURL(url.Values{"repository": []string{"foo/["}})
+	checkErr(t, err, "building events url")
+	resp, err = http.Get(invalidURL)
+	checkErr(t, err, "streaming events")
+	resp.Body.Close()
+	checkResponse(t, "streaming events with an invalid pattern", resp, http.StatusBadRequest)
+
+	eventsURL, err = env.builder.BuildEventsURL(url.Values{"repository": []string{"foo/*"}, "action": []string{"push"}})
+	checkErr(t, err, "building events url")
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err = client.Get(eventsURL)
+	checkErr(t, err, "streaming events")
+	defer resp.Body.Close()
+	checkResponse(t, "streaming events", resp, http.StatusOK)
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Fatalf("unexpected content type %q", contentType)
+	}
+
+	createRepository(env, t, "bar/events", "latest")
+	createRepository(env, t, "foo/events", "latest")
+
+	// read the events until the push of the manifest, skipping the
+	// heartbeats
+	var heartbeats int
+	scanner := bufio.NewScanner(resp.Body)
+	fields := make(map[string]string)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, ":") {
+			heartbeats++
+			continue
+		}
+		if line != "" {
+			parts := strings.SplitN(line, ": ", 2)
+			fields[parts[0]] = parts[1]
+			continue
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		var event notifications.Event
+		if err := json.Unmarshal([]byte(fields["data"]), &event); err != nil {
+			t.Fatalf("error decoding event %q: %v", fields["data"], err)
+		}
+		if fields["id"] != event.ID || fields["event"] != "push" || event.Action != "push" || event.Target.Repository != "foo/events" {
+			t.Fatalf("unexpected event %v", fields)
+		}
+		if event.Target.Tag == "latest" {
+			break
+		}
+		fields = make(map[string]string)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("error reading events: %v", err)
+	}
+	if heartbeats == 0 {
+		t.Errorf("expected heartbeats")
+	}
+}
+
 // TestTagsAPI tests the /v2/<name>/tags/list endpoint
 func TestTagsAPI(t *testing.T) {
 	env := newTestEnv(t, false)
@@ -456,6 +713,58 @@ func TestBlobAPI(t *testing.T) {
 
 }
 
+func TestBlobAPIOutOfOrderChunks(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	config.Policy.Upload.OutOfOrderChunks = true
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	imageName, _ := reference.WithName("foo/chunks")
+	content := bytes.Repeat([]byte("0123456789"), 10)
+	uploadURLBase, _ := startPushLayer(t, env, imageName)
+
+	for _, chunk := range []struct {
+		start, end int
+		status     int
+		offset     string
+	}{
+		{start: 50, end: 99, status: http.StatusAccepted, offset: "0-0"},
+		// overlapping the chunk held
+		{start: 20, end: 59, status: http.StatusRequestedRangeNotSatisfiable, offset: "0-0"},
+		{start: 20, end: 49, status: http.StatusAccepted, offset: "0-0"},
+		{start: 0, end: 19, status: http.StatusAccepted, offset: "0-99"},
+		// overlapping the data uploaded
+		{start: 90, end: 99, status: http.StatusRequestedRangeNotSatisfiable, offset: "0-99"},
+	} {
+		resp, err := doPushChunk(t, uploadURLBase, bytes.NewReader(content[chunk.start:chunk.end+1]), chunkOptions{
+			contentRange: fmt.Sprintf("%d-%d", chunk.start, chunk.end),
+		})
+		if err != nil {
+			t.Fatalf("unexpected error pushing chunk: %v", err)
+		}
+		msg := fmt.Sprintf("putting chunk %d-%d", chunk.start, chunk.end)
+		checkResponse(t, msg, resp, chunk.status)
+		checkHeaders(t, resp, http.Header{
+			"Range": []string{chunk.offset},
+		})
+		if chunk.status == http.StatusRequestedRangeNotSatisfiable {
+			checkBodyHasErrorCodes(t, msg, resp, v2.ErrorCodeRangeInvalid)
+		}
+		resp.Body.Close()
+		uploadURLBase = resp.Header.Get("Location")
+	}
+
+	finishUpload(t, env.builder, imageName, uploadURLBase, digest.FromBytes(content))
+}
+
 func TestBlobDelete(t *testing.T) {
 	deleteEnabled := true
 	env := newTestEnv(t, deleteEnabled)
@@ -714,6 +1023,10 @@ func testBlobAPI(t *testing.T, env *testEnv, args blobArgs) *testEnv {
 	}
 	defer resp.Body.Close()
 	checkResponse(t, "putting range out of order chunk", resp, http.StatusRequestedRangeNotSatisfiable)
+	checkHeaders(t, resp, http.Header{
+		"Range": []string{"0-0"},
+	})
+	checkBodyHasErrorCodes(t, "putting range out of order chunk", resp, v2.ErrorCodeRangeInvalid)
 
 	// ------------------------
 	// Use a head request to see if the layer exists.
@@ -929,7 +1242,7 @@ func TestDeleteReadOnly(t *testing.T) {
 	uploadURLBase, _ := startPushLayer(t, env, imageName)
 	pushLayer(t, env.builder, imageName, layerDigest, uploadURLBase, layerFile)
 
-	env.app.readOnly = true
+	env.app.SetReadOnly(true)
 
 	resp, err := httpDelete(layerURL)
 	if err != nil {
@@ -942,7 +1255,7 @@ func TestDeleteReadOnly(t *testing.T) {
 func TestStartPushReadOnly(t *testing.T) {
 	env := newTestEnv(t, true)
 	defer env.Shutdown()
-	env.app.readOnly = true
+	env.app.SetReadOnly(true)
 
 	imageName, _ := reference.WithName("foo/bar")
 
@@ -960,601 +1273,933 @@ func TestStartPushReadOnly(t *testing.T) {
 	checkResponse(t, "starting push in read-only mode", resp, http.StatusMethodNotAllowed)
 }
 
-func httpDelete(url string) (*http.Response, error) {
-	req, err := http.NewRequest("DELETE", url, nil)
+func TestBlobMountFallback(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+	}
+	config.Policy.Mount.Fallback = true
+	config.Policy.Mount.AllowUnauthorizedSource = true
+	config.HTTP.Headers = headerConfig
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	otherName, _ := reference.WithName("foo/other")
+	imageName, _ := reference.WithName("foo/bar")
+
+	// the layer is only pushed to another repository than the source
+	layerFile, layerDigest, err := testutil.CreateRandomTarFile()
 	if err != nil {
-		return nil, err
+		t.Fatalf("error creating random layer file: %v", err)
 	}
+	uploadURLBase, _ := startPushLayer(t, env, otherName)
+	pushLayer(t, env.builder, otherName, layerDigest, uploadURLBase, layerFile)
 
-	resp, err := http.DefaultClient.Do(req)
+	layerUploadURL, err := env.builder.BuildBlobUploadURL(imageName, url.Values{
+		"mount": []string{layerDigest.String()},
+		"from":  []string{"foo/source"},
+	})
 	if err != nil {
-		return nil, err
+		t.Fatalf("unexpected error building layer upload url: %v", err)
 	}
-	//	defer resp.Body.Close()
-	return resp, err
-}
 
-type manifestArgs struct {
-	imageName reference.Named
-	mediaType string
-	manifest  distribution.Manifest
-	dgst      digest.Digest
-}
+	resp, err := http.Post(layerUploadURL, "", nil)
+	if err != nil {
+		t.Fatalf("unexpected error mounting layer: %v", err)
+	}
+	defer resp.Body.Close()
 
-func TestManifestAPI(t *testing.T) {
-	schema1Repo, _ := reference.WithName("foo/schema1")
-	schema2Repo, _ := reference.WithName("foo/schema2")
+	checkResponse(t, "mounting layer missing from the source repository", resp, http.StatusCreated)
+	checkHeaders(t, resp, http.Header{
+		"Docker-Content-Digest": []string{layerDigest.String()},
+	})
 
-	deleteEnabled := false
-	env1 := newTestEnv(t, deleteEnabled)
-	defer env1.Shutdown()
-	testManifestAPISchema1(t, env1, schema1Repo)
-	schema2Args := testManifestAPISchema2(t, env1, schema2Repo)
-	testManifestAPIManifestList(t, env1, schema2Args)
+	ref, _ := reference.WithDigest(imageName, layerDigest)
+	layerURL, err := env.builder.BuildBlobURL(ref)
+	if err != nil {
+		t.Fatalf("error building layer url: %v", err)
+	}
+	resp, err = http.Head(layerURL)
+	if err != nil {
+		t.Fatalf("unexpected error checking head on existing layer: %v", err)
+	}
+	defer resp.Body.Close()
 
-	deleteEnabled = true
-	env2 := newTestEnv(t, deleteEnabled)
-	defer env2.Shutdown()
-	testManifestAPISchema1(t, env2, schema1Repo)
-	schema2Args = testManifestAPISchema2(t, env2, schema2Repo)
-	testManifestAPIManifestList(t, env2, schema2Args)
+	checkResponse(t, "checking head on mounted layer", resp, http.StatusOK)
 }
 
-func TestManifestAPI_DeleteTag(t *testing.T) {
-	env := newTestEnv(t, false)
-	defer env.Shutdown()
+// deniedRepositoriesController is an access controller allowing all the
+// accesses but those to the repositories of its denied option.
+type deniedRepositoriesController struct {
+	denied string
+}
 
-	imageName, err := reference.WithName("foo/bar")
-	checkErr(t, err, "building image name")
+type deniedRepositoryChallenge string
 
-	tag := "latest"
-	dgst := createRepository(env, t, imageName.Name(), tag)
+func (c deniedRepositoryChallenge) Error() string {
+	return "access to repository " + string(c) + " denied"
+}
 
-	ref, err := reference.WithTag(imageName, tag)
-	checkErr(t, err, "building tag reference")
+func (c deniedRepositoryChallenge) SetHeaders(r *http.Request, w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+}
 
-	u, err := env.builder.BuildManifestURL(ref)
-	checkErr(t, err, "building tag URL")
+func (ac deniedRepositoriesController) Authorized(ctx context.Context, accessRecords ...auth.Access) (context.Context, error) {
+	for _, access := range accessRecords {
+		if access.Type == "repository" && access.Name == ac.denied {
+			return nil, deniedRepositoryChallenge(access.Name)
+		}
+	}
+	return auth.WithUser(ctx, auth.UserInfo{Name: "user"}), nil
+}
 
-	resp, err := httpDelete(u)
-	m := "deleting tag"
-	checkErr(t, err, m)
-	defer resp.Body.Close()
+func init() {
+	auth.Register("deniedrepositories", auth.InitFunc(func(options map[string]interface{}) (auth.AccessController, error) {
+		return deniedRepositoriesController{denied: fmt.Sprint(options["denied"])}, nil
+	}))
+}
 
-	checkResponse(t, m, resp, http.StatusAccepted)
-	if resp.Body != http.NoBody {
-		t.Fatal("unexpected response body")
+// TestBlobMountFallbackUnauthorizedSource checks that the mount fallback
+// requires allowunauthorizedsource, which mounts the blobs of the repositories
+// the client is not allowed to pull from.
+func TestBlobMountFallbackUnauthorizedSource(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+		Auth: configuration.Auth{
+			"deniedrepositories": configuration.Parameters{"denied": "foo/secret"},
+		},
 	}
+	config.Policy.Mount.Fallback = true
+	config.HTTP.Headers = headerConfig
 
-	msg := "checking tag no longer exists"
-	resp, err = http.Get(u)
-	checkErr(t, err, msg)
-	checkResponse(t, msg, resp, http.StatusNotFound)
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected the mount fallback to be refused without allowunauthorizedsource")
+			}
+		}()
+		NewApp(context.Background(), &config)
+	}()
 
-	digestRef, err := reference.WithDigest(imageName, dgst)
-	checkErr(t, err, "building manifest digest reference")
+	config.Policy.Mount.AllowUnauthorizedSource = true
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
 
-	u, err = env.builder.BuildManifestURL(digestRef)
-	checkErr(t, err, "building manifest URL")
+	// the blob is only in a repository the client is not allowed to pull
+	// from
+	secretName, _ := reference.WithName("foo/secret")
+	secret, err := env.app.registry.Repository(env.ctx, secretName)
+	checkErr(t, err, "getting repository")
+	desc, err := secret.Blobs(env.ctx).Put(env.ctx, "application/octet-stream", []byte("secret layer"))
+	checkErr(t, err, "putting blob")
 
-	msg = "checking manifest still exists"
-	resp, err = http.Head(u)
-	checkErr(t, err, msg)
-	checkResponse(t, msg, resp, http.StatusOK)
+	imageName, _ := reference.WithName("foo/bar")
+	layerUploadURL, err := env.builder.BuildBlobUploadURL(imageName, url.Values{
+		"mount": []string{desc.Digest.String()},
+		"from":  []string{"foo/secret"},
+	})
+	checkErr(t, err, "building layer upload url")
+	resp, err := http.Post(layerUploadURL, "", nil)
+	checkErr(t, err, "mounting layer")
+	defer resp.Body.Close()
+	checkResponse(t, "mounting layer from foo/secret", resp, http.StatusCreated)
 }
 
-func TestManifestAPI_DeleteTag_Unknown(t *testing.T) {
-	env := newTestEnv(t, false)
-	defer env.Shutdown()
-
-	imageName, err := reference.WithName("foo/bar")
-	checkErr(t, err, "building named object")
-
-	ref, err := reference.WithTag(imageName, "latest")
-	checkErr(t, err, "building tag reference")
-
-	u, err := env.builder.BuildManifestURL(ref)
-	checkErr(t, err, "building tag URL")
+// TestBlobUploadDigest starts uploads declaring the digest of the blob, which
+// complete without data transfer when the blob exists.
+func TestBlobUploadDigest(t *testing.T) {
+	newEnv := func(dedupe bool) *testEnv {
+		config := configuration.Configuration{
+			Storage: configuration.Storage{
+				"testdriver": configuration.Parameters{},
+				"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+					"enabled": false,
+				}},
+			},
+		}
+		config.Policy.Mount.Fallback = dedupe
+		config.Policy.Mount.AllowUnauthorizedSource = dedupe
+		config.HTTP.Headers = headerConfig
+		return newTestEnvWithConfig(t, &config)
+	}
 
-	resp, err := httpDelete(u)
-	msg := "deleting unknown tag"
-	checkErr(t, err, msg)
-	defer resp.Body.Close()
+	layerFile, layerDigest, err := testutil.CreateRandomTarFile()
+	if err != nil {
+		t.Fatalf("error creating random layer file: %v", err)
+	}
+	layer, err := ioutil.ReadAll(layerFile)
+	if err != nil {
+		t.Fatalf("error reading layer file: %v", err)
+	}
 
-	checkResponse(t, msg, resp, http.StatusNotFound)
-	checkBodyHasErrorCodes(t, msg, resp, v2.ErrorCodeManifestUnknown)
-}
+	post := func(env *testEnv, name reference.Named, body []byte) *http.Response {
+		layerUploadURL, err := env.builder.BuildBlobUploadURL(name, url.Values{
+			"digest": []string{layerDigest.String()},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error building layer upload url: %v", err)
+		}
+		resp, err := http.Post(layerUploadURL, "application/octet-stream", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("unexpected error starting layer push: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	head := func(env *testEnv, name reference.Named) *http.Response {
+		ref, _ := reference.WithDigest(name, layerDigest)
+		layerURL, err := env.builder.BuildBlobURL(ref)
+		if err != nil {
+			t.Fatalf("error building layer url: %v", err)
+		}
+		resp, err := http.Head(layerURL)
+		if err != nil {
+			t.Fatalf("unexpected error checking head on layer: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
 
-func TestManifestAPI_DeleteTag_ReadOnly(t *testing.T) {
-	env := newTestEnv(t, false)
+	env := newEnv(false)
 	defer env.Shutdown()
-	env.app.readOnly = true
-
-	imageName, err := reference.WithName("foo/bar")
-	checkErr(t, err, "building named object")
-
-	ref, err := reference.WithTag(imageName, "latest")
-	checkErr(t, err, "building tag reference")
+	imageName, _ := reference.WithName("foo/bar")
+	otherName, _ := reference.WithName("foo/other")
 
-	u, err := env.builder.BuildManifestURL(ref)
-	checkErr(t, err, "building URL")
+	resp := post(env, imageName, nil)
+	checkResponse(t, "declaring a missing layer", resp, http.StatusAccepted)
 
-	resp, err := httpDelete(u)
-	msg := "deleting tag"
-	checkErr(t, err, msg)
-	defer resp.Body.Close()
+	resp = post(env, imageName, layer)
+	checkResponse(t, "uploading a layer in a single request", resp, http.StatusCreated)
+	checkHeaders(t, resp, http.Header{
+		"Docker-Content-Digest": []string{layerDigest.String()},
+	})
+	checkResponse(t, "checking head on uploaded layer", head(env, imageName), http.StatusOK)
 
-	checkResponse(t, msg, resp, http.StatusMethodNotAllowed)
-}
+	resp = post(env, imageName, nil)
+	checkResponse(t, "declaring a layer of the repository", resp, http.StatusCreated)
+	checkHeaders(t, resp, http.Header{
+		"Docker-Content-Digest": []string{layerDigest.String()},
+	})
 
-// storageManifestErrDriverFactory implements the factory.StorageDriverFactory interface.
-type storageManifestErrDriverFactory struct{}
+	// the layer of another repository is not mounted without the policy
+	resp = post(env, otherName, nil)
+	checkResponse(t, "declaring a layer of another repository", resp, http.StatusAccepted)
+	checkResponse(t, "checking head on layer of another repository", head(env, otherName), http.StatusNotFound)
 
-const (
-	repositoryWithManifestNotFound    = "manifesttagnotfound"
-	repositoryWithManifestInvalidPath = "manifestinvalidpath"
-	repositoryWithManifestBadLink     = "manifestbadlink"
-	repositoryWithGenericStorageError = "genericstorageerr"
-)
+	dedupeEnv := newEnv(true)
+	defer dedupeEnv.Shutdown()
 
-func (factory *storageManifestErrDriverFactory) Create(parameters map[string]interface{}) (storagedriver.StorageDriver, error) {
-	// Initialize the mock driver
-	var errGenericStorage = errors.New("generic storage error")
-	return &mockErrorDriver{
-		returnErrs: []mockErrorMapping{
-			{
-				pathMatch: fmt.Sprintf("%s/_manifests/tags", repositoryWithManifestNotFound),
-				content:   nil,
-				err:       storagedriver.PathNotFoundError{},
-			},
-			{
-				pathMatch: fmt.Sprintf("%s/_manifests/tags", repositoryWithManifestInvalidPath),
-				content:   nil,
-				err:       storagedriver.InvalidPathError{},
-			},
-			{
-				pathMatch: fmt.Sprintf("%s/_manifests/tags", repositoryWithManifestBadLink),
-				content:   []byte("this is a bad sha"),
-				err:       nil,
-			},
-			{
-				pathMatch: fmt.Sprintf("%s/_manifests/tags", repositoryWithGenericStorageError),
-				content:   nil,
-				err:       errGenericStorage,
-			},
-		},
-	}, nil
+	resp = post(dedupeEnv, imageName, layer)
+	checkResponse(t, "uploading a layer in a single request", resp, http.StatusCreated)
+	resp = post(dedupeEnv, otherName, nil)
+	checkResponse(t, "declaring a layer of another repository with the mount policy", resp, http.StatusCreated)
+	checkHeaders(t, resp, http.Header{
+		"Docker-Content-Digest": []string{layerDigest.String()},
+	})
+	checkResponse(t, "checking head on mounted layer", head(dedupeEnv, otherName), http.StatusOK)
 }
 
-type mockErrorMapping struct {
-	pathMatch string
-	content   []byte
-	err       error
-}
+// TestBlobUploadDigestTrailer checks the running digest of an upload sent
+// with its chunks, and completes it with the digest sent as a trailer.
+func TestBlobUploadDigestTrailer(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
 
-// mockErrorDriver implements StorageDriver to force storage error on manifest request
-type mockErrorDriver struct {
-	storagedriver.StorageDriver
-	returnErrs []mockErrorMapping
-}
+	imageName, _ := reference.WithName("foo/trailer")
+	content := bytes.Repeat([]byte("0123456789"), 10)
 
-func (dr *mockErrorDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
-	for _, returns := range dr.returnErrs {
-		if strings.Contains(path, returns.pathMatch) {
-			return returns.content, returns.err
+	// put sends the last chunk, with the digest of the content in a trailer
+	put := func(uploadURLBase string, trailer string) *http.Response {
+		req, err := http.NewRequest(http.MethodPut, uploadURLBase, io.NopCloser(bytes.NewReader(content[60:])))
+		if err != nil {
+			t.Fatalf("unexpected error creating new request: %v", err)
+		}
+		req.ContentLength = -1
+		req.Trailer = http.Header{"Digest": []string{trailer}}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error completing upload: %v", err)
 		}
+		return resp
 	}
-	return nil, errors.New("Unknown storage error")
-}
-
-func TestGetManifestWithStorageError(t *testing.T) {
-	factory.Register("storagemanifesterror", &storageManifestErrDriverFactory{})
-	config := configuration.Configuration{
-		Storage: configuration.Storage{
-			"storagemanifesterror": configuration.Parameters{},
-			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
-				"enabled": false,
-			}},
-		},
+	push := func(options chunkOptions, chunk []byte) *http.Response {
+		uploadURLBase, _ := startPushLayer(t, env, imageName)
+		resp, err := doPushChunk(t, uploadURLBase, bytes.NewReader(chunk), options)
+		if err != nil {
+			t.Fatalf("unexpected error pushing chunk: %v", err)
+		}
+		return resp
 	}
-	config.HTTP.Headers = headerConfig
-	env1 := newTestEnvWithConfig(t, &config)
-	defer env1.Shutdown()
-
-	repo, _ := reference.WithName(repositoryWithManifestNotFound)
-	testManifestWithStorageError(t, env1, repo, http.StatusNotFound, v2.ErrorCodeManifestUnknown)
-
-	repo, _ = reference.WithName(repositoryWithGenericStorageError)
-	testManifestWithStorageError(t, env1, repo, http.StatusInternalServerError, errcode.ErrorCodeUnknown)
-
-	repo, _ = reference.WithName(repositoryWithManifestInvalidPath)
-	testManifestWithStorageError(t, env1, repo, http.StatusInternalServerError, errcode.ErrorCodeUnknown)
 
-	repo, _ = reference.WithName(repositoryWithManifestBadLink)
-	testManifestWithStorageError(t, env1, repo, http.StatusInternalServerError, errcode.ErrorCodeUnknown)
-}
+	// the digest of the first chunk, then of the data uploaded so far in
+	// the RFC 3230 format
+	resp := push(chunkOptions{digest: digest.FromBytes(content[:30]).String()}, content[:30])
+	checkResponse(t, "putting chunk with its digest", resp, http.StatusAccepted)
+	sum := sha256.Sum256(content[:60])
+	resp, err := doPushChunk(t, resp.Header.Get("Location"), bytes.NewReader(content[30:60]), chunkOptions{
+		digest: "sha-256=" + base64.StdEncoding.EncodeToString(sum[:]),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error pushing chunk: %v", err)
+	}
+	checkResponse(t, "putting chunk with the digest of the upload", resp, http.StatusAccepted)
 
-func TestManifestDelete(t *testing.T) {
-	schema1Repo, _ := reference.WithName("foo/schema1")
-	schema2Repo, _ := reference.WithName("foo/schema2")
+	resp = put(resp.Header.Get("Location"), digest.FromBytes(content).String())
+	defer resp.Body.Close()
+	checkResponse(t, "completing upload with a digest trailer", resp, http.StatusCreated)
+	checkHeaders(t, resp, http.Header{
+		"Docker-Content-Digest": []string{digest.FromBytes(content).String()},
+	})
 
-	deleteEnabled := true
-	env := newTestEnv(t, deleteEnabled)
-	defer env.Shutdown()
-	schema1Args := testManifestAPISchema1(t, env, schema1Repo)
-	testManifestDelete(t, env, schema1Args)
-	schema2Args := testManifestAPISchema2(t, env, schema2Repo)
-	testManifestDelete(t, env, schema2Args)
-}
+	// a chunk not matching its digest cancels the upload
+	resp = push(chunkOptions{digest: digest.FromBytes(content).String()}, content[:30])
+	defer resp.Body.Close()
+	checkResponse(t, "putting chunk with another digest", resp, http.StatusBadRequest)
+	checkBodyHasErrorCodes(t, "putting chunk with another digest", resp, v2.ErrorCodeDigestInvalid)
 
-func TestManifestDeleteDisabled(t *testing.T) {
-	schema1Repo, _ := reference.WithName("foo/schema1")
-	deleteEnabled := false
-	env := newTestEnv(t, deleteEnabled)
-	defer env.Shutdown()
-	testManifestDeleteDisabled(t, env, schema1Repo)
+	// as does a trailer not matching the content
+	resp = push(chunkOptions{}, content[:60])
+	checkResponse(t, "putting chunk", resp, http.StatusAccepted)
+	resp = put(resp.Header.Get("Location"), digest.FromBytes(content[:60]).String())
+	defer resp.Body.Close()
+	checkResponse(t, "completing upload with another digest trailer", resp, http.StatusBadRequest)
+	checkBodyHasErrorCodes(t, "completing upload with another digest trailer", resp, v2.ErrorCodeDigestInvalid)
 }
 
-func testManifestDeleteDisabled(t *testing.T, env *testEnv, imageName reference.Named) {
-	ref, _ := reference.WithDigest(imageName, digestSha256EmptyTar)
-	manifestURL, err := env.builder.BuildManifestURL(ref)
+// TestBlobUploadAcrossInstances resumes an upload on another instance of
+// the registry sharing the storage, without a configured HTTP secret.
+func TestBlobUploadAcrossInstances(t *testing.T) {
+	root, err := ioutil.TempDir("", "registry-")
 	if err != nil {
-		t.Fatalf("unexpected error getting manifest url: %v", err)
+		t.Fatalf("unexpected error creating temporary directory: %v", err)
 	}
+	defer os.RemoveAll(root)
 
-	resp, err := httpDelete(manifestURL)
-	if err != nil {
-		t.Fatalf("unexpected error deleting manifest %v", err)
+	newInstance := func() *testEnv {
+		config := configuration.Configuration{
+			Storage: configuration.Storage{
+				"filesystem": configuration.Parameters{"rootdirectory": root},
+				"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+					"enabled": false,
+				}},
+			},
+		}
+		config.HTTP.Headers = headerConfig
+		return newTestEnvWithConfig(t, &config)
 	}
-	defer resp.Body.Close()
-
-	checkResponse(t, "status of disabled delete of manifest", resp, http.StatusMethodNotAllowed)
-}
+	env1 := newInstance()
+	defer env1.Shutdown()
+	env2 := newInstance()
+	defer env2.Shutdown()
 
-func testManifestWithStorageError(t *testing.T, env *testEnv, imageName reference.Named, expectedStatusCode int, expectedErrorCode errcode.ErrorCode) {
-	tag := "latest"
-	tagRef, _ := reference.WithTag(imageName, tag)
-	manifestURL, err := env.builder.BuildManifestURL(tagRef)
-	if err != nil {
-		t.Fatalf("unexpected error getting manifest url: %v", err)
+	if env1.app.Config.HTTP.Secret != env2.app.Config.HTTP.Secret {
+		t.Fatal("expected the instances to share the upload secret")
 	}
 
-	// -----------------------------
-	// Attempt to fetch the manifest
-	resp, err := http.Get(manifestURL)
+	imageName, _ := reference.WithName("foo/bar")
+	layerFile, layerDigest, err := testutil.CreateRandomTarFile()
 	if err != nil {
-		t.Fatalf("unexpected error getting manifest: %v", err)
+		t.Fatalf("error creating random layer file: %v", err)
 	}
-	defer resp.Body.Close()
-	checkResponse(t, "getting non-existent manifest", resp, expectedStatusCode)
-	checkBodyHasErrorCodes(t, "getting non-existent manifest", resp, expectedErrorCode)
-}
 
-func testManifestAPISchema1(t *testing.T, env *testEnv, imageName reference.Named) manifestArgs {
-	tag := "thetag"
-	args := manifestArgs{imageName: imageName}
+	// start the upload on the first instance and push on the second one
+	uploadURLBase, _ := startPushLayer(t, env1, imageName)
+	uploadURLBase = strings.Replace(uploadURLBase, env1.server.URL, env2.server.URL, 1)
+	pushLayer(t, env2.builder, imageName, layerDigest, uploadURLBase, layerFile)
 
-	tagRef, _ := reference.WithTag(imageName, tag)
-	manifestURL, err := env.builder.BuildManifestURL(tagRef)
+	ref, _ := reference.WithDigest(imageName, layerDigest)
+	layerURL, err := env1.builder.BuildBlobURL(ref)
 	if err != nil {
-		t.Fatalf("unexpected error getting manifest url: %v", err)
+		t.Fatalf("error building layer url: %v", err)
 	}
-
-	// -----------------------------
-	// Attempt to fetch the manifest
-	resp, err := http.Get(manifestURL)
+	resp, err := http.Head(layerURL)
 	if err != nil {
-		t.Fatalf("unexpected error getting manifest: %v", err)
+		t.Fatalf("unexpected error checking head on existing layer: %v", err)
 	}
 	defer resp.Body.Close()
 
-	checkResponse(t, "getting non-existent manifest", resp, http.StatusNotFound)
-	checkBodyHasErrorCodes(t, "getting non-existent manifest", resp, v2.ErrorCodeManifestUnknown)
+	checkResponse(t, "checking head on layer pushed across instances", resp, http.StatusOK)
+}
 
-	tagsURL, err := env.builder.BuildTagsURL(imageName)
+func httpDelete(url string) (*http.Response, error) {
+	req, err := http.NewRequest("DELETE", url, nil)
 	if err != nil {
-		t.Fatalf("unexpected error building tags url: %v", err)
+		return nil, err
 	}
 
-	resp, err = http.Get(tagsURL)
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		t.Fatalf("unexpected error getting unknown tags: %v", err)
+		return nil, err
 	}
-	defer resp.Body.Close()
+	//	defer resp.Body.Close()
+	return resp, err
+}
 
-	// Check that we get an unknown repository error when asking for tags
-	checkResponse(t, "getting unknown manifest tags", resp, http.StatusNotFound)
-	checkBodyHasErrorCodes(t, "getting unknown manifest tags", resp, v2.ErrorCodeNameUnknown)
+type manifestArgs struct {
+	imageName reference.Named
+	mediaType string
+	manifest  distribution.Manifest
+	dgst      digest.Digest
+}
 
-	// --------------------------------
-	// Attempt to push unsigned manifest with missing layers
-	unsignedManifest := &schema1.Manifest{
-		Versioned: manifest.Versioned{
-			SchemaVersion: 1,
-		},
-		Name: imageName.Name(),
-		Tag:  tag,
-		FSLayers: []schema1.FSLayer{
-			{
-				BlobSum: "asdf",
-			},
-			{
-				BlobSum: "qwer",
-			},
-		},
-		History: []schema1.History{
-			{
-				V1Compatibility: "",
-			},
-			{
-				V1Compatibility: "",
-			},
-		},
-	}
+func TestManifestAPI(t *testing.T) {
+	schema1Repo, _ := reference.WithName("foo/schema1")
+	schema2Repo, _ := reference.WithName("foo/schema2")
 
-	resp = putManifest(t, "putting unsigned manifest", manifestURL, "", unsignedManifest)
-	defer resp.Body.Close()
-	checkResponse(t, "putting unsigned manifest", resp, http.StatusBadRequest)
-	_, p, counts := checkBodyHasErrorCodes(t, "putting unsigned manifest", resp, v2.ErrorCodeManifestInvalid)
+	deleteEnabled := false
+	env1 := newTestEnv(t, deleteEnabled)
+	defer env1.Shutdown()
+	testManifestAPISchema1(t, env1, schema1Repo)
+	schema2Args := testManifestAPISchema2(t, env1, schema2Repo)
+	testManifestAPIManifestList(t, env1, schema2Args)
 
-	expectedCounts := map[errcode.ErrorCode]int{
-		v2.ErrorCodeManifestInvalid: 1,
-	}
+	deleteEnabled = true
+	env2 := newTestEnv(t, deleteEnabled)
+	defer env2.Shutdown()
+	testManifestAPISchema1(t, env2, schema1Repo)
+	schema2Args = testManifestAPISchema2(t, env2, schema2Repo)
+	testManifestAPIManifestList(t, env2, schema2Args)
+}
 
-	if !reflect.DeepEqual(counts, expectedCounts) {
-		t.Fatalf("unexpected number of error codes encountered: %v\n!=\n%v\n---\n%s", counts, expectedCounts, string(p))
+func TestManifestAPISchema1Rejected(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
 	}
-
-	// sign the manifest and still get some interesting errors.
-	sm, err := schema1.Sign(unsignedManifest, env.pk)
-	if err != nil {
-		t.Fatalf("error signing manifest: %v", err)
+	config.HTTP.Headers = headerConfig
+	config.Compatibility.Schema1.Conversion = "reject"
+	config.Compatibility.Schema1.Message = "upgrade to docker 1.10 or later"
+	config.Policy.Namespaces = []configuration.Namespace{
+		{Name: "legacy", NamespaceSettings: configuration.NamespaceSettings{Schema1Conversion: "convert"}},
 	}
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
 
-	resp = putManifest(t, "putting signed manifest with errors", manifestURL, "", sm)
-	defer resp.Body.Close()
-	checkResponse(t, "putting signed manifest with errors", resp, http.StatusBadRequest)
-	_, p, counts = checkBodyHasErrorCodes(t, "putting signed manifest with errors", resp,
-		v2.ErrorCodeManifestBlobUnknown, v2.ErrorCodeDigestInvalid)
+	// the schema2 manifests are converted in the legacy namespace
+	legacyRepo, _ := reference.WithName("legacy/app")
+	args := testManifestAPISchema2(t, env, legacyRepo)
 
-	expectedCounts = map[errcode.ErrorCode]int{
-		v2.ErrorCodeManifestBlobUnknown: 2,
-		v2.ErrorCodeDigestInvalid:       2,
-	}
+	// and rejected without it, unless fetched by digest
+	env.app.namespaces = nil
 
-	if !reflect.DeepEqual(counts, expectedCounts) {
-		t.Fatalf("unexpected number of error codes encountered: %v\n!=\n%v\n---\n%s", counts, expectedCounts, string(p))
+	tagRef, _ := reference.WithTag(legacyRepo, "schema2tag")
+	tagURL, err := env.builder.BuildManifestURL(tagRef)
+	checkErr(t, err, "building manifest url")
+	resp, err := http.Get(tagURL)
+	checkErr(t, err, "fetching manifest as schema1")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching manifest as schema1", resp, http.StatusNotFound)
+	errs, _, _ := checkBodyHasErrorCodes(t, "fetching manifest as schema1", resp, v2.ErrorCodeManifestUnknown)
+	if errs[0].(errcode.Error).Message != config.Compatibility.Schema1.Message {
+		t.Errorf("unexpected error message %q", errs[0].(errcode.Error).Message)
 	}
 
-	// TODO(stevvooe): Add a test case where we take a mostly valid registry,
-	// tamper with the content and ensure that we get an unverified manifest
-	// error.
-
-	// Push 2 random layers
-	expectedLayers := make(map[digest.Digest]io.ReadSeeker)
-
-	for i := range unsignedManifest.FSLayers {
-		rs, dgst, err := testutil.CreateRandomTarFile()
-
-		if err != nil {
-			t.Fatalf("error creating random layer %d: %v", i, err)
-		}
-
-		expectedLayers[dgst] = rs
-		unsignedManifest.FSLayers[i].BlobSum = dgst
-
-		uploadURLBase, _ := startPushLayer(t, env, imageName)
-		pushLayer(t, env.builder, imageName, dgst, uploadURLBase, rs)
-	}
+	digestRef, _ := reference.WithDigest(legacyRepo, args.dgst)
+	digestURL, err := env.builder.BuildManifestURL(digestRef)
+	checkErr(t, err, "building manifest url")
+	resp, err = http.Get(digestURL)
+	checkErr(t, err, "fetching manifest by digest")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching manifest by digest", resp, http.StatusOK)
+	checkHeaders(t, resp, http.Header{
+		"Content-Type": []string{schema2.MediaTypeManifest},
+	})
+}
 
-	// -------------------
-	// Push the signed manifest with all layers pushed.
-	signedManifest, err := schema1.Sign(unsignedManifest, env.pk)
-	if err != nil {
-		t.Fatalf("unexpected error signing manifest: %v", err)
-	}
+func TestManifestAPIMount(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
 
-	dgst := digest.FromBytes(signedManifest.Canonical)
-	args.manifest = signedManifest
-	args.dgst = dgst
+	staging, _ := reference.WithName("staging/app")
+	args := testManifestAPISchema2(t, env, staging)
+	testManifestAPIManifestList(t, env, args)
 
-	digestRef, _ := reference.WithDigest(imageName, dgst)
-	manifestDigestURL, err := env.builder.BuildManifestURL(digestRef)
+	// resolve the digest of the manifest list pushed to staging
+	listRef, _ := reference.WithTag(staging, "manifestlisttag")
+	listURL, err := env.builder.BuildManifestURL(listRef)
 	checkErr(t, err, "building manifest url")
+	req, err := http.NewRequest(http.MethodHead, listURL, nil)
+	checkErr(t, err, "building request")
+	req.Header.Set("Accept", manifestlist.MediaTypeManifestList)
+	resp, err := http.DefaultClient.Do(req)
+	checkErr(t, err, "fetching manifest list")
+	resp.Body.Close()
+	checkResponse(t, "fetching manifest list", resp, http.StatusOK)
+	listDigest := digest.Digest(resp.Header.Get("Docker-Content-Digest"))
+
+	prod, _ := reference.WithName("prod/app")
+	prodTag, _ := reference.WithTag(prod, "1.2")
+	mountURL := func(ref reference.Named, dgst digest.Digest) string {
+		u, err := env.builder.BuildManifestURL(ref)
+		checkErr(t, err, "building manifest url")
+		return u + "?" + url.Values{
+			"mount": []string{dgst.String()},
+			"from":  []string{staging.Name()},
+		}.Encode()
+	}
+	put := func(u string) *http.Response {
+		req, err := http.NewRequest(http.MethodPut, u, nil)
+		checkErr(t, err, "building request")
+		resp, err := http.DefaultClient.Do(req)
+		checkErr(t, err, "mounting manifest")
+		return resp
+	}
+
+	// a manifest unknown to the source repository is not mounted
+	resp = put(mountURL(prodTag, digest.FromString("unknown")))
+	defer resp.Body.Close()
+	checkResponse(t, "mounting unknown manifest", resp, http.StatusNotFound)
+	checkBodyHasErrorCodes(t, "mounting unknown manifest", resp, v2.ErrorCodeManifestUnknown)
 
-	resp = putManifest(t, "putting signed manifest no error", manifestURL, "", signedManifest)
-	checkResponse(t, "putting signed manifest no error", resp, http.StatusCreated)
+	// the digest must match the reference
+	prodDigest, _ := reference.WithDigest(prod, args.dgst)
+	resp = put(mountURL(prodDigest, listDigest))
+	defer resp.Body.Close()
+	checkResponse(t, "mounting manifest under another digest", resp, http.StatusBadRequest)
+
+	resp = put(mountURL(prodTag, listDigest))
+	defer resp.Body.Close()
+	checkResponse(t, "mounting manifest list", resp, http.StatusCreated)
 	checkHeaders(t, resp, http.Header{
-		"Location":              []string{manifestDigestURL},
-		"Docker-Content-Digest": []string{dgst.String()},
+		"Docker-Content-Digest": []string{listDigest.String()},
 	})
 
-	// --------------------
-	// Push by digest -- should get same result
-	resp = putManifest(t, "putting signed manifest", manifestDigestURL, "", signedManifest)
-	checkResponse(t, "putting signed manifest", resp, http.StatusCreated)
+	// the tag, the manifests and the blobs are in the target repository
+	tagURL, err := env.builder.BuildManifestURL(prodTag)
+	checkErr(t, err, "building manifest url")
+	req, err = http.NewRequest(http.MethodGet, tagURL, nil)
+	checkErr(t, err, "building request")
+	req.Header.Set("Accept", manifestlist.MediaTypeManifestList)
+	resp, err = http.DefaultClient.Do(req)
+	checkErr(t, err, "fetching mounted manifest list")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching mounted manifest list", resp, http.StatusOK)
 	checkHeaders(t, resp, http.Header{
-		"Location":              []string{manifestDigestURL},
-		"Docker-Content-Digest": []string{dgst.String()},
+		"Docker-Content-Digest": []string{listDigest.String()},
 	})
 
-	// ------------------
-	// Fetch by tag name
-	resp, err = http.Get(manifestURL)
-	if err != nil {
-		t.Fatalf("unexpected error fetching manifest: %v", err)
+	digestURL, err := env.builder.BuildManifestURL(prodDigest)
+	checkErr(t, err, "building manifest url")
+	req, err = http.NewRequest(http.MethodHead, digestURL, nil)
+	checkErr(t, err, "building request")
+	req.Header.Set("Accept", schema2.MediaTypeManifest)
+	resp, err = http.DefaultClient.Do(req)
+	checkErr(t, err, "fetching mounted manifest")
+	resp.Body.Close()
+	checkResponse(t, "fetching mounted manifest", resp, http.StatusOK)
+
+	for _, ref := range args.manifest.References() {
+		blobRef, _ := reference.WithDigest(prod, ref.Digest)
+		blobURL, err := env.builder.BuildBlobURL(blobRef)
+		checkErr(t, err, "building blob url")
+		resp, err := http.Head(blobURL)
+		checkErr(t, err, "fetching mounted blob")
+		resp.Body.Close()
+		checkResponse(t, "fetching mounted blob", resp, http.StatusOK)
 	}
-	defer resp.Body.Close()
+}
 
-	checkResponse(t, "fetching uploaded manifest", resp, http.StatusOK)
-	checkHeaders(t, resp, http.Header{
-		"Docker-Content-Digest": []string{dgst.String()},
-		"ETag":                  []string{fmt.Sprintf(`"%s"`, dgst)},
-	})
+func TestManifestAPI_DeleteTag(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
 
-	var fetchedManifest schema1.SignedManifest
-	dec := json.NewDecoder(resp.Body)
+	imageName, err := reference.WithName("foo/bar")
+	checkErr(t, err, "building image name")
 
-	if err := dec.Decode(&fetchedManifest); err != nil {
-		t.Fatalf("error decoding fetched manifest: %v", err)
-	}
+	tag := "latest"
+	dgst := createRepository(env, t, imageName.Name(), tag)
 
-	if !bytes.Equal(fetchedManifest.Canonical, signedManifest.Canonical) {
-		t.Fatalf("manifests do not match")
-	}
+	ref, err := reference.WithTag(imageName, tag)
+	checkErr(t, err, "building tag reference")
 
-	// ---------------
-	// Fetch by digest
-	resp, err = http.Get(manifestDigestURL)
-	checkErr(t, err, "fetching manifest by digest")
-	defer resp.Body.Close()
+	u, err := env.builder.BuildManifestURL(ref)
+	checkErr(t, err, "building tag URL")
 
-	checkResponse(t, "fetching uploaded manifest", resp, http.StatusOK)
-	checkHeaders(t, resp, http.Header{
-		"Docker-Content-Digest": []string{dgst.String()},
-		"ETag":                  []string{fmt.Sprintf(`"%s"`, dgst)},
-	})
+	resp, err := httpDelete(u)
+	m := "deleting tag"
+	checkErr(t, err, m)
+	defer resp.Body.Close()
 
-	var fetchedManifestByDigest schema1.SignedManifest
-	dec = json.NewDecoder(resp.Body)
-	if err := dec.Decode(&fetchedManifestByDigest); err != nil {
-		t.Fatalf("error decoding fetched manifest: %v", err)
+	checkResponse(t, m, resp, http.StatusAccepted)
+	if resp.Body != http.NoBody {
+		t.Fatal("unexpected response body")
 	}
 
-	if !bytes.Equal(fetchedManifestByDigest.Canonical, signedManifest.Canonical) {
-		t.Fatalf("manifests do not match")
-	}
+	msg := "checking tag no longer exists"
+	resp, err = http.Get(u)
+	checkErr(t, err, msg)
+	checkResponse(t, msg, resp, http.StatusNotFound)
 
-	// check signature was roundtripped
-	signatures, err := fetchedManifestByDigest.Signatures()
-	if err != nil {
-		t.Fatal(err)
-	}
+	digestRef, err := reference.WithDigest(imageName, dgst)
+	checkErr(t, err, "building manifest digest reference")
 
-	if len(signatures) != 1 {
-		t.Fatalf("expected 1 signature from manifest, got: %d", len(signatures))
-	}
+	u, err = env.builder.BuildManifestURL(digestRef)
+	checkErr(t, err, "building manifest URL")
 
-	// Re-sign, push and pull the same digest
-	sm2, err := schema1.Sign(&fetchedManifestByDigest.Manifest, env.pk)
-	if err != nil {
-		t.Fatal(err)
+	msg = "checking manifest still exists"
+	resp, err = http.Head(u)
+	checkErr(t, err, msg)
+	checkResponse(t, msg, resp, http.StatusOK)
+}
 
-	}
+func TestManifestAPI_DeleteTag_Unknown(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
 
-	// Re-push with a few different Content-Types. The official schema1
-	// content type should work, as should application/json with/without a
-	// charset.
-	resp = putManifest(t, "re-putting signed manifest", manifestDigestURL, schema1.MediaTypeSignedManifest, sm2)
-	checkResponse(t, "re-putting signed manifest", resp, http.StatusCreated)
-	resp = putManifest(t, "re-putting signed manifest", manifestDigestURL, "application/json", sm2)
-	checkResponse(t, "re-putting signed manifest", resp, http.StatusCreated)
-	resp = putManifest(t, "re-putting signed manifest", manifestDigestURL, "application/json", sm2)
-	checkResponse(t, "re-putting signed manifest", resp, http.StatusCreated)
+	imageName, err := reference.WithName("foo/bar")
+	checkErr(t, err, "building named object")
 
-	resp, err = http.Get(manifestDigestURL)
-	checkErr(t, err, "re-fetching manifest by digest")
+	ref, err := reference.WithTag(imageName, "latest")
+	checkErr(t, err, "building tag reference")
+
+	u, err := env.builder.BuildManifestURL(ref)
+	checkErr(t, err, "building tag URL")
+
+	resp, err := httpDelete(u)
+	msg := "deleting unknown tag"
+	checkErr(t, err, msg)
 	defer resp.Body.Close()
 
-	checkResponse(t, "re-fetching uploaded manifest", resp, http.StatusOK)
-	checkHeaders(t, resp, http.Header{
-		"Docker-Content-Digest": []string{dgst.String()},
-		"ETag":                  []string{fmt.Sprintf(`"%s"`, dgst)},
-	})
+	checkResponse(t, msg, resp, http.StatusNotFound)
+	checkBodyHasErrorCodes(t, msg, resp, v2.ErrorCodeManifestUnknown)
+}
 
-	dec = json.NewDecoder(resp.Body)
-	if err := dec.Decode(&fetchedManifestByDigest); err != nil {
-		t.Fatalf("error decoding fetched manifest: %v", err)
-	}
+func TestManifestAPI_DeleteTag_ReadOnly(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+	env.app.SetReadOnly(true)
 
-	// check only 1 signature is returned
-	signatures, err = fetchedManifestByDigest.Signatures()
-	if err != nil {
-		t.Fatal(err)
-	}
+	imageName, err := reference.WithName("foo/bar")
+	checkErr(t, err, "building named object")
 
-	if len(signatures) != 1 {
-		t.Fatalf("expected 2 signature from manifest, got: %d", len(signatures))
-	}
+	ref, err := reference.WithTag(imageName, "latest")
+	checkErr(t, err, "building tag reference")
 
-	// Get by name with etag, gives 304
-	etag := resp.Header.Get("Etag")
-	req, err := http.NewRequest("GET", manifestURL, nil)
-	if err != nil {
-		t.Fatalf("Error constructing request: %s", err)
+	u, err := env.builder.BuildManifestURL(ref)
+	checkErr(t, err, "building URL")
+
+	resp, err := httpDelete(u)
+	msg := "deleting tag"
+	checkErr(t, err, msg)
+	defer resp.Body.Close()
+
+	checkResponse(t, msg, resp, http.StatusMethodNotAllowed)
+}
+
+// TestManifestAPI_DeleteCachedDescriptor checks that deleting a tag, a
+// manifest or a layer is visible at once, even though their descriptors were
+// cached by the requests before.
+func TestManifestAPI_DeleteCachedDescriptor(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"cache":    configuration.Parameters{"blobdescriptor": "inmemory"},
+			"delete":   configuration.Parameters{"enabled": true},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
 	}
-	req.Header.Set("If-None-Match", etag)
-	resp, err = http.DefaultClient.Do(req)
-	if err != nil {
-		t.Fatalf("Error constructing request: %s", err)
+	config.Compatibility.Schema1.Enabled = true
+	config.HTTP.Headers = headerConfig
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	imageName, err := reference.WithName("foo/bar")
+	checkErr(t, err, "building image name")
+
+	tag := "latest"
+	dgst := createRepository(env, t, imageName.Name(), tag)
+
+	tagRef, err := reference.WithTag(imageName, tag)
+	checkErr(t, err, "building tag reference")
+	tagURL, err := env.builder.BuildManifestURL(tagRef)
+	checkErr(t, err, "building tag URL")
+
+	digestRef, err := reference.WithDigest(imageName, dgst)
+	checkErr(t, err, "building manifest digest reference")
+	digestURL, err := env.builder.BuildManifestURL(digestRef)
+	checkErr(t, err, "building manifest URL")
+
+	checkHead := func(msg, u string, status int) {
+		t.Helper()
+		resp, err := http.Head(u)
+		checkErr(t, err, msg)
+		resp.Body.Close()
+		checkResponse(t, msg, resp, status)
+	}
+	checkDelete := func(msg, u string) {
+		t.Helper()
+		resp, err := httpDelete(u)
+		checkErr(t, err, msg)
+		resp.Body.Close()
+		checkResponse(t, msg, resp, http.StatusAccepted)
 	}
 
-	checkResponse(t, "fetching manifest by name with etag", resp, http.StatusNotModified)
+	layerFile, layerDigest, err := testutil.CreateRandomTarFile()
+	checkErr(t, err, "creating random layer")
+	uploadURLBase, _ := startPushLayer(t, env, imageName)
+	pushLayer(t, env.builder, imageName, layerDigest, uploadURLBase, layerFile)
+	layerRef, err := reference.WithDigest(imageName, layerDigest)
+	checkErr(t, err, "building layer reference")
+	layerURL, err := env.builder.BuildBlobURL(layerRef)
+	checkErr(t, err, "building layer URL")
 
-	// Get by digest with etag, gives 304
-	req, err = http.NewRequest("GET", manifestDigestURL, nil)
-	if err != nil {
-		t.Fatalf("Error constructing request: %s", err)
+	// the descriptors are cached by these requests
+	checkHead("warming the cache by tag", tagURL, http.StatusOK)
+	checkHead("warming the cache by digest", digestURL, http.StatusOK)
+	checkHead("warming the cache of the layer", layerURL, http.StatusOK)
+
+	checkDelete("deleting layer", layerURL)
+	checkHead("checking layer no longer exists", layerURL, http.StatusNotFound)
+
+	checkDelete("deleting tag", tagURL)
+	checkHead("checking tag no longer exists", tagURL, http.StatusNotFound)
+	checkHead("checking manifest still exists", digestURL, http.StatusOK)
+
+	checkDelete("deleting manifest", digestURL)
+	checkHead("checking manifest no longer exists", digestURL, http.StatusNotFound)
+
+	resp, err := http.Get(digestURL)
+	checkErr(t, err, "fetching deleted manifest")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching deleted manifest", resp, http.StatusNotFound)
+	checkBodyHasErrorCodes(t, "fetching deleted manifest", resp, v2.ErrorCodeManifestUnknown)
+}
+
+// storageManifestErrDriverFactory implements the factory.StorageDriverFactory interface.
+type storageManifestErrDriverFactory struct{}
+
+const (
+	repositoryWithManifestNotFound    = "manifesttagnotfound"
+	repositoryWithManifestInvalidPath = "manifestinvalidpath"
+	repositoryWithManifestBadLink     = "manifestbadlink"
+	repositoryWithGenericStorageError = "genericstorageerr"
+)
+
+func (factory *storageManifestErrDriverFactory) Create(parameters map[string]interface{}) (storagedriver.StorageDriver, error) {
+	// Initialize the mock driver
+	var errGenericStorage = errors.New("generic storage error")
+	return &mockErrorDriver{
+		returnErrs: []mockErrorMapping{
+			{
+				pathMatch: fmt.Sprintf("%s/_manifests/tags", repositoryWithManifestNotFound),
+				content:   nil,
+				err:       storagedriver.PathNotFoundError{},
+			},
+			{
+				pathMatch: fmt.Sprintf("%s/_manifests/tags", repositoryWithManifestInvalidPath),
+				content:   nil,
+				err:       storagedriver.InvalidPathError{},
+			},
+			{
+				pathMatch: fmt.Sprintf("%s/_manifests/tags", repositoryWithManifestBadLink),
+				content:   []byte("this is a bad sha"),
+				err:       nil,
+			},
+			{
+				pathMatch: fmt.Sprintf("%s/_manifests/tags", repositoryWithGenericStorageError),
+				content:   nil,
+				err:       errGenericStorage,
+			},
+		},
+	}, nil
+}
+
+type mockErrorMapping struct {
+	pathMatch string
+	content   []byte
+	err       error
+}
+
+// mockErrorDriver implements StorageDriver to force storage error on manifest request
+type mockErrorDriver struct {
+	storagedriver.StorageDriver
+	returnErrs []mockErrorMapping
+}
+
+func (dr *mockErrorDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	for _, returns := range dr.returnErrs {
+		if strings.Contains(path, returns.pathMatch) {
+			return returns.content, returns.err
+		}
 	}
-	req.Header.Set("If-None-Match", etag)
-	resp, err = http.DefaultClient.Do(req)
-	if err != nil {
-		t.Fatalf("Error constructing request: %s", err)
+	return nil, errors.New("Unknown storage error")
+}
+
+func TestGetManifestWithStorageError(t *testing.T) {
+	factory.Register("storagemanifesterror", &storageManifestErrDriverFactory{})
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"storagemanifesterror": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
 	}
+	config.HTTP.Headers = headerConfig
+	env1 := newTestEnvWithConfig(t, &config)
+	defer env1.Shutdown()
 
-	checkResponse(t, "fetching manifest by dgst with etag", resp, http.StatusNotModified)
+	repo, _ := reference.WithName(repositoryWithManifestNotFound)
+	testManifestWithStorageError(t, env1, repo, http.StatusNotFound, v2.ErrorCodeManifestUnknown)
 
-	// Ensure that the tag is listed.
-	resp, err = http.Get(tagsURL)
+	repo, _ = reference.WithName(repositoryWithGenericStorageError)
+	testManifestWithStorageError(t, env1, repo, http.StatusInternalServerError, errcode.ErrorCodeUnknown)
+
+	repo, _ = reference.WithName(repositoryWithManifestInvalidPath)
+	testManifestWithStorageError(t, env1, repo, http.StatusInternalServerError, errcode.ErrorCodeUnknown)
+
+	repo, _ = reference.WithName(repositoryWithManifestBadLink)
+	testManifestWithStorageError(t, env1, repo, http.StatusInternalServerError, errcode.ErrorCodeUnknown)
+}
+
+func TestManifestDelete(t *testing.T) {
+	schema1Repo, _ := reference.WithName("foo/schema1")
+	schema2Repo, _ := reference.WithName("foo/schema2")
+
+	deleteEnabled := true
+	env := newTestEnv(t, deleteEnabled)
+	defer env.Shutdown()
+	schema1Args := testManifestAPISchema1(t, env, schema1Repo)
+	testManifestDelete(t, env, schema1Args)
+	schema2Args := testManifestAPISchema2(t, env, schema2Repo)
+	testManifestDelete(t, env, schema2Args)
+}
+
+func TestManifestDeleteDisabled(t *testing.T) {
+	schema1Repo, _ := reference.WithName("foo/schema1")
+	deleteEnabled := false
+	env := newTestEnv(t, deleteEnabled)
+	defer env.Shutdown()
+	testManifestDeleteDisabled(t, env, schema1Repo)
+}
+
+func testManifestDeleteDisabled(t *testing.T, env *testEnv, imageName reference.Named) {
+	ref, _ := reference.WithDigest(imageName, digestSha256EmptyTar)
+	manifestURL, err := env.builder.BuildManifestURL(ref)
 	if err != nil {
-		t.Fatalf("unexpected error getting unknown tags: %v", err)
+		t.Fatalf("unexpected error getting manifest url: %v", err)
+	}
+
+	resp, err := httpDelete(manifestURL)
+	if err != nil {
+		t.Fatalf("unexpected error deleting manifest %v", err)
 	}
 	defer resp.Body.Close()
 
-	checkResponse(t, "getting tags", resp, http.StatusOK)
-	dec = json.NewDecoder(resp.Body)
+	checkResponse(t, "status of disabled delete of manifest", resp, http.StatusMethodNotAllowed)
+}
 
-	var tagsResponse tagsAPIResponse
+func TestRepositoryDelete(t *testing.T) {
+	imageName, _ := reference.WithName("foo/schema2")
 
-	if err := dec.Decode(&tagsResponse); err != nil {
-		t.Fatalf("unexpected error decoding error response: %v", err)
+	env := newTestEnv(t, true)
+	defer env.Shutdown()
+	env.app.repositoryDeletion = true
+
+	args := testManifestAPISchema2(t, env, imageName)
+
+	repositoryURL, err := env.builder.BuildRepositoryURL(imageName)
+	if err != nil {
+		t.Fatalf("unexpected error building repository url: %v", err)
 	}
 
-	if tagsResponse.Name != imageName.Name() {
-		t.Fatalf("tags name should match image name: %v != %v", tagsResponse.Name, imageName.Name())
+	resp, err := httpDelete(repositoryURL)
+	if err != nil {
+		t.Fatalf("unexpected error deleting repository: %v", err)
 	}
+	defer resp.Body.Close()
+	checkResponse(t, "deleting repository", resp, http.StatusAccepted)
 
-	if len(tagsResponse.Tags) != 1 {
-		t.Fatalf("expected some tags in response: %v", tagsResponse.Tags)
+	digestRef, _ := reference.WithDigest(imageName, args.dgst)
+	manifestURL, err := env.builder.BuildManifestURL(digestRef)
+	if err != nil {
+		t.Fatalf("unexpected error building manifest url: %v", err)
 	}
 
-	if tagsResponse.Tags[0] != tag {
-		t.Fatalf("tag not as expected: %q != %q", tagsResponse.Tags[0], tag)
+	resp, err = http.Get(manifestURL)
+	if err != nil {
+		t.Fatalf("unexpected error fetching manifest: %v", err)
 	}
+	defer resp.Body.Close()
+	checkResponse(t, "fetching manifest of deleted repository", resp, http.StatusNotFound)
 
-	// Attempt to put a manifest with mismatching FSLayer and History array cardinalities
+	resp, err = httpDelete(repositoryURL)
+	if err != nil {
+		t.Fatalf("unexpected error deleting repository: %v", err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, "deleting unknown repository", resp, http.StatusNotFound)
+	checkBodyHasErrorCodes(t, "deleting unknown repository", resp, v2.ErrorCodeNameUnknown)
 
-	unsignedManifest.History = append(unsignedManifest.History, schema1.History{
-		V1Compatibility: "",
-	})
-	invalidSigned, err := schema1.Sign(unsignedManifest, env.pk)
+	// the unknown paths below a repository are not found, rather than not
+	// allowed as deletions of repositories
+	resp, err = http.Get(repositoryURL + "/tags")
 	if err != nil {
-		t.Fatalf("error signing manifest")
+		t.Fatalf("unexpected error fetching unknown path: %v", err)
 	}
+	defer resp.Body.Close()
+	checkResponse(t, "fetching unknown path", resp, http.StatusNotFound)
+}
 
-	resp = putManifest(t, "putting invalid signed manifest", manifestDigestURL, "", invalidSigned)
-	checkResponse(t, "putting invalid signed manifest", resp, http.StatusBadRequest)
+func TestRepositoryDeleteDisabled(t *testing.T) {
+	imageName, _ := reference.WithName("foo/schema2")
 
-	return args
+	env := newTestEnv(t, true)
+	defer env.Shutdown()
+
+	testManifestAPISchema2(t, env, imageName)
+
+	repositoryURL, err := env.builder.BuildRepositoryURL(imageName)
+	if err != nil {
+		t.Fatalf("unexpected error building repository url: %v", err)
+	}
+
+	resp, err := httpDelete(repositoryURL)
+	if err != nil {
+		t.Fatalf("unexpected error deleting repository: %v", err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, "status of disabled delete of repository", resp, http.StatusMethodNotAllowed)
 }
 
-func testManifestAPISchema2(t *testing.T, env *testEnv, imageName reference.Named) manifestArgs {
-	tag := "schema2tag"
-	args := manifestArgs{
-		imageName: imageName,
-		mediaType: schema2.MediaTypeManifest,
+func testManifestWithStorageError(t *testing.T, env *testEnv, imageName reference.Named, expectedStatusCode int, expectedErrorCode errcode.ErrorCode) {
+	tag := "latest"
+	tagRef, _ := reference.WithTag(imageName, tag)
+	manifestURL, err := env.builder.BuildManifestURL(tagRef)
+	if err != nil {
+		t.Fatalf("unexpected error getting manifest url: %v", err)
 	}
 
+	// -----------------------------
+	// Attempt to fetch the manifest
+	resp, err := http.Get(manifestURL)
+	if err != nil {
+		t.Fatalf("unexpected error getting manifest: %v", err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, "getting non-existent manifest", resp, expectedStatusCode)
+	checkBodyHasErrorCodes(t, "getting non-existent manifest", resp, expectedErrorCode)
+}
+
+func testManifestAPISchema1(t *testing.T, env *testEnv, imageName reference.Named) manifestArgs {
+	tag := "thetag"
+	args := manifestArgs{imageName: imageName}
+
 	tagRef, _ := reference.WithTag(imageName, tag)
 	manifestURL, err := env.builder.BuildManifestURL(tagRef)
 	if err != nil {
@@ -1588,90 +2233,73 @@ func testManifestAPISchema2(t *testing.T, env *testEnv, imageName reference.Name
 	checkBodyHasErrorCodes(t, "getting unknown manifest tags", resp, v2.ErrorCodeNameUnknown)
 
 	// --------------------------------
-	// Attempt to push manifest with missing config and missing layers
-	manifest := &schema2.Manifest{
+	// Attempt to push unsigned manifest with missing layers
+	unsignedManifest := &schema1.Manifest{
 		Versioned: manifest.Versioned{
-			SchemaVersion: 2,
-			MediaType:     schema2.MediaTypeManifest,
+			SchemaVersion: 1,
 		},
-		Config: distribution.Descriptor{
-			Digest:    "sha256:1a9ec845ee94c202b2d5da74a24f0ed2058318bfa9879fa541efaecba272e86b",
-			Size:      3253,
-			MediaType: schema2.MediaTypeImageConfig,
+		Name: imageName.Name(),
+		Tag:  tag,
+		FSLayers: []schema1.FSLayer{
+			{
+				BlobSum: "asdf",
+			},
+			{
+				BlobSum: "qwer",
+			},
 		},
-		Layers: []distribution.Descriptor{
+		History: []schema1.History{
 			{
-				Digest:    "sha256:463434349086340864309863409683460843608348608934092322395278926a",
-				Size:      6323,
-				MediaType: schema2.MediaTypeLayer,
+				V1Compatibility: "",
 			},
 			{
-				Digest:    "sha256:630923423623623423352523525237238023652897356239852383652aaaaaaa",
-				Size:      6863,
-				MediaType: schema2.MediaTypeLayer,
+				V1Compatibility: "",
 			},
 		},
 	}
 
-	resp = putManifest(t, "putting missing config manifest", manifestURL, schema2.MediaTypeManifest, manifest)
+	resp = putManifest(t, "putting unsigned manifest", manifestURL, "", unsignedManifest)
 	defer resp.Body.Close()
-	checkResponse(t, "putting missing config manifest", resp, http.StatusBadRequest)
-	_, p, counts := checkBodyHasErrorCodes(t, "putting missing config manifest", resp, v2.ErrorCodeManifestBlobUnknown)
+	checkResponse(t, "putting unsigned manifest", resp, http.StatusBadRequest)
+	_, p, counts := checkBodyHasErrorCodes(t, "putting unsigned manifest", resp, v2.ErrorCodeManifestInvalid)
 
 	expectedCounts := map[errcode.ErrorCode]int{
-		v2.ErrorCodeManifestBlobUnknown: 3,
+		v2.ErrorCodeManifestInvalid: 1,
 	}
 
 	if !reflect.DeepEqual(counts, expectedCounts) {
 		t.Fatalf("unexpected number of error codes encountered: %v\n!=\n%v\n---\n%s", counts, expectedCounts, string(p))
 	}
 
-	// Push a config, and reference it in the manifest
-	sampleConfig := []byte(`{
-		"architecture": "amd64",
-		"history": [
-		  {
-		    "created": "2015-10-31T22:22:54.690851953Z",
-		    "created_by": "/bin/sh -c #(nop) ADD file:a3bc1e842b69636f9df5256c49c5374fb4eef1e281fe3f282c65fb853ee171c5 in /"
-		  },
-		  {
-		    "created": "2015-10-31T22:22:55.613815829Z",
-		    "created_by": "/bin/sh -c #(nop) CMD [\"sh\"]"
-		  }
-		],
-		"rootfs": {
-		  "diff_ids": [
-		    "sha256:c6f988f4874bb0add23a778f753c65efe992244e148a1d2ec2a8b664fb66bbd1",
-		    "sha256:5f70bf18a086007016e948b04aed3b82103a36bea41755b6cddfaf10ace3c6ef"
-		  ],
-		  "type": "layers"
-		}
-	}`)
-	sampleConfigDigest := digest.FromBytes(sampleConfig)
-
-	uploadURLBase, _ := startPushLayer(t, env, imageName)
-	pushLayer(t, env.builder, imageName, sampleConfigDigest, uploadURLBase, bytes.NewReader(sampleConfig))
-	manifest.Config.Digest = sampleConfigDigest
-	manifest.Config.Size = int64(len(sampleConfig))
+	// sign the manifest and still get some interesting errors.
+	sm, err := schema1.Sign(unsignedManifest, env.pk)
+	if err != nil {
+		t.Fatalf("error signing manifest: %v", err)
+	}
 
-	// The manifest should still be invalid, because its layer doesn't exist
-	resp = putManifest(t, "putting missing layer manifest", manifestURL, schema2.MediaTypeManifest, manifest)
+	resp = putManifest(t, "putting signed manifest with errors", manifestURL, "", sm)
 	defer resp.Body.Close()
-	checkResponse(t, "putting missing layer manifest", resp, http.StatusBadRequest)
-	_, p, counts = checkBodyHasErrorCodes(t, "getting unknown manifest tags", resp, v2.ErrorCodeManifestBlobUnknown)
+	checkResponse(t, "putting signed manifest with errors", resp, http.StatusBadRequest)
+	_, p, counts = checkBodyHasErrorCodes(t, "putting signed manifest with errors", resp,
+		v2.ErrorCodeManifestBlobUnknown, v2.ErrorCodeDigestInvalid)
 
 	expectedCounts = map[errcode.ErrorCode]int{
 		v2.ErrorCodeManifestBlobUnknown: 2,
+		v2.ErrorCodeDigestInvalid:       2,
 	}
 
 	if !reflect.DeepEqual(counts, expectedCounts) {
 		t.Fatalf("unexpected number of error codes encountered: %v\n!=\n%v\n---\n%s", counts, expectedCounts, string(p))
 	}
 
+	// TODO(stevvooe): Add a test case where we take a mostly valid registry,
+	// tamper with the content and ensure that we get an unverified manifest
+	// error.
+
 	// Push 2 random layers
 	expectedLayers := make(map[digest.Digest]io.ReadSeeker)
 
-	for i := range manifest.Layers {
+	for i := range unsignedManifest.FSLayers {
 		rs, dgst, err := testutil.CreateRandomTarFile()
 
 		if err != nil {
@@ -1679,32 +2307,29 @@ func testManifestAPISchema2(t *testing.T, env *testEnv, imageName reference.Name
 		}
 
 		expectedLayers[dgst] = rs
-		manifest.Layers[i].Digest = dgst
+		unsignedManifest.FSLayers[i].BlobSum = dgst
 
 		uploadURLBase, _ := startPushLayer(t, env, imageName)
 		pushLayer(t, env.builder, imageName, dgst, uploadURLBase, rs)
 	}
 
 	// -------------------
-	// Push the manifest with all layers pushed.
-	deserializedManifest, err := schema2.FromStruct(*manifest)
-	if err != nil {
-		t.Fatalf("could not create DeserializedManifest: %v", err)
-	}
-	_, canonical, err := deserializedManifest.Payload()
+	// Push the signed manifest with all layers pushed.
+	signedManifest, err := schema1.Sign(unsignedManifest, env.pk)
 	if err != nil {
-		t.Fatalf("could not get manifest payload: %v", err)
+		t.Fatalf("unexpected error signing manifest: %v", err)
 	}
-	dgst := digest.FromBytes(canonical)
+
+	dgst := digest.FromBytes(signedManifest.Canonical)
+	args.manifest = signedManifest
 	args.dgst = dgst
-	args.manifest = deserializedManifest
 
 	digestRef, _ := reference.WithDigest(imageName, dgst)
 	manifestDigestURL, err := env.builder.BuildManifestURL(digestRef)
 	checkErr(t, err, "building manifest url")
 
-	resp = putManifest(t, "putting manifest no error", manifestURL, schema2.MediaTypeManifest, manifest)
-	checkResponse(t, "putting manifest no error", resp, http.StatusCreated)
+	resp = putManifest(t, "putting signed manifest no error", manifestURL, "", signedManifest)
+	checkResponse(t, "putting signed manifest no error", resp, http.StatusCreated)
 	checkHeaders(t, resp, http.Header{
 		"Location":              []string{manifestDigestURL},
 		"Docker-Content-Digest": []string{dgst.String()},
@@ -1712,8 +2337,8 @@ func testManifestAPISchema2(t *testing.T, env *testEnv, imageName reference.Name
 
 	// --------------------
 	// Push by digest -- should get same result
-	resp = putManifest(t, "putting manifest by digest", manifestDigestURL, schema2.MediaTypeManifest, manifest)
-	checkResponse(t, "putting manifest by digest", resp, http.StatusCreated)
+	resp = putManifest(t, "putting signed manifest", manifestDigestURL, "", signedManifest)
+	checkResponse(t, "putting signed manifest", resp, http.StatusCreated)
 	checkHeaders(t, resp, http.Header{
 		"Location":              []string{manifestDigestURL},
 		"Docker-Content-Digest": []string{dgst.String()},
@@ -1721,12 +2346,7 @@ func testManifestAPISchema2(t *testing.T, env *testEnv, imageName reference.Name
 
 	// ------------------
 	// Fetch by tag name
-	req, err := http.NewRequest("GET", manifestURL, nil)
-	if err != nil {
-		t.Fatalf("Error constructing request: %s", err)
-	}
-	req.Header.Set("Accept", schema2.MediaTypeManifest)
-	resp, err = http.DefaultClient.Do(req)
+	resp, err = http.Get(manifestURL)
 	if err != nil {
 		t.Fatalf("unexpected error fetching manifest: %v", err)
 	}
@@ -1738,30 +2358,20 @@ func testManifestAPISchema2(t *testing.T, env *testEnv, imageName reference.Name
 		"ETag":                  []string{fmt.Sprintf(`"%s"`, dgst)},
 	})
 
-	var fetchedManifest schema2.DeserializedManifest
+	var fetchedManifest schema1.SignedManifest
 	dec := json.NewDecoder(resp.Body)
 
 	if err := dec.Decode(&fetchedManifest); err != nil {
 		t.Fatalf("error decoding fetched manifest: %v", err)
 	}
 
-	_, fetchedCanonical, err := fetchedManifest.Payload()
-	if err != nil {
-		t.Fatalf("error getting manifest payload: %v", err)
-	}
-
-	if !bytes.Equal(fetchedCanonical, canonical) {
+	if !bytes.Equal(fetchedManifest.Canonical, signedManifest.Canonical) {
 		t.Fatalf("manifests do not match")
 	}
 
 	// ---------------
 	// Fetch by digest
-	req, err = http.NewRequest("GET", manifestDigestURL, nil)
-	if err != nil {
-		t.Fatalf("Error constructing request: %s", err)
-	}
-	req.Header.Set("Accept", schema2.MediaTypeManifest)
-	resp, err = http.DefaultClient.Do(req)
+	resp, err = http.Get(manifestDigestURL)
 	checkErr(t, err, "fetching manifest by digest")
 	defer resp.Body.Close()
 
@@ -1771,24 +2381,71 @@ func testManifestAPISchema2(t *testing.T, env *testEnv, imageName reference.Name
 		"ETag":                  []string{fmt.Sprintf(`"%s"`, dgst)},
 	})
 
-	var fetchedManifestByDigest schema2.DeserializedManifest
+	var fetchedManifestByDigest schema1.SignedManifest
 	dec = json.NewDecoder(resp.Body)
 	if err := dec.Decode(&fetchedManifestByDigest); err != nil {
 		t.Fatalf("error decoding fetched manifest: %v", err)
 	}
 
-	_, fetchedCanonical, err = fetchedManifest.Payload()
+	if !bytes.Equal(fetchedManifestByDigest.Canonical, signedManifest.Canonical) {
+		t.Fatalf("manifests do not match")
+	}
+
+	// check signature was roundtripped
+	signatures, err := fetchedManifestByDigest.Signatures()
 	if err != nil {
-		t.Fatalf("error getting manifest payload: %v", err)
+		t.Fatal(err)
 	}
 
-	if !bytes.Equal(fetchedCanonical, canonical) {
-		t.Fatalf("manifests do not match")
+	if len(signatures) != 1 {
+		t.Fatalf("expected 1 signature from manifest, got: %d", len(signatures))
+	}
+
+	// Re-sign, push and pull the same digest
+	sm2, err := schema1.Sign(&fetchedManifestByDigest.Manifest, env.pk)
+	if err != nil {
+		t.Fatal(err)
+
+	}
+
+	// Re-push with a few different Content-Types. The official schema1
+	// content type should work, as should application/json with/without a
+	// charset.
+	resp = putManifest(t, "re-putting signed manifest", manifestDigestURL, schema1.MediaTypeSignedManifest, sm2)
+	checkResponse(t, "re-putting signed manifest", resp, http.StatusCreated)
+	resp = putManifest(t, "re-putting signed manifest", manifestDigestURL, "application/json", sm2)
+	checkResponse(t, "re-putting signed manifest", resp, http.StatusCreated)
+	resp = putManifest(t, "re-putting signed manifest", manifestDigestURL, "application/json", sm2)
+	checkResponse(t, "re-putting signed manifest", resp, http.StatusCreated)
+
+	resp, err = http.Get(manifestDigestURL)
+	checkErr(t, err, "re-fetching manifest by digest")
+	defer resp.Body.Close()
+
+	checkResponse(t, "re-fetching uploaded manifest", resp, http.StatusOK)
+	checkHeaders(t, resp, http.Header{
+		"Docker-Content-Digest": []string{dgst.String()},
+		"ETag":                  []string{fmt.Sprintf(`"%s"`, dgst)},
+	})
+
+	dec = json.NewDecoder(resp.Body)
+	if err := dec.Decode(&fetchedManifestByDigest); err != nil {
+		t.Fatalf("error decoding fetched manifest: %v", err)
+	}
+
+	// check only 1 signature is returned
+	signatures, err = fetchedManifestByDigest.Signatures()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(signatures) != 1 {
+		t.Fatalf("expected 2 signature from manifest, got: %d", len(signatures))
 	}
 
 	// Get by name with etag, gives 304
 	etag := resp.Header.Get("Etag")
-	req, err = http.NewRequest("GET", manifestURL, nil)
+	req, err := http.NewRequest("GET", manifestURL, nil)
 	if err != nil {
 		t.Fatalf("Error constructing request: %s", err)
 	}
@@ -1820,7 +2477,7 @@ func testManifestAPISchema2(t *testing.T, env *testEnv, imageName reference.Name
 	}
 	defer resp.Body.Close()
 
-	checkResponse(t, "getting unknown manifest tags", resp, http.StatusOK)
+	checkResponse(t, "getting tags", resp, http.StatusOK)
 	dec = json.NewDecoder(resp.Body)
 
 	var tagsResponse tagsAPIResponse
@@ -1830,7 +2487,7 @@ func testManifestAPISchema2(t *testing.T, env *testEnv, imageName reference.Name
 	}
 
 	if tagsResponse.Name != imageName.Name() {
-		t.Fatalf("tags name should match image name: %v != %v", tagsResponse.Name, imageName)
+		t.Fatalf("tags name should match image name: %v != %v", tagsResponse.Name, imageName.Name())
 	}
 
 	if len(tagsResponse.Tags) != 1 {
@@ -1841,130 +2498,179 @@ func testManifestAPISchema2(t *testing.T, env *testEnv, imageName reference.Name
 		t.Fatalf("tag not as expected: %q != %q", tagsResponse.Tags[0], tag)
 	}
 
-	// ------------------
-	// Fetch as a schema1 manifest
-	resp, err = http.Get(manifestURL)
-	if err != nil {
-		t.Fatalf("unexpected error fetching manifest as schema1: %v", err)
-	}
-	defer resp.Body.Close()
+	// Attempt to put a manifest with mismatching FSLayer and History array cardinalities
 
-	manifestBytes, err := ioutil.ReadAll(resp.Body)
+	unsignedManifest.History = append(unsignedManifest.History, schema1.History{
+		V1Compatibility: "",
+	})
+	invalidSigned, err := schema1.Sign(unsignedManifest, env.pk)
 	if err != nil {
-		t.Fatalf("error reading response body: %v", err)
+		t.Fatalf("error signing manifest")
 	}
 
-	checkResponse(t, "fetching uploaded manifest as schema1", resp, http.StatusOK)
+	resp = putManifest(t, "putting invalid signed manifest", manifestDigestURL, "", invalidSigned)
+	checkResponse(t, "putting invalid signed manifest", resp, http.StatusBadRequest)
 
-	m, desc, err := distribution.UnmarshalManifest(schema1.MediaTypeManifest, manifestBytes)
+	return args
+}
+
+func testManifestAPISchema2(t *testing.T, env *testEnv, imageName reference.Named) manifestArgs {
+	tag := "schema2tag"
+	args := manifestArgs{
+		imageName: imageName,
+		mediaType: schema2.MediaTypeManifest,
+	}
+
+	tagRef, _ := reference.WithTag(imageName, tag)
+	manifestURL, err := env.builder.BuildManifestURL(tagRef)
 	if err != nil {
-		t.Fatalf("unexpected error unmarshalling manifest: %v", err)
+		t.Fatalf("unexpected error getting manifest url: %v", err)
 	}
 
-	fetchedSchema1Manifest, ok := m.(*schema1.SignedManifest)
-	if !ok {
-		t.Fatalf("expecting schema1 manifest")
+	// -----------------------------
+	// Attempt to fetch the manifest
+	resp, err := http.Get(manifestURL)
+	if err != nil {
+		t.Fatalf("unexpected error getting manifest: %v", err)
 	}
+	defer resp.Body.Close()
 
-	checkHeaders(t, resp, http.Header{
-		"Docker-Content-Digest": []string{desc.Digest.String()},
-		"ETag":                  []string{fmt.Sprintf(`"%s"`, desc.Digest)},
-	})
+	checkResponse(t, "getting non-existent manifest", resp, http.StatusNotFound)
+	checkBodyHasErrorCodes(t, "getting non-existent manifest", resp, v2.ErrorCodeManifestUnknown)
 
-	if fetchedSchema1Manifest.Manifest.SchemaVersion != 1 {
-		t.Fatal("wrong schema version")
+	tagsURL, err := env.builder.BuildTagsURL(imageName)
+	if err != nil {
+		t.Fatalf("unexpected error building tags url: %v", err)
 	}
-	if fetchedSchema1Manifest.Architecture != "amd64" {
-		t.Fatal("wrong architecture")
+
+	resp, err = http.Get(tagsURL)
+	if err != nil {
+		t.Fatalf("unexpected error getting unknown tags: %v", err)
 	}
-	if fetchedSchema1Manifest.Name != imageName.Name() {
-		t.Fatal("wrong image name")
-	}
-	if fetchedSchema1Manifest.Tag != tag {
-		t.Fatal("wrong tag")
-	}
-	if len(fetchedSchema1Manifest.FSLayers) != 2 {
-		t.Fatal("wrong number of FSLayers")
-	}
-	for i := range manifest.Layers {
-		if fetchedSchema1Manifest.FSLayers[i].BlobSum != manifest.Layers[len(manifest.Layers)-i-1].Digest {
-			t.Fatalf("blob digest mismatch in schema1 manifest for layer %d", i)
-		}
-	}
-	if len(fetchedSchema1Manifest.History) != 2 {
-		t.Fatal("wrong number of History entries")
-	}
-
-	// Don't check V1Compatibility fields because we're using randomly-generated
-	// layers.
-
-	return args
-}
-
-func testManifestAPIManifestList(t *testing.T, env *testEnv, args manifestArgs) {
-	imageName := args.imageName
-	tag := "manifestlisttag"
+	defer resp.Body.Close()
 
-	tagRef, _ := reference.WithTag(imageName, tag)
-	manifestURL, err := env.builder.BuildManifestURL(tagRef)
-	if err != nil {
-		t.Fatalf("unexpected error getting manifest url: %v", err)
-	}
+	// Check that we get an unknown repository error when asking for tags
+	checkResponse(t, "getting unknown manifest tags", resp, http.StatusNotFound)
+	checkBodyHasErrorCodes(t, "getting unknown manifest tags", resp, v2.ErrorCodeNameUnknown)
 
 	// --------------------------------
-	// Attempt to push manifest list that refers to an unknown manifest
-	manifestList := &manifestlist.ManifestList{
+	// Attempt to push manifest with missing config and missing layers
+	manifest := &schema2.Manifest{
 		Versioned: manifest.Versioned{
 			SchemaVersion: 2,
-			MediaType:     manifestlist.MediaTypeManifestList,
+			MediaType:     schema2.MediaTypeManifest,
 		},
-		Manifests: []manifestlist.ManifestDescriptor{
+		Config: distribution.Descriptor{
+			Digest:    "sha256:1a9ec845ee94c202b2d5da74a24f0ed2058318bfa9879fa541efaecba272e86b",
+			Size:      3253,
+			MediaType: schema2.MediaTypeImageConfig,
+		},
+		Layers: []distribution.Descriptor{
 			{
-				Descriptor: distribution.Descriptor{
-					Digest:    "sha256:1a9ec845ee94c202b2d5da74a24f0ed2058318bfa9879fa541efaecba272e86b",
-					Size:      3253,
-					MediaType: schema2.MediaTypeManifest,
-				},
-				Platform: manifestlist.PlatformSpec{
-					Architecture: "amd64",
-					OS:           "linux",
-				},
+				Digest:    "sha256:463434349086340864309863409683460843608348608934092322395278926a",
+				Size:      6323,
+				MediaType: schema2.MediaTypeLayer,
+			},
+			{
+				Digest:    "sha256:630923423623623423352523525237238023652897356239852383652aaaaaaa",
+				Size:      6863,
+				MediaType: schema2.MediaTypeLayer,
 			},
 		},
 	}
 
-	resp := putManifest(t, "putting missing manifest manifestlist", manifestURL, manifestlist.MediaTypeManifestList, manifestList)
+	resp = putManifest(t, "putting missing config manifest", manifestURL, schema2.MediaTypeManifest, manifest)
 	defer resp.Body.Close()
-	checkResponse(t, "putting missing manifest manifestlist", resp, http.StatusBadRequest)
-	_, p, counts := checkBodyHasErrorCodes(t, "putting missing manifest manifestlist", resp, v2.ErrorCodeManifestBlobUnknown)
+	checkResponse(t, "putting missing config manifest", resp, http.StatusBadRequest)
+	_, p, counts := checkBodyHasErrorCodes(t, "putting missing config manifest", resp, v2.ErrorCodeManifestBlobUnknown)
 
 	expectedCounts := map[errcode.ErrorCode]int{
-		v2.ErrorCodeManifestBlobUnknown: 1,
+		v2.ErrorCodeManifestBlobUnknown: 3,
+	}
+
+	if !reflect.DeepEqual(counts, expectedCounts) {
+		t.Fatalf("unexpected number of error codes encountered: %v\n!=\n%v\n---\n%s", counts, expectedCounts, string(p))
+	}
+
+	// Push a config, and reference it in the manifest
+	sampleConfig := []byte(`{
+		"architecture": "amd64",
+		"history": [
+		  {
+		    "created": "2015-10-31T22:22:54.690851953Z",
+		    "created_by": "/bin/sh -c #(nop) ADD file:a3bc1e842b69636f9df5256c49c5374fb4eef1e281fe3f282c65fb853ee171c5 in /"
+		  },
+		  {
+		    "created": "2015-10-31T22:22:55.613815829Z",
+		    "created_by": "/bin/sh -c #(nop) CMD [\"sh\"]"
+		  }
+		],
+		"rootfs": {
+		  "diff_ids": [
+		    "sha256:c6f988f4874bb0add23a778f753c65efe992244e148a1d2ec2a8b664fb66bbd1",
+		    "sha256:5f70bf18a086007016e948b04aed3b82103a36bea41755b6cddfaf10ace3c6ef"
+		  ],
+		  "type": "layers"
+		}
+	}`)
+	sampleConfigDigest := digest.FromBytes(sampleConfig)
+
+	uploadURLBase, _ := startPushLayer(t, env, imageName)
+	pushLayer(t, env.builder, imageName, sampleConfigDigest, uploadURLBase, bytes.NewReader(sampleConfig))
+	manifest.Config.Digest = sampleConfigDigest
+	manifest.Config.Size = int64(len(sampleConfig))
+
+	// The manifest should still be invalid, because its layer doesn't exist
+	resp = putManifest(t, "putting missing layer manifest", manifestURL, schema2.MediaTypeManifest, manifest)
+	defer resp.Body.Close()
+	checkResponse(t, "putting missing layer manifest", resp, http.StatusBadRequest)
+	_, p, counts = checkBodyHasErrorCodes(t, "getting unknown manifest tags", resp, v2.ErrorCodeManifestBlobUnknown)
+
+	expectedCounts = map[errcode.ErrorCode]int{
+		v2.ErrorCodeManifestBlobUnknown: 2,
 	}
 
 	if !reflect.DeepEqual(counts, expectedCounts) {
 		t.Fatalf("unexpected number of error codes encountered: %v\n!=\n%v\n---\n%s", counts, expectedCounts, string(p))
 	}
 
+	// Push 2 random layers
+	expectedLayers := make(map[digest.Digest]io.ReadSeeker)
+
+	for i := range manifest.Layers {
+		rs, dgst, err := testutil.CreateRandomTarFile()
+
+		if err != nil {
+			t.Fatalf("error creating random layer %d: %v", i, err)
+		}
+
+		expectedLayers[dgst] = rs
+		manifest.Layers[i].Digest = dgst
+
+		uploadURLBase, _ := startPushLayer(t, env, imageName)
+		pushLayer(t, env.builder, imageName, dgst, uploadURLBase, rs)
+	}
+
 	// -------------------
-	// Push a manifest list that references an actual manifest
-	manifestList.Manifests[0].Digest = args.dgst
-	deserializedManifestList, err := manifestlist.FromDescriptors(manifestList.Manifests)
+	// Push the manifest with all layers pushed.
+	deserializedManifest, err := schema2.FromStruct(*manifest)
 	if err != nil {
-		t.Fatalf("could not create DeserializedManifestList: %v", err)
+		t.Fatalf("could not create DeserializedManifest: %v", err)
 	}
-	_, canonical, err := deserializedManifestList.Payload()
+	_, canonical, err := deserializedManifest.Payload()
 	if err != nil {
-		t.Fatalf("could not get manifest list payload: %v", err)
+		t.Fatalf("could not get manifest payload: %v", err)
 	}
 	dgst := digest.FromBytes(canonical)
+	args.dgst = dgst
+	args.manifest = deserializedManifest
 
 	digestRef, _ := reference.WithDigest(imageName, dgst)
 	manifestDigestURL, err := env.builder.BuildManifestURL(digestRef)
 	checkErr(t, err, "building manifest url")
 
-	resp = putManifest(t, "putting manifest list no error", manifestURL, manifestlist.MediaTypeManifestList, deserializedManifestList)
-	checkResponse(t, "putting manifest list no error", resp, http.StatusCreated)
+	resp = putManifest(t, "putting manifest no error", manifestURL, schema2.MediaTypeManifest, manifest)
+	checkResponse(t, "putting manifest no error", resp, http.StatusCreated)
 	checkHeaders(t, resp, http.Header{
 		"Location":              []string{manifestDigestURL},
 		"Docker-Content-Digest": []string{dgst.String()},
@@ -1972,8 +2678,8 @@ func testManifestAPIManifestList(t *testing.T, env *testEnv, args manifestArgs)
 
 	// --------------------
 	// Push by digest -- should get same result
-	resp = putManifest(t, "putting manifest list by digest", manifestDigestURL, manifestlist.MediaTypeManifestList, deserializedManifestList)
-	checkResponse(t, "putting manifest list by digest", resp, http.StatusCreated)
+	resp = putManifest(t, "putting manifest by digest", manifestDigestURL, schema2.MediaTypeManifest, manifest)
+	checkResponse(t, "putting manifest by digest", resp, http.StatusCreated)
 	checkHeaders(t, resp, http.Header{
 		"Location":              []string{manifestDigestURL},
 		"Docker-Content-Digest": []string{dgst.String()},
@@ -1985,35 +2691,33 @@ func testManifestAPIManifestList(t *testing.T, env *testEnv, args manifestArgs)
 	if err != nil {
 		t.Fatalf("Error constructing request: %s", err)
 	}
-	// multiple headers in mixed list format to ensure we parse correctly server-side
-	req.Header.Set("Accept", fmt.Sprintf(` %s ; q=0.8 , %s ; q=0.5 `, manifestlist.MediaTypeManifestList, schema1.MediaTypeSignedManifest))
-	req.Header.Add("Accept", schema2.MediaTypeManifest)
+	req.Header.Set("Accept", schema2.MediaTypeManifest)
 	resp, err = http.DefaultClient.Do(req)
 	if err != nil {
-		t.Fatalf("unexpected error fetching manifest list: %v", err)
+		t.Fatalf("unexpected error fetching manifest: %v", err)
 	}
 	defer resp.Body.Close()
 
-	checkResponse(t, "fetching uploaded manifest list", resp, http.StatusOK)
+	checkResponse(t, "fetching uploaded manifest", resp, http.StatusOK)
 	checkHeaders(t, resp, http.Header{
 		"Docker-Content-Digest": []string{dgst.String()},
 		"ETag":                  []string{fmt.Sprintf(`"%s"`, dgst)},
 	})
 
-	var fetchedManifestList manifestlist.DeserializedManifestList
+	var fetchedManifest schema2.DeserializedManifest
 	dec := json.NewDecoder(resp.Body)
 
-	if err := dec.Decode(&fetchedManifestList); err != nil {
-		t.Fatalf("error decoding fetched manifest list: %v", err)
+	if err := dec.Decode(&fetchedManifest); err != nil {
+		t.Fatalf("error decoding fetched manifest: %v", err)
 	}
 
-	_, fetchedCanonical, err := fetchedManifestList.Payload()
+	_, fetchedCanonical, err := fetchedManifest.Payload()
 	if err != nil {
-		t.Fatalf("error getting manifest list payload: %v", err)
+		t.Fatalf("error getting manifest payload: %v", err)
 	}
 
 	if !bytes.Equal(fetchedCanonical, canonical) {
-		t.Fatalf("manifest lists do not match")
+		t.Fatalf("manifests do not match")
 	}
 
 	// ---------------
@@ -2022,26 +2726,26 @@ func testManifestAPIManifestList(t *testing.T, env *testEnv, args manifestArgs)
 	if err != nil {
 		t.Fatalf("Error constructing request: %s", err)
 	}
-	req.Header.Set("Accept", manifestlist.MediaTypeManifestList)
+	req.Header.Set("Accept", schema2.MediaTypeManifest)
 	resp, err = http.DefaultClient.Do(req)
-	checkErr(t, err, "fetching manifest list by digest")
+	checkErr(t, err, "fetching manifest by digest")
 	defer resp.Body.Close()
 
-	checkResponse(t, "fetching uploaded manifest list", resp, http.StatusOK)
+	checkResponse(t, "fetching uploaded manifest", resp, http.StatusOK)
 	checkHeaders(t, resp, http.Header{
 		"Docker-Content-Digest": []string{dgst.String()},
 		"ETag":                  []string{fmt.Sprintf(`"%s"`, dgst)},
 	})
 
-	var fetchedManifestListByDigest manifestlist.DeserializedManifestList
+	var fetchedManifestByDigest schema2.DeserializedManifest
 	dec = json.NewDecoder(resp.Body)
-	if err := dec.Decode(&fetchedManifestListByDigest); err != nil {
+	if err := dec.Decode(&fetchedManifestByDigest); err != nil {
 		t.Fatalf("error decoding fetched manifest: %v", err)
 	}
 
-	_, fetchedCanonical, err = fetchedManifestListByDigest.Payload()
+	_, fetchedCanonical, err = fetchedManifest.Payload()
 	if err != nil {
-		t.Fatalf("error getting manifest list payload: %v", err)
+		t.Fatalf("error getting manifest payload: %v", err)
 	}
 
 	if !bytes.Equal(fetchedCanonical, canonical) {
@@ -2075,11 +2779,39 @@ func testManifestAPIManifestList(t *testing.T, env *testEnv, args manifestArgs)
 
 	checkResponse(t, "fetching manifest by dgst with etag", resp, http.StatusNotModified)
 
+	// Ensure that the tag is listed.
+	resp, err = http.Get(tagsURL)
+	if err != nil {
+		t.Fatalf("unexpected error getting unknown tags: %v", err)
+	}
+	defer resp.Body.Close()
+
+	checkResponse(t, "getting unknown manifest tags", resp, http.StatusOK)
+	dec = json.NewDecoder(resp.Body)
+
+	var tagsResponse tagsAPIResponse
+
+	if err := dec.Decode(&tagsResponse); err != nil {
+		t.Fatalf("unexpected error decoding error response: %v", err)
+	}
+
+	if tagsResponse.Name != imageName.Name() {
+		t.Fatalf("tags name should match image name: %v != %v", tagsResponse.Name, imageName)
+	}
+
+	if len(tagsResponse.Tags) != 1 {
+		t.Fatalf("expected some tags in response: %v", tagsResponse.Tags)
+	}
+
+	if tagsResponse.Tags[0] != tag {
+		t.Fatalf("tag not as expected: %q != %q", tagsResponse.Tags[0], tag)
+	}
+
 	// ------------------
 	// Fetch as a schema1 manifest
 	resp, err = http.Get(manifestURL)
 	if err != nil {
-		t.Fatalf("unexpected error fetching manifest list as schema1: %v", err)
+		t.Fatalf("unexpected error fetching manifest as schema1: %v", err)
 	}
 	defer resp.Body.Close()
 
@@ -2088,7 +2820,7 @@ func testManifestAPIManifestList(t *testing.T, env *testEnv, args manifestArgs)
 		t.Fatalf("error reading response body: %v", err)
 	}
 
-	checkResponse(t, "fetching uploaded manifest list as schema1", resp, http.StatusOK)
+	checkResponse(t, "fetching uploaded manifest as schema1", resp, http.StatusOK)
 
 	m, desc, err := distribution.UnmarshalManifest(schema1.MediaTypeManifest, manifestBytes)
 	if err != nil {
@@ -2103,6 +2835,7 @@ func testManifestAPIManifestList(t *testing.T, env *testEnv, args manifestArgs)
 	checkHeaders(t, resp, http.Header{
 		"Docker-Content-Digest": []string{desc.Digest.String()},
 		"ETag":                  []string{fmt.Sprintf(`"%s"`, desc.Digest)},
+		"Warning":               []string{schema1Warning},
 	})
 
 	if fetchedSchema1Manifest.Manifest.SchemaVersion != 1 {
@@ -2120,9 +2853,8 @@ func testManifestAPIManifestList(t *testing.T, env *testEnv, args manifestArgs)
 	if len(fetchedSchema1Manifest.FSLayers) != 2 {
 		t.Fatal("wrong number of FSLayers")
 	}
-	layers := args.manifest.(*schema2.DeserializedManifest).Layers
-	for i := range layers {
-		if fetchedSchema1Manifest.FSLayers[i].BlobSum != layers[len(layers)-i-1].Digest {
+	for i := range manifest.Layers {
+		if fetchedSchema1Manifest.FSLayers[i].BlobSum != manifest.Layers[len(manifest.Layers)-i-1].Digest {
 			t.Fatalf("blob digest mismatch in schema1 manifest for layer %d", i)
 		}
 	}
@@ -2132,35 +2864,271 @@ func testManifestAPIManifestList(t *testing.T, env *testEnv, args manifestArgs)
 
 	// Don't check V1Compatibility fields because we're using randomly-generated
 	// layers.
+
+	return args
 }
 
-func testManifestDelete(t *testing.T, env *testEnv, args manifestArgs) {
+func testManifestAPIManifestList(t *testing.T, env *testEnv, args manifestArgs) {
 	imageName := args.imageName
-	dgst := args.dgst
-	manifest := args.manifest
-
-	ref, _ := reference.WithDigest(imageName, dgst)
-	manifestDigestURL, _ := env.builder.BuildManifestURL(ref)
-	// ---------------
-	// Delete by digest
-	resp, err := httpDelete(manifestDigestURL)
-	checkErr(t, err, "deleting manifest by digest")
-
-	checkResponse(t, "deleting manifest", resp, http.StatusAccepted)
-	checkHeaders(t, resp, http.Header{
-		"Content-Length": []string{"0"},
-	})
-
-	// ---------------
-	// Attempt to fetch deleted manifest
-	resp, err = http.Get(manifestDigestURL)
-	checkErr(t, err, "fetching deleted manifest by digest")
-	defer resp.Body.Close()
+	tag := "manifestlisttag"
 
-	checkResponse(t, "fetching deleted manifest", resp, http.StatusNotFound)
+	tagRef, _ := reference.WithTag(imageName, tag)
+	manifestURL, err := env.builder.BuildManifestURL(tagRef)
+	if err != nil {
+		t.Fatalf("unexpected error getting manifest url: %v", err)
+	}
 
-	// ---------------
-	// Delete already deleted manifest by digest
+	// --------------------------------
+	// Attempt to push manifest list that refers to an unknown manifest
+	manifestList := &manifestlist.ManifestList{
+		Versioned: manifest.Versioned{
+			SchemaVersion: 2,
+			MediaType:     manifestlist.MediaTypeManifestList,
+		},
+		Manifests: []manifestlist.ManifestDescriptor{
+			{
+				Descriptor: distribution.Descriptor{
+					Digest:    "sha256:1a9ec845ee94c202b2d5da74a24f0ed2058318bfa9879fa541efaecba272e86b",
+					Size:      3253,
+					MediaType: schema2.MediaTypeManifest,
+				},
+				Platform: manifestlist.PlatformSpec{
+					Architecture: "amd64",
+					OS:           "linux",
+				},
+			},
+		},
+	}
+
+	resp := putManifest(t, "putting missing manifest manifestlist", manifestURL, manifestlist.MediaTypeManifestList, manifestList)
+	defer resp.Body.Close()
+	checkResponse(t, "putting missing manifest manifestlist", resp, http.StatusBadRequest)
+	_, p, counts := checkBodyHasErrorCodes(t, "putting missing manifest manifestlist", resp, v2.ErrorCodeManifestBlobUnknown)
+
+	expectedCounts := map[errcode.ErrorCode]int{
+		v2.ErrorCodeManifestBlobUnknown: 1,
+	}
+
+	if !reflect.DeepEqual(counts, expectedCounts) {
+		t.Fatalf("unexpected number of error codes encountered: %v\n!=\n%v\n---\n%s", counts, expectedCounts, string(p))
+	}
+
+	// -------------------
+	// Push a manifest list that references an actual manifest
+	manifestList.Manifests[0].Digest = args.dgst
+	deserializedManifestList, err := manifestlist.FromDescriptors(manifestList.Manifests)
+	if err != nil {
+		t.Fatalf("could not create DeserializedManifestList: %v", err)
+	}
+	_, canonical, err := deserializedManifestList.Payload()
+	if err != nil {
+		t.Fatalf("could not get manifest list payload: %v", err)
+	}
+	dgst := digest.FromBytes(canonical)
+
+	digestRef, _ := reference.WithDigest(imageName, dgst)
+	manifestDigestURL, err := env.builder.BuildManifestURL(digestRef)
+	checkErr(t, err, "building manifest url")
+
+	resp = putManifest(t, "putting manifest list no error", manifestURL, manifestlist.MediaTypeManifestList, deserializedManifestList)
+	checkResponse(t, "putting manifest list no error", resp, http.StatusCreated)
+	checkHeaders(t, resp, http.Header{
+		"Location":              []string{manifestDigestURL},
+		"Docker-Content-Digest": []string{dgst.String()},
+	})
+
+	// --------------------
+	// Push by digest -- should get same result
+	resp = putManifest(t, "putting manifest list by digest", manifestDigestURL, manifestlist.MediaTypeManifestList, deserializedManifestList)
+	checkResponse(t, "putting manifest list by digest", resp, http.StatusCreated)
+	checkHeaders(t, resp, http.Header{
+		"Location":              []string{manifestDigestURL},
+		"Docker-Content-Digest": []string{dgst.String()},
+	})
+
+	// ------------------
+	// Fetch by tag name
+	req, err := http.NewRequest("GET", manifestURL, nil)
+	if err != nil {
+		t.Fatalf("Error constructing request: %s", err)
+	}
+	// multiple headers in mixed list format to ensure we parse correctly server-side
+	req.Header.Set("Accept", fmt.Sprintf(` %s ; q=0.8 , %s ; q=0.5 `, manifestlist.MediaTypeManifestList, schema1.MediaTypeSignedManifest))
+	req.Header.Add("Accept", schema2.MediaTypeManifest)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error fetching manifest list: %v", err)
+	}
+	defer resp.Body.Close()
+
+	checkResponse(t, "fetching uploaded manifest list", resp, http.StatusOK)
+	checkHeaders(t, resp, http.Header{
+		"Docker-Content-Digest": []string{dgst.String()},
+		"ETag":                  []string{fmt.Sprintf(`"%s"`, dgst)},
+	})
+
+	var fetchedManifestList manifestlist.DeserializedManifestList
+	dec := json.NewDecoder(resp.Body)
+
+	if err := dec.Decode(&fetchedManifestList); err != nil {
+		t.Fatalf("error decoding fetched manifest list: %v", err)
+	}
+
+	_, fetchedCanonical, err := fetchedManifestList.Payload()
+	if err != nil {
+		t.Fatalf("error getting manifest list payload: %v", err)
+	}
+
+	if !bytes.Equal(fetchedCanonical, canonical) {
+		t.Fatalf("manifest lists do not match")
+	}
+
+	// ---------------
+	// Fetch by digest
+	req, err = http.NewRequest("GET", manifestDigestURL, nil)
+	if err != nil {
+		t.Fatalf("Error constructing request: %s", err)
+	}
+	req.Header.Set("Accept", manifestlist.MediaTypeManifestList)
+	resp, err = http.DefaultClient.Do(req)
+	checkErr(t, err, "fetching manifest list by digest")
+	defer resp.Body.Close()
+
+	checkResponse(t, "fetching uploaded manifest list", resp, http.StatusOK)
+	checkHeaders(t, resp, http.Header{
+		"Docker-Content-Digest": []string{dgst.String()},
+		"ETag":                  []string{fmt.Sprintf(`"%s"`, dgst)},
+	})
+
+	var fetchedManifestListByDigest manifestlist.DeserializedManifestList
+	dec = json.NewDecoder(resp.Body)
+	if err := dec.Decode(&fetchedManifestListByDigest); err != nil {
+		t.Fatalf("error decoding fetched manifest: %v", err)
+	}
+
+	_, fetchedCanonical, err = fetchedManifestListByDigest.Payload()
+	if err != nil {
+		t.Fatalf("error getting manifest list payload: %v", err)
+	}
+
+	if !bytes.Equal(fetchedCanonical, canonical) {
+		t.Fatalf("manifests do not match")
+	}
+
+	// Get by name with etag, gives 304
+	etag := resp.Header.Get("Etag")
+	req, err = http.NewRequest("GET", manifestURL, nil)
+	if err != nil {
+		t.Fatalf("Error constructing request: %s", err)
+	}
+	req.Header.Set("If-None-Match", etag)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error constructing request: %s", err)
+	}
+
+	checkResponse(t, "fetching manifest by name with etag", resp, http.StatusNotModified)
+
+	// Get by digest with etag, gives 304
+	req, err = http.NewRequest("GET", manifestDigestURL, nil)
+	if err != nil {
+		t.Fatalf("Error constructing request: %s", err)
+	}
+	req.Header.Set("If-None-Match", etag)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error constructing request: %s", err)
+	}
+
+	checkResponse(t, "fetching manifest by dgst with etag", resp, http.StatusNotModified)
+
+	// ------------------
+	// Fetch as a schema1 manifest
+	resp, err = http.Get(manifestURL)
+	if err != nil {
+		t.Fatalf("unexpected error fetching manifest list as schema1: %v", err)
+	}
+	defer resp.Body.Close()
+
+	manifestBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("error reading response body: %v", err)
+	}
+
+	checkResponse(t, "fetching uploaded manifest list as schema1", resp, http.StatusOK)
+
+	m, desc, err := distribution.UnmarshalManifest(schema1.MediaTypeManifest, manifestBytes)
+	if err != nil {
+		t.Fatalf("unexpected error unmarshalling manifest: %v", err)
+	}
+
+	fetchedSchema1Manifest, ok := m.(*schema1.SignedManifest)
+	if !ok {
+		t.Fatalf("expecting schema1 manifest")
+	}
+
+	checkHeaders(t, resp, http.Header{
+		"Docker-Content-Digest": []string{desc.Digest.String()},
+		"ETag":                  []string{fmt.Sprintf(`"%s"`, desc.Digest)},
+		"Warning":               []string{schema1Warning},
+	})
+
+	if fetchedSchema1Manifest.Manifest.SchemaVersion != 1 {
+		t.Fatal("wrong schema version")
+	}
+	if fetchedSchema1Manifest.Architecture != "amd64" {
+		t.Fatal("wrong architecture")
+	}
+	if fetchedSchema1Manifest.Name != imageName.Name() {
+		t.Fatal("wrong image name")
+	}
+	if fetchedSchema1Manifest.Tag != tag {
+		t.Fatal("wrong tag")
+	}
+	if len(fetchedSchema1Manifest.FSLayers) != 2 {
+		t.Fatal("wrong number of FSLayers")
+	}
+	layers := args.manifest.(*schema2.DeserializedManifest).Layers
+	for i := range layers {
+		if fetchedSchema1Manifest.FSLayers[i].BlobSum != layers[len(layers)-i-1].Digest {
+			t.Fatalf("blob digest mismatch in schema1 manifest for layer %d", i)
+		}
+	}
+	if len(fetchedSchema1Manifest.History) != 2 {
+		t.Fatal("wrong number of History entries")
+	}
+
+	// Don't check V1Compatibility fields because we're using randomly-generated
+	// layers.
+}
+
+func testManifestDelete(t *testing.T, env *testEnv, args manifestArgs) {
+	imageName := args.imageName
+	dgst := args.dgst
+	manifest := args.manifest
+
+	ref, _ := reference.WithDigest(imageName, dgst)
+	manifestDigestURL, _ := env.builder.BuildManifestURL(ref)
+	// ---------------
+	// Delete by digest
+	resp, err := httpDelete(manifestDigestURL)
+	checkErr(t, err, "deleting manifest by digest")
+
+	checkResponse(t, "deleting manifest", resp, http.StatusAccepted)
+	checkHeaders(t, resp, http.Header{
+		"Content-Length": []string{"0"},
+	})
+
+	// ---------------
+	// Attempt to fetch deleted manifest
+	resp, err = http.Get(manifestDigestURL)
+	checkErr(t, err, "fetching deleted manifest by digest")
+	defer resp.Body.Close()
+
+	checkResponse(t, "fetching deleted manifest", resp, http.StatusNotFound)
+
+	// ---------------
+	// Delete already deleted manifest by digest
 	resp, err = httpDelete(manifestDigestURL)
 	checkErr(t, err, "re-deleting manifest by digest")
 
@@ -2280,471 +3248,1344 @@ type testEnv struct {
 	builder *v2.URLBuilder
 }
 
-func newTestEnvMirror(t *testing.T, deleteEnabled bool) *testEnv {
-	upstreamEnv := newTestEnv(t, deleteEnabled)
-	config := configuration.Configuration{
-		Storage: configuration.Storage{
-			"testdriver": configuration.Parameters{},
-			"delete":     configuration.Parameters{"enabled": deleteEnabled},
-			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
-				"enabled": false,
-			}},
-		},
-		Proxy: configuration.Proxy{
-			RemoteURL: upstreamEnv.server.URL,
-		},
+func newTestEnvMirror(t *testing.T, deleteEnabled bool) *testEnv {
+	upstreamEnv := newTestEnv(t, deleteEnabled)
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+			"delete":     configuration.Parameters{"enabled": deleteEnabled},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+		Proxy: configuration.Proxy{
+			RemoteURL: upstreamEnv.server.URL,
+		},
+	}
+	config.Compatibility.Schema1.Enabled = true
+
+	return newTestEnvWithConfig(t, &config)
+
+}
+
+func newTestEnv(t *testing.T, deleteEnabled bool) *testEnv {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"testdriver": configuration.Parameters{},
+			"delete":     configuration.Parameters{"enabled": deleteEnabled},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+	}
+
+	config.Compatibility.Schema1.Enabled = true
+	config.HTTP.Headers = headerConfig
+
+	return newTestEnvWithConfig(t, &config)
+}
+
+func newTestEnvWithConfig(t *testing.T, config *configuration.Configuration) *testEnv {
+	ctx := context.Background()
+
+	app := NewApp(ctx, config)
+	server := httptest.NewServer(handlers.CombinedLoggingHandler(os.Stderr, app))
+	builder, err := v2.NewURLBuilderFromString(server.URL+config.HTTP.Prefix, false)
+
+	if err != nil {
+		t.Fatalf("error creating url builder: %v", err)
+	}
+
+	pk, err := libtrust.GenerateECP256PrivateKey()
+	if err != nil {
+		t.Fatalf("unexpected error generating private key: %v", err)
+	}
+
+	return &testEnv{
+		pk:      pk,
+		ctx:     ctx,
+		config:  *config,
+		app:     app,
+		server:  server,
+		builder: builder,
+	}
+}
+
+func (t *testEnv) Shutdown() {
+	t.server.CloseClientConnections()
+	t.server.Close()
+}
+
+func putManifest(t *testing.T, msg, url, contentType string, v interface{}) *http.Response {
+	var body []byte
+
+	switch m := v.(type) {
+	case *schema1.SignedManifest:
+		_, pl, err := m.Payload()
+		if err != nil {
+			t.Fatalf("error getting payload: %v", err)
+		}
+		body = pl
+	case *manifestlist.DeserializedManifestList:
+		_, pl, err := m.Payload()
+		if err != nil {
+			t.Fatalf("error getting payload: %v", err)
+		}
+		body = pl
+	default:
+		var err error
+		body, err = json.MarshalIndent(v, "", "   ")
+		if err != nil {
+			t.Fatalf("unexpected error marshaling %v: %v", v, err)
+		}
+	}
+
+	req, err := http.NewRequest("PUT", url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("error creating request for %s: %v", msg, err)
+	}
+
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error doing put request while %s: %v", msg, err)
+	}
+
+	return resp
+}
+
+func startPushLayer(t *testing.T, env *testEnv, name reference.Named) (location string, uuid string) {
+	layerUploadURL, err := env.builder.BuildBlobUploadURL(name)
+	if err != nil {
+		t.Fatalf("unexpected error building layer upload url: %v", err)
+	}
+
+	u, err := url.Parse(layerUploadURL)
+	if err != nil {
+		t.Fatalf("error parsing layer upload URL: %v", err)
+	}
+
+	base, err := url.Parse(env.server.URL)
+	if err != nil {
+		t.Fatalf("error parsing server URL: %v", err)
+	}
+
+	layerUploadURL = base.ResolveReference(u).String()
+	resp, err := http.Post(layerUploadURL, "", nil)
+	if err != nil {
+		t.Fatalf("unexpected error starting layer push: %v", err)
+	}
+
+	defer resp.Body.Close()
+
+	checkResponse(t, fmt.Sprintf("pushing starting layer push %v", name.String()), resp, http.StatusAccepted)
+
+	u, err = url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("error parsing location header: %v", err)
+	}
+
+	uuid = path.Base(u.Path)
+	checkHeaders(t, resp, http.Header{
+		"Location":           []string{"*"},
+		"Content-Length":     []string{"0"},
+		"Docker-Upload-UUID": []string{uuid},
+	})
+
+	return resp.Header.Get("Location"), uuid
+}
+
+// doPushLayer pushes the layer content returning the url on success returning
+// the response. If you're only expecting a successful response, use pushLayer.
+func doPushLayer(t *testing.T, ub *v2.URLBuilder, name reference.Named, dgst digest.Digest, uploadURLBase string, body io.Reader) (*http.Response, error) {
+	u, err := url.Parse(uploadURLBase)
+	if err != nil {
+		t.Fatalf("unexpected error parsing pushLayer url: %v", err)
+	}
+
+	u.RawQuery = url.Values{
+		"_state": u.Query()["_state"],
+		"digest": []string{dgst.String()},
+	}.Encode()
+
+	uploadURL := u.String()
+
+	// Just do a monolithic upload
+	req, err := http.NewRequest("PUT", uploadURL, body)
+	if err != nil {
+		t.Fatalf("unexpected error creating new request: %v", err)
+	}
+
+	return http.DefaultClient.Do(req)
+}
+
+// pushLayer pushes the layer content returning the url on success.
+func pushLayer(t *testing.T, ub *v2.URLBuilder, name reference.Named, dgst digest.Digest, uploadURLBase string, body io.Reader) string {
+	digester := digest.Canonical.Digester()
+
+	resp, err := doPushLayer(t, ub, name, dgst, uploadURLBase, io.TeeReader(body, digester.Hash()))
+	if err != nil {
+		t.Fatalf("unexpected error doing push layer request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	checkResponse(t, "putting monolithic chunk", resp, http.StatusCreated)
+
+	if err != nil {
+		t.Fatalf("error generating sha256 digest of body")
+	}
+
+	sha256Dgst := digester.Digest()
+
+	ref, _ := reference.WithDigest(name, sha256Dgst)
+	expectedLayerURL, err := ub.BuildBlobURL(ref)
+	if err != nil {
+		t.Fatalf("error building expected layer url: %v", err)
+	}
+
+	checkHeaders(t, resp, http.Header{
+		"Location":              []string{expectedLayerURL},
+		"Content-Length":        []string{"0"},
+		"Docker-Content-Digest": []string{sha256Dgst.String()},
+	})
+
+	return resp.Header.Get("Location")
+}
+
+func finishUpload(t *testing.T, ub *v2.URLBuilder, name reference.Named, uploadURLBase string, dgst digest.Digest) string {
+	resp, err := doPushLayer(t, ub, name, dgst, uploadURLBase, nil)
+	if err != nil {
+		t.Fatalf("unexpected error doing push layer request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	checkResponse(t, "putting monolithic chunk", resp, http.StatusCreated)
+
+	ref, _ := reference.WithDigest(name, dgst)
+	expectedLayerURL, err := ub.BuildBlobURL(ref)
+	if err != nil {
+		t.Fatalf("error building expected layer url: %v", err)
+	}
+
+	checkHeaders(t, resp, http.Header{
+		"Location":              []string{expectedLayerURL},
+		"Content-Length":        []string{"0"},
+		"Docker-Content-Digest": []string{dgst.String()},
+	})
+
+	return resp.Header.Get("Location")
+}
+
+type chunkOptions struct {
+	// Content-Range header to set when pushing chunks
+	contentRange string
+	// Digest header to set when pushing chunks
+	digest string
+}
+
+func doPushChunk(t *testing.T, uploadURLBase string, body io.Reader, options chunkOptions) (*http.Response, error) {
+	u, err := url.Parse(uploadURLBase)
+	if err != nil {
+		t.Fatalf("unexpected error parsing pushLayer url: %v", err)
+	}
+
+	u.RawQuery = url.Values{
+		"_state": u.Query()["_state"],
+	}.Encode()
+
+	uploadURL := u.String()
+
+	req, err := http.NewRequest("PATCH", uploadURL, body)
+	if err != nil {
+		t.Fatalf("unexpected error creating new request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if options.contentRange != "" {
+		req.Header.Set("Content-Range", options.contentRange)
+	}
+	if options.digest != "" {
+		req.Header.Set("Digest", options.digest)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+
+	return resp, err
+}
+
+func pushChunk(t *testing.T, ub *v2.URLBuilder, name reference.Named, uploadURLBase string, body io.Reader, length int64) (string, digest.Digest) {
+	digester := digest.Canonical.Digester()
+
+	resp, err := doPushChunk(t, uploadURLBase, io.TeeReader(body, digester.Hash()), chunkOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error doing push layer request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	checkResponse(t, "putting chunk", resp, http.StatusAccepted)
+
+	if err != nil {
+		t.Fatalf("error generating sha256 digest of body")
+	}
+
+	checkHeaders(t, resp, http.Header{
+		"Range":          []string{fmt.Sprintf("0-%d", length-1)},
+		"Content-Length": []string{"0"},
+	})
+
+	return resp.Header.Get("Location"), digester.Digest()
+}
+
+func checkResponse(t *testing.T, msg string, resp *http.Response, expectedStatus int) {
+	if resp.StatusCode != expectedStatus {
+		t.Logf("unexpected status %s: %v != %v", msg, resp.StatusCode, expectedStatus)
+		maybeDumpResponse(t, resp)
+
+		t.FailNow()
+	}
+
+	// We expect the headers included in the configuration, unless the
+	// status code is 405 (Method Not Allowed), which means the handler
+	// doesn't even get called.
+	if resp.StatusCode != 405 && !reflect.DeepEqual(resp.Header["X-Content-Type-Options"], []string{"nosniff"}) {
+		t.Logf("missing or incorrect header X-Content-Type-Options %s", msg)
+		maybeDumpResponse(t, resp)
+
+		t.FailNow()
+	}
+}
+
+// checkBodyHasErrorCodes ensures the body is an error body and has the
+// expected error codes, returning the error structure, the json slice and a
+// count of the errors by code.
+func checkBodyHasErrorCodes(t *testing.T, msg string, resp *http.Response, errorCodes ...errcode.ErrorCode) (errcode.Errors, []byte, map[errcode.ErrorCode]int) {
+	p, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unexpected error reading body %s: %v", msg, err)
+	}
+
+	var errs errcode.Errors
+	if err := json.Unmarshal(p, &errs); err != nil {
+		t.Fatalf("unexpected error decoding error response: %v", err)
+	}
+
+	if len(errs) == 0 {
+		t.Fatalf("expected errors in response")
+	}
+
+	// TODO(stevvooe): Shoot. The error setup is not working out. The content-
+	// type headers are being set after writing the status code.
+	// if resp.Header.Get("Content-Type") != "application/json" {
+	// 	t.Fatalf("unexpected content type: %v != 'application/json'",
+	// 		resp.Header.Get("Content-Type"))
+	// }
+
+	expected := map[errcode.ErrorCode]struct{}{}
+	counts := map[errcode.ErrorCode]int{}
+
+	// Initialize map with zeros for expected
+	for _, code := range errorCodes {
+		expected[code] = struct{}{}
+		counts[code] = 0
+	}
+
+	for _, e := range errs {
+		err, ok := e.(errcode.ErrorCoder)
+		if !ok {
+			t.Fatalf("not an ErrorCoder: %#v", e)
+		}
+		if _, ok := expected[err.ErrorCode()]; !ok {
+			t.Fatalf("unexpected error code %v encountered during %s: %s ", err.ErrorCode(), msg, string(p))
+		}
+		counts[err.ErrorCode()]++
+	}
+
+	// Ensure that counts of expected errors were all non-zero
+	for code := range expected {
+		if counts[code] == 0 {
+			t.Fatalf("expected error code %v not encountered during %s: %s", code, msg, string(p))
+		}
+	}
+
+	return errs, p, counts
+}
+
+func maybeDumpResponse(t *testing.T, resp *http.Response) {
+	if d, err := httputil.DumpResponse(resp, true); err != nil {
+		t.Logf("error dumping response: %v", err)
+	} else {
+		t.Logf("response:\n%s", string(d))
+	}
+}
+
+// matchHeaders checks that the response has at least the headers. If not, the
+// test will fail. If a passed in header value is "*", any non-zero value will
+// suffice as a match.
+func checkHeaders(t *testing.T, resp *http.Response, headers http.Header) {
+	for k, vs := range headers {
+		if resp.Header.Get(k) == "" {
+			t.Fatalf("response missing header %q", k)
+		}
+
+		for _, v := range vs {
+			if v == "*" {
+				// Just ensure there is some value.
+				if len(resp.Header[http.CanonicalHeaderKey(k)]) > 0 {
+					continue
+				}
+			}
+
+			for _, hv := range resp.Header[http.CanonicalHeaderKey(k)] {
+				if hv != v {
+					t.Fatalf("%+v %v header value not matched in response: %q != %q", resp.Header, k, hv, v)
+				}
+			}
+		}
+	}
+}
+
+func checkErr(t *testing.T, err error, msg string) {
+	if err != nil {
+		t.Fatalf("unexpected error %s: %v", msg, err)
+	}
+}
+
+func createRepository(env *testEnv, t *testing.T, imageName string, tag string) digest.Digest {
+	imageNameRef, err := reference.WithName(imageName)
+	if err != nil {
+		t.Fatalf("unable to parse reference: %v", err)
+	}
+
+	unsignedManifest := &schema1.Manifest{
+		Versioned: manifest.Versioned{
+			SchemaVersion: 1,
+		},
+		Name: imageName,
+		Tag:  tag,
+		FSLayers: []schema1.FSLayer{
+			{
+				BlobSum: "asdf",
+			},
+		},
+		History: []schema1.History{
+			{
+				V1Compatibility: "",
+			},
+		},
+	}
+
+	// Push 2 random layers
+	expectedLayers := make(map[digest.Digest]io.ReadSeeker)
+
+	for i := range unsignedManifest.FSLayers {
+		rs, dgst, err := testutil.CreateRandomTarFile()
+		if err != nil {
+			t.Fatalf("error creating random layer %d: %v", i, err)
+		}
+
+		expectedLayers[dgst] = rs
+		unsignedManifest.FSLayers[i].BlobSum = dgst
+		uploadURLBase, _ := startPushLayer(t, env, imageNameRef)
+		pushLayer(t, env.builder, imageNameRef, dgst, uploadURLBase, rs)
+	}
+
+	signedManifest, err := schema1.Sign(unsignedManifest, env.pk)
+	if err != nil {
+		t.Fatalf("unexpected error signing manifest: %v", err)
 	}
-	config.Compatibility.Schema1.Enabled = true
 
-	return newTestEnvWithConfig(t, &config)
+	dgst := digest.FromBytes(signedManifest.Canonical)
+
+	// Create this repository by tag to ensure the tag mapping is made in the registry
+	tagRef, _ := reference.WithTag(imageNameRef, tag)
+	manifestDigestURL, err := env.builder.BuildManifestURL(tagRef)
+	checkErr(t, err, "building manifest url")
+
+	digestRef, _ := reference.WithDigest(imageNameRef, dgst)
+	location, err := env.builder.BuildManifestURL(digestRef)
+	checkErr(t, err, "building location URL")
 
+	resp := putManifest(t, "putting signed manifest", manifestDigestURL, "", signedManifest)
+	checkResponse(t, "putting signed manifest", resp, http.StatusCreated)
+	checkHeaders(t, resp, http.Header{
+		"Location":              []string{location},
+		"Docker-Content-Digest": []string{dgst.String()},
+	})
+	return dgst
 }
 
-func newTestEnv(t *testing.T, deleteEnabled bool) *testEnv {
+// TestCompressedManifestETag checks that the weak etag of a compressed
+// manifest matches the manifest in If-None-Match.
+func TestCompressedManifestETag(t *testing.T) {
 	config := configuration.Configuration{
 		Storage: configuration.Storage{
 			"testdriver": configuration.Parameters{},
-			"delete":     configuration.Parameters{"enabled": deleteEnabled},
 			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
 				"enabled": false,
 			}},
 		},
 	}
-
 	config.Compatibility.Schema1.Enabled = true
 	config.HTTP.Headers = headerConfig
+	config.HTTP.Compression = configuration.HTTPCompression{Enabled: true, Encodings: []string{"gzip"}, MinSize: 1}
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
 
-	return newTestEnvWithConfig(t, &config)
-}
-
-func newTestEnvWithConfig(t *testing.T, config *configuration.Configuration) *testEnv {
-	ctx := context.Background()
-
-	app := NewApp(ctx, config)
-	server := httptest.NewServer(handlers.CombinedLoggingHandler(os.Stderr, app))
-	builder, err := v2.NewURLBuilderFromString(server.URL+config.HTTP.Prefix, false)
+	createRepository(env, t, "foo/compressed", "latest")
+	imageName, _ := reference.WithName("foo/compressed")
+	tagRef, _ := reference.WithTag(imageName, "latest")
+	manifestURL, err := env.builder.BuildManifestURL(tagRef)
+	checkErr(t, err, "building manifest url")
 
-	if err != nil {
-		t.Fatalf("error creating url builder: %v", err)
+	get := func(etag string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, manifestURL, nil)
+		checkErr(t, err, "building manifest request")
+		req.Header.Set("Accept-Encoding", "gzip")
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		checkErr(t, err, "fetching manifest")
+		return resp
 	}
 
-	pk, err := libtrust.GenerateECP256PrivateKey()
-	if err != nil {
-		t.Fatalf("unexpected error generating private key: %v", err)
+	resp := get("")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching compressed manifest", resp, http.StatusOK)
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "gzip" {
+		t.Fatalf("unexpected encoding of the manifest: %q", encoding)
 	}
-
-	return &testEnv{
-		pk:      pk,
-		ctx:     ctx,
-		config:  *config,
-		app:     app,
-		server:  server,
-		builder: builder,
+	etag := resp.Header.Get("Etag")
+	if !strings.HasPrefix(etag, "W/") {
+		t.Fatalf("expected a weak etag for a compressed manifest, got %q", etag)
 	}
-}
 
-func (t *testEnv) Shutdown() {
-	t.server.CloseClientConnections()
-	t.server.Close()
+	resp = get(etag)
+	defer resp.Body.Close()
+	checkResponse(t, "fetching compressed manifest with etag", resp, http.StatusNotModified)
 }
 
-func putManifest(t *testing.T, msg, url, contentType string, v interface{}) *http.Response {
-	var body []byte
+// TestReferrersAPI pushes an image manifest and a manifest referring to it
+// through its subject, and checks the referrers endpoint lists it.
+func TestReferrersAPI(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
 
-	switch m := v.(type) {
-	case *schema1.SignedManifest:
-		_, pl, err := m.Payload()
-		if err != nil {
-			t.Fatalf("error getting payload: %v", err)
-		}
-		body = pl
-	case *manifestlist.DeserializedManifestList:
-		_, pl, err := m.Payload()
-		if err != nil {
-			t.Fatalf("error getting payload: %v", err)
-		}
-		body = pl
-	default:
-		var err error
-		body, err = json.MarshalIndent(v, "", "   ")
-		if err != nil {
-			t.Fatalf("unexpected error marshaling %v: %v", v, err)
-		}
-	}
+	imageName, err := reference.WithName("foo/referrers")
+	checkErr(t, err, "building image name")
 
-	req, err := http.NewRequest("PUT", url, bytes.NewReader(body))
-	if err != nil {
-		t.Fatalf("error creating request for %s: %v", msg, err)
-	}
+	configBlob := []byte("{}")
+	configDigest := digest.FromBytes(configBlob)
+	uploadURLBase, _ := startPushLayer(t, env, imageName)
+	pushLayer(t, env.builder, imageName, configDigest, uploadURLBase, bytes.NewReader(configBlob))
 
-	if contentType != "" {
-		req.Header.Set("Content-Type", contentType)
+	config := distribution.Descriptor{
+		MediaType: v1.MediaTypeImageConfig,
+		Digest:    configDigest,
+		Size:      int64(len(configBlob)),
 	}
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		t.Fatalf("error doing put request while %s: %v", msg, err)
-	}
+	subject, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned: ocischema.SchemaVersion,
+		Config:    config,
+		Layers:    []distribution.Descriptor{},
+	})
+	checkErr(t, err, "building subject manifest")
+	_, subjectPayload, err := subject.Payload()
+	checkErr(t, err, "getting subject payload")
+	subjectDigest := digest.FromBytes(subjectPayload)
 
-	return resp
-}
+	subjectRef, err := reference.WithDigest(imageName, subjectDigest)
+	checkErr(t, err, "building subject reference")
+	subjectURL, err := env.builder.BuildManifestURL(subjectRef)
+	checkErr(t, err, "building subject url")
 
-func startPushLayer(t *testing.T, env *testEnv, name reference.Named) (location string, uuid string) {
-	layerUploadURL, err := env.builder.BuildBlobUploadURL(name)
-	if err != nil {
-		t.Fatalf("unexpected error building layer upload url: %v", err)
+	resp := putManifest(t, "putting subject manifest", subjectURL, v1.MediaTypeImageManifest, subject)
+	checkResponse(t, "putting subject manifest", resp, http.StatusCreated)
+	if resp.Header.Get("OCI-Subject") != "" {
+		t.Fatalf("unexpected OCI-Subject header on manifest without subject")
 	}
 
-	u, err := url.Parse(layerUploadURL)
-	if err != nil {
-		t.Fatalf("error parsing layer upload URL: %v", err)
-	}
+	referrersURL, err := env.builder.BuildReferrersURL(subjectRef)
+	checkErr(t, err, "building referrers url")
 
-	base, err := url.Parse(env.server.URL)
-	if err != nil {
-		t.Fatalf("error parsing server URL: %v", err)
-	}
+	getReferrers := func(msg, u string, expected int) *http.Response {
+		resp, err := http.Get(u)
+		checkErr(t, err, msg)
+		defer resp.Body.Close()
 
-	layerUploadURL = base.ResolveReference(u).String()
-	resp, err := http.Post(layerUploadURL, "", nil)
-	if err != nil {
-		t.Fatalf("unexpected error starting layer push: %v", err)
+		checkResponse(t, msg, resp, http.StatusOK)
+		checkHeaders(t, resp, http.Header{
+			"Content-Type": []string{v1.MediaTypeImageIndex},
+		})
+
+		var index manifestlist.ManifestList
+		if err := json.NewDecoder(resp.Body).Decode(&index); err != nil {
+			t.Fatalf("error decoding referrers response: %v", err)
+		}
+		if index.MediaType != v1.MediaTypeImageIndex || index.SchemaVersion != 2 {
+			t.Fatalf("unexpected referrers index %+v", index)
+		}
+		if index.Manifests == nil || len(index.Manifests) != expected {
+			t.Fatalf("expected %d referrers, got %+v", expected, index.Manifests)
+		}
+		return resp
 	}
 
-	defer resp.Body.Close()
+	getReferrers("fetching empty referrers", referrersURL, 0)
 
-	checkResponse(t, fmt.Sprintf("pushing starting layer push %v", name.String()), resp, http.StatusAccepted)
+	artifactType := "application/vnd.example.sbom"
+	referrer, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned:    ocischema.SchemaVersion,
+		ArtifactType: artifactType,
+		Config:       config,
+		Layers:       []distribution.Descriptor{},
+		Subject: &distribution.Descriptor{
+			MediaType: v1.MediaTypeImageManifest,
+			Digest:    subjectDigest,
+			Size:      int64(len(subjectPayload)),
+		},
+	})
+	checkErr(t, err, "building referrer manifest")
+	_, referrerPayload, err := referrer.Payload()
+	checkErr(t, err, "getting referrer payload")
 
-	u, err = url.Parse(resp.Header.Get("Location"))
-	if err != nil {
-		t.Fatalf("error parsing location header: %v", err)
-	}
+	referrerRef, err := reference.WithDigest(imageName, digest.FromBytes(referrerPayload))
+	checkErr(t, err, "building referrer reference")
+	referrerURL, err := env.builder.BuildManifestURL(referrerRef)
+	checkErr(t, err, "building referrer url")
 
-	uuid = path.Base(u.Path)
+	resp = putManifest(t, "putting referrer manifest", referrerURL, v1.MediaTypeImageManifest, referrer)
+	checkResponse(t, "putting referrer manifest", resp, http.StatusCreated)
 	checkHeaders(t, resp, http.Header{
-		"Location":           []string{"*"},
-		"Content-Length":     []string{"0"},
-		"Docker-Upload-UUID": []string{uuid},
+		"OCI-Subject": []string{subjectDigest.String()},
 	})
 
-	return resp.Header.Get("Location"), uuid
-}
+	getReferrers("fetching referrers", referrersURL, 1)
 
-// doPushLayer pushes the layer content returning the url on success returning
-// the response. If you're only expecting a successful response, use pushLayer.
-func doPushLayer(t *testing.T, ub *v2.URLBuilder, name reference.Named, dgst digest.Digest, uploadURLBase string, body io.Reader) (*http.Response, error) {
-	u, err := url.Parse(uploadURLBase)
-	if err != nil {
-		t.Fatalf("unexpected error parsing pushLayer url: %v", err)
-	}
+	filteredURL, err := env.builder.BuildReferrersURL(subjectRef, url.Values{
+		"artifactType": []string{artifactType},
+	})
+	checkErr(t, err, "building filtered referrers url")
+	resp = getReferrers("fetching filtered referrers", filteredURL, 1)
+	checkHeaders(t, resp, http.Header{
+		"OCI-Filters-Applied": []string{"artifactType"},
+	})
 
-	u.RawQuery = url.Values{
-		"_state": u.Query()["_state"],
-		"digest": []string{dgst.String()},
-	}.Encode()
+	filteredURL, err = env.builder.BuildReferrersURL(subjectRef, url.Values{
+		"artifactType": []string{"application/vnd.example.unknown"},
+	})
+	checkErr(t, err, "building filtered referrers url")
+	getReferrers("fetching unmatched referrers", filteredURL, 0)
+
+	// the referrers of an unknown repository are not an empty list
+	unknownName, err := reference.WithName("foo/unknown")
+	checkErr(t, err, "building unknown name")
+	unknownRef, err := reference.WithDigest(unknownName, subjectDigest)
+	checkErr(t, err, "building unknown reference")
+	unknownURL, err := env.builder.BuildReferrersURL(unknownRef)
+	checkErr(t, err, "building unknown referrers url")
+	resp, err = http.Get(unknownURL)
+	checkErr(t, err, "fetching referrers of an unknown repository")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching referrers of an unknown repository", resp, http.StatusNotFound)
+	checkBodyHasErrorCodes(t, "fetching referrers of an unknown repository", resp, v2.ErrorCodeNameUnknown)
+}
 
-	uploadURL := u.String()
+func TestTagHistoryAPI(t *testing.T) {
+	env := newTestEnv(t, true)
+	defer env.Shutdown()
 
-	// Just do a monolithic upload
-	req, err := http.NewRequest("PUT", uploadURL, body)
-	if err != nil {
-		t.Fatalf("unexpected error creating new request: %v", err)
-	}
+	imageName, err := reference.WithName("foo/taghistory")
+	checkErr(t, err, "building image name")
 
-	return http.DefaultClient.Do(req)
-}
+	prodRef, err := reference.WithTag(imageName, "prod")
+	checkErr(t, err, "building tag reference")
+	prodURL, err := env.builder.BuildManifestURL(prodRef)
+	checkErr(t, err, "building manifest url")
 
-// pushLayer pushes the layer content returning the url on success.
-func pushLayer(t *testing.T, ub *v2.URLBuilder, name reference.Named, dgst digest.Digest, uploadURLBase string, body io.Reader) string {
-	digester := digest.Canonical.Digester()
+	var digests []digest.Digest
+	for _, configBlob := range [][]byte{[]byte(`{"v":1}`), []byte(`{"v":2}`)} {
+		configDigest := digest.FromBytes(configBlob)
+		uploadURLBase, _ := startPushLayer(t, env, imageName)
+		pushLayer(t, env.builder, imageName, configDigest, uploadURLBase, bytes.NewReader(configBlob))
+
+		m, err := ocischema.FromStruct(ocischema.Manifest{
+			Versioned: ocischema.SchemaVersion,
+			Config: distribution.Descriptor{
+				MediaType: v1.MediaTypeImageConfig,
+				Digest:    configDigest,
+				Size:      int64(len(configBlob)),
+			},
+			Layers: []distribution.Descriptor{},
+		})
+		checkErr(t, err, "building manifest")
+		_, payload, err := m.Payload()
+		checkErr(t, err, "getting manifest payload")
+		digests = append(digests, digest.FromBytes(payload))
 
-	resp, err := doPushLayer(t, ub, name, dgst, uploadURLBase, io.TeeReader(body, digester.Hash()))
-	if err != nil {
-		t.Fatalf("unexpected error doing push layer request: %v", err)
+		resp := putManifest(t, "putting manifest", prodURL, v1.MediaTypeImageManifest, m)
+		checkResponse(t, "putting manifest", resp, http.StatusCreated)
 	}
-	defer resp.Body.Close()
 
-	checkResponse(t, "putting monolithic chunk", resp, http.StatusCreated)
+	historyURL, err := env.builder.BuildTagHistoryURL(imageName)
+	checkErr(t, err, "building tag history url")
 
-	if err != nil {
-		t.Fatalf("error generating sha256 digest of body")
-	}
+	getHistory := func(msg, u string) tagHistory {
+		resp, err := http.Get(u)
+		checkErr(t, err, msg)
+		defer resp.Body.Close()
 
-	sha256Dgst := digester.Digest()
+		checkResponse(t, msg, resp, http.StatusOK)
 
-	ref, _ := reference.WithDigest(name, sha256Dgst)
-	expectedLayerURL, err := ub.BuildBlobURL(ref)
-	if err != nil {
-		t.Fatalf("error building expected layer url: %v", err)
+		var body tagHistoryAPIResponse
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("error decoding tag history response: %v", err)
+		}
+		if body.Name != imageName.Name() || len(body.Tags) != 1 || body.Tags[0].Tag != "prod" {
+			t.Fatalf("unexpected tag history %+v", body)
+		}
+		return body.Tags[0]
 	}
 
-	checkHeaders(t, resp, http.Header{
-		"Location":              []string{expectedLayerURL},
-		"Content-Length":        []string{"0"},
-		"Docker-Content-Digest": []string{sha256Dgst.String()},
-	})
-
-	return resp.Header.Get("Location")
-}
-
-func finishUpload(t *testing.T, ub *v2.URLBuilder, name reference.Named, uploadURLBase string, dgst digest.Digest) string {
-	resp, err := doPushLayer(t, ub, name, dgst, uploadURLBase, nil)
-	if err != nil {
-		t.Fatalf("unexpected error doing push layer request: %v", err)
+	history := getHistory("fetching tag history", historyURL)
+	if history.Digest != digests[1] {
+		t.Fatalf("unexpected current digest %s, expected %s", history.Digest, digests[1])
+	}
+	if len(history.Previous) != 1 || history.Previous[0] != digests[0] {
+		t.Fatalf("unexpected previous digests %v", history.Previous)
+	}
+	if len(history.Events) != 2 || history.Events[1].Previous != digests[0] || history.LastModified == nil || !history.LastModified.Equal(history.Events[1].Timestamp) {
+		t.Fatalf("unexpected events %+v", history.Events)
 	}
-	defer resp.Body.Close()
 
-	checkResponse(t, "putting monolithic chunk", resp, http.StatusCreated)
+	// the history of a deleted tag is still served
+	resp, err := httpDelete(prodURL)
+	checkErr(t, err, "deleting tag")
+	checkResponse(t, "deleting tag", resp, http.StatusAccepted)
 
-	ref, _ := reference.WithDigest(name, dgst)
-	expectedLayerURL, err := ub.BuildBlobURL(ref)
-	if err != nil {
-		t.Fatalf("error building expected layer url: %v", err)
+	prodHistoryURL, err := env.builder.BuildTagHistoryURL(imageName, url.Values{
+		"tag": []string{"prod"},
+	})
+	checkErr(t, err, "building tag history url")
+	history = getHistory("fetching deleted tag history", prodHistoryURL)
+	if history.Digest != "" || len(history.Previous) != 2 || history.Previous[0] != digests[1] {
+		t.Fatalf("unexpected history of deleted tag %+v", history)
+	}
+	if len(history.Events) != 3 || history.Events[2].Action != distribution.TagEventActionUntag {
+		t.Fatalf("unexpected events %+v", history.Events)
 	}
 
-	checkHeaders(t, resp, http.Header{
-		"Location":              []string{expectedLayerURL},
-		"Content-Length":        []string{"0"},
-		"Docker-Content-Digest": []string{dgst.String()},
+	unknownURL, err := env.builder.BuildTagHistoryURL(imageName, url.Values{
+		"tag": []string{"unknown"},
 	})
-
-	return resp.Header.Get("Location")
-}
-
-type chunkOptions struct {
-	// Content-Range header to set when pushing chunks
-	contentRange string
+	checkErr(t, err, "building tag history url")
+	resp, err = http.Get(unknownURL)
+	checkErr(t, err, "fetching unknown tag history")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching unknown tag history", resp, http.StatusNotFound)
+	checkBodyHasErrorCodes(t, "fetching unknown tag history", resp, v2.ErrorCodeManifestUnknown)
 }
 
-func doPushChunk(t *testing.T, uploadURLBase string, body io.Reader, options chunkOptions) (*http.Response, error) {
-	u, err := url.Parse(uploadURLBase)
-	if err != nil {
-		t.Fatalf("unexpected error parsing pushLayer url: %v", err)
-	}
-
-	u.RawQuery = url.Values{
-		"_state": u.Query()["_state"],
-	}.Encode()
+func TestBlobsExistAPI(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
 
-	uploadURL := u.String()
+	imageName, err := reference.WithName("foo/blobsexist")
+	checkErr(t, err, "building image name")
 
-	req, err := http.NewRequest("PATCH", uploadURL, body)
-	if err != nil {
-		t.Fatalf("unexpected error creating new request: %v", err)
+	content := []byte("existing layer")
+	existing := digest.FromBytes(content)
+	uploadURLBase, _ := startPushLayer(t, env, imageName)
+	pushLayer(t, env.builder, imageName, existing, uploadURLBase, bytes.NewReader(content))
+	missing := digest.FromString("missing layer")
+
+	blobsExistURL, err := env.builder.BuildBlobsExistURL(imageName)
+	checkErr(t, err, "building blobs exist url")
+
+	checkBlobs := func(msg string, body string, status int) blobsExistAPIResponse {
+		resp, err := http.Post(blobsExistURL, "application/json", strings.NewReader(body))
+		checkErr(t, err, msg)
+		defer resp.Body.Close()
+		checkResponse(t, msg, resp, status)
+
+		var response blobsExistAPIResponse
+		if status == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+				t.Fatalf("error decoding blobs exist response: %v", err)
+			}
+		}
+		return response
 	}
-	req.Header.Set("Content-Type", "application/octet-stream")
-	if options.contentRange != "" {
-		req.Header.Set("Content-Range", options.contentRange)
+
+	response := checkBlobs("checking blobs", fmt.Sprintf(`{"digests": [%q, %q]}`, missing, existing), http.StatusOK)
+	expected := []existingBlob{{Digest: existing, Size: int64(len(content))}}
+	if !reflect.DeepEqual(response.Blobs, expected) {
+		t.Fatalf("unexpected existing blobs: %v != %v", response.Blobs, expected)
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	response = checkBlobs("checking missing blobs", fmt.Sprintf(`{"digests": [%q]}`, missing), http.StatusOK)
+	if len(response.Blobs) != 0 {
+		t.Fatalf("unexpected existing blobs: %v", response.Blobs)
+	}
 
-	return resp, err
+	checkBlobs("checking invalid digests", `{"digests": ["sha256:invalid"]}`, http.StatusBadRequest)
+	checkBlobs("checking invalid body", `digests`, http.StatusBadRequest)
+
+	digests := make([]string, maxBlobsExistDigests+1)
+	for i := range digests {
+		digests[i] = fmt.Sprintf("%q", missing)
+	}
+	checkBlobs("checking too many digests", `{"digests": [`+strings.Join(digests, ",")+`]}`, http.StatusBadRequest)
+	checkBlobs("checking too large body", `{"digests": [`+strings.Repeat(" ", maxBlobsExistBodySize)+`]}`, http.StatusBadRequest)
 }
 
-func pushChunk(t *testing.T, ub *v2.URLBuilder, name reference.Named, uploadURLBase string, body io.Reader, length int64) (string, digest.Digest) {
-	digester := digest.Canonical.Digester()
+func TestUntaggedAPI(t *testing.T) {
+	env := newTestEnv(t, true)
+	defer env.Shutdown()
 
-	resp, err := doPushChunk(t, uploadURLBase, io.TeeReader(body, digester.Hash()), chunkOptions{})
-	if err != nil {
-		t.Fatalf("unexpected error doing push layer request: %v", err)
-	}
-	defer resp.Body.Close()
+	imageName, err := reference.WithName("foo/untagged")
+	checkErr(t, err, "building image name")
 
-	checkResponse(t, "putting chunk", resp, http.StatusAccepted)
+	prodRef, err := reference.WithTag(imageName, "prod")
+	checkErr(t, err, "building tag reference")
+	prodURL, err := env.builder.BuildManifestURL(prodRef)
+	checkErr(t, err, "building manifest url")
 
-	if err != nil {
-		t.Fatalf("error generating sha256 digest of body")
-	}
+	// the previous manifests of the moved tag are left untagged
+	var digests []digest.Digest
+	for _, configBlob := range [][]byte{[]byte(`{"v":1}`), []byte(`{"v":2}`), []byte(`{"v":3}`)} {
+		configDigest := digest.FromBytes(configBlob)
+		uploadURLBase, _ := startPushLayer(t, env, imageName)
+		pushLayer(t, env.builder, imageName, configDigest, uploadURLBase, bytes.NewReader(configBlob))
+
+		m, err := ocischema.FromStruct(ocischema.Manifest{
+			Versioned: ocischema.SchemaVersion,
+			Config: distribution.Descriptor{
+				MediaType: v1.MediaTypeImageConfig,
+				Digest:    configDigest,
+				Size:      int64(len(configBlob)),
+			},
+			Layers: []distribution.Descriptor{},
+		})
+		checkErr(t, err, "building manifest")
+		_, payload, err := m.Payload()
+		checkErr(t, err, "getting manifest payload")
+		digests = append(digests, digest.FromBytes(payload))
 
-	checkHeaders(t, resp, http.Header{
-		"Range":          []string{fmt.Sprintf("0-%d", length-1)},
-		"Content-Length": []string{"0"},
+		resp := putManifest(t, "putting manifest", prodURL, v1.MediaTypeImageManifest, m)
+		checkResponse(t, "putting manifest", resp, http.StatusCreated)
+	}
+	expected := digests[:2]
+	sort.Slice(expected, func(i, j int) bool {
+		return expected[i] < expected[j]
 	})
 
-	return resp.Header.Get("Location"), digester.Digest()
-}
+	getUntagged := func(msg, u string) (*http.Response, untaggedAPIResponse) {
+		resp, err := http.Get(u)
+		checkErr(t, err, msg)
+		defer resp.Body.Close()
 
-func checkResponse(t *testing.T, msg string, resp *http.Response, expectedStatus int) {
-	if resp.StatusCode != expectedStatus {
-		t.Logf("unexpected status %s: %v != %v", msg, resp.StatusCode, expectedStatus)
-		maybeDumpResponse(t, resp)
+		checkResponse(t, msg, resp, http.StatusOK)
 
-		t.FailNow()
+		var body untaggedAPIResponse
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("error decoding untagged manifests response: %v", err)
+		}
+		if body.Name != imageName.Name() {
+			t.Fatalf("unexpected repository name %q", body.Name)
+		}
+		return resp, body
 	}
 
-	// We expect the headers included in the configuration, unless the
-	// status code is 405 (Method Not Allowed), which means the handler
-	// doesn't even get called.
-	if resp.StatusCode != 405 && !reflect.DeepEqual(resp.Header["X-Content-Type-Options"], []string{"nosniff"}) {
-		t.Logf("missing or incorrect header X-Content-Type-Options %s", msg)
-		maybeDumpResponse(t, resp)
+	untaggedURL, err := env.builder.BuildUntaggedURL(imageName)
+	checkErr(t, err, "building untagged url")
+	_, body := getUntagged("fetching untagged manifests", untaggedURL)
+	if len(body.Manifests) != len(expected) {
+		t.Fatalf("unexpected untagged manifests %+v", body.Manifests)
+	}
+	for i, m := range body.Manifests {
+		if m.Digest != expected[i] || m.MediaType != v1.MediaTypeImageManifest || m.Created.IsZero() {
+			t.Errorf("unexpected untagged manifest %+v, expected %s", m, expected[i])
+		}
+	}
 
-		t.FailNow()
+	pageURL, err := env.builder.BuildUntaggedURL(imageName, url.Values{"n": []string{"1"}})
+	checkErr(t, err, "building untagged url")
+	resp, body := getUntagged("fetching untagged manifests page", pageURL)
+	if len(body.Manifests) != 1 || body.Manifests[0].Digest != expected[0] {
+		t.Fatalf("unexpected untagged manifests page %+v", body.Manifests)
+	}
+	if resp.Header.Get("Link") == "" {
+		t.Fatal("expected a Link header to the next page")
 	}
-}
 
-// checkBodyHasErrorCodes ensures the body is an error body and has the
-// expected error codes, returning the error structure, the json slice and a
-// count of the errors by code.
-func checkBodyHasErrorCodes(t *testing.T, msg string, resp *http.Response, errorCodes ...errcode.ErrorCode) (errcode.Errors, []byte, map[errcode.ErrorCode]int) {
-	p, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		t.Fatalf("unexpected error reading body %s: %v", msg, err)
+	nextURL, err := env.builder.BuildUntaggedURL(imageName, url.Values{"last": []string{expected[0].String()}})
+	checkErr(t, err, "building untagged url")
+	_, body = getUntagged("fetching untagged manifests next page", nextURL)
+	if len(body.Manifests) != 1 || body.Manifests[0].Digest != expected[1] {
+		t.Fatalf("unexpected untagged manifests next page %+v", body.Manifests)
 	}
+}
 
-	var errs errcode.Errors
-	if err := json.Unmarshal(p, &errs); err != nil {
-		t.Fatalf("unexpected error decoding error response: %v", err)
+// TestManifestConditionalAPI moves a tag with If-Match and If-None-Match
+// headers, and fetches it with an If-None-Match header.
+func TestManifestConditionalAPI(t *testing.T) {
+	env := newTestEnv(t, true)
+	defer env.Shutdown()
+
+	imageName, err := reference.WithName("foo/conditional")
+	checkErr(t, err, "building image name")
+
+	prodRef, err := reference.WithTag(imageName, "prod")
+	checkErr(t, err, "building tag reference")
+	prodURL, err := env.builder.BuildManifestURL(prodRef)
+	checkErr(t, err, "building manifest url")
+
+	var payloads [][]byte
+	var etags []string
+	for _, configBlob := range [][]byte{[]byte(`{"v":1}`), []byte(`{"v":2}`)} {
+		configDigest := digest.FromBytes(configBlob)
+		uploadURLBase, _ := startPushLayer(t, env, imageName)
+		pushLayer(t, env.builder, imageName, configDigest, uploadURLBase, bytes.NewReader(configBlob))
+
+		m, err := ocischema.FromStruct(ocischema.Manifest{
+			Versioned: ocischema.SchemaVersion,
+			Config: distribution.Descriptor{
+				MediaType: v1.MediaTypeImageConfig,
+				Digest:    configDigest,
+				Size:      int64(len(configBlob)),
+			},
+			Layers: []distribution.Descriptor{},
+		})
+		checkErr(t, err, "building manifest")
+		_, payload, err := m.Payload()
+		checkErr(t, err, "getting manifest payload")
+		payloads = append(payloads, payload)
+		etags = append(etags, fmt.Sprintf(`"%s"`, digest.FromBytes(payload)))
+	}
+
+	putConditional := func(msg string, payload []byte, header, value string, expected int) {
+		req, err := http.NewRequest("PUT", prodURL, bytes.NewReader(payload))
+		checkErr(t, err, msg)
+		req.Header.Set("Content-Type", v1.MediaTypeImageManifest)
+		req.Header.Set(header, value)
+		resp, err := http.DefaultClient.Do(req)
+		checkErr(t, err, msg)
+		defer resp.Body.Close()
+
+		checkResponse(t, msg, resp, expected)
+		if expected == http.StatusPreconditionFailed {
+			checkBodyHasErrorCodes(t, msg, resp, v2.ErrorCodePreconditionFailed)
+		}
 	}
 
-	if len(errs) == 0 {
-		t.Fatalf("expected errors in response")
+	putConditional("creating tag", payloads[0], "If-None-Match", "*", http.StatusCreated)
+	putConditional("creating existing tag", payloads[1], "If-None-Match", "*", http.StatusPreconditionFailed)
+	putConditional("moving tag from another manifest", payloads[1], "If-Match", etags[1], http.StatusPreconditionFailed)
+	putConditional("moving tag", payloads[1], "If-Match", etags[1]+", "+etags[0], http.StatusCreated)
+	putConditional("moving tag away from its manifest", payloads[0], "If-None-Match", etags[1], http.StatusPreconditionFailed)
+
+	req, err := http.NewRequest("GET", prodURL, nil)
+	checkErr(t, err, "building manifest request")
+	req.Header.Set("Accept", v1.MediaTypeImageManifest)
+	req.Header.Set("If-None-Match", etags[0]+", W/"+etags[1])
+	resp, err := http.DefaultClient.Do(req)
+	checkErr(t, err, "fetching manifest with etag")
+	defer resp.Body.Close()
+
+	checkResponse(t, "fetching manifest with etag", resp, http.StatusNotModified)
+	if resp.Header.Get("Etag") != etags[1] {
+		t.Fatalf("unexpected etag %q, expected %q", resp.Header.Get("Etag"), etags[1])
 	}
+}
 
-	// TODO(stevvooe): Shoot. The error setup is not working out. The content-
-	// type headers are being set after writing the status code.
-	// if resp.Header.Get("Content-Type") != "application/json" {
-	// 	t.Fatalf("unexpected content type: %v != 'application/json'",
-	// 		resp.Header.Get("Content-Type"))
-	// }
+// TestManifestArtifactsAPI pushes an index listing an image and its SBOM, and
+// an attestation referring to the index, and checks that both artifacts are
+// served in place of the index when requested by artifact type.
+func TestManifestArtifactsAPI(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
 
-	expected := map[errcode.ErrorCode]struct{}{}
-	counts := map[errcode.ErrorCode]int{}
+	imageName, err := reference.WithName("foo/artifacts")
+	checkErr(t, err, "building image name")
 
-	// Initialize map with zeros for expected
-	for _, code := range errorCodes {
-		expected[code] = struct{}{}
-		counts[code] = 0
+	configBlob := []byte("{}")
+	configDigest := digest.FromBytes(configBlob)
+	uploadURLBase, _ := startPushLayer(t, env, imageName)
+	pushLayer(t, env.builder, imageName, configDigest, uploadURLBase, bytes.NewReader(configBlob))
+
+	config := distribution.Descriptor{
+		MediaType: v1.MediaTypeImageConfig,
+		Digest:    configDigest,
+		Size:      int64(len(configBlob)),
 	}
 
-	for _, e := range errs {
-		err, ok := e.(errcode.ErrorCoder)
-		if !ok {
-			t.Fatalf("not an ErrorCoder: %#v", e)
+	push := func(msg string, m distribution.Manifest, ref reference.Named) distribution.Descriptor {
+		mediaType, payload, err := m.Payload()
+		checkErr(t, err, msg)
+		dgst := digest.FromBytes(payload)
+		if ref == nil {
+			ref, err = reference.WithDigest(imageName, dgst)
+			checkErr(t, err, msg)
 		}
-		if _, ok := expected[err.ErrorCode()]; !ok {
-			t.Fatalf("unexpected error code %v encountered during %s: %s ", err.ErrorCode(), msg, string(p))
+		u, err := env.builder.BuildManifestURL(ref)
+		checkErr(t, err, msg)
+		resp := putManifest(t, msg, u, mediaType, m)
+		checkResponse(t, msg, resp, http.StatusCreated)
+		return distribution.Descriptor{MediaType: mediaType, Digest: dgst, Size: int64(len(payload))}
+	}
+
+	sbomType := "application/vnd.example.sbom"
+	image, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned: ocischema.SchemaVersion,
+		Config:    config,
+		Layers:    []distribution.Descriptor{},
+	})
+	checkErr(t, err, "building image manifest")
+	sbom, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned:    ocischema.SchemaVersion,
+		ArtifactType: sbomType,
+		Config:       config,
+		Layers:       []distribution.Descriptor{},
+	})
+	checkErr(t, err, "building sbom manifest")
+	imageDesc := push("putting image manifest", image, nil)
+	sbomDesc := push("putting sbom manifest", sbom, nil)
+
+	index, err := manifestlist.FromDescriptorsWithMediaType([]manifestlist.ManifestDescriptor{
+		{Descriptor: imageDesc},
+		{Descriptor: sbomDesc},
+	}, v1.MediaTypeImageIndex)
+	checkErr(t, err, "building index")
+	tagRef, err := reference.WithTag(imageName, "latest")
+	checkErr(t, err, "building tag reference")
+	indexDesc := push("putting index", index, tagRef)
+
+	attestation, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned:    ocischema.SchemaVersion,
+		ArtifactType: sbomType,
+		Config:       config,
+		Layers: []distribution.Descriptor{{
+			MediaType: v1.MediaTypeImageLayer,
+			Digest:    configDigest,
+			Size:      int64(len(configBlob)),
+		}},
+		Subject: &indexDesc,
+	})
+	checkErr(t, err, "building attestation manifest")
+	attestationDesc := push("putting attestation manifest", attestation, nil)
+
+	tagURL, err := env.builder.BuildManifestURL(tagRef)
+	checkErr(t, err, "building tag url")
+
+	getArtifacts := func(msg, accept string) (*http.Response, manifestlist.ManifestList) {
+		req, err := http.NewRequest(http.MethodGet, tagURL, nil)
+		checkErr(t, err, msg)
+		req.Header.Set("Accept", accept)
+		resp, err := http.DefaultClient.Do(req)
+		checkErr(t, err, msg)
+		defer resp.Body.Close()
+
+		checkResponse(t, msg, resp, http.StatusOK)
+		checkHeaders(t, resp, http.Header{
+			"Content-Type": []string{v1.MediaTypeImageIndex},
+		})
+		var index manifestlist.ManifestList
+		if err := json.NewDecoder(resp.Body).Decode(&index); err != nil {
+			t.Fatalf("%s: error decoding index: %v", msg, err)
 		}
-		counts[err.ErrorCode()]++
+		return resp, index
 	}
 
-	// Ensure that counts of expected errors were all non-zero
-	for code := range expected {
-		if counts[code] == 0 {
-			t.Fatalf("expected error code %v not encountered during %s: %s", code, msg, string(p))
+	resp, fetched := getArtifacts("fetching index", v1.MediaTypeImageIndex)
+	checkHeaders(t, resp, http.Header{
+		"Docker-Content-Digest": []string{indexDesc.Digest.String()},
+	})
+	if len(fetched.Manifests) != 2 {
+		t.Fatalf("expected the stored index, got %+v", fetched.Manifests)
+	}
+
+	resp, fetched = getArtifacts("fetching artifacts", v1.MediaTypeImageIndex+`; artifactType="`+sbomType+`"`)
+	checkHeaders(t, resp, http.Header{
+		"OCI-Filters-Applied": []string{"artifactType"},
+	})
+	if resp.Header.Get("Docker-Content-Digest") == indexDesc.Digest.String() {
+		t.Fatalf("expected the digest of the filtered index, got the stored one")
+	}
+	if len(fetched.Manifests) != 2 ||
+		fetched.Manifests[0].Digest != sbomDesc.Digest ||
+		fetched.Manifests[1].Digest != attestationDesc.Digest {
+		t.Fatalf("expected the sbom and the attestation, got %+v", fetched.Manifests)
+	}
+	for _, m := range fetched.Manifests {
+		if m.ArtifactType != sbomType {
+			t.Fatalf("unexpected artifact type %q", m.ArtifactType)
 		}
 	}
 
-	return errs, p, counts
-}
+	_, fetched = getArtifacts("fetching unmatched artifacts", v1.MediaTypeImageIndex+`; artifactType="application/vnd.example.unknown"`)
+	if fetched.Manifests == nil || len(fetched.Manifests) != 0 {
+		t.Fatalf("expected no artifacts, got %+v", fetched.Manifests)
+	}
 
-func maybeDumpResponse(t *testing.T, resp *http.Response) {
-	if d, err := httputil.DumpResponse(resp, true); err != nil {
-		t.Logf("error dumping response: %v", err)
-	} else {
-		t.Logf("response:\n%s", string(d))
+	// a manifest fetched by digest is never filtered
+	digestRef, err := reference.WithDigest(imageName, indexDesc.Digest)
+	checkErr(t, err, "building digest reference")
+	digestURL, err := env.builder.BuildManifestURL(digestRef)
+	checkErr(t, err, "building digest url")
+	req, err := http.NewRequest(http.MethodGet, digestURL, nil)
+	checkErr(t, err, "fetching artifacts by digest")
+	req.Header.Set("Accept", v1.MediaTypeImageIndex+`; artifactType="`+sbomType+`"`)
+	resp, err = http.DefaultClient.Do(req)
+	checkErr(t, err, "fetching artifacts by digest")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching artifacts by digest", resp, http.StatusOK)
+	checkHeaders(t, resp, http.Header{
+		"Docker-Content-Digest": []string{indexDesc.Digest.String()},
+	})
+	if body, err := io.ReadAll(resp.Body); err != nil || digest.FromBytes(body) != indexDesc.Digest {
+		t.Fatalf("expected the stored index: %v", err)
+	}
+	if resp.Header.Get("OCI-Filters-Applied") != "" {
+		t.Fatalf("unexpected filter header on the stored index")
 	}
 }
 
-// matchHeaders checks that the response has at least the headers. If not, the
-// test will fail. If a passed in header value is "*", any non-zero value will
-// suffice as a match.
-func checkHeaders(t *testing.T, resp *http.Response, headers http.Header) {
-	for k, vs := range headers {
-		if resp.Header.Get(k) == "" {
-			t.Fatalf("response missing header %q", k)
-		}
+func TestManifestPlatformsAPI(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
 
-		for _, v := range vs {
-			if v == "*" {
-				// Just ensure there is some value.
-				if len(resp.Header[http.CanonicalHeaderKey(k)]) > 0 {
-					continue
-				}
-			}
+	imageName, err := reference.WithName("foo/platforms")
+	checkErr(t, err, "building image name")
 
-			for _, hv := range resp.Header[http.CanonicalHeaderKey(k)] {
-				if hv != v {
-					t.Fatalf("%+v %v header value not matched in response: %q != %q", resp.Header, k, hv, v)
-				}
-			}
+	configBlob := []byte("{}")
+	configDigest := digest.FromBytes(configBlob)
+	uploadURLBase, _ := startPushLayer(t, env, imageName)
+	pushLayer(t, env.builder, imageName, configDigest, uploadURLBase, bytes.NewReader(configBlob))
+
+	push := func(msg string, m distribution.Manifest, ref reference.Named) distribution.Descriptor {
+		mediaType, payload, err := m.Payload()
+		checkErr(t, err, msg)
+		dgst := digest.FromBytes(payload)
+		if ref == nil {
+			ref, err = reference.WithDigest(imageName, dgst)
+			checkErr(t, err, msg)
+		}
+		u, err := env.builder.BuildManifestURL(ref)
+		checkErr(t, err, msg)
+		resp := putManifest(t, msg, u, mediaType, m)
+		checkResponse(t, msg, resp, http.StatusCreated)
+		return distribution.Descriptor{MediaType: mediaType, Digest: dgst, Size: int64(len(payload))}
+	}
+	image := func(name string) distribution.Descriptor {
+		m, err := ocischema.FromStruct(ocischema.Manifest{
+			Versioned: ocischema.SchemaVersion,
+			Config: distribution.Descriptor{
+				MediaType: v1.MediaTypeImageConfig,
+				Digest:    configDigest,
+				Size:      int64(len(configBlob)),
+			},
+			Layers:      []distribution.Descriptor{},
+			Annotations: map[string]string{"name": name},
+		})
+		checkErr(t, err, "building image manifest")
+		return push("putting image manifest "+name, m, nil)
+	}
+
+	amd64 := image("amd64")
+	arm64 := image("arm64")
+	armv7 := image("armv7")
+	attestation := image("attestation")
+	attestation.Annotations = map[string]string{
+		"vnd.docker.reference.type":   "attestation-manifest",
+		"vnd.docker.reference.digest": arm64.Digest.String(),
+	}
+	index, err := manifestlist.FromDescriptorsWithMediaType([]manifestlist.ManifestDescriptor{
+		{Descriptor: amd64, Platform: manifestlist.PlatformSpec{OS: "linux", Architecture: "amd64"}},
+		{Descriptor: arm64, Platform: manifestlist.PlatformSpec{OS: "linux", Architecture: "arm64", Variant: "v8"}},
+		{Descriptor: armv7, Platform: manifestlist.PlatformSpec{OS: "linux", Architecture: "arm", Variant: "v7"}},
+		{Descriptor: attestation, Platform: manifestlist.PlatformSpec{OS: "unknown", Architecture: "unknown"}},
+	}, v1.MediaTypeImageIndex)
+	checkErr(t, err, "building index")
+	tagRef, err := reference.WithTag(imageName, "latest")
+	checkErr(t, err, "building tag reference")
+	indexDesc := push("putting index", index, tagRef)
+
+	tagURL, err := env.builder.BuildManifestURL(tagRef)
+	checkErr(t, err, "building tag url")
+
+	getIndex := func(msg, accept string, status int) (*http.Response, []byte) {
+		req, err := http.NewRequest(http.MethodGet, tagURL, nil)
+		checkErr(t, err, msg)
+		req.Header.Set("Accept", accept)
+		resp, err := http.DefaultClient.Do(req)
+		checkErr(t, err, msg)
+		defer resp.Body.Close()
+
+		checkResponse(t, msg, resp, status)
+		body, err := io.ReadAll(resp.Body)
+		checkErr(t, err, msg)
+		return resp, body
+	}
+	platforms := func(body []byte) []digest.Digest {
+		var index manifestlist.ManifestList
+		if err := json.Unmarshal(body, &index); err != nil {
+			t.Fatalf("error decoding index: %v", err)
 		}
+		var digests []digest.Digest
+		for _, m := range index.Manifests {
+			digests = append(digests, m.Digest)
+		}
+		return digests
 	}
-}
 
-func checkErr(t *testing.T, err error, msg string) {
-	if err != nil {
-		t.Fatalf("unexpected error %s: %v", msg, err)
+	platformsAccept := func(platforms ...string) string {
+		var accept []string
+		for _, platform := range platforms {
+			accept = append(accept, v1.MediaTypeImageIndex+`; platform="`+platform+`"`)
+		}
+		return strings.Join(accept, ", ")
 	}
-}
 
-func createRepository(env *testEnv, t *testing.T, imageName string, tag string) digest.Digest {
-	imageNameRef, err := reference.WithName(imageName)
-	if err != nil {
-		t.Fatalf("unable to parse reference: %v", err)
+	resp, body := getIndex("fetching filtered index", platformsAccept("linux/amd64", "linux/arm64"), http.StatusOK)
+	checkHeaders(t, resp, http.Header{
+		"Content-Type":          []string{v1.MediaTypeImageIndex},
+		"OCI-Filters-Applied":   []string{"platform"},
+		"Docker-Content-Digest": []string{digest.FromBytes(body).String()},
+	})
+	if digests := platforms(body); !reflect.DeepEqual(digests, []digest.Digest{amd64.Digest, arm64.Digest, attestation.Digest}) {
+		t.Fatalf("expected the amd64 and arm64 images and the arm64 attestation, got %v", digests)
 	}
 
-	unsignedManifest := &schema1.Manifest{
-		Versioned: manifest.Versioned{
-			SchemaVersion: 1,
-		},
-		Name: imageName,
-		Tag:  tag,
-		FSLayers: []schema1.FSLayer{
-			{
-				BlobSum: "asdf",
-			},
-		},
-		History: []schema1.History{
-			{
-				V1Compatibility: "",
-			},
-		},
+	// the filtered index is revalidated with its own digest
+	req, err := http.NewRequest(http.MethodGet, tagURL, nil)
+	checkErr(t, err, "revalidating filtered index")
+	req.Header.Set("Accept", platformsAccept("linux/amd64", "linux/arm64"))
+	req.Header.Set("If-None-Match", resp.Header.Get("Etag"))
+	resp, err = http.DefaultClient.Do(req)
+	checkErr(t, err, "revalidating filtered index")
+	resp.Body.Close()
+	checkResponse(t, "revalidating filtered index", resp, http.StatusNotModified)
+
+	_, body = getIndex("fetching variant", platformsAccept("linux/arm/v7"), http.StatusOK)
+	if digests := platforms(body); !reflect.DeepEqual(digests, []digest.Digest{armv7.Digest}) {
+		t.Fatalf("expected the armv7 image, got %v", digests)
 	}
 
-	// Push 2 random layers
-	expectedLayers := make(map[digest.Digest]io.ReadSeeker)
+	// an index left unchanged by the filter is the stored one
+	resp, _ = getIndex("fetching all platforms", platformsAccept("linux/amd64", "linux/arm64", "linux/arm", "unknown/unknown"), http.StatusOK)
+	checkHeaders(t, resp, http.Header{
+		"Docker-Content-Digest": []string{indexDesc.Digest.String()},
+	})
+	if resp.Header.Get("OCI-Filters-Applied") != "" {
+		t.Fatalf("unexpected filter header on the stored index")
+	}
 
-	for i := range unsignedManifest.FSLayers {
-		rs, dgst, err := testutil.CreateRandomTarFile()
-		if err != nil {
-			t.Fatalf("error creating random layer %d: %v", i, err)
-		}
+	getIndex("fetching unknown platform", platformsAccept("windows/amd64"), http.StatusNotFound)
 
-		expectedLayers[dgst] = rs
-		unsignedManifest.FSLayers[i].BlobSum = dgst
-		uploadURLBase, _ := startPushLayer(t, env, imageNameRef)
-		pushLayer(t, env.builder, imageNameRef, dgst, uploadURLBase, rs)
+	// a manifest fetched by digest is never filtered
+	digestRef, err := reference.WithDigest(imageName, indexDesc.Digest)
+	checkErr(t, err, "building digest reference")
+	tagURL, err = env.builder.BuildManifestURL(digestRef)
+	checkErr(t, err, "building digest url")
+	resp, body = getIndex("fetching index by digest", platformsAccept("linux/amd64"), http.StatusOK)
+	checkHeaders(t, resp, http.Header{
+		"Docker-Content-Digest": []string{indexDesc.Digest.String()},
+	})
+	if digest.FromBytes(body) != indexDesc.Digest || resp.Header.Get("OCI-Filters-Applied") != "" {
+		t.Fatalf("expected the stored index")
 	}
+}
 
-	signedManifest, err := schema1.Sign(unsignedManifest, env.pk)
-	if err != nil {
-		t.Fatalf("unexpected error signing manifest: %v", err)
+// Test mutation operations on a registry configured as a cache.  Ensure that they return
+// appropriate errors.
+// tagDenyValidator rejects manifests pushed with the configured tag.
+type tagDenyValidator struct {
+	tag string
+}
+
+func (v *tagDenyValidator) ValidateManifest(ctx context.Context, repository distribution.Repository, tag string, manifest distribution.Manifest) error {
+	if tag == v.tag {
+		return fmt.Errorf("tag %s is not allowed", tag)
 	}
+	return nil
+}
 
-	dgst := digest.FromBytes(signedManifest.Canonical)
+func init() {
+	validation.Register("tagdeny", func(ctx context.Context, options map[string]interface{}) (validation.ManifestValidator, error) {
+		return &tagDenyValidator{tag: fmt.Sprint(options["tag"])}, nil
+	})
+}
 
-	// Create this repository by tag to ensure the tag mapping is made in the registry
-	tagRef, _ := reference.WithTag(imageNameRef, tag)
-	manifestDigestURL, err := env.builder.BuildManifestURL(tagRef)
-	checkErr(t, err, "building manifest url")
+// TestManifestValidatorRejection checks that manifests rejected by a
+// configured validator are not stored.
+func TestManifestValidatorRejection(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	config.Validation.Manifests.Validators = []configuration.ManifestValidator{
+		{Name: "tagdeny", Options: configuration.Parameters{"tag": "latest"}},
+	}
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
 
-	digestRef, _ := reference.WithDigest(imageNameRef, dgst)
-	location, err := env.builder.BuildManifestURL(digestRef)
-	checkErr(t, err, "building location URL")
+	imageName, err := reference.WithName("foo/validated")
+	checkErr(t, err, "building image name")
 
-	resp := putManifest(t, "putting signed manifest", manifestDigestURL, "", signedManifest)
-	checkResponse(t, "putting signed manifest", resp, http.StatusCreated)
-	checkHeaders(t, resp, http.Header{
-		"Location":              []string{location},
-		"Docker-Content-Digest": []string{dgst.String()},
+	configBlob := []byte("{}")
+	configDigest := digest.FromBytes(configBlob)
+	uploadURLBase, _ := startPushLayer(t, env, imageName)
+	pushLayer(t, env.builder, imageName, configDigest, uploadURLBase, bytes.NewReader(configBlob))
+
+	m, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned: ocischema.SchemaVersion,
+		Config: distribution.Descriptor{
+			MediaType: v1.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      int64(len(configBlob)),
+		},
+		Layers: []distribution.Descriptor{},
 	})
-	return dgst
+	checkErr(t, err, "building manifest")
+
+	for _, tag := range []string{"latest", "v1"} {
+		ref, err := reference.WithTag(imageName, tag)
+		checkErr(t, err, "building tag reference")
+		manifestURL, err := env.builder.BuildManifestURL(ref)
+		checkErr(t, err, "building manifest url")
+
+		resp := putManifest(t, "putting manifest", manifestURL, v1.MediaTypeImageManifest, m)
+		defer resp.Body.Close()
+		if tag == "latest" {
+			checkResponse(t, "putting rejected manifest", resp, http.StatusBadRequest)
+			checkBodyHasErrorCodes(t, "putting rejected manifest", resp, v2.ErrorCodeManifestInvalid)
+		} else {
+			checkResponse(t, "putting accepted manifest", resp, http.StatusCreated)
+		}
+
+		req, err := http.NewRequest("GET", manifestURL, nil)
+		checkErr(t, err, "building manifest request")
+		req.Header.Set("Accept", v1.MediaTypeImageManifest)
+		resp, err = http.DefaultClient.Do(req)
+		checkErr(t, err, "fetching manifest")
+		defer resp.Body.Close()
+		if tag == "latest" {
+			checkResponse(t, "fetching rejected manifest", resp, http.StatusNotFound)
+		} else {
+			checkResponse(t, "fetching accepted manifest", resp, http.StatusOK)
+		}
+	}
 }
 
-// Test mutation operations on a registry configured as a cache.  Ensure that they return
-// appropriate errors.
 func TestRegistryAsCacheMutationAPIs(t *testing.T) {
 	deleteEnabled := true
 	env := newTestEnvMirror(t, deleteEnabled)
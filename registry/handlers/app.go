@@ -3,18 +3,25 @@ package handlers
 import (
 	"context"
 	"crypto/rand"
+	"crypto/tls"
+	"errors"
 	"expvar"
 	"fmt"
+	"io"
 	"math"
 	"math/big"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
+	"reflect"
 	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/distribution/distribution/v3"
@@ -27,23 +34,34 @@ import (
 	"github.com/distribution/distribution/v3/reference"
 	"github.com/distribution/distribution/v3/registry/api/errcode"
 	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/distribution/distribution/v3/registry/auditlog"
 	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/distribution/distribution/v3/registry/auth/tokenserver"
 	registrymiddleware "github.com/distribution/distribution/v3/registry/middleware/registry"
 	repositorymiddleware "github.com/distribution/distribution/v3/registry/middleware/repository"
 	"github.com/distribution/distribution/v3/registry/proxy"
+	"github.com/distribution/distribution/v3/registry/replication"
 	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/distribution/v3/registry/storage/cache"
 	memorycache "github.com/distribution/distribution/v3/registry/storage/cache/memory"
 	rediscache "github.com/distribution/distribution/v3/registry/storage/cache/redis"
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
 	storagemiddleware "github.com/distribution/distribution/v3/registry/storage/driver/middleware"
+	"github.com/distribution/distribution/v3/registry/storage/lock"
+	redislock "github.com/distribution/distribution/v3/registry/storage/lock/redis"
+	"github.com/distribution/distribution/v3/registry/validation"
+	"github.com/distribution/distribution/v3/uuid"
 	"github.com/distribution/distribution/v3/version"
 	events "github.com/docker/go-events"
 	"github.com/docker/go-metrics"
 	"github.com/docker/libtrust"
-	"github.com/gomodule/redigo/redis"
 	"github.com/gorilla/mux"
+	"github.com/opencontainers/go-digest"
+	"github.com/redis/go-redis/v9"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // randomSecretSize is the number of random bytes to generate if no secret
@@ -53,6 +71,15 @@ const randomSecretSize = 32
 // defaultCheckInterval is the default time in between health checks
 const defaultCheckInterval = 10 * time.Second
 
+const (
+	// defaultProbeDirectory is the default directory of the canary objects
+	// of the storage driver probe
+	defaultProbeDirectory = "/health"
+
+	// defaultProbeTimeout is the default time a storage driver probe may take
+	defaultProbeTimeout = 10 * time.Second
+)
+
 // App is a global registry application object. Shared resources can be placed
 // on this object that will be accessible from all requests. Any writable
 // fields should be protected.
@@ -73,22 +100,100 @@ type App struct {
 
 	// events contains notification related configuration.
 	events struct {
-		sink   events.Sink
-		source notifications.SourceRecord
+		sink      *events.Broadcaster
+		source    notifications.SourceRecord
+		stream    *notifications.Stream
+		endpoints []events.Sink // the sinks of the endpoints, replaced when the configuration is reloaded
 	}
 
-	redis *redis.Pool
+	// reloadMu guards the access controller and the rate limits, which are
+	// replaced when the configuration is reloaded. reloading serializes the
+	// reloads, and reloaded is the configuration last applied.
+	reloadMu  sync.RWMutex
+	reloading sync.Mutex
+	reloaded  *configuration.Configuration
+
+	redis redis.UniversalClient
+
+	// transport is the transport of the outbound HTTP connections of the
+	// pull through cache and of the notification endpoints.
+	transport *http.Transport
 
 	// trustKey is a deprecated key used to sign manifests converted to
 	// schema1 for backward compatibility. It should not be used for any
 	// other purposes.
 	trustKey libtrust.PrivateKey
 
+	// schema1Conversion is what is served to the clients not supporting
+	// schema2 fetching a schema2 manifest or a manifest list by tag, unless
+	// overridden by the namespace of the repository, and schema1Message
+	// the message of the rejections.
+	schema1Conversion string
+	schema1Message    string
+
 	// isCache is true if this registry is configured as a pull through cache
 	isCache bool
 
-	// readOnly is true if the registry is in a read-only maintenance mode
-	readOnly bool
+	// readOnly is non-zero if the registry is in a read-only maintenance
+	// mode. It is accessed atomically as it can be switched at runtime.
+	readOnly int32
+
+	// gc runs the garbage collections started through the admin routes.
+	gc *gcRunner
+
+	// stats computes the statistics served by the admin routes, if they
+	// are enabled.
+	stats *statsIndexer
+
+	// blobDescriptorCache caches the descriptors of the blobs, nil if no
+	// cache is configured. It is purged through the admin routes.
+	blobDescriptorCache cache.BlobDescriptorCacheProvider
+
+	// repositoryDeletion is true if whole repositories may be deleted
+	// through the API
+	repositoryDeletion bool
+
+	// trash restores and purges the manifests, tags and blobs soft deleted
+	// from the repositories through the admin routes. It is nil unless soft
+	// deletion is enabled.
+	trash distribution.Namespace
+
+	// freezer reports and switches whether the repositories are frozen, in
+	// the storage beneath the registry middlewares.
+	freezer distribution.Namespace
+
+	// renamer renames the repositories through the admin routes, and
+	// resolves the aliases left by the renames. It is nil unless the
+	// storage supports renaming.
+	renamer distribution.RepositoryRenamer
+
+	// auditLog records the API requests, if enabled
+	auditLog *auditlog.Logger
+
+	// rateLimits limit the rate of the API requests
+	rateLimits []rateLimit
+
+	// trustedProxies are the reverse proxies whose forwarding headers
+	// identify the clients of the rate limits and upload caps
+	trustedProxies []*net.IPNet
+
+	// uploadLimits cap the upload sessions open at once, nil if there is
+	// no cap
+	uploadLimits *uploadLimits
+
+	// classTimeouts override the timeouts of the connections for classes
+	// of requests
+	classTimeouts map[string]configuration.HTTPClassTimeouts
+
+	// namespaces resolve the settings of the repositories
+	namespaces *namespaces
+
+	// tenants resolve the root directories of the requests, if the
+	// registry serves several tenants
+	tenants *tenants
+
+	// compressor compresses the API responses, if enabled
+	compressor *compressor
 }
 
 // NewApp takes a configuration and returns a configured app, ready to serve
@@ -96,22 +201,32 @@ type App struct {
 // handlers accordingly.
 func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 	app := &App{
-		Config:  config,
-		Context: ctx,
-		router:  v2.RouterWithPrefix(config.HTTP.Prefix),
-		isCache: config.Proxy.RemoteURL != "",
+		Config:   config,
+		Context:  ctx,
+		router:   v2.RouterWithPrefix(config.HTTP.Prefix),
+		isCache:  config.Proxy.Enabled(),
+		reloaded: config,
 	}
 
+	app.configureCompression(config)
+
 	// Register the handler dispatchers.
 	app.register(v2.RouteNameBase, func(ctx *Context, r *http.Request) http.Handler {
 		return http.HandlerFunc(apiBase)
 	})
 	app.register(v2.RouteNameManifest, manifestDispatcher)
 	app.register(v2.RouteNameCatalog, catalogDispatcher)
+	app.register(v2.RouteNameCatalogActivity, catalogActivityDispatcher)
+	app.register(v2.RouteNameEvents, eventsDispatcher)
 	app.register(v2.RouteNameTags, tagsDispatcher)
+	app.register(v2.RouteNameTagHistory, tagHistoryDispatcher)
+	app.register(v2.RouteNameUntagged, untaggedDispatcher)
+	app.register(v2.RouteNameReferrers, referrersDispatcher)
 	app.register(v2.RouteNameBlob, blobDispatcher)
+	app.register(v2.RouteNameBlobsExist, blobsExistDispatcher)
 	app.register(v2.RouteNameBlobUpload, blobUploadDispatcher)
 	app.register(v2.RouteNameBlobUploadChunk, blobUploadDispatcher)
+	app.register(v2.RouteNameRepository, repositoryDispatcher)
 
 	// override the storage driver's UA string for registry outbound HTTP requests
 	storageParams := config.Storage.Parameters()
@@ -130,6 +245,8 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 	}
 
 	purgeConfig := uploadPurgeDefaultConfig()
+	onlineGCConfig := onlineGCDefaultConfig()
+	var retentionConfig map[interface{}]interface{}
 	if mc, ok := config.Storage["maintenance"]; ok {
 		if v, ok := mc["uploadpurging"]; ok {
 			purgeConfig, ok = v.(map[interface{}]interface{})
@@ -137,33 +254,74 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 				panic("uploadpurging config key must contain additional keys")
 			}
 		}
-		if v, ok := mc["readonly"]; ok {
-			readOnly, ok := v.(map[interface{}]interface{})
+		if v, ok := mc["onlinegc"]; ok {
+			onlineGCConfig, ok = v.(map[interface{}]interface{})
 			if !ok {
-				panic("readonly config key must contain additional keys")
+				panic("onlinegc config key must contain additional keys")
 			}
-			if readOnlyEnabled, ok := readOnly["enabled"]; ok {
-				app.readOnly, ok = readOnlyEnabled.(bool)
-				if !ok {
-					panic("readonly's enabled config key must have a boolean value")
-				}
+		}
+		if v, ok := mc["retention"]; ok {
+			retentionConfig, ok = v.(map[interface{}]interface{})
+			if !ok {
+				panic("retention config key must contain additional keys")
 			}
 		}
 	}
+	readOnly, err := readOnlyEnabled(config)
+	if err != nil {
+		panic(err)
+	}
+	app.SetReadOnly(readOnly)
 
+	app.configureTenants(config)
 	startUploadPurger(app, app.driver, dcontext.GetLogger(app), purgeConfig)
+	if app.tenants != nil {
+		rooted := storage.NewContextRootedDriver(app.driver)
+		for _, root := range app.tenants.roots() {
+			ctx := storage.WithRootDirectory(app, root)
+			startUploadPurger(ctx, rooted, dcontext.GetLoggerWithField(ctx, "rootdirectory", root), purgeConfig)
+		}
+	}
 
-	app.driver, err = applyStorageMiddleware(app.driver, config.Middleware["storage"])
+	app.driver, err = ApplyStorageMiddleware(app.driver, config.Middleware["storage"])
 	if err != nil {
 		panic(err)
 	}
 
-	app.configureSecret(config)
+	app.transport, err = newHTTPTransport(config.HTTPClient)
+	if err != nil {
+		panic(fmt.Sprintf("unable to configure httpclient: %v", err))
+	}
 	app.configureEvents(config)
 	app.configureRedis(config)
 	app.configureLogHook(config)
+	app.configureAuditLog(config)
+	app.configureRateLimits(config)
+	app.configureUploadLimits(config)
+	app.configureTimeouts(config)
+	app.configureNamespaces(config)
+
+	if config.Policy.Mount.Fallback && !config.Policy.Mount.AllowUnauthorizedSource {
+		panic("the mount fallback exposes the blobs of all the repositories: it requires allowunauthorizedsource to be set")
+	}
 
 	options := registrymiddleware.GetRegistryOptions()
+	locker, err := NewLocker(config, app.driver, app.redis)
+	if err != nil {
+		panic(fmt.Sprintf("unable to configure locks: %v", err))
+	}
+	app.configureSecret(config, locker)
+	if locker != nil {
+		options = append(options, storage.Locks(locker))
+	}
+	// the locks are shared by the tenants, the rest of the content is
+	// stored in the root directory of the tenant of each request
+	if app.tenants != nil {
+		app.driver = storage.NewContextRootedDriver(app.driver)
+		// the data of the blobs pushed by several tenants is linked
+		// rather than stored again, by the drivers able to
+		options = append(options, storage.ShareBlobData(append([]string{"/"}, app.tenants.roots()...)...))
+	}
 	if config.Compatibility.Schema1.TrustKey != "" {
 		app.trustKey, err = libtrust.LoadKeyFile(config.Compatibility.Schema1.TrustKey)
 		if err != nil {
@@ -184,6 +342,19 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 		options = append(options, storage.EnableSchema1)
 	}
 
+	switch conversion := config.Compatibility.Schema1.Conversion; conversion {
+	case "":
+		app.schema1Conversion = schema1Convert
+	case schema1Convert, schema1Reject:
+		app.schema1Conversion = conversion
+	default:
+		panic(fmt.Sprintf("unknown schema1 conversion %q, expected convert or reject", conversion))
+	}
+	app.schema1Message = config.Compatibility.Schema1.Message
+	if app.schema1Message == "" {
+		app.schema1Message = defaultSchema1Message
+	}
+
 	if config.HTTP.Host != "" {
 		u, err := url.Parse(config.HTTP.Host)
 		if err != nil {
@@ -196,14 +367,54 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 		options = append(options, storage.DisableDigestResumption)
 	}
 
+	// configure the Cache-Control header of blob responses
+	if cc := config.HTTP.CacheControl; cc.MaxAge != 0 || cc.Immutable || cc.NoStore || len(cc.MediaTypes) > 0 {
+		options = append(options, storage.BlobCacheControl(blobCacheControl(cc)))
+	}
+
+	// maintain an index of the repositories for the catalog API
+	if config.Catalog.Index.Enabled {
+		options = append(options, storage.EnableCatalogIndex)
+	}
+
+	// record blob references for the online garbage collector
+	if onlineGCConfig["enabled"] == true {
+		options = append(options, storage.EnableMarkLog)
+	}
+
 	// configure deletion
+	var softDelete, deleteEnabled bool
 	if d, ok := config.Storage["delete"]; ok {
 		e, ok := d["enabled"]
 		if ok {
-			if deleteEnabled, ok := e.(bool); ok && deleteEnabled {
+			if deleteEnabled, ok = e.(bool); ok && deleteEnabled {
 				options = append(options, storage.EnableDelete)
 			}
 		}
+		if r, ok := d["repositories"]; ok {
+			repositoriesEnabled, ok := r.(bool)
+			if !ok {
+				panic(fmt.Sprintf("invalid type for delete repositories config: %#v", r))
+			}
+			deleteEnabled, _ := e.(bool)
+			if repositoriesEnabled && !deleteEnabled {
+				panic("delete repositories requires delete to be enabled")
+			}
+			app.repositoryDeletion = repositoriesEnabled
+		}
+		if sd, ok := d["softdelete"]; ok {
+			retention, err := softDeleteRetention(sd)
+			if err != nil {
+				panic(err)
+			}
+			if retention > 0 {
+				if deleteEnabled, _ := e.(bool); !deleteEnabled {
+					panic("soft delete requires delete to be enabled")
+				}
+				options = append(options, storage.EnableSoftDelete(retention))
+				softDelete = true
+			}
+		}
 	}
 
 	// configure redirects
@@ -211,11 +422,36 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 	if redirectConfig, ok := config.Storage["redirect"]; ok {
 		v := redirectConfig["disable"]
 		switch v := v.(type) {
+		case nil:
 		case bool:
 			redirectDisabled = v
 		default:
 			panic(fmt.Sprintf("invalid type for redirect config: %#v", redirectConfig))
 		}
+
+		switch v := redirectConfig["expiry"].(type) {
+		case nil:
+		case string:
+			expiry, err := time.ParseDuration(v)
+			if err != nil {
+				panic(fmt.Sprintf("invalid redirect expiry %q: %v", v, err))
+			}
+			options = append(options, storage.RedirectExpiry(expiry))
+		default:
+			panic(fmt.Sprintf("invalid type for redirect expiry config: %#v", v))
+		}
+
+		switch v := redirectConfig["baseurl"].(type) {
+		case nil:
+		case string:
+			baseURL, err := url.Parse(v)
+			if err != nil {
+				panic(fmt.Sprintf("invalid redirect baseurl %q: %v", v, err))
+			}
+			options = append(options, storage.RedirectBaseURL(baseURL))
+		default:
+			panic(fmt.Sprintf("invalid type for redirect baseurl config: %#v", v))
+		}
 	}
 	if redirectDisabled {
 		dcontext.GetLogger(app).Infof("backend redirection disabled")
@@ -223,6 +459,65 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 		options = append(options, storage.EnableRedirect)
 	}
 
+	// configure the serving of blobs not redirected
+	if blobServerConfig, ok := config.Storage["blobserver"]; ok {
+		switch v := blobServerConfig["buffersize"].(type) {
+		case nil:
+		case int:
+			options = append(options, storage.ReadBufferSize(v))
+		default:
+			panic(fmt.Sprintf("invalid type for blobserver buffersize config: %#v", v))
+		}
+
+		switch v := blobServerConfig["sendfile"].(type) {
+		case nil:
+		case string:
+			prefix, ok := blobServerConfig["sendfileprefix"].(string)
+			if !ok && blobServerConfig["sendfileprefix"] != nil {
+				panic(fmt.Sprintf("invalid type for blobserver sendfileprefix config: %#v", blobServerConfig["sendfileprefix"]))
+			}
+			// the web server reads the files of the backend as is, while
+			// storage middlewares may store them encrypted or elsewhere
+			if len(config.Middleware["storage"]) > 0 {
+				panic("blobserver sendfile is not supported with storage middlewares")
+			}
+			options = append(options, storage.BlobSendfile(v, prefix))
+		default:
+			panic(fmt.Sprintf("invalid type for blobserver sendfile config: %#v", v))
+		}
+
+		switch v := blobServerConfig["toc"].(type) {
+		case nil:
+		case bool:
+			if v {
+				dcontext.GetLogger(app).Infof("serving table of contents of seekable layers")
+				options = append(options, storage.EnableBlobTOC)
+			}
+		default:
+			panic(fmt.Sprintf("invalid type for blobserver toc config: %#v", v))
+		}
+	}
+
+	// configure pre-compressed blob variants
+	if compressionConfig, ok := config.Storage["compression"]; ok {
+		var encodings []string
+		switch v := compressionConfig["encodings"].(type) {
+		case nil:
+		case []interface{}:
+			for _, encoding := range v {
+				encodings = append(encodings, fmt.Sprint(encoding))
+			}
+		case []string:
+			encodings = v
+		default:
+			panic(fmt.Sprintf("invalid type for compression encodings config: %#v", compressionConfig))
+		}
+		if len(encodings) > 0 {
+			dcontext.GetLogger(app).Infof("generating blob variants with encodings: %s", strings.Join(encodings, ", "))
+			options = append(options, storage.EnableBlobEncodings(encodings...))
+		}
+	}
+
 	if !config.Validation.Enabled {
 		config.Validation.Enabled = !config.Validation.Disabled
 	}
@@ -258,6 +553,18 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 				options = append(options, storage.ManifestURLsDenyRegexp(re))
 			}
 		}
+
+		for _, v := range config.Validation.Manifests.Validators {
+			if v.Disabled {
+				continue
+			}
+			validator, err := validation.Get(app, v.Name, v.Options)
+			if err != nil {
+				panic(fmt.Sprintf("unable to configure manifest validator (%s): %s", v.Name, err))
+			}
+			options = append(options, storage.ManifestValidators(validator))
+			dcontext.GetLogger(app).Infof("configured manifest validator %q", v.Name)
+		}
 	}
 
 	// configure storage caches
@@ -273,10 +580,16 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 			if app.redis == nil {
 				panic("redis configuration required to use for layerinfo cache")
 			}
-			if _, ok := cc["blobdescriptorsize"]; ok {
-				dcontext.GetLogger(app).Warnf("blobdescriptorsize parameter is not supported with redis cache")
+			if app.tenants != nil {
+				panic("tenancy is not supported by the redis blob descriptor cache")
+			}
+			for _, param := range []string{"blobdescriptorsize", "blobdescriptorbytes"} {
+				if _, ok := cc[param]; ok {
+					dcontext.GetLogger(app).Warnf("%s parameter is not supported with redis cache", param)
+				}
 			}
 			cacheProvider := rediscache.NewRedisBlobDescriptorCacheProvider(app.redis)
+			app.blobDescriptorCache = cacheProvider
 			localOptions := append(options, storage.BlobDescriptorCacheProvider(cacheProvider))
 			app.registry, err = storage.NewRegistry(app, app.driver, localOptions...)
 			if err != nil {
@@ -294,7 +607,21 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 				}
 			}
 
-			cacheProvider := memorycache.NewInMemoryBlobDescriptorCacheProvider(blobDescriptorSize)
+			var blobDescriptorBytes int64
+			if configuredBytes, ok := cc["blobdescriptorbytes"]; ok {
+				blobDescriptorBytes, err = strconv.ParseInt(fmt.Sprint(configuredBytes), 10, 64)
+				if err != nil || blobDescriptorBytes < 0 {
+					panic(fmt.Sprintf("invalid blobdescriptorbytes value %s: %v", configuredBytes, err))
+				}
+			}
+
+			cacheProvider := memorycache.NewBoundedInMemoryBlobDescriptorCacheProvider(blobDescriptorSize, blobDescriptorBytes)
+			if app.tenants != nil {
+				cacheProvider = newTenantBlobDescriptorCacheProvider(func() cache.BlobDescriptorCacheProvider {
+					return memorycache.NewBoundedInMemoryBlobDescriptorCacheProvider(blobDescriptorSize, blobDescriptorBytes)
+				})
+			}
+			app.blobDescriptorCache = cacheProvider
 			localOptions := append(options, storage.BlobDescriptorCacheProvider(cacheProvider))
 			app.registry, err = storage.NewRegistry(app, app.driver, localOptions...)
 			if err != nil {
@@ -316,31 +643,100 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 		}
 	}
 
+	startOnlineGC(app, app.driver, app.registry, dcontext.GetLogger(app), onlineGCConfig, app.ReadOnly)
+	if retentionConfig["enabled"] == true && !deleteEnabled {
+		panic("retention requires delete to be enabled")
+	}
+	startRetention(app, app.driver, app.registry, dcontext.GetLogger(app), retentionConfig, app.ReadOnly, app.retentionBridge())
+	if app.tenants != nil {
+		// each tenant is collected and retained on its own
+		for _, root := range app.tenants.roots() {
+			ctx := storage.WithRootDirectory(app, root)
+			log := dcontext.GetLoggerWithField(ctx, "rootdirectory", root)
+			startOnlineGC(ctx, app.driver, app.registry, log, onlineGCConfig, app.ReadOnly)
+			startRetention(ctx, app.driver, app.registry, log, retentionConfig, app.ReadOnly, app.retentionBridge())
+		}
+	}
+	app.gc = newGCRunner(app.driver, app.registry)
+	app.freezer = app.registry
+	app.renamer, _ = app.registry.(distribution.RepositoryRenamer)
+	if softDelete {
+		app.trash = app.registry
+	}
+
 	app.registry, err = applyRegistryMiddleware(app, app.registry, config.Middleware["registry"])
 	if err != nil {
 		panic(err)
 	}
 
-	authType := config.Auth.Type()
+	app.accessController, err = app.newAccessController(config)
+	if err != nil {
+		panic(err.Error())
+	}
 
-	if authType != "" && !strings.EqualFold(authType, "none") {
-		accessController, err := auth.GetAccessController(config.Auth.Type(), config.Auth.Parameters())
+	// configure the admin routes, which must not be served to anonymous
+	// clients
+	if config.HTTP.Admin.Enabled {
+		if app.accessController == nil {
+			panic("admin routes require auth to be configured")
+		}
+		app.router.Path(path.Join("/", config.HTTP.Prefix, adminReadOnlyPath)).Name(routeNameAdminReadOnly)
+		app.register(routeNameAdminReadOnly, adminReadOnlyDispatcher)
+		app.router.Path(path.Join("/", config.HTTP.Prefix, adminGCPath)).Name(routeNameAdminGC)
+		app.register(routeNameAdminGC, adminGCDispatcher)
+		app.router.Path(path.Join("/", config.HTTP.Prefix, adminTrashPath)).Name(routeNameAdminTrash)
+		app.register(routeNameAdminTrash, adminTrashDispatcher)
+		app.router.Path(path.Join("/", config.HTTP.Prefix, adminFrozenPath)).Name(routeNameAdminFrozen)
+		app.register(routeNameAdminFrozen, adminFrozenDispatcher)
+		app.router.Path(path.Join("/", config.HTTP.Prefix, adminWarmPath)).Name(routeNameAdminWarm)
+		app.register(routeNameAdminWarm, adminWarmDispatcher)
+		app.router.Path(path.Join("/", config.HTTP.Prefix, adminRenamePath)).Name(routeNameAdminRename)
+		app.register(routeNameAdminRename, adminRenameDispatcher)
+		app.router.Path(path.Join("/", config.HTTP.Prefix, adminStatsPath)).Name(routeNameAdminStats)
+		app.register(routeNameAdminStats, adminStatsDispatcher)
+		app.router.Path(path.Join("/", config.HTTP.Prefix, adminCachePath)).Name(routeNameAdminCache)
+		app.register(routeNameAdminCache, adminCacheDispatcher)
+
+		// the statistics of each tenant are computed on their own
+		statsRoots := []string{"/"}
+		if app.tenants != nil {
+			statsRoots = append(statsRoots, app.tenants.roots()...)
+		}
+		app.stats = newStatsIndexer(app.driver, app.registry, statsRoots)
+		app.stats.start(app, config.HTTP.Admin.Stats.Interval)
+	}
+
+	// configure the token server, whose requests are authenticated by the
+	// token server itself
+	if config.TokenServer.Enabled {
+		tokenServer, err := tokenserver.New(config.TokenServer)
 		if err != nil {
-			panic(fmt.Sprintf("unable to configure authorization (%s): %v", authType, err))
+			panic(err)
+		}
+		tokenPath := config.TokenServer.Path
+		if tokenPath == "" {
+			tokenPath = tokenserver.DefaultPath
 		}
-		app.accessController = accessController
-		dcontext.GetLogger(app).Debugf("configured %q access controller", authType)
+		app.router.Path(path.Join("/", config.HTTP.Prefix, tokenPath)).Handler(tokenServer)
 	}
 
 	// configure as a pull through cache
-	if config.Proxy.RemoteURL != "" {
-		app.registry, err = proxy.NewRegistryPullThroughCache(ctx, app.registry, app.driver, config.Proxy)
+	if config.Proxy.Enabled() {
+		app.registry, err = proxy.NewRegistryPullThroughCache(ctx, app.registry, app.driver, config.Proxy, app.transport)
 		if err != nil {
 			panic(err.Error())
 		}
 		app.isCache = true
-		dcontext.GetLogger(app).Info("Registry configured as a proxy cache to ", config.Proxy.RemoteURL)
+		for _, remote := range config.Proxy.Remotes {
+			dcontext.GetLogger(app).Infof("Registry configured as a proxy cache to %s for %s/*", remote.RemoteURL, remote.Prefix)
+		}
+		if config.Proxy.RemoteURL != "" {
+			dcontext.GetLogger(app).Info("Registry configured as a proxy cache to ", config.Proxy.RemoteURL)
+		}
 	}
+
+	app.configureReplication(config)
+
 	var ok bool
 	app.repoRemover, ok = app.registry.(distribution.RepositoryRemover)
 	if !ok {
@@ -350,6 +746,279 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 	return app
 }
 
+// ReadOnly reports whether the registry is in read-only maintenance mode.
+func (app *App) ReadOnly() bool {
+	return atomic.LoadInt32(&app.readOnly) != 0
+}
+
+// SetReadOnly switches the registry to or from read-only maintenance mode.
+// Requests already being served are not affected.
+func (app *App) SetReadOnly(readOnly bool) {
+	var v int32
+	if readOnly {
+		v = 1
+	}
+	if atomic.SwapInt32(&app.readOnly, v) != v {
+		dcontext.GetLogger(app).Infof("read-only mode set to %t", readOnly)
+	}
+}
+
+// switchReadOnly switches the registry to or from read-only maintenance
+// mode, unless a garbage collection started through the admin routes is
+// running: it would then remove the blobs of the pushes accepted meanwhile,
+// so the mode is kept and false is returned.
+func (app *App) switchReadOnly(readOnly bool) bool {
+	if app.gc == nil {
+		app.SetReadOnly(readOnly)
+		return true
+	}
+	app.gc.mu.Lock()
+	defer app.gc.mu.Unlock()
+	if !readOnly && app.gc.running() {
+		return false
+	}
+	app.SetReadOnly(readOnly)
+	return true
+}
+
+// newAccessController returns the access controller configured by the auth
+// section, or nil if there is none.
+func (app *App) newAccessController(config *configuration.Configuration) (auth.AccessController, error) {
+	authType := config.Auth.Type()
+	if authType == "" || strings.EqualFold(authType, "none") {
+		return nil, nil
+	}
+
+	accessController, err := auth.GetAccessController(authType, config.Auth.Parameters())
+	if err != nil {
+		return nil, fmt.Errorf("unable to configure authorization (%s): %v", authType, err)
+	}
+	dcontext.GetLogger(app).Debugf("configured %q access controller", authType)
+	return accessController, nil
+}
+
+// closeAccessController releases the resources of an access controller
+// which is not used, if it holds any.
+func closeAccessController(ctx context.Context, accessController auth.AccessController) {
+	if closer, ok := accessController.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			dcontext.GetLogger(ctx).Errorf("error closing access controller: %v", err)
+		}
+	}
+}
+
+// getAccessController returns the access controller, or nil if there is
+// none.
+func (app *App) getAccessController() auth.AccessController {
+	app.reloadMu.RLock()
+	defer app.reloadMu.RUnlock()
+	return app.accessController
+}
+
+// getRateLimits returns the rate limits of the API requests.
+func (app *App) getRateLimits() []rateLimit {
+	app.reloadMu.RLock()
+	defer app.reloadMu.RUnlock()
+	return app.rateLimits
+}
+
+// ReloadConfiguration applies the settings of config which can change while
+// the registry is running: the read-only maintenance mode, the parameters of
+// the access controller, the notification endpoints, the rate limits and the
+// credentials of the proxy remotes. The access controller is reloaded too if
+// it supports it, so that it reads its files again.
+//
+// The settings are all checked before any is applied, so that an invalid
+// configuration leaves the registry unchanged. The requests being served are
+// not affected, and the events queued for the endpoints which are replaced
+// are still delivered.
+func (app *App) ReloadConfiguration(config *configuration.Configuration) (err error) {
+	app.reloading.Lock()
+	defer app.reloading.Unlock()
+	previous := app.reloaded
+
+	// the access controller created for config is closed unless it is
+	// applied
+	var created auth.AccessController
+	defer func() {
+		if err != nil && created != nil {
+			closeAccessController(app, created)
+		}
+	}()
+
+	readOnly, err := readOnlyEnabled(config)
+	if err != nil {
+		return err
+	}
+
+	accessController := app.getAccessController()
+	if !reflect.DeepEqual(config.Auth, previous.Auth) {
+		if !strings.EqualFold(config.Auth.Type(), previous.Auth.Type()) {
+			return fmt.Errorf("the auth type can not change while the registry is running")
+		}
+		if accessController, err = app.newAccessController(config); err != nil {
+			return err
+		}
+		created = accessController
+	} else if reloader, ok := accessController.(auth.Reloader); ok {
+		if err := reloader.Reload(); err != nil {
+			return fmt.Errorf("error reloading access controller: %v", err)
+		}
+	}
+
+	rateLimits := app.getRateLimits()
+	if !reflect.DeepEqual(config.RateLimit, previous.RateLimit) {
+		if rateLimits, err = newRateLimits(config.RateLimit); err != nil {
+			return fmt.Errorf("invalid rate limit configuration: %v", err)
+		}
+	}
+
+	var endpoints []events.Sink
+	endpointsChanged := !reflect.DeepEqual(config.Notifications.Endpoints, previous.Notifications.Endpoints)
+	if endpointsChanged {
+		if endpoints, err = app.newEndpointSinks(config.Notifications.Endpoints); err != nil {
+			return err
+		}
+	}
+	closeEndpoints := func() {
+		for _, sink := range endpoints {
+			sink.Close()
+		}
+	}
+
+	var applyProxyCredentials func()
+	if app.isCache && !reflect.DeepEqual(config.Proxy, previous.Proxy) {
+		if applyProxyCredentials, err = proxy.ReloadCredentials(app.registry, config.Proxy); err != nil {
+			closeEndpoints()
+			return fmt.Errorf("error reloading proxy credentials: %v", err)
+		}
+	}
+
+	// everything is built, it is applied from now on, starting with the
+	// steps which may fail and are undone if a later one does
+	if endpointsChanged {
+		for i, sink := range endpoints {
+			if err := app.events.sink.Add(sink); err != nil {
+				for _, added := range endpoints[:i] {
+					app.events.sink.Remove(added)
+				}
+				closeEndpoints()
+				return fmt.Errorf("error adding notification endpoint: %v", err)
+			}
+		}
+	}
+
+	if !app.switchReadOnly(readOnly) {
+		if endpointsChanged {
+			for _, added := range endpoints {
+				app.events.sink.Remove(added)
+			}
+			closeEndpoints()
+		}
+		return fmt.Errorf("the read-only mode can not be disabled while a garbage collection is running")
+	}
+
+	if applyProxyCredentials != nil {
+		applyProxyCredentials()
+	}
+
+	app.reloadMu.Lock()
+	replacedController := app.accessController
+	app.accessController = accessController
+	app.rateLimits = rateLimits
+	app.reloadMu.Unlock()
+	if created != nil {
+		created = nil
+		closeAccessController(app, replacedController)
+	}
+
+	if endpointsChanged {
+		replaced := app.events.endpoints
+		app.events.endpoints = endpoints
+		for _, sink := range replaced {
+			if err := app.events.sink.Remove(sink); err != nil {
+				dcontext.GetLogger(app).Errorf("error removing notification endpoint: %v", err)
+			}
+		}
+		// the replaced endpoints deliver the events they queued in the
+		// background
+		go func() {
+			for _, sink := range replaced {
+				if err := sink.Close(); err != nil {
+					dcontext.GetLogger(app).Errorf("error closing notification endpoint: %v", err)
+				}
+			}
+		}()
+	}
+
+	app.reloaded = config
+	dcontext.GetLogger(app).Info("configuration reloaded")
+	return nil
+}
+
+// defaultSoftDeleteRetention is the time the soft deleted objects are kept
+// by default.
+const defaultSoftDeleteRetention = 7 * 24 * time.Hour
+
+// softDeleteRetention returns the retention of the soft deleted objects
+// configured by the softdelete parameters of the delete section, or zero if
+// soft deletion is disabled.
+func softDeleteRetention(v interface{}) (time.Duration, error) {
+	config, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return 0, fmt.Errorf("softdelete config key must contain additional keys")
+	}
+
+	if enabled, ok := config["enabled"].(bool); !ok || !enabled {
+		if _, present := config["enabled"]; present && !ok {
+			return 0, fmt.Errorf("invalid type for softdelete enabled config: %#v", config["enabled"])
+		}
+		return 0, nil
+	}
+
+	v, ok = config["retention"]
+	if !ok {
+		return defaultSoftDeleteRetention, nil
+	}
+	str, ok := v.(string)
+	if !ok {
+		return 0, fmt.Errorf("invalid type for softdelete retention config: %#v", v)
+	}
+	retention, err := time.ParseDuration(str)
+	if err != nil {
+		return 0, fmt.Errorf("invalid softdelete retention: %v", err)
+	}
+	if retention <= 0 {
+		return 0, fmt.Errorf("invalid softdelete retention: %s", str)
+	}
+	return retention, nil
+}
+
+// readOnlyEnabled returns the read-only maintenance mode of config.
+func readOnlyEnabled(config *configuration.Configuration) (bool, error) {
+	mc, ok := config.Storage["maintenance"]
+	if !ok {
+		return false, nil
+	}
+	v, ok := mc["readonly"]
+	if !ok {
+		return false, nil
+	}
+	readOnly, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return false, errors.New("readonly config key must contain additional keys")
+	}
+	enabled, ok := readOnly["enabled"]
+	if !ok {
+		return false, nil
+	}
+	readOnlyEnabled, ok := enabled.(bool)
+	if !ok {
+		return false, errors.New("readonly's enabled config key must have a boolean value")
+	}
+	return readOnlyEnabled, nil
+}
+
 // RegisterHealthChecks is an awful hack to defer health check registration
 // control to callers. This should only ever be called once per registry
 // process, typically in a main function. The correct way would be register
@@ -387,6 +1056,33 @@ func (app *App) RegisterHealthChecks(healthRegistries ...*health.Registry) {
 		}
 	}
 
+	if probe := app.Config.Health.StorageDriver.Probe; probe.Enabled {
+		interval := probe.Interval
+		if interval == 0 {
+			interval = defaultCheckInterval
+		}
+		timeout := probe.Timeout
+		if timeout == 0 {
+			timeout = defaultProbeTimeout
+		}
+		directory := probe.Directory
+		if directory == "" {
+			directory = defaultProbeDirectory
+		}
+		// each instance probes its own canary object, as several instances
+		// may share the storage
+		canary := path.Join(directory, uuid.Generate().String())
+
+		name := "storagedriver_" + app.Config.Storage.Type() + "_probe"
+		checker := checks.StorageDriverChecker(app, app.driver, canary, timeout)
+		dcontext.GetLogger(app).Infof("configuring storage driver probe path=%s, interval=%d, threshold=%d", canary, interval/time.Second, probe.Threshold)
+		if probe.Threshold != 0 {
+			healthRegistry.Register(name, health.PeriodicThresholdChecker(checker, interval, probe.Threshold))
+		} else {
+			healthRegistry.Register(name, health.PeriodicChecker(checker, interval))
+		}
+	}
+
 	for _, fileChecker := range app.Config.Health.FileCheckers {
 		interval := fileChecker.Interval
 		if interval == 0 {
@@ -440,7 +1136,7 @@ func (app *App) RegisterHealthChecks(healthRegistries ...*health.Registry) {
 // passed through the application filters and context will be constructed at
 // request time.
 func (app *App) register(routeName string, dispatch dispatchFunc) {
-	handler := app.dispatcher(dispatch)
+	handler := app.compressor.handler(routeName, app.dispatcher(dispatch))
 
 	// Chain the handler with prometheus instrumented handler
 	if app.Config.HTTP.Debug.Prometheus.Enabled {
@@ -462,24 +1158,16 @@ func (app *App) register(routeName string, dispatch dispatchFunc) {
 // configureEvents prepares the event sink for action.
 func (app *App) configureEvents(configuration *configuration.Configuration) {
 	// Configure all of the endpoint sinks.
-	var sinks []events.Sink
-	for _, endpoint := range configuration.Notifications.Endpoints {
-		if endpoint.Disabled {
-			dcontext.GetLogger(app).Infof("endpoint %s disabled, skipping", endpoint.Name)
-			continue
-		}
-
-		dcontext.GetLogger(app).Infof("configuring endpoint %v (%v), timeout=%s, headers=%v", endpoint.Name, endpoint.URL, endpoint.Timeout, endpoint.Headers)
-		endpoint := notifications.NewEndpoint(endpoint.Name, endpoint.URL, notifications.EndpointConfig{
-			Timeout:           endpoint.Timeout,
-			Threshold:         endpoint.Threshold,
-			Backoff:           endpoint.Backoff,
-			Headers:           endpoint.Headers,
-			IgnoredMediaTypes: endpoint.IgnoredMediaTypes,
-			Ignore:            endpoint.Ignore,
-		})
+	endpoints, err := app.newEndpointSinks(configuration.Notifications.Endpoints)
+	if err != nil {
+		panic(err.Error())
+	}
+	app.events.endpoints = endpoints
+	sinks := append([]events.Sink(nil), endpoints...)
 
-		sinks = append(sinks, endpoint)
+	if configuration.Notifications.Stream.Enabled {
+		app.events.stream = notifications.NewStream(configuration.Notifications.Stream.Backlog)
+		sinks = append(sinks, app.events.stream)
 	}
 
 	// NOTE(stevvooe): Moving to a new queuing implementation is as easy as
@@ -500,82 +1188,96 @@ func (app *App) configureEvents(configuration *configuration.Configuration) {
 		}
 	}
 
-	app.events.source = notifications.SourceRecord{
-		Addr:       hostname,
-		InstanceID: dcontext.GetStringValue(app, "instance.id"),
+	app.events.source = notifications.SourceRecord{
+		Addr:       hostname,
+		InstanceID: dcontext.GetStringValue(app, "instance.id"),
+	}
+}
+
+// newEndpointSinks returns the sinks delivering the events to the enabled
+// notification endpoints.
+func (app *App) newEndpointSinks(endpoints []configuration.Endpoint) ([]events.Sink, error) {
+	var sinks []events.Sink
+	for _, endpoint := range endpoints {
+		if endpoint.Disabled {
+			dcontext.GetLogger(app).Infof("endpoint %s disabled, skipping", endpoint.Name)
+			continue
+		}
+
+		endpointConfig := notifications.EndpointConfig{
+			Timeout:           endpoint.Timeout,
+			Threshold:         endpoint.Threshold,
+			Backoff:           endpoint.Backoff,
+			MaxBackoff:        endpoint.MaxBackoff,
+			MaxRetries:        endpoint.MaxRetries,
+			DeadLetter:        endpoint.DeadLetter,
+			Headers:           endpoint.Headers,
+			IgnoredMediaTypes: endpoint.IgnoredMediaTypes,
+			Ignore:            endpoint.Ignore,
+			Filter:            endpoint.Filter,
+			Format:            endpoint.Format,
+			CloudEvents:       endpoint.CloudEvents,
+			Signing:           endpoint.Signing,
+			Include:           endpoint.Include,
+			Transport:         app.transport,
+		}
+		if err := notifications.CheckFormat(endpoint.Format, endpoint.CloudEvents); err != nil {
+			return nil, fmt.Errorf("unable to configure endpoint %s: %v", endpoint.Name, err)
+		}
+
+		switch endpoint.Type {
+		case "", "http":
+			dcontext.GetLogger(app).Infof("configuring endpoint %v (%v), timeout=%s, headers=%v", endpoint.Name, endpoint.URL, endpoint.Timeout, endpoint.Headers)
+			sinks = append(sinks, notifications.NewEndpoint(endpoint.Name, endpoint.URL, endpointConfig))
+		case "kafka":
+			dcontext.GetLogger(app).Infof("configuring kafka endpoint %v (%v, topic %v), timeout=%s", endpoint.Name, endpoint.Kafka.Brokers, endpoint.Kafka.Topic, endpoint.Timeout)
+			kafkaEndpoint, err := notifications.NewKafkaEndpoint(endpoint.Name, endpoint.Kafka, endpointConfig)
+			if err != nil {
+				return nil, fmt.Errorf("unable to configure kafka endpoint %s: %v", endpoint.Name, err)
+			}
+			sinks = append(sinks, kafkaEndpoint)
+		case "nats":
+			dcontext.GetLogger(app).Infof("configuring nats endpoint %v (%v, subject %v, jetstream %t), timeout=%s", endpoint.Name, endpoint.Nats.URLs, endpoint.Nats.Subject, endpoint.Nats.JetStream, endpoint.Timeout)
+			natsEndpoint, err := notifications.NewNatsEndpoint(endpoint.Name, endpoint.Nats, endpointConfig)
+			if err != nil {
+				return nil, fmt.Errorf("unable to configure nats endpoint %s: %v", endpoint.Name, err)
+			}
+			sinks = append(sinks, natsEndpoint)
+		default:
+			return nil, fmt.Errorf("unknown type %q for endpoint %s", endpoint.Type, endpoint.Name)
+		}
+	}
+	return sinks, nil
+}
+
+// configureReplication subscribes the replicator mirroring the pushed
+// content to the remote registries, if any, to the registry events.
+func (app *App) configureReplication(configuration *configuration.Configuration) {
+	if len(configuration.Replication.Remotes) == 0 {
+		return
+	}
+
+	replicator, err := replication.New(app, app.registry, app.driver, configuration.Replication)
+	if err != nil {
+		panic(fmt.Sprintf("unable to configure replication: %v", err))
+	}
+	if err := app.events.sink.Add(replicator); err != nil {
+		panic(fmt.Sprintf("unable to configure replication: %v", err))
 	}
 }
 
 type redisStartAtKey struct{}
 
 func (app *App) configureRedis(configuration *configuration.Configuration) {
-	if configuration.Redis.Addr == "" {
+	if configuration.Redis.Addr == "" && len(configuration.Redis.Addrs) == 0 {
 		dcontext.GetLogger(app).Infof("redis not configured")
 		return
 	}
 
-	pool := &redis.Pool{
-		Dial: func() (redis.Conn, error) {
-			// TODO(stevvooe): Yet another use case for contextual timing.
-			ctx := context.WithValue(app, redisStartAtKey{}, time.Now())
-
-			done := func(err error) {
-				logger := dcontext.GetLoggerWithField(ctx, "redis.connect.duration",
-					dcontext.Since(ctx, redisStartAtKey{}))
-				if err != nil {
-					logger.Errorf("redis: error connecting: %v", err)
-				} else {
-					logger.Infof("redis: connect %v", configuration.Redis.Addr)
-				}
-			}
-
-			conn, err := redis.Dial("tcp",
-				configuration.Redis.Addr,
-				redis.DialConnectTimeout(configuration.Redis.DialTimeout),
-				redis.DialReadTimeout(configuration.Redis.ReadTimeout),
-				redis.DialWriteTimeout(configuration.Redis.WriteTimeout),
-				redis.DialUseTLS(configuration.Redis.TLS.Enabled))
-			if err != nil {
-				dcontext.GetLogger(app).Errorf("error connecting to redis instance %s: %v",
-					configuration.Redis.Addr, err)
-				done(err)
-				return nil, err
-			}
-
-			// authorize the connection
-			if configuration.Redis.Password != "" {
-				if _, err = conn.Do("AUTH", configuration.Redis.Password); err != nil {
-					defer conn.Close()
-					done(err)
-					return nil, err
-				}
-			}
-
-			// select the database to use
-			if configuration.Redis.DB != 0 {
-				if _, err = conn.Do("SELECT", configuration.Redis.DB); err != nil {
-					defer conn.Close()
-					done(err)
-					return nil, err
-				}
-			}
-
-			done(nil)
-			return conn, nil
-		},
-		MaxIdle:     configuration.Redis.Pool.MaxIdle,
-		MaxActive:   configuration.Redis.Pool.MaxActive,
-		IdleTimeout: configuration.Redis.Pool.IdleTimeout,
-		TestOnBorrow: func(c redis.Conn, t time.Time) error {
-			// TODO(stevvooe): We can probably do something more interesting
-			// here with the health package.
-			_, err := c.Do("PING")
-			return err
-		},
-		Wait: false, // if a connection is not available, proceed without cache.
-	}
+	client := NewRedisClient(configuration)
+	client.AddHook(redisLogHook{app: app})
 
-	app.redis = pool
+	app.redis = client
 
 	// setup expvar
 	registry := expvar.Get("registry")
@@ -586,11 +1288,113 @@ func (app *App) configureRedis(configuration *configuration.Configuration) {
 	registry.(*expvar.Map).Set("redis", expvar.Func(func() interface{} {
 		return map[string]interface{}{
 			"Config": configuration.Redis,
-			"Active": app.redis.ActiveCount(),
+			"Active": app.redis.PoolStats().TotalConns,
 		}
 	}))
 }
 
+// NewLocker returns the locker of the lock configuration of the storage, or
+// nil if none is configured. Locks are held in the storage driver, or in redis
+// through client.
+func NewLocker(config *configuration.Configuration, storageDriver storagedriver.StorageDriver, client redis.UniversalClient) (lock.Locker, error) {
+	params, ok := config.Storage["lock"]
+	if !ok {
+		return nil, nil
+	}
+
+	var ttl time.Duration
+	if v, ok := params["ttl"]; ok {
+		str, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("ttl is not a string")
+		}
+		var err error
+		if ttl, err = time.ParseDuration(str); err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("invalid ttl %q", str)
+		}
+	}
+
+	switch params["type"] {
+	case "redis":
+		if client == nil {
+			return nil, fmt.Errorf("redis configuration required to hold locks in redis")
+		}
+		return redislock.NewRedisLocker(client, ttl), nil
+	case "storage":
+		return storage.NewLeaseLocker(storageDriver, ttl), nil
+	default:
+		return nil, fmt.Errorf("unknown lock type %v, expected redis or storage", params["type"])
+	}
+}
+
+// NewRedisClient returns a client of the redis instance, sentinel or cluster
+// of the configuration.
+func NewRedisClient(configuration *configuration.Configuration) redis.UniversalClient {
+	addrs := configuration.Redis.Addrs
+	if len(addrs) == 0 {
+		addrs = []string{configuration.Redis.Addr}
+	}
+
+	options := &redis.UniversalOptions{
+		Addrs:            addrs,
+		MasterName:       configuration.Redis.MasterName,
+		Username:         configuration.Redis.Username,
+		Password:         configuration.Redis.Password,
+		SentinelUsername: configuration.Redis.SentinelUsername,
+		SentinelPassword: configuration.Redis.SentinelPassword,
+		DB:               configuration.Redis.DB,
+		DialTimeout:      configuration.Redis.DialTimeout,
+		ReadTimeout:      configuration.Redis.ReadTimeout,
+		WriteTimeout:     configuration.Redis.WriteTimeout,
+		MaxIdleConns:     configuration.Redis.Pool.MaxIdle,
+		PoolSize:         configuration.Redis.Pool.MaxActive,
+		ConnMaxIdleTime:  configuration.Redis.Pool.IdleTimeout,
+	}
+	if configuration.Redis.TLS.Enabled {
+		options.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+
+	switch {
+	case configuration.Redis.MasterName != "":
+		return redis.NewFailoverClient(options.Failover())
+	case configuration.Redis.Cluster:
+		return redis.NewClusterClient(options.Cluster())
+	default:
+		return redis.NewClient(options.Simple())
+	}
+}
+
+// redisLogHook logs the connections made by the redis client.
+type redisLogHook struct {
+	app *App
+}
+
+func (h redisLogHook) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		// TODO(stevvooe): Yet another use case for contextual timing.
+		logCtx := context.WithValue(h.app, redisStartAtKey{}, time.Now())
+
+		conn, err := next(ctx, network, addr)
+
+		logger := dcontext.GetLoggerWithField(logCtx, "redis.connect.duration",
+			dcontext.Since(logCtx, redisStartAtKey{}))
+		if err != nil {
+			logger.Errorf("redis: error connecting to redis instance %s: %v", addr, err)
+		} else {
+			logger.Infof("redis: connect %v", addr)
+		}
+		return conn, err
+	}
+}
+
+func (h redisLogHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return next
+}
+
+func (h redisLogHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
 // configureLogHook prepares logging hook parameters.
 func (app *App) configureLogHook(configuration *configuration.Configuration) {
 	entry, ok := dcontext.GetLogger(app).(*logrus.Entry)
@@ -622,10 +1426,20 @@ func (app *App) configureLogHook(configuration *configuration.Configuration) {
 	}
 }
 
-// configureSecret creates a random secret if a secret wasn't included in the
-// configuration.
-func (app *App) configureSecret(configuration *configuration.Configuration) {
+// configureSecret uses the upload secret saved in the storage if a secret
+// wasn't included in the configuration, so that uploads may be resumed on
+// any instance sharing the storage. The secret is generated under the lock
+// of locker, if any. A random secret is created if it cannot be saved.
+func (app *App) configureSecret(configuration *configuration.Configuration, locker lock.Locker) {
 	if configuration.HTTP.Secret == "" {
+		secret, err := storage.UploadSecret(app, app.driver, locker)
+		if err == nil {
+			configuration.HTTP.Secret = secret
+			dcontext.GetLogger(app).Info("No HTTP secret provided - using the upload secret saved in the storage.")
+			return
+		}
+		dcontext.GetLogger(app).Warnf("could not use the upload secret saved in the storage: %v", err)
+
 		var secretBytes [randomSecretSize]byte
 		if _, err := rand.Read(secretBytes[:]); err != nil {
 			panic(fmt.Sprintf("could not generate random bytes for HTTP secret: %v", err))
@@ -643,6 +1457,9 @@ func (app *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx = dcontext.WithRequest(ctx, r)
 	ctx, w = dcontext.WithResponseWriter(ctx, w)
 	ctx = dcontext.WithLogger(ctx, dcontext.GetRequestLogger(ctx))
+	ctx = withCorrelationID(ctx, w, r)
+	ctx = dcontext.WithClientIP(ctx, app.clientIP(r))
+	ctx, completeAudit := app.startAudit(ctx, r)
 	r = r.WithContext(ctx)
 
 	defer func() {
@@ -650,6 +1467,7 @@ func (app *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		if ok && status >= 200 && status <= 399 {
 			dcontext.GetResponseLogger(r.Context()).Infof("response completed")
 		}
+		completeAudit()
 	}()
 
 	// Set a header with the Docker Distribution API Version for all responses.
@@ -676,8 +1494,24 @@ func (app *App) dispatcher(dispatch dispatchFunc) http.Handler {
 			}
 		}
 
+		defer app.applyClassTimeouts(r)()
+
 		context := app.context(w, r)
 
+		// name the request span after the route rather than the path,
+		// which holds repository names and digests.
+		span := trace.SpanFromContext(context)
+		if route := mux.CurrentRoute(r); route != nil {
+			span.SetName(r.Method + " " + route.GetName())
+		}
+		auditRequest(context, r)
+
+		// limits by address apply before authorization, so that they also
+		// protect against brute force attempts
+		if app.rateLimited(context, w, r, rateLimitKeyIP) {
+			return
+		}
+
 		if err := app.authorized(w, r, context); err != nil {
 			dcontext.GetLogger(context).Warnf("error authorizing context: %v", err)
 			return
@@ -685,6 +1519,27 @@ func (app *App) dispatcher(dispatch dispatchFunc) http.Handler {
 
 		// Add username to request logging
 		context.Context = dcontext.WithLogger(context.Context, dcontext.GetLogger(context.Context, auth.UserNameKey))
+		auditActor(context)
+
+		// limits by repository only apply after authorization, so that the
+		// clients denied access to a repository cannot drain its limits
+		if app.rateLimited(context, w, r, rateLimitKeyUser, rateLimitKeyRepository) {
+			return
+		}
+
+		release, limited := app.uploadLimited(context, w, r)
+		if limited {
+			return
+		}
+		defer release()
+
+		if err := app.tenantRoot(context); err != nil {
+			context.Errors = append(context.Errors, err)
+			if err := errcode.ServeJSON(w, context.Errors); err != nil {
+				dcontext.GetLogger(context).Errorf("error serving error json: %v (from %v)", err, context.Errors)
+			}
+			return
+		}
 
 		// sync up context on the request.
 		r = r.WithContext(context)
@@ -702,6 +1557,31 @@ func (app *App) dispatcher(dispatch dispatchFunc) http.Handler {
 				}
 				return
 			}
+			span.SetAttributes(attribute.String("registry.repository", nameRef.Name()))
+
+			context.namespace = app.namespaces.settings(nameRef.Name())
+			if err := namespaceDenied(context.namespace, r, nameRef.Name()); err != nil {
+				context.Errors = append(context.Errors, err)
+				if err := errcode.ServeJSON(w, context.Errors); err != nil {
+					dcontext.GetLogger(context).Errorf("error serving error json: %v (from %v)", err, context.Errors)
+				}
+				return
+			}
+			if err := app.mountSourceDenied(r); err != nil {
+				context.Errors = append(context.Errors, err)
+				if err := errcode.ServeJSON(w, context.Errors); err != nil {
+					dcontext.GetLogger(context).Errorf("error serving error json: %v (from %v)", err, context.Errors)
+				}
+				return
+			}
+			if err := app.frozenDenied(context, r, nameRef); err != nil {
+				context.Errors = append(context.Errors, err)
+				if err := errcode.ServeJSON(w, context.Errors); err != nil {
+					dcontext.GetLogger(context).Errorf("error serving error json: %v (from %v)", err, context.Errors)
+				}
+				return
+			}
+
 			repository, err := app.registry.Repository(context, nameRef)
 
 			if err != nil {
@@ -745,11 +1625,15 @@ func (app *App) dispatcher(dispatch dispatchFunc) http.Handler {
 		// own errors if they need different behavior (such as range errors
 		// for layer upload).
 		if context.Errors.Len() > 0 {
+			if app.aliasRedirected(context, w, r) {
+				return
+			}
 			if err := errcode.ServeJSON(w, context.Errors); err != nil {
 				dcontext.GetLogger(context).Errorf("error serving error json: %v (from %v)", err, context.Errors)
 			}
 
 			app.logError(context, context.Errors)
+			auditErrors(context)
 		}
 	})
 }
@@ -827,18 +1711,30 @@ func (app *App) authorized(w http.ResponseWriter, r *http.Request, context *Cont
 	dcontext.GetLogger(context).Debug("authorizing request")
 	repo := getName(context)
 
-	if app.accessController == nil {
+	accessController := app.getAccessController()
+	if accessController == nil {
 		return nil // access controller is not enabled.
 	}
 
 	var accessRecords []auth.Access
+	var sourceRecords int // access records of the source repository of a mount
 
 	if repo != "" {
-		accessRecords = appendAccessRecords(accessRecords, r.Method, repo)
+		switch mux.CurrentRoute(r).GetName() {
+		case v2.RouteNameRepository:
+			accessRecords = appendRepositoryAccessRecord(accessRecords, r.Method, repo)
+		case v2.RouteNameBlobsExist:
+			// checking the existence of blobs only reads the repository
+			accessRecords = appendAccessRecords(accessRecords, "GET", repo)
+		default:
+			accessRecords = appendAccessRecords(accessRecords, r.Method, repo)
+		}
 		if fromRepo := r.FormValue("from"); fromRepo != "" {
-			// mounting a blob from one repository to another requires pull (GET)
-			// access to the source repository.
+			// mounting a blob or a manifest from one repository to another
+			// requires pull (GET) access to the source repository.
+			n := len(accessRecords)
 			accessRecords = appendAccessRecords(accessRecords, "GET", fromRepo)
+			sourceRecords = len(accessRecords) - n
 		}
 	} else {
 		// Only allow the name not to be set on the base route.
@@ -855,9 +1751,17 @@ func (app *App) authorized(w http.ResponseWriter, r *http.Request, context *Cont
 			return fmt.Errorf("forbidden: no repository name")
 		}
 		accessRecords = appendCatalogAccessRecord(accessRecords, r)
+		accessRecords = appendAdminAccessRecord(accessRecords, r)
 	}
 
-	ctx, err := app.accessController.Authorized(context.Context, accessRecords...)
+	ctx, err := accessController.Authorized(context.Context, accessRecords...)
+	if err != nil && sourceRecords > 0 && mux.CurrentRoute(r).GetName() == v2.RouteNameBlobUpload && app.Config.Policy.Mount.Fallback {
+		// The mount falls back to the blobs of the registry, which does
+		// not require access to the source repository.
+		if fallbackCtx, fallbackErr := accessController.Authorized(context.Context, accessRecords[:len(accessRecords)-sourceRecords]...); fallbackErr == nil {
+			ctx, err = fallbackCtx, nil
+		}
+	}
 	if err != nil {
 		switch err := err.(type) {
 		case auth.Challenge:
@@ -898,6 +1802,17 @@ func (app *App) eventBridge(ctx *Context, r *http.Request) notifications.Listene
 	return notifications.NewBridge(ctx.urlBuilder, app.events.source, actor, request, app.events.sink, app.Config.Notifications.EventConfig.IncludeReferences)
 }
 
+// retentionBridge returns a bridge for the removals of the retention
+// policies, which are made by no request.
+func (app *App) retentionBridge() notifications.Listener {
+	actor := notifications.ActorRecord{
+		Name: "retention",
+	}
+	ub := v2.NewURLBuilder(&app.httpHost, false)
+
+	return notifications.NewBridge(ub, app.events.source, actor, notifications.RequestRecord{}, app.events.sink, app.Config.Notifications.EventConfig.IncludeReferences)
+}
+
 // nameRequired returns true if the route requires a name.
 func (app *App) nameRequired(r *http.Request) bool {
 	route := mux.CurrentRoute(r)
@@ -905,7 +1820,7 @@ func (app *App) nameRequired(r *http.Request) bool {
 		return true
 	}
 	routeName := route.GetName()
-	return routeName != v2.RouteNameBase && routeName != v2.RouteNameCatalog
+	return routeName != v2.RouteNameBase && routeName != v2.RouteNameCatalog && routeName != v2.RouteNameCatalogActivity && routeName != v2.RouteNameEvents && !isAdminRoute(routeName)
 }
 
 // apiBase implements a simple yes-man for doing overall checks against the
@@ -953,12 +1868,29 @@ func appendAccessRecords(records []auth.Access, method string, repo string) []au
 	return records
 }
 
+// appendRepositoryAccessRecord adds the access record required to operate on
+// the repository as a whole. Deleting a repository requires the purge action,
+// so that it can be granted separately from deleting single manifests.
+func appendRepositoryAccessRecord(records []auth.Access, method string, repo string) []auth.Access {
+	if method == "DELETE" {
+		records = append(records,
+			auth.Access{
+				Resource: auth.Resource{
+					Type: "repository",
+					Name: repo,
+				},
+				Action: "purge",
+			})
+	}
+	return records
+}
+
 // Add the access record for the catalog if it's our current route
 func appendCatalogAccessRecord(accessRecords []auth.Access, r *http.Request) []auth.Access {
 	route := mux.CurrentRoute(r)
 	routeName := route.GetName()
 
-	if routeName == v2.RouteNameCatalog {
+	if routeName == v2.RouteNameCatalog || routeName == v2.RouteNameCatalogActivity || routeName == v2.RouteNameEvents {
 		resource := auth.Resource{
 			Type: "registry",
 			Name: "catalog",
@@ -998,8 +1930,8 @@ func applyRepoMiddleware(ctx context.Context, repository distribution.Repository
 	return repository, nil
 }
 
-// applyStorageMiddleware wraps a storage driver with the configured middlewares
-func applyStorageMiddleware(driver storagedriver.StorageDriver, middlewares []configuration.Middleware) (storagedriver.StorageDriver, error) {
+// ApplyStorageMiddleware wraps a storage driver with the configured middlewares
+func ApplyStorageMiddleware(driver storagedriver.StorageDriver, middlewares []configuration.Middleware) (storagedriver.StorageDriver, error) {
 	for _, mw := range middlewares {
 		smw, err := storagemiddleware.Get(mw.Name, mw.Options, driver)
 		if err != nil {
@@ -1061,6 +1993,9 @@ func startUploadPurger(ctx context.Context, storageDriver storagedriver.StorageD
 		if err != nil {
 			badPurgeUploadConfig(fmt.Sprintf("Cannot parse interval: %s", err.Error()))
 		}
+		if intervalDuration <= 0 {
+			badPurgeUploadConfig(fmt.Sprintf("interval must be positive: %s", intervalStr))
+		}
 	} else {
 		badPurgeUploadConfig("interval missing")
 	}
@@ -1076,6 +2011,24 @@ func startUploadPurger(ctx context.Context, storageDriver storagedriver.StorageD
 		badPurgeUploadConfig("dryrun missing")
 	}
 
+	policies := []storage.UploadPurgePolicy{}
+	if v, ok := config["policies"]; ok {
+		list, ok := v.([]interface{})
+		if !ok {
+			badPurgeUploadConfig("policies is not a list")
+		}
+		for _, item := range list {
+			policies = append(policies, parseUploadPurgePolicy(item, purgeAgeDuration, intervalDuration))
+		}
+	}
+	// the global settings apply to the repositories matching no policy
+	policies = append(policies, storage.UploadPurgePolicy{
+		Name:     "default",
+		Age:      purgeAgeDuration,
+		Interval: intervalDuration,
+	})
+	purger := storage.NewUploadPurger(storageDriver, policies, dryRunBool)
+
 	go func() {
 		randInt, err := rand.Int(rand.Reader, new(big.Int).SetInt64(math.MaxInt64))
 		if err != nil {
@@ -1088,9 +2041,324 @@ func startUploadPurger(ctx context.Context, storageDriver storagedriver.StorageD
 		time.Sleep(jitter)
 
 		for {
-			storage.PurgeUploads(ctx, storageDriver, time.Now().Add(-purgeAgeDuration), !dryRunBool)
-			log.Infof("Starting upload purge in %s", intervalDuration)
+			next, err := purger.Purge(ctx)
+			if err != nil {
+				log.Errorf("upload purge failed: %v", err)
+				next = intervalDuration
+			}
+			log.Infof("Starting upload purge in %s", next)
+			time.Sleep(next)
+		}
+	}()
+}
+
+// parseUploadPurgePolicy parses an entry of the upload purging policies,
+// whose age and interval default to the global ones.
+func parseUploadPurgePolicy(item interface{}, age, interval time.Duration) storage.UploadPurgePolicy {
+	config, ok := item.(map[interface{}]interface{})
+	if !ok {
+		badPurgeUploadConfig("policy is not a map")
+	}
+
+	parseDuration := func(key string, d time.Duration) time.Duration {
+		v, ok := config[key]
+		if !ok {
+			return d
+		}
+		str, ok := v.(string)
+		if !ok {
+			badPurgeUploadConfig(fmt.Sprintf("policy %s is not a string", key))
+		}
+		d, err := time.ParseDuration(str)
+		if err != nil {
+			badPurgeUploadConfig(fmt.Sprintf("Cannot parse policy %s: %s", key, err.Error()))
+		}
+		return d
+	}
+
+	list, ok := config["repositories"].([]interface{})
+	if !ok || len(list) == 0 {
+		badPurgeUploadConfig("policy repositories missing")
+	}
+	match, err := parsePatterns(list)
+	if err != nil {
+		badPurgeUploadConfig(fmt.Sprintf("invalid policy repositories: %v", err))
+	}
+
+	policyInterval := parseDuration("interval", interval)
+	if policyInterval <= 0 {
+		badPurgeUploadConfig(fmt.Sprintf("policy interval must be positive: %s", policyInterval))
+	}
+
+	return storage.UploadPurgePolicy{
+		// the last run of a policy is recorded under the digest of its
+		// patterns, which survives reordering the policies
+		Name:     digest.FromString(fmt.Sprint(list)).Encoded(),
+		Match:    match,
+		Age:      parseDuration("age", age),
+		Interval: policyInterval,
+	}
+}
+
+// parsePatterns parses a list of patterns, either globs or regular
+// expressions prefixed with regexp:, into a function reporting whether a
+// string matches any of them.
+func parsePatterns(list []interface{}) (func(string) bool, error) {
+	patterns := make([]string, 0, len(list))
+	for _, item := range list {
+		pattern, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("pattern %v is not a string", item)
+		}
+		patterns = append(patterns, pattern)
+	}
+
+	matchers, err := configuration.NewRepositoryMatchers(patterns)
+	if err != nil {
+		return nil, err
+	}
+	return matchers.MatchAny, nil
+}
+
+// blobCacheControl converts the Cache-Control configuration of blob
+// responses, defaulting unset max-age directives to the registry wide one.
+func blobCacheControl(config configuration.CacheControl) (storage.CacheControl, map[string]storage.CacheControl) {
+	maxAge := config.MaxAge
+	if maxAge == 0 {
+		maxAge = 365 * 24 * time.Hour
+	}
+
+	cacheControl := storage.CacheControl{
+		MaxAge:    maxAge,
+		Immutable: config.Immutable,
+		NoStore:   config.NoStore,
+	}
+
+	var mediaTypes map[string]storage.CacheControl
+	for mediaType, policy := range config.MediaTypes {
+		if mediaTypes == nil {
+			mediaTypes = make(map[string]storage.CacheControl, len(config.MediaTypes))
+		}
+
+		mediaTypeMaxAge := policy.MaxAge
+		if mediaTypeMaxAge == 0 {
+			mediaTypeMaxAge = maxAge
+		}
+		mediaTypes[mediaType] = storage.CacheControl{
+			MaxAge:    mediaTypeMaxAge,
+			Immutable: policy.Immutable,
+			NoStore:   policy.NoStore,
+		}
+	}
+
+	return cacheControl, mediaTypes
+}
+
+func onlineGCDefaultConfig() map[interface{}]interface{} {
+	config := map[interface{}]interface{}{}
+	config["enabled"] = false
+	config["interval"] = "24h"
+	config["graceperiod"] = "1h"
+	config["dryrun"] = false
+	return config
+}
+
+func badOnlineGCConfig(reason string) {
+	panic(fmt.Sprintf("Unable to parse online garbage collection configuration: %s", reason))
+}
+
+// startOnlineGC schedules a goroutine which will periodically remove
+// unreferenced blobs while the registry keeps accepting pushes. Collections
+// are skipped while readOnly reports the registry is in read-only mode, as
+// the storage may then be collected or migrated by another process.
+func startOnlineGC(ctx context.Context, storageDriver storagedriver.StorageDriver, registry distribution.Namespace, log dcontext.Logger, config map[interface{}]interface{}, readOnly func() bool) {
+	if config["enabled"] != true {
+		return
+	}
+
+	parseDuration := func(key string) time.Duration {
+		v, ok := config[key]
+		if !ok {
+			badOnlineGCConfig(fmt.Sprintf("%s missing", key))
+		}
+		str, ok := v.(string)
+		if !ok {
+			badOnlineGCConfig(fmt.Sprintf("%s is not a string", key))
+		}
+		d, err := time.ParseDuration(str)
+		if err != nil {
+			badOnlineGCConfig(fmt.Sprintf("Cannot parse %s: %s", key, err.Error()))
+		}
+		return d
+	}
+
+	intervalDuration := parseDuration("interval")
+	if intervalDuration <= 0 {
+		badOnlineGCConfig(fmt.Sprintf("interval must be positive: %s", intervalDuration))
+	}
+	gracePeriod := parseDuration("graceperiod")
+
+	dryRunBool, ok := config["dryrun"].(bool)
+	if _, present := config["dryrun"]; present && !ok {
+		badOnlineGCConfig("cannot parse dryrun")
+	}
+
+	opts := storage.OnlineGCOpts{
+		GracePeriod: gracePeriod,
+		DryRun:      dryRunBool,
+	}
+
+	go func() {
+		for {
+			log.Infof("Starting online garbage collection in %s", intervalDuration)
+			time.Sleep(intervalDuration)
+
+			if readOnly() {
+				log.Infof("Skipping online garbage collection in read-only mode")
+				continue
+			}
+			if err := storage.OnlineMarkAndSweep(ctx, storageDriver, registry, opts); err != nil {
+				log.Errorf("online garbage collection failed: %v", err)
+			}
+		}
+	}()
+}
+
+func badRetentionConfig(reason string) {
+	panic(fmt.Sprintf("Unable to parse retention configuration: %s", reason))
+}
+
+// startRetention schedules a goroutine which will periodically apply the
+// retention policies, notifying listener of the tags and manifests removed.
+// Runs are skipped while readOnly reports the registry is in read-only mode.
+func startRetention(ctx context.Context, storageDriver storagedriver.StorageDriver, registry distribution.Namespace, log dcontext.Logger, config map[interface{}]interface{}, readOnly func() bool, listener storage.RetentionListener) {
+	if config["enabled"] != true {
+		return
+	}
+
+	intervalDuration := 24 * time.Hour
+	if v, ok := config["interval"]; ok {
+		str, ok := v.(string)
+		if !ok {
+			badRetentionConfig("interval is not a string")
+		}
+		d, err := time.ParseDuration(str)
+		if err != nil {
+			badRetentionConfig(fmt.Sprintf("Cannot parse interval: %s", err.Error()))
+		}
+		if d <= 0 {
+			badRetentionConfig(fmt.Sprintf("interval must be positive: %s", str))
+		}
+		intervalDuration = d
+	}
+
+	dryRunBool, ok := config["dryrun"].(bool)
+	if _, present := config["dryrun"]; present && !ok {
+		badRetentionConfig("cannot parse dryrun")
+	}
+
+	list, ok := config["policies"].([]interface{})
+	if !ok || len(list) == 0 {
+		badRetentionConfig("policies missing")
+	}
+	var policies []storage.RetentionPolicy
+	for _, item := range list {
+		policies = append(policies, parseRetentionPolicy(item))
+	}
+
+	opts := storage.RetentionOpts{
+		DryRun:   dryRunBool,
+		Listener: listener,
+	}
+
+	go func() {
+		for {
+			log.Infof("Applying retention policies in %s", intervalDuration)
 			time.Sleep(intervalDuration)
+
+			if readOnly() {
+				log.Infof("Skipping retention policies in read-only mode")
+				continue
+			}
+			if err := storage.ApplyRetention(ctx, storageDriver, registry, policies, opts); err != nil {
+				log.Errorf("retention failed: %v", err)
+			}
 		}
 	}()
 }
+
+// parseRetentionPolicy parses an entry of the retention policies.
+func parseRetentionPolicy(item interface{}) storage.RetentionPolicy {
+	config, ok := item.(map[interface{}]interface{})
+	if !ok {
+		badRetentionConfig("policy is not a map")
+	}
+
+	parseDuration := func(key string) time.Duration {
+		v, ok := config[key]
+		if !ok {
+			return 0
+		}
+		str, ok := v.(string)
+		if !ok {
+			badRetentionConfig(fmt.Sprintf("policy %s is not a string", key))
+		}
+		d, err := time.ParseDuration(str)
+		if err != nil || d < 0 {
+			badRetentionConfig(fmt.Sprintf("Cannot parse policy %s: %v", key, v))
+		}
+		return d
+	}
+
+	var policy storage.RetentionPolicy
+	list, ok := config["repositories"].([]interface{})
+	if !ok || len(list) == 0 {
+		badRetentionConfig("policy repositories missing")
+	}
+	match, err := parsePatterns(list)
+	if err != nil {
+		badRetentionConfig(fmt.Sprintf("invalid policy repositories: %v", err))
+	}
+	policy.Match = match
+
+	if v, ok := config["tags"]; ok {
+		list, ok := v.([]interface{})
+		if !ok || len(list) == 0 {
+			badRetentionConfig("policy tags is not a list")
+		}
+		match, err := parsePatterns(list)
+		if err != nil {
+			badRetentionConfig(fmt.Sprintf("invalid policy tags: %v", err))
+		}
+		policy.MatchTag = match
+	}
+
+	if v, ok := config["keeplast"]; ok {
+		n, ok := v.(int)
+		if !ok || n < 0 {
+			badRetentionConfig(fmt.Sprintf("policy keeplast is not a positive integer: %v", v))
+		}
+		policy.KeepLast = n
+	}
+	policy.MaxAge = parseDuration("maxage")
+	policy.UntaggedMaxAge = parseDuration("untaggedmaxage")
+
+	if v, ok := config["independentartifacttypes"]; ok {
+		list, ok := v.([]interface{})
+		if !ok {
+			badRetentionConfig("policy independentartifacttypes is not a list")
+		}
+		for _, item := range list {
+			artifactType, ok := item.(string)
+			if !ok || artifactType == "" {
+				badRetentionConfig(fmt.Sprintf("policy independentartifacttypes contains an invalid type: %v", item))
+			}
+			policy.IndependentArtifactTypes = append(policy.IndependentArtifactTypes, artifactType)
+		}
+	}
+
+	if policy.KeepLast == 0 && policy.MaxAge == 0 && policy.UntaggedMaxAge == 0 {
+		badRetentionConfig("policy must set keeplast, maxage or untaggedmaxage")
+	}
+	return policy
+}
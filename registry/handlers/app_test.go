@@ -39,7 +39,9 @@ func TestAppDispatcher(t *testing.T) {
 	}
 	server := httptest.NewServer(app)
 	defer server.Close()
-	router := v2.Router()
+	// a router of its own, as setting the host of its routes would affect
+	// the urls built by other tests
+	router := v2.RouterWithPrefix("")
 
 	serverURL, err := url.Parse(server.URL)
 	if err != nil {
@@ -277,3 +279,199 @@ func TestAppendAccessRecords(t *testing.T) {
 	}
 
 }
+
+// TestReloadConfiguration checks that the rate limits, the notification
+// endpoints and the access controller follow the reloaded configuration, and
+// that an invalid configuration leaves them unchanged.
+func TestReloadConfiguration(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	config.RateLimit.Limits = []configuration.RateLimitRule{
+		{Class: "catalog", Key: "ip", Rate: 0.01, Burst: 1},
+	}
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	catalogURL, err := env.builder.BuildCatalogURL()
+	checkErr(t, err, "building catalog url")
+	get := func(expectedStatus int) {
+		t.Helper()
+		resp, err := http.Get(catalogURL)
+		checkErr(t, err, "issuing request")
+		defer resp.Body.Close()
+		checkResponse(t, "listing catalog", resp, expectedStatus)
+	}
+
+	get(http.StatusOK)
+	get(http.StatusTooManyRequests)
+
+	// an invalid configuration is not applied at all
+	invalid := config
+	invalid.RateLimit.Limits = nil
+	invalid.Notifications.Endpoints = []configuration.Endpoint{{Name: "invalid", Type: "carrier-pigeon"}}
+	if err := env.app.ReloadConfiguration(&invalid); err == nil {
+		t.Fatal("expected an error reloading an unknown endpoint type")
+	}
+	get(http.StatusTooManyRequests)
+
+	invalid = config
+	invalid.Auth = configuration.Auth{"silly": {"realm": "realm-test", "service": "service-test"}}
+	if err := env.app.ReloadConfiguration(&invalid); err == nil {
+		t.Fatal("expected an error enabling auth while running")
+	}
+
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer endpoint.Close()
+	reloaded := config
+	reloaded.RateLimit.Limits = nil
+	reloaded.Notifications.Endpoints = []configuration.Endpoint{{Name: "reloaded", URL: endpoint.URL}}
+	if err := env.app.ReloadConfiguration(&reloaded); err != nil {
+		t.Fatalf("unexpected error reloading configuration: %v", err)
+	}
+	get(http.StatusOK)
+	get(http.StatusOK)
+	if len(env.app.events.endpoints) != 1 {
+		t.Fatalf("unexpected endpoints after reload: %v", env.app.events.endpoints)
+	}
+
+	// the endpoints are replaced only when they change
+	endpoints := env.app.events.endpoints
+	if err := env.app.ReloadConfiguration(&reloaded); err != nil {
+		t.Fatalf("unexpected error reloading configuration: %v", err)
+	}
+	if env.app.events.endpoints[0] != endpoints[0] {
+		t.Fatal("unexpected replacement of an unchanged endpoint")
+	}
+}
+
+// closingController is an access controller counting how many times it is
+// closed in its closed option.
+type closingController struct {
+	deniedRepositoriesController
+	closed *int
+}
+
+func (c closingController) Close() error {
+	*c.closed++
+	return nil
+}
+
+func init() {
+	auth.Register("closing", auth.InitFunc(func(options map[string]interface{}) (auth.AccessController, error) {
+		return closingController{closed: options["closed"].(*int)}, nil
+	}))
+}
+
+// TestReloadConfigurationCloses checks that the access controller created
+// for a configuration which is not applied is closed, as is the one replaced
+// by a configuration applied.
+func TestReloadConfigurationCloses(t *testing.T) {
+	var closed int
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+		Auth: configuration.Auth{"closing": {"closed": &closed}},
+	}
+	app := NewApp(context.Background(), &config)
+	accessController := app.getAccessController()
+
+	invalid := config
+	invalid.Auth = configuration.Auth{"closing": {"closed": &closed, "reloaded": true}}
+	invalid.Notifications.Endpoints = []configuration.Endpoint{{Name: "invalid", Type: "carrier-pigeon"}}
+	if err := app.ReloadConfiguration(&invalid); err == nil {
+		t.Fatal("expected an error reloading an unknown endpoint type")
+	}
+	if closed != 1 {
+		t.Fatalf("expected the access controller not applied to be closed once, got %d", closed)
+	}
+	if app.getAccessController() != accessController {
+		t.Fatal("unexpected replacement of the access controller")
+	}
+
+	// a configuration refused once built is not applied either
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer endpoint.Close()
+	app.gc.runs["/"] = &gcRun{status: gcStatus{State: gcStateRunning}}
+	refused := config
+	refused.Auth = invalid.Auth
+	refused.Notifications.Endpoints = []configuration.Endpoint{{Name: "refused", URL: endpoint.URL}}
+	if err := app.ReloadConfiguration(&refused); err == nil {
+		t.Fatal("expected an error disabling the read-only mode during a garbage collection")
+	}
+	if closed != 2 {
+		t.Fatalf("expected the access controller not applied to be closed, got %d closes", closed)
+	}
+	if app.getAccessController() != accessController || len(app.events.endpoints) != 0 {
+		t.Fatal("unexpected partial application of a refused configuration")
+	}
+	delete(app.gc.runs, "/")
+
+	reloaded := config
+	reloaded.Auth = invalid.Auth
+	if err := app.ReloadConfiguration(&reloaded); err != nil {
+		t.Fatalf("unexpected error reloading configuration: %v", err)
+	}
+	if closed != 3 {
+		t.Fatalf("expected the replaced access controller to be closed, got %d closes", closed)
+	}
+}
+
+func TestUploadPurgeIntervals(t *testing.T) {
+	for _, config := range []map[interface{}]interface{}{
+		{"enabled": true, "age": "168h", "interval": "0s", "dryrun": false},
+		{"enabled": true, "age": "168h", "interval": "-1h", "dryrun": false},
+		{"enabled": true, "age": "168h", "interval": "24h", "dryrun": false, "policies": []interface{}{
+			map[interface{}]interface{}{"repositories": []interface{}{"ci/*"}, "interval": "0s"},
+		}},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected the upload purge configuration %v to be refused", config)
+				}
+			}()
+			startUploadPurger(context.Background(), testdriver.New(), context.GetLogger(context.Background()), config)
+		}()
+	}
+}
+
+func TestMaintenanceIntervals(t *testing.T) {
+	ctx := context.Background()
+	readOnly := func() bool { return false }
+	for _, interval := range []string{"0s", "-1h"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected the online garbage collection interval %s to be refused", interval)
+				}
+			}()
+			startOnlineGC(ctx, testdriver.New(), nil, context.GetLogger(ctx), map[interface{}]interface{}{
+				"enabled": true, "interval": interval, "graceperiod": "1h",
+			}, readOnly)
+		}()
+
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected the retention interval %s to be refused", interval)
+				}
+			}()
+			startRetention(ctx, testdriver.New(), nil, context.GetLogger(ctx), map[interface{}]interface{}{
+				"enabled": true, "interval": interval, "policies": []interface{}{
+					map[interface{}]interface{}{"repositories": []interface{}{"*"}, "keeplast": 1},
+				},
+			}, readOnly, nil)
+		}()
+	}
+}
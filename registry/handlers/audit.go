@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/distribution/distribution/v3/registry/auditlog"
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/gorilla/mux"
+	"github.com/opencontainers/go-digest"
+)
+
+// correlationIDHeader carries the id correlating the logs of a request, which
+// clients may set to follow their requests in the registry logs.
+const correlationIDHeader = "X-Correlation-ID"
+
+// maxCorrelationIDLength bounds the correlation ids accepted from clients.
+const maxCorrelationIDLength = 128
+
+// correlationIDKey is the context key of the correlation id, which is also
+// the name of the field of the logs.
+const correlationIDKey = "correlation.id"
+
+// configureAuditLog opens the sink of the audit log, if enabled.
+func (app *App) configureAuditLog(config *configuration.Configuration) {
+	if !config.Log.AuditLog.Enabled {
+		return
+	}
+
+	logger, err := auditlog.New(config.Log.AuditLog)
+	if err != nil {
+		panic(err)
+	}
+	app.auditLog = logger
+}
+
+// withCorrelationID adds the correlation id of the request to the context
+// and its logger, so that the logs of the storage drivers carry it too. The
+// id is echoed in the response.
+func withCorrelationID(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
+	id := r.Header.Get(correlationIDHeader)
+	if id == "" || len(id) > maxCorrelationIDLength {
+		id = dcontext.GetRequestID(ctx)
+	}
+	w.Header().Set(correlationIDHeader, id)
+
+	ctx = context.WithValue(ctx, correlationIDKey, id)
+	return dcontext.WithLogger(ctx, dcontext.GetLogger(ctx, correlationIDKey))
+}
+
+// startAudit creates the audit record of the request, if audited, and counts
+// the bytes read from the request body. The record is completed by the
+// dispatcher and the returned function, which writes it.
+func (app *App) startAudit(ctx context.Context, r *http.Request) (context.Context, func()) {
+	if app.auditLog == nil {
+		return ctx, func() {}
+	}
+
+	record := &auditlog.Record{
+		Time:          time.Now().UTC(),
+		CorrelationID: dcontext.GetStringValue(ctx, correlationIDKey),
+		RequestID:     dcontext.GetRequestID(ctx),
+		Actor: auditlog.ActorRecord{
+			Addr:      app.clientIP(r),
+			UserAgent: r.UserAgent(),
+		},
+		Method: r.Method,
+	}
+	r.Body = &countingReadCloser{ReadCloser: r.Body, n: &record.BytesIn}
+
+	return auditlog.WithRecord(ctx, record), func() {
+		record.Status, _ = ctx.Value("http.response.status").(int)
+		record.BytesOut, _ = ctx.Value("http.response.written").(int64)
+		record.Duration = time.Since(record.Time).Milliseconds()
+		if err := app.auditLog.Log(record); err != nil {
+			dcontext.GetLogger(ctx).Errorf("error writing audit record: %v", err)
+		}
+	}
+}
+
+// auditRequest records the route and targets of the request in its audit
+// record, if any.
+func auditRequest(ctx *Context, r *http.Request) {
+	record := auditlog.GetRecord(ctx)
+	if record == nil {
+		return
+	}
+
+	if route := mux.CurrentRoute(r); route != nil {
+		record.Route = route.GetName()
+		record.Action = auditAction(record.Route, r)
+	}
+	record.Repository = getName(ctx)
+
+	if ref := getReference(ctx); ref != "" {
+		if _, err := digest.Parse(ref); err == nil {
+			record.Digest = ref
+		} else {
+			record.Tag = ref
+		}
+	}
+	if dgst := dcontext.GetStringValue(ctx, "vars.digest"); dgst != "" {
+		record.Digest = dgst
+	}
+}
+
+// auditActor records the authenticated user in the audit record of the
+// request, if any.
+func auditActor(ctx *Context) {
+	if record := auditlog.GetRecord(ctx); record != nil {
+		record.Actor.Name = dcontext.GetStringValue(ctx, auth.UserNameKey)
+	}
+}
+
+// auditErrors records the codes of the errors returned in the audit record
+// of the request, if any.
+func auditErrors(ctx *Context) {
+	record := auditlog.GetRecord(ctx)
+	if record == nil {
+		return
+	}
+
+	for _, err := range ctx.Errors {
+		switch err := err.(type) {
+		case errcode.Error:
+			record.Errors = append(record.Errors, err.Code.String())
+		case errcode.ErrorCode:
+			record.Errors = append(record.Errors, err.String())
+		default:
+			record.Errors = append(record.Errors, errcode.ErrorCodeUnknown.String())
+		}
+	}
+}
+
+// auditAction returns the action of a request to the given route.
+func auditAction(route string, r *http.Request) string {
+	switch route {
+	case v2.RouteNameBase:
+		return auditlog.ActionPing
+	case v2.RouteNameCatalog, v2.RouteNameCatalogActivity, v2.RouteNameEvents:
+		return auditlog.ActionCatalog
+	case v2.RouteNameTags, v2.RouteNameReferrers, v2.RouteNameUntagged:
+		return auditlog.ActionList
+	case v2.RouteNameBlobsExist:
+		return auditlog.ActionPull
+	case v2.RouteNameBlobUpload, v2.RouteNameBlobUploadChunk:
+		if r.Method == http.MethodPost && r.URL.Query().Get("mount") != "" {
+			return auditlog.ActionMount
+		}
+		// checking or cancelling an upload is still part of a push
+		return auditlog.ActionPush
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return auditlog.ActionPull
+	case http.MethodDelete:
+		return auditlog.ActionDelete
+	default:
+		return auditlog.ActionPush
+	}
+}
+
+// countingReadCloser counts the bytes read from an io.ReadCloser.
+type countingReadCloser struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	*c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/auditlog"
+	"github.com/opencontainers/go-digest"
+)
+
+// recordWriter hands the audit records written by the app over to the test.
+type recordWriter chan []byte
+
+func (w recordWriter) Write(p []byte) (int, error) {
+	w <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func (w recordWriter) next(t *testing.T) auditlog.Record {
+	t.Helper()
+	select {
+	case p := <-w:
+		var r auditlog.Record
+		if err := json.Unmarshal(p, &r); err != nil {
+			t.Fatalf("invalid audit record %q: %v", p, err)
+		}
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("no audit record written")
+	}
+	return auditlog.Record{}
+}
+
+func TestAuditLog(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	records := make(recordWriter, 10)
+	env.app.auditLog = auditlog.NewLogger(records)
+
+	baseURL, err := env.builder.BuildBaseURL()
+	if err != nil {
+		t.Fatalf("unexpected error building base url: %v", err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, baseURL, nil)
+	req.Header.Set("X-Forwarded-For", "5.6.7.8")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error issuing request: %v", err)
+	}
+	resp.Body.Close()
+
+	record := records.next(t)
+	if record.Action != auditlog.ActionPing || record.Method != http.MethodGet || record.Status != http.StatusOK {
+		t.Errorf("unexpected record for ping: %+v", record)
+	}
+	if record.Actor.Addr != "127.0.0.1" {
+		t.Errorf("expected the address of the untrusted peer, got %q", record.Actor.Addr)
+	}
+	if record.CorrelationID == "" || record.CorrelationID != record.RequestID {
+		t.Errorf("expected the request id as correlation id: %+v", record)
+	}
+	if resp.Header.Get(correlationIDHeader) != record.CorrelationID {
+		t.Errorf("unexpected correlation id header %q", resp.Header.Get(correlationIDHeader))
+	}
+
+	named, _ := reference.WithName("foo/bar")
+	tagged, _ := reference.WithTag(named, "latest")
+	manifestURL, err := env.builder.BuildManifestURL(tagged)
+	if err != nil {
+		t.Fatalf("unexpected error building manifest url: %v", err)
+	}
+	env.app.trustedProxies, _ = parseTrustedProxies([]string{"127.0.0.1"})
+	req, _ = http.NewRequest(http.MethodGet, manifestURL, nil)
+	req.Header.Set(correlationIDHeader, "client-id")
+	req.Header.Set("X-Forwarded-For", "5.6.7.8")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error issuing request: %v", err)
+	}
+	resp.Body.Close()
+
+	record = records.next(t)
+	if record.Actor.Addr != "5.6.7.8" {
+		t.Errorf("expected the address forwarded by the trusted proxy, got %q", record.Actor.Addr)
+	}
+	if record.Action != auditlog.ActionPull || record.Repository != "foo/bar" || record.Tag != "latest" || record.Status != http.StatusNotFound {
+		t.Errorf("unexpected record for manifest pull: %+v", record)
+	}
+	if record.CorrelationID != "client-id" || resp.Header.Get(correlationIDHeader) != "client-id" {
+		t.Errorf("correlation id of the client not used: %+v", record)
+	}
+	if len(record.Errors) != 1 || record.BytesOut == 0 {
+		t.Errorf("expected an error response: %+v", record)
+	}
+
+	content := []byte("audited content")
+	dgst := digest.FromBytes(content)
+	uploadURL, _ := startPushLayer(t, env, named)
+	records.next(t)
+	pushLayer(t, env.builder, named, dgst, uploadURL, bytes.NewReader(content))
+
+	record = records.next(t)
+	if record.Action != auditlog.ActionPush || record.Repository != "foo/bar" || record.Method != http.MethodPut || record.Status != http.StatusCreated {
+		t.Errorf("unexpected record for blob push: %+v", record)
+	}
+	if record.BytesIn != int64(len(content)) {
+		t.Errorf("unexpected bytes in: %d != %d", record.BytesIn, len(content))
+	}
+
+	blobURL, err := env.builder.BuildBlobURL(mustCanonical(t, named, dgst))
+	if err != nil {
+		t.Fatalf("unexpected error building blob url: %v", err)
+	}
+	resp, err = http.Get(blobURL)
+	if err != nil {
+		t.Fatalf("unexpected error issuing request: %v", err)
+	}
+	resp.Body.Close()
+
+	record = records.next(t)
+	if record.Action != auditlog.ActionPull || record.Digest != dgst.String() || record.BytesOut != int64(len(content)) {
+		t.Errorf("unexpected record for blob pull: %+v", record)
+	}
+}
+
+func mustCanonical(t *testing.T, named reference.Named, dgst digest.Digest) reference.Canonical {
+	ref, err := reference.WithDigest(named, dgst)
+	if err != nil {
+		t.Fatalf("unexpected error building reference: %v", err)
+	}
+	return ref
+}
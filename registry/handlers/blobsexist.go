@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/gorilla/handlers"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// maxBlobsExistDigests is the maximum number of digests of a request
+	// checking the existence of blobs.
+	maxBlobsExistDigests = 1000
+
+	// maxBlobsExistBodySize is the maximum size of the body of a request
+	// checking the existence of blobs, well above the size of the body
+	// listing maxBlobsExistDigests digests.
+	maxBlobsExistBodySize = 1 << 20
+
+	// blobsExistConcurrency is the number of blobs checked concurrently,
+	// those missing from the descriptor cache being checked in the storage.
+	blobsExistConcurrency = 8
+)
+
+// blobsExistDispatcher constructs the handler checking the existence of
+// several blobs at once.
+func blobsExistDispatcher(ctx *Context, r *http.Request) http.Handler {
+	blobsExistHandler := &blobsExistHandler{
+		Context: ctx,
+	}
+
+	return handlers.MethodHandler{
+		"POST": http.HandlerFunc(blobsExistHandler.CheckBlobs),
+	}
+}
+
+// blobsExistHandler handles the requests checking the existence of several
+// blobs of a repository, sparing the clients a HEAD request per blob.
+type blobsExistHandler struct {
+	*Context
+}
+
+type blobsExistAPIRequest struct {
+	Digests []digest.Digest `json:"digests"`
+}
+
+type blobsExistAPIResponse struct {
+	Blobs []existingBlob `json:"blobs"`
+}
+
+type existingBlob struct {
+	Digest digest.Digest `json:"digest"`
+	Size   int64         `json:"size"`
+}
+
+// CheckBlobs returns the blobs of the requested digests which exist in the
+// repository, with their size.
+func (bh *blobsExistHandler) CheckBlobs(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var request blobsExistAPIRequest
+	body := http.MaxBytesReader(w, r.Body, maxBlobsExistBodySize)
+	if err := json.NewDecoder(body).Decode(&request); err != nil {
+		bh.Errors = append(bh.Errors, v2.ErrorCodeDigestInvalid.WithDetail(err))
+		return
+	}
+	if len(request.Digests) > maxBlobsExistDigests {
+		bh.Errors = append(bh.Errors, v2.ErrorCodeDigestInvalid.WithDetail(fmt.Sprintf("at most %d digests can be checked at once", maxBlobsExistDigests)))
+		return
+	}
+	for _, dgst := range request.Digests {
+		if err := dgst.Validate(); err != nil {
+			bh.Errors = append(bh.Errors, v2.ErrorCodeDigestInvalid.WithDetail(err))
+			return
+		}
+	}
+
+	var (
+		blobs   = bh.Repository.Blobs(bh)
+		descs   = make([]distribution.Descriptor, len(request.Digests))
+		errs    = make([]error, len(request.Digests))
+		workers = make(chan struct{}, blobsExistConcurrency)
+		wg      sync.WaitGroup
+	)
+	for i, dgst := range request.Digests {
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(i int, dgst digest.Digest) {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+			descs[i], errs[i] = blobs.Stat(bh, dgst)
+		}(i, dgst)
+	}
+	wg.Wait()
+
+	response := blobsExistAPIResponse{Blobs: []existingBlob{}}
+	for i, err := range errs {
+		switch err {
+		case nil:
+			response.Blobs = append(response.Blobs, existingBlob{
+				Digest: request.Digests[i],
+				Size:   descs[i].Size,
+			})
+		case distribution.ErrBlobUnknown:
+		default:
+			bh.Errors = append(bh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(response); err != nil {
+		bh.Errors = append(bh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+}
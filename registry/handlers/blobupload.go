@@ -1,10 +1,12 @@
 package handlers
 
 import (
+	"encoding/base64"
 	"fmt"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 
 	"github.com/distribution/distribution/v3"
 	dcontext "github.com/distribution/distribution/v3/context"
@@ -29,7 +31,7 @@ func blobUploadDispatcher(ctx *Context, r *http.Request) http.Handler {
 		"HEAD": http.HandlerFunc(buh.GetUploadStatus),
 	}
 
-	if !ctx.readOnly {
+	if !ctx.ReadOnly() {
 		handler["POST"] = http.HandlerFunc(buh.StartBlobUpload)
 		handler["PATCH"] = http.HandlerFunc(buh.PatchBlobData)
 		handler["PUT"] = http.HandlerFunc(buh.PutBlobUploadComplete)
@@ -61,17 +63,46 @@ type blobUploadHandler struct {
 
 // StartBlobUpload begins the blob upload process and allocates a server-side
 // blob writer session, optionally mounting the blob from a separate repository.
+// When the request declares the digest of the blob, the upload completes
+// without reading the request body if the blob already exists, and otherwise
+// completes in a single request with the request body as the blob.
 func (buh *blobUploadHandler) StartBlobUpload(w http.ResponseWriter, r *http.Request) {
 	var options []distribution.BlobCreateOption
 
 	fromRepo := r.FormValue("from")
 	mountDigest := r.FormValue("mount")
 
+	var dgst digest.Digest
+	if dgstStr := r.FormValue("digest"); dgstStr != "" {
+		var err error
+		dgst, err = digest.Parse(dgstStr)
+		if err != nil {
+			buh.Errors = append(buh.Errors, v2.ErrorCodeDigestInvalid.WithDetail("digest parsing failed"))
+			return
+		}
+	}
+
 	if mountDigest != "" && fromRepo != "" {
 		opt, err := buh.createBlobMountOption(fromRepo, mountDigest)
 		if opt != nil && err == nil {
+			// the blob store holds the blobs of all the repositories,
+			// including those the client is not allowed to pull from
+			fallback := buh.App.Config.Policy.Mount.Fallback && buh.App.Config.Policy.Mount.AllowUnauthorizedSource
+			if err := buh.mountedBlobSizeDenied(fromRepo, mountDigest, fallback); err != nil {
+				buh.Errors = append(buh.Errors, err)
+				return
+			}
 			options = append(options, opt)
+			if fallback {
+				options = append(options, storage.WithMountFallback())
+			}
+		}
+	} else if dgst != "" {
+		opts, done := buh.existingBlobOptions(w, dgst)
+		if done {
+			return
 		}
+		options = append(options, opts...)
 	}
 
 	blobs := buh.Repository.Blobs(buh)
@@ -92,11 +123,17 @@ func (buh *blobUploadHandler) StartBlobUpload(w http.ResponseWriter, r *http.Req
 
 	buh.Upload = upload
 
+	if dgst != "" && r.ContentLength != 0 {
+		buh.completeBlobUpload(w, r, dgst, "blob POST")
+		return
+	}
+
 	if err := buh.blobUploadResponse(w, r, true); err != nil {
 		buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
 		return
 	}
 
+	buh.startUploadSession()
 	w.Header().Set("Docker-Upload-UUID", buh.Upload.ID())
 	w.WriteHeader(http.StatusAccepted)
 }
@@ -126,6 +163,7 @@ func (buh *blobUploadHandler) PatchBlobData(w http.ResponseWriter, r *http.Reque
 		buh.Errors = append(buh.Errors, v2.ErrorCodeBlobUploadUnknown)
 		return
 	}
+	defer buh.touchUploadSession()()
 
 	ct := r.Header.Get("Content-Type")
 	if ct != "" && ct != "application/octet-stream" {
@@ -135,34 +173,98 @@ func (buh *blobUploadHandler) PatchBlobData(w http.ResponseWriter, r *http.Reque
 	}
 
 	cr := r.Header.Get("Content-Range")
-	cl := r.Header.Get("Content-Length")
-	if cr != "" && cl != "" {
+	if cr != "" {
 		start, end, err := parseContentRange(cr)
-		if err != nil {
-			buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err.Error()))
+		if err != nil || start > end {
+			buh.rangeNotSatisfiable(w, r, fmt.Sprintf("invalid content range %q", cr))
 			return
 		}
-		if start > end || start != buh.Upload.Size() {
-			buh.Errors = append(buh.Errors, v2.ErrorCodeRangeInvalid)
-			return
+
+		// the chunk writer checks the range against the data uploaded and
+		// the chunks held
+		cw, outOfOrder := buh.Upload.(distribution.BlobChunkWriter)
+		outOfOrder = outOfOrder && buh.App.Config.Policy.Upload.OutOfOrderChunks
+		if !outOfOrder {
+			if start < buh.Upload.Size() {
+				buh.rangeNotSatisfiable(w, r, "chunk overlaps the uploaded data")
+				return
+			}
+			if start > buh.Upload.Size() {
+				buh.rangeNotSatisfiable(w, r, "chunk leaves a gap after the uploaded data")
+				return
+			}
 		}
 
-		clInt, err := strconv.ParseInt(cl, 10, 64)
-		if err != nil {
-			buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err.Error()))
-			return
+		if cl := r.Header.Get("Content-Length"); cl != "" {
+			clInt, err := strconv.ParseInt(cl, 10, 64)
+			if err != nil {
+				buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err.Error()))
+				return
+			}
+			if clInt != (end-start)+1 {
+				buh.Errors = append(buh.Errors, v2.ErrorCodeSizeInvalid)
+				return
+			}
 		}
-		if clInt != (end-start)+1 {
-			buh.Errors = append(buh.Errors, v2.ErrorCodeSizeInvalid)
+
+		if outOfOrder {
+			buh.patchBlobChunk(w, r, cw, start, end)
 			return
 		}
 	}
 
+	if buh.exceedsMaxBlobSize(r.ContentLength) {
+		return
+	}
+
 	if err := copyFullPayload(buh, w, r, buh.Upload, -1, "blob PATCH"); err != nil {
 		buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err.Error()))
 		return
 	}
 
+	if buh.exceedsMaxBlobSize(0) {
+		return
+	}
+
+	// the client may send the digest of the data uploaded so far, to detect
+	// a corrupted upload before it is completed
+	expected, err := requestDigest(r)
+	if err != nil {
+		buh.Errors = append(buh.Errors, v2.ErrorCodeDigestInvalid.WithDetail(err.Error()))
+		return
+	}
+	if expected != "" && !buh.verifyUploadDigest(expected) {
+		return
+	}
+
+	if err := buh.blobUploadResponse(w, r, false); err != nil {
+		buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// patchBlobChunk writes the chunk of the request at its range, which may be
+// ahead of the data uploaded so far.
+func (buh *blobUploadHandler) patchBlobChunk(w http.ResponseWriter, r *http.Request, cw distribution.BlobChunkWriter, start, end int64) {
+	if buh.exceedsMaxBlobSize(end + 1 - buh.Upload.Size()) {
+		return
+	}
+
+	if err := cw.WriteChunk(buh, start, end-start+1, r.Body); err != nil {
+		if err == distribution.ErrBlobChunkOverlap || err == distribution.ErrBlobTooManyChunks {
+			buh.rangeNotSatisfiable(w, r, err.Error())
+			return
+		}
+		if err == distribution.ErrUnsupported {
+			buh.Errors = append(buh.Errors, errcode.ErrorCodeUnsupported)
+			return
+		}
+		buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err.Error()))
+		return
+	}
+
 	if err := buh.blobUploadResponse(w, r, false); err != nil {
 		buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
 		return
@@ -171,6 +273,19 @@ func (buh *blobUploadHandler) PatchBlobData(w http.ResponseWriter, r *http.Reque
 	w.WriteHeader(http.StatusAccepted)
 }
 
+// rangeNotSatisfiable rejects a chunk whose range does not follow the data
+// uploaded so far, letting the client know the current offset of the upload
+// through the Range header.
+func (buh *blobUploadHandler) rangeNotSatisfiable(w http.ResponseWriter, r *http.Request, detail string) {
+	if err := buh.blobUploadResponse(w, r, false); err != nil {
+		buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+	// the error is written as the response body
+	w.Header().Del("Content-Length")
+	buh.Errors = append(buh.Errors, v2.ErrorCodeRangeInvalid.WithDetail(detail))
+}
+
 // PutBlobUploadComplete takes the final request of a blob upload. The
 // request may include all the blob data or no blob data. Any data
 // provided is received and verified. If successful, the blob is linked
@@ -181,24 +296,71 @@ func (buh *blobUploadHandler) PutBlobUploadComplete(w http.ResponseWriter, r *ht
 		buh.Errors = append(buh.Errors, v2.ErrorCodeBlobUploadUnknown)
 		return
 	}
+	defer buh.touchUploadSession()()
 
 	dgstStr := r.FormValue("digest") // TODO(stevvooe): Support multiple digest parameters!
 
-	if dgstStr == "" {
+	// the digest may be sent in a trailer instead, by the clients computing
+	// it as they stream the data
+	_, trailer := r.Trailer[digestHeader]
+	if dgstStr == "" && !trailer {
 		// no digest? return error, but allow retry.
 		buh.Errors = append(buh.Errors, v2.ErrorCodeDigestInvalid.WithDetail("digest missing"))
 		return
 	}
 
-	dgst, err := digest.Parse(dgstStr)
+	var dgst digest.Digest
+	if dgstStr != "" {
+		var err error
+		dgst, err = digest.Parse(dgstStr)
+		if err != nil {
+			// no digest? return error, but allow retry.
+			buh.Errors = append(buh.Errors, v2.ErrorCodeDigestInvalid.WithDetail("digest parsing failed"))
+			return
+		}
+	}
+
+	buh.completeBlobUpload(w, r, dgst, "blob PUT")
+}
+
+// completeBlobUpload writes the request body to the upload, then commits it
+// as the blob with the given digest, or else the digest sent with the
+// request. The upload is canceled if it fails.
+func (buh *blobUploadHandler) completeBlobUpload(w http.ResponseWriter, r *http.Request, dgst digest.Digest, action string) {
+	if buh.exceedsMaxBlobSize(r.ContentLength) {
+		return
+	}
+
+	if err := copyFullPayload(buh, w, r, buh.Upload, -1, action); err != nil {
+		buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err.Error()))
+		return
+	}
+
+	if buh.exceedsMaxBlobSize(0) {
+		return
+	}
+
+	// the trailers are only available once the body is read
+	sent, err := requestDigest(r)
 	if err != nil {
+		buh.Errors = append(buh.Errors, v2.ErrorCodeDigestInvalid.WithDetail(err.Error()))
+		return
+	}
+	switch {
+	case dgst == "" && sent == "":
 		// no digest? return error, but allow retry.
-		buh.Errors = append(buh.Errors, v2.ErrorCodeDigestInvalid.WithDetail("digest parsing failed"))
+		buh.Errors = append(buh.Errors, v2.ErrorCodeDigestInvalid.WithDetail("digest missing"))
+		return
+	case dgst == "":
+		dgst = sent
+	case sent != "" && sent != dgst:
+		buh.Errors = append(buh.Errors, v2.ErrorCodeDigestInvalid.WithDetail(fmt.Sprintf("digest %s sent with the data does not match the digest parameter %s", sent, dgst)))
 		return
 	}
 
-	if err := copyFullPayload(buh, w, r, buh.Upload, -1, "blob PUT"); err != nil {
-		buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err.Error()))
+	// the running digest of the upload is checked before it is committed, to
+	// reject a mismatch without moving the data
+	if !buh.verifyUploadDigest(dgst) {
 		return
 	}
 
@@ -236,15 +398,88 @@ func (buh *blobUploadHandler) PutBlobUploadComplete(w http.ResponseWriter, r *ht
 			// If the cleanup fails, all we can do is observe and report.
 			dcontext.GetLogger(buh).Errorf("error canceling upload after error: %v", err)
 		}
+		buh.endUploadSession()
 
 		return
 	}
+	buh.endUploadSession()
 	if err := buh.writeBlobCreatedHeaders(w, desc); err != nil {
 		buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
 		return
 	}
 }
 
+// digestHeader is the header, or trailer, in which clients may send the
+// digest of the data they upload.
+const digestHeader = "Digest"
+
+// requestDigest returns the digest sent in the Digest trailer, or else
+// header, of the request, if any. The digest is either an OCI digest, or a
+// list of RFC 3230 instance digests of which the sha-256 and sha-512 ones
+// are supported.
+func requestDigest(r *http.Request) (digest.Digest, error) {
+	value := r.Trailer.Get(digestHeader)
+	if value == "" {
+		value = r.Header.Get(digestHeader)
+	}
+	if value == "" {
+		return "", nil
+	}
+	if dgst, err := digest.Parse(value); err == nil {
+		return dgst, nil
+	}
+
+	algorithms := map[string]digest.Algorithm{
+		"sha-256": digest.SHA256,
+		"sha-512": digest.SHA512,
+	}
+	for _, instance := range strings.Split(value, ",") {
+		name, encoded, ok := strings.Cut(strings.TrimSpace(instance), "=")
+		if !ok {
+			continue
+		}
+		algorithm, ok := algorithms[strings.ToLower(name)]
+		if !ok {
+			continue
+		}
+		sum, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(sum) != algorithm.Size() {
+			return "", fmt.Errorf("invalid %s digest %q", name, encoded)
+		}
+		return digest.NewDigestFromBytes(algorithm, sum), nil
+	}
+	return "", fmt.Errorf("unsupported digest %q", value)
+}
+
+// verifyUploadDigest checks the digest of the data uploaded so far against
+// expected, canceling the upload on a mismatch. The check is skipped if the
+// upload does not keep the digest of its data with the algorithm of
+// expected, the data being verified when the upload is committed anyway.
+func (buh *blobUploadHandler) verifyUploadDigest(expected digest.Digest) bool {
+	d, ok := buh.Upload.(distribution.BlobDigester)
+	if !ok {
+		return true
+	}
+	actual, err := d.Digest(buh, expected.Algorithm())
+	if err == distribution.ErrUnsupported {
+		return true
+	}
+	if err != nil {
+		buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return false
+	}
+	if actual == expected {
+		return true
+	}
+
+	buh.Errors = append(buh.Errors, v2.ErrorCodeDigestInvalid.WithDetail(fmt.Sprintf("digest of the uploaded data %s does not match %s", actual, expected)))
+	if err := buh.Upload.Cancel(buh); err != nil {
+		dcontext.GetLogger(buh).Errorf("error canceling upload after digest mismatch: %v", err)
+	}
+	buh.endUploadSession()
+	return false
+}
+
 // CancelBlobUpload cancels an in-progress upload of a blob.
 func (buh *blobUploadHandler) CancelBlobUpload(w http.ResponseWriter, r *http.Request) {
 	if buh.Upload == nil {
@@ -257,10 +492,68 @@ func (buh *blobUploadHandler) CancelBlobUpload(w http.ResponseWriter, r *http.Re
 		dcontext.GetLogger(buh).Errorf("error encountered canceling upload: %v", err)
 		buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
 	}
+	buh.endUploadSession()
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// existingBlobOptions looks up the blob declared by the digest parameter of
+// a new upload. If the repository has it, the upload completes right away
+// with 201 Created and done is set. If another repository has it and the
+// mount policy lets clients mount blobs from repositories they cannot pull
+// from, the returned options mount it from the storage instead of uploading
+// it. The namespace policies of the repository apply to the existing blob as
+// to an uploaded one.
+func (buh *blobUploadHandler) existingBlobOptions(w http.ResponseWriter, dgst digest.Digest) (options []distribution.BlobCreateOption, done bool) {
+	desc, err := buh.Repository.Blobs(buh).Stat(buh, dgst)
+	linked := err == nil
+	if err == distribution.ErrBlobUnknown && buh.App.Config.Policy.Mount.Fallback && buh.App.Config.Policy.Mount.AllowUnauthorizedSource {
+		desc, err = buh.App.registry.BlobStatter().Stat(buh, dgst)
+	}
+	if err != nil {
+		if err != distribution.ErrBlobUnknown {
+			dcontext.GetLogger(buh).Errorf("error looking up blob %s before upload: %v", dgst, err)
+		}
+		return nil, false
+	}
+
+	if err := buh.blobSizeDenied(desc.Size); err != nil {
+		buh.Errors = append(buh.Errors, err)
+		return nil, true
+	}
+
+	if linked {
+		if err := buh.writeBlobCreatedHeaders(w, desc); err != nil {
+			buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		}
+		return nil, true
+	}
+
+	canonical, err := reference.WithDigest(buh.Repository.Named(), dgst)
+	if err != nil {
+		return nil, false
+	}
+	dcontext.GetLogger(buh).Infof("mounting blob %s declared by the upload from the blob store", dgst)
+	return []distribution.BlobCreateOption{storage.WithMountFrom(canonical), storage.WithMountDescriptor(desc)}, false
+}
+
+// exceedsMaxBlobSize returns whether the upload, along with n more bytes,
+// exceeds the maximum blob size of the namespace of the repository. The
+// upload is then canceled.
+func (buh *blobUploadHandler) exceedsMaxBlobSize(n int64) bool {
+	max := buh.maxBlobSize()
+	if max == 0 || n < 0 || buh.Upload.Size()+n <= max {
+		return false
+	}
+
+	buh.Errors = append(buh.Errors, errcode.ErrorCodeDenied.WithDetail(fmt.Sprintf("blob exceeds the maximum size of %d bytes", max)))
+	if err := buh.Upload.Cancel(buh); err != nil {
+		dcontext.GetLogger(buh).Errorf("error canceling upload exceeding the maximum blob size: %v", err)
+	}
+	buh.endUploadSession()
+	return true
+}
+
 func (buh *blobUploadHandler) ResumeBlobUpload(ctx *Context, r *http.Request) http.Handler {
 	state, err := hmacKey(ctx.Config.HTTP.Secret).unpackUploadState(r.FormValue("_state"))
 	if err != nil {
@@ -307,6 +600,7 @@ func (buh *blobUploadHandler) ResumeBlobUpload(ctx *Context, r *http.Request) ht
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			buh.Errors = append(buh.Errors, v2.ErrorCodeBlobUploadInvalid.WithDetail(err))
 			upload.Cancel(buh)
+			buh.endUploadSession()
 		})
 	}
 	return nil
@@ -377,6 +671,34 @@ func (buh *blobUploadHandler) createBlobMountOption(fromRepo, mountDigest string
 	return storage.WithMountFrom(canonical), nil
 }
 
+// mountedBlobSizeDenied returns an error when the blob mounted from fromRepo
+// exceeds the maximum size of the blobs of the repository, which applies to
+// the mounted blobs as to the uploaded ones. The blob is looked up in the
+// blob store when the source repository does not have it and fallback is
+// set, as the mount then links it from there.
+func (buh *blobUploadHandler) mountedBlobSizeDenied(fromRepo, mountDigest string, fallback bool) error {
+	if buh.maxBlobSize() == 0 {
+		return nil
+	}
+	// the mount option was created from valid parameters
+	dgst := digest.Digest(mountDigest)
+	from, _ := reference.WithName(fromRepo)
+
+	source, err := buh.App.registry.Repository(buh, from)
+	if err != nil {
+		return nil
+	}
+	desc, err := source.Blobs(buh).Stat(buh, dgst)
+	if err == distribution.ErrBlobUnknown && fallback {
+		desc, err = buh.App.registry.BlobStatter().Stat(buh, dgst)
+	}
+	if err != nil {
+		// the blob is not mounted, but uploaded
+		return nil
+	}
+	return buh.blobSizeDenied(desc.Size)
+}
+
 // writeBlobCreatedHeaders writes the standard headers describing a newly
 // created blob. A 201 Created is written as well as the canonical URL and
 // blob digest.
@@ -1,14 +1,19 @@
 package handlers
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"strconv"
+	"time"
 
+	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/registry/api/errcode"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
 	"github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/gorilla/handlers"
 )
@@ -31,18 +36,38 @@ type catalogHandler struct {
 
 type catalogAPIResponse struct {
 	Repositories []string `json:"repositories"`
+	Total        *int     `json:"total,omitempty"`
 }
 
 func (ch *catalogHandler) GetCatalog(w http.ResponseWriter, r *http.Request) {
 	var moreEntries = true
 
 	q := r.URL.Query()
-	lastEntry := q.Get("last")
+	prefix := q.Get("prefix")
+	position, ok := ch.parsePosition(q, prefix)
+	if !ok {
+		return
+	}
+	lastEntry := position.Last
 	maxEntries, err := strconv.Atoi(q.Get("n"))
 	if err != nil || maxEntries < 0 {
 		maxEntries = maximumReturnedEntries
 	}
 
+	if catalog, ok := ch.App.registry.(distribution.RepositoryCatalog); ok {
+		repos, total, next, err := listCatalogPage(ch.Context, catalog, position, maxEntries)
+		if err != distribution.ErrUnsupported {
+			ch.serveIndexedCatalog(w, r, repos, total, next, maxEntries, err)
+			return
+		}
+	}
+
+	if prefix != "" {
+		// filtering would require to walk every repository
+		ch.Errors = append(ch.Errors, errcode.ErrorCodeUnsupported.WithDetail("prefix filtering requires the catalog index"))
+		return
+	}
+
 	repos := make([]string, maxEntries)
 
 	filled, err := ch.App.registry.Repositories(ch.Context, repos, lastEntry)
@@ -77,6 +102,187 @@ func (ch *catalogHandler) GetCatalog(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// serveIndexedCatalog writes the repositories listed from the catalog index,
+// with their total number and a link to the position of the next page.
+func (ch *catalogHandler) serveIndexedCatalog(w http.ResponseWriter, r *http.Request, repos []string, total int, next *catalogPosition, maxEntries int, err error) {
+	if err != nil {
+		ch.Errors = append(ch.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Add a link header if there are more entries to retrieve
+	if next != nil {
+		urlStr, err := createTokenLinkEntry(r.URL.String(), maxEntries, next)
+		if err != nil {
+			ch.Errors = append(ch.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+			return
+		}
+		w.Header().Set("Link", urlStr)
+	}
+
+	if repos == nil {
+		repos = []string{}
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(catalogAPIResponse{
+		Repositories: repos,
+		Total:        &total,
+	}); err != nil {
+		ch.Errors = append(ch.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+}
+
+// catalogPosition is the position of a page in the catalog index, carried by
+// the pagination tokens. The total number of repositories starting with the
+// prefix is counted for the first page only, and carried to the next ones so
+// that a page only lists the part of the index it returns.
+type catalogPosition struct {
+	Prefix string `json:"prefix,omitempty"`
+	Last   string `json:"last,omitempty"`
+	Total  *int   `json:"total,omitempty"`
+}
+
+// parsePosition returns the position of the requested page, from its token
+// or its last parameter. If the token is invalid, it records the error and
+// returns false.
+func (ch *catalogHandler) parsePosition(q url.Values, prefix string) (catalogPosition, bool) {
+	token := q.Get("token")
+	if token == "" {
+		return catalogPosition{Prefix: prefix, Last: q.Get("last")}, true
+	}
+
+	var position catalogPosition
+	p, err := base64.RawURLEncoding.DecodeString(token)
+	if err == nil {
+		err = json.Unmarshal(p, &position)
+	}
+	if err != nil || position.Total == nil || position.Prefix != prefix {
+		ch.Errors = append(ch.Errors, v2.ErrorCodePaginationTokenInvalid.WithDetail(map[string]string{"token": token}))
+		return catalogPosition{}, false
+	}
+	return position, true
+}
+
+// listCatalogPage lists up to n repositories from the position in the
+// catalog index, along with the total number of repositories starting with
+// the prefix and the position of the next page, if any.
+func listCatalogPage(ctx context.Context, catalog distribution.RepositoryCatalog, position catalogPosition, n int) ([]string, int, *catalogPosition, error) {
+	if position.Total == nil {
+		total, err := catalog.CountRepositories(ctx, position.Prefix)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		position.Total = &total
+	}
+	if n == 0 {
+		// only the total was requested
+		return nil, *position.Total, nil, nil
+	}
+
+	repos, err := catalog.ListRepositories(ctx, position.Prefix, position.Last, n)
+	if err == io.EOF {
+		return repos, *position.Total, nil, nil
+	} else if err != nil {
+		return nil, 0, nil, err
+	}
+	return repos, *position.Total, &catalogPosition{
+		Prefix: position.Prefix,
+		Last:   repos[len(repos)-1],
+		Total:  position.Total,
+	}, nil
+}
+
+func catalogActivityDispatcher(ctx *Context, r *http.Request) http.Handler {
+	catalogHandler := &catalogHandler{
+		Context: ctx,
+	}
+
+	return handlers.MethodHandler{
+		"GET": http.HandlerFunc(catalogHandler.GetCatalogActivity),
+	}
+}
+
+type repositoryActivity struct {
+	Name     string     `json:"name"`
+	LastPush *time.Time `json:"lastPush,omitempty"`
+}
+
+type catalogActivityAPIResponse struct {
+	Repositories []repositoryActivity `json:"repositories"`
+	Total        int                  `json:"total"`
+}
+
+// GetCatalogActivity lists the repositories of the catalog index with the
+// time of their last push, paginated like the indexed catalog.
+func (ch *catalogHandler) GetCatalogActivity(w http.ResponseWriter, r *http.Request) {
+	catalog, ok := ch.App.registry.(interface {
+		distribution.RepositoryCatalog
+		distribution.RepositoryActivity
+	})
+	if !ok {
+		ch.Errors = append(ch.Errors, errcode.ErrorCodeUnsupported.WithDetail("repository activity requires the catalog index"))
+		return
+	}
+
+	q := r.URL.Query()
+	prefix := q.Get("prefix")
+	position, ok := ch.parsePosition(q, prefix)
+	if !ok {
+		return
+	}
+	maxEntries, err := strconv.Atoi(q.Get("n"))
+	if err != nil || maxEntries < 0 {
+		maxEntries = maximumReturnedEntries
+	}
+
+	repos, total, next, err := listCatalogPage(ch.Context, catalog, position, maxEntries)
+	if err == distribution.ErrUnsupported {
+		ch.Errors = append(ch.Errors, errcode.ErrorCodeUnsupported.WithDetail("repository activity requires the catalog index"))
+		return
+	} else if err != nil {
+		ch.Errors = append(ch.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+
+	response := catalogActivityAPIResponse{
+		Repositories: make([]repositoryActivity, 0, len(repos)),
+		Total:        total,
+	}
+	for _, repo := range repos {
+		lastPush, err := catalog.LastPush(ch.Context, repo)
+		if err != nil {
+			ch.Errors = append(ch.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+			return
+		}
+		entry := repositoryActivity{Name: repo}
+		if !lastPush.IsZero() {
+			entry.LastPush = &lastPush
+		}
+		response.Repositories = append(response.Repositories, entry)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if next != nil {
+		urlStr, err := createTokenLinkEntry(r.URL.String(), maxEntries, next)
+		if err != nil {
+			ch.Errors = append(ch.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+			return
+		}
+		w.Header().Set("Link", urlStr)
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(response); err != nil {
+		ch.Errors = append(ch.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+}
+
 // Use the original URL from the request to create a new URL for
 // the link header
 func createLinkEntry(origURL string, maxEntries int, lastEntry string) (string, error) {
@@ -96,3 +302,31 @@ func createLinkEntry(origURL string, maxEntries int, lastEntry string) (string,
 
 	return urlStr, nil
 }
+
+// Use the original URL from the request to create a new URL for the link
+// header of the catalog index, paginated with a token carrying the position
+func createTokenLinkEntry(origURL string, maxEntries int, position *catalogPosition) (string, error) {
+	calledURL, err := url.Parse(origURL)
+	if err != nil {
+		return "", err
+	}
+
+	p, err := json.Marshal(position)
+	if err != nil {
+		return "", err
+	}
+
+	v := url.Values{}
+	v.Add("n", strconv.Itoa(maxEntries))
+	if position.Prefix != "" {
+		v.Add("prefix", position.Prefix)
+	}
+	v.Add("token", base64.RawURLEncoding.EncodeToString(p))
+
+	calledURL.RawQuery = v.Encode()
+
+	calledURL.Fragment = ""
+	urlStr := fmt.Sprintf("<%s>; rel=\"next\"", calledURL.String())
+
+	return urlStr, nil
+}
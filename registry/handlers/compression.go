@@ -0,0 +1,289 @@
+package handlers
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/distribution/distribution/v3/configuration"
+	dcontext "github.com/distribution/distribution/v3/context"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/klauspost/compress/zstd"
+)
+
+// defaultCompressionMinSize is the size below which responses are sent
+// uncompressed when none is configured: smaller responses hardly benefit
+// from compression.
+const defaultCompressionMinSize = 1024
+
+// defaultCompressionEncodings are the encodings of the compressed responses
+// when none are configured, in order of preference.
+var defaultCompressionEncodings = []string{storage.EncodingZstd, storage.EncodingGzip}
+
+// defaultCompressionContentTypes are the media types of the compressed
+// responses when none are configured: the errors, tag lists and catalogs, and
+// the manifests.
+var defaultCompressionContentTypes = []string{
+	"application/json",
+	"application/*+json",
+	"application/vnd.docker.distribution.manifest.v1+prettyjws",
+}
+
+// uncompressedRoutes are the routes whose responses are never compressed,
+// which serve or receive blobs, or stream the events.
+var uncompressedRoutes = map[string]bool{
+	v2.RouteNameBlob:            true,
+	v2.RouteNameBlobUpload:      true,
+	v2.RouteNameBlobUploadChunk: true,
+	v2.RouteNameEvents:          true,
+}
+
+// compressor compresses the API responses for the clients accepting it.
+type compressor struct {
+	encodings    []string
+	minSize      int
+	contentTypes []string
+
+	gzipWriters  sync.Pool
+	zstdEncoders sync.Pool
+}
+
+// newCompressor returns the compressor of a configuration.
+func newCompressor(config configuration.HTTPCompression) (*compressor, error) {
+	c := &compressor{
+		encodings:    config.Encodings,
+		minSize:      config.MinSize,
+		contentTypes: config.ContentTypes,
+	}
+	if len(c.encodings) == 0 {
+		c.encodings = defaultCompressionEncodings
+	}
+	for _, encoding := range c.encodings {
+		if encoding != storage.EncodingGzip && encoding != storage.EncodingZstd {
+			return nil, fmt.Errorf("unsupported encoding %q, expected gzip or zstd", encoding)
+		}
+	}
+	if c.minSize < 0 {
+		return nil, fmt.Errorf("invalid minimum size %d", c.minSize)
+	} else if c.minSize == 0 {
+		c.minSize = defaultCompressionMinSize
+	}
+	if len(c.contentTypes) == 0 {
+		c.contentTypes = defaultCompressionContentTypes
+	}
+	for _, pattern := range c.contentTypes {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid content type %q: %v", pattern, err)
+		}
+	}
+	return c, nil
+}
+
+// configureCompression sets up the compression of the API responses.
+func (app *App) configureCompression(config *configuration.Configuration) {
+	if !config.HTTP.Compression.Enabled {
+		return
+	}
+	c, err := newCompressor(config.HTTP.Compression)
+	if err != nil {
+		panic(fmt.Sprintf("invalid compression configuration: %v", err))
+	}
+	app.compressor = c
+}
+
+// handler wraps the handler of a route with the compression of its
+// responses.
+func (c *compressor) handler(routeName string, handler http.Handler) http.Handler {
+	if c == nil || uncompressedRoutes[routeName] {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		// the response varies whichever encoding is negotiated
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := storage.NegotiateEncoding(r, c.encodings)
+		if encoding == "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{
+			ResponseWriter: w,
+			compressor:     c,
+			encoding:       encoding,
+		}
+		defer func() {
+			if err := cw.Close(); err != nil {
+				dcontext.GetLogger(r.Context()).Errorf("error compressing response: %v", err)
+			}
+		}()
+		handler.ServeHTTP(cw, r)
+	})
+}
+
+// compresses reports whether responses of the content type are compressed.
+func (c *compressor) compresses(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range c.contentTypes {
+		if ok, _ := path.Match(pattern, mediaType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// encoder returns a pooled encoder writing to w.
+func (c *compressor) encoder(encoding string, w io.Writer) (io.WriteCloser, error) {
+	switch encoding {
+	case storage.EncodingGzip:
+		if gw, ok := c.gzipWriters.Get().(*gzip.Writer); ok {
+			gw.Reset(w)
+			return gw, nil
+		}
+		return gzip.NewWriter(w), nil
+	case storage.EncodingZstd:
+		if ze, ok := c.zstdEncoders.Get().(*zstd.Encoder); ok {
+			ze.Reset(w)
+			return ze, nil
+		}
+		// responses are small, they are not worth encoding concurrently
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	}
+	return nil, fmt.Errorf("unsupported encoding %q", encoding)
+}
+
+// release returns an encoder to its pool.
+func (c *compressor) release(encoder io.WriteCloser) {
+	switch e := encoder.(type) {
+	case *gzip.Writer:
+		e.Reset(io.Discard)
+		c.gzipWriters.Put(e)
+	case *zstd.Encoder:
+		e.Reset(nil)
+		c.zstdEncoders.Put(e)
+	}
+}
+
+// compressWriter compresses a response once it has received enough content
+// to decide whether it is worth it. Until then, the status and content are
+// held back.
+type compressWriter struct {
+	http.ResponseWriter
+	compressor *compressor
+	encoding   string
+
+	status  int
+	buf     []byte
+	decided bool
+	encoder io.WriteCloser
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.status == 0 && !cw.decided {
+		cw.status = status
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if !cw.decided {
+		cw.buf = append(cw.buf, p...)
+		if len(cw.buf) < cw.compressor.minSize {
+			return len(p), nil
+		}
+		if err := cw.decide(); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if cw.encoder != nil {
+		return cw.encoder.Write(p)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+// decide writes the held back status and content, compressed if the
+// response is large enough and of a compressed content type.
+func (cw *compressWriter) decide() error {
+	cw.decided = true
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+
+	header := cw.Header()
+	compress := len(cw.buf) >= cw.compressor.minSize &&
+		cw.status != http.StatusNoContent && cw.status != http.StatusNotModified &&
+		header.Get("Content-Encoding") == "" &&
+		cw.compressor.compresses(header.Get("Content-Type"))
+	if compress {
+		encoder, err := cw.compressor.encoder(cw.encoding, cw.ResponseWriter)
+		if err != nil {
+			return err
+		}
+		cw.encoder = encoder
+		header.Del("Content-Length")
+		header.Set("Content-Encoding", cw.encoding)
+		// the compressed representation is not byte for byte the entity
+		// the etag was computed for, the manifest handler compares the
+		// If-None-Match etags weakly so that it still matches
+		if etag := header.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			header.Set("Etag", "W/"+etag)
+		}
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.status)
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := cw.Write(buf)
+	return err
+}
+
+// Close writes the content held back, if any, and ends the compressed
+// stream.
+func (cw *compressWriter) Close() error {
+	if !cw.decided {
+		if cw.status == 0 && len(cw.buf) == 0 {
+			// nothing was written
+			return nil
+		}
+		if err := cw.decide(); err != nil {
+			return err
+		}
+	}
+	if cw.encoder == nil {
+		return nil
+	}
+	err := cw.encoder.Close()
+	cw.compressor.release(cw.encoder)
+	cw.encoder = nil
+	return err
+}
+
+// Flush writes the content held back and flushes the compressed stream.
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		if err := cw.decide(); err != nil {
+			return
+		}
+	}
+	if f, ok := cw.encoder.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
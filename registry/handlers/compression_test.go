@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/distribution/distribution/v3/configuration"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestCompression(t *testing.T) {
+	c, err := newCompressor(configuration.HTTPCompression{Enabled: true})
+	if err != nil {
+		t.Fatalf("unexpected error creating compressor: %v", err)
+	}
+
+	large := bytes.Repeat([]byte(`{"tags":["latest"]}`), 100)
+	serve := func(routeName, contentType string, body []byte, acceptEncoding string) *httptest.ResponseRecorder {
+		handler := c.handler(routeName, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			w.Header().Set("Etag", `"sha256:abc"`)
+			w.WriteHeader(http.StatusOK)
+			w.Write(body)
+		}))
+		r := httptest.NewRequest(http.MethodGet, "/v2/foo/tags/list", nil)
+		if acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	for _, tc := range []struct {
+		acceptEncoding string
+		encoding       string
+		decode         func(io.Reader) (io.Reader, error)
+	}{
+		{
+			acceptEncoding: "gzip",
+			encoding:       "gzip",
+			decode:         func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		},
+		{
+			acceptEncoding: "gzip;q=0.5, zstd",
+			encoding:       "zstd",
+			decode:         func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) },
+		},
+	} {
+		w := serve(v2.RouteNameTags, "application/json", large, tc.acceptEncoding)
+		if encoding := w.Header().Get("Content-Encoding"); encoding != tc.encoding {
+			t.Fatalf("unexpected encoding accepting %q: %q", tc.acceptEncoding, encoding)
+		}
+		if w.Header().Get("Content-Length") != "" {
+			t.Error("unexpected Content-Length of a compressed response")
+		}
+		if etag := w.Header().Get("Etag"); etag != `W/"sha256:abc"` {
+			t.Errorf("unexpected etag of a compressed response: %s", etag)
+		}
+		if vary := w.Header().Get("Vary"); vary != "Accept-Encoding" {
+			t.Errorf("unexpected Vary header: %q", vary)
+		}
+		r, err := tc.decode(w.Body)
+		if err != nil {
+			t.Fatalf("unexpected error decoding %s response: %v", tc.encoding, err)
+		}
+		body, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("unexpected error decoding %s response: %v", tc.encoding, err)
+		}
+		if !bytes.Equal(body, large) {
+			t.Errorf("unexpected decoded %s response", tc.encoding)
+		}
+	}
+
+	// manifests are compressed
+	w := serve(v2.RouteNameManifest, "application/vnd.oci.image.index.v1+json", large, "gzip")
+	if encoding := w.Header().Get("Content-Encoding"); encoding != "gzip" {
+		t.Errorf("unexpected encoding of a manifest: %q", encoding)
+	}
+
+	for _, tc := range []struct {
+		name           string
+		routeName      string
+		contentType    string
+		body           []byte
+		acceptEncoding string
+	}{
+		{"not accepted", v2.RouteNameTags, "application/json", large, ""},
+		{"identity", v2.RouteNameTags, "application/json", large, "identity"},
+		{"small", v2.RouteNameTags, "application/json", []byte(`{}`), "gzip"},
+		{"content type", v2.RouteNameTags, "text/plain", large, "gzip"},
+		{"blob", v2.RouteNameBlob, "application/vnd.oci.image.config.v1+json", large, "gzip"},
+	} {
+		w := serve(tc.routeName, tc.contentType, tc.body, tc.acceptEncoding)
+		if encoding := w.Header().Get("Content-Encoding"); encoding != "" {
+			t.Errorf("%s: unexpected encoding %q", tc.name, encoding)
+		}
+		if !bytes.Equal(w.Body.Bytes(), tc.body) {
+			t.Errorf("%s: unexpected body", tc.name)
+		}
+		if length := w.Header().Get("Content-Length"); length != strconv.Itoa(len(tc.body)) {
+			t.Errorf("%s: unexpected Content-Length: %q", tc.name, length)
+		}
+	}
+}
+
+func TestCompressionInvalid(t *testing.T) {
+	for _, config := range []configuration.HTTPCompression{
+		{Enabled: true, Encodings: []string{"br"}},
+		{Enabled: true, MinSize: -1},
+		{Enabled: true, ContentTypes: []string{"application/[json"}},
+	} {
+		if _, err := newCompressor(config); err == nil {
+			t.Errorf("expected an error creating compressor of %+v", config)
+		}
+	}
+}
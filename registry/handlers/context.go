@@ -6,6 +6,7 @@ import (
 	"net/http"
 
 	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
 	dcontext "github.com/distribution/distribution/v3/context"
 	"github.com/distribution/distribution/v3/registry/api/errcode"
 	v2 "github.com/distribution/distribution/v3/registry/api/v2"
@@ -35,6 +36,14 @@ type Context struct {
 
 	urlBuilder *v2.URLBuilder
 
+	// namespace holds the settings of the repository resolved from its
+	// namespaces.
+	namespace configuration.NamespaceSettings
+
+	// uploadSlot is the upload session counted for a request starting an
+	// upload, if the upload sessions are capped.
+	uploadSlot *uploadSlot
+
 	// TODO(stevvooe): The goal is too completely factor this context and
 	// dispatching out of the web application. Ideally, we should lean on
 	// context.Context for injection of these resources.
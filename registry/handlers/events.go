@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/gorilla/handlers"
+)
+
+// defaultEventStreamHeartbeat is the interval of the comments keeping the
+// connections of the event stream open when none is configured.
+const defaultEventStreamHeartbeat = 30 * time.Second
+
+// eventsDispatcher takes the request context and builds the appropriate
+// handler for streaming the registry events.
+func eventsDispatcher(ctx *Context, r *http.Request) http.Handler {
+	eventsHandler := &eventsHandler{
+		Context: ctx,
+	}
+
+	return handlers.MethodHandler{
+		"GET": http.HandlerFunc(eventsHandler.GetEvents),
+	}
+}
+
+type eventsHandler struct {
+	*Context
+}
+
+// GetEvents streams the registry events matching the repository and action
+// filters of the request as server-sent events, until the client goes away
+// or the registry shuts down.
+func (eh *eventsHandler) GetEvents(w http.ResponseWriter, r *http.Request) {
+	if eh.App.events.stream == nil {
+		eh.Errors = append(eh.Errors, errcode.ErrorCodeUnsupported.WithDetail("the event stream is not enabled"))
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		eh.Errors = append(eh.Errors, errcode.ErrorCodeUnsupported.WithDetail("the connection does not support streaming"))
+		return
+	}
+
+	q := r.URL.Query()
+	filter := configuration.Filter{
+		Repositories: q["repository"],
+		Actions:      q["action"],
+	}
+	for _, pattern := range filter.Repositories {
+		if err := configuration.ValidateRepositoryPattern(pattern); err != nil {
+			eh.Errors = append(eh.Errors, v2.ErrorCodeNameInvalid.WithDetail(err.Error()))
+			return
+		}
+	}
+
+	sub, err := eh.App.events.stream.Subscribe(filter)
+	if err != nil {
+		eh.Errors = append(eh.Errors, errcode.ErrorCodeUnavailable.WithDetail(err.Error()))
+		return
+	}
+	defer sub.Close()
+
+	heartbeat := eh.App.Config.Notifications.Stream.Heartbeat
+	if heartbeat <= 0 {
+		heartbeat = defaultEventStreamHeartbeat
+	}
+	ticker := time.NewTicker(heartbeat)
+	defer ticker.Stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// keep reverse proxies such as nginx from buffering the events
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-sub.Events():
+			if !ok {
+				return
+			}
+			var p []byte
+			p, err = json.Marshal(event)
+			if err != nil {
+				dcontext.GetLogger(eh).Errorf("error marshaling event %s: %v", event.ID, err)
+				continue
+			}
+			_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Action, p)
+		case <-sub.Dropped():
+			_, err = fmt.Fprint(w, "event: dropped\ndata: {}\n\n")
+		case <-ticker.C:
+			_, err = fmt.Fprint(w, ": heartbeat\n\n")
+		}
+		if err != nil {
+			dcontext.GetLogger(eh).Debugf("error streaming events: %v", err)
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// CloseEventStream ends the event stream of the registry, if enabled, so that
+// its clients do not hold a graceful shutdown until the drain timeout.
+func (app *App) CloseEventStream() {
+	if app.events.stream == nil {
+		return
+	}
+	if err := app.events.stream.Close(); err != nil {
+		dcontext.GetLogger(app).Errorf("error closing the event stream: %v", err)
+	}
+}
@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/gorilla/mux"
+)
+
+// frozenDenied returns an error when the request pushes to or deletes from a
+// frozen repository. Only the requests reading the repository are allowed.
+func (app *App) frozenDenied(ctx *Context, r *http.Request, name reference.Named) error {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead || app.freezer == nil {
+		return nil
+	}
+	if route := mux.CurrentRoute(r); route != nil && route.GetName() == v2.RouteNameBlobsExist {
+		return nil
+	}
+
+	repository, err := app.freezer.Repository(ctx, name)
+	if err != nil {
+		// the error is reported when resolving the repository of the request
+		return nil
+	}
+	freezer, ok := repository.(distribution.RepositoryFreezer)
+	if !ok {
+		return nil
+	}
+
+	frozen, err := freezer.Frozen(ctx)
+	if err != nil {
+		return errcode.ErrorCodeUnknown.WithDetail(err)
+	}
+	if frozen {
+		return v2.ErrorCodeRepositoryFrozen.WithDetail(map[string]string{"name": name.Name()})
+	}
+	return nil
+}
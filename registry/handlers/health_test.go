@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	gocontext "context"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -12,6 +13,7 @@ import (
 	"github.com/distribution/distribution/v3/configuration"
 	"github.com/distribution/distribution/v3/context"
 	"github.com/distribution/distribution/v3/health"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
 )
 
 func TestFileHealthCheck(t *testing.T) {
@@ -65,6 +67,65 @@ func TestFileHealthCheck(t *testing.T) {
 	}
 }
 
+// probedDriver signals the deletions of the canary objects, marking the end
+// of each probe.
+type probedDriver struct {
+	storagedriver.StorageDriver
+	deleted chan struct{}
+}
+
+func (d probedDriver) Delete(ctx gocontext.Context, path string) error {
+	err := d.StorageDriver.Delete(ctx, path)
+	select {
+	case d.deleted <- struct{}{}:
+	default:
+	}
+	return err
+}
+
+func TestStorageDriverProbe(t *testing.T) {
+	interval := 100 * time.Millisecond
+
+	config := &configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+	}
+	config.Health.StorageDriver.Probe = configuration.StorageDriverProbe{
+		Enabled:  true,
+		Interval: interval,
+	}
+
+	ctx := context.Background()
+
+	app := NewApp(ctx, config)
+	driver := app.driver
+	deleted := make(chan struct{})
+	app.driver = probedDriver{StorageDriver: driver, deleted: deleted}
+	healthRegistry := health.NewRegistry()
+	app.RegisterHealthChecks(healthRegistry)
+
+	// Wait for the third probe to delete its canary, the status of the
+	// previous ones being updated by then
+	for i := 0; i < 3; i++ {
+		select {
+		case <-deleted:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for probe %d", i)
+		}
+	}
+
+	if status := healthRegistry.CheckStatus(); len(status) != 0 {
+		t.Fatalf("expected 0 items in health check results, got %v", status)
+	}
+	if canaries, err := driver.List(ctx, defaultProbeDirectory); err == nil && len(canaries) != 0 {
+		t.Fatalf("expected the canary objects to be deleted, got %v", canaries)
+	}
+}
+
 func TestTCPHealthCheck(t *testing.T) {
 	interval := time.Second
 
@@ -73,14 +73,15 @@ func parseContentRange(cr string) (int64, int64, error) {
 	if len(ranges) != 2 {
 		return -1, -1, fmt.Errorf("invalid content range format, %s", cr)
 	}
-	start, err := strconv.ParseInt(ranges[0], 10, 64)
+	// signs are rejected, such as in 10-+20
+	start, err := strconv.ParseUint(ranges[0], 10, 63)
 	if err != nil {
 		return -1, -1, err
 	}
-	end, err := strconv.ParseInt(ranges[1], 10, 64)
+	end, err := strconv.ParseUint(ranges[1], 10, 63)
 	if err != nil {
 		return -1, -1, err
 	}
 
-	return start, end, nil
+	return int64(start), int64(end), nil
 }
@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+)
+
+const (
+	// defaultDialTimeout and defaultDialKeepAlive are the settings of the
+	// dialer of the default Go transport.
+	defaultDialTimeout   = 30 * time.Second
+	defaultDialKeepAlive = 30 * time.Second
+)
+
+// httpClientTLSVersions maps the minimum TLS versions of the outbound
+// connections to their constants.
+var httpClientTLSVersions = map[string]uint16{
+	"tls1.2": tls.VersionTLS12,
+	"tls1.3": tls.VersionTLS13,
+}
+
+// newHTTPTransport returns the transport of the outbound HTTP connections,
+// the default Go transport with the configured settings.
+func newHTTPTransport(config configuration.HTTPClient) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	dialer := &net.Dialer{
+		Timeout:       config.Dialer.Timeout,
+		KeepAlive:     config.Dialer.KeepAlive,
+		FallbackDelay: config.Dialer.FallbackDelay,
+	}
+	if dialer.Timeout == 0 {
+		dialer.Timeout = defaultDialTimeout
+	}
+	if dialer.KeepAlive == 0 {
+		dialer.KeepAlive = defaultDialKeepAlive
+	}
+	switch network := config.Dialer.Network; network {
+	case "", "tcp":
+		transport.DialContext = dialer.DialContext
+	case "tcp4", "tcp6":
+		transport.DialContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		}
+	default:
+		return nil, fmt.Errorf("unknown network %q, expected tcp, tcp4 or tcp6", network)
+	}
+
+	if config.Proxy != "" {
+		proxyURL, err := url.Parse(config.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %v", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if len(config.TLS.RootCAs) > 0 || config.TLS.MinimumTLS != "" {
+		tlsConfig := &tls.Config{}
+		if config.TLS.MinimumTLS != "" {
+			version, ok := httpClientTLSVersions[config.TLS.MinimumTLS]
+			if !ok {
+				return nil, fmt.Errorf("unknown minimum TLS level %q", config.TLS.MinimumTLS)
+			}
+			tlsConfig.MinVersion = version
+		}
+		if len(config.TLS.RootCAs) > 0 {
+			pool, err := x509.SystemCertPool()
+			if err != nil {
+				pool = x509.NewCertPool()
+			}
+			for _, ca := range config.TLS.RootCAs {
+				pem, err := os.ReadFile(ca)
+				if err != nil {
+					return nil, err
+				}
+				if !pool.AppendCertsFromPEM(pem) {
+					return nil, fmt.Errorf("no certificate found in CA bundle %s", ca)
+				}
+			}
+			tlsConfig.RootCAs = pool
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	if config.TLSHandshakeTimeout != 0 {
+		transport.TLSHandshakeTimeout = config.TLSHandshakeTimeout
+	}
+	if config.ResponseHeaderTimeout != 0 {
+		transport.ResponseHeaderTimeout = config.ResponseHeaderTimeout
+	}
+	if config.IdleConnTimeout != 0 {
+		transport.IdleConnTimeout = config.IdleConnTimeout
+	}
+	return transport, nil
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+)
+
+func TestNewHTTPTransport(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(bundle, cert, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var config configuration.HTTPClient
+	config.Dialer.Network = "tcp4"
+	config.TLS.RootCAs = []string{bundle}
+	config.TLS.MinimumTLS = "tls1.3"
+	config.ResponseHeaderTimeout = 5 * time.Second
+	transport, err := newHTTPTransport(config)
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %v", err)
+	}
+	if transport.TLSClientConfig.MinVersion != tls.VersionTLS13 {
+		t.Errorf("unexpected minimum TLS version: %x", transport.TLSClientConfig.MinVersion)
+	}
+	if transport.ResponseHeaderTimeout != 5*time.Second {
+		t.Errorf("unexpected response header timeout: %s", transport.ResponseHeaderTimeout)
+	}
+
+	// the CA bundle is trusted
+	resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error connecting to the server: %v", err)
+	}
+	resp.Body.Close()
+
+	// the server only listens on IPv4
+	config.Dialer.Network = "tcp6"
+	transport, err = newHTTPTransport(config)
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %v", err)
+	}
+	if _, err := (&http.Client{Transport: transport}).Get(server.URL); err == nil {
+		t.Fatal("expected an error connecting to an IPv4 server over IPv6")
+	}
+}
+
+func TestNewHTTPTransportProxy(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+	}))
+	defer proxy.Close()
+
+	var config configuration.HTTPClient
+	config.Proxy = proxy.URL
+	transport, err := newHTTPTransport(config)
+	if err != nil {
+		t.Fatalf("unexpected error creating transport: %v", err)
+	}
+	resp, err := (&http.Client{Transport: transport}).Get("http://registry.example.com/v2/")
+	if err != nil {
+		t.Fatalf("unexpected error connecting through the proxy: %v", err)
+	}
+	resp.Body.Close()
+	if proxied != "http://registry.example.com/v2/" {
+		t.Errorf("unexpected proxied request: %q", proxied)
+	}
+}
+
+func TestNewHTTPTransportInvalid(t *testing.T) {
+	for _, config := range []configuration.HTTPClient{
+		{Proxy: "://proxy"},
+		func() (c configuration.HTTPClient) { c.Dialer.Network = "udp"; return }(),
+		func() (c configuration.HTTPClient) { c.TLS.MinimumTLS = "tls1.0"; return }(),
+		func() (c configuration.HTTPClient) { c.TLS.RootCAs = []string{"/nonexistent/ca.pem"}; return }(),
+	} {
+		if _, err := newHTTPTransport(config); err == nil {
+			t.Errorf("expected an error creating transport of %+v", config)
+		}
+	}
+}
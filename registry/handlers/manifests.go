@@ -2,6 +2,8 @@ package handlers
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"mime"
 	"net/http"
@@ -9,6 +11,7 @@ import (
 
 	"github.com/distribution/distribution/v3"
 	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/manifest"
 	"github.com/distribution/distribution/v3/manifest/manifestlist"
 	"github.com/distribution/distribution/v3/manifest/ocischema"
 	"github.com/distribution/distribution/v3/manifest/schema1"
@@ -17,6 +20,7 @@ import (
 	"github.com/distribution/distribution/v3/registry/api/errcode"
 	v2 "github.com/distribution/distribution/v3/registry/api/v2"
 	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/distribution/distribution/v3/registry/storage"
 	"github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/gorilla/handlers"
 	"github.com/opencontainers/go-digest"
@@ -32,6 +36,36 @@ const (
 	imageClass          = "image"
 )
 
+// The conversions of the schema2 manifests and manifest lists fetched by tag
+// by the clients not supporting schema2.
+const (
+	// schema1Convert converts them to schema1 on the fly.
+	schema1Convert = "convert"
+	// schema1Reject rejects the requests with a message guiding the users
+	// to upgrade their client.
+	schema1Reject = "reject"
+)
+
+// schema1Conversions are the valid conversions.
+var schema1Conversions = map[string]struct{}{
+	schema1Convert: {},
+	schema1Reject:  {},
+}
+
+const (
+	// defaultSchema1Message is the message of the rejected requests for
+	// schema1 manifests, unless configured.
+	defaultSchema1Message = "the manifest is not available in the deprecated schema1 format requested by the client, upgrade the client to pull it"
+
+	// schema1Warning is the Warning header of the manifests converted to
+	// schema1.
+	schema1Warning = `299 - "the manifest was converted to the deprecated schema1 format requested by the client, upgrade the client to pull it unconverted"`
+)
+
+// errSchema1Rejected is returned when the conversion of a manifest to schema1
+// is rejected.
+var errSchema1Rejected = errors.New("conversion to schema1 rejected")
+
 type storageType int
 
 const (
@@ -63,7 +97,7 @@ func manifestDispatcher(ctx *Context, r *http.Request) http.Handler {
 		"HEAD": http.HandlerFunc(manifestHandler.GetManifest),
 	}
 
-	if !ctx.readOnly {
+	if !ctx.ReadOnly() {
 		mhandler["PUT"] = http.HandlerFunc(manifestHandler.PutManifest)
 		mhandler["DELETE"] = http.HandlerFunc(manifestHandler.DeleteManifest)
 	}
@@ -89,6 +123,8 @@ func (imh *manifestHandler) GetManifest(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	var supports [numStorageTypes]bool
+	var artifactType string
+	var platforms []manifestlist.PlatformSpec
 
 	// this parsing of Accept headers is not quite as full-featured as godoc.org's parser, but we don't care about "q=" values
 	// https://github.com/golang/gddo/blob/e91d4165076d7474d20abda83f92d15c7ebc3e81/httputil/header/header.go#L165-L202
@@ -99,7 +135,8 @@ func (imh *manifestHandler) GetManifest(w http.ResponseWriter, r *http.Request)
 		// we need to split each header value on "," to get the full list of "Accept" values (per RFC 2616)
 		// https://www.w3.org/Protocols/rfc2616/rfc2616-sec14.html#sec14.1
 		for _, mediaType := range strings.Split(acceptHeader, ",") {
-			if mediaType, _, err = mime.ParseMediaType(mediaType); err != nil {
+			var params map[string]string
+			if mediaType, params, err = mime.ParseMediaType(mediaType); err != nil {
 				continue
 			}
 
@@ -109,15 +146,34 @@ func (imh *manifestHandler) GetManifest(w http.ResponseWriter, r *http.Request)
 			if mediaType == manifestlist.MediaTypeManifestList {
 				supports[manifestlistSchema] = true
 			}
+			if mediaType == manifestlist.MediaTypeManifestList || mediaType == v1.MediaTypeImageIndex {
+				// the entries of an index may be filtered to the
+				// platforms of the client, one per accepted type
+				if platform, ok := parsePlatform(params["platform"]); ok {
+					platforms = append(platforms, platform)
+				}
+			}
 			if mediaType == v1.MediaTypeImageManifest {
 				supports[ociSchema] = true
 			}
 			if mediaType == v1.MediaTypeImageIndex {
 				supports[ociImageIndexSchema] = true
+				// an index of the artifacts of a given type may be
+				// requested instead of the manifest
+				if params["artifacttype"] != "" {
+					artifactType = params["artifacttype"]
+				}
 			}
 		}
 	}
 
+	if imh.Tag == "" {
+		// a manifest fetched by digest must match it, so it is never
+		// filtered
+		artifactType = ""
+		platforms = nil
+	}
+
 	if imh.Tag != "" {
 		tags := imh.Repository.Tags(imh)
 		desc, err := tags.Get(imh, imh.Tag)
@@ -132,7 +188,8 @@ func (imh *manifestHandler) GetManifest(w http.ResponseWriter, r *http.Request)
 		imh.Digest = desc.Digest
 	}
 
-	if etagMatch(r, imh.Digest.String()) {
+	if artifactType == "" && len(platforms) == 0 && etagMatch(r, imh.Digest.String()) {
+		w.Header().Set("Etag", fmt.Sprintf(`"%s"`, imh.Digest))
 		w.WriteHeader(http.StatusNotModified)
 		return
 	}
@@ -150,6 +207,11 @@ func (imh *manifestHandler) GetManifest(w http.ResponseWriter, r *http.Request)
 		}
 		return
 	}
+
+	if artifactType != "" {
+		imh.serveArtifacts(w, r, manifests, manifest, artifactType)
+		return
+	}
 	// determine the type of the returned manifest
 	manifestType := manifestSchema1
 	schema2Manifest, isSchema2 := manifest.(*schema2.DeserializedManifest)
@@ -174,9 +236,14 @@ func (imh *manifestHandler) GetManifest(w http.ResponseWriter, r *http.Request)
 		imh.Errors = append(imh.Errors, v2.ErrorCodeManifestUnknown.WithMessage("OCI index found, but accept header does not support OCI indexes"))
 		return
 	}
+	if isManifestList && supports[manifestType] && len(platforms) > 0 {
+		imh.servePlatforms(w, r, manifestList, platforms)
+		return
+	}
 	// Only rewrite schema2 manifests when they are being fetched by tag.
 	// If they are being fetched by digest, we can't return something not
 	// matching the digest.
+	converted := false
 	if imh.Tag != "" && manifestType == manifestSchema2 && !supports[manifestSchema2] {
 		// Rewrite manifest in schema1 format
 		dcontext.GetLogger(imh).Infof("rewriting manifest %s in schema1 format to support old client", imh.Digest.String())
@@ -185,6 +252,7 @@ func (imh *manifestHandler) GetManifest(w http.ResponseWriter, r *http.Request)
 		if err != nil {
 			return
 		}
+		converted = true
 	} else if imh.Tag != "" && manifestType == manifestlistSchema && !supports[manifestlistSchema] {
 		// Rewrite manifest in schema1 format
 		dcontext.GetLogger(imh).Infof("rewriting manifest list %s in schema1 format to support old client", imh.Digest.String())
@@ -200,7 +268,7 @@ func (imh *manifestHandler) GetManifest(w http.ResponseWriter, r *http.Request)
 		}
 
 		if manifestDigest == "" {
-			imh.Errors = append(imh.Errors, v2.ErrorCodeManifestUnknown)
+			imh.Errors = append(imh.Errors, v2.ErrorCodeManifestUnknown.WithMessage(fmt.Sprintf("manifest list has no manifest for the %s/%s platform", defaultOS, defaultArch)))
 			return
 		}
 
@@ -220,11 +288,16 @@ func (imh *manifestHandler) GetManifest(w http.ResponseWriter, r *http.Request)
 			if err != nil {
 				return
 			}
+			converted = true
 		} else {
 			imh.Digest = manifestDigest
 		}
 	}
 
+	if converted {
+		w.Header().Set("Warning", schema1Warning)
+	}
+
 	ct, p, err := manifest.Payload()
 	if err != nil {
 		return
@@ -237,7 +310,174 @@ func (imh *manifestHandler) GetManifest(w http.ResponseWriter, r *http.Request)
 	w.Write(p)
 }
 
+// serveArtifacts serves an OCI index of the manifests of the given artifact
+// type listed by the fetched manifest, if it is an index, and of its
+// referrers. It saves clients fetching the attestations of an image, such as
+// SBOMs, a round trip to the referrers API. The index is built on the fly and
+// is not stored, its digest is the digest of the served payload.
+func (imh *manifestHandler) serveArtifacts(w http.ResponseWriter, r *http.Request, manifests distribution.ManifestService, fetched distribution.Manifest, artifactType string) {
+	artifacts := []distribution.Descriptor{}
+	listed := make(map[digest.Digest]bool)
+
+	if index, ok := fetched.(*manifestlist.DeserializedManifestList); ok {
+		for _, entry := range index.Manifests {
+			descriptor := entry.Descriptor
+			if descriptor.ArtifactType == "" {
+				// entries rarely declare the artifact type of the
+				// manifest they point to
+				child, err := manifests.Get(imh, descriptor.Digest)
+				if err != nil {
+					if _, ok := err.(distribution.ErrManifestUnknownRevision); ok {
+						continue
+					}
+					imh.Errors = append(imh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+					return
+				}
+				descriptor.ArtifactType = storage.ManifestArtifactType(child)
+			}
+			if descriptor.ArtifactType != artifactType {
+				continue
+			}
+			artifacts = append(artifacts, descriptor)
+			listed[descriptor.Digest] = true
+		}
+	}
+
+	if referrerService, ok := manifests.(distribution.ManifestReferrers); ok {
+		referrers, err := referrerService.Referrers(imh, imh.Digest, artifactType)
+		if err != nil && err != distribution.ErrUnsupported {
+			imh.Errors = append(imh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+			return
+		}
+		for _, referrer := range referrers {
+			if !listed[referrer.Digest] {
+				artifacts = append(artifacts, referrer)
+			}
+		}
+	}
+
+	p, err := json.Marshal(referrersAPIResponse{
+		Versioned: manifest.Versioned{
+			SchemaVersion: 2,
+			MediaType:     v1.MediaTypeImageIndex,
+		},
+		Manifests: artifacts,
+	})
+	if err != nil {
+		imh.Errors = append(imh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+	dgst := digest.FromBytes(p)
+
+	w.Header().Set("Vary", "Accept")
+	if etagMatch(r, dgst.String()) {
+		w.Header().Set("Etag", fmt.Sprintf(`"%s"`, dgst))
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("OCI-Filters-Applied", "artifactType")
+	w.Header().Set("Content-Type", v1.MediaTypeImageIndex)
+	w.Header().Set("Content-Length", fmt.Sprint(len(p)))
+	w.Header().Set("Docker-Content-Digest", dgst.String())
+	w.Header().Set("Etag", fmt.Sprintf(`"%s"`, dgst))
+	w.Write(p)
+}
+
+// servePlatforms serves the fetched index with only the entries of the given
+// platforms, sparing multi-platform clients the download of the entries of
+// all the others. The attestation manifests buildkit lists for the entries
+// kept are kept too. If entries are filtered out, the index is built on the
+// fly and is not stored, its digest is the digest of the served payload.
+func (imh *manifestHandler) servePlatforms(w http.ResponseWriter, r *http.Request, index *manifestlist.DeserializedManifestList, platforms []manifestlist.PlatformSpec) {
+	kept := make(map[digest.Digest]bool)
+	for _, entry := range index.Manifests {
+		for _, platform := range platforms {
+			if matchPlatform(entry.Platform, platform) {
+				kept[entry.Digest] = true
+				break
+			}
+		}
+	}
+	if len(kept) == 0 {
+		imh.Errors = append(imh.Errors, v2.ErrorCodeManifestUnknown.WithMessage("no manifest of the index matches the requested platforms"))
+		return
+	}
+
+	filtered := index.ManifestList
+	filtered.Manifests = nil
+	for _, entry := range index.Manifests {
+		if kept[entry.Digest] ||
+			entry.Annotations[attestationReferenceTypeAnnotation] == "attestation-manifest" && kept[digest.Digest(entry.Annotations[attestationReferenceDigestAnnotation])] {
+			filtered.Manifests = append(filtered.Manifests, entry)
+		}
+	}
+
+	ct, p, err := index.Payload()
+	if err != nil {
+		imh.Errors = append(imh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+	dgst := imh.Digest
+	if len(filtered.Manifests) < len(index.Manifests) {
+		p, err = json.MarshalIndent(&filtered, "", "   ")
+		if err != nil {
+			imh.Errors = append(imh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+			return
+		}
+		dgst = digest.FromBytes(p)
+		w.Header().Set("OCI-Filters-Applied", "platform")
+	}
+
+	w.Header().Set("Vary", "Accept")
+	if etagMatch(r, dgst.String()) {
+		w.Header().Set("Etag", fmt.Sprintf(`"%s"`, dgst))
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", ct)
+	w.Header().Set("Content-Length", fmt.Sprint(len(p)))
+	w.Header().Set("Docker-Content-Digest", dgst.String())
+	w.Header().Set("Etag", fmt.Sprintf(`"%s"`, dgst))
+	w.Write(p)
+}
+
+// These annotations mark the attestation manifests listed by buildkit in
+// image indexes, with the digest of the image manifest they attest.
+const (
+	attestationReferenceTypeAnnotation   = "vnd.docker.reference.type"
+	attestationReferenceDigestAnnotation = "vnd.docker.reference.digest"
+)
+
+// parsePlatform parses a platform formatted as os/architecture[/variant].
+func parsePlatform(value string) (manifestlist.PlatformSpec, bool) {
+	parts := strings.Split(value, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return manifestlist.PlatformSpec{}, false
+	}
+	platform := manifestlist.PlatformSpec{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		platform.Variant = parts[2]
+	}
+	return platform, true
+}
+
+// matchPlatform returns whether the platform of an index entry matches the
+// requested one, whose variant only needs to match if it is set.
+func matchPlatform(platform, requested manifestlist.PlatformSpec) bool {
+	return platform.OS == requested.OS &&
+		platform.Architecture == requested.Architecture &&
+		(requested.Variant == "" || platform.Variant == requested.Variant)
+}
+
 func (imh *manifestHandler) convertSchema2Manifest(schema2Manifest *schema2.DeserializedManifest) (distribution.Manifest, error) {
+	if imh.schema1Conversion() == schema1Reject {
+		dcontext.GetLogger(imh).Infof("rejecting conversion of manifest %s in schema1 format for old client", imh.Digest.String())
+		imh.Errors = append(imh.Errors, v2.ErrorCodeManifestUnknown.WithMessage(imh.App.schema1Message))
+		return nil, errSchema1Rejected
+	}
+
 	targetDescriptor := schema2Manifest.Target()
 	blobs := imh.Repository.Blobs(imh)
 	configJSON, err := blobs.Get(imh, targetDescriptor.Digest)
@@ -277,15 +517,37 @@ func (imh *manifestHandler) convertSchema2Manifest(schema2Manifest *schema2.Dese
 	return manifest, nil
 }
 
+// etagMatch reports whether the If-None-Match header of the request matches
+// the given etag.
 func etagMatch(r *http.Request, etag string) bool {
-	for _, headerVal := range r.Header["If-None-Match"] {
-		if headerVal == etag || headerVal == fmt.Sprintf(`"%s"`, etag) { // allow quoted or unquoted
-			return true
+	return etagListMatch(r.Header["If-None-Match"], etag)
+}
+
+// etagListMatch reports whether the values of a conditional header, each a
+// comma separated list of entity tags, match the given etag or contain "*".
+// Manifests are identified by their digest, so weak entity tags are compared
+// as strong ones.
+func etagListMatch(values []string, etag string) bool {
+	for _, headerVal := range values {
+		for _, candidate := range strings.Split(headerVal, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag || candidate == fmt.Sprintf(`"%s"`, etag) { // allow quoted or unquoted
+				return true
+			}
 		}
 	}
 	return false
 }
 
+// maxManifestSize returns the maximum size of the body of a manifest PUT
+// request.
+func (imh *manifestHandler) maxManifestSize() int64 {
+	if max := imh.App.Config.HTTP.Limits.MaxManifestSize; max > 0 {
+		return max
+	}
+	return maxManifestBodySize
+}
+
 // PutManifest validates and stores a manifest in the registry.
 func (imh *manifestHandler) PutManifest(w http.ResponseWriter, r *http.Request) {
 	dcontext.GetLogger(imh).Debug("PutImageManifest")
@@ -295,18 +557,35 @@ func (imh *manifestHandler) PutManifest(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	var jsonBuf bytes.Buffer
-	if err := copyFullPayload(imh, w, r, &jsonBuf, maxManifestBodySize, "image manifest PUT"); err != nil {
-		// copyFullPayload reports the error if necessary
-		imh.Errors = append(imh.Errors, v2.ErrorCodeManifestInvalid.WithDetail(err.Error()))
+	// the preconditions are checked before storing the manifest, and again
+	// when tagging it
+	checkTag, err := imh.checkTagPreconditions(r)
+	if err != nil {
+		imh.Errors = append(imh.Errors, err)
 		return
 	}
 
-	mediaType := r.Header.Get("Content-Type")
-	manifest, desc, err := distribution.UnmarshalManifest(mediaType, jsonBuf.Bytes())
-	if err != nil {
-		imh.Errors = append(imh.Errors, v2.ErrorCodeManifestInvalid.WithDetail(err))
-		return
+	var manifest distribution.Manifest
+	var desc distribution.Descriptor
+	if mountDigest, fromRepo := r.FormValue("mount"), r.FormValue("from"); mountDigest != "" && fromRepo != "" {
+		manifest, desc, err = imh.mountManifest(manifests, fromRepo, mountDigest)
+		if err != nil {
+			imh.Errors = append(imh.Errors, err)
+			return
+		}
+	} else {
+		var jsonBuf bytes.Buffer
+		if err := copyFullPayload(imh, w, r, &jsonBuf, imh.maxManifestSize(), "image manifest PUT"); err != nil {
+			// copyFullPayload reports the error if necessary
+			imh.Errors = append(imh.Errors, v2.ErrorCodeManifestInvalid.WithDetail(err.Error()))
+			return
+		}
+
+		manifest, desc, err = distribution.UnmarshalManifest(r.Header.Get("Content-Type"), jsonBuf.Bytes())
+		if err != nil {
+			imh.Errors = append(imh.Errors, v2.ErrorCodeManifestInvalid.WithDetail(err))
+			return
+		}
 	}
 
 	if imh.Digest != "" {
@@ -322,7 +601,7 @@ func (imh *manifestHandler) PutManifest(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	isAnOCIManifest := mediaType == v1.MediaTypeImageManifest || mediaType == v1.MediaTypeImageIndex
+	isAnOCIManifest := desc.MediaType == v1.MediaTypeImageManifest || desc.MediaType == v1.MediaTypeImageIndex
 
 	if isAnOCIManifest {
 		dcontext.GetLogger(imh).Debug("Putting an OCI Manifest!")
@@ -340,6 +619,11 @@ func (imh *manifestHandler) PutManifest(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	if err := imh.applyTagPolicy(desc.Digest); err != nil {
+		imh.Errors = append(imh.Errors, err)
+		return
+	}
+
 	_, err = manifests.Put(imh, manifest, options...)
 	if err != nil {
 		// TODO(stevvooe): These error handling switches really need to be
@@ -362,6 +646,8 @@ func (imh *manifestHandler) PutManifest(w http.ResponseWriter, r *http.Request)
 					imh.Errors = append(imh.Errors, v2.ErrorCodeNameInvalid.WithDetail(err))
 				case distribution.ErrManifestUnverified:
 					imh.Errors = append(imh.Errors, v2.ErrorCodeManifestUnverified)
+				case distribution.ErrManifestRejected:
+					imh.Errors = append(imh.Errors, v2.ErrorCodeManifestInvalid.WithDetail(verificationError.Reason.Error()))
 				default:
 					if verificationError == digest.ErrDigestInvalidFormat {
 						imh.Errors = append(imh.Errors, v2.ErrorCodeDigestInvalid)
@@ -381,8 +667,18 @@ func (imh *manifestHandler) PutManifest(w http.ResponseWriter, r *http.Request)
 	// Tag this manifest
 	if imh.Tag != "" {
 		tags := imh.Repository.Tags(imh)
-		err = tags.Tag(imh, imh.Tag, desc)
+		err = distribution.ErrUnsupported
+		if tagger, ok := tags.(distribution.TagConditionalTagger); ok && checkTag != nil {
+			err = tagger.TagIf(imh, imh.Tag, desc, checkTag)
+		}
+		if err == distribution.ErrUnsupported {
+			err = tags.Tag(imh, imh.Tag, desc)
+		}
 		if err != nil {
+			if err, ok := err.(errcode.Error); ok {
+				imh.Errors = append(imh.Errors, err)
+				return
+			}
 			imh.Errors = append(imh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
 			return
 		}
@@ -404,6 +700,18 @@ func (imh *manifestHandler) PutManifest(w http.ResponseWriter, r *http.Request)
 		dcontext.GetLogger(imh).Errorf("error building manifest url from digest: %v", err)
 	}
 
+	// Signal that the subject was indexed for the referrers API.
+	var subject *distribution.Descriptor
+	switch m := manifest.(type) {
+	case *ocischema.DeserializedManifest:
+		subject = m.Subject
+	case *manifestlist.DeserializedManifestList:
+		subject = m.Subject
+	}
+	if subject != nil {
+		w.Header().Set("OCI-Subject", subject.Digest.String())
+	}
+
 	w.Header().Set("Location", location)
 	w.Header().Set("Docker-Content-Digest", imh.Digest.String())
 	w.WriteHeader(http.StatusCreated)
@@ -411,6 +719,108 @@ func (imh *manifestHandler) PutManifest(w http.ResponseWriter, r *http.Request)
 	dcontext.GetLogger(imh).Debug("Succeeded in putting manifest!")
 }
 
+// mountManifest links the manifest of fromRepo with the given digest into the
+// repository of the request, along with the blobs and manifests it
+// references, so that it can be put there without the client pulling and
+// pushing its content. The returned errors are meant for the response.
+func (imh *manifestHandler) mountManifest(manifests distribution.ManifestService, fromRepo, mountDigest string) (distribution.Manifest, distribution.Descriptor, error) {
+	dgst, err := digest.Parse(mountDigest)
+	if err != nil {
+		return nil, distribution.Descriptor{}, v2.ErrorCodeDigestInvalid.WithDetail(err)
+	}
+	if imh.Digest != "" && imh.Digest != dgst {
+		return nil, distribution.Descriptor{}, v2.ErrorCodeDigestInvalid.WithDetail("the mounted digest does not match the reference")
+	}
+	from, err := reference.WithName(fromRepo)
+	if err != nil {
+		return nil, distribution.Descriptor{}, v2.ErrorCodeNameInvalid.WithDetail(err)
+	}
+	source, err := imh.App.registry.Repository(imh, from)
+	if err != nil {
+		if _, ok := err.(distribution.ErrRepositoryUnknown); ok {
+			return nil, distribution.Descriptor{}, v2.ErrorCodeNameUnknown.WithDetail(err)
+		}
+		return nil, distribution.Descriptor{}, errcode.ErrorCodeUnknown.WithDetail(err)
+	}
+	sourceManifests, err := source.Manifests(imh)
+	if err != nil {
+		return nil, distribution.Descriptor{}, errcode.ErrorCodeUnknown.WithDetail(err)
+	}
+
+	manifest, err := imh.mountReferences(manifests, from, sourceManifests, source.Blobs(imh), dgst)
+	if err != nil {
+		return nil, distribution.Descriptor{}, err
+	}
+	mediaType, payload, err := manifest.Payload()
+	if err != nil {
+		return nil, distribution.Descriptor{}, errcode.ErrorCodeUnknown.WithDetail(err)
+	}
+	return manifest, distribution.Descriptor{
+		MediaType: mediaType,
+		Digest:    dgst,
+		Size:      int64(len(payload)),
+	}, nil
+}
+
+// mountReferences gets the manifest of the source repository with the given
+// digest and links what it references into the repository of the request:
+// the manifests of an index are put, after their own references, and the
+// other references are blobs, which are mounted unless they exceed the
+// maximum blob size of the repository.
+func (imh *manifestHandler) mountReferences(manifests distribution.ManifestService, from reference.Named, sourceManifests distribution.ManifestService, sourceBlobs distribution.BlobStatter, dgst digest.Digest) (distribution.Manifest, error) {
+	manifest, err := sourceManifests.Get(imh, dgst)
+	if err != nil {
+		if _, ok := err.(distribution.ErrManifestUnknownRevision); ok {
+			return nil, v2.ErrorCodeManifestUnknown.WithDetail(err)
+		}
+		return nil, errcode.ErrorCodeUnknown.WithDetail(err)
+	}
+
+	_, isIndex := manifest.(*manifestlist.DeserializedManifestList)
+	blobs := imh.Repository.Blobs(imh)
+	for _, ref := range manifest.References() {
+		if isIndex {
+			child, err := imh.mountReferences(manifests, from, sourceManifests, sourceBlobs, ref.Digest)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := manifests.Put(imh, child); err != nil {
+				return nil, errcode.ErrorCodeUnknown.WithDetail(err)
+			}
+			continue
+		}
+
+		canonical, err := reference.WithDigest(from, ref.Digest)
+		if err != nil {
+			return nil, v2.ErrorCodeDigestInvalid.WithDetail(err)
+		}
+		desc, err := sourceBlobs.Stat(imh, ref.Digest)
+		if err != nil {
+			if err == distribution.ErrBlobUnknown {
+				return nil, v2.ErrorCodeManifestBlobUnknown.WithDetail(ref.Digest)
+			}
+			return nil, errcode.ErrorCodeUnknown.WithDetail(err)
+		}
+		if err := imh.blobSizeDenied(desc.Size); err != nil {
+			return nil, err
+		}
+		upload, err := blobs.Create(imh, storage.WithMountFrom(canonical), storage.WithMountDescriptor(desc))
+		switch err.(type) {
+		case distribution.ErrBlobMounted:
+		case nil:
+			// the blob is not in the source repository
+			upload.Cancel(imh)
+			return nil, v2.ErrorCodeManifestBlobUnknown.WithDetail(ref.Digest)
+		default:
+			if err == distribution.ErrUnsupported {
+				return nil, errcode.ErrorCodeUnsupported
+			}
+			return nil, errcode.ErrorCodeUnknown.WithDetail(err)
+		}
+	}
+	return manifest, nil
+}
+
 // applyResourcePolicy checks whether the resource class matches what has
 // been authorized and allowed by the policy configuration.
 func (imh *manifestHandler) applyResourcePolicy(manifest distribution.Manifest) error {
@@ -482,6 +892,81 @@ func (imh *manifestHandler) applyResourcePolicy(manifest distribution.Manifest)
 
 }
 
+// checkTagPreconditions evaluates the If-Match and If-None-Match headers of a
+// manifest PUT by tag against the manifest the tag references, so that
+// clients moving a tag do not clobber a concurrent update: If-Match requires
+// the tag to reference one of the listed digests, or to exist with "*", and
+// If-None-Match requires it not to, "*" creating the tag only if it does not
+// exist yet. It returns the check of the preconditions, to be evaluated again
+// atomically with the update of the tag, or nil if there is none.
+func (imh *manifestHandler) checkTagPreconditions(r *http.Request) (func(current digest.Digest) error, error) {
+	ifMatch, ifNoneMatch := r.Header["If-Match"], r.Header["If-None-Match"]
+	if imh.Tag == "" || (len(ifMatch) == 0 && len(ifNoneMatch) == 0) {
+		return nil, nil
+	}
+
+	check := func(current digest.Digest) error {
+		if len(ifMatch) > 0 && (current == "" || !etagListMatch(ifMatch, current.String())) {
+			return v2.ErrorCodePreconditionFailed.WithDetail(fmt.Sprintf("tag %s does not reference a manifest matching If-Match", imh.Tag))
+		}
+		if len(ifNoneMatch) > 0 && current != "" && etagListMatch(ifNoneMatch, current.String()) {
+			return v2.ErrorCodePreconditionFailed.WithDetail(fmt.Sprintf("tag %s references a manifest matching If-None-Match", imh.Tag))
+		}
+		return nil
+	}
+
+	var current digest.Digest
+	desc, err := imh.Repository.Tags(imh).Get(imh, imh.Tag)
+	switch err.(type) {
+	case nil:
+		current = desc.Digest
+	case distribution.ErrTagUnknown:
+	default:
+		return nil, errcode.ErrorCodeUnknown.WithDetail(err)
+	}
+	if err := check(current); err != nil {
+		return nil, err
+	}
+	return check, nil
+}
+
+// applyTagPolicy checks whether the namespace of the repository allows
+// tagging the manifest with the given digest: immutable tags may not be moved
+// to another manifest, and new tags may not exceed the maximum number of tags.
+func (imh *manifestHandler) applyTagPolicy(dgst digest.Digest) error {
+	if imh.Tag == "" || (!imh.immutableTags() && imh.maxTags() == 0) {
+		return nil
+	}
+
+	tags := imh.Repository.Tags(imh)
+	current, err := tags.Get(imh, imh.Tag)
+	switch err.(type) {
+	case nil:
+		if imh.immutableTags() && current.Digest != dgst {
+			return errcode.ErrorCodeDenied.WithDetail(fmt.Sprintf("tag %s is immutable", imh.Tag))
+		}
+		return nil
+	case distribution.ErrTagUnknown:
+	default:
+		return errcode.ErrorCodeUnknown.WithDetail(err)
+	}
+
+	max := imh.maxTags()
+	if max == 0 {
+		return nil
+	}
+	all, err := tags.All(imh)
+	if err != nil {
+		if _, ok := err.(distribution.ErrRepositoryUnknown); !ok {
+			return errcode.ErrorCodeUnknown.WithDetail(err)
+		}
+	}
+	if len(all) >= max {
+		return errcode.ErrorCodeDenied.WithDetail(fmt.Sprintf("repository has reached its maximum of %d tags", max))
+	}
+	return nil
+}
+
 // DeleteManifest removes the manifest with the given digest or the tag with the given name from the registry.
 func (imh *manifestHandler) DeleteManifest(w http.ResponseWriter, r *http.Request) {
 	dcontext.GetLogger(imh).Debug("DeleteImageManifest")
@@ -493,6 +978,10 @@ func (imh *manifestHandler) DeleteManifest(w http.ResponseWriter, r *http.Reques
 
 	if imh.Tag != "" {
 		dcontext.GetLogger(imh).Debug("DeleteImageTag")
+		if imh.immutableTags() {
+			imh.Errors = append(imh.Errors, errcode.ErrorCodeDenied.WithDetail(fmt.Sprintf("tag %s is immutable", imh.Tag)))
+			return
+		}
 		tagService := imh.Repository.Tags(imh.Context)
 		if err := tagService.Untag(imh.Context, imh.Tag); err != nil {
 			switch err.(type) {
@@ -507,6 +996,19 @@ func (imh *manifestHandler) DeleteManifest(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	if imh.immutableTags() {
+		// deleting the manifest would delete its immutable tags
+		referencedTags, err := imh.Repository.Tags(imh).Lookup(imh, distribution.Descriptor{Digest: imh.Digest})
+		if err != nil {
+			imh.Errors = append(imh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+			return
+		}
+		if len(referencedTags) > 0 {
+			imh.Errors = append(imh.Errors, errcode.ErrorCodeDenied.WithDetail(fmt.Sprintf("manifest is tagged with immutable tags %v", referencedTags)))
+			return
+		}
+	}
+
 	manifests, err := imh.Repository.Manifests(imh)
 	if err != nil {
 		imh.Errors = append(imh.Errors, err)
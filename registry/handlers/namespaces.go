@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/gorilla/mux"
+)
+
+// namespaceActions are the actions the namespaces may allow.
+var namespaceActions = map[string]struct{}{
+	"pull":   {},
+	"push":   {},
+	"delete": {},
+	"purge":  {},
+}
+
+// namespaces resolves the settings of the repositories from the namespaces
+// they belong to.
+type namespaces struct {
+	// namespaces are sorted by name, so that parents come before their
+	// children.
+	namespaces []configuration.Namespace
+}
+
+// configureNamespaces sets up the namespaces of the repositories, if any.
+func (app *App) configureNamespaces(config *configuration.Configuration) {
+	ns, err := newNamespaces(config.Policy.Namespaces)
+	if err != nil {
+		panic(fmt.Sprintf("invalid namespace configuration: %v", err))
+	}
+	app.namespaces = ns
+}
+
+// newNamespaces validates the namespaces of the configuration.
+func newNamespaces(config []configuration.Namespace) (*namespaces, error) {
+	seen := make(map[string]struct{}, len(config))
+	for _, namespace := range config {
+		if _, err := reference.WithName(namespace.Name); err != nil {
+			return nil, fmt.Errorf("invalid namespace name %q", namespace.Name)
+		}
+		if _, ok := seen[namespace.Name]; ok {
+			return nil, fmt.Errorf("duplicate namespace %q", namespace.Name)
+		}
+		seen[namespace.Name] = struct{}{}
+
+		for _, action := range namespace.Actions {
+			if _, ok := namespaceActions[action]; !ok {
+				return nil, fmt.Errorf("unknown action %q of namespace %q", action, namespace.Name)
+			}
+		}
+		if namespace.MaxBlobSize != nil && *namespace.MaxBlobSize < 0 {
+			return nil, fmt.Errorf("negative maxblobsize of namespace %q", namespace.Name)
+		}
+		if namespace.MaxTags != nil && *namespace.MaxTags < 0 {
+			return nil, fmt.Errorf("negative maxtags of namespace %q", namespace.Name)
+		}
+		if namespace.Schema1Conversion != "" {
+			if _, ok := schema1Conversions[namespace.Schema1Conversion]; !ok {
+				return nil, fmt.Errorf("unknown schema1conversion %q of namespace %q", namespace.Schema1Conversion, namespace.Name)
+			}
+		}
+	}
+
+	sorted := append([]configuration.Namespace(nil), config...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+	return &namespaces{namespaces: sorted}, nil
+}
+
+// settings returns the effective settings of the repository, those of the
+// most specific namespace it belongs to, completed by those of its parents.
+func (ns *namespaces) settings(repository string) configuration.NamespaceSettings {
+	var settings configuration.NamespaceSettings
+	if ns == nil {
+		return settings
+	}
+
+	// parents sort before their children, whose settings override theirs
+	for _, namespace := range ns.namespaces {
+		if repository != namespace.Name && !strings.HasPrefix(repository, namespace.Name+"/") {
+			continue
+		}
+		if namespace.ImmutableTags != nil {
+			settings.ImmutableTags = namespace.ImmutableTags
+		}
+		if namespace.Actions != nil {
+			settings.Actions = namespace.Actions
+		}
+		if namespace.MaxBlobSize != nil {
+			settings.MaxBlobSize = namespace.MaxBlobSize
+		}
+		if namespace.MaxTags != nil {
+			settings.MaxTags = namespace.MaxTags
+		}
+		if namespace.Schema1Conversion != "" {
+			settings.Schema1Conversion = namespace.Schema1Conversion
+		}
+	}
+	return settings
+}
+
+// namespaceDenied returns an error when the namespace of the repository does
+// not allow the actions of the request.
+func namespaceDenied(settings configuration.NamespaceSettings, r *http.Request, repository string) error {
+	if settings.Actions == nil {
+		return nil
+	}
+
+	var records []auth.Access
+	if mux.CurrentRoute(r).GetName() == v2.RouteNameRepository {
+		records = appendRepositoryAccessRecord(records, r.Method, repository)
+	} else {
+		records = appendAccessRecords(records, r.Method, repository)
+	}
+
+	for _, record := range records {
+		if err := namespaceActionDenied(settings, "repository", record.Action); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mountSourceDenied returns an error when the namespace of the source
+// repository of a cross-repository mount does not allow pulling from it, as
+// mounting content copies it out of the source repository.
+func (app *App) mountSourceDenied(r *http.Request) error {
+	fromRepo := r.FormValue("from")
+	if fromRepo == "" {
+		return nil
+	}
+	return namespaceActionDenied(app.namespaces.settings(fromRepo), "source repository", "pull")
+}
+
+// namespaceActionDenied returns an error when the namespace settings of a
+// repository do not allow action. what describes the repository in the
+// error.
+func namespaceActionDenied(settings configuration.NamespaceSettings, what, action string) error {
+	if settings.Actions == nil {
+		return nil
+	}
+	for _, allowed := range settings.Actions {
+		if action == allowed {
+			return nil
+		}
+	}
+	return errcode.ErrorCodeDenied.WithDetail(fmt.Sprintf("the namespace of the %s does not allow %s", what, action))
+}
+
+// immutableTags returns whether the tags of the repository of the request
+// are immutable.
+func (ctx *Context) immutableTags() bool {
+	return ctx.namespace.ImmutableTags != nil && *ctx.namespace.ImmutableTags
+}
+
+// maxBlobSize returns the maximum size of the blobs uploaded to the
+// repository of the request, zero being unlimited.
+func (ctx *Context) maxBlobSize() int64 {
+	if ctx.namespace.MaxBlobSize == nil {
+		return 0
+	}
+	return *ctx.namespace.MaxBlobSize
+}
+
+// blobSizeDenied returns an error when a blob of the given size exceeds the
+// maximum size of the blobs of the repository of the request.
+func (ctx *Context) blobSizeDenied(size int64) error {
+	if max := ctx.maxBlobSize(); max > 0 && size > max {
+		return errcode.ErrorCodeDenied.WithDetail(fmt.Sprintf("blob exceeds the maximum size of %d bytes", max))
+	}
+	return nil
+}
+
+// maxTags returns the maximum number of tags of the repository of the
+// request, zero being unlimited.
+func (ctx *Context) maxTags() int {
+	if ctx.namespace.MaxTags == nil {
+		return 0
+	}
+	return *ctx.namespace.MaxTags
+}
+
+// schema1Conversion returns what is served to the clients not supporting
+// schema2 fetching a schema2 manifest or a manifest list by tag from the
+// repository of the request, either schema1Convert or schema1Reject.
+func (ctx *Context) schema1Conversion() string {
+	if ctx.namespace.Schema1Conversion != "" {
+		return ctx.namespace.Schema1Conversion
+	}
+	return ctx.App.schema1Conversion
+}
@@ -0,0 +1,279 @@
+package handlers
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/manifest"
+	"github.com/distribution/distribution/v3/manifest/schema1"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/distribution/v3/testutil"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestNamespaceSettings(t *testing.T) {
+	immutable, mutable := true, false
+	small, large := int64(10), int64(100)
+	ns, err := newNamespaces([]configuration.Namespace{
+		{
+			Name: "team-a/frozen",
+			NamespaceSettings: configuration.NamespaceSettings{
+				ImmutableTags: &mutable,
+				Actions:       []string{"pull"},
+			},
+		},
+		{
+			Name: "team-a",
+			NamespaceSettings: configuration.NamespaceSettings{
+				ImmutableTags: &immutable,
+				MaxBlobSize:   &large,
+			},
+		},
+		{
+			Name: "team-a/small",
+			NamespaceSettings: configuration.NamespaceSettings{
+				MaxBlobSize: &small,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		repository string
+		expected   configuration.NamespaceSettings
+	}{
+		{
+			repository: "team-a/app",
+			expected:   configuration.NamespaceSettings{ImmutableTags: &immutable, MaxBlobSize: &large},
+		},
+		{
+			repository: "team-a",
+			expected:   configuration.NamespaceSettings{ImmutableTags: &immutable, MaxBlobSize: &large},
+		},
+		{
+			repository: "team-a/frozen/app",
+			expected:   configuration.NamespaceSettings{ImmutableTags: &mutable, Actions: []string{"pull"}, MaxBlobSize: &large},
+		},
+		{
+			repository: "team-a/small/app",
+			expected:   configuration.NamespaceSettings{ImmutableTags: &immutable, MaxBlobSize: &small},
+		},
+		{
+			repository: "team-ab/app",
+		},
+	} {
+		if settings := ns.settings(tc.repository); !reflect.DeepEqual(settings, tc.expected) {
+			t.Errorf("%s: expected settings %+v, got %+v", tc.repository, tc.expected, settings)
+		}
+	}
+}
+
+func TestInvalidNamespaces(t *testing.T) {
+	negative := int64(-1)
+	for _, config := range [][]configuration.Namespace{
+		{{Name: ""}},
+		{{Name: "team-a/"}},
+		{{Name: "Team-A"}},
+		{{Name: "team-a"}, {Name: "team-a"}},
+		{{Name: "team-a", NamespaceSettings: configuration.NamespaceSettings{Actions: []string{"write"}}}},
+		{{Name: "team-a", NamespaceSettings: configuration.NamespaceSettings{MaxBlobSize: &negative}}},
+		{{Name: "team-a", NamespaceSettings: configuration.NamespaceSettings{Schema1Conversion: "drop"}}},
+	} {
+		if _, err := newNamespaces(config); err == nil {
+			t.Errorf("expected an error for namespaces %+v", config)
+		}
+	}
+}
+
+// TestNamespaces checks that the settings of the namespaces are enforced on
+// their repositories.
+func TestNamespaces(t *testing.T) {
+	immutable := true
+	maxBlobSize := int64(1024)
+	maxTags := 2
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"delete":   configuration.Parameters{"enabled": true},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+	}
+	config.Compatibility.Schema1.Enabled = true
+	config.HTTP.Headers = headerConfig
+	config.Policy.Namespaces = []configuration.Namespace{
+		{
+			Name: "team-a",
+			NamespaceSettings: configuration.NamespaceSettings{
+				ImmutableTags: &immutable,
+				MaxTags:       &maxTags,
+			},
+		},
+		{
+			Name: "archive",
+			NamespaceSettings: configuration.NamespaceSettings{
+				Actions: []string{"pull"},
+			},
+		},
+		{
+			Name: "small",
+			NamespaceSettings: configuration.NamespaceSettings{
+				MaxBlobSize: &maxBlobSize,
+			},
+		},
+		{
+			Name: "vault",
+			NamespaceSettings: configuration.NamespaceSettings{
+				Actions: []string{"delete"},
+			},
+		},
+	}
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	// immutable tags
+	imageName, _ := reference.WithName("team-a/app")
+	dgst := createRepository(env, t, imageName.Name(), "latest")
+	tagRef, _ := reference.WithTag(imageName, "latest")
+	tagURL, err := env.builder.BuildManifestURL(tagRef)
+	checkErr(t, err, "building manifest url")
+
+	resp, err := httpDelete(tagURL)
+	checkErr(t, err, "deleting immutable tag")
+	defer resp.Body.Close()
+	checkResponse(t, "deleting immutable tag", resp, http.StatusForbidden)
+	checkBodyHasErrorCodes(t, "deleting immutable tag", resp, errcode.ErrorCodeDenied)
+
+	digestRef, _ := reference.WithDigest(imageName, dgst)
+	digestURL, err := env.builder.BuildManifestURL(digestRef)
+	checkErr(t, err, "building manifest url")
+	resp, err = httpDelete(digestURL)
+	checkErr(t, err, "deleting manifest with an immutable tag")
+	defer resp.Body.Close()
+	checkResponse(t, "deleting manifest with an immutable tag", resp, http.StatusForbidden)
+
+	// moving an immutable tag
+	resp = putSchema1Manifest(t, env, imageName, "latest")
+	defer resp.Body.Close()
+	checkResponse(t, "moving immutable tag", resp, http.StatusForbidden)
+	checkBodyHasErrorCodes(t, "moving immutable tag", resp, errcode.ErrorCodeDenied)
+
+	// maximum number of tags
+	resp = putSchema1Manifest(t, env, imageName, "v1")
+	defer resp.Body.Close()
+	checkResponse(t, "adding a tag", resp, http.StatusCreated)
+	resp = putSchema1Manifest(t, env, imageName, "v2")
+	defer resp.Body.Close()
+	checkResponse(t, "exceeding the maximum number of tags", resp, http.StatusForbidden)
+	checkBodyHasErrorCodes(t, "exceeding the maximum number of tags", resp, errcode.ErrorCodeDenied)
+
+	// read-only namespace
+	archiveName, _ := reference.WithName("archive/app")
+	uploadURL, err := env.builder.BuildBlobUploadURL(archiveName)
+	checkErr(t, err, "building upload url")
+	resp, err = http.Post(uploadURL, "", nil)
+	checkErr(t, err, "starting upload")
+	defer resp.Body.Close()
+	checkResponse(t, "starting upload", resp, http.StatusForbidden)
+	checkBodyHasErrorCodes(t, "starting upload", resp, errcode.ErrorCodeDenied)
+
+	tagsURL, err := env.builder.BuildTagsURL(archiveName)
+	checkErr(t, err, "building tags url")
+	resp, err = http.Get(tagsURL)
+	checkErr(t, err, "listing tags")
+	defer resp.Body.Close()
+	checkResponse(t, "listing tags", resp, http.StatusNotFound)
+
+	// maximum blob size
+	smallName, _ := reference.WithName("small/app")
+	content := bytes.Repeat([]byte("a"), int(maxBlobSize)+1)
+	uploadURLBase, _ := startPushLayer(t, env, smallName)
+	resp, err = doPushLayer(t, env.builder, smallName, digest.FromBytes(content), uploadURLBase, bytes.NewReader(content))
+	checkErr(t, err, "pushing large layer")
+	defer resp.Body.Close()
+	checkResponse(t, "pushing large layer", resp, http.StatusForbidden)
+	checkBodyHasErrorCodes(t, "pushing large layer", resp, errcode.ErrorCodeDenied)
+
+	content = content[:maxBlobSize]
+	uploadURLBase, _ = startPushLayer(t, env, smallName)
+	pushLayer(t, env.builder, smallName, digest.FromBytes(content), uploadURLBase, bytes.NewReader(content))
+
+	// the maximum blob size applies to the mounted blobs and to the blobs
+	// of the mounted manifests
+	otherName, _ := reference.WithName("other/app")
+	content = bytes.Repeat([]byte("b"), int(maxBlobSize)+1)
+	uploadURLBase, _ = startPushLayer(t, env, otherName)
+	pushLayer(t, env.builder, otherName, digest.FromBytes(content), uploadURLBase, bytes.NewReader(content))
+	mountURL, err := env.builder.BuildBlobUploadURL(smallName, url.Values{
+		"mount": []string{digest.FromBytes(content).String()},
+		"from":  []string{otherName.Name()},
+	})
+	checkErr(t, err, "building upload url")
+	resp, err = http.Post(mountURL, "", nil)
+	checkErr(t, err, "mounting large layer")
+	defer resp.Body.Close()
+	checkResponse(t, "mounting large layer", resp, http.StatusForbidden)
+	checkBodyHasErrorCodes(t, "mounting large layer", resp, errcode.ErrorCodeDenied)
+
+	resp = putSchema1Manifest(t, env, otherName, "latest")
+	defer resp.Body.Close()
+	checkResponse(t, "putting manifest", resp, http.StatusCreated)
+	smallTag, _ := reference.WithTag(smallName, "latest")
+	manifestURL, err := env.builder.BuildManifestURL(smallTag)
+	checkErr(t, err, "building manifest url")
+	req, err := http.NewRequest(http.MethodPut, manifestURL+"?"+url.Values{
+		"mount": []string{resp.Header.Get("Docker-Content-Digest")},
+		"from":  []string{otherName.Name()},
+	}.Encode(), nil)
+	checkErr(t, err, "building request")
+	resp, err = http.DefaultClient.Do(req)
+	checkErr(t, err, "mounting manifest with a large layer")
+	defer resp.Body.Close()
+	checkResponse(t, "mounting manifest with a large layer", resp, http.StatusForbidden)
+	checkBodyHasErrorCodes(t, "mounting manifest with a large layer", resp, errcode.ErrorCodeDenied)
+
+	// the namespace of the source of a mount must allow pulls
+	mountURL, err = env.builder.BuildBlobUploadURL(otherName, url.Values{
+		"mount": []string{digest.FromBytes(content).String()},
+		"from":  []string{"vault/app"},
+	})
+	checkErr(t, err, "building upload url")
+	resp, err = http.Post(mountURL, "", nil)
+	checkErr(t, err, "mounting layer from a namespace denying pulls")
+	defer resp.Body.Close()
+	checkResponse(t, "mounting layer from a namespace denying pulls", resp, http.StatusForbidden)
+	checkBodyHasErrorCodes(t, "mounting layer from a namespace denying pulls", resp, errcode.ErrorCodeDenied)
+}
+
+// putSchema1Manifest pushes a manifest with a random layer to the repository
+// with the given tag.
+func putSchema1Manifest(t *testing.T, env *testEnv, name reference.Named, tag string) *http.Response {
+	rs, dgst, err := testutil.CreateRandomTarFile()
+	checkErr(t, err, "creating random layer")
+	uploadURLBase, _ := startPushLayer(t, env, name)
+	pushLayer(t, env.builder, name, dgst, uploadURLBase, rs)
+
+	signedManifest, err := schema1.Sign(&schema1.Manifest{
+		Versioned: manifest.Versioned{
+			SchemaVersion: 1,
+		},
+		Name:     name.Name(),
+		Tag:      tag,
+		FSLayers: []schema1.FSLayer{{BlobSum: dgst}},
+		History:  []schema1.History{{V1Compatibility: ""}},
+	}, env.pk)
+	checkErr(t, err, "signing manifest")
+
+	tagRef, _ := reference.WithTag(name, tag)
+	manifestURL, err := env.builder.BuildManifestURL(tagRef)
+	checkErr(t, err, "building manifest url")
+	return putManifest(t, "putting manifest", manifestURL, "", signedManifest)
+}
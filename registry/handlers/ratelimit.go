@@ -0,0 +1,240 @@
+package handlers
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/distribution/distribution/v3/registry/auditlog"
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/distribution/distribution/v3/registry/ratelimit"
+	"github.com/gorilla/mux"
+)
+
+// Keys the requests are rate limited by.
+const (
+	rateLimitKeyIP         = "ip"
+	rateLimitKeyUser       = "user"
+	rateLimitKeyRepository = "repository"
+)
+
+// Classes of requests rate limits may be restricted to.
+const (
+	rateLimitClassPull    = "pull"
+	rateLimitClassPush    = "push"
+	rateLimitClassCatalog = "catalog"
+)
+
+// rateLimit limits the rate of a class of requests, per key.
+type rateLimit struct {
+	class   string
+	key     string
+	limiter *ratelimit.Limiter
+}
+
+// configureRateLimits sets up the rate limits of the API requests, if any.
+func (app *App) configureRateLimits(config *configuration.Configuration) {
+	limits, err := newRateLimits(config.RateLimit)
+	if err != nil {
+		panic(fmt.Sprintf("invalid rate limit configuration: %v", err))
+	}
+	app.rateLimits = limits
+
+	proxies, err := parseTrustedProxies(config.HTTP.TrustedProxies)
+	if err != nil {
+		panic(fmt.Sprintf("invalid trusted proxies configuration: %v", err))
+	}
+	app.trustedProxies = proxies
+}
+
+// parseTrustedProxies parses the addresses and CIDR ranges of the trusted
+// reverse proxies.
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid proxy address %q", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy range %q: %v", proxy, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// trustedProxy reports whether addr is the address of a trusted proxy.
+func (app *App) trustedProxy(addr string) bool {
+	ip := net.ParseIP(strings.TrimSpace(addr))
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range app.trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client of a request. The forwarding
+// headers are only read from the trusted proxies, since any client may set
+// them: the client is then the last address of X-Forwarded-For which is not
+// a trusted proxy, or the one of X-Real-Ip.
+func (app *App) clientIP(r *http.Request) string {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	if !app.trustedProxy(ip) {
+		return ip
+	}
+
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		addrs := strings.Split(forwarded, ",")
+		for i := len(addrs) - 1; i >= 0; i-- {
+			addr := strings.TrimSpace(addrs[i])
+			if net.ParseIP(addr) == nil {
+				break
+			}
+			ip = addr
+			if !app.trustedProxy(addr) {
+				break
+			}
+		}
+		return ip
+	}
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-Ip")); net.ParseIP(realIP) != nil {
+		return realIP
+	}
+	return ip
+}
+
+// newRateLimits returns the rate limits configured for the API requests.
+func newRateLimits(config configuration.RateLimit) ([]rateLimit, error) {
+	var limits []rateLimit
+	for _, rule := range config.Limits {
+		switch rule.Class {
+		case "", rateLimitClassPull, rateLimitClassPush, rateLimitClassCatalog:
+		default:
+			return nil, fmt.Errorf("unknown rate limit class %q", rule.Class)
+		}
+		switch rule.Key {
+		case rateLimitKeyIP, rateLimitKeyUser, rateLimitKeyRepository:
+		default:
+			return nil, fmt.Errorf("unknown rate limit key %q", rule.Key)
+		}
+		if rule.Rate <= 0 {
+			return nil, fmt.Errorf("rate limit rate must be positive: %v", rule.Rate)
+		}
+		burst := rule.Burst
+		if burst <= 0 {
+			burst = int(math.Ceil(rule.Rate))
+		}
+
+		limits = append(limits, rateLimit{
+			class:   rule.Class,
+			key:     rule.Key,
+			limiter: ratelimit.NewLimiter(rule.Rate, burst),
+		})
+	}
+	return limits, nil
+}
+
+// rateLimitClass returns the class of the request routed to route, or an
+// empty string if it is not part of a class.
+func rateLimitClass(route string, r *http.Request) string {
+	if route == v2.RouteNameBase || isAdminRoute(route) {
+		return ""
+	}
+
+	switch auditAction(route, r) {
+	case auditlog.ActionPull, auditlog.ActionList:
+		return rateLimitClassPull
+	case auditlog.ActionPush, auditlog.ActionMount, auditlog.ActionDelete:
+		return rateLimitClassPush
+	case auditlog.ActionCatalog:
+		return rateLimitClassCatalog
+	}
+	return ""
+}
+
+// rateLimited takes a token from each of the rate limits counting the
+// request by one of the given keys. If one of them is exceeded, it responds
+// with a TOOMANYREQUESTS error and returns true.
+func (app *App) rateLimited(ctx *Context, w http.ResponseWriter, r *http.Request, keys ...string) bool {
+	rateLimits := app.getRateLimits()
+	if len(rateLimits) == 0 {
+		return false
+	}
+
+	var class string
+	if route := mux.CurrentRoute(r); route != nil {
+		class = rateLimitClass(route.GetName(), r)
+	}
+
+	for _, limit := range rateLimits {
+		if limit.class != "" && limit.class != class {
+			continue
+		}
+		if !containsString(keys, limit.key) {
+			continue
+		}
+
+		var key string
+		switch limit.key {
+		case rateLimitKeyIP:
+			key = app.clientIP(r)
+		case rateLimitKeyUser:
+			// anonymous clients are limited by address
+			if key = dcontext.GetStringValue(ctx, auth.UserNameKey); key == "" {
+				key = "ip:" + app.clientIP(r)
+			}
+		case rateLimitKeyRepository:
+			key = getName(ctx)
+		}
+		if key == "" {
+			continue
+		}
+
+		if ok, wait := limit.limiter.Allow(key); !ok {
+			dcontext.GetLogger(ctx).Warnf("rate limit exceeded for %s %q", limit.key, key)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			ctx.Errors = append(ctx.Errors, errcode.ErrorCodeTooManyRequests.WithDetail(
+				fmt.Sprintf("retry in %s", wait.Round(time.Millisecond))))
+			if err := errcode.ServeJSON(w, ctx.Errors); err != nil {
+				dcontext.GetLogger(ctx).Errorf("error serving error json: %v (from %v)", err, ctx.Errors)
+			}
+			auditErrors(ctx)
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
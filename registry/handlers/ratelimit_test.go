@@ -0,0 +1,216 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/distribution/distribution/v3/configuration"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/distribution/distribution/v3/registry/auth"
+)
+
+// TestRateLimits checks that the requests exceeding the rate limits of their
+// class are rejected.
+func TestRateLimits(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	config.RateLimit.Limits = []configuration.RateLimitRule{
+		{Class: "pull", Key: "ip", Rate: 0.01, Burst: 2},
+		{Class: "push", Key: "repository", Rate: 0.01},
+	}
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	fooName, _ := reference.WithName("foo/bar")
+	barName, _ := reference.WithName("bar/baz")
+	tagsURL, err := env.builder.BuildTagsURL(fooName)
+	checkErr(t, err, "building tags url")
+	catalogURL, err := env.builder.BuildCatalogURL()
+	checkErr(t, err, "building catalog url")
+
+	get := func(u string, expectedStatus int) *http.Response {
+		t.Helper()
+		resp, err := http.Get(u)
+		checkErr(t, err, "issuing request")
+		defer resp.Body.Close()
+		checkResponse(t, "issuing request", resp, expectedStatus)
+		return resp
+	}
+
+	get(tagsURL, http.StatusNotFound)
+	get(tagsURL, http.StatusNotFound)
+	resp := get(tagsURL, http.StatusTooManyRequests)
+	if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "100" {
+		t.Fatalf("unexpected Retry-After header: %q", retryAfter)
+	}
+
+	// other classes have their own limits
+	get(catalogURL, http.StatusOK)
+
+	// pushes are limited per repository
+	startPushLayer(t, env, fooName)
+	startPushLayer(t, env, barName)
+
+	uploadURL, err := env.builder.BuildBlobUploadURL(fooName)
+	checkErr(t, err, "building upload url")
+	resp, err = http.Post(uploadURL, "", nil)
+	checkErr(t, err, "starting upload")
+	defer resp.Body.Close()
+	checkResponse(t, "starting upload", resp, http.StatusTooManyRequests)
+	checkBodyHasErrorCodes(t, "starting upload", resp, errcode.ErrorCodeTooManyRequests)
+}
+
+// TestRateLimitsUnauthorized checks that the requests denied access to a
+// repository do not take from its rate limits.
+func TestRateLimitsUnauthorized(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	config.RateLimit.Limits = []configuration.RateLimitRule{
+		{Class: "push", Key: "repository", Rate: 0.01},
+	}
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	fooName, _ := reference.WithName("foo/bar")
+	uploadURL, err := env.builder.BuildBlobUploadURL(fooName)
+	checkErr(t, err, "building upload url")
+	post := func(expectedStatus int) {
+		t.Helper()
+		resp, err := http.Post(uploadURL, "", nil)
+		checkErr(t, err, "starting upload")
+		defer resp.Body.Close()
+		checkResponse(t, "starting upload", resp, expectedStatus)
+	}
+
+	env.app.accessController = deniedRepositoriesController{denied: fooName.Name()}
+	post(http.StatusUnauthorized)
+	post(http.StatusUnauthorized)
+
+	env.app.accessController = nil
+	post(http.StatusAccepted)
+	post(http.StatusTooManyRequests)
+}
+
+// TestRateLimitClass checks the classes of the requests.
+func TestRateLimitClass(t *testing.T) {
+	for _, tc := range []struct {
+		route    string
+		method   string
+		expected string
+	}{
+		{v2.RouteNameManifest, http.MethodGet, rateLimitClassPull},
+		{v2.RouteNameBlobUpload, http.MethodPost, rateLimitClassPush},
+		{v2.RouteNameCatalog, http.MethodGet, rateLimitClassCatalog},
+		{v2.RouteNameBase, http.MethodGet, ""},
+		{routeNameAdminGC, http.MethodPost, ""},
+		{routeNameAdminFrozen, http.MethodPut, ""},
+		{routeNameAdminWarm, http.MethodPost, ""},
+		{routeNameAdminRename, http.MethodPost, ""},
+		{routeNameAdminStats, http.MethodGet, ""},
+		{routeNameAdminCache, http.MethodDelete, ""},
+	} {
+		r, _ := http.NewRequest(tc.method, "/", nil)
+		if class := rateLimitClass(tc.route, r); class != tc.expected {
+			t.Errorf("unexpected class of %s %s: %q != %q", tc.method, tc.route, class, tc.expected)
+		}
+	}
+}
+
+// TestClientIP checks that the forwarding headers identify the clients only
+// in the requests of the trusted proxies.
+func TestClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &App{trustedProxies: proxies}
+
+	for _, tc := range []struct {
+		remoteAddr string
+		headers    map[string]string
+		expected   string
+	}{
+		{"1.2.3.4:1234", nil, "1.2.3.4"},
+		{"1.2.3.4:1234", map[string]string{"X-Forwarded-For": "5.6.7.8"}, "1.2.3.4"},
+		{"1.2.3.4:1234", map[string]string{"X-Real-Ip": "5.6.7.8"}, "1.2.3.4"},
+		{"10.1.2.3:1234", map[string]string{"X-Forwarded-For": "5.6.7.8"}, "5.6.7.8"},
+		{"10.1.2.3:1234", map[string]string{"X-Real-Ip": "5.6.7.8"}, "5.6.7.8"},
+		{"192.168.1.1:1234", map[string]string{"X-Forwarded-For": "9.9.9.9, 5.6.7.8, 10.0.0.1"}, "5.6.7.8"},
+		{"192.168.1.2:1234", map[string]string{"X-Forwarded-For": "5.6.7.8"}, "192.168.1.2"},
+		{"10.1.2.3:1234", map[string]string{"X-Forwarded-For": "invalid"}, "10.1.2.3"},
+	} {
+		r, _ := http.NewRequest(http.MethodGet, "/v2/", nil)
+		r.RemoteAddr = tc.remoteAddr
+		for name, value := range tc.headers {
+			r.Header.Set(name, value)
+		}
+		if ip := app.clientIP(r); ip != tc.expected {
+			t.Errorf("expected client %s from %s with %v, got %s", tc.expected, tc.remoteAddr, tc.headers, ip)
+		}
+	}
+
+	if _, err := parseTrustedProxies([]string{"invalid"}); err == nil {
+		t.Error("expected an error parsing an invalid proxy address")
+	}
+}
+
+// clientIPAccessController hands the client addresses of the requests it
+// authorizes over to the test.
+type clientIPAccessController chan string
+
+func (ac clientIPAccessController) Authorized(ctx context.Context, access ...auth.Access) (context.Context, error) {
+	ac <- dcontext.ClientIP(ctx)
+	return ctx, nil
+}
+
+// TestClientIPAuthorized checks that the access controllers are given the
+// client address resolved from the trusted proxies only.
+func TestClientIPAuthorized(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	clientIPs := make(clientIPAccessController, 1)
+	env.app.accessController = clientIPs
+
+	baseURL, err := env.builder.BuildBaseURL()
+	checkErr(t, err, "building base url")
+
+	for _, tc := range []struct {
+		proxies  []string
+		expected string
+	}{
+		{nil, "127.0.0.1"},
+		{[]string{"127.0.0.1"}, "5.6.7.8"},
+	} {
+		proxies, err := parseTrustedProxies(tc.proxies)
+		checkErr(t, err, "parsing trusted proxies")
+		env.app.trustedProxies = proxies
+
+		req, _ := http.NewRequest(http.MethodGet, baseURL, nil)
+		req.Header.Set("X-Forwarded-For", "5.6.7.8")
+		resp, err := http.DefaultClient.Do(req)
+		checkErr(t, err, "issuing request")
+		resp.Body.Close()
+		if ip := <-clientIPs; ip != tc.expected {
+			t.Errorf("expected client %s with trusted proxies %v, got %s", tc.expected, tc.proxies, ip)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/gorilla/handlers"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// referrersDispatcher constructs the referrers handler api endpoint.
+func referrersDispatcher(ctx *Context, r *http.Request) http.Handler {
+	dgst, err := getDigest(ctx)
+	if err != nil {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx.Errors = append(ctx.Errors, v2.ErrorCodeDigestInvalid.WithDetail(err))
+		})
+	}
+
+	referrersHandler := &referrersHandler{
+		Context: ctx,
+		Digest:  dgst,
+	}
+
+	return handlers.MethodHandler{
+		"GET": http.HandlerFunc(referrersHandler.GetReferrers),
+	}
+}
+
+// referrersHandler handles requests for the referrers of a manifest.
+type referrersHandler struct {
+	*Context
+
+	Digest digest.Digest
+}
+
+// referrersAPIResponse is the image index returned by the referrers API.
+type referrersAPIResponse struct {
+	manifest.Versioned
+
+	Manifests []distribution.Descriptor `json:"manifests"`
+}
+
+// GetReferrers returns an image index listing the manifests which declare
+// the requested manifest as their subject.
+func (rh *referrersHandler) GetReferrers(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	manifests, err := rh.Repository.Manifests(rh)
+	if err != nil {
+		rh.Errors = append(rh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+
+	referrerService, ok := manifests.(distribution.ManifestReferrers)
+	if !ok {
+		rh.Errors = append(rh.Errors, errcode.ErrorCodeUnsupported)
+		return
+	}
+
+	artifactType := r.URL.Query().Get("artifactType")
+	referrers, err := referrerService.Referrers(rh, rh.Digest, artifactType)
+	if err != nil {
+		if err == distribution.ErrUnsupported {
+			rh.Errors = append(rh.Errors, errcode.ErrorCodeUnsupported)
+			return
+		}
+		switch err := err.(type) {
+		case distribution.ErrRepositoryUnknown:
+			rh.Errors = append(rh.Errors, v2.ErrorCodeNameUnknown.WithDetail(map[string]string{"name": err.Name}))
+		case errcode.Error:
+			rh.Errors = append(rh.Errors, err)
+		default:
+			rh.Errors = append(rh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		}
+		return
+	}
+
+	if artifactType != "" {
+		w.Header().Set("OCI-Filters-Applied", "artifactType")
+	}
+	w.Header().Set("Content-Type", v1.MediaTypeImageIndex)
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(referrersAPIResponse{
+		Versioned: manifest.Versioned{
+			SchemaVersion: 2,
+			MediaType:     v1.MediaTypeImageIndex,
+		},
+		Manifests: referrers,
+	}); err != nil {
+		rh.Errors = append(rh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+}
@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/gorilla/handlers"
+)
+
+// repositoryDispatcher constructs the repository handler api endpoint.
+func repositoryDispatcher(ctx *Context, r *http.Request) http.Handler {
+	repositoryHandler := &repositoryHandler{
+		Context: ctx,
+	}
+
+	rhandler := handlers.MethodHandler{}
+
+	if !ctx.ReadOnly() {
+		rhandler["DELETE"] = http.HandlerFunc(repositoryHandler.DeleteRepository)
+	}
+
+	return rhandler
+}
+
+// repositoryHandler handles http operations on whole repositories.
+type repositoryHandler struct {
+	*Context
+}
+
+// DeleteRepository removes the manifests, tags, layer links and uploads of
+// the repository. The blobs are left to garbage collection.
+func (rh *repositoryHandler) DeleteRepository(w http.ResponseWriter, r *http.Request) {
+	dcontext.GetLogger(rh).Debug("DeleteRepository")
+
+	if rh.App.isCache || !rh.App.repositoryDeletion || rh.App.repoRemover == nil {
+		rh.Errors = append(rh.Errors, errcode.ErrorCodeUnsupported)
+		return
+	}
+
+	if err := rh.RepositoryRemover.Remove(rh, rh.Repository.Named()); err != nil {
+		if err == distribution.ErrUnsupported {
+			rh.Errors = append(rh.Errors, errcode.ErrorCodeUnsupported)
+			return
+		}
+		switch err := err.(type) {
+		case distribution.ErrRepositoryUnknown:
+			rh.Errors = append(rh.Errors, v2.ErrorCodeNameUnknown.WithDetail(map[string]string{"name": err.Name}))
+		case errcode.Error:
+			rh.Errors = append(rh.Errors, err)
+		default:
+			rh.Errors = append(rh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/gorilla/handlers"
+	"github.com/opencontainers/go-digest"
+)
+
+// tagHistoryDispatcher constructs the tag history handler api endpoint.
+func tagHistoryDispatcher(ctx *Context, r *http.Request) http.Handler {
+	tagHistoryHandler := &tagHistoryHandler{
+		Context: ctx,
+	}
+
+	return handlers.MethodHandler{
+		"GET": http.HandlerFunc(tagHistoryHandler.GetTagHistory),
+	}
+}
+
+// tagHistoryHandler handles requests for the history of the tags of a
+// repository.
+type tagHistoryHandler struct {
+	*Context
+}
+
+// tagHistory describes the current and previous manifests of a tag.
+type tagHistory struct {
+	Tag          string                  `json:"tag"`
+	Digest       digest.Digest           `json:"digest,omitempty"`
+	Previous     []digest.Digest         `json:"previous"`
+	LastModified *time.Time              `json:"lastModified,omitempty"`
+	Events       []distribution.TagEvent `json:"events"`
+}
+
+type tagHistoryAPIResponse struct {
+	Name string       `json:"name"`
+	Tags []tagHistory `json:"tags"`
+}
+
+// GetTagHistory returns, for each tag of the repository or for the tag
+// requested with the tag parameter, its current manifest, the manifests it
+// pointed to before and the log of its changes.
+func (th *tagHistoryHandler) GetTagHistory(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	tagService := th.Repository.Tags(th)
+	historyProvider, ok := tagService.(distribution.TagHistoryProvider)
+	if !ok {
+		th.Errors = append(th.Errors, errcode.ErrorCodeUnsupported)
+		return
+	}
+
+	q := r.URL.Query()
+
+	var tags []string
+	if tag := q.Get("tag"); tag != "" {
+		// deleted tags are only known by their history
+		tags = []string{tag}
+	} else {
+		all, err := tagService.All(th)
+		if err != nil {
+			switch err := err.(type) {
+			case distribution.ErrRepositoryUnknown:
+				th.Errors = append(th.Errors, v2.ErrorCodeNameUnknown.WithDetail(map[string]string{"name": th.Repository.Named().Name()}))
+			case errcode.Error:
+				th.Errors = append(th.Errors, err)
+			default:
+				th.Errors = append(th.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+			}
+			return
+		}
+		tags = all
+
+		if lastEntry := q.Get("last"); lastEntry != "" {
+			lastEntryIndex := sort.SearchStrings(tags, lastEntry)
+			if lastEntryIndex == len(tags) {
+				tags = []string{}
+			} else {
+				tags = tags[lastEntryIndex+1:]
+			}
+		}
+
+		if n := q.Get("n"); n != "" {
+			maxEntries, err := strconv.Atoi(n)
+			if err != nil || maxEntries < 0 {
+				th.Errors = append(th.Errors, v2.ErrorCodePaginationNumberInvalid.WithDetail(map[string]string{"n": n}))
+				return
+			}
+
+			if maxEntries >= len(tags) {
+				maxEntries = len(tags)
+			} else if maxEntries > 0 {
+				// defined in `catalog.go`
+				urlStr, err := createLinkEntry(r.URL.String(), maxEntries, tags[maxEntries-1])
+				if err != nil {
+					th.Errors = append(th.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+					return
+				}
+				w.Header().Set("Link", urlStr)
+			}
+			tags = tags[:maxEntries]
+		}
+	}
+
+	histories := make([]tagHistory, 0, len(tags))
+	for _, tag := range tags {
+		history, err := th.tagHistory(tagService, historyProvider, tag)
+		if err != nil {
+			th.Errors = append(th.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+			return
+		}
+		if history.Digest == "" && len(history.Events) == 0 {
+			th.Errors = append(th.Errors, v2.ErrorCodeManifestUnknown.WithDetail(map[string]string{"tag": tag}))
+			return
+		}
+		histories = append(histories, history)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(tagHistoryAPIResponse{
+		Name: th.Repository.Named().Name(),
+		Tags: histories,
+	}); err != nil {
+		th.Errors = append(th.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+}
+
+// tagHistory builds the history of tag from its events. The previous
+// manifests are listed from the most recent one.
+func (th *tagHistoryHandler) tagHistory(tagService distribution.TagService, historyProvider distribution.TagHistoryProvider, tag string) (tagHistory, error) {
+	history := tagHistory{
+		Tag:      tag,
+		Previous: []digest.Digest{},
+	}
+
+	desc, err := tagService.Get(th, tag)
+	switch err.(type) {
+	case nil:
+		history.Digest = desc.Digest
+	case distribution.ErrTagUnknown:
+	default:
+		return history, err
+	}
+
+	events, err := historyProvider.History(th, tag)
+	if err != nil {
+		return history, err
+	}
+	history.Events = events
+	if history.Events == nil {
+		history.Events = []distribution.TagEvent{}
+	}
+
+	seen := map[digest.Digest]struct{}{history.Digest: {}}
+	addPrevious := func(dgst digest.Digest) {
+		if _, ok := seen[dgst]; ok || dgst == "" {
+			return
+		}
+		seen[dgst] = struct{}{}
+		history.Previous = append(history.Previous, dgst)
+	}
+	for i := len(events) - 1; i >= 0; i-- {
+		addPrevious(events[i].Digest)
+		addPrevious(events[i].Previous)
+	}
+	if len(events) > 0 {
+		history.LastModified = &events[len(events)-1].Timestamp
+	} else if history.Digest != "" {
+		// tags moved before the history was kept only have their index
+		// of revisions, which is not ordered
+		if md, ok := tagService.(distribution.TagManifestsProvider); ok {
+			digests, err := md.ManifestDigests(th, tag)
+			if err != nil {
+				return history, err
+			}
+			for _, dgst := range digests {
+				addPrevious(dgst)
+			}
+		}
+	}
+
+	return history, nil
+}
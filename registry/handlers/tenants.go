@@ -0,0 +1,263 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/distribution/v3/registry/storage/cache"
+	"github.com/opencontainers/go-digest"
+)
+
+// tenants resolves the tenant of the requests, whose content is isolated in
+// the root directory of the tenant.
+type tenants struct {
+	claim string
+
+	// tenants are sorted by decreasing prefix length, so that the most
+	// specific prefix matches first.
+	tenants []configuration.Tenant
+}
+
+// configureTenants sets up the tenants of the registry, if any.
+func (app *App) configureTenants(config *configuration.Configuration) {
+	if len(config.Tenancy.Tenants) == 0 {
+		return
+	}
+	t, err := newTenants(config.Tenancy)
+	if err != nil {
+		panic(fmt.Sprintf("invalid tenancy configuration: %v", err))
+	}
+	if config.Proxy.Enabled() {
+		panic("tenancy is not supported by the pull through cache")
+	}
+	if len(config.Replication.Remotes) > 0 {
+		panic("tenancy is not supported by the replication")
+	}
+	// the sendfile paths are the paths of the blobs under the default root
+	if config.Storage["blobserver"]["sendfile"] != nil {
+		panic("tenancy is not supported by the blobserver sendfile")
+	}
+	app.tenants = t
+}
+
+// newTenants validates the tenants of the configuration.
+func newTenants(config configuration.Tenancy) (*tenants, error) {
+	names := make(map[string]struct{}, len(config.Tenants))
+	prefixes := make(map[string]struct{}, len(config.Tenants))
+	for i, tenant := range config.Tenants {
+		if tenant.Name == "" {
+			return nil, fmt.Errorf("tenant name missing")
+		}
+		if _, ok := names[tenant.Name]; ok {
+			return nil, fmt.Errorf("duplicate tenant %q", tenant.Name)
+		}
+		names[tenant.Name] = struct{}{}
+
+		if tenant.Prefix != "" {
+			if _, err := reference.WithName(tenant.Prefix); err != nil {
+				return nil, fmt.Errorf("invalid prefix %q of tenant %q", tenant.Prefix, tenant.Name)
+			}
+			if _, ok := prefixes[tenant.Prefix]; ok {
+				return nil, fmt.Errorf("duplicate prefix %q of tenant %q", tenant.Prefix, tenant.Name)
+			}
+			prefixes[tenant.Prefix] = struct{}{}
+		}
+
+		root := tenant.RootDirectory
+		if !path.IsAbs(root) || path.Clean(root) == "/" {
+			return nil, fmt.Errorf("rootdirectory of tenant %q must be an absolute path other than /", tenant.Name)
+		}
+		// the content of the default tenant is stored under /docker
+		if nested(root, "/docker") || nested("/docker", root) {
+			return nil, fmt.Errorf("rootdirectory of tenant %q overlaps the content of the default tenant", tenant.Name)
+		}
+		for _, other := range config.Tenants[:i] {
+			if nested(root, other.RootDirectory) || nested(other.RootDirectory, root) {
+				return nil, fmt.Errorf("rootdirectory of tenant %q overlaps that of tenant %q", tenant.Name, other.Name)
+			}
+		}
+	}
+
+	sorted := append([]configuration.Tenant(nil), config.Tenants...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return len(sorted[i].Prefix) > len(sorted[j].Prefix)
+	})
+	return &tenants{claim: config.Claim, tenants: sorted}, nil
+}
+
+// nested returns whether the directory is dir or within parent.
+func nested(dir, parent string) bool {
+	dir, parent = path.Clean(dir), path.Clean(parent)
+	return dir == parent || strings.HasPrefix(dir, parent+"/")
+}
+
+// roots returns the root directories of the tenants.
+func (t *tenants) roots() []string {
+	roots := make([]string, 0, len(t.tenants))
+	for _, tenant := range t.tenants {
+		roots = append(roots, tenant.RootDirectory)
+	}
+	return roots
+}
+
+// resolve returns the tenant of a request made by the authorized client of
+// ctx on the repository, nil for the default tenant. A client whose token
+// names an unknown tenant, or a tenant other than the one owning the prefix
+// of the repository, is denied.
+func (t *tenants) resolve(ctx context.Context, repository string) (*configuration.Tenant, error) {
+	var claimed *configuration.Tenant
+	if t.claim != "" {
+		user, _ := ctx.Value(auth.UserKey).(auth.UserInfo)
+		if v, ok := user.Claims[t.claim]; ok {
+			name, _ := v.(string)
+			for i := range t.tenants {
+				if t.tenants[i].Name == name {
+					claimed = &t.tenants[i]
+					break
+				}
+			}
+			if claimed == nil {
+				return nil, errcode.ErrorCodeDenied.WithDetail("unknown tenant")
+			}
+		}
+	}
+
+	var owner *configuration.Tenant
+	if repository != "" {
+		for i, tenant := range t.tenants {
+			if tenant.Prefix != "" && (repository == tenant.Prefix || strings.HasPrefix(repository, tenant.Prefix+"/")) {
+				owner = &t.tenants[i]
+				break
+			}
+		}
+	}
+
+	switch {
+	case claimed == nil:
+		return owner, nil
+	case owner != nil && owner != claimed:
+		return nil, errcode.ErrorCodeDenied.WithDetail("the repository belongs to another tenant")
+	default:
+		return claimed, nil
+	}
+}
+
+// tenantRoot confines the storage operations of the request to the root
+// directory of its tenant, if any.
+func (app *App) tenantRoot(ctx *Context) error {
+	if app.tenants == nil {
+		return nil
+	}
+	tenant, err := app.tenants.resolve(ctx, getName(ctx))
+	if err != nil {
+		return err
+	}
+	if tenant != nil {
+		ctx.Context = storage.WithRootDirectory(ctx.Context, tenant.RootDirectory)
+	}
+	return nil
+}
+
+// tenantBlobDescriptorCacheProvider keeps distinct caches for the root
+// directories of the tenants, so that the descriptors of the blobs of a
+// tenant are not served to the others.
+type tenantBlobDescriptorCacheProvider struct {
+	newProvider func() cache.BlobDescriptorCacheProvider
+
+	mu        sync.Mutex
+	providers map[string]cache.BlobDescriptorCacheProvider
+}
+
+var _ cache.BlobDescriptorCacheProvider = &tenantBlobDescriptorCacheProvider{}
+
+func newTenantBlobDescriptorCacheProvider(newProvider func() cache.BlobDescriptorCacheProvider) *tenantBlobDescriptorCacheProvider {
+	return &tenantBlobDescriptorCacheProvider{
+		newProvider: newProvider,
+		providers:   make(map[string]cache.BlobDescriptorCacheProvider),
+	}
+}
+
+// provider returns the cache of the root directory of ctx.
+func (p *tenantBlobDescriptorCacheProvider) provider(ctx context.Context) cache.BlobDescriptorCacheProvider {
+	root := storage.RootDirectory(ctx)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	provider, ok := p.providers[root]
+	if !ok {
+		provider = p.newProvider()
+		p.providers[root] = provider
+	}
+	return provider
+}
+
+func (p *tenantBlobDescriptorCacheProvider) Stat(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
+	return p.provider(ctx).Stat(ctx, dgst)
+}
+
+func (p *tenantBlobDescriptorCacheProvider) SetDescriptor(ctx context.Context, dgst digest.Digest, desc distribution.Descriptor) error {
+	return p.provider(ctx).SetDescriptor(ctx, dgst, desc)
+}
+
+func (p *tenantBlobDescriptorCacheProvider) Clear(ctx context.Context, dgst digest.Digest) error {
+	return p.provider(ctx).Clear(ctx, dgst)
+}
+
+func (p *tenantBlobDescriptorCacheProvider) RepositoryScoped(repo string) (distribution.BlobDescriptorService, error) {
+	if _, err := reference.ParseNormalizedNamed(repo); err != nil {
+		return nil, err
+	}
+	return &tenantScopedBlobDescriptorCache{provider: p, repo: repo}, nil
+}
+
+func (p *tenantBlobDescriptorCacheProvider) ClearRepository(ctx context.Context, repo string) error {
+	return p.provider(ctx).ClearRepository(ctx, repo)
+}
+
+func (p *tenantBlobDescriptorCacheProvider) Purge(ctx context.Context) error {
+	return p.provider(ctx).Purge(ctx)
+}
+
+// tenantScopedBlobDescriptorCache is the repository scoped cache of the
+// root directory of the context of each operation.
+type tenantScopedBlobDescriptorCache struct {
+	provider *tenantBlobDescriptorCacheProvider
+	repo     string
+}
+
+func (c *tenantScopedBlobDescriptorCache) scoped(ctx context.Context) (distribution.BlobDescriptorService, error) {
+	return c.provider.provider(ctx).RepositoryScoped(c.repo)
+}
+
+func (c *tenantScopedBlobDescriptorCache) Stat(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
+	scoped, err := c.scoped(ctx)
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+	return scoped.Stat(ctx, dgst)
+}
+
+func (c *tenantScopedBlobDescriptorCache) SetDescriptor(ctx context.Context, dgst digest.Digest, desc distribution.Descriptor) error {
+	scoped, err := c.scoped(ctx)
+	if err != nil {
+		return err
+	}
+	return scoped.SetDescriptor(ctx, dgst, desc)
+}
+
+func (c *tenantScopedBlobDescriptorCache) Clear(ctx context.Context, dgst digest.Digest) error {
+	scoped, err := c.scoped(ctx)
+	if err != nil {
+		return err
+	}
+	return scoped.Clear(ctx, dgst)
+}
@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestTenantResolve(t *testing.T) {
+	tn, err := newTenants(configuration.Tenancy{
+		Claim: "tenant",
+		Tenants: []configuration.Tenant{
+			{Name: "acme", Prefix: "acme", RootDirectory: "/tenants/acme"},
+			{Name: "acme-labs", Prefix: "acme/labs", RootDirectory: "/tenants/acme-labs"},
+			{Name: "initech", RootDirectory: "/tenants/initech"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		claim      interface{}
+		repository string
+		expected   string
+		denied     bool
+	}{
+		{repository: "acme/app", expected: "acme"},
+		{repository: "acme", expected: "acme"},
+		{repository: "acme/labs/app", expected: "acme-labs"},
+		{repository: "acmeco/app"},
+		{repository: ""},
+		{claim: "initech", repository: "app", expected: "initech"},
+		{claim: "initech", repository: "", expected: "initech"},
+		{claim: "acme", repository: "acme/app", expected: "acme"},
+		{claim: "initech", repository: "acme/app", denied: true},
+		{claim: "acme", repository: "acme/labs/app", denied: true},
+		{claim: "unknown", repository: "app", denied: true},
+		{claim: 42, repository: "app", denied: true},
+	} {
+		ctx := context.Background()
+		if tc.claim != nil {
+			ctx = auth.WithUser(ctx, auth.UserInfo{Name: "user", Claims: map[string]interface{}{"tenant": tc.claim}})
+		}
+		tenant, err := tn.resolve(ctx, tc.repository)
+		if tc.denied {
+			if err == nil {
+				t.Errorf("expected %v to be denied access to %q", tc.claim, tc.repository)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error resolving the tenant of %v on %q: %v", tc.claim, tc.repository, err)
+			continue
+		}
+		var name string
+		if tenant != nil {
+			name = tenant.Name
+		}
+		if name != tc.expected {
+			t.Errorf("unexpected tenant of %v on %q: %q != %q", tc.claim, tc.repository, name, tc.expected)
+		}
+	}
+}
+
+func TestInvalidTenants(t *testing.T) {
+	for _, config := range [][]configuration.Tenant{
+		{{RootDirectory: "/tenants/acme"}},
+		{{Name: "acme"}},
+		{{Name: "acme", RootDirectory: "tenants/acme"}},
+		{{Name: "acme", RootDirectory: "/"}},
+		{{Name: "acme", RootDirectory: "/docker/acme"}},
+		{{Name: "acme", Prefix: "Acme", RootDirectory: "/tenants/acme"}},
+		{{Name: "acme", RootDirectory: "/tenants/acme"}, {Name: "acme", RootDirectory: "/tenants/other"}},
+		{{Name: "acme", Prefix: "acme", RootDirectory: "/tenants/acme"}, {Name: "other", Prefix: "acme", RootDirectory: "/tenants/other"}},
+		{{Name: "acme", RootDirectory: "/tenants/acme"}, {Name: "other", RootDirectory: "/tenants/acme/other"}},
+		{{Name: "acme", RootDirectory: "/tenants"}, {Name: "other", RootDirectory: "/tenants/other"}},
+	} {
+		if _, err := newTenants(configuration.Tenancy{Tenants: config}); err == nil {
+			t.Errorf("expected an error for tenants %+v", config)
+		}
+	}
+}
+
+// TestTenantsProxy checks that tenancy is refused on top of a pull through
+// cache, however its remotes are configured.
+func TestTenantsProxy(t *testing.T) {
+	for _, proxy := range []configuration.Proxy{
+		{RemoteURL: "https://registry-1.docker.io"},
+		{Remotes: []configuration.ProxyRemote{{Prefix: "docker.io", RemoteURL: "https://registry-1.docker.io"}}},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected tenancy to be refused with the proxy %+v", proxy)
+				}
+			}()
+			config := &configuration.Configuration{Proxy: proxy}
+			config.Tenancy.Tenants = []configuration.Tenant{{Name: "acme", RootDirectory: "/tenants/acme"}}
+			(&App{}).configureTenants(config)
+		}()
+	}
+}
+
+// TestTenants checks that the content of a tenant is stored in its root
+// directory and is not visible to the other tenants.
+func TestTenants(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"cache":    configuration.Parameters{"blobdescriptor": "inmemory"},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+	}
+	config.Compatibility.Schema1.Enabled = true
+	config.HTTP.Headers = headerConfig
+	config.Policy.Mount.Fallback = true
+	config.Policy.Mount.AllowUnauthorizedSource = true
+	config.Tenancy.Tenants = []configuration.Tenant{
+		{Name: "acme", Prefix: "acme", RootDirectory: "/tenants/acme"},
+	}
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	acmeName, _ := reference.WithName("acme/app")
+	content := []byte("acme layer")
+	dgst := digest.FromBytes(content)
+	uploadURLBase, _ := startPushLayer(t, env, acmeName)
+	pushLayer(t, env.builder, acmeName, dgst, uploadURLBase, bytes.NewReader(content))
+
+	if _, err := env.app.driver.Stat(env.ctx, "/tenants/acme/docker/registry/v2/repositories/acme/app"); err != nil {
+		t.Fatalf("expected the repository to be stored in the root directory of the tenant: %v", err)
+	}
+	if _, err := env.app.driver.Stat(env.ctx, "/docker/registry/v2/repositories/acme"); err == nil {
+		t.Fatal("unexpected repository of the tenant in the root directory of the storage")
+	}
+
+	// the blobs of the tenant cannot be mounted from outside of it
+	otherName, _ := reference.WithName("other/app")
+	uploadURL, err := env.builder.BuildBlobUploadURL(otherName, map[string][]string{
+		"mount": {dgst.String()},
+		"from":  {acmeName.Name()},
+	})
+	checkErr(t, err, "building upload url")
+	resp, err := http.Post(uploadURL, "", nil)
+	checkErr(t, err, "mounting the blob of the tenant")
+	defer resp.Body.Close()
+	checkResponse(t, "mounting the blob of the tenant", resp, http.StatusAccepted)
+
+	createRepository(env, t, acmeName.Name(), "latest")
+	createRepository(env, t, otherName.Name(), "latest")
+
+	catalogURL, err := env.builder.BuildCatalogURL()
+	checkErr(t, err, "building catalog url")
+	resp, err = http.Get(catalogURL)
+	checkErr(t, err, "listing the catalog")
+	defer resp.Body.Close()
+	checkResponse(t, "listing the catalog", resp, http.StatusOK)
+
+	var ctlg struct {
+		Repositories []string `json:"repositories"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&ctlg); err != nil {
+		t.Fatalf("error decoding the catalog: %v", err)
+	}
+	if expected := []string{"other/app"}; !reflect.DeepEqual(ctlg.Repositories, expected) {
+		t.Fatalf("unexpected catalog: %v != %v", ctlg.Repositories, expected)
+	}
+}
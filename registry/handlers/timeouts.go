@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/gorilla/mux"
+)
+
+// connKey is the context key of the connection a request is received from.
+type connKey struct{}
+
+// ConnContext returns ctx carrying the connection c, so that the timeouts
+// configured for the class of the requests received from it can be applied.
+// It is meant to be the ConnContext of the server serving the App.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, c)
+}
+
+// configureTimeouts sets up the timeouts of the classes of requests, if any.
+func (app *App) configureTimeouts(config *configuration.Configuration) {
+	for class := range config.HTTP.Timeouts.Classes {
+		switch class {
+		case rateLimitClassPull, rateLimitClassPush, rateLimitClassCatalog:
+		default:
+			panic(fmt.Sprintf("invalid timeouts configuration: unknown class %q", class))
+		}
+	}
+	app.classTimeouts = config.HTTP.Timeouts.Classes
+}
+
+// applyClassTimeouts sets the read and write deadlines of the connection of
+// the request to the timeouts of its class, if configured. The returned
+// function restores the write deadline of the connection once the request is
+// served, as the server only resets it before the next request when it has a
+// write timeout itself. http2 requests are left alone, as their connection
+// is shared with other requests.
+func (app *App) applyClassTimeouts(r *http.Request) func() {
+	noop := func() {}
+	if len(app.classTimeouts) == 0 || r.ProtoMajor != 1 {
+		return noop
+	}
+
+	conn, ok := r.Context().Value(connKey{}).(net.Conn)
+	if !ok {
+		return noop
+	}
+
+	var class string
+	if route := mux.CurrentRoute(r); route != nil {
+		class = rateLimitClass(route.GetName(), r)
+	}
+	timeouts, ok := app.classTimeouts[class]
+	if !ok {
+		return noop
+	}
+
+	now := time.Now()
+	if timeouts.Read > 0 {
+		if err := conn.SetReadDeadline(now.Add(timeouts.Read)); err != nil {
+			dcontext.GetLogger(r.Context()).Warnf("error setting read deadline of %s request: %v", class, err)
+		}
+	}
+	if timeouts.Write <= 0 {
+		return noop
+	}
+	if err := conn.SetWriteDeadline(now.Add(timeouts.Write)); err != nil {
+		dcontext.GetLogger(r.Context()).Warnf("error setting write deadline of %s request: %v", class, err)
+		return noop
+	}
+	return func() {
+		if app.Config.HTTP.Timeouts.Write == 0 {
+			conn.SetWriteDeadline(time.Time{})
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/reference"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+)
+
+// deadlineConn records the deadlines set on a connection, ignoring those in
+// the past the server uses to abort reads.
+type deadlineConn struct {
+	net.Conn
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+	writeResets   int
+}
+
+func (c *deadlineConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	if t.After(time.Now()) {
+		c.readDeadline = t
+	}
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *deadlineConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	if t.IsZero() {
+		c.writeResets++
+	} else if t.After(time.Now()) {
+		c.writeDeadline = t
+	}
+	c.mu.Unlock()
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// TestClassTimeouts checks that the timeouts of the class of a request are
+// applied to its connection.
+func TestClassTimeouts(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+	}
+	config.HTTP.Timeouts.Classes = map[string]configuration.HTTPClassTimeouts{
+		"pull": {Write: time.Hour},
+		"push": {Read: 2 * time.Hour},
+	}
+
+	var (
+		mu    sync.Mutex
+		conns []*deadlineConn
+	)
+	server := httptest.NewUnstartedServer(NewApp(context.Background(), &config))
+	server.Config.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		dc := &deadlineConn{Conn: c}
+		mu.Lock()
+		conns = append(conns, dc)
+		mu.Unlock()
+		return ConnContext(ctx, dc)
+	}
+	server.Start()
+	defer server.Close()
+
+	builder, err := v2.NewURLBuilderFromString(server.URL, false)
+	checkErr(t, err, "creating url builder")
+	name, _ := reference.WithName("foo/bar")
+
+	do := func(method, u string) *deadlineConn {
+		t.Helper()
+		client := &http.Client{Transport: &http.Transport{}}
+		defer client.CloseIdleConnections()
+		req, err := http.NewRequest(method, u, nil)
+		checkErr(t, err, "creating request")
+		resp, err := client.Do(req)
+		checkErr(t, err, "issuing request")
+		resp.Body.Close()
+
+		mu.Lock()
+		defer mu.Unlock()
+		c := conns[len(conns)-1]
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return &deadlineConn{readDeadline: c.readDeadline, writeDeadline: c.writeDeadline, writeResets: c.writeResets}
+	}
+
+	start := time.Now()
+	tagsURL, err := builder.BuildTagsURL(name)
+	checkErr(t, err, "building tags url")
+	c := do("GET", tagsURL)
+	if c.writeDeadline.Before(start.Add(time.Hour)) || c.writeResets == 0 {
+		t.Fatalf("unexpected write deadline of pull request: %v, reset %d times", c.writeDeadline, c.writeResets)
+	}
+	if !c.readDeadline.IsZero() {
+		t.Fatalf("unexpected read deadline of pull request: %v", c.readDeadline)
+	}
+
+	uploadURL, err := builder.BuildBlobUploadURL(name)
+	checkErr(t, err, "building upload url")
+	c = do("POST", uploadURL)
+	if c.readDeadline.Before(start.Add(2 * time.Hour)) {
+		t.Fatalf("unexpected read deadline of push request: %v", c.readDeadline)
+	}
+	if !c.writeDeadline.IsZero() {
+		t.Fatalf("unexpected write deadline of push request: %v", c.writeDeadline)
+	}
+
+	// the base route is not part of a class
+	baseURL, err := builder.BuildBaseURL()
+	checkErr(t, err, "building base url")
+	c = do("GET", baseURL)
+	if !c.readDeadline.IsZero() || !c.writeDeadline.IsZero() {
+		t.Fatalf("unexpected deadlines of base request: %v, %v", c.readDeadline, c.writeDeadline)
+	}
+}
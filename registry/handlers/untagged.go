@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/gorilla/handlers"
+)
+
+// untaggedDispatcher constructs the untagged manifests handler api endpoint.
+func untaggedDispatcher(ctx *Context, r *http.Request) http.Handler {
+	untaggedHandler := &untaggedHandler{
+		Context: ctx,
+	}
+
+	return handlers.MethodHandler{
+		"GET": http.HandlerFunc(untaggedHandler.GetUntagged),
+	}
+}
+
+// untaggedHandler handles requests for the untagged manifests of a
+// repository.
+type untaggedHandler struct {
+	*Context
+}
+
+type untaggedAPIResponse struct {
+	Name      string                          `json:"name"`
+	Manifests []distribution.UntaggedManifest `json:"manifests"`
+}
+
+// GetUntagged returns the manifests of the repository which are neither
+// tagged nor referenced by a tagged manifest, with the time they were pushed.
+func (uh *untaggedHandler) GetUntagged(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	manifests, err := uh.Repository.Manifests(uh)
+	if err != nil {
+		uh.Errors = append(uh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+
+	lister, ok := manifests.(distribution.UntaggedManifestLister)
+	if !ok {
+		uh.Errors = append(uh.Errors, errcode.ErrorCodeUnsupported)
+		return
+	}
+
+	untagged, err := lister.Untagged(uh)
+	if err != nil {
+		switch err {
+		case distribution.ErrUnsupported:
+			uh.Errors = append(uh.Errors, errcode.ErrorCodeUnsupported)
+		default:
+			uh.Errors = append(uh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		}
+		return
+	}
+
+	q := r.URL.Query()
+	if lastEntry := q.Get("last"); lastEntry != "" {
+		lastEntryIndex := sort.Search(len(untagged), func(i int) bool {
+			return untagged[i].Digest.String() > lastEntry
+		})
+		untagged = untagged[lastEntryIndex:]
+	}
+
+	if n := q.Get("n"); n != "" {
+		maxEntries, err := strconv.Atoi(n)
+		if err != nil || maxEntries < 0 {
+			uh.Errors = append(uh.Errors, v2.ErrorCodePaginationNumberInvalid.WithDetail(map[string]string{"n": n}))
+			return
+		}
+
+		if maxEntries >= len(untagged) {
+			maxEntries = len(untagged)
+		} else if maxEntries > 0 {
+			// defined in `catalog.go`
+			urlStr, err := createLinkEntry(r.URL.String(), maxEntries, untagged[maxEntries-1].Digest.String())
+			if err != nil {
+				uh.Errors = append(uh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+				return
+			}
+			w.Header().Set("Link", urlStr)
+		}
+		untagged = untagged[:maxEntries]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(untaggedAPIResponse{
+		Name:      uh.Repository.Named().Name(),
+		Manifests: untagged,
+	}); err != nil {
+		uh.Errors = append(uh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+}
@@ -0,0 +1,257 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/gorilla/mux"
+)
+
+// defaultUploadSessionIdleTimeout is the time without request the sessions
+// stop being counted after, if sessionidletimeout is not configured.
+const defaultUploadSessionIdleTimeout = 10 * time.Minute
+
+// uploadLimits caps the blob upload sessions open at once, per repository
+// and per client, so that a single client can not exhaust the write
+// throughput of the storage. A session is open from the request starting it
+// until it is completed or canceled, or has served no request for the idle
+// timeout, such as the sessions abandoned by crashed clients or finished on
+// another registry instance. The sessions are counted by each instance, for
+// the sessions started on it.
+type uploadLimits struct {
+	perRepository int
+	perClient     int
+	idleTimeout   time.Duration
+
+	mu           sync.Mutex
+	sessions     map[string]*uploadSession // open sessions by upload id
+	repositories map[string]int            // open sessions by repository
+	clients      map[string]int            // open sessions by client
+}
+
+// uploadSession is an upload counted against the caps of its repository and
+// client.
+type uploadSession struct {
+	repository string
+	client     string
+	// lastActive is the time the last request of the session ended
+	lastActive time.Time
+	// requests is the number of requests of the session being served, which
+	// is not idle meanwhile
+	requests int
+}
+
+// configureUploadLimits sets up the caps of the concurrent upload sessions,
+// if any.
+func (app *App) configureUploadLimits(config *configuration.Configuration) {
+	perRepository := config.Policy.Upload.MaxConcurrentPerRepository
+	perClient := config.Policy.Upload.MaxConcurrentPerClient
+	idleTimeout := config.Policy.Upload.SessionIdleTimeout
+	if perRepository < 0 || perClient < 0 {
+		panic(fmt.Sprintf("invalid upload concurrency limits: %d per repository, %d per client", perRepository, perClient))
+	}
+	if idleTimeout < 0 {
+		panic(fmt.Sprintf("invalid upload session idle timeout: %v", idleTimeout))
+	}
+	if perRepository == 0 && perClient == 0 {
+		return
+	}
+	if idleTimeout == 0 {
+		idleTimeout = defaultUploadSessionIdleTimeout
+	}
+	app.uploadLimits = &uploadLimits{
+		perRepository: perRepository,
+		perClient:     perClient,
+		idleTimeout:   idleTimeout,
+		sessions:      make(map[string]*uploadSession),
+		repositories:  make(map[string]int),
+		clients:       make(map[string]int),
+	}
+}
+
+// acquire counts an upload session of the repository by the client, unless
+// it exceeds one of the caps. It returns the cap exceeded, if any.
+func (l *uploadLimits) acquire(repository, client string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	exceeded := l.exceeded(repository, client)
+	if exceeded != "" {
+		// the sessions expired may leave room
+		l.expire(time.Now())
+		exceeded = l.exceeded(repository, client)
+	}
+	if exceeded != "" {
+		return exceeded
+	}
+	l.repositories[repository]++
+	l.clients[client]++
+	return ""
+}
+
+// exceeded returns the cap a new session of the repository by the client
+// would exceed, if any.
+func (l *uploadLimits) exceeded(repository, client string) string {
+	if l.perRepository > 0 && l.repositories[repository] >= l.perRepository {
+		return "repository"
+	}
+	if l.perClient > 0 && l.clients[client] >= l.perClient {
+		return "client"
+	}
+	return ""
+}
+
+// expire stops counting the sessions which served no request for the idle
+// timeout.
+func (l *uploadLimits) expire(now time.Time) {
+	for id, session := range l.sessions {
+		if session.requests == 0 && now.Sub(session.lastActive) > l.idleTimeout {
+			delete(l.sessions, id)
+			l.decrement(session.repository, session.client)
+		}
+	}
+}
+
+// release stops counting an upload session of the repository by the client
+// which was not started.
+func (l *uploadLimits) release(repository, client string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.decrement(repository, client)
+}
+
+func (l *uploadLimits) decrement(repository, client string) {
+	if l.repositories[repository]--; l.repositories[repository] <= 0 {
+		delete(l.repositories, repository)
+	}
+	if l.clients[client]--; l.clients[client] <= 0 {
+		delete(l.clients, client)
+	}
+}
+
+// start records the session counted by acquire under its upload id.
+func (l *uploadLimits) start(id string, session uploadSession) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sessions[id] = &session
+}
+
+// touch marks the session of the upload id, if any, as serving a request
+// until the returned function is called.
+func (l *uploadLimits) touch(id string) func() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	session, ok := l.sessions[id]
+	if !ok {
+		return func() {}
+	}
+	session.requests++
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		session.requests--
+		session.lastActive = time.Now()
+	}
+}
+
+// finish stops counting the session of the upload id, if any.
+func (l *uploadLimits) finish(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	session, ok := l.sessions[id]
+	if !ok {
+		return
+	}
+	delete(l.sessions, id)
+	l.decrement(session.repository, session.client)
+}
+
+// uploadSlot is the session counted for a request starting an upload, until
+// the upload it starts holds it.
+type uploadSlot struct {
+	repository string
+	client     string
+	held       bool
+}
+
+// uploadLimited counts the requests starting an upload against the caps of
+// their repository and client. If one of them is exceeded, it responds with
+// a TOOMANYREQUESTS error and returns true. Otherwise, the returned function
+// must be called once the request is served: it stops counting the session
+// unless the request started it.
+func (app *App) uploadLimited(ctx *Context, w http.ResponseWriter, r *http.Request) (func(), bool) {
+	route := mux.CurrentRoute(r)
+	if app.uploadLimits == nil || route == nil || route.GetName() != v2.RouteNameBlobUpload || r.Method != http.MethodPost {
+		return func() {}, false
+	}
+
+	repository := getName(ctx)
+	// anonymous clients are limited by address
+	client := dcontext.GetStringValue(ctx, auth.UserNameKey)
+	if client == "" {
+		client = "ip:" + app.clientIP(r)
+	}
+
+	if exceeded := app.uploadLimits.acquire(repository, client); exceeded != "" {
+		dcontext.GetLogger(ctx).Warnf("concurrent upload limit exceeded for %s of %q by %q", exceeded, repository, client)
+		ctx.Errors = append(ctx.Errors, errcode.ErrorCodeTooManyRequests.WithDetail(
+			fmt.Sprintf("too many concurrent uploads per %s", exceeded)))
+		if err := errcode.ServeJSON(w, ctx.Errors); err != nil {
+			dcontext.GetLogger(ctx).Errorf("error serving error json: %v (from %v)", err, ctx.Errors)
+		}
+		auditErrors(ctx)
+		return nil, true
+	}
+
+	slot := &uploadSlot{repository: repository, client: client}
+	ctx.uploadSlot = slot
+	return func() {
+		if !slot.held {
+			app.uploadLimits.release(repository, client)
+		}
+	}, false
+}
+
+// startUploadSession counts the upload started by the request as an open
+// session, until endUploadSession is called.
+func (buh *blobUploadHandler) startUploadSession() {
+	if buh.App.uploadLimits == nil || buh.uploadSlot == nil {
+		return
+	}
+	buh.App.uploadLimits.start(buh.Upload.ID(), uploadSession{
+		repository: buh.uploadSlot.repository,
+		client:     buh.uploadSlot.client,
+		lastActive: time.Now(),
+	})
+	buh.uploadSlot.held = true
+}
+
+// touchUploadSession marks the session of the upload as active until the
+// returned function is called, once the request is served.
+func (buh *blobUploadHandler) touchUploadSession() func() {
+	if buh.App.uploadLimits == nil || buh.Upload == nil {
+		return func() {}
+	}
+	return buh.App.uploadLimits.touch(buh.Upload.ID())
+}
+
+// endUploadSession stops counting the session of the upload, once it is
+// completed or canceled.
+func (buh *blobUploadHandler) endUploadSession() {
+	if buh.App.uploadLimits == nil || buh.Upload == nil {
+		return
+	}
+	buh.App.uploadLimits.finish(buh.Upload.ID())
+}
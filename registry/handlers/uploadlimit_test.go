@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/distribution/v3/testutil"
+)
+
+// TestUploadLimits checks that the upload sessions beyond the concurrency
+// caps of their repository are rejected, even when the open sessions are
+// idle, until one of them is completed or canceled.
+func TestUploadLimits(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[interface{}]interface{}{
+				"enabled": false,
+			}},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	config.Policy.Upload.MaxConcurrentPerRepository = 2
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	fooName, _ := reference.WithName("foo/bar")
+	barName, _ := reference.WithName("bar/baz")
+	uploadURL, err := env.builder.BuildBlobUploadURL(fooName)
+	checkErr(t, err, "building upload url")
+
+	checkRejected := func(msg string) {
+		t.Helper()
+		resp, err := http.Post(uploadURL, "", nil)
+		checkErr(t, err, msg)
+		defer resp.Body.Close()
+		checkResponse(t, msg, resp, http.StatusTooManyRequests)
+		checkBodyHasErrorCodes(t, msg, resp, errcode.ErrorCodeTooManyRequests)
+	}
+
+	// the open sessions hold the slots of the repository, even though no
+	// request of theirs is being served
+	first, _ := startPushLayer(t, env, fooName)
+	second, _ := startPushLayer(t, env, fooName)
+	checkRejected("starting upload beyond the cap")
+
+	// other repositories have their own cap
+	startPushLayer(t, env, barName)
+
+	// canceling a session releases its slot
+	resp, err := httpDelete(first)
+	checkErr(t, err, "canceling upload")
+	resp.Body.Close()
+	checkResponse(t, "canceling upload", resp, http.StatusNoContent)
+	third, _ := startPushLayer(t, env, fooName)
+	checkRejected("starting upload after canceling one")
+
+	// completing a session releases its slot
+	layerFile, layerDigest, err := testutil.CreateRandomTarFile()
+	checkErr(t, err, "creating random layer")
+	pushLayer(t, env.builder, fooName, layerDigest, second, layerFile)
+	startPushLayer(t, env, fooName)
+	checkRejected("starting upload after completing one")
+
+	resp, err = httpDelete(third)
+	checkErr(t, err, "canceling upload")
+	resp.Body.Close()
+}
+
+// TestUploadLimitsIdle checks that the sessions stop being counted once they
+// served no request for the idle timeout, unless a request of theirs is being
+// served.
+func TestUploadLimitsIdle(t *testing.T) {
+	limits := &uploadLimits{
+		perRepository: 1,
+		idleTimeout:   time.Minute,
+		sessions:      make(map[string]*uploadSession),
+		repositories:  make(map[string]int),
+		clients:       make(map[string]int),
+	}
+
+	if exceeded := limits.acquire("foo/bar", "alice"); exceeded != "" {
+		t.Fatalf("unexpected cap exceeded for the first session: %s", exceeded)
+	}
+	limits.start("abandoned", uploadSession{repository: "foo/bar", client: "alice", lastActive: time.Now().Add(-30 * time.Second)})
+	if exceeded := limits.acquire("foo/bar", "alice"); exceeded != "repository" {
+		t.Fatalf("expected the repository cap to be exceeded, got %q", exceeded)
+	}
+
+	// a long request keeps the session open past the idle timeout
+	done := limits.touch("abandoned")
+	limits.sessions["abandoned"].lastActive = time.Now().Add(-time.Hour)
+	if exceeded := limits.acquire("foo/bar", "alice"); exceeded != "repository" {
+		t.Fatalf("expected the repository cap to be exceeded while a request is served, got %q", exceeded)
+	}
+	done()
+	if exceeded := limits.acquire("foo/bar", "alice"); exceeded != "repository" {
+		t.Fatalf("expected the repository cap to be exceeded after a request, got %q", exceeded)
+	}
+
+	limits.sessions["abandoned"].lastActive = time.Now().Add(-2 * time.Minute)
+	if exceeded := limits.acquire("foo/bar", "alice"); exceeded != "" {
+		t.Fatalf("unexpected cap exceeded once the session is idle: %s", exceeded)
+	}
+	if _, ok := limits.sessions["abandoned"]; ok {
+		t.Fatal("expected the idle session to be forgotten")
+	}
+}
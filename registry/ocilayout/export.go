@@ -0,0 +1,269 @@
+package ocilayout
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// exportTarget is a repository to export, restricted to a tag if set.
+type exportTarget struct {
+	name     reference.Named
+	tag      string
+	explicit bool
+}
+
+// Export writes the tagged manifests of the repositories of the registry,
+// along with the manifests and blobs they reference, to the OCI image layout
+// at path: a tarball if path ends with .tar, a directory otherwise. A
+// repository is restricted to a tag with the name:tag form, and all the
+// repositories of the registry are exported if none is given.
+//
+// The manifests of the index of the layout are annotated with their tag, and
+// their repository and tag as containerd does, for Import to restore them.
+func Export(ctx context.Context, registry distribution.Namespace, repositories []string, path string) error {
+	targets, err := exportTargets(ctx, registry, repositories)
+	if err != nil {
+		return err
+	}
+
+	w, err := newLayoutWriter(path)
+	if err != nil {
+		return err
+	}
+
+	e := &exporter{
+		w:       w,
+		written: make(map[digest.Digest]bool),
+	}
+	err = e.export(ctx, registry, targets)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// exportTargets parses the repositories to export, or lists the repositories
+// of the registry if there are none.
+func exportTargets(ctx context.Context, registry distribution.Namespace, repositories []string) ([]exportTarget, error) {
+	var targets []exportTarget
+	for _, r := range repositories {
+		name, tag := splitReference(r)
+		if name == "" {
+			name, tag = r, ""
+		}
+		named, err := reference.WithName(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid repository %q: %v", r, err)
+		}
+		if tag != "" {
+			if _, err := reference.WithTag(named, tag); err != nil {
+				return nil, fmt.Errorf("invalid repository %q: %v", r, err)
+			}
+		}
+		targets = append(targets, exportTarget{name: named, tag: tag, explicit: true})
+	}
+	if len(targets) > 0 {
+		return targets, nil
+	}
+
+	enumerator, ok := registry.(distribution.RepositoryEnumerator)
+	if !ok {
+		return nil, fmt.Errorf("unable to list the repositories of the registry")
+	}
+	err := enumerator.Enumerate(ctx, func(name string) error {
+		named, err := reference.WithName(name)
+		if err != nil {
+			return fmt.Errorf("failed to parse repository name %s: %v", name, err)
+		}
+		targets = append(targets, exportTarget{name: named})
+		return nil
+	})
+	return targets, err
+}
+
+// exporter writes manifests and blobs to an image layout, each of them once.
+type exporter struct {
+	w       layoutWriter
+	written map[digest.Digest]bool
+}
+
+func (e *exporter) export(ctx context.Context, registry distribution.Namespace, targets []exportTarget) error {
+	layout, err := json.Marshal(v1.ImageLayout{Version: v1.ImageLayoutVersion})
+	if err != nil {
+		return err
+	}
+	if err := e.w.writeFile(v1.ImageLayoutFile, int64(len(layout)), bytes.NewReader(layout)); err != nil {
+		return err
+	}
+
+	index := v1.Index{
+		MediaType: v1.MediaTypeImageIndex,
+		Manifests: []v1.Descriptor{},
+	}
+	index.SchemaVersion = 2
+
+	for _, target := range targets {
+		descriptors, err := e.exportRepository(ctx, registry, target)
+		if err != nil {
+			return fmt.Errorf("failed to export %s: %v", target.name.Name(), err)
+		}
+		index.Manifests = append(index.Manifests, descriptors...)
+	}
+
+	content, err := json.MarshalIndent(index, "", "   ")
+	if err != nil {
+		return err
+	}
+	return e.w.writeFile(indexFile, int64(len(content)), bytes.NewReader(content))
+}
+
+// exportRepository exports the tagged manifests of a repository, returning
+// their descriptors for the index of the layout.
+func (e *exporter) exportRepository(ctx context.Context, registry distribution.Namespace, target exportTarget) ([]v1.Descriptor, error) {
+	repo, err := registry.Repository(ctx, target.name)
+	if err != nil {
+		return nil, err
+	}
+	manifests, err := repo.Manifests(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := []string{target.tag}
+	if target.tag == "" {
+		tags, err = repo.Tags(ctx).All(ctx)
+		if err != nil {
+			if _, ok := err.(distribution.ErrRepositoryUnknown); ok && !target.explicit {
+				// a repository without tags has nothing to export
+				return nil, nil
+			}
+			return nil, err
+		}
+	}
+
+	var descriptors []v1.Descriptor
+	for _, tag := range tags {
+		tagged, err := repo.Tags(ctx).Get(ctx, tag)
+		if err != nil {
+			return nil, err
+		}
+		desc, err := e.exportManifest(ctx, repo, manifests, tagged.Digest)
+		if err != nil {
+			return nil, err
+		}
+		descriptors = append(descriptors, v1.Descriptor{
+			MediaType: desc.MediaType,
+			Digest:    desc.Digest,
+			Size:      desc.Size,
+			Annotations: map[string]string{
+				v1.AnnotationRefName: tag,
+				imageNameAnnotation:  target.name.Name() + ":" + tag,
+			},
+		})
+		dcontext.GetLogger(ctx).Infof("exported %s:%s", target.name.Name(), tag)
+	}
+	return descriptors, nil
+}
+
+// exportManifest exports a manifest after the manifests and blobs it
+// references, returning its descriptor.
+func (e *exporter) exportManifest(ctx context.Context, repo distribution.Repository, manifests distribution.ManifestService, dgst digest.Digest) (distribution.Descriptor, error) {
+	manifest, err := manifests.Get(ctx, dgst)
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+	mediaType, payload, err := manifest.Payload()
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+
+	if !e.written[dgst] {
+		for _, desc := range manifest.References() {
+			switch {
+			case isManifest(desc.MediaType):
+				_, err = e.exportManifest(ctx, repo, manifests, desc.Digest)
+			case len(desc.URLs) > 0:
+				// foreign layers are not stored in registries
+				continue
+			default:
+				err = e.exportBlob(ctx, repo.Blobs(ctx), desc)
+			}
+			if err != nil {
+				return distribution.Descriptor{}, err
+			}
+		}
+
+		if err := e.w.writeFile(blobPath(dgst), int64(len(payload)), bytes.NewReader(payload)); err != nil {
+			return distribution.Descriptor{}, err
+		}
+		e.written[dgst] = true
+	}
+
+	return distribution.Descriptor{
+		MediaType: mediaType,
+		Digest:    dgst,
+		Size:      int64(len(payload)),
+	}, nil
+}
+
+// exportBlob exports a blob, unless it was already.
+func (e *exporter) exportBlob(ctx context.Context, blobs distribution.BlobStore, desc distribution.Descriptor) error {
+	if e.written[desc.Digest] {
+		return nil
+	}
+
+	stat, err := blobs.Stat(ctx, desc.Digest)
+	if err != nil {
+		return fmt.Errorf("blob %s: %v", desc.Digest, err)
+	}
+	rc, err := blobs.Open(ctx, desc.Digest)
+	if err != nil {
+		return fmt.Errorf("blob %s: %v", desc.Digest, err)
+	}
+	defer rc.Close()
+
+	if err := e.w.writeFile(blobPath(desc.Digest), stat.Size, rc); err != nil {
+		return err
+	}
+	e.written[desc.Digest] = true
+	return nil
+}
+
+// isManifest reports whether mediaType is the media type of a manifest
+// referenced by another one. The configuration of an artifact may be
+// application/json, which is also registered for schema1 manifests.
+func isManifest(mediaType string) bool {
+	switch mediaType {
+	case schema2.MediaTypeManifest, manifestlist.MediaTypeManifestList, v1.MediaTypeImageManifest, v1.MediaTypeImageIndex:
+		return true
+	}
+	return false
+}
+
+// splitReference splits a reference into its repository name and tag,
+// either of them possibly empty: a reference without a slash or colon, as
+// the ref name annotation of the OCI image layouts usually is, is a tag.
+func splitReference(ref string) (name, tag string) {
+	if i := strings.Index(ref, "@"); i >= 0 {
+		ref = ref[:i]
+	}
+	slash := strings.LastIndex(ref, "/")
+	if colon := strings.LastIndex(ref, ":"); colon > slash {
+		return ref[:colon], ref[colon+1:]
+	}
+	if slash < 0 {
+		return "", ref
+	}
+	return ref, ""
+}
@@ -0,0 +1,225 @@
+package ocilayout
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/reference"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Import loads the manifests of the index of the OCI image layout at path, a
+// tarball if path ends with .tar or a directory otherwise, into the registry
+// along with the manifests and blobs they reference, and tags them.
+//
+// The repository and tag of a manifest are read from its containerd image
+// name or ref name annotations. If repository is set, all the manifests are
+// imported into it instead, with the tag of their annotations. Manifests
+// without a tag are imported untagged.
+func Import(ctx context.Context, registry distribution.Namespace, path string, repository string) error {
+	r, err := newLayoutReader(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var layout v1.ImageLayout
+	if err := readJSON(r, v1.ImageLayoutFile, &layout); err != nil {
+		return err
+	}
+	if layout.Version != v1.ImageLayoutVersion {
+		return fmt.Errorf("unsupported image layout version %q", layout.Version)
+	}
+
+	var index v1.Index
+	if err := readJSON(r, indexFile, &index); err != nil {
+		return err
+	}
+
+	im := &importer{r: r}
+	for _, desc := range index.Manifests {
+		name, tag := importTarget(desc, repository)
+		if name == "" {
+			return fmt.Errorf("no repository for manifest %s, one must be given", desc.Digest)
+		}
+		named, err := reference.WithName(name)
+		if err != nil {
+			return fmt.Errorf("invalid repository of manifest %s: %v", desc.Digest, err)
+		}
+		if tag != "" {
+			if _, err := reference.WithTag(named, tag); err != nil {
+				return fmt.Errorf("invalid tag of manifest %s: %v", desc.Digest, err)
+			}
+		}
+
+		if err := im.importTagged(ctx, registry, named, tag, desc); err != nil {
+			return fmt.Errorf("failed to import %s into %s: %v", desc.Digest, name, err)
+		}
+		dcontext.GetLogger(ctx).Infof("imported %s@%s, tagged %q", name, desc.Digest, tag)
+	}
+	return nil
+}
+
+// importTarget returns the repository and tag of a manifest of the index.
+func importTarget(desc v1.Descriptor, repository string) (name, tag string) {
+	if ref := desc.Annotations[imageNameAnnotation]; ref != "" {
+		name, tag = splitReference(ref)
+	}
+	if ref := desc.Annotations[v1.AnnotationRefName]; ref != "" {
+		n, t := splitReference(ref)
+		if name == "" {
+			name = n
+		}
+		if t != "" {
+			tag = t
+		}
+	}
+	if repository != "" {
+		name = repository
+	}
+	return name, tag
+}
+
+// importer imports manifests and blobs from an image layout.
+type importer struct {
+	r layoutReader
+}
+
+func (im *importer) importTagged(ctx context.Context, registry distribution.Namespace, name reference.Named, tag string, desc v1.Descriptor) error {
+	repo, err := registry.Repository(ctx, name)
+	if err != nil {
+		return err
+	}
+	manifests, err := repo.Manifests(ctx)
+	if err != nil {
+		return err
+	}
+
+	d := distribution.Descriptor{
+		MediaType: desc.MediaType,
+		Digest:    desc.Digest,
+		Size:      desc.Size,
+	}
+	if err := im.importManifest(ctx, repo, manifests, d); err != nil {
+		return err
+	}
+	if tag == "" {
+		return nil
+	}
+	return repo.Tags(ctx).Tag(ctx, tag, d)
+}
+
+// importManifest imports a manifest after the manifests and blobs it
+// references, unless the repository already has it.
+func (im *importer) importManifest(ctx context.Context, repo distribution.Repository, manifests distribution.ManifestService, desc distribution.Descriptor) error {
+	exists, err := manifests.Exists(ctx, desc.Digest)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	content, err := im.readManifest(desc)
+	if err != nil {
+		return err
+	}
+	mediaType := desc.MediaType
+	if mediaType == "" {
+		var versioned struct {
+			MediaType string `json:"mediaType"`
+		}
+		if err := json.Unmarshal(content, &versioned); err != nil {
+			return fmt.Errorf("manifest %s: %v", desc.Digest, err)
+		}
+		mediaType = versioned.MediaType
+	}
+	manifest, _, err := distribution.UnmarshalManifest(mediaType, content)
+	if err != nil {
+		return fmt.Errorf("manifest %s: %v", desc.Digest, err)
+	}
+
+	for _, ref := range manifest.References() {
+		switch {
+		case isManifest(ref.MediaType):
+			err = im.importManifest(ctx, repo, manifests, ref)
+		case len(ref.URLs) > 0:
+			// foreign layers are not stored in registries
+			continue
+		default:
+			err = im.importBlob(ctx, repo.Blobs(ctx), ref)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	dgst, err := manifests.Put(ctx, manifest)
+	if err != nil {
+		return err
+	}
+	if dgst != desc.Digest {
+		return fmt.Errorf("manifest %s stored with digest %s", desc.Digest, dgst)
+	}
+	return nil
+}
+
+// importBlob imports a blob, unless the repository already has it. The
+// content of the blob is verified as it is committed.
+func (im *importer) importBlob(ctx context.Context, blobs distribution.BlobStore, desc distribution.Descriptor) error {
+	if _, err := blobs.Stat(ctx, desc.Digest); err == nil {
+		return nil
+	} else if err != distribution.ErrBlobUnknown {
+		return err
+	}
+
+	if err := desc.Digest.Validate(); err != nil {
+		return err
+	}
+	rc, err := im.r.open(blobPath(desc.Digest))
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	bw, err := blobs.Create(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(bw, rc); err != nil {
+		bw.Cancel(ctx)
+		return err
+	}
+	if _, err := bw.Commit(ctx, desc); err != nil {
+		return fmt.Errorf("blob %s: %v", desc.Digest, err)
+	}
+	return nil
+}
+
+// readManifest reads a manifest from the layout, verifying its digest.
+func (im *importer) readManifest(desc distribution.Descriptor) ([]byte, error) {
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, err
+	}
+	rc, err := im.r.open(blobPath(desc.Digest))
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	content, err := io.ReadAll(io.LimitReader(rc, desc.Size+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(content)) != desc.Size {
+		return nil, fmt.Errorf("manifest %s: size mismatch", desc.Digest)
+	}
+	if desc.Digest.Algorithm().FromBytes(content) != desc.Digest {
+		return nil, fmt.Errorf("manifest %s: digest mismatch", desc.Digest)
+	}
+	return content, nil
+}
@@ -0,0 +1,239 @@
+// Package ocilayout imports and exports the content of a registry from and to
+// OCI image layouts, as directories or tarballs, to transfer repositories
+// between registries without a network connection.
+package ocilayout
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// indexFile is the file name of the index of an image layout.
+	indexFile = "index.json"
+
+	// imageNameAnnotation is the annotation of the manifests of an index
+	// with their full reference, repository and tag, as set by containerd.
+	imageNameAnnotation = "io.containerd.image.name"
+)
+
+// isTarball reports whether the image layout at path is a tarball rather
+// than a directory.
+func isTarball(p string) bool {
+	return strings.HasSuffix(p, ".tar")
+}
+
+// blobPath returns the path of a blob in an image layout.
+func blobPath(dgst digest.Digest) string {
+	return path.Join("blobs", dgst.Algorithm().String(), dgst.Encoded())
+}
+
+// layoutWriter writes the files of an image layout.
+type layoutWriter interface {
+	// writeFile writes a file of size bytes read from r.
+	writeFile(name string, size int64, r io.Reader) error
+
+	// Close completes the image layout.
+	Close() error
+}
+
+func newLayoutWriter(p string) (layoutWriter, error) {
+	if !isTarball(p) {
+		if err := os.MkdirAll(p, 0755); err != nil {
+			return nil, err
+		}
+		return dirWriter(p), nil
+	}
+
+	f, err := os.Create(p)
+	if err != nil {
+		return nil, err
+	}
+	return &tarWriter{
+		f:    f,
+		tw:   tar.NewWriter(f),
+		dirs: make(map[string]bool),
+	}, nil
+}
+
+// dirWriter writes an image layout to a directory.
+type dirWriter string
+
+func (w dirWriter) writeFile(name string, size int64, r io.Reader) error {
+	p := filepath.Join(string(w), filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && n != size {
+		err = fmt.Errorf("short write of %s: %d of %d bytes", name, n, size)
+	}
+	return err
+}
+
+func (w dirWriter) Close() error {
+	return nil
+}
+
+// tarWriter writes an image layout to a tarball.
+type tarWriter struct {
+	f    *os.File
+	tw   *tar.Writer
+	dirs map[string]bool
+}
+
+func (w *tarWriter) writeFile(name string, size int64, r io.Reader) error {
+	now := time.Now()
+	// the parent directories missing are written first, from the outermost
+	var parents []string
+	for d := path.Dir(name); d != "." && !w.dirs[d]; d = path.Dir(d) {
+		parents = append(parents, d)
+	}
+	for i := len(parents) - 1; i >= 0; i-- {
+		if err := w.tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeDir,
+			Name:     parents[i] + "/",
+			Mode:     0755,
+			ModTime:  now,
+		}); err != nil {
+			return err
+		}
+		w.dirs[parents[i]] = true
+	}
+
+	if err := w.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  now,
+	}); err != nil {
+		return err
+	}
+	_, err := io.Copy(w.tw, r)
+	return err
+}
+
+func (w *tarWriter) Close() error {
+	err := w.tw.Close()
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// layoutReader reads the files of an image layout.
+type layoutReader interface {
+	// open opens a file of the image layout.
+	open(name string) (io.ReadCloser, error)
+
+	// Close releases the image layout.
+	Close() error
+}
+
+func newLayoutReader(p string) (layoutReader, error) {
+	if !isTarball(p) {
+		return dirReader(p), nil
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	r := &tarReader{
+		f:     f,
+		files: make(map[string]*io.SectionReader),
+	}
+	if err := r.scan(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// dirReader reads an image layout from a directory.
+type dirReader string
+
+func (r dirReader) open(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(string(r), filepath.FromSlash(name)))
+}
+
+func (r dirReader) Close() error {
+	return nil
+}
+
+// tarReader reads an image layout from a tarball. Its files are located once
+// when it is opened, and read in place from then on.
+type tarReader struct {
+	f     *os.File
+	files map[string]*io.SectionReader
+}
+
+// scan locates the regular files of the tarball. The tar reader reads the
+// headers of the files without buffering, so the offset of the tarball once
+// a header is read is the offset of the content of the file.
+func (r *tarReader) scan() error {
+	tr := tar.NewReader(r.f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		offset, err := r.f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		r.files[name] = io.NewSectionReader(r.f, offset, hdr.Size)
+	}
+}
+
+func (r *tarReader) open(name string) (io.ReadCloser, error) {
+	sr, ok := r.files[name]
+	if !ok {
+		return nil, fmt.Errorf("%s not found in tarball", name)
+	}
+	return io.NopCloser(io.NewSectionReader(sr, 0, sr.Size())), nil
+}
+
+func (r *tarReader) Close() error {
+	return r.f.Close()
+}
+
+// readJSON decodes a JSON file of an image layout.
+func readJSON(r layoutReader, name string, v interface{}) error {
+	rc, err := r.open(name)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	if err := json.NewDecoder(rc).Decode(v); err != nil {
+		return fmt.Errorf("invalid %s: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package ocilayout
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func newRegistry(t *testing.T) distribution.Namespace {
+	t.Helper()
+	registry, err := storage.NewRegistry(context.Background(), inmemory.New())
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+	return registry
+}
+
+func repository(t *testing.T, registry distribution.Namespace, name string) distribution.Repository {
+	t.Helper()
+	named, err := reference.WithName(name)
+	if err != nil {
+		t.Fatalf("unexpected error parsing name: %v", err)
+	}
+	repo, err := registry.Repository(context.Background(), named)
+	if err != nil {
+		t.Fatalf("unexpected error getting repo: %v", err)
+	}
+	return repo
+}
+
+// pushImage pushes an image of a layer, and an index of it, tagging them.
+func pushImage(t *testing.T, repo distribution.Repository, layer string, tag, indexTag string) (digest.Digest, digest.Digest) {
+	t.Helper()
+	ctx := context.Background()
+
+	desc, err := repo.Blobs(ctx).Put(ctx, v1.MediaTypeImageLayer, []byte(layer))
+	if err != nil {
+		t.Fatalf("unexpected error putting layer: %v", err)
+	}
+	builder := ocischema.NewManifestBuilder(repo.Blobs(ctx), []byte("{}"), map[string]string{})
+	if err := builder.AppendReference(desc); err != nil {
+		t.Fatalf("unexpected error building manifest: %v", err)
+	}
+	m, err := builder.Build(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error building manifest: %v", err)
+	}
+	manifests, err := repo.Manifests(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error getting manifest service: %v", err)
+	}
+	dgst, err := manifests.Put(ctx, m)
+	if err != nil {
+		t.Fatalf("unexpected error putting manifest: %v", err)
+	}
+	_, payload, _ := m.Payload()
+	mdesc := distribution.Descriptor{MediaType: v1.MediaTypeImageManifest, Digest: dgst, Size: int64(len(payload))}
+	if err := repo.Tags(ctx).Tag(ctx, tag, mdesc); err != nil {
+		t.Fatalf("unexpected error tagging manifest: %v", err)
+	}
+
+	index, err := manifestlist.FromDescriptorsWithMediaType([]manifestlist.ManifestDescriptor{{
+		Descriptor: mdesc,
+		Platform:   manifestlist.PlatformSpec{Architecture: "amd64", OS: "linux"},
+	}}, v1.MediaTypeImageIndex)
+	if err != nil {
+		t.Fatalf("unexpected error building index: %v", err)
+	}
+	indexDigest, err := manifests.Put(ctx, index)
+	if err != nil {
+		t.Fatalf("unexpected error putting index: %v", err)
+	}
+	_, payload, _ = index.Payload()
+	if err := repo.Tags(ctx).Tag(ctx, indexTag, distribution.Descriptor{MediaType: v1.MediaTypeImageIndex, Digest: indexDigest, Size: int64(len(payload))}); err != nil {
+		t.Fatalf("unexpected error tagging index: %v", err)
+	}
+	return dgst, indexDigest
+}
+
+// checkTag checks that a tag of a repository resolves to the digest, and
+// that the manifest and the blobs it references are readable.
+func checkTag(t *testing.T, repo distribution.Repository, tag string, dgst digest.Digest) {
+	t.Helper()
+	ctx := context.Background()
+
+	desc, err := repo.Tags(ctx).Get(ctx, tag)
+	if err != nil {
+		t.Fatalf("unexpected error getting tag %s of %s: %v", tag, repo.Named(), err)
+	}
+	if desc.Digest != dgst {
+		t.Fatalf("unexpected digest of tag %s of %s: %s != %s", tag, repo.Named(), desc.Digest, dgst)
+	}
+
+	manifests, err := repo.Manifests(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error getting manifest service: %v", err)
+	}
+	var check func(dgst digest.Digest)
+	check = func(dgst digest.Digest) {
+		m, err := manifests.Get(ctx, dgst)
+		if err != nil {
+			t.Fatalf("unexpected error getting manifest %s of %s: %v", dgst, repo.Named(), err)
+		}
+		for _, ref := range m.References() {
+			if isManifest(ref.MediaType) {
+				check(ref.Digest)
+				continue
+			}
+			content, err := repo.Blobs(ctx).Get(ctx, ref.Digest)
+			if err != nil {
+				t.Fatalf("unexpected error getting blob %s of %s: %v", ref.Digest, repo.Named(), err)
+			}
+			if digest.FromBytes(content) != ref.Digest {
+				t.Fatalf("unexpected content of blob %s of %s", ref.Digest, repo.Named())
+			}
+		}
+	}
+	check(dgst)
+}
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	source := newRegistry(t)
+	fooManifest, fooIndex := pushImage(t, repository(t, source, "foo/bar"), "foo layer", "v1", "multi")
+	bazManifest, _ := pushImage(t, repository(t, source, "baz"), "baz layer", "latest", "all")
+
+	for _, name := range []string{"layout", "layout.tar"} {
+		path := filepath.Join(t.TempDir(), name)
+		if err := Export(ctx, source, nil, path); err != nil {
+			t.Fatalf("unexpected error exporting to %s: %v", name, err)
+		}
+
+		target := newRegistry(t)
+		if err := Import(ctx, target, path, ""); err != nil {
+			t.Fatalf("unexpected error importing from %s: %v", name, err)
+		}
+		foo := repository(t, target, "foo/bar")
+		checkTag(t, foo, "v1", fooManifest)
+		checkTag(t, foo, "multi", fooIndex)
+		checkTag(t, repository(t, target, "baz"), "latest", bazManifest)
+
+		// importing again is a no-op
+		if err := Import(ctx, target, path, ""); err != nil {
+			t.Fatalf("unexpected error importing from %s again: %v", name, err)
+		}
+	}
+}
+
+func TestExportImportRepository(t *testing.T) {
+	ctx := context.Background()
+	source := newRegistry(t)
+	fooManifest, _ := pushImage(t, repository(t, source, "foo/bar"), "foo layer", "v1", "multi")
+	pushImage(t, repository(t, source, "baz"), "baz layer", "latest", "all")
+
+	path := filepath.Join(t.TempDir(), "layout.tar")
+	if err := Export(ctx, source, []string{"foo/bar:v1"}, path); err != nil {
+		t.Fatalf("unexpected error exporting: %v", err)
+	}
+
+	target := newRegistry(t)
+	if err := Import(ctx, target, path, "copied/foo"); err != nil {
+		t.Fatalf("unexpected error importing: %v", err)
+	}
+	copied := repository(t, target, "copied/foo")
+	checkTag(t, copied, "v1", fooManifest)
+	if tags, err := copied.Tags(ctx).All(ctx); err != nil || len(tags) != 1 {
+		t.Fatalf("unexpected tags of the imported repository: %v, %v", tags, err)
+	}
+	if _, err := repository(t, target, "foo/bar").Tags(ctx).All(ctx); err == nil {
+		t.Fatalf("expected the repository of the export to be left alone")
+	}
+
+	if err := Export(ctx, source, []string{"foo/bar:missing"}, filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Fatalf("expected an error exporting a missing tag")
+	}
+}
+
+func TestImportVerifiesContent(t *testing.T) {
+	ctx := context.Background()
+	source := newRegistry(t)
+	pushImage(t, repository(t, source, "foo/bar"), "foo layer", "v1", "multi")
+
+	path := filepath.Join(t.TempDir(), "layout")
+	if err := Export(ctx, source, []string{"foo/bar:v1"}, path); err != nil {
+		t.Fatalf("unexpected error exporting: %v", err)
+	}
+
+	// tamper with the layer
+	layer := digest.FromString("foo layer")
+	if err := dirWriter(path).writeFile(blobPath(layer), 9, bytes.NewReader([]byte("bad layer"))); err != nil {
+		t.Fatalf("unexpected error writing layer: %v", err)
+	}
+	if err := Import(ctx, newRegistry(t), path, ""); err == nil {
+		t.Fatalf("expected an error importing tampered content")
+	}
+}
+
+func TestSplitReference(t *testing.T) {
+	for _, tc := range []struct {
+		ref, name, tag string
+	}{
+		{"latest", "", "latest"},
+		{"foo:latest", "foo", "latest"},
+		{"foo/bar", "foo/bar", ""},
+		{"localhost:5000/foo/bar:v1", "localhost:5000/foo/bar", "v1"},
+		{"foo/bar@sha256:abc", "foo/bar", ""},
+	} {
+		name, tag := splitReference(tc.ref)
+		if name != tc.name || tag != tc.tag {
+			t.Errorf("unexpected split of %q: %q, %q", tc.ref, name, tag)
+		}
+	}
+}
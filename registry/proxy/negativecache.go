@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/distribution/v3/registry/client"
+)
+
+// negativeCacheMaxEntries is the number of entries of the negative cache
+// above which its expired entries are pruned, or all its entries if none
+// expired.
+const negativeCacheMaxEntries = 10000
+
+// negativeCache remembers the manifest references the remote reported as not
+// found, so that they are not requested again until their entry expires. The
+// references are the tags or digests of the manifests of a repository, such
+// as ":latest" or "@sha256:...". A nil cache remembers nothing.
+type negativeCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]time.Time // expiration time by repository and reference
+}
+
+// newNegativeCache returns a negative cache whose entries expire after ttl,
+// or nil if ttl is not positive.
+func newNegativeCache(ttl time.Duration) *negativeCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &negativeCache{
+		ttl:     ttl,
+		entries: make(map[string]time.Time),
+	}
+}
+
+// add records that the remote did not find ref in the repository.
+func (nc *negativeCache) add(name reference.Named, ref string) {
+	if nc == nil {
+		return
+	}
+	key := name.Name() + ref
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	now := time.Now()
+	if len(nc.entries) >= negativeCacheMaxEntries {
+		for k, expiresAt := range nc.entries {
+			if !now.Before(expiresAt) {
+				delete(nc.entries, k)
+			}
+		}
+		if len(nc.entries) >= negativeCacheMaxEntries {
+			nc.entries = make(map[string]time.Time)
+		}
+	}
+	nc.entries[key] = now.Add(nc.ttl)
+}
+
+// contains returns whether the remote did not find ref in the repository
+// recently.
+func (nc *negativeCache) contains(name reference.Named, ref string) bool {
+	if nc == nil {
+		return false
+	}
+	key := name.Name() + ref
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	expiresAt, ok := nc.entries[key]
+	if !ok {
+		return false
+	}
+	if !time.Now().Before(expiresAt) {
+		delete(nc.entries, key)
+		return false
+	}
+	return true
+}
+
+// remove forgets ref in the repository, once it is known to exist.
+func (nc *negativeCache) remove(name reference.Named, ref string) {
+	if nc == nil {
+		return
+	}
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	delete(nc.entries, name.Name()+ref)
+}
+
+// isRemoteNotFound returns whether err reports the remote did not find the
+// requested content or repository, as opposed to failing to serve it.
+func isRemoteNotFound(err error) bool {
+	switch err := err.(type) {
+	case distribution.ErrTagUnknown, distribution.ErrManifestUnknown, distribution.ErrManifestUnknownRevision, distribution.ErrRepositoryUnknown:
+		return true
+	case errcode.ErrorCode:
+		return err.Descriptor().HTTPStatusCode == http.StatusNotFound
+	case errcode.Error:
+		return err.Code.Descriptor().HTTPStatusCode == http.StatusNotFound
+	case errcode.Errors:
+		if len(err) == 0 {
+			return false
+		}
+		for _, e := range err {
+			if !isRemoteNotFound(e) {
+				return false
+			}
+		}
+		return true
+	case *client.UnexpectedHTTPResponseError:
+		return err.StatusCode == http.StatusNotFound
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/distribution/distribution/v3/registry/client"
+)
+
+func TestIsRemoteNotFound(t *testing.T) {
+	for _, tc := range []struct {
+		err      error
+		notFound bool
+	}{
+		{errcode.Errors{v2.ErrorCodeManifestUnknown.WithDetail("latest")}, true},
+		{errcode.Errors{v2.ErrorCodeNameUnknown}, true},
+		{&client.UnexpectedHTTPResponseError{StatusCode: http.StatusNotFound}, true},
+		{errcode.Errors{errcode.ErrorCodeTooManyRequests}, false},
+		{errcode.Errors{v2.ErrorCodeManifestUnknown, errcode.ErrorCodeUnauthorized}, false},
+		{errcode.Errors{}, false},
+		{&client.UnexpectedHTTPStatusError{Status: "503 Service Unavailable"}, false},
+		{errors.New("connection refused"), false},
+	} {
+		if notFound := isRemoteNotFound(tc.err); notFound != tc.notFound {
+			t.Errorf("isRemoteNotFound(%v) = %t, expected %t", tc.err, notFound, tc.notFound)
+		}
+	}
+}
+
+func TestNegativeCacheMaxEntries(t *testing.T) {
+	name, err := reference.WithName("foo/bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nc := newNegativeCache(time.Hour)
+	for i := 0; i < negativeCacheMaxEntries; i++ {
+		nc.add(name, ":"+strconv.Itoa(i))
+	}
+	if len(nc.entries) != negativeCacheMaxEntries {
+		t.Fatalf("expected %d entries, got %d", negativeCacheMaxEntries, len(nc.entries))
+	}
+
+	nc.add(name, ":latest")
+	if len(nc.entries) != 1 {
+		t.Fatalf("expected the full cache to be reset, got %d entries", len(nc.entries))
+	}
+	if !nc.contains(name, ":latest") {
+		t.Fatal("expected the cache to contain the added reference")
+	}
+}
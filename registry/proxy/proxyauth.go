@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 
 	"github.com/distribution/distribution/v3/context"
 	"github.com/distribution/distribution/v3/registry/client/auth"
@@ -17,28 +18,46 @@ type userpass struct {
 	password string
 }
 
+// credentials are the credentials of a remote, sent to its token
+// authentication URLs. They may be changed while the cache is running.
 type credentials struct {
+	mu    sync.RWMutex
 	creds map[string]userpass
 }
 
-func (c credentials) Basic(u *url.URL) (string, string) {
+func (c *credentials) Basic(u *url.URL) (string, string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	up := c.creds[u.String()]
 
 	return up.username, up.password
 }
 
-func (c credentials) RefreshToken(u *url.URL, service string) string {
+func (c *credentials) RefreshToken(u *url.URL, service string) string {
 	return ""
 }
 
-func (c credentials) SetRefreshToken(u *url.URL, service, token string) {
+func (c *credentials) SetRefreshToken(u *url.URL, service, token string) {
+}
+
+// set replaces the username and password sent to the token authentication
+// URLs discovered when the credentials were configured.
+func (c *credentials) set(username, password string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for url := range c.creds {
+		c.creds[url] = userpass{
+			username: username,
+			password: password,
+		}
+	}
 }
 
 // configureAuth stores credentials for challenge responses
-func configureAuth(username, password, remoteURL string) (auth.CredentialStore, error) {
+func configureAuth(username, password, remoteURL string, transport http.RoundTripper) (auth.CredentialStore, error) {
 	creds := map[string]userpass{}
 
-	authURLs, err := getAuthURLs(remoteURL)
+	authURLs, err := getAuthURLs(remoteURL, transport)
 	if err != nil {
 		return nil, err
 	}
@@ -51,13 +70,14 @@ func configureAuth(username, password, remoteURL string) (auth.CredentialStore,
 		}
 	}
 
-	return credentials{creds: creds}, nil
+	return &credentials{creds: creds}, nil
 }
 
-func getAuthURLs(remoteURL string) ([]string, error) {
+func getAuthURLs(remoteURL string, transport http.RoundTripper) ([]string, error) {
 	authURLs := []string{}
 
-	resp, err := http.Get(remoteURL + "/v2/")
+	client := &http.Client{Transport: transport}
+	resp, err := client.Get(remoteURL + "/v2/")
 	if err != nil {
 		return nil, err
 	}
@@ -72,8 +92,9 @@ func getAuthURLs(remoteURL string) ([]string, error) {
 	return authURLs, nil
 }
 
-func ping(manager challenge.Manager, endpoint, versionHeader string) error {
-	resp, err := http.Get(endpoint)
+func ping(manager challenge.Manager, endpoint, versionHeader string, transport http.RoundTripper) error {
+	client := &http.Client{Transport: transport}
+	resp, err := client.Get(endpoint)
 	if err != nil {
 		return err
 	}
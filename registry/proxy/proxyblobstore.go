@@ -2,6 +2,8 @@ package proxy
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"strconv"
@@ -11,19 +13,26 @@ import (
 	dcontext "github.com/distribution/distribution/v3/context"
 	"github.com/distribution/distribution/v3/reference"
 	"github.com/distribution/distribution/v3/registry/proxy/scheduler"
+	"github.com/distribution/distribution/v3/registry/storage"
 	"github.com/opencontainers/go-digest"
 )
 
 type proxyBlobStore struct {
 	localStore     distribution.BlobStore
 	remoteStore    distribution.BlobService
+	blobStatter    distribution.BlobStatter // the blobs stored locally for any repository
 	scheduler      *scheduler.TTLExpirationScheduler
 	repositoryName reference.Named
 	authChallenger authChallenger
+	pushThrough    bool // accept uploads to the local store
 }
 
 var _ distribution.BlobStore = &proxyBlobStore{}
 
+// errRemoteDigestMismatch is returned when content fetched from the remote
+// does not match its digest.
+var errRemoteDigestMismatch = errors.New("content fetched from the remote does not match its digest")
+
 // inflight tracks currently downloading blobs
 var inflight = make(map[digest.Digest]struct{})
 
@@ -54,8 +63,27 @@ func (pbs *proxyBlobStore) copyContent(ctx context.Context, dgst digest.Digest,
 
 	defer remoteReader.Close()
 
-	_, err = io.CopyN(writer, remoteReader, desc.Size)
-	if err != nil {
+	// The content is verified as it is copied. Its last byte is held back
+	// until it is verified, so that corrupted content is never committed nor
+	// entirely served: clients receive a truncated response instead.
+	verifier := dgst.Verifier()
+	reader := io.TeeReader(remoteReader, verifier)
+	var last []byte
+	if desc.Size > 0 {
+		if _, err := io.CopyN(writer, reader, desc.Size-1); err != nil {
+			return distribution.Descriptor{}, err
+		}
+		last = make([]byte, 1)
+		if _, err := io.ReadFull(reader, last); err != nil {
+			return distribution.Descriptor{}, err
+		}
+	}
+	if !verifier.Verified() {
+		proxyMetrics.BlobDigestMismatch()
+		dcontext.GetLogger(ctx).Errorf("Error fetching blob %s of %s: %s", dgst, pbs.repositoryName, errRemoteDigestMismatch)
+		return distribution.Descriptor{}, fmt.Errorf("blob %s: %w", dgst, errRemoteDigestMismatch)
+	}
+	if _, err := writer.Write(last); err != nil {
 		return distribution.Descriptor{}, err
 	}
 
@@ -73,10 +101,44 @@ func (pbs *proxyBlobStore) serveLocal(ctx context.Context, w http.ResponseWriter
 	}
 
 	proxyMetrics.BlobPush(uint64(localDesc.Size))
+	if blobRef, err := reference.WithDigest(pbs.repositoryName, dgst); err == nil {
+		pbs.scheduler.Access(blobRef)
+	}
 	return true, pbs.localStore.ServeBlob(ctx, w, r, dgst)
 }
 
-func (pbs *proxyBlobStore) storeLocal(ctx context.Context, dgst digest.Digest) error {
+// mountLocal links the blob into the repository when it is already stored
+// locally, such as when it was cached for another repository or from
+// another remote, rather than fetching it again, and returns whether it did.
+// The remote must still have the blob in the repository, so that the blobs
+// of the other repositories are not served through it.
+func (pbs *proxyBlobStore) mountLocal(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, bool) {
+	if pbs.blobStatter == nil {
+		return distribution.Descriptor{}, false
+	}
+	if _, err := pbs.blobStatter.Stat(ctx, dgst); err != nil {
+		return distribution.Descriptor{}, false
+	}
+	blobRef, err := reference.WithDigest(pbs.repositoryName, dgst)
+	if err != nil {
+		return distribution.Descriptor{}, false
+	}
+	if _, err := pbs.remoteStore.Stat(ctx, dgst); err != nil {
+		return distribution.Descriptor{}, false
+	}
+
+	bw, err := pbs.localStore.Create(ctx, storage.WithMountFrom(blobRef), storage.WithMountFallback())
+	if mounted, ok := err.(distribution.ErrBlobMounted); ok {
+		pbs.scheduler.AddBlob(blobRef, repositoryTTL, mounted.Descriptor.Size)
+		return mounted.Descriptor, true
+	}
+	if err == nil {
+		bw.Cancel(ctx)
+	}
+	return distribution.Descriptor{}, false
+}
+
+func (pbs *proxyBlobStore) storeLocal(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
 	defer func() {
 		mu.Lock()
 		delete(inflight, dgst)
@@ -89,20 +151,59 @@ func (pbs *proxyBlobStore) storeLocal(ctx context.Context, dgst digest.Digest) e
 
 	bw, err = pbs.localStore.Create(ctx)
 	if err != nil {
-		return err
+		return distribution.Descriptor{}, err
 	}
 
 	desc, err = pbs.copyContent(ctx, dgst, bw)
 	if err != nil {
-		return err
+		bw.Cancel(ctx)
+		return distribution.Descriptor{}, err
 	}
 
 	_, err = bw.Commit(ctx, desc)
 	if err != nil {
-		return err
+		return distribution.Descriptor{}, err
 	}
 
-	return nil
+	return desc, nil
+}
+
+// fetch stores the blob locally without serving it, unless it is already
+// stored or being stored, and returns whether it was fetched from the
+// remote.
+func (pbs *proxyBlobStore) fetch(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, bool, error) {
+	blobRef, err := reference.WithDigest(pbs.repositoryName, dgst)
+	if err != nil {
+		return distribution.Descriptor{}, false, err
+	}
+	if desc, err := pbs.localStore.Stat(ctx, dgst); err == nil {
+		pbs.scheduler.Access(blobRef)
+		return desc, false, nil
+	}
+
+	if err := pbs.authChallenger.tryEstablishChallenges(ctx); err != nil {
+		return distribution.Descriptor{}, false, err
+	}
+
+	if desc, ok := pbs.mountLocal(ctx, dgst); ok {
+		return desc, false, nil
+	}
+
+	mu.Lock()
+	if _, ok := inflight[dgst]; ok {
+		mu.Unlock()
+		desc, err := pbs.remoteStore.Stat(ctx, dgst)
+		return desc, false, err
+	}
+	inflight[dgst] = struct{}{}
+	mu.Unlock()
+
+	desc, err := pbs.storeLocal(ctx, dgst)
+	if err != nil {
+		return distribution.Descriptor{}, false, err
+	}
+	pbs.scheduler.AddBlob(blobRef, repositoryTTL, desc.Size)
+	return desc, true, nil
 }
 
 func (pbs *proxyBlobStore) ServeBlob(ctx context.Context, w http.ResponseWriter, r *http.Request, dgst digest.Digest) error {
@@ -120,6 +221,11 @@ func (pbs *proxyBlobStore) ServeBlob(ctx context.Context, w http.ResponseWriter,
 		return err
 	}
 
+	if desc, ok := pbs.mountLocal(ctx, dgst); ok {
+		proxyMetrics.BlobPush(uint64(desc.Size))
+		return pbs.localStore.ServeBlob(ctx, w, r, dgst)
+	}
+
 	mu.Lock()
 	_, ok := inflight[dgst]
 	if ok {
@@ -136,7 +242,8 @@ func (pbs *proxyBlobStore) ServeBlob(ctx context.Context, w http.ResponseWriter,
 	storeLocalCtx, cancel := context.WithCancel(context.Background())
 	go func(dgst digest.Digest) {
 		defer cancel()
-		if err := pbs.storeLocal(storeLocalCtx, dgst); err != nil {
+		desc, err := pbs.storeLocal(storeLocalCtx, dgst)
+		if err != nil {
 			dcontext.GetLogger(storeLocalCtx).Errorf("Error committing to storage: %s", err.Error())
 		}
 
@@ -146,7 +253,7 @@ func (pbs *proxyBlobStore) ServeBlob(ctx context.Context, w http.ResponseWriter,
 			return
 		}
 
-		pbs.scheduler.AddBlob(blobRef, repositoryTTL)
+		pbs.scheduler.AddBlob(blobRef, repositoryTTL, desc.Size)
 	}(dgst)
 
 	_, err = pbs.copyContent(ctx, dgst, w)
@@ -189,6 +296,12 @@ func (pbs *proxyBlobStore) Get(ctx context.Context, dgst digest.Digest) ([]byte,
 		return []byte{}, err
 	}
 
+	if dgst.Algorithm().FromBytes(blob) != dgst {
+		proxyMetrics.BlobDigestMismatch()
+		dcontext.GetLogger(ctx).Errorf("Error fetching blob %s of %s: %s", dgst, pbs.repositoryName, errRemoteDigestMismatch)
+		return []byte{}, fmt.Errorf("blob %s: %w", dgst, errRemoteDigestMismatch)
+	}
+
 	_, err = pbs.localStore.Put(ctx, "", blob)
 	if err != nil {
 		return []byte{}, err
@@ -196,17 +309,25 @@ func (pbs *proxyBlobStore) Get(ctx context.Context, dgst digest.Digest) ([]byte,
 	return blob, nil
 }
 
-// Unsupported functions
-func (pbs *proxyBlobStore) Put(ctx context.Context, mediaType string, p []byte) (distribution.Descriptor, error) {
-	return distribution.Descriptor{}, distribution.ErrUnsupported
-}
-
+// Uploads are stored locally, to be forwarded to the remote along with the
+// manifests referencing them, and unsupported unless push through is enabled.
 func (pbs *proxyBlobStore) Create(ctx context.Context, options ...distribution.BlobCreateOption) (distribution.BlobWriter, error) {
-	return nil, distribution.ErrUnsupported
+	if !pbs.pushThrough {
+		return nil, distribution.ErrUnsupported
+	}
+	return pbs.localStore.Create(ctx, options...)
 }
 
 func (pbs *proxyBlobStore) Resume(ctx context.Context, id string) (distribution.BlobWriter, error) {
-	return nil, distribution.ErrUnsupported
+	if !pbs.pushThrough {
+		return nil, distribution.ErrUnsupported
+	}
+	return pbs.localStore.Resume(ctx, id)
+}
+
+// Unsupported functions
+func (pbs *proxyBlobStore) Put(ctx context.Context, mediaType string, p []byte) (distribution.Descriptor, error) {
+	return distribution.Descriptor{}, distribution.ErrUnsupported
 }
 
 func (pbs *proxyBlobStore) Mount(ctx context.Context, sourceRepo reference.Named, dgst digest.Digest) (distribution.Descriptor, error) {
@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"context"
+	"errors"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
@@ -95,6 +96,7 @@ type testEnv struct {
 	numUnique int
 	inRemote  []distribution.Descriptor
 	store     proxyBlobStore
+	local     distribution.Namespace
 	ctx       context.Context
 }
 
@@ -180,12 +182,14 @@ func makeTestEnv(t *testing.T, name string) *testEnv {
 		repositoryName: nameRef,
 		remoteStore:    truthBlobs,
 		localStore:     localBlobs,
+		blobStatter:    localRegistry.BlobStatter(),
 		scheduler:      s,
 		authChallenger: &mockChallenger{},
 	}
 
 	te := &testEnv{
 		store: proxyBlobStore,
+		local: localRegistry,
 		ctx:   ctx,
 	}
 	return te
@@ -408,3 +412,109 @@ func testProxyStoreServe(t *testing.T, te *testEnv, numClients int) {
 		t.Fatalf("unexpected remote stats: %#v", remoteStats)
 	}
 }
+
+func TestProxyStoreMountLocal(t *testing.T) {
+	te := makeTestEnv(t, "foo/bar")
+	localStats := te.LocalStats()
+	remoteStats := te.RemoteStats()
+
+	// the blobs were cached for another repository
+	otherName, _ := reference.WithName("other/repo")
+	other, err := te.local.Repository(te.ctx, otherName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, secret := makeBlob(10), makeBlob(10)
+	desc, err := te.store.remoteStore.Put(te.ctx, "", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range [][]byte{content, secret} {
+		if _, err := other.Blobs(te.ctx).Put(te.ctx, "", p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest("GET", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := te.store.ServeBlob(te.ctx, w, r, desc.Digest); err != nil {
+		t.Fatal(err)
+	}
+	if digest.FromBytes(w.Body.Bytes()) != desc.Digest {
+		t.Fatal("Mismatching blob fetch from proxy")
+	}
+	if _, err := te.store.localStore.Stat(te.ctx, desc.Digest); err != nil {
+		t.Fatalf("expected the blob to be linked to the repository: %v", err)
+	}
+	sbsMu.Lock()
+	if (*remoteStats)["open"] != 0 || (*localStats)["create"] != 1 {
+		t.Errorf("expected the blob to be mounted rather than fetched, got remote %v and local %v", *remoteStats, *localStats)
+	}
+	sbsMu.Unlock()
+
+	// the remote does not have the other blob in the repository
+	if _, _, err := te.store.fetch(te.ctx, digest.FromBytes(secret)); err == nil {
+		t.Fatal("expected an error fetching a blob the remote does not have")
+	}
+	if _, err := te.store.localStore.Stat(te.ctx, digest.FromBytes(secret)); err != distribution.ErrBlobUnknown {
+		t.Fatalf("expected the blob not to be linked to the repository, got %v", err)
+	}
+}
+
+// swappingBlobStore serves the content of another blob of the remote, as a
+// corrupted remote would.
+type swappingBlobStore struct {
+	statsBlobStore
+	swaps map[digest.Digest]digest.Digest
+}
+
+func (sbs swappingBlobStore) Get(ctx context.Context, dgst digest.Digest) ([]byte, error) {
+	return sbs.statsBlobStore.Get(ctx, sbs.swaps[dgst])
+}
+
+func (sbs swappingBlobStore) Open(ctx context.Context, dgst digest.Digest) (distribution.ReadSeekCloser, error) {
+	return sbs.statsBlobStore.Open(ctx, sbs.swaps[dgst])
+}
+
+func TestProxyStoreDigestMismatch(t *testing.T) {
+	te := makeTestEnv(t, "foo/bar")
+	populate(t, te, 2, 10, 2)
+	requested, served := te.inRemote[0], te.inRemote[1]
+	te.store.remoteStore = swappingBlobStore{
+		statsBlobStore: te.store.remoteStore.(statsBlobStore),
+		swaps:          map[digest.Digest]digest.Digest{requested.Digest: served.Digest},
+	}
+
+	if _, err := te.store.Get(te.ctx, requested.Digest); !errors.Is(err, errRemoteDigestMismatch) {
+		t.Fatalf("expected a digest mismatch error, got %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	r, err := http.NewRequest("GET", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := te.store.ServeBlob(te.ctx, w, r, requested.Digest); !errors.Is(err, errRemoteDigestMismatch) {
+		t.Fatalf("expected a digest mismatch error, got %v", err)
+	}
+	// the response is truncated
+	if w.Body.Len() != int(requested.Size)-1 {
+		t.Errorf("unexpected length of the response: %d", w.Body.Len())
+	}
+
+	// Wait for any async storage goroutines to finish
+	time.Sleep(time.Second)
+
+	if _, err := te.store.localStore.Stat(te.ctx, requested.Digest); err != distribution.ErrBlobUnknown {
+		t.Errorf("expected the corrupted blob not to be cached, got %v", err)
+	}
+	if _, err := te.store.localStore.Stat(te.ctx, served.Digest); err != distribution.ErrBlobUnknown {
+		t.Errorf("expected the served blob not to be cached, got %v", err)
+	}
+	if proxyMetrics.blobMetrics.DigestMismatches < 2 {
+		t.Errorf("unexpected count of digest mismatches: %d", proxyMetrics.blobMetrics.DigestMismatches)
+	}
+}
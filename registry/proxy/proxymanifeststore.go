@@ -2,12 +2,15 @@ package proxy
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	"github.com/distribution/distribution/v3"
 	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/manifest/schema1"
 	"github.com/distribution/distribution/v3/reference"
 	"github.com/distribution/distribution/v3/registry/proxy/scheduler"
+	"github.com/distribution/distribution/v3/registry/pushqueue"
 	"github.com/opencontainers/go-digest"
 )
 
@@ -21,9 +24,14 @@ type proxyManifestStore struct {
 	repositoryName  reference.Named
 	scheduler       *scheduler.TTLExpirationScheduler
 	authChallenger  authChallenger
+	pushes          *pushqueue.Queue
+	notFound        *negativeCache // the manifests the remote did not find recently
 }
 
-var _ distribution.ManifestService = &proxyManifestStore{}
+var (
+	_ distribution.ManifestService   = &proxyManifestStore{}
+	_ distribution.ManifestReferrers = &proxyManifestStore{}
+)
 
 func (pms proxyManifestStore) Exists(ctx context.Context, dgst digest.Digest) (bool, error) {
 	exists, err := pms.localManifests.Exists(ctx, dgst)
@@ -33,10 +41,18 @@ func (pms proxyManifestStore) Exists(ctx context.Context, dgst digest.Digest) (b
 	if exists {
 		return true, nil
 	}
+	if pms.notFound.contains(pms.repositoryName, "@"+dgst.String()) {
+		proxyMetrics.ManifestNotFoundHit()
+		return false, nil
+	}
 	if err := pms.authChallenger.tryEstablishChallenges(ctx); err != nil {
 		return false, err
 	}
-	return pms.remoteManifests.Exists(ctx, dgst)
+	exists, err = pms.remoteManifests.Exists(ctx, dgst)
+	if err == nil && !exists {
+		pms.notFound.add(pms.repositoryName, "@"+dgst.String())
+	}
+	return exists, err
 }
 
 func (pms proxyManifestStore) Get(ctx context.Context, dgst digest.Digest, options ...distribution.ManifestServiceOption) (distribution.Manifest, error) {
@@ -45,12 +61,20 @@ func (pms proxyManifestStore) Get(ctx context.Context, dgst digest.Digest, optio
 	var fromRemote bool
 	manifest, err := pms.localManifests.Get(ctx, dgst, options...)
 	if err != nil {
+		if pms.notFound.contains(pms.repositoryName, "@"+dgst.String()) {
+			proxyMetrics.ManifestNotFoundHit()
+			return nil, distribution.ErrManifestUnknownRevision{Name: pms.repositoryName.Name(), Revision: dgst}
+		}
 		if err := pms.authChallenger.tryEstablishChallenges(ctx); err != nil {
 			return nil, err
 		}
 
 		manifest, err = pms.remoteManifests.Get(ctx, dgst, options...)
 		if err != nil {
+			if isRemoteNotFound(err) {
+				pms.notFound.add(pms.repositoryName, "@"+dgst.String())
+				return nil, distribution.ErrManifestUnknownRevision{Name: pms.repositoryName.Name(), Revision: dgst}
+			}
 			return nil, err
 		}
 		fromRemote = true
@@ -61,7 +85,29 @@ func (pms proxyManifestStore) Get(ctx context.Context, dgst digest.Digest, optio
 		return nil, err
 	}
 
+	// Manifests from the remote are verified before they are cached. The
+	// digest of schema1 manifests is the one of their unsigned content.
+	if fromRemote {
+		content := payload
+		if sm, ok := manifest.(*schema1.SignedManifest); ok {
+			content = sm.Canonical
+		}
+		if dgst.Algorithm().FromBytes(content) != dgst {
+			proxyMetrics.ManifestDigestMismatch()
+			dcontext.GetLogger(ctx).Errorf("Error fetching manifest %s of %s: %s", dgst, pms.repositoryName, errRemoteDigestMismatch)
+			return nil, fmt.Errorf("manifest %s: %w", dgst, errRemoteDigestMismatch)
+		}
+	}
+
 	proxyMetrics.ManifestPush(uint64(len(payload)))
+
+	// Schedule the manifest blob for removal, or record it was pulled again
+	repoBlob, err := reference.WithDigest(pms.repositoryName, dgst)
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("Error creating reference: %s", err)
+		return nil, err
+	}
+
 	if fromRemote {
 		proxyMetrics.ManifestPull(uint64(len(payload)))
 
@@ -70,27 +116,81 @@ func (pms proxyManifestStore) Get(ctx context.Context, dgst digest.Digest, optio
 			return nil, err
 		}
 
-		// Schedule the manifest blob for removal
-		repoBlob, err := reference.WithDigest(pms.repositoryName, dgst)
-		if err != nil {
-			dcontext.GetLogger(ctx).Errorf("Error creating reference: %s", err)
-			return nil, err
-		}
-
-		pms.scheduler.AddManifest(repoBlob, repositoryTTL)
+		pms.scheduler.AddManifest(repoBlob, repositoryTTL, int64(len(payload)))
 		// Ensure the manifest blob is cleaned up
 		//pms.scheduler.AddBlob(blobRef, repositoryTTL)
 
+	} else {
+		pms.scheduler.Access(repoBlob)
 	}
 
 	return manifest, err
 }
 
+// Put stores a pushed manifest locally and buffers it to be forwarded to the
+// remote, if push through is enabled.
 func (pms proxyManifestStore) Put(ctx context.Context, manifest distribution.Manifest, options ...distribution.ManifestServiceOption) (digest.Digest, error) {
 	var d digest.Digest
-	return d, distribution.ErrUnsupported
+	if pms.pushes == nil {
+		return d, distribution.ErrUnsupported
+	}
+
+	d, err := pms.localManifests.Put(ctx, manifest, options...)
+	if err != nil {
+		return d, err
+	}
+	pms.notFound.remove(pms.repositoryName, "@"+d.String())
+
+	entry := pushqueue.Entry{
+		Repository: pms.repositoryName.Name(),
+		Digest:     d,
+	}
+	for _, option := range options {
+		if opt, ok := option.(distribution.WithTagOption); ok {
+			entry.Tag = opt.Tag
+		}
+	}
+	return d, pms.pushes.Add(entry)
 }
 
 func (pms proxyManifestStore) Delete(ctx context.Context, dgst digest.Digest) error {
 	return distribution.ErrUnsupported
 }
+
+// Referrers lists the referrers of subject from the remote, caching the
+// referrer manifests locally so they can be verified against the proxy. The
+// locally cached referrers are returned if the remote cannot be reached.
+func (pms proxyManifestStore) Referrers(ctx context.Context, subject digest.Digest, artifactType string) ([]distribution.Descriptor, error) {
+	referrers, err := pms.remoteReferrers(ctx, subject, artifactType)
+	if err == nil {
+		for _, desc := range referrers {
+			// Get caches the referrer manifest, linking it to its subject
+			// in the local storage.
+			if _, err := pms.Get(ctx, desc.Digest); err != nil {
+				dcontext.GetLogger(ctx).Warnf("Error caching referrer %s of %s: %s", desc.Digest, subject, err)
+			}
+		}
+		return referrers, nil
+	}
+
+	localReferrers, ok := pms.localManifests.(distribution.ManifestReferrers)
+	if !ok {
+		return nil, err
+	}
+
+	dcontext.GetLogger(ctx).Warnf("Error listing remote referrers of %s, serving cached referrers: %s", subject, err)
+	return localReferrers.Referrers(ctx, subject, artifactType)
+}
+
+func (pms proxyManifestStore) remoteReferrers(ctx context.Context, subject digest.Digest, artifactType string) ([]distribution.Descriptor, error) {
+	remoteReferrers, ok := pms.remoteManifests.(distribution.ManifestReferrers)
+	if !ok {
+		return nil, distribution.ErrUnsupported
+	}
+
+	if err := pms.authChallenger.tryEstablishChallenges(ctx); err != nil {
+		return nil, err
+	}
+
+	return remoteReferrers.Referrers(ctx, subject, artifactType)
+}
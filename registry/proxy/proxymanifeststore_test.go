@@ -2,12 +2,15 @@ package proxy
 
 import (
 	"context"
+	"errors"
 	"io"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/manifest"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
 	"github.com/distribution/distribution/v3/manifest/schema1"
 	"github.com/distribution/distribution/v3/reference"
 	"github.com/distribution/distribution/v3/registry/client/auth"
@@ -19,6 +22,7 @@ import (
 	"github.com/distribution/distribution/v3/testutil"
 	"github.com/docker/libtrust"
 	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 type statsManifest struct {
@@ -61,6 +65,15 @@ func (sm statsManifest) Put(ctx context.Context, manifest distribution.Manifest,
 	return sm.manifests.Put(ctx, manifest)
 }
 
+func (sm statsManifest) Referrers(ctx context.Context, subject digest.Digest, artifactType string) ([]distribution.Descriptor, error) {
+	sm.stats["referrers"]++
+	referrers, ok := sm.manifests.(distribution.ManifestReferrers)
+	if !ok {
+		return nil, distribution.ErrUnsupported
+	}
+	return referrers.Referrers(ctx, subject, artifactType)
+}
+
 type mockChallenger struct {
 	sync.Mutex
 	count int
@@ -273,3 +286,174 @@ func TestProxyManifests(t *testing.T) {
 	}
 
 }
+
+// swappingManifests serves another manifest of the remote, as a corrupted
+// remote would.
+type swappingManifests struct {
+	distribution.ManifestService
+	served digest.Digest
+}
+
+func (sm swappingManifests) Get(ctx context.Context, dgst digest.Digest, options ...distribution.ManifestServiceOption) (distribution.Manifest, error) {
+	return sm.ManifestService.Get(ctx, sm.served, options...)
+}
+
+func TestProxyManifestsDigestMismatch(t *testing.T) {
+	env := newManifestStoreTestEnv(t, "foo/bar", "latest")
+	ctx := context.Background()
+
+	requested := digest.FromString("requested")
+	env.manifests.remoteManifests = swappingManifests{
+		ManifestService: env.manifests.remoteManifests,
+		served:          env.manifestDigest,
+	}
+	if _, err := env.manifests.Get(ctx, requested); !errors.Is(err, errRemoteDigestMismatch) {
+		t.Fatalf("expected a digest mismatch error, got %v", err)
+	}
+	if (*env.LocalStats())["put"] != 0 {
+		t.Error("expected the corrupted manifest not to be cached")
+	}
+}
+
+// unreachableManifests simulates a remote which cannot be reached.
+type unreachableManifests struct {
+	distribution.ManifestService
+}
+
+func (um unreachableManifests) Referrers(ctx context.Context, subject digest.Digest, artifactType string) ([]distribution.Descriptor, error) {
+	return nil, errors.New("remote unreachable")
+}
+
+func TestProxyManifestsReferrers(t *testing.T) {
+	name := "foo/referrers"
+	nameRef, err := reference.WithName(name)
+	if err != nil {
+		t.Fatalf("unable to parse reference: %s", err)
+	}
+
+	ctx := context.Background()
+	truthRegistry, err := storage.NewRegistry(ctx, inmemory.New())
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+	truthRepo, err := truthRegistry.Repository(ctx, nameRef)
+	if err != nil {
+		t.Fatalf("unexpected error getting repo: %v", err)
+	}
+	tr, err := truthRepo.Manifests(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subject, err := ocischema.NewManifestBuilder(truthRepo.Blobs(ctx), []byte("{}"), map[string]string{}).Build(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error generating manifest: %v", err)
+	}
+	subjectDigest, err := tr.Put(ctx, subject)
+	if err != nil {
+		t.Fatalf("unexpected error putting manifest: %v", err)
+	}
+
+	referrer, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned:    ocischema.SchemaVersion,
+		ArtifactType: "application/vnd.example.signature",
+		Config:       subject.(*ocischema.DeserializedManifest).Config,
+		Layers:       []distribution.Descriptor{},
+		Subject: &distribution.Descriptor{
+			MediaType: v1.MediaTypeImageManifest,
+			Digest:    subjectDigest,
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error generating referrer: %v", err)
+	}
+	referrerDigest, err := tr.Put(ctx, referrer)
+	if err != nil {
+		t.Fatalf("unexpected error putting referrer: %v", err)
+	}
+
+	localRegistry, err := storage.NewRegistry(ctx, inmemory.New())
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+	localRepo, err := localRegistry.Repository(ctx, nameRef)
+	if err != nil {
+		t.Fatalf("unexpected error getting repo: %v", err)
+	}
+	lr, err := localRepo.Manifests(ctx, storage.SkipLayerVerification())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	localManifests := statsManifest{manifests: lr, stats: make(map[string]int)}
+	remoteManifests := statsManifest{manifests: tr, stats: make(map[string]int)}
+	pms := proxyManifestStore{
+		ctx:             ctx,
+		localManifests:  localManifests,
+		remoteManifests: remoteManifests,
+		scheduler:       scheduler.New(ctx, inmemory.New(), "/scheduler-state.json"),
+		repositoryName:  nameRef,
+		authChallenger:  &mockChallenger{},
+	}
+
+	referrers, err := pms.Referrers(ctx, subjectDigest, "")
+	if err != nil {
+		t.Fatalf("unexpected error listing referrers: %v", err)
+	}
+	if len(referrers) != 1 || referrers[0].Digest != referrerDigest {
+		t.Fatalf("unexpected referrers %v", referrers)
+	}
+	if remoteManifests.stats["referrers"] != 1 {
+		t.Fatalf("expected referrers to be listed from the remote")
+	}
+	if localManifests.stats["put"] != 1 {
+		t.Fatalf("expected referrer manifest to be cached")
+	}
+
+	// The cached referrers are served when the remote is unreachable.
+	pms.remoteManifests = unreachableManifests{ManifestService: tr}
+	referrers, err = pms.Referrers(ctx, subjectDigest, "")
+	if err != nil {
+		t.Fatalf("unexpected error listing cached referrers: %v", err)
+	}
+	if len(referrers) != 1 || referrers[0].Digest != referrerDigest {
+		t.Fatalf("unexpected cached referrers %v", referrers)
+	}
+	if localManifests.stats["referrers"] != 1 {
+		t.Fatalf("expected referrers to be listed from the local storage")
+	}
+}
+
+func TestProxyManifestsNegativeCache(t *testing.T) {
+	env := newManifestStoreTestEnv(t, "foo/bar", "latest")
+	env.manifests.notFound = newNegativeCache(time.Hour)
+	remoteStats := env.RemoteStats()
+	ctx := context.Background()
+
+	missing := digest.FromString("missing")
+	for i := 0; i < 2; i++ {
+		_, err := env.manifests.Get(ctx, missing)
+		if _, ok := err.(distribution.ErrManifestUnknownRevision); !ok {
+			t.Fatalf("expected an unknown manifest error, got %v", err)
+		}
+	}
+	if (*remoteStats)["get"] != 1 {
+		t.Fatalf("expected the remote to be requested once, got %d", (*remoteStats)["get"])
+	}
+
+	exists, err := env.manifests.Exists(ctx, missing)
+	if err != nil || exists {
+		t.Fatalf("unexpected existence of an unknown manifest: %t, %v", exists, err)
+	}
+	if (*remoteStats)["exists"] != 0 {
+		t.Fatalf("expected the remote not to be requested, got %d", (*remoteStats)["exists"])
+	}
+
+	// the manifests found are not cached
+	if _, err := env.manifests.Get(ctx, env.manifestDigest); err != nil {
+		t.Fatal(err)
+	}
+	if (*remoteStats)["get"] != 2 {
+		t.Fatalf("expected the remote to be requested, got %d", (*remoteStats)["get"])
+	}
+}
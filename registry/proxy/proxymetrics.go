@@ -3,8 +3,15 @@ package proxy
 import (
 	"expvar"
 	"sync/atomic"
+
+	prometheus "github.com/distribution/distribution/v3/metrics"
+	"github.com/docker/go-metrics"
 )
 
+// digestMismatchCounter counts the content fetched from the remotes which
+// does not match its digest, by type of content
+var digestMismatchCounter = prometheus.ProxyNamespace.NewLabeledCounter("digest_mismatches", "The number of remote contents not matching their digest", "type")
+
 // Metrics is used to hold metric counters
 // related to the proxy
 type Metrics struct {
@@ -13,6 +20,12 @@ type Metrics struct {
 	Misses      uint64
 	BytesPulled uint64
 	BytesPushed uint64
+	// DigestMismatches counts the contents fetched from the remote which
+	// did not match their digest, and were neither cached nor served.
+	DigestMismatches uint64
+	// NotFoundHits counts the lookups of content the remote did not find
+	// recently, answered without requesting it again.
+	NotFoundHits uint64
 }
 
 type proxyMetricsCollector struct {
@@ -46,6 +59,26 @@ func (pmc *proxyMetricsCollector) ManifestPush(bytesPushed uint64) {
 	atomic.AddUint64(&pmc.manifestMetrics.BytesPushed, bytesPushed)
 }
 
+// BlobDigestMismatch tracks blobs fetched from the remote not matching their
+// digest
+func (pmc *proxyMetricsCollector) BlobDigestMismatch() {
+	atomic.AddUint64(&pmc.blobMetrics.DigestMismatches, 1)
+	digestMismatchCounter.WithValues("blob").Inc(1)
+}
+
+// ManifestDigestMismatch tracks manifests fetched from the remote not matching
+// their digest
+func (pmc *proxyMetricsCollector) ManifestDigestMismatch() {
+	atomic.AddUint64(&pmc.manifestMetrics.DigestMismatches, 1)
+	digestMismatchCounter.WithValues("manifest").Inc(1)
+}
+
+// ManifestNotFoundHit tracks lookups of manifests and tags answered by the
+// negative cache
+func (pmc *proxyMetricsCollector) ManifestNotFoundHit() {
+	atomic.AddUint64(&pmc.manifestMetrics.NotFoundHits, 1)
+}
+
 // proxyMetrics tracks metrics about the proxy cache.  This is
 // kept globally and made available via expvar.
 var proxyMetrics = &proxyMetricsCollector{}
@@ -71,4 +104,5 @@ func init() {
 		return proxyMetrics.manifestMetrics
 	}))
 
+	metrics.Register(prometheus.ProxyNamespace)
 }
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
 	"sync"
 
 	"github.com/distribution/distribution/v3"
@@ -16,25 +17,92 @@ import (
 	"github.com/distribution/distribution/v3/registry/client/auth/challenge"
 	"github.com/distribution/distribution/v3/registry/client/transport"
 	"github.com/distribution/distribution/v3/registry/proxy/scheduler"
+	"github.com/distribution/distribution/v3/registry/pushqueue"
 	"github.com/distribution/distribution/v3/registry/storage"
 	"github.com/distribution/distribution/v3/registry/storage/driver"
 )
 
 // proxyingRegistry fetches content from a remote registry and caches it locally
 type proxyingRegistry struct {
-	embedded       distribution.Namespace // provides local registry functionality
-	scheduler      *scheduler.TTLExpirationScheduler
+	embedded  distribution.Namespace // provides local registry functionality
+	scheduler *scheduler.TTLExpirationScheduler
+	remotes   []*proxyRemote   // in the order the repositories are routed
+	pushes    *pushqueue.Queue // buffers the pushes forwarded to the remote, nil unless push through is enabled
+	notFound  *negativeCache   // the manifests and tags the remotes did not find recently, nil if disabled
+}
+
+// proxyRemote is a remote registry the cache pulls content from.
+type proxyRemote struct {
+	// prefix is the prefix of the names of the repositories routed to the
+	// remote, which is removed from their name on the remote. All the
+	// repositories are routed to a remote without prefix.
+	prefix         string
 	remoteURL      url.URL
 	authChallenger authChallenger
+	transport      http.RoundTripper
 }
 
-// NewRegistryPullThroughCache creates a registry acting as a pull through cache
-func NewRegistryPullThroughCache(ctx context.Context, registry distribution.Namespace, driver driver.StorageDriver, config configuration.Proxy) (distribution.Namespace, error) {
-	remoteURL, err := url.Parse(config.RemoteURL)
+// newProxyRemote sets up a remote registry, with the credentials
+// authenticating with it and the transport of the connections to it.
+func newProxyRemote(prefix, rawURL, username, password string, transport http.RoundTripper) (*proxyRemote, error) {
+	remoteURL, err := url.Parse(rawURL)
 	if err != nil {
 		return nil, err
 	}
 
+	cs, err := configureAuth(username, password, rawURL, transport)
+	if err != nil {
+		return nil, err
+	}
+
+	return &proxyRemote{
+		prefix:    prefix,
+		remoteURL: *remoteURL,
+		authChallenger: &remoteAuthChallenger{
+			remoteURL: *remoteURL,
+			cm:        challenge.NewSimpleManager(),
+			cs:        cs,
+			transport: transport,
+		},
+		transport: transport,
+	}, nil
+}
+
+// NewRegistryPullThroughCache creates a registry acting as a pull through cache,
+// which also forwards the pushes to the remote if push through is enabled. The
+// connections to the remotes use transport, or the default one if nil.
+func NewRegistryPullThroughCache(ctx context.Context, registry distribution.Namespace, driver driver.StorageDriver, config configuration.Proxy, transport http.RoundTripper) (distribution.Namespace, error) {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	var remotes []*proxyRemote
+	prefixes := make(map[string]struct{}, len(config.Remotes))
+	for _, rc := range config.Remotes {
+		if _, err := reference.WithName(rc.Prefix); err != nil {
+			return nil, fmt.Errorf("invalid proxy remote prefix %q: %v", rc.Prefix, err)
+		}
+		if _, ok := prefixes[rc.Prefix]; ok {
+			return nil, fmt.Errorf("duplicate proxy remote prefix %q", rc.Prefix)
+		}
+		prefixes[rc.Prefix] = struct{}{}
+		if rc.RemoteURL == "" {
+			return nil, fmt.Errorf("proxy remote %q has no remoteurl", rc.Prefix)
+		}
+
+		remote, err := newProxyRemote(rc.Prefix, rc.RemoteURL, rc.Username, rc.Password, transport)
+		if err != nil {
+			return nil, err
+		}
+		remotes = append(remotes, remote)
+	}
+	if config.RemoteURL != "" {
+		remote, err := newProxyRemote("", config.RemoteURL, config.Username, config.Password, transport)
+		if err != nil {
+			return nil, err
+		}
+		remotes = append(remotes, remote)
+	}
+
 	v := storage.NewVacuum(ctx, driver)
 	s := scheduler.New(ctx, driver, "/scheduler-state.json")
 	s.OnBlobExpire(func(ref reference.Reference) error {
@@ -88,26 +156,28 @@ func NewRegistryPullThroughCache(ctx context.Context, registry distribution.Name
 		return nil
 	})
 
-	err = s.Start()
+	s.SetMaxSize(config.MaxSize)
+	err := s.Start()
 	if err != nil {
 		return nil, err
 	}
 
-	cs, err := configureAuth(config.Username, config.Password, config.RemoteURL)
-	if err != nil {
-		return nil, err
-	}
-
-	return &proxyingRegistry{
+	pr := &proxyingRegistry{
 		embedded:  registry,
 		scheduler: s,
-		remoteURL: *remoteURL,
-		authChallenger: &remoteAuthChallenger{
-			remoteURL: *remoteURL,
-			cm:        challenge.NewSimpleManager(),
-			cs:        cs,
-		},
-	}, nil
+		remotes:   remotes,
+		notFound:  newNegativeCache(config.NegativeCacheTTL),
+	}
+
+	if config.PushThrough.Enabled {
+		pr.pushes = pushqueue.New(ctx, driver, "/push-queue", config.PushThrough.RetryInterval, pr.forwardPush)
+		if err := pr.pushes.Start(); err != nil {
+			return nil, err
+		}
+		dcontext.GetLogger(ctx).Infof("Starting push forwarder with %d buffered pushes...", pr.pushes.Len())
+	}
+
+	return pr, nil
 }
 
 func (pr *proxyingRegistry) Scope() distribution.Scope {
@@ -119,34 +189,22 @@ func (pr *proxyingRegistry) Repositories(ctx context.Context, repos []string, la
 }
 
 func (pr *proxyingRegistry) Repository(ctx context.Context, name reference.Named) (distribution.Repository, error) {
-	c := pr.authChallenger
-
-	tkopts := auth.TokenHandlerOptions{
-		Transport:   http.DefaultTransport,
-		Credentials: c.credentialStore(),
-		Scopes: []auth.Scope{
-			auth.RepositoryScope{
-				Repository: name.Name(),
-				Actions:    []string{"pull"},
-			},
-		},
-		Logger: dcontext.GetLogger(ctx),
-	}
-
-	tr := transport.NewTransport(http.DefaultTransport,
-		auth.NewAuthorizer(c.challengeManager(),
-			auth.NewTokenHandlerWithOptions(tkopts)))
-
 	localRepo, err := pr.embedded.Repository(ctx, name)
 	if err != nil {
 		return nil, err
 	}
+	// pushed manifests may reference blobs which only the remote has
 	localManifests, err := localRepo.Manifests(ctx, storage.SkipLayerVerification())
 	if err != nil {
 		return nil, err
 	}
 
-	remoteRepo, err := client.NewRepository(name, pr.remoteURL.String(), tr)
+	remote, remoteName, err := pr.route(name)
+	if err != nil {
+		return nil, err
+	}
+
+	remoteRepo, err := remote.repository(ctx, remoteName, "pull")
 	if err != nil {
 		return nil, err
 	}
@@ -160,9 +218,11 @@ func (pr *proxyingRegistry) Repository(ctx context.Context, name reference.Named
 		blobStore: &proxyBlobStore{
 			localStore:     localRepo.Blobs(ctx),
 			remoteStore:    remoteRepo.Blobs(ctx),
+			blobStatter:    pr.embedded.BlobStatter(),
 			scheduler:      pr.scheduler,
 			repositoryName: name,
-			authChallenger: pr.authChallenger,
+			authChallenger: remote.authChallenger,
+			pushThrough:    pr.pushes != nil,
 		},
 		manifests: &proxyManifestStore{
 			repositoryName:  name,
@@ -170,17 +230,121 @@ func (pr *proxyingRegistry) Repository(ctx context.Context, name reference.Named
 			remoteManifests: remoteManifests,
 			ctx:             ctx,
 			scheduler:       pr.scheduler,
-			authChallenger:  pr.authChallenger,
+			authChallenger:  remote.authChallenger,
+			pushes:          pr.pushes,
+			notFound:        pr.notFound,
 		},
 		name: name,
 		tags: &proxyTagService{
 			localTags:      localRepo.Tags(ctx),
 			remoteTags:     remoteRepo.Tags(ctx),
-			authChallenger: pr.authChallenger,
+			authChallenger: remote.authChallenger,
+			repositoryName: name,
+			pushes:         pr.pushes,
+			notFound:       pr.notFound,
 		},
 	}, nil
 }
 
+// route returns the remote the repository is routed to, along with the name
+// of the repository on the remote.
+func (pr *proxyingRegistry) route(name reference.Named) (*proxyRemote, reference.Named, error) {
+	for _, remote := range pr.remotes {
+		if remote.prefix == "" {
+			return remote, name, nil
+		}
+		if strings.HasPrefix(name.Name(), remote.prefix+"/") {
+			remoteName, err := reference.WithName(strings.TrimPrefix(name.Name(), remote.prefix+"/"))
+			if err != nil {
+				return nil, nil, err
+			}
+			return remote, remoteName, nil
+		}
+	}
+	return nil, nil, distribution.ErrRepositoryUnknown{Name: name.Name()}
+}
+
+// ReloadCredentials returns a function replacing the credentials the pull
+// through cache authenticates with its remotes by those of config, so that
+// they can be applied along with the rest of a configuration. The remotes
+// themselves can not change while the cache is running: a remote of config
+// the cache was not created with is an error.
+func ReloadCredentials(registry distribution.Namespace, config configuration.Proxy) (func(), error) {
+	pr, ok := registry.(*proxyingRegistry)
+	if !ok {
+		return nil, ErrNotPullThroughCache
+	}
+
+	remotes := make(map[string]userpass, len(config.Remotes)+1)
+	for _, rc := range config.Remotes {
+		remotes[rc.Prefix] = userpass{username: rc.Username, password: rc.Password}
+	}
+	if config.RemoteURL != "" {
+		remotes[""] = userpass{username: config.Username, password: config.Password}
+	}
+
+	known := make(map[string]*credentials, len(pr.remotes))
+	for _, remote := range pr.remotes {
+		creds, ok := remote.authChallenger.credentialStore().(*credentials)
+		if !ok {
+			return nil, fmt.Errorf("unexpected credential store type: %T", remote.authChallenger.credentialStore())
+		}
+		known[remote.prefix] = creds
+	}
+	for prefix := range remotes {
+		if _, ok := known[prefix]; !ok {
+			return nil, fmt.Errorf("proxy remote %q can not be added while the registry is running", prefix)
+		}
+	}
+
+	return func() {
+		for prefix, creds := range known {
+			up := remotes[prefix]
+			creds.set(up.username, up.password)
+		}
+	}, nil
+}
+
+// repository returns the repository of the remote, authorized for the given
+// actions.
+func (remote *proxyRemote) repository(ctx context.Context, name reference.Named, actions ...string) (distribution.Repository, error) {
+	c := remote.authChallenger
+
+	tkopts := auth.TokenHandlerOptions{
+		Transport:   remote.transport,
+		Credentials: c.credentialStore(),
+		Scopes: []auth.Scope{
+			auth.RepositoryScope{
+				Repository: name.Name(),
+				Actions:    actions,
+			},
+		},
+		Logger: dcontext.GetLogger(ctx),
+	}
+
+	tr := transport.NewTransport(remote.transport,
+		auth.NewAuthorizer(c.challengeManager(),
+			auth.NewTokenHandlerWithOptions(tkopts)))
+
+	return client.NewRepository(name, remote.remoteURL.String(), tr)
+}
+
+func (pr *proxyingRegistry) ListRepositories(ctx context.Context, prefix, last string, n int) ([]string, error) {
+	catalog, ok := pr.embedded.(distribution.RepositoryCatalog)
+	if !ok {
+		return nil, distribution.ErrUnsupported
+	}
+	return catalog.ListRepositories(ctx, prefix, last, n)
+}
+
+func (pr *proxyingRegistry) CountRepositories(ctx context.Context, prefix string) (int, error) {
+	catalog, ok := pr.embedded.(distribution.RepositoryCatalog)
+	if !ok {
+		return 0, distribution.ErrUnsupported
+	}
+	return catalog.CountRepositories(ctx, prefix)
+}
+
 func (pr *proxyingRegistry) Blobs() distribution.BlobEnumerator {
 	return pr.embedded.Blobs()
 }
@@ -199,8 +363,9 @@ type authChallenger interface {
 type remoteAuthChallenger struct {
 	remoteURL url.URL
 	sync.Mutex
-	cm challenge.Manager
-	cs auth.CredentialStore
+	cm        challenge.Manager
+	cs        auth.CredentialStore
+	transport http.RoundTripper
 }
 
 func (r *remoteAuthChallenger) credentialStore() auth.CredentialStore {
@@ -228,7 +393,7 @@ func (r *remoteAuthChallenger) tryEstablishChallenges(ctx context.Context) error
 	}
 
 	// establish challenge type with upstream
-	if err := ping(r.cm, remoteURL.String(), challengeHeader); err != nil {
+	if err := ping(r.cm, remoteURL.String(), challengeHeader, r.transport); err != nil {
 		return err
 	}
 
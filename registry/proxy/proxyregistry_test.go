@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+)
+
+// newTagsRemote returns a remote registry listing the given tag in all its
+// repositories, and recording the repositories it was asked for.
+func newTagsRemote(t *testing.T, tag string, repositories *[]string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			return
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v2/"), "/tags/list")
+		*repositories = append(*repositories, name)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"name": name, "tags": []string{tag}})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestProxyRemotes(t *testing.T) {
+	ctx := context.Background()
+
+	var hubRepositories, quayRepositories []string
+	hub := newTagsRemote(t, "hub", &hubRepositories)
+	quay := newTagsRemote(t, "quay", &quayRepositories)
+
+	driver := inmemory.New()
+	local, err := storage.NewRegistry(ctx, driver)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := configuration.Proxy{
+		Remotes: []configuration.ProxyRemote{
+			{Prefix: "docker.io", RemoteURL: hub.URL},
+			{Prefix: "quay.io", RemoteURL: quay.URL},
+		},
+	}
+	registry, err := NewRegistryPullThroughCache(ctx, local, driver, config, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating the cache: %v", err)
+	}
+
+	tags := func(name string) ([]string, error) {
+		named, err := reference.WithName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		repo, err := registry.Repository(ctx, named)
+		if err != nil {
+			return nil, err
+		}
+		return repo.Tags(ctx).All(ctx)
+	}
+
+	for name, expected := range map[string]string{
+		"docker.io/library/nginx": "hub",
+		"quay.io/coreos/etcd":     "quay",
+	} {
+		all, err := tags(name)
+		if err != nil {
+			t.Fatalf("%s: unexpected error listing tags: %v", name, err)
+		}
+		if !reflect.DeepEqual(all, []string{expected}) {
+			t.Errorf("%s: expected the tags of the %s remote, got %v", name, expected, all)
+		}
+	}
+	if !reflect.DeepEqual(hubRepositories, []string{"library/nginx"}) || !reflect.DeepEqual(quayRepositories, []string{"coreos/etcd"}) {
+		t.Fatalf("unexpected repositories requested from the remotes: %v %v", hubRepositories, quayRepositories)
+	}
+
+	if _, err := tags("gcr.io/distroless/static"); err == nil {
+		t.Fatal("expected an error for a repository routed to no remote")
+	} else if _, ok := err.(distribution.ErrRepositoryUnknown); !ok {
+		t.Fatalf("unexpected error for a repository routed to no remote: %v", err)
+	}
+
+	// the remote url serves the other repositories, under their own name
+	config.RemoteURL = hub.URL
+	registry, err = NewRegistryPullThroughCache(ctx, local, driver, config, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating the cache: %v", err)
+	}
+	if all, err := tags("gcr.io/distroless/static"); err != nil || !reflect.DeepEqual(all, []string{"hub"}) {
+		t.Fatalf("unexpected tags %v: %v", all, err)
+	}
+	if hubRepositories[len(hubRepositories)-1] != "gcr.io/distroless/static" {
+		t.Fatalf("unexpected repositories requested from the remote: %v", hubRepositories)
+	}
+}
+
+func TestInvalidProxyRemotes(t *testing.T) {
+	ctx := context.Background()
+	driver := inmemory.New()
+	local, err := storage.NewRegistry(ctx, driver)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var repositories []string
+	remote := newTagsRemote(t, "latest", &repositories)
+
+	for _, remotes := range [][]configuration.ProxyRemote{
+		{{Prefix: "", RemoteURL: remote.URL}},
+		{{Prefix: "docker.io/", RemoteURL: remote.URL}},
+		{{Prefix: "docker.io"}},
+		{{Prefix: "docker.io", RemoteURL: remote.URL}, {Prefix: "docker.io", RemoteURL: remote.URL}},
+	} {
+		if _, err := NewRegistryPullThroughCache(ctx, local, driver, configuration.Proxy{Remotes: remotes}, nil); err == nil {
+			t.Errorf("expected an error for remotes %+v", remotes)
+		}
+	}
+}
+
+func TestReloadCredentials(t *testing.T) {
+	ctx := context.Background()
+
+	var remote *httptest.Server
+	remote = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="`+remote.URL+`/token",service="registry"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	t.Cleanup(remote.Close)
+
+	driver := inmemory.New()
+	local, err := storage.NewRegistry(ctx, driver)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := configuration.Proxy{RemoteURL: remote.URL, Username: "old", Password: "old-secret"}
+	registry, err := NewRegistryPullThroughCache(ctx, local, driver, config, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating the cache: %v", err)
+	}
+
+	tokenURL, err := url.Parse(remote.URL + "/token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := registry.(*proxyingRegistry).remotes[0].authChallenger.credentialStore()
+	if username, password := cs.Basic(tokenURL); username != "old" || password != "old-secret" {
+		t.Fatalf("unexpected credentials %q %q", username, password)
+	}
+
+	config.Username, config.Password = "new", "new-secret"
+	apply, err := ReloadCredentials(registry, config)
+	if err != nil {
+		t.Fatalf("unexpected error reloading the credentials: %v", err)
+	}
+	// the credentials are only replaced once applied
+	if username, _ := cs.Basic(tokenURL); username != "old" {
+		t.Fatalf("credentials replaced before being applied: %q", username)
+	}
+	apply()
+	if username, password := cs.Basic(tokenURL); username != "new" || password != "new-secret" {
+		t.Fatalf("unexpected credentials after reload %q %q", username, password)
+	}
+
+	config.Remotes = []configuration.ProxyRemote{{Prefix: "docker.io", RemoteURL: remote.URL}}
+	if _, err := ReloadCredentials(registry, config); err == nil {
+		t.Fatal("expected an error reloading the credentials of a new remote")
+	}
+	if _, err := ReloadCredentials(local, config); err != ErrNotPullThroughCache {
+		t.Fatalf("unexpected error reloading the credentials of a registry which is not a cache: %v", err)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 
 	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/pushqueue"
 )
 
 // proxyTagService supports local and remote lookup of tags.
@@ -11,16 +13,26 @@ type proxyTagService struct {
 	localTags      distribution.TagService
 	remoteTags     distribution.TagService
 	authChallenger authChallenger
+	repositoryName reference.Named
+	pushes         *pushqueue.Queue
+	notFound       *negativeCache // the tags the remote did not find recently
 }
 
 var _ distribution.TagService = proxyTagService{}
 
 // Get attempts to get the most recent digest for the tag by checking the remote
 // tag service first and then caching it locally.  If the remote is unavailable
-// the local association is returned
+// the local association is returned, as is the association of a tag pushed
+// to the cache which has not been forwarded to the remote yet. The remote is
+// not requested for the tags it did not find recently.
 func (pt proxyTagService) Get(ctx context.Context, tag string) (distribution.Descriptor, error) {
-	err := pt.authChallenger.tryEstablishChallenges(ctx)
-	if err == nil {
+	if pt.pushes != nil && pt.pushes.PendingTag(pt.repositoryName.Name(), tag) {
+		return pt.localTags.Get(ctx, tag)
+	}
+
+	if pt.notFound.contains(pt.repositoryName, ":"+tag) {
+		proxyMetrics.ManifestNotFoundHit()
+	} else if err := pt.authChallenger.tryEstablishChallenges(ctx); err == nil {
 		desc, err := pt.remoteTags.Get(ctx, tag)
 		if err == nil {
 			err := pt.localTags.Tag(ctx, tag, desc)
@@ -29,6 +41,9 @@ func (pt proxyTagService) Get(ctx context.Context, tag string) (distribution.Des
 			}
 			return desc, nil
 		}
+		if isRemoteNotFound(err) {
+			pt.notFound.add(pt.repositoryName, ":"+tag)
+		}
 	}
 
 	desc, err := pt.localTags.Get(ctx, tag)
@@ -38,8 +53,14 @@ func (pt proxyTagService) Get(ctx context.Context, tag string) (distribution.Des
 	return desc, nil
 }
 
+// Tag tags a manifest pushed to the cache locally, the tag being forwarded to
+// the remote along with the manifest.
 func (pt proxyTagService) Tag(ctx context.Context, tag string, desc distribution.Descriptor) error {
-	return distribution.ErrUnsupported
+	if pt.pushes == nil {
+		return distribution.ErrUnsupported
+	}
+	pt.notFound.remove(pt.repositoryName, ":"+tag)
+	return pt.localTags.Tag(ctx, tag, desc)
 }
 
 func (pt proxyTagService) Untag(ctx context.Context, tag string) error {
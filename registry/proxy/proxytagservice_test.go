@@ -6,8 +6,10 @@ import (
 	"sort"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/reference"
 )
 
 type mockTagStore struct {
@@ -180,3 +182,50 @@ func TestGet(t *testing.T) {
 		t.Fatalf("Expected 4 auth challenge calls, got %#v", proxyTags.authChallenger)
 	}
 }
+
+// countingTagStore counts the lookups of the tags.
+type countingTagStore struct {
+	distribution.TagService
+	gets int
+}
+
+func (c *countingTagStore) Get(ctx context.Context, tag string) (distribution.Descriptor, error) {
+	c.gets++
+	return c.TagService.Get(ctx, tag)
+}
+
+func TestGetNegativeCache(t *testing.T) {
+	proxyTags := testProxyTagService(nil, nil)
+	remote := &countingTagStore{TagService: proxyTags.remoteTags}
+	proxyTags.remoteTags = remote
+	proxyTags.repositoryName, _ = reference.WithName("foo/bar")
+	proxyTags.notFound = newNegativeCache(time.Hour)
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if _, err := proxyTags.Get(ctx, "missing"); err == nil {
+			t.Fatal("expected an error getting an unknown tag")
+		}
+	}
+	if remote.gets != 1 {
+		t.Fatalf("expected the remote to be requested once, got %d", remote.gets)
+	}
+
+	// the tag is found once its entry expires
+	proxyTags.notFound = newNegativeCache(time.Nanosecond)
+	if _, err := proxyTags.Get(ctx, "missing"); err == nil {
+		t.Fatal("expected an error getting an unknown tag")
+	}
+	desc := distribution.Descriptor{Size: 42}
+	if err := remote.Tag(ctx, "missing", desc); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	d, err := proxyTags.Get(ctx, "missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(d, desc) {
+		t.Fatalf("unexpected descriptor %v", d)
+	}
+}
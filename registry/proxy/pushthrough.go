@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"context"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/pushqueue"
+)
+
+// forwardPush forwards a manifest pushed to the cache to the remote, along
+// with the blobs it references. Once forwarded, the pushed content expires
+// like the content pulled through the cache.
+func (pr *proxyingRegistry) forwardPush(ctx context.Context, entry pushqueue.Entry) error {
+	name, err := reference.WithName(entry.Repository)
+	if err != nil {
+		return err
+	}
+
+	localRepo, err := pr.embedded.Repository(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	remote, remoteName, err := pr.route(name)
+	if err != nil {
+		if _, ok := err.(distribution.ErrRepositoryUnknown); ok {
+			// the repository is no longer routed to any remote
+			dcontext.GetLogger(ctx).Errorf("Dropping push of %s@%s: %s", entry.Repository, entry.Digest, err)
+			return nil
+		}
+		return err
+	}
+
+	if err := remote.authChallenger.tryEstablishChallenges(ctx); err != nil {
+		return err
+	}
+
+	remoteRepo, err := remote.repository(ctx, remoteName, "pull", "push")
+	if err != nil {
+		return err
+	}
+
+	size, blobs, err := pushqueue.ForwardManifest(ctx, localRepo, remoteRepo, entry.Digest, entry.Tag)
+	if err != nil {
+		if _, ok := err.(distribution.ErrManifestUnknownRevision); ok || err == distribution.ErrBlobUnknown {
+			// retrying would not help, the content is missing from the cache
+			dcontext.GetLogger(ctx).Errorf("Dropping push of %s@%s: %s", entry.Repository, entry.Digest, err)
+			return nil
+		}
+		return err
+	}
+
+	dcontext.GetLogger(ctx).Infof("Forwarded push of %s@%s", entry.Repository, entry.Digest)
+
+	manifestRef, err := reference.WithDigest(name, entry.Digest)
+	if err != nil {
+		return err
+	}
+	pr.scheduler.AddManifest(manifestRef, repositoryTTL, size)
+	for _, desc := range blobs {
+		blobRef, err := reference.WithDigest(name, desc.Digest)
+		if err != nil {
+			return err
+		}
+		pr.scheduler.AddBlob(blobRef, repositoryTTL, desc.Size)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/pushqueue"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestForwardManifest(t *testing.T) {
+	ctx := context.Background()
+	nameRef, err := reference.WithName("foo/push")
+	if err != nil {
+		t.Fatalf("unable to parse reference: %s", err)
+	}
+
+	localRegistry, err := storage.NewRegistry(ctx, inmemory.New())
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+	localRepo, err := localRegistry.Repository(ctx, nameRef)
+	if err != nil {
+		t.Fatalf("unexpected error getting repo: %v", err)
+	}
+	remoteRegistry, err := storage.NewRegistry(ctx, inmemory.New())
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+	remoteRepo, err := remoteRegistry.Repository(ctx, nameRef)
+	if err != nil {
+		t.Fatalf("unexpected error getting repo: %v", err)
+	}
+
+	// the base layer is already known to the remote
+	base, err := remoteRepo.Blobs(ctx).Put(ctx, v1.MediaTypeImageLayer, []byte("base layer"))
+	if err != nil {
+		t.Fatalf("unexpected error putting blob: %v", err)
+	}
+	layer, err := localRepo.Blobs(ctx).Put(ctx, v1.MediaTypeImageLayer, []byte("pushed layer"))
+	if err != nil {
+		t.Fatalf("unexpected error putting blob: %v", err)
+	}
+
+	builder := ocischema.NewManifestBuilder(localRepo.Blobs(ctx), []byte("{}"), map[string]string{})
+	for _, desc := range []distribution.Descriptor{base, layer} {
+		if err := builder.AppendReference(desc); err != nil {
+			t.Fatalf("unexpected error building manifest: %v", err)
+		}
+	}
+	m, err := builder.Build(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error building manifest: %v", err)
+	}
+
+	lr, err := localRepo.Manifests(ctx, storage.SkipLayerVerification())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pq := pushqueue.New(ctx, inmemory.New(), "/push-queue", time.Hour, nil)
+	pms := proxyManifestStore{
+		ctx:            ctx,
+		localManifests: lr,
+		repositoryName: nameRef,
+		authChallenger: &mockChallenger{},
+		pushes:         pq,
+	}
+	dgst, err := pms.Put(ctx, m, distribution.WithTag("latest"))
+	if err != nil {
+		t.Fatalf("unexpected error pushing manifest: %v", err)
+	}
+	if !pq.PendingTag("foo/push", "latest") || pq.Len() != 1 {
+		t.Fatalf("expected the push to be buffered: %d", pq.Len())
+	}
+
+	size, blobs, err := pushqueue.ForwardManifest(ctx, localRepo, remoteRepo, dgst, "latest")
+	if err != nil {
+		t.Fatalf("unexpected error forwarding manifest: %v", err)
+	}
+	if _, payload, _ := m.Payload(); size != int64(len(payload)) {
+		t.Fatalf("unexpected manifest size %d, expected %d", size, len(payload))
+	}
+	if len(blobs) != 3 {
+		t.Fatalf("expected the config and layers to be forwarded: %v", blobs)
+	}
+	for _, desc := range blobs {
+		if _, err := remoteRepo.Blobs(ctx).Stat(ctx, desc.Digest); err != nil {
+			t.Errorf("blob %s not forwarded: %v", desc.Digest, err)
+		}
+	}
+
+	rm, err := remoteRepo.Manifests(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := rm.Exists(ctx, dgst); err != nil || !exists {
+		t.Fatalf("manifest not forwarded: %v", err)
+	}
+
+	// a manifest missing from the cache cannot be forwarded
+	_, _, err = pushqueue.ForwardManifest(ctx, localRepo, remoteRepo, digest.FromString("missing"), "")
+	if _, ok := err.(distribution.ErrManifestUnknownRevision); !ok {
+		t.Fatalf("unexpected error forwarding a missing manifest: %v", err)
+	}
+}
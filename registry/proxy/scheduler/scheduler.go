@@ -1,9 +1,11 @@
 package scheduler
 
 import (
+	"container/list"
 	"context"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
@@ -24,17 +26,21 @@ const (
 // schedulerEntry represents an entry in the scheduler
 // fields are exported for serialization
 type schedulerEntry struct {
-	Key       string    `json:"Key"`
-	Expiry    time.Time `json:"ExpiryData"`
-	EntryType int       `json:"EntryType"`
-
-	timer *time.Timer
+	Key        string    `json:"Key"`
+	Expiry     time.Time `json:"ExpiryData"`
+	EntryType  int       `json:"EntryType"`
+	Size       int64     `json:"Size,omitempty"`
+	LastAccess time.Time `json:"LastAccess,omitempty"`
+
+	timer   *time.Timer
+	element *list.Element // position of the entry in the lru list
 }
 
 // New returns a new instance of the scheduler
 func New(ctx context.Context, driver driver.StorageDriver, path string) *TTLExpirationScheduler {
 	return &TTLExpirationScheduler{
 		entries:         make(map[string]*schedulerEntry),
+		lru:             list.New(),
 		driver:          driver,
 		pathToStateFile: path,
 		ctx:             ctx,
@@ -51,6 +57,13 @@ type TTLExpirationScheduler struct {
 
 	entries map[string]*schedulerEntry
 
+	// lru orders the entries from the least to the most recently accessed,
+	// size is the total size of the entries, which are evicted in that
+	// order when it exceeds maxSize, unless maxSize is 0.
+	lru     *list.List
+	size    int64
+	maxSize int64
+
 	driver          driver.StorageDriver
 	ctx             context.Context
 	pathToStateFile string
@@ -81,8 +94,19 @@ func (ttles *TTLExpirationScheduler) OnManifestExpire(f expiryFunc) {
 	ttles.onManifestExpire = f
 }
 
-// AddBlob schedules a blob cleanup after ttl expires
-func (ttles *TTLExpirationScheduler) AddBlob(blobRef reference.Canonical, ttl time.Duration) error {
+// SetMaxSize sets the total size of the scheduled blobs and manifests above
+// which the least recently accessed ones are cleaned up before their ttl
+// expires. A maxSize of 0 disables the size limit.
+func (ttles *TTLExpirationScheduler) SetMaxSize(maxSize int64) {
+	ttles.Lock()
+	defer ttles.Unlock()
+
+	ttles.maxSize = maxSize
+}
+
+// AddBlob schedules a blob cleanup after ttl expires, or sooner if the
+// scheduled content exceeds the maximum size
+func (ttles *TTLExpirationScheduler) AddBlob(blobRef reference.Canonical, ttl time.Duration, size int64) error {
 	ttles.Lock()
 	defer ttles.Unlock()
 
@@ -90,12 +114,14 @@ func (ttles *TTLExpirationScheduler) AddBlob(blobRef reference.Canonical, ttl ti
 		return fmt.Errorf("scheduler not started")
 	}
 
-	ttles.add(blobRef, ttl, entryTypeBlob)
+	ttles.add(blobRef, ttl, size, entryTypeBlob)
+	ttles.evict()
 	return nil
 }
 
-// AddManifest schedules a manifest cleanup after ttl expires
-func (ttles *TTLExpirationScheduler) AddManifest(manifestRef reference.Canonical, ttl time.Duration) error {
+// AddManifest schedules a manifest cleanup after ttl expires, or sooner if
+// the scheduled content exceeds the maximum size
+func (ttles *TTLExpirationScheduler) AddManifest(manifestRef reference.Canonical, ttl time.Duration, size int64) error {
 	ttles.Lock()
 	defer ttles.Unlock()
 
@@ -103,10 +129,26 @@ func (ttles *TTLExpirationScheduler) AddManifest(manifestRef reference.Canonical
 		return fmt.Errorf("scheduler not started")
 	}
 
-	ttles.add(manifestRef, ttl, entryTypeManifest)
+	ttles.add(manifestRef, ttl, size, entryTypeManifest)
+	ttles.evict()
 	return nil
 }
 
+// Access records that a scheduled blob or manifest was served, so that the
+// least recently accessed ones are cleaned up first.
+func (ttles *TTLExpirationScheduler) Access(ref reference.Canonical) {
+	ttles.Lock()
+	defer ttles.Unlock()
+
+	entry, ok := ttles.entries[ref.String()]
+	if !ok || entry.element == nil {
+		return
+	}
+	entry.LastAccess = time.Now()
+	ttles.lru.MoveToBack(entry.element)
+	ttles.indexDirty = true
+}
+
 // Start starts the scheduler
 func (ttles *TTLExpirationScheduler) Start() error {
 	ttles.Lock()
@@ -124,10 +166,22 @@ func (ttles *TTLExpirationScheduler) Start() error {
 	dcontext.GetLogger(ttles.ctx).Infof("Starting cached object TTL expiration scheduler...")
 	ttles.stopped = false
 
-	// Start timer for each deserialized entry
+	// Start timer for each deserialized entry, and restore the lru order.
+	// Entries saved before sizes were tracked have a zero LastAccess, and
+	// are evicted first.
+	restored := make([]*schedulerEntry, 0, len(ttles.entries))
 	for _, entry := range ttles.entries {
+		restored = append(restored, entry)
+	}
+	sort.Slice(restored, func(i, j int) bool {
+		return restored[i].LastAccess.Before(restored[j].LastAccess)
+	})
+	for _, entry := range restored {
+		entry.element = ttles.lru.PushBack(entry)
+		ttles.size += entry.Size
 		entry.timer = ttles.startTimer(entry, time.Until(entry.Expiry))
 	}
+	ttles.evict()
 
 	// Start a ticker to periodically save the entries index
 
@@ -158,50 +212,90 @@ func (ttles *TTLExpirationScheduler) Start() error {
 	return nil
 }
 
-func (ttles *TTLExpirationScheduler) add(r reference.Reference, ttl time.Duration, eType int) {
+func (ttles *TTLExpirationScheduler) add(r reference.Reference, ttl time.Duration, size int64, eType int) {
+	now := time.Now()
 	entry := &schedulerEntry{
-		Key:       r.String(),
-		Expiry:    time.Now().Add(ttl),
-		EntryType: eType,
+		Key:        r.String(),
+		Expiry:     now.Add(ttl),
+		EntryType:  eType,
+		Size:       size,
+		LastAccess: now,
 	}
 	dcontext.GetLogger(ttles.ctx).Infof("Adding new scheduler entry for %s with ttl=%s", entry.Key, time.Until(entry.Expiry))
-	if oldEntry, present := ttles.entries[entry.Key]; present && oldEntry.timer != nil {
-		oldEntry.timer.Stop()
+	if oldEntry, present := ttles.entries[entry.Key]; present {
+		if oldEntry.timer != nil {
+			oldEntry.timer.Stop()
+		}
+		ttles.remove(oldEntry)
 	}
 	ttles.entries[entry.Key] = entry
+	entry.element = ttles.lru.PushBack(entry)
+	ttles.size += entry.Size
 	entry.timer = ttles.startTimer(entry, ttl)
 	ttles.indexDirty = true
 }
 
-func (ttles *TTLExpirationScheduler) startTimer(entry *schedulerEntry, ttl time.Duration) *time.Timer {
-	return time.AfterFunc(ttl, func() {
-		ttles.Lock()
-		defer ttles.Unlock()
+// remove removes an entry from the scheduler, without cleaning it up.
+func (ttles *TTLExpirationScheduler) remove(entry *schedulerEntry) {
+	if entry.element != nil {
+		ttles.lru.Remove(entry.element)
+		entry.element = nil
+		ttles.size -= entry.Size
+	}
+	delete(ttles.entries, entry.Key)
+	ttles.indexDirty = true
+}
 
-		var f expiryFunc
+// evict cleans up the least recently accessed entries until the scheduled
+// content no longer exceeds the maximum size.
+func (ttles *TTLExpirationScheduler) evict() {
+	for ttles.maxSize > 0 && ttles.size > ttles.maxSize && ttles.lru.Len() > 0 {
+		entry := ttles.lru.Front().Value.(*schedulerEntry)
+		dcontext.GetLogger(ttles.ctx).Infof("Evicting scheduler entry for %s, cached content exceeds %d bytes", entry.Key, ttles.maxSize)
+		if entry.timer != nil {
+			entry.timer.Stop()
+		}
+		ttles.expire(entry)
+	}
+}
 
-		switch entry.EntryType {
-		case entryTypeBlob:
-			f = ttles.onBlobExpire
-		case entryTypeManifest:
-			f = ttles.onManifestExpire
-		default:
-			f = func(reference.Reference) error {
-				return fmt.Errorf("scheduler entry type")
-			}
+// expire cleans up an entry and removes it from the scheduler.
+func (ttles *TTLExpirationScheduler) expire(entry *schedulerEntry) {
+	var f expiryFunc
+
+	switch entry.EntryType {
+	case entryTypeBlob:
+		f = ttles.onBlobExpire
+	case entryTypeManifest:
+		f = ttles.onManifestExpire
+	default:
+		f = func(reference.Reference) error {
+			return fmt.Errorf("scheduler entry type")
 		}
+	}
 
-		ref, err := reference.Parse(entry.Key)
-		if err == nil {
-			if err := f(ref); err != nil {
-				dcontext.GetLogger(ttles.ctx).Errorf("Scheduler error returned from OnExpire(%s): %s", entry.Key, err)
-			}
-		} else {
-			dcontext.GetLogger(ttles.ctx).Errorf("Error unpacking reference: %s", err)
+	ref, err := reference.Parse(entry.Key)
+	if err == nil {
+		if err := f(ref); err != nil {
+			dcontext.GetLogger(ttles.ctx).Errorf("Scheduler error returned from OnExpire(%s): %s", entry.Key, err)
 		}
+	} else {
+		dcontext.GetLogger(ttles.ctx).Errorf("Error unpacking reference: %s", err)
+	}
+
+	ttles.remove(entry)
+}
+
+func (ttles *TTLExpirationScheduler) startTimer(entry *schedulerEntry, ttl time.Duration) *time.Timer {
+	return time.AfterFunc(ttl, func() {
+		ttles.Lock()
+		defer ttles.Unlock()
 
-		delete(ttles.entries, entry.Key)
-		ttles.indexDirty = true
+		if ttles.entries[entry.Key] != entry {
+			// evicted or replaced since the timer started
+			return
+		}
+		ttles.expire(entry)
 	})
 }
 
@@ -62,12 +62,12 @@ func TestSchedule(t *testing.T) {
 		t.Fatalf("Error starting ttlExpirationScheduler: %s", err)
 	}
 
-	s.add(ref1, 3*timeUnit, entryTypeBlob)
-	s.add(ref2, 1*timeUnit, entryTypeBlob)
+	s.add(ref1, 3*timeUnit, 0, entryTypeBlob)
+	s.add(ref2, 1*timeUnit, 0, entryTypeBlob)
 
 	func() {
 		s.Lock()
-		s.add(ref3, 1*timeUnit, entryTypeBlob)
+		s.add(ref3, 1*timeUnit, 0, entryTypeBlob)
 		s.Unlock()
 
 	}()
@@ -173,8 +173,8 @@ func TestStopRestore(t *testing.T) {
 	if err != nil {
 		t.Fatalf(err.Error())
 	}
-	s.add(ref1, 300*timeUnit, entryTypeBlob)
-	s.add(ref2, 100*timeUnit, entryTypeBlob)
+	s.add(ref1, 300*timeUnit, 0, entryTypeBlob)
+	s.add(ref2, 100*timeUnit, 0, entryTypeBlob)
 
 	// Start and stop before all operations complete
 	// state will be written to fs
@@ -209,3 +209,65 @@ func TestDoubleStart(t *testing.T) {
 		t.Fatalf("Scheduler started twice without error")
 	}
 }
+
+func TestEvictLeastRecentlyAccessed(t *testing.T) {
+	ref1, ref2, ref3 := testRefs(t)
+
+	var mu sync.Mutex
+	var evicted []string
+	deleteFunc := func(r reference.Reference) error {
+		mu.Lock()
+		evicted = append(evicted, r.String())
+		mu.Unlock()
+		return nil
+	}
+
+	fs := inmemory.New()
+	pathToStateFile := "/ttl"
+	s := New(context.Background(), fs, pathToStateFile)
+	s.OnBlobExpire(deleteFunc)
+	s.SetMaxSize(100)
+	if err := s.Start(); err != nil {
+		t.Fatalf("Error starting ttlExpirationScheduler: %s", err)
+	}
+
+	if err := s.AddBlob(ref1.(reference.Canonical), time.Hour, 40); err != nil {
+		t.Fatalf("Error adding blob: %s", err)
+	}
+	if err := s.AddBlob(ref2.(reference.Canonical), time.Hour, 40); err != nil {
+		t.Fatalf("Error adding blob: %s", err)
+	}
+	// ref1 is pulled again, so ref2 is the least recently accessed
+	s.Access(ref1.(reference.Canonical))
+	if err := s.AddBlob(ref3.(reference.Canonical), time.Hour, 40); err != nil {
+		t.Fatalf("Error adding blob: %s", err)
+	}
+
+	mu.Lock()
+	if len(evicted) != 1 || evicted[0] != ref2.String() {
+		t.Fatalf("unexpected evicted entries: %v", evicted)
+	}
+	mu.Unlock()
+	if s.size != 80 {
+		t.Fatalf("unexpected scheduled size: %d", s.size)
+	}
+
+	// the lru order survives restarts
+	s.Stop()
+	s2 := New(context.Background(), fs, pathToStateFile)
+	s2.OnBlobExpire(deleteFunc)
+	s2.SetMaxSize(50)
+	if err := s2.Start(); err != nil {
+		t.Fatalf("Error starting ttlExpirationScheduler: %s", err)
+	}
+	defer s2.Stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(evicted) != 2 || evicted[1] != ref1.String() {
+		t.Fatalf("unexpected evicted entries: %v", evicted)
+	}
+	if _, ok := s2.entries[ref3.String()]; !ok {
+		t.Fatalf("most recently accessed entry evicted")
+	}
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+// ErrNotPullThroughCache is returned when warming a registry which is not a
+// pull through cache.
+var ErrNotPullThroughCache = errors.New("the registry is not a pull through cache")
+
+// WarmResult describes the content of an image pulled through the cache.
+type WarmResult struct {
+	// Digest is the digest of the manifest of the image.
+	Digest digest.Digest
+	// Manifests is the number of manifests of the image, more than one for
+	// image indexes.
+	Manifests int
+	// Blobs is the number of blobs referenced by the manifests.
+	Blobs int
+	// FetchedBlobs and FetchedBytes are the number and size of the blobs
+	// fetched from the remote, those already cached being excluded.
+	FetchedBlobs int
+	FetchedBytes int64
+}
+
+// Warm pulls the manifests and blobs of the image ref through the cache, so
+// that they are served from the local storage when it is pulled. The image
+// is resolved by its digest, or else its tag, latest by default. Image
+// indexes are warmed along with all the manifests they reference. At most
+// concurrency blobs are fetched at once.
+func Warm(ctx context.Context, registry distribution.Namespace, ref reference.Named, concurrency int) (WarmResult, error) {
+	if _, ok := registry.(*proxyingRegistry); !ok {
+		return WarmResult{}, ErrNotPullThroughCache
+	}
+	repo, err := registry.Repository(ctx, reference.TrimNamed(ref))
+	if err != nil {
+		return WarmResult{}, err
+	}
+	return warmRepository(ctx, repo, ref, concurrency)
+}
+
+func warmRepository(ctx context.Context, repo distribution.Repository, ref reference.Named, concurrency int) (WarmResult, error) {
+	var result WarmResult
+	pbs, ok := repo.Blobs(ctx).(*proxyBlobStore)
+	if !ok {
+		return result, ErrNotPullThroughCache
+	}
+	manifests, err := repo.Manifests(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	switch r := reference.TagNameOnly(ref).(type) {
+	case reference.Canonical:
+		result.Digest = r.Digest()
+	case reference.Tagged:
+		desc, err := repo.Tags(ctx).Get(ctx, r.Tag())
+		if err != nil {
+			return result, err
+		}
+		result.Digest = desc.Digest
+	}
+
+	manifestTypes := make(map[string]struct{})
+	for _, mediaType := range distribution.ManifestMediaTypes() {
+		manifestTypes[mediaType] = struct{}{}
+	}
+
+	// the manifests are pulled first, to find the blobs of the image
+	var blobs []digest.Digest
+	seen := make(map[digest.Digest]struct{})
+	pending := []digest.Digest{result.Digest}
+	seen[result.Digest] = struct{}{}
+	for len(pending) > 0 {
+		dgst := pending[0]
+		pending = pending[1:]
+		manifest, err := manifests.Get(ctx, dgst)
+		if err != nil {
+			return result, fmt.Errorf("manifest %s: %w", dgst, err)
+		}
+		result.Manifests++
+		for _, desc := range manifest.References() {
+			if _, ok := seen[desc.Digest]; ok {
+				continue
+			}
+			seen[desc.Digest] = struct{}{}
+			if _, ok := manifestTypes[desc.MediaType]; ok {
+				pending = append(pending, desc.Digest)
+			} else {
+				blobs = append(blobs, desc.Digest)
+			}
+		}
+	}
+	result.Blobs = len(blobs)
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	var (
+		mu       sync.Mutex
+		firstErr error
+		wg       sync.WaitGroup
+		workers  = make(chan struct{}, concurrency)
+	)
+	for _, dgst := range blobs {
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(dgst digest.Digest) {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+			desc, fetched, err := pbs.fetch(ctx, dgst)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err != nil:
+				if firstErr == nil {
+					firstErr = fmt.Errorf("blob %s: %w", dgst, err)
+				}
+			case fetched:
+				result.FetchedBlobs++
+				result.FetchedBytes += desc.Size
+			}
+		}(dgst)
+	}
+	wg.Wait()
+	return result, firstErr
+}
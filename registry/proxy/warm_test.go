@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/proxy/scheduler"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestWarm(t *testing.T) {
+	ctx := context.Background()
+	nameRef, err := reference.WithName("foo/warm")
+	if err != nil {
+		t.Fatalf("unable to parse reference: %s", err)
+	}
+
+	newRepository := func() distribution.Repository {
+		registry, err := storage.NewRegistry(ctx, inmemory.New())
+		if err != nil {
+			t.Fatalf("error creating registry: %v", err)
+		}
+		repo, err := registry.Repository(ctx, nameRef)
+		if err != nil {
+			t.Fatalf("unexpected error getting repo: %v", err)
+		}
+		return repo
+	}
+	remoteRepo, localRepo := newRepository(), newRepository()
+	remoteManifests, err := remoteRepo.Manifests(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an index of two images sharing a layer
+	shared, err := remoteRepo.Blobs(ctx).Put(ctx, v1.MediaTypeImageLayer, []byte("shared layer"))
+	if err != nil {
+		t.Fatalf("unexpected error putting blob: %v", err)
+	}
+	var images []manifestlist.ManifestDescriptor
+	for _, platform := range []string{"amd64", "arm64"} {
+		layer, err := remoteRepo.Blobs(ctx).Put(ctx, v1.MediaTypeImageLayer, []byte(platform+" layer"))
+		if err != nil {
+			t.Fatalf("unexpected error putting blob: %v", err)
+		}
+		builder := ocischema.NewManifestBuilder(remoteRepo.Blobs(ctx), []byte(`{"architecture":"`+platform+`"}`), nil)
+		for _, desc := range []distribution.Descriptor{shared, layer} {
+			if err := builder.AppendReference(desc); err != nil {
+				t.Fatalf("unexpected error building manifest: %v", err)
+			}
+		}
+		m, err := builder.Build(ctx)
+		if err != nil {
+			t.Fatalf("unexpected error building manifest: %v", err)
+		}
+		dgst, err := remoteManifests.Put(ctx, m)
+		if err != nil {
+			t.Fatalf("unexpected error putting manifest: %v", err)
+		}
+		_, payload, _ := m.Payload()
+		images = append(images, manifestlist.ManifestDescriptor{
+			Descriptor: distribution.Descriptor{MediaType: v1.MediaTypeImageManifest, Digest: dgst, Size: int64(len(payload))},
+			Platform:   manifestlist.PlatformSpec{OS: "linux", Architecture: platform},
+		})
+	}
+	index, err := manifestlist.FromDescriptorsWithMediaType(images, v1.MediaTypeImageIndex)
+	if err != nil {
+		t.Fatalf("unexpected error building index: %v", err)
+	}
+	indexDigest, err := remoteManifests.Put(ctx, index)
+	if err != nil {
+		t.Fatalf("unexpected error putting index: %v", err)
+	}
+	if err := remoteRepo.Tags(ctx).Tag(ctx, "latest", distribution.Descriptor{Digest: indexDigest}); err != nil {
+		t.Fatalf("unexpected error tagging index: %v", err)
+	}
+
+	localManifests, err := localRepo.Manifests(ctx, storage.SkipLayerVerification())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := scheduler.New(ctx, inmemory.New(), "/scheduler-state.json")
+	repo := &proxiedRepository{
+		blobStore: &proxyBlobStore{
+			localStore:     localRepo.Blobs(ctx),
+			remoteStore:    remoteRepo.Blobs(ctx),
+			scheduler:      s,
+			repositoryName: nameRef,
+			authChallenger: &mockChallenger{},
+		},
+		manifests: &proxyManifestStore{
+			repositoryName:  nameRef,
+			localManifests:  localManifests,
+			remoteManifests: remoteManifests,
+			ctx:             ctx,
+			scheduler:       s,
+			authChallenger:  &mockChallenger{},
+		},
+		name: nameRef,
+		tags: &proxyTagService{
+			localTags:      localRepo.Tags(ctx),
+			remoteTags:     remoteRepo.Tags(ctx),
+			authChallenger: &mockChallenger{},
+			repositoryName: nameRef,
+		},
+	}
+
+	// the image is warmed with the latest tag by default
+	result, err := warmRepository(ctx, repo, nameRef, 2)
+	if err != nil {
+		t.Fatalf("unexpected error warming the cache: %v", err)
+	}
+	// the index and its images, the shared layer, the layers and configs of
+	// the images
+	expected := WarmResult{Digest: indexDigest, Manifests: 3, Blobs: 5, FetchedBlobs: 5}
+	expected.FetchedBytes = result.FetchedBytes
+	if result != expected || result.FetchedBytes == 0 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	for _, image := range images {
+		if _, err := localManifests.Get(ctx, image.Digest); err != nil {
+			t.Errorf("manifest %s not cached: %v", image.Digest, err)
+		}
+	}
+	if _, err := localRepo.Blobs(ctx).Stat(ctx, shared.Digest); err != nil {
+		t.Errorf("layer %s not cached: %v", shared.Digest, err)
+	}
+
+	// the cached blobs are not fetched again
+	canonical, err := reference.WithDigest(nameRef, images[0].Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err = warmRepository(ctx, repo, canonical, 2)
+	if err != nil {
+		t.Fatalf("unexpected error warming the cache: %v", err)
+	}
+	if expected := (WarmResult{Digest: images[0].Digest, Manifests: 1, Blobs: 3}); result != expected {
+		t.Fatalf("unexpected result %+v", result)
+	}
+
+	if _, err := Warm(ctx, nil, nameRef, 1); !errors.Is(err, ErrNotPullThroughCache) {
+		t.Fatalf("unexpected error warming a registry which is not a cache: %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package pushqueue
+
+import (
+	"context"
+	"io"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/opencontainers/go-digest"
+)
+
+// ForwardManifest copies a manifest and the blobs it references from the
+// local repository to the remote one, tagging it if tag is set. It returns
+// the size of the manifest and the blobs it references.
+func ForwardManifest(ctx context.Context, local, remote distribution.Repository, dgst digest.Digest, tag string) (int64, []distribution.Descriptor, error) {
+	localManifests, err := local.Manifests(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	manifest, err := localManifests.Get(ctx, dgst)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	_, payload, err := manifest.Payload()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	manifestMediaTypes := make(map[string]struct{})
+	for _, mediaType := range distribution.ManifestMediaTypes() {
+		manifestMediaTypes[mediaType] = struct{}{}
+	}
+
+	var blobs []distribution.Descriptor
+	for _, desc := range manifest.References() {
+		if _, ok := manifestMediaTypes[desc.MediaType]; ok {
+			// the manifests of an index, or the subject of a manifest,
+			// are pushed before it
+			continue
+		}
+		if len(desc.URLs) > 0 {
+			// foreign layers are not stored in registries
+			continue
+		}
+		if err := ForwardBlob(ctx, local.Blobs(ctx), remote.Blobs(ctx), desc); err != nil {
+			return 0, nil, err
+		}
+		blobs = append(blobs, desc)
+	}
+
+	remoteManifests, err := remote.Manifests(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var options []distribution.ManifestServiceOption
+	if tag != "" {
+		options = append(options, distribution.WithTag(tag))
+	}
+	if _, err := remoteManifests.Put(ctx, manifest, options...); err != nil {
+		return 0, nil, err
+	}
+	return int64(len(payload)), blobs, nil
+}
+
+// ForwardBlob uploads a blob to the remote, unless it already has it.
+func ForwardBlob(ctx context.Context, local distribution.BlobStore, remote distribution.BlobStore, desc distribution.Descriptor) error {
+	_, err := remote.Stat(ctx, desc.Digest)
+	if err == nil {
+		return nil
+	}
+	if err != distribution.ErrBlobUnknown {
+		return err
+	}
+
+	reader, err := local.Open(ctx, desc.Digest)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	bw, err := remote.Create(ctx)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(bw, reader); err != nil {
+		bw.Cancel(ctx)
+		return err
+	}
+
+	_, err = bw.Commit(ctx, desc)
+	return err
+}
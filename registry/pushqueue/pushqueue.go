@@ -0,0 +1,222 @@
+// Package pushqueue buffers the manifests pushed to a registry until they
+// are forwarded to a remote registry, along with the blobs they reference.
+package pushqueue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/uuid"
+	"github.com/opencontainers/go-digest"
+)
+
+// defaultRetryInterval is the interval between attempts to forward the
+// buffered pushes when none is configured.
+const defaultRetryInterval = 30 * time.Second
+
+// Entry is a manifest pushed to the registry which has not been forwarded
+// to the remote yet. Fields are exported for serialization.
+type Entry struct {
+	Repository string        `json:"repository"`
+	Digest     digest.Digest `json:"digest"`
+	Tag        string        `json:"tag,omitempty"`
+}
+
+// ForwardFunc forwards a pushed manifest to the remote.
+type ForwardFunc func(context.Context, Entry) error
+
+// queued is an entry along with the path it is saved at.
+type queued struct {
+	Entry
+	path string
+}
+
+// Queue buffers the manifests pushed to a registry and forwards them to a
+// remote in the order they were pushed, so that indexes follow their
+// manifests. Each push is saved as its own object in the storage, so that
+// no push is lost across restarts while the remote is unreachable, and the
+// registry instances sharing the storage do not overwrite the pushes of
+// each other.
+type Queue struct {
+	sync.Mutex
+
+	entries []queued
+
+	driver driver.StorageDriver
+	ctx    context.Context
+	dir    string
+
+	forward       ForwardFunc
+	retryInterval time.Duration
+	wake          chan struct{}
+}
+
+// New creates a queue saving the pushes under dir in the storage and
+// forwarding them with forward, until ctx is done.
+func New(ctx context.Context, driver driver.StorageDriver, dir string, retryInterval time.Duration, forward ForwardFunc) *Queue {
+	if retryInterval <= 0 {
+		retryInterval = defaultRetryInterval
+	}
+	return &Queue{
+		driver:        driver,
+		ctx:           ctx,
+		dir:           dir,
+		forward:       forward,
+		retryInterval: retryInterval,
+		wake:          make(chan struct{}, 1),
+	}
+}
+
+// Start reads the pushes buffered by a previous run and starts forwarding
+// them, until the context of the queue is done.
+func (q *Queue) Start() error {
+	q.Lock()
+	err := q.readState()
+	q.Unlock()
+	if err != nil {
+		return err
+	}
+
+	go q.run()
+	return nil
+}
+
+// Add buffers a pushed manifest until it is forwarded.
+func (q *Queue) Add(entry Entry) error {
+	jsonBytes, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	q.Lock()
+	defer q.Unlock()
+
+	// the names sort in the order of the pushes
+	p := path.Join(q.dir, fmt.Sprintf("%020d-%s.json", time.Now().UnixNano(), uuid.Generate()))
+	if err := q.driver.PutContent(q.ctx, p, jsonBytes); err != nil {
+		return err
+	}
+	q.entries = append(q.entries, queued{Entry: entry, path: p})
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// PendingTag reports whether a push of the tag has not been forwarded yet,
+// in which case the remote does not know of it.
+func (q *Queue) PendingTag(repository, tag string) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	for _, entry := range q.entries {
+		if entry.Repository == repository && entry.Tag == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Len returns the number of pushes not forwarded yet.
+func (q *Queue) Len() int {
+	q.Lock()
+	defer q.Unlock()
+
+	return len(q.entries)
+}
+
+func (q *Queue) run() {
+	ticker := time.NewTicker(q.retryInterval)
+	defer ticker.Stop()
+
+	for {
+		q.forwardAll()
+
+		select {
+		case <-q.ctx.Done():
+			return
+		case <-ticker.C:
+		case <-q.wake:
+		}
+	}
+}
+
+// forwardAll forwards the buffered pushes in order, stopping at the first
+// failure to retry later. The pushes are read again from the storage first,
+// to pick up those buffered by other instances.
+func (q *Queue) forwardAll() {
+	q.Lock()
+	err := q.readState()
+	q.Unlock()
+	if err != nil {
+		dcontext.GetLogger(q.ctx).Errorf("Error reading push queue %s: %s", q.dir, err)
+		return
+	}
+
+	for {
+		q.Lock()
+		if len(q.entries) == 0 {
+			q.Unlock()
+			return
+		}
+		entry := q.entries[0]
+		q.Unlock()
+
+		if err := q.forward(q.ctx, entry.Entry); err != nil {
+			dcontext.GetLogger(q.ctx).Warnf("Error forwarding push of %s@%s, retrying in %s: %s", entry.Repository, entry.Digest, q.retryInterval, err)
+			return
+		}
+
+		if err := q.driver.Delete(q.ctx, entry.path); err != nil {
+			if _, ok := err.(driver.PathNotFoundError); !ok {
+				dcontext.GetLogger(q.ctx).Errorf("Error removing forwarded push %s: %s", entry.path, err)
+			}
+		}
+
+		// only forwardAll removes entries, so the head is still entry
+		q.Lock()
+		q.entries = q.entries[1:]
+		q.Unlock()
+	}
+}
+
+func (q *Queue) readState() error {
+	paths, err := q.driver.List(q.ctx, q.dir)
+	if err != nil {
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			q.entries = nil
+			return nil
+		}
+		return err
+	}
+	sort.Strings(paths)
+
+	entries := make([]queued, 0, len(paths))
+	for _, p := range paths {
+		bytes, err := q.driver.GetContent(q.ctx, p)
+		if err != nil {
+			if _, ok := err.(driver.PathNotFoundError); ok {
+				// forwarded by another instance in the meantime
+				continue
+			}
+			return err
+		}
+
+		entry := queued{path: p}
+		if err := json.Unmarshal(bytes, &entry.Entry); err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+	}
+	q.entries = entries
+	return nil
+}
@@ -0,0 +1,101 @@
+package pushqueue
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestQueueForwardsInOrder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d := inmemory.New()
+
+	entries := []Entry{
+		{Repository: "foo/bar", Digest: digest.FromString("first"), Tag: "latest"},
+		{Repository: "foo/bar", Digest: digest.FromString("second")},
+	}
+
+	// pushes buffered by a previous run are forwarded after a restart
+	previous := New(ctx, d, "/push-queue", time.Hour, nil)
+	for _, entry := range entries {
+		if err := previous.Add(entry); err != nil {
+			t.Fatalf("unexpected error buffering push: %v", err)
+		}
+	}
+
+	failures := 2
+	forwarded := make(chan Entry, len(entries))
+	q := New(ctx, d, "/push-queue", 10*time.Millisecond, func(ctx context.Context, entry Entry) error {
+		if failures > 0 {
+			failures--
+			return errors.New("unreachable")
+		}
+		forwarded <- entry
+		return nil
+	})
+	if err := q.Start(); err != nil {
+		t.Fatalf("unexpected error starting queue: %v", err)
+	}
+	if !q.PendingTag("foo/bar", "latest") {
+		t.Fatal("expected the buffered tag to be pending")
+	}
+
+	for _, expected := range entries {
+		select {
+		case entry := <-forwarded:
+			if entry != expected {
+				t.Fatalf("unexpected push forwarded %v, expected %v", entry, expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("push %v not forwarded", expected)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for q.PendingTag("foo/bar", "latest") {
+		if time.Now().After(deadline) {
+			t.Fatal("forwarded tag still pending")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if paths, err := d.List(ctx, "/push-queue"); err != nil || len(paths) != 0 {
+		t.Fatalf("expected the forwarded pushes to be removed from the storage: %v %v", paths, err)
+	}
+}
+
+func TestQueueSharedStorage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d := inmemory.New()
+
+	// instances sharing the storage do not overwrite the pushes of each other
+	first := New(ctx, d, "/push-queue", time.Hour, nil)
+	second := New(ctx, d, "/push-queue", time.Hour, nil)
+	for i, q := range []*Queue{first, second, first} {
+		entry := Entry{Repository: "foo/bar", Digest: digest.FromString(string(rune('a' + i)))}
+		if err := q.Add(entry); err != nil {
+			t.Fatalf("unexpected error buffering push: %v", err)
+		}
+	}
+
+	q := New(ctx, d, "/push-queue", time.Hour, nil)
+	q.Lock()
+	err := q.readState()
+	q.Unlock()
+	if err != nil {
+		t.Fatalf("unexpected error reading queue: %v", err)
+	}
+	if q.Len() != 3 {
+		t.Fatalf("expected 3 buffered pushes, got %d", q.Len())
+	}
+	for i, entry := range q.entries {
+		if expected := digest.FromString(string(rune('a' + i))); entry.Digest != expected {
+			t.Errorf("unexpected push %d %s, expected %s", i, entry.Digest, expected)
+		}
+	}
+}
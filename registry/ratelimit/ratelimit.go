@@ -0,0 +1,136 @@
+// Package ratelimit implements token bucket rate limiters keyed by an
+// arbitrary string, such as a client address or a user name.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often the buckets which filled up again are
+// forgotten.
+const sweepInterval = time.Minute
+
+// Limiter limits the rate of events per key. Each key has a bucket holding
+// up to burst tokens, refilled at rate tokens per second, and each event
+// takes one token. A Limiter is safe for concurrent use.
+type Limiter struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+
+	// now is replaced in tests.
+	now func() time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a limiter allowing rate events per second per key, with
+// bursts of up to burst events.
+func NewLimiter(rate float64, burst int) *Limiter {
+	return &Limiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// Allow takes a token from the bucket of key. If the bucket is empty, the
+// event is not allowed and Allow returns how long to wait before a token is
+// available.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	return l.AllowN(key, 1)
+}
+
+// AllowN takes n tokens from the bucket of key, such as the bytes of a
+// transfer. If the bucket does not hold n tokens, none are taken and AllowN
+// returns how long to wait before they are available. n should not exceed
+// the burst of the limiter, which the bucket never holds more than.
+func (l *Limiter) AllowN(key string, n int) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = l.refill(b, now)
+	b.last = now
+
+	if b.tokens < float64(n) {
+		wait := time.Duration(math.Ceil((float64(n) - b.tokens) / l.rate * float64(time.Second)))
+		return false, wait
+	}
+	b.tokens -= float64(n)
+	return true, 0
+}
+
+// Burst returns the maximum number of tokens of a bucket.
+func (l *Limiter) Burst() int {
+	return int(l.burst)
+}
+
+// Wait blocks until a token is taken from the bucket of key, or ctx is done.
+func (l *Limiter) Wait(ctx context.Context, key string) error {
+	return l.WaitN(ctx, key, 1)
+}
+
+// WaitN blocks until n tokens are taken from the bucket of key, or ctx is
+// done. It fails right away if n exceeds the burst of the limiter.
+func (l *Limiter) WaitN(ctx context.Context, key string, n int) error {
+	if float64(n) > l.burst {
+		return fmt.Errorf("ratelimit: %d tokens exceed the burst of %d", n, l.Burst())
+	}
+	for {
+		ok, wait := l.AllowN(key, n)
+		if ok {
+			return nil
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// refill returns the tokens in the bucket at the given time.
+func (l *Limiter) refill(b *bucket, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.last).Seconds()*l.rate
+	if tokens > l.burst {
+		tokens = l.burst
+	}
+	return tokens
+}
+
+// sweep forgets the buckets which are full, as they are equivalent to new
+// ones, so that the limiter does not grow with the number of keys it has
+// ever seen.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	for key, b := range l.buckets {
+		if l.refill(b, now) >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
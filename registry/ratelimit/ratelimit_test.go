@@ -0,0 +1,91 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := NewLimiter(2, 3)
+	l.now = func() time.Time { return now }
+
+	allow := func(key string, expected bool, expectedWait time.Duration) {
+		t.Helper()
+		ok, wait := l.Allow(key)
+		if ok != expected || wait != expectedWait {
+			t.Fatalf("unexpected result for %s: %t, %v != %t, %v", key, ok, wait, expected, expectedWait)
+		}
+	}
+
+	// the burst is allowed, then one event every half second
+	for i := 0; i < 3; i++ {
+		allow("a", true, 0)
+	}
+	allow("a", false, 500*time.Millisecond)
+
+	// other keys have their own bucket
+	allow("b", true, 0)
+
+	now = now.Add(250 * time.Millisecond)
+	allow("a", false, 250*time.Millisecond)
+	now = now.Add(250 * time.Millisecond)
+	allow("a", true, 0)
+	allow("a", false, 500*time.Millisecond)
+
+	// buckets do not fill up beyond the burst
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		allow("a", true, 0)
+	}
+	allow("a", false, 500*time.Millisecond)
+
+	// full buckets are forgotten
+	if _, ok := l.buckets["b"]; ok {
+		t.Fatalf("full bucket was not swept")
+	}
+}
+
+func TestLimiterWait(t *testing.T) {
+	l := NewLimiter(20, 1)
+	ctx := context.Background()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := l.Wait(ctx, "a"); err != nil {
+			t.Fatalf("unexpected error waiting: %v", err)
+		}
+	}
+	// the burst is taken at once, then one event every 50ms
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("waited %v for three events", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := l.Wait(ctx, "a"); err != context.Canceled {
+		t.Errorf("unexpected error waiting with a cancelled context: %v", err)
+	}
+}
+
+func TestLimiterAllowN(t *testing.T) {
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := NewLimiter(100, 100)
+	l.now = func() time.Time { return now }
+
+	if ok, _ := l.AllowN("a", 60); !ok {
+		t.Fatal("expected the tokens of the burst to be allowed")
+	}
+	// no token is taken when the bucket does not hold enough of them
+	if ok, wait := l.AllowN("a", 60); ok || wait != 200*time.Millisecond {
+		t.Fatalf("unexpected result: %t, %v", ok, wait)
+	}
+	if ok, _ := l.AllowN("a", 40); !ok {
+		t.Fatal("expected the remaining tokens to be allowed")
+	}
+
+	if err := l.WaitN(context.Background(), "a", 101); err == nil {
+		t.Fatal("expected an error waiting for more tokens than the burst")
+	}
+}
@@ -24,12 +24,14 @@ import (
 	"github.com/yvasiyarov/gorelic"
 	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/http2"
 
 	"github.com/distribution/distribution/v3/configuration"
 	dcontext "github.com/distribution/distribution/v3/context"
 	"github.com/distribution/distribution/v3/health"
 	"github.com/distribution/distribution/v3/registry/handlers"
 	"github.com/distribution/distribution/v3/registry/listener"
+	"github.com/distribution/distribution/v3/tracing"
 	"github.com/distribution/distribution/v3/uuid"
 	"github.com/distribution/distribution/v3/version"
 )
@@ -123,6 +125,11 @@ var ServeCmd = &cobra.Command{
 			http.Handle(path, metrics.Handler())
 		}
 
+		// reload the configuration on SIGHUP
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		go registry.reloadConfiguration(reload, args)
+
 		if err = registry.ListenAndServe(); err != nil {
 			logrus.Fatalln(err)
 		}
@@ -135,6 +142,9 @@ type Registry struct {
 	config *configuration.Configuration
 	app    *handlers.App
 	server *http.Server
+
+	// shutdownTracing flushes the spans not exported yet.
+	shutdownTracing func(context.Context) error
 }
 
 // NewRegistry creates a new registry from a context and configuration struct.
@@ -147,6 +157,11 @@ func NewRegistry(ctx context.Context, config *configuration.Configuration) (*Reg
 
 	configureBugsnag(config)
 
+	shutdownTracing, err := tracing.InitOpenTelemetry(ctx, config.Tracing)
+	if err != nil {
+		return nil, fmt.Errorf("error configuring tracing: %v", err)
+	}
+
 	// inject a logger into the uuid library. warns us if there is a problem
 	// with uuid generation under low entropy.
 	uuid.Loggerf = dcontext.GetLogger(ctx).Warnf
@@ -159,18 +174,39 @@ func NewRegistry(ctx context.Context, config *configuration.Configuration) (*Reg
 	handler = alive("/", handler)
 	handler = health.Handler(handler)
 	handler = panicHandler(handler)
+	if config.Tracing.Endpoint != "" {
+		handler = tracing.Handler(handler)
+	}
 	if !config.Log.AccessLog.Disabled {
 		handler = gorhandlers.CombinedLoggingHandler(os.Stdout, handler)
 	}
 
 	server := &http.Server{
-		Handler: handler,
+		Handler:           handler,
+		ReadHeaderTimeout: config.HTTP.Timeouts.ReadHeader,
+		ReadTimeout:       config.HTTP.Timeouts.Read,
+		WriteTimeout:      config.HTTP.Timeouts.Write,
+		IdleTimeout:       config.HTTP.Timeouts.Idle,
+		// the handlers apply the timeouts of the class of the requests to
+		// their connection
+		ConnContext: handlers.ConnContext,
+	}
+	// the clients of the event stream would otherwise hold the graceful
+	// shutdowns until the drain timeout
+	server.RegisterOnShutdown(app.CloseEventStream)
+	if !config.HTTP.HTTP2.Disabled && config.HTTP.HTTP2.MaxConcurrentStreams > 0 {
+		if err := http2.ConfigureServer(server, &http2.Server{
+			MaxConcurrentStreams: config.HTTP.HTTP2.MaxConcurrentStreams,
+		}); err != nil {
+			return nil, fmt.Errorf("error configuring http2: %v", err)
+		}
 	}
 
 	return &Registry{
-		app:    app,
-		config: config,
-		server: server,
+		app:             app,
+		config:          config,
+		server:          server,
+		shutdownTracing: shutdownTracing,
 	}, nil
 }
 
@@ -207,10 +243,20 @@ func getCipherSuiteNames(ids []uint16) []string {
 func (registry *Registry) ListenAndServe() error {
 	config := registry.config
 
+	defer func() {
+		if err := registry.shutdownTracing(context.Background()); err != nil {
+			dcontext.GetLogger(registry.app).Errorf("error flushing traces: %v", err)
+		}
+	}()
+
 	ln, err := listener.NewListener(config.HTTP.Net, config.HTTP.Addr)
 	if err != nil {
 		return err
 	}
+	if max := config.HTTP.Limits.MaxConnections; max > 0 {
+		dcontext.GetLogger(registry.app).Infof("limiting client connections to %d", max)
+		ln = listener.NewLimitListener(ln, max)
+	}
 
 	if config.HTTP.TLS.Certificate != "" || config.HTTP.TLS.LetsEncrypt.CacheFile != "" {
 		if config.HTTP.TLS.MinimumTLS == "" {
@@ -316,6 +362,30 @@ func (registry *Registry) ListenAndServe() error {
 	}
 }
 
+// reloadConfiguration resolves the configuration again whenever reload
+// receives a signal, and applies the settings which can change while the
+// registry is running, the log level included once the others are applied.
+func (registry *Registry) reloadConfiguration(reload <-chan os.Signal, args []string) {
+	for range reload {
+		config, err := resolveConfiguration(args)
+		if err != nil {
+			dcontext.GetLogger(registry.app).Errorf("error reloading configuration: %v", err)
+			continue
+		}
+
+		dcontext.GetLogger(registry.app).Info("reloading configuration")
+		if err := registry.app.ReloadConfiguration(config); err != nil {
+			dcontext.GetLogger(registry.app).Errorf("error reloading configuration: %v", err)
+			continue
+		}
+		// the log level is only applied along with the other settings
+		if level := logLevel(config.Log.Level); level != logrus.GetLevel() {
+			logrus.SetLevel(level)
+			dcontext.GetLogger(registry.app).Infof("log level set to %s", level)
+		}
+	}
+}
+
 func configureReporting(app *handlers.App) http.Handler {
 	var handler http.Handler = app
 
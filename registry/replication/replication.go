@@ -0,0 +1,337 @@
+// Package replication mirrors the content pushed to the registry to remote
+// registries.
+package replication
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/notifications"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/client"
+	"github.com/distribution/distribution/v3/registry/client/auth"
+	"github.com/distribution/distribution/v3/registry/client/auth/challenge"
+	"github.com/distribution/distribution/v3/registry/client/transport"
+	"github.com/distribution/distribution/v3/registry/pushqueue"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	events "github.com/docker/go-events"
+	"github.com/opencontainers/go-digest"
+)
+
+// validRemoteName matches the names of the remotes, which are part of the
+// path of their queues in the storage.
+var validRemoteName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// Replicator mirrors the manifests pushed to the registry, along with the
+// blobs they reference, to remote registries. It is a sink of the registry
+// events: each manifest push is buffered in a queue per remote, saved in
+// the storage, until it is mirrored.
+type Replicator struct {
+	remotes []*remote
+}
+
+// New creates a replicator mirroring the content of registry to the remotes
+// of config, and starts mirroring the pushes buffered by a previous run.
+// The queues are stored with driver.
+func New(ctx context.Context, registry distribution.Namespace, driver driver.StorageDriver, config configuration.Replication) (*Replicator, error) {
+	r := &Replicator{}
+	names := make(map[string]bool)
+	for _, rc := range config.Remotes {
+		if rc.Disabled {
+			dcontext.GetLogger(ctx).Infof("replication remote %s disabled, skipping", rc.Name)
+			continue
+		}
+		if !validRemoteName.MatchString(rc.Name) {
+			return nil, fmt.Errorf("invalid replication remote name %q", rc.Name)
+		}
+		if names[rc.Name] {
+			return nil, fmt.Errorf("duplicate replication remote name %q", rc.Name)
+		}
+		names[rc.Name] = true
+
+		rem, err := newRemote(registry, rc)
+		if err != nil {
+			return nil, fmt.Errorf("replication remote %s: %v", rc.Name, err)
+		}
+		rem.queue = pushqueue.New(ctx, driver, path.Join("/replication", rc.Name, "queue"), config.RetryInterval, rem.mirror)
+		if err := rem.queue.Start(); err != nil {
+			return nil, fmt.Errorf("replication remote %s: %v", rc.Name, err)
+		}
+		dcontext.GetLogger(ctx).Infof("Replicating to %s (%s) with %d buffered pushes", rc.Name, rc.URL, rem.queue.Len())
+		r.remotes = append(r.remotes, rem)
+	}
+	return r, nil
+}
+
+// Write buffers the manifest pushes for the remotes their repository is
+// mirrored to, and discards the other events.
+func (r *Replicator) Write(event events.Event) error {
+	e, ok := event.(notifications.Event)
+	if !ok || e.Action != notifications.EventActionPush || !isManifest(e.Target.MediaType) {
+		return nil
+	}
+
+	var errs []string
+	for _, rem := range r.remotes {
+		if !rem.matchRepository(e.Target.Repository) {
+			continue
+		}
+		err := rem.queue.Add(pushqueue.Entry{
+			Repository: e.Target.Repository,
+			Digest:     e.Target.Digest,
+			Tag:        e.Target.Tag,
+		})
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", rem.name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("error buffering push of %s@%s: %s", e.Target.Repository, e.Target.Digest, strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// Close does nothing: the queues stop with the context of the replicator.
+func (r *Replicator) Close() error {
+	return nil
+}
+
+// isManifest reports whether mediaType is the media type of a manifest.
+func isManifest(mediaType string) bool {
+	for _, mt := range distribution.ManifestMediaTypes() {
+		if mt == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// repositoryFunc returns the repository of a remote, authorized for the
+// given actions.
+type repositoryFunc func(ctx context.Context, name reference.Named, actions ...string) (distribution.Repository, error)
+
+// remote is a registry the pushed content is mirrored to.
+type remote struct {
+	name    string
+	include configuration.RepositoryMatchers
+	exclude configuration.RepositoryMatchers
+	local   distribution.Namespace
+	remote  repositoryFunc
+	queue   *pushqueue.Queue
+
+	sync.Mutex
+	url url.URL
+	cm  challenge.Manager
+	cs  *credentials
+}
+
+func newRemote(registry distribution.Namespace, config configuration.ReplicationRemote) (*remote, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid url %q", config.URL)
+	}
+
+	include, err := configuration.NewRepositoryMatchers(config.Include)
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := configuration.NewRepositoryMatchers(config.Exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	rem := &remote{
+		name:    config.Name,
+		include: include,
+		exclude: exclude,
+		local:   registry,
+		url:     *u,
+		cm:      challenge.NewSimpleManager(),
+		cs: &credentials{
+			username: config.Username,
+			password: config.Password,
+			host:     u.Host,
+			realms:   make(map[string]bool),
+		},
+	}
+	rem.remote = rem.repository
+	return rem, nil
+}
+
+// matchRepository reports whether the repository name is mirrored to the
+// remote.
+func (rem *remote) matchRepository(name string) bool {
+	if len(rem.include) > 0 && !rem.include.MatchAny(name) {
+		return false
+	}
+	return !rem.exclude.MatchAny(name)
+}
+
+// mirror copies a pushed manifest to the remote, along with the blobs it
+// references.
+func (rem *remote) mirror(ctx context.Context, e pushqueue.Entry) error {
+	name, err := reference.WithName(e.Repository)
+	if err != nil {
+		return err
+	}
+
+	remoteRepo, err := rem.remote(ctx, name, "pull", "push")
+	if err != nil {
+		return err
+	}
+
+	localRepo, err := rem.local.Repository(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	if err := copyManifest(ctx, localRepo, remoteRepo, e.Digest, e.Tag); err != nil {
+		if _, ok := err.(distribution.ErrManifestUnknownRevision); ok || err == distribution.ErrBlobUnknown {
+			// retrying would not help, the content was deleted since
+			dcontext.GetLogger(ctx).Errorf("Dropping push of %s@%s to %s: %s", e.Repository, e.Digest, rem.name, err)
+			return nil
+		}
+		return err
+	}
+
+	dcontext.GetLogger(ctx).Infof("Mirrored push of %s@%s to %s", e.Repository, e.Digest, rem.name)
+	return nil
+}
+
+// repository returns the repository of the remote registry, authorized for
+// the given actions.
+func (rem *remote) repository(ctx context.Context, name reference.Named, actions ...string) (distribution.Repository, error) {
+	if err := rem.establishChallenges(ctx); err != nil {
+		return nil, err
+	}
+
+	tkopts := auth.TokenHandlerOptions{
+		Transport:   http.DefaultTransport,
+		Credentials: rem.cs,
+		Scopes: []auth.Scope{
+			auth.RepositoryScope{
+				Repository: name.Name(),
+				Actions:    actions,
+			},
+		},
+		Logger: dcontext.GetLogger(ctx),
+	}
+
+	tr := transport.NewTransport(http.DefaultTransport,
+		auth.NewAuthorizer(rem.cm,
+			auth.NewTokenHandlerWithOptions(tkopts),
+			auth.NewBasicHandler(rem.cs)))
+
+	return client.NewRepository(name, rem.url.String(), tr)
+}
+
+// establishChallenges pings the remote to learn the authentication it
+// requires, unless it already did.
+func (rem *remote) establishChallenges(ctx context.Context) error {
+	rem.Lock()
+	defer rem.Unlock()
+
+	pingURL := rem.url
+	pingURL.Path = "/v2/"
+	challenges, err := rem.cm.GetChallenges(pingURL)
+	if err != nil {
+		return err
+	}
+	if len(challenges) > 0 {
+		return nil
+	}
+
+	resp, err := http.Get(pingURL.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := rem.cm.AddResponse(resp); err != nil {
+		return err
+	}
+
+	for _, c := range challenge.ResponseChallenges(resp) {
+		if strings.EqualFold(c.Scheme, "bearer") {
+			dcontext.GetLogger(ctx).Infof("Discovered token authentication URL of %s: %s", rem.name, c.Parameters["realm"])
+			rem.cs.addRealm(c.Parameters["realm"])
+		}
+	}
+	return nil
+}
+
+// credentials answers the challenges of a remote with its username and
+// password, which are only sent to the remote itself and its token realms.
+type credentials struct {
+	sync.Mutex
+	username string
+	password string
+	host     string
+	realms   map[string]bool
+}
+
+func (c *credentials) addRealm(realm string) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.realms[realm] = true
+}
+
+func (c *credentials) Basic(u *url.URL) (string, string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if u.Host != c.host && !c.realms[u.String()] {
+		return "", ""
+	}
+	return c.username, c.password
+}
+
+func (c *credentials) RefreshToken(u *url.URL, service string) string {
+	return ""
+}
+
+func (c *credentials) SetRefreshToken(u *url.URL, service, token string) {
+}
+
+// copyManifest copies a manifest and the blobs it references from the local
+// repository to the remote one, tagging it if tag is set. A manifest the
+// remote already has, with the same tag, is not pushed again so that
+// registries replicating to each other do not loop.
+func copyManifest(ctx context.Context, local, remote distribution.Repository, dgst digest.Digest, tag string) error {
+	remoteManifests, err := remote.Manifests(ctx)
+	if err != nil {
+		return err
+	}
+
+	exists, err := remoteManifests.Exists(ctx, dgst)
+	if err != nil {
+		return err
+	}
+	if exists {
+		if tag == "" {
+			return nil
+		}
+		desc, err := remote.Tags(ctx).Get(ctx, tag)
+		if err == nil && desc.Digest == dgst {
+			return nil
+		}
+		if _, ok := err.(distribution.ErrTagUnknown); err != nil && !ok {
+			return err
+		}
+	}
+
+	_, _, err = pushqueue.ForwardManifest(ctx, local, remote, dgst, tag)
+	return err
+}
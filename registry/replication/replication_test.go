@@ -0,0 +1,180 @@
+package replication
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/notifications"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/pushqueue"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestNewValidatesRemotes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, remotes := range [][]configuration.ReplicationRemote{
+		{{Name: "", URL: "https://mirror.example.com"}},
+		{{Name: "../escape", URL: "https://mirror.example.com"}},
+		{{Name: "mirror", URL: "mirror.example.com"}},
+		{{Name: "mirror", URL: "https://mirror.example.com", Include: []string{"regexp:("}}},
+		{{Name: "mirror", URL: "https://mirror.example.com"}, {Name: "mirror", URL: "https://other.example.com"}},
+	} {
+		_, err := New(ctx, nil, inmemory.New(), configuration.Replication{Remotes: remotes})
+		if err == nil {
+			t.Errorf("expected an error configuring remotes %v", remotes)
+		}
+	}
+}
+
+func TestWriteBuffersMatchingPushes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r, err := New(ctx, nil, inmemory.New(), configuration.Replication{
+		RetryInterval: time.Hour,
+		Remotes: []configuration.ReplicationRemote{
+			{Name: "all", URL: "https://all.example.com"},
+			{Name: "prod", URL: "https://prod.example.com", Include: []string{"prod/*"}, Exclude: []string{"regexp:prod/tmp-.*"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating replicator: %v", err)
+	}
+	// keep the pushes buffered
+	for _, rem := range r.remotes {
+		rem.remote = func(context.Context, reference.Named, ...string) (distribution.Repository, error) {
+			return nil, distribution.ErrUnsupported
+		}
+	}
+
+	dgst := digest.FromString("manifest")
+	for _, event := range []notifications.Event{
+		{Action: notifications.EventActionPush},
+		{Action: notifications.EventActionPull},
+	} {
+		event.Target.MediaType = v1.MediaTypeImageManifest
+		event.Target.Digest = dgst
+		event.Target.Repository = "prod/app"
+		if err := r.Write(event); err != nil {
+			t.Fatalf("unexpected error writing event: %v", err)
+		}
+	}
+	for _, repository := range []string{"dev/app", "prod/tmp-1"} {
+		event := notifications.Event{Action: notifications.EventActionPush}
+		event.Target.MediaType = v1.MediaTypeImageManifest
+		event.Target.Digest = dgst
+		event.Target.Repository = repository
+		if err := r.Write(event); err != nil {
+			t.Fatalf("unexpected error writing event: %v", err)
+		}
+	}
+	// blob pushes are mirrored with their manifests
+	event := notifications.Event{Action: notifications.EventActionPush}
+	event.Target.MediaType = v1.MediaTypeImageLayer
+	event.Target.Repository = "prod/app"
+	if err := r.Write(event); err != nil {
+		t.Fatalf("unexpected error writing event: %v", err)
+	}
+
+	if n := r.remotes[0].queue.Len(); n != 3 {
+		t.Errorf("expected 3 pushes buffered for all repositories, got %d", n)
+	}
+	if n := r.remotes[1].queue.Len(); n != 1 {
+		t.Errorf("expected 1 push buffered for prod repositories, got %d", n)
+	}
+}
+
+func TestMirror(t *testing.T) {
+	ctx := context.Background()
+	nameRef, err := reference.WithName("foo/mirror")
+	if err != nil {
+		t.Fatalf("unable to parse reference: %s", err)
+	}
+
+	localRegistry, err := storage.NewRegistry(ctx, inmemory.New())
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+	localRepo, err := localRegistry.Repository(ctx, nameRef)
+	if err != nil {
+		t.Fatalf("unexpected error getting repo: %v", err)
+	}
+	remoteRegistry, err := storage.NewRegistry(ctx, inmemory.New())
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+	remoteRepo, err := remoteRegistry.Repository(ctx, nameRef)
+	if err != nil {
+		t.Fatalf("unexpected error getting repo: %v", err)
+	}
+
+	// the base layer is already known to the remote
+	base, err := remoteRepo.Blobs(ctx).Put(ctx, v1.MediaTypeImageLayer, []byte("base layer"))
+	if err != nil {
+		t.Fatalf("unexpected error putting blob: %v", err)
+	}
+	if _, err := localRepo.Blobs(ctx).Put(ctx, v1.MediaTypeImageLayer, []byte("base layer")); err != nil {
+		t.Fatalf("unexpected error putting blob: %v", err)
+	}
+	layer, err := localRepo.Blobs(ctx).Put(ctx, v1.MediaTypeImageLayer, []byte("pushed layer"))
+	if err != nil {
+		t.Fatalf("unexpected error putting blob: %v", err)
+	}
+
+	builder := ocischema.NewManifestBuilder(localRepo.Blobs(ctx), []byte("{}"), map[string]string{})
+	for _, desc := range []distribution.Descriptor{base, layer} {
+		if err := builder.AppendReference(desc); err != nil {
+			t.Fatalf("unexpected error building manifest: %v", err)
+		}
+	}
+	m, err := builder.Build(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error building manifest: %v", err)
+	}
+	lm, err := localRepo.Manifests(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dgst, err := lm.Put(ctx, m, distribution.WithTag("latest"))
+	if err != nil {
+		t.Fatalf("unexpected error pushing manifest: %v", err)
+	}
+
+	rem := &remote{
+		name:  "mirror",
+		local: localRegistry,
+		remote: func(ctx context.Context, name reference.Named, actions ...string) (distribution.Repository, error) {
+			return remoteRegistry.Repository(ctx, name)
+		},
+	}
+	if err := rem.mirror(ctx, pushqueue.Entry{Repository: "foo/mirror", Digest: dgst, Tag: "latest"}); err != nil {
+		t.Fatalf("unexpected error mirroring manifest: %v", err)
+	}
+
+	for _, desc := range m.References() {
+		if _, err := remoteRepo.Blobs(ctx).Stat(ctx, desc.Digest); err != nil {
+			t.Errorf("blob %s not mirrored: %v", desc.Digest, err)
+		}
+	}
+	rm, err := remoteRepo.Manifests(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := rm.Exists(ctx, dgst); err != nil || !exists {
+		t.Fatalf("manifest not mirrored: %v", err)
+	}
+
+	// a manifest deleted since it was pushed is dropped
+	if err := rem.mirror(ctx, pushqueue.Entry{Repository: "foo/mirror", Digest: digest.FromString("missing")}); err != nil {
+		t.Fatalf("unexpected error mirroring a missing manifest: %v", err)
+	}
+}
@@ -1,14 +1,22 @@
 package registry
 
 import (
+	"context"
 	"fmt"
+	"net/http"
 	"os"
+	"time"
 
+	"github.com/distribution/distribution/v3"
 	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/auth/tokenserver"
+	"github.com/distribution/distribution/v3/registry/handlers"
+	"github.com/distribution/distribution/v3/registry/ocilayout"
 	"github.com/distribution/distribution/v3/registry/storage"
 	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
 	"github.com/distribution/distribution/v3/version"
 	"github.com/docker/libtrust"
+	"github.com/redis/go-redis/v9"
 	"github.com/spf13/cobra"
 )
 
@@ -17,8 +25,36 @@ var showVersion bool
 func init() {
 	RootCmd.AddCommand(ServeCmd)
 	RootCmd.AddCommand(GCCmd)
+	RootCmd.AddCommand(FsckCmd)
+	RootCmd.AddCommand(TokenServerCmd)
+	RootCmd.AddCommand(CacheCmd)
+	CacheCmd.AddCommand(CachePurgeCmd)
+	RootCmd.AddCommand(ExportCmd)
+	RootCmd.AddCommand(ImportCmd)
+	RootCmd.AddCommand(WarmCmd)
+	ExportCmd.Flags().StringVarP(&layoutPath, "output", "o", "", "OCI image layout to write: a tarball if it ends with .tar, a directory otherwise")
+	ExportCmd.Flags().StringArrayVarP(&exportRepositories, "repository", "r", nil, "repository to export, as name or name:tag, all of them if none is given")
+	ImportCmd.Flags().StringVarP(&layoutPath, "input", "i", "", "OCI image layout to read: a tarball if it ends with .tar, a directory otherwise")
+	ImportCmd.Flags().StringVarP(&importRepository, "repository", "r", "", "repository to import the manifests into, instead of the one of their annotations")
+	CachePurgeCmd.Flags().StringVar(&cacheURL, "url", "", "URL of the running registry, including its http prefix")
+	CachePurgeCmd.Flags().StringVarP(&cacheUsername, "username", "u", "", "username of the admin of the registry")
+	CachePurgeCmd.Flags().StringVarP(&cachePassword, "password", "p", "", "password of the admin of the registry")
+	WarmCmd.Flags().StringVar(&warmURL, "url", "", "URL of the pull through cache, including its http prefix")
+	WarmCmd.Flags().StringVarP(&warmUsername, "username", "u", "", "username of the admin of the cache")
+	WarmCmd.Flags().StringVarP(&warmPassword, "password", "p", "", "password of the admin of the cache")
+	WarmCmd.Flags().IntVarP(&warmConcurrency, "concurrency", "c", 1, "number of blobs of an image fetched at once")
 	GCCmd.Flags().BoolVarP(&dryRun, "dry-run", "d", false, "do everything except remove the blobs")
 	GCCmd.Flags().BoolVarP(&removeUntagged, "delete-untagged", "m", false, "delete manifests that are not currently referenced via tag")
+	GCCmd.Flags().BoolVar(&removeOrphanedReferrers, "delete-orphaned-referrers", false, "delete manifests whose subject manifest is missing or deleted")
+	GCCmd.Flags().StringVarP(&gcOutput, "output", "o", "text", "output format of the collection: text, or a report of the deleted manifests and blobs in json or csv")
+	GCCmd.Flags().IntVarP(&gcConcurrency, "concurrency", "c", 1, "number of repositories marked, and of manifests and blobs deleted, at once")
+	GCCmd.Flags().Float64Var(&gcRateLimit, "rate-limit", 0, "maximum number of storage operations per second, unlimited if zero")
+	GCCmd.Flags().DurationVar(&gcCheckpointInterval, "checkpoint-interval", 5*time.Minute, "interval between the checkpoints of the mark phase, none if zero")
+	GCCmd.Flags().BoolVar(&gcResume, "resume", false, "resume the mark phase from the last checkpoint of an interrupted collection")
+	FsckCmd.Flags().BoolVar(&fsckRepair, "repair", false, "remove the corrupted blobs, dangling links and tags, and orphaned uploads")
+	FsckCmd.Flags().Float64Var(&fsckVerifySample, "verify", 0, "fraction of the blobs whose content is hashed, from 0 (none) to 1 (all)")
+	FsckCmd.Flags().DurationVar(&fsckUploadMaxAge, "upload-max-age", 168*time.Hour, "age past which uploads are orphaned, only those without start time if zero")
+	FsckCmd.Flags().StringVarP(&fsckOutput, "output", "o", "text", "output format of the problems found: text or json")
 	RootCmd.Flags().BoolVarP(&showVersion, "version", "v", false, "show the version and exit")
 }
 
@@ -38,6 +74,12 @@ var RootCmd = &cobra.Command{
 
 var dryRun bool
 var removeUntagged bool
+var removeOrphanedReferrers bool
+var gcConcurrency int
+var gcRateLimit float64
+var gcCheckpointInterval time.Duration
+var gcResume bool
+var gcOutput string
 
 // GCCmd is the cobra command that corresponds to the garbage-collect subcommand
 var GCCmd = &cobra.Command{
@@ -52,6 +94,17 @@ var GCCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
+		var report *storage.GCReport
+		switch gcOutput {
+		case "text":
+		case "json", "csv":
+			report = &storage.GCReport{}
+		default:
+			fmt.Fprintf(os.Stderr, "invalid output format %q, expected text, json or csv\n", gcOutput)
+			cmd.Usage()
+			os.Exit(1)
+		}
+
 		driver, err := factory.Create(config.Storage.Type(), config.Storage.Parameters())
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "failed to construct %s driver: %v", config.Storage.Type(), err)
@@ -71,19 +124,352 @@ var GCCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
-		registry, err := storage.NewRegistry(ctx, driver, storage.Schema1SigningKey(k))
+		options := []storage.RegistryOption{storage.Schema1SigningKey(k)}
+		// serialize the marking of the repositories with the running
+		// registry instances
+		var client redis.UniversalClient
+		if config.Redis.Addr != "" || len(config.Redis.Addrs) > 0 {
+			client = handlers.NewRedisClient(config)
+		}
+		locker, err := handlers.NewLocker(config, driver, client)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to configure locks: %v", err)
+			os.Exit(1)
+		}
+		if locker != nil {
+			options = append(options, storage.Locks(locker))
+		}
+
+		registry, err := storage.NewRegistry(ctx, driver, options...)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "failed to construct registry: %v", err)
 			os.Exit(1)
 		}
 
 		err = storage.MarkAndSweep(ctx, driver, registry, storage.GCOpts{
-			DryRun:         dryRun,
-			RemoveUntagged: removeUntagged,
+			DryRun:                  dryRun,
+			RemoveUntagged:          removeUntagged,
+			RemoveOrphanedReferrers: removeOrphanedReferrers,
+			Quiet:                   report != nil,
+			Report:                  report,
+			Concurrency:             gcConcurrency,
+			RateLimit:               gcRateLimit,
+			CheckpointInterval:      gcCheckpointInterval,
+			Resume:                  gcResume,
 		})
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "failed to garbage collect: %v", err)
 			os.Exit(1)
 		}
+
+		if report != nil {
+			if err := writeGCReport(os.Stdout, gcOutput, report); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to write the garbage collection report: %v", err)
+				os.Exit(1)
+			}
+		}
+	},
+}
+
+var fsckRepair bool
+var fsckVerifySample float64
+var fsckUploadMaxAge time.Duration
+var fsckOutput string
+
+// FsckCmd is the cobra command that corresponds to the fsck subcommand,
+// checking the consistency of the storage.
+var FsckCmd = &cobra.Command{
+	Use:   "fsck [--repair] [--verify fraction] <config>",
+	Short: "`fsck` checks the consistency of the storage",
+	Long:  "`fsck` checks the links of the repositories point at existing blobs, the tags at existing manifests, the content of the blobs matches their digest, and reports the orphaned uploads. It exits with status 1 if problems remain unrepaired.",
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := resolveConfiguration(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+			cmd.Usage()
+			os.Exit(1)
+		}
+		if fsckVerifySample < 0 || fsckVerifySample > 1 {
+			fmt.Fprintf(os.Stderr, "invalid verify fraction %v, expected a number between 0 and 1\n", fsckVerifySample)
+			cmd.Usage()
+			os.Exit(1)
+		}
+		if fsckOutput != "text" && fsckOutput != "json" {
+			fmt.Fprintf(os.Stderr, "invalid output format %q, expected text or json\n", fsckOutput)
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		driver, err := factory.Create(config.Storage.Type(), config.Storage.Parameters())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct %s driver: %v", config.Storage.Type(), err)
+			os.Exit(1)
+		}
+		// the blobs are hashed and removed through the middlewares, such as
+		// the encryption, the registry stores them with
+		driver, err = handlers.ApplyStorageMiddleware(driver, config.Middleware["storage"])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct storage middlewares: %v", err)
+			os.Exit(1)
+		}
+
+		ctx := dcontext.Background()
+		ctx, err = configureLogging(ctx, config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to configure logging with config: %s", err)
+			os.Exit(1)
+		}
+
+		k, err := libtrust.GenerateECP256PrivateKey()
+		if err != nil {
+			fmt.Fprint(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		registry, err := storage.NewRegistry(ctx, driver, storage.Schema1SigningKey(k))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct registry: %v", err)
+			os.Exit(1)
+		}
+
+		report, err := storage.Fsck(ctx, driver, registry, storage.FsckOpts{
+			VerifySample: fsckVerifySample,
+			UploadMaxAge: fsckUploadMaxAge,
+			Repair:       fsckRepair,
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to check the storage: %v", err)
+			os.Exit(1)
+		}
+
+		if err := writeFsckReport(os.Stdout, fsckOutput, report); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write the fsck report: %v", err)
+			os.Exit(1)
+		}
+		if report.Unrepaired() > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+// TokenServerCmd is the cobra command that corresponds to the token-server
+// subcommand, running the token server on its own.
+var TokenServerCmd = &cobra.Command{
+	Use:   "token-server <config>",
+	Short: "`token-server` issues the tokens of the token authentication",
+	Long:  "`token-server` issues the tokens of the token authentication to the users granted access by an ACL",
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := resolveConfiguration(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		ctx := dcontext.Background()
+		ctx, err = configureLogging(ctx, config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to configure logging with config: %s", err)
+			os.Exit(1)
+		}
+
+		if config.TokenServer.Addr == "" {
+			fmt.Fprintln(os.Stderr, "configuration error: tokenserver.addr is required")
+			os.Exit(1)
+		}
+		tokenServer, err := tokenserver.New(config.TokenServer)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+			os.Exit(1)
+		}
+		tokenPath := config.TokenServer.Path
+		if tokenPath == "" {
+			tokenPath = tokenserver.DefaultPath
+		}
+
+		mux := http.NewServeMux()
+		mux.Handle(tokenPath, tokenServer)
+
+		// the token server is served with the TLS certificate of the
+		// registry, if any
+		dcontext.GetLogger(ctx).Infof("token server listening on %v", config.TokenServer.Addr)
+		if config.HTTP.TLS.Certificate != "" {
+			err = http.ListenAndServeTLS(config.TokenServer.Addr, config.HTTP.TLS.Certificate, config.HTTP.TLS.Key, mux)
+		} else {
+			err = http.ListenAndServe(config.TokenServer.Addr, mux)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to serve tokens: %v", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// CacheCmd is the cobra command that corresponds to the cache subcommand,
+// grouping the maintenance commands of the blob descriptor cache.
+var CacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "`cache` maintains the blob descriptor cache",
+	Long:  "`cache` maintains the blob descriptor cache",
+	Run: func(cmd *cobra.Command, args []string) {
+		cmd.Usage()
+	},
+}
+
+var cacheURL string
+var cacheUsername string
+var cachePassword string
+
+// CachePurgeCmd is the cobra command that corresponds to the cache purge
+// subcommand, removing every entry of the blob descriptor cache, either
+// through the admin route of a running registry or directly from redis.
+var CachePurgeCmd = &cobra.Command{
+	Use:   "purge [--url <url> [-u username -p password]] [<config>]",
+	Short: "`purge` removes every entry of the blob descriptor cache",
+	Long:  "`purge` removes every entry of the blob descriptor cache, to be run once content is deleted from the storage by another process, such as the garbage-collect command. With --url, the cache of the running registry is purged through its admin route, whichever its kind. Otherwise, the redis cache of the configuration is purged",
+	Run: func(cmd *cobra.Command, args []string) {
+		if cacheURL != "" {
+			if err := purgeRegistryCache(context.Background(), cacheURL, adminCredentials{username: cacheUsername, password: cachePassword}); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to purge the blob descriptor cache: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+
+		config, err := resolveConfiguration(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		ctx := dcontext.Background()
+		ctx, err = configureLogging(ctx, config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to configure logging with config: %s", err)
+			os.Exit(1)
+		}
+
+		if err := purgeRedisCache(ctx, config); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to purge the blob descriptor cache: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+var layoutPath string
+var exportRepositories []string
+var importRepository string
+
+// ExportCmd is the cobra command that corresponds to the export subcommand,
+// writing repositories to an OCI image layout.
+var ExportCmd = &cobra.Command{
+	Use:   "export -o <layout> [-r repository[:tag]]... <config>",
+	Short: "`export` writes repositories to an OCI image layout",
+	Long:  "`export` writes the tagged manifests of repositories, and the content they reference, from the storage to an OCI image layout directory or tarball",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, registry := layoutRegistry(cmd, args)
+
+		if err := ocilayout.Export(ctx, registry, exportRepositories, layoutPath); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to export to %s: %v\n", layoutPath, err)
+			os.Exit(1)
+		}
+	},
+}
+
+// ImportCmd is the cobra command that corresponds to the import subcommand,
+// loading repositories from an OCI image layout.
+var ImportCmd = &cobra.Command{
+	Use:   "import -i <layout> [-r repository] <config>",
+	Short: "`import` loads repositories from an OCI image layout",
+	Long:  "`import` loads the manifests of an OCI image layout directory or tarball, and the content they reference, into the storage and tags them",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, registry := layoutRegistry(cmd, args)
+
+		if err := ocilayout.Import(ctx, registry, layoutPath, importRepository); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to import from %s: %v\n", layoutPath, err)
+			os.Exit(1)
+		}
+	},
+}
+
+// layoutRegistry returns the registry of the storage of the configuration
+// of the export and import commands, which maintains the catalog index and
+// the references of the online garbage collector when they are enabled.
+func layoutRegistry(cmd *cobra.Command, args []string) (context.Context, distribution.Namespace) {
+	config, err := resolveConfiguration(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+		cmd.Usage()
+		os.Exit(1)
+	}
+	if layoutPath == "" {
+		fmt.Fprintf(os.Stderr, "image layout path unspecified\n")
+		cmd.Usage()
+		os.Exit(1)
+	}
+
+	driver, err := factory.Create(config.Storage.Type(), config.Storage.Parameters())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to construct %s driver: %v", config.Storage.Type(), err)
+		os.Exit(1)
+	}
+
+	ctx := dcontext.Background()
+	ctx, err = configureLogging(ctx, config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to configure logging with config: %s", err)
+		os.Exit(1)
+	}
+
+	k, err := libtrust.GenerateECP256PrivateKey()
+	if err != nil {
+		fmt.Fprint(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	options := []storage.RegistryOption{storage.Schema1SigningKey(k)}
+	if config.Catalog.Index.Enabled {
+		options = append(options, storage.EnableCatalogIndex)
+	}
+	if mc, ok := config.Storage["maintenance"]; ok {
+		if gc, ok := mc["onlinegc"].(map[interface{}]interface{}); ok && gc["enabled"] == true {
+			options = append(options, storage.EnableMarkLog)
+		}
+	}
+
+	registry, err := storage.NewRegistry(ctx, driver, options...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to construct registry: %v", err)
+		os.Exit(1)
+	}
+	return ctx, registry
+}
+
+var warmURL string
+var warmUsername string
+var warmPassword string
+var warmConcurrency int
+
+// WarmCmd is the cobra command that corresponds to the warm subcommand,
+// priming a pull through cache through its admin route.
+var WarmCmd = &cobra.Command{
+	Use:   "warm --url <url> [-u username -p password] <reference>...",
+	Short: "`warm` pulls images through a running pull through cache",
+	Long:  "`warm` requests a running pull through cache to fetch the manifests and blobs of images from its remote, so that they are served from its storage when they are pulled",
+	Run: func(cmd *cobra.Command, args []string) {
+		if warmURL == "" || len(args) == 0 {
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		images, err := warmCache(context.Background(), warmURL, adminCredentials{username: warmUsername, password: warmPassword}, args, warmConcurrency)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to warm the cache: %v\n", err)
+			os.Exit(1)
+		}
+		if !writeWarmedImages(os.Stdout, images) {
+			os.Exit(1)
+		}
 	},
 }
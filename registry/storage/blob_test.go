@@ -9,11 +9,14 @@ import (
 	"io/ioutil"
 	"path"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/reference"
 	"github.com/distribution/distribution/v3/registry/storage/cache/memory"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/distribution/distribution/v3/registry/storage/driver/testdriver"
 	"github.com/distribution/distribution/v3/testutil"
 	"github.com/opencontainers/go-digest"
@@ -514,6 +517,77 @@ func TestBlobMount(t *testing.T) {
 	}
 }
 
+// TestBlobMountFallback covers mounts from a source repository missing the
+// blob, which fall back to the blobs of the registry when enabled.
+func TestBlobMountFallback(t *testing.T) {
+	ctx := context.Background()
+	imageName, _ := reference.WithName("foo/bar")
+	sourceImageName, _ := reference.WithName("foo/source")
+	otherImageName, _ := reference.WithName("foo/other")
+	registry, err := NewRegistry(ctx, testdriver.New(), BlobDescriptorCacheProvider(memory.NewInMemoryBlobDescriptorCacheProvider(memory.UnlimitedSize)))
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+
+	repository, err := registry.Repository(ctx, imageName)
+	if err != nil {
+		t.Fatalf("unexpected error getting repo: %v", err)
+	}
+	otherRepository, err := registry.Repository(ctx, otherImageName)
+	if err != nil {
+		t.Fatalf("unexpected error getting repo: %v", err)
+	}
+
+	// the blob is only stored by another repository than the source
+	desc, err := otherRepository.Blobs(ctx).Put(ctx, "application/octet-stream", []byte("fallback layer"))
+	if err != nil {
+		t.Fatalf("unexpected error putting blob: %v", err)
+	}
+
+	canonicalRef, err := reference.WithDigest(sourceImageName, desc.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bs := repository.Blobs(ctx)
+	bw, err := bs.Create(ctx, WithMountFrom(canonicalRef))
+	if err != nil {
+		t.Fatalf("unexpected error starting upload without fallback: %v", err)
+	}
+	if err := bw.Cancel(ctx); err != nil {
+		t.Fatalf("unexpected error cancelling upload: %v", err)
+	}
+
+	bw, err = bs.Create(ctx, WithMountFrom(canonicalRef), WithMountFallback())
+	if bw != nil {
+		t.Fatal("unexpected blobwriter returned from Create call, should mount instead")
+	}
+	ebm, ok := err.(distribution.ErrBlobMounted)
+	if !ok {
+		t.Fatalf("unexpected error mounting layer: %v", err)
+	}
+	if ebm.Descriptor.Digest != desc.Digest || ebm.Descriptor.Size != desc.Size {
+		t.Fatalf("descriptors not equal: %v != %v", ebm.Descriptor, desc)
+	}
+
+	if _, err := bs.Stat(ctx, desc.Digest); err != nil {
+		t.Fatalf("unexpected error checking for existence: %v", err)
+	}
+
+	// blobs missing from the registry are uploaded
+	missingRef, err := reference.WithDigest(sourceImageName, digest.FromString("missing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bw, err = bs.Create(ctx, WithMountFrom(missingRef), WithMountFallback())
+	if err != nil {
+		t.Fatalf("unexpected error starting upload of missing blob: %v", err)
+	}
+	if err := bw.Cancel(ctx); err != nil {
+		t.Fatalf("unexpected error cancelling upload: %v", err)
+	}
+}
+
 // TestLayerUploadZeroLength uploads zero-length
 func TestLayerUploadZeroLength(t *testing.T) {
 	ctx := context.Background()
@@ -532,6 +606,196 @@ func TestLayerUploadZeroLength(t *testing.T) {
 	simpleUpload(t, bs, []byte{}, digestSha256Empty)
 }
 
+// TestBlobUploadChunks ensures the chunks of an upload written out of order
+// are held until the data before them is.
+func TestBlobUploadChunks(t *testing.T) {
+	ctx := context.Background()
+	imageName, _ := reference.WithName("foo/bar")
+	driver := testdriver.New()
+	registry, err := NewRegistry(ctx, driver, BlobDescriptorCacheProvider(memory.NewInMemoryBlobDescriptorCacheProvider(memory.UnlimitedSize)), EnableDelete)
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+	repository, err := registry.Repository(ctx, imageName)
+	if err != nil {
+		t.Fatalf("unexpected error getting repo: %v", err)
+	}
+	bs := repository.Blobs(ctx)
+
+	upload, err := bs.Create(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error starting upload: %v", err)
+	}
+	id := upload.ID()
+	upload.Close()
+
+	content := bytes.Repeat([]byte("0123456789"), 30)
+	writeChunk := func(offset, end int64) (int64, error) {
+		wr, err := bs.Resume(ctx, id)
+		if err != nil {
+			t.Fatalf("unexpected error resuming upload: %v", err)
+		}
+		err = wr.(distribution.BlobChunkWriter).WriteChunk(ctx, offset, end-offset, bytes.NewReader(content[offset:end]))
+		if err := wr.Close(); err != nil {
+			t.Fatalf("unexpected error closing upload: %v", err)
+		}
+		return wr.Size(), err
+	}
+
+	for _, chunk := range []struct {
+		offset, end int64
+		size        int64
+		err         error
+	}{
+		{offset: 200, end: 300, size: 0},
+		{offset: 100, end: 200, size: 0},
+		// overlapping a chunk held
+		{offset: 150, end: 250, size: 0, err: distribution.ErrBlobChunkOverlap},
+		{offset: 0, end: 100, size: 300},
+		// overlapping the data written
+		{offset: 250, end: 300, size: 300, err: distribution.ErrBlobChunkOverlap},
+	} {
+		size, err := writeChunk(chunk.offset, chunk.end)
+		if err != chunk.err {
+			t.Fatalf("unexpected error writing chunk %d-%d: %v != %v", chunk.offset, chunk.end, err, chunk.err)
+		}
+		if size != chunk.size {
+			t.Fatalf("unexpected size after writing chunk %d-%d: %d != %d", chunk.offset, chunk.end, size, chunk.size)
+		}
+	}
+
+	wr, err := bs.Resume(ctx, id)
+	if err != nil {
+		t.Fatalf("unexpected error resuming upload: %v", err)
+	}
+	desc, err := wr.Commit(ctx, distribution.Descriptor{Digest: digest.FromBytes(content)})
+	if err != nil {
+		t.Fatalf("unexpected error committing upload: %v", err)
+	}
+	if desc.Size != int64(len(content)) {
+		t.Fatalf("unexpected size of the blob: %d != %d", desc.Size, len(content))
+	}
+}
+
+// TestBlobUploadHeldChunksLimit ensures the chunks of an upload written out
+// of order are rejected once too many are held.
+func TestBlobUploadHeldChunksLimit(t *testing.T) {
+	ctx := context.Background()
+	imageName, _ := reference.WithName("foo/bar")
+	driver := testdriver.New()
+	registry, err := NewRegistry(ctx, driver, BlobDescriptorCacheProvider(memory.NewInMemoryBlobDescriptorCacheProvider(memory.UnlimitedSize)), EnableDelete)
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+	repository, err := registry.Repository(ctx, imageName)
+	if err != nil {
+		t.Fatalf("unexpected error getting repo: %v", err)
+	}
+	bs := repository.Blobs(ctx)
+
+	wr, err := bs.Create(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error starting upload: %v", err)
+	}
+	cw := wr.(distribution.BlobChunkWriter)
+
+	for offset := int64(1); offset <= maxHeldChunks; offset++ {
+		if err := cw.WriteChunk(ctx, offset, 1, bytes.NewReader([]byte{'a'})); err != nil {
+			t.Fatalf("unexpected error holding chunk %d: %v", offset, err)
+		}
+	}
+	if err := cw.WriteChunk(ctx, maxHeldChunks+1, 1, bytes.NewReader([]byte{'a'})); err != distribution.ErrBlobTooManyChunks {
+		t.Fatalf("expected ErrBlobTooManyChunks holding one more chunk, got %v", err)
+	}
+
+	// the chunk the held ones follow is still accepted
+	if err := cw.WriteChunk(ctx, 0, 1, bytes.NewReader([]byte{'a'})); err != nil {
+		t.Fatalf("unexpected error writing the first chunk: %v", err)
+	}
+	desc, err := wr.Commit(ctx, distribution.Descriptor{Digest: digest.FromBytes(bytes.Repeat([]byte{'a'}, maxHeldChunks+1))})
+	if err != nil {
+		t.Fatalf("unexpected error committing upload: %v", err)
+	}
+	if desc.Size != maxHeldChunks+1 {
+		t.Fatalf("unexpected size of the blob: %d != %d", desc.Size, maxHeldChunks+1)
+	}
+}
+
+// slowListDriver lists slowly, so that the requests for concurrent chunks
+// interleave between the listing of the chunks held and their writes.
+type slowListDriver struct {
+	storagedriver.StorageDriver
+}
+
+func (d slowListDriver) List(ctx context.Context, path string) ([]string, error) {
+	time.Sleep(time.Millisecond)
+	return d.StorageDriver.List(ctx, path)
+}
+
+// TestBlobUploadParallelChunks checks that the chunks of an upload sent in
+// parallel are all written, without a locker.
+func TestBlobUploadParallelChunks(t *testing.T) {
+	ctx := context.Background()
+	imageName, _ := reference.WithName("foo/bar")
+	driver := slowListDriver{testdriver.New()}
+	registry, err := NewRegistry(ctx, driver, BlobDescriptorCacheProvider(memory.NewInMemoryBlobDescriptorCacheProvider(memory.UnlimitedSize)), EnableDelete)
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+	repository, err := registry.Repository(ctx, imageName)
+	if err != nil {
+		t.Fatalf("unexpected error getting repo: %v", err)
+	}
+	bs := repository.Blobs(ctx)
+
+	upload, err := bs.Create(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error starting upload: %v", err)
+	}
+	id := upload.ID()
+	upload.Close()
+
+	// the upload is committed by a writer resumed before the chunks were
+	// written, the data they append being committed under the upload lock
+	committer, err := bs.Resume(ctx, id)
+	if err != nil {
+		t.Fatalf("unexpected error resuming upload: %v", err)
+	}
+
+	const chunkSize, chunks = 100, 20
+	content := bytes.Repeat([]byte("0123456789"), chunkSize*chunks/10)
+	var wg sync.WaitGroup
+	errs := make(chan error, chunks)
+	for i := 0; i < chunks; i++ {
+		wg.Add(1)
+		go func(offset int64) {
+			defer wg.Done()
+			wr, err := bs.Resume(ctx, id)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer wr.Close()
+			errs <- wr.(distribution.BlobChunkWriter).WriteChunk(ctx, offset, chunkSize, bytes.NewReader(content[offset:offset+chunkSize]))
+		}(int64(i * chunkSize))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("unexpected error writing chunk: %v", err)
+		}
+	}
+
+	desc, err := committer.Commit(ctx, distribution.Descriptor{Digest: digest.FromBytes(content)})
+	if err != nil {
+		t.Fatalf("unexpected error committing upload: %v", err)
+	}
+	if desc.Size != int64(len(content)) {
+		t.Fatalf("unexpected size of the blob: %d != %d", desc.Size, len(content))
+	}
+}
+
 func simpleUpload(t *testing.T, bs distribution.BlobIngester, blob []byte, expectedDigest digest.Digest) {
 	ctx := context.Background()
 	wr, err := bs.Create(ctx)
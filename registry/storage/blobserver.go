@@ -4,26 +4,112 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/tracing"
 	"github.com/opencontainers/go-digest"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-// TODO(stevvooe): This should configurable in the future.
+// blobCacheControlMaxAge is the default max-age of blob responses. Blobs are
+// content addressable, so they can be cached for a long time.
 const blobCacheControlMaxAge = 365 * 24 * time.Hour
 
+// The headers delegating the serving of blobs to the web server fronting the
+// registry.
+const (
+	// XAccelRedirect is the header of nginx, whose value is the URI of an
+	// internal location.
+	XAccelRedirect = "X-Accel-Redirect"
+	// XSendfile is the header of Apache and lighttpd, whose value is the
+	// path of a file.
+	XSendfile = "X-Sendfile"
+)
+
+// CacheControl describes the Cache-Control header set on blob responses.
+type CacheControl struct {
+	// MaxAge is the max-age directive.
+	MaxAge time.Duration
+
+	// Immutable adds the immutable directive.
+	Immutable bool
+
+	// NoStore replaces all directives with no-store.
+	NoStore bool
+}
+
+// String returns the value of the Cache-Control header.
+func (cc CacheControl) String() string {
+	if cc.NoStore {
+		return "no-store"
+	}
+
+	value := fmt.Sprintf("max-age=%.f", cc.MaxAge.Seconds())
+	if cc.Immutable {
+		value += ", immutable"
+	}
+	return value
+}
+
 // blobServer simply serves blobs from a driver instance using a path function
 // to identify paths and a descriptor service to fill in metadata.
 type blobServer struct {
 	driver   driver.StorageDriver
 	statter  distribution.BlobStatter
 	pathFn   func(dgst digest.Digest) (string, error)
-	redirect bool // allows disabling URLFor redirects
+	redirect bool         // allows disabling URLFor redirects
+	encoder  *blobEncoder // serves pre-compressed variants, if enabled
+
+	// tocIndexer serves the table of contents of seekable layers in the
+	// response headers, if set.
+	tocIndexer *blobTOCIndexer
+
+	// redirectExpiry is how long the redirect URLs remain valid, the default
+	// of the storage driver being used when zero.
+	redirectExpiry time.Duration
+	// redirectBaseURL replaces the scheme and host of the redirect URLs, if
+	// set.
+	redirectBaseURL *url.URL
+
+	// cacheControl is the Cache-Control of responses, unless overridden for
+	// the media type of the blob by mediaTypeCacheControl.
+	cacheControl          CacheControl
+	mediaTypeCacheControl map[string]CacheControl
+
+	// readBufferSize is the size of the buffer of the blobs served
+	// directly, the default of the file reader being used when zero.
+	readBufferSize int
+
+	// sendfileHeader delegates the serving of the blobs not redirected to
+	// the web server fronting the registry, with their path in the storage
+	// appended to sendfilePrefix as its value, if set.
+	sendfileHeader string
+	sendfilePrefix string
+}
+
+// rangeCoalesceGap is the largest gap between two requested ranges which are
+// coalesced into one, about the overhead of a part of a multipart response.
+const rangeCoalesceGap = 128
+
+// cacheControlFor returns the Cache-Control header value for a blob of the
+// given media type.
+func (bs *blobServer) cacheControlFor(mediaType string) string {
+	if cc, ok := bs.mediaTypeCacheControl[mediaType]; ok {
+		return cc.String()
+	}
+	return bs.cacheControl.String()
 }
 
 func (bs *blobServer) ServeBlob(ctx context.Context, w http.ResponseWriter, r *http.Request, dgst digest.Digest) error {
+	ctx, span := tracing.StartSpan(ctx, "blobServer.ServeBlob", attribute.String("digest", dgst.String()))
+	defer span.End()
+
 	desc, err := bs.statter.Stat(ctx, dgst)
 	if err != nil {
 		return err
@@ -34,10 +120,64 @@ func (bs *blobServer) ServeBlob(ctx context.Context, w http.ResponseWriter, r *h
 		return err
 	}
 
-	if bs.redirect {
-		redirectURL, err := bs.driver.URLFor(ctx, path, map[string]interface{}{"method": r.Method})
+	// chunkRanges is set when the Range header fetches chunks, which are
+	// translated to byte ranges the storage backends and web servers do
+	// not know of, so the blob is then served by the registry itself.
+	var chunkRanges bool
+	if bs.tocIndexer != nil {
+		// The headers are set on redirects as well, so that clients get
+		// them from a HEAD request.
+		toc, err := bs.tocIndexer.toc(ctx, desc.Digest)
+		switch err.(type) {
+		case nil:
+			toc.setHeaders(w.Header())
+			var ranges string
+			ranges, chunkRanges, err = bs.tocIndexer.chunkRanges(ctx, desc.Digest, toc, r.Header.Get("Range"))
+			if err != nil {
+				return err
+			}
+			if chunkRanges {
+				r.Header.Set("Range", ranges)
+			}
+		case driver.PathNotFoundError:
+			// Not a seekable layer, or pushed before the index was enabled.
+		default:
+			return err
+		}
+	}
+
+	if bs.encoder != nil && !chunkRanges {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		// A pre-compressed variant is served directly rather than through a
+		// redirect, as the storage backend would not set Content-Encoding.
+		if encoding := bs.encoder.negotiateEncoding(r); encoding != "" {
+			variant, variantPath, err := bs.encoder.variant(ctx, desc.Digest, encoding)
+			switch err.(type) {
+			case nil:
+				return bs.serveEncodedBlob(ctx, w, r, desc, variant, variantPath, encoding)
+			case driver.PathNotFoundError:
+				// Fallback to serving the blob as is.
+			default:
+				return err
+			}
+		}
+	}
+
+	if bs.redirect && !chunkRanges {
+		options := map[string]interface{}{"method": r.Method}
+		if bs.redirectExpiry > 0 {
+			options["expiry"] = time.Now().Add(bs.redirectExpiry)
+		}
+		redirectURL, err := bs.driver.URLFor(ctx, path, options)
 		switch err.(type) {
 		case nil:
+			if bs.redirectBaseURL != nil {
+				redirectURL, err = rewriteRedirectURL(redirectURL, bs.redirectBaseURL)
+				if err != nil {
+					return err
+				}
+			}
 			// Redirect to storage URL.
 			http.Redirect(w, r, redirectURL, http.StatusTemporaryRedirect)
 			return err
@@ -50,14 +190,36 @@ func (bs *blobServer) ServeBlob(ctx context.Context, w http.ResponseWriter, r *h
 		}
 	}
 
-	br, err := newFileReader(ctx, bs.driver, path, desc.Size)
+	if bs.sendfileHeader != "" && !chunkRanges {
+		bs.setBlobHeaders(w, desc)
+		// The web server serves the file, handling ranges and conditional
+		// requests, and sets the length of the response.
+		w.Header().Set(bs.sendfileHeader, bs.sendfilePrefix+path)
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	br, err := bs.newFileReader(ctx, path, desc.Size)
 	if err != nil {
 		return err
 	}
 	defer br.Close()
 
+	bs.setBlobHeaders(w, desc)
+
+	if w.Header().Get("Content-Length") == "" {
+		// Set the content length if not already set.
+		w.Header().Set("Content-Length", fmt.Sprint(desc.Size))
+	}
+
+	coalesceRanges(r, br.size)
+	http.ServeContent(w, r, desc.Digest.String(), time.Time{}, br)
+	return nil
+}
+
+// setBlobHeaders sets the headers describing the blob of a response.
+func (bs *blobServer) setBlobHeaders(w http.ResponseWriter, desc distribution.Descriptor) {
 	w.Header().Set("ETag", fmt.Sprintf(`"%s"`, desc.Digest)) // If-None-Match handled by ServeContent
-	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%.f", blobCacheControlMaxAge.Seconds()))
 
 	if w.Header().Get("Docker-Content-Digest") == "" {
 		w.Header().Set("Docker-Content-Digest", desc.Digest.String())
@@ -68,11 +230,139 @@ func (bs *blobServer) ServeBlob(ctx context.Context, w http.ResponseWriter, r *h
 		w.Header().Set("Content-Type", desc.MediaType)
 	}
 
-	if w.Header().Get("Content-Length") == "" {
-		// Set the content length if not already set.
-		w.Header().Set("Content-Length", fmt.Sprint(desc.Size))
+	w.Header().Set("Cache-Control", bs.cacheControlFor(w.Header().Get("Content-Type")))
+}
+
+// serveEncodedBlob serves the variant of the blob described by desc in the
+// given content encoding. The Content-Type and Docker-Content-Digest headers
+// describe the blob, as for the blob itself, while the ETag identifies the
+// encoded representation, so that conditional and range requests apply to
+// the variant.
+func (bs *blobServer) serveEncodedBlob(ctx context.Context, w http.ResponseWriter, r *http.Request, desc, variant distribution.Descriptor, path, encoding string) error {
+	br, err := bs.newFileReader(ctx, path, variant.Size)
+	if err != nil {
+		return err
+	}
+	defer br.Close()
+
+	bs.setBlobHeaders(w, desc)
+	w.Header().Set("ETag", fmt.Sprintf(`"%s"`, variant.Digest)) // If-None-Match handled by ServeContent
+	w.Header().Set("Content-Encoding", encoding)
+
+	// http.ServeContent does not set the length of encoded content, but for
+	// range requests. The Content-Length of the blob does not apply to its
+	// variant.
+	if r.Header.Get("Range") == "" {
+		w.Header().Set("Content-Length", fmt.Sprint(variant.Size))
 	}
 
+	coalesceRanges(r, br.size)
 	http.ServeContent(w, r, desc.Digest.String(), time.Time{}, br)
 	return nil
 }
+
+// rewriteRedirectURL replaces the scheme and host of the redirect URL with
+// those of baseURL, keeping its path and query, which carry the signature of
+// the storage backend.
+func rewriteRedirectURL(redirectURL string, baseURL *url.URL) (string, error) {
+	u, err := url.Parse(redirectURL)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse redirect URL: %v", err)
+	}
+	u.Scheme = baseURL.Scheme
+	u.Host = baseURL.Host
+	return u.String(), nil
+}
+
+// newFileReader returns a reader of the file at path, buffered with the read
+// buffer size of the server.
+func (bs *blobServer) newFileReader(ctx context.Context, path string, size int64) (*fileReader, error) {
+	fr, err := newFileReader(ctx, bs.driver, path, size)
+	if err != nil {
+		return nil, err
+	}
+	if bs.readBufferSize > 0 {
+		fr.bufferSize = bs.readBufferSize
+	}
+	return fr, nil
+}
+
+// byteRange is a range of bytes of a blob, both ends included.
+type byteRange struct {
+	start, end int64
+}
+
+// coalesceRanges rewrites the Range header of a request for several ranges of
+// a blob of the given size, sorting them and merging those which overlap or
+// are separated by a small gap. The multipart response then has fewer parts,
+// read sequentially from the storage. Headers which cannot be parsed
+// are left to http.ServeContent to reject.
+func coalesceRanges(r *http.Request, size int64) {
+	header := r.Header.Get("Range")
+	if !strings.HasPrefix(header, "bytes=") || !strings.Contains(header, ",") {
+		return
+	}
+
+	var ranges []byteRange
+	for _, spec := range strings.Split(strings.TrimPrefix(header, "bytes="), ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		first, last, ok := strings.Cut(spec, "-")
+		if !ok {
+			return
+		}
+		var br byteRange
+		if first == "" {
+			// suffix range, the last bytes of the blob
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n <= 0 {
+				return
+			}
+			if n > size {
+				n = size
+			}
+			br = byteRange{start: size - n, end: size - 1}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 || start >= size {
+				return
+			}
+			br = byteRange{start: start, end: size - 1}
+			if last != "" {
+				end, err := strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					return
+				}
+				if end < size-1 {
+					br.end = end
+				}
+			}
+		}
+		ranges = append(ranges, br)
+	}
+	if len(ranges) < 2 {
+		return
+	}
+
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].start < ranges[j].start
+	})
+	coalesced := ranges[:1]
+	for _, br := range ranges[1:] {
+		current := &coalesced[len(coalesced)-1]
+		if br.start <= current.end+1+rangeCoalesceGap {
+			if br.end > current.end {
+				current.end = br.end
+			}
+			continue
+		}
+		coalesced = append(coalesced, br)
+	}
+	specs := make([]string, len(coalesced))
+	for i, br := range coalesced {
+		specs[i] = fmt.Sprintf("%d-%d", br.start, br.end)
+	}
+	r.Header.Set("Range", "bytes="+strings.Join(specs, ","))
+}
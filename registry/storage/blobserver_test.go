@@ -0,0 +1,301 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/reference"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/testdriver"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestCacheControlString(t *testing.T) {
+	for _, tc := range []struct {
+		cacheControl CacheControl
+		expected     string
+	}{
+		{cacheControl: CacheControl{MaxAge: blobCacheControlMaxAge}, expected: "max-age=31536000"},
+		{cacheControl: CacheControl{MaxAge: time.Hour, Immutable: true}, expected: "max-age=3600, immutable"},
+		{cacheControl: CacheControl{MaxAge: time.Hour, Immutable: true, NoStore: true}, expected: "no-store"},
+	} {
+		if value := tc.cacheControl.String(); value != tc.expected {
+			t.Errorf("%+v: expected %q, got %q", tc.cacheControl, tc.expected, value)
+		}
+	}
+}
+
+// TestServeBlobCacheControl ensures the configured Cache-Control is set on
+// blob responses, and overridden for configured media types.
+func TestServeBlobCacheControl(t *testing.T) {
+	ctx := context.Background()
+	imageName, _ := reference.WithName("foo/bar")
+
+	contents := []byte("cache control")
+	dgst := digest.FromBytes(contents)
+
+	for _, tc := range []struct {
+		name     string
+		options  []RegistryOption
+		expected string
+	}{
+		{
+			name:     "default",
+			expected: "max-age=31536000",
+		},
+		{
+			name: "configured",
+			options: []RegistryOption{
+				BlobCacheControl(CacheControl{MaxAge: 24 * time.Hour, Immutable: true}, nil),
+			},
+			expected: "max-age=86400, immutable",
+		},
+		{
+			name: "media type",
+			options: []RegistryOption{
+				BlobCacheControl(CacheControl{MaxAge: 24 * time.Hour}, map[string]CacheControl{
+					"application/octet-stream": {NoStore: true},
+				}),
+			},
+			expected: "no-store",
+		},
+	} {
+		registry, err := NewRegistry(ctx, testdriver.New(), tc.options...)
+		if err != nil {
+			t.Fatalf("%s: error creating registry: %v", tc.name, err)
+		}
+		repository, err := registry.Repository(ctx, imageName)
+		if err != nil {
+			t.Fatalf("%s: unexpected error getting repo: %v", tc.name, err)
+		}
+		bs := repository.Blobs(ctx)
+
+		if _, err := addBlob(ctx, bs, distribution.Descriptor{Digest: dgst, Size: int64(len(contents))}, bytes.NewReader(contents)); err != nil {
+			t.Fatalf("%s: error adding blob: %v", tc.name, err)
+		}
+
+		w := httptest.NewRecorder()
+		if err := bs.ServeBlob(ctx, w, httptest.NewRequest(http.MethodGet, "/", nil), dgst); err != nil {
+			t.Fatalf("%s: unexpected error serving blob: %v", tc.name, err)
+		}
+
+		if cacheControl := w.Header().Get("Cache-Control"); cacheControl != tc.expected {
+			t.Fatalf("%s: expected Cache-Control %q, got %q", tc.name, tc.expected, cacheControl)
+		}
+	}
+}
+
+// urlForDriver returns signed-like URLs to the storage, recording the expiry
+// they were requested with.
+type urlForDriver struct {
+	storagedriver.StorageDriver
+	expiry time.Time
+}
+
+func (d *urlForDriver) URLFor(ctx context.Context, path string, options map[string]interface{}) (string, error) {
+	d.expiry, _ = options["expiry"].(time.Time)
+	return "https://bucket.storage.example.com" + path + "?signature=abc", nil
+}
+
+// TestServeBlobRedirect ensures the redirect URLs have the configured expiry
+// and base URL.
+func TestServeBlobRedirect(t *testing.T) {
+	ctx := context.Background()
+	imageName, _ := reference.WithName("foo/bar")
+
+	contents := []byte("redirect")
+	dgst := digest.FromBytes(contents)
+
+	driver := &urlForDriver{StorageDriver: testdriver.New()}
+	baseURL, _ := url.Parse("https://cdn.example.com")
+	registry, err := NewRegistry(ctx, driver, EnableRedirect, RedirectExpiry(time.Hour), RedirectBaseURL(baseURL))
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+	repository, err := registry.Repository(ctx, imageName)
+	if err != nil {
+		t.Fatalf("unexpected error getting repo: %v", err)
+	}
+	bs := repository.Blobs(ctx)
+
+	if _, err := addBlob(ctx, bs, distribution.Descriptor{Digest: dgst, Size: int64(len(contents))}, bytes.NewReader(contents)); err != nil {
+		t.Fatalf("error adding blob: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	if err := bs.ServeBlob(ctx, w, httptest.NewRequest(http.MethodGet, "/", nil), dgst); err != nil {
+		t.Fatalf("unexpected error serving blob: %v", err)
+	}
+
+	if w.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("expected a redirect, got status %d", w.Code)
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("unexpected error parsing location: %v", err)
+	}
+	if location.Host != "cdn.example.com" || location.RawQuery != "signature=abc" {
+		t.Errorf("unexpected redirect location %s", location)
+	}
+	if expiresIn := time.Until(driver.expiry); expiresIn < 59*time.Minute || expiresIn > time.Hour {
+		t.Errorf("unexpected redirect expiry %v", driver.expiry)
+	}
+
+	if _, err := NewRegistry(ctx, driver, RedirectBaseURL(&url.URL{Path: "/cdn"})); err == nil {
+		t.Error("expected an error for a redirect base URL without host")
+	}
+}
+
+func TestServeBlobSendfile(t *testing.T) {
+	ctx := context.Background()
+	imageName, _ := reference.WithName("foo/bar")
+
+	contents := []byte("sendfile")
+	dgst := digest.FromBytes(contents)
+
+	driver := &readerCountingDriver{StorageDriver: testdriver.New()}
+	registry, err := NewRegistry(ctx, driver, BlobSendfile("x-accel-redirect", "/_registry/"))
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+	repository, err := registry.Repository(ctx, imageName)
+	if err != nil {
+		t.Fatalf("unexpected error getting repo: %v", err)
+	}
+	bs := repository.Blobs(ctx)
+	if _, err := addBlob(ctx, bs, distribution.Descriptor{Digest: dgst, Size: int64(len(contents))}, bytes.NewReader(contents)); err != nil {
+		t.Fatalf("error adding blob: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	driver.readers = 0
+	if err := bs.ServeBlob(ctx, w, httptest.NewRequest(http.MethodGet, "/", nil), dgst); err != nil {
+		t.Fatalf("unexpected error serving blob: %v", err)
+	}
+	if w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Fatalf("unexpected response %d with %d bytes", w.Code, w.Body.Len())
+	}
+	if driver.readers != 0 {
+		t.Errorf("expected the blob not to be read, got %d readers", driver.readers)
+	}
+	blobPath, _ := pathFor(blobDataPathSpec{digest: dgst})
+	if location := w.Header().Get("X-Accel-Redirect"); location != "/_registry"+blobPath {
+		t.Errorf("unexpected X-Accel-Redirect %q", location)
+	}
+	if w.Header().Get("Docker-Content-Digest") != dgst.String() {
+		t.Errorf("unexpected Docker-Content-Digest %q", w.Header().Get("Docker-Content-Digest"))
+	}
+
+	if _, err := NewRegistry(ctx, driver, BlobSendfile("X-Forwarded-For", "")); err == nil {
+		t.Error("expected an error for an unknown sendfile header")
+	}
+}
+
+// readerCountingDriver counts the readers opened on the storage.
+type readerCountingDriver struct {
+	storagedriver.StorageDriver
+	readers int
+}
+
+func (d *readerCountingDriver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	d.readers++
+	return d.StorageDriver.Reader(ctx, path, offset)
+}
+
+func TestCoalesceRanges(t *testing.T) {
+	for _, tc := range []struct {
+		header   string
+		expected string
+	}{
+		{header: "bytes=0-99", expected: "bytes=0-99"},
+		{header: "bytes=0-99,100-199", expected: "bytes=0-199"},
+		{header: "bytes=400-499, 0-99,100-149", expected: "bytes=0-149,400-499"},
+		{header: "bytes=0-99,50-79,400-", expected: "bytes=0-99,400-999"},
+		{header: "bytes=500-599,0-99", expected: "bytes=0-99,500-599"},
+		{header: "bytes=0-99,-900", expected: "bytes=0-999"},
+		{header: "bytes=0-99,500-599", expected: "bytes=0-99,500-599"},
+		{header: "bytes=0-99,0-99999", expected: "bytes=0-999"},
+		{header: "bytes=0-99,1000-1099", expected: "bytes=0-99,1000-1099"}, // unsatisfiable
+		{header: "bytes=0-99,x-1", expected: "bytes=0-99,x-1"},
+		{header: "items=0-99,100-199", expected: "items=0-99,100-199"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Range", tc.header)
+		coalesceRanges(r, 1000)
+		if header := r.Header.Get("Range"); header != tc.expected {
+			t.Errorf("%q: expected %q, got %q", tc.header, tc.expected, header)
+		}
+	}
+}
+
+// TestServeBlobRanges ensures that the ranges of a multipart response are
+// read from a single reader of the storage.
+func TestServeBlobRanges(t *testing.T) {
+	ctx := context.Background()
+	imageName, _ := reference.WithName("foo/bar")
+
+	contents := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	dgst := digest.FromBytes(contents)
+
+	driver := &readerCountingDriver{StorageDriver: testdriver.New()}
+	registry, err := NewRegistry(ctx, driver, ReadBufferSize(1<<10))
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+	repository, err := registry.Repository(ctx, imageName)
+	if err != nil {
+		t.Fatalf("unexpected error getting repo: %v", err)
+	}
+	bs := repository.Blobs(ctx)
+	if _, err := addBlob(ctx, bs, distribution.Descriptor{Digest: dgst, Size: int64(len(contents))}, bytes.NewReader(contents)); err != nil {
+		t.Fatalf("error adding blob: %v", err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Range", "bytes=0-99,600-699,300-399")
+	w := httptest.NewRecorder()
+	driver.readers = 0
+	if err := bs.ServeBlob(ctx, w, r, dgst); err != nil {
+		t.Fatalf("unexpected error serving blob: %v", err)
+	}
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+	if driver.readers != 1 {
+		t.Fatalf("expected the ranges to be read from a single reader, got %d", driver.readers)
+	}
+
+	_, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if err != nil {
+		t.Fatalf("unexpected Content-Type %q: %v", w.Header().Get("Content-Type"), err)
+	}
+	mr := multipart.NewReader(w.Body, params["boundary"])
+	for _, expected := range []string{"0-99", "300-399", "600-699"} {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("unexpected error reading part %s: %v", expected, err)
+		}
+		if contentRange := part.Header.Get("Content-Range"); contentRange != fmt.Sprintf("bytes %s/%d", expected, len(contents)) {
+			t.Fatalf("unexpected Content-Range %q", contentRange)
+		}
+		var start, end int
+		fmt.Sscanf(expected, "%d-%d", &start, &end)
+		body, _ := io.ReadAll(part)
+		if !bytes.Equal(body, contents[start:end+1]) {
+			t.Fatalf("unexpected content of part %s", expected)
+		}
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Fatalf("expected no more parts: %v", err)
+	}
+}
@@ -11,8 +11,10 @@ import (
 	"github.com/distribution/distribution/v3"
 	dcontext "github.com/distribution/distribution/v3/context"
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/tracing"
 	"github.com/opencontainers/go-digest"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 var (
@@ -35,6 +37,10 @@ type blobWriter struct {
 	digester  digest.Digester
 	written   int64 // track the write to digester
 
+	// digestIncomplete is set when the hash state of the data written by
+	// the previous requests of the upload could not be restored
+	digestIncomplete bool
+
 	fileWriter storagedriver.FileWriter
 	driver     storagedriver.StorageDriver
 	path       string
@@ -59,6 +65,20 @@ func (bw *blobWriter) StartedAt() time.Time {
 func (bw *blobWriter) Commit(ctx context.Context, desc distribution.Descriptor) (distribution.Descriptor, error) {
 	dcontext.GetLogger(ctx).Debug("(*blobWriter).Commit")
 
+	ctx, span := tracing.StartSpan(ctx, "blobWriter.Commit", attribute.String("digest", desc.Digest.String()))
+	defer span.End()
+
+	// the chunks of the upload may be written by concurrent requests, whose
+	// data must be committed along with the data of this one
+	unlock, err := bw.lockUpload(ctx)
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+	defer unlock()
+	if err := bw.reopen(ctx); err != nil {
+		return distribution.Descriptor{}, err
+	}
+
 	if err := bw.fileWriter.Commit(); err != nil {
 		return distribution.Descriptor{}, err
 	}
@@ -75,6 +95,10 @@ func (bw *blobWriter) Commit(ctx context.Context, desc distribution.Descriptor)
 		return distribution.Descriptor{}, err
 	}
 
+	if encoder := bw.blobStore.registry.blobEncoder; encoder != nil {
+		encoder.encodeAsync(ctx, canonical)
+	}
+
 	if err := bw.blobStore.linkBlob(ctx, canonical, desc.Digest); err != nil {
 		return distribution.Descriptor{}, err
 	}
@@ -115,7 +139,7 @@ func (bw *blobWriter) Write(p []byte) (int, error) {
 	// Ensure that the current write offset matches how many bytes have been
 	// written to the digester. If not, we need to update the digest state to
 	// match the current write position.
-	if err := bw.resumeDigest(bw.blobStore.ctx); err != nil && err != errResumableDigestNotAvailable {
+	if err := bw.resumeWriteDigest(bw.blobStore.ctx); err != nil {
 		return 0, err
 	}
 
@@ -134,7 +158,7 @@ func (bw *blobWriter) ReadFrom(r io.Reader) (n int64, err error) {
 	// Ensure that the current write offset matches how many bytes have been
 	// written to the digester. If not, we need to update the digest state to
 	// match the current write position.
-	if err := bw.resumeDigest(bw.blobStore.ctx); err != nil && err != errResumableDigestNotAvailable {
+	if err := bw.resumeWriteDigest(bw.blobStore.ctx); err != nil {
 		return 0, err
 	}
 
@@ -148,6 +172,39 @@ func (bw *blobWriter) ReadFrom(r io.Reader) (n int64, err error) {
 	return nn, err
 }
 
+// Digest returns the digest of the data written so far, restoring the hash
+// state saved by the previous requests of the upload if needed.
+func (bw *blobWriter) Digest(ctx context.Context, algorithm digest.Algorithm) (digest.Digest, error) {
+	if algorithm != bw.digester.Digest().Algorithm() {
+		return "", distribution.ErrUnsupported
+	}
+	if bw.written == 0 && bw.Size() > 0 {
+		// nothing was written by this request yet
+		if err := bw.resumeDigest(ctx); err == errResumableDigestNotAvailable {
+			return "", distribution.ErrUnsupported
+		} else if err != nil {
+			return "", err
+		}
+	}
+	if bw.digestIncomplete {
+		return "", distribution.ErrUnsupported
+	}
+	return bw.digester.Digest(), nil
+}
+
+// resumeWriteDigest restores the hash state before data is written, noting
+// whether the data written by the previous requests of the upload is missing
+// from the digester.
+func (bw *blobWriter) resumeWriteDigest(ctx context.Context) error {
+	resuming := bw.written == 0 && bw.Size() > 0
+	err := bw.resumeDigest(ctx)
+	if err == errResumableDigestNotAvailable {
+		bw.digestIncomplete = bw.digestIncomplete || resuming
+		return nil
+	}
+	return err
+}
+
 func (bw *blobWriter) Close() error {
 	if bw.committed {
 		return errors.New("blobwriter close after commit")
@@ -317,6 +374,10 @@ func (bw *blobWriter) moveBlob(ctx context.Context, desc distribution.Descriptor
 		return nil
 	}
 
+	if bw.blobStore.linkSharedData(ctx, blobPath) {
+		return nil
+	}
+
 	// If no data was received, we may not actually have a file on disk. Check
 	// the size here and write a zero-length file to blobPath if this is the
 	// case. For the most part, this should only ever happen with zero-length
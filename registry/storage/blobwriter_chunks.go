@@ -0,0 +1,237 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+var _ distribution.BlobChunkWriter = &blobWriter{}
+
+// maxHeldChunks is the number of chunks held at most for an upload, so that
+// a client can not fill the storage with chunks which are never appended.
+const maxHeldChunks = 100
+
+// heldChunk is a chunk of an upload received ahead of the data before it.
+type heldChunk struct {
+	offset int64
+	size   int64
+	path   string
+}
+
+// WriteChunk writes a chunk of the upload at offset, holding it in the
+// storage if the data before it has not been written yet. The chunks of an
+// upload are written under its lock, so that clients may send them in
+// parallel, to several registry instances if the registry has a locker.
+func (bw *blobWriter) WriteChunk(ctx context.Context, offset, length int64, r io.Reader) error {
+	unlock, err := bw.lockUpload(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// the data may have been appended by the requests for the other chunks
+	// since the upload was resumed
+	if err := bw.reopen(ctx); err != nil {
+		return err
+	}
+
+	size := bw.Size()
+	if offset < size {
+		return distribution.ErrBlobChunkOverlap
+	}
+	held, err := bw.heldChunks(ctx)
+	if err != nil {
+		return err
+	}
+	for _, chunk := range held {
+		if offset < chunk.offset+chunk.size && chunk.offset < offset+length {
+			return distribution.ErrBlobChunkOverlap
+		}
+	}
+
+	if offset > size {
+		if len(held) >= maxHeldChunks {
+			return distribution.ErrBlobTooManyChunks
+		}
+		return bw.holdChunk(ctx, offset, length, r)
+	}
+
+	// the chunks held right after the chunk are written along with it, in a
+	// single write so that the digest state is resumed once
+	readers := []io.Reader{r}
+	var following []heldChunk
+	end := offset + length
+	for _, chunk := range held {
+		if chunk.offset != end {
+			// the chunks after a gap are held until it is filled
+			break
+		}
+		rc, err := bw.driver.Reader(ctx, chunk.path, 0)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		readers = append(readers, rc)
+		following = append(following, chunk)
+		end += chunk.size
+	}
+
+	n, err := bw.ReadFrom(io.MultiReader(readers...))
+	if err != nil {
+		return err
+	}
+	if offset+n != end {
+		return fmt.Errorf("%d bytes written at offset %d, expected %d", n, offset, end-offset)
+	}
+	for _, chunk := range following {
+		if err := bw.driver.Delete(ctx, chunk.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lockUpload acquires the lock of the upload and returns the function
+// releasing it. Without a locker, the upload is only locked in this process.
+func (bw *blobWriter) lockUpload(ctx context.Context) (func(), error) {
+	reg := bw.blobStore.registry
+	if reg == nil {
+		return func() {}, nil
+	}
+	if reg.locker == nil {
+		return reg.uploadLocks.lock(bw.id), nil
+	}
+	return reg.locker.Lock(ctx, "uploads/"+bw.id)
+}
+
+// keyedMutex holds a mutex per key, for the keys locked at the moment.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*refMutex
+}
+
+// refMutex is a mutex and the number of holders and waiters of its key.
+type refMutex struct {
+	sync.Mutex
+	refs int
+}
+
+// lock acquires the mutex of key and returns the function releasing it.
+func (km *keyedMutex) lock(key string) func() {
+	km.mu.Lock()
+	if km.locks == nil {
+		km.locks = make(map[string]*refMutex)
+	}
+	m, ok := km.locks[key]
+	if !ok {
+		m = &refMutex{}
+		km.locks[key] = m
+	}
+	m.refs++
+	km.mu.Unlock()
+
+	m.Lock()
+	return func() {
+		m.Unlock()
+		km.mu.Lock()
+		if m.refs--; m.refs == 0 {
+			delete(km.locks, key)
+		}
+		km.mu.Unlock()
+	}
+}
+
+// reopen resumes the file writer of the upload at the end of its data.
+func (bw *blobWriter) reopen(ctx context.Context) error {
+	if err := bw.fileWriter.Close(); err != nil {
+		return err
+	}
+	fw, err := bw.driver.Writer(ctx, bw.path, true)
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		// nothing was written yet
+		fw, err = bw.driver.Writer(ctx, bw.path, false)
+	}
+	if err != nil {
+		return err
+	}
+	bw.fileWriter = fw
+	return nil
+}
+
+// heldChunks returns the chunks held for the upload, ordered by offset.
+func (bw *blobWriter) heldChunks(ctx context.Context) ([]heldChunk, error) {
+	prefix, err := pathFor(uploadChunkPathSpec{
+		name: bw.blobStore.repository.Named().Name(),
+		id:   bw.id,
+		list: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	paths, err := bw.driver.List(ctx, prefix)
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	chunks := make([]heldChunk, 0, len(paths))
+	for _, p := range paths {
+		offset, err := strconv.ParseInt(path.Base(p), 10, 64)
+		if err != nil {
+			dcontext.GetLogger(ctx).Errorf("unable to parse offset from upload chunk path %q: %s", p, err)
+			continue
+		}
+		fi, err := bw.driver.Stat(ctx, p)
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, heldChunk{offset: offset, size: fi.Size(), path: p})
+	}
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].offset < chunks[j].offset
+	})
+	return chunks, nil
+}
+
+// holdChunk stores a chunk until the data before it is written.
+func (bw *blobWriter) holdChunk(ctx context.Context, offset, length int64, r io.Reader) error {
+	chunkPath, err := pathFor(uploadChunkPathSpec{
+		name:   bw.blobStore.repository.Named().Name(),
+		id:     bw.id,
+		offset: offset,
+	})
+	if err != nil {
+		return err
+	}
+
+	fw, err := bw.driver.Writer(ctx, chunkPath, false)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(fw, r)
+	if err == nil && n != length {
+		err = fmt.Errorf("chunk of %d bytes held at offset %d, expected %d", n, offset, length)
+	}
+	if err != nil {
+		fw.Cancel()
+		fw.Close()
+		return err
+	}
+	if err := fw.Commit(); err != nil {
+		fw.Close()
+		return err
+	}
+	return fw.Close()
+}
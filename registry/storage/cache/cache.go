@@ -3,6 +3,7 @@
 package cache
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/distribution/distribution/v3"
@@ -10,10 +11,20 @@ import (
 
 // BlobDescriptorCacheProvider provides repository scoped
 // BlobDescriptorService cache instances and a global descriptor cache.
+//
+// Clearing a digest from the global cache invalidates it in every repository
+// scope as well, as its blob was removed from the storage.
 type BlobDescriptorCacheProvider interface {
 	distribution.BlobDescriptorService
 
 	RepositoryScoped(repo string) (distribution.BlobDescriptorService, error)
+
+	// ClearRepository removes the descriptors cached in the scope of the
+	// repository, when it is removed.
+	ClearRepository(ctx context.Context, repo string) error
+
+	// Purge removes all the cached descriptors.
+	Purge(ctx context.Context) error
 }
 
 // ValidateDescriptor provides a helper function to ensure that caches have
@@ -19,6 +19,7 @@ func CheckBlobDescriptorCache(t *testing.T, provider cache.BlobDescriptorCachePr
 	checkBlobDescriptorCacheEmptyRepository(ctx, t, provider)
 	checkBlobDescriptorCacheSetAndRead(ctx, t, provider)
 	checkBlobDescriptorCacheClear(ctx, t, provider)
+	checkBlobDescriptorCacheInvalidation(ctx, t, provider)
 }
 
 func checkBlobDescriptorCacheEmptyRepository(ctx context.Context, t *testing.T, provider cache.BlobDescriptorCacheProvider) {
@@ -181,3 +182,67 @@ func checkBlobDescriptorCacheClear(ctx context.Context, t *testing.T, provider c
 		t.Fatalf("expected error statting deleted blob: %v", err)
 	}
 }
+
+func checkBlobDescriptorCacheInvalidation(ctx context.Context, t *testing.T, provider cache.BlobDescriptorCacheProvider) {
+	dgst := digest.Digest("sha256:cba1111111111111111111111111111111111111111111111111111111111111")
+	desc := distribution.Descriptor{
+		Digest:    dgst,
+		Size:      10,
+		MediaType: "application/octet-stream"}
+
+	repos := []string{"foo/bar", "foo/baz"}
+	set := func() []distribution.BlobDescriptorService {
+		t.Helper()
+		var scopes []distribution.BlobDescriptorService
+		for _, repo := range repos {
+			scoped, err := provider.RepositoryScoped(repo)
+			if err != nil {
+				t.Fatalf("unexpected error getting scoped cache: %v", err)
+			}
+			if err := scoped.SetDescriptor(ctx, dgst, desc); err != nil {
+				t.Fatalf("error setting descriptor: %v", err)
+			}
+			scopes = append(scopes, scoped)
+		}
+		return scopes
+	}
+	checkCleared := func(cleared bool, bs distribution.BlobDescriptorService, name string) {
+		t.Helper()
+		_, err := bs.Stat(ctx, dgst)
+		if cleared && err != distribution.ErrBlobUnknown {
+			t.Fatalf("expected unknown blob error statting cleared descriptor in %s: %v", name, err)
+		}
+		if !cleared && err != nil {
+			t.Fatalf("unexpected error statting descriptor in %s: %v", name, err)
+		}
+	}
+
+	// clearing a digest globally invalidates it in every repository
+	scopes := set()
+	if err := provider.Clear(ctx, dgst); err != nil {
+		t.Fatalf("unexpected error clearing descriptor: %v", err)
+	}
+	checkCleared(true, provider, "global cache")
+	for i, scoped := range scopes {
+		checkCleared(true, scoped, repos[i])
+	}
+
+	// clearing a repository leaves the other repositories alone
+	scopes = set()
+	if err := provider.ClearRepository(ctx, repos[0]); err != nil {
+		t.Fatalf("unexpected error clearing repository: %v", err)
+	}
+	checkCleared(true, scopes[0], repos[0])
+	checkCleared(false, scopes[1], repos[1])
+	checkCleared(false, provider, "global cache")
+
+	// purging removes everything
+	scopes = set()
+	if err := provider.Purge(ctx); err != nil {
+		t.Fatalf("unexpected error purging cache: %v", err)
+	}
+	checkCleared(true, provider, "global cache")
+	for i, scoped := range scopes {
+		checkCleared(true, scoped, repos[i])
+	}
+}
@@ -61,8 +61,9 @@ func (cbds *cachedBlobStatter) Stat(ctx context.Context, dgst digest.Digest) (di
 }
 
 func (cbds *cachedBlobStatter) Clear(ctx context.Context, dgst digest.Digest) error {
+	// the blob may not be cached, it must still be cleared from the backend
 	err := cbds.cache.Clear(ctx, dgst)
-	if err != nil {
+	if err != nil && err != distribution.ErrBlobUnknown {
 		return err
 	}
 
@@ -3,11 +3,13 @@ package memory
 import (
 	"context"
 	"math"
+	"sync"
 
 	"github.com/distribution/distribution/v3"
+	prometheus "github.com/distribution/distribution/v3/metrics"
 	"github.com/distribution/distribution/v3/reference"
 	"github.com/distribution/distribution/v3/registry/storage/cache"
-	lru "github.com/hashicorp/golang-lru"
+	"github.com/hashicorp/golang-lru/simplelru"
 	"github.com/opencontainers/go-digest"
 )
 
@@ -18,31 +20,115 @@ const (
 
 	// UnlimitedSize indicates the cache size should not be limited.
 	UnlimitedSize = math.MaxInt
+
+	// entryOverhead is an estimate of the memory used by an entry of the
+	// cache besides the strings of its key and descriptor: the structures
+	// themselves and the bookkeeping of the LRU list and map.
+	entryOverhead = 256
 )
 
+// cacheCounter counts the hits, misses and evictions of the in-memory
+// caches.
+var cacheCounter = prometheus.StorageNamespace.NewLabeledCounter("inmemory_cache", "The number of hits, misses and evictions of the in-memory blob descriptor cache", "type")
+
 type descriptorCacheKey struct {
 	digest digest.Digest
 	repo   string
 }
 
 type inMemoryBlobDescriptorCacheProvider struct {
-	lru *lru.ARCCache
+	// mu protects lru and bytes
+	mu  sync.Mutex
+	lru *simplelru.LRU
+
+	// maxBytes is the estimated memory the entries may use, zero being
+	// unlimited, and bytes the memory they currently use.
+	maxBytes int64
+	bytes    int64
 }
 
 // NewInMemoryBlobDescriptorCacheProvider returns a new mapped-based cache for
 // storing blob descriptor data.
 func NewInMemoryBlobDescriptorCacheProvider(size int) cache.BlobDescriptorCacheProvider {
+	return NewBoundedInMemoryBlobDescriptorCacheProvider(size, 0)
+}
+
+// NewBoundedInMemoryBlobDescriptorCacheProvider returns a cache storing blob
+// descriptor data which evicts the least recently used descriptors beyond
+// size entries, or when the estimated memory used by the entries exceeds
+// maxBytes, unless zero.
+func NewBoundedInMemoryBlobDescriptorCacheProvider(size int, maxBytes int64) cache.BlobDescriptorCacheProvider {
 	if size <= 0 {
 		size = math.MaxInt
 	}
-	lruCache, err := lru.NewARC(size)
+	imbdcp := &inMemoryBlobDescriptorCacheProvider{
+		maxBytes: maxBytes,
+	}
+	lruCache, err := simplelru.NewLRU(size, func(key, value interface{}) {
+		imbdcp.bytes -= entrySize(key.(descriptorCacheKey), value.(distribution.Descriptor))
+	})
 	if err != nil {
-		// NewARC can only fail if size is <= 0, so this unreachable
+		// NewLRU can only fail if size is <= 0, so this unreachable
 		panic(err)
 	}
-	return &inMemoryBlobDescriptorCacheProvider{
-		lru: lruCache,
+	imbdcp.lru = lruCache
+	return imbdcp
+}
+
+// entrySize estimates the memory used by an entry of the cache.
+func entrySize(key descriptorCacheKey, desc distribution.Descriptor) int64 {
+	size := entryOverhead + len(key.digest) + len(key.repo) + len(desc.MediaType) + len(desc.Digest) + len(desc.ArtifactType)
+	for _, u := range desc.URLs {
+		size += len(u)
 	}
+	for k, v := range desc.Annotations {
+		size += len(k) + len(v)
+	}
+	return int64(size)
+}
+
+// get returns the descriptor cached under key, counting the hit or miss.
+func (imbdcp *inMemoryBlobDescriptorCacheProvider) get(key descriptorCacheKey) (distribution.Descriptor, error) {
+	imbdcp.mu.Lock()
+	descriptor, ok := imbdcp.lru.Get(key)
+	imbdcp.mu.Unlock()
+	if ok {
+		cacheCounter.WithValues("hit").Inc(1)
+		return descriptor.(distribution.Descriptor), nil
+	}
+	cacheCounter.WithValues("miss").Inc(1)
+	return distribution.Descriptor{}, distribution.ErrBlobUnknown
+}
+
+// add caches the descriptor under key, evicting the least recently used
+// entries beyond the bounds of the cache.
+func (imbdcp *inMemoryBlobDescriptorCacheProvider) add(key descriptorCacheKey, desc distribution.Descriptor) {
+	imbdcp.mu.Lock()
+	defer imbdcp.mu.Unlock()
+
+	// replacing an entry does not call the eviction callback
+	if previous, ok := imbdcp.lru.Peek(key); ok {
+		imbdcp.bytes -= entrySize(key, previous.(distribution.Descriptor))
+	}
+	imbdcp.bytes += entrySize(key, desc)
+	evictions := 0
+	if imbdcp.lru.Add(key, desc) {
+		evictions++
+	}
+	for imbdcp.maxBytes > 0 && imbdcp.bytes > imbdcp.maxBytes && imbdcp.lru.Len() > 1 {
+		imbdcp.lru.RemoveOldest()
+		evictions++
+	}
+	if evictions > 0 {
+		cacheCounter.WithValues("eviction").Inc(float64(evictions))
+	}
+}
+
+// remove removes the descriptor cached under key.
+func (imbdcp *inMemoryBlobDescriptorCacheProvider) remove(key descriptorCacheKey) {
+	imbdcp.mu.Lock()
+	imbdcp.lru.Remove(key)
+	imbdcp.mu.Unlock()
 }
 
 func (imbdcp *inMemoryBlobDescriptorCacheProvider) RepositoryScoped(repo string) (distribution.BlobDescriptorService, error) {
@@ -61,31 +147,57 @@ func (imbdcp *inMemoryBlobDescriptorCacheProvider) Stat(ctx context.Context, dgs
 		return distribution.Descriptor{}, err
 	}
 
-	key := descriptorCacheKey{
+	return imbdcp.get(descriptorCacheKey{
 		digest: dgst,
-	}
-	descriptor, ok := imbdcp.lru.Get(key)
-	if ok {
-		// Type assertion not really necessary, but included in case
-		// it's necessary for the fuzzer
-		if desc, ok := descriptor.(distribution.Descriptor); ok {
-			return desc, nil
-		}
-	}
-	return distribution.Descriptor{}, distribution.ErrBlobUnknown
+	})
 }
 
+// Clear removes the descriptor of the digest from the global cache and from
+// the scope of every repository.
 func (imbdcp *inMemoryBlobDescriptorCacheProvider) Clear(ctx context.Context, dgst digest.Digest) error {
-	key := descriptorCacheKey{
-		digest: dgst,
-	}
-	imbdcp.lru.Remove(key)
+	imbdcp.removeKeys(func(key descriptorCacheKey) bool {
+		return key.digest == dgst
+	})
 	return nil
 }
 
+// ClearRepository removes the descriptors cached in the scope of the
+// repository.
+func (imbdcp *inMemoryBlobDescriptorCacheProvider) ClearRepository(ctx context.Context, repo string) error {
+	imbdcp.removeKeys(func(key descriptorCacheKey) bool {
+		return key.repo == repo
+	})
+	return nil
+}
+
+// Purge removes all the cached descriptors.
+func (imbdcp *inMemoryBlobDescriptorCacheProvider) Purge(ctx context.Context) error {
+	imbdcp.mu.Lock()
+	imbdcp.lru.Purge()
+	imbdcp.mu.Unlock()
+	return nil
+}
+
+// removeKeys removes the cached descriptors whose key matches.
+func (imbdcp *inMemoryBlobDescriptorCacheProvider) removeKeys(match func(descriptorCacheKey) bool) {
+	imbdcp.mu.Lock()
+	defer imbdcp.mu.Unlock()
+	for _, k := range imbdcp.lru.Keys() {
+		if key := k.(descriptorCacheKey); match(key) {
+			imbdcp.lru.Remove(key)
+		}
+	}
+}
+
 func (imbdcp *inMemoryBlobDescriptorCacheProvider) SetDescriptor(ctx context.Context, dgst digest.Digest, desc distribution.Descriptor) error {
-	_, err := imbdcp.Stat(ctx, dgst)
-	if err == distribution.ErrBlobUnknown {
+	if err := dgst.Validate(); err != nil {
+		return err
+	}
+
+	imbdcp.mu.Lock()
+	known := imbdcp.lru.Contains(descriptorCacheKey{digest: dgst})
+	imbdcp.mu.Unlock()
+	if !known {
 		if dgst.Algorithm() != desc.Digest.Algorithm() && dgst != desc.Digest {
 			// if the digests differ, set the other canonical mapping
 			if err := imbdcp.SetDescriptor(ctx, desc.Digest, desc); err != nil {
@@ -101,14 +213,13 @@ func (imbdcp *inMemoryBlobDescriptorCacheProvider) SetDescriptor(ctx context.Con
 			return err
 		}
 
-		key := descriptorCacheKey{
+		imbdcp.add(descriptorCacheKey{
 			digest: dgst,
-		}
-		imbdcp.lru.Add(key, desc)
+		}, desc)
 		return nil
 	}
 	// we already know it, do nothing
-	return err
+	return nil
 }
 
 // repositoryScopedInMemoryBlobDescriptorCache provides the request scoped
@@ -124,19 +235,10 @@ func (rsimbdcp *repositoryScopedInMemoryBlobDescriptorCache) Stat(ctx context.Co
 		return distribution.Descriptor{}, err
 	}
 
-	key := descriptorCacheKey{
+	return rsimbdcp.parent.get(descriptorCacheKey{
 		digest: dgst,
 		repo:   rsimbdcp.repo,
-	}
-	descriptor, ok := rsimbdcp.parent.lru.Get(key)
-	if ok {
-		// Type assertion not really necessary, but included in case
-		// it's necessary for the fuzzer
-		if desc, ok := descriptor.(distribution.Descriptor); ok {
-			return desc, nil
-		}
-	}
-	return distribution.Descriptor{}, distribution.ErrBlobUnknown
+	})
 }
 
 func (rsimbdcp *repositoryScopedInMemoryBlobDescriptorCache) Clear(ctx context.Context, dgst digest.Digest) error {
@@ -144,7 +246,7 @@ func (rsimbdcp *repositoryScopedInMemoryBlobDescriptorCache) Clear(ctx context.C
 		digest: dgst,
 		repo:   rsimbdcp.repo,
 	}
-	rsimbdcp.parent.lru.Remove(key)
+	rsimbdcp.parent.remove(key)
 	return nil
 }
 
@@ -161,6 +263,6 @@ func (rsimbdcp *repositoryScopedInMemoryBlobDescriptorCache) SetDescriptor(ctx c
 		digest: dgst,
 		repo:   rsimbdcp.repo,
 	}
-	rsimbdcp.parent.lru.Add(key, desc)
+	rsimbdcp.parent.add(key, desc)
 	return rsimbdcp.parent.SetDescriptor(ctx, dgst, desc)
 }
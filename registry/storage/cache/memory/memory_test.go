@@ -1,9 +1,12 @@
 package memory
 
 import (
+	"context"
 	"testing"
 
+	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/registry/storage/cache/cachecheck"
+	"github.com/opencontainers/go-digest"
 )
 
 // TestInMemoryBlobInfoCache checks the in memory implementation is working
@@ -11,3 +14,67 @@ import (
 func TestInMemoryBlobInfoCache(t *testing.T) {
 	cachecheck.CheckBlobDescriptorCache(t, NewInMemoryBlobDescriptorCacheProvider(UnlimitedSize))
 }
+
+func TestInMemoryBlobInfoCacheBounds(t *testing.T) {
+	ctx := context.Background()
+	descriptor := func(content string) distribution.Descriptor {
+		return distribution.Descriptor{
+			Digest:    digest.FromString(content),
+			Size:      int64(len(content)),
+			MediaType: "application/octet-stream",
+		}
+	}
+	first, second, third := descriptor("first"), descriptor("second"), descriptor("third")
+
+	// the least recently used descriptors are evicted beyond the entry count
+	provider := NewInMemoryBlobDescriptorCacheProvider(2)
+	for _, desc := range []distribution.Descriptor{first, second} {
+		if err := provider.SetDescriptor(ctx, desc.Digest, desc); err != nil {
+			t.Fatalf("unexpected error setting descriptor: %v", err)
+		}
+	}
+	if _, err := provider.Stat(ctx, first.Digest); err != nil {
+		t.Fatalf("unexpected error getting descriptor: %v", err)
+	}
+	if err := provider.SetDescriptor(ctx, third.Digest, third); err != nil {
+		t.Fatalf("unexpected error setting descriptor: %v", err)
+	}
+	if _, err := provider.Stat(ctx, second.Digest); err != distribution.ErrBlobUnknown {
+		t.Errorf("expected the least recently used descriptor to be evicted, got %v", err)
+	}
+	for _, desc := range []distribution.Descriptor{first, third} {
+		if _, err := provider.Stat(ctx, desc.Digest); err != nil {
+			t.Errorf("unexpected error getting descriptor %s: %v", desc.Digest, err)
+		}
+	}
+
+	// and beyond the estimated memory of the entries
+	key := descriptorCacheKey{digest: first.Digest}
+	provider = NewBoundedInMemoryBlobDescriptorCacheProvider(UnlimitedSize, 2*entrySize(key, first))
+	for _, desc := range []distribution.Descriptor{first, second, third} {
+		if err := provider.SetDescriptor(ctx, desc.Digest, desc); err != nil {
+			t.Fatalf("unexpected error setting descriptor: %v", err)
+		}
+	}
+	if _, err := provider.Stat(ctx, first.Digest); err != distribution.ErrBlobUnknown {
+		t.Errorf("expected the least recently used descriptor to be evicted, got %v", err)
+	}
+	imbdcp := provider.(*inMemoryBlobDescriptorCacheProvider)
+	if imbdcp.lru.Len() != 2 {
+		t.Errorf("unexpected number of cached descriptors: %d", imbdcp.lru.Len())
+	}
+	if expected := entrySize(key, second) + entrySize(key, third); imbdcp.bytes != expected {
+		t.Errorf("unexpected estimated memory: %d != %d", imbdcp.bytes, expected)
+	}
+
+	// the estimated memory is released with the descriptors
+	if err := provider.Clear(ctx, second.Digest); err != nil {
+		t.Fatalf("unexpected error clearing descriptor: %v", err)
+	}
+	if err := provider.Purge(ctx); err != nil {
+		t.Fatalf("unexpected error purging cache: %v", err)
+	}
+	if imbdcp.bytes != 0 {
+		t.Errorf("unexpected estimated memory of an empty cache: %d", imbdcp.bytes)
+	}
+}
@@ -3,13 +3,14 @@ package redis
 import (
 	"context"
 	"fmt"
+	"strconv"
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/reference"
 	"github.com/distribution/distribution/v3/registry/storage/cache"
 	"github.com/distribution/distribution/v3/registry/storage/cache/metrics"
-	"github.com/gomodule/redigo/redis"
 	"github.com/opencontainers/go-digest"
+	"github.com/redis/go-redis/v9"
 )
 
 // redisBlobStatService provides an implementation of
@@ -24,17 +25,13 @@ import (
 // Note that there is no implied relationship between these two caches. The
 // layer may exist in one, both or none and the code must be written this way.
 type redisBlobDescriptorService struct {
-	pool *redis.Pool
-
-	// TODO(stevvooe): We use a pool because we don't have great control over
-	// the cache lifecycle to manage connections. A new connection if fetched
-	// for each operation. Once we have better lifecycle management of the
-	// request objects, we can change this to a connection.
+	pool redis.UniversalClient
 }
 
 // NewRedisBlobDescriptorCacheProvider returns a new redis-based
-// BlobDescriptorCacheProvider using the provided redis connection pool.
-func NewRedisBlobDescriptorCacheProvider(pool *redis.Pool) cache.BlobDescriptorCacheProvider {
+// BlobDescriptorCacheProvider using the provided redis client, which may
+// connect to a single instance, a Sentinel or a Cluster deployment.
+func NewRedisBlobDescriptorCacheProvider(pool redis.UniversalClient) cache.BlobDescriptorCacheProvider {
 	return metrics.NewPrometheusCacheProvider(
 		&redisBlobDescriptorService{
 			pool: pool,
@@ -62,22 +59,18 @@ func (rbds *redisBlobDescriptorService) Stat(ctx context.Context, dgst digest.Di
 		return distribution.Descriptor{}, err
 	}
 
-	conn := rbds.pool.Get()
-	defer conn.Close()
-
-	return rbds.stat(ctx, conn, dgst)
+	return rbds.stat(ctx, dgst)
 }
 
+// Clear removes the descriptor from the redis hash entry, which invalidates
+// it in the scope of every repository as well.
 func (rbds *redisBlobDescriptorService) Clear(ctx context.Context, dgst digest.Digest) error {
 	if err := dgst.Validate(); err != nil {
 		return err
 	}
 
-	conn := rbds.pool.Get()
-	defer conn.Close()
-
 	// Not atomic in redis <= 2.3
-	reply, err := conn.Do("HDEL", rbds.blobDescriptorHashKey(dgst), "digest", "size", "mediatype")
+	reply, err := rbds.pool.HDel(ctx, rbds.blobDescriptorHashKey(dgst), "digest", "size", "mediatype").Result()
 	if err != nil {
 		return err
 	}
@@ -89,10 +82,62 @@ func (rbds *redisBlobDescriptorService) Clear(ctx context.Context, dgst digest.D
 	return nil
 }
 
-// stat provides an internal stat call that takes a connection parameter. This
-// allows some internal management of the connection scope.
-func (rbds *redisBlobDescriptorService) stat(ctx context.Context, conn redis.Conn, dgst digest.Digest) (distribution.Descriptor, error) {
-	reply, err := redis.Values(conn.Do("HMGET", rbds.blobDescriptorHashKey(dgst), "digest", "size", "mediatype"))
+// ClearRepository removes the set of the blobs of the repository, along
+// with their per-repository hashes.
+func (rbds *redisBlobDescriptorService) ClearRepository(ctx context.Context, repo string) error {
+	scoped := &repositoryScopedRedisBlobDescriptorService{
+		repo:     repo,
+		upstream: rbds,
+	}
+	setKey := scoped.repositoryBlobSetKey(repo)
+
+	members, err := rbds.pool.SMembers(ctx, setKey).Result()
+	if err != nil {
+		return err
+	}
+
+	// keys are deleted one by one, as they may be stored by different
+	// nodes of a cluster
+	_, err = rbds.pool.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, member := range members {
+			pipe.Del(ctx, scoped.blobDescriptorHashKey(digest.Digest(member)))
+		}
+		pipe.Del(ctx, setKey)
+		return nil
+	})
+	return err
+}
+
+// Purge removes all the keys of the cache, scanning every master node of a
+// cluster.
+func (rbds *redisBlobDescriptorService) Purge(ctx context.Context) error {
+	if cluster, ok := rbds.pool.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+			return purgeKeys(ctx, client)
+		})
+	}
+	return purgeKeys(ctx, rbds.pool)
+}
+
+// purgeKeys deletes the keys of the cache stored by a redis node.
+func purgeKeys(ctx context.Context, client redis.Cmdable) error {
+	for _, pattern := range []string{"blobs::*", "repository::*::blobs*"} {
+		iter := client.Scan(ctx, 0, pattern, 1000).Iterator()
+		for iter.Next(ctx) {
+			if err := client.Del(ctx, iter.Val()).Err(); err != nil {
+				return err
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stat provides an internal stat call which does not validate the digest.
+func (rbds *redisBlobDescriptorService) stat(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
+	reply, err := rbds.pool.HMGet(ctx, rbds.blobDescriptorHashKey(dgst), "digest", "size", "mediatype").Result()
 	if err != nil {
 		return distribution.Descriptor{}, err
 	}
@@ -105,10 +150,24 @@ func (rbds *redisBlobDescriptorService) stat(ctx context.Context, conn redis.Con
 	}
 
 	var desc distribution.Descriptor
-	if _, err := redis.Scan(reply, &desc.Digest, &desc.Size, &desc.MediaType); err != nil {
+	digestString, ok := reply[0].(string)
+	if !ok {
+		return distribution.Descriptor{}, fmt.Errorf("redis cache: unexpected digest type %T", reply[0])
+	}
+	desc.Digest = digest.Digest(digestString)
+
+	sizeString, ok := reply[1].(string)
+	if !ok {
+		return distribution.Descriptor{}, fmt.Errorf("redis cache: unexpected size type %T", reply[1])
+	}
+	if desc.Size, err = strconv.ParseInt(sizeString, 10, 64); err != nil {
 		return distribution.Descriptor{}, err
 	}
 
+	if mediatype, ok := reply[2].(string); ok {
+		desc.MediaType = mediatype
+	}
+
 	return desc, nil
 }
 
@@ -124,22 +183,19 @@ func (rbds *redisBlobDescriptorService) SetDescriptor(ctx context.Context, dgst
 		return err
 	}
 
-	conn := rbds.pool.Get()
-	defer conn.Close()
-
-	return rbds.setDescriptor(ctx, conn, dgst, desc)
+	return rbds.setDescriptor(ctx, dgst, desc)
 }
 
-func (rbds *redisBlobDescriptorService) setDescriptor(ctx context.Context, conn redis.Conn, dgst digest.Digest, desc distribution.Descriptor) error {
-	if _, err := conn.Do("HMSET", rbds.blobDescriptorHashKey(dgst),
-		"digest", desc.Digest,
-		"size", desc.Size); err != nil {
+func (rbds *redisBlobDescriptorService) setDescriptor(ctx context.Context, dgst digest.Digest, desc distribution.Descriptor) error {
+	if err := rbds.pool.HSet(ctx, rbds.blobDescriptorHashKey(dgst),
+		"digest", desc.Digest.String(),
+		"size", desc.Size).Err(); err != nil {
 		return err
 	}
 
 	// Only set mediatype if not already set.
-	if _, err := conn.Do("HSETNX", rbds.blobDescriptorHashKey(dgst),
-		"mediatype", desc.MediaType); err != nil {
+	if err := rbds.pool.HSetNX(ctx, rbds.blobDescriptorHashKey(dgst),
+		"mediatype", desc.MediaType).Err(); err != nil {
 		return err
 	}
 
@@ -165,11 +221,10 @@ func (rsrbds *repositoryScopedRedisBlobDescriptorService) Stat(ctx context.Conte
 		return distribution.Descriptor{}, err
 	}
 
-	conn := rsrbds.upstream.pool.Get()
-	defer conn.Close()
+	pool := rsrbds.upstream.pool
 
 	// Check membership to repository first
-	member, err := redis.Bool(conn.Do("SISMEMBER", rsrbds.repositoryBlobSetKey(rsrbds.repo), dgst))
+	member, err := pool.SIsMember(ctx, rsrbds.repositoryBlobSetKey(rsrbds.repo), dgst.String()).Result()
 	if err != nil {
 		return distribution.Descriptor{}, err
 	}
@@ -178,15 +233,15 @@ func (rsrbds *repositoryScopedRedisBlobDescriptorService) Stat(ctx context.Conte
 		return distribution.Descriptor{}, distribution.ErrBlobUnknown
 	}
 
-	upstream, err := rsrbds.upstream.stat(ctx, conn, dgst)
+	upstream, err := rsrbds.upstream.stat(ctx, dgst)
 	if err != nil {
 		return distribution.Descriptor{}, err
 	}
 
 	// We allow a per repository mediatype, let's look it up here.
-	mediatype, err := redis.String(conn.Do("HGET", rsrbds.blobDescriptorHashKey(dgst), "mediatype"))
+	mediatype, err := pool.HGet(ctx, rsrbds.blobDescriptorHashKey(dgst), "mediatype").Result()
 	if err != nil {
-		if err == redis.ErrNil {
+		if err == redis.Nil {
 			return distribution.Descriptor{}, distribution.ErrBlobUnknown
 		}
 
@@ -200,26 +255,29 @@ func (rsrbds *repositoryScopedRedisBlobDescriptorService) Stat(ctx context.Conte
 	return upstream, nil
 }
 
-// Clear removes the descriptor from the cache and forwards to the upstream descriptor store
+// Clear removes the descriptor from the repository: its membership to the
+// repository and its per-repository hash. The descriptor of the blob is left
+// in the global hash, as the blob may still be part of other repositories.
 func (rsrbds *repositoryScopedRedisBlobDescriptorService) Clear(ctx context.Context, dgst digest.Digest) error {
 	if err := dgst.Validate(); err != nil {
 		return err
 	}
 
-	conn := rsrbds.upstream.pool.Get()
-	defer conn.Close()
-
-	// Check membership to repository first
-	member, err := redis.Bool(conn.Do("SISMEMBER", rsrbds.repositoryBlobSetKey(rsrbds.repo), dgst))
+	pool := rsrbds.upstream.pool
+	removed, err := pool.SRem(ctx, rsrbds.repositoryBlobSetKey(rsrbds.repo), dgst.String()).Result()
 	if err != nil {
 		return err
 	}
 
-	if !member {
+	if err := pool.Del(ctx, rsrbds.blobDescriptorHashKey(dgst)).Err(); err != nil {
+		return err
+	}
+
+	if removed == 0 {
 		return distribution.ErrBlobUnknown
 	}
 
-	return rsrbds.upstream.Clear(ctx, dgst)
+	return nil
 }
 
 func (rsrbds *repositoryScopedRedisBlobDescriptorService) SetDescriptor(ctx context.Context, dgst digest.Digest, desc distribution.Descriptor) error {
@@ -237,30 +295,28 @@ func (rsrbds *repositoryScopedRedisBlobDescriptorService) SetDescriptor(ctx cont
 		}
 	}
 
-	conn := rsrbds.upstream.pool.Get()
-	defer conn.Close()
-
-	return rsrbds.setDescriptor(ctx, conn, dgst, desc)
+	return rsrbds.setDescriptor(ctx, dgst, desc)
 }
 
-func (rsrbds *repositoryScopedRedisBlobDescriptorService) setDescriptor(ctx context.Context, conn redis.Conn, dgst digest.Digest, desc distribution.Descriptor) error {
-	if _, err := conn.Do("SADD", rsrbds.repositoryBlobSetKey(rsrbds.repo), dgst); err != nil {
+func (rsrbds *repositoryScopedRedisBlobDescriptorService) setDescriptor(ctx context.Context, dgst digest.Digest, desc distribution.Descriptor) error {
+	pool := rsrbds.upstream.pool
+	if err := pool.SAdd(ctx, rsrbds.repositoryBlobSetKey(rsrbds.repo), dgst.String()).Err(); err != nil {
 		return err
 	}
 
-	if err := rsrbds.upstream.setDescriptor(ctx, conn, dgst, desc); err != nil {
+	if err := rsrbds.upstream.setDescriptor(ctx, dgst, desc); err != nil {
 		return err
 	}
 
 	// Override repository mediatype.
-	if _, err := conn.Do("HSET", rsrbds.blobDescriptorHashKey(dgst), "mediatype", desc.MediaType); err != nil {
+	if err := pool.HSet(ctx, rsrbds.blobDescriptorHashKey(dgst), "mediatype", desc.MediaType).Err(); err != nil {
 		return err
 	}
 
 	// Also set the values for the primary descriptor, if they differ by
 	// algorithm (ie sha256 vs sha512).
 	if desc.Digest != "" && dgst != desc.Digest && dgst.Algorithm() != desc.Digest.Algorithm() {
-		if err := rsrbds.setDescriptor(ctx, conn, desc.Digest, desc); err != nil {
+		if err := rsrbds.setDescriptor(ctx, desc.Digest, desc); err != nil {
 			return err
 		}
 	}
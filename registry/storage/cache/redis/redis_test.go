@@ -1,13 +1,13 @@
 package redis
 
 import (
+	"context"
 	"flag"
 	"os"
 	"testing"
-	"time"
 
 	"github.com/distribution/distribution/v3/registry/storage/cache/cachecheck"
-	"github.com/gomodule/redigo/redis"
+	"github.com/redis/go-redis/v9"
 )
 
 var redisAddr string
@@ -29,25 +29,17 @@ func TestRedisBlobDescriptorCacheProvider(t *testing.T) {
 		t.Skip("please set -test.registry.storage.cache.redis.addr to test layer info cache against redis")
 	}
 
-	pool := &redis.Pool{
-		Dial: func() (redis.Conn, error) {
-			return redis.Dial("tcp", redisAddr)
-		},
-		MaxIdle:   1,
-		MaxActive: 2,
-		TestOnBorrow: func(c redis.Conn, t time.Time) error {
-			_, err := c.Do("PING")
-			return err
-		},
-		Wait: false, // if a connection is not available, proceed without cache.
-	}
+	pool := redis.NewClient(&redis.Options{
+		Addr:         redisAddr,
+		MaxIdleConns: 1,
+		PoolSize:     2,
+	})
+	defer pool.Close()
 
 	// Clear the database
-	conn := pool.Get()
-	if _, err := conn.Do("FLUSHDB"); err != nil {
+	if err := pool.FlushDB(context.Background()).Err(); err != nil {
 		t.Fatalf("unexpected error flushing redis db: %v", err)
 	}
-	conn.Close()
 
 	cachecheck.CheckBlobDescriptorCache(t, NewRedisBlobDescriptorCacheProvider(pool))
 }
@@ -7,6 +7,7 @@ import (
 	"path"
 	"strings"
 
+	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/reference"
 	"github.com/distribution/distribution/v3/registry/storage/driver"
 )
@@ -71,14 +72,72 @@ func (reg *registry) Enumerate(ctx context.Context, ingester func(string) error)
 	return err
 }
 
-// Remove removes a repository from storage
+// Remove removes a repository from storage: its manifests, tags, layer links
+// and upload state. Repositories nested under its name are left untouched.
+// The blobs themselves are left to garbage collection. With soft deletion,
+// repositories can not be removed, since their trash would be removed too.
 func (reg *registry) Remove(ctx context.Context, name reference.Named) error {
+	if reg.trash != nil {
+		return distribution.ErrUnsupported
+	}
+
 	root, err := pathFor(repositoriesRootPathSpec{})
 	if err != nil {
 		return err
 	}
 	repoDir := path.Join(root, name.Name())
-	return reg.driver.Delete(ctx, repoDir)
+
+	unlock, err := reg.lockRepository(ctx, name.Name())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := reg.clearRepositoryDescriptorCache(ctx, name); err != nil {
+		return err
+	}
+
+	var found bool
+	for _, dir := range []string{"_manifests", "_layers", "_uploads"} {
+		err := reg.driver.Delete(ctx, path.Join(repoDir, dir))
+		switch err.(type) {
+		case nil:
+			found = true
+		case driver.PathNotFoundError:
+		default:
+			return err
+		}
+	}
+	if !found {
+		return distribution.ErrRepositoryUnknown{Name: name.Name()}
+	}
+
+	if reg.catalogIndex != nil {
+		if err := reg.catalogIndex.remove(ctx, name.Name()); err != nil {
+			return err
+		}
+	}
+
+	// Drivers backed by a filesystem keep the emptied directory around.
+	children, err := reg.driver.List(ctx, repoDir)
+	if err == nil && len(children) == 0 {
+		if err := reg.driver.Delete(ctx, repoDir); err != nil {
+			if _, ok := err.(driver.PathNotFoundError); !ok {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// clearRepositoryDescriptorCache removes the layers of the repository from
+// the blob descriptor cache, so they are not served once the repository is
+// removed.
+func (reg *registry) clearRepositoryDescriptorCache(ctx context.Context, name reference.Named) error {
+	if reg.blobDescriptorCacheProvider == nil {
+		return nil
+	}
+	return reg.blobDescriptorCacheProvider.ClearRepository(ctx, name.Name())
 }
 
 // lessPath returns true if one path a is less than path b.
@@ -6,6 +6,7 @@ import (
 	"io"
 	"math/rand"
 	"testing"
+	"time"
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/reference"
@@ -195,6 +196,173 @@ func TestCatalogEnumerate(t *testing.T) {
 	}
 }
 
+func TestCatalogIndex(t *testing.T) {
+	env := setupFS(t)
+
+	// the repositories pushed before the index was enabled are indexed
+	reg, err := NewRegistry(env.ctx, env.driver, EnableCatalogIndex, EnableSchema1)
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+	catalog := reg.(distribution.RepositoryCatalog)
+
+	repos, err := catalog.ListRepositories(env.ctx, "", "", 50)
+	if err != io.EOF {
+		t.Fatalf("expected io.EOF listing every repository, got %v", err)
+	}
+	if total, err := catalog.CountRepositories(env.ctx, ""); err != nil || total != len(env.expected) || !testEq(repos, env.expected, len(env.expected)) {
+		t.Fatalf("unexpected repositories %v (%d), expected %v: %v", repos, total, env.expected, err)
+	}
+
+	repos, err = catalog.ListRepositories(env.ctx, "foo/", "", 2)
+	if err != nil || !testEq(repos, []string{"foo/a", "foo/b"}, 2) {
+		t.Fatalf("unexpected first page %v: %v", repos, err)
+	}
+	if total, err := catalog.CountRepositories(env.ctx, "foo/"); err != nil || total != 3 {
+		t.Fatalf("unexpected count %d: %v", total, err)
+	}
+	repos, err = catalog.ListRepositories(env.ctx, "foo/", repos[1], 2)
+	if err != io.EOF || !testEq(repos, []string{"foo/d/in"}, 1) {
+		t.Fatalf("unexpected last page %v: %v", repos, err)
+	}
+
+	makeRepo(env.ctx, t, "zzz/new", reg)
+	named, err := reference.WithName("bar/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.(distribution.RepositoryRemover).Remove(env.ctx, named); err != nil {
+		t.Fatalf("unexpected error removing repository: %v", err)
+	}
+
+	expected := append(env.expected[1:], "zzz/new")
+	repos, err = catalog.ListRepositories(env.ctx, "", "", 50)
+	if err != io.EOF || !testEq(repos, expected, len(expected)) {
+		t.Fatalf("unexpected repositories %v, expected %v: %v", repos, expected, err)
+	}
+
+	// the catalog index is only listed when enabled
+	if _, err := env.registry.(distribution.RepositoryCatalog).ListRepositories(env.ctx, "", "", 50); err != distribution.ErrUnsupported {
+		t.Fatalf("expected ErrUnsupported without the index, got %v", err)
+	}
+}
+
+// listRecorder records the directories listed from its driver.
+type listRecorder struct {
+	driver.StorageDriver
+	listed []string
+}
+
+func (lr *listRecorder) List(ctx context.Context, path string) ([]string, error) {
+	lr.listed = append(lr.listed, path)
+	return lr.StorageDriver.List(ctx, path)
+}
+
+func TestCatalogIndexPageShards(t *testing.T) {
+	env := setupFS(t)
+
+	recorder := &listRecorder{StorageDriver: env.driver}
+	reg, err := NewRegistry(env.ctx, recorder, EnableCatalogIndex, EnableSchema1)
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+	catalog := reg.(distribution.RepositoryCatalog)
+	if _, err := catalog.ListRepositories(env.ctx, "", "", 1); err != nil {
+		t.Fatalf("unexpected error building the index: %v", err)
+	}
+
+	barShard, err := pathFor(catalogIndexShardPathSpec{shard: catalogIndexShard("bar/c")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fooShard, err := pathFor(catalogIndexShardPathSpec{shard: catalogIndexShard("foo/a")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testShard, err := pathFor(catalogIndexShardPathSpec{shard: catalogIndexShard("test")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a page only lists the shards it returns repositories from
+	recorder.listed = nil
+	repos, err := catalog.ListRepositories(env.ctx, "", "foo/a", 2)
+	if err != nil || !testEq(repos, []string{"foo/b", "foo/d/in"}, 2) {
+		t.Fatalf("unexpected page %v: %v", repos, err)
+	}
+	for _, listed := range recorder.listed {
+		if listed == barShard || listed == testShard {
+			t.Fatalf("unexpected listing of %s for the page", listed)
+		}
+	}
+
+	// counting only lists the shards which may hold the prefix
+	recorder.listed = nil
+	if total, err := catalog.CountRepositories(env.ctx, "foo-"); err != nil || total != 2 {
+		t.Fatalf("unexpected count %d: %v", total, err)
+	}
+	for _, listed := range recorder.listed {
+		if listed == barShard || listed == testShard {
+			t.Fatalf("unexpected listing of %s for the count", listed)
+		}
+	}
+	if len(recorder.listed) != 2 || recorder.listed[1] != fooShard {
+		t.Fatalf("unexpected listings %v for the count", recorder.listed)
+	}
+
+	// the count is cached until a repository it includes is pushed
+	recorder.listed = nil
+	if total, err := catalog.CountRepositories(env.ctx, "foo-"); err != nil || total != 2 || len(recorder.listed) != 0 {
+		t.Fatalf("unexpected count %d with listings %v: %v", total, recorder.listed, err)
+	}
+	makeRepo(env.ctx, t, "bar/new", reg)
+	if total, err := catalog.CountRepositories(env.ctx, "foo-"); err != nil || total != 2 || len(recorder.listed) != 0 {
+		t.Fatalf("unexpected count %d with listings %v: %v", total, recorder.listed, err)
+	}
+	makeRepo(env.ctx, t, "foo-new", reg)
+	if total, err := catalog.CountRepositories(env.ctx, "foo-"); err != nil || total != 3 {
+		t.Fatalf("unexpected count %d after a push: %v", total, err)
+	}
+}
+
+func TestCatalogIndexLastPush(t *testing.T) {
+	env := setupFS(t)
+
+	reg, err := NewRegistry(env.ctx, env.driver, EnableCatalogIndex, EnableSchema1)
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+	activity := reg.(distribution.RepositoryActivity)
+	if _, err := reg.(distribution.RepositoryCatalog).ListRepositories(env.ctx, "", "", 50); err != io.EOF {
+		t.Fatalf("unexpected error listing repositories: %v", err)
+	}
+
+	// the time of the pushes before the index was built is unknown
+	lastPush, err := activity.LastPush(env.ctx, env.expected[0])
+	if err != nil || !lastPush.IsZero() {
+		t.Fatalf("expected an unknown last push, got %v: %v", lastPush, err)
+	}
+
+	before := time.Now()
+	makeRepo(env.ctx, t, env.expected[0], reg)
+	lastPush, err = activity.LastPush(env.ctx, env.expected[0])
+	if err != nil {
+		t.Fatalf("unexpected error getting the last push: %v", err)
+	}
+	if lastPush.Before(before) || lastPush.After(time.Now()) {
+		t.Fatalf("unexpected last push %v, expected after %v", lastPush, before)
+	}
+
+	lastPush, err = activity.LastPush(env.ctx, "does/not/exist")
+	if err != nil || !lastPush.IsZero() {
+		t.Fatalf("expected an unknown last push for an unknown repository, got %v: %v", lastPush, err)
+	}
+
+	if _, err := env.registry.(distribution.RepositoryActivity).LastPush(env.ctx, env.expected[0]); err != distribution.ErrUnsupported {
+		t.Fatalf("expected ErrUnsupported without the index, got %v", err)
+	}
+}
+
 func testEq(a, b []string, size int) bool {
 	for cnt := 0; cnt < size-1; cnt++ {
 		if a[cnt] != b[cnt] {
@@ -243,6 +411,71 @@ func TestCatalogWalkError(t *testing.T) {
 	}
 }
 
+func TestRemoveRepository(t *testing.T) {
+	env := setupFS(t)
+	remover := env.registry.(distribution.RepositoryRemover)
+
+	named, err := reference.WithName("foo/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remover.Remove(env.ctx, named); err != nil {
+		t.Fatalf("unexpected error removing repository: %v", err)
+	}
+
+	// foo/d only holds the nested foo/d/in repository
+	named, err = reference.WithName("foo/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := remover.Remove(env.ctx, named).(distribution.ErrRepositoryUnknown); !ok {
+		t.Fatalf("expected ErrRepositoryUnknown removing a repository without content")
+	}
+
+	var repos []string
+	if err := env.registry.(distribution.RepositoryEnumerator).Enumerate(env.ctx, func(repo string) error {
+		repos = append(repos, repo)
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected error enumerating repositories: %v", err)
+	}
+
+	expected := []string{
+		"bar/c",
+		"bar/d",
+		"bar/e",
+		"foo/b",
+		"foo/d/in",
+		"foo-bar/a",
+		"foo-bar/b",
+		"test",
+	}
+	if !testEq(repos, expected, len(expected)) {
+		t.Errorf("unexpected repositories after removal: %v", repos)
+	}
+}
+
+// TestRemoveRepositorySoftDelete checks that repositories are not removed
+// along with their trash when soft deletion is enabled.
+func TestRemoveRepositorySoftDelete(t *testing.T) {
+	env := setupFS(t)
+	registry, err := NewRegistry(env.ctx, env.driver, EnableSoftDelete(time.Hour))
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+
+	named, err := reference.WithName("foo/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.(distribution.RepositoryRemover).Remove(env.ctx, named); err != distribution.ErrUnsupported {
+		t.Fatalf("expected ErrUnsupported removing a repository with soft deletion, got %v", err)
+	}
+	if _, err := env.driver.Stat(env.ctx, "/docker/registry/v2/repositories/foo/a/_manifests"); err != nil {
+		t.Fatalf("expected the manifests of the repository to be kept: %v", err)
+	}
+}
+
 func BenchmarkPathCompareEqual(B *testing.B) {
 	B.StopTimer()
 	pp := randomPath(100)
@@ -0,0 +1,399 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/hashicorp/golang-lru/simplelru"
+)
+
+const (
+	// catalogIndexCountTTL is how long the number of repositories starting
+	// with a prefix is cached, the index being updated by other instances.
+	catalogIndexCountTTL = time.Minute
+
+	// catalogIndexCountCacheSize is the number of prefixes whose number of
+	// repositories is cached.
+	catalogIndexCountCacheSize = 1000
+)
+
+// catalogIndex lists the repositories of the registry in directories sharded
+// by the start of their name, so that listing them does not require to walk
+// the repositories, and a page of the catalog only lists the shards it returns
+// repositories from. An entry is written whenever a manifest is pushed,
+// holding the time of the push, and removed with the repository. The index is
+// built from a walk of the repositories the first time it is listed, as
+// repositories may have been pushed before it was enabled: their entries are
+// empty until their next push, as the time of their last push is unknown.
+// The number of repositories is cached for catalogIndexCountTTL, as counting
+// them lists every shard, and is dropped whenever this instance adds or
+// removes a repository it counts.
+type catalogIndex struct {
+	driver driver.StorageDriver
+
+	mu     sync.Mutex
+	counts *simplelru.LRU
+}
+
+// cachedCount is the number of repositories starting with a prefix, counted
+// at a time.
+type cachedCount struct {
+	total     int
+	countedAt time.Time
+}
+
+func newCatalogIndex(d driver.StorageDriver) *catalogIndex {
+	// only fails for a non positive size
+	counts, _ := simplelru.NewLRU(catalogIndexCountCacheSize, nil)
+	return &catalogIndex{
+		driver: d,
+		counts: counts,
+	}
+}
+
+// cachedCount returns the number of repositories starting with prefix, if it
+// was counted less than catalogIndexCountTTL ago.
+func (ci *catalogIndex) cachedCount(prefix string) (int, bool) {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+
+	v, ok := ci.counts.Get(prefix)
+	if !ok {
+		return 0, false
+	}
+	cached := v.(cachedCount)
+	if time.Since(cached.countedAt) >= catalogIndexCountTTL {
+		ci.counts.Remove(prefix)
+		return 0, false
+	}
+	return cached.total, true
+}
+
+// countsName reports whether a cached count includes the repository.
+func (ci *catalogIndex) countsName(name string) bool {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+
+	for _, key := range ci.counts.Keys() {
+		if strings.HasPrefix(name, key.(string)) {
+			return true
+		}
+	}
+	return false
+}
+
+// invalidateCounts drops the cached counts including the repository.
+func (ci *catalogIndex) invalidateCounts(name string) {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+
+	for _, key := range ci.counts.Keys() {
+		if strings.HasPrefix(name, key.(string)) {
+			ci.counts.Remove(key)
+		}
+	}
+}
+
+// add records the repository in the index.
+func (ci *catalogIndex) add(ctx context.Context, name string) error {
+	entryPath, err := pathFor(catalogIndexEntryPathSpec{name: name})
+	if err != nil {
+		return err
+	}
+
+	if _, err := ci.driver.Stat(ctx, entryPath); err == nil {
+		return nil
+	} else if _, ok := err.(driver.PathNotFoundError); !ok {
+		return err
+	}
+	defer ci.invalidateCounts(name)
+	return ci.driver.PutContent(ctx, entryPath, []byte{})
+}
+
+// touch records the repository in the index, pushed at the current time.
+func (ci *catalogIndex) touch(ctx context.Context, name string) error {
+	entryPath, err := pathFor(catalogIndexEntryPathSpec{name: name})
+	if err != nil {
+		return err
+	}
+
+	// the push of a new repository changes the cached counts including it,
+	// which are the only reason to check whether the repository is new
+	if ci.countsName(name) {
+		if _, err := ci.driver.Stat(ctx, entryPath); err != nil {
+			if _, ok := err.(driver.PathNotFoundError); !ok {
+				return err
+			}
+			defer ci.invalidateCounts(name)
+		}
+	}
+	return ci.driver.PutContent(ctx, entryPath, []byte(time.Now().UTC().Format(time.RFC3339Nano)))
+}
+
+// lastPush returns the time of the last push to the repository, or the zero
+// time if it is unknown.
+func (ci *catalogIndex) lastPush(ctx context.Context, name string) (time.Time, error) {
+	entryPath, err := pathFor(catalogIndexEntryPathSpec{name: name})
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	content, err := ci.driver.GetContent(ctx, entryPath)
+	if err != nil {
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+
+	lastPush, err := time.Parse(time.RFC3339Nano, string(content))
+	if err != nil {
+		return time.Time{}, nil
+	}
+	return lastPush, nil
+}
+
+// remove removes the repository from the index.
+func (ci *catalogIndex) remove(ctx context.Context, name string) error {
+	entryPath, err := pathFor(catalogIndexEntryPathSpec{name: name})
+	if err != nil {
+		return err
+	}
+
+	defer ci.invalidateCounts(name)
+	err = ci.driver.Delete(ctx, entryPath)
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		return nil
+	}
+	return err
+}
+
+// rename moves the entry of the repository from to the repository to,
+// keeping the time of its last push.
+func (ci *catalogIndex) rename(ctx context.Context, from, to string) error {
+	fromPath, err := pathFor(catalogIndexEntryPathSpec{name: from})
+	if err != nil {
+		return err
+	}
+	toPath, err := pathFor(catalogIndexEntryPathSpec{name: to})
+	if err != nil {
+		return err
+	}
+
+	defer ci.invalidateCounts(from)
+	defer ci.invalidateCounts(to)
+	err = ci.driver.Move(ctx, fromPath, toPath)
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		return ci.add(ctx, to)
+	}
+	return err
+}
+
+// ensureBuilt builds the index if it was never built.
+func (ci *catalogIndex) ensureBuilt(ctx context.Context, enumerator distribution.RepositoryEnumerator) error {
+	completePath, err := pathFor(catalogIndexCompletePathSpec{})
+	if err != nil {
+		return err
+	}
+
+	if _, err := ci.driver.Stat(ctx, completePath); err == nil {
+		return nil
+	} else if _, ok := err.(driver.PathNotFoundError); !ok {
+		return err
+	}
+	return ci.build(ctx, enumerator)
+}
+
+// shards returns the shards of the index which may hold repositories whose
+// name starts with prefix, in the order of the catalog.
+func (ci *catalogIndex) shards(ctx context.Context, prefix string) ([]string, error) {
+	root, err := pathFor(catalogIndexPathSpec{})
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := ci.driver.List(ctx, root)
+	if err != nil {
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	prefixShard := catalogIndexShard(prefix)
+	shards := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		shard := path.Base(entry)
+		if strings.HasPrefix(shard, "_") {
+			continue
+		}
+		// the shard of a name shorter than the shard prefix may still
+		// hold repositories starting with prefix, and the other way around
+		if !strings.HasPrefix(shard, prefixShard) && !strings.HasPrefix(prefixShard, shard) {
+			continue
+		}
+		shards = append(shards, shard)
+	}
+	sort.Strings(shards)
+	return shards, nil
+}
+
+// listShard returns the repositories of the shard whose name starts with
+// prefix, in the order of the catalog.
+func (ci *catalogIndex) listShard(ctx context.Context, shard, prefix string) ([]string, error) {
+	shardPath, err := pathFor(catalogIndexShardPathSpec{shard: shard})
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := ci.driver.List(ctx, shardPath)
+	if err != nil {
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	repos := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		repo := strings.ReplaceAll(path.Base(entry), catalogIndexSeparator, "/")
+		if strings.HasPrefix(repo, prefix) {
+			repos = append(repos, repo)
+		}
+	}
+	sort.Slice(repos, func(i, j int) bool {
+		return lessPath(repos[i], repos[j])
+	})
+	return repos, nil
+}
+
+// list returns up to n repositories following last in the catalog whose name
+// starts with prefix. Only the shards from the one of last are listed, until
+// n repositories are found. more is set if there are repositories left.
+func (ci *catalogIndex) list(ctx context.Context, prefix, last string, n int) (repos []string, more bool, err error) {
+	shards, err := ci.shards(ctx, prefix)
+	if err != nil {
+		return nil, false, err
+	}
+
+	lastShard := catalogIndexShard(last)
+	for _, shard := range shards {
+		if last != "" && shard < lastShard {
+			continue
+		}
+
+		shardRepos, err := ci.listShard(ctx, shard, prefix)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, repo := range shardRepos {
+			if !lessPath(last, repo) {
+				continue
+			}
+			if len(repos) == n {
+				return repos, true, nil
+			}
+			repos = append(repos, repo)
+		}
+	}
+	return repos, false, nil
+}
+
+// count returns the number of repositories of the index whose name starts
+// with prefix, listing every shard which may hold them unless it is cached.
+func (ci *catalogIndex) count(ctx context.Context, prefix string) (int, error) {
+	if total, ok := ci.cachedCount(prefix); ok {
+		return total, nil
+	}
+
+	countedAt := time.Now()
+	shards, err := ci.shards(ctx, prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	var total int
+	for _, shard := range shards {
+		repos, err := ci.listShard(ctx, shard, prefix)
+		if err != nil {
+			return 0, err
+		}
+		total += len(repos)
+	}
+
+	ci.mu.Lock()
+	ci.counts.Add(prefix, cachedCount{total: total, countedAt: countedAt})
+	ci.mu.Unlock()
+	return total, nil
+}
+
+// build adds every repository of the registry to the index, and marks it as
+// complete.
+func (ci *catalogIndex) build(ctx context.Context, enumerator distribution.RepositoryEnumerator) error {
+	dcontext.GetLogger(ctx).Info("building the catalog index")
+
+	err := enumerator.Enumerate(ctx, func(name string) error {
+		return ci.add(ctx, name)
+	})
+	if _, ok := err.(driver.PathNotFoundError); err != nil && !ok {
+		return err
+	}
+
+	completePath, err := pathFor(catalogIndexCompletePathSpec{})
+	if err != nil {
+		return err
+	}
+	return ci.driver.PutContent(ctx, completePath, []byte{})
+}
+
+// ListRepositories lists up to n repositories following last in the catalog
+// whose name starts with prefix, from the catalog index. err is set to io.EOF
+// if there are no more repositories to list.
+func (reg *registry) ListRepositories(ctx context.Context, prefix, last string, n int) ([]string, error) {
+	if reg.catalogIndex == nil {
+		return nil, distribution.ErrUnsupported
+	}
+
+	if err := reg.catalogIndex.ensureBuilt(ctx, reg); err != nil {
+		return nil, err
+	}
+
+	repos, more, err := reg.catalogIndex.list(ctx, prefix, last, n)
+	if err != nil {
+		return nil, err
+	}
+	if !more {
+		return repos, io.EOF
+	}
+	return repos, nil
+}
+
+// CountRepositories returns the number of repositories whose name starts
+// with prefix, from the catalog index.
+func (reg *registry) CountRepositories(ctx context.Context, prefix string) (int, error) {
+	if reg.catalogIndex == nil {
+		return 0, distribution.ErrUnsupported
+	}
+
+	if err := reg.catalogIndex.ensureBuilt(ctx, reg); err != nil {
+		return 0, err
+	}
+	return reg.catalogIndex.count(ctx, prefix)
+}
+
+// LastPush returns the time of the last manifest push to the repository from
+// the catalog index, or the zero time if it is unknown.
+func (reg *registry) LastPush(ctx context.Context, name string) (time.Time, error) {
+	if reg.catalogIndex == nil {
+		return time.Time{}, distribution.ErrUnsupported
+	}
+	return reg.catalogIndex.lastPush(ctx, name)
+}
@@ -6,11 +6,17 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
@@ -23,16 +29,60 @@ import (
 const driverName = "azure"
 
 const (
-	paramAccountName = "accountname"
-	paramAccountKey  = "accountkey"
-	paramContainer   = "container"
-	paramRealm       = "realm"
-	maxChunkSize     = 4 * 1024 * 1024
+	paramAccountName    = "accountname"
+	paramAccountKey     = "accountkey"
+	paramContainer      = "container"
+	paramRealm          = "realm"
+	paramCredentials    = "credentials"
+	paramBlockSize      = "blocksize"
+	paramMaxConcurrency = "maxconcurrency"
+	paramAccessTier     = "accesstier"
+	paramBlobAccessTier = "blobaccesstier"
+	paramMaxRetries     = "maxretries"
+	paramRetryDelay     = "retrydelay"
+	maxChunkSize        = 4 * 1024 * 1024
 )
 
+const (
+	// defaultBlockSize is the size of the blocks uploaded by the writers.
+	defaultBlockSize = 4 * 1024 * 1024
+	// minBlockSize and maxBlockSize bound the size of the blocks, the
+	// latter being the limit of Put Block of the storage API version.
+	minBlockSize = 1024 * 1024
+	maxBlockSize = 100 * 1024 * 1024
+	// maxBlocks is the maximum number of blocks of a block blob.
+	maxBlocks = 50000
+
+	defaultMaxConcurrency = 1
+	defaultMaxRetries     = 4
+	defaultRetryDelay     = 5 * time.Second
+
+	// tierAPIVersion is the first storage API version setting the access
+	// tier of the blobs as they are written.
+	tierAPIVersion = "2018-11-09"
+)
+
+// accessTiers are the online access tiers of block blobs.
+var accessTiers = []string{"Hot", "Cool"}
+
+// blobDataPathRegexp matches the paths of committed blob data.
+var blobDataPathRegexp = regexp.MustCompile(`/blobs/[^/]+/[0-9a-f]{2}/[^/]+/data$`)
+
 type driver struct {
-	client    azure.BlobStorageClient
-	container string
+	client      azure.BlobStorageClient
+	accountName string
+	container   string
+
+	blockSize      int64
+	maxConcurrency int
+	accessTier     string
+	blobAccessTier string
+	// tierClients write the blobs with the access tier they are keyed by.
+	tierClients map[string]*azure.BlobStorageClient
+
+	// delegationKeys signs URLs when authenticating with an Azure AD
+	// identity rather than the account key.
+	delegationKeys *userDelegationKeyCache
 }
 
 type baseEmbed struct{ base.Base }
@@ -51,52 +101,266 @@ func (factory *azureDriverFactory) Create(parameters map[string]interface{}) (st
 	return FromParameters(parameters)
 }
 
+// DriverParameters is a struct that encapsulates all of the driver parameters
+// after all values have been set
+type DriverParameters struct {
+	AccountName string
+	AccountKey  string
+	Container   string
+	Realm       string
+	Credentials Credentials
+
+	// BlockSize is the size of the blocks the uploads are written in.
+	BlockSize int64
+	// MaxConcurrency is the number of blocks of an upload written
+	// concurrently.
+	MaxConcurrency int
+	// AccessTier is the access tier of the blobs written, the default
+	// access tier of the account if empty.
+	AccessTier string
+	// BlobAccessTier is the access tier of committed blob data, which
+	// defaults to AccessTier.
+	BlobAccessTier string
+	// MaxRetries is the number of times the failed requests are retried,
+	// after a delay growing exponentially from RetryDelay.
+	MaxRetries int
+	RetryDelay time.Duration
+}
+
 // FromParameters constructs a new Driver with a given parameters map.
 func FromParameters(parameters map[string]interface{}) (*Driver, error) {
+	params, err := parseParameters(parameters)
+	if err != nil {
+		return nil, err
+	}
+	return NewWithParameters(params)
+}
+
+func parseParameters(parameters map[string]interface{}) (DriverParameters, error) {
+	var params DriverParameters
+
 	accountName, ok := parameters[paramAccountName]
 	if !ok || fmt.Sprint(accountName) == "" {
-		return nil, fmt.Errorf("no %s parameter provided", paramAccountName)
+		return params, fmt.Errorf("no %s parameter provided", paramAccountName)
+	}
+	params.AccountName = fmt.Sprint(accountName)
+
+	credentials, err := parseCredentials(parameters)
+	if err != nil {
+		return params, err
 	}
+	params.Credentials = credentials
 
 	accountKey, ok := parameters[paramAccountKey]
-	if !ok || fmt.Sprint(accountKey) == "" {
-		return nil, fmt.Errorf("no %s parameter provided", paramAccountKey)
+	if credentials.Type == credentialsSharedKey && (!ok || fmt.Sprint(accountKey) == "") {
+		return params, fmt.Errorf("no %s parameter provided", paramAccountKey)
+	}
+	if ok {
+		params.AccountKey = fmt.Sprint(accountKey)
 	}
 
 	container, ok := parameters[paramContainer]
 	if !ok || fmt.Sprint(container) == "" {
-		return nil, fmt.Errorf("no %s parameter provided", paramContainer)
+		return params, fmt.Errorf("no %s parameter provided", paramContainer)
 	}
+	params.Container = fmt.Sprint(container)
 
 	realm, ok := parameters[paramRealm]
 	if !ok || fmt.Sprint(realm) == "" {
 		realm = azure.DefaultBaseURL
 	}
+	params.Realm = fmt.Sprint(realm)
+
+	if params.BlockSize, err = getParameterAsInt64(parameters, paramBlockSize, defaultBlockSize, minBlockSize, maxBlockSize); err != nil {
+		return params, err
+	}
+	maxConcurrency, err := getParameterAsInt64(parameters, paramMaxConcurrency, defaultMaxConcurrency, 1, 64)
+	if err != nil {
+		return params, err
+	}
+	params.MaxConcurrency = int(maxConcurrency)
+	maxRetries, err := getParameterAsInt64(parameters, paramMaxRetries, defaultMaxRetries, 0, 100)
+	if err != nil {
+		return params, err
+	}
+	params.MaxRetries = int(maxRetries)
+
+	params.RetryDelay = defaultRetryDelay
+	if retryDelay, ok := parameters[paramRetryDelay]; ok && retryDelay != nil {
+		params.RetryDelay, err = time.ParseDuration(fmt.Sprint(retryDelay))
+		if err != nil || params.RetryDelay < 0 {
+			return params, fmt.Errorf("the %s parameter must be a positive duration, %v invalid", paramRetryDelay, retryDelay)
+		}
+	}
+
+	if params.AccessTier, err = parseAccessTier(parameters, paramAccessTier); err != nil {
+		return params, err
+	}
+	if params.BlobAccessTier, err = parseAccessTier(parameters, paramBlobAccessTier); err != nil {
+		return params, err
+	}
+
+	return params, nil
+}
+
+// parseAccessTier validates the access tier of the named parameter, if set.
+func parseAccessTier(parameters map[string]interface{}, name string) (string, error) {
+	param, ok := parameters[name]
+	if !ok || param == nil || fmt.Sprint(param) == "" {
+		return "", nil
+	}
+	for _, tier := range accessTiers {
+		if strings.EqualFold(fmt.Sprint(param), tier) {
+			return tier, nil
+		}
+	}
+	return "", fmt.Errorf("the %s parameter must be one of %v, %v invalid", name, accessTiers, param)
+}
+
+// getParameterAsInt64 converts parameters[name] to an int64 value (using
+// defaultt if nil), verifies it is between min and max, and returns it.
+func getParameterAsInt64(parameters map[string]interface{}, name string, defaultt int64, min int64, max int64) (int64, error) {
+	rv := defaultt
+	param := parameters[name]
+	switch v := param.(type) {
+	case string:
+		vv, err := strconv.ParseInt(v, 0, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%s parameter must be an integer, %v invalid", name, param)
+		}
+		rv = vv
+	case int64:
+		rv = v
+	case int, uint, int32, uint32, uint64:
+		rv = reflect.ValueOf(v).Convert(reflect.TypeOf(rv)).Int()
+	case nil:
+		// do nothing
+	default:
+		return 0, fmt.Errorf("invalid value for %s: %#v", name, param)
+	}
+
+	if rv < min || rv > max {
+		return 0, fmt.Errorf("the %s %#v parameter should be a number between %d and %d (inclusive)", name, rv, min, max)
+	}
 
-	return New(fmt.Sprint(accountName), fmt.Sprint(accountKey), fmt.Sprint(container), fmt.Sprint(realm))
+	return rv, nil
 }
 
 // New constructs a new Driver with the given Azure Storage Account credentials
 func New(accountName, accountKey, container, realm string) (*Driver, error) {
-	api, err := azure.NewClient(accountName, accountKey, realm, azure.DefaultAPIVersion, true)
+	return NewWithParameters(DriverParameters{
+		AccountName: accountName,
+		AccountKey:  accountKey,
+		Container:   container,
+		Realm:       realm,
+		Credentials: Credentials{Type: credentialsSharedKey},
+
+		BlockSize:      defaultBlockSize,
+		MaxConcurrency: defaultMaxConcurrency,
+		MaxRetries:     defaultMaxRetries,
+		RetryDelay:     defaultRetryDelay,
+	})
+}
+
+// NewWithParameters constructs a new Driver with the given parameters,
+// authenticating with the account key or with an Azure AD identity.
+func NewWithParameters(params DriverParameters) (*Driver, error) {
+	if params.BlockSize <= 0 {
+		params.BlockSize = defaultBlockSize
+	}
+	if params.MaxConcurrency <= 0 {
+		params.MaxConcurrency = defaultMaxConcurrency
+	}
+
+	api, err := newClient(params, azure.DefaultAPIVersion)
 	if err != nil {
 		return nil, err
 	}
 
-	blobClient := api.GetBlobService()
+	d := &driver{
+		accountName:    params.AccountName,
+		container:      params.Container,
+		blockSize:      params.BlockSize,
+		maxConcurrency: params.MaxConcurrency,
+		accessTier:     params.AccessTier,
+		blobAccessTier: params.BlobAccessTier,
+		tierClients:    make(map[string]*azure.BlobStorageClient),
+	}
+
+	if params.Credentials.Type != credentialsSharedKey {
+		token, err := newServicePrincipalToken(params.Credentials)
+		if err != nil {
+			return nil, err
+		}
+		api.HTTPClient = &http.Client{
+			Transport: &bearerTransport{token: token, transport: http.DefaultTransport},
+		}
+		d.delegationKeys = &userDelegationKeyCache{
+			client:   api.HTTPClient,
+			endpoint: fmt.Sprintf("https://%s.blob.%s/", params.AccountName, params.Realm),
+		}
+	}
+
+	d.client = api.GetBlobService()
+
+	// the blobs are written with their access tier by clients sending it
+	// along with every request
+	for _, tier := range []string{params.AccessTier, params.BlobAccessTier} {
+		if _, ok := d.tierClients[tier]; ok || tier == "" {
+			continue
+		}
+		tierAPI, err := newClient(params, tierAPIVersion)
+		if err != nil {
+			return nil, err
+		}
+		tierAPI.HTTPClient = api.HTTPClient
+		tierAPI.AddAdditionalHeaders(map[string]string{"x-ms-access-tier": tier})
+		tierClient := tierAPI.GetBlobService()
+		d.tierClients[tier] = &tierClient
+	}
 
 	// Create registry container
-	containerRef := blobClient.GetContainerReference(container)
+	containerRef := d.client.GetContainerReference(params.Container)
 	if _, err = containerRef.CreateIfNotExists(nil); err != nil {
 		return nil, err
 	}
 
-	d := &driver{
-		client:    blobClient,
-		container: container}
 	return &Driver{baseEmbed: baseEmbed{Base: base.Base{StorageDriver: d}}}, nil
 }
 
+// newClient returns a storage client of the API version retrying the failed
+// requests as configured.
+func newClient(params DriverParameters, apiVersion string) (azure.Client, error) {
+	accountKey := params.AccountKey
+	if params.Credentials.Type != credentialsSharedKey {
+		// the storage client always signs requests with a shared key,
+		// which is replaced by the Azure AD token before they are sent
+		accountKey = base64.StdEncoding.EncodeToString([]byte(params.Credentials.Type))
+	}
+	api, err := azure.NewClient(params.AccountName, accountKey, params.Realm, apiVersion, true)
+	if err != nil {
+		return api, err
+	}
+	if sender, ok := api.Sender.(*azure.DefaultSender); ok {
+		sender.RetryAttempts = params.MaxRetries + 1
+		sender.RetryDuration = params.RetryDelay
+	}
+	return api, nil
+}
+
+// writeClient returns the client writing the blob at path with its access
+// tier.
+func (d *driver) writeClient(path string) *azure.BlobStorageClient {
+	tier := d.accessTier
+	if d.blobAccessTier != "" && blobDataPathRegexp.MatchString(path) {
+		tier = d.blobAccessTier
+	}
+	if client, ok := d.tierClients[tier]; ok {
+		return client
+	}
+	return &d.client
+}
+
 // Implement the storagedriver.StorageDriver interface.
 func (d *driver) Name() string {
 	return driverName
@@ -149,8 +413,7 @@ func (d *driver) PutContent(ctx context.Context, path string, contents []byte) e
 	}
 
 	r := bytes.NewReader(contents)
-	// reset properties to empty before doing overwrite
-	blobRef.Properties = azure.BlobProperties{}
+	blobRef = d.writeClient(path).GetContainerReference(d.container).GetBlobReference(path)
 	return blobRef.CreateBlockBlobFromReader(r, nil)
 }
 
@@ -188,38 +451,65 @@ func (d *driver) Reader(ctx context.Context, path string, offset int64) (io.Read
 
 // Writer returns a FileWriter which will store the content written to it
 // at the location designated by "path" after the call to Commit.
+//
+// The content is written as a block blob, in blocks of the configured size
+// uploaded concurrently and committed by Close and Commit. Appending to an
+// append blob, written by the previous versions of the driver, appends
+// blocks to it instead.
 func (d *driver) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
 	blobRef := d.client.GetContainerReference(d.container).GetBlobReference(path)
 	blobExists, err := blobRef.Exists()
 	if err != nil {
 		return nil, err
 	}
-	var size int64
-	if blobExists {
-		if append {
-			err = blobRef.GetProperties(nil)
-			if err != nil {
-				return nil, err
-			}
-			blobProperties := blobRef.Properties
-			size = blobProperties.ContentLength
-		} else {
-			err = blobRef.Delete(nil)
-			if err != nil {
+
+	if !append {
+		if blobExists {
+			if err := blobRef.Delete(nil); err != nil {
 				return nil, err
 			}
 		}
-	} else {
-		if append {
-			return nil, storagedriver.PathNotFoundError{Path: path}
+		// the blob exists from now on, even if nothing is written
+		if err := blobRef.CreateBlockBlob(nil); err != nil {
+			return nil, err
 		}
-		err = blobRef.PutAppendBlob(nil)
+		return d.newBlockBlobWriter(path, 0, nil), nil
+	}
+
+	if !blobExists {
+		return nil, storagedriver.PathNotFoundError{Path: path}
+	}
+	if err := blobRef.GetProperties(nil); err != nil {
+		return nil, err
+	}
+	size := blobRef.Properties.ContentLength
+	if blobRef.Properties.BlobType == azure.BlobTypeAppend {
+		return d.newAppendWriter(path, size), nil
+	}
+
+	list, err := blobRef.GetBlockList(azure.BlockListTypeCommitted, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(list.CommittedBlocks) == 0 && size > 0 {
+		// the blob was written at once, its content is written again as
+		// the first blocks
+		blob, err := blobRef.Get(nil)
 		if err != nil {
 			return nil, err
 		}
+		defer blob.Close()
+		w := d.newBlockBlobWriter(path, 0, nil)
+		if _, err := io.Copy(w, blob); err != nil {
+			return nil, err
+		}
+		return w, nil
 	}
-
-	return d.newWriter(path, size), nil
+	blocks := make([]azure.Block, len(list.CommittedBlocks))
+	for i, block := range list.CommittedBlocks {
+		blocks[i] = azure.Block{ID: block.Name, Status: azure.BlockStatusCommitted}
+	}
+	return d.newBlockBlobWriter(path, size, blocks), nil
 }
 
 // Stat retrieves the FileInfo for the given path, including the current size
@@ -294,7 +584,7 @@ func (d *driver) List(ctx context.Context, path string) ([]string, error) {
 func (d *driver) Move(ctx context.Context, sourcePath string, destPath string) error {
 	srcBlobRef := d.client.GetContainerReference(d.container).GetBlobReference(sourcePath)
 	sourceBlobURL := srcBlobRef.GetURL()
-	destBlobRef := d.client.GetContainerReference(d.container).GetBlobReference(destPath)
+	destBlobRef := d.writeClient(destPath).GetContainerReference(d.container).GetBlobReference(destPath)
 	err := destBlobRef.Copy(sourceBlobURL, nil)
 	if err != nil {
 		if is404(err) {
@@ -338,6 +628,8 @@ func (d *driver) Delete(ctx context.Context, path string) error {
 
 // URLFor returns a publicly accessible URL for the blob stored at given path
 // for specified duration by making use of Azure Storage Shared Access Signatures (SAS).
+// The SAS is signed with the account key or, when authenticating with an
+// Azure AD identity, with a user delegation key.
 // See https://msdn.microsoft.com/en-us/library/azure/ee395415.aspx for more info.
 func (d *driver) URLFor(ctx context.Context, path string, options map[string]interface{}) (string, error) {
 	expiresTime := time.Now().UTC().Add(20 * time.Minute) // default expiration
@@ -349,6 +641,17 @@ func (d *driver) URLFor(ctx context.Context, path string, options map[string]int
 		}
 	}
 	blobRef := d.client.GetContainerReference(d.container).GetBlobReference(path)
+	if d.delegationKeys != nil {
+		key, err := d.delegationKeys.get(expiresTime)
+		if err != nil {
+			return "", err
+		}
+		sas, err := userDelegationSAS(key, d.accountName, d.container, path, expiresTime)
+		if err != nil {
+			return "", err
+		}
+		return blobRef.GetURL() + "?" + sas.Encode(), nil
+	}
 	return blobRef.GetSASURI(azure.BlobSASOptions{
 		BlobServiceSASPermissions: azure.BlobServiceSASPermissions{
 			Read: true,
@@ -434,7 +737,9 @@ func is404(err error) bool {
 	return ok && statusCodeErr.StatusCode == http.StatusNotFound
 }
 
-type writer struct {
+// appendWriter appends blocks to an append blob written by the previous
+// versions of the driver.
+type appendWriter struct {
 	driver    *driver
 	path      string
 	size      int64
@@ -444,12 +749,12 @@ type writer struct {
 	cancelled bool
 }
 
-func (d *driver) newWriter(path string, size int64) storagedriver.FileWriter {
-	return &writer{
+func (d *driver) newAppendWriter(path string, size int64) storagedriver.FileWriter {
+	return &appendWriter{
 		driver: d,
 		path:   path,
 		size:   size,
-		bw: bufio.NewWriterSize(&blockWriter{
+		bw: bufio.NewWriterSize(&appendBlockWriter{
 			client:    d.client,
 			container: d.container,
 			path:      path,
@@ -457,7 +762,7 @@ func (d *driver) newWriter(path string, size int64) storagedriver.FileWriter {
 	}
 }
 
-func (w *writer) Write(p []byte) (int, error) {
+func (w *appendWriter) Write(p []byte) (int, error) {
 	if w.closed {
 		return 0, fmt.Errorf("already closed")
 	} else if w.committed {
@@ -471,11 +776,11 @@ func (w *writer) Write(p []byte) (int, error) {
 	return n, err
 }
 
-func (w *writer) Size() int64 {
+func (w *appendWriter) Size() int64 {
 	return w.size
 }
 
-func (w *writer) Close() error {
+func (w *appendWriter) Close() error {
 	if w.closed {
 		return fmt.Errorf("already closed")
 	}
@@ -483,7 +788,7 @@ func (w *writer) Close() error {
 	return w.bw.Flush()
 }
 
-func (w *writer) Cancel() error {
+func (w *appendWriter) Cancel() error {
 	if w.closed {
 		return fmt.Errorf("already closed")
 	} else if w.committed {
@@ -494,7 +799,7 @@ func (w *writer) Cancel() error {
 	return blobRef.Delete(nil)
 }
 
-func (w *writer) Commit() error {
+func (w *appendWriter) Commit() error {
 	if w.closed {
 		return fmt.Errorf("already closed")
 	} else if w.committed {
@@ -506,13 +811,13 @@ func (w *writer) Commit() error {
 	return w.bw.Flush()
 }
 
-type blockWriter struct {
+type appendBlockWriter struct {
 	client    azure.BlobStorageClient
 	container string
 	path      string
 }
 
-func (bw *blockWriter) Write(p []byte) (int, error) {
+func (bw *appendBlockWriter) Write(p []byte) (int, error) {
 	n := 0
 	blobRef := bw.client.GetContainerReference(bw.container).GetBlobReference(bw.path)
 	for offset := 0; offset < len(p); offset += maxChunkSize {
@@ -530,3 +835,198 @@ func (bw *blockWriter) Write(p []byte) (int, error) {
 
 	return n, nil
 }
+
+// blockBlobWriter writes a block blob in blocks of the block size of the
+// driver, up to its maximum concurrency being uploaded at once. The blocks
+// are committed, after those already committed to the blob, by Close and
+// Commit, so that the upload can be resumed.
+type blockBlobWriter struct {
+	driver *driver
+	path   string
+	size   int64
+	// blocks are the blocks of the blob, those committed followed by
+	// those uploaded since
+	blocks      []azure.Block
+	uncommitted bool
+	buf         []byte
+	closed      bool
+	committed   bool
+	cancelled   bool
+
+	limiter  chan struct{}
+	inflight sync.WaitGroup
+	mu       sync.Mutex
+	err      error
+}
+
+func (d *driver) newBlockBlobWriter(path string, size int64, blocks []azure.Block) *blockBlobWriter {
+	return &blockBlobWriter{
+		driver:  d,
+		path:    path,
+		size:    size,
+		blocks:  blocks,
+		limiter: make(chan struct{}, d.maxConcurrency),
+	}
+}
+
+func (w *blockBlobWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fmt.Errorf("already closed")
+	} else if w.committed {
+		return 0, fmt.Errorf("already committed")
+	} else if w.cancelled {
+		return 0, fmt.Errorf("already cancelled")
+	}
+
+	var n int
+	for len(p) > 0 {
+		needed := int(w.driver.blockSize) - len(w.buf)
+		if len(p) < needed {
+			w.buf = append(w.buf, p...)
+			n += len(p)
+			break
+		}
+		w.buf = append(w.buf, p[:needed]...)
+		n += needed
+		p = p[needed:]
+		if err := w.flushBlock(); err != nil {
+			w.size += int64(n)
+			return n, err
+		}
+	}
+	w.size += int64(n)
+	return n, nil
+}
+
+func (w *blockBlobWriter) Size() int64 {
+	return w.size
+}
+
+func (w *blockBlobWriter) Close() error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	}
+	w.closed = true
+	if w.cancelled {
+		return nil
+	}
+	return w.commitBlocks()
+}
+
+func (w *blockBlobWriter) Cancel() error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	} else if w.committed {
+		return fmt.Errorf("already committed")
+	}
+	w.cancelled = true
+	// blocks still being uploaded would otherwise outlive the blob
+	w.wait()
+	blobRef := w.driver.client.GetContainerReference(w.driver.container).GetBlobReference(w.path)
+	return blobRef.Delete(nil)
+}
+
+func (w *blockBlobWriter) Commit() error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	} else if w.committed {
+		return fmt.Errorf("already committed")
+	} else if w.cancelled {
+		return fmt.Errorf("already cancelled")
+	}
+	if err := w.commitBlocks(); err != nil {
+		return err
+	}
+	w.committed = true
+	return nil
+}
+
+// flushBlock uploads the buffered content as a block, in the background
+// once fewer than the maximum concurrency of blocks are in flight. Errors
+// are reported by the following calls to flushBlock and wait.
+func (w *blockBlobWriter) flushBlock() error {
+	if err := w.uploadErr(); err != nil {
+		return err
+	}
+	if len(w.buf) == 0 {
+		return nil
+	}
+	if len(w.blocks) >= maxBlocks {
+		return fmt.Errorf("upload to %s exceeds the maximum of %d blocks", w.path, maxBlocks)
+	}
+
+	id, err := newBlockID()
+	if err != nil {
+		return err
+	}
+	w.blocks = append(w.blocks, azure.Block{ID: id, Status: azure.BlockStatusUncommitted})
+	w.uncommitted = true
+	body := w.buf
+	w.buf = nil
+
+	w.limiter <- struct{}{}
+	w.inflight.Add(1)
+	go func() {
+		defer func() {
+			<-w.limiter
+			w.inflight.Done()
+		}()
+		blobRef := w.driver.client.GetContainerReference(w.driver.container).GetBlobReference(w.path)
+		if err := blobRef.PutBlock(id, body, nil); err != nil {
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			if w.err == nil {
+				w.err = err
+			}
+		}
+	}()
+	return nil
+}
+
+// commitBlocks uploads the buffered content and commits the blocks uploaded
+// since the last commit, if any.
+func (w *blockBlobWriter) commitBlocks() error {
+	if err := w.flushBlock(); err != nil {
+		return err
+	}
+	if err := w.wait(); err != nil {
+		return err
+	}
+	if !w.uncommitted {
+		return nil
+	}
+
+	blobRef := w.driver.writeClient(w.path).GetContainerReference(w.driver.container).GetBlobReference(w.path)
+	if err := blobRef.PutBlockList(w.blocks, nil); err != nil {
+		return err
+	}
+	for i := range w.blocks {
+		w.blocks[i].Status = azure.BlockStatusCommitted
+	}
+	w.uncommitted = false
+	return nil
+}
+
+// uploadErr returns the first error of the blocks uploaded so far.
+func (w *blockBlobWriter) uploadErr() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// wait waits for the blocks in flight to be uploaded and returns the first
+// error of the uploads.
+func (w *blockBlobWriter) wait() error {
+	w.inflight.Wait()
+	return w.uploadErr()
+}
+
+// newBlockID returns a random block ID. The IDs of the blocks of a blob
+// must all have the same length.
+func newBlockID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(id), nil
+}
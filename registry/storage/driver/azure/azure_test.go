@@ -1,14 +1,20 @@
 package azure
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/distribution/distribution/v3/registry/storage/driver/testsuites"
 	. "gopkg.in/check.v1"
+
+	azure "github.com/Azure/azure-sdk-for-go/storage"
 )
 
 const (
@@ -61,3 +67,242 @@ func init() {
 
 	testsuites.RegisterSuite(azureDriverConstructor, skipCheck)
 }
+
+func TestParseParameters(t *testing.T) {
+	tokenFile := "/var/run/secrets/azure/tokens/azure-identity-token"
+
+	tests := []struct {
+		parameters map[string]interface{}
+		expected   *DriverParameters
+	}{
+		{
+			parameters: map[string]interface{}{
+				"accountname": "account",
+				"container":   "registry",
+			},
+		},
+		{
+			parameters: map[string]interface{}{
+				"accountname": "account",
+				"accountkey":  "key",
+				"container":   "registry",
+			},
+			expected: &DriverParameters{
+				AccountName:    "account",
+				AccountKey:     "key",
+				Container:      "registry",
+				Realm:          "core.windows.net",
+				Credentials:    Credentials{Type: credentialsSharedKey},
+				BlockSize:      defaultBlockSize,
+				MaxConcurrency: defaultMaxConcurrency,
+				MaxRetries:     defaultMaxRetries,
+				RetryDelay:     defaultRetryDelay,
+			},
+		},
+		{
+			parameters: map[string]interface{}{
+				"accountname": "account",
+				"container":   "registry",
+				"realm":       "core.chinacloudapi.cn",
+				"credentials": map[interface{}]interface{}{
+					"type":     "managedidentity",
+					"clientid": "client",
+				},
+			},
+			expected: &DriverParameters{
+				AccountName:    "account",
+				Container:      "registry",
+				Realm:          "core.chinacloudapi.cn",
+				Credentials:    Credentials{Type: credentialsManagedIdentity, ClientID: "client"},
+				BlockSize:      defaultBlockSize,
+				MaxConcurrency: defaultMaxConcurrency,
+				MaxRetries:     defaultMaxRetries,
+				RetryDelay:     defaultRetryDelay,
+			},
+		},
+		{
+			parameters: map[string]interface{}{
+				"accountname": "account",
+				"container":   "registry",
+				"credentials": map[interface{}]interface{}{
+					"type":               "workloadidentity",
+					"clientid":           "client",
+					"tenantid":           "tenant",
+					"federatedtokenfile": tokenFile,
+				},
+			},
+			expected: &DriverParameters{
+				AccountName: "account",
+				Container:   "registry",
+				Realm:       "core.windows.net",
+				Credentials: Credentials{
+					Type:               credentialsWorkloadIdentity,
+					ClientID:           "client",
+					TenantID:           "tenant",
+					FederatedTokenFile: tokenFile,
+				},
+				BlockSize:      defaultBlockSize,
+				MaxConcurrency: defaultMaxConcurrency,
+				MaxRetries:     defaultMaxRetries,
+				RetryDelay:     defaultRetryDelay,
+			},
+		},
+		{
+			parameters: map[string]interface{}{
+				"accountname": "account",
+				"container":   "registry",
+				"credentials": map[interface{}]interface{}{
+					"type":     "workloadidentity",
+					"clientid": "client",
+				},
+			},
+		},
+		{
+			parameters: map[string]interface{}{
+				"accountname": "account",
+				"container":   "registry",
+				"credentials": map[interface{}]interface{}{
+					"type": "password",
+				},
+			},
+		},
+		{
+			parameters: map[string]interface{}{
+				"accountname":    "account",
+				"accountkey":     "key",
+				"container":      "registry",
+				"blocksize":      "16777216",
+				"maxconcurrency": 8,
+				"accesstier":     "hot",
+				"blobaccesstier": "Cool",
+				"maxretries":     0,
+				"retrydelay":     "2s",
+			},
+			expected: &DriverParameters{
+				AccountName:    "account",
+				AccountKey:     "key",
+				Container:      "registry",
+				Realm:          "core.windows.net",
+				Credentials:    Credentials{Type: credentialsSharedKey},
+				BlockSize:      16 * 1024 * 1024,
+				MaxConcurrency: 8,
+				AccessTier:     "Hot",
+				BlobAccessTier: "Cool",
+				MaxRetries:     0,
+				RetryDelay:     2 * time.Second,
+			},
+		},
+		{
+			parameters: map[string]interface{}{
+				"accountname": "account",
+				"accountkey":  "key",
+				"container":   "registry",
+				"blocksize":   200 * 1024 * 1024,
+			},
+		},
+		{
+			parameters: map[string]interface{}{
+				"accountname":    "account",
+				"accountkey":     "key",
+				"container":      "registry",
+				"blobaccesstier": "Archive",
+			},
+		},
+		{
+			parameters: map[string]interface{}{
+				"accountname": "account",
+				"accountkey":  "key",
+				"container":   "registry",
+				"retrydelay":  "soon",
+			},
+		},
+	}
+
+	for i, test := range tests {
+		params, err := parseParameters(test.parameters)
+		if test.expected == nil {
+			if err == nil {
+				t.Errorf("%d: expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: unexpected error: %v", i, err)
+			continue
+		}
+		if params != *test.expected {
+			t.Errorf("%d: unexpected parameters: %+v != %+v", i, params, *test.expected)
+		}
+	}
+}
+
+func TestUserDelegationSAS(t *testing.T) {
+	secret := []byte("user delegation key")
+	key := &userDelegationKey{
+		SignedOID:     "oid",
+		SignedTID:     "tid",
+		SignedStart:   time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
+		SignedExpiry:  time.Date(2022, 1, 2, 0, 0, 0, 0, time.UTC),
+		SignedService: "b",
+		SignedVersion: "2020-02-10",
+		Value:         base64.StdEncoding.EncodeToString(secret),
+	}
+	expiry := time.Date(2022, 1, 1, 0, 20, 0, 0, time.UTC)
+
+	sas, err := userDelegationSAS(key, "account", "registry", "/docker/registry/v2/blobs/data", expiry)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	stringToSign := "r\n\n2022-01-01T00:20:00Z\n/blob/account/registry/docker/registry/v2/blobs/data\n" +
+		"oid\ntid\n2022-01-01T00:00:00Z\n2022-01-02T00:00:00Z\nb\n2020-02-10\n\n\n\n\nhttps\n2020-02-10\nb\n\n\n\n\n\n"
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(stringToSign))
+	if sig := base64.StdEncoding.EncodeToString(h.Sum(nil)); sas.Get("sig") != sig {
+		t.Errorf("unexpected signature: %s != %s", sas.Get("sig"), sig)
+	}
+
+	for k, v := range map[string]string{
+		"sv":    "2020-02-10",
+		"sr":    "b",
+		"sp":    "r",
+		"se":    "2022-01-01T00:20:00Z",
+		"skoid": "oid",
+		"sktid": "tid",
+		"skt":   "2022-01-01T00:00:00Z",
+		"ske":   "2022-01-02T00:00:00Z",
+	} {
+		if sas.Get(k) != v {
+			t.Errorf("unexpected %s: %q != %q", k, sas.Get(k), v)
+		}
+	}
+}
+
+func TestWriteClientAccessTier(t *testing.T) {
+	var hot, cool azure.BlobStorageClient
+	d := &driver{
+		accessTier:     "Hot",
+		blobAccessTier: "Cool",
+		tierClients: map[string]*azure.BlobStorageClient{
+			"Hot":  &hot,
+			"Cool": &cool,
+		},
+	}
+
+	for path, expected := range map[string]*azure.BlobStorageClient{
+		"/docker/registry/v2/blobs/sha256/ab/abcdef/data":                     &cool,
+		"/docker/registry/v2/repositories/app/_layers/sha256/abcdef/link":     &hot,
+		"/docker/registry/v2/repositories/app/_uploads/0123/data":             &hot,
+		"/docker/registry/v2/repositories/app/_manifests/tags/latest/current": &hot,
+	} {
+		if client := d.writeClient(path); client != expected {
+			t.Errorf("unexpected client writing %s", path)
+		}
+	}
+
+	d.accessTier = ""
+	delete(d.tierClients, "Hot")
+	if client := d.writeClient("/docker/registry/v2/repositories/app/_uploads/0123/data"); client != &d.client {
+		t.Error("expected the default client to write the blobs without access tier")
+	}
+}
@@ -0,0 +1,296 @@
+package azure
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+)
+
+const (
+	credentialsSharedKey        = "sharedkey"
+	credentialsManagedIdentity  = "managedidentity"
+	credentialsWorkloadIdentity = "workloadidentity"
+)
+
+const (
+	// storageResource is the resource Azure AD tokens are requested for.
+	storageResource = "https://storage.azure.com/"
+
+	// defaultAuthorityHost is the Azure AD endpoint used to exchange
+	// federated tokens when AZURE_AUTHORITY_HOST is not set.
+	defaultAuthorityHost = "https://login.microsoftonline.com/"
+
+	// userDelegationVersion is the storage service version used to request
+	// user delegation keys and to sign the SAS built with them.
+	userDelegationVersion = "2020-02-10"
+
+	// userDelegationKeyValidity is how long a requested user delegation key
+	// is valid for, unless a URL expiring later requires a longer validity.
+	userDelegationKeyValidity = 24 * time.Hour
+
+	sasTimeFormat = "2006-01-02T15:04:05Z"
+)
+
+// Credentials holds the Azure AD identity used to authenticate against the
+// storage account instead of the account key.
+type Credentials struct {
+	// Type is one of sharedkey, managedidentity or workloadidentity.
+	Type string
+	// ClientID selects a user-assigned managed identity, or the application
+	// the federated token is exchanged for with workload identity.
+	ClientID string
+	// TenantID is the Azure AD tenant of the workload identity.
+	TenantID string
+	// FederatedTokenFile is the path of the federated token presented with
+	// workload identity.
+	FederatedTokenFile string
+}
+
+func parseCredentials(parameters map[string]interface{}) (Credentials, error) {
+	creds := Credentials{Type: credentialsSharedKey}
+	credentials, ok := parameters[paramCredentials]
+	if !ok || credentials == nil {
+		return creds, nil
+	}
+
+	credentialsMap, ok := credentials.(map[interface{}]interface{})
+	if !ok {
+		return creds, fmt.Errorf("the %s parameter must be a map", paramCredentials)
+	}
+	values := make(map[string]string, len(credentialsMap))
+	for k, v := range credentialsMap {
+		values[fmt.Sprint(k)] = fmt.Sprint(v)
+	}
+
+	if t := strings.ToLower(values["type"]); t != "" {
+		creds.Type = t
+	}
+	creds.ClientID = values["clientid"]
+	creds.TenantID = values["tenantid"]
+	creds.FederatedTokenFile = values["federatedtokenfile"]
+
+	switch creds.Type {
+	case credentialsSharedKey, credentialsManagedIdentity:
+	case credentialsWorkloadIdentity:
+		// default to the environment injected by the AKS workload identity
+		// webhook
+		if creds.ClientID == "" {
+			creds.ClientID = os.Getenv("AZURE_CLIENT_ID")
+		}
+		if creds.TenantID == "" {
+			creds.TenantID = os.Getenv("AZURE_TENANT_ID")
+		}
+		if creds.FederatedTokenFile == "" {
+			creds.FederatedTokenFile = os.Getenv("AZURE_FEDERATED_TOKEN_FILE")
+		}
+		if creds.ClientID == "" || creds.TenantID == "" || creds.FederatedTokenFile == "" {
+			return creds, fmt.Errorf("%s credentials require a clientid, a tenantid and a federatedtokenfile", credentialsWorkloadIdentity)
+		}
+	default:
+		return creds, fmt.Errorf("unknown %s type: %q", paramCredentials, creds.Type)
+	}
+	return creds, nil
+}
+
+// newServicePrincipalToken returns the token source of the given Azure AD
+// credentials.
+func newServicePrincipalToken(creds Credentials) (*adal.ServicePrincipalToken, error) {
+	switch creds.Type {
+	case credentialsManagedIdentity:
+		return adal.NewServicePrincipalTokenFromManagedIdentity(storageResource, &adal.ManagedIdentityOptions{
+			ClientID: creds.ClientID,
+		})
+	case credentialsWorkloadIdentity:
+		authorityHost := os.Getenv("AZURE_AUTHORITY_HOST")
+		if authorityHost == "" {
+			authorityHost = defaultAuthorityHost
+		}
+		oauthConfig, err := adal.NewOAuthConfig(authorityHost, creds.TenantID)
+		if err != nil {
+			return nil, err
+		}
+		return adal.NewServicePrincipalTokenWithSecret(*oauthConfig, creds.ClientID, storageResource, &federatedTokenSecret{file: creds.FederatedTokenFile})
+	}
+	return nil, fmt.Errorf("no Azure AD token for %s credentials", creds.Type)
+}
+
+// federatedTokenSecret implements adal.ServicePrincipalSecret by presenting
+// the federated token found in a file as client assertion. The file is read
+// on every refresh as it is rotated by the platform.
+type federatedTokenSecret struct {
+	file string
+}
+
+// SetAuthenticationValues implements adal.ServicePrincipalSecret.
+func (s *federatedTokenSecret) SetAuthenticationValues(spt *adal.ServicePrincipalToken, v *url.Values) error {
+	assertion, err := ioutil.ReadFile(s.file)
+	if err != nil {
+		return fmt.Errorf("failed to read federated token: %v", err)
+	}
+	v.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+	v.Set("client_assertion", strings.TrimSpace(string(assertion)))
+	return nil
+}
+
+// bearerTransport authenticates the requests it forwards with an Azure AD
+// token, replacing the shared key signature set by the storage client.
+type bearerTransport struct {
+	token     *adal.ServicePrincipalToken
+	transport http.RoundTripper
+}
+
+func (t *bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.token.EnsureFreshWithContext(req.Context()); err != nil {
+		return nil, fmt.Errorf("failed to refresh Azure AD token: %v", err)
+	}
+	// RoundTrip must not modify the request it was given
+	r := req.Clone(req.Context())
+	r.Header.Set("Authorization", "Bearer "+t.token.OAuthToken())
+	return t.transport.RoundTrip(r)
+}
+
+// userDelegationKey is a key obtained with Azure AD credentials to sign
+// shared access signatures.
+// See https://docs.microsoft.com/en-us/rest/api/storageservices/get-user-delegation-key
+type userDelegationKey struct {
+	SignedOID     string    `xml:"SignedOid"`
+	SignedTID     string    `xml:"SignedTid"`
+	SignedStart   time.Time `xml:"SignedStart"`
+	SignedExpiry  time.Time `xml:"SignedExpiry"`
+	SignedService string    `xml:"SignedService"`
+	SignedVersion string    `xml:"SignedVersion"`
+	Value         string    `xml:"Value"`
+}
+
+// userDelegationKeyCache requests user delegation keys from the blob service
+// and reuses them until they no longer cover the requested expiry.
+type userDelegationKeyCache struct {
+	sync.Mutex
+	client   *http.Client
+	endpoint string
+	key      *userDelegationKey
+}
+
+func (c *userDelegationKeyCache) get(expiry time.Time) (*userDelegationKey, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.key != nil && c.key.SignedExpiry.After(expiry) {
+		return c.key, nil
+	}
+
+	start := time.Now().UTC()
+	keyExpiry := start.Add(userDelegationKeyValidity)
+	if expiry.After(keyExpiry) {
+		keyExpiry = expiry
+	}
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"KeyInfo"`
+		Start   string   `xml:"Start"`
+		Expiry  string   `xml:"Expiry"`
+	}{
+		Start:  start.Format(sasTimeFormat),
+		Expiry: keyExpiry.UTC().Format(sasTimeFormat),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.endpoint+"?restype=service&comp=userdelegationkey", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-ms-version", userDelegationVersion)
+	req.Header.Set("Content-Type", "application/xml")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("failed to get user delegation key: %s: %s", resp.Status, msg)
+	}
+
+	var key userDelegationKey
+	if err := xml.NewDecoder(resp.Body).Decode(&key); err != nil {
+		return nil, fmt.Errorf("failed to decode user delegation key: %v", err)
+	}
+	c.key = &key
+	return c.key, nil
+}
+
+// userDelegationSAS returns the query of a read only user delegation SAS for
+// the blob at the given path. The SAS has no start time so that it is valid
+// immediately regardless of clock skew.
+// See https://docs.microsoft.com/en-us/rest/api/storageservices/create-user-delegation-sas
+func userDelegationSAS(key *userDelegationKey, accountName, container, path string, expiry time.Time) (url.Values, error) {
+	secret, err := base64.StdEncoding.DecodeString(key.Value)
+	if err != nil {
+		return nil, fmt.Errorf("malformed user delegation key: %v", err)
+	}
+
+	const (
+		permissions = "r"
+		resource    = "b"
+		protocol    = "https"
+	)
+	signedExpiry := expiry.UTC().Format(sasTimeFormat)
+	keyStart := key.SignedStart.UTC().Format(sasTimeFormat)
+	keyExpiry := key.SignedExpiry.UTC().Format(sasTimeFormat)
+
+	stringToSign := strings.Join([]string{
+		permissions,
+		"", // start
+		signedExpiry,
+		"/blob/" + accountName + "/" + container + "/" + strings.TrimPrefix(path, "/"),
+		key.SignedOID,
+		key.SignedTID,
+		keyStart,
+		keyExpiry,
+		key.SignedService,
+		key.SignedVersion,
+		"", // authorized user object id
+		"", // unauthorized user object id
+		"", // correlation id
+		"", // ip range
+		protocol,
+		userDelegationVersion,
+		resource,
+		"", // snapshot time
+		"", // cache control
+		"", // content disposition
+		"", // content encoding
+		"", // content language
+		"", // content type
+	}, "\n")
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(stringToSign))
+
+	return url.Values{
+		"sv":    {userDelegationVersion},
+		"sr":    {resource},
+		"se":    {signedExpiry},
+		"sp":    {permissions},
+		"spr":   {protocol},
+		"skoid": {key.SignedOID},
+		"sktid": {key.SignedTID},
+		"skt":   {keyStart},
+		"ske":   {keyExpiry},
+		"sks":   {key.SignedService},
+		"skv":   {key.SignedVersion},
+		"sig":   {base64.StdEncoding.EncodeToString(h.Sum(nil))},
+	}, nil
+}
@@ -0,0 +1,540 @@
+package b2
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3/version"
+)
+
+// defaultAuthURL is the endpoint accounts are authorized against.
+const defaultAuthURL = "https://api.backblazeb2.com"
+
+// maxRetries is the number of times a request failing with a transient error
+// is attempted before giving up.
+const maxRetries = 5
+
+// apiError is the body of the B2 API error responses.
+type apiError struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("b2: %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// retryable reports whether the request may succeed when sent again, as
+// advised by the B2 integration checklist.
+func (e *apiError) retryable() bool {
+	switch e.Status {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusServiceUnavailable:
+		return true
+	}
+	return false
+}
+
+// expiredAuth reports whether the request was rejected because the account
+// authorization token expired.
+func (e *apiError) expiredAuth() bool {
+	return e.Status == http.StatusUnauthorized && e.Code == "expired_auth_token"
+}
+
+func isNotFound(err error) bool {
+	e, ok := err.(*apiError)
+	return ok && e.Status == http.StatusNotFound
+}
+
+// file describes a version of a file, or an unfinished large file.
+type file struct {
+	FileID          string `json:"fileId"`
+	FileName        string `json:"fileName"`
+	Action          string `json:"action"`
+	ContentLength   int64  `json:"contentLength"`
+	ContentSha1     string `json:"contentSha1"`
+	UploadTimestamp int64  `json:"uploadTimestamp"`
+}
+
+// part describes a part of a large file.
+type part struct {
+	PartNumber    int    `json:"partNumber"`
+	ContentLength int64  `json:"contentLength"`
+	ContentSha1   string `json:"contentSha1"`
+}
+
+// authorization holds the result of b2_authorize_account.
+type authorization struct {
+	AccountID               string `json:"accountId"`
+	AuthorizationToken      string `json:"authorizationToken"`
+	APIURL                  string `json:"apiUrl"`
+	DownloadURL             string `json:"downloadUrl"`
+	RecommendedPartSize     int64  `json:"recommendedPartSize"`
+	AbsoluteMinimumPartSize int64  `json:"absoluteMinimumPartSize"`
+}
+
+// client calls the B2 native API on behalf of an application key.
+type client struct {
+	httpClient     *http.Client
+	authURL        string
+	keyID          string
+	applicationKey string
+
+	mu   sync.Mutex
+	auth authorization
+}
+
+// authorize obtains a new account authorization token.
+func (c *client) authorize(ctx context.Context) error {
+	req, err := http.NewRequest(http.MethodGet, c.authURL+"/b2api/v2/b2_authorize_account", nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(c.keyID, c.applicationKey)
+
+	var auth authorization
+	if err := c.do(ctx, req, &auth); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.auth = auth
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *client) authorization() authorization {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.auth
+}
+
+// do sends req and decodes the JSON response body into v, if not nil.
+func (c *client) do(ctx context.Context, req *http.Request, v interface{}) error {
+	req.Header.Set("User-Agent", "distribution/"+version.Version)
+
+	resp, err := c.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return parseError(resp)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// withRetries calls f until it succeeds, fails with a permanent error or the
+// retries are exhausted. The account is authorized again when the token
+// expires.
+func (c *client) withRetries(ctx context.Context, f func(auth authorization) error) error {
+	backoff := 500 * time.Millisecond
+	var err error
+	for i := 0; i < maxRetries; i++ {
+		err = f(c.authorization())
+		e, ok := err.(*apiError)
+		switch {
+		case !ok:
+			return err
+		case e.expiredAuth():
+			if err := c.authorize(ctx); err != nil {
+				return err
+			}
+			continue
+		case !e.retryable():
+			return err
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+	return err
+}
+
+// call invokes the API operation op with the JSON request body in, decoding
+// the response into out.
+func (c *client) call(ctx context.Context, op string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+
+	return c.withRetries(ctx, func(auth authorization) error {
+		req, err := http.NewRequest(http.MethodPost, auth.APIURL+"/b2api/v2/"+op, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", auth.AuthorizationToken)
+		req.Header.Set("Content-Type", "application/json")
+		return c.do(ctx, req, out)
+	})
+}
+
+// bucketID looks up the id of the bucket named name.
+func (c *client) bucketID(ctx context.Context, name string) (string, error) {
+	var resp struct {
+		Buckets []struct {
+			BucketID   string `json:"bucketId"`
+			BucketName string `json:"bucketName"`
+		} `json:"buckets"`
+	}
+	err := c.call(ctx, "b2_list_buckets", map[string]interface{}{
+		"accountId":  c.authorization().AccountID,
+		"bucketName": name,
+	}, &resp)
+	if err != nil {
+		return "", err
+	}
+	for _, bucket := range resp.Buckets {
+		if bucket.BucketName == name {
+			return bucket.BucketID, nil
+		}
+	}
+	return "", fmt.Errorf("bucket %s does not exist", name)
+}
+
+// uploadFile stores content as a new version of the file named name.
+func (c *client) uploadFile(ctx context.Context, bucketID, name string, content []byte) (file, error) {
+	checksum := sha1.Sum(content)
+
+	var f file
+	err := c.withRetries(ctx, func(auth authorization) error {
+		// An upload url can't be used concurrently, so each upload gets
+		// its own.
+		var upload struct {
+			UploadURL          string `json:"uploadUrl"`
+			AuthorizationToken string `json:"authorizationToken"`
+		}
+		if err := c.call(ctx, "b2_get_upload_url", map[string]string{"bucketId": bucketID}, &upload); err != nil {
+			return err
+		}
+
+		req, err := http.NewRequest(http.MethodPost, upload.UploadURL, bytes.NewReader(content))
+		if err != nil {
+			return err
+		}
+		req.ContentLength = int64(len(content))
+		req.Header.Set("Authorization", upload.AuthorizationToken)
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("X-Bz-File-Name", escapeName(name))
+		req.Header.Set("X-Bz-Content-Sha1", hex.EncodeToString(checksum[:]))
+		return c.do(ctx, req, &f)
+	})
+	return f, err
+}
+
+// startLargeFile starts the upload of a large file named name, returning its
+// id.
+func (c *client) startLargeFile(ctx context.Context, bucketID, name string) (string, error) {
+	var f file
+	err := c.call(ctx, "b2_start_large_file", map[string]string{
+		"bucketId":    bucketID,
+		"fileName":    name,
+		"contentType": contentType,
+	}, &f)
+	return f.FileID, err
+}
+
+// uploadPart uploads content as the part partNumber of the large file
+// fileID.
+func (c *client) uploadPart(ctx context.Context, fileID string, partNumber int, content []byte) (part, error) {
+	checksum := sha1.Sum(content)
+
+	var p part
+	err := c.withRetries(ctx, func(auth authorization) error {
+		var upload struct {
+			UploadURL          string `json:"uploadUrl"`
+			AuthorizationToken string `json:"authorizationToken"`
+		}
+		if err := c.call(ctx, "b2_get_upload_part_url", map[string]string{"fileId": fileID}, &upload); err != nil {
+			return err
+		}
+
+		req, err := http.NewRequest(http.MethodPost, upload.UploadURL, bytes.NewReader(content))
+		if err != nil {
+			return err
+		}
+		req.ContentLength = int64(len(content))
+		req.Header.Set("Authorization", upload.AuthorizationToken)
+		req.Header.Set("X-Bz-Part-Number", strconv.Itoa(partNumber))
+		req.Header.Set("X-Bz-Content-Sha1", hex.EncodeToString(checksum[:]))
+		return c.do(ctx, req, &p)
+	})
+	return p, err
+}
+
+// copyPart copies the given byte range of the file sourceID as the part
+// partNumber of the large file fileID.
+func (c *client) copyPart(ctx context.Context, sourceID, fileID string, partNumber int, start, end int64) (part, error) {
+	var p part
+	err := c.call(ctx, "b2_copy_part", map[string]interface{}{
+		"sourceFileId": sourceID,
+		"largeFileId":  fileID,
+		"partNumber":   partNumber,
+		"range":        fmt.Sprintf("bytes=%d-%d", start, end-1),
+	}, &p)
+	return p, err
+}
+
+// listParts lists the parts uploaded so far for the large file fileID.
+func (c *client) listParts(ctx context.Context, fileID string) ([]part, error) {
+	var parts []part
+	startPartNumber := 0
+	for {
+		var resp struct {
+			Parts          []part `json:"parts"`
+			NextPartNumber *int   `json:"nextPartNumber"`
+		}
+		req := map[string]interface{}{
+			"fileId":       fileID,
+			"maxPartCount": 1000,
+		}
+		if startPartNumber > 0 {
+			req["startPartNumber"] = startPartNumber
+		}
+		if err := c.call(ctx, "b2_list_parts", req, &resp); err != nil {
+			return nil, err
+		}
+		parts = append(parts, resp.Parts...)
+		if resp.NextPartNumber == nil {
+			return parts, nil
+		}
+		startPartNumber = *resp.NextPartNumber
+	}
+}
+
+// finishLargeFile assembles the parts of the large file fileID.
+func (c *client) finishLargeFile(ctx context.Context, fileID string, parts []part) (file, error) {
+	checksums := make([]string, len(parts))
+	for i, p := range parts {
+		checksums[i] = p.ContentSha1
+	}
+
+	var f file
+	err := c.call(ctx, "b2_finish_large_file", map[string]interface{}{
+		"fileId":        fileID,
+		"partSha1Array": checksums,
+	}, &f)
+	return f, err
+}
+
+// cancelLargeFile discards the large file fileID and its parts.
+func (c *client) cancelLargeFile(ctx context.Context, fileID string) error {
+	return c.call(ctx, "b2_cancel_large_file", map[string]string{"fileId": fileID}, nil)
+}
+
+// listUnfinishedLargeFiles lists the large files being uploaded whose name
+// starts with prefix.
+func (c *client) listUnfinishedLargeFiles(ctx context.Context, bucketID, prefix string) ([]file, error) {
+	var files []file
+	var startFileID string
+	for {
+		var resp struct {
+			Files      []file  `json:"files"`
+			NextFileID *string `json:"nextFileId"`
+		}
+		req := map[string]interface{}{
+			"bucketId":     bucketID,
+			"namePrefix":   prefix,
+			"maxFileCount": 100,
+		}
+		if startFileID != "" {
+			req["startFileId"] = startFileID
+		}
+		if err := c.call(ctx, "b2_list_unfinished_large_files", req, &resp); err != nil {
+			return nil, err
+		}
+		files = append(files, resp.Files...)
+		if resp.NextFileID == nil {
+			return files, nil
+		}
+		startFileID = *resp.NextFileID
+	}
+}
+
+// listFileNames lists the latest version of the files whose name starts
+// with prefix. When delimiter is set, the files of the sub folders are
+// rolled up into a single entry with the folder action. The listing stops
+// once limit files are found, unless limit is 0.
+func (c *client) listFileNames(ctx context.Context, bucketID, prefix, delimiter string, limit int) ([]file, error) {
+	maxFileCount := 1000
+	if limit > 0 && limit < maxFileCount {
+		maxFileCount = limit
+	}
+
+	var files []file
+	var startFileName string
+	for {
+		var resp struct {
+			Files        []file  `json:"files"`
+			NextFileName *string `json:"nextFileName"`
+		}
+		req := map[string]interface{}{
+			"bucketId":     bucketID,
+			"prefix":       prefix,
+			"maxFileCount": maxFileCount,
+		}
+		if delimiter != "" {
+			req["delimiter"] = delimiter
+		}
+		if startFileName != "" {
+			req["startFileName"] = startFileName
+		}
+		if err := c.call(ctx, "b2_list_file_names", req, &resp); err != nil {
+			return nil, err
+		}
+		files = append(files, resp.Files...)
+		if resp.NextFileName == nil || limit > 0 && len(files) >= limit {
+			return files, nil
+		}
+		startFileName = *resp.NextFileName
+	}
+}
+
+// listFileVersions lists all the versions of the files whose name starts
+// with prefix, including hide markers and unfinished large files.
+func (c *client) listFileVersions(ctx context.Context, bucketID, prefix string) ([]file, error) {
+	var files []file
+	var startFileName, startFileID string
+	for {
+		var resp struct {
+			Files        []file  `json:"files"`
+			NextFileName *string `json:"nextFileName"`
+			NextFileID   *string `json:"nextFileId"`
+		}
+		req := map[string]interface{}{
+			"bucketId":     bucketID,
+			"prefix":       prefix,
+			"maxFileCount": 1000,
+		}
+		if startFileName != "" {
+			req["startFileName"] = startFileName
+			req["startFileId"] = startFileID
+		}
+		if err := c.call(ctx, "b2_list_file_versions", req, &resp); err != nil {
+			return nil, err
+		}
+		files = append(files, resp.Files...)
+		if resp.NextFileName == nil {
+			return files, nil
+		}
+		startFileName = *resp.NextFileName
+		if resp.NextFileID != nil {
+			startFileID = *resp.NextFileID
+		}
+	}
+}
+
+// deleteFileVersion deletes the version fileID of the file named name.
+func (c *client) deleteFileVersion(ctx context.Context, name, fileID string) error {
+	return c.call(ctx, "b2_delete_file_version", map[string]string{
+		"fileName": name,
+		"fileId":   fileID,
+	}, nil)
+}
+
+// copyFile copies the file sourceID, up to 5GB, to a file named name.
+func (c *client) copyFile(ctx context.Context, sourceID, name string) (file, error) {
+	var f file
+	err := c.call(ctx, "b2_copy_file", map[string]string{
+		"sourceFileId":      sourceID,
+		"fileName":          name,
+		"metadataDirective": "COPY",
+	}, &f)
+	return f, err
+}
+
+// downloadAuthorization returns a token allowing to download the files
+// whose name starts with prefix for the given duration.
+func (c *client) downloadAuthorization(ctx context.Context, bucketID, prefix string, duration time.Duration) (string, error) {
+	var resp struct {
+		AuthorizationToken string `json:"authorizationToken"`
+	}
+	err := c.call(ctx, "b2_get_download_authorization", map[string]interface{}{
+		"bucketId":               bucketID,
+		"fileNamePrefix":         prefix,
+		"validDurationInSeconds": int64(duration / time.Second),
+	}, &resp)
+	return resp.AuthorizationToken, err
+}
+
+// download sends a GET or HEAD request for the file named name, starting at
+// offset. The caller must close the body of the response.
+func (c *client) download(ctx context.Context, method, bucket, name string, offset int64) (*http.Response, error) {
+	var resp *http.Response
+	err := c.withRetries(ctx, func(auth authorization) error {
+		req, err := http.NewRequest(method, auth.DownloadURL+"/file/"+bucket+"/"+escapeName(name), nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", auth.AuthorizationToken)
+		req.Header.Set("User-Agent", "distribution/"+version.Version)
+		if offset > 0 {
+			req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+		}
+
+		resp, err = c.httpClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode >= 300 {
+			defer resp.Body.Close()
+			return parseError(resp)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// parseError reads the API error from resp. HEAD responses have no body, so
+// only the status is known.
+func parseError(resp *http.Response) error {
+	e := &apiError{Status: resp.StatusCode}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err == nil && len(body) > 0 {
+		if err := json.Unmarshal(body, e); err != nil {
+			e.Message = strings.TrimSpace(string(body))
+		}
+	}
+	if e.Status == 0 {
+		e.Status = resp.StatusCode
+	}
+	return e
+}
+
+// escapeName percent-encodes the file name name for use in urls and headers.
+// Slashes separate the folders and are kept as is.
+func escapeName(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
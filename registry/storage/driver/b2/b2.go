@@ -0,0 +1,744 @@
+// Package b2 provides a storagedriver.StorageDriver implementation to
+// store blobs in Backblaze B2 cloud storage.
+//
+// This package talks to the B2 native API directly. Files larger than the
+// chunk size are uploaded with the large file API, in parts carrying their
+// SHA1 checksum. As parts must be at least 5MB but the last one, appending to
+// an upload whose last part is smaller finishes the large file and copies it
+// server side as the first part of a new one.
+//
+// Overwriting a file uploads a new version of it, the previous versions being
+// kept until the bucket lifecycle rules remove them. Configure the bucket to
+// keep only the last version of files to avoid paying for them. Deleting a
+// path removes all the versions of the files beneath it.
+package b2
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/base"
+	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
+)
+
+const driverName = "b2"
+
+// defaultChunkSize defines the default size of the parts of large files
+const defaultChunkSize = 10 * 1024 * 1024
+
+// maxPartSize is the maximum size of a part of a large file, and of a file
+// copied in a single request
+const maxPartSize = 5 * 1000 * 1000 * 1000
+
+// contentType defines the Content-Type of the stored files
+const contentType = "application/octet-stream"
+
+// DriverParameters is a struct that encapsulates all of the driver parameters
+// after all values have been set
+type DriverParameters struct {
+	// KeyID and ApplicationKey are the credentials of the application key
+	// used to access the bucket.
+	KeyID          string `mapstructure:"keyid"`
+	ApplicationKey string `mapstructure:"applicationkey"`
+	Bucket         string `mapstructure:"bucket"`
+	RootDirectory  string `mapstructure:"rootdirectory"`
+	ChunkSize      int64  `mapstructure:"chunksize"`
+	// AuthURL overrides the endpoint the account is authorized against.
+	AuthURL string `mapstructure:"authurl"`
+}
+
+func init() {
+	factory.Register(driverName, &b2DriverFactory{})
+}
+
+// b2DriverFactory implements the factory.StorageDriverFactory interface
+type b2DriverFactory struct{}
+
+func (factory *b2DriverFactory) Create(parameters map[string]interface{}) (storagedriver.StorageDriver, error) {
+	return FromParameters(parameters)
+}
+
+type driver struct {
+	client        *client
+	Bucket        string
+	BucketID      string
+	RootDirectory string
+	ChunkSize     int64
+	MinPartSize   int64
+}
+
+type baseEmbed struct {
+	base.Base
+}
+
+// Driver is a storagedriver.StorageDriver implementation backed by Backblaze
+// B2. Objects are stored at absolute keys in the provided bucket.
+type Driver struct {
+	baseEmbed
+}
+
+// FromParameters constructs a new Driver with a given parameters map
+// Required parameters:
+// - keyid
+// - applicationkey
+// - bucket
+func FromParameters(parameters map[string]interface{}) (*Driver, error) {
+	params := DriverParameters{
+		ChunkSize: defaultChunkSize,
+		AuthURL:   defaultAuthURL,
+	}
+
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		WeaklyTypedInput: true,
+		Result:           &params,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := decoder.Decode(parameters); err != nil {
+		return nil, err
+	}
+
+	if params.KeyID == "" {
+		return nil, fmt.Errorf("no keyid parameter provided")
+	}
+
+	if params.ApplicationKey == "" {
+		return nil, fmt.Errorf("no applicationkey parameter provided")
+	}
+
+	if params.Bucket == "" {
+		return nil, fmt.Errorf("no bucket parameter provided")
+	}
+
+	if params.ChunkSize > maxPartSize {
+		return nil, fmt.Errorf("the chunksize %#v parameter should be a number that is smaller than or equal to %d", params.ChunkSize, maxPartSize)
+	}
+
+	return New(params)
+}
+
+// New constructs a new Driver with the given B2 application key and bucket
+func New(params DriverParameters) (*Driver, error) {
+	ctx := context.Background()
+
+	authURL := params.AuthURL
+	if authURL == "" {
+		authURL = defaultAuthURL
+	}
+
+	c := &client{
+		httpClient:     &http.Client{Transport: http.DefaultTransport},
+		authURL:        strings.TrimRight(authURL, "/"),
+		keyID:          params.KeyID,
+		applicationKey: params.ApplicationKey,
+	}
+	if err := c.authorize(ctx); err != nil {
+		return nil, fmt.Errorf("b2 authorization failed: %v", err)
+	}
+
+	minPartSize := c.authorization().AbsoluteMinimumPartSize
+	if params.ChunkSize < minPartSize {
+		return nil, fmt.Errorf("the chunksize %#v parameter should be a number that is larger than or equal to %d", params.ChunkSize, minPartSize)
+	}
+
+	bucketID, err := c.bucketID(ctx, params.Bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &driver{
+		client:        c,
+		Bucket:        params.Bucket,
+		BucketID:      bucketID,
+		RootDirectory: params.RootDirectory,
+		ChunkSize:     params.ChunkSize,
+		MinPartSize:   minPartSize,
+	}
+
+	return &Driver{
+		baseEmbed: baseEmbed{
+			Base: base.Base{
+				StorageDriver: d,
+			},
+		},
+	}, nil
+}
+
+// Implement the storagedriver.StorageDriver interface
+
+func (d *driver) Name() string {
+	return driverName
+}
+
+// GetContent retrieves the content stored at "path" as a []byte.
+func (d *driver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	reader, err := d.Reader(ctx, path, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
+
+// PutContent stores the []byte content at a location designated by "path".
+func (d *driver) PutContent(ctx context.Context, path string, contents []byte) error {
+	_, err := d.client.uploadFile(ctx, d.BucketID, d.b2Path(path), contents)
+	return err
+}
+
+// Reader retrieves an io.ReadCloser for the content stored at "path" with a
+// given byte offset.
+func (d *driver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	resp, err := d.client.download(ctx, http.MethodGet, d.Bucket, d.b2Path(path), offset)
+	if err != nil {
+		if e, ok := err.(*apiError); ok && e.Status == http.StatusRequestedRangeNotSatisfiable {
+			return ioutil.NopCloser(bytes.NewReader(nil)), nil
+		}
+		return nil, pathError(path, err)
+	}
+	return resp.Body, nil
+}
+
+// Writer returns a FileWriter which will store the content written to it
+// at the location designated by "path" after the call to Commit.
+func (d *driver) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	key := d.b2Path(path)
+	if !append {
+		return d.newWriter(ctx, key), nil
+	}
+
+	// A large file being uploaded takes precedence, as the file stored at
+	// the path, if any, is previous content.
+	files, err := d.client.listUnfinishedLargeFiles(ctx, d.BucketID, key)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(files) - 1; i >= 0; i-- {
+		if files[i].FileName != key {
+			continue
+		}
+		parts, err := d.client.listParts(ctx, files[i].FileID)
+		if err != nil {
+			return nil, err
+		}
+		w := d.newWriter(ctx, key)
+		w.fileID = files[i].FileID
+		w.parts = parts
+		for _, p := range parts {
+			w.size += p.ContentLength
+		}
+		return w, nil
+	}
+
+	f, err := d.head(ctx, key)
+	if err != nil {
+		return nil, pathError(path, err)
+	}
+	w := d.newWriter(ctx, key)
+	w.previous = &f
+	w.size = f.ContentLength
+	return w, nil
+}
+
+// Stat retrieves the FileInfo for the given path, including the current size
+// in bytes and the creation time.
+func (d *driver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	key := d.b2Path(path)
+	fi := storagedriver.FileInfoFields{
+		Path: path,
+	}
+
+	if key != "" && !strings.HasSuffix(key, "/") {
+		f, err := d.head(ctx, key)
+		if err == nil {
+			fi.Size = f.ContentLength
+			fi.ModTime = time.Unix(0, f.UploadTimestamp*int64(time.Millisecond))
+			return storagedriver.FileInfoInternal{FileInfoFields: fi}, nil
+		}
+		if !isNotFound(err) {
+			return nil, err
+		}
+	}
+
+	prefix := key
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	files, err := d.client.listFileNames(ctx, d.BucketID, prefix, "/", 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, storagedriver.PathNotFoundError{Path: path}
+	}
+
+	fi.IsDir = true
+	return storagedriver.FileInfoInternal{FileInfoFields: fi}, nil
+}
+
+// List returns a list of the objects that are direct descendants of the given path.
+func (d *driver) List(ctx context.Context, path string) ([]string, error) {
+	prefix := d.b2Path(path)
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	files, err := d.client.listFileNames(ctx, d.BucketID, prefix, "/", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []string
+	for _, f := range files {
+		list = append(list, d.storagePath(strings.TrimSuffix(f.FileName, "/")))
+	}
+
+	if len(list) == 0 && path != "/" {
+		return nil, storagedriver.PathNotFoundError{Path: path}
+	}
+	return list, nil
+}
+
+// Move moves an object stored at sourcePath to destPath, removing the original
+// object.
+func (d *driver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	source, err := d.head(ctx, d.b2Path(sourcePath))
+	if err != nil {
+		return pathError(sourcePath, err)
+	}
+
+	if err := d.copy(ctx, source, d.b2Path(destPath)); err != nil {
+		return err
+	}
+
+	_, err = d.deleteVersions(ctx, source.FileName, func(name string) bool {
+		return name == source.FileName
+	})
+	return err
+}
+
+// copy copies the file source to a file named name, server side. Files larger
+// than maxPartSize are copied in parts.
+func (d *driver) copy(ctx context.Context, source file, name string) error {
+	if source.ContentLength <= maxPartSize {
+		_, err := d.client.copyFile(ctx, source.FileID, name)
+		return err
+	}
+
+	fileID, err := d.client.startLargeFile(ctx, d.BucketID, name)
+	if err != nil {
+		return err
+	}
+	parts, err := d.copyParts(ctx, source, fileID)
+	if err == nil {
+		_, err = d.client.finishLargeFile(ctx, fileID, parts)
+	}
+	if err != nil {
+		d.client.cancelLargeFile(ctx, fileID)
+		return err
+	}
+	return nil
+}
+
+// copyParts copies the file source as the first parts of the large file
+// fileID. The parts are all about the same size, which is kept below
+// maxPartSize.
+func (d *driver) copyParts(ctx context.Context, source file, fileID string) ([]part, error) {
+	count := (source.ContentLength + maxPartSize - 1) / maxPartSize
+	partSize := (source.ContentLength + count - 1) / count
+
+	var parts []part
+	for start := int64(0); start < source.ContentLength; start += partSize {
+		end := start + partSize
+		if end > source.ContentLength {
+			end = source.ContentLength
+		}
+		p, err := d.client.copyPart(ctx, source.FileID, fileID, len(parts)+1, start, end)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, p)
+	}
+	return parts, nil
+}
+
+// Delete recursively deletes all objects stored at "path" and its subpaths.
+func (d *driver) Delete(ctx context.Context, path string) error {
+	key := d.b2Path(path)
+	found, err := d.deleteVersions(ctx, key, func(name string) bool {
+		return name == key || strings.HasPrefix(name, key+"/")
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return storagedriver.PathNotFoundError{Path: path}
+	}
+	return nil
+}
+
+// deleteVersions deletes all the versions of the files, and the unfinished
+// large files, whose name starts with prefix and satisfies match. It reports
+// whether any such file was found.
+func (d *driver) deleteVersions(ctx context.Context, prefix string, match func(name string) bool) (bool, error) {
+	files, err := d.client.listFileVersions(ctx, d.BucketID, prefix)
+	if err != nil {
+		return false, err
+	}
+
+	found := false
+	for _, f := range files {
+		if !match(f.FileName) {
+			continue
+		}
+		switch f.Action {
+		case "start":
+			err = d.client.cancelLargeFile(ctx, f.FileID)
+		case "folder":
+			continue
+		default:
+			err = d.client.deleteFileVersion(ctx, f.FileName, f.FileID)
+		}
+		// Don't fail on files not found, which were deleted concurrently.
+		if err != nil && !isNotFound(err) {
+			return found, err
+		}
+		if f.Action != "hide" {
+			found = true
+		}
+	}
+	return found, nil
+}
+
+// URLFor returns a URL which may be used to retrieve the content stored at the given path.
+func (d *driver) URLFor(ctx context.Context, path string, options map[string]interface{}) (string, error) {
+	methodString := "GET"
+	method, ok := options["method"]
+	if ok {
+		methodString, ok = method.(string)
+		if !ok || (methodString != "GET" && methodString != "HEAD") {
+			return "", storagedriver.ErrUnsupportedMethod{}
+		}
+	}
+
+	expiresIn := 20 * time.Minute
+	expires, ok := options["expiry"]
+	if ok {
+		et, ok := expires.(time.Time)
+		if ok {
+			expiresIn = time.Until(et)
+		}
+	}
+	// The authorization is valid between a second and a week.
+	if expiresIn < time.Second {
+		expiresIn = time.Second
+	} else if expiresIn > 7*24*time.Hour {
+		expiresIn = 7 * 24 * time.Hour
+	}
+
+	key := d.b2Path(path)
+	token, err := d.client.downloadAuthorization(ctx, d.BucketID, key, expiresIn)
+	if err != nil {
+		return "", err
+	}
+
+	return d.client.authorization().DownloadURL + "/file/" + d.Bucket + "/" + escapeName(key) + "?Authorization=" + token, nil
+}
+
+// Walk traverses a filesystem defined within driver, starting
+// from the given path, calling f on each file and directory
+func (d *driver) Walk(ctx context.Context, path string, f storagedriver.WalkFn) error {
+	return storagedriver.WalkFallback(ctx, d, path, f)
+}
+
+// head retrieves the latest version of the file named name.
+func (d *driver) head(ctx context.Context, name string) (file, error) {
+	resp, err := d.client.download(ctx, http.MethodHead, d.Bucket, name, 0)
+	if err != nil {
+		return file{}, err
+	}
+	resp.Body.Close()
+
+	timestamp, _ := strconv.ParseInt(resp.Header.Get("X-Bz-Upload-Timestamp"), 10, 64)
+	return file{
+		FileID:          resp.Header.Get("X-Bz-File-Id"),
+		FileName:        name,
+		ContentLength:   resp.ContentLength,
+		UploadTimestamp: timestamp,
+	}, nil
+}
+
+func (d *driver) b2Path(path string) string {
+	return strings.TrimLeft(strings.TrimRight(d.RootDirectory, "/")+path, "/")
+}
+
+// storagePath returns the path of the storage driver for the B2 file name.
+func (d *driver) storagePath(name string) string {
+	return "/" + strings.TrimPrefix(strings.TrimPrefix(name, strings.Trim(d.RootDirectory, "/")), "/")
+}
+
+// pathError returns a PathNotFoundError for path if err reports a file not found.
+func pathError(path string, err error) error {
+	if isNotFound(err) {
+		return storagedriver.PathNotFoundError{Path: path}
+	}
+	return err
+}
+
+// writer uploads the content written to it as a regular file when it fits in
+// a chunk, and as a large file otherwise. Closing a writer
+// persists what was written so far, so that it can be resumed.
+type writer struct {
+	driver *driver
+	ctx    context.Context
+	key    string
+	// fileID is the id of the large file being uploaded, if started.
+	fileID string
+	parts  []part
+	// previous is the file holding the content written before the writer
+	// was resumed, when it was not a large file. It is removed once its
+	// content is persisted elsewhere.
+	previous    *file
+	size        int64
+	readyPart   []byte
+	pendingPart []byte
+	closed      bool
+	committed   bool
+	cancelled   bool
+}
+
+func (d *driver) newWriter(ctx context.Context, key string) *writer {
+	return &writer{
+		driver: d,
+		ctx:    ctx,
+		key:    key,
+	}
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fmt.Errorf("already closed")
+	} else if w.committed {
+		return 0, fmt.Errorf("already committed")
+	} else if w.cancelled {
+		return 0, fmt.Errorf("already cancelled")
+	}
+
+	if len(p) > 0 {
+		if err := w.resume(); err != nil {
+			return 0, err
+		}
+	}
+
+	var n int
+
+	for len(p) > 0 {
+		// If no parts are ready to write, fill up the first part
+		if neededBytes := int(w.driver.ChunkSize) - len(w.readyPart); neededBytes > 0 {
+			if len(p) >= neededBytes {
+				w.readyPart = append(w.readyPart, p[:neededBytes]...)
+				n += neededBytes
+				p = p[neededBytes:]
+			} else {
+				w.readyPart = append(w.readyPart, p...)
+				n += len(p)
+				p = nil
+			}
+		}
+
+		if neededBytes := int(w.driver.ChunkSize) - len(w.pendingPart); neededBytes > 0 {
+			if len(p) >= neededBytes {
+				w.pendingPart = append(w.pendingPart, p[:neededBytes]...)
+				n += neededBytes
+				p = p[neededBytes:]
+				err := w.flushPart()
+				if err != nil {
+					w.size += int64(n)
+					return n, err
+				}
+			} else {
+				w.pendingPart = append(w.pendingPart, p...)
+				n += len(p)
+				p = nil
+			}
+		}
+	}
+	w.size += int64(n)
+	return n, nil
+}
+
+// resume prepares a resumed writer for appending content. Only the last
+// part of a large file may be smaller than the minimum part size, so a large
+// file ending with such a part is finished and copied as the first part of a
+// new one. Previous content too small to be a part is read back to be
+// uploaded again along with the new content.
+func (w *writer) resume() error {
+	ctx := w.ctx
+	d := w.driver
+
+	if w.fileID != "" && len(w.parts) > 0 && len(w.readyPart) == 0 && w.parts[len(w.parts)-1].ContentLength < d.MinPartSize {
+		f, err := d.client.finishLargeFile(ctx, w.fileID, w.parts)
+		if err != nil {
+			return err
+		}
+		w.fileID = ""
+		w.parts = nil
+		w.previous = &f
+	}
+
+	if w.previous == nil || w.fileID != "" || len(w.readyPart) > 0 {
+		return nil
+	}
+
+	if w.previous.ContentLength < d.MinPartSize {
+		resp, err := d.client.download(ctx, http.MethodGet, d.Bucket, w.key, 0)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		w.readyPart, err = ioutil.ReadAll(resp.Body)
+		return err
+	}
+
+	fileID, err := d.client.startLargeFile(ctx, d.BucketID, w.key)
+	if err != nil {
+		return err
+	}
+	parts, err := d.copyParts(ctx, *w.previous, fileID)
+	if err != nil {
+		d.client.cancelLargeFile(ctx, fileID)
+		return err
+	}
+	w.fileID = fileID
+	w.parts = parts
+	return w.dropPrevious()
+}
+
+// dropPrevious deletes the previous content of the writer, once persisted
+// elsewhere.
+func (w *writer) dropPrevious() error {
+	if w.previous == nil {
+		return nil
+	}
+	err := w.driver.client.deleteFileVersion(w.ctx, w.key, w.previous.FileID)
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	w.previous = nil
+	return nil
+}
+
+func (w *writer) Size() int64 {
+	return w.size
+}
+
+func (w *writer) Close() error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	}
+	w.closed = true
+	if w.committed || w.cancelled {
+		return nil
+	}
+	return w.flush()
+}
+
+func (w *writer) Cancel() error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	} else if w.committed {
+		return fmt.Errorf("already committed")
+	}
+	w.cancelled = true
+	err := w.driver.Delete(w.ctx, w.driver.storagePath(w.key))
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		return nil
+	}
+	return err
+}
+
+func (w *writer) Commit() error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	} else if w.committed {
+		return fmt.Errorf("already committed")
+	} else if w.cancelled {
+		return fmt.Errorf("already cancelled")
+	}
+	if err := w.flush(); err != nil {
+		return err
+	}
+	w.committed = true
+
+	if w.fileID == "" {
+		return nil
+	}
+	if _, err := w.driver.client.finishLargeFile(w.ctx, w.fileID, w.parts); err != nil {
+		w.driver.client.cancelLargeFile(w.ctx, w.fileID)
+		return err
+	}
+	return nil
+}
+
+// flush persists the buffered content, as the last parts of the large file if
+// it outgrew a chunk, or as a regular file otherwise.
+func (w *writer) flush() error {
+	if len(w.pendingPart) > 0 {
+		if err := w.flushPart(); err != nil {
+			return err
+		}
+	}
+
+	if w.fileID != "" {
+		if len(w.readyPart) > 0 {
+			p, err := w.driver.client.uploadPart(w.ctx, w.fileID, len(w.parts)+1, w.readyPart)
+			if err != nil {
+				return err
+			}
+			w.parts = append(w.parts, p)
+		}
+	} else if len(w.readyPart) > 0 || w.previous == nil {
+		if _, err := w.driver.client.uploadFile(w.ctx, w.driver.BucketID, w.key, w.readyPart); err != nil {
+			return err
+		}
+	} else {
+		// The previous content was not read back and is still current.
+		return nil
+	}
+
+	w.readyPart = nil
+	return w.dropPrevious()
+}
+
+// flushPart uploads the ready part to the large file, starting it if needed,
+// and makes the pending part ready.
+func (w *writer) flushPart() error {
+	if w.fileID == "" {
+		fileID, err := w.driver.client.startLargeFile(w.ctx, w.driver.BucketID, w.key)
+		if err != nil {
+			return err
+		}
+		w.fileID = fileID
+	}
+
+	p, err := w.driver.client.uploadPart(w.ctx, w.fileID, len(w.parts)+1, w.readyPart)
+	if err != nil {
+		return err
+	}
+	w.parts = append(w.parts, p)
+	w.readyPart = w.pendingPart
+	w.pendingPart = nil
+	return w.dropPrevious()
+}
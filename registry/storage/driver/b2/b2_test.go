@@ -0,0 +1,183 @@
+package b2
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"gopkg.in/check.v1"
+
+	"github.com/distribution/distribution/v3/context"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/testsuites"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { check.TestingT(t) }
+
+var b2DriverConstructor func(rootDirectory string) (*Driver, error)
+
+func init() {
+	keyID := os.Getenv("B2_KEY_ID")
+	applicationKey := os.Getenv("B2_APPLICATION_KEY")
+	bucket := os.Getenv("B2_BUCKET")
+	authURL := defaultAuthURL
+	skipCheck := testsuites.NeverSkip
+
+	// Without credentials, run the tests against an in-memory server, which
+	// can not hold the 5GB streams of the suite run without -short.
+	if keyID == "" || applicationKey == "" || bucket == "" {
+		keyID = "b2test"
+		applicationKey = "b2test"
+		bucket = "test"
+		authURL = newFakeServer(keyID, applicationKey, bucket).URL
+		skipCheck = func() string {
+			if !testing.Short() {
+				return "Must set B2_KEY_ID, B2_APPLICATION_KEY and B2_BUCKET to run the suite without -short"
+			}
+			return ""
+		}
+	}
+
+	root, err := ioutil.TempDir("", "driver-")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(root)
+
+	b2DriverConstructor = func(rootDirectory string) (*Driver, error) {
+		return New(DriverParameters{
+			KeyID:          keyID,
+			ApplicationKey: applicationKey,
+			Bucket:         bucket,
+			RootDirectory:  rootDirectory,
+			ChunkSize:      5 * 1024 * 1024,
+			AuthURL:        authURL,
+		})
+	}
+
+	testsuites.RegisterSuite(func() (storagedriver.StorageDriver, error) {
+		return b2DriverConstructor(root)
+	}, skipCheck)
+}
+
+func TestEmptyRootList(t *testing.T) {
+	validRoot, err := ioutil.TempDir("", "driver-")
+	if err != nil {
+		t.Fatalf("unexpected error creating temporary directory: %v", err)
+	}
+	defer os.Remove(validRoot)
+
+	rootedDriver, err := b2DriverConstructor(validRoot)
+	if err != nil {
+		t.Fatalf("unexpected error creating rooted driver: %v", err)
+	}
+
+	emptyRootDriver, err := b2DriverConstructor("")
+	if err != nil {
+		t.Fatalf("unexpected error creating empty root driver: %v", err)
+	}
+
+	slashRootDriver, err := b2DriverConstructor("/")
+	if err != nil {
+		t.Fatalf("unexpected error creating slash root driver: %v", err)
+	}
+
+	filename := "/test"
+	contents := []byte("contents")
+	ctx := context.Background()
+	err = rootedDriver.PutContent(ctx, filename, contents)
+	if err != nil {
+		t.Fatalf("unexpected error creating content: %v", err)
+	}
+	defer rootedDriver.Delete(ctx, filename)
+
+	keys, _ := emptyRootDriver.List(ctx, "/")
+	for _, path := range keys {
+		if !storagedriver.PathRegexp.MatchString(path) {
+			t.Fatalf("unexpected string in path: %q != %q", path, storagedriver.PathRegexp)
+		}
+	}
+
+	keys, _ = slashRootDriver.List(ctx, "/")
+	for _, path := range keys {
+		if !storagedriver.PathRegexp.MatchString(path) {
+			t.Fatalf("unexpected string in path: %q != %q", path, storagedriver.PathRegexp)
+		}
+	}
+}
+
+// TestAppendAfterSmallPart checks that a writer closed after uploading a
+// part smaller than the minimum part size can be resumed.
+func TestAppendAfterSmallPart(t *testing.T) {
+	root, err := ioutil.TempDir("", "driver-")
+	if err != nil {
+		t.Fatalf("unexpected error creating temporary directory: %v", err)
+	}
+	defer os.Remove(root)
+
+	d, err := b2DriverConstructor(root)
+	if err != nil {
+		t.Fatalf("unexpected error creating driver: %v", err)
+	}
+
+	ctx := context.Background()
+	filename := "/upload"
+	defer d.Delete(ctx, filename)
+
+	contents := make([]byte, 13*1024*1024)
+	rand.Read(contents)
+	// The first writer uploads a full part, then a 1MB one.
+	first := 6 * 1024 * 1024
+
+	writer, err := d.Writer(ctx, filename, false)
+	if err != nil {
+		t.Fatalf("unexpected error creating writer: %v", err)
+	}
+	if _, err := writer.Write(contents[:first]); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("unexpected error closing writer: %v", err)
+	}
+
+	writer, err = d.Writer(ctx, filename, true)
+	if err != nil {
+		t.Fatalf("unexpected error resuming writer: %v", err)
+	}
+	if writer.Size() != int64(first) {
+		t.Fatalf("unexpected size of resumed writer: %d != %d", writer.Size(), first)
+	}
+	if _, err := writer.Write(contents[first:]); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	if err := writer.Commit(); err != nil {
+		t.Fatalf("unexpected error committing: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("unexpected error closing writer: %v", err)
+	}
+
+	received, err := d.GetContent(ctx, filename)
+	if err != nil {
+		t.Fatalf("unexpected error reading content: %v", err)
+	}
+	if !bytes.Equal(received, contents) {
+		t.Fatalf("unexpected content read back")
+	}
+}
+
+func TestFromParametersValidation(t *testing.T) {
+	for _, parameters := range []map[string]interface{}{
+		{"applicationkey": "key", "bucket": "bucket"},
+		{"keyid": "id", "bucket": "bucket"},
+		{"keyid": "id", "applicationkey": "key"},
+		{"keyid": "id", "applicationkey": "key", "bucket": "bucket", "chunksize": "6000000000"},
+	} {
+		if _, err := FromParameters(parameters); err == nil {
+			t.Errorf("expected an error for parameters %v", parameters)
+		}
+	}
+}
@@ -0,0 +1,432 @@
+package b2
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeServer is an in-memory implementation of the subset of the B2 native
+// API used by the driver, holding a single bucket.
+type fakeServer struct {
+	*httptest.Server
+
+	keyID          string
+	applicationKey string
+	bucket         string
+	minPartSize    int64
+
+	mu        sync.Mutex
+	nextID    int
+	versions  []*fakeFile
+	parts     map[string]map[int][]byte
+	downloads map[string]string
+}
+
+type fakeFile struct {
+	id        string
+	name      string
+	action    string
+	content   []byte
+	timestamp int64
+}
+
+const (
+	fakeToken    = "fake-account-token"
+	fakeBucketID = "fake-bucket-id"
+)
+
+func newFakeServer(keyID, applicationKey, bucket string) *fakeServer {
+	s := &fakeServer{
+		keyID:          keyID,
+		applicationKey: applicationKey,
+		bucket:         bucket,
+		minPartSize:    5 * 1024 * 1024,
+		parts:          make(map[string]map[int][]byte),
+		downloads:      make(map[string]string),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+func (s *fakeServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case r.URL.Path == "/b2api/v2/b2_authorize_account":
+		keyID, applicationKey, ok := r.BasicAuth()
+		if !ok || keyID != s.keyID || applicationKey != s.applicationKey {
+			writeError(w, http.StatusUnauthorized, "unauthorized", "invalid key")
+			return
+		}
+		writeJSON(w, authorization{
+			AccountID:               "fake-account",
+			AuthorizationToken:      fakeToken,
+			APIURL:                  s.URL,
+			DownloadURL:             s.URL,
+			RecommendedPartSize:     100 * 1000 * 1000,
+			AbsoluteMinimumPartSize: s.minPartSize,
+		})
+	case strings.HasPrefix(r.URL.Path, "/file/"):
+		s.download(w, r)
+	case r.Header.Get("Authorization") != fakeToken:
+		writeError(w, http.StatusUnauthorized, "bad_auth_token", "invalid token")
+	case strings.HasPrefix(r.URL.Path, "/upload/file/"):
+		s.uploadFile(w, r)
+	case strings.HasPrefix(r.URL.Path, "/upload/part/"):
+		s.uploadPart(w, r, strings.TrimPrefix(r.URL.Path, "/upload/part/"))
+	case strings.HasPrefix(r.URL.Path, "/b2api/v2/"):
+		var req map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+		s.call(w, strings.TrimPrefix(r.URL.Path, "/b2api/v2/"), req)
+	default:
+		writeError(w, http.StatusNotFound, "not_found", r.URL.Path)
+	}
+}
+
+func (s *fakeServer) call(w http.ResponseWriter, op string, req map[string]interface{}) {
+	str := func(key string) string {
+		v, _ := req[key].(string)
+		return v
+	}
+	num := func(key string) int {
+		v, _ := req[key].(float64)
+		return int(v)
+	}
+
+	switch op {
+	case "b2_list_buckets":
+		writeJSON(w, map[string]interface{}{
+			"buckets": []map[string]string{{"bucketId": fakeBucketID, "bucketName": s.bucket}},
+		})
+	case "b2_get_upload_url":
+		writeJSON(w, map[string]string{
+			"uploadUrl":          s.URL + "/upload/file/" + str("bucketId"),
+			"authorizationToken": fakeToken,
+		})
+	case "b2_get_upload_part_url":
+		writeJSON(w, map[string]string{
+			"uploadUrl":          s.URL + "/upload/part/" + str("fileId"),
+			"authorizationToken": fakeToken,
+		})
+	case "b2_start_large_file":
+		f := s.add(str("fileName"), "start", nil)
+		s.parts[f.id] = make(map[int][]byte)
+		writeJSON(w, f.info())
+	case "b2_list_parts":
+		parts, ok := s.parts[str("fileId")]
+		if !ok {
+			writeError(w, http.StatusBadRequest, "bad_request", "no such large file")
+			return
+		}
+		var list []part
+		for n, content := range parts {
+			list = append(list, partInfo(n, content))
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].PartNumber < list[j].PartNumber })
+		writeJSON(w, map[string]interface{}{"parts": list, "nextPartNumber": nil})
+	case "b2_copy_part":
+		source := s.find(str("sourceFileId"))
+		parts, ok := s.parts[str("largeFileId")]
+		if source == nil || !ok {
+			writeError(w, http.StatusBadRequest, "bad_request", "no such file")
+			return
+		}
+		var start, end int
+		if _, err := fmt.Sscanf(str("range"), "bytes=%d-%d", &start, &end); err != nil || end >= len(source.content) {
+			writeError(w, http.StatusBadRequest, "bad_request", "invalid range")
+			return
+		}
+		content := append([]byte(nil), source.content[start:end+1]...)
+		parts[num("partNumber")] = content
+		writeJSON(w, partInfo(num("partNumber"), content))
+	case "b2_finish_large_file":
+		f := s.find(str("fileId"))
+		parts, ok := s.parts[str("fileId")]
+		if f == nil || !ok {
+			writeError(w, http.StatusBadRequest, "bad_request", "no such large file")
+			return
+		}
+		checksums, _ := req["partSha1Array"].([]interface{})
+		if len(checksums) != len(parts) || len(parts) == 0 {
+			writeError(w, http.StatusBadRequest, "bad_request", "invalid part count")
+			return
+		}
+		var content []byte
+		for i, checksum := range checksums {
+			p, ok := parts[i+1]
+			if !ok || partInfo(i+1, p).ContentSha1 != checksum {
+				writeError(w, http.StatusBadRequest, "bad_request", "invalid part checksum")
+				return
+			}
+			if i < len(checksums)-1 && int64(len(p)) < s.minPartSize {
+				writeError(w, http.StatusBadRequest, "bad_request", "part too small")
+				return
+			}
+			content = append(content, p...)
+		}
+		delete(s.parts, f.id)
+		f.action = "upload"
+		f.content = content
+		writeJSON(w, f.info())
+	case "b2_cancel_large_file":
+		f := s.find(str("fileId"))
+		if _, ok := s.parts[str("fileId")]; f == nil || !ok {
+			writeError(w, http.StatusBadRequest, "bad_request", "no such large file")
+			return
+		}
+		delete(s.parts, f.id)
+		s.remove(f)
+		writeJSON(w, f.info())
+	case "b2_list_unfinished_large_files":
+		var files []file
+		for _, f := range s.versions {
+			if f.action == "start" && strings.HasPrefix(f.name, str("namePrefix")) {
+				files = append(files, f.info())
+			}
+		}
+		writeJSON(w, map[string]interface{}{"files": files, "nextFileId": nil})
+	case "b2_list_file_names":
+		s.listFileNames(w, str("prefix"), str("delimiter"), str("startFileName"), num("maxFileCount"))
+	case "b2_list_file_versions":
+		var files []file
+		for _, f := range s.sorted() {
+			if strings.HasPrefix(f.name, str("prefix")) {
+				files = append(files, f.info())
+			}
+		}
+		writeJSON(w, map[string]interface{}{"files": files, "nextFileName": nil, "nextFileId": nil})
+	case "b2_delete_file_version":
+		f := s.find(str("fileId"))
+		if f == nil || f.name != str("fileName") || f.action == "start" {
+			writeError(w, http.StatusNotFound, "file_not_present", "no such file")
+			return
+		}
+		s.remove(f)
+		writeJSON(w, map[string]string{"fileId": f.id, "fileName": f.name})
+	case "b2_copy_file":
+		source := s.find(str("sourceFileId"))
+		if source == nil || source.action != "upload" {
+			writeError(w, http.StatusNotFound, "file_not_present", "no such file")
+			return
+		}
+		writeJSON(w, s.add(str("fileName"), "upload", source.content).info())
+	case "b2_get_download_authorization":
+		token := fmt.Sprintf("download-%d", len(s.downloads))
+		s.downloads[token] = str("fileNamePrefix")
+		writeJSON(w, map[string]string{"authorizationToken": token})
+	default:
+		writeError(w, http.StatusBadRequest, "bad_request", "unsupported operation "+op)
+	}
+}
+
+func (s *fakeServer) uploadFile(w http.ResponseWriter, r *http.Request) {
+	content, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	checksum := sha1.Sum(content)
+	if r.Header.Get("X-Bz-Content-Sha1") != hex.EncodeToString(checksum[:]) {
+		writeError(w, http.StatusBadRequest, "bad_request", "checksum mismatch")
+		return
+	}
+	name, err := url.PathUnescape(r.Header.Get("X-Bz-File-Name"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	writeJSON(w, s.add(name, "upload", content).info())
+}
+
+func (s *fakeServer) uploadPart(w http.ResponseWriter, r *http.Request, fileID string) {
+	parts, ok := s.parts[fileID]
+	if !ok {
+		writeError(w, http.StatusBadRequest, "bad_request", "no such large file")
+		return
+	}
+	content, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	partNumber, _ := strconv.Atoi(r.Header.Get("X-Bz-Part-Number"))
+	p := partInfo(partNumber, content)
+	if r.Header.Get("X-Bz-Content-Sha1") != p.ContentSha1 {
+		writeError(w, http.StatusBadRequest, "bad_request", "checksum mismatch")
+		return
+	}
+	parts[partNumber] = content
+	writeJSON(w, p)
+}
+
+func (s *fakeServer) download(w http.ResponseWriter, r *http.Request) {
+	name, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/file/"+s.bucket+"/"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+
+	token := r.Header.Get("Authorization")
+	if token == "" {
+		token = r.URL.Query().Get("Authorization")
+	}
+	if prefix, ok := s.downloads[token]; token != fakeToken && (!ok || !strings.HasPrefix(name, prefix)) {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "invalid token")
+		return
+	}
+
+	f := s.latest(name)
+	if f == nil {
+		writeError(w, http.StatusNotFound, "not_found", "no such file")
+		return
+	}
+
+	content := f.content
+	status := http.StatusOK
+	if rng := r.Header.Get("Range"); rng != "" {
+		var offset int
+		if _, err := fmt.Sscanf(rng, "bytes=%d-", &offset); err != nil || offset >= len(content) {
+			writeError(w, http.StatusRequestedRangeNotSatisfiable, "range_not_satisfiable", rng)
+			return
+		}
+		content = content[offset:]
+		status = http.StatusPartialContent
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	w.Header().Set("X-Bz-File-Id", f.id)
+	w.Header().Set("X-Bz-Upload-Timestamp", strconv.FormatInt(f.timestamp, 10))
+	w.WriteHeader(status)
+	if r.Method == http.MethodGet {
+		w.Write(content)
+	}
+}
+
+func (s *fakeServer) listFileNames(w http.ResponseWriter, prefix, delimiter, startFileName string, maxFileCount int) {
+	if maxFileCount <= 0 {
+		maxFileCount = 100
+	}
+
+	var files []file
+	for _, f := range s.sorted() {
+		if f.action != "upload" || !strings.HasPrefix(f.name, prefix) || s.latest(f.name) != f {
+			continue
+		}
+		info := f.info()
+		if i := strings.Index(f.name[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			info = file{FileName: f.name[:len(prefix)+i+1], Action: "folder"}
+			if len(files) > 0 && files[len(files)-1].FileName == info.FileName {
+				continue
+			}
+		}
+		if info.FileName >= startFileName {
+			files = append(files, info)
+		}
+	}
+
+	var next *string
+	if len(files) > maxFileCount {
+		next = &files[maxFileCount].FileName
+		files = files[:maxFileCount]
+	}
+	writeJSON(w, map[string]interface{}{"files": files, "nextFileName": next})
+}
+
+// add records a new version of the file named name.
+func (s *fakeServer) add(name, action string, content []byte) *fakeFile {
+	s.nextID++
+	f := &fakeFile{
+		id:        fmt.Sprintf("file-%d", s.nextID),
+		name:      name,
+		action:    action,
+		content:   content,
+		timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+	}
+	s.versions = append(s.versions, f)
+	return f
+}
+
+func (s *fakeServer) find(id string) *fakeFile {
+	for _, f := range s.versions {
+		if f.id == id {
+			return f
+		}
+	}
+	return nil
+}
+
+func (s *fakeServer) remove(f *fakeFile) {
+	for i, v := range s.versions {
+		if v == f {
+			s.versions = append(s.versions[:i], s.versions[i+1:]...)
+			return
+		}
+	}
+}
+
+// latest returns the last uploaded version of the file named name.
+func (s *fakeServer) latest(name string) *fakeFile {
+	for i := len(s.versions) - 1; i >= 0; i-- {
+		if f := s.versions[i]; f.name == name && f.action == "upload" {
+			return f
+		}
+	}
+	return nil
+}
+
+// sorted returns the versions by name, the most recent first for each name.
+func (s *fakeServer) sorted() []*fakeFile {
+	versions := make([]*fakeFile, len(s.versions))
+	for i, f := range s.versions {
+		versions[len(versions)-1-i] = f
+	}
+	sort.SliceStable(versions, func(i, j int) bool { return versions[i].name < versions[j].name })
+	return versions
+}
+
+func (f *fakeFile) info() file {
+	checksum := sha1.Sum(f.content)
+	return file{
+		FileID:          f.id,
+		FileName:        f.name,
+		Action:          f.action,
+		ContentLength:   int64(len(f.content)),
+		ContentSha1:     hex.EncodeToString(checksum[:]),
+		UploadTimestamp: f.timestamp,
+	}
+}
+
+func partInfo(partNumber int, content []byte) part {
+	checksum := sha1.Sum(content)
+	return part{
+		PartNumber:    partNumber,
+		ContentLength: int64(len(content)),
+		ContentSha1:   hex.EncodeToString(checksum[:]),
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(apiError{Status: status, Code: code, Message: message})
+}
@@ -45,7 +45,10 @@ import (
 	dcontext "github.com/distribution/distribution/v3/context"
 	prometheus "github.com/distribution/distribution/v3/metrics"
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/tracing"
 	"github.com/docker/go-metrics"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
@@ -63,6 +66,23 @@ type Base struct {
 	storagedriver.StorageDriver
 }
 
+// startSpan starts the span of a storage driver operation on path.
+func (base *Base) startSpan(ctx context.Context, action, path string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append(attrs,
+		attribute.String("storage.driver", base.Name()),
+		attribute.String("storage.path", path))
+	return tracing.StartSpan(ctx, "storage."+action, attrs...)
+}
+
+// endSpan ends the span of a storage driver operation. Callers commonly probe
+// for paths which may not exist, so these are not recorded as errors.
+func endSpan(span trace.Span, err error) {
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		err = nil
+	}
+	tracing.EndSpan(span, err)
+}
+
 // Format errors received from the storage driver
 func (base *Base) setDriverName(e error) error {
 	switch actual := e.(type) {
@@ -99,9 +119,11 @@ func (base *Base) GetContent(ctx context.Context, path string) ([]byte, error) {
 		return nil, storagedriver.InvalidPathError{Path: path, DriverName: base.StorageDriver.Name()}
 	}
 
+	ctx, span := base.startSpan(ctx, "GetContent", path)
 	start := time.Now()
 	b, e := base.StorageDriver.GetContent(ctx, path)
 	storageAction.WithValues(base.Name(), "GetContent").UpdateSince(start)
+	endSpan(span, e)
 	return b, base.setDriverName(e)
 }
 
@@ -114,9 +136,11 @@ func (base *Base) PutContent(ctx context.Context, path string, content []byte) e
 		return storagedriver.InvalidPathError{Path: path, DriverName: base.StorageDriver.Name()}
 	}
 
+	ctx, span := base.startSpan(ctx, "PutContent", path)
 	start := time.Now()
 	err := base.setDriverName(base.StorageDriver.PutContent(ctx, path, content))
 	storageAction.WithValues(base.Name(), "PutContent").UpdateSince(start)
+	endSpan(span, err)
 	return err
 }
 
@@ -133,7 +157,9 @@ func (base *Base) Reader(ctx context.Context, path string, offset int64) (io.Rea
 		return nil, storagedriver.InvalidPathError{Path: path, DriverName: base.StorageDriver.Name()}
 	}
 
+	ctx, span := base.startSpan(ctx, "Reader", path)
 	rc, e := base.StorageDriver.Reader(ctx, path, offset)
+	endSpan(span, e)
 	return rc, base.setDriverName(e)
 }
 
@@ -146,7 +172,9 @@ func (base *Base) Writer(ctx context.Context, path string, append bool) (storage
 		return nil, storagedriver.InvalidPathError{Path: path, DriverName: base.StorageDriver.Name()}
 	}
 
+	ctx, span := base.startSpan(ctx, "Writer", path)
 	writer, e := base.StorageDriver.Writer(ctx, path, append)
+	endSpan(span, e)
 	return writer, base.setDriverName(e)
 }
 
@@ -159,9 +187,11 @@ func (base *Base) Stat(ctx context.Context, path string) (storagedriver.FileInfo
 		return nil, storagedriver.InvalidPathError{Path: path, DriverName: base.StorageDriver.Name()}
 	}
 
+	ctx, span := base.startSpan(ctx, "Stat", path)
 	start := time.Now()
 	fi, e := base.StorageDriver.Stat(ctx, path)
 	storageAction.WithValues(base.Name(), "Stat").UpdateSince(start)
+	endSpan(span, e)
 	return fi, base.setDriverName(e)
 }
 
@@ -174,9 +204,11 @@ func (base *Base) List(ctx context.Context, path string) ([]string, error) {
 		return nil, storagedriver.InvalidPathError{Path: path, DriverName: base.StorageDriver.Name()}
 	}
 
+	ctx, span := base.startSpan(ctx, "List", path)
 	start := time.Now()
 	str, e := base.StorageDriver.List(ctx, path)
 	storageAction.WithValues(base.Name(), "List").UpdateSince(start)
+	endSpan(span, e)
 	return str, base.setDriverName(e)
 }
 
@@ -191,9 +223,35 @@ func (base *Base) Move(ctx context.Context, sourcePath string, destPath string)
 		return storagedriver.InvalidPathError{Path: destPath, DriverName: base.StorageDriver.Name()}
 	}
 
+	ctx, span := base.startSpan(ctx, "Move", sourcePath, attribute.String("storage.destination", destPath))
 	start := time.Now()
 	err := base.setDriverName(base.StorageDriver.Move(ctx, sourcePath, destPath))
 	storageAction.WithValues(base.Name(), "Move").UpdateSince(start)
+	endSpan(span, err)
+	return err
+}
+
+// Link wraps Link of the underlying storage driver, if it supports it.
+func (base *Base) Link(ctx context.Context, sourcePath string, destPath string) error {
+	ctx, done := dcontext.WithTrace(ctx)
+	defer done("%s.Link(%q, %q", base.Name(), sourcePath, destPath)
+
+	if !storagedriver.PathRegexp.MatchString(sourcePath) {
+		return storagedriver.InvalidPathError{Path: sourcePath, DriverName: base.StorageDriver.Name()}
+	} else if !storagedriver.PathRegexp.MatchString(destPath) {
+		return storagedriver.InvalidPathError{Path: destPath, DriverName: base.StorageDriver.Name()}
+	}
+
+	linker, ok := base.StorageDriver.(storagedriver.Linker)
+	if !ok {
+		return storagedriver.ErrUnsupportedMethod{DriverName: base.StorageDriver.Name()}
+	}
+
+	ctx, span := base.startSpan(ctx, "Link", sourcePath, attribute.String("storage.destination", destPath))
+	start := time.Now()
+	err := base.setDriverName(linker.Link(ctx, sourcePath, destPath))
+	storageAction.WithValues(base.Name(), "Link").UpdateSince(start)
+	endSpan(span, err)
 	return err
 }
 
@@ -206,9 +264,11 @@ func (base *Base) Delete(ctx context.Context, path string) error {
 		return storagedriver.InvalidPathError{Path: path, DriverName: base.StorageDriver.Name()}
 	}
 
+	ctx, span := base.startSpan(ctx, "Delete", path)
 	start := time.Now()
 	err := base.setDriverName(base.StorageDriver.Delete(ctx, path))
 	storageAction.WithValues(base.Name(), "Delete").UpdateSince(start)
+	endSpan(span, err)
 	return err
 }
 
@@ -221,9 +281,11 @@ func (base *Base) URLFor(ctx context.Context, path string, options map[string]in
 		return "", storagedriver.InvalidPathError{Path: path, DriverName: base.StorageDriver.Name()}
 	}
 
+	ctx, span := base.startSpan(ctx, "URLFor", path)
 	start := time.Now()
 	str, e := base.StorageDriver.URLFor(ctx, path, options)
 	storageAction.WithValues(base.Name(), "URLFor").UpdateSince(start)
+	endSpan(span, e)
 	return str, base.setDriverName(e)
 }
 
@@ -236,5 +298,8 @@ func (base *Base) Walk(ctx context.Context, path string, f storagedriver.WalkFn)
 		return storagedriver.InvalidPathError{Path: path, DriverName: base.StorageDriver.Name()}
 	}
 
-	return base.setDriverName(base.StorageDriver.Walk(ctx, path, f))
+	ctx, span := base.startSpan(ctx, "Walk", path)
+	err := base.setDriverName(base.StorageDriver.Walk(ctx, path, f))
+	endSpan(span, err)
+	return err
 }
@@ -164,6 +164,20 @@ func (r *regulator) Move(ctx context.Context, sourcePath string, destPath string
 	return r.StorageDriver.Move(ctx, sourcePath, destPath)
 }
 
+// Link stores the object at sourcePath at destPath as well, sharing their
+// content, if the regulated driver supports it.
+func (r *regulator) Link(ctx context.Context, sourcePath string, destPath string) error {
+	linker, ok := r.StorageDriver.(storagedriver.Linker)
+	if !ok {
+		return storagedriver.ErrUnsupportedMethod{}
+	}
+
+	r.enter()
+	defer r.exit()
+
+	return linker.Link(ctx, sourcePath, destPath)
+}
+
 // Delete recursively deletes all objects stored at "path" and its subpaths.
 func (r *regulator) Delete(ctx context.Context, path string) error {
 	r.enter()
@@ -0,0 +1,502 @@
+// Package external provides a storagedriver.StorageDriver implementation
+// delegating to a storage driver running in another process, over gRPC.
+//
+// External drivers implement the StorageDriver service of the
+// storagedriverpb package, which mirrors the storage driver interface, so that
+// custom backends can be developed and deployed out of the registry. The
+// NewServer function serves any storage driver of this repository with the
+// protocol, which is the simplest way to implement an external driver in Go.
+package external
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/base"
+	pb "github.com/distribution/distribution/v3/registry/storage/driver/external/storagedriverpb"
+	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
+)
+
+const driverName = "external"
+
+// defaultConnectTimeout is how long the connection to the driver is waited for
+// when none is configured.
+const defaultConnectTimeout = 30 * time.Second
+
+// chunkSize is the maximum size of the data carried by a message of the
+// reader and writer streams.
+const chunkSize = 1 << 20
+
+// maxMessageSize is the maximum size of the messages exchanged with the
+// driver. Larger contents are streamed.
+const maxMessageSize = 16 << 20
+
+// DriverParameters is a struct that encapsulates all of the driver parameters
+// after all values have been set
+type DriverParameters struct {
+	// Address is the gRPC target of the driver, such as
+	// unix:///run/registry/driver.sock or localhost:5050.
+	Address string `mapstructure:"address"`
+	// ConnectTimeout bounds the wait for the driver at startup.
+	ConnectTimeout time.Duration `mapstructure:"connecttimeout"`
+}
+
+func init() {
+	factory.Register(driverName, &externalDriverFactory{})
+}
+
+// externalDriverFactory implements the factory.StorageDriverFactory interface
+type externalDriverFactory struct{}
+
+func (factory *externalDriverFactory) Create(parameters map[string]interface{}) (storagedriver.StorageDriver, error) {
+	return FromParameters(parameters)
+}
+
+type driver struct {
+	conn   *grpc.ClientConn
+	client pb.StorageDriverClient
+	name   string
+}
+
+type baseEmbed struct {
+	base.Base
+}
+
+// Driver is a storagedriver.StorageDriver implementation forwarding the
+// storage operations to an external driver.
+type Driver struct {
+	baseEmbed
+}
+
+// FromParameters constructs a new Driver with a given parameters map
+// Required parameters:
+// - address
+func FromParameters(parameters map[string]interface{}) (*Driver, error) {
+	params := DriverParameters{
+		ConnectTimeout: defaultConnectTimeout,
+	}
+
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		WeaklyTypedInput: true,
+		DecodeHook:       mapstructure.StringToTimeDurationHookFunc(),
+		Result:           &params,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := decoder.Decode(parameters); err != nil {
+		return nil, err
+	}
+
+	if params.Address == "" {
+		return nil, fmt.Errorf("no address parameter provided")
+	}
+
+	return New(params)
+}
+
+// New constructs a new Driver connected to the external driver at the given
+// address. It waits for the driver to answer, so that a misconfigured or
+// missing driver is reported at startup.
+func New(params DriverParameters) (*Driver, error) {
+	conn, err := grpc.Dial(params.Address,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(
+			grpc.MaxCallRecvMsgSize(maxMessageSize),
+			grpc.MaxCallSendMsgSize(maxMessageSize),
+		),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %q: %v", params.Address, err)
+	}
+
+	timeout := params.ConnectTimeout
+	if timeout <= 0 {
+		timeout = defaultConnectTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	client := pb.NewStorageDriverClient(conn)
+	resp, err := client.Name(ctx, &pb.NameRequest{}, grpc.WaitForReady(true))
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error connecting to external driver at %s: %v", params.Address, err)
+	}
+	name := resp.GetName()
+	if name == "" {
+		name = driverName
+	}
+
+	d := &driver{
+		conn:   conn,
+		client: client,
+		name:   name,
+	}
+
+	return &Driver{
+		baseEmbed: baseEmbed{
+			Base: base.Base{
+				StorageDriver: d,
+			},
+		},
+	}, nil
+}
+
+// Implement the storagedriver.StorageDriver interface
+
+// Name returns the name the external driver reports.
+func (d *driver) Name() string {
+	return d.name
+}
+
+// GetContent retrieves the content stored at "path" as a []byte.
+func (d *driver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	resp, err := d.client.GetContent(ctx, &pb.GetContentRequest{Path: path})
+	if status.Code(err) == codes.ResourceExhausted {
+		// the content is larger than the messages, stream it
+		reader, err := d.Reader(ctx, path, 0)
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return ioutil.ReadAll(reader)
+	}
+	if err != nil {
+		return nil, d.fromStatus(err, path, 0)
+	}
+	return resp.GetContent(), nil
+}
+
+// PutContent stores the []byte content at a location designated by "path".
+func (d *driver) PutContent(ctx context.Context, path string, contents []byte) error {
+	if len(contents) > chunkSize {
+		// stream the content larger than the messages
+		writer, err := d.Writer(ctx, path, false)
+		if err != nil {
+			return err
+		}
+		defer writer.Close()
+		if _, err := writer.Write(contents); err != nil {
+			writer.Cancel()
+			return err
+		}
+		return writer.Commit()
+	}
+
+	_, err := d.client.PutContent(ctx, &pb.PutContentRequest{Path: path, Content: contents})
+	return d.fromStatus(err, path, 0)
+}
+
+// Reader retrieves an io.ReadCloser for the content stored at "path" with a
+// given byte offset.
+func (d *driver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	stream, err := d.client.Reader(ctx, &pb.ReaderRequest{Path: path, Offset: offset})
+	if err != nil {
+		cancel()
+		return nil, d.fromStatus(err, path, offset)
+	}
+
+	// receive the first message, to report the errors opening the file
+	r := &reader{
+		driver: d,
+		path:   path,
+		offset: offset,
+		stream: stream,
+		cancel: cancel,
+	}
+	resp, err := stream.Recv()
+	switch {
+	case err == io.EOF:
+		r.err = io.EOF
+	case err != nil:
+		cancel()
+		return nil, d.fromStatus(err, path, offset)
+	default:
+		r.buf = resp.GetData()
+	}
+	return r, nil
+}
+
+// Writer returns a FileWriter which will store the content written to it
+// at the location designated by "path" after the call to Commit.
+func (d *driver) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	stream, err := d.client.Writer(ctx)
+	if err != nil {
+		cancel()
+		return nil, d.fromStatus(err, path, 0)
+	}
+
+	w := &writer{
+		driver: d,
+		path:   path,
+		stream: stream,
+		cancel: cancel,
+	}
+	size, err := w.call(&pb.WriterRequest{Path: path, Append: append})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	w.size = size
+	return w, nil
+}
+
+// Stat retrieves the FileInfo for the given path, including the current size
+// in bytes and the creation time.
+func (d *driver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	resp, err := d.client.Stat(ctx, &pb.StatRequest{Path: path})
+	if err != nil {
+		return nil, d.fromStatus(err, path, 0)
+	}
+
+	fi := storagedriver.FileInfoFields{
+		Path:  resp.GetPath(),
+		Size:  resp.GetSize(),
+		IsDir: resp.GetIsDir(),
+	}
+	if fi.Path == "" {
+		fi.Path = path
+	}
+	if resp.GetModTime() != nil {
+		fi.ModTime = resp.GetModTime().AsTime()
+	}
+	return storagedriver.FileInfoInternal{FileInfoFields: fi}, nil
+}
+
+// List returns a list of the objects that are direct descendants of the given
+// path.
+func (d *driver) List(ctx context.Context, path string) ([]string, error) {
+	resp, err := d.client.List(ctx, &pb.ListRequest{Path: path})
+	if err != nil {
+		return nil, d.fromStatus(err, path, 0)
+	}
+	return resp.GetPaths(), nil
+}
+
+// Move moves an object stored at sourcePath to destPath, removing the original
+// object.
+func (d *driver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	_, err := d.client.Move(ctx, &pb.MoveRequest{SourcePath: sourcePath, DestPath: destPath})
+	return d.fromStatus(err, sourcePath, 0)
+}
+
+// Delete recursively deletes all objects stored at "path" and its subpaths.
+func (d *driver) Delete(ctx context.Context, path string) error {
+	_, err := d.client.Delete(ctx, &pb.DeleteRequest{Path: path})
+	return d.fromStatus(err, path, 0)
+}
+
+// URLFor returns a URL which may be used to retrieve the content stored at
+// the given path, if the external driver supports it.
+func (d *driver) URLFor(ctx context.Context, path string, options map[string]interface{}) (string, error) {
+	req := &pb.URLForRequest{Path: path}
+	if method, ok := options["method"]; ok {
+		if req.Method, ok = method.(string); !ok {
+			return "", storagedriver.ErrUnsupportedMethod{DriverName: d.name}
+		}
+	}
+	if expiry, ok := options["expiry"]; ok {
+		et, ok := expiry.(time.Time)
+		if !ok {
+			return "", storagedriver.ErrUnsupportedMethod{DriverName: d.name}
+		}
+		req.Expiry = timestamppb.New(et)
+	}
+
+	resp, err := d.client.URLFor(ctx, req)
+	if err != nil {
+		return "", d.fromStatus(err, path, 0)
+	}
+	return resp.GetUrl(), nil
+}
+
+// Walk traverses a filesystem defined within driver, starting
+// from the given path, calling f on each file and directory
+func (d *driver) Walk(ctx context.Context, path string, f storagedriver.WalkFn) error {
+	return storagedriver.WalkFallback(ctx, d, path, f)
+}
+
+// fromStatus converts the status of a failed call to the errors of the
+// storage drivers.
+func (d *driver) fromStatus(err error, path string, offset int64) error {
+	if err == nil {
+		return nil
+	}
+	s, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	switch s.Code() {
+	case codes.NotFound:
+		return storagedriver.PathNotFoundError{Path: path, DriverName: d.name}
+	case codes.InvalidArgument:
+		return storagedriver.InvalidPathError{Path: path, DriverName: d.name}
+	case codes.OutOfRange:
+		return storagedriver.InvalidOffsetError{Path: path, Offset: offset, DriverName: d.name}
+	case codes.Unimplemented:
+		return storagedriver.ErrUnsupportedMethod{DriverName: d.name}
+	case codes.Canceled:
+		return context.Canceled
+	case codes.DeadlineExceeded:
+		return context.DeadlineExceeded
+	}
+	return storagedriver.Error{DriverName: d.name, Enclosed: errors.New(s.Message())}
+}
+
+type reader struct {
+	driver *driver
+	path   string
+	offset int64
+	stream pb.StorageDriver_ReaderClient
+	cancel context.CancelFunc
+	buf    []byte
+	err    error
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		resp, err := r.stream.Recv()
+		if err != nil {
+			if err != io.EOF {
+				err = r.driver.fromStatus(err, r.path, r.offset)
+			}
+			r.err = err
+			continue
+		}
+		r.buf = resp.GetData()
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	r.offset += int64(n)
+	return n, nil
+}
+
+func (r *reader) Close() error {
+	r.cancel()
+	return nil
+}
+
+type writer struct {
+	driver    *driver
+	path      string
+	stream    pb.StorageDriver_WriterClient
+	cancel    context.CancelFunc
+	size      int64
+	closed    bool
+	committed bool
+	cancelled bool
+}
+
+// call sends a request which is answered by the driver, and returns the size
+// of the file it reports.
+func (w *writer) call(req *pb.WriterRequest) (int64, error) {
+	if err := w.stream.Send(req); err != nil {
+		return 0, w.streamError(err)
+	}
+	resp, err := w.stream.Recv()
+	if err != nil {
+		return 0, w.streamError(err)
+	}
+	return resp.GetSize(), nil
+}
+
+// streamError returns the error the stream failed with. Sending to a failed
+// stream reports io.EOF, the status being returned when receiving.
+func (w *writer) streamError(err error) error {
+	if err == io.EOF {
+		if _, err = w.stream.Recv(); err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	return w.driver.fromStatus(err, w.path, w.size)
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fmt.Errorf("already closed")
+	} else if w.committed {
+		return 0, fmt.Errorf("already committed")
+	} else if w.cancelled {
+		return 0, fmt.Errorf("already cancelled")
+	}
+
+	n := 0
+	for n < len(p) {
+		chunk := p[n:]
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+		if err := w.stream.Send(&pb.WriterRequest{Data: chunk}); err != nil {
+			return n, w.streamError(err)
+		}
+		n += len(chunk)
+		w.size += int64(len(chunk))
+	}
+	return n, nil
+}
+
+func (w *writer) Size() int64 {
+	return w.size
+}
+
+func (w *writer) Close() error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	}
+	w.closed = true
+	defer w.cancel()
+
+	if err := w.stream.CloseSend(); err != nil {
+		return w.streamError(err)
+	}
+	if _, err := w.stream.Recv(); err != io.EOF {
+		return w.streamError(err)
+	}
+	return nil
+}
+
+func (w *writer) Cancel() error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	} else if w.committed {
+		return fmt.Errorf("already committed")
+	}
+	w.cancelled = true
+	_, err := w.call(&pb.WriterRequest{Cancel: true})
+	return err
+}
+
+func (w *writer) Commit() error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	} else if w.committed {
+		return fmt.Errorf("already committed")
+	} else if w.cancelled {
+		return fmt.Errorf("already cancelled")
+	}
+	size, err := w.call(&pb.WriterRequest{Commit: true})
+	if err != nil {
+		return err
+	}
+	w.committed = true
+	w.size = size
+	return nil
+}
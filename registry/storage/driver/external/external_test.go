@@ -0,0 +1,89 @@
+package external
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/filesystem"
+	"github.com/distribution/distribution/v3/registry/storage/driver/testsuites"
+	"gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { check.TestingT(t) }
+
+func init() {
+	root, err := ioutil.TempDir("", "driver-")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(root)
+
+	// serve a filesystem driver over a unix socket
+	fsDriver, err := filesystem.FromParameters(map[string]interface{}{
+		"rootdirectory": filepath.Join(root, "storage"),
+	})
+	if err != nil {
+		panic(err)
+	}
+	socket := filepath.Join(root, "driver.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		panic(err)
+	}
+	go NewServer(fsDriver).Serve(listener)
+
+	driver, err := FromParameters(map[string]interface{}{
+		"address": "unix://" + socket,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	testsuites.RegisterSuite(func() (storagedriver.StorageDriver, error) {
+		return driver, nil
+	}, testsuites.NeverSkip)
+}
+
+func TestName(t *testing.T) {
+	root := t.TempDir()
+	fsDriver, err := filesystem.FromParameters(map[string]interface{}{
+		"rootdirectory": root,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(fsDriver)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	driver, err := FromParameters(map[string]interface{}{
+		"address": listener.Addr().String(),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error connecting to the driver: %v", err)
+	}
+	if driver.Name() != "filesystem" {
+		t.Errorf("unexpected driver name: %q", driver.Name())
+	}
+}
+
+func TestFromParametersInvalid(t *testing.T) {
+	for _, parameters := range []map[string]interface{}{
+		{},
+		{"address": "unix://" + filepath.Join(t.TempDir(), "missing.sock"), "connecttimeout": "100ms"},
+		{"address": "localhost:5050", "connecttimeout": "forever"},
+	} {
+		if _, err := FromParameters(parameters); err == nil {
+			t.Errorf("expected an error creating a driver with %v", parameters)
+		}
+	}
+}
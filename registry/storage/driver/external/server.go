@@ -0,0 +1,195 @@
+package external
+
+import (
+	"context"
+	"io"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	pb "github.com/distribution/distribution/v3/registry/storage/driver/external/storagedriverpb"
+)
+
+// NewServer returns a gRPC server serving the storage driver as an external
+// driver, to be started with its Serve method.
+func NewServer(driver storagedriver.StorageDriver, opts ...grpc.ServerOption) *grpc.Server {
+	opts = append([]grpc.ServerOption{
+		grpc.MaxRecvMsgSize(maxMessageSize),
+		grpc.MaxSendMsgSize(maxMessageSize),
+	}, opts...)
+	s := grpc.NewServer(opts...)
+	pb.RegisterStorageDriverServer(s, &server{driver: driver})
+	return s
+}
+
+// server implements the StorageDriver service with a storage driver.
+type server struct {
+	pb.UnimplementedStorageDriverServer
+	driver storagedriver.StorageDriver
+}
+
+func (s *server) Name(ctx context.Context, req *pb.NameRequest) (*pb.NameResponse, error) {
+	return &pb.NameResponse{Name: s.driver.Name()}, nil
+}
+
+func (s *server) GetContent(ctx context.Context, req *pb.GetContentRequest) (*pb.GetContentResponse, error) {
+	content, err := s.driver.GetContent(ctx, req.GetPath())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &pb.GetContentResponse{Content: content}, nil
+}
+
+func (s *server) PutContent(ctx context.Context, req *pb.PutContentRequest) (*pb.PutContentResponse, error) {
+	if err := s.driver.PutContent(ctx, req.GetPath(), req.GetContent()); err != nil {
+		return nil, toStatus(err)
+	}
+	return &pb.PutContentResponse{}, nil
+}
+
+func (s *server) Reader(req *pb.ReaderRequest, stream pb.StorageDriver_ReaderServer) error {
+	rc, err := s.driver.Reader(stream.Context(), req.GetPath(), req.GetOffset())
+	if err != nil {
+		return toStatus(err)
+	}
+	defer rc.Close()
+
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(rc, buf)
+		if n > 0 {
+			if err := stream.Send(&pb.ReaderResponse{Data: buf[:n]}); err != nil {
+				return err
+			}
+		}
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			return nil
+		default:
+			return toStatus(err)
+		}
+	}
+}
+
+func (s *server) Writer(stream pb.StorageDriver_WriterServer) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	fw, err := s.driver.Writer(stream.Context(), req.GetPath(), req.GetAppend())
+	if err != nil {
+		return toStatus(err)
+	}
+	if err := stream.Send(&pb.WriterResponse{Size: fw.Size()}); err != nil {
+		fw.Close()
+		return err
+	}
+
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return toStatus(fw.Close())
+		}
+		if err != nil {
+			fw.Close()
+			return err
+		}
+
+		switch {
+		case req.GetCommit():
+			err = fw.Commit()
+		case req.GetCancel():
+			err = fw.Cancel()
+		default:
+			_, err = fw.Write(req.GetData())
+		}
+		if err != nil {
+			fw.Close()
+			return toStatus(err)
+		}
+		if req.GetCommit() || req.GetCancel() {
+			if err := stream.Send(&pb.WriterResponse{Size: fw.Size()}); err != nil {
+				fw.Close()
+				return err
+			}
+		}
+	}
+}
+
+func (s *server) Stat(ctx context.Context, req *pb.StatRequest) (*pb.StatResponse, error) {
+	fi, err := s.driver.Stat(ctx, req.GetPath())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	resp := &pb.StatResponse{
+		Path:  fi.Path(),
+		Size:  fi.Size(),
+		IsDir: fi.IsDir(),
+	}
+	if !fi.ModTime().IsZero() {
+		resp.ModTime = timestamppb.New(fi.ModTime())
+	}
+	return resp, nil
+}
+
+func (s *server) List(ctx context.Context, req *pb.ListRequest) (*pb.ListResponse, error) {
+	paths, err := s.driver.List(ctx, req.GetPath())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &pb.ListResponse{Paths: paths}, nil
+}
+
+func (s *server) Move(ctx context.Context, req *pb.MoveRequest) (*pb.MoveResponse, error) {
+	if err := s.driver.Move(ctx, req.GetSourcePath(), req.GetDestPath()); err != nil {
+		return nil, toStatus(err)
+	}
+	return &pb.MoveResponse{}, nil
+}
+
+func (s *server) Delete(ctx context.Context, req *pb.DeleteRequest) (*pb.DeleteResponse, error) {
+	if err := s.driver.Delete(ctx, req.GetPath()); err != nil {
+		return nil, toStatus(err)
+	}
+	return &pb.DeleteResponse{}, nil
+}
+
+func (s *server) URLFor(ctx context.Context, req *pb.URLForRequest) (*pb.URLForResponse, error) {
+	options := make(map[string]interface{})
+	if req.GetMethod() != "" {
+		options["method"] = req.GetMethod()
+	}
+	if req.GetExpiry() != nil {
+		options["expiry"] = req.GetExpiry().AsTime()
+	}
+	url, err := s.driver.URLFor(ctx, req.GetPath(), options)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &pb.URLForResponse{Url: url}, nil
+}
+
+// toStatus converts the errors of the storage drivers to the status of the
+// calls, their codes telling the errors apart.
+func toStatus(err error) error {
+	switch err := err.(type) {
+	case nil:
+		return nil
+	case storagedriver.PathNotFoundError:
+		return status.Error(codes.NotFound, err.Error())
+	case storagedriver.InvalidPathError:
+		return status.Error(codes.InvalidArgument, err.Error())
+	case storagedriver.InvalidOffsetError:
+		return status.Error(codes.OutOfRange, err.Error())
+	case storagedriver.ErrUnsupportedMethod:
+		return status.Error(codes.Unimplemented, err.Error())
+	}
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return status.FromContextError(err).Err()
+	}
+	return status.Error(codes.Unknown, err.Error())
+}
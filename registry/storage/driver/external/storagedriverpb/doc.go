@@ -0,0 +1,5 @@
+// Package storagedriverpb holds the protocol of the external storage drivers,
+// generated from storagedriver.proto.
+package storagedriverpb
+
+//go:generate protoc -I ../../../../.. --go_out=../../../../.. --go_opt=paths=source_relative --go-grpc_out=../../../../.. --go-grpc_opt=paths=source_relative registry/storage/driver/external/storagedriverpb/storagedriver.proto
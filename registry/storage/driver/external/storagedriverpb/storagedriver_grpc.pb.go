@@ -0,0 +1,519 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.2.0
+// - protoc             (unknown)
+// source: registry/storage/driver/external/storagedriverpb/storagedriver.proto
+
+package storagedriverpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// StorageDriverClient is the client API for StorageDriver service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type StorageDriverClient interface {
+	// Name returns the name of the driver, which the registry reports in its
+	// logs and errors.
+	Name(ctx context.Context, in *NameRequest, opts ...grpc.CallOption) (*NameResponse, error)
+	// GetContent returns the content of a file.
+	GetContent(ctx context.Context, in *GetContentRequest, opts ...grpc.CallOption) (*GetContentResponse, error)
+	// PutContent replaces the content of a file.
+	PutContent(ctx context.Context, in *PutContentRequest, opts ...grpc.CallOption) (*PutContentResponse, error)
+	// Reader streams the content of a file from an offset.
+	Reader(ctx context.Context, in *ReaderRequest, opts ...grpc.CallOption) (StorageDriver_ReaderClient, error)
+	// Writer writes a file. The first request opens the file and is answered
+	// with its current size. The following requests carry data, which is not
+	// answered, or commit or cancel the file, which are answered once done.
+	// The file is closed when the client closes the stream.
+	Writer(ctx context.Context, opts ...grpc.CallOption) (StorageDriver_WriterClient, error)
+	// Stat returns the information about a file or directory.
+	Stat(ctx context.Context, in *StatRequest, opts ...grpc.CallOption) (*StatResponse, error)
+	// List returns the paths of the direct children of a directory.
+	List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResponse, error)
+	// Move moves a file, replacing the destination.
+	Move(ctx context.Context, in *MoveRequest, opts ...grpc.CallOption) (*MoveResponse, error)
+	// Delete recursively deletes a path.
+	Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error)
+	// URLFor returns a URL from which the content of a file can be retrieved
+	// directly.
+	URLFor(ctx context.Context, in *URLForRequest, opts ...grpc.CallOption) (*URLForResponse, error)
+}
+
+type storageDriverClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewStorageDriverClient(cc grpc.ClientConnInterface) StorageDriverClient {
+	return &storageDriverClient{cc}
+}
+
+func (c *storageDriverClient) Name(ctx context.Context, in *NameRequest, opts ...grpc.CallOption) (*NameResponse, error) {
+	out := new(NameResponse)
+	err := c.cc.Invoke(ctx, "/distribution.storagedriver.v1.StorageDriver/Name", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *storageDriverClient) GetContent(ctx context.Context, in *GetContentRequest, opts ...grpc.CallOption) (*GetContentResponse, error) {
+	out := new(GetContentResponse)
+	err := c.cc.Invoke(ctx, "/distribution.storagedriver.v1.StorageDriver/GetContent", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *storageDriverClient) PutContent(ctx context.Context, in *PutContentRequest, opts ...grpc.CallOption) (*PutContentResponse, error) {
+	out := new(PutContentResponse)
+	err := c.cc.Invoke(ctx, "/distribution.storagedriver.v1.StorageDriver/PutContent", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *storageDriverClient) Reader(ctx context.Context, in *ReaderRequest, opts ...grpc.CallOption) (StorageDriver_ReaderClient, error) {
+	stream, err := c.cc.NewStream(ctx, &StorageDriver_ServiceDesc.Streams[0], "/distribution.storagedriver.v1.StorageDriver/Reader", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &storageDriverReaderClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type StorageDriver_ReaderClient interface {
+	Recv() (*ReaderResponse, error)
+	grpc.ClientStream
+}
+
+type storageDriverReaderClient struct {
+	grpc.ClientStream
+}
+
+func (x *storageDriverReaderClient) Recv() (*ReaderResponse, error) {
+	m := new(ReaderResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *storageDriverClient) Writer(ctx context.Context, opts ...grpc.CallOption) (StorageDriver_WriterClient, error) {
+	stream, err := c.cc.NewStream(ctx, &StorageDriver_ServiceDesc.Streams[1], "/distribution.storagedriver.v1.StorageDriver/Writer", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &storageDriverWriterClient{stream}
+	return x, nil
+}
+
+type StorageDriver_WriterClient interface {
+	Send(*WriterRequest) error
+	Recv() (*WriterResponse, error)
+	grpc.ClientStream
+}
+
+type storageDriverWriterClient struct {
+	grpc.ClientStream
+}
+
+func (x *storageDriverWriterClient) Send(m *WriterRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *storageDriverWriterClient) Recv() (*WriterResponse, error) {
+	m := new(WriterResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *storageDriverClient) Stat(ctx context.Context, in *StatRequest, opts ...grpc.CallOption) (*StatResponse, error) {
+	out := new(StatResponse)
+	err := c.cc.Invoke(ctx, "/distribution.storagedriver.v1.StorageDriver/Stat", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *storageDriverClient) List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResponse, error) {
+	out := new(ListResponse)
+	err := c.cc.Invoke(ctx, "/distribution.storagedriver.v1.StorageDriver/List", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *storageDriverClient) Move(ctx context.Context, in *MoveRequest, opts ...grpc.CallOption) (*MoveResponse, error) {
+	out := new(MoveResponse)
+	err := c.cc.Invoke(ctx, "/distribution.storagedriver.v1.StorageDriver/Move", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *storageDriverClient) Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error) {
+	out := new(DeleteResponse)
+	err := c.cc.Invoke(ctx, "/distribution.storagedriver.v1.StorageDriver/Delete", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *storageDriverClient) URLFor(ctx context.Context, in *URLForRequest, opts ...grpc.CallOption) (*URLForResponse, error) {
+	out := new(URLForResponse)
+	err := c.cc.Invoke(ctx, "/distribution.storagedriver.v1.StorageDriver/URLFor", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// StorageDriverServer is the server API for StorageDriver service.
+// All implementations must embed UnimplementedStorageDriverServer
+// for forward compatibility
+type StorageDriverServer interface {
+	// Name returns the name of the driver, which the registry reports in its
+	// logs and errors.
+	Name(context.Context, *NameRequest) (*NameResponse, error)
+	// GetContent returns the content of a file.
+	GetContent(context.Context, *GetContentRequest) (*GetContentResponse, error)
+	// PutContent replaces the content of a file.
+	PutContent(context.Context, *PutContentRequest) (*PutContentResponse, error)
+	// Reader streams the content of a file from an offset.
+	Reader(*ReaderRequest, StorageDriver_ReaderServer) error
+	// Writer writes a file. The first request opens the file and is answered
+	// with its current size. The following requests carry data, which is not
+	// answered, or commit or cancel the file, which are answered once done.
+	// The file is closed when the client closes the stream.
+	Writer(StorageDriver_WriterServer) error
+	// Stat returns the information about a file or directory.
+	Stat(context.Context, *StatRequest) (*StatResponse, error)
+	// List returns the paths of the direct children of a directory.
+	List(context.Context, *ListRequest) (*ListResponse, error)
+	// Move moves a file, replacing the destination.
+	Move(context.Context, *MoveRequest) (*MoveResponse, error)
+	// Delete recursively deletes a path.
+	Delete(context.Context, *DeleteRequest) (*DeleteResponse, error)
+	// URLFor returns a URL from which the content of a file can be retrieved
+	// directly.
+	URLFor(context.Context, *URLForRequest) (*URLForResponse, error)
+	mustEmbedUnimplementedStorageDriverServer()
+}
+
+// UnimplementedStorageDriverServer must be embedded to have forward compatible implementations.
+type UnimplementedStorageDriverServer struct {
+}
+
+func (UnimplementedStorageDriverServer) Name(context.Context, *NameRequest) (*NameResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Name not implemented")
+}
+func (UnimplementedStorageDriverServer) GetContent(context.Context, *GetContentRequest) (*GetContentResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetContent not implemented")
+}
+func (UnimplementedStorageDriverServer) PutContent(context.Context, *PutContentRequest) (*PutContentResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PutContent not implemented")
+}
+func (UnimplementedStorageDriverServer) Reader(*ReaderRequest, StorageDriver_ReaderServer) error {
+	return status.Errorf(codes.Unimplemented, "method Reader not implemented")
+}
+func (UnimplementedStorageDriverServer) Writer(StorageDriver_WriterServer) error {
+	return status.Errorf(codes.Unimplemented, "method Writer not implemented")
+}
+func (UnimplementedStorageDriverServer) Stat(context.Context, *StatRequest) (*StatResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Stat not implemented")
+}
+func (UnimplementedStorageDriverServer) List(context.Context, *ListRequest) (*ListResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method List not implemented")
+}
+func (UnimplementedStorageDriverServer) Move(context.Context, *MoveRequest) (*MoveResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Move not implemented")
+}
+func (UnimplementedStorageDriverServer) Delete(context.Context, *DeleteRequest) (*DeleteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Delete not implemented")
+}
+func (UnimplementedStorageDriverServer) URLFor(context.Context, *URLForRequest) (*URLForResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method URLFor not implemented")
+}
+func (UnimplementedStorageDriverServer) mustEmbedUnimplementedStorageDriverServer() {}
+
+// UnsafeStorageDriverServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to StorageDriverServer will
+// result in compilation errors.
+type UnsafeStorageDriverServer interface {
+	mustEmbedUnimplementedStorageDriverServer()
+}
+
+func RegisterStorageDriverServer(s grpc.ServiceRegistrar, srv StorageDriverServer) {
+	s.RegisterService(&StorageDriver_ServiceDesc, srv)
+}
+
+func _StorageDriver_Name_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(NameRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StorageDriverServer).Name(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/distribution.storagedriver.v1.StorageDriver/Name",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StorageDriverServer).Name(ctx, req.(*NameRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _StorageDriver_GetContent_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetContentRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StorageDriverServer).GetContent(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/distribution.storagedriver.v1.StorageDriver/GetContent",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StorageDriverServer).GetContent(ctx, req.(*GetContentRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _StorageDriver_PutContent_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PutContentRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StorageDriverServer).PutContent(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/distribution.storagedriver.v1.StorageDriver/PutContent",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StorageDriverServer).PutContent(ctx, req.(*PutContentRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _StorageDriver_Reader_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ReaderRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(StorageDriverServer).Reader(m, &storageDriverReaderServer{stream})
+}
+
+type StorageDriver_ReaderServer interface {
+	Send(*ReaderResponse) error
+	grpc.ServerStream
+}
+
+type storageDriverReaderServer struct {
+	grpc.ServerStream
+}
+
+func (x *storageDriverReaderServer) Send(m *ReaderResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _StorageDriver_Writer_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(StorageDriverServer).Writer(&storageDriverWriterServer{stream})
+}
+
+type StorageDriver_WriterServer interface {
+	Send(*WriterResponse) error
+	Recv() (*WriterRequest, error)
+	grpc.ServerStream
+}
+
+type storageDriverWriterServer struct {
+	grpc.ServerStream
+}
+
+func (x *storageDriverWriterServer) Send(m *WriterResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *storageDriverWriterServer) Recv() (*WriterRequest, error) {
+	m := new(WriterRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _StorageDriver_Stat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StatRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StorageDriverServer).Stat(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/distribution.storagedriver.v1.StorageDriver/Stat",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StorageDriverServer).Stat(ctx, req.(*StatRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _StorageDriver_List_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StorageDriverServer).List(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/distribution.storagedriver.v1.StorageDriver/List",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StorageDriverServer).List(ctx, req.(*ListRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _StorageDriver_Move_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MoveRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StorageDriverServer).Move(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/distribution.storagedriver.v1.StorageDriver/Move",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StorageDriverServer).Move(ctx, req.(*MoveRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _StorageDriver_Delete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StorageDriverServer).Delete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/distribution.storagedriver.v1.StorageDriver/Delete",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StorageDriverServer).Delete(ctx, req.(*DeleteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _StorageDriver_URLFor_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(URLForRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StorageDriverServer).URLFor(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/distribution.storagedriver.v1.StorageDriver/URLFor",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StorageDriverServer).URLFor(ctx, req.(*URLForRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// StorageDriver_ServiceDesc is the grpc.ServiceDesc for StorageDriver service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var StorageDriver_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "distribution.storagedriver.v1.StorageDriver",
+	HandlerType: (*StorageDriverServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Name",
+			Handler:    _StorageDriver_Name_Handler,
+		},
+		{
+			MethodName: "GetContent",
+			Handler:    _StorageDriver_GetContent_Handler,
+		},
+		{
+			MethodName: "PutContent",
+			Handler:    _StorageDriver_PutContent_Handler,
+		},
+		{
+			MethodName: "Stat",
+			Handler:    _StorageDriver_Stat_Handler,
+		},
+		{
+			MethodName: "List",
+			Handler:    _StorageDriver_List_Handler,
+		},
+		{
+			MethodName: "Move",
+			Handler:    _StorageDriver_Move_Handler,
+		},
+		{
+			MethodName: "Delete",
+			Handler:    _StorageDriver_Delete_Handler,
+		},
+		{
+			MethodName: "URLFor",
+			Handler:    _StorageDriver_URLFor_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Reader",
+			Handler:       _StorageDriver_Reader_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Writer",
+			Handler:       _StorageDriver_Writer_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "registry/storage/driver/external/storagedriverpb/storagedriver.proto",
+}
@@ -4,11 +4,16 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"strconv"
+	"syscall"
 	"time"
 
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
@@ -27,11 +32,32 @@ const (
 	minThreads = uint64(25)
 )
 
+// Durability controls which writes the driver fsyncs before reporting them
+// as done.
+type Durability string
+
+const (
+	// DurabilityNone never fsyncs, leaving it to the operating system to
+	// flush writes to disk. Content written shortly before a power loss may
+	// be lost or corrupted.
+	DurabilityNone Durability = "none"
+	// DurabilityData fsyncs the content of files before they are committed.
+	DurabilityData Durability = "data"
+	// DurabilityFull fsyncs the content of files before they are committed,
+	// and the directories in which files are created or moved, so that
+	// their entries survive a power loss as well.
+	DurabilityFull Durability = "full"
+
+	defaultDurability = DurabilityData
+)
+
 // DriverParameters represents all configuration options available for the
 // filesystem driver
 type DriverParameters struct {
 	RootDirectory string
 	MaxThreads    uint64
+	Durability    Durability
+	Hardlinks     bool
 }
 
 func init() {
@@ -47,6 +73,8 @@ func (factory *filesystemDriverFactory) Create(parameters map[string]interface{}
 
 type driver struct {
 	rootDirectory string
+	durability    Durability
+	hardlinks     bool
 }
 
 type baseEmbed struct {
@@ -63,6 +91,8 @@ type Driver struct {
 // Optional Parameters:
 // - rootdirectory
 // - maxthreads
+// - durability
+// - hardlinks
 func FromParameters(parameters map[string]interface{}) (*Driver, error) {
 	params, err := fromParametersImpl(parameters)
 	if err != nil || params == nil {
@@ -76,6 +106,8 @@ func fromParametersImpl(parameters map[string]interface{}) (*DriverParameters, e
 		err           error
 		maxThreads    = defaultMaxThreads
 		rootDirectory = defaultRootDirectory
+		durability    = defaultDurability
+		hardlinks     = false
 	)
 
 	if parameters != nil {
@@ -87,18 +119,51 @@ func fromParametersImpl(parameters map[string]interface{}) (*DriverParameters, e
 		if err != nil {
 			return nil, fmt.Errorf("maxthreads config error: %s", err.Error())
 		}
+
+		if d, ok := parameters["durability"]; ok {
+			durability = Durability(fmt.Sprint(d))
+			switch durability {
+			case DurabilityNone, DurabilityData, DurabilityFull:
+			default:
+				return nil, fmt.Errorf("durability config error: must be one of %q, %q or %q, got %q",
+					DurabilityNone, DurabilityData, DurabilityFull, durability)
+			}
+		}
+
+		if h, ok := parameters["hardlinks"]; ok {
+			switch v := h.(type) {
+			case bool:
+				hardlinks = v
+			case string:
+				if hardlinks, err = strconv.ParseBool(v); err != nil {
+					return nil, fmt.Errorf("hardlinks config error: %v", err)
+				}
+			default:
+				return nil, fmt.Errorf("hardlinks config error: must be a boolean, got %#v", h)
+			}
+		}
 	}
 
 	params := &DriverParameters{
 		RootDirectory: rootDirectory,
 		MaxThreads:    maxThreads,
+		Durability:    durability,
+		Hardlinks:     hardlinks,
 	}
 	return params, nil
 }
 
 // New constructs a new Driver with a given rootDirectory
 func New(params DriverParameters) *Driver {
-	fsDriver := &driver{rootDirectory: params.RootDirectory}
+	durability := params.Durability
+	if durability == "" {
+		durability = defaultDurability
+	}
+	fsDriver := &driver{
+		rootDirectory: params.RootDirectory,
+		durability:    durability,
+		hardlinks:     params.Hardlinks,
+	}
 
 	return &Driver{
 		baseEmbed: baseEmbed{
@@ -173,15 +238,33 @@ func (d *driver) Reader(ctx context.Context, path string, offset int64) (io.Read
 func (d *driver) Writer(ctx context.Context, subPath string, append bool) (storagedriver.FileWriter, error) {
 	fullPath := d.fullPath(subPath)
 	parentDir := path.Dir(fullPath)
-	if err := os.MkdirAll(parentDir, 0777); err != nil {
+	if err := d.mkdirAll(parentDir); err != nil {
 		return nil, err
 	}
 
+	fi, err := os.Stat(fullPath)
+	created := os.IsNotExist(err)
+
+	// an object linked to others is written to a new file, so that their
+	// content is left unchanged
+	if d.hardlinks && err == nil && linkCount(fi) > 1 {
+		if err := d.unlink(fullPath, append); err != nil {
+			return nil, err
+		}
+	}
+
 	fp, err := os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE, 0666)
 	if err != nil {
 		return nil, err
 	}
 
+	if created && d.durability == DurabilityFull {
+		if err := syncDir(parentDir); err != nil {
+			fp.Close()
+			return nil, err
+		}
+	}
+
 	var offset int64
 
 	if !append {
@@ -199,7 +282,7 @@ func (d *driver) Writer(ctx context.Context, subPath string, append bool) (stora
 		offset = n
 	}
 
-	return newFileWriter(fp, offset), nil
+	return newFileWriter(fp, offset, d.durability != DurabilityNone), nil
 }
 
 // Stat retrieves the FileInfo for the given path, including the current size
@@ -260,12 +343,125 @@ func (d *driver) Move(ctx context.Context, sourcePath string, destPath string) e
 		return storagedriver.PathNotFoundError{Path: sourcePath}
 	}
 
-	if err := os.MkdirAll(path.Dir(dest), 0777); err != nil {
+	if err := d.mkdirAll(path.Dir(dest)); err != nil {
 		return err
 	}
 
-	err := os.Rename(source, dest)
-	return err
+	if err := os.Rename(source, dest); err != nil {
+		return err
+	}
+
+	if d.durability == DurabilityFull {
+		if err := syncDir(path.Dir(dest)); err != nil {
+			return err
+		}
+		if path.Dir(source) != path.Dir(dest) {
+			return syncDir(path.Dir(source))
+		}
+	}
+	return nil
+}
+
+// Link stores the object at sourcePath at destPath as well, with a hardlink
+// sharing their content. ErrUnsupportedMethod is returned when hardlinks are
+// disabled or not supported between the paths by the filesystem.
+func (d *driver) Link(ctx context.Context, sourcePath string, destPath string) error {
+	if !d.hardlinks || !linksCounted {
+		return storagedriver.ErrUnsupportedMethod{}
+	}
+
+	source := d.fullPath(sourcePath)
+	dest := d.fullPath(destPath)
+
+	fi, err := os.Stat(source)
+	if os.IsNotExist(err) {
+		return storagedriver.PathNotFoundError{Path: sourcePath}
+	} else if err != nil {
+		return err
+	} else if fi.IsDir() {
+		return storagedriver.ErrUnsupportedMethod{}
+	}
+
+	if err := d.mkdirAll(path.Dir(dest)); err != nil {
+		return err
+	}
+
+	// the link is renamed over the destination, which os.Link does not
+	// replace
+	tmp, err := tempPath(dest)
+	if err != nil {
+		return err
+	}
+	if err := os.Link(source, tmp); err != nil {
+		if errors.Is(err, syscall.EXDEV) || errors.Is(err, syscall.EPERM) ||
+			errors.Is(err, syscall.EMLINK) || errors.Is(err, syscall.ENOTSUP) ||
+			errors.Is(err, syscall.EOPNOTSUPP) {
+			return storagedriver.ErrUnsupportedMethod{}
+		}
+		return err
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if d.durability == DurabilityFull {
+		return syncDir(path.Dir(dest))
+	}
+	return nil
+}
+
+// unlink replaces the file at fullPath, linked to others, with a new file,
+// with a copy of its content if it is kept.
+func (d *driver) unlink(fullPath string, keepContent bool) error {
+	if !keepContent {
+		return os.Remove(fullPath)
+	}
+
+	tmp, err := tempPath(fullPath)
+	if err != nil {
+		return err
+	}
+	src, err := os.Open(fullPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if d.durability != DurabilityNone {
+		if err := dst.Sync(); err != nil {
+			dst.Close()
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, fullPath); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// tempPath returns a unique path next to fullPath, for files renamed over
+// it once written.
+func tempPath(fullPath string) (string, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return fullPath + ".tmp-" + hex.EncodeToString(b[:]), nil
 }
 
 // Delete recursively deletes all objects stored at "path" and its subpaths.
@@ -300,6 +496,46 @@ func (d *driver) fullPath(subPath string) string {
 	return path.Join(d.rootDirectory, subPath)
 }
 
+// mkdirAll creates the directory dir along with its missing parents. With
+// full durability, the parent of each created directory is fsynced.
+func (d *driver) mkdirAll(dir string) error {
+	if d.durability != DurabilityFull {
+		return os.MkdirAll(dir, 0777)
+	}
+
+	if fi, err := os.Stat(dir); err == nil {
+		if !fi.IsDir() {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+		return nil
+	}
+
+	parent := path.Dir(dir)
+	if parent != dir {
+		if err := d.mkdirAll(parent); err != nil {
+			return err
+		}
+	}
+	if err := os.Mkdir(dir, 0777); err != nil {
+		if os.IsExist(err) {
+			return nil
+		}
+		return err
+	}
+	return syncDir(parent)
+}
+
+// syncDir fsyncs the directory dir, persisting the creation, removal and
+// renaming of its entries.
+func syncDir(dir string) error {
+	fp, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	return fp.Sync()
+}
+
 type fileInfo struct {
 	os.FileInfo
 	path string
@@ -338,16 +574,18 @@ type fileWriter struct {
 	file      *os.File
 	size      int64
 	bw        *bufio.Writer
+	sync      bool
 	closed    bool
 	committed bool
 	cancelled bool
 }
 
-func newFileWriter(file *os.File, size int64) *fileWriter {
+func newFileWriter(file *os.File, size int64, sync bool) *fileWriter {
 	return &fileWriter{
 		file: file,
 		size: size,
 		bw:   bufio.NewWriter(file),
+		sync: sync,
 	}
 }
 
@@ -377,8 +615,10 @@ func (fw *fileWriter) Close() error {
 		return err
 	}
 
-	if err := fw.file.Sync(); err != nil {
-		return err
+	if fw.sync {
+		if err := fw.file.Sync(); err != nil {
+			return err
+		}
 	}
 
 	if err := fw.file.Close(); err != nil {
@@ -411,8 +651,10 @@ func (fw *fileWriter) Commit() error {
 		return err
 	}
 
-	if err := fw.file.Sync(); err != nil {
-		return err
+	if fw.sync {
+		if err := fw.file.Sync(); err != nil {
+			return err
+		}
 	}
 
 	fw.committed = true
@@ -1,8 +1,10 @@
 package filesystem
 
 import (
+	"context"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 
@@ -31,6 +33,25 @@ func init() {
 	testsuites.RegisterSuite(func() (storagedriver.StorageDriver, error) {
 		return driver, nil
 	}, testsuites.NeverSkip)
+
+	// run the suite again syncing every write and directory
+	fullRoot, err := ioutil.TempDir("", "driver-")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(fullRoot)
+
+	fullDriver, err := FromParameters(map[string]interface{}{
+		"rootdirectory": fullRoot,
+		"durability":    "full",
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	testsuites.RegisterSuite(func() (storagedriver.StorageDriver, error) {
+		return fullDriver, nil
+	}, testsuites.NeverSkip)
 }
 
 func TestFromParametersImpl(t *testing.T) {
@@ -46,6 +67,7 @@ func TestFromParametersImpl(t *testing.T) {
 			expected: DriverParameters{
 				RootDirectory: defaultRootDirectory,
 				MaxThreads:    defaultMaxThreads,
+				Durability:    defaultDurability,
 			},
 			pass: true,
 		},
@@ -64,6 +86,7 @@ func TestFromParametersImpl(t *testing.T) {
 			expected: DriverParameters{
 				RootDirectory: defaultRootDirectory,
 				MaxThreads:    uint64(100),
+				Durability:    defaultDurability,
 			},
 			pass: true,
 		},
@@ -74,6 +97,7 @@ func TestFromParametersImpl(t *testing.T) {
 			expected: DriverParameters{
 				RootDirectory: defaultRootDirectory,
 				MaxThreads:    uint64(100),
+				Durability:    defaultDurability,
 			},
 			pass: true,
 		},
@@ -85,9 +109,48 @@ func TestFromParametersImpl(t *testing.T) {
 			expected: DriverParameters{
 				RootDirectory: defaultRootDirectory,
 				MaxThreads:    minThreads,
+				Durability:    defaultDurability,
+			},
+			pass: true,
+		},
+		{
+			params: map[string]interface{}{
+				"durability": "full",
+			},
+			expected: DriverParameters{
+				RootDirectory: defaultRootDirectory,
+				MaxThreads:    defaultMaxThreads,
+				Durability:    DurabilityFull,
+			},
+			pass: true,
+		},
+		{
+			params: map[string]interface{}{
+				"hardlinks": "true",
+			},
+			expected: DriverParameters{
+				RootDirectory: defaultRootDirectory,
+				MaxThreads:    defaultMaxThreads,
+				Durability:    defaultDurability,
+				Hardlinks:     true,
 			},
 			pass: true,
 		},
+		{
+			params: map[string]interface{}{
+				"hardlinks": "sometimes",
+			},
+			expected: DriverParameters{},
+			pass:     false,
+		},
+		// unknown durability modes are rejected
+		{
+			params: map[string]interface{}{
+				"durability": "always",
+			},
+			expected: DriverParameters{},
+			pass:     false,
+		},
 	}
 
 	for _, item := range tests {
@@ -111,3 +174,90 @@ func TestFromParametersImpl(t *testing.T) {
 	}
 
 }
+
+func TestLink(t *testing.T) {
+	if !linksCounted {
+		t.Skip("hardlinks are not supported on this platform")
+	}
+	ctx := context.Background()
+	root := t.TempDir()
+
+	d, err := FromParameters(map[string]interface{}{
+		"rootdirectory": root,
+		"hardlinks":     true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutContent(ctx, "/a/data", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Link(ctx, "/a/data", "/b/data"); err != nil {
+		t.Fatalf("unexpected error linking: %v", err)
+	}
+
+	a, err := os.Stat(filepath.Join(root, "a", "data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.Stat(filepath.Join(root, "b", "data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(a, b) {
+		t.Fatal("expected the objects to be hardlinked")
+	}
+
+	// writing a linked object leaves the others unchanged
+	if err := d.PutContent(ctx, "/b/data", []byte("changed")); err != nil {
+		t.Fatal(err)
+	}
+	w, err := d.Writer(ctx, "/a/data", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(" appended")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for path, expected := range map[string]string{"/a/data": "content appended", "/b/data": "changed"} {
+		content, err := d.GetContent(ctx, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != expected {
+			t.Errorf("unexpected content of %s: %q != %q", path, content, expected)
+		}
+	}
+
+	if err := d.Link(ctx, "/missing", "/c/data"); err == nil {
+		t.Error("expected an error linking a missing object")
+	} else if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+		t.Errorf("unexpected error linking a missing object: %v", err)
+	}
+}
+
+func TestLinkDisabled(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+
+	d, err := FromParameters(map[string]interface{}{
+		"rootdirectory": root,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutContent(ctx, "/a/data", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Link(ctx, "/a/data", "/b/data"); err == nil {
+		t.Fatal("expected linking to be unsupported")
+	} else if _, ok := err.(storagedriver.ErrUnsupportedMethod); !ok {
+		t.Fatalf("unexpected error linking: %v", err)
+	}
+}
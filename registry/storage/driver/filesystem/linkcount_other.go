@@ -0,0 +1,16 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package filesystem
+
+import "os"
+
+// linksCounted reports whether linkCount is known on this platform. Files are
+// not hardlinked when it is not, as they would be written in place.
+const linksCounted = false
+
+// linkCount returns the number of hardlinks to a file, which is not known on
+// this platform.
+func linkCount(fi os.FileInfo) uint64 {
+	return 1
+}
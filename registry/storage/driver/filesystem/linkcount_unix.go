@@ -0,0 +1,20 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package filesystem
+
+import (
+	"os"
+	"syscall"
+)
+
+// linksCounted reports whether linkCount is known on this platform.
+const linksCounted = true
+
+// linkCount returns the number of hardlinks to a file.
+func linkCount(fi os.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Nlink)
+	}
+	return 1
+}
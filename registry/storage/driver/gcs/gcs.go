@@ -40,6 +40,7 @@ import (
 	"golang.org/x/oauth2/google"
 	"golang.org/x/oauth2/jwt"
 	"google.golang.org/api/googleapi"
+	storageapi "google.golang.org/api/storage/v1"
 	"google.golang.org/cloud"
 	"google.golang.org/cloud/storage"
 )
@@ -65,6 +66,7 @@ type driverParameters struct {
 	config        *jwt.Config
 	email         string
 	privateKey    []byte
+	kmsKeyName    string
 	client        *http.Client
 	rootDirectory string
 	chunkSize     int
@@ -95,8 +97,13 @@ type driver struct {
 	bucket        string
 	email         string
 	privateKey    []byte
+	kmsKeyName    string
 	rootDirectory string
 	chunkSize     int
+
+	// signedURLs caches the URLs signed with the IAM credentials API, when
+	// there is no private key to sign them locally
+	signedURLs signedURLCache
 }
 
 // Wrapper wraps `driver` with a throttler, ensuring that no more than N
@@ -148,18 +155,19 @@ func FromParameters(parameters map[string]interface{}) (storagedriver.StorageDri
 		}
 	}
 
-	var ts oauth2.TokenSource
-	jwtConf := new(jwt.Config)
+	// the iam scope authorizes signing the redirect URLs without a private
+	// key
+	scopes := []string{storage.ScopeFullControl, iamScope}
+	var creds *google.Credentials
 	if keyfile, ok := parameters["keyfile"]; ok {
 		jsonKey, err := ioutil.ReadFile(fmt.Sprint(keyfile))
 		if err != nil {
 			return nil, err
 		}
-		jwtConf, err = google.JWTConfigFromJSON(jsonKey, storage.ScopeFullControl)
+		creds, err = google.CredentialsFromJSON(context.Background(), jsonKey, scopes...)
 		if err != nil {
 			return nil, err
 		}
-		ts = jwtConf.TokenSource(context.Background())
 	} else if credentials, ok := parameters["credentials"]; ok {
 		credentialMap, ok := credentials.(map[interface{}]interface{})
 		if !ok {
@@ -180,19 +188,35 @@ func FromParameters(parameters map[string]interface{}) (storagedriver.StorageDri
 			return nil, fmt.Errorf("Failed to marshal gcs credentials to json")
 		}
 
-		jwtConf, err = google.JWTConfigFromJSON(data, storage.ScopeFullControl)
+		creds, err = google.CredentialsFromJSON(context.Background(), data, scopes...)
 		if err != nil {
 			return nil, err
 		}
-		ts = jwtConf.TokenSource(context.Background())
 	} else {
+		// application default credentials, which include workload identity
+		// federation configurations and the metadata server of GKE
 		var err error
-		ts, err = google.DefaultTokenSource(context.Background(), storage.ScopeFullControl)
+		creds, err = google.FindDefaultCredentials(context.Background(), scopes...)
 		if err != nil {
 			return nil, err
 		}
 	}
 
+	email, privateKey, err := signingCredentials(creds)
+	if err != nil {
+		return nil, fmt.Errorf("unable to determine the service account signing URLs: %v", err)
+	}
+	if serviceAccount, ok := parameters["serviceaccount"]; ok && fmt.Sprint(serviceAccount) != "" {
+		// signed with the IAM credentials API on behalf of the account
+		email = fmt.Sprint(serviceAccount)
+		privateKey = nil
+	}
+
+	kmsKeyName := ""
+	if k, ok := parameters["kmskeyname"]; ok {
+		kmsKeyName = fmt.Sprint(k)
+	}
+
 	maxConcurrency, err := base.GetLimitFromParameter(parameters["maxconcurrency"], minConcurrency, defaultMaxConcurrency)
 	if err != nil {
 		return nil, fmt.Errorf("maxconcurrency config error: %s", err)
@@ -201,9 +225,10 @@ func FromParameters(parameters map[string]interface{}) (storagedriver.StorageDri
 	params := driverParameters{
 		bucket:         fmt.Sprint(bucket),
 		rootDirectory:  fmt.Sprint(rootDirectory),
-		email:          jwtConf.Email,
-		privateKey:     jwtConf.PrivateKey,
-		client:         oauth2.NewClient(context.Background(), ts),
+		email:          email,
+		privateKey:     privateKey,
+		kmsKeyName:     kmsKeyName,
+		client:         oauth2.NewClient(context.Background(), creds.TokenSource),
 		chunkSize:      chunkSize,
 		maxConcurrency: maxConcurrency,
 	}
@@ -225,6 +250,7 @@ func New(params driverParameters) (storagedriver.StorageDriver, error) {
 		rootDirectory: rootDirectory,
 		email:         params.email,
 		privateKey:    params.privateKey,
+		kmsKeyName:    params.kmsKeyName,
 		client:        params.client,
 		chunkSize:     params.chunkSize,
 	}
@@ -274,9 +300,7 @@ func (d *driver) GetContent(context context.Context, path string) ([]byte, error
 // This should primarily be used for small objects.
 func (d *driver) PutContent(context context.Context, path string, contents []byte) error {
 	return retry(func() error {
-		wc := storage.NewWriter(d.context(context), d.bucket, d.pathToKey(path))
-		wc.ContentType = "application/octet-stream"
-		return putContentsClose(wc, contents)
+		return putObject(context, d.client, d.bucket, d.pathToKey(path), "application/octet-stream", nil, d.kmsKeyName, contents)
 	})
 }
 
@@ -344,10 +368,11 @@ func getObject(client *http.Client, bucket string, name string, offset int64) (*
 // at the location designated by "path" after the call to Commit.
 func (d *driver) Writer(context context.Context, path string, append bool) (storagedriver.FileWriter, error) {
 	writer := &writer{
-		client: d.client,
-		bucket: d.bucket,
-		name:   d.pathToKey(path),
-		buffer: make([]byte, d.chunkSize),
+		client:     d.client,
+		bucket:     d.bucket,
+		name:       d.pathToKey(path),
+		kmsKeyName: d.kmsKeyName,
+		buffer:     make([]byte, d.chunkSize),
 	}
 
 	if append {
@@ -363,6 +388,7 @@ type writer struct {
 	client     *http.Client
 	bucket     string
 	name       string
+	kmsKeyName string
 	size       int64
 	offset     int64
 	closed     bool
@@ -406,13 +432,11 @@ func (w *writer) Close() error {
 
 	// commit the writes by updating the upload session
 	err = retry(func() error {
-		wc := storage.NewWriter(cloud.NewContext(dummyProjectID, w.client), w.bucket, w.name)
-		wc.ContentType = uploadSessionContentType
-		wc.Metadata = map[string]string{
+		metadata := map[string]string{
 			"Session-URI": w.sessionURI,
 			"Offset":      strconv.FormatInt(w.offset, 10),
 		}
-		return putContentsClose(wc, w.buffer[0:w.buffSize])
+		return putObject(context.Background(), w.client, w.bucket, w.name, uploadSessionContentType, metadata, w.kmsKeyName, w.buffer[0:w.buffSize])
 	})
 	if err != nil {
 		return err
@@ -422,23 +446,24 @@ func (w *writer) Close() error {
 	return nil
 }
 
-func putContentsClose(wc *storage.Writer, contents []byte) error {
-	size := len(contents)
-	var nn int
-	var err error
-	for nn < size {
-		var n int
-		n, err = wc.Write(contents[nn:size])
-		nn += n
-		if err != nil {
-			break
-		}
-	}
+// putObject uploads contents to the object name in a single request,
+// encrypting it with the Cloud KMS key kmsKeyName if set.
+func putObject(ctx context.Context, client *http.Client, bucket, name, contentType string, metadata map[string]string, kmsKeyName string, contents []byte) error {
+	svc, err := storageapi.New(client)
 	if err != nil {
-		wc.CloseWithError(err)
 		return err
 	}
-	return wc.Close()
+	object := &storageapi.Object{
+		Name:        name,
+		ContentType: contentType,
+		Metadata:    metadata,
+	}
+	call := svc.Objects.Insert(bucket, object).Media(bytes.NewReader(contents), googleapi.ContentType(contentType)).Context(ctx)
+	if kmsKeyName != "" {
+		call = call.KmsKeyName(kmsKeyName)
+	}
+	_, err = call.Do()
+	return err
 }
 
 // Commit flushes all content written to this FileWriter and makes it
@@ -454,9 +479,7 @@ func (w *writer) Commit() error {
 	// no session started yet just perform a simple upload
 	if w.sessionURI == "" {
 		err := retry(func() error {
-			wc := storage.NewWriter(cloud.NewContext(dummyProjectID, w.client), w.bucket, w.name)
-			wc.ContentType = "application/octet-stream"
-			return putContentsClose(wc, w.buffer[0:w.buffSize])
+			return putObject(context.Background(), w.client, w.bucket, w.name, "application/octet-stream", nil, w.kmsKeyName, w.buffer[0:w.buffSize])
 		})
 		if err != nil {
 			return err
@@ -503,7 +526,7 @@ func (w *writer) writeChunk() error {
 	}
 	// if their is no sessionURI yet, obtain one by starting the session
 	if w.sessionURI == "" {
-		w.sessionURI, err = startSession(w.client, w.bucket, w.name)
+		w.sessionURI, err = startSession(w.client, w.bucket, w.name, w.kmsKeyName)
 	}
 	if err != nil {
 		return err
@@ -681,7 +704,7 @@ func (d *driver) List(context context.Context, path string) ([]string, error) {
 // original object.
 func (d *driver) Move(context context.Context, sourcePath string, destPath string) error {
 	gcsContext := d.context(context)
-	_, err := storageCopyObject(gcsContext, d.bucket, d.pathToKey(sourcePath), d.bucket, d.pathToKey(destPath), nil)
+	err := d.copyObject(gcsContext, d.pathToKey(sourcePath), d.pathToKey(destPath))
 	if err != nil {
 		if status, ok := err.(*googleapi.Error); ok {
 			if status.Code == http.StatusNotFound {
@@ -789,21 +812,30 @@ func storageListObjects(context context.Context, bucket string, q *storage.Query
 	return objs, err
 }
 
-func storageCopyObject(context context.Context, srcBucket, srcName string, destBucket, destName string, attrs *storage.ObjectAttrs) (*storage.Object, error) {
-	var obj *storage.Object
-	err := retry(func() error {
-		var err error
-		obj, err = storage.CopyObject(context, srcBucket, srcName, destBucket, destName, attrs)
+// copyObject copies the object srcName to destName, encrypting the copy with
+// the Cloud KMS key of the driver if set.
+func (d *driver) copyObject(context context.Context, srcName string, destName string) error {
+	svc, err := storageapi.New(d.client)
+	if err != nil {
+		return err
+	}
+	return retry(func() error {
+		call := svc.Objects.Copy(d.bucket, srcName, d.bucket, destName, nil).Context(context)
+		if d.kmsKeyName != "" {
+			call = call.DestinationKmsKeyName(d.kmsKeyName)
+		}
+		_, err := call.Do()
 		return err
 	})
-	return obj, err
 }
 
 // URLFor returns a URL which may be used to retrieve the content stored at
-// the given path, possibly using the given options.
-// Returns ErrUnsupportedMethod if this driver has no privateKey
+// the given path, possibly using the given options. Without a privateKey,
+// the URL is signed by the service account of the driver with the IAM
+// credentials API.
+// Returns ErrUnsupportedMethod if this driver has no service account
 func (d *driver) URLFor(context context.Context, path string, options map[string]interface{}) (string, error) {
-	if d.privateKey == nil {
+	if d.email == "" {
 		return "", storagedriver.ErrUnsupportedMethod{}
 	}
 
@@ -818,12 +850,36 @@ func (d *driver) URLFor(context context.Context, path string, options map[string
 	}
 
 	expiresTime := time.Now().Add(20 * time.Minute)
+	explicitExpiry := false
 	expires, ok := options["expiry"]
 	if ok {
 		et, ok := expires.(time.Time)
 		if ok {
 			expiresTime = et
+			explicitExpiry = true
+		}
+	}
+
+	if d.privateKey == nil {
+		// the URLs with the default expiry are reused while they remain
+		// valid long enough, each signature being a remote call
+		key := methodString + " " + name
+		if !explicitExpiry {
+			if u, ok := d.signedURLs.get(key); ok {
+				return u, nil
+			}
 		}
+		u, err := signedURLWithIAM(context, d.client, d.email, d.bucket, name, methodString, expiresTime)
+		if err != nil {
+			// serve the content through the registry rather than fail,
+			// the account may lack the permission to sign blobs
+			logrus.Warnf("error signing URL as %s, redirect disabled: %v", d.email, err)
+			return "", storagedriver.ErrUnsupportedMethod{}
+		}
+		if !explicitExpiry {
+			d.signedURLs.add(key, u, expiresTime)
+		}
+		return u, nil
 	}
 
 	opts := &storage.SignedURLOptions{
@@ -841,13 +897,16 @@ func (d *driver) Walk(ctx context.Context, path string, f storagedriver.WalkFn)
 	return storagedriver.WalkFallback(ctx, d, path, f)
 }
 
-func startSession(client *http.Client, bucket string, name string) (uri string, err error) {
+func startSession(client *http.Client, bucket string, name string, kmsKeyName string) (uri string, err error) {
 	u := &url.URL{
 		Scheme:   "https",
 		Host:     "www.googleapis.com",
 		Path:     fmt.Sprintf("/upload/storage/v1/b/%v/o", bucket),
 		RawQuery: fmt.Sprintf("uploadType=resumable&name=%v", name),
 	}
+	if kmsKeyName != "" {
+		u.RawQuery += "&kmsKeyName=" + url.QueryEscape(kmsKeyName)
+	}
 	err = retry(func() error {
 		req, err := http.NewRequest("POST", u.String(), nil)
 		if err != nil {
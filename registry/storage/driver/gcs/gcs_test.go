@@ -4,10 +4,16 @@
 package gcs
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"testing"
+	"time"
 
 	dcontext "github.com/distribution/distribution/v3/context"
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
@@ -310,3 +316,113 @@ func TestMoveDirectory(t *testing.T) {
 		t.Fatalf("Moving directory /parent/dir /parent/other should have return a non-nil error\n")
 	}
 }
+
+func TestSigningCredentials(t *testing.T) {
+	for _, item := range []struct {
+		json       string
+		email      string
+		privateKey string
+	}{
+		{
+			json:       `{"type": "service_account", "client_email": "registry@project.iam.gserviceaccount.com", "private_key": "key"}`,
+			email:      "registry@project.iam.gserviceaccount.com",
+			privateKey: "key",
+		},
+		{
+			json:  `{"type": "external_account", "service_account_impersonation_url": "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/registry@project.iam.gserviceaccount.com:generateAccessToken"}`,
+			email: "registry@project.iam.gserviceaccount.com",
+		},
+		{
+			// federated identities without impersonation cannot sign
+			json: `{"type": "external_account"}`,
+		},
+		{
+			json: `{"type": "authorized_user"}`,
+		},
+	} {
+		email, privateKey, err := signingCredentials(&google.Credentials{JSON: []byte(item.json)})
+		if err != nil {
+			t.Fatalf("unexpected error reading %s: %v", item.json, err)
+		}
+		if email != item.email || string(privateKey) != item.privateKey {
+			t.Errorf("unexpected signing credentials %q, %q from %s", email, privateKey, item.json)
+		}
+	}
+}
+
+func TestURLForSignedWithIAM(t *testing.T) {
+	signature := []byte("signature")
+	var payload []byte
+	signatures := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/projects/-/serviceAccounts/registry@project.iam.gserviceaccount.com:signBlob" {
+			http.NotFound(w, r)
+			return
+		}
+		signatures++
+		var req struct {
+			Payload string `json:"payload"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		payload, _ = base64.StdEncoding.DecodeString(req.Payload)
+		json.NewEncoder(w).Encode(map[string]string{
+			"keyId":      "key",
+			"signedBlob": base64.StdEncoding.EncodeToString(signature),
+		})
+	}))
+	defer server.Close()
+	defer func(u string) { iamCredentialsURL = u }(iamCredentialsURL)
+	iamCredentialsURL = server.URL + "/v1/"
+
+	d := &driver{
+		client: http.DefaultClient,
+		bucket: "bucket",
+		email:  "registry@project.iam.gserviceaccount.com",
+	}
+	expires := time.Unix(1700000000, 0)
+	u, err := d.URLFor(dcontext.Background(), "/blob", map[string]interface{}{"expiry": expires})
+	if err != nil {
+		t.Fatalf("unexpected error signing URL: %v", err)
+	}
+
+	if expected := "GET\n\n\n1700000000\n/bucket/blob"; string(payload) != expected {
+		t.Errorf("unexpected payload signed %q, expected %q", payload, expected)
+	}
+	parsed, err := url.Parse(u)
+	if err != nil {
+		t.Fatalf("unexpected error parsing URL %s: %v", u, err)
+	}
+	q := parsed.Query()
+	if parsed.Path != "/bucket/blob" || q.Get("GoogleAccessId") != d.email || q.Get("Expires") != "1700000000" || q.Get("Signature") != base64.StdEncoding.EncodeToString(signature) {
+		t.Errorf("unexpected signed URL %s", u)
+	}
+
+	// the URLs with the default expiry are only signed once
+	signatures = 0
+	first, err := d.URLFor(dcontext.Background(), "/blob", nil)
+	if err != nil {
+		t.Fatalf("unexpected error signing URL: %v", err)
+	}
+	second, err := d.URLFor(dcontext.Background(), "/blob", nil)
+	if err != nil {
+		t.Fatalf("unexpected error signing URL: %v", err)
+	}
+	if first != second || signatures != 1 {
+		t.Errorf("expected the signed URL to be reused, got %d signatures", signatures)
+	}
+	if _, err := d.URLFor(dcontext.Background(), "/blob", map[string]interface{}{"method": "HEAD"}); err != nil {
+		t.Fatalf("unexpected error signing URL: %v", err)
+	}
+	if signatures != 2 {
+		t.Errorf("expected the URL of another method to be signed, got %d signatures", signatures)
+	}
+
+	// redirects are disabled rather than failing when signing fails
+	d.email = "unknown@project.iam.gserviceaccount.com"
+	if _, err := d.URLFor(dcontext.Background(), "/other", nil); err != (storagedriver.ErrUnsupportedMethod{}) {
+		t.Errorf("unexpected error signing URL as an unknown account: %v", err)
+	}
+}
@@ -0,0 +1,185 @@
+//go:build include_gcs
+// +build include_gcs
+
+package gcs
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	"github.com/hashicorp/golang-lru/simplelru"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
+)
+
+// iamScope authorizes signing blobs with the IAM credentials API.
+const iamScope = "https://www.googleapis.com/auth/iam"
+
+// iamCredentialsURL is the endpoint of the IAM credentials API, overridden
+// in tests.
+var iamCredentialsURL = "https://iamcredentials.googleapis.com/v1/"
+
+const (
+	// signedURLCacheSize is the number of URLs signed with the IAM
+	// credentials API kept for reuse.
+	signedURLCacheSize = 10000
+
+	// signedURLMinLifetime is the lifetime a cached signed URL must have
+	// left to be handed out again.
+	signedURLMinLifetime = 10 * time.Minute
+)
+
+// signingCredentials returns the email of the service account the
+// credentials authenticate as, and its private key if they include it. The
+// email of workload identity federation credentials is the one of the
+// service account they impersonate, and the email of credentials from the
+// metadata server is the one of the default service account of the
+// instance.
+func signingCredentials(creds *google.Credentials) (string, []byte, error) {
+	if len(creds.JSON) == 0 {
+		if !metadata.OnGCE() {
+			return "", nil, nil
+		}
+		email, err := metadata.Email("")
+		return email, nil, err
+	}
+
+	var f struct {
+		Type                           string `json:"type"`
+		ClientEmail                    string `json:"client_email"`
+		PrivateKey                     string `json:"private_key"`
+		ServiceAccountImpersonationURL string `json:"service_account_impersonation_url"`
+	}
+	if err := json.Unmarshal(creds.JSON, &f); err != nil {
+		return "", nil, err
+	}
+
+	switch f.Type {
+	case "service_account":
+		return f.ClientEmail, []byte(f.PrivateKey), nil
+	case "external_account", "impersonated_service_account":
+		// the URL ends with serviceAccounts/<email>:generateAccessToken
+		if f.ServiceAccountImpersonationURL == "" {
+			return "", nil, nil
+		}
+		u, err := url.Parse(f.ServiceAccountImpersonationURL)
+		if err != nil {
+			return "", nil, err
+		}
+		account := u.Path[strings.LastIndex(u.Path, "/")+1:]
+		return strings.TrimSuffix(account, ":generateAccessToken"), nil, nil
+	}
+	return "", nil, nil
+}
+
+// signBlob signs payload with the key of the service account email, using
+// the signBlob method of the IAM credentials API.
+func signBlob(ctx context.Context, client *http.Client, email string, payload []byte) ([]byte, error) {
+	body, err := json.Marshal(map[string]string{
+		"payload": base64.StdEncoding.EncodeToString(payload),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	u := iamCredentialsURL + "projects/-/serviceAccounts/" + url.PathEscape(email) + ":signBlob"
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return nil, err
+	}
+
+	var signed struct {
+		SignedBlob string `json:"signedBlob"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&signed); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(signed.SignedBlob)
+}
+
+// signedURLWithIAM returns a V2 signed URL of the object name, like
+// storage.SignedURL, signed by the service account email with the IAM
+// credentials API rather than with its private key.
+func signedURLWithIAM(ctx context.Context, client *http.Client, email, bucket, name, method string, expires time.Time) (string, error) {
+	payload := fmt.Sprintf("%s\n\n\n%d\n/%s/%s", method, expires.Unix(), bucket, name)
+	signature, err := signBlob(ctx, client, email, []byte(payload))
+	if err != nil {
+		return "", err
+	}
+
+	u := &url.URL{
+		Scheme: "https",
+		Host:   "storage.googleapis.com",
+		Path:   fmt.Sprintf("/%s/%s", bucket, name),
+	}
+	q := u.Query()
+	q.Set("GoogleAccessId", email)
+	q.Set("Expires", fmt.Sprintf("%d", expires.Unix()))
+	q.Set("Signature", base64.StdEncoding.EncodeToString(signature))
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+type cachedURL struct {
+	url     string
+	expires time.Time
+}
+
+// signedURLCache keeps the URLs signed with the IAM credentials API, so
+// that redirecting to a blob does not wait for a remote signature every
+// time. The zero value is ready to use.
+type signedURLCache struct {
+	mu  sync.Mutex
+	lru *simplelru.LRU
+}
+
+// get returns the URL cached for key, if it is still valid for at least
+// signedURLMinLifetime.
+func (c *signedURLCache) get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.lru == nil {
+		return "", false
+	}
+	v, ok := c.lru.Get(key)
+	if !ok {
+		return "", false
+	}
+	cached := v.(cachedURL)
+	if time.Until(cached.expires) < signedURLMinLifetime {
+		c.lru.Remove(key)
+		return "", false
+	}
+	return cached.url, true
+}
+
+func (c *signedURLCache) add(key, u string, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.lru == nil {
+		// only fails for a non positive size
+		c.lru, _ = simplelru.NewLRU(signedURLCacheSize, nil)
+	}
+	c.lru.Add(key, cachedURL{url: u, expires: expires})
+}
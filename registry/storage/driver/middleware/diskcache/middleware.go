@@ -0,0 +1,578 @@
+// Package middleware - disk cache wrapper for storage drivers, keeping the
+// hot blobs on a local disk in front of a remote backend such as S3, GCS or
+// Azure, to cut the egress and the latency of the frequently pulled blobs.
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	prometheus "github.com/distribution/distribution/v3/metrics"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	storagemiddleware "github.com/distribution/distribution/v3/registry/storage/driver/middleware"
+	"github.com/hashicorp/golang-lru/simplelru"
+	"github.com/opencontainers/go-digest"
+)
+
+// cacheCounter counts the hits, misses and evictions of the disk caches.
+var cacheCounter = prometheus.StorageNamespace.NewLabeledCounter("disk_cache", "The number of hits, misses and evictions of the disk cache storage middleware", "type")
+
+var (
+	// blobDataPathRegexp matches the paths of the content of the blobs,
+	// capturing the algorithm and the hex of their digest.
+	blobDataPathRegexp = regexp.MustCompile(`/blobs/([a-z0-9]+)/[0-9a-f]{2}/([0-9a-f]+)/data$`)
+	// uploadDataPathRegexp matches the paths of the content of the uploads.
+	uploadDataPathRegexp = regexp.MustCompile(`/_uploads/[^/]+/data$`)
+)
+
+// Directories of the cache, below its root.
+const (
+	blobsDir   = "blobs"
+	uploadsDir = "uploads"
+	tmpDir     = "tmp"
+)
+
+// diskCacheStorageMiddleware keeps the content of the blobs read from or
+// written to the backend on a local disk, evicting the least recently used
+// ones beyond maxSize. Since blobs are content addressed, the cached content
+// never goes stale: it is verified against the digest of the blob before
+// being cached, and evicted when the blob is deleted. Only the content is
+// cached, all the other operations, including Stat, still reach the backend,
+// so that the blobs deleted by other instances are not served.
+//
+// Uploads are written through: their content is staged on the local disk as
+// it is written to the backend, and cached once the upload is moved to its
+// blob.
+type diskCacheStorageMiddleware struct {
+	storagedriver.StorageDriver
+
+	root          string
+	maxSize       int64
+	maxObjectSize int64
+
+	// mu protects lru and size
+	mu   sync.Mutex
+	lru  *simplelru.LRU
+	size int64
+}
+
+var _ storagedriver.StorageDriver = &diskCacheStorageMiddleware{}
+
+// newDiskCacheStorageMiddleware constructs a disk cache storage middleware.
+// Required options: root, maxsize
+// Optional options: maxobjectsize
+func newDiskCacheStorageMiddleware(sd storagedriver.StorageDriver, options map[string]interface{}) (storagedriver.StorageDriver, error) {
+	root, ok := options["root"].(string)
+	if !ok || root == "" {
+		return nil, fmt.Errorf("root must be the path of the cache directory")
+	}
+	maxSize, err := sizeOption(options, "maxsize", 0)
+	if err != nil {
+		return nil, err
+	}
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("maxsize must be a positive number of bytes")
+	}
+	maxObjectSize, err := sizeOption(options, "maxobjectsize", maxSize)
+	if err != nil {
+		return nil, err
+	}
+	if maxObjectSize <= 0 || maxObjectSize > maxSize {
+		maxObjectSize = maxSize
+	}
+
+	m := &diskCacheStorageMiddleware{
+		StorageDriver: sd,
+		root:          root,
+		maxSize:       maxSize,
+		maxObjectSize: maxObjectSize,
+	}
+	lru, err := simplelru.NewLRU(math.MaxInt, m.evicted)
+	if err != nil {
+		return nil, err
+	}
+	m.lru = lru
+	if err := m.load(); err != nil {
+		return nil, fmt.Errorf("unable to load the disk cache: %v", err)
+	}
+	return m, nil
+}
+
+func sizeOption(options map[string]interface{}, name string, defaultValue int64) (int64, error) {
+	v, ok := options[name]
+	if !ok {
+		return defaultValue, nil
+	}
+	switch v := v.(type) {
+	case int:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case float64:
+		return int64(v), nil
+	}
+	return 0, fmt.Errorf("%s must be a number of bytes", name)
+}
+
+// load indexes the blobs cached by a previous run, by order of their last
+// use, and discards the temporary and staged files left behind.
+func (m *diskCacheStorageMiddleware) load() error {
+	for _, dir := range []string{tmpDir, uploadsDir} {
+		if err := os.RemoveAll(filepath.Join(m.root, dir)); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Join(m.root, dir), 0755); err != nil {
+			return err
+		}
+	}
+
+	type cached struct {
+		path    string
+		size    int64
+		lastUse time.Time
+	}
+	var entries []cached
+	blobs := filepath.Join(m.root, blobsDir)
+	err := filepath.Walk(blobs, func(local string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && local == blobs {
+			return filepath.SkipDir
+		}
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(blobs, local)
+		if err != nil {
+			return err
+		}
+		p := "/" + filepath.ToSlash(rel)
+		if !blobDataPathRegexp.MatchString(p) {
+			return os.Remove(local)
+		}
+		entries = append(entries, cached{path: p, size: info.Size(), lastUse: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].lastUse.Before(entries[j].lastUse)
+	})
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, e := range entries {
+		m.lru.Add(e.path, e.size)
+		m.size += e.size
+	}
+	m.evict()
+	return nil
+}
+
+// localPath returns the path of the cached content of the blob at p.
+func (m *diskCacheStorageMiddleware) localPath(p string) string {
+	return filepath.Join(m.root, blobsDir, filepath.FromSlash(p))
+}
+
+// stagingPath returns the path of the content staged for the upload at p.
+func (m *diskCacheStorageMiddleware) stagingPath(p string) string {
+	sum := sha256.Sum256([]byte(p))
+	return filepath.Join(m.root, uploadsDir, hex.EncodeToString(sum[:]))
+}
+
+// blobDigest returns the digest of the blob at p, if it is the path of the
+// content of a blob.
+func blobDigest(p string) (digest.Digest, bool) {
+	match := blobDataPathRegexp.FindStringSubmatch(p)
+	if match == nil {
+		return "", false
+	}
+	dgst := digest.NewDigestFromEncoded(digest.Algorithm(match[1]), match[2])
+	return dgst, dgst.Validate() == nil
+}
+
+// evicted removes the content of an entry evicted from the index. It is
+// called with mu held.
+func (m *diskCacheStorageMiddleware) evicted(key, value interface{}) {
+	m.size -= value.(int64)
+	if err := os.Remove(m.localPath(key.(string))); err != nil && !os.IsNotExist(err) {
+		dcontext.GetLogger(context.Background()).Warnf("diskcache: error removing %s: %v", key, err)
+	}
+}
+
+// evict removes the least recently used entries beyond maxSize. It is
+// called with mu held.
+func (m *diskCacheStorageMiddleware) evict() {
+	evictions := 0
+	for m.size > m.maxSize && m.lru.Len() > 0 {
+		m.lru.RemoveOldest()
+		evictions++
+	}
+	if evictions > 0 {
+		cacheCounter.WithValues("eviction").Inc(float64(evictions))
+	}
+}
+
+// open returns the cached content of the blob at p, or nil on a miss.
+func (m *diskCacheStorageMiddleware) open(ctx context.Context, p string) *os.File {
+	m.mu.Lock()
+	_, ok := m.lru.Get(p)
+	m.mu.Unlock()
+	if !ok {
+		cacheCounter.WithValues("miss").Inc(1)
+		return nil
+	}
+
+	local := m.localPath(p)
+	f, err := os.Open(local)
+	if err != nil {
+		dcontext.GetLogger(ctx).Warnf("diskcache: error opening %s: %v", p, err)
+		m.remove(p)
+		cacheCounter.WithValues("miss").Inc(1)
+		return nil
+	}
+	// the modification time keeps the order of the entries across restarts
+	now := time.Now()
+	if err := os.Chtimes(local, now, now); err != nil {
+		dcontext.GetLogger(ctx).Debugf("diskcache: error touching %s: %v", p, err)
+	}
+	cacheCounter.WithValues("hit").Inc(1)
+	return f
+}
+
+// remove evicts the blob at p from the cache.
+func (m *diskCacheStorageMiddleware) remove(p string) {
+	m.mu.Lock()
+	m.lru.Remove(p)
+	m.mu.Unlock()
+}
+
+// admit caches the content of the blob at p held by the temporary file tmp,
+// which is removed if the blob is already cached.
+func (m *diskCacheStorageMiddleware) admit(ctx context.Context, p string, tmp string, size int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.lru.Contains(p) {
+		os.Remove(tmp)
+		return
+	}
+	local := m.localPath(p)
+	if err := os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+		dcontext.GetLogger(ctx).Warnf("diskcache: error caching %s: %v", p, err)
+		os.Remove(tmp)
+		return
+	}
+	if err := os.Rename(tmp, local); err != nil {
+		dcontext.GetLogger(ctx).Warnf("diskcache: error caching %s: %v", p, err)
+		os.Remove(tmp)
+		return
+	}
+	m.lru.Add(p, size)
+	m.size += size
+	m.evict()
+}
+
+// admitContent caches the content of the blob at p, if it matches its
+// digest.
+func (m *diskCacheStorageMiddleware) admitContent(ctx context.Context, p string, dgst digest.Digest, content []byte) {
+	if int64(len(content)) > m.maxObjectSize || dgst.Algorithm().FromBytes(content) != dgst {
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Join(m.root, tmpDir), "blob")
+	if err != nil {
+		dcontext.GetLogger(ctx).Warnf("diskcache: error caching %s: %v", p, err)
+		return
+	}
+	_, err = tmp.Write(content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		dcontext.GetLogger(ctx).Warnf("diskcache: error caching %s: %v", p, err)
+		os.Remove(tmp.Name())
+		return
+	}
+	m.admit(ctx, p, tmp.Name(), int64(len(content)))
+}
+
+// admitStaged caches the content staged for the upload at uploadPath as the
+// content of the blob at p, if it matches its digest.
+func (m *diskCacheStorageMiddleware) admitStaged(ctx context.Context, uploadPath string, p string) {
+	staging := m.stagingPath(uploadPath)
+	dgst, ok := blobDigest(p)
+	if !ok {
+		os.Remove(staging)
+		return
+	}
+	f, err := os.Open(staging)
+	if err != nil {
+		return
+	}
+	verifier := dgst.Verifier()
+	size, err := io.Copy(verifier, f)
+	f.Close()
+	if err != nil || !verifier.Verified() {
+		os.Remove(staging)
+		return
+	}
+	m.admit(ctx, p, staging, size)
+}
+
+// GetContent returns the cached content of the blobs, caching it on a miss.
+func (m *diskCacheStorageMiddleware) GetContent(ctx context.Context, p string) ([]byte, error) {
+	dgst, ok := blobDigest(p)
+	if !ok {
+		return m.StorageDriver.GetContent(ctx, p)
+	}
+	if f := m.open(ctx, p); f != nil {
+		content, err := io.ReadAll(f)
+		f.Close()
+		if err == nil {
+			return content, nil
+		}
+		dcontext.GetLogger(ctx).Warnf("diskcache: error reading %s: %v", p, err)
+		m.remove(p)
+	}
+
+	content, err := m.StorageDriver.GetContent(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	m.admitContent(ctx, p, dgst, content)
+	return content, nil
+}
+
+// PutContent writes the content of the blobs through the cache.
+func (m *diskCacheStorageMiddleware) PutContent(ctx context.Context, p string, content []byte) error {
+	if err := m.StorageDriver.PutContent(ctx, p, content); err != nil {
+		return err
+	}
+	if dgst, ok := blobDigest(p); ok {
+		m.admitContent(ctx, p, dgst, content)
+	}
+	return nil
+}
+
+// Reader returns a reader of the cached content of the blobs. On a miss,
+// the content read from the start is cached once it was read entirely.
+func (m *diskCacheStorageMiddleware) Reader(ctx context.Context, p string, offset int64) (io.ReadCloser, error) {
+	dgst, ok := blobDigest(p)
+	if !ok {
+		return m.StorageDriver.Reader(ctx, p, offset)
+	}
+	if offset < 0 {
+		return nil, storagedriver.InvalidOffsetError{Path: p, Offset: offset, DriverName: m.Name()}
+	}
+	if f := m.open(ctx, p); f != nil {
+		if _, err := f.Seek(offset, io.SeekStart); err == nil {
+			return f, nil
+		}
+		f.Close()
+	}
+
+	rc, err := m.StorageDriver.Reader(ctx, p, offset)
+	if err != nil || offset != 0 {
+		return rc, err
+	}
+	tmp, err := os.CreateTemp(filepath.Join(m.root, tmpDir), "blob")
+	if err != nil {
+		dcontext.GetLogger(ctx).Warnf("diskcache: error caching %s: %v", p, err)
+		return rc, nil
+	}
+	return &fillReader{
+		ReadCloser: rc,
+		ctx:        ctx,
+		m:          m,
+		path:       p,
+		tmp:        tmp,
+		verifier:   dgst.Verifier(),
+	}, nil
+}
+
+// Writer stages the content of the uploads on the local disk as it is
+// written to the backend, so that it is cached once moved to its blob. The
+// content staged for an upload is discarded if it is resumed by a writer
+// not going through the cache, such as one of another instance.
+func (m *diskCacheStorageMiddleware) Writer(ctx context.Context, p string, append bool) (storagedriver.FileWriter, error) {
+	fw, err := m.StorageDriver.Writer(ctx, p, append)
+	if err != nil || !uploadDataPathRegexp.MatchString(p) {
+		return fw, err
+	}
+
+	staging := m.stagingPath(p)
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if append {
+		flags = os.O_WRONLY | os.O_APPEND
+	}
+	f, err := os.OpenFile(staging, flags, 0644)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			dcontext.GetLogger(ctx).Warnf("diskcache: error staging %s: %v", p, err)
+		}
+		os.Remove(staging)
+		return fw, nil
+	}
+	if info, err := f.Stat(); err != nil || info.Size() != fw.Size() {
+		f.Close()
+		os.Remove(staging)
+		return fw, nil
+	}
+	return &stagingWriter{
+		FileWriter: fw,
+		ctx:        ctx,
+		m:          m,
+		staging:    f,
+	}, nil
+}
+
+// Move caches the content staged for an upload moved to its blob.
+func (m *diskCacheStorageMiddleware) Move(ctx context.Context, sourcePath string, destPath string) error {
+	if err := m.StorageDriver.Move(ctx, sourcePath, destPath); err != nil {
+		return err
+	}
+	if uploadDataPathRegexp.MatchString(sourcePath) {
+		m.admitStaged(ctx, sourcePath, destPath)
+	}
+	if _, ok := blobDigest(sourcePath); ok {
+		m.remove(sourcePath)
+	}
+	return nil
+}
+
+// Delete evicts the deleted blobs and discards the content staged for the
+// deleted uploads.
+func (m *diskCacheStorageMiddleware) Delete(ctx context.Context, p string) error {
+	err := m.StorageDriver.Delete(ctx, p)
+
+	prefix := strings.TrimSuffix(p, "/") + "/"
+	m.mu.Lock()
+	for _, key := range m.lru.Keys() {
+		if key == p || strings.HasPrefix(key.(string), prefix) {
+			m.lru.Remove(key)
+		}
+	}
+	m.mu.Unlock()
+	for _, upload := range []string{p, path.Join(p, "data")} {
+		if uploadDataPathRegexp.MatchString(upload) {
+			os.Remove(m.stagingPath(upload))
+		}
+	}
+
+	return err
+}
+
+// fillReader caches the content of a blob read entirely, if it matches its
+// digest.
+type fillReader struct {
+	io.ReadCloser
+
+	ctx      context.Context
+	m        *diskCacheStorageMiddleware
+	path     string
+	tmp      *os.File
+	size     int64
+	verifier digest.Verifier
+}
+
+func (fr *fillReader) Read(p []byte) (int, error) {
+	n, err := fr.ReadCloser.Read(p)
+	if fr.tmp != nil && n > 0 {
+		fr.size += int64(n)
+		if fr.size > fr.m.maxObjectSize {
+			fr.discard()
+		} else if _, werr := fr.tmp.Write(p[:n]); werr != nil {
+			dcontext.GetLogger(fr.ctx).Warnf("diskcache: error caching %s: %v", fr.path, werr)
+			fr.discard()
+		} else {
+			fr.verifier.Write(p[:n])
+		}
+	}
+	if fr.tmp != nil && err == io.EOF {
+		tmp := fr.tmp.Name()
+		closeErr := fr.tmp.Close()
+		fr.tmp = nil
+		if closeErr != nil || !fr.verifier.Verified() {
+			os.Remove(tmp)
+		} else {
+			fr.m.admit(fr.ctx, fr.path, tmp, fr.size)
+		}
+	}
+	return n, err
+}
+
+// discard stops caching the content, which was not read entirely.
+func (fr *fillReader) discard() {
+	fr.tmp.Close()
+	os.Remove(fr.tmp.Name())
+	fr.tmp = nil
+}
+
+func (fr *fillReader) Close() error {
+	if fr.tmp != nil {
+		fr.discard()
+	}
+	return fr.ReadCloser.Close()
+}
+
+// stagingWriter stages the content written to an upload on the local disk.
+type stagingWriter struct {
+	storagedriver.FileWriter
+
+	ctx     context.Context
+	m       *diskCacheStorageMiddleware
+	staging *os.File
+}
+
+func (sw *stagingWriter) Write(p []byte) (int, error) {
+	n, err := sw.FileWriter.Write(p)
+	if sw.staging != nil && n > 0 {
+		if sw.FileWriter.Size() > sw.m.maxObjectSize {
+			sw.discard()
+		} else if _, werr := sw.staging.Write(p[:n]); werr != nil {
+			dcontext.GetLogger(sw.ctx).Warnf("diskcache: error staging upload: %v", werr)
+			sw.discard()
+		}
+	}
+	return n, err
+}
+
+// discard stops staging the content, which is removed.
+func (sw *stagingWriter) discard() {
+	sw.staging.Close()
+	os.Remove(sw.staging.Name())
+	sw.staging = nil
+}
+
+func (sw *stagingWriter) Close() error {
+	if sw.staging != nil {
+		if err := sw.staging.Close(); err != nil {
+			os.Remove(sw.staging.Name())
+		}
+		sw.staging = nil
+	}
+	return sw.FileWriter.Close()
+}
+
+func (sw *stagingWriter) Cancel() error {
+	if sw.staging != nil {
+		sw.discard()
+	}
+	return sw.FileWriter.Cancel()
+}
+
+func init() {
+	storagemiddleware.Register("diskcache", storagemiddleware.InitFunc(newDiskCacheStorageMiddleware))
+}
@@ -0,0 +1,265 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/distribution/v3/registry/storage/driver/testsuites"
+	"github.com/opencontainers/go-digest"
+	"gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { check.TestingT(t) }
+
+func init() {
+	testsuites.RegisterSuite(func() (storagedriver.StorageDriver, error) {
+		root, err := os.MkdirTemp("", "diskcache")
+		if err != nil {
+			return nil, err
+		}
+		return newDiskCacheStorageMiddleware(inmemory.New(), map[string]interface{}{"root": root, "maxsize": 1 << 20})
+	}, testsuites.NeverSkip)
+}
+
+// countingDriver counts the reads of the content of the files.
+type countingDriver struct {
+	storagedriver.StorageDriver
+
+	mu    sync.Mutex
+	reads int
+}
+
+func (d *countingDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	d.mu.Lock()
+	d.reads++
+	d.mu.Unlock()
+	return d.StorageDriver.GetContent(ctx, path)
+}
+
+func (d *countingDriver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	d.mu.Lock()
+	d.reads++
+	d.mu.Unlock()
+	return d.StorageDriver.Reader(ctx, path, offset)
+}
+
+func (d *countingDriver) count() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.reads
+}
+
+func newTestMiddleware(t *testing.T, backend storagedriver.StorageDriver, root string, maxSize int) *diskCacheStorageMiddleware {
+	sd, err := newDiskCacheStorageMiddleware(backend, map[string]interface{}{"root": root, "maxsize": maxSize})
+	if err != nil {
+		t.Fatalf("unexpected error creating middleware: %v", err)
+	}
+	return sd.(*diskCacheStorageMiddleware)
+}
+
+func blobPath(content []byte) string {
+	dgst := digest.FromBytes(content)
+	return "/docker/registry/v2/blobs/sha256/" + dgst.Encoded()[:2] + "/" + dgst.Encoded() + "/data"
+}
+
+func readAll(t *testing.T, sd storagedriver.StorageDriver, path string, offset int64) []byte {
+	rc, err := sd.Reader(context.Background(), path, offset)
+	if err != nil {
+		t.Fatalf("unexpected error opening %s: %v", path, err)
+	}
+	defer rc.Close()
+	content, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("unexpected error reading %s: %v", path, err)
+	}
+	return content
+}
+
+func TestInvalidOptions(t *testing.T) {
+	for _, options := range []map[string]interface{}{
+		{},
+		{"root": t.TempDir()},
+		{"root": t.TempDir(), "maxsize": "large"},
+		{"root": t.TempDir(), "maxsize": 0},
+		{"maxsize": 1024},
+	} {
+		if _, err := newDiskCacheStorageMiddleware(inmemory.New(), options); err == nil {
+			t.Errorf("expected an error with options %v", options)
+		}
+	}
+}
+
+func TestReadThrough(t *testing.T) {
+	ctx := context.Background()
+	backend := &countingDriver{StorageDriver: inmemory.New()}
+	root := t.TempDir()
+	sd := newTestMiddleware(t, backend, root, 1<<20)
+
+	content := bytes.Repeat([]byte("layer"), 1000)
+	path := blobPath(content)
+	if err := backend.PutContent(ctx, path, content); err != nil {
+		t.Fatal(err)
+	}
+
+	// partial reads are not cached
+	if got := readAll(t, sd, path, 5); !bytes.Equal(got, content[5:]) {
+		t.Fatalf("unexpected content read from offset")
+	}
+	if got := readAll(t, sd, path, 0); !bytes.Equal(got, content) {
+		t.Fatalf("unexpected content read")
+	}
+	if reads := backend.count(); reads != 2 {
+		t.Fatalf("expected 2 reads of the backend, got %d", reads)
+	}
+
+	// the content is now served from the disk
+	if got := readAll(t, sd, path, 0); !bytes.Equal(got, content) {
+		t.Fatalf("unexpected cached content read")
+	}
+	if got := readAll(t, sd, path, 5); !bytes.Equal(got, content[5:]) {
+		t.Fatalf("unexpected cached content read from offset")
+	}
+	if got, err := sd.GetContent(ctx, path); err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("unexpected cached content %v", err)
+	}
+	if reads := backend.count(); reads != 2 {
+		t.Fatalf("expected no more reads of the backend, got %d", reads)
+	}
+
+	// a cached blob is evicted once deleted
+	if err := sd.Delete(ctx, filepath.Dir(path)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(sd.localPath(path)); !os.IsNotExist(err) {
+		t.Fatalf("expected the deleted blob to be evicted, got %v", err)
+	}
+	if _, err := sd.Reader(ctx, path, 0); err == nil {
+		t.Fatalf("expected an error reading a deleted blob")
+	}
+}
+
+func TestCorruptedBlobNotCached(t *testing.T) {
+	ctx := context.Background()
+	backend := &countingDriver{StorageDriver: inmemory.New()}
+	sd := newTestMiddleware(t, backend, t.TempDir(), 1<<20)
+
+	path := blobPath([]byte("expected"))
+	if err := backend.PutContent(ctx, path, []byte("corrupted")); err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, sd, path, 0)
+	if _, err := sd.GetContent(ctx, path); err != nil {
+		t.Fatal(err)
+	}
+	readAll(t, sd, path, 0)
+	if reads := backend.count(); reads != 3 {
+		t.Fatalf("expected the corrupted blob to be read from the backend, got %d reads", reads)
+	}
+}
+
+func TestWriteThrough(t *testing.T) {
+	ctx := context.Background()
+	backend := &countingDriver{StorageDriver: inmemory.New()}
+	sd := newTestMiddleware(t, backend, t.TempDir(), 1<<20)
+
+	content := bytes.Repeat([]byte("upload"), 1000)
+	uploadPath := "/docker/registry/v2/repositories/foo/_uploads/1234/data"
+
+	// the upload is resumed halfway
+	for i, chunk := range [][]byte{content[:3000], content[3000:]} {
+		fw, err := sd.Writer(ctx, uploadPath, i > 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fw.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 {
+			if err := fw.Commit(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := fw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := blobPath(content)
+	if err := sd.Move(ctx, uploadPath, path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(sd.stagingPath(uploadPath)); !os.IsNotExist(err) {
+		t.Fatalf("expected the staged upload to be cached, got %v", err)
+	}
+	if got := readAll(t, sd, path, 0); !bytes.Equal(got, content) {
+		t.Fatalf("unexpected cached content read")
+	}
+	if reads := backend.count(); reads != 0 {
+		t.Fatalf("expected the uploaded blob to be cached, got %d reads of the backend", reads)
+	}
+
+	// an upload cancelled is not staged anymore
+	fw, err := sd.Writer(ctx, uploadPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+	fw.Close()
+	if _, err := os.Stat(sd.stagingPath(uploadPath)); !os.IsNotExist(err) {
+		t.Fatalf("expected the cancelled upload not to be staged, got %v", err)
+	}
+}
+
+func TestEviction(t *testing.T) {
+	ctx := context.Background()
+	backend := &countingDriver{StorageDriver: inmemory.New()}
+	root := t.TempDir()
+	sd := newTestMiddleware(t, backend, root, 2500)
+
+	var paths []string
+	for _, c := range []byte("abc") {
+		content := bytes.Repeat([]byte{c}, 1000)
+		path := blobPath(content)
+		if err := sd.PutContent(ctx, path, content); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+		if c == 'b' {
+			// the first blob is used again, so that the second one is the
+			// least recently used
+			readAll(t, sd, paths[0], 0)
+		}
+	}
+
+	for i, cached := range []bool{true, false, true} {
+		if _, err := os.Stat(sd.localPath(paths[i])); os.IsNotExist(err) == cached {
+			t.Errorf("unexpected cache state of blob %d: %v", i, err)
+		}
+	}
+	if sd.size != 2000 {
+		t.Fatalf("unexpected size of the cache %d", sd.size)
+	}
+
+	// the cached blobs are indexed again on start
+	sd = newTestMiddleware(t, backend, root, 2500)
+	if sd.size != 2000 || sd.lru.Len() != 2 {
+		t.Fatalf("unexpected cache reloaded, size %d with %d blobs", sd.size, sd.lru.Len())
+	}
+	readAll(t, sd, paths[2], 0)
+	if reads := backend.count(); reads != 0 {
+		t.Fatalf("expected the reloaded blobs to be cached, got %d reads of the backend", reads)
+	}
+}
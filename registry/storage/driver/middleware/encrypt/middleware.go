@@ -0,0 +1,496 @@
+// Package middleware - encryption wrapper for storage drivers, encrypting
+// the content of the files before it reaches the backend, for backends
+// without native encryption such as filesystems or NFS shares.
+package middleware
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	storagemiddleware "github.com/distribution/distribution/v3/registry/storage/driver/middleware"
+)
+
+// keySize is the size of the master key, an AES-256 key.
+const keySize = 32
+
+// ErrWrongKey is returned, enclosed in a storagedriver.Error, when reading a
+// file encrypted with another key.
+var ErrWrongKey = errors.New("file encrypted with another key")
+
+// ErrCorrupted is returned, enclosed in a storagedriver.Error, when reading
+// a file which is not encrypted, truncated or was tampered with.
+var ErrCorrupted = errors.New("encrypted file corrupted")
+
+// encryptStorageMiddleware encrypts the content of the files with AES-GCM.
+// Each file is encrypted with its own key, derived from the master key and
+// a random salt stored in the header of the file, in chunks of chunkSize,
+// so that files can be read from any offset and appended to. Since the
+// chunks of a file are append only, the last partial chunk of a file closed
+// without being committed, such as an upload between two requests, is
+// stored in a partial file next to it until the file is resumed.
+type encryptStorageMiddleware struct {
+	storagedriver.StorageDriver
+
+	key   []byte
+	keyID []byte
+}
+
+var _ storagedriver.StorageDriver = &encryptStorageMiddleware{}
+
+// newEncryptStorageMiddleware constructs an encryption storage middleware.
+// Required options: one of key, keyfile or kms
+func newEncryptStorageMiddleware(sd storagedriver.StorageDriver, options map[string]interface{}) (storagedriver.StorageDriver, error) {
+	key, err := loadKey(options)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != keySize {
+		return nil, fmt.Errorf("encryption key must be %d bytes, got %d", keySize, len(key))
+	}
+
+	// the id of the key identifies it in the files, so that reading files
+	// encrypted with another key fails explicitly
+	sum := sha256.Sum256(key)
+	return &encryptStorageMiddleware{
+		StorageDriver: sd,
+		key:           key,
+		keyID:         sum[:keyIDSize],
+	}, nil
+}
+
+// loadKey returns the master key, set either in the options, in a file, or
+// as a data key encrypted with AWS KMS.
+func loadKey(options map[string]interface{}) ([]byte, error) {
+	var sources []string
+	for _, name := range []string{"key", "keyfile", "kms"} {
+		if _, ok := options[name]; ok {
+			sources = append(sources, name)
+		}
+	}
+	if len(sources) != 1 {
+		return nil, fmt.Errorf("exactly one of key, keyfile or kms must be set")
+	}
+
+	switch sources[0] {
+	case "key":
+		key, ok := options["key"].(string)
+		if !ok {
+			return nil, fmt.Errorf("key must be a base64 encoded string")
+		}
+		return decodeKey(key)
+	case "keyfile":
+		file, ok := options["keyfile"].(string)
+		if !ok {
+			return nil, fmt.Errorf("keyfile must be a path")
+		}
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read keyfile: %v", err)
+		}
+		return decodeKey(string(content))
+	default:
+		return decryptKMSKey(options["kms"])
+	}
+}
+
+func decodeKey(key string) ([]byte, error) {
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(key))
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 encoded key: %v", err)
+	}
+	return decoded, nil
+}
+
+// decryptKMSKey decrypts the data key of the kms options with AWS KMS, using
+// the default credentials of the registry.
+func decryptKMSKey(option interface{}) ([]byte, error) {
+	options := make(map[string]string)
+	switch o := option.(type) {
+	case map[string]interface{}:
+		for k, v := range o {
+			options[k] = fmt.Sprint(v)
+		}
+	case map[interface{}]interface{}:
+		for k, v := range o {
+			options[fmt.Sprint(k)] = fmt.Sprint(v)
+		}
+	default:
+		return nil, fmt.Errorf("kms must be a map of options")
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(options["ciphertext"])
+	if err != nil || len(ciphertext) == 0 {
+		return nil, fmt.Errorf("kms ciphertext must be a base64 encoded data key")
+	}
+	config := aws.NewConfig()
+	if region := options["region"]; region != "" {
+		config.WithRegion(region)
+	}
+	if endpoint := options["endpoint"]; endpoint != "" {
+		config.WithEndpoint(endpoint)
+	}
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create aws session: %v", err)
+	}
+	output, err := kms.New(sess).Decrypt(&kms.DecryptInput{CiphertextBlob: ciphertext})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt kms data key: %v", err)
+	}
+	return output.Plaintext, nil
+}
+
+// fileCipher returns the cipher of the file with the given salt.
+func (m *encryptStorageMiddleware) fileCipher(salt []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, m.key)
+	mac.Write(salt)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// newHeader returns the header of a new file and its cipher.
+func (m *encryptStorageMiddleware) newHeader() ([]byte, cipher.AEAD, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, nil, err
+	}
+	aead, err := m.fileCipher(salt)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header := make([]byte, 0, headerSize)
+	header = append(header, magic...)
+	header = append(header, formatVersion)
+	header = append(header, m.keyID...)
+	header = append(header, salt...)
+	return header, aead, nil
+}
+
+// parseHeader returns the cipher of the file with the given header.
+func (m *encryptStorageMiddleware) parseHeader(header []byte) (cipher.AEAD, error) {
+	if len(header) < headerSize || string(header[:len(magic)]) != magic || header[len(magic)] != formatVersion {
+		return nil, m.error(ErrCorrupted)
+	}
+	keyID := header[len(magic)+1 : len(magic)+1+keyIDSize]
+	if !hmac.Equal(keyID, m.keyID) {
+		return nil, m.error(ErrWrongKey)
+	}
+	return m.fileCipher(header[len(magic)+1+keyIDSize : headerSize])
+}
+
+// encrypt returns the encrypted content of a committed file.
+func (m *encryptStorageMiddleware) encrypt(content []byte) ([]byte, error) {
+	header, aead, err := m.newHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted := make([]byte, 0, encryptedSize(int64(len(content))))
+	encrypted = append(encrypted, header...)
+	var index uint64
+	for ; len(content) >= chunkSize; index++ {
+		encrypted = sealChunk(encrypted, aead, index, false, content[:chunkSize])
+		content = content[chunkSize:]
+	}
+	return sealChunk(encrypted, aead, index, true, content), nil
+}
+
+// decrypt returns the content of the encrypted file at path.
+func (m *encryptStorageMiddleware) decrypt(ctx context.Context, path string, encrypted []byte) ([]byte, error) {
+	aead, err := m.parseHeader(encrypted)
+	if err != nil {
+		return nil, err
+	}
+
+	body := encrypted[headerSize:]
+	content := make([]byte, 0, len(body))
+	for index := uint64(0); ; index++ {
+		if len(body) == 0 {
+			// the file was not committed, the end of its content is in
+			// the partial file
+			partial, err := m.readPartial(ctx, path)
+			if err != nil {
+				return nil, err
+			}
+			return append(content, partial...), nil
+		}
+
+		final := len(body) < sealedChunkSize
+		n := sealedChunkSize
+		if final {
+			n = len(body)
+		}
+		content, err = openChunk(content, aead, index, final, body[:n])
+		if err != nil {
+			return nil, m.error(ErrCorrupted)
+		}
+		if final {
+			return content, nil
+		}
+		body = body[n:]
+	}
+}
+
+// readPartial returns the content of the last partial chunk of the file at
+// path, which was closed without being committed.
+func (m *encryptStorageMiddleware) readPartial(ctx context.Context, path string) ([]byte, error) {
+	partial, err := m.GetContent(ctx, path+partialSuffix)
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		// the partial file is always written when closing a file
+		return nil, m.error(ErrCorrupted)
+	}
+	return partial, err
+}
+
+// deletePartial deletes the partial file of the file at path, if any.
+func (m *encryptStorageMiddleware) deletePartial(ctx context.Context, path string) error {
+	err := m.StorageDriver.Delete(ctx, path+partialSuffix)
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		return nil
+	}
+	return err
+}
+
+func (m *encryptStorageMiddleware) error(err error) error {
+	return storagedriver.Error{
+		DriverName: m.StorageDriver.Name(),
+		Enclosed:   err,
+	}
+}
+
+// GetContent decrypts the content stored at path.
+func (m *encryptStorageMiddleware) GetContent(ctx context.Context, path string) ([]byte, error) {
+	encrypted, err := m.StorageDriver.GetContent(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	return m.decrypt(ctx, path, encrypted)
+}
+
+// PutContent encrypts the content before storing it at path.
+func (m *encryptStorageMiddleware) PutContent(ctx context.Context, path string, content []byte) error {
+	encrypted, err := m.encrypt(content)
+	if err != nil {
+		return err
+	}
+	return m.StorageDriver.PutContent(ctx, path, encrypted)
+}
+
+// Reader returns a reader decrypting the content of path from offset, only
+// reading the chunks from the one holding offset.
+func (m *encryptStorageMiddleware) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, storagedriver.InvalidOffsetError{Path: path, Offset: offset, DriverName: m.StorageDriver.Name()}
+	}
+
+	rc, err := m.StorageDriver.Reader(ctx, path, 0)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(rc, header); err != nil {
+		rc.Close()
+		return nil, m.error(ErrCorrupted)
+	}
+	aead, err := m.parseHeader(header)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+
+	index := offset / chunkSize
+	if index > 0 {
+		rc.Close()
+		rc, err = m.StorageDriver.Reader(ctx, path, headerSize+index*sealedChunkSize)
+		if err != nil {
+			if _, ok := err.(storagedriver.InvalidOffsetError); ok {
+				return nil, storagedriver.InvalidOffsetError{Path: path, Offset: offset, DriverName: m.StorageDriver.Name()}
+			}
+			return nil, err
+		}
+	}
+
+	r := &decryptingReader{
+		ctx:    ctx,
+		m:      m,
+		path:   path,
+		rc:     rc,
+		aead:   aead,
+		index:  uint64(index),
+		sealed: make([]byte, sealedChunkSize),
+	}
+	if err := r.skip(offset - index*chunkSize); err != nil {
+		r.Close()
+		if err == io.EOF {
+			return nil, storagedriver.InvalidOffsetError{Path: path, Offset: offset, DriverName: m.StorageDriver.Name()}
+		}
+		return nil, err
+	}
+	return r, nil
+}
+
+// Writer returns a writer encrypting the content written to path. When
+// appending, the cipher of the file is read from its header.
+func (m *encryptStorageMiddleware) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	w := &encryptingWriter{
+		ctx:  ctx,
+		m:    m,
+		path: path,
+	}
+
+	if !append {
+		header, aead, err := m.newHeader()
+		if err != nil {
+			return nil, err
+		}
+		fw, err := m.StorageDriver.Writer(ctx, path, false)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := fw.Write(header); err != nil {
+			fw.Cancel()
+			return nil, err
+		}
+		w.fw, w.aead = fw, aead
+		return w, nil
+	}
+
+	rc, err := m.StorageDriver.Reader(ctx, path, 0)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, headerSize)
+	_, err = io.ReadFull(rc, header)
+	rc.Close()
+	if err != nil {
+		return nil, m.error(ErrCorrupted)
+	}
+	if w.aead, err = m.parseHeader(header); err != nil {
+		return nil, err
+	}
+
+	fw, err := m.StorageDriver.Writer(ctx, path, true)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := contentSize(fw.Size()); !ok || committed(fw.Size()) {
+		// only the uncommitted files, made of full chunks, are appended to
+		fw.Close()
+		return nil, m.error(ErrCorrupted)
+	}
+	partial, err := m.readPartial(ctx, path)
+	if err != nil {
+		fw.Close()
+		return nil, err
+	}
+	w.fw = fw
+	w.index = uint64((fw.Size() - headerSize) / sealedChunkSize)
+	w.buf = partial
+	w.size = int64(w.index)*chunkSize + int64(len(partial))
+	return w, nil
+}
+
+// Stat returns the size of the content of the files, rather than the size
+// of their encrypted content.
+func (m *encryptStorageMiddleware) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	fi, err := m.StorageDriver.Stat(ctx, path)
+	if err != nil || fi.IsDir() {
+		return fi, err
+	}
+
+	size, ok := contentSize(fi.Size())
+	if !ok {
+		return nil, m.error(ErrCorrupted)
+	}
+	if !committed(fi.Size()) {
+		// the end of the content is in the partial file
+		partial, err := m.Stat(ctx, path+partialSuffix)
+		if err != nil {
+			if _, ok := err.(storagedriver.PathNotFoundError); ok {
+				return nil, m.error(ErrCorrupted)
+			}
+			return nil, err
+		}
+		size += partial.Size()
+	}
+	return fileInfo{FileInfo: fi, size: size}, nil
+}
+
+// List hides the partial files.
+func (m *encryptStorageMiddleware) List(ctx context.Context, path string) ([]string, error) {
+	entries, err := m.StorageDriver.List(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	listed := entries[:0]
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry, partialSuffix) {
+			listed = append(listed, entry)
+		}
+	}
+	return listed, nil
+}
+
+// Move moves the file at sourcePath and its partial file, if any.
+func (m *encryptStorageMiddleware) Move(ctx context.Context, sourcePath string, destPath string) error {
+	if err := m.StorageDriver.Move(ctx, sourcePath, destPath); err != nil {
+		return err
+	}
+	err := m.StorageDriver.Move(ctx, sourcePath+partialSuffix, destPath+partialSuffix)
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		return nil
+	}
+	return err
+}
+
+// Delete deletes the file at path and its partial file, if any.
+func (m *encryptStorageMiddleware) Delete(ctx context.Context, path string) error {
+	if err := m.StorageDriver.Delete(ctx, path); err != nil {
+		return err
+	}
+	return m.deletePartial(ctx, path)
+}
+
+// URLFor is not supported, since the backend only serves the encrypted
+// content, so that the content is served through the registry.
+func (m *encryptStorageMiddleware) URLFor(ctx context.Context, path string, options map[string]interface{}) (string, error) {
+	return "", storagedriver.ErrUnsupportedMethod{DriverName: m.StorageDriver.Name()}
+}
+
+// Walk walks the files through the middleware, so that the partial files
+// are hidden and the sizes of the files are the sizes of their content.
+func (m *encryptStorageMiddleware) Walk(ctx context.Context, path string, f storagedriver.WalkFn) error {
+	return storagedriver.WalkFallback(ctx, m, path, f)
+}
+
+// fileInfo reports the size of the content of an encrypted file.
+type fileInfo struct {
+	storagedriver.FileInfo
+	size int64
+}
+
+func (fi fileInfo) Size() int64 {
+	return fi.size
+}
+
+func init() {
+	storagemiddleware.Register("encrypt", storagemiddleware.InitFunc(newEncryptStorageMiddleware))
+}
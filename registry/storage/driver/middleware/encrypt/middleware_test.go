@@ -0,0 +1,210 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/distribution/v3/registry/storage/driver/testsuites"
+	"gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { check.TestingT(t) }
+
+var testKey = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{42}, keySize))
+
+func init() {
+	testsuites.RegisterSuite(func() (storagedriver.StorageDriver, error) {
+		return newEncryptStorageMiddleware(inmemory.New(), map[string]interface{}{"key": testKey})
+	}, testsuites.NeverSkip)
+}
+
+func newTestMiddleware(t *testing.T, backend storagedriver.StorageDriver, key string) storagedriver.StorageDriver {
+	sd, err := newEncryptStorageMiddleware(backend, map[string]interface{}{"key": key})
+	if err != nil {
+		t.Fatalf("unexpected error creating middleware: %v", err)
+	}
+	return sd
+}
+
+func TestInvalidOptions(t *testing.T) {
+	for _, options := range []map[string]interface{}{
+		{},
+		{"key": "not base64"},
+		{"key": base64.StdEncoding.EncodeToString([]byte("too short"))},
+		{"key": testKey, "keyfile": "/etc/key"},
+		{"keyfile": "/does/not/exist"},
+		{"kms": "arn:aws:kms"},
+		{"kms": map[interface{}]interface{}{"region": "us-east-1"}},
+	} {
+		if _, err := newEncryptStorageMiddleware(inmemory.New(), options); err == nil {
+			t.Errorf("expected an error with options %v", options)
+		}
+	}
+
+	keyFile := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(keyFile, []byte(testKey+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newEncryptStorageMiddleware(inmemory.New(), map[string]interface{}{"keyfile": keyFile}); err != nil {
+		t.Fatalf("unexpected error with a key file: %v", err)
+	}
+}
+
+func TestEncryptedAtRest(t *testing.T) {
+	ctx := context.Background()
+	backend := inmemory.New()
+	sd := newTestMiddleware(t, backend, testKey)
+
+	content := bytes.Repeat([]byte("secret layer content "), 10000)
+	if err := sd.PutContent(ctx, "/blob", content); err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, err := backend.GetContent(ctx, "/blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(encrypted, []byte("secret")) {
+		t.Fatalf("content stored in clear")
+	}
+	if int64(len(encrypted)) != encryptedSize(int64(len(content))) {
+		t.Fatalf("unexpected encrypted size %d", len(encrypted))
+	}
+
+	fi, err := sd.Stat(ctx, "/blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != int64(len(content)) {
+		t.Fatalf("expected size %d, got %d", len(content), fi.Size())
+	}
+
+	// reading from an offset only decrypts the chunks from the offset
+	offset := int64(3*chunkSize + 123)
+	rc, err := sd.Reader(ctx, "/blob", offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, content[offset:]) {
+		t.Fatalf("unexpected content read from offset %d", offset)
+	}
+
+	if _, err := sd.URLFor(ctx, "/blob", nil); !errors.As(err, &storagedriver.ErrUnsupportedMethod{}) {
+		t.Fatalf("expected URLFor to be unsupported, got %v", err)
+	}
+
+	// the content cannot be read with another key
+	other := newTestMiddleware(t, backend, base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, keySize)))
+	if _, err := other.GetContent(ctx, "/blob"); !errors.Is(err.(storagedriver.Error).Enclosed, ErrWrongKey) {
+		t.Fatalf("expected wrong key error, got %v", err)
+	}
+}
+
+func TestTampering(t *testing.T) {
+	ctx := context.Background()
+	backend := inmemory.New()
+	sd := newTestMiddleware(t, backend, testKey)
+
+	content := bytes.Repeat([]byte{1}, 2*chunkSize+10)
+	if err := sd.PutContent(ctx, "/blob", content); err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := backend.GetContent(ctx, "/blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tampered := range map[string][]byte{
+		"flipped bit":   append(append([]byte(nil), encrypted[:headerSize+5]...), append([]byte{encrypted[headerSize+5] ^ 1}, encrypted[headerSize+6:]...)...),
+		"truncated":     encrypted[:headerSize+2*sealedChunkSize],
+		"dropped chunk": append(append([]byte(nil), encrypted[:headerSize]...), encrypted[headerSize+sealedChunkSize:]...),
+		"not encrypted": content,
+	} {
+		if err := backend.PutContent(ctx, "/tampered", tampered); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sd.GetContent(ctx, "/tampered"); err == nil {
+			t.Errorf("%s: expected an error reading tampered content", name)
+		}
+		rc, err := sd.Reader(ctx, "/tampered", 0)
+		if err == nil {
+			_, err = io.ReadAll(rc)
+			rc.Close()
+		}
+		if err == nil {
+			t.Errorf("%s: expected an error reading tampered content", name)
+		}
+	}
+}
+
+func TestResumeWriter(t *testing.T) {
+	ctx := context.Background()
+	backend := inmemory.New()
+	sd := newTestMiddleware(t, backend, testKey)
+
+	content := bytes.Repeat([]byte("0123456789"), chunkSize/4)
+	parts := [][]byte{content[:100], content[100 : chunkSize+10], content[chunkSize+10:]}
+
+	for i, part := range parts {
+		w, err := sd.Writer(ctx, "/upload/data", i > 0)
+		if err != nil {
+			t.Fatalf("part %d: %v", i, err)
+		}
+		if _, err := w.Write(part); err != nil {
+			t.Fatalf("part %d: %v", i, err)
+		}
+		if i == len(parts)-1 {
+			if err := w.Commit(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("part %d: %v", i, err)
+		}
+
+		fi, err := sd.Stat(ctx, "/upload/data")
+		if err != nil {
+			t.Fatalf("part %d: %v", i, err)
+		}
+		if fi.Size() != w.Size() {
+			t.Fatalf("part %d: expected size %d, got %d", i, w.Size(), fi.Size())
+		}
+		read, err := sd.GetContent(ctx, "/upload/data")
+		if err != nil {
+			t.Fatalf("part %d: %v", i, err)
+		}
+		if int64(len(read)) != w.Size() || !bytes.Equal(read, content[:len(read)]) {
+			t.Fatalf("part %d: unexpected content", i)
+		}
+
+		// the partial file is hidden
+		entries, err := sd.List(ctx, "/upload")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || entries[0] != "/upload/data" {
+			t.Fatalf("part %d: unexpected entries %v", i, entries)
+		}
+	}
+
+	if _, err := backend.Stat(ctx, "/upload/data"+partialSuffix); !errors.As(err, &storagedriver.PathNotFoundError{}) {
+		t.Fatalf("expected the partial file to be deleted on commit, got %v", err)
+	}
+	if _, err := sd.Writer(ctx, "/upload/data", true); err == nil {
+		t.Fatalf("expected an error appending to a committed file")
+	}
+}
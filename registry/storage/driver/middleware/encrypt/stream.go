@@ -0,0 +1,267 @@
+package middleware
+
+import (
+	"context"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+// An encrypted file is made of a header followed by the chunks of its
+// content, each sealed with AES-GCM. All the chunks are chunkSize bytes of
+// content but the last one of a committed file, which is shorter, possibly
+// empty, so that the size of the content is known from the size of the file
+// and truncated files are detected.
+const (
+	magic         = "DENC"
+	formatVersion = 1
+	keyIDSize     = 4
+	saltSize      = 16
+	headerSize    = 4 + 1 + keyIDSize + saltSize // magic, version, key id, salt
+
+	chunkSize       = 64 << 10
+	tagSize         = 16
+	sealedChunkSize = chunkSize + tagSize
+
+	// partialSuffix is the suffix of the files holding the last partial
+	// chunk of the files closed without being committed.
+	partialSuffix = ".partial"
+)
+
+// sealChunk appends the chunk of the given index, sealed, to dst. The index
+// is the nonce of the chunk, so that chunks cannot be reordered, and whether
+// it is the final chunk is authenticated, so that files cannot be truncated
+// at a chunk boundary.
+func sealChunk(dst []byte, aead cipher.AEAD, index uint64, final bool, chunk []byte) []byte {
+	return aead.Seal(dst, chunkNonce(aead, index), chunk, chunkData(final))
+}
+
+// openChunk appends the content of the sealed chunk to dst.
+func openChunk(dst []byte, aead cipher.AEAD, index uint64, final bool, sealed []byte) ([]byte, error) {
+	return aead.Open(dst, chunkNonce(aead, index), sealed, chunkData(final))
+}
+
+func chunkNonce(aead cipher.AEAD, index uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], index)
+	return nonce
+}
+
+func chunkData(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// encryptedSize returns the size of a committed file with size bytes of
+// content.
+func encryptedSize(size int64) int64 {
+	return headerSize + size/chunkSize*sealedChunkSize + size%chunkSize + tagSize
+}
+
+// contentSize returns the size of the content of an encrypted file of the
+// given size, excluding the content of the partial file of uncommitted
+// files, or false if the size is invalid.
+func contentSize(size int64) (int64, bool) {
+	body := size - headerSize
+	if body < 0 {
+		return 0, false
+	}
+	chunks, last := body/sealedChunkSize, body%sealedChunkSize
+	if last == 0 {
+		return chunks * chunkSize, true
+	}
+	if last < tagSize {
+		return 0, false
+	}
+	return chunks*chunkSize + last - tagSize, true
+}
+
+// committed returns whether an encrypted file of the given size ends with
+// its final chunk.
+func committed(size int64) bool {
+	return (size-headerSize)%sealedChunkSize != 0
+}
+
+// decryptingReader decrypts an encrypted file from the chunk of the given
+// index, reading the content of its partial file once all its chunks are
+// read if it was not committed.
+type decryptingReader struct {
+	ctx  context.Context
+	m    *encryptStorageMiddleware
+	path string
+
+	rc     io.ReadCloser
+	aead   cipher.AEAD
+	index  uint64
+	sealed []byte
+
+	// buf holds the content of the current chunk not read yet.
+	buf []byte
+	eof bool
+}
+
+// next reads the next chunk in buf, returning io.EOF after the final one.
+func (r *decryptingReader) next() error {
+	if r.eof {
+		return io.EOF
+	}
+
+	n, err := io.ReadFull(r.rc, r.sealed)
+	switch err {
+	case nil:
+		r.buf, err = openChunk(r.buf[:0], r.aead, r.index, false, r.sealed)
+	case io.ErrUnexpectedEOF:
+		r.eof = true
+		r.buf, err = openChunk(r.buf[:0], r.aead, r.index, true, r.sealed[:n])
+	case io.EOF:
+		// the file was not committed, the end of its content is in the
+		// partial file
+		r.eof = true
+		r.buf, err = r.m.readPartial(r.ctx, r.path)
+		return err
+	default:
+		return err
+	}
+	if err != nil {
+		return r.m.error(ErrCorrupted)
+	}
+	r.index++
+	return nil
+}
+
+// skip skips n bytes of content, returning io.EOF if the content is shorter.
+func (r *decryptingReader) skip(n int64) error {
+	for n > 0 {
+		if len(r.buf) == 0 {
+			if err := r.next(); err != nil {
+				return err
+			}
+			continue
+		}
+		skipped := int64(len(r.buf))
+		if skipped > n {
+			skipped = n
+		}
+		r.buf = r.buf[skipped:]
+		n -= skipped
+	}
+	return nil
+}
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *decryptingReader) Close() error {
+	return r.rc.Close()
+}
+
+// encryptingWriter encrypts the content written to a file, chunk by chunk.
+// The final chunk is written when the file is committed, the last partial
+// chunk is written to the partial file when it is only closed.
+type encryptingWriter struct {
+	ctx  context.Context
+	m    *encryptStorageMiddleware
+	path string
+
+	fw    storagedriver.FileWriter
+	aead  cipher.AEAD
+	index uint64
+
+	// buf holds the content written since the last full chunk.
+	buf  []byte
+	size int64
+
+	closed    bool
+	committed bool
+	cancelled bool
+}
+
+func (w *encryptingWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fmt.Errorf("already closed")
+	} else if w.committed {
+		return 0, fmt.Errorf("already committed")
+	} else if w.cancelled {
+		return 0, fmt.Errorf("already cancelled")
+	}
+
+	w.buf = append(w.buf, p...)
+	var sealed []byte
+	for len(w.buf) >= chunkSize {
+		sealed = sealChunk(sealed[:0], w.aead, w.index, false, w.buf[:chunkSize])
+		if _, err := w.fw.Write(sealed); err != nil {
+			return 0, err
+		}
+		w.index++
+		w.buf = w.buf[chunkSize:]
+	}
+	// release the written chunks
+	w.buf = append([]byte(nil), w.buf...)
+	w.size += int64(len(p))
+	return len(p), nil
+}
+
+func (w *encryptingWriter) Size() int64 {
+	return w.size
+}
+
+func (w *encryptingWriter) Close() error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	}
+	w.closed = true
+
+	if !w.committed && !w.cancelled {
+		if err := w.m.PutContent(w.ctx, w.path+partialSuffix, w.buf); err != nil {
+			w.fw.Close()
+			return err
+		}
+	}
+	return w.fw.Close()
+}
+
+func (w *encryptingWriter) Cancel() error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	} else if w.committed {
+		return fmt.Errorf("already committed")
+	}
+	w.cancelled = true
+
+	if err := w.fw.Cancel(); err != nil {
+		return err
+	}
+	return w.m.deletePartial(w.ctx, w.path)
+}
+
+func (w *encryptingWriter) Commit() error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	} else if w.committed {
+		return fmt.Errorf("already committed")
+	} else if w.cancelled {
+		return fmt.Errorf("already cancelled")
+	}
+
+	if _, err := w.fw.Write(sealChunk(nil, w.aead, w.index, true, w.buf)); err != nil {
+		return err
+	}
+	if err := w.fw.Commit(); err != nil {
+		return err
+	}
+	w.committed = true
+	return w.m.deletePartial(w.ctx, w.path)
+}
@@ -4,15 +4,36 @@ import (
 	"context"
 	"fmt"
 	"net/url"
+	"strings"
+	"time"
 
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
 	storagemiddleware "github.com/distribution/distribution/v3/registry/storage/driver/middleware"
 )
 
+// defaultDuration is how long the signed URLs are valid by default.
+const defaultDuration = 20 * time.Minute
+
 type redirectStorageMiddleware struct {
 	storagedriver.StorageDriver
 	scheme string
 	host   string
+
+	signer   urlSigner
+	duration time.Duration
+	policies []policy
+}
+
+// policy overrides how the files under a path prefix are redirected.
+type policy struct {
+	prefix string
+	// duration is how long the signed URLs of the files are valid.
+	duration time.Duration
+	// unsigned files are redirected to unsigned URLs.
+	unsigned bool
+	// direct files are redirected to the URLs of the storage driver,
+	// bypassing the CDN.
+	direct bool
 }
 
 var _ storagedriver.StorageDriver = &redirectStorageMiddleware{}
@@ -37,12 +58,107 @@ func newRedirectStorageMiddleware(sd storagedriver.StorageDriver, options map[st
 		return nil, fmt.Errorf("no host specified for redirect baseurl")
 	}
 
-	return &redirectStorageMiddleware{StorageDriver: sd, scheme: u.Scheme, host: u.Host}, nil
+	m := &redirectStorageMiddleware{StorageDriver: sd, scheme: u.Scheme, host: u.Host, duration: defaultDuration}
+	if o, ok := options["signing"]; ok {
+		signing, ok := o.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("signing must be a map")
+		}
+		if m.signer, err = newURLSigner(signing); err != nil {
+			return nil, err
+		}
+		if d, ok := signing["duration"]; ok {
+			if m.duration, err = parseDuration(d); err != nil {
+				return nil, fmt.Errorf("invalid signing duration: %v", err)
+			}
+		}
+	}
+	if o, ok := options["policies"]; ok {
+		policies, ok := o.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("policies must be a list")
+		}
+		for _, p := range policies {
+			policy, err := parsePolicy(p, m.duration)
+			if err != nil {
+				return nil, err
+			}
+			m.policies = append(m.policies, policy)
+		}
+	}
+	return m, nil
 }
 
+func parsePolicy(o interface{}, duration time.Duration) (policy, error) {
+	options, ok := o.(map[interface{}]interface{})
+	if !ok {
+		return policy{}, fmt.Errorf("policy must be a map")
+	}
+	prefix, ok := options["prefix"].(string)
+	if !ok || !strings.HasPrefix(prefix, "/") {
+		return policy{}, fmt.Errorf("policy prefix must be an absolute path")
+	}
+	p := policy{prefix: prefix, duration: duration}
+	if d, ok := options["duration"]; ok {
+		var err error
+		if p.duration, err = parseDuration(d); err != nil {
+			return policy{}, fmt.Errorf("invalid duration of policy %s: %v", prefix, err)
+		}
+	}
+	for name, flag := range map[string]*bool{"unsigned": &p.unsigned, "direct": &p.direct} {
+		if v, ok := options[name]; ok {
+			if *flag, ok = v.(bool); !ok {
+				return policy{}, fmt.Errorf("%s of policy %s must be a boolean", name, prefix)
+			}
+		}
+	}
+	return p, nil
+}
+
+func parseDuration(d interface{}) (time.Duration, error) {
+	var duration time.Duration
+	switch d := d.(type) {
+	case time.Duration:
+		duration = d
+	case string:
+		var err error
+		if duration, err = time.ParseDuration(d); err != nil {
+			return 0, err
+		}
+	default:
+		return 0, fmt.Errorf("duration must be a string")
+	}
+	if duration <= 0 {
+		return 0, fmt.Errorf("duration must be positive")
+	}
+	return duration, nil
+}
+
+// URLFor returns the URL of the file at path on the base URL, signed if
+// signing is configured, unless a policy overrides it.
 func (r *redirectStorageMiddleware) URLFor(ctx context.Context, path string, options map[string]interface{}) (string, error) {
+	p := r.policyFor(path)
+	if p.direct {
+		return r.StorageDriver.URLFor(ctx, path, options)
+	}
+
 	u := &url.URL{Scheme: r.scheme, Host: r.host, Path: path}
-	return u.String(), nil
+	if r.signer == nil || p.unsigned {
+		return u.String(), nil
+	}
+	return r.signer.sign(u, time.Now().Add(p.duration))
+}
+
+// policyFor returns the policy with the longest prefix matching path, or the
+// default one.
+func (r *redirectStorageMiddleware) policyFor(path string) policy {
+	match := policy{duration: r.duration}
+	for _, p := range r.policies {
+		if strings.HasPrefix(path, p.prefix) && len(p.prefix) >= len(match.prefix) {
+			match = p
+		}
+	}
+	return match
 }
 
 func init() {
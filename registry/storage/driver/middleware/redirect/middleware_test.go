@@ -2,8 +2,23 @@ package middleware
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
 	check "gopkg.in/check.v1"
 )
 
@@ -57,3 +72,133 @@ func (s *MiddlewareSuite) TestHTTP(c *check.C) {
 	c.Assert(err, check.Equals, nil)
 	c.Assert(url, check.Equals, "http://example.com/morty/data")
 }
+
+func (s *MiddlewareSuite) TestFastlySigning(c *check.C) {
+	options := map[string]interface{}{
+		"baseurl": "https://cdn.example.com",
+		"signing": map[interface{}]interface{}{
+			"type":     "fastly",
+			"key":      "secret",
+			"duration": "1h",
+		},
+	}
+	middleware, err := newRedirectStorageMiddleware(nil, options)
+	c.Assert(err, check.IsNil)
+
+	before := time.Now()
+	signed, err := middleware.URLFor(context.TODO(), "/docker/registry/v2/blobs/data", nil)
+	c.Assert(err, check.IsNil)
+	u, err := url.Parse(signed)
+	c.Assert(err, check.IsNil)
+	c.Assert(u.Host, check.Equals, "cdn.example.com")
+	c.Assert(u.Path, check.Equals, "/docker/registry/v2/blobs/data")
+
+	expiration, signature, ok := strings.Cut(u.Query().Get("token"), "_")
+	c.Assert(ok, check.Equals, true)
+	expires, err := strconv.ParseInt(expiration, 10, 64)
+	c.Assert(err, check.IsNil)
+	c.Assert(expires >= before.Add(time.Hour).Unix(), check.Equals, true)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(u.Path + expiration))
+	c.Assert(signature, check.Equals, hex.EncodeToString(mac.Sum(nil)))
+}
+
+func (s *MiddlewareSuite) TestAkamaiSigning(c *check.C) {
+	options := map[string]interface{}{
+		"baseurl": "https://cdn.example.com",
+		"signing": map[interface{}]interface{}{
+			"type":      "akamai",
+			"key":       "0a1b2c3d",
+			"parameter": "hdnts",
+		},
+	}
+	middleware, err := newRedirectStorageMiddleware(nil, options)
+	c.Assert(err, check.IsNil)
+
+	signed, err := middleware.URLFor(context.TODO(), "/docker/registry/v2/blobs/data", nil)
+	c.Assert(err, check.IsNil)
+	u, err := url.Parse(signed)
+	c.Assert(err, check.IsNil)
+
+	token, signature, ok := strings.Cut(u.Query().Get("hdnts"), "~hmac=")
+	c.Assert(ok, check.Equals, true)
+	c.Assert(strings.HasPrefix(token, "exp="), check.Equals, true)
+	mac := hmac.New(sha256.New, []byte{0x0a, 0x1b, 0x2c, 0x3d})
+	mac.Write([]byte(token + "~url=" + u.Path))
+	c.Assert(signature, check.Equals, hex.EncodeToString(mac.Sum(nil)))
+}
+
+func (s *MiddlewareSuite) TestCloudFrontSigning(c *check.C) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, check.IsNil)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	c.Assert(err, check.IsNil)
+	keyPath := filepath.Join(c.MkDir(), "key.pem")
+	err = os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600)
+	c.Assert(err, check.IsNil)
+
+	options := map[string]interface{}{
+		"baseurl": "https://d111111abcdef8.cloudfront.net",
+		"signing": map[interface{}]interface{}{
+			"type":       "cloudfront",
+			"privatekey": keyPath,
+			"keypairid":  "K2JCJMDEHXQW5F",
+		},
+	}
+	middleware, err := newRedirectStorageMiddleware(nil, options)
+	c.Assert(err, check.IsNil)
+
+	signed, err := middleware.URLFor(context.TODO(), "/docker/registry/v2/blobs/data", nil)
+	c.Assert(err, check.IsNil)
+	u, err := url.Parse(signed)
+	c.Assert(err, check.IsNil)
+	c.Assert(u.Query().Get("Key-Pair-Id"), check.Equals, "K2JCJMDEHXQW5F")
+	c.Assert(u.Query().Get("Signature"), check.Not(check.Equals), "")
+	c.Assert(u.Query().Get("Expires"), check.Not(check.Equals), "")
+}
+
+func (s *MiddlewareSuite) TestPolicies(c *check.C) {
+	options := map[string]interface{}{
+		"baseurl": "https://cdn.example.com",
+		"signing": map[interface{}]interface{}{
+			"type": "fastly",
+			"key":  "secret",
+		},
+		"policies": []interface{}{
+			map[interface{}]interface{}{"prefix": "/docker/registry/v2/blobs/", "duration": "2h"},
+			map[interface{}]interface{}{"prefix": "/docker/registry/v2/blobs/public/", "unsigned": true},
+			map[interface{}]interface{}{"prefix": "/docker/registry/v2/repositories/", "direct": true},
+		},
+	}
+	middleware, err := newRedirectStorageMiddleware(inmemory.New(), options)
+	c.Assert(err, check.IsNil)
+	m := middleware.(*redirectStorageMiddleware)
+
+	c.Assert(m.policyFor("/docker/registry/v2/blobs/data").duration, check.Equals, 2*time.Hour)
+	c.Assert(m.policyFor("/other/data").duration, check.Equals, defaultDuration)
+
+	unsigned, err := middleware.URLFor(context.TODO(), "/docker/registry/v2/blobs/public/data", nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(unsigned, check.Equals, "https://cdn.example.com/docker/registry/v2/blobs/public/data")
+
+	// the URLs of the storage driver are used, which the inmemory driver
+	// does not support
+	_, err = middleware.URLFor(context.TODO(), "/docker/registry/v2/repositories/data", nil)
+	c.Assert(err, check.FitsTypeOf, storagedriver.ErrUnsupportedMethod{})
+}
+
+func (s *MiddlewareSuite) TestInvalidSigning(c *check.C) {
+	for _, signing := range []map[interface{}]interface{}{
+		{"type": "unknown"},
+		{"type": "fastly"},
+		{"type": "akamai", "key": "not hex"},
+		{"type": "cloudfront", "privatekey": "/missing/key.pem", "keypairid": "K2JCJMDEHXQW5F"},
+		{"type": "fastly", "key": "secret", "duration": "-1h"},
+	} {
+		_, err := newRedirectStorageMiddleware(nil, map[string]interface{}{
+			"baseurl": "https://cdn.example.com",
+			"signing": signing,
+		})
+		c.Assert(err, check.NotNil, check.Commentf("signing %v", signing))
+	}
+}
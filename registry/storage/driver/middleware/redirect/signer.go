@@ -0,0 +1,168 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudfront/sign"
+)
+
+// urlSigner signs the URLs of the content served by a CDN, so that the CDN
+// only serves them until they expire.
+type urlSigner interface {
+	sign(u *url.URL, expires time.Time) (string, error)
+}
+
+// newURLSigner returns the signer configured by the signing options.
+func newURLSigner(options map[interface{}]interface{}) (urlSigner, error) {
+	stringOption := func(name string) (string, error) {
+		v, ok := options[name]
+		if !ok {
+			return "", fmt.Errorf("no signing %s provided", name)
+		}
+		s, ok := v.(string)
+		if !ok || s == "" {
+			return "", fmt.Errorf("signing %s must be a string", name)
+		}
+		return s, nil
+	}
+	parameter := func(defaultName string) (string, error) {
+		if _, ok := options["parameter"]; !ok {
+			return defaultName, nil
+		}
+		return stringOption("parameter")
+	}
+
+	signingType, err := stringOption("type")
+	if err != nil {
+		return nil, err
+	}
+	switch signingType {
+	case "fastly":
+		key, err := stringOption("key")
+		if err != nil {
+			return nil, err
+		}
+		name, err := parameter("token")
+		if err != nil {
+			return nil, err
+		}
+		return &fastlySigner{key: []byte(key), parameter: name}, nil
+	case "akamai":
+		encoded, err := stringOption("key")
+		if err != nil {
+			return nil, err
+		}
+		key, err := hex.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("signing key must be hex encoded: %v", err)
+		}
+		name, err := parameter("__token__")
+		if err != nil {
+			return nil, err
+		}
+		return &akamaiSigner{key: key, parameter: name}, nil
+	case "cloudfront":
+		keyPath, err := stringOption("privatekey")
+		if err != nil {
+			return nil, err
+		}
+		keyID, err := stringOption("keypairid")
+		if err != nil {
+			return nil, err
+		}
+		privateKey, err := readRSAPrivateKey(keyPath)
+		if err != nil {
+			return nil, err
+		}
+		return &cloudFrontSigner{signer: sign.NewURLSigner(keyID, privateKey)}, nil
+	default:
+		return nil, fmt.Errorf("unknown signing type %q, expected fastly, akamai or cloudfront", signingType)
+	}
+}
+
+// readRSAPrivateKey reads a PEM encoded RSA private key, in the PKCS #1 or
+// PKCS #8 format.
+func readRSAPrivateKey(path string) (*rsa.PrivateKey, error) {
+	pemBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read privatekey file: %s", err)
+	}
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode private key as an rsa private key")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key is a %T, not an rsa private key", key)
+	}
+	return rsaKey, nil
+}
+
+// fastlySigner signs URLs for the token authentication of Fastly: the token
+// is the expiration time, in seconds since the epoch, and the hex encoded
+// HMAC-SHA256 of the path followed by the expiration time, separated by an
+// underscore.
+type fastlySigner struct {
+	key       []byte
+	parameter string
+}
+
+func (s *fastlySigner) sign(u *url.URL, expires time.Time) (string, error) {
+	expiration := strconv.FormatInt(expires.Unix(), 10)
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(u.EscapedPath() + expiration))
+
+	signed := *u
+	q := signed.Query()
+	q.Set(s.parameter, expiration+"_"+hex.EncodeToString(mac.Sum(nil)))
+	signed.RawQuery = q.Encode()
+	return signed.String(), nil
+}
+
+// akamaiSigner signs URLs for the edge authorization tokens of Akamai, as
+// issued by its EdgeAuth libraries for a URL: the token holds the expiration
+// time and the HMAC-SHA256 of the expiration time and the path, keyed with
+// the hex decoded key.
+type akamaiSigner struct {
+	key       []byte
+	parameter string
+}
+
+func (s *akamaiSigner) sign(u *url.URL, expires time.Time) (string, error) {
+	token := "exp=" + strconv.FormatInt(expires.Unix(), 10)
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(token + "~url=" + u.EscapedPath()))
+
+	signed := *u
+	q := signed.Query()
+	q.Set(s.parameter, token+"~hmac="+hex.EncodeToString(mac.Sum(nil)))
+	signed.RawQuery = q.Encode()
+	return signed.String(), nil
+}
+
+// cloudFrontSigner signs URLs with a canned policy of CloudFront, with the
+// key of a key group, or of a key pair of the root account.
+type cloudFrontSigner struct {
+	signer *sign.URLSigner
+}
+
+func (s *cloudFrontSigner) sign(u *url.URL, expires time.Time) (string, error) {
+	return s.signer.Sign(u.String(), expires)
+}
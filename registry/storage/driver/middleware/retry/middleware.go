@@ -0,0 +1,384 @@
+// Package middleware - retry wrapper for storage drivers, retrying the
+// operations failing with transient errors and failing fast while the
+// backend is down.
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"regexp"
+	"sync"
+	"time"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	storagemiddleware "github.com/distribution/distribution/v3/registry/storage/driver/middleware"
+)
+
+const (
+	defaultAttempts         = 3
+	defaultBackoff          = 100 * time.Millisecond
+	defaultMaxBackoff       = 2 * time.Second
+	defaultBreakerThreshold = 5
+	defaultBreakerTimeout   = 30 * time.Second
+)
+
+// ErrCircuitOpen is returned, enclosed in a storagedriver.Error, by the
+// operations attempted while the circuit breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker open, storage backend unavailable")
+
+// retryStorageMiddleware retries the idempotent operations of the storage
+// driver failing with a retryable error, backing off exponentially between
+// attempts. A circuit breaker opens after breakerThreshold consecutive
+// operations failed, during which operations fail immediately, so that
+// requests don't pile up while the backend is down.
+type retryStorageMiddleware struct {
+	storagedriver.StorageDriver
+
+	attempts   int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	retryable  []*regexp.Regexp
+
+	breaker *breaker
+}
+
+var _ storagedriver.StorageDriver = &retryStorageMiddleware{}
+
+// newRetryStorageMiddleware constructs a retry storage middleware.
+// Optional options: attempts, backoff, maxbackoff, retryable,
+// breakerthreshold, breakertimeout
+func newRetryStorageMiddleware(sd storagedriver.StorageDriver, options map[string]interface{}) (storagedriver.StorageDriver, error) {
+	attempts, err := intOption(options, "attempts", defaultAttempts)
+	if err != nil {
+		return nil, err
+	}
+	if attempts < 1 {
+		return nil, fmt.Errorf("attempts must be at least 1")
+	}
+	backoff, err := durationOption(options, "backoff", defaultBackoff)
+	if err != nil {
+		return nil, err
+	}
+	maxBackoff, err := durationOption(options, "maxbackoff", defaultMaxBackoff)
+	if err != nil {
+		return nil, err
+	}
+	if maxBackoff < backoff {
+		maxBackoff = backoff
+	}
+	threshold, err := intOption(options, "breakerthreshold", defaultBreakerThreshold)
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := durationOption(options, "breakertimeout", defaultBreakerTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	var retryable []*regexp.Regexp
+	if r, ok := options["retryable"]; ok {
+		patterns, ok := r.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("retryable must be a list of regular expressions")
+		}
+		for _, p := range patterns {
+			pattern, ok := p.(string)
+			if !ok {
+				return nil, fmt.Errorf("retryable must be a list of regular expressions")
+			}
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid retryable pattern %q: %v", pattern, err)
+			}
+			retryable = append(retryable, re)
+		}
+	}
+
+	return &retryStorageMiddleware{
+		StorageDriver: sd,
+		attempts:      attempts,
+		backoff:       backoff,
+		maxBackoff:    maxBackoff,
+		retryable:     retryable,
+		breaker:       newBreaker(threshold, timeout),
+	}, nil
+}
+
+func intOption(options map[string]interface{}, name string, defaultValue int) (int, error) {
+	v, ok := options[name]
+	if !ok {
+		return defaultValue, nil
+	}
+	switch v := v.(type) {
+	case int:
+		return v, nil
+	case float64:
+		return int(v), nil
+	}
+	return 0, fmt.Errorf("%s must be an integer", name)
+}
+
+func durationOption(options map[string]interface{}, name string, defaultValue time.Duration) (time.Duration, error) {
+	v, ok := options[name]
+	if !ok {
+		return defaultValue, nil
+	}
+	switch v := v.(type) {
+	case time.Duration:
+		return v, nil
+	case string:
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s: %v", name, err)
+		}
+		return d, nil
+	}
+	return 0, fmt.Errorf("%s must be a duration", name)
+}
+
+// GetContent retries storagedriver.StorageDriver.GetContent.
+func (r *retryStorageMiddleware) GetContent(ctx context.Context, path string) ([]byte, error) {
+	var content []byte
+	err := r.do(ctx, r.attempts, func() error {
+		var err error
+		content, err = r.StorageDriver.GetContent(ctx, path)
+		return err
+	})
+	return content, err
+}
+
+// PutContent retries storagedriver.StorageDriver.PutContent, which
+// overwrites the content of path.
+func (r *retryStorageMiddleware) PutContent(ctx context.Context, path string, content []byte) error {
+	return r.do(ctx, r.attempts, func() error {
+		return r.StorageDriver.PutContent(ctx, path, content)
+	})
+}
+
+// Reader retries opening the reader, reads are not retried.
+func (r *retryStorageMiddleware) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	var rc io.ReadCloser
+	err := r.do(ctx, r.attempts, func() error {
+		var err error
+		rc, err = r.StorageDriver.Reader(ctx, path, offset)
+		return err
+	})
+	return rc, err
+}
+
+// Writer retries opening the writer, writes are not retried.
+func (r *retryStorageMiddleware) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	var fw storagedriver.FileWriter
+	err := r.do(ctx, r.attempts, func() error {
+		var err error
+		fw, err = r.StorageDriver.Writer(ctx, path, append)
+		return err
+	})
+	return fw, err
+}
+
+// Stat retries storagedriver.StorageDriver.Stat.
+func (r *retryStorageMiddleware) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	var fi storagedriver.FileInfo
+	err := r.do(ctx, r.attempts, func() error {
+		var err error
+		fi, err = r.StorageDriver.Stat(ctx, path)
+		return err
+	})
+	return fi, err
+}
+
+// List retries storagedriver.StorageDriver.List.
+func (r *retryStorageMiddleware) List(ctx context.Context, path string) ([]string, error) {
+	var entries []string
+	err := r.do(ctx, r.attempts, func() error {
+		var err error
+		entries, err = r.StorageDriver.List(ctx, path)
+		return err
+	})
+	return entries, err
+}
+
+// Move is attempted once, as a move which succeeded on the backend but
+// reported an error would fail when retried.
+func (r *retryStorageMiddleware) Move(ctx context.Context, sourcePath string, destPath string) error {
+	return r.do(ctx, 1, func() error {
+		return r.StorageDriver.Move(ctx, sourcePath, destPath)
+	})
+}
+
+// Delete retries storagedriver.StorageDriver.Delete.
+func (r *retryStorageMiddleware) Delete(ctx context.Context, path string) error {
+	return r.do(ctx, r.attempts, func() error {
+		return r.StorageDriver.Delete(ctx, path)
+	})
+}
+
+// Walk is attempted once, as the walk function may not be idempotent.
+func (r *retryStorageMiddleware) Walk(ctx context.Context, path string, f storagedriver.WalkFn) error {
+	return r.do(ctx, 1, func() error {
+		return r.StorageDriver.Walk(ctx, path, f)
+	})
+}
+
+// do calls op up to attempts times while it fails with a retryable error,
+// unless the circuit breaker is open.
+func (r *retryStorageMiddleware) do(ctx context.Context, attempts int, op func() error) error {
+	if !r.breaker.allow() {
+		return storagedriver.Error{
+			DriverName: r.StorageDriver.Name(),
+			Enclosed:   ErrCircuitOpen,
+		}
+	}
+
+	backoff := r.backoff
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || !r.isRetryable(err) {
+			r.breaker.success(ctx)
+			return err
+		}
+		if attempt >= attempts {
+			r.breaker.failure(ctx)
+			return err
+		}
+
+		// full jitter, so that the instances retrying after an error of
+		// the backend don't retry together
+		wait := time.Duration(rand.Int63n(int64(backoff) + 1))
+		dcontext.GetLogger(ctx).Warnf("storage operation failed, retrying in %s (attempt %d of %d): %v", wait, attempt, attempts, err)
+		select {
+		case <-ctx.Done():
+			r.breaker.failure(ctx)
+			return err
+		case <-time.After(wait):
+		}
+
+		backoff *= 2
+		if backoff > r.maxBackoff {
+			backoff = r.maxBackoff
+		}
+	}
+}
+
+// isRetryable returns whether err is a transient error of the backend. If
+// retryable patterns are configured, only the errors matching one of them
+// are retried. Otherwise, all errors but the ones reporting an invalid
+// operation, such as a missing path or a 4xx status, are retried.
+func (r *retryStorageMiddleware) isRetryable(err error) bool {
+	if e, ok := err.(storagedriver.Error); ok {
+		err = e.Enclosed
+	}
+
+	switch err.(type) {
+	case storagedriver.PathNotFoundError, storagedriver.InvalidPathError,
+		storagedriver.InvalidOffsetError, storagedriver.ErrUnsupportedMethod:
+		return false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	if len(r.retryable) > 0 {
+		for _, re := range r.retryable {
+			if re.MatchString(err.Error()) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	// as reported by the errors of the aws and azure sdks
+	var statusErr interface{ StatusCode() int }
+	if errors.As(err, &statusErr) {
+		status := statusErr.StatusCode()
+		return status >= 500 || status == 408 || status == 429
+	}
+	return true
+}
+
+// breaker is a circuit breaker opening after threshold consecutive failures,
+// for timeout. Once the timeout elapsed, a single operation is let through,
+// closing the breaker if it succeeds.
+type breaker struct {
+	threshold int
+	timeout   time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newBreaker(threshold int, timeout time.Duration) *breaker {
+	return &breaker{
+		threshold: threshold,
+		timeout:   timeout,
+	}
+}
+
+// allow returns whether an operation may be attempted.
+func (b *breaker) allow() bool {
+	if b.threshold <= 0 {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.probing || time.Since(b.openedAt) < b.timeout {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func (b *breaker) success(ctx context.Context) {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures >= b.threshold {
+		dcontext.GetLogger(ctx).Infof("storage backend available, closing circuit breaker")
+	}
+	b.failures = 0
+	b.probing = false
+}
+
+func (b *breaker) failure(ctx context.Context) {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.failures >= b.threshold {
+		if !b.probing {
+			dcontext.GetLogger(ctx).Errorf("storage backend failed %d consecutive operations, opening circuit breaker for %s", b.failures, b.timeout)
+		}
+		b.openedAt = time.Now()
+		b.probing = false
+	}
+}
+
+func init() {
+	storagemiddleware.Register("retry", storagemiddleware.InitFunc(newRetryStorageMiddleware))
+}
@@ -0,0 +1,172 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+)
+
+// statusError reports an http status, like the errors of the cloud sdks.
+type statusError int
+
+func (e statusError) Error() string   { return "status error" }
+func (e statusError) StatusCode() int { return int(e) }
+
+// failingDriver fails the GetContent calls with the errors of errs, in
+// order, before calling the underlying driver.
+type failingDriver struct {
+	storagedriver.StorageDriver
+	errs  []error
+	calls int
+}
+
+func (d *failingDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	d.calls++
+	if len(d.errs) > 0 {
+		err := d.errs[0]
+		d.errs = d.errs[1:]
+		return nil, err
+	}
+	return d.StorageDriver.GetContent(ctx, path)
+}
+
+func newTestMiddleware(t *testing.T, d storagedriver.StorageDriver, options map[string]interface{}) *retryStorageMiddleware {
+	options["backoff"] = "1ms"
+	sd, err := newRetryStorageMiddleware(d, options)
+	if err != nil {
+		t.Fatalf("unexpected error creating middleware: %v", err)
+	}
+	return sd.(*retryStorageMiddleware)
+}
+
+func TestInvalidOptions(t *testing.T) {
+	for _, options := range []map[string]interface{}{
+		{"attempts": 0},
+		{"attempts": "three"},
+		{"backoff": "soon"},
+		{"retryable": "timeout"},
+		{"retryable": []interface{}{"("}},
+	} {
+		if _, err := newRetryStorageMiddleware(inmemory.New(), options); err == nil {
+			t.Errorf("expected an error with options %v", options)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	ctx := context.Background()
+	d := &failingDriver{StorageDriver: inmemory.New()}
+	if err := d.PutContent(ctx, "/foo", []byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+	r := newTestMiddleware(t, d, map[string]interface{}{"attempts": 3})
+
+	// transient errors are retried
+	d.errs = []error{statusError(503), storagedriver.Error{DriverName: "test", Enclosed: statusError(500)}}
+	content, err := r.GetContent(ctx, "/foo")
+	if err != nil || string(content) != "bar" {
+		t.Fatalf("unexpected result %q, %v", content, err)
+	}
+	if d.calls != 3 {
+		t.Fatalf("expected 3 calls, got %d", d.calls)
+	}
+
+	// up to the number of attempts
+	d.calls = 0
+	d.errs = []error{statusError(503), statusError(503), statusError(503), statusError(503)}
+	if _, err := r.GetContent(ctx, "/foo"); err != statusError(503) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if d.calls != 3 {
+		t.Fatalf("expected 3 calls, got %d", d.calls)
+	}
+
+	// invalid operations are not retried
+	for _, err := range []error{statusError(403), storagedriver.PathNotFoundError{Path: "/foo"}, context.Canceled} {
+		d.calls = 0
+		d.errs = []error{err}
+		if _, e := r.GetContent(ctx, "/foo"); e != err {
+			t.Fatalf("unexpected error %v, expected %v", e, err)
+		}
+		if d.calls != 1 {
+			t.Fatalf("expected error %v not to be retried, got %d calls", err, d.calls)
+		}
+	}
+}
+
+func TestRetryablePatterns(t *testing.T) {
+	ctx := context.Background()
+	d := &failingDriver{StorageDriver: inmemory.New()}
+	if err := d.PutContent(ctx, "/foo", []byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+	r := newTestMiddleware(t, d, map[string]interface{}{
+		"retryable": []interface{}{"SlowDown", "connection reset"},
+	})
+
+	d.errs = []error{errors.New("SlowDown: please reduce your request rate")}
+	if _, err := r.GetContent(ctx, "/foo"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	d.calls = 0
+	d.errs = []error{statusError(503)}
+	if _, err := r.GetContent(ctx, "/foo"); err != statusError(503) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if d.calls != 1 {
+		t.Fatalf("expected unmatched error not to be retried, got %d calls", d.calls)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	d := &failingDriver{StorageDriver: inmemory.New()}
+	if err := d.PutContent(ctx, "/foo", []byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+	r := newTestMiddleware(t, d, map[string]interface{}{
+		"attempts":         1,
+		"breakerthreshold": 2,
+		"breakertimeout":   "50ms",
+	})
+
+	d.errs = []error{statusError(500), statusError(500)}
+	for i := 0; i < 2; i++ {
+		if _, err := r.GetContent(ctx, "/foo"); err != statusError(500) {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+
+	// the backend is not called while the breaker is open
+	d.calls = 0
+	_, err := r.GetContent(ctx, "/foo")
+	if e, ok := err.(storagedriver.Error); !ok || e.Enclosed != ErrCircuitOpen {
+		t.Fatalf("expected the circuit to be open, got %v", err)
+	}
+	if d.calls != 0 {
+		t.Fatalf("expected no call to the backend, got %d", d.calls)
+	}
+
+	// a failed probe opens the breaker again
+	time.Sleep(60 * time.Millisecond)
+	d.errs = []error{statusError(500)}
+	if _, err := r.GetContent(ctx, "/foo"); err != statusError(500) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := r.GetContent(ctx, "/foo"); err == nil {
+		t.Fatal("expected the circuit to be open")
+	}
+
+	// a successful probe closes it
+	time.Sleep(60 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if _, err := r.GetContent(ctx, "/foo"); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+}
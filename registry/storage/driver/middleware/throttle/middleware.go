@@ -0,0 +1,289 @@
+// Package middleware - throttle wrapper for storage drivers, capping the
+// bandwidth and the operations per second of the registry on its backend, so
+// that a burst of large pulls can't saturate a shared NFS or SAN store.
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/ratelimit"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	storagemiddleware "github.com/distribution/distribution/v3/registry/storage/driver/middleware"
+)
+
+// instanceKey is the key of the buckets of the limits of the instance.
+const instanceKey = ""
+
+// throttleStorageMiddleware caps the bandwidth and the operations per second
+// of the storage driver, for the whole instance and for each request. The
+// requests are told apart by their ID, the operations outside of a request,
+// such as the garbage collection, are only subject to the limits of the
+// instance. A nil limiter does not limit anything.
+type throttleStorageMiddleware struct {
+	storagedriver.StorageDriver
+
+	// readBandwidth and writeBandwidth limit the bytes per second read from
+	// and written to the backend by the instance.
+	readBandwidth  *ratelimit.Limiter
+	writeBandwidth *ratelimit.Limiter
+	// requestBandwidth limits the bytes per second read and written by
+	// each request.
+	requestBandwidth *ratelimit.Limiter
+
+	// iops and requestIOPS limit the operations per second of the instance
+	// and of each request.
+	iops        *ratelimit.Limiter
+	requestIOPS *ratelimit.Limiter
+}
+
+var _ storagedriver.StorageDriver = &throttleStorageMiddleware{}
+
+// newThrottleStorageMiddleware constructs a throttle storage middleware.
+// Optional options: readbandwidth, writebandwidth, requestbandwidth, iops,
+// requestiops
+func newThrottleStorageMiddleware(sd storagedriver.StorageDriver, options map[string]interface{}) (storagedriver.StorageDriver, error) {
+	m := &throttleStorageMiddleware{StorageDriver: sd}
+	for _, limit := range []struct {
+		name    string
+		limiter **ratelimit.Limiter
+	}{
+		{name: "readbandwidth", limiter: &m.readBandwidth},
+		{name: "writebandwidth", limiter: &m.writeBandwidth},
+		{name: "requestbandwidth", limiter: &m.requestBandwidth},
+		{name: "iops", limiter: &m.iops},
+		{name: "requestiops", limiter: &m.requestIOPS},
+	} {
+		rate, err := rateOption(options, limit.name)
+		if err != nil {
+			return nil, err
+		}
+		if rate > 0 {
+			// the buckets hold a second of the rate
+			*limit.limiter = ratelimit.NewLimiter(float64(rate), rate)
+		}
+	}
+	if m.readBandwidth == nil && m.writeBandwidth == nil && m.requestBandwidth == nil && m.iops == nil && m.requestIOPS == nil {
+		return nil, fmt.Errorf("at least one of readbandwidth, writebandwidth, requestbandwidth, iops or requestiops must be set")
+	}
+	return m, nil
+}
+
+func rateOption(options map[string]interface{}, name string) (int, error) {
+	v, ok := options[name]
+	if !ok {
+		return 0, nil
+	}
+	var rate int
+	switch v := v.(type) {
+	case int:
+		rate = v
+	case int64:
+		rate = int(v)
+	case float64:
+		rate = int(v)
+	default:
+		return 0, fmt.Errorf("%s must be a number per second", name)
+	}
+	if rate < 0 {
+		return 0, fmt.Errorf("%s must not be negative", name)
+	}
+	return rate, nil
+}
+
+// operation waits for an operation to be allowed by the iops limits.
+func (m *throttleStorageMiddleware) operation(ctx context.Context) error {
+	if m.iops != nil {
+		if err := m.iops.Wait(ctx, instanceKey); err != nil {
+			return err
+		}
+	}
+	if id := dcontext.GetRequestID(ctx); m.requestIOPS != nil && id != "" {
+		if err := m.requestIOPS.Wait(ctx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// transfer waits for n bytes to be allowed by instance, the bandwidth limit
+// of the instance in the direction of the transfer, and by the bandwidth
+// limit of the request.
+func (m *throttleStorageMiddleware) transfer(ctx context.Context, instance *ratelimit.Limiter, n int) error {
+	id := dcontext.GetRequestID(ctx)
+	for n > 0 {
+		chunk := m.chunkSize(instance, n)
+		if instance != nil {
+			if err := instance.WaitN(ctx, instanceKey, chunk); err != nil {
+				return err
+			}
+		}
+		if m.requestBandwidth != nil && id != "" {
+			if err := m.requestBandwidth.WaitN(ctx, id, chunk); err != nil {
+				return err
+			}
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// chunkSize returns the size of the next chunk of a transfer of n bytes,
+// which the buckets of the bandwidth limits can hold.
+func (m *throttleStorageMiddleware) chunkSize(instance *ratelimit.Limiter, n int) int {
+	for _, l := range []*ratelimit.Limiter{instance, m.requestBandwidth} {
+		if l != nil && l.Burst() < n {
+			n = l.Burst()
+		}
+	}
+	return n
+}
+
+// GetContent throttles storagedriver.StorageDriver.GetContent.
+func (m *throttleStorageMiddleware) GetContent(ctx context.Context, path string) ([]byte, error) {
+	if err := m.operation(ctx); err != nil {
+		return nil, err
+	}
+	content, err := m.StorageDriver.GetContent(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.transfer(ctx, m.readBandwidth, len(content)); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// PutContent throttles storagedriver.StorageDriver.PutContent.
+func (m *throttleStorageMiddleware) PutContent(ctx context.Context, path string, content []byte) error {
+	if err := m.operation(ctx); err != nil {
+		return err
+	}
+	if err := m.transfer(ctx, m.writeBandwidth, len(content)); err != nil {
+		return err
+	}
+	return m.StorageDriver.PutContent(ctx, path, content)
+}
+
+// Reader returns a reader throttled by the read bandwidth limits.
+func (m *throttleStorageMiddleware) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	if err := m.operation(ctx); err != nil {
+		return nil, err
+	}
+	rc, err := m.StorageDriver.Reader(ctx, path, offset)
+	if err != nil {
+		return nil, err
+	}
+	if m.readBandwidth == nil && m.requestBandwidth == nil {
+		return rc, nil
+	}
+	return &throttledReader{ReadCloser: rc, ctx: ctx, m: m}, nil
+}
+
+// Writer returns a writer throttled by the write bandwidth limits.
+func (m *throttleStorageMiddleware) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	if err := m.operation(ctx); err != nil {
+		return nil, err
+	}
+	fw, err := m.StorageDriver.Writer(ctx, path, append)
+	if err != nil {
+		return nil, err
+	}
+	if m.writeBandwidth == nil && m.requestBandwidth == nil {
+		return fw, nil
+	}
+	return &throttledWriter{FileWriter: fw, ctx: ctx, m: m}, nil
+}
+
+// Stat throttles storagedriver.StorageDriver.Stat.
+func (m *throttleStorageMiddleware) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	if err := m.operation(ctx); err != nil {
+		return nil, err
+	}
+	return m.StorageDriver.Stat(ctx, path)
+}
+
+// List throttles storagedriver.StorageDriver.List.
+func (m *throttleStorageMiddleware) List(ctx context.Context, path string) ([]string, error) {
+	if err := m.operation(ctx); err != nil {
+		return nil, err
+	}
+	return m.StorageDriver.List(ctx, path)
+}
+
+// Move throttles storagedriver.StorageDriver.Move.
+func (m *throttleStorageMiddleware) Move(ctx context.Context, sourcePath string, destPath string) error {
+	if err := m.operation(ctx); err != nil {
+		return err
+	}
+	return m.StorageDriver.Move(ctx, sourcePath, destPath)
+}
+
+// Delete throttles storagedriver.StorageDriver.Delete.
+func (m *throttleStorageMiddleware) Delete(ctx context.Context, path string) error {
+	if err := m.operation(ctx); err != nil {
+		return err
+	}
+	return m.StorageDriver.Delete(ctx, path)
+}
+
+// Walk throttles storagedriver.StorageDriver.Walk, as a single operation.
+func (m *throttleStorageMiddleware) Walk(ctx context.Context, path string, f storagedriver.WalkFn) error {
+	if err := m.operation(ctx); err != nil {
+		return err
+	}
+	return m.StorageDriver.Walk(ctx, path, f)
+}
+
+// throttledReader waits for the bytes read to be allowed by the bandwidth
+// limits before returning them.
+type throttledReader struct {
+	io.ReadCloser
+	ctx context.Context
+	m   *throttleStorageMiddleware
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	// read at most a chunk, so that the bytes read are allowed at once
+	if chunk := r.m.chunkSize(r.m.readBandwidth, len(p)); chunk < len(p) {
+		p = p[:chunk]
+	}
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		if werr := r.m.transfer(r.ctx, r.m.readBandwidth, n); werr != nil {
+			return 0, werr
+		}
+	}
+	return n, err
+}
+
+// throttledWriter waits for the bytes to be allowed by the bandwidth limits
+// before writing them.
+type throttledWriter struct {
+	storagedriver.FileWriter
+	ctx context.Context
+	m   *throttleStorageMiddleware
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := w.m.chunkSize(w.m.writeBandwidth, len(p))
+		if err := w.m.transfer(w.ctx, w.m.writeBandwidth, chunk); err != nil {
+			return written, err
+		}
+		n, err := w.FileWriter.Write(p[:chunk])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[chunk:]
+	}
+	return written, nil
+}
+
+func init() {
+	storagemiddleware.Register("throttle", storagemiddleware.InitFunc(newThrottleStorageMiddleware))
+}
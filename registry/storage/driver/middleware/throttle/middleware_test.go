@@ -0,0 +1,138 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+)
+
+func newTestMiddleware(t *testing.T, options map[string]interface{}) storagedriver.StorageDriver {
+	sd, err := newThrottleStorageMiddleware(inmemory.New(), options)
+	if err != nil {
+		t.Fatalf("unexpected error creating middleware: %v", err)
+	}
+	return sd
+}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return dcontext.WithValues(ctx, map[string]interface{}{"http.request.id": id})
+}
+
+func TestInvalidOptions(t *testing.T) {
+	for _, options := range []map[string]interface{}{
+		{},
+		{"readbandwidth": 0},
+		{"readbandwidth": "fast"},
+		{"iops": -1},
+	} {
+		if _, err := newThrottleStorageMiddleware(inmemory.New(), options); err == nil {
+			t.Errorf("expected an error with options %v", options)
+		}
+	}
+}
+
+func TestReadBandwidth(t *testing.T) {
+	ctx := context.Background()
+	sd := newTestMiddleware(t, map[string]interface{}{"readbandwidth": 1 << 20})
+	content := bytes.Repeat([]byte("a"), 3<<19)
+	if err := sd.PutContent(ctx, "/blob", content); err != nil {
+		t.Fatal(err)
+	}
+
+	// the burst of a second is read at once, then the remaining half
+	// second of the rate
+	start := time.Now()
+	rc, err := sd.Reader(ctx, "/blob", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil || !bytes.Equal(read, content) {
+		t.Fatalf("unexpected read of %d bytes: %v", len(read), err)
+	}
+	if elapsed := time.Since(start); elapsed < 450*time.Millisecond {
+		t.Errorf("read %d bytes in %v", len(read), elapsed)
+	}
+
+	// writes are not limited by the read bandwidth
+	start = time.Now()
+	if err := sd.PutContent(ctx, "/other", content); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("wrote %d bytes in %v", len(content), elapsed)
+	}
+}
+
+func TestRequestBandwidth(t *testing.T) {
+	ctx := context.Background()
+	sd := newTestMiddleware(t, map[string]interface{}{"requestbandwidth": 1 << 20})
+	content := bytes.Repeat([]byte("a"), 1<<20)
+
+	write := func(ctx context.Context, path string) time.Duration {
+		t.Helper()
+		start := time.Now()
+		fw, err := sd.Writer(ctx, path, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fw.Write(content); err != nil {
+			t.Fatal(err)
+		}
+		if err := fw.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		fw.Close()
+		return time.Since(start)
+	}
+
+	// the first write of a request takes its burst
+	a := withRequestID(ctx, "a")
+	if elapsed := write(a, "/a1"); elapsed > 200*time.Millisecond {
+		t.Errorf("first write of the request took %v", elapsed)
+	}
+	if elapsed := write(a, "/a2"); elapsed < 900*time.Millisecond {
+		t.Errorf("second write of the request took %v", elapsed)
+	}
+
+	// other requests, and the operations outside of a request, have their
+	// own limit
+	if elapsed := write(withRequestID(ctx, "b"), "/b"); elapsed > 200*time.Millisecond {
+		t.Errorf("write of another request took %v", elapsed)
+	}
+	if elapsed := write(ctx, "/c"); elapsed > 200*time.Millisecond {
+		t.Errorf("write outside of a request took %v", elapsed)
+	}
+}
+
+func TestIOPS(t *testing.T) {
+	ctx := context.Background()
+	sd := newTestMiddleware(t, map[string]interface{}{"iops": 20})
+	if err := sd.PutContent(ctx, "/foo", []byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the burst of a second, less the put, then one operation every 50ms
+	start := time.Now()
+	for i := 0; i < 24; i++ {
+		if _, err := sd.Stat(ctx, "/foo"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("24 operations took %v", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := sd.Stat(ctx, "/foo"); err != context.Canceled {
+		t.Errorf("unexpected error of a cancelled operation: %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+//go:build include_oss
+// +build include_oss
+
+package oss
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// credentialsRefreshWindow is how long before their expiration temporary
+// credentials are refreshed.
+const credentialsRefreshWindow = 5 * time.Minute
+
+// ramRoleCredentialsURL is the URL of the ECS metadata service serving the
+// STS credentials of the RAM roles attached to the instance.
+var ramRoleCredentialsURL = "http://100.100.100.200/latest/meta-data/ram/security-credentials/"
+
+// credentials are the credentials the driver accesses OSS with, either
+// static or STS credentials.
+type credentials struct {
+	AccessKeyID     string
+	AccessKeySecret string
+	SecurityToken   string
+	// Expiration is the time the STS credentials of a RAM role expire.
+	Expiration time.Time
+}
+
+// fetchRAMRoleCredentials returns the STS credentials of the RAM role from
+// the ECS metadata service.
+func fetchRAMRoleCredentials(role string) (credentials, error) {
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(ramRoleCredentialsURL + url.PathEscape(role))
+	if err != nil {
+		return credentials{}, fmt.Errorf("failed to fetch the credentials of RAM role %s: %v", role, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return credentials{}, fmt.Errorf("failed to fetch the credentials of RAM role %s: unexpected status %s", role, resp.Status)
+	}
+
+	var body struct {
+		Code            string
+		AccessKeyID     string `json:"AccessKeyId"`
+		AccessKeySecret string
+		SecurityToken   string
+		Expiration      string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return credentials{}, fmt.Errorf("failed to decode the credentials of RAM role %s: %v", role, err)
+	}
+	if body.Code != "Success" {
+		return credentials{}, fmt.Errorf("failed to fetch the credentials of RAM role %s: %s", role, body.Code)
+	}
+
+	expiration, err := time.Parse(time.RFC3339, body.Expiration)
+	if err != nil {
+		return credentials{}, fmt.Errorf("invalid expiration of the credentials of RAM role %s: %v", role, err)
+	}
+
+	return credentials{
+		AccessKeyID:     body.AccessKeyID,
+		AccessKeySecret: body.AccessKeySecret,
+		SecurityToken:   body.SecurityToken,
+		Expiration:      expiration,
+	}, nil
+}
@@ -18,13 +18,17 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/denverdino/aliyungo/oss"
+	dcontext "github.com/distribution/distribution/v3/context"
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/distribution/distribution/v3/registry/storage/driver/base"
 	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
@@ -43,19 +47,31 @@ const defaultTimeout = 2 * time.Minute // 2 minute timeout per chunk
 // listMax is the largest amount of objects you can request from OSS in a list call
 const listMax = 1000
 
+// Signature versions of the URLs generated by URLFor.
+const (
+	signatureV1 = "v1"
+	signatureV4 = "v4"
+)
+
 //DriverParameters A struct that encapsulates all of the driver parameters after all values have been set
 type DriverParameters struct {
 	AccessKeyID     string
 	AccessKeySecret string
+	SecurityToken   string
+	RAMRole         string
 	Bucket          string
 	Region          oss.Region
 	Internal        bool
+	InternalCIDRs   []*net.IPNet
 	Encrypt         bool
 	Secure          bool
 	ChunkSize       int64
 	RootDirectory   string
 	Endpoint        string
 	EncryptionKeyID string
+	// SignatureVersion is the version of the signature of the URLs
+	// generated by URLFor, v1 or v4.
+	SignatureVersion string
 }
 
 func init() {
@@ -70,12 +86,24 @@ func (factory *ossDriverFactory) Create(parameters map[string]interface{}) (stor
 }
 
 type driver struct {
-	Client          *oss.Client
-	Bucket          *oss.Bucket
-	ChunkSize       int64
-	Encrypt         bool
-	RootDirectory   string
-	EncryptionKeyID string
+	BucketName       string
+	Region           oss.Region
+	Internal         bool
+	InternalCIDRs    []*net.IPNet
+	Secure           bool
+	Endpoint         string
+	ChunkSize        int64
+	Encrypt          bool
+	RootDirectory    string
+	EncryptionKeyID  string
+	SignatureVersion string
+	RAMRole          string
+
+	// mu protects the credentials, which are refreshed when they come from
+	// a RAM role, and the bucket using them.
+	mu          sync.Mutex
+	credentials credentials
+	bucket      *oss.Bucket
 }
 
 type baseEmbed struct {
@@ -90,21 +118,35 @@ type Driver struct {
 
 // FromParameters constructs a new Driver with a given parameters map
 // Required parameters:
-// - accesskey
-// - secretkey
+// - accesskey, unless ramrole is set
+// - secretkey, unless ramrole is set
 // - region
 // - bucket
 // - encrypt
 func FromParameters(parameters map[string]interface{}) (*Driver, error) {
-	// Providing no values for these is valid in case the user is authenticating
+	ramRole, ok := parameters["ramrole"]
+	if !ok {
+		ramRole = ""
+	}
 
 	accessKey, ok := parameters["accesskeyid"]
 	if !ok {
-		return nil, fmt.Errorf("No accesskeyid parameter provided")
+		if ramRole == "" {
+			return nil, fmt.Errorf("No accesskeyid parameter provided")
+		}
+		accessKey = ""
 	}
 	secretKey, ok := parameters["accesskeysecret"]
 	if !ok {
-		return nil, fmt.Errorf("No accesskeysecret parameter provided")
+		if ramRole == "" {
+			return nil, fmt.Errorf("No accesskeysecret parameter provided")
+		}
+		secretKey = ""
+	}
+
+	securityToken, ok := parameters["securitytoken"]
+	if !ok {
+		securityToken = ""
 	}
 
 	regionName, ok := parameters["region"]
@@ -182,50 +224,119 @@ func FromParameters(parameters map[string]interface{}) (*Driver, error) {
 		endpoint = ""
 	}
 
+	var internalCIDRs []*net.IPNet
+	if cidrs, ok := parameters["internalcidrs"]; ok {
+		var err error
+		internalCIDRs, err = parseCIDRs(cidrs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	signatureVersion := signatureV1
+	if version, ok := parameters["signatureversion"]; ok {
+		signatureVersion = fmt.Sprint(version)
+		if signatureVersion != signatureV1 && signatureVersion != signatureV4 {
+			return nil, fmt.Errorf("The signatureversion parameter should be %s or %s, not %q", signatureV1, signatureV4, signatureVersion)
+		}
+	}
+
 	params := DriverParameters{
-		AccessKeyID:     fmt.Sprint(accessKey),
-		AccessKeySecret: fmt.Sprint(secretKey),
-		Bucket:          fmt.Sprint(bucket),
-		Region:          oss.Region(fmt.Sprint(regionName)),
-		ChunkSize:       chunkSize,
-		RootDirectory:   fmt.Sprint(rootDirectory),
-		Encrypt:         encryptBool,
-		Secure:          secureBool,
-		Internal:        internalBool,
-		Endpoint:        fmt.Sprint(endpoint),
-		EncryptionKeyID: fmt.Sprint(encryptionKeyID),
+		AccessKeyID:      fmt.Sprint(accessKey),
+		AccessKeySecret:  fmt.Sprint(secretKey),
+		SecurityToken:    fmt.Sprint(securityToken),
+		RAMRole:          fmt.Sprint(ramRole),
+		Bucket:           fmt.Sprint(bucket),
+		Region:           oss.Region(fmt.Sprint(regionName)),
+		ChunkSize:        chunkSize,
+		RootDirectory:    fmt.Sprint(rootDirectory),
+		Encrypt:          encryptBool,
+		Secure:           secureBool,
+		Internal:         internalBool,
+		InternalCIDRs:    internalCIDRs,
+		Endpoint:         fmt.Sprint(endpoint),
+		EncryptionKeyID:  fmt.Sprint(encryptionKeyID),
+		SignatureVersion: signatureVersion,
 	}
 
 	return New(params)
 }
 
+// parseCIDRs parses a list of CIDRs, or a comma separated string of CIDRs.
+func parseCIDRs(param interface{}) ([]*net.IPNet, error) {
+	var cidrs []string
+	switch v := param.(type) {
+	case string:
+		for _, cidr := range strings.Split(v, ",") {
+			if cidr = strings.TrimSpace(cidr); cidr != "" {
+				cidrs = append(cidrs, cidr)
+			}
+		}
+	case []interface{}:
+		for _, cidr := range v {
+			cidrs = append(cidrs, fmt.Sprint(cidr))
+		}
+	default:
+		return nil, fmt.Errorf("The internalcidrs parameter should be a list of CIDRs")
+	}
+
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("The internalcidrs parameter contains an invalid CIDR: %v", err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
 // New constructs a new Driver with the given Aliyun credentials, region, encryption flag, and
 // bucketName
 func New(params DriverParameters) (*Driver, error) {
+	if params.SignatureVersion == "" {
+		params.SignatureVersion = signatureV1
+	}
 
-	client := oss.NewOSSClient(params.Region, params.Internal, params.AccessKeyID, params.AccessKeySecret, params.Secure)
-	client.SetEndpoint(params.Endpoint)
-	bucket := client.Bucket(params.Bucket)
-	client.SetDebug(false)
+	d := &driver{
+		BucketName:       params.Bucket,
+		Region:           params.Region,
+		Internal:         params.Internal,
+		InternalCIDRs:    params.InternalCIDRs,
+		Secure:           params.Secure,
+		Endpoint:         params.Endpoint,
+		ChunkSize:        params.ChunkSize,
+		Encrypt:          params.Encrypt,
+		RootDirectory:    params.RootDirectory,
+		EncryptionKeyID:  params.EncryptionKeyID,
+		SignatureVersion: params.SignatureVersion,
+		RAMRole:          params.RAMRole,
+	}
+
+	if params.RAMRole != "" {
+		creds, err := fetchRAMRoleCredentials(params.RAMRole)
+		if err != nil {
+			return nil, err
+		}
+		d.credentials = creds
+	} else {
+		d.credentials = credentials{
+			AccessKeyID:     params.AccessKeyID,
+			AccessKeySecret: params.AccessKeySecret,
+			SecurityToken:   params.SecurityToken,
+		}
+	}
+	d.bucket = d.newBucket(d.credentials, d.Internal)
 
 	// Validate that the given credentials have at least read permissions in the
 	// given bucket scope.
-	if _, err := bucket.List(strings.TrimRight(params.RootDirectory, "/"), "", "", 1); err != nil {
+	if _, err := d.bucket.List(strings.TrimRight(params.RootDirectory, "/"), "", "", 1); err != nil {
 		return nil, err
 	}
 
 	// TODO(tg123): Currently multipart uploads have no timestamps, so this would be unwise
 	// if you initiated a new OSS client while another one is running on the same bucket.
 
-	d := &driver{
-		Client:          client,
-		Bucket:          bucket,
-		ChunkSize:       params.ChunkSize,
-		Encrypt:         params.Encrypt,
-		RootDirectory:   params.RootDirectory,
-		EncryptionKeyID: params.EncryptionKeyID,
-	}
-
 	return &Driver{
 		baseEmbed: baseEmbed{
 			Base: base.Base{
@@ -243,7 +354,7 @@ func (d *driver) Name() string {
 
 // GetContent retrieves the content stored at "path" as a []byte.
 func (d *driver) GetContent(ctx context.Context, path string) ([]byte, error) {
-	content, err := d.Bucket.Get(d.ossPath(path))
+	content, err := d.currentBucket().Get(d.ossPath(path))
 	if err != nil {
 		return nil, parseError(path, err)
 	}
@@ -252,7 +363,7 @@ func (d *driver) GetContent(ctx context.Context, path string) ([]byte, error) {
 
 // PutContent stores the []byte content at a location designated by "path".
 func (d *driver) PutContent(ctx context.Context, path string, contents []byte) error {
-	return parseError(path, d.Bucket.Put(d.ossPath(path), contents, d.getContentType(), getPermissions(), d.getOptions()))
+	return parseError(path, d.currentBucket().Put(d.ossPath(path), contents, d.getContentType(), getPermissions(), d.getOptions()))
 }
 
 // Reader retrieves an io.ReadCloser for the content stored at "path" with a
@@ -261,7 +372,7 @@ func (d *driver) Reader(ctx context.Context, path string, offset int64) (io.Read
 	headers := make(http.Header)
 	headers.Add("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
 
-	resp, err := d.Bucket.GetResponseWithHeaders(d.ossPath(path), headers)
+	resp, err := d.currentBucket().GetResponseWithHeaders(d.ossPath(path), headers)
 	if err != nil {
 		return nil, parseError(path, err)
 	}
@@ -284,13 +395,13 @@ func (d *driver) Writer(ctx context.Context, path string, append bool) (storaged
 	key := d.ossPath(path)
 	if !append {
 		// TODO (brianbland): cancel other uploads at this path
-		multi, err := d.Bucket.InitMulti(key, d.getContentType(), getPermissions(), d.getOptions())
+		multi, err := d.currentBucket().InitMulti(key, d.getContentType(), getPermissions(), d.getOptions())
 		if err != nil {
 			return nil, err
 		}
 		return d.newWriter(key, multi, nil), nil
 	}
-	multis, _, err := d.Bucket.ListMulti(key, "")
+	multis, _, err := d.currentBucket().ListMulti(key, "")
 	if err != nil {
 		return nil, parseError(path, err)
 	}
@@ -314,7 +425,7 @@ func (d *driver) Writer(ctx context.Context, path string, append bool) (storaged
 // Stat retrieves the FileInfo for the given path, including the current size
 // in bytes and the creation time.
 func (d *driver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
-	listResponse, err := d.Bucket.List(d.ossPath(path), "", "", 1)
+	listResponse, err := d.currentBucket().List(d.ossPath(path), "", "", 1)
 	if err != nil {
 		return nil, err
 	}
@@ -361,7 +472,7 @@ func (d *driver) List(ctx context.Context, opath string) ([]string, error) {
 	}
 
 	ossPath := d.ossPath(path)
-	listResponse, err := d.Bucket.List(ossPath, "/", "", listMax)
+	listResponse, err := d.currentBucket().List(ossPath, "/", "", listMax)
 	if err != nil {
 		return nil, parseError(opath, err)
 	}
@@ -379,7 +490,7 @@ func (d *driver) List(ctx context.Context, opath string) ([]string, error) {
 		}
 
 		if listResponse.IsTruncated {
-			listResponse, err = d.Bucket.List(ossPath, "/", listResponse.NextMarker, listMax)
+			listResponse, err = d.currentBucket().List(ossPath, "/", listResponse.NextMarker, listMax)
 			if err != nil {
 				return nil, err
 			}
@@ -410,7 +521,7 @@ const maxConcurrency = 10
 // object.
 func (d *driver) Move(ctx context.Context, sourcePath string, destPath string) error {
 	logrus.Infof("Move from %s to %s", d.ossPath(sourcePath), d.ossPath(destPath))
-	err := d.Bucket.CopyLargeFileInParallel(d.ossPath(sourcePath), d.ossPath(destPath),
+	err := d.currentBucket().CopyLargeFileInParallel(d.ossPath(sourcePath), d.ossPath(destPath),
 		d.getContentType(),
 		getPermissions(),
 		d.getOptions(),
@@ -426,7 +537,7 @@ func (d *driver) Move(ctx context.Context, sourcePath string, destPath string) e
 // Delete recursively deletes all objects stored at "path" and its subpaths.
 func (d *driver) Delete(ctx context.Context, path string) error {
 	ossPath := d.ossPath(path)
-	listResponse, err := d.Bucket.List(ossPath, "", "", listMax)
+	listResponse, err := d.currentBucket().List(ossPath, "", "", listMax)
 	if err != nil || len(listResponse.Contents) == 0 {
 		return storagedriver.PathNotFoundError{Path: path}
 	}
@@ -444,7 +555,7 @@ func (d *driver) Delete(ctx context.Context, path string) error {
 			ossObjects[index].Key = key.Key
 		}
 
-		err := d.Bucket.DelMulti(oss.Delete{Quiet: false, Objects: ossObjects[0:numOssObjects]})
+		err := d.currentBucket().DelMulti(oss.Delete{Quiet: false, Objects: ossObjects[0:numOssObjects]})
 		if err != nil {
 			return nil
 		}
@@ -453,7 +564,7 @@ func (d *driver) Delete(ctx context.Context, path string) error {
 			return nil
 		}
 
-		listResponse, err = d.Bucket.List(d.ossPath(path), "", "", listMax)
+		listResponse, err = d.currentBucket().List(d.ossPath(path), "", "", listMax)
 		if err != nil {
 			return err
 		}
@@ -483,10 +594,82 @@ func (d *driver) URLFor(ctx context.Context, path string, options map[string]int
 			expiresTime = et
 		}
 	}
-	logrus.Infof("methodString: %s, expiresTime: %v", methodString, expiresTime)
-	signedURL := d.Bucket.SignedURLWithMethod(methodString, d.ossPath(path), expiresTime, nil, nil)
-	logrus.Infof("signed URL: %s", signedURL)
-	return signedURL, nil
+
+	_, creds := d.current()
+	internal := d.internalRedirect(ctx)
+	if d.SignatureVersion == signatureV4 {
+		return d.signURLV4(methodString, d.ossPath(path), creds, internal, time.Now(), expiresTime), nil
+	}
+
+	var params url.Values
+	if creds.SecurityToken != "" {
+		params = url.Values{"security-token": []string{creds.SecurityToken}}
+	}
+	return d.newBucket(creds, internal).SignedURLWithMethod(methodString, d.ossPath(path), expiresTime, params, nil), nil
+}
+
+// internalRedirect returns whether the URLs generated for the client of the
+// request target the internal endpoint of the region: if internal CIDRs are
+// configured, only the clients in them are redirected to it, otherwise the
+// endpoint of the driver is used. The address of the client is the one
+// resolved by the registry from its trusted proxies, as any client may set
+// the proxy headers.
+func (d *driver) internalRedirect(ctx context.Context) bool {
+	if len(d.InternalCIDRs) == 0 {
+		return d.Internal
+	}
+
+	ip := net.ParseIP(dcontext.ClientIP(ctx))
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range d.InternalCIDRs {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// newBucket returns the bucket of the driver accessed with the given
+// credentials, on the internal or public endpoint of the region. The
+// configured endpoint replaces the one the driver is configured to use.
+func (d *driver) newBucket(creds credentials, internal bool) *oss.Bucket {
+	var client *oss.Client
+	if creds.SecurityToken != "" {
+		client = oss.NewOSSClientForAssumeRole(d.Region, internal, creds.AccessKeyID, creds.AccessKeySecret, creds.SecurityToken, d.Secure)
+	} else {
+		client = oss.NewOSSClient(d.Region, internal, creds.AccessKeyID, creds.AccessKeySecret, d.Secure)
+	}
+	if internal == d.Internal {
+		client.SetEndpoint(d.Endpoint)
+	}
+	client.SetDebug(false)
+	return client.Bucket(d.BucketName)
+}
+
+// current returns the bucket of the driver and its credentials, refreshing
+// the credentials of the RAM role before they expire.
+func (d *driver) current() (*oss.Bucket, credentials) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.RAMRole != "" && time.Until(d.credentials.Expiration) < credentialsRefreshWindow {
+		creds, err := fetchRAMRoleCredentials(d.RAMRole)
+		if err != nil {
+			// the current credentials may still be valid for a while
+			logrus.Errorf("error refreshing the credentials of RAM role %s: %v", d.RAMRole, err)
+		} else {
+			d.credentials = creds
+			d.bucket = d.newBucket(creds, d.Internal)
+		}
+	}
+	return d.bucket, d.credentials
+}
+
+func (d *driver) currentBucket() *oss.Bucket {
+	bucket, _ := d.current()
+	return bucket
 }
 
 // Walk traverses a filesystem defined within driver, starting
@@ -574,6 +757,10 @@ func (w *writer) Write(p []byte) (int, error) {
 		return 0, fmt.Errorf("already cancelled")
 	}
 
+	// the credentials of the driver may have been refreshed since the upload
+	// was started
+	w.multi.Bucket = w.driver.currentBucket()
+
 	// If the last written part is smaller than minChunkSize, we need to make a
 	// new multipart upload :sadface:
 	if len(w.parts) > 0 && int(w.parts[len(w.parts)-1].Size) < minChunkSize {
@@ -583,7 +770,7 @@ func (w *writer) Write(p []byte) (int, error) {
 			return 0, err
 		}
 
-		multi, err := w.driver.Bucket.InitMulti(w.key, w.driver.getContentType(), getPermissions(), w.driver.getOptions())
+		multi, err := w.driver.currentBucket().InitMulti(w.key, w.driver.getContentType(), getPermissions(), w.driver.getOptions())
 		if err != nil {
 			return 0, err
 		}
@@ -592,7 +779,7 @@ func (w *writer) Write(p []byte) (int, error) {
 		// If the entire written file is smaller than minChunkSize, we need to make
 		// a new part from scratch :double sad face:
 		if w.size < minChunkSize {
-			contents, err := w.driver.Bucket.Get(w.key)
+			contents, err := w.driver.currentBucket().Get(w.key)
 			if err != nil {
 				return 0, err
 			}
@@ -600,7 +787,7 @@ func (w *writer) Write(p []byte) (int, error) {
 			w.readyPart = contents
 		} else {
 			// Otherwise we can use the old file as the new first part
-			_, part, err := multi.PutPartCopy(1, w.driver.getCopyOptions(), w.driver.Bucket.Name+"/"+w.key)
+			_, part, err := multi.PutPartCopy(1, w.driver.getCopyOptions(), w.driver.BucketName+"/"+w.key)
 			if err != nil {
 				return 0, err
 			}
@@ -664,6 +851,7 @@ func (w *writer) Cancel() error {
 		return fmt.Errorf("already committed")
 	}
 	w.cancelled = true
+	w.multi.Bucket = w.driver.currentBucket()
 	err := w.multi.Abort()
 	return err
 }
@@ -681,6 +869,7 @@ func (w *writer) Commit() error {
 		return err
 	}
 	w.committed = true
+	w.multi.Bucket = w.driver.currentBucket()
 	err = w.multi.Complete(w.parts)
 	if err != nil {
 		w.multi.Abort()
@@ -703,6 +892,7 @@ func (w *writer) flushPart() error {
 		w.pendingPart = nil
 	}
 
+	w.multi.Bucket = w.driver.currentBucket()
 	part, err := w.multi.PutPart(len(w.parts)+1, bytes.NewReader(w.readyPart))
 	if err != nil {
 		return err
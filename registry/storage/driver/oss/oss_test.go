@@ -4,10 +4,16 @@
 package oss
 
 import (
+	"fmt"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"strconv"
 	"testing"
+	"time"
 
 	alioss "github.com/denverdino/aliyungo/oss"
 	"github.com/distribution/distribution/v3/context"
@@ -143,3 +149,180 @@ func TestEmptyRootList(t *testing.T) {
 		}
 	}
 }
+
+func TestURLForEndpoints(t *testing.T) {
+	_, internalNet, _ := net.ParseCIDR("172.16.0.0/12")
+	d := &driver{
+		BucketName:       "registry",
+		Region:           alioss.Hangzhou,
+		Secure:           true,
+		InternalCIDRs:    []*net.IPNet{internalNet},
+		SignatureVersion: signatureV1,
+		credentials: credentials{
+			AccessKeyID:     "ak",
+			AccessKeySecret: "sk",
+			SecurityToken:   "token",
+		},
+	}
+
+	for _, tc := range []struct {
+		remoteAddr   string
+		forwardedFor string
+		clientIP     string
+		version      string
+		host         string
+	}{
+		{"172.16.3.4:1234", "", "", signatureV1, "registry.oss-cn-hangzhou-internal.aliyuncs.com"},
+		{"8.8.8.8:1234", "", "", signatureV1, "registry.oss-cn-hangzhou.aliyuncs.com"},
+		{"172.16.3.4:1234", "", "", signatureV4, "registry.oss-cn-hangzhou-internal.aliyuncs.com"},
+		{"8.8.8.8:1234", "", "", signatureV4, "registry.oss-cn-hangzhou.aliyuncs.com"},
+		// the proxy headers of the clients are ignored
+		{"8.8.8.8:1234", "172.16.3.4", "", signatureV1, "registry.oss-cn-hangzhou.aliyuncs.com"},
+		// the address resolved by the registry from its trusted proxies
+		{"10.0.0.1:1234", "172.16.3.4", "172.16.3.4", signatureV1, "registry.oss-cn-hangzhou-internal.aliyuncs.com"},
+	} {
+		d.SignatureVersion = tc.version
+		req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+		req.RemoteAddr = tc.remoteAddr
+		if tc.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", tc.forwardedFor)
+		}
+		ctx := context.WithRequest(context.Background(), req)
+		if tc.clientIP != "" {
+			ctx = context.WithClientIP(ctx, tc.clientIP)
+		}
+
+		signedURL, err := d.URLFor(ctx, "/docker/registry/v2/blobs/data", nil)
+		if err != nil {
+			t.Fatalf("unexpected error generating url: %v", err)
+		}
+		u, err := url.Parse(signedURL)
+		if err != nil {
+			t.Fatalf("unexpected error parsing url %s: %v", signedURL, err)
+		}
+		if u.Host != tc.host || u.Path != "/docker/registry/v2/blobs/data" {
+			t.Errorf("%s %s: unexpected url %s", tc.remoteAddr, tc.version, signedURL)
+		}
+
+		query := u.Query()
+		switch tc.version {
+		case signatureV1:
+			if query.Get("OSSAccessKeyId") != "ak" || query.Get("Signature") == "" || query.Get("security-token") != "token" {
+				t.Errorf("%s: unexpected v1 signed url %s", tc.remoteAddr, signedURL)
+			}
+		case signatureV4:
+			if query.Get("x-oss-signature-version") != "OSS4-HMAC-SHA256" || query.Get("x-oss-signature") == "" || query.Get("x-oss-security-token") != "token" {
+				t.Errorf("%s: unexpected v4 signed url %s", tc.remoteAddr, signedURL)
+			}
+		}
+	}
+}
+
+func TestSignURLV4(t *testing.T) {
+	d := &driver{
+		BucketName: "examplebucket",
+		Region:     alioss.Region("oss-cn-hangzhou"),
+		Secure:     true,
+	}
+	creds := credentials{AccessKeyID: "ak", AccessKeySecret: "sk"}
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	signedURL := d.signURLV4("GET", "path/to/some file", creds, false, now, now.Add(30*24*time.Hour))
+	u, err := url.Parse(signedURL)
+	if err != nil {
+		t.Fatalf("unexpected error parsing url %s: %v", signedURL, err)
+	}
+	if u.Host != "examplebucket.oss-cn-hangzhou.aliyuncs.com" || u.EscapedPath() != "/path/to/some%20file" {
+		t.Fatalf("unexpected url %s", signedURL)
+	}
+
+	query := u.Query()
+	for param, expected := range map[string]string{
+		"x-oss-credential": "ak/20240102/cn-hangzhou/oss/aliyun_v4_request",
+		"x-oss-date":       "20240102T030405Z",
+		"x-oss-expires":    "604800",
+	} {
+		if query.Get(param) != expected {
+			t.Errorf("expected %s to be %q, got %q", param, expected, query.Get(param))
+		}
+	}
+	if len(query.Get("x-oss-signature")) != 64 {
+		t.Errorf("unexpected signature %q", query.Get("x-oss-signature"))
+	}
+
+	// the signature covers the key and the secret
+	if other := d.signURLV4("GET", "path/to/other", creds, false, now, now.Add(time.Hour)); other == signedURL {
+		t.Errorf("expected different keys to have different signatures")
+	}
+	otherCreds := credentials{AccessKeyID: "ak", AccessKeySecret: "other"}
+	if other := d.signURLV4("GET", "path/to/some file", otherCreds, false, now, now.Add(30*24*time.Hour)); other == signedURL {
+		t.Errorf("expected different secrets to have different signatures")
+	}
+}
+
+func TestRAMRoleCredentials(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/registry-role" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		requests++
+		fmt.Fprintf(w, `{"Code": "Success", "AccessKeyId": "STS.ak%d", "AccessKeySecret": "sk", "SecurityToken": "token", "Expiration": %q}`,
+			requests, time.Now().Add(time.Duration(requests)*time.Hour).UTC().Format(time.RFC3339))
+	}))
+	defer server.Close()
+
+	defaultURL := ramRoleCredentialsURL
+	ramRoleCredentialsURL = server.URL + "/"
+	defer func() { ramRoleCredentialsURL = defaultURL }()
+
+	if _, err := fetchRAMRoleCredentials("unknown"); err == nil {
+		t.Fatalf("expected an error fetching the credentials of an unknown role")
+	}
+
+	d := &driver{BucketName: "registry", Region: alioss.Hangzhou, RAMRole: "registry-role"}
+	creds, err := fetchRAMRoleCredentials(d.RAMRole)
+	if err != nil {
+		t.Fatalf("unexpected error fetching credentials: %v", err)
+	}
+	if creds.AccessKeyID != "STS.ak1" || creds.SecurityToken != "token" {
+		t.Fatalf("unexpected credentials %v", creds)
+	}
+
+	// the credentials are refreshed before they expire
+	creds.Expiration = time.Now().Add(credentialsRefreshWindow / 2)
+	d.credentials = creds
+	bucket, creds := d.current()
+	if creds.AccessKeyID != "STS.ak2" || bucket.AccessKeyId != "STS.ak2" || bucket.SecurityToken != "token" {
+		t.Fatalf("expected the credentials to be refreshed, got %v", creds)
+	}
+	if _, creds := d.current(); creds.AccessKeyID != "STS.ak2" {
+		t.Fatalf("expected the credentials not to be refreshed again, got %v", creds)
+	}
+}
+
+func TestInvalidParameters(t *testing.T) {
+	valid := map[string]interface{}{
+		"accesskeyid":     "ak",
+		"accesskeysecret": "sk",
+		"region":          "oss-cn-hangzhou",
+		"bucket":          "registry",
+	}
+	for param, value := range map[string]interface{}{
+		"signatureversion": "v2",
+		"internalcidrs":    "10.0.0.0/33",
+	} {
+		parameters := map[string]interface{}{param: value}
+		for k, v := range valid {
+			parameters[k] = v
+		}
+		if _, err := FromParameters(parameters); err == nil {
+			t.Errorf("expected an error with %s %v", param, value)
+		}
+	}
+
+	if _, err := FromParameters(map[string]interface{}{"region": "oss-cn-hangzhou", "bucket": "registry"}); err == nil {
+		t.Errorf("expected an error without credentials nor RAM role")
+	}
+}
@@ -0,0 +1,4 @@
+// Package rados implements the Ceph RADOS storage driver backend. Support can
+// be enabled by including the "include_rados" build tag, and requires the
+// librados development files.
+package rados
@@ -0,0 +1,717 @@
+//go:build include_rados
+
+// Package rados provides a storagedriver.StorageDriver implementation to
+// store blobs in a Ceph RADOS pool, without going through the RADOS Gateway.
+//
+// This package leverages the ceph/go-ceph bindings of librados.
+//
+// The content of a file is striped over RADOS objects of the chunk size,
+// named after the id of the file and the index of the stripe. The object
+// named after the id of the file holds its size in an extended attribute.
+// Directories are objects whose omap maps the names of their entries to the
+// id of the files, and to an empty value for the subdirectories, so that
+// moving a file only updates the omap of the directories.
+package rados
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strconv"
+
+	"github.com/ceph/go-ceph/rados"
+	"github.com/mitchellh/mapstructure"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/base"
+	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
+	"github.com/distribution/distribution/v3/uuid"
+)
+
+const driverName = "rados"
+
+// defaultChunkSize defines the default size of the stripes of the files, the
+// default object size of RBD and CephFS
+const defaultChunkSize = 4 << 20
+
+// sizeXattr is the extended attribute holding the size of a file
+const sizeXattr = "size"
+
+// Prefixes of the names of the objects of the directories and of the files.
+const (
+	dirPrefix  = "dir:"
+	filePrefix = "file:"
+)
+
+// listMax is the number of directory entries read at once
+const listMax = 1000
+
+// DriverParameters is a struct that encapsulates all of the driver parameters
+// after all values have been set
+type DriverParameters struct {
+	PoolName string `mapstructure:"poolname"`
+	// Namespace isolates the objects of the registry from the other objects
+	// of the pool.
+	Namespace string `mapstructure:"namespace"`
+	// Username is the name of the Ceph user, without the "client." prefix.
+	Username   string `mapstructure:"username"`
+	ConfigFile string `mapstructure:"configfile"`
+	ChunkSize  int64  `mapstructure:"chunksize"`
+}
+
+func init() {
+	factory.Register(driverName, &radosDriverFactory{})
+}
+
+// radosDriverFactory implements the factory.StorageDriverFactory interface
+type radosDriverFactory struct{}
+
+func (factory *radosDriverFactory) Create(parameters map[string]interface{}) (storagedriver.StorageDriver, error) {
+	return FromParameters(parameters)
+}
+
+type driver struct {
+	conn      *rados.Conn
+	ioctx     *rados.IOContext
+	ChunkSize int64
+}
+
+type baseEmbed struct {
+	base.Base
+}
+
+// Driver is a storagedriver.StorageDriver implementation backed by a Ceph
+// RADOS pool.
+type Driver struct {
+	baseEmbed
+}
+
+// FromParameters constructs a new Driver with a given parameters map
+// Required parameters:
+// - poolname
+func FromParameters(parameters map[string]interface{}) (*Driver, error) {
+	params := DriverParameters{
+		ChunkSize: defaultChunkSize,
+	}
+
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		WeaklyTypedInput: true,
+		Result:           &params,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := decoder.Decode(parameters); err != nil {
+		return nil, err
+	}
+
+	if params.PoolName == "" {
+		return nil, fmt.Errorf("no poolname parameter provided")
+	}
+
+	if params.ChunkSize <= 0 {
+		return nil, fmt.Errorf("the chunksize %#v parameter should be a positive number", params.ChunkSize)
+	}
+
+	return New(params)
+}
+
+// New constructs a new Driver connected to the Ceph cluster of the
+// configuration file, storing files in the given pool
+func New(params DriverParameters) (*Driver, error) {
+	var conn *rados.Conn
+	var err error
+	if params.Username != "" {
+		conn, err = rados.NewConnWithUser(params.Username)
+	} else {
+		conn, err = rados.NewConn()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if params.ConfigFile != "" {
+		err = conn.ReadConfigFile(params.ConfigFile)
+	} else {
+		err = conn.ReadDefaultConfigFile()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the ceph configuration: %v", err)
+	}
+
+	if err := conn.Connect(); err != nil {
+		return nil, fmt.Errorf("unable to connect to the ceph cluster: %v", err)
+	}
+
+	ioctx, err := conn.OpenIOContext(params.PoolName)
+	if err != nil {
+		conn.Shutdown()
+		return nil, fmt.Errorf("unable to open the %s pool: %v", params.PoolName, err)
+	}
+	ioctx.SetNamespace(params.Namespace)
+
+	chunkSize := params.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+
+	d := &driver{
+		conn:      conn,
+		ioctx:     ioctx,
+		ChunkSize: chunkSize,
+	}
+
+	return &Driver{
+		baseEmbed: baseEmbed{
+			Base: base.Base{
+				StorageDriver: d,
+			},
+		},
+	}, nil
+}
+
+// Implement the storagedriver.StorageDriver interface
+
+func (d *driver) Name() string {
+	return driverName
+}
+
+// GetContent retrieves the content stored at "path" as a []byte.
+func (d *driver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	reader, err := d.Reader(ctx, path, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
+
+// PutContent stores the []byte content at a location designated by "path".
+// The content is written before the file is linked to the path, so that it
+// is never read partially.
+func (d *driver) PutContent(ctx context.Context, path string, contents []byte) error {
+	id, err := d.newFile()
+	if err != nil {
+		return err
+	}
+
+	w := d.newWriter(path, id, 0)
+	if _, err := w.Write(contents); err != nil {
+		d.removeFile(id)
+		return err
+	}
+	if err := w.Commit(); err != nil {
+		d.removeFile(id)
+		return err
+	}
+
+	previous, err := d.link(path, id)
+	if err != nil {
+		d.removeFile(id)
+		return err
+	}
+	if previous != "" {
+		return d.removeFile(previous)
+	}
+	return nil
+}
+
+// Reader retrieves an io.ReadCloser for the content stored at "path" with a
+// given byte offset.
+func (d *driver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	id, err := d.file(path)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := d.size(id)
+	if err != nil {
+		return nil, pathError(path, err)
+	}
+	if offset > size {
+		return nil, storagedriver.InvalidOffsetError{Path: path, Offset: offset}
+	}
+
+	return &reader{
+		driver: d,
+		id:     id,
+		size:   size,
+		offset: offset,
+	}, nil
+}
+
+// Writer returns a FileWriter which will store the content written to it
+// at the location designated by "path" after the call to Commit.
+func (d *driver) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	if append {
+		id, err := d.file(path)
+		if err != nil {
+			return nil, err
+		}
+		size, err := d.size(id)
+		if err != nil {
+			return nil, pathError(path, err)
+		}
+		return d.newWriter(path, id, size), nil
+	}
+
+	id, err := d.newFile()
+	if err != nil {
+		return nil, err
+	}
+	previous, err := d.link(path, id)
+	if err != nil {
+		d.removeFile(id)
+		return nil, err
+	}
+	if previous != "" {
+		if err := d.removeFile(previous); err != nil {
+			return nil, err
+		}
+	}
+	return d.newWriter(path, id, 0), nil
+}
+
+// Stat retrieves the FileInfo for the given path, including the current size
+// in bytes and the modification time.
+func (d *driver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	id, ok, err := d.entry(path)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, storagedriver.PathNotFoundError{Path: path}
+	}
+
+	fi := storagedriver.FileInfoFields{
+		Path: path,
+	}
+	if id == "" {
+		fi.IsDir = true
+		return storagedriver.FileInfoInternal{FileInfoFields: fi}, nil
+	}
+
+	stat, err := d.ioctx.Stat(id)
+	if err != nil {
+		return nil, pathError(path, err)
+	}
+	size, err := d.size(id)
+	if err != nil {
+		return nil, pathError(path, err)
+	}
+	fi.Size = size
+	fi.ModTime = stat.ModTime
+	return storagedriver.FileInfoInternal{FileInfoFields: fi}, nil
+}
+
+// List returns a list of the objects that are direct descendants of the given path.
+func (d *driver) List(ctx context.Context, dir string) ([]string, error) {
+	id, ok, err := d.entry(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || id != "" {
+		return nil, storagedriver.PathNotFoundError{Path: dir}
+	}
+
+	entries, err := d.ioctx.GetAllOmapValues(dirObject(dir), "", "", listMax)
+	if err != nil && err != rados.ErrNotFound {
+		return nil, err
+	}
+
+	list := make([]string, 0, len(entries))
+	for name := range entries {
+		list = append(list, path.Join(dir, name))
+	}
+	sort.Strings(list)
+	return list, nil
+}
+
+// Move moves an object stored at sourcePath to destPath, removing the original
+// object. Only the entries of the directories are updated, the content of the
+// file is not copied.
+func (d *driver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	id, err := d.file(sourcePath)
+	if err != nil {
+		return err
+	}
+	if sourcePath == destPath {
+		return nil
+	}
+
+	previous, err := d.link(destPath, id)
+	if err != nil {
+		return err
+	}
+	if err := d.ioctx.RmOmapKeys(dirObject(path.Dir(sourcePath)), []string{path.Base(sourcePath)}); err != nil {
+		return err
+	}
+	if previous != "" {
+		return d.removeFile(previous)
+	}
+	return nil
+}
+
+// Delete recursively deletes all objects stored at "path" and its subpaths.
+// The path is unlinked from its parent before its content is removed.
+func (d *driver) Delete(ctx context.Context, p string) error {
+	id, ok, err := d.entry(p)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return storagedriver.PathNotFoundError{Path: p}
+	}
+
+	if p != "/" {
+		if err := d.ioctx.RmOmapKeys(dirObject(path.Dir(p)), []string{path.Base(p)}); err != nil {
+			return err
+		}
+	}
+	if id != "" {
+		return d.removeFile(id)
+	}
+	return d.removeDir(p)
+}
+
+// URLFor returns a URL which may be used to retrieve the content stored at the given path.
+// RADOS has no HTTP endpoint, so it always returns ErrUnsupportedMethod.
+func (d *driver) URLFor(ctx context.Context, path string, options map[string]interface{}) (string, error) {
+	return "", storagedriver.ErrUnsupportedMethod{}
+}
+
+// Walk traverses a filesystem defined within driver, starting
+// from the given path, calling f on each file and directory
+func (d *driver) Walk(ctx context.Context, path string, f storagedriver.WalkFn) error {
+	return storagedriver.WalkFallback(ctx, d, path, f)
+}
+
+// entry returns the value of the entry of p in its parent directory, the id of
+// the file or an empty string for a directory, and whether it exists.
+func (d *driver) entry(p string) (string, bool, error) {
+	if p == "/" {
+		return "", true, nil
+	}
+
+	// the entry sorts first among the names it prefixes
+	name := path.Base(p)
+	entries, err := d.ioctx.GetOmapValues(dirObject(path.Dir(p)), "", name, 1)
+	if err != nil {
+		if err == rados.ErrNotFound {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	value, ok := entries[name]
+	return string(value), ok, nil
+}
+
+// file returns the id of the file at p, or a PathNotFoundError if there is
+// none.
+func (d *driver) file(p string) (string, error) {
+	id, ok, err := d.entry(p)
+	if err != nil {
+		return "", err
+	}
+	if !ok || id == "" {
+		return "", storagedriver.PathNotFoundError{Path: p}
+	}
+	return id, nil
+}
+
+// link makes the file with the given id the entry of p in its parent
+// directory, creating the missing directories. It returns the id of the file
+// previously at p, if any.
+func (d *driver) link(p, id string) (string, error) {
+	previous, ok, err := d.entry(p)
+	if err != nil {
+		return "", err
+	}
+	if ok && previous == "" {
+		return "", fmt.Errorf("rados: %s is a directory", p)
+	}
+	if err := d.mkdirAll(path.Dir(p)); err != nil {
+		return "", err
+	}
+	if err := d.ioctx.SetOmap(dirObject(path.Dir(p)), map[string][]byte{path.Base(p): []byte(id)}); err != nil {
+		return "", err
+	}
+	if previous == id {
+		return "", nil
+	}
+	return previous, nil
+}
+
+// mkdirAll creates the directory dir and its missing parents.
+func (d *driver) mkdirAll(dir string) error {
+	id, ok, err := d.entry(dir)
+	if err != nil {
+		return err
+	}
+	if ok {
+		if id != "" {
+			return fmt.Errorf("rados: %s is not a directory", dir)
+		}
+		return nil
+	}
+	if err := d.mkdirAll(path.Dir(dir)); err != nil {
+		return err
+	}
+	return d.ioctx.SetOmap(dirObject(path.Dir(dir)), map[string][]byte{path.Base(dir): nil})
+}
+
+// removeDir removes the files and the subdirectories of dir, and the object
+// holding its entries.
+func (d *driver) removeDir(dir string) error {
+	entries, err := d.ioctx.GetAllOmapValues(dirObject(dir), "", "", listMax)
+	if err != nil {
+		if err == rados.ErrNotFound {
+			return nil
+		}
+		return err
+	}
+
+	for name, id := range entries {
+		if len(id) == 0 {
+			err = d.removeDir(path.Join(dir, name))
+		} else {
+			err = d.removeFile(string(id))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return ignoreNotFound(d.ioctx.Delete(dirObject(dir)))
+}
+
+// newFile creates an empty file, not linked to any path, and returns its id.
+func (d *driver) newFile() (string, error) {
+	id := filePrefix + uuid.Generate().String()
+	if err := d.ioctx.Create(id, rados.CreateExclusive); err != nil {
+		return "", err
+	}
+	if err := d.setSize(id, 0); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// removeFile removes the stripes of the file with the given id and the object
+// holding its size.
+func (d *driver) removeFile(id string) error {
+	size, err := d.size(id)
+	if err != nil {
+		return ignoreNotFound(err)
+	}
+	for index := int64(0); index*d.ChunkSize < size; index++ {
+		if err := ignoreNotFound(d.ioctx.Delete(stripeObject(id, index))); err != nil {
+			return err
+		}
+	}
+	return ignoreNotFound(d.ioctx.Delete(id))
+}
+
+// size returns the size of the file with the given id.
+func (d *driver) size(id string) (int64, error) {
+	buf := make([]byte, 32)
+	n, err := d.ioctx.GetXattr(id, sizeXattr, buf)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(buf[:n]), 10, 64)
+}
+
+// setSize records the size of the file with the given id, once its stripes
+// are written.
+func (d *driver) setSize(id string, size int64) error {
+	return d.ioctx.SetXattr(id, sizeXattr, []byte(strconv.FormatInt(size, 10)))
+}
+
+// dirObject returns the name of the object holding the entries of dir.
+func dirObject(dir string) string {
+	return dirPrefix + dir
+}
+
+// stripeObject returns the name of the object holding the stripe of the file
+// with the given id at index.
+func stripeObject(id string, index int64) string {
+	return fmt.Sprintf("%s.%016x", id, index)
+}
+
+func ignoreNotFound(err error) error {
+	if err == rados.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// pathError returns a PathNotFoundError for path if err reports an object not
+// found, the file being removed concurrently.
+func pathError(path string, err error) error {
+	if err == rados.ErrNotFound {
+		return storagedriver.PathNotFoundError{Path: path}
+	}
+	return err
+}
+
+// reader reads the stripes of a file, one at a time.
+type reader struct {
+	driver *driver
+	id     string
+	size   int64
+	offset int64
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	index, off := r.offset/r.driver.ChunkSize, r.offset%r.driver.ChunkSize
+	n := int64(len(p))
+	if n > r.driver.ChunkSize-off {
+		n = r.driver.ChunkSize - off
+	}
+	if n > r.size-r.offset {
+		n = r.size - r.offset
+	}
+
+	read, err := r.driver.ioctx.Read(stripeObject(r.id, index), p[:n], uint64(off))
+	if err != nil {
+		return 0, err
+	}
+	if read == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	r.offset += int64(read)
+	return read, nil
+}
+
+func (r *reader) Close() error {
+	return nil
+}
+
+// writer writes the content written to it to the stripes of a file, a stripe
+// at a time. Closing a writer persists what was written so far, so that it
+// can be resumed.
+type writer struct {
+	driver *driver
+	path   string
+	id     string
+	size   int64
+	// flushed is the size of the content written to the stripes, the
+	// remainder being buffered.
+	flushed   int64
+	buf       []byte
+	closed    bool
+	committed bool
+	cancelled bool
+}
+
+func (d *driver) newWriter(path, id string, size int64) *writer {
+	return &writer{
+		driver:  d,
+		path:    path,
+		id:      id,
+		size:    size,
+		flushed: size,
+	}
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fmt.Errorf("already closed")
+	} else if w.committed {
+		return 0, fmt.Errorf("already committed")
+	} else if w.cancelled {
+		return 0, fmt.Errorf("already cancelled")
+	}
+
+	w.buf = append(w.buf, p...)
+	w.size += int64(len(p))
+
+	// write the complete stripes
+	if end := w.size - w.size%w.driver.ChunkSize; end > w.flushed {
+		if err := w.flush(end); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *writer) Size() int64 {
+	return w.size
+}
+
+func (w *writer) Close() error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	}
+	w.closed = true
+	if w.committed || w.cancelled {
+		return nil
+	}
+	return w.flush(w.size)
+}
+
+func (w *writer) Cancel() error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	} else if w.committed {
+		return fmt.Errorf("already committed")
+	}
+	w.cancelled = true
+	err := w.driver.Delete(context.Background(), w.path)
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		return nil
+	}
+	return err
+}
+
+func (w *writer) Commit() error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	} else if w.committed {
+		return fmt.Errorf("already committed")
+	} else if w.cancelled {
+		return fmt.Errorf("already cancelled")
+	}
+	if err := w.flush(w.size); err != nil {
+		return err
+	}
+	w.committed = true
+	return nil
+}
+
+// flush writes the buffered content up to the offset end to the stripes of
+// the file, and records its new size.
+func (w *writer) flush(end int64) error {
+	if end == w.flushed {
+		return nil
+	}
+
+	start := w.flushed
+	for w.flushed < end {
+		index, off := w.flushed/w.driver.ChunkSize, w.flushed%w.driver.ChunkSize
+		n := w.driver.ChunkSize - off
+		if n > end-w.flushed {
+			n = end - w.flushed
+		}
+		data := w.buf[w.flushed-start : w.flushed-start+n]
+		if err := w.driver.ioctx.Write(stripeObject(w.id, index), data, uint64(off)); err != nil {
+			w.buf = w.buf[w.flushed-start:]
+			return err
+		}
+		w.flushed += n
+	}
+	w.buf = append(w.buf[:0], w.buf[end-start:]...)
+
+	return w.driver.setSize(w.id, w.flushed)
+}
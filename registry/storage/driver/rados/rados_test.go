@@ -0,0 +1,74 @@
+//go:build include_rados
+// +build include_rados
+
+package rados
+
+import (
+	"os"
+	"strconv"
+	"testing"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/testsuites"
+	"github.com/distribution/distribution/v3/uuid"
+	"gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { check.TestingT(t) }
+
+var radosDriverConstructor func() (*Driver, error)
+
+var skipCheck func() string
+
+func init() {
+	poolname := os.Getenv("RADOS_POOL")
+	username := os.Getenv("RADOS_USER")
+	configFile := os.Getenv("RADOS_CONFIG_FILE")
+
+	radosDriverConstructor = func() (*Driver, error) {
+		// each driver stores its files in a namespace of its own, as the
+		// test suite expects an empty storage
+		parameters := DriverParameters{
+			PoolName:   poolname,
+			Namespace:  "registry-test-" + uuid.Generate().String(),
+			Username:   username,
+			ConfigFile: configFile,
+			// small stripes, so that files span several of them
+			ChunkSize: 1 << 16,
+		}
+		if chunkSize := os.Getenv("RADOS_CHUNK_SIZE"); chunkSize != "" {
+			size, err := strconv.ParseInt(chunkSize, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			parameters.ChunkSize = size
+		}
+
+		return New(parameters)
+	}
+
+	// Skip RADOS storage driver tests if environment variable parameters are not provided
+	skipCheck = func() string {
+		if poolname == "" {
+			return "Must set RADOS_POOL, and optionally RADOS_USER and RADOS_CONFIG_FILE, to run RADOS tests"
+		}
+		return ""
+	}
+
+	testsuites.RegisterSuite(func() (storagedriver.StorageDriver, error) {
+		return radosDriverConstructor()
+	}, skipCheck)
+}
+
+func TestFromParameters(t *testing.T) {
+	for _, parameters := range []map[string]interface{}{
+		{},
+		{"poolname": "registry", "chunksize": 0},
+		{"poolname": "registry", "chunksize": "notanumber"},
+	} {
+		if _, err := FromParameters(parameters); err == nil {
+			t.Errorf("expected an error with parameters %v", parameters)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package s3
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// checksumOperations are the operations whose body is checksummed with the
+// configured checksum algorithm.
+var checksumOperations = map[string]struct{}{
+	"PutObject":     {},
+	"UploadPart":    {},
+	"DeleteObjects": {},
+}
+
+// parseChecksumAlgorithm returns the S3 checksum algorithm named, case
+// insensitively, by value.
+func parseChecksumAlgorithm(value string) (string, error) {
+	for _, algorithm := range s3.ChecksumAlgorithm_Values() {
+		if strings.EqualFold(value, algorithm) {
+			return algorithm, nil
+		}
+	}
+	return "", fmt.Errorf("the checksumalgorithm parameter must be one of %v, %v invalid", s3.ChecksumAlgorithm_Values(), value)
+}
+
+// computeChecksum returns the base64 encoded checksum of the content of r
+// with the given algorithm, as expected by the x-amz-checksum-* headers.
+func computeChecksum(algorithm string, r io.Reader) (string, error) {
+	var h hash.Hash
+	switch algorithm {
+	case s3.ChecksumAlgorithmCrc32:
+		h = crc32.NewIEEE()
+	case s3.ChecksumAlgorithmCrc32c:
+		h = crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	case s3.ChecksumAlgorithmSha1:
+		h = sha1.New()
+	case s3.ChecksumAlgorithmSha256:
+		h = sha256.New()
+	default:
+		return "", fmt.Errorf("unsupported checksum algorithm %q", algorithm)
+	}
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// checksumHandler returns a handler adding the checksum of the body of the
+// requests uploading content, as the aws sdk does not compute the flexible
+// checksums itself. It runs before the request is signed.
+func checksumHandler(algorithm string) request.NamedHandler {
+	header := "X-Amz-Checksum-" + strings.ToLower(algorithm)
+	return request.NamedHandler{
+		Name: "s3aws.ChecksumHandler",
+		Fn: func(r *request.Request) {
+			if _, ok := checksumOperations[r.Operation.Name]; !ok {
+				return
+			}
+			if r.HTTPRequest.Header.Get(header) != "" {
+				// computed by a previous attempt
+				return
+			}
+
+			body := r.GetBody()
+			if body == nil {
+				return
+			}
+			start, err := body.Seek(0, io.SeekCurrent)
+			if err != nil {
+				r.Error = err
+				return
+			}
+			sum, err := computeChecksum(algorithm, body)
+			if err != nil {
+				r.Error = err
+				return
+			}
+			if _, err := body.Seek(start, io.SeekStart); err != nil {
+				r.Error = err
+				return
+			}
+
+			r.HTTPRequest.Header.Set("X-Amz-Sdk-Checksum-Algorithm", algorithm)
+			r.HTTPRequest.Header.Set(header, sum)
+		},
+	}
+}
+
+// completedPart returns the part to complete a multipart upload with,
+// carrying the checksum of the part when the upload has a checksum algorithm.
+func completedPart(part *s3.Part) *s3.CompletedPart {
+	return &s3.CompletedPart{
+		ETag:           part.ETag,
+		PartNumber:     part.PartNumber,
+		ChecksumCRC32:  part.ChecksumCRC32,
+		ChecksumCRC32C: part.ChecksumCRC32C,
+		ChecksumSHA1:   part.ChecksumSHA1,
+		ChecksumSHA256: part.ChecksumSHA256,
+	}
+}
+
+// copiedPart returns the part of a multipart upload copied by UploadPartCopy.
+func copiedPart(result *s3.CopyPartResult, partNumber, size int64) *s3.Part {
+	return &s3.Part{
+		ETag:           result.ETag,
+		PartNumber:     aws.Int64(partNumber),
+		Size:           aws.Int64(size),
+		ChecksumCRC32:  result.ChecksumCRC32,
+		ChecksumCRC32C: result.ChecksumCRC32C,
+		ChecksumSHA1:   result.ChecksumSHA1,
+		ChecksumSHA256: result.ChecksumSHA256,
+	}
+}
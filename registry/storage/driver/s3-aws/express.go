@@ -0,0 +1,184 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+const (
+	// directoryBucketSuffix is the suffix of the names of the directory
+	// buckets of S3 Express One Zone.
+	directoryBucketSuffix = "--x-s3"
+
+	expressSigningName = "s3express"
+
+	// expressSessionRefresh is how long before their expiration the session
+	// credentials are refreshed. Sessions last five minutes.
+	expressSessionRefresh = time.Minute
+)
+
+// isDirectoryBucket returns whether bucket is a directory bucket of S3
+// Express One Zone, named bucket-base-name--azid--x-s3.
+func isDirectoryBucket(bucket string) bool {
+	return strings.HasSuffix(bucket, directoryBucketSuffix)
+}
+
+// expressEndpoint returns the zonal endpoint of a directory bucket, in the
+// availability zone its name ends with.
+func expressEndpoint(bucket, region string) (string, error) {
+	base := strings.TrimSuffix(bucket, directoryBucketSuffix)
+	i := strings.LastIndex(base, "--")
+	if i <= 0 || i+2 == len(base) {
+		return "", fmt.Errorf("invalid directory bucket name %q, expected bucket-base-name--azid--x-s3", bucket)
+	}
+	return fmt.Sprintf("https://s3express-%s.%s.amazonaws.com", base[i+2:], region), nil
+}
+
+type createSessionInput struct {
+	_ struct{} `type:"structure"`
+
+	SessionMode *string `location:"header" locationName:"x-amz-create-session-mode" type:"string"`
+}
+
+type createSessionOutput struct {
+	_ struct{} `type:"structure"`
+
+	Credentials *sessionCredentials `type:"structure"`
+}
+
+type sessionCredentials struct {
+	_ struct{} `type:"structure"`
+
+	AccessKeyId     *string    `type:"string"`
+	SecretAccessKey *string    `type:"string"`
+	SessionToken    *string    `type:"string"`
+	Expiration      *time.Time `type:"timestamp"`
+}
+
+// expressSessions signs the requests to a directory bucket with the
+// credentials of a session, created with CreateSession by the credentials of
+// the driver and refreshed before it expires. The aws sdk does not support
+// S3 Express One Zone.
+type expressSessions struct {
+	client *s3.S3
+	bucket string
+
+	mu         sync.Mutex
+	creds      credentials.Value
+	expiration time.Time
+}
+
+// get returns the credentials of the current session, creating a new session
+// when it is about to expire.
+func (s *expressSessions) get(ctx aws.Context) (credentials.Value, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if time.Until(s.expiration) > expressSessionRefresh {
+		return s.creds, nil
+	}
+
+	output := &createSessionOutput{}
+	req := s.client.NewRequest(&request.Operation{
+		Name:       "CreateSession",
+		HTTPMethod: "GET",
+		HTTPPath:   "/?session",
+	}, &createSessionInput{SessionMode: aws.String("ReadWrite")}, output)
+	req.SetContext(ctx)
+	req.ClientInfo.SigningName = expressSigningName
+	req.Handlers.Build.PushBack(func(r *request.Request) {
+		r.HTTPRequest.URL.Host = s.bucket + "." + r.HTTPRequest.URL.Host
+	})
+	if err := req.Send(); err != nil {
+		return credentials.Value{}, fmt.Errorf("unable to create a session on bucket %s: %v", s.bucket, err)
+	}
+
+	c := output.Credentials
+	if c == nil || c.AccessKeyId == nil || c.SecretAccessKey == nil || c.SessionToken == nil {
+		return credentials.Value{}, fmt.Errorf("unable to create a session on bucket %s: no credentials returned", s.bucket)
+	}
+	s.creds = credentials.Value{
+		AccessKeyID:     *c.AccessKeyId,
+		SecretAccessKey: *c.SecretAccessKey,
+		SessionToken:    *c.SessionToken,
+	}
+	s.expiration = aws.TimeValue(c.Expiration)
+	return s.creds, nil
+}
+
+// signHandler returns a handler, run before the request is signed, swapping
+// the credentials of the request for those of the session. Presigned URLs
+// carry the session token in their query, and expire with the session.
+func (s *expressSessions) signHandler() request.NamedHandler {
+	return request.NamedHandler{
+		Name: "s3aws.ExpressSessionHandler",
+		Fn: func(r *request.Request) {
+			creds, err := s.get(r.Context())
+			if err != nil {
+				r.Error = err
+				return
+			}
+
+			// directory buckets reject the MD5 checksums of DeleteObjects, the
+			// checksum handler adds a flexible checksum instead
+			r.HTTPRequest.Header.Del("Content-Md5")
+
+			r.Config.Credentials = credentials.NewStaticCredentials(creds.AccessKeyID, creds.SecretAccessKey, "")
+			r.HTTPRequest.Header.Set("X-Amz-S3session-Token", creds.SessionToken)
+			r.ClientInfo.SigningName = expressSigningName
+		},
+	}
+}
+
+// statDirectoryBucket retrieves the FileInfo for the given path in a
+// directory bucket, whose listings only support prefixes ending with a
+// delimiter.
+func (d *driver) statDirectoryBucket(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	fi := storagedriver.FileInfoFields{
+		Path: path,
+	}
+
+	key := d.s3Path(path)
+	prefix := ""
+	if key != "" {
+		resp, err := d.S3.HeadObject(&s3.HeadObjectInput{
+			Bucket: aws.String(d.Bucket),
+			Key:    aws.String(key),
+		})
+		if err == nil {
+			fi.Size = aws.Int64Value(resp.ContentLength)
+			fi.ModTime = aws.TimeValue(resp.LastModified)
+			return storagedriver.FileInfoInternal{FileInfoFields: fi}, nil
+		}
+		if reqErr, ok := err.(awserr.RequestFailure); !ok || reqErr.StatusCode() != http.StatusNotFound {
+			return nil, err
+		}
+		prefix = key + "/"
+	}
+
+	resp, err := d.S3.ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket:  aws.String(d.Bucket),
+		Prefix:  aws.String(prefix),
+		MaxKeys: aws.Int64(1),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Contents) == 0 && len(resp.CommonPrefixes) == 0 {
+		return nil, storagedriver.PathNotFoundError{Path: path}
+	}
+	fi.IsDir = true
+	return storagedriver.FileInfoInternal{FileInfoFields: fi}, nil
+}
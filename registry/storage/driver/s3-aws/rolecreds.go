@@ -0,0 +1,408 @@
+package s3
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+const (
+	// roleCredentialsRefresh is how long before their expiration the
+	// credentials of an assumed role are refreshed.
+	roleCredentialsRefresh = 5 * time.Minute
+
+	// defaultRoleSessionName is the name of the sessions of the assumed
+	// roles, unless configured.
+	defaultRoleSessionName = "docker-registry"
+
+	// defaultRolesAnywhereDuration is the duration of the sessions of IAM
+	// Roles Anywhere, unless configured. The sessions last between 15
+	// minutes and 12 hours.
+	defaultRolesAnywhereDuration = time.Hour
+	minRolesAnywhereDuration     = 15 * time.Minute
+	maxRolesAnywhereDuration     = 12 * time.Hour
+)
+
+// WebIdentityParameters configure the role assumed with a web identity token,
+// such as the token of a Kubernetes service account (IRSA) or of another OIDC
+// provider.
+type WebIdentityParameters struct {
+	// RoleARN is the ARN of the role to assume.
+	RoleARN string
+	// TokenFile is the path of the file of the web identity token, which is
+	// read again whenever the credentials are refreshed.
+	TokenFile string
+	// SessionName is the name of the role session.
+	SessionName string
+	// Endpoint overrides the endpoint of STS.
+	Endpoint string
+}
+
+// RolesAnywhereParameters configure the role assumed through IAM Roles
+// Anywhere, authenticating with an X.509 certificate.
+type RolesAnywhereParameters struct {
+	// Certificate is the path of the PEM encoded certificate, followed by
+	// its intermediate certificates if any.
+	Certificate string
+	// PrivateKey is the path of the PEM encoded private key of the
+	// certificate, either RSA or ECDSA.
+	PrivateKey     string
+	TrustAnchorARN string
+	ProfileARN     string
+	RoleARN        string
+	// SessionDuration is the duration of the sessions.
+	SessionDuration time.Duration
+	// Region is the region of IAM Roles Anywhere, which defaults to the
+	// region of the bucket.
+	Region string
+	// Endpoint overrides the endpoint of IAM Roles Anywhere.
+	Endpoint string
+}
+
+// parseWebIdentity parses the webidentity parameter.
+func parseWebIdentity(param interface{}) (*WebIdentityParameters, error) {
+	values, err := parseStringMap("webidentity", param)
+	if err != nil {
+		return nil, err
+	}
+	params := &WebIdentityParameters{
+		RoleARN:     values["rolearn"],
+		TokenFile:   values["tokenfile"],
+		SessionName: values["sessionname"],
+		Endpoint:    values["endpoint"],
+	}
+	if params.RoleARN == "" || params.TokenFile == "" {
+		return nil, fmt.Errorf("the webidentity parameter requires a rolearn and a tokenfile")
+	}
+	return params, nil
+}
+
+// parseRolesAnywhere parses the rolesanywhere parameter.
+func parseRolesAnywhere(param interface{}) (*RolesAnywhereParameters, error) {
+	values, err := parseStringMap("rolesanywhere", param)
+	if err != nil {
+		return nil, err
+	}
+	params := &RolesAnywhereParameters{
+		Certificate:     values["certificate"],
+		PrivateKey:      values["privatekey"],
+		TrustAnchorARN:  values["trustanchorarn"],
+		ProfileARN:      values["profilearn"],
+		RoleARN:         values["rolearn"],
+		SessionDuration: defaultRolesAnywhereDuration,
+		Region:          values["region"],
+		Endpoint:        values["endpoint"],
+	}
+	if params.Certificate == "" || params.PrivateKey == "" || params.TrustAnchorARN == "" || params.ProfileARN == "" || params.RoleARN == "" {
+		return nil, fmt.Errorf("the rolesanywhere parameter requires a certificate, a privatekey, a trustanchorarn, a profilearn and a rolearn")
+	}
+	if duration := values["sessionduration"]; duration != "" {
+		params.SessionDuration, err = time.ParseDuration(duration)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sessionduration of the rolesanywhere parameter: %v", err)
+		}
+		if params.SessionDuration < minRolesAnywhereDuration || params.SessionDuration > maxRolesAnywhereDuration {
+			return nil, fmt.Errorf("the sessionduration of the rolesanywhere parameter must be between %v and %v", minRolesAnywhereDuration, maxRolesAnywhereDuration)
+		}
+	}
+	return params, nil
+}
+
+// parseStringMap parses the named parameter as a map of strings.
+func parseStringMap(name string, param interface{}) (map[string]string, error) {
+	values := make(map[string]string)
+	switch v := param.(type) {
+	case map[interface{}]interface{}:
+		for key, value := range v {
+			values[strings.ToLower(fmt.Sprint(key))] = fmt.Sprint(value)
+		}
+	case map[string]interface{}:
+		for key, value := range v {
+			values[strings.ToLower(key)] = fmt.Sprint(value)
+		}
+	case map[string]string:
+		for key, value := range v {
+			values[strings.ToLower(key)] = value
+		}
+	default:
+		return nil, fmt.Errorf("the %s parameter must be a map, %v invalid", name, param)
+	}
+	return values, nil
+}
+
+// webIdentityCredentials returns the credentials of the role assumed with a
+// web identity token, refreshed before they expire.
+func webIdentityCredentials(awsConfig *aws.Config, params *WebIdentityParameters) (*credentials.Credentials, error) {
+	stsConfig := awsConfig.Copy()
+	stsConfig.Endpoint = nil
+	if params.Endpoint != "" {
+		stsConfig.WithEndpoint(params.Endpoint)
+	}
+	sess, err := session.NewSession(stsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new session with aws config: %v", err)
+	}
+
+	sessionName := params.SessionName
+	if sessionName == "" {
+		sessionName = defaultRoleSessionName
+	}
+	provider := stscreds.NewWebIdentityRoleProviderWithOptions(sts.New(sess), params.RoleARN, sessionName, stscreds.FetchTokenPath(params.TokenFile), func(p *stscreds.WebIdentityRoleProvider) {
+		p.ExpiryWindow = roleCredentialsRefresh
+	})
+	return credentials.NewCredentials(provider), nil
+}
+
+// rolesAnywhereCredentials returns the credentials of the role assumed
+// through IAM Roles Anywhere, refreshed before they expire.
+func rolesAnywhereCredentials(client *http.Client, region string, params *RolesAnywhereParameters) (*credentials.Credentials, error) {
+	// fail early on unreadable certificates, which are read again whenever
+	// the credentials are refreshed so that they can be renewed
+	if _, _, _, err := loadX509Credentials(params.Certificate, params.PrivateKey); err != nil {
+		return nil, err
+	}
+
+	if params.Region != "" {
+		region = params.Region
+	}
+	endpoint := params.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://rolesanywhere.%s.amazonaws.com", region)
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return credentials.NewCredentials(&rolesAnywhereProvider{
+		params:   params,
+		region:   region,
+		endpoint: endpoint,
+		client:   client,
+	}), nil
+}
+
+// rolesAnywhereProvider retrieves the credentials of a role from IAM Roles
+// Anywhere, creating sessions with requests signed by the private key of an
+// X.509 certificate.
+type rolesAnywhereProvider struct {
+	credentials.Expiry
+
+	params   *RolesAnywhereParameters
+	region   string
+	endpoint string
+	client   *http.Client
+}
+
+type rolesAnywhereSessionInput struct {
+	DurationSeconds int    `json:"durationSeconds"`
+	ProfileARN      string `json:"profileArn"`
+	RoleARN         string `json:"roleArn"`
+	TrustAnchorARN  string `json:"trustAnchorArn"`
+}
+
+type rolesAnywhereSessionOutput struct {
+	CredentialSet []struct {
+		Credentials struct {
+			AccessKeyID     string `json:"accessKeyId"`
+			SecretAccessKey string `json:"secretAccessKey"`
+			SessionToken    string `json:"sessionToken"`
+			Expiration      string `json:"expiration"`
+		} `json:"credentials"`
+	} `json:"credentialSet"`
+}
+
+// Retrieve creates a session of IAM Roles Anywhere.
+func (p *rolesAnywhereProvider) Retrieve() (credentials.Value, error) {
+	certificate, chain, signer, err := loadX509Credentials(p.params.Certificate, p.params.PrivateKey)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+
+	body, err := json.Marshal(rolesAnywhereSessionInput{
+		DurationSeconds: int(p.params.SessionDuration / time.Second),
+		ProfileARN:      p.params.ProfileARN,
+		RoleARN:         p.params.RoleARN,
+		TrustAnchorARN:  p.params.TrustAnchorARN,
+	})
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(p.endpoint, "/")+"/sessions", bytes.NewReader(body))
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	if err := signX509Request(req, body, p.region, time.Now(), certificate, chain, signer); err != nil {
+		return credentials.Value{}, err
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return credentials.Value{}, fmt.Errorf("failed to create IAM Roles Anywhere session: %v", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return credentials.Value{}, fmt.Errorf("failed to create IAM Roles Anywhere session: %v", err)
+	}
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return credentials.Value{}, fmt.Errorf("failed to create IAM Roles Anywhere session: %s: %s", resp.Status, respBody)
+	}
+
+	var output rolesAnywhereSessionOutput
+	if err := json.Unmarshal(respBody, &output); err != nil {
+		return credentials.Value{}, fmt.Errorf("invalid IAM Roles Anywhere session: %v", err)
+	}
+	if len(output.CredentialSet) == 0 {
+		return credentials.Value{}, fmt.Errorf("invalid IAM Roles Anywhere session: no credentials")
+	}
+	creds := output.CredentialSet[0].Credentials
+	expiration, err := time.Parse(time.RFC3339, creds.Expiration)
+	if err != nil {
+		return credentials.Value{}, fmt.Errorf("invalid IAM Roles Anywhere session expiration: %v", err)
+	}
+	p.SetExpiration(expiration, roleCredentialsRefresh)
+
+	return credentials.Value{
+		AccessKeyID:     creds.AccessKeyID,
+		SecretAccessKey: creds.SecretAccessKey,
+		SessionToken:    creds.SessionToken,
+		ProviderName:    "RolesAnywhereProvider",
+	}, nil
+}
+
+// loadX509Credentials reads a certificate, its intermediate certificates and
+// its private key.
+func loadX509Credentials(certificateFile, privateKeyFile string) (*x509.Certificate, []*x509.Certificate, crypto.Signer, error) {
+	certificatePEM, err := ioutil.ReadFile(certificateFile)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to read certificate: %v", err)
+	}
+	var certificates []*x509.Certificate
+	for block, rest := pem.Decode(certificatePEM); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid certificate %s: %v", certificateFile, err)
+		}
+		certificates = append(certificates, certificate)
+	}
+	if len(certificates) == 0 {
+		return nil, nil, nil, fmt.Errorf("no certificate found in %s", certificateFile)
+	}
+
+	privateKeyPEM, err := ioutil.ReadFile(privateKeyFile)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to read private key: %v", err)
+	}
+	block, _ := pem.Decode(privateKeyPEM)
+	if block == nil {
+		return nil, nil, nil, fmt.Errorf("no private key found in %s", privateKeyFile)
+	}
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid private key %s: %v", privateKeyFile, err)
+	}
+	switch key.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey:
+	default:
+		return nil, nil, nil, fmt.Errorf("unsupported private key type %T, expected RSA or ECDSA", key)
+	}
+
+	return certificates[0], certificates[1:], key.(crypto.Signer), nil
+}
+
+// signX509Request signs a request to IAM Roles Anywhere as Signature Version
+// 4 does, with the private key of the certificate in place of the secret
+// access key.
+func signX509Request(req *http.Request, body []byte, region string, now time.Time, certificate *x509.Certificate, chain []*x509.Certificate, signer crypto.Signer) error {
+	var algorithm string
+	switch signer.Public().(type) {
+	case *rsa.PublicKey:
+		algorithm = "AWS4-X509-RSA-SHA256"
+	case *ecdsa.PublicKey:
+		algorithm = "AWS4-X509-ECDSA-SHA256"
+	default:
+		return fmt.Errorf("unsupported private key type %T", signer.Public())
+	}
+
+	amzDate := now.UTC().Format("20060102T150405Z")
+	scope := strings.Join([]string{amzDate[:8], region, "rolesanywhere", "aws4_request"}, "/")
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-X509", base64.StdEncoding.EncodeToString(certificate.Raw))
+	headers := []string{"content-type", "host", "x-amz-date", "x-amz-x509"}
+	if len(chain) > 0 {
+		encoded := make([]string, len(chain))
+		for i, c := range chain {
+			encoded[i] = base64.StdEncoding.EncodeToString(c.Raw)
+		}
+		req.Header.Set("X-Amz-X509-Chain", strings.Join(encoded, ","))
+		headers = append(headers, "x-amz-x509-chain")
+	}
+
+	var canonicalHeaders strings.Builder
+	for _, header := range headers {
+		value := req.Header.Get(header)
+		if header == "host" {
+			value = req.URL.Host
+		}
+		canonicalHeaders.WriteString(header + ":" + strings.TrimSpace(value) + "\n")
+	}
+	signedHeaders := strings.Join(headers, ";")
+	payloadHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		(&url.URL{Path: req.URL.Path}).EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		algorithm,
+		amzDate,
+		scope,
+		hex.EncodeToString(canonicalRequestHash[:]),
+	}, "\n")
+
+	digest := sha256.Sum256([]byte(stringToSign))
+	signature, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return fmt.Errorf("failed to sign IAM Roles Anywhere request: %v", err)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		algorithm, certificate.SerialNumber.String(), scope, signedHeaders, hex.EncodeToString(signature)))
+	return nil
+}
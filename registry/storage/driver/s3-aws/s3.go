@@ -20,11 +20,14 @@ import (
 	"io/ioutil"
 	"math"
 	"net/http"
+	"net/url"
 	"path/filepath"
 	"reflect"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -67,6 +70,14 @@ const (
 	// above which multipart copy will be used. (PUT Object - Copy is used
 	// for objects at or below this size.)  Empirically, 32 MB is optimal.
 	defaultMultipartCopyThresholdSize = 32 << 20
+
+	// defaultMultipartUploadConcurrency defines the default maximum number
+	// of parts of a multipart upload being uploaded concurrently by a writer.
+	defaultMultipartUploadConcurrency = 5
+
+	// maxMultipartUploadParts defines the maximum number of parts of a
+	// multipart upload allowed by S3.
+	maxMultipartUploadParts = 10000
 )
 
 // listMax is the largest amount of objects you can request from S3 in a list call
@@ -87,6 +98,13 @@ var s3StorageClasses = []string{
 	s3.StorageClassGlacierIr,
 }
 
+// uploadPathRegexp matches the paths of the objects of uploads, which are
+// purged once committed or abandoned.
+var uploadPathRegexp = regexp.MustCompile(`/_uploads/`)
+
+// blobDataPathRegexp matches the paths of committed blob data.
+var blobDataPathRegexp = regexp.MustCompile(`/blobs/[^/]+/[0-9a-f]{2}/[^/]+/data$`)
+
 // validRegions maps known s3 region identifiers to region descriptors
 var validRegions = map[string]struct{}{}
 
@@ -111,6 +129,8 @@ type DriverParameters struct {
 	MultipartCopyMaxConcurrency int64
 	MultipartCopyThresholdSize  int64
 	MultipartCombineSmallPart   bool
+	MultipartUploadConcurrency  int64
+	MultipartUploadMaxParts     int64
 	RootDirectory               string
 	StorageClass                string
 	UserAgent                   string
@@ -118,6 +138,17 @@ type DriverParameters struct {
 	SessionToken                string
 	UseDualStack                bool
 	Accelerate                  bool
+	ChecksumAlgorithm           string
+	// UploadTags are the tags of the objects of uploads, so that bucket
+	// lifecycle rules can expire the ones left behind.
+	UploadTags map[string]string
+	// BlobStorageClass is the storage class of committed blob data, which
+	// defaults to StorageClass.
+	BlobStorageClass string
+	// WebIdentity and RolesAnywhere configure the role the driver assumes,
+	// in place of the access keys or of the default credentials of the SDK.
+	WebIdentity   *WebIdentityParameters
+	RolesAnywhere *RolesAnywhereParameters
 }
 
 func init() {
@@ -162,9 +193,15 @@ type driver struct {
 	MultipartCopyMaxConcurrency int64
 	MultipartCopyThresholdSize  int64
 	MultipartCombineSmallPart   bool
+	MultipartUploadConcurrency  int64
+	MultipartUploadMaxParts     int64
 	RootDirectory               string
 	StorageClass                string
 	ObjectACL                   string
+	ChecksumAlgorithm           string
+	DirectoryBucket             bool
+	UploadTags                  map[string]string
+	BlobStorageClass            string
 }
 
 type baseEmbed struct {
@@ -329,39 +366,43 @@ func FromParameters(parameters map[string]interface{}) (*Driver, error) {
 		return nil, err
 	}
 
+	multipartUploadConcurrency, err := getParameterAsInt64(parameters, "multipartuploadconcurrency", defaultMultipartUploadConcurrency, 1, math.MaxInt64)
+	if err != nil {
+		return nil, err
+	}
+
+	multipartUploadMaxParts, err := getParameterAsInt64(parameters, "multipartuploadmaxparts", maxMultipartUploadParts, 1, maxMultipartUploadParts)
+	if err != nil {
+		return nil, err
+	}
+
 	rootDirectory := parameters["rootdirectory"]
 	if rootDirectory == nil {
 		rootDirectory = ""
 	}
 
 	storageClass := s3.StorageClassStandard
-	storageClassParam := parameters["storageclass"]
-	if storageClassParam != nil {
-		storageClassString, ok := storageClassParam.(string)
-		if !ok {
-			return nil, fmt.Errorf(
-				"the storageclass parameter must be one of %v, %v invalid",
-				s3StorageClasses,
-				storageClassParam,
-			)
-		}
-		// All valid storage class parameters are UPPERCASE, so be a bit more flexible here
-		storageClassString = strings.ToUpper(storageClassString)
-		if storageClassString != noStorageClass &&
-			storageClassString != s3.StorageClassStandard &&
-			storageClassString != s3.StorageClassReducedRedundancy &&
-			storageClassString != s3.StorageClassStandardIa &&
-			storageClassString != s3.StorageClassOnezoneIa &&
-			storageClassString != s3.StorageClassIntelligentTiering &&
-			storageClassString != s3.StorageClassOutposts &&
-			storageClassString != s3.StorageClassGlacierIr {
-			return nil, fmt.Errorf(
-				"the storageclass parameter must be one of %v, %v invalid",
-				s3StorageClasses,
-				storageClassParam,
-			)
-		}
-		storageClass = storageClassString
+	if storageClassParam := parameters["storageclass"]; storageClassParam != nil {
+		storageClass, err = parseStorageClass("storageclass", storageClassParam)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	blobStorageClass := ""
+	if blobStorageClassParam := parameters["blobstorageclass"]; blobStorageClassParam != nil {
+		blobStorageClass, err = parseStorageClass("blobstorageclass", blobStorageClassParam)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var uploadTags map[string]string
+	if uploadTagsParam := parameters["uploadtags"]; uploadTagsParam != nil {
+		uploadTags, err = parseTags("uploadtags", uploadTagsParam)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	userAgent := parameters["useragent"]
@@ -436,6 +477,35 @@ func FromParameters(parameters map[string]interface{}) (*Driver, error) {
 		return nil, fmt.Errorf("the accelerate parameter should be a boolean")
 	}
 
+	checksumAlgorithm := ""
+	checksumAlgorithmParam := parameters["checksumalgorithm"]
+	if checksumAlgorithmParam != nil {
+		checksumAlgorithmString, ok := checksumAlgorithmParam.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid value for checksumalgorithm parameter: %v", checksumAlgorithmParam)
+		}
+		checksumAlgorithm, err = parseChecksumAlgorithm(checksumAlgorithmString)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var webIdentity *WebIdentityParameters
+	if webIdentityParam := parameters["webidentity"]; webIdentityParam != nil {
+		webIdentity, err = parseWebIdentity(webIdentityParam)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var rolesAnywhere *RolesAnywhereParameters
+	if rolesAnywhereParam := parameters["rolesanywhere"]; rolesAnywhereParam != nil {
+		rolesAnywhere, err = parseRolesAnywhere(rolesAnywhereParam)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	params := DriverParameters{
 		fmt.Sprint(accessKey),
 		fmt.Sprint(secretKey),
@@ -453,6 +523,8 @@ func FromParameters(parameters map[string]interface{}) (*Driver, error) {
 		multipartCopyMaxConcurrency,
 		multipartCopyThresholdSize,
 		mutlipartCombineSmallPart,
+		multipartUploadConcurrency,
+		multipartUploadMaxParts,
 		fmt.Sprint(rootDirectory),
 		storageClass,
 		fmt.Sprint(userAgent),
@@ -460,11 +532,69 @@ func FromParameters(parameters map[string]interface{}) (*Driver, error) {
 		fmt.Sprint(sessionToken),
 		useDualStackBool,
 		accelerateBool,
+		checksumAlgorithm,
+		uploadTags,
+		blobStorageClass,
+		webIdentity,
+		rolesAnywhere,
 	}
 
 	return New(params)
 }
 
+// parseStorageClass validates the storage class of the named parameter.
+func parseStorageClass(name string, param interface{}) (string, error) {
+	storageClass, ok := param.(string)
+	if !ok {
+		return "", fmt.Errorf("the %s parameter must be one of %v, %v invalid", name, s3StorageClasses, param)
+	}
+	// All valid storage class parameters are UPPERCASE, so be a bit more flexible here
+	storageClass = strings.ToUpper(storageClass)
+	for _, valid := range s3StorageClasses {
+		if storageClass == valid {
+			return storageClass, nil
+		}
+	}
+	return "", fmt.Errorf("the %s parameter must be one of %v, %v invalid", name, s3StorageClasses, param)
+}
+
+// parseTags parses the object tags of the named parameter, either a map or a
+// URL encoded query string.
+func parseTags(name string, param interface{}) (map[string]string, error) {
+	tags := make(map[string]string)
+	switch v := param.(type) {
+	case map[interface{}]interface{}:
+		for key, value := range v {
+			tags[fmt.Sprint(key)] = fmt.Sprint(value)
+		}
+	case map[string]interface{}:
+		for key, value := range v {
+			tags[key] = fmt.Sprint(value)
+		}
+	case map[string]string:
+		for key, value := range v {
+			tags[key] = value
+		}
+	case string:
+		query, err := url.ParseQuery(v)
+		if err != nil {
+			return nil, fmt.Errorf("the %s parameter must be a map of tags: %v", name, err)
+		}
+		for key := range query {
+			tags[key] = query.Get(key)
+		}
+	default:
+		return nil, fmt.Errorf("the %s parameter must be a map of tags, %v invalid", name, param)
+	}
+
+	for key := range tags {
+		if key == "" {
+			return nil, fmt.Errorf("the %s parameter must not have empty tag keys", name)
+		}
+	}
+	return tags, nil
+}
+
 // getParameterAsInt64 converts parameters[name] to an int64 value (using
 // defaultt if nil), verifies it is no smaller than min, and returns it.
 func getParameterAsInt64(parameters map[string]interface{}, name string, defaultt int64, min int64, max int64) (int64, error) {
@@ -503,9 +633,30 @@ func New(params DriverParameters) (*Driver, error) {
 		return nil, fmt.Errorf("on Amazon S3 this storage driver can only be used with v4 authentication")
 	}
 
+	directoryBucket := isDirectoryBucket(params.Bucket)
+	if directoryBucket && !params.V4Auth {
+		return nil, fmt.Errorf("directory buckets can only be used with v4 authentication")
+	}
+	checksumAlgorithm := params.ChecksumAlgorithm
+	if directoryBucket && checksumAlgorithm == "" {
+		// directory buckets do not support MD5 checksums
+		checksumAlgorithm = s3.ChecksumAlgorithmCrc32
+	}
+
+	accessKeys := params.AccessKey != "" && params.SecretKey != ""
+	configured := 0
+	for _, ok := range []bool{accessKeys, params.WebIdentity != nil, params.RolesAnywhere != nil} {
+		if ok {
+			configured++
+		}
+	}
+	if configured > 1 {
+		return nil, fmt.Errorf("only one of the access keys, webidentity and rolesanywhere can be configured")
+	}
+
 	awsConfig := aws.NewConfig()
 
-	if params.AccessKey != "" && params.SecretKey != "" {
+	if accessKeys {
 		creds := credentials.NewStaticCredentials(
 			params.AccessKey,
 			params.SecretKey,
@@ -519,6 +670,20 @@ func New(params DriverParameters) (*Driver, error) {
 		awsConfig.WithS3ForcePathStyle(params.ForcePathStyle)
 	}
 
+	if directoryBucket {
+		if params.RegionEndpoint == "" {
+			endpoint, err := expressEndpoint(params.Bucket, params.Region)
+			if err != nil {
+				return nil, err
+			}
+			awsConfig.WithEndpoint(endpoint)
+		}
+		// directory buckets are only addressed virtual-hosted style, and
+		// reject MD5 checksums
+		awsConfig.WithS3ForcePathStyle(false)
+		awsConfig.WithS3DisableContentMD5Validation(true)
+	}
+
 	awsConfig.WithS3UseAccelerate(params.Accelerate)
 	awsConfig.WithRegion(params.Region)
 	awsConfig.WithDisableSSL(!params.Secure)
@@ -544,6 +709,23 @@ func New(params DriverParameters) (*Driver, error) {
 		}
 	}
 
+	// the credentials of the assumed roles are requested with the same
+	// region and HTTP client as S3
+	if params.WebIdentity != nil {
+		creds, err := webIdentityCredentials(awsConfig, params.WebIdentity)
+		if err != nil {
+			return nil, err
+		}
+		awsConfig.WithCredentials(creds)
+	}
+	if params.RolesAnywhere != nil {
+		creds, err := rolesAnywhereCredentials(awsConfig.HTTPClient, params.Region, params.RolesAnywhere)
+		if err != nil {
+			return nil, err
+		}
+		awsConfig.WithCredentials(creds)
+	}
+
 	sess, err := session.NewSession(awsConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create new session with aws config: %v", err)
@@ -555,6 +737,17 @@ func New(params DriverParameters) (*Driver, error) {
 		setv2Handlers(s3obj)
 	}
 
+	if directoryBucket {
+		sessions := &expressSessions{
+			client: s3.New(sess),
+			bucket: params.Bucket,
+		}
+		s3obj.Handlers.Sign.PushFrontNamed(sessions.signHandler())
+	}
+	if checksumAlgorithm != "" {
+		s3obj.Handlers.Sign.PushFrontNamed(checksumHandler(checksumAlgorithm))
+	}
+
 	// TODO Currently multipart uploads have no timestamps, so this would be unwise
 	// if you initiated a new s3driver while another one is running on the same bucket.
 	// multis, _, err := bucket.ListMulti("", "")
@@ -580,9 +773,15 @@ func New(params DriverParameters) (*Driver, error) {
 		MultipartCopyMaxConcurrency: params.MultipartCopyMaxConcurrency,
 		MultipartCopyThresholdSize:  params.MultipartCopyThresholdSize,
 		MultipartCombineSmallPart:   params.MultipartCombineSmallPart,
+		MultipartUploadConcurrency:  params.MultipartUploadConcurrency,
+		MultipartUploadMaxParts:     params.MultipartUploadMaxParts,
 		RootDirectory:               params.RootDirectory,
 		StorageClass:                params.StorageClass,
 		ObjectACL:                   params.ObjectACL,
+		ChecksumAlgorithm:           checksumAlgorithm,
+		DirectoryBucket:             directoryBucket,
+		UploadTags:                  params.UploadTags,
+		BlobStorageClass:            params.BlobStorageClass,
 	}
 
 	return &Driver{
@@ -618,7 +817,8 @@ func (d *driver) PutContent(ctx context.Context, path string, contents []byte) e
 		ACL:                  d.getACL(),
 		ServerSideEncryption: d.getEncryptionMode(),
 		SSEKMSKeyId:          d.getSSEKMSKeyID(),
-		StorageClass:         d.getStorageClass(),
+		StorageClass:         d.getStorageClass(path),
+		Tagging:              d.getTagging(path),
 		Body:                 bytes.NewReader(contents),
 	})
 	return parseError(path, err)
@@ -656,7 +856,9 @@ func (d *driver) Writer(ctx context.Context, path string, appendParam bool) (sto
 			ACL:                  d.getACL(),
 			ServerSideEncryption: d.getEncryptionMode(),
 			SSEKMSKeyId:          d.getSSEKMSKeyID(),
-			StorageClass:         d.getStorageClass(),
+			StorageClass:         d.getStorageClass(path),
+			Tagging:              d.getTagging(path),
+			ChecksumAlgorithm:    d.getChecksumAlgorithm(),
 		})
 		if err != nil {
 			return nil, err
@@ -668,6 +870,10 @@ func (d *driver) Writer(ctx context.Context, path string, appendParam bool) (sto
 		Bucket: aws.String(d.Bucket),
 		Prefix: aws.String(key),
 	}
+	if d.DirectoryBucket {
+		// directory buckets only support prefixes ending with a delimiter
+		listMultipartUploadsInput.Prefix = aws.String(key[:strings.LastIndex(key, "/")+1])
+	}
 	for {
 		resp, err := d.S3.ListMultipartUploads(listMultipartUploadsInput)
 		if err != nil {
@@ -712,7 +918,11 @@ func (d *driver) Writer(ctx context.Context, path string, appendParam bool) (sto
 		}
 
 		// resp.NextUploadIdMarker must have at least one element or we would have returned not found
-		listMultipartUploadsInput.UploadIdMarker = resp.NextUploadIdMarker
+		listMultipartUploadsInput.KeyMarker = resp.NextKeyMarker
+		if !d.DirectoryBucket {
+			// directory buckets do not support the upload id marker
+			listMultipartUploadsInput.UploadIdMarker = resp.NextUploadIdMarker
+		}
 
 		// from the s3 api docs, IsTruncated "specifies whether (true) or not (false) all of the results were returned"
 		// if everything has been returned, break
@@ -726,6 +936,10 @@ func (d *driver) Writer(ctx context.Context, path string, appendParam bool) (sto
 // Stat retrieves the FileInfo for the given path, including the current size
 // in bytes and the creation time.
 func (d *driver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	if d.DirectoryBucket {
+		return d.statDirectoryBucket(ctx, path)
+	}
+
 	resp, err := d.S3.ListObjectsV2(&s3.ListObjectsV2Input{
 		Bucket:  aws.String(d.Bucket),
 		Prefix:  aws.String(d.s3Path(path)),
@@ -852,7 +1066,10 @@ func (d *driver) copy(ctx context.Context, sourcePath string, destPath string) e
 			ACL:                  d.getACL(),
 			ServerSideEncryption: d.getEncryptionMode(),
 			SSEKMSKeyId:          d.getSSEKMSKeyID(),
-			StorageClass:         d.getStorageClass(),
+			StorageClass:         d.getStorageClass(destPath),
+			Tagging:              d.getTagging(destPath),
+			TaggingDirective:     d.getTaggingDirective(),
+			ChecksumAlgorithm:    d.getChecksumAlgorithm(),
 			CopySource:           aws.String(d.Bucket + "/" + d.s3Path(sourcePath)),
 		})
 		if err != nil {
@@ -868,7 +1085,9 @@ func (d *driver) copy(ctx context.Context, sourcePath string, destPath string) e
 		ACL:                  d.getACL(),
 		SSEKMSKeyId:          d.getSSEKMSKeyID(),
 		ServerSideEncryption: d.getEncryptionMode(),
-		StorageClass:         d.getStorageClass(),
+		StorageClass:         d.getStorageClass(destPath),
+		Tagging:              d.getTagging(destPath),
+		ChecksumAlgorithm:    d.getChecksumAlgorithm(),
 	})
 	if err != nil {
 		return err
@@ -897,10 +1116,7 @@ func (d *driver) copy(ctx context.Context, sourcePath string, destPath string) e
 				CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", firstByte, lastByte)),
 			})
 			if err == nil {
-				completedParts[i] = &s3.CompletedPart{
-					ETag:       uploadResp.CopyPartResult.ETag,
-					PartNumber: aws.Int64(i + 1),
-				}
+				completedParts[i] = completedPart(copiedPart(uploadResp.CopyPartResult, i+1, lastByte-firstByte+1))
 			}
 			errChan <- err
 			<-limiter
@@ -972,7 +1188,12 @@ ListLoop:
 		}
 
 		// resp.Contents must have at least one element or we would have returned not found
-		listObjectsInput.StartAfter = resp.Contents[len(resp.Contents)-1].Key
+		if d.DirectoryBucket {
+			// directory buckets do not support StartAfter
+			listObjectsInput.ContinuationToken = resp.NextContinuationToken
+		} else {
+			listObjectsInput.StartAfter = resp.Contents[len(resp.Contents)-1].Key
+		}
 
 		// from the s3 api docs, IsTruncated "specifies whether (true) or not (false) all of the results were returned"
 		// if everything has been returned, break
@@ -1046,6 +1267,12 @@ func (d *driver) URLFor(ctx context.Context, path string, options map[string]int
 // Walk traverses a filesystem defined within driver, starting
 // from the given path, calling f on each file
 func (d *driver) Walk(ctx context.Context, from string, f storagedriver.WalkFn) error {
+	if d.DirectoryBucket {
+		// doWalk relies on the lexicographical order of the listings, which
+		// directory buckets do not guarantee
+		return storagedriver.WalkFallback(ctx, d, from, f)
+	}
+
 	path := from
 	if !strings.HasSuffix(path, "/") {
 		path = path + "/"
@@ -1240,20 +1467,61 @@ func (d *driver) getContentType() *string {
 }
 
 func (d *driver) getACL() *string {
+	if d.DirectoryBucket {
+		// directory buckets do not support ACLs
+		return nil
+	}
 	return aws.String(d.ObjectACL)
 }
 
-func (d *driver) getStorageClass() *string {
-	if d.StorageClass == noStorageClass {
+// getStorageClass returns the storage class of the object at path, or key:
+// the blob storage class for committed blob data, if set.
+func (d *driver) getStorageClass(path string) *string {
+	storageClass := d.StorageClass
+	if d.BlobStorageClass != "" && blobDataPathRegexp.MatchString(path) {
+		storageClass = d.BlobStorageClass
+	}
+	if storageClass == noStorageClass || d.DirectoryBucket {
+		// directory buckets have their own storage class
+		return nil
+	}
+	return aws.String(storageClass)
+}
+
+// getTagging returns the URL encoded tags of the object at path, or key: the
+// upload tags for the objects of uploads, which the registry purges.
+func (d *driver) getTagging(path string) *string {
+	if len(d.UploadTags) == 0 || d.DirectoryBucket || !uploadPathRegexp.MatchString(path) {
+		return nil
+	}
+	tags := url.Values{}
+	for key, value := range d.UploadTags {
+		tags.Set(key, value)
+	}
+	return aws.String(tags.Encode())
+}
+
+// getTaggingDirective returns the tagging directive of copies, replacing the
+// tags of the source, so that committed blobs do not keep the upload tags.
+func (d *driver) getTaggingDirective() *string {
+	if len(d.UploadTags) == 0 || d.DirectoryBucket {
 		return nil
 	}
-	return aws.String(d.StorageClass)
+	return aws.String(s3.TaggingDirectiveReplace)
+}
+
+func (d *driver) getChecksumAlgorithm() *string {
+	if d.ChecksumAlgorithm == "" {
+		return nil
+	}
+	return aws.String(d.ChecksumAlgorithm)
 }
 
 // writer attempts to upload parts to S3 in a buffered fashion where the last
 // part is at least as large as the chunksize, so the multipart upload could be
 // cleanly resumed in the future. This is violated if Close is called after less
-// than a full chunk is written.
+// than a full chunk is written. Up to MultipartUploadConcurrency parts are
+// uploaded concurrently, Close and Commit waiting for all of them.
 type writer struct {
 	driver      *driver
 	key         string
@@ -1265,6 +1533,11 @@ type writer struct {
 	closed      bool
 	committed   bool
 	cancelled   bool
+
+	limiter  chan struct{}
+	inflight sync.WaitGroup
+	mu       sync.Mutex
+	err      error
 }
 
 func (d *driver) newWriter(key, uploadID string, parts []*s3.Part) storagedriver.FileWriter {
@@ -1278,6 +1551,7 @@ func (d *driver) newWriter(key, uploadID string, parts []*s3.Part) storagedriver
 		uploadID: uploadID,
 		parts:    parts,
 		size:     size,
+		limiter:  make(chan struct{}, d.MultipartUploadConcurrency),
 	}
 }
 
@@ -1301,10 +1575,7 @@ func (w *writer) Write(p []byte) (int, error) {
 	if len(w.parts) > 0 && int(*w.parts[len(w.parts)-1].Size) < minChunkSize {
 		var completedUploadedParts completedParts
 		for _, part := range w.parts {
-			completedUploadedParts = append(completedUploadedParts, &s3.CompletedPart{
-				ETag:       part.ETag,
-				PartNumber: part.PartNumber,
-			})
+			completedUploadedParts = append(completedUploadedParts, completedPart(part))
 		}
 
 		sort.Sort(completedUploadedParts)
@@ -1332,7 +1603,9 @@ func (w *writer) Write(p []byte) (int, error) {
 			ContentType:          w.driver.getContentType(),
 			ACL:                  w.driver.getACL(),
 			ServerSideEncryption: w.driver.getEncryptionMode(),
-			StorageClass:         w.driver.getStorageClass(),
+			StorageClass:         w.driver.getStorageClass(w.key),
+			Tagging:              w.driver.getTagging(w.key),
+			ChecksumAlgorithm:    w.driver.getChecksumAlgorithm(),
 		})
 		if err != nil {
 			return 0, err
@@ -1367,13 +1640,7 @@ func (w *writer) Write(p []byte) (int, error) {
 			if err != nil {
 				return 0, err
 			}
-			w.parts = []*s3.Part{
-				{
-					ETag:       copyPartResp.CopyPartResult.ETag,
-					PartNumber: aws.Int64(1),
-					Size:       aws.Int64(w.size),
-				},
-			}
+			w.parts = []*s3.Part{copiedPart(copyPartResp.CopyPartResult, 1, w.size)}
 		}
 	}
 
@@ -1423,7 +1690,11 @@ func (w *writer) Close() error {
 		return fmt.Errorf("already closed")
 	}
 	w.closed = true
-	return w.flushPart()
+	err := w.flushPart()
+	if waitErr := w.wait(); err == nil {
+		err = waitErr
+	}
+	return err
 }
 
 func (w *writer) Cancel() error {
@@ -1433,6 +1704,8 @@ func (w *writer) Cancel() error {
 		return fmt.Errorf("already committed")
 	}
 	w.cancelled = true
+	// parts still being uploaded would otherwise outlive the upload
+	w.wait()
 	_, err := w.driver.S3.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
 		Bucket:   aws.String(w.driver.Bucket),
 		Key:      aws.String(w.key),
@@ -1453,14 +1726,14 @@ func (w *writer) Commit() error {
 	if err != nil {
 		return err
 	}
+	if err := w.wait(); err != nil {
+		return err
+	}
 	w.committed = true
 
 	var completedUploadedParts completedParts
 	for _, part := range w.parts {
-		completedUploadedParts = append(completedUploadedParts, &s3.CompletedPart{
-			ETag:       part.ETag,
-			PartNumber: part.PartNumber,
-		})
+		completedUploadedParts = append(completedUploadedParts, completedPart(part))
 	}
 
 	sort.Sort(completedUploadedParts)
@@ -1484,9 +1757,14 @@ func (w *writer) Commit() error {
 	return nil
 }
 
-// flushPart flushes buffers to write a part to S3.
+// flushPart flushes buffers to write a part to S3. The part is uploaded in
+// the background once fewer than MultipartUploadConcurrency parts are in
+// flight; errors are reported by the following calls to flushPart and wait.
 // Only called by Write (with both buffers full) and Close/Commit (always)
 func (w *writer) flushPart() error {
+	if err := w.uploadErr(); err != nil {
+		return err
+	}
 	if len(w.readyPart) == 0 && len(w.pendingPart) == 0 {
 		// nothing to write
 		return nil
@@ -1497,24 +1775,62 @@ func (w *writer) flushPart() error {
 		w.readyPart = append(w.readyPart, w.pendingPart...)
 		w.pendingPart = nil
 	}
-
-	partNumber := aws.Int64(int64(len(w.parts) + 1))
-	resp, err := w.driver.S3.UploadPart(&s3.UploadPartInput{
-		Bucket:     aws.String(w.driver.Bucket),
-		Key:        aws.String(w.key),
-		PartNumber: partNumber,
-		UploadId:   aws.String(w.uploadID),
-		Body:       bytes.NewReader(w.readyPart),
-	})
-	if err != nil {
-		return err
+	if int64(len(w.parts)) >= w.driver.MultipartUploadMaxParts {
+		return fmt.Errorf("upload to %s exceeds the maximum of %d parts", w.key, w.driver.MultipartUploadMaxParts)
 	}
-	w.parts = append(w.parts, &s3.Part{
-		ETag:       resp.ETag,
-		PartNumber: partNumber,
+
+	part := &s3.Part{
+		PartNumber: aws.Int64(int64(len(w.parts) + 1)),
 		Size:       aws.Int64(int64(len(w.readyPart))),
-	})
+	}
+	w.parts = append(w.parts, part)
+	body := w.readyPart
+
+	w.limiter <- struct{}{}
+	w.inflight.Add(1)
+	go func() {
+		defer func() {
+			<-w.limiter
+			w.inflight.Done()
+		}()
+		resp, err := w.driver.S3.UploadPart(&s3.UploadPartInput{
+			Bucket:     aws.String(w.driver.Bucket),
+			Key:        aws.String(w.key),
+			PartNumber: part.PartNumber,
+			UploadId:   aws.String(w.uploadID),
+			Body:       bytes.NewReader(body),
+		})
+
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if err != nil {
+			if w.err == nil {
+				w.err = err
+			}
+			return
+		}
+		part.ETag = resp.ETag
+		part.ChecksumCRC32 = resp.ChecksumCRC32
+		part.ChecksumCRC32C = resp.ChecksumCRC32C
+		part.ChecksumSHA1 = resp.ChecksumSHA1
+		part.ChecksumSHA256 = resp.ChecksumSHA256
+	}()
+
 	w.readyPart = w.pendingPart
 	w.pendingPart = nil
 	return nil
 }
+
+// uploadErr returns the first error of the parts uploaded so far.
+func (w *writer) uploadErr() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// wait waits for the parts in flight to be uploaded and returns the first
+// error of the uploads.
+func (w *writer) wait() error {
+	w.inflight.Wait()
+	return w.uploadErr()
+}
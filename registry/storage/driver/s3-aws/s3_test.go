@@ -2,17 +2,32 @@ package s3
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/big"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
+	"path/filepath"
 	"reflect"
 	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"gopkg.in/check.v1"
 
@@ -48,6 +63,7 @@ func init() {
 	useDualStack := os.Getenv("S3_USE_DUALSTACK")
 	combineSmallPart := os.Getenv("MULTIPART_COMBINE_SMALL_PART")
 	accelerate := os.Getenv("S3_ACCELERATE")
+	checksumAlgorithm := os.Getenv("S3_CHECKSUM_ALGORITHM")
 	if err != nil {
 		panic(err)
 	}
@@ -131,6 +147,8 @@ func init() {
 			defaultMultipartCopyMaxConcurrency,
 			defaultMultipartCopyThresholdSize,
 			multipartCombineSmallPart,
+			defaultMultipartUploadConcurrency,
+			maxMultipartUploadParts,
 			rootDirectory,
 			storageClass,
 			driverName + "-test",
@@ -138,6 +156,11 @@ func init() {
 			sessionToken,
 			useDualStackBool,
 			accelerateBool,
+			checksumAlgorithm,
+			nil,
+			"",
+			nil,
+			nil,
 		}
 
 		return New(parameters)
@@ -857,3 +880,373 @@ func compareWalked(t *testing.T, expected, walked []string) {
 		}
 	}
 }
+
+func TestMultipartUploadParameters(t *testing.T) {
+	parameters := map[string]interface{}{
+		"region": "us-east-1",
+		"bucket": "bucket",
+	}
+
+	for _, invalid := range []map[string]interface{}{
+		{"multipartuploadconcurrency": 0},
+		{"multipartuploadmaxparts": 0},
+		{"multipartuploadmaxparts": maxMultipartUploadParts + 1},
+	} {
+		for k, v := range parameters {
+			invalid[k] = v
+		}
+		if _, err := FromParameters(invalid); err == nil {
+			t.Errorf("expected an error for parameters %v", invalid)
+		}
+	}
+
+	parameters["multipartuploadconcurrency"] = "10"
+	parameters["multipartuploadmaxparts"] = 1000
+	d, err := FromParameters(parameters)
+	if err != nil {
+		t.Fatalf("unexpected error creating driver: %v", err)
+	}
+	s3Driver := d.baseEmbed.Base.StorageDriver.(*driver)
+	if s3Driver.MultipartUploadConcurrency != 10 || s3Driver.MultipartUploadMaxParts != 1000 {
+		t.Errorf("unexpected multipart upload settings: %d, %d", s3Driver.MultipartUploadConcurrency, s3Driver.MultipartUploadMaxParts)
+	}
+}
+
+func TestChecksumAlgorithmParameter(t *testing.T) {
+	parameters := map[string]interface{}{
+		"region": "us-east-1",
+		"bucket": "bucket",
+	}
+
+	for _, invalid := range []interface{}{"md5", 32} {
+		parameters["checksumalgorithm"] = invalid
+		if _, err := FromParameters(parameters); err == nil {
+			t.Errorf("expected an error for checksumalgorithm %v", invalid)
+		}
+	}
+
+	parameters["checksumalgorithm"] = "crc32c"
+	d, err := FromParameters(parameters)
+	if err != nil {
+		t.Fatalf("unexpected error creating driver: %v", err)
+	}
+	s3Driver := d.baseEmbed.Base.StorageDriver.(*driver)
+	if s3Driver.ChecksumAlgorithm != s3.ChecksumAlgorithmCrc32c {
+		t.Errorf("unexpected checksum algorithm %q", s3Driver.ChecksumAlgorithm)
+	}
+}
+
+func TestComputeChecksum(t *testing.T) {
+	for algorithm, expected := range map[string]string{
+		s3.ChecksumAlgorithmCrc32:  "DUoRhQ==",
+		s3.ChecksumAlgorithmCrc32c: "yZRlqg==",
+		s3.ChecksumAlgorithmSha1:   "Kq5sNclPz7QV2+lfQIuc6R7oRu0=",
+		s3.ChecksumAlgorithmSha256: "uU0nuZNNPgilLlLX2n2r+sSE7+N6U4DukIj3rOLvzek=",
+	} {
+		sum, err := computeChecksum(algorithm, strings.NewReader("hello world"))
+		if err != nil {
+			t.Fatalf("unexpected error computing %s checksum: %v", algorithm, err)
+		}
+		if sum != expected {
+			t.Errorf("unexpected %s checksum %q, expected %q", algorithm, sum, expected)
+		}
+	}
+}
+
+func TestDirectoryBucket(t *testing.T) {
+	if isDirectoryBucket("bucket") {
+		t.Error("expected a general purpose bucket")
+	}
+	if !isDirectoryBucket("bucket--usw2-az1--x-s3") {
+		t.Error("expected a directory bucket")
+	}
+
+	endpoint, err := expressEndpoint("bucket--usw2-az1--x-s3", "us-west-2")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if endpoint != "https://s3express-usw2-az1.us-west-2.amazonaws.com" {
+		t.Errorf("unexpected endpoint %q", endpoint)
+	}
+	for _, invalid := range []string{"--x-s3", "bucket--x-s3", "bucket----x-s3"} {
+		if _, err := expressEndpoint(invalid, "us-west-2"); err == nil {
+			t.Errorf("expected an error for bucket %q", invalid)
+		}
+	}
+
+	d, err := FromParameters(map[string]interface{}{
+		"region": "us-west-2",
+		"bucket": "bucket--usw2-az1--x-s3",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating driver: %v", err)
+	}
+	s3Driver := d.baseEmbed.Base.StorageDriver.(*driver)
+	if !s3Driver.DirectoryBucket || s3Driver.ChecksumAlgorithm != s3.ChecksumAlgorithmCrc32 {
+		t.Errorf("unexpected directory bucket settings: %v, %q", s3Driver.DirectoryBucket, s3Driver.ChecksumAlgorithm)
+	}
+	if s3Driver.getACL() != nil || s3Driver.getStorageClass("/a") != nil {
+		t.Error("expected no ACL nor storage class on a directory bucket")
+	}
+}
+
+func TestUploadTagsAndBlobStorageClass(t *testing.T) {
+	parameters := map[string]interface{}{
+		"region": "us-east-1",
+		"bucket": "bucket",
+	}
+
+	for _, invalid := range []map[string]interface{}{
+		{"uploadtags": 42},
+		{"uploadtags": map[interface{}]interface{}{"": "empty"}},
+		{"blobstorageclass": "GLACIER"},
+	} {
+		for k, v := range parameters {
+			invalid[k] = v
+		}
+		if _, err := FromParameters(invalid); err == nil {
+			t.Errorf("expected an error for parameters %v", invalid)
+		}
+	}
+
+	parameters["uploadtags"] = map[interface{}]interface{}{"registry-upload": true}
+	parameters["blobstorageclass"] = "intelligent_tiering"
+	d, err := FromParameters(parameters)
+	if err != nil {
+		t.Fatalf("unexpected error creating driver: %v", err)
+	}
+	s3Driver := d.baseEmbed.Base.StorageDriver.(*driver)
+
+	uploadPath := "/docker/registry/v2/repositories/foo/_uploads/0a8f3c2e/data"
+	blobPath := "/docker/registry/v2/blobs/sha256/ab/ab12cd/data"
+	if tagging := s3Driver.getTagging(uploadPath); tagging == nil || *tagging != "registry-upload=true" {
+		t.Errorf("unexpected tagging of upload %v", tagging)
+	}
+	if tagging := s3Driver.getTagging(blobPath); tagging != nil {
+		t.Errorf("unexpected tagging of blob %q", *tagging)
+	}
+	if directive := s3Driver.getTaggingDirective(); directive == nil || *directive != s3.TaggingDirectiveReplace {
+		t.Errorf("expected copies to replace the tags, got %v", directive)
+	}
+
+	if storageClass := s3Driver.getStorageClass(blobPath); storageClass == nil || *storageClass != s3.StorageClassIntelligentTiering {
+		t.Errorf("unexpected storage class of blob %v", storageClass)
+	}
+	if storageClass := s3Driver.getStorageClass(uploadPath); storageClass == nil || *storageClass != s3.StorageClassStandard {
+		t.Errorf("unexpected storage class of upload %v", storageClass)
+	}
+
+	// the tags are only set when configured
+	delete(parameters, "uploadtags")
+	d, err = FromParameters(parameters)
+	if err != nil {
+		t.Fatalf("unexpected error creating driver: %v", err)
+	}
+	s3Driver = d.baseEmbed.Base.StorageDriver.(*driver)
+	if s3Driver.getTagging(uploadPath) != nil || s3Driver.getTaggingDirective() != nil {
+		t.Errorf("expected no tagging without upload tags")
+	}
+}
+
+func TestRoleCredentialsParameters(t *testing.T) {
+	for _, invalid := range []map[string]interface{}{
+		{"webidentity": "arn:aws:iam::123456789012:role/registry"},
+		{"webidentity": map[interface{}]interface{}{"rolearn": "arn:aws:iam::123456789012:role/registry"}},
+		{"rolesanywhere": map[interface{}]interface{}{"certificate": "/cert.pem", "privatekey": "/key.pem"}},
+		{"rolesanywhere": map[interface{}]interface{}{
+			"certificate":     "/cert.pem",
+			"privatekey":      "/key.pem",
+			"trustanchorarn":  "arn:aws:rolesanywhere:us-east-1:123456789012:trust-anchor/ta",
+			"profilearn":      "arn:aws:rolesanywhere:us-east-1:123456789012:profile/p",
+			"rolearn":         "arn:aws:iam::123456789012:role/registry",
+			"sessionduration": "24h",
+		}},
+		{
+			"accesskey":   "AKIDEXAMPLE",
+			"secretkey":   "secret",
+			"webidentity": map[interface{}]interface{}{"rolearn": "arn:aws:iam::123456789012:role/registry", "tokenfile": "/token"},
+		},
+	} {
+		invalid["region"] = "us-east-1"
+		invalid["bucket"] = "bucket"
+		if _, err := FromParameters(invalid); err == nil {
+			t.Errorf("expected an error for parameters %v", invalid)
+		}
+	}
+}
+
+func TestWebIdentityCredentials(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("web-identity-token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var requests int32
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("unexpected error parsing request: %v", err)
+		}
+		if r.Form.Get("Action") != "AssumeRoleWithWebIdentity" || r.Form.Get("WebIdentityToken") != "web-identity-token" || r.Form.Get("RoleArn") != "arn:aws:iam::123456789012:role/registry" {
+			t.Errorf("unexpected request: %v", r.Form)
+		}
+		w.Header().Set("Content-Type", "text/xml")
+		fmt.Fprintf(w, `<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <Credentials>
+      <AccessKeyId>ASIAWEBIDENTITY</AccessKeyId>
+      <SecretAccessKey>secret</SecretAccessKey>
+      <SessionToken>token</SessionToken>
+      <Expiration>%s</Expiration>
+    </Credentials>
+  </AssumeRoleWithWebIdentityResult>
+</AssumeRoleWithWebIdentityResponse>`, time.Now().Add(time.Minute).UTC().Format(time.RFC3339))
+	}))
+	defer sts.Close()
+
+	d, err := FromParameters(map[string]interface{}{
+		"region": "us-east-1",
+		"bucket": "bucket",
+		"webidentity": map[interface{}]interface{}{
+			"rolearn":   "arn:aws:iam::123456789012:role/registry",
+			"tokenfile": tokenFile,
+			"endpoint":  sts.URL,
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating driver: %v", err)
+	}
+	creds := d.baseEmbed.Base.StorageDriver.(*driver).S3.Config.Credentials
+	value, err := creds.Get()
+	if err != nil {
+		t.Fatalf("unexpected error getting credentials: %v", err)
+	}
+	if value.AccessKeyID != "ASIAWEBIDENTITY" || value.SecretAccessKey != "secret" || value.SessionToken != "token" {
+		t.Fatalf("unexpected credentials: %+v", value)
+	}
+
+	// the credentials expiring within the refresh window are requested again
+	if _, err := creds.Get(); err != nil {
+		t.Fatalf("unexpected error getting credentials: %v", err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Fatalf("expected the credentials to be refreshed, got %d requests", n)
+	}
+}
+
+func TestRolesAnywhereCredentials(t *testing.T) {
+	dir := t.TempDir()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(4242),
+		Subject:      pkix.Name{CommonName: "registry"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certificateDER, err := x509.CreateCertificate(cryptorand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificateFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certificateFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificateDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var requests int32
+	rolesAnywhere := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("unexpected error reading request: %v", err)
+		}
+		if r.Method != http.MethodPost || r.URL.Path != "/sessions" || !strings.Contains(string(body), `"durationSeconds":900`) {
+			t.Errorf("unexpected request %s %s: %s", r.Method, r.URL.Path, body)
+		}
+
+		// the signature is verified with the public key of the certificate
+		authorization := r.Header.Get("Authorization")
+		prefix := "AWS4-X509-ECDSA-SHA256 Credential=4242/" + r.Header.Get("X-Amz-Date")[:8] + "/eu-west-1/rolesanywhere/aws4_request, SignedHeaders=content-type;host;x-amz-date;x-amz-x509, Signature="
+		if !strings.HasPrefix(authorization, prefix) {
+			t.Errorf("unexpected authorization %q", authorization)
+			return
+		}
+		signature, err := hex.DecodeString(strings.TrimPrefix(authorization, prefix))
+		if err != nil {
+			t.Errorf("invalid signature: %v", err)
+		}
+		date, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+		if err != nil {
+			t.Errorf("invalid date: %v", err)
+		}
+		signer := &digestSigner{public: key.Public()}
+		signed := httptest.NewRequest(r.Method, "http://"+r.Host+r.URL.Path, nil)
+		if err := signX509Request(signed, body, "eu-west-1", date, &x509.Certificate{Raw: certificateDER, SerialNumber: big.NewInt(4242)}, nil, signer); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if !ecdsa.VerifyASN1(&key.PublicKey, signer.digest, signature) {
+			t.Errorf("invalid signature of %q", authorization)
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"credentialSet":[{"credentials":{"accessKeyId":"ASIAROLESANYWHERE","secretAccessKey":"secret","sessionToken":"token","expiration":%q}}]}`,
+			time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	}))
+	defer rolesAnywhere.Close()
+
+	d, err := FromParameters(map[string]interface{}{
+		"region": "eu-west-1",
+		"bucket": "bucket",
+		"rolesanywhere": map[interface{}]interface{}{
+			"certificate":     certificateFile,
+			"privatekey":      keyFile,
+			"trustanchorarn":  "arn:aws:rolesanywhere:eu-west-1:123456789012:trust-anchor/ta",
+			"profilearn":      "arn:aws:rolesanywhere:eu-west-1:123456789012:profile/p",
+			"rolearn":         "arn:aws:iam::123456789012:role/registry",
+			"sessionduration": "15m",
+			"endpoint":        rolesAnywhere.URL,
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating driver: %v", err)
+	}
+	creds := d.baseEmbed.Base.StorageDriver.(*driver).S3.Config.Credentials
+	for i := 0; i < 2; i++ {
+		value, err := creds.Get()
+		if err != nil {
+			t.Fatalf("unexpected error getting credentials: %v", err)
+		}
+		if value.AccessKeyID != "ASIAROLESANYWHERE" || value.SecretAccessKey != "secret" || value.SessionToken != "token" {
+			t.Fatalf("unexpected credentials: %+v", value)
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("expected the credentials to be cached until they expire, got %d requests", n)
+	}
+}
+
+// digestSigner is a crypto.Signer recording the digest it is asked to sign,
+// for the signature of a request to be verified.
+type digestSigner struct {
+	public crypto.PublicKey
+	digest []byte
+}
+
+func (s *digestSigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+func (s *digestSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	s.digest = digest
+	return nil, nil
+}
@@ -92,6 +92,16 @@ type StorageDriver interface {
 	Walk(ctx context.Context, path string, f WalkFn) error
 }
 
+// Linker is implemented by the storage drivers able to store an object at a
+// second path without copying its content, such as with hardlinks.
+type Linker interface {
+	// Link stores the object at sourcePath at destPath as well, replacing
+	// any object stored there, sharing their content. ErrUnsupportedMethod
+	// is returned when the driver cannot link the paths, in which case the
+	// object must be copied instead.
+	Link(ctx context.Context, sourcePath string, destPath string) error
+}
+
 // FileWriter provides an abstraction for an opened writable file-like object in
 // the storage backend. The FileWriter must flush all content written to it on
 // the call to Close, but is only required to make its content readable on a
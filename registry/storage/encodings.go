@@ -0,0 +1,334 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+)
+
+// Content encodings supported for pre-compressed blob variants.
+const (
+	EncodingGzip = "gzip"
+	EncodingZstd = "zstd"
+)
+
+// encodeConcurrency is the maximum number of blobs compressed at once.
+const encodeConcurrency = 4
+
+// blobEncoder generates and looks up pre-compressed variants of blobs in
+// the blob store. Variants are stored next to the blob data, so they are
+// removed along with the blob.
+type blobEncoder struct {
+	driver storagedriver.StorageDriver
+
+	// encodings lists the enabled encodings in order of preference.
+	encodings []string
+
+	// slots bounds the blobs compressed at once, pending the blobs being
+	// compressed, by root directory and digest, so that a blob pushed twice
+	// is only compressed once.
+	slots   chan struct{}
+	mu      sync.Mutex
+	pending map[string]struct{}
+	wg      sync.WaitGroup
+}
+
+// newBlobEncoder returns an encoder generating the variants of the blobs in
+// the given encodings.
+func newBlobEncoder(driver storagedriver.StorageDriver, encodings []string) *blobEncoder {
+	return &blobEncoder{
+		driver:    driver,
+		encodings: encodings,
+		slots:     make(chan struct{}, encodeConcurrency),
+		pending:   make(map[string]struct{}),
+	}
+}
+
+// validateBlobEncoding returns an error if encoding is not supported.
+func validateBlobEncoding(encoding string) error {
+	switch encoding {
+	case EncodingGzip, EncodingZstd:
+		return nil
+	}
+	return fmt.Errorf("unsupported blob encoding: %q", encoding)
+}
+
+// newEncodingWriter wraps w with a compressor for the given encoding.
+func newEncodingWriter(w io.Writer, encoding string) (io.WriteCloser, error) {
+	switch encoding {
+	case EncodingGzip:
+		return gzip.NewWriter(w), nil
+	case EncodingZstd:
+		return zstd.NewWriter(w)
+	}
+	return nil, validateBlobEncoding(encoding)
+}
+
+// encodeAsync generates the variants of the blob identified by desc in the
+// background, so that pushes do not wait for the compression of their
+// blobs. The blob is served as is until its variants are generated.
+func (be *blobEncoder) encodeAsync(ctx context.Context, desc distribution.Descriptor) {
+	root := RootDirectory(ctx)
+	key := path.Join(root, desc.Digest.String())
+	be.mu.Lock()
+	if _, ok := be.pending[key]; ok {
+		be.mu.Unlock()
+		return
+	}
+	be.pending[key] = struct{}{}
+	be.mu.Unlock()
+
+	// the compression outlives the request which pushed the blob, but not
+	// the root directory the blob was pushed to
+	ctx = dcontext.WithLogger(context.Background(), dcontext.GetLogger(ctx))
+	ctx = WithRootDirectory(ctx, root)
+	be.wg.Add(1)
+	go func() {
+		defer be.wg.Done()
+		defer func() {
+			be.mu.Lock()
+			delete(be.pending, key)
+			be.mu.Unlock()
+		}()
+
+		be.slots <- struct{}{}
+		defer func() { <-be.slots }()
+
+		// Variants are an optimization: failing to generate them must not
+		// fail the upload, the blob is then served as is.
+		if err := be.encode(ctx, desc); err != nil {
+			dcontext.GetLogger(ctx).Errorf("error encoding blob %s: %v", desc.Digest, err)
+		}
+	}()
+}
+
+// wait waits for the variants being generated in the background.
+func (be *blobEncoder) wait() {
+	be.wg.Wait()
+}
+
+// encode generates all enabled variants of the blob identified by desc
+// which do not exist yet, unless the blob is compressed already.
+func (be *blobEncoder) encode(ctx context.Context, desc distribution.Descriptor) error {
+	compressed, err := be.compressed(ctx, desc)
+	if err != nil {
+		return err
+	}
+	if compressed {
+		dcontext.GetLogger(ctx).Debugf("(*blobEncoder).encode: %s is compressed already", desc.Digest)
+		return nil
+	}
+
+	for _, encoding := range be.encodings {
+		if _, _, err := be.variant(ctx, desc.Digest, encoding); err == nil {
+			continue
+		}
+
+		if err := be.encodeVariant(ctx, desc, encoding); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compressedMagics are the magic numbers of the gzip and zstd streams,
+// whose compression would not save any space.
+var compressedMagics = [][]byte{
+	{0x1f, 0x8b},
+	{0x28, 0xb5, 0x2f, 0xfd},
+}
+
+// compressed returns whether the blob identified by desc is compressed with
+// gzip or zstd already.
+func (be *blobEncoder) compressed(ctx context.Context, desc distribution.Descriptor) (bool, error) {
+	blobPath, err := pathFor(blobDataPathSpec{digest: desc.Digest})
+	if err != nil {
+		return false, err
+	}
+	br, err := newFileReader(ctx, be.driver, blobPath, desc.Size)
+	if err != nil {
+		return false, err
+	}
+	defer br.Close()
+
+	header := make([]byte, 4)
+	n, err := io.ReadFull(br, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, err
+	}
+	for _, magic := range compressedMagics {
+		if bytes.HasPrefix(header[:n], magic) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// encodeVariant compresses the blob identified by desc and records the
+// digest of the result.
+func (be *blobEncoder) encodeVariant(ctx context.Context, desc distribution.Descriptor, encoding string) error {
+	dcontext.GetLogger(ctx).Debugf("(*blobEncoder).encodeVariant %s %s", desc.Digest, encoding)
+
+	blobPath, err := pathFor(blobDataPathSpec{digest: desc.Digest})
+	if err != nil {
+		return err
+	}
+
+	dataPath, err := pathFor(blobEncodedDataPathSpec{digest: desc.Digest, encoding: encoding})
+	if err != nil {
+		return err
+	}
+
+	linkPath, err := pathFor(blobEncodedLinkPathSpec{digest: desc.Digest, encoding: encoding})
+	if err != nil {
+		return err
+	}
+
+	br, err := newFileReader(ctx, be.driver, blobPath, desc.Size)
+	if err != nil {
+		return err
+	}
+	defer br.Close()
+
+	fw, err := be.driver.Writer(ctx, dataPath, false)
+	if err != nil {
+		return err
+	}
+
+	digester := digest.Canonical.Digester()
+	ew, err := newEncodingWriter(io.MultiWriter(fw, digester.Hash()), encoding)
+	if err != nil {
+		fw.Cancel()
+		return err
+	}
+
+	if _, err := io.Copy(ew, br); err != nil {
+		fw.Cancel()
+		return err
+	}
+
+	if err := ew.Close(); err != nil {
+		fw.Cancel()
+		return err
+	}
+
+	if err := fw.Commit(); err != nil {
+		fw.Cancel()
+		return err
+	}
+
+	if err := fw.Close(); err != nil {
+		return err
+	}
+
+	// The link is written last, so a variant is only ever served once its
+	// data is complete.
+	return be.driver.PutContent(ctx, linkPath, []byte(digester.Digest()))
+}
+
+// variant returns a descriptor of the variant of the blob identified by dgst
+// in the given encoding, along with the path of its data.
+func (be *blobEncoder) variant(ctx context.Context, dgst digest.Digest, encoding string) (distribution.Descriptor, string, error) {
+	linkPath, err := pathFor(blobEncodedLinkPathSpec{digest: dgst, encoding: encoding})
+	if err != nil {
+		return distribution.Descriptor{}, "", err
+	}
+
+	content, err := be.driver.GetContent(ctx, linkPath)
+	if err != nil {
+		return distribution.Descriptor{}, "", err
+	}
+
+	variantDigest, err := digest.Parse(string(content))
+	if err != nil {
+		return distribution.Descriptor{}, "", err
+	}
+
+	dataPath, err := pathFor(blobEncodedDataPathSpec{digest: dgst, encoding: encoding})
+	if err != nil {
+		return distribution.Descriptor{}, "", err
+	}
+
+	fi, err := be.driver.Stat(ctx, dataPath)
+	if err != nil {
+		return distribution.Descriptor{}, "", err
+	}
+
+	return distribution.Descriptor{
+		Size:   fi.Size(),
+		Digest: variantDigest,
+	}, dataPath, nil
+}
+
+// negotiateEncoding returns the preferred enabled encoding accepted by the
+// request, or an empty string if the blob should be served as is.
+func (be *blobEncoder) negotiateEncoding(r *http.Request) string {
+	return NegotiateEncoding(r, be.encodings)
+}
+
+// NegotiateEncoding returns the encoding of encodings, in order of
+// preference, with the highest quality in the Accept-Encoding headers of the
+// request, or an empty string if none is accepted.
+func NegotiateEncoding(r *http.Request, encodings []string) string {
+	accepted := parseAcceptEncoding(r.Header.Values("Accept-Encoding"))
+	if len(accepted) == 0 {
+		return ""
+	}
+
+	var (
+		best  string
+		bestQ float64
+	)
+	for _, encoding := range encodings {
+		q, ok := accepted[encoding]
+		if !ok {
+			q, ok = accepted["*"]
+		}
+		if !ok || q <= bestQ {
+			continue
+		}
+		best, bestQ = encoding, q
+	}
+	return best
+}
+
+// parseAcceptEncoding maps the codings listed in Accept-Encoding headers to
+// their quality value.
+func parseAcceptEncoding(headers []string) map[string]float64 {
+	accepted := make(map[string]float64)
+	for _, header := range headers {
+		for _, part := range strings.Split(header, ",") {
+			coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding == "" {
+				continue
+			}
+
+			q := 1.0
+			for _, param := range strings.Split(params, ";") {
+				key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+				if !ok || strings.TrimSpace(key) != "q" {
+					continue
+				}
+				if parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+					q = parsed
+				}
+			}
+			accepted[coding] = q
+		}
+	}
+	return accepted
+}
@@ -0,0 +1,334 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/distribution/v3/registry/storage/driver/testdriver"
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	encoder := &blobEncoder{encodings: []string{EncodingZstd, EncodingGzip}}
+
+	for _, tc := range []struct {
+		acceptEncoding string
+		expected       string
+	}{
+		{acceptEncoding: "", expected: ""},
+		{acceptEncoding: "identity", expected: ""},
+		{acceptEncoding: "gzip", expected: EncodingGzip},
+		{acceptEncoding: "gzip, zstd", expected: EncodingZstd},
+		{acceptEncoding: "gzip;q=1.0, zstd;q=0.5", expected: EncodingGzip},
+		{acceptEncoding: "zstd;q=0, gzip", expected: EncodingGzip},
+		{acceptEncoding: "*", expected: EncodingZstd},
+		{acceptEncoding: "ZSTD", expected: EncodingZstd},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tc.acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		}
+
+		if encoding := encoder.negotiateEncoding(r); encoding != tc.expected {
+			t.Errorf("Accept-Encoding %q: expected %q, got %q", tc.acceptEncoding, tc.expected, encoding)
+		}
+	}
+}
+
+// registryEncoder returns the blob encoder of the registry.
+func registryEncoder(ns distribution.Namespace) *blobEncoder {
+	return ns.(*registry).blobEncoder
+}
+
+// waitBlobEncodings waits for the variants of the blobs pushed to the
+// registry to be generated.
+func waitBlobEncodings(ns distribution.Namespace) {
+	registryEncoder(ns).wait()
+}
+
+func TestEnableBlobEncodingsInvalid(t *testing.T) {
+	if _, err := NewRegistry(context.Background(), testdriver.New(), EnableBlobEncodings("br")); err == nil {
+		t.Fatal("expected error enabling unsupported encoding")
+	}
+}
+
+// TestServeEncodedBlob ensures variants are generated on push and served to
+// clients accepting them.
+func TestServeEncodedBlob(t *testing.T) {
+	ctx := context.Background()
+	imageName, _ := reference.WithName("foo/bar")
+	registry, err := NewRegistry(ctx, testdriver.New(), EnableRedirect, EnableBlobEncodings(EncodingZstd, EncodingGzip))
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+	repository, err := registry.Repository(ctx, imageName)
+	if err != nil {
+		t.Fatalf("unexpected error getting repo: %v", err)
+	}
+	bs := repository.Blobs(ctx)
+
+	contents := bytes.Repeat([]byte("compressible content "), 1024)
+	dgst := digest.FromBytes(contents)
+
+	wr, err := bs.Create(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error starting upload: %v", err)
+	}
+	if _, err := wr.Write(contents); err != nil {
+		t.Fatalf("unexpected error writing upload: %v", err)
+	}
+	if _, err := wr.Commit(ctx, distribution.Descriptor{Digest: dgst}); err != nil {
+		t.Fatalf("unexpected error committing upload: %v", err)
+	}
+	waitBlobEncodings(registry)
+
+	for _, tc := range []struct {
+		acceptEncoding string
+		decode         func(io.Reader) (io.Reader, error)
+	}{
+		{
+			acceptEncoding: "",
+			decode:         func(r io.Reader) (io.Reader, error) { return r, nil },
+		},
+		{
+			acceptEncoding: EncodingGzip,
+			decode:         func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		},
+		{
+			acceptEncoding: EncodingZstd,
+			decode:         func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) },
+		},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tc.acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+
+		if err := bs.ServeBlob(ctx, w, r, dgst); err != nil {
+			t.Fatalf("%q: unexpected error serving blob: %v", tc.acceptEncoding, err)
+		}
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("%q: unexpected status code %d", tc.acceptEncoding, w.Code)
+		}
+		if encoding := w.Header().Get("Content-Encoding"); encoding != tc.acceptEncoding {
+			t.Fatalf("%q: unexpected Content-Encoding %q", tc.acceptEncoding, encoding)
+		}
+		if w.Header().Get("Docker-Content-Digest") != dgst.String() {
+			t.Fatalf("%q: unexpected Docker-Content-Digest %q", tc.acceptEncoding, w.Header().Get("Docker-Content-Digest"))
+		}
+		if w.Header().Get("Vary") != "Accept-Encoding" {
+			t.Fatalf("%q: unexpected Vary %q", tc.acceptEncoding, w.Header().Get("Vary"))
+		}
+		if tc.acceptEncoding != "" && w.Header().Get("ETag") != `"`+digest.FromBytes(w.Body.Bytes()).String()+`"` {
+			t.Fatalf("%q: ETag %q does not match the variant", tc.acceptEncoding, w.Header().Get("ETag"))
+		}
+
+		rd, err := tc.decode(w.Body)
+		if err != nil {
+			t.Fatalf("%q: unexpected error decoding body: %v", tc.acceptEncoding, err)
+		}
+		decoded, err := ioutil.ReadAll(rd)
+		if err != nil {
+			t.Fatalf("%q: unexpected error reading body: %v", tc.acceptEncoding, err)
+		}
+		if !bytes.Equal(decoded, contents) {
+			t.Fatalf("%q: decoded content does not match blob", tc.acceptEncoding)
+		}
+	}
+}
+
+func TestServeEncodedBlobConditional(t *testing.T) {
+	ctx := context.Background()
+	imageName, _ := reference.WithName("foo/bar")
+	registry, err := NewRegistry(ctx, testdriver.New(), EnableBlobEncodings(EncodingGzip))
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+	repository, err := registry.Repository(ctx, imageName)
+	if err != nil {
+		t.Fatalf("unexpected error getting repo: %v", err)
+	}
+	bs := repository.Blobs(ctx)
+
+	contents := bytes.Repeat([]byte("compressible content "), 1024)
+	dgst := digest.FromBytes(contents)
+
+	wr, err := bs.Create(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error starting upload: %v", err)
+	}
+	if _, err := wr.Write(contents); err != nil {
+		t.Fatalf("unexpected error writing upload: %v", err)
+	}
+	if _, err := wr.Commit(ctx, distribution.Descriptor{Digest: dgst, MediaType: "application/octet-stream"}); err != nil {
+		t.Fatalf("unexpected error committing upload: %v", err)
+	}
+	waitBlobEncodings(registry)
+
+	serve := func(method string, headers map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/", nil)
+		r.Header.Set("Accept-Encoding", EncodingGzip)
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		if err := bs.ServeBlob(ctx, w, r, dgst); err != nil {
+			t.Fatalf("unexpected error serving blob: %v", err)
+		}
+		return w
+	}
+
+	w := serve(http.MethodGet, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %d", w.Code)
+	}
+	encoded := w.Body.Bytes()
+	etag := w.Header().Get("ETag")
+
+	w = serve(http.MethodHead, nil)
+	if w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Fatalf("unexpected HEAD response %d with %d bytes", w.Code, w.Body.Len())
+	}
+	for header, expected := range map[string]string{
+		"Content-Encoding":      EncodingGzip,
+		"Content-Length":        fmt.Sprint(len(encoded)),
+		"Content-Type":          "application/octet-stream",
+		"Docker-Content-Digest": dgst.String(),
+		"ETag":                  etag,
+	} {
+		if w.Header().Get(header) != expected {
+			t.Errorf("unexpected %s %q on HEAD, expected %q", header, w.Header().Get(header), expected)
+		}
+	}
+
+	w = serve(http.MethodGet, map[string]string{"Range": "bytes=10-19"})
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("unexpected range status code %d", w.Code)
+	}
+	if !bytes.Equal(w.Body.Bytes(), encoded[10:20]) {
+		t.Fatalf("range does not match the encoded variant")
+	}
+	if w.Header().Get("Content-Range") != fmt.Sprintf("bytes 10-19/%d", len(encoded)) {
+		t.Fatalf("unexpected Content-Range %q", w.Header().Get("Content-Range"))
+	}
+	if w.Header().Get("Content-Length") != "10" {
+		t.Fatalf("unexpected range Content-Length %q", w.Header().Get("Content-Length"))
+	}
+
+	w = serve(http.MethodGet, map[string]string{"If-None-Match": etag})
+	if w.Code != http.StatusNotModified {
+		t.Fatalf("unexpected status code %d with the variant ETag", w.Code)
+	}
+
+	// the ETag of the blob does not match its variant
+	w = serve(http.MethodGet, map[string]string{"If-None-Match": `"` + dgst.String() + `"`})
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), encoded) {
+		t.Fatalf("unexpected response %d with the blob ETag", w.Code)
+	}
+}
+
+// TestEncodeCompressedBlob ensures no variant is generated for the blobs
+// compressed already.
+func TestEncodeCompressedBlob(t *testing.T) {
+	ctx := context.Background()
+	imageName, _ := reference.WithName("foo/bar")
+	registry, err := NewRegistry(ctx, testdriver.New(), EnableBlobEncodings(EncodingZstd, EncodingGzip))
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+	repository, err := registry.Repository(ctx, imageName)
+	if err != nil {
+		t.Fatalf("unexpected error getting repo: %v", err)
+	}
+	bs := repository.Blobs(ctx)
+
+	var compressed bytes.Buffer
+	gw := gzip.NewWriter(&compressed)
+	if _, err := gw.Write(bytes.Repeat([]byte("compressible content "), 1024)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	desc, err := bs.Put(ctx, "application/vnd.oci.image.layer.v1.tar+gzip", compressed.Bytes())
+	if err != nil {
+		t.Fatalf("unexpected error putting blob: %v", err)
+	}
+	waitBlobEncodings(registry)
+	encoder := registryEncoder(registry)
+
+	for _, encoding := range encoder.encodings {
+		if _, _, err := encoder.variant(ctx, desc.Digest, encoding); err == nil {
+			t.Errorf("unexpected %s variant of a compressed blob", encoding)
+		}
+	}
+}
+
+// TestServeEncodedBlobRootDirectory ensures the variants of the blobs pushed
+// under a root directory are generated and served within it.
+func TestServeEncodedBlobRootDirectory(t *testing.T) {
+	ctx := context.Background()
+	backend := inmemory.New()
+	registry, err := NewRegistry(ctx, NewContextRootedDriver(backend), EnableBlobEncodings(EncodingGzip))
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+	acme := WithRootDirectory(ctx, "/tenants/acme")
+
+	imageName, _ := reference.WithName("foo/bar")
+	repository, err := registry.Repository(acme, imageName)
+	if err != nil {
+		t.Fatalf("unexpected error getting repo: %v", err)
+	}
+	bs := repository.Blobs(acme)
+
+	contents := bytes.Repeat([]byte("compressible content "), 1024)
+	dgst := digest.FromBytes(contents)
+
+	wr, err := bs.Create(acme)
+	if err != nil {
+		t.Fatalf("unexpected error starting upload: %v", err)
+	}
+	if _, err := wr.Write(contents); err != nil {
+		t.Fatalf("unexpected error writing upload: %v", err)
+	}
+	if _, err := wr.Commit(acme, distribution.Descriptor{Digest: dgst}); err != nil {
+		t.Fatalf("unexpected error committing upload: %v", err)
+	}
+	waitBlobEncodings(registry)
+
+	linkPath, err := pathFor(blobEncodedLinkPathSpec{digest: dgst, encoding: EncodingGzip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.Stat(ctx, path.Join("/tenants/acme", linkPath)); err != nil {
+		t.Fatalf("expected the variant to be stored in the root directory: %v", err)
+	}
+	if _, err := backend.Stat(ctx, linkPath); err == nil {
+		t.Fatal("unexpected variant stored outside of the root directory")
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", EncodingGzip)
+	w := httptest.NewRecorder()
+	if err := bs.ServeBlob(acme, w, r, dgst); err != nil {
+		t.Fatalf("unexpected error serving blob: %v", err)
+	}
+	if encoding := w.Header().Get("Content-Encoding"); w.Code != http.StatusOK || encoding != EncodingGzip {
+		t.Fatalf("unexpected response %d with Content-Encoding %q", w.Code, encoding)
+	}
+}
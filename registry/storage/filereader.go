@@ -11,11 +11,9 @@ import (
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
 )
 
-// TODO(stevvooe): Set an optimal buffer size here. We'll have to
-// understand the latency characteristics of the underlying network to
-// set this correctly, so we may want to leave it to the driver. For
-// out of process drivers, we'll have to optimize this buffer size for
-// local communication.
+// fileReaderBufferSize is the default size of the read buffer. The blob
+// server may be configured with another size, to match the latency
+// characteristics of the storage backend.
 const fileReaderBufferSize = 4 << 20
 
 // remoteFileReader provides a read seeker interface to files stored in
@@ -30,6 +28,11 @@ type fileReader struct {
 	path string
 	size int64 // size is the total size, must be set.
 
+	// bufferSize is the size of the read buffer. Seeking forward by up to
+	// bufferSize bytes reads through the current reader rather than
+	// opening a new one, so that close ranges are served by a single read.
+	bufferSize int
+
 	// mutable fields
 	rc     io.ReadCloser // remote read closer
 	brd    *bufio.Reader // internal buffered io
@@ -43,10 +46,11 @@ type fileReader struct {
 // there.
 func newFileReader(ctx context.Context, driver storagedriver.StorageDriver, path string, size int64) (*fileReader, error) {
 	return &fileReader{
-		ctx:    ctx,
-		driver: driver,
-		path:   path,
-		size:   size,
+		ctx:        ctx,
+		driver:     driver,
+		path:       path,
+		size:       size,
+		bufferSize: fileReaderBufferSize,
 	}, nil
 }
 
@@ -91,7 +95,7 @@ func (fr *fileReader) Seek(offset int64, whence int) (int64, error) {
 	if newOffset < 0 {
 		err = fmt.Errorf("cannot seek to negative position")
 	} else {
-		if fr.offset != newOffset {
+		if fr.offset != newOffset && !fr.skip(newOffset-fr.offset) {
 			fr.reset()
 		}
 
@@ -135,7 +139,7 @@ func (fr *fileReader) reader() (io.Reader, error) {
 	fr.rc = rc
 
 	if fr.brd == nil {
-		fr.brd = bufio.NewReaderSize(fr.rc, fileReaderBufferSize)
+		fr.brd = bufio.NewReaderSize(fr.rc, fr.bufferSize)
 	} else {
 		fr.brd.Reset(fr.rc)
 	}
@@ -143,6 +147,17 @@ func (fr *fileReader) reader() (io.Reader, error) {
 	return fr.brd, nil
 }
 
+// skip discards the next n bytes of the current reader, returning whether it
+// did. Only forward skips of up to the buffer size are done, larger ones
+// being cheaper with a new reader.
+func (fr *fileReader) skip(n int64) bool {
+	if fr.rc == nil || n <= 0 || n > int64(fr.bufferSize) {
+		return false
+	}
+	discarded, err := fr.brd.Discard(int(n))
+	return err == nil && discarded == int(n)
+}
+
 // resetReader resets the reader, forcing the read method to open up a new
 // connection and rebuild the buffered reader. This should be called when the
 // offset and the reader will become out of sync, such as during a seek
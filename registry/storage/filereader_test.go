@@ -191,3 +191,50 @@ func TestFileReaderErrors(t *testing.T) {
 	//     failure cases and how the storage driver propagates these errors
 	//     up the stack.
 }
+
+// TestFileReaderSeekAhead ensures that seeking forward within the buffer size
+// reads through the current reader rather than opening a new one.
+func TestFileReaderSeekAhead(t *testing.T) {
+	ctx := context.Background()
+	driver := &readerCountingDriver{StorageDriver: inmemory.New()}
+	path := "/patterned"
+	content := bytes.Repeat([]byte("01234567890ab"), 1024)
+	if err := driver.PutContent(ctx, path, content); err != nil {
+		t.Fatalf("error putting patterned content: %v", err)
+	}
+
+	fr, err := newFileReader(ctx, driver, path, int64(len(content)))
+	if err != nil {
+		t.Fatalf("unexpected error creating file reader: %v", err)
+	}
+	defer fr.Close()
+	fr.bufferSize = 1024
+
+	p := make([]byte, 16)
+	for _, tc := range []struct {
+		offset  int64
+		readers int
+	}{
+		{offset: 0, readers: 1},
+		{offset: 100, readers: 1},
+		{offset: 1000, readers: 1},
+		{offset: 500, readers: 2},  // backward
+		{offset: 8000, readers: 3}, // beyond the buffer size
+		{offset: 8012, readers: 3}, // where the last read ended
+		{offset: 8500, readers: 3}, // within the buffer size of the last read
+	} {
+		if _, err := fr.Seek(tc.offset, io.SeekStart); err != nil {
+			t.Fatalf("unexpected error seeking to %d: %v", tc.offset, err)
+		}
+		n, err := io.ReadFull(fr, p[:12])
+		if err != nil {
+			t.Fatalf("unexpected error reading at %d: %v", tc.offset, err)
+		}
+		if !bytes.Equal(p[:n], content[tc.offset:tc.offset+12]) {
+			t.Fatalf("unexpected content at %d: %q", tc.offset, p[:n])
+		}
+		if driver.readers != tc.readers {
+			t.Fatalf("expected %d readers after reading at %d, got %d", tc.readers, tc.offset, driver.readers)
+		}
+	}
+}
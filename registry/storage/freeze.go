@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+var _ distribution.RepositoryFreezer = &repository{}
+
+// Frozen reports whether the repository is frozen, that is whether it holds
+// a _frozen file.
+func (repo *repository) Frozen(ctx context.Context) (bool, error) {
+	frozenPath, err := pathFor(repositoryFrozenPathSpec{name: repo.name.Name()})
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := repo.driver.Stat(ctx, frozenPath); err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); ok {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// SetFrozen freezes the repository by writing its _frozen file, holding the
+// time it was frozen, and unfreezes it by deleting the file.
+func (repo *repository) SetFrozen(ctx context.Context, frozen bool) error {
+	frozenPath, err := pathFor(repositoryFrozenPathSpec{name: repo.name.Name()})
+	if err != nil {
+		return err
+	}
+
+	if frozen {
+		return repo.driver.PutContent(ctx, frozenPath, []byte(time.Now().UTC().Format(time.RFC3339)))
+	}
+
+	if err := repo.driver.Delete(ctx, frozenPath); err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,414 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+)
+
+// FsckProblemKind is the kind of an inconsistency found in the storage.
+type FsckProblemKind string
+
+const (
+	// FsckCorruptedBlob is a blob whose content does not hash to its
+	// digest. It is removed on repair, so it can be pushed again.
+	FsckCorruptedBlob FsckProblemKind = "corrupted-blob"
+	// FsckInvalidLink is a link file whose content is not a digest.
+	FsckInvalidLink FsckProblemKind = "invalid-link"
+	// FsckDanglingLink is a layer or manifest revision link to a blob
+	// missing from the blob store. It is removed on repair.
+	FsckDanglingLink FsckProblemKind = "dangling-link"
+	// FsckDanglingTag is a tag of a manifest missing from its repository.
+	// It is removed on repair.
+	FsckDanglingTag FsckProblemKind = "dangling-tag"
+	// FsckOrphanedUpload is an upload without start time, or started
+	// before the upload max age. It is removed on repair.
+	FsckOrphanedUpload FsckProblemKind = "orphaned-upload"
+)
+
+// FsckOpts contains options for the consistency check.
+type FsckOpts struct {
+	// VerifySample is the fraction of the blobs whose content is hashed to
+	// check it matches their digest: none if zero, all of them if one.
+	VerifySample float64
+	// UploadMaxAge is the age past which uploads are reported as orphaned.
+	// If zero, only the uploads without start time are.
+	UploadMaxAge time.Duration
+	// Repair removes the corrupted blobs, dangling links and tags, and the
+	// orphaned uploads. The invalid links are only reported.
+	Repair bool
+}
+
+// FsckReport describes the inconsistencies found in the storage.
+type FsckReport struct {
+	Problems []FsckProblem `json:"problems"`
+	// VerifiedBlobs is the number of blobs whose content was hashed.
+	VerifiedBlobs int `json:"verifiedBlobs"`
+}
+
+// FsckProblem is an inconsistency found in the storage.
+type FsckProblem struct {
+	Kind       FsckProblemKind `json:"kind"`
+	Repository string          `json:"repository,omitempty"`
+	// Path is the path of the inconsistent file in the storage.
+	Path   string        `json:"path"`
+	Digest digest.Digest `json:"digest,omitempty"`
+	Tag    string        `json:"tag,omitempty"`
+	// Repaired is set once the problem is repaired.
+	Repaired bool `json:"repaired"`
+}
+
+// Unrepaired returns the number of problems which were not repaired.
+func (r *FsckReport) Unrepaired() int {
+	var n int
+	for _, p := range r.Problems {
+		if !p.Repaired {
+			n++
+		}
+	}
+	return n
+}
+
+// fsck checks the consistency of the storage of a registry.
+type fsck struct {
+	driver   driver.StorageDriver
+	registry distribution.Namespace
+	opts     FsckOpts
+	report   *FsckReport
+}
+
+// Fsck checks the consistency of the storage of a registry: the content of
+// the blobs matches their digest, the links of the repositories point at
+// existing blobs, the tags at existing manifests, and the uploads are not
+// abandoned. It can run while the registry serves requests, though uploads
+// and deletions in progress may then be reported, and repairs must only be
+// made when the registry is stopped or read-only.
+//
+// The blobs are checked first, so that the links to the corrupted blobs
+// removed on repair are reported as dangling and removed as well.
+func Fsck(ctx context.Context, storageDriver driver.StorageDriver, registry distribution.Namespace, opts FsckOpts) (*FsckReport, error) {
+	f := &fsck{
+		driver:   storageDriver,
+		registry: registry,
+		opts:     opts,
+		report:   &FsckReport{},
+	}
+
+	if err := f.checkBlobs(ctx); err != nil {
+		return nil, fmt.Errorf("failed to check blobs: %v", err)
+	}
+
+	repositoryEnumerator, ok := registry.(distribution.RepositoryEnumerator)
+	if !ok {
+		return nil, fmt.Errorf("unable to convert Namespace to RepositoryEnumerator")
+	}
+	var names []string
+	err := repositoryEnumerator.Enumerate(ctx, func(repoName string) error {
+		names = append(names, repoName)
+		return nil
+	})
+	if _, ok := err.(driver.PathNotFoundError); !ok && err != nil {
+		return nil, fmt.Errorf("failed to enumerate repositories: %v", err)
+	}
+	for _, repoName := range names {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if err := f.checkRepository(ctx, repoName); err != nil {
+			return nil, fmt.Errorf("failed to check repository %s: %v", repoName, err)
+		}
+	}
+
+	if err := f.checkUploads(ctx); err != nil {
+		return nil, fmt.Errorf("failed to check uploads: %v", err)
+	}
+	return f.report, nil
+}
+
+// problem records a problem, repairing it with repair if enabled.
+func (f *fsck) problem(ctx context.Context, p FsckProblem, repair func() error) error {
+	log := dcontext.GetLogger(ctx)
+	log.Warnf("fsck: %s %s", p.Kind, p.Path)
+	if f.opts.Repair && repair != nil {
+		if err := repair(); err != nil {
+			return fmt.Errorf("failed to repair %s %s: %v", p.Kind, p.Path, err)
+		}
+		p.Repaired = true
+		log.Infof("fsck: repaired %s %s", p.Kind, p.Path)
+	}
+	f.report.Problems = append(f.report.Problems, p)
+	return nil
+}
+
+// checkBlobs hashes the sampled blobs of the blob store.
+func (f *fsck) checkBlobs(ctx context.Context) error {
+	if f.opts.VerifySample <= 0 {
+		return nil
+	}
+	blobService := f.registry.Blobs()
+	// the blobs are removed after the enumeration, which may otherwise
+	// interfere with it
+	var corrupted []digest.Digest
+	err := blobService.Enumerate(ctx, func(dgst digest.Digest) error {
+		if f.opts.VerifySample < 1 && rand.Float64() >= f.opts.VerifySample {
+			return nil
+		}
+		ok, err := f.verifyBlob(ctx, dgst)
+		if err != nil {
+			return err
+		}
+		f.report.VerifiedBlobs++
+		if !ok {
+			corrupted = append(corrupted, dgst)
+		}
+		return nil
+	})
+	if _, ok := err.(driver.PathNotFoundError); !ok && err != nil {
+		return err
+	}
+
+	vacuum := registryVacuum(ctx, f.driver, f.registry)
+	for _, dgst := range corrupted {
+		blobPath, err := pathFor(blobDataPathSpec{digest: dgst})
+		if err != nil {
+			return err
+		}
+		err = f.problem(ctx, FsckProblem{Kind: FsckCorruptedBlob, Path: blobPath, Digest: dgst}, func() error {
+			return vacuum.RemoveBlob(dgst.String())
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyBlob reports whether the content of a blob hashes to its digest.
+func (f *fsck) verifyBlob(ctx context.Context, dgst digest.Digest) (bool, error) {
+	if !dgst.Algorithm().Available() {
+		return true, nil
+	}
+	blobPath, err := pathFor(blobDataPathSpec{digest: dgst})
+	if err != nil {
+		return false, err
+	}
+	rc, err := f.driver.Reader(ctx, blobPath, 0)
+	if err != nil {
+		return false, err
+	}
+	defer rc.Close()
+
+	verifier := dgst.Verifier()
+	if _, err := io.Copy(verifier, rc); err != nil {
+		return false, err
+	}
+	return verifier.Verified(), nil
+}
+
+// checkRepository checks the layer and manifest revision links, and the
+// tags of a repository.
+func (f *fsck) checkRepository(ctx context.Context, repoName string) error {
+	layersPath, err := pathFor(layersPathSpec{name: repoName})
+	if err != nil {
+		return err
+	}
+	if err := f.checkLinks(ctx, repoName, layersPath); err != nil {
+		return err
+	}
+	revisionsPath, err := pathFor(manifestRevisionsPathSpec{name: repoName})
+	if err != nil {
+		return err
+	}
+	if err := f.checkLinks(ctx, repoName, revisionsPath); err != nil {
+		return err
+	}
+	return f.checkTags(ctx, repoName)
+}
+
+// checkLinks checks the link files under root point at existing blobs.
+func (f *fsck) checkLinks(ctx context.Context, repoName, root string) error {
+	var links []string
+	err := f.driver.Walk(ctx, root, func(fileInfo driver.FileInfo) error {
+		if !fileInfo.IsDir() && path.Base(fileInfo.Path()) == "link" {
+			links = append(links, fileInfo.Path())
+		}
+		return nil
+	})
+	if _, ok := err.(driver.PathNotFoundError); !ok && err != nil {
+		return err
+	}
+
+	for _, linkPath := range links {
+		content, err := f.driver.GetContent(ctx, linkPath)
+		if err != nil {
+			if _, ok := err.(driver.PathNotFoundError); ok {
+				// removed meanwhile
+				continue
+			}
+			return err
+		}
+		dgst, err := digest.Parse(string(content))
+		if err != nil {
+			if err := f.problem(ctx, FsckProblem{Kind: FsckInvalidLink, Repository: repoName, Path: linkPath}, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		exists, err := f.blobExists(ctx, dgst)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		err = f.problem(ctx, FsckProblem{Kind: FsckDanglingLink, Repository: repoName, Path: linkPath, Digest: dgst}, func() error {
+			return f.driver.Delete(ctx, path.Dir(linkPath))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkTags checks the tags of a repository point at existing manifests.
+func (f *fsck) checkTags(ctx context.Context, repoName string) error {
+	named, err := reference.WithName(repoName)
+	if err != nil {
+		return fmt.Errorf("failed to parse repo name %s: %v", repoName, err)
+	}
+	repository, err := f.registry.Repository(ctx, named)
+	if err != nil {
+		return fmt.Errorf("failed to construct repository: %v", err)
+	}
+	tagService := repository.Tags(ctx)
+	tags, err := tagService.All(ctx)
+	if err != nil {
+		if _, ok := err.(distribution.ErrRepositoryUnknown); ok {
+			return nil
+		}
+		return fmt.Errorf("failed to retrieve tags: %v", err)
+	}
+	sort.Strings(tags)
+
+	for _, tag := range tags {
+		currentPath, err := pathFor(manifestTagCurrentPathSpec{name: repoName, tag: tag})
+		if err != nil {
+			return err
+		}
+		content, err := f.driver.GetContent(ctx, currentPath)
+		if err != nil {
+			if _, ok := err.(driver.PathNotFoundError); ok {
+				continue
+			}
+			return err
+		}
+		dgst, err := digest.Parse(string(content))
+		if err != nil {
+			if err := f.problem(ctx, FsckProblem{Kind: FsckInvalidLink, Repository: repoName, Path: currentPath, Tag: tag}, nil); err != nil {
+				return err
+			}
+			continue
+		}
+
+		revisionPath, err := manifestRevisionLinkPath(repoName, dgst)
+		if err != nil {
+			return err
+		}
+		_, err = f.driver.Stat(ctx, revisionPath)
+		switch err.(type) {
+		case nil:
+			exists, err := f.blobExists(ctx, dgst)
+			if err != nil {
+				return err
+			}
+			if exists {
+				continue
+			}
+		case driver.PathNotFoundError:
+		default:
+			return err
+		}
+
+		tag := tag
+		err = f.problem(ctx, FsckProblem{Kind: FsckDanglingTag, Repository: repoName, Path: currentPath, Digest: dgst, Tag: tag}, func() error {
+			return tagService.Untag(ctx, tag)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkUploads reports the uploads without start time, or started before
+// the upload max age.
+func (f *fsck) checkUploads(ctx context.Context) error {
+	root, err := pathFor(repositoriesRootPathSpec{})
+	if err != nil {
+		return err
+	}
+	if _, err := f.driver.Stat(ctx, root); err != nil {
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			return nil
+		}
+		return err
+	}
+
+	// the uploads whose start time cannot be read are reported as orphaned
+	uploads, errs := getOutstandingUploads(ctx, f.driver)
+	for _, err := range errs {
+		dcontext.GetLogger(ctx).Warnf("fsck: %v", err)
+	}
+
+	now := time.Now()
+	var dirs []string
+	for _, upload := range uploads {
+		if upload.containingDir == "" {
+			continue
+		}
+		// the start time of the uploads without one is in the future
+		if upload.startedAt.After(now) || (f.opts.UploadMaxAge > 0 && now.Sub(upload.startedAt) > f.opts.UploadMaxAge) {
+			dirs = append(dirs, upload.containingDir)
+		}
+	}
+	sort.Strings(dirs)
+
+	for _, dir := range dirs {
+		dir := dir
+		repoName := uploadData{containingDir: dir}.repository(root)
+		err := f.problem(ctx, FsckProblem{Kind: FsckOrphanedUpload, Repository: repoName, Path: dir}, func() error {
+			return f.driver.Delete(ctx, dir)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blobExists reports whether a blob is in the blob store.
+func (f *fsck) blobExists(ctx context.Context, dgst digest.Digest) (bool, error) {
+	blobPath, err := pathFor(blobDataPathSpec{digest: dgst})
+	if err != nil {
+		return false, err
+	}
+	_, err = f.driver.Stat(ctx, blobPath)
+	switch err.(type) {
+	case nil:
+		return true, nil
+	case driver.PathNotFoundError:
+		return false, nil
+	}
+	return false, err
+}
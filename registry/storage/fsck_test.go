@@ -0,0 +1,191 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	storagemiddleware "github.com/distribution/distribution/v3/registry/storage/driver/middleware"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/middleware/encrypt"
+	"github.com/distribution/distribution/v3/uuid"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func fsckKinds(report *FsckReport) map[FsckProblemKind]int {
+	kinds := make(map[FsckProblemKind]int)
+	for _, p := range report.Problems {
+		kinds[p.Kind]++
+	}
+	return kinds
+}
+
+func TestFsck(t *testing.T) {
+	ctx := context.Background()
+	d := inmemory.New()
+	registry := createRegistry(t, d)
+	repo := makeRepository(t, registry, "fsck")
+	bs := repo.Blobs(ctx)
+
+	if _, err := Fsck(ctx, d, registry, FsckOpts{VerifySample: 1}); err != nil {
+		t.Fatalf("unexpected error checking an empty storage: %v", err)
+	}
+
+	config, err := bs.Put(ctx, v1.MediaTypeImageConfig, []byte("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer, err := bs.Put(ctx, v1.MediaTypeImageLayerGzip, []byte("layer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned: manifest.Versioned{
+			SchemaVersion: 2,
+			MediaType:     v1.MediaTypeImageManifest,
+		},
+		Config: config,
+		Layers: []distribution.Descriptor{layer},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dgst, err := makeManifestService(t, repo).Put(ctx, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Tags(ctx).Tag(ctx, "latest", distribution.Descriptor{Digest: dgst}); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Fsck(ctx, d, registry, FsckOpts{VerifySample: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 0 {
+		t.Fatalf("unexpected problems in a consistent storage: %v", report.Problems)
+	}
+	if report.VerifiedBlobs != 3 {
+		t.Errorf("expected 3 verified blobs, got %d", report.VerifiedBlobs)
+	}
+
+	// corrupt the layer
+	layerPath, err := pathFor(blobDataPathSpec{digest: layer.Digest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutContent(ctx, layerPath, []byte("corrupted")); err != nil {
+		t.Fatal(err)
+	}
+	// tag a missing manifest
+	currentPath, err := pathFor(manifestTagCurrentPathSpec{name: "fsck", tag: "dangling"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutContent(ctx, currentPath, []byte(digest.FromString("missing"))); err != nil {
+		t.Fatal(err)
+	}
+	// write an invalid link
+	invalidPath, err := blobLinkPath("fsck", digest.FromString("invalid"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutContent(ctx, invalidPath, []byte("invalid")); err != nil {
+		t.Fatal(err)
+	}
+	// abandon an upload without start time
+	uploadPath, err := pathFor(uploadDataPathSpec{name: "fsck", id: uuid.Generate().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutContent(ctx, uploadPath, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err = Fsck(ctx, d, registry, FsckOpts{VerifySample: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[FsckProblemKind]int{
+		FsckCorruptedBlob:  1,
+		FsckDanglingTag:    1,
+		FsckInvalidLink:    1,
+		FsckOrphanedUpload: 1,
+	}
+	if kinds := fsckKinds(report); len(kinds) != len(expected) {
+		t.Fatalf("expected problems %v, got %v", expected, kinds)
+	} else {
+		for kind, n := range expected {
+			if kinds[kind] != n {
+				t.Errorf("expected %d %s, got %d", n, kind, kinds[kind])
+			}
+		}
+	}
+	if report.Unrepaired() != len(report.Problems) {
+		t.Errorf("expected no problem repaired")
+	}
+
+	// the link to the corrupted layer removed is dangling
+	report, err = Fsck(ctx, d, registry, FsckOpts{VerifySample: 1, Repair: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected[FsckDanglingLink] = 1
+	kinds := fsckKinds(report)
+	for kind, n := range expected {
+		if kinds[kind] != n {
+			t.Errorf("expected %d %s on repair, got %d", n, kind, kinds[kind])
+		}
+	}
+	if report.Unrepaired() != 1 {
+		t.Errorf("expected the invalid link only to be unrepaired, got %d problems unrepaired", report.Unrepaired())
+	}
+
+	report, err = Fsck(ctx, d, registry, FsckOpts{VerifySample: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 1 || report.Problems[0].Kind != FsckInvalidLink {
+		t.Errorf("expected the invalid link only after repair, got %v", report.Problems)
+	}
+	if _, err := repo.Tags(ctx).Get(ctx, "latest"); err != nil {
+		t.Errorf("expected the consistent tag to be kept: %v", err)
+	}
+}
+
+func TestFsckEncrypted(t *testing.T) {
+	ctx := context.Background()
+	d, err := storagemiddleware.Get("encrypt", map[string]interface{}{
+		"key": base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32)),
+	}, inmemory.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := createRegistry(t, d)
+	repo := makeRepository(t, registry, "fsck")
+	bs := repo.Blobs(ctx)
+	layer, err := bs.Put(ctx, v1.MediaTypeImageLayerGzip, []byte("layer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the blobs are hashed decrypted, and kept on repair
+	report, err := Fsck(ctx, d, registry, FsckOpts{VerifySample: 1, Repair: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 0 {
+		t.Fatalf("unexpected problems in an encrypted storage: %v", report.Problems)
+	}
+	if report.VerifiedBlobs != 1 {
+		t.Errorf("expected 1 verified blob, got %d", report.VerifiedBlobs)
+	}
+	if _, err := bs.Stat(ctx, layer.Digest); err != nil {
+		t.Errorf("expected the layer to be kept: %v", err)
+	}
+}
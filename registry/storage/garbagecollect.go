@@ -2,10 +2,16 @@ package storage
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/ratelimit"
 	"github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/opencontainers/go-digest"
 )
@@ -18,6 +24,90 @@ func emit(format string, a ...interface{}) {
 type GCOpts struct {
 	DryRun         bool
 	RemoveUntagged bool
+	// RemoveOrphanedReferrers removes the manifests declaring a subject
+	// manifest which no longer exists, or is removed by the collection,
+	// whether they are tagged or not.
+	RemoveOrphanedReferrers bool
+	// Quiet disables the output of the progress of the collection.
+	Quiet bool
+	// Report, if set, is filled with the manifests and blobs deleted, or
+	// eligible for deletion in dry-run mode.
+	Report *GCReport
+	// Progress, if set, is updated while the collection runs.
+	Progress *GCProgress
+	// Concurrency is the number of repositories marked, and of manifests
+	// and blobs deleted, at once. The collection is sequential if it is
+	// zero or one.
+	Concurrency int
+	// RateLimit, if set, is the number of storage operations per second
+	// performed by the collection, such as fetching a manifest or deleting
+	// a blob, so that it does not starve the registry serving requests
+	// from the same storage.
+	RateLimit float64
+	// CheckpointInterval, if set, is how often the progress of the mark
+	// phase is saved to the storage, so that a collection which failed or
+	// was interrupted can be resumed. The checkpoint is removed once the
+	// mark phase completes.
+	CheckpointInterval time.Duration
+	// Resume resumes the mark phase from the last checkpoint, if any,
+	// skipping the repositories it had marked.
+	Resume bool
+}
+
+// GCProgress counts the repositories, manifests and blobs processed by a
+// running garbage collection. Its fields are updated atomically, and may be
+// read with Load while the collection runs.
+type GCProgress struct {
+	// Repositories is the number of repositories marked.
+	Repositories int64 `json:"repositories"`
+	// MarkedBlobs is the number of blobs and manifests marked as referenced.
+	MarkedBlobs int64 `json:"markedBlobs"`
+	// SweptManifests is the number of manifests deleted, or eligible for
+	// deletion in dry-run mode.
+	SweptManifests int64 `json:"sweptManifests"`
+	// SweptBlobs is the number of blobs deleted, or eligible for deletion in
+	// dry-run mode.
+	SweptBlobs int64 `json:"sweptBlobs"`
+	// ReclaimedBytes is the total size of the swept blobs.
+	ReclaimedBytes int64 `json:"reclaimedBytes"`
+}
+
+// Load returns a copy of the progress.
+func (p *GCProgress) Load() GCProgress {
+	return GCProgress{
+		Repositories:   atomic.LoadInt64(&p.Repositories),
+		MarkedBlobs:    atomic.LoadInt64(&p.MarkedBlobs),
+		SweptManifests: atomic.LoadInt64(&p.SweptManifests),
+		SweptBlobs:     atomic.LoadInt64(&p.SweptBlobs),
+		ReclaimedBytes: atomic.LoadInt64(&p.ReclaimedBytes),
+	}
+}
+
+// GCReport describes the manifests and blobs deleted by a garbage
+// collection, or eligible for deletion in dry-run mode.
+type GCReport struct {
+	Manifests []GCReportManifest `json:"manifests"`
+	Blobs     []GCReportBlob     `json:"blobs"`
+	// ReclaimableBytes is the total size of the blobs.
+	ReclaimableBytes int64 `json:"reclaimableBytes"`
+}
+
+// GCReportManifest is a manifest deleted from a repository.
+type GCReportManifest struct {
+	Repository string        `json:"repository"`
+	Digest     digest.Digest `json:"digest"`
+	Size       int64         `json:"size"`
+	// Subject is the digest of the subject manifest of a referrer.
+	Subject digest.Digest `json:"subject,omitempty"`
+}
+
+// GCReportBlob is a blob deleted from the storage.
+type GCReportBlob struct {
+	Digest digest.Digest `json:"digest"`
+	Size   int64         `json:"size"`
+	// Repositories are the repositories whose manifests referenced the blob,
+	// if any.
+	Repositories []string `json:"repositories,omitempty"`
 }
 
 // ManifestDel contains manifest structure which will be deleted
@@ -25,6 +115,8 @@ type ManifestDel struct {
 	Name   string
 	Digest digest.Digest
 	Tags   []string
+	// Subject is the digest of the subject manifest of a referrer.
+	Subject digest.Digest
 }
 
 // MarkAndSweep performs a mark and sweep of registry data
@@ -34,11 +126,140 @@ func MarkAndSweep(ctx context.Context, storageDriver driver.StorageDriver, regis
 		return fmt.Errorf("unable to convert Namespace to RepositoryEnumerator")
 	}
 
+	emit := emit
+	if opts.Quiet {
+		emit = func(format string, a ...interface{}) {}
+	}
+	progress := opts.Progress
+	if progress == nil {
+		progress = &GCProgress{}
+	}
+	// throttle waits for the next operation to be allowed, and returns an
+	// error once the collection is cancelled with its context
+	throttle := func(ctx context.Context) error { return ctx.Err() }
+	if opts.RateLimit > 0 {
+		limiter := ratelimit.NewLimiter(opts.RateLimit, 1)
+		throttle = func(ctx context.Context) error { return limiter.Wait(ctx, "") }
+	}
+
+	// mu protects the state shared by the repositories marked at once
+	var mu sync.Mutex
+	mark := func(markSet map[digest.Digest]struct{}, dgst digest.Digest) {
+		mu.Lock()
+		defer mu.Unlock()
+		if _, ok := markSet[dgst]; !ok {
+			markSet[dgst] = struct{}{}
+			atomic.AddInt64(&progress.MarkedBlobs, 1)
+		}
+	}
+
+	// owners are the repositories referencing each blob, for the report
+	owners := make(map[digest.Digest][]string)
+	own := func(dgst digest.Digest, repoName string) {
+		if opts.Report == nil {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if repos := owners[dgst]; len(repos) == 0 || repos[len(repos)-1] != repoName {
+			owners[dgst] = append(repos, repoName)
+		}
+	}
+
 	// mark
 	markSet := make(map[digest.Digest]struct{})
 	manifestArr := make([]ManifestDel, 0)
-	err := repositoryEnumerator.Enumerate(ctx, func(repoName string) error {
+	expiredTrash := make(map[string][]string)
+	marked := make(map[string]struct{})
+	now := time.Now()
+
+	checkpoints := &gcCheckpointer{
+		driver:   storageDriver,
+		interval: opts.CheckpointInterval,
+		last:     now,
+	}
+	if opts.Resume {
+		checkpoint, err := checkpoints.load(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to load the checkpoint: %v", err)
+		}
+		if checkpoint == nil {
+			emit("no checkpoint to resume from, marking all repositories")
+		} else {
+			if checkpoint.RemoveUntagged != opts.RemoveUntagged || checkpoint.RemoveOrphanedReferrers != opts.RemoveOrphanedReferrers {
+				return fmt.Errorf("the checkpoint was saved by a collection with other options")
+			}
+			emit("resuming from the checkpoint of %s, %d repositories marked", checkpoint.SavedAt.Format(time.RFC3339), len(checkpoint.Repositories))
+			for _, repoName := range checkpoint.Repositories {
+				marked[repoName] = struct{}{}
+			}
+			for _, dgst := range checkpoint.Marked {
+				markSet[dgst] = struct{}{}
+			}
+			manifestArr = append(manifestArr, checkpoint.Manifests...)
+			for repoName, ids := range checkpoint.ExpiredTrash {
+				expiredTrash[repoName] = ids
+			}
+			for dgst, repos := range checkpoint.Owners {
+				owners[dgst] = repos
+			}
+			if opts.Report != nil {
+				opts.Report.Manifests = append(opts.Report.Manifests, checkpoint.ReportManifests...)
+			}
+			atomic.StoreInt64(&progress.Repositories, int64(len(checkpoint.Repositories)))
+			atomic.StoreInt64(&progress.MarkedBlobs, int64(len(checkpoint.Marked)))
+		}
+	}
+	// checkpoint saves the state of the repositories marked so far, if the
+	// interval elapsed since the last checkpoint. The marks of the
+	// repositories being marked are saved as well, which only keeps more
+	// blobs.
+	checkpoint := func(ctx context.Context, force bool) error {
+		mu.Lock()
+		if !checkpoints.due(force) {
+			mu.Unlock()
+			return nil
+		}
+		state := gcCheckpoint{
+			SavedAt:                 time.Now(),
+			RemoveUntagged:          opts.RemoveUntagged,
+			RemoveOrphanedReferrers: opts.RemoveOrphanedReferrers,
+			Repositories:            make([]string, 0, len(marked)),
+			Marked:                  make([]digest.Digest, 0, len(markSet)),
+			Manifests:               append([]ManifestDel(nil), manifestArr...),
+			ExpiredTrash:            make(map[string][]string, len(expiredTrash)),
+			Owners:                  make(map[digest.Digest][]string, len(owners)),
+		}
+		for repoName := range marked {
+			state.Repositories = append(state.Repositories, repoName)
+		}
+		for dgst := range markSet {
+			state.Marked = append(state.Marked, dgst)
+		}
+		for repoName, ids := range expiredTrash {
+			state.ExpiredTrash[repoName] = ids
+		}
+		for dgst, repos := range owners {
+			state.Owners[dgst] = append([]string(nil), repos...)
+		}
+		if opts.Report != nil {
+			state.ReportManifests = append([]GCReportManifest(nil), opts.Report.Manifests...)
+		}
+		mu.Unlock()
+
+		if err := checkpoints.save(ctx, &state); err != nil {
+			return fmt.Errorf("failed to save the checkpoint: %v", err)
+		}
+		emit("checkpoint saved, %d repositories marked", len(state.Repositories))
+		return nil
+	}
+
+	markRepository := func(ctx context.Context, repoName string) error {
+		if err := throttle(ctx); err != nil {
+			return err
+		}
 		emit(repoName)
+		atomic.AddInt64(&progress.Repositories, 1)
 
 		var err error
 		named, err := reference.WithName(repoName)
@@ -50,6 +271,14 @@ func MarkAndSweep(ctx context.Context, storageDriver driver.StorageDriver, regis
 			return fmt.Errorf("failed to construct repository: %v", err)
 		}
 
+		// tags are not updated nor manifests deleted while the repository
+		// is marked
+		unlock, err := lockRepository(ctx, registry, repoName)
+		if err != nil {
+			return fmt.Errorf("failed to lock repository %s: %v", repoName, err)
+		}
+		defer unlock()
+
 		manifestService, err := repository.Manifests(ctx)
 		if err != nil {
 			return fmt.Errorf("failed to construct manifest service: %v", err)
@@ -60,67 +289,224 @@ func MarkAndSweep(ctx context.Context, storageDriver driver.StorageDriver, regis
 			return fmt.Errorf("unable to convert ManifestService into ManifestEnumerator")
 		}
 
+		// Manifests declaring a subject, such as signatures or SBOMs, are
+		// kept as long as their subject is. Only the digests of the
+		// references of the manifests are kept, rather than the manifests.
+		var digests []digest.Digest
+		references := make(map[digest.Digest][]digest.Digest)
+		sizes := make(map[digest.Digest]int64)
+		roots := make(map[digest.Digest]struct{})
+		referrers := make(map[digest.Digest][]digest.Digest)
+		subjects := make(map[digest.Digest]digest.Digest)
 		err = manifestEnumerator.Enumerate(ctx, func(dgst digest.Digest) error {
+			if err := throttle(ctx); err != nil {
+				return err
+			}
+			manifest, err := manifestService.Get(ctx, dgst)
+			if err != nil {
+				return fmt.Errorf("failed to retrieve manifest for digest %v: %v", dgst, err)
+			}
+			digests = append(digests, dgst)
+			for _, descriptor := range manifest.References() {
+				references[dgst] = append(references[dgst], descriptor.Digest)
+			}
+			if opts.Report != nil {
+				_, payload, _ := manifest.Payload()
+				sizes[dgst] = int64(len(payload))
+			}
+
+			subject := manifestSubject(manifest)
+			if subject != nil {
+				referrers[subject.Digest] = append(referrers[subject.Digest], dgst)
+				subjects[dgst] = subject.Digest
+				if opts.RemoveOrphanedReferrers {
+					return nil
+				}
+			}
+
 			if opts.RemoveUntagged {
+				if err := throttle(ctx); err != nil {
+					return err
+				}
 				// fetch all tags where this manifest is the latest one
 				tags, err := repository.Tags(ctx).Lookup(ctx, distribution.Descriptor{Digest: dgst})
 				if err != nil {
 					return fmt.Errorf("failed to retrieve tags for digest %v: %v", dgst, err)
 				}
 				if len(tags) == 0 {
-					emit("manifest eligible for deletion: %s", dgst)
+					return nil
+				}
+			}
+			roots[dgst] = struct{}{}
+			return nil
+		})
+		// In certain situations such as unfinished uploads, deleting all
+		// tags in S3 or removing the _manifests folder manually, this
+		// error may be of type PathNotFound.
+		//
+		// In these cases we can continue marking other manifests safely.
+		if _, ok := err.(driver.PathNotFoundError); !ok && err != nil {
+			return err
+		}
+
+		kept := make(map[digest.Digest]struct{})
+		var keep func(dgst digest.Digest)
+		keep = func(dgst digest.Digest) {
+			if _, ok := kept[dgst]; ok {
+				return
+			}
+			kept[dgst] = struct{}{}
+			for _, referrer := range referrers[dgst] {
+				keep(referrer)
+			}
+		}
+		for dgst := range roots {
+			keep(dgst)
+		}
+
+		// the manifests to delete are recorded along with the repository
+		// once it is marked, so that a checkpoint never holds a part of them
+		var deletions []ManifestDel
+		var reported []GCReportManifest
+		var allTags []string
+		for _, dgst := range digests {
+			own(dgst, repoName)
+			for _, ref := range references[dgst] {
+				own(ref, repoName)
+			}
+
+			if _, ok := kept[dgst]; !ok {
+				emit("manifest eligible for deletion: %s", dgst)
+				if allTags == nil {
 					// fetch all tags from repository
 					// all of these tags could contain manifest in history
 					// which means that we need check (and delete) those references when deleting manifest
-					allTags, err := repository.Tags(ctx).All(ctx)
+					allTags, err = repository.Tags(ctx).All(ctx)
 					if err != nil {
-						return fmt.Errorf("failed to retrieve tags %v", err)
+						if _, ok := err.(distribution.ErrRepositoryUnknown); !ok {
+							return fmt.Errorf("failed to retrieve tags %v", err)
+						}
+						allTags = []string{}
 					}
-					manifestArr = append(manifestArr, ManifestDel{Name: repoName, Digest: dgst, Tags: allTags})
-					return nil
 				}
+				if opts.Report != nil {
+					reported = append(reported, GCReportManifest{
+						Repository: repoName,
+						Digest:     dgst,
+						Size:       sizes[dgst],
+						Subject:    subjects[dgst],
+					})
+				}
+				deletions = append(deletions, ManifestDel{Name: repoName, Digest: dgst, Tags: allTags, Subject: subjects[dgst]})
+				continue
 			}
+
 			// Mark the manifest's blob
 			emit("%s: marking manifest %s ", repoName, dgst)
-			markSet[dgst] = struct{}{}
+			mark(markSet, dgst)
 
-			manifest, err := manifestService.Get(ctx, dgst)
-			if err != nil {
-				return fmt.Errorf("failed to retrieve manifest for digest %v: %v", dgst, err)
+			for _, ref := range references[dgst] {
+				mark(markSet, ref)
+				emit("%s: marking blob %s", repoName, ref)
 			}
+		}
 
-			descriptors := manifest.References()
-			for _, descriptor := range descriptors {
-				markSet[descriptor.Digest] = struct{}{}
-				emit("%s: marking blob %s", repoName, descriptor.Digest)
-			}
+		// The content of the soft deleted objects is kept until their
+		// trash entry expires.
+		trashed, expired, err := trashedContent(ctx, repository, now)
+		if err != nil {
+			return fmt.Errorf("failed to read trash of %s: %v", repoName, err)
+		}
+		for _, dgst := range trashed {
+			own(dgst, repoName)
+			mark(markSet, dgst)
+			emit("%s: marking trashed blob %s", repoName, dgst)
+		}
 
-			return nil
-		})
+		mu.Lock()
+		manifestArr = append(manifestArr, deletions...)
+		if opts.Report != nil {
+			opts.Report.Manifests = append(opts.Report.Manifests, reported...)
+		}
+		if len(expired) > 0 {
+			expiredTrash[repoName] = expired
+		}
+		marked[repoName] = struct{}{}
+		mu.Unlock()
 
-		// In certain situations such as unfinished uploads, deleting all
-		// tags in S3 or removing the _manifests folder manually, this
-		// error may be of type PathNotFound.
-		//
-		// In these cases we can continue marking other manifests safely.
-		if _, ok := err.(driver.PathNotFoundError); ok {
+		return checkpoint(ctx, false)
+	}
+
+	markers := newWorkerPool(ctx, opts.Concurrency)
+	err := repositoryEnumerator.Enumerate(ctx, func(repoName string) error {
+		mu.Lock()
+		_, ok := marked[repoName]
+		mu.Unlock()
+		if ok {
 			return nil
 		}
-
-		return err
+		return markers.Go(func(ctx context.Context) error {
+			return markRepository(ctx, repoName)
+		})
 	})
-
+	if werr := markers.Wait(); werr != nil {
+		err = werr
+	}
 	if err != nil {
+		// save the progress of the repositories marked before the failure
+		if cerr := checkpoint(context.Background(), true); cerr != nil {
+			emit("%v", cerr)
+		}
 		return fmt.Errorf("failed to mark: %v", err)
 	}
+	if err := checkpoints.remove(ctx); err != nil {
+		return fmt.Errorf("failed to remove the checkpoint: %v", err)
+	}
+	if opts.Report != nil {
+		// repositories marked at once report their manifests in any order
+		sort.SliceStable(opts.Report.Manifests, func(i, j int) bool {
+			return opts.Report.Manifests[i].Repository < opts.Report.Manifests[j].Repository
+		})
+	}
 
 	// sweep
-	vacuum := NewVacuum(ctx, storageDriver)
-	if !opts.DryRun {
-		for _, obj := range manifestArr {
-			err = vacuum.RemoveManifest(obj.Name, obj.Digest, obj.Tags)
-			if err != nil {
-				return fmt.Errorf("failed to delete manifest %s: %v", obj.Digest, err)
+	vacuum := registryVacuum(ctx, storageDriver, registry)
+	sweepers := newWorkerPool(ctx, opts.Concurrency)
+	for _, obj := range manifestArr {
+		obj := obj
+		err := sweepers.Go(func(ctx context.Context) error {
+			if err := throttle(ctx); err != nil {
+				return err
+			}
+			if !opts.DryRun {
+				err := vacuum.RemoveManifest(obj.Name, obj.Digest, obj.Tags)
+				if err != nil {
+					return fmt.Errorf("failed to delete manifest %s: %v", obj.Digest, err)
+				}
+				if obj.Subject != "" {
+					err = vacuum.RemoveReferrer(obj.Name, obj.Subject, obj.Digest)
+					if err != nil {
+						return fmt.Errorf("failed to delete referrer link of manifest %s: %v", obj.Digest, err)
+					}
+				}
+			}
+			atomic.AddInt64(&progress.SweptManifests, 1)
+			return nil
+		})
+		if err != nil {
+			break
+		}
+	}
+	if err := sweepers.Wait(); err != nil {
+		return err
+	}
+	for repoName, ids := range expiredTrash {
+		for _, id := range ids {
+			emit("%s: trash entry expired: %s", repoName, id)
+			if !opts.DryRun {
+				if err := vacuum.RemoveTrashEntry(repoName, id); err != nil {
+					return fmt.Errorf("failed to delete trash entry %s: %v", id, err)
+				}
 			}
 		}
 	}
@@ -137,16 +523,249 @@ func MarkAndSweep(ctx context.Context, storageDriver driver.StorageDriver, regis
 		return fmt.Errorf("error enumerating blobs: %v", err)
 	}
 	emit("\n%d blobs marked, %d blobs and %d manifests eligible for deletion", len(markSet), len(deleteSet), len(manifestArr))
-	for dgst := range deleteSet {
-		emit("blob eligible for deletion: %s", dgst)
-		if opts.DryRun {
-			continue
+	if opts.Report != nil {
+		if err := reportBlobs(ctx, storageDriver, opts.Report, deleteSet, owners); err != nil {
+			return err
 		}
-		err = vacuum.RemoveBlob(string(dgst))
+	}
+	sweepers = newWorkerPool(ctx, opts.Concurrency)
+	for dgst := range deleteSet {
+		dgst := dgst
+		err := sweepers.Go(func(ctx context.Context) error {
+			if err := throttle(ctx); err != nil {
+				return err
+			}
+			emit("blob eligible for deletion: %s", dgst)
+			if opts.Progress != nil {
+				size, err := blobSize(ctx, storageDriver, dgst)
+				if err != nil {
+					return err
+				}
+				atomic.AddInt64(&progress.ReclaimedBytes, size)
+			}
+			if !opts.DryRun {
+				if err := vacuum.RemoveBlob(string(dgst)); err != nil {
+					return fmt.Errorf("failed to delete blob %s: %v", dgst, err)
+				}
+			}
+			atomic.AddInt64(&progress.SweptBlobs, 1)
+			return nil
+		})
 		if err != nil {
-			return fmt.Errorf("failed to delete blob %s: %v", dgst, err)
+			break
 		}
 	}
+	return sweepers.Wait()
+}
 
+// gcCheckpoint is the state of the mark phase of a garbage collection, from
+// which it can be resumed.
+type gcCheckpoint struct {
+	SavedAt                 time.Time `json:"savedAt"`
+	RemoveUntagged          bool      `json:"removeUntagged"`
+	RemoveOrphanedReferrers bool      `json:"removeOrphanedReferrers"`
+	// Repositories are the repositories marked.
+	Repositories []string        `json:"repositories"`
+	Marked       []digest.Digest `json:"marked"`
+	// Manifests are the manifests of the repositories marked to delete.
+	Manifests    []ManifestDel              `json:"manifests,omitempty"`
+	ExpiredTrash map[string][]string        `json:"expiredTrash,omitempty"`
+	Owners       map[digest.Digest][]string `json:"owners,omitempty"`
+	// ReportManifests are the manifests of the report, if requested.
+	ReportManifests []GCReportManifest `json:"reportManifests,omitempty"`
+}
+
+// gcCheckpointer saves the checkpoints of the mark phase in the storage.
+type gcCheckpointer struct {
+	driver driver.StorageDriver
+	// interval is the minimum time between two checkpoints, no checkpoint
+	// being saved if it is zero.
+	interval time.Duration
+	last     time.Time
+}
+
+// due returns whether a checkpoint is to be saved, and resets the interval
+// if so. It is called with the lock of the state held.
+func (c *gcCheckpointer) due(force bool) bool {
+	if c.interval <= 0 || (!force && time.Since(c.last) < c.interval) {
+		return false
+	}
+	c.last = time.Now()
+	return true
+}
+
+func (c *gcCheckpointer) save(ctx context.Context, checkpoint *gcCheckpoint) error {
+	p, err := pathFor(gcCheckpointPathSpec{})
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	return c.driver.PutContent(ctx, p, content)
+}
+
+// load returns the last checkpoint, or nil if there is none.
+func (c *gcCheckpointer) load(ctx context.Context) (*gcCheckpoint, error) {
+	p, err := pathFor(gcCheckpointPathSpec{})
+	if err != nil {
+		return nil, err
+	}
+	content, err := c.driver.GetContent(ctx, p)
+	if err != nil {
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var checkpoint gcCheckpoint
+	if err := json.Unmarshal(content, &checkpoint); err != nil {
+		return nil, err
+	}
+	return &checkpoint, nil
+}
+
+// remove removes the last checkpoint, if any.
+func (c *gcCheckpointer) remove(ctx context.Context) error {
+	p, err := pathFor(gcCheckpointPathSpec{})
+	if err != nil {
+		return err
+	}
+	if err := c.driver.Delete(ctx, p); err != nil {
+		if _, ok := err.(driver.PathNotFoundError); !ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// workerPool runs tasks on a number of goroutines, stopping at the first
+// failed task.
+type workerPool struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	tasks  chan func(context.Context) error
+	wg     sync.WaitGroup
+
+	mu  sync.Mutex
+	err error
+}
+
+// newWorkerPool returns a pool running tasks on up to concurrency
+// goroutines, or in the calling one if concurrency is one or less.
+func newWorkerPool(ctx context.Context, concurrency int) *workerPool {
+	ctx, cancel := context.WithCancel(ctx)
+	p := &workerPool{
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	if concurrency <= 1 {
+		return p
+	}
+	p.tasks = make(chan func(context.Context) error)
+	for i := 0; i < concurrency; i++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for task := range p.tasks {
+				if p.ctx.Err() != nil {
+					continue
+				}
+				if err := task(p.ctx); err != nil {
+					p.fail(err)
+				}
+			}
+		}()
+	}
+	return p
+}
+
+// fail records the first error of the tasks and cancels the others.
+func (p *workerPool) fail(err error) {
+	p.mu.Lock()
+	if p.err == nil {
+		p.err = err
+	}
+	p.mu.Unlock()
+	p.cancel()
+}
+
+// Go runs the task once a goroutine is available. It returns an error once
+// a task failed or the context of the pool is done, after which no more
+// tasks should be submitted.
+func (p *workerPool) Go(task func(context.Context) error) error {
+	if err := p.ctx.Err(); err != nil {
+		return err
+	}
+	if p.tasks == nil {
+		if err := task(p.ctx); err != nil {
+			p.fail(err)
+			return err
+		}
+		return nil
+	}
+	select {
+	case p.tasks <- task:
+		return nil
+	case <-p.ctx.Done():
+		return p.ctx.Err()
+	}
+}
+
+// Wait waits for the submitted tasks to complete, and returns the error of
+// the first failed one or of the context of the pool.
+func (p *workerPool) Wait() error {
+	if p.tasks != nil {
+		close(p.tasks)
+		p.wg.Wait()
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	err := p.err
+	if err == nil {
+		err = p.ctx.Err()
+	}
+	p.cancel()
 	return err
 }
+
+// reportBlobs adds the blobs of deleteSet to the report, sorted by digest,
+// with their size and owning repositories.
+func reportBlobs(ctx context.Context, storageDriver driver.StorageDriver, report *GCReport, deleteSet map[digest.Digest]struct{}, owners map[digest.Digest][]string) error {
+	for dgst := range deleteSet {
+		size, err := blobSize(ctx, storageDriver, dgst)
+		if err != nil {
+			return err
+		}
+
+		report.Blobs = append(report.Blobs, GCReportBlob{
+			Digest:       dgst,
+			Size:         size,
+			Repositories: owners[dgst],
+		})
+		report.ReclaimableBytes += size
+	}
+	sort.Slice(report.Blobs, func(i, j int) bool {
+		return report.Blobs[i].Digest < report.Blobs[j].Digest
+	})
+	return nil
+}
+
+// blobSize returns the size of the data of a blob, zero if it has none.
+func blobSize(ctx context.Context, storageDriver driver.StorageDriver, dgst digest.Digest) (int64, error) {
+	blobPath, err := pathFor(blobDataPathSpec{digest: dgst})
+	if err != nil {
+		return 0, err
+	}
+	fi, err := storageDriver.Stat(ctx, blobPath)
+	switch err.(type) {
+	case nil:
+		return fi.Size(), nil
+	case driver.PathNotFoundError:
+		// the blob directory has no data
+		return 0, nil
+	default:
+		return 0, fmt.Errorf("failed to stat blob %s: %v", dgst, err)
+	}
+}
@@ -1,18 +1,27 @@
 package storage
 
 import (
+	stdcontext "context"
+	"fmt"
 	"io"
 	"path"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
 	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/storage/cache/memory"
 	"github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
 	"github.com/distribution/distribution/v3/testutil"
 	"github.com/docker/libtrust"
 	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 type image struct {
@@ -381,6 +390,74 @@ func TestDeletionHasEffect(t *testing.T) {
 	}
 }
 
+func TestDeletionClearsDescriptorCache(t *testing.T) {
+	ctx := context.Background()
+	inmemoryDriver := inmemory.New()
+
+	descriptorCache := memory.NewInMemoryBlobDescriptorCacheProvider(memory.UnlimitedSize)
+	registry := createRegistry(t, inmemoryDriver, BlobDescriptorCacheProvider(descriptorCache))
+	repo := makeRepository(t, registry, "komnenos")
+	manifests, _ := repo.Manifests(ctx)
+
+	image1 := uploadRandomSchema2Image(t, repo)
+	image2 := uploadRandomSchema2Image(t, repo)
+
+	// cache the descriptors of both images
+	for _, im := range []image{image1, image2} {
+		if _, err := manifests.Exists(ctx, im.manifestDigest); err != nil {
+			t.Fatalf("Failed to stat manifest: %v", err)
+		}
+		for layer := range im.layers {
+			if _, err := repo.Blobs(ctx).Stat(ctx, layer); err != nil {
+				t.Fatalf("Failed to stat layer: %v", err)
+			}
+		}
+	}
+	if _, err := descriptorCache.Stat(ctx, image2.manifestDigest); err != nil {
+		t.Fatalf("Expected the manifest descriptor to be cached: %v", err)
+	}
+
+	if err := manifests.Delete(ctx, image2.manifestDigest); err != nil {
+		t.Fatalf("Failed to delete manifest: %v", err)
+	}
+
+	err := MarkAndSweep(context.Background(), inmemoryDriver, registry, GCOpts{
+		DryRun:         false,
+		RemoveUntagged: false,
+	})
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+
+	scoped, err := descriptorCache.RepositoryScoped("komnenos")
+	if err != nil {
+		t.Fatalf("Failed to get scoped cache: %v", err)
+	}
+
+	// the descriptors of the deleted image are invalidated
+	if _, err := descriptorCache.Stat(ctx, image2.manifestDigest); err != distribution.ErrBlobUnknown {
+		t.Fatalf("Expected the deleted manifest descriptor to be invalidated, got %v", err)
+	}
+	for layer := range image2.layers {
+		if _, err := scoped.Stat(ctx, layer); err != distribution.ErrBlobUnknown {
+			t.Fatalf("Expected the collected layer descriptor to be invalidated, got %v", err)
+		}
+		if _, err := repo.Blobs(ctx).Stat(ctx, layer); err != distribution.ErrBlobUnknown {
+			t.Fatalf("Expected the collected layer to be unknown, got %v", err)
+		}
+	}
+
+	// the descriptors of the other image are left alone
+	if _, err := descriptorCache.Stat(ctx, image1.manifestDigest); err != nil {
+		t.Fatalf("Unexpected error statting kept manifest descriptor: %v", err)
+	}
+	for layer := range image1.layers {
+		if _, err := scoped.Stat(ctx, layer); err != nil {
+			t.Fatalf("Unexpected error statting kept layer descriptor: %v", err)
+		}
+	}
+}
+
 func getAnyKey(digests map[digest.Digest]io.ReadSeeker) (d digest.Digest) {
 	for d = range digests {
 		break
@@ -500,3 +577,441 @@ func TestOrphanBlobDeleted(t *testing.T) {
 		}
 	}
 }
+
+func uploadReferrer(t *testing.T, repository distribution.Repository, subject digest.Digest) digest.Digest {
+	ctx := context.Background()
+	config, err := repository.Blobs(ctx).Put(ctx, v1.MediaTypeImageConfig, []byte(`{"subject":"`+subject.String()+`"}`))
+	if err != nil {
+		t.Fatalf("config upload failed: %v", err)
+	}
+
+	referrer, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned:    ocischema.SchemaVersion,
+		ArtifactType: "application/vnd.example.signature",
+		Config:       config,
+		Layers:       []distribution.Descriptor{},
+		Subject: &distribution.Descriptor{
+			MediaType: v1.MediaTypeImageManifest,
+			Digest:    subject,
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to make referrer: %v", err)
+	}
+
+	dgst, err := makeManifestService(t, repository).Put(ctx, referrer)
+	if err != nil {
+		t.Fatalf("referrer upload failed: %v", err)
+	}
+	return dgst
+}
+
+func TestReferrersFollowSubject(t *testing.T) {
+	ctx := context.Background()
+	inmemoryDriver := inmemory.New()
+
+	registry := createRegistry(t, inmemoryDriver)
+	repo := makeRepository(t, registry, "referrers")
+	manifestService := makeManifestService(t, repo)
+
+	tagged := uploadRandomSchema2Image(t, repo)
+	if err := repo.Tags(ctx).Tag(ctx, "latest", distribution.Descriptor{Digest: tagged.manifestDigest}); err != nil {
+		t.Fatalf("failed to tag manifest: %v", err)
+	}
+	signature := uploadReferrer(t, repo, tagged.manifestDigest)
+	// referrers of referrers are kept too
+	countersignature := uploadReferrer(t, repo, signature)
+
+	untagged := uploadRandomSchema2Image(t, repo)
+	untaggedSignature := uploadReferrer(t, repo, untagged.manifestDigest)
+
+	err := MarkAndSweep(ctx, inmemoryDriver, registry, GCOpts{
+		DryRun:         false,
+		RemoveUntagged: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+
+	manifests := allManifests(t, manifestService)
+	for _, dgst := range []digest.Digest{tagged.manifestDigest, signature, countersignature} {
+		if _, ok := manifests[dgst]; !ok {
+			t.Errorf("manifest %s was deleted", dgst)
+		}
+	}
+	for _, dgst := range []digest.Digest{untagged.manifestDigest, untaggedSignature} {
+		if _, ok := manifests[dgst]; ok {
+			t.Errorf("manifest %s was not deleted", dgst)
+		}
+	}
+
+	referrers, err := manifestService.(distribution.ManifestReferrers).Referrers(ctx, untagged.manifestDigest, "")
+	if err != nil {
+		t.Fatalf("unexpected error listing referrers: %v", err)
+	}
+	if len(referrers) != 0 {
+		t.Errorf("unexpected referrers of deleted manifest: %v", referrers)
+	}
+	referrerLinkPath, err := pathFor(manifestReferrerLinkPathSpec{name: "referrers", subject: untagged.manifestDigest, revision: untaggedSignature})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inmemoryDriver.Stat(ctx, referrerLinkPath); err == nil {
+		t.Errorf("referrer link of deleted manifest still exists")
+	}
+
+	blobs := allBlobs(t, registry)
+	for dgst := range tagged.layers {
+		if _, ok := blobs[dgst]; !ok {
+			t.Errorf("layer %s of tagged manifest was deleted", dgst)
+		}
+	}
+}
+
+func TestOrphanedReferrersDeleted(t *testing.T) {
+	ctx := context.Background()
+	inmemoryDriver := inmemory.New()
+
+	registry := createRegistry(t, inmemoryDriver)
+	repo := makeRepository(t, registry, "orphans")
+	manifestService := makeManifestService(t, repo)
+
+	kept := uploadRandomSchema2Image(t, repo)
+	keptSignature := uploadReferrer(t, repo, kept.manifestDigest)
+
+	deleted := uploadRandomSchema2Image(t, repo)
+	orphan := uploadReferrer(t, repo, deleted.manifestDigest)
+	if err := repo.Tags(ctx).Tag(ctx, "orphan", distribution.Descriptor{Digest: orphan}); err != nil {
+		t.Fatalf("failed to tag manifest: %v", err)
+	}
+	if err := manifestService.Delete(ctx, deleted.manifestDigest); err != nil {
+		t.Fatalf("failed to delete manifest: %v", err)
+	}
+
+	// Without the option, orphans are kept
+	err := MarkAndSweep(ctx, inmemoryDriver, registry, GCOpts{
+		DryRun:         false,
+		RemoveUntagged: false,
+	})
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+	if _, ok := allManifests(t, manifestService)[orphan]; !ok {
+		t.Fatalf("orphaned referrer was deleted")
+	}
+
+	err = MarkAndSweep(ctx, inmemoryDriver, registry, GCOpts{
+		DryRun:                  false,
+		RemoveUntagged:          false,
+		RemoveOrphanedReferrers: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+
+	manifests := allManifests(t, manifestService)
+	for _, dgst := range []digest.Digest{kept.manifestDigest, keptSignature} {
+		if _, ok := manifests[dgst]; !ok {
+			t.Errorf("manifest %s was deleted", dgst)
+		}
+	}
+	if _, ok := manifests[orphan]; ok {
+		t.Errorf("orphaned referrer was not deleted")
+	}
+
+	tags, err := repo.Tags(ctx).All(ctx)
+	if err != nil {
+		t.Fatalf("failed to list tags: %v", err)
+	}
+	if len(tags) != 0 {
+		t.Errorf("tag of orphaned referrer was not deleted: %v", tags)
+	}
+}
+
+func TestGCReport(t *testing.T) {
+	ctx := context.Background()
+	inmemoryDriver := inmemory.New()
+
+	registry := createRegistry(t, inmemoryDriver)
+	repo := makeRepository(t, registry, "report")
+
+	tagged := uploadRandomSchema2Image(t, repo)
+	if err := repo.Tags(ctx).Tag(ctx, "latest", distribution.Descriptor{Digest: tagged.manifestDigest}); err != nil {
+		t.Fatalf("failed to tag manifest: %v", err)
+	}
+	untagged := uploadRandomSchema2Image(t, repo)
+
+	before := allBlobs(t, registry)
+
+	report := &GCReport{}
+	err := MarkAndSweep(ctx, inmemoryDriver, registry, GCOpts{
+		DryRun:         true,
+		RemoveUntagged: true,
+		Quiet:          true,
+		Report:         report,
+	})
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+	if after := allBlobs(t, registry); len(before) != len(after) {
+		t.Fatalf("Garbage collection affected blobs storage: %d != %d", len(before), len(after))
+	}
+
+	if len(report.Manifests) != 1 || report.Manifests[0].Digest != untagged.manifestDigest || report.Manifests[0].Repository != "report" {
+		t.Fatalf("unexpected manifests in report: %+v", report.Manifests)
+	}
+
+	// the manifest and the blobs it references, which the tagged manifest
+	// does not reference
+	expected := map[digest.Digest]struct{}{untagged.manifestDigest: {}}
+	for _, descriptor := range untagged.manifest.References() {
+		expected[descriptor.Digest] = struct{}{}
+	}
+	for _, descriptor := range tagged.manifest.References() {
+		delete(expected, descriptor.Digest)
+	}
+	if len(report.Blobs) != len(expected) {
+		t.Fatalf("expected %d blobs in report, got %+v", len(expected), report.Blobs)
+	}
+	var total int64
+	for _, blob := range report.Blobs {
+		if _, ok := expected[blob.Digest]; !ok {
+			t.Errorf("unexpected blob %s in report", blob.Digest)
+		}
+		if len(blob.Repositories) != 1 || blob.Repositories[0] != "report" {
+			t.Errorf("unexpected repositories of blob %s: %v", blob.Digest, blob.Repositories)
+		}
+		if blob.Size <= 0 {
+			t.Errorf("unexpected size of blob %s: %d", blob.Digest, blob.Size)
+		}
+		total += blob.Size
+	}
+	if report.ReclaimableBytes != total {
+		t.Errorf("expected %d reclaimable bytes, got %d", total, report.ReclaimableBytes)
+	}
+}
+
+func TestGCProgressAndCancel(t *testing.T) {
+	inmemoryDriver := inmemory.New()
+
+	registry := createRegistry(t, inmemoryDriver)
+	repo := makeRepository(t, registry, "progress")
+
+	digests, err := testutil.CreateRandomLayers(2)
+	if err != nil {
+		t.Fatalf("Failed to create random digest: %v", err)
+	}
+	if err = testutil.UploadBlobs(repo, digests); err != nil {
+		t.Fatalf("Failed to upload blob: %v", err)
+	}
+	image := uploadRandomSchema2Image(t, repo)
+
+	// a cancelled collection deletes nothing
+	ctx, cancel := stdcontext.WithCancel(context.Background())
+	cancel()
+	before := allBlobs(t, registry)
+	if err := MarkAndSweep(ctx, inmemoryDriver, registry, GCOpts{Quiet: true}); err == nil {
+		t.Fatal("Expected an error for a cancelled mark and sweep")
+	}
+	if after := allBlobs(t, registry); len(after) != len(before) {
+		t.Fatalf("Unexpected blobs after a cancelled mark and sweep: %d != %d", len(after), len(before))
+	}
+
+	var progress GCProgress
+	err = MarkAndSweep(context.Background(), inmemoryDriver, registry, GCOpts{
+		Quiet:    true,
+		Progress: &progress,
+	})
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+
+	var reclaimed int64
+	for _, rs := range digests {
+		size, err := rs.Seek(0, io.SeekEnd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reclaimed += size
+	}
+	expected := GCProgress{
+		Repositories:   1,
+		MarkedBlobs:    int64(len(image.layers) + 2),
+		SweptBlobs:     int64(len(digests)),
+		ReclaimedBytes: reclaimed,
+	}
+	if progress.Load() != expected {
+		t.Fatalf("Unexpected progress: %+v != %+v", progress.Load(), expected)
+	}
+}
+
+func TestGCConcurrency(t *testing.T) {
+	ctx := context.Background()
+	inmemoryDriver := inmemory.New()
+
+	registry := createRegistry(t, inmemoryDriver)
+	var kept, deleted []image
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		repo := makeRepository(t, registry, name)
+		manifests, err := repo.Manifests(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kept = append(kept, uploadRandomSchema2Image(t, repo))
+		image := uploadRandomSchema2Image(t, repo)
+		if err := manifests.Delete(ctx, image.manifestDigest); err != nil {
+			t.Fatalf("failed to delete manifest: %v", err)
+		}
+		deleted = append(deleted, image)
+	}
+
+	var progress GCProgress
+	start := time.Now()
+	err := MarkAndSweep(ctx, inmemoryDriver, registry, GCOpts{
+		Quiet:       true,
+		Progress:    &progress,
+		Concurrency: 4,
+		RateLimit:   200,
+	})
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+	// each repository, manifest and blob is an operation of the collection
+	operations := progress.Repositories + int64(len(kept)) + progress.SweptBlobs
+	if elapsed := time.Since(start); elapsed < time.Duration(operations-1)*time.Second/200 {
+		t.Errorf("%d operations performed in %v", operations, elapsed)
+	}
+
+	blobs := allBlobs(t, registry)
+	for _, image := range kept {
+		if _, ok := blobs[image.manifestDigest]; !ok {
+			t.Errorf("manifest %s was deleted", image.manifestDigest)
+		}
+		for layer := range image.layers {
+			if _, ok := blobs[layer]; !ok {
+				t.Errorf("layer %s was deleted", layer)
+			}
+		}
+	}
+	for _, image := range deleted {
+		for layer := range image.layers {
+			if _, ok := blobs[layer]; ok {
+				t.Errorf("layer %s was not deleted", layer)
+			}
+		}
+	}
+	if progress.Repositories != 5 {
+		t.Errorf("unexpected number of marked repositories: %d", progress.Repositories)
+	}
+}
+
+// failingRepositoryDriver fails to read the manifests of a repository.
+type failingRepositoryDriver struct {
+	driver.StorageDriver
+	repository string
+}
+
+func (d *failingRepositoryDriver) fails(p string) error {
+	if d.repository != "" && strings.Contains(p, "/repositories/"+d.repository+"/_manifests") {
+		return fmt.Errorf("failed to read %s", p)
+	}
+	return nil
+}
+
+func (d *failingRepositoryDriver) List(ctx stdcontext.Context, p string) ([]string, error) {
+	if err := d.fails(p); err != nil {
+		return nil, err
+	}
+	return d.StorageDriver.List(ctx, p)
+}
+
+func (d *failingRepositoryDriver) Walk(ctx stdcontext.Context, p string, f driver.WalkFn) error {
+	if err := d.fails(p); err != nil {
+		return err
+	}
+	return d.StorageDriver.Walk(ctx, p, f)
+}
+
+func TestGCCheckpointResume(t *testing.T) {
+	ctx := context.Background()
+	failingDriver := &failingRepositoryDriver{StorageDriver: inmemory.New()}
+
+	registry := createRegistry(t, failingDriver)
+	var kept, deleted []image
+	for _, name := range []string{"a", "b", "c"} {
+		repo := makeRepository(t, registry, name)
+		manifests, err := repo.Manifests(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kept = append(kept, uploadRandomSchema2Image(t, repo))
+		image := uploadRandomSchema2Image(t, repo)
+		if err := manifests.Delete(ctx, image.manifestDigest); err != nil {
+			t.Fatalf("failed to delete manifest: %v", err)
+		}
+		deleted = append(deleted, image)
+	}
+
+	// the collection fails marking the last repository, and saves the
+	// repositories marked before
+	failingDriver.repository = "c"
+	before := allBlobs(t, registry)
+	opts := GCOpts{Quiet: true, CheckpointInterval: time.Hour}
+	if err := MarkAndSweep(ctx, failingDriver, registry, opts); err == nil {
+		t.Fatal("Expected an error for a failed mark and sweep")
+	}
+	if after := allBlobs(t, registry); len(after) != len(before) {
+		t.Fatalf("Unexpected blobs after a failed mark and sweep: %d != %d", len(after), len(before))
+	}
+	checkpoint, err := (&gcCheckpointer{driver: failingDriver}).load(ctx)
+	if err != nil {
+		t.Fatalf("Failed to load the checkpoint: %v", err)
+	}
+	if checkpoint == nil {
+		t.Fatal("Expected a checkpoint")
+	}
+	sort.Strings(checkpoint.Repositories)
+	if !reflect.DeepEqual(checkpoint.Repositories, []string{"a", "b"}) {
+		t.Fatalf("Unexpected repositories of the checkpoint: %v", checkpoint.Repositories)
+	}
+
+	// the checkpoint is not resumed with other options
+	if err := MarkAndSweep(ctx, failingDriver, registry, GCOpts{Quiet: true, RemoveUntagged: true, Resume: true}); err == nil {
+		t.Fatal("Expected an error resuming with other options")
+	}
+
+	// the resumed collection doesn't mark the repositories of the checkpoint
+	// again
+	failingDriver.repository = "a"
+	var progress GCProgress
+	opts.Resume = true
+	opts.Progress = &progress
+	if err := MarkAndSweep(ctx, failingDriver, registry, opts); err != nil {
+		t.Fatalf("Failed to resume mark and sweep: %v", err)
+	}
+	if progress.Repositories != 3 {
+		t.Errorf("unexpected number of marked repositories: %d", progress.Repositories)
+	}
+
+	blobs := allBlobs(t, registry)
+	for _, image := range kept {
+		if _, ok := blobs[image.manifestDigest]; !ok {
+			t.Errorf("manifest %s was deleted", image.manifestDigest)
+		}
+		for layer := range image.layers {
+			if _, ok := blobs[layer]; !ok {
+				t.Errorf("layer %s was deleted", layer)
+			}
+		}
+	}
+	for _, image := range deleted {
+		for layer := range image.layers {
+			if _, ok := blobs[layer]; ok {
+				t.Errorf("layer %s was not deleted", layer)
+			}
+		}
+	}
+	if checkpoint, err := (&gcCheckpointer{driver: failingDriver}).load(ctx); err != nil || checkpoint != nil {
+		t.Fatalf("Unexpected checkpoint after the collection: %v, %v", checkpoint, err)
+	}
+}
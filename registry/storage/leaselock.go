@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/lock"
+)
+
+// leaseSettleDelay is how long a lease written to the storage is left to
+// settle before it is read back, so that a concurrent writer overwriting it
+// is noticed.
+const leaseSettleDelay = 50 * time.Millisecond
+
+// lease is the content of the lease file of a lock.
+type lease struct {
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+type leaseLocker struct {
+	driver driver.StorageDriver
+	ttl    time.Duration
+}
+
+// NewLeaseLocker returns a locker holding its locks as lease files in the
+// storage, for registry instances which share no redis. The storage drivers
+// offer no atomic creation of files: a lease is written and read back after a
+// delay to detect concurrent writers, which is only reliable with storage
+// backends whose writes are strongly consistent.
+func NewLeaseLocker(storageDriver driver.StorageDriver, ttl time.Duration) lock.Locker {
+	if ttl <= 0 {
+		ttl = lock.DefaultTTL
+	}
+	return &leaseLocker{
+		driver: storageDriver,
+		ttl:    ttl,
+	}
+}
+
+func (ll *leaseLocker) Lock(ctx context.Context, key string) (func(), error) {
+	leasePath, err := pathFor(lockPathSpec{key: key})
+	if err != nil {
+		return nil, err
+	}
+	token := lock.NewToken()
+
+	return lock.Lease{
+		TTL: ll.ttl,
+		TryAcquire: func(ctx context.Context) (bool, error) {
+			current, err := ll.read(ctx, leasePath)
+			if err != nil {
+				return false, err
+			}
+			if current != nil && current.Token != token && time.Now().Before(current.Expires) {
+				return false, nil
+			}
+			if err := ll.write(ctx, leasePath, token); err != nil {
+				return false, err
+			}
+
+			time.Sleep(leaseSettleDelay)
+			current, err = ll.read(ctx, leasePath)
+			if err != nil {
+				return false, err
+			}
+			return current != nil && current.Token == token, nil
+		},
+		Renew: func(ctx context.Context) (bool, error) {
+			current, err := ll.read(ctx, leasePath)
+			if err != nil || current == nil || current.Token != token {
+				return false, err
+			}
+			return true, ll.write(ctx, leasePath, token)
+		},
+		Release: func(ctx context.Context) error {
+			current, err := ll.read(ctx, leasePath)
+			if err != nil || current == nil || current.Token != token {
+				return err
+			}
+			return ll.driver.Delete(ctx, leasePath)
+		},
+	}.Hold(ctx, key)
+}
+
+// read returns the lease of a lock, nil if it has none. An unreadable lease
+// is considered expired.
+func (ll *leaseLocker) read(ctx context.Context, leasePath string) (*lease, error) {
+	content, err := ll.driver.GetContent(ctx, leasePath)
+	if err != nil {
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var l lease
+	if err := json.Unmarshal(content, &l); err != nil {
+		return &lease{}, nil
+	}
+	return &l, nil
+}
+
+func (ll *leaseLocker) write(ctx context.Context, leasePath, token string) error {
+	content, err := json.Marshal(lease{
+		Token:   token,
+		Expires: time.Now().Add(ll.ttl),
+	})
+	if err != nil {
+		return err
+	}
+	return ll.driver.PutContent(ctx, leasePath, content)
+}
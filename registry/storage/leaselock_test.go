@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/distribution/v3/registry/storage/lock/lockcheck"
+)
+
+func TestLeaseLocker(t *testing.T) {
+	lockcheck.CheckLocker(t, NewLeaseLocker(inmemory.New(), time.Second))
+}
+
+func TestLeaseLockerExpiry(t *testing.T) {
+	ctx := context.Background()
+	d := inmemory.New()
+	locker := NewLeaseLocker(d, 300*time.Millisecond)
+
+	// the lease of a crashed holder expires
+	leasePath, err := pathFor(lockPathSpec{key: "repositories/crashed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := json.Marshal(lease{Token: "crashed", Expires: time.Now().Add(-time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutContent(ctx, leasePath, content); err != nil {
+		t.Fatal(err)
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	unlock, err := locker.Lock(timeoutCtx, "repositories/crashed")
+	if err != nil {
+		t.Fatalf("unexpected error locking a lock whose lease expired: %v", err)
+	}
+	unlock()
+
+	// the lease of a live holder is renewed past its lifetime
+	unlock, err = locker.Lock(ctx, "repositories/held")
+	if err != nil {
+		t.Fatalf("unexpected error locking: %v", err)
+	}
+	defer unlock()
+	time.Sleep(time.Second)
+	timeoutCtx, cancel = context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	if _, err := locker.Lock(timeoutCtx, "repositories/held"); err == nil {
+		t.Fatal("expected an error locking a held lock past the lifetime of its lease")
+	}
+}
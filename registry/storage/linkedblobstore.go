@@ -40,6 +40,11 @@ type linkedBlobStore struct {
 
 	// linkDirectoryPathSpec locates the root directories in which one might find links
 	linkDirectoryPathSpec pathSpec
+
+	// trash records the deleted blobs when soft deletion is enabled. It is
+	// not set for manifests, whose deletions are recorded by the manifest
+	// store.
+	trash *trash
 }
 
 var _ distribution.BlobStore = &linkedBlobStore{}
@@ -122,6 +127,40 @@ func WithMountFrom(ref reference.Canonical) distribution.BlobCreateOption {
 	})
 }
 
+// WithMountFallback returns a BlobCreateOption which designates that the blob
+// to mount should be linked from the blob store if the source repository
+// does not have it. As blobs are stored once, linking it copies it into the
+// repository.
+func WithMountFallback() distribution.BlobCreateOption {
+	return optionFunc(func(v interface{}) error {
+		opts, ok := v.(*distribution.CreateOptions)
+		if !ok {
+			return fmt.Errorf("unexpected options type: %T", v)
+		}
+
+		opts.Mount.Fallback = true
+
+		return nil
+	})
+}
+
+// WithMountDescriptor returns a BlobCreateOption which designates that the
+// blob to mount is described by desc, which the caller already looked up in
+// the blob store. The blob is then linked without checking that the source
+// repository has it.
+func WithMountDescriptor(desc distribution.Descriptor) distribution.BlobCreateOption {
+	return optionFunc(func(v interface{}) error {
+		opts, ok := v.(*distribution.CreateOptions)
+		if !ok {
+			return fmt.Errorf("unexpected options type: %T", v)
+		}
+
+		opts.Mount.Stat = &desc
+
+		return nil
+	})
+}
+
 // Writer begins a blob write session, returning a handle.
 func (lbs *linkedBlobStore) Create(ctx context.Context, options ...distribution.BlobCreateOption) (distribution.BlobWriter, error) {
 	dcontext.GetLogger(ctx).Debug("(*linkedBlobStore).Writer")
@@ -137,6 +176,9 @@ func (lbs *linkedBlobStore) Create(ctx context.Context, options ...distribution.
 
 	if opts.Mount.ShouldMount {
 		desc, err := lbs.mount(ctx, opts.Mount.From, opts.Mount.From.Digest(), opts.Mount.Stat)
+		if err != nil && opts.Mount.Fallback {
+			desc, err = lbs.mountFromBlobStore(ctx, opts.Mount.From)
+		}
 		if err == nil {
 			// Mount successful, no need to initiate an upload session
 			return nil, distribution.ErrBlobMounted{From: opts.Mount.From, Descriptor: desc}
@@ -222,8 +264,24 @@ func (lbs *linkedBlobStore) Delete(ctx context.Context, dgst digest.Digest) erro
 		return err
 	}
 
+	var trashID string
+	if lbs.trash != nil {
+		trashID, err = lbs.trash.add(ctx, lbs.repository.Named().Name(), distribution.TrashEntry{
+			Kind:   distribution.TrashEntryBlob,
+			Digest: dgst,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
 	err = lbs.blobAccessController.Clear(ctx, dgst)
 	if err != nil {
+		if trashID != "" {
+			if err := lbs.trash.remove(ctx, lbs.repository.Named().Name(), trashID); err != nil {
+				dcontext.GetLogger(ctx).Errorf("error removing trash entry of blob %s: %v", dgst, err)
+			}
+		}
 		return err
 	}
 
@@ -302,6 +360,51 @@ func (lbs *linkedBlobStore) mount(ctx context.Context, sourceRepo reference.Name
 	return desc, lbs.linkBlob(ctx, desc)
 }
 
+// mountFromBlobStore links a blob stored by any repository, when it cannot be
+// mounted from the source repository.
+func (lbs *linkedBlobStore) mountFromBlobStore(ctx context.Context, sourceRepo reference.Canonical) (distribution.Descriptor, error) {
+	stat, err := lbs.blobStore.statter.Stat(ctx, sourceRepo.Digest())
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+
+	dcontext.GetLogger(ctx).Infof("mounting blob %s from the blob store, it is not available in %s", sourceRepo.Digest(), sourceRepo.Name())
+	return lbs.mount(ctx, sourceRepo, sourceRepo.Digest(), &stat)
+}
+
+// linkSharedData links the data of a blob committed under the root directory
+// of ctx from another root directory sharing its blob data, returning whether
+// it did. The data uploaded is stored instead when no other root directory
+// holds it, or when the driver cannot link objects.
+func (lbs *linkedBlobStore) linkSharedData(ctx context.Context, blobPath string) bool {
+	if lbs.registry == nil || len(lbs.registry.sharedRoots) == 0 {
+		return false
+	}
+	d, ok := lbs.driver.(*contextRootedDriver)
+	if !ok {
+		return false
+	}
+
+	current := RootDirectory(ctx)
+	for _, root := range lbs.registry.sharedRoots {
+		if root == current {
+			continue
+		}
+		switch err := d.linkFromRoot(ctx, root, blobPath).(type) {
+		case nil:
+			dcontext.GetLogger(ctx).Debugf("linked blob data %s from root directory %s", blobPath, root)
+			return true
+		case driver.PathNotFoundError:
+			continue
+		case driver.ErrUnsupportedMethod:
+			return false
+		default:
+			dcontext.GetLogger(ctx).Warnf("error linking blob data %s from root directory %s: %v", blobPath, root, err)
+		}
+	}
+	return false
+}
+
 // newBlobUpload allocates a new upload controller with the given state.
 func (lbs *linkedBlobStore) newBlobUpload(ctx context.Context, uuid, path string, startedAt time.Time, append bool) (distribution.BlobWriter, error) {
 	fw, err := lbs.driver.Writer(ctx, path, append)
@@ -333,6 +436,12 @@ func (lbs *linkedBlobStore) linkBlob(ctx context.Context, canonical distribution
 	// since we don't care about the aliases. They are generally unused except
 	// for tarsum but those versions don't care about mediatype.
 
+	if lbs.registry != nil && lbs.registry.markLog != nil {
+		if err := lbs.registry.markLog.mark(ctx, canonical.Digest); err != nil {
+			return err
+		}
+	}
+
 	// Don't make duplicate links.
 	seenDigests := make(map[digest.Digest]struct{}, len(dgsts))
 
@@ -0,0 +1,113 @@
+// Package lock provides the locks serializing the critical sections of the
+// registry instances sharing a storage backend, such as tag updates and the
+// marking of a repository by the garbage collector.
+package lock
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+)
+
+const (
+	// DefaultTTL is the lifetime of the leases of the locks when none is
+	// configured. Leases are renewed while their lock is held, so it only
+	// bounds how long the lock of a crashed instance is held.
+	DefaultTTL = 30 * time.Second
+
+	// minPollInterval and maxPollInterval bound the interval between the
+	// attempts to acquire a lock held by someone else.
+	minPollInterval = 10 * time.Millisecond
+	maxPollInterval = time.Second
+)
+
+// Locker acquires locks shared by the registry instances writing to the same
+// storage.
+type Locker interface {
+	// Lock blocks until the lock of key is acquired, or ctx is done, and
+	// returns the function releasing it. A lock is held under a lease, which
+	// is renewed until the lock is released so that the locks of crashed
+	// instances eventually expire.
+	Lock(ctx context.Context, key string) (func(), error)
+}
+
+// Lease implements the acquisition and renewal of the leased locks, on top of
+// the operations of a backend.
+type Lease struct {
+	// TTL is the lifetime of the lease.
+	TTL time.Duration
+	// TryAcquire attempts to take the lease, reporting whether it did.
+	TryAcquire func(ctx context.Context) (bool, error)
+	// Renew extends the lease, reporting whether it is still held.
+	Renew func(ctx context.Context) (bool, error)
+	// Release gives the lease up.
+	Release func(ctx context.Context) error
+}
+
+// Hold acquires the lease, polling until it is free or ctx is done, and
+// renews it in the background until the returned function is called.
+func (l Lease) Hold(ctx context.Context, key string) (func(), error) {
+	interval := minPollInterval
+	for {
+		ok, err := l.TryAcquire(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+		if interval *= 2; interval > maxPollInterval {
+			interval = maxPollInterval
+		}
+	}
+
+	// the lease outlives the context of the acquisition, such as the one of
+	// the request which acquired it
+	bg := context.Background()
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(l.TTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				ok, err := l.Renew(bg)
+				if err != nil {
+					dcontext.GetLogger(ctx).Errorf("error renewing the lease of lock %s: %v", key, err)
+				} else if !ok {
+					dcontext.GetLogger(ctx).Errorf("lease of lock %s lost", key)
+					return
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+		if err := l.Release(bg); err != nil {
+			dcontext.GetLogger(ctx).Errorf("error releasing lock %s: %v", key, err)
+		}
+	}, nil
+}
+
+// NewToken returns a random token identifying the holder of a lease.
+func NewToken() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,87 @@
+// Package lockcheck provides the tests of the implementations of the lock
+// package.
+package lockcheck
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/storage/lock"
+)
+
+// CheckLocker checks that the locks of a locker are mutually exclusive, and
+// released when their holder is done.
+func CheckLocker(t *testing.T, locker lock.Locker) {
+	checkExclusion(t, locker)
+	checkConcurrentHolders(t, locker)
+}
+
+func checkExclusion(t *testing.T, locker lock.Locker) {
+	ctx := context.Background()
+
+	unlock, err := locker.Lock(ctx, "repositories/foo/bar")
+	if err != nil {
+		t.Fatalf("unexpected error locking: %v", err)
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	if _, err := locker.Lock(timeoutCtx, "repositories/foo/bar"); err != context.DeadlineExceeded {
+		t.Fatalf("expected a deadline error locking a held lock, got %v", err)
+	}
+
+	// other keys are independent
+	unlockOther, err := locker.Lock(ctx, "repositories/foo")
+	if err != nil {
+		t.Fatalf("unexpected error locking another key: %v", err)
+	}
+	unlockOther()
+
+	unlock()
+	timeoutCtx, cancel = context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	unlock, err = locker.Lock(timeoutCtx, "repositories/foo/bar")
+	if err != nil {
+		t.Fatalf("unexpected error locking a released lock: %v", err)
+	}
+	unlock()
+}
+
+func checkConcurrentHolders(t *testing.T, locker lock.Locker) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		holders int
+		overlap bool
+	)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock, err := locker.Lock(ctx, "repositories/concurrent")
+			if err != nil {
+				t.Errorf("unexpected error locking: %v", err)
+				return
+			}
+			defer unlock()
+
+			mu.Lock()
+			holders++
+			overlap = overlap || holders > 1
+			mu.Unlock()
+			time.Sleep(20 * time.Millisecond)
+			mu.Lock()
+			holders--
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if overlap {
+		t.Fatal("lock held by several holders at once")
+	}
+}
@@ -0,0 +1,62 @@
+// Package redis provides locks held in redis.
+package redis
+
+import (
+	"context"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/storage/lock"
+	"github.com/redis/go-redis/v9"
+)
+
+// renewScript extends the lease of a lock if the token still holds it.
+var renewScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("pexpire", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// releaseScript deletes a lock if the token still holds it.
+var releaseScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0
+`)
+
+type redisLocker struct {
+	client redis.UniversalClient
+	ttl    time.Duration
+}
+
+// NewRedisLocker returns a locker holding its locks in redis, as keys set to
+// the token of their holder and expiring with their lease.
+func NewRedisLocker(client redis.UniversalClient, ttl time.Duration) lock.Locker {
+	if ttl <= 0 {
+		ttl = lock.DefaultTTL
+	}
+	return &redisLocker{
+		client: client,
+		ttl:    ttl,
+	}
+}
+
+func (rl *redisLocker) Lock(ctx context.Context, key string) (func(), error) {
+	redisKey := "lock::" + key
+	token := lock.NewToken()
+
+	return lock.Lease{
+		TTL: rl.ttl,
+		TryAcquire: func(ctx context.Context) (bool, error) {
+			return rl.client.SetNX(ctx, redisKey, token, rl.ttl).Result()
+		},
+		Renew: func(ctx context.Context) (bool, error) {
+			n, err := renewScript.Run(ctx, rl.client, []string{redisKey}, token, rl.ttl.Milliseconds()).Int()
+			return n == 1, err
+		},
+		Release: func(ctx context.Context) error {
+			return releaseScript.Run(ctx, rl.client, []string{redisKey}, token).Err()
+		},
+	}.Hold(ctx, key)
+}
@@ -0,0 +1,43 @@
+package redis
+
+import (
+	"context"
+	"flag"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/storage/lock/lockcheck"
+	"github.com/redis/go-redis/v9"
+)
+
+var redisAddr string
+
+func init() {
+	flag.StringVar(&redisAddr, "test.registry.storage.lock.redis.addr", "", "configure the address of a test instance of redis")
+}
+
+// TestRedisLocker exercises a live redis instance using the locker
+// implementation.
+func TestRedisLocker(t *testing.T) {
+	if redisAddr == "" {
+		// fallback to an environement variable
+		redisAddr = os.Getenv("TEST_REGISTRY_STORAGE_LOCK_REDIS_ADDR")
+	}
+
+	if redisAddr == "" {
+		// skip if still not set
+		t.Skip("please set -test.registry.storage.lock.redis.addr to test locks against redis")
+	}
+
+	client := redis.NewClient(&redis.Options{
+		Addr: redisAddr,
+	})
+	defer client.Close()
+
+	if err := client.FlushDB(context.Background()).Err(); err != nil {
+		t.Fatalf("unexpected error flushing redis db: %v", err)
+	}
+
+	lockcheck.CheckLocker(t, NewRedisLocker(client, 3*time.Second))
+}
@@ -12,8 +12,10 @@ import (
 	"github.com/distribution/distribution/v3/manifest/ocischema"
 	"github.com/distribution/distribution/v3/manifest/schema1"
 	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/distribution/distribution/v3/tracing"
 	"github.com/opencontainers/go-digest"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // A ManifestHandler gets and puts manifests of a particular type.
@@ -74,6 +76,9 @@ func (ms *manifestStore) Exists(ctx context.Context, dgst digest.Digest) (bool,
 func (ms *manifestStore) Get(ctx context.Context, dgst digest.Digest, options ...distribution.ManifestServiceOption) (distribution.Manifest, error) {
 	dcontext.GetLogger(ms.ctx).Debug("(*manifestStore).Get")
 
+	ctx, span := tracing.StartSpan(ctx, "manifestStore.Get", attribute.String("digest", dgst.String()))
+	defer span.End()
+
 	// TODO(stevvooe): Need to check descriptor from above to ensure that the
 	// mediatype is as we expect for the manifest store.
 
@@ -89,8 +94,14 @@ func (ms *manifestStore) Get(ctx context.Context, dgst digest.Digest, options ..
 		return nil, err
 	}
 
+	return ms.unmarshal(ctx, dgst, content)
+}
+
+// unmarshal unmarshals the content of the manifest with the handler of its
+// media type.
+func (ms *manifestStore) unmarshal(ctx context.Context, dgst digest.Digest, content []byte) (distribution.Manifest, error) {
 	var versioned manifest.Versioned
-	if err = json.Unmarshal(content, &versioned); err != nil {
+	if err := json.Unmarshal(content, &versioned); err != nil {
 		return nil, err
 	}
 
@@ -129,24 +140,147 @@ func (ms *manifestStore) Get(ctx context.Context, dgst digest.Digest, options ..
 func (ms *manifestStore) Put(ctx context.Context, manifest distribution.Manifest, options ...distribution.ManifestServiceOption) (digest.Digest, error) {
 	dcontext.GetLogger(ms.ctx).Debug("(*manifestStore).Put")
 
+	ctx, span := tracing.StartSpan(ctx, "manifestStore.Put")
+	defer span.End()
+
+	var handler ManifestHandler
 	switch manifest.(type) {
 	case *schema1.SignedManifest:
-		return ms.schema1Handler.Put(ctx, manifest, ms.skipDependencyVerification)
+		handler = ms.schema1Handler
 	case *schema2.DeserializedManifest:
-		return ms.schema2Handler.Put(ctx, manifest, ms.skipDependencyVerification)
+		handler = ms.schema2Handler
 	case *ocischema.DeserializedManifest:
-		return ms.ocischemaHandler.Put(ctx, manifest, ms.skipDependencyVerification)
+		handler = ms.ocischemaHandler
 	case *manifestlist.DeserializedManifestList:
-		return ms.manifestListHandler.Put(ctx, manifest, ms.skipDependencyVerification)
+		handler = ms.manifestListHandler
+	default:
+		return "", fmt.Errorf("unrecognized manifest type %T", manifest)
+	}
+
+	if err := ms.validate(ctx, manifest, options...); err != nil {
+		return "", err
+	}
+
+	if ml := ms.repository.registry.markLog; ml != nil {
+		// Mark the references before verifying them, so they can't be
+		// reaped by an online garbage collection until the manifest is
+		// stored.
+		var references []digest.Digest
+		for _, descriptor := range manifest.References() {
+			references = append(references, descriptor.Digest)
+		}
+		if err := ml.mark(ctx, references...); err != nil {
+			return "", err
+		}
+	}
+
+	dgst, err := handler.Put(ctx, manifest, ms.skipDependencyVerification)
+	if err != nil {
+		return "", err
+	}
+
+	if subject := manifestSubject(manifest); subject != nil {
+		if err := ms.linkReferrer(ctx, subject.Digest, dgst); err != nil {
+			return "", err
+		}
+	}
+
+	if ti := ms.repository.registry.tocIndexer; ti != nil {
+		// The table of contents is an optimization: failing to index it
+		// must not fail the push, clients then read the layer footer.
+		if err := ti.index(ctx, manifest); err != nil {
+			dcontext.GetLogger(ctx).Errorf("error indexing table of contents of manifest %s: %v", dgst, err)
+		}
+	}
+
+	if ci := ms.repository.registry.catalogIndex; ci != nil {
+		if err := ci.touch(ctx, ms.repository.Named().Name()); err != nil {
+			return "", err
+		}
+	}
+
+	return dgst, nil
+}
+
+// validate calls the manifest validators of the registry, returning the
+// first rejection as a verification error.
+func (ms *manifestStore) validate(ctx context.Context, manifest distribution.Manifest, options ...distribution.ManifestServiceOption) error {
+	var tag string
+	for _, option := range options {
+		if opt, ok := option.(distribution.WithTagOption); ok {
+			tag = opt.Tag
+		}
 	}
 
-	return "", fmt.Errorf("unrecognized manifest type %T", manifest)
+	for _, validator := range ms.repository.registry.manifestValidators {
+		if err := validator.ValidateManifest(ctx, ms.repository, tag, manifest); err != nil {
+			if _, ok := err.(distribution.ErrManifestVerification); ok {
+				return err
+			}
+			return distribution.ErrManifestVerification{distribution.ErrManifestRejected{Reason: err}}
+		}
+	}
+	return nil
 }
 
 // Delete removes the revision of the specified manifest.
 func (ms *manifestStore) Delete(ctx context.Context, dgst digest.Digest) error {
 	dcontext.GetLogger(ms.ctx).Debug("(*manifestStore).Delete")
-	return ms.blobStore.Delete(ctx, dgst)
+
+	ctx, span := tracing.StartSpan(ctx, "manifestStore.Delete", attribute.String("digest", dgst.String()))
+	defer span.End()
+
+	unlock, err := ms.repository.registry.lockRepository(ctx, ms.repository.Named().Name())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// Look up the subject before the revision goes away, so the manifest
+	// can be removed from the referrers index.
+	var subject *distribution.Descriptor
+	if manifest, err := ms.Get(ctx, dgst); err == nil {
+		subject = manifestSubject(manifest)
+	}
+
+	// Record the deletion in the trash before the revision goes away, along
+	// with the tags removed with the manifest.
+	var trashID string
+	if t := ms.repository.trash; t != nil && ms.blobStore.deleteEnabled {
+		if _, err := ms.blobStore.Stat(ctx, dgst); err != nil {
+			return err
+		}
+		tags, err := ms.repository.Tags(ctx).Lookup(ctx, distribution.Descriptor{Digest: dgst})
+		if err != nil {
+			return err
+		}
+		trashID, err = t.add(ctx, ms.repository.Named().Name(), distribution.TrashEntry{
+			Kind:   distribution.TrashEntryManifest,
+			Digest: dgst,
+			Tags:   tags,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := ms.blobStore.Delete(ctx, dgst); err != nil {
+		if trashID != "" {
+			if err := ms.repository.trash.remove(ctx, ms.repository.Named().Name(), trashID); err != nil {
+				dcontext.GetLogger(ctx).Errorf("error removing trash entry of manifest %s: %v", dgst, err)
+			}
+		}
+		return err
+	}
+
+	if subject != nil {
+		if err := ms.unlinkReferrer(ctx, subject.Digest, dgst); err != nil {
+			// a dangling link is ignored when listing referrers
+			dcontext.GetLogger(ctx).Warnf("error removing referrer link for %s: %v", dgst, err)
+		}
+	}
+
+	return nil
 }
 
 func (ms *manifestStore) Enumerate(ctx context.Context, ingester func(digest.Digest) error) error {
@@ -3,6 +3,8 @@ package storage
 import (
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"reflect"
 	"testing"
@@ -543,6 +545,192 @@ func testOCIManifestStorage(t *testing.T, testname string, includeMediaTypes boo
 
 }
 
+// TestOCIManifestReferrers ensures manifests declaring a subject are indexed
+// on put and removed from the index on delete.
+func TestOCIManifestReferrers(t *testing.T) {
+	repoName, _ := reference.WithName("foo/referrers")
+	env := newManifestStoreTestEnv(t, repoName, "thetag",
+		BlobDescriptorCacheProvider(memory.NewInMemoryBlobDescriptorCacheProvider(memory.UnlimitedSize)),
+		EnableDelete, EnableRedirect)
+
+	ctx := context.Background()
+	ms, err := env.repository.Manifests(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	builder := ocischema.NewManifestBuilder(env.repository.Blobs(ctx), []byte("{}"), map[string]string{})
+	subject, err := builder.Build(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error generating manifest: %v", err)
+	}
+
+	subjectDigest, err := ms.Put(ctx, subject)
+	if err != nil {
+		t.Fatalf("unexpected error putting manifest: %v", err)
+	}
+
+	referrerService, ok := ms.(distribution.ManifestReferrers)
+	if !ok {
+		t.Fatalf("manifest store does not implement distribution.ManifestReferrers")
+	}
+
+	referrers, err := referrerService.Referrers(ctx, subjectDigest, "")
+	if err != nil {
+		t.Fatalf("unexpected error listing referrers: %v", err)
+	}
+	if len(referrers) != 0 {
+		t.Fatalf("expected no referrers, got %v", referrers)
+	}
+
+	config := subject.(*ocischema.DeserializedManifest).Config
+	artifactTypes := []string{"application/vnd.example.sbom", "application/vnd.example.signature"}
+	referrerDigests := make(map[string]digest.Digest)
+	for _, artifactType := range artifactTypes {
+		referrer, err := ocischema.FromStruct(ocischema.Manifest{
+			Versioned:    ocischema.SchemaVersion,
+			ArtifactType: artifactType,
+			Config:       config,
+			Layers:       []distribution.Descriptor{},
+			Subject: &distribution.Descriptor{
+				MediaType: v1.MediaTypeImageManifest,
+				Digest:    subjectDigest,
+			},
+			Annotations: map[string]string{"type": artifactType},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error generating referrer: %v", err)
+		}
+
+		dgst, err := ms.Put(ctx, referrer)
+		if err != nil {
+			t.Fatalf("unexpected error putting referrer: %v", err)
+		}
+		referrerDigests[artifactType] = dgst
+	}
+
+	referrers, err = referrerService.Referrers(ctx, subjectDigest, "")
+	if err != nil {
+		t.Fatalf("unexpected error listing referrers: %v", err)
+	}
+	if len(referrers) != len(artifactTypes) {
+		t.Fatalf("expected %d referrers, got %v", len(artifactTypes), referrers)
+	}
+	for _, desc := range referrers {
+		if desc.Digest != referrerDigests[desc.ArtifactType] {
+			t.Fatalf("unexpected referrer %v", desc)
+		}
+		if desc.MediaType != v1.MediaTypeImageManifest {
+			t.Fatalf("unexpected referrer media type %q", desc.MediaType)
+		}
+		if desc.Annotations["type"] != desc.ArtifactType {
+			t.Fatalf("unexpected referrer annotations %v", desc.Annotations)
+		}
+	}
+
+	referrers, err = referrerService.Referrers(ctx, subjectDigest, artifactTypes[0])
+	if err != nil {
+		t.Fatalf("unexpected error listing referrers: %v", err)
+	}
+	if len(referrers) != 1 || referrers[0].Digest != referrerDigests[artifactTypes[0]] {
+		t.Fatalf("unexpected filtered referrers %v", referrers)
+	}
+
+	if err := ms.Delete(ctx, referrerDigests[artifactTypes[0]]); err != nil {
+		t.Fatalf("unexpected error deleting referrer: %v", err)
+	}
+
+	referrers, err = referrerService.Referrers(ctx, subjectDigest, "")
+	if err != nil {
+		t.Fatalf("unexpected error listing referrers: %v", err)
+	}
+	if len(referrers) != 1 || referrers[0].Digest != referrerDigests[artifactTypes[1]] {
+		t.Fatalf("unexpected referrers after delete %v", referrers)
+	}
+}
+
+// noLatestValidator rejects the manifests pushed with the latest tag, and
+// the manifests of the repository it is given without source annotation.
+type noLatestValidator struct {
+	requireSource string
+}
+
+func (v *noLatestValidator) ValidateManifest(ctx context.Context, repository distribution.Repository, tag string, m distribution.Manifest) error {
+	if tag == "latest" {
+		return errors.New("the latest tag is not allowed")
+	}
+	if repository.Named().Name() == v.requireSource {
+		if om, ok := m.(*ocischema.DeserializedManifest); !ok || om.Annotations[v1.AnnotationSource] == "" {
+			return fmt.Errorf("manifests of %s require a source", v.requireSource)
+		}
+	}
+	return nil
+}
+
+// TestManifestValidators checks that the manifest validators are called
+// before manifests are stored.
+func TestManifestValidators(t *testing.T) {
+	ctx := context.Background()
+	registry := createRegistry(t, inmemory.New(), ManifestValidators(&noLatestValidator{requireSource: "test/sourced"}))
+
+	for _, c := range []struct {
+		repository  string
+		tag         string
+		annotations map[string]string
+		rejected    bool
+	}{
+		{repository: "test/other", tag: "latest", rejected: true},
+		{repository: "test/other", tag: "v1"},
+		{repository: "test/other"},
+		{repository: "test/sourced", tag: "v1", rejected: true},
+		{repository: "test/sourced", tag: "v1", annotations: map[string]string{v1.AnnotationSource: "https://example.com/src"}},
+	} {
+		repo := makeRepository(t, registry, c.repository)
+		manifests := makeManifestService(t, repo)
+
+		config, err := repo.Blobs(ctx).Put(ctx, v1.MediaTypeImageConfig, []byte("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dm, err := ocischema.FromStruct(ocischema.Manifest{
+			Versioned: manifest.Versioned{
+				SchemaVersion: 2,
+				MediaType:     v1.MediaTypeImageManifest,
+			},
+			Config:      config,
+			Annotations: c.annotations,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var options []distribution.ManifestServiceOption
+		if c.tag != "" {
+			options = append(options, distribution.WithTag(c.tag))
+		}
+		_, err = manifests.Put(ctx, dm, options...)
+		if !c.rejected {
+			if err != nil {
+				t.Errorf("%s:%s: unexpected error: %v", c.repository, c.tag, err)
+			}
+			continue
+		}
+
+		verr, ok := err.(distribution.ErrManifestVerification)
+		if !ok || len(verr) != 1 {
+			t.Errorf("%s:%s: expected a verification error, got %v", c.repository, c.tag, err)
+			continue
+		}
+		if _, ok := verr[0].(distribution.ErrManifestRejected); !ok {
+			t.Errorf("%s:%s: expected a rejection, got %v", c.repository, c.tag, verr[0])
+		}
+		_, payload, _ := dm.Payload()
+		if exists, _ := manifests.Exists(ctx, digest.FromBytes(payload)); exists {
+			t.Errorf("%s:%s: rejected manifest was stored", c.repository, c.tag)
+		}
+	}
+}
+
 // TestLinkPathFuncs ensures that the link path functions behavior are locked
 // down and implemented as expected.
 func TestLinkPathFuncs(t *testing.T) {
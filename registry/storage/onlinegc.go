@@ -0,0 +1,261 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+)
+
+// markLog records the last time blobs were referenced, so that online
+// garbage collection does not reap blobs pushed or referenced while it runs.
+// An entry is written whenever a blob is linked into a repository and for
+// every reference of a manifest before it is stored.
+type markLog struct {
+	driver driver.StorageDriver
+}
+
+// mark records that the blobs identified by dgsts are referenced now.
+func (ml *markLog) mark(ctx context.Context, dgsts ...digest.Digest) error {
+	now := []byte(time.Now().UTC().Format(time.RFC3339Nano))
+	for _, dgst := range dgsts {
+		markPath, err := pathFor(gcMarkPathSpec{digest: dgst})
+		if err != nil {
+			return err
+		}
+
+		if err := ml.driver.PutContent(ctx, markPath, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markedSince returns true if the blob identified by dgst was referenced
+// after the given time.
+func (ml *markLog) markedSince(ctx context.Context, dgst digest.Digest, since time.Time) (bool, error) {
+	markPath, err := pathFor(gcMarkPathSpec{digest: dgst})
+	if err != nil {
+		return false, err
+	}
+
+	content, err := ml.driver.GetContent(ctx, markPath)
+	if err != nil {
+		switch err.(type) {
+		case driver.PathNotFoundError:
+			return false, nil
+		}
+		return false, err
+	}
+
+	marked, err := time.Parse(time.RFC3339Nano, string(content))
+	if err != nil {
+		// an unreadable mark is conservatively considered recent
+		return true, nil
+	}
+
+	return marked.After(since), nil
+}
+
+// prune removes the mark log entries older than the given time.
+func (ml *markLog) prune(ctx context.Context, before time.Time) error {
+	marksPath, err := pathFor(gcMarksPathSpec{})
+	if err != nil {
+		return err
+	}
+
+	var stale []string
+	err = ml.driver.Walk(ctx, marksPath, func(fileInfo driver.FileInfo) error {
+		if fileInfo.IsDir() {
+			return nil
+		}
+
+		rel := strings.TrimPrefix(fileInfo.Path(), marksPath+"/")
+		algorithm, hex := path.Split(rel)
+		dgst := digest.NewDigestFromHex(strings.TrimSuffix(algorithm, "/"), hex)
+		if dgst.Validate() != nil {
+			return nil
+		}
+
+		recent, err := ml.markedSince(ctx, dgst, before)
+		if err != nil {
+			return err
+		}
+		if !recent {
+			stale = append(stale, fileInfo.Path())
+		}
+		return nil
+	})
+	if err != nil {
+		switch err.(type) {
+		case driver.PathNotFoundError:
+			return nil
+		}
+		return err
+	}
+
+	for _, p := range stale {
+		if err := ml.driver.Delete(ctx, p); err != nil {
+			switch err.(type) {
+			case driver.PathNotFoundError:
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// OnlineGCOpts contains options for the online garbage collector
+type OnlineGCOpts struct {
+	// GracePeriod protects blobs written or referenced within this duration
+	// before the collection started.
+	GracePeriod time.Duration
+	DryRun      bool
+}
+
+// OnlineMarkAndSweep performs a mark and sweep of registry blobs which can
+// run while the registry accepts pushes. Unlike MarkAndSweep, it never
+// removes manifests, and it only removes unreferenced blobs which were
+// neither written nor recorded in the mark log within the grace period.
+// Every registry instance writing to the storage must be configured with
+// EnableMarkLog for this to be safe.
+func OnlineMarkAndSweep(ctx context.Context, storageDriver driver.StorageDriver, registry distribution.Namespace, opts OnlineGCOpts) error {
+	repositoryEnumerator, ok := registry.(distribution.RepositoryEnumerator)
+	if !ok {
+		return fmt.Errorf("unable to convert Namespace to RepositoryEnumerator")
+	}
+
+	log := dcontext.GetLogger(ctx)
+	cutoff := time.Now().Add(-opts.GracePeriod)
+	ml := &markLog{driver: storageDriver}
+
+	// mark
+	markSet := make(map[digest.Digest]struct{})
+	err := repositoryEnumerator.Enumerate(ctx, func(repoName string) error {
+		named, err := reference.WithName(repoName)
+		if err != nil {
+			return fmt.Errorf("failed to parse repo name %s: %v", repoName, err)
+		}
+		repository, err := registry.Repository(ctx, named)
+		if err != nil {
+			return fmt.Errorf("failed to construct repository: %v", err)
+		}
+
+		// tags are not updated nor manifests deleted while the repository
+		// is marked
+		unlock, err := lockRepository(ctx, registry, repoName)
+		if err != nil {
+			return fmt.Errorf("failed to lock repository %s: %v", repoName, err)
+		}
+		defer unlock()
+
+		manifestService, err := repository.Manifests(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to construct manifest service: %v", err)
+		}
+
+		manifestEnumerator, ok := manifestService.(distribution.ManifestEnumerator)
+		if !ok {
+			return fmt.Errorf("unable to convert ManifestService into ManifestEnumerator")
+		}
+
+		err = manifestEnumerator.Enumerate(ctx, func(dgst digest.Digest) error {
+			markSet[dgst] = struct{}{}
+
+			manifest, err := manifestService.Get(ctx, dgst)
+			if err != nil {
+				// The manifest may have been deleted since it was
+				// enumerated, its blob is then left to the next run.
+				log.Warnf("online gc: failed to retrieve manifest %s@%s: %v", repoName, dgst, err)
+				return nil
+			}
+
+			for _, descriptor := range manifest.References() {
+				markSet[descriptor.Digest] = struct{}{}
+			}
+			return nil
+		})
+
+		if _, ok := err.(driver.PathNotFoundError); !ok && err != nil {
+			return err
+		}
+
+		// the content of the soft deleted objects is kept until their
+		// trash entry expires, which only MarkAndSweep removes
+		trashed, _, err := trashedContent(ctx, repository, time.Now())
+		if err != nil {
+			return fmt.Errorf("failed to read trash of %s: %v", repoName, err)
+		}
+		for _, dgst := range trashed {
+			markSet[dgst] = struct{}{}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to mark: %v", err)
+	}
+
+	// sweep
+	var candidates []digest.Digest
+	err = registry.Blobs().Enumerate(ctx, func(dgst digest.Digest) error {
+		if _, ok := markSet[dgst]; !ok {
+			candidates = append(candidates, dgst)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error enumerating blobs: %v", err)
+	}
+
+	vacuum := registryVacuum(ctx, storageDriver, registry)
+	var removed int
+	for _, dgst := range candidates {
+		// The mark log and modification time are checked as late as
+		// possible, to account for concurrent pushes.
+		recent, err := ml.markedSince(ctx, dgst, cutoff)
+		if err != nil {
+			return fmt.Errorf("failed to read mark of blob %s: %v", dgst, err)
+		}
+		if recent {
+			continue
+		}
+
+		blobPath, err := pathFor(blobDataPathSpec{digest: dgst})
+		if err != nil {
+			return err
+		}
+		fi, err := storageDriver.Stat(ctx, blobPath)
+		if err != nil {
+			if _, ok := err.(driver.PathNotFoundError); ok {
+				continue
+			}
+			return fmt.Errorf("failed to stat blob %s: %v", dgst, err)
+		}
+		if fi.ModTime().After(cutoff) {
+			continue
+		}
+
+		log.Infof("online gc: blob eligible for deletion: %s", dgst)
+		removed++
+		if opts.DryRun {
+			continue
+		}
+		if err := vacuum.RemoveBlob(string(dgst)); err != nil {
+			return fmt.Errorf("failed to delete blob %s: %v", dgst, err)
+		}
+	}
+	log.Infof("online gc: %d blobs marked, %d blobs eligible for deletion", len(markSet), removed)
+
+	if opts.DryRun {
+		return nil
+	}
+	return ml.prune(ctx, cutoff)
+}
@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/distribution/v3/testutil"
+)
+
+func TestOnlineGCOrphanBlobDeleted(t *testing.T) {
+	inmemoryDriver := inmemory.New()
+
+	registry := createRegistry(t, inmemoryDriver, EnableMarkLog)
+	repo := makeRepository(t, registry, "online")
+
+	digests, err := testutil.CreateRandomLayers(1)
+	if err != nil {
+		t.Fatalf("Failed to create random digest: %v", err)
+	}
+
+	if err = testutil.UploadBlobs(repo, digests); err != nil {
+		t.Fatalf("Failed to upload blob: %v", err)
+	}
+
+	image := uploadRandomSchema2Image(t, repo)
+
+	err = OnlineMarkAndSweep(context.Background(), inmemoryDriver, registry, OnlineGCOpts{})
+	if err != nil {
+		t.Fatalf("Failed online mark and sweep: %v", err)
+	}
+
+	blobs := allBlobs(t, registry)
+
+	for dgst := range digests {
+		if _, ok := blobs[dgst]; ok {
+			t.Fatalf("Orphan layer is present: %v", dgst)
+		}
+	}
+
+	for dgst := range image.layers {
+		if _, ok := blobs[dgst]; !ok {
+			t.Fatalf("Referenced layer was deleted: %v", dgst)
+		}
+	}
+	if _, ok := blobs[image.manifestDigest]; !ok {
+		t.Fatalf("Manifest was deleted: %v", image.manifestDigest)
+	}
+}
+
+func TestOnlineGCGracePeriod(t *testing.T) {
+	inmemoryDriver := inmemory.New()
+
+	registry := createRegistry(t, inmemoryDriver, EnableMarkLog)
+	repo := makeRepository(t, registry, "online")
+
+	digests, err := testutil.CreateRandomLayers(1)
+	if err != nil {
+		t.Fatalf("Failed to create random digest: %v", err)
+	}
+
+	if err = testutil.UploadBlobs(repo, digests); err != nil {
+		t.Fatalf("Failed to upload blob: %v", err)
+	}
+
+	uploadRandomSchema2Image(t, repo)
+
+	err = OnlineMarkAndSweep(context.Background(), inmemoryDriver, registry, OnlineGCOpts{
+		GracePeriod: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("Failed online mark and sweep: %v", err)
+	}
+
+	blobs := allBlobs(t, registry)
+
+	// the orphan was pushed within the grace period, as if a manifest
+	// referencing it was about to be pushed
+	for dgst := range digests {
+		if _, ok := blobs[dgst]; !ok {
+			t.Fatalf("Recently pushed layer was deleted: %v", dgst)
+		}
+	}
+}
+
+func TestMarkLog(t *testing.T) {
+	ctx := context.Background()
+	ml := &markLog{driver: inmemory.New()}
+
+	digests, err := testutil.CreateRandomLayers(2)
+	if err != nil {
+		t.Fatalf("Failed to create random digest: %v", err)
+	}
+	dgsts := getKeys(digests)
+
+	before := time.Now().Add(-time.Minute)
+	if err := ml.mark(ctx, dgsts[0]); err != nil {
+		t.Fatalf("Failed to mark blob: %v", err)
+	}
+
+	for _, tc := range []struct {
+		index    int
+		since    time.Time
+		expected bool
+	}{
+		{index: 0, since: before, expected: true},
+		{index: 0, since: time.Now().Add(time.Minute), expected: false},
+		{index: 1, since: before, expected: false},
+	} {
+		marked, err := ml.markedSince(ctx, dgsts[tc.index], tc.since)
+		if err != nil {
+			t.Fatalf("Failed to read mark: %v", err)
+		}
+		if marked != tc.expected {
+			t.Fatalf("unexpected mark state for %s since %s: %v", dgsts[tc.index], tc.since, marked)
+		}
+	}
+
+	if err := ml.prune(ctx, time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("Failed to prune marks: %v", err)
+	}
+
+	marked, err := ml.markedSince(ctx, dgsts[0], before)
+	if err != nil {
+		t.Fatalf("Failed to read mark: %v", err)
+	}
+	if marked {
+		t.Fatalf("mark was not pruned")
+	}
+}
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"encoding/hex"
 	"fmt"
 	"path"
 	"strings"
@@ -34,14 +35,28 @@ const (
 //							-> current/link
 // 							-> index
 //								-> <algorithm>/<hex digest>/link
+// 						referrers/<subject algorithm>/<subject hex digest>
+//							-> <algorithm>/<hex digest>/link
+// 						taghistory/<tag>
+//							-> <timestamp>-<id>
+// 						trash
+//							-> <timestamp>-<id>
 // 					-> _layers/
 // 						<layer links to blob store>
 // 					-> _uploads/<id>
 // 						data
 // 						startedat
 // 						hashstates/<algorithm>/<offset>
+// 					-> _frozen
 //			-> blob/<algorithm>
 //				<split directory content addressable storage>
+//					-> encodings/<encoding>
+//						<pre-compressed variant data and digest link>
+//					-> toc
+//					-> chunks
+//			-> gc/marks/<algorithm>/<hex digest>
+//			-> gc/checkpoint
+//			-> uploads/_secret
 //
 // The storage backend layout is broken up into a content-addressable blob
 // store and repositories. The content-addressable blob store holds most data
@@ -65,7 +80,14 @@ const (
 // implied as to the ordering of changes to a manifest. The tag store provides
 // support for name, tag lookups of manifests, using "current/link" under a
 // named tag directory. An index is maintained to support deletions of all
-// revisions of a given manifest tag.
+// revisions of a given manifest tag. The changes of each tag are appended to a
+// tag history, kept apart from the tag so that it survives its deletion. A
+// referrers index, keyed by subject
+// digest, links manifests declaring a subject to support the referrers API.
+// When soft deletion is enabled, the manifests, tags and blobs deleted from
+// the repository are recorded in its trash, from which they can be restored.
+// A repository frozen by an administrator holds a _frozen file, whose content
+// can be pulled but not pushed nor deleted.
 //
 // We cover the path formats implemented by this path mapper below.
 //
@@ -83,6 +105,23 @@ const (
 // 	manifestTagIndexPathSpec:              <root>/v2/repositories/<name>/_manifests/tags/<tag>/index/
 // 	manifestTagIndexEntryPathSpec:         <root>/v2/repositories/<name>/_manifests/tags/<tag>/index/<algorithm>/<hex digest>/
 // 	manifestTagIndexEntryLinkPathSpec:     <root>/v2/repositories/<name>/_manifests/tags/<tag>/index/<algorithm>/<hex digest>/link
+// 	manifestTagHistoryPathSpec:            <root>/v2/repositories/<name>/_manifests/taghistory/<tag>/
+// 	manifestTagHistoryEntryPathSpec:       <root>/v2/repositories/<name>/_manifests/taghistory/<tag>/<timestamp>-<id>
+//
+//	Repository:
+//
+// 	repositoryFrozenPathSpec:       <root>/v2/repositories/<name>/_frozen
+// 	repositoryAliasPathSpec:        <root>/v2/repositories/<name>/_alias
+//
+//	Trash:
+//
+// 	manifestTrashPathSpec:          <root>/v2/repositories/<name>/_manifests/trash/
+// 	manifestTrashEntryPathSpec:     <root>/v2/repositories/<name>/_manifests/trash/<timestamp>-<id>
+//
+//	Referrers:
+//
+// 	manifestReferrersPathSpec:     <root>/v2/repositories/<name>/_manifests/referrers/<subject algorithm>/<subject hex digest>/
+// 	manifestReferrerLinkPathSpec:  <root>/v2/repositories/<name>/_manifests/referrers/<subject algorithm>/<subject hex digest>/<algorithm>/<hex digest>/link
 //
 // 	Blobs:
 //
@@ -94,6 +133,9 @@ const (
 // 	uploadDataPathSpec:             <root>/v2/repositories/<name>/_uploads/<id>/data
 // 	uploadStartedAtPathSpec:        <root>/v2/repositories/<name>/_uploads/<id>/startedat
 // 	uploadHashStatePathSpec:        <root>/v2/repositories/<name>/_uploads/<id>/hashstates/<algorithm>/<offset>
+// 	uploadChunkPathSpec:            <root>/v2/repositories/<name>/_uploads/<id>/chunks/<offset>
+// 	uploadSecretPathSpec:           <root>/v2/uploads/_secret
+// 	uploadPurgeRunPathSpec:         <root>/v2/uploads/_purge/<policy>
 //
 //	Blob Store:
 //
@@ -101,6 +143,27 @@ const (
 // 	blobPathSpec:                   <root>/v2/blobs/<algorithm>/<first two hex bytes of digest>/<hex digest>
 // 	blobDataPathSpec:               <root>/v2/blobs/<algorithm>/<first two hex bytes of digest>/<hex digest>/data
 // 	blobMediaTypePathSpec:               <root>/v2/blobs/<algorithm>/<first two hex bytes of digest>/<hex digest>/data
+// 	blobEncodedDataPathSpec:        <root>/v2/blobs/<algorithm>/<first two hex bytes of digest>/<hex digest>/encodings/<encoding>/encoded
+// 	blobEncodedLinkPathSpec:        <root>/v2/blobs/<algorithm>/<first two hex bytes of digest>/<hex digest>/encodings/<encoding>/link
+// 	blobTOCPathSpec:                <root>/v2/blobs/<algorithm>/<first two hex bytes of digest>/<hex digest>/toc
+// 	blobTOCChunksPathSpec:          <root>/v2/blobs/<algorithm>/<first two hex bytes of digest>/<hex digest>/chunks
+//
+//	Garbage Collection:
+//
+//	gcMarksPathSpec:                <root>/v2/gc/marks/
+//	gcMarkPathSpec:                 <root>/v2/gc/marks/<algorithm>/<hex digest>
+//	gcCheckpointPathSpec:           <root>/v2/gc/checkpoint
+//
+//	Locks:
+//
+//	lockPathSpec:                   <root>/v2/locks/<key>/lease
+//
+//	Catalog Index:
+//
+//	catalogIndexPathSpec:           <root>/v2/catalog/
+//	catalogIndexShardPathSpec:      <root>/v2/catalog/<shard>
+//	catalogIndexEntryPathSpec:      <root>/v2/catalog/<shard of name>/<name with "/" replaced by "..">
+//	catalogIndexCompletePathSpec:   <root>/v2/catalog/_complete
 //
 // For more information on the semantic meaning of each path and their
 // contents, please see the path spec documentation.
@@ -193,6 +256,55 @@ func pathFor(spec pathSpec) (string, error) {
 		}
 
 		return path.Join(root, path.Join(components...)), nil
+	case manifestTagHistoryPathSpec:
+		return path.Join(append(repoPrefix, v.name, "_manifests", "taghistory", v.tag)...), nil
+	case manifestTagHistoryEntryPathSpec:
+		root, err := pathFor(manifestTagHistoryPathSpec{
+			name: v.name,
+			tag:  v.tag,
+		})
+		if err != nil {
+			return "", err
+		}
+
+		return path.Join(root, v.entry), nil
+	case repositoryFrozenPathSpec:
+		return path.Join(append(repoPrefix, v.name, "_frozen")...), nil
+	case repositoryAliasPathSpec:
+		return path.Join(append(repoPrefix, v.name, "_alias")...), nil
+	case manifestTrashPathSpec:
+		return path.Join(append(repoPrefix, v.name, "_manifests", "trash")...), nil
+	case manifestTrashEntryPathSpec:
+		root, err := pathFor(manifestTrashPathSpec{
+			name: v.name,
+		})
+		if err != nil {
+			return "", err
+		}
+
+		return path.Join(root, v.id), nil
+	case manifestReferrersPathSpec:
+		components, err := digestPathComponents(v.subject, false)
+		if err != nil {
+			return "", err
+		}
+
+		return path.Join(append(append(repoPrefix, v.name, "_manifests", "referrers"), components...)...), nil
+	case manifestReferrerLinkPathSpec:
+		root, err := pathFor(manifestReferrersPathSpec{
+			name:    v.name,
+			subject: v.subject,
+		})
+		if err != nil {
+			return "", err
+		}
+
+		components, err := digestPathComponents(v.revision, false)
+		if err != nil {
+			return "", err
+		}
+
+		return path.Join(root, path.Join(components...), "link"), nil
 	case layerLinkPathSpec:
 		components, err := digestPathComponents(v.digest, false)
 		if err != nil {
@@ -229,6 +341,42 @@ func pathFor(spec pathSpec) (string, error) {
 		components = append(components, "data")
 		blobPathPrefix := append(rootPrefix, "blobs")
 		return path.Join(append(blobPathPrefix, components...)...), nil
+	case blobEncodedDataPathSpec:
+		components, err := digestPathComponents(v.digest, true)
+		if err != nil {
+			return "", err
+		}
+
+		components = append(components, "encodings", v.encoding, "encoded")
+		blobPathPrefix := append(rootPrefix, "blobs")
+		return path.Join(append(blobPathPrefix, components...)...), nil
+	case blobEncodedLinkPathSpec:
+		components, err := digestPathComponents(v.digest, true)
+		if err != nil {
+			return "", err
+		}
+
+		components = append(components, "encodings", v.encoding, "link")
+		blobPathPrefix := append(rootPrefix, "blobs")
+		return path.Join(append(blobPathPrefix, components...)...), nil
+	case blobTOCPathSpec:
+		components, err := digestPathComponents(v.digest, true)
+		if err != nil {
+			return "", err
+		}
+
+		components = append(components, "toc")
+		blobPathPrefix := append(rootPrefix, "blobs")
+		return path.Join(append(blobPathPrefix, components...)...), nil
+	case blobTOCChunksPathSpec:
+		components, err := digestPathComponents(v.digest, true)
+		if err != nil {
+			return "", err
+		}
+
+		components = append(components, "chunks")
+		blobPathPrefix := append(rootPrefix, "blobs")
+		return path.Join(append(blobPathPrefix, components...)...), nil
 
 	case uploadDataPathSpec:
 		return path.Join(append(repoPrefix, v.name, "_uploads", v.id, "data")...), nil
@@ -240,8 +388,39 @@ func pathFor(spec pathSpec) (string, error) {
 			offset = "" // Limit to the prefix for listing offsets.
 		}
 		return path.Join(append(repoPrefix, v.name, "_uploads", v.id, "hashstates", string(v.alg), offset)...), nil
+	case uploadChunkPathSpec:
+		offset := fmt.Sprintf("%d", v.offset)
+		if v.list {
+			offset = "" // Limit to the prefix for listing offsets.
+		}
+		return path.Join(append(repoPrefix, v.name, "_uploads", v.id, "chunks", offset)...), nil
+	case uploadSecretPathSpec:
+		return path.Join(append(rootPrefix, "uploads", "_secret")...), nil
+	case uploadPurgeRunPathSpec:
+		return path.Join(append(rootPrefix, "uploads", "_purge", v.policy)...), nil
 	case repositoriesRootPathSpec:
 		return path.Join(repoPrefix...), nil
+	case catalogIndexPathSpec:
+		return path.Join(append(rootPrefix, "catalog")...), nil
+	case catalogIndexShardPathSpec:
+		return path.Join(append(rootPrefix, "catalog", v.shard)...), nil
+	case catalogIndexEntryPathSpec:
+		return path.Join(append(rootPrefix, "catalog", catalogIndexShard(v.name), strings.ReplaceAll(v.name, "/", catalogIndexSeparator))...), nil
+	case catalogIndexCompletePathSpec:
+		return path.Join(append(rootPrefix, "catalog", "_complete")...), nil
+	case lockPathSpec:
+		return path.Join(append(rootPrefix, "locks", v.key, "lease")...), nil
+	case gcMarksPathSpec:
+		return path.Join(append(rootPrefix, "gc", "marks")...), nil
+	case gcCheckpointPathSpec:
+		return path.Join(append(rootPrefix, "gc", "checkpoint")...), nil
+	case gcMarkPathSpec:
+		components, err := digestPathComponents(v.digest, false)
+		if err != nil {
+			return "", err
+		}
+
+		return path.Join(append(append(rootPrefix, "gc", "marks"), components...)...), nil
 	default:
 		// TODO(sday): This is an internal error. Ensure it doesn't escape (panic?).
 		return "", fmt.Errorf("unknown path spec: %#v", v)
@@ -338,6 +517,64 @@ type manifestTagIndexEntryLinkPathSpec struct {
 
 func (manifestTagIndexEntryLinkPathSpec) pathSpec() {}
 
+// manifestTagHistoryPathSpec describes the directory holding the events of a
+// tag, one file per event.
+type manifestTagHistoryPathSpec struct {
+	name string
+	tag  string
+}
+
+func (manifestTagHistoryPathSpec) pathSpec() {}
+
+// manifestTagHistoryEntryPathSpec describes a file holding an event of a tag,
+// as JSON. Entries are named after the time of the event so that they sort in
+// order.
+type manifestTagHistoryEntryPathSpec struct {
+	name  string
+	tag   string
+	entry string
+}
+
+func (manifestTagHistoryEntryPathSpec) pathSpec() {}
+
+// manifestTrashPathSpec describes the directory holding the trash of a
+// repository, one file per deleted object.
+type manifestTrashPathSpec struct {
+	name string
+}
+
+func (manifestTrashPathSpec) pathSpec() {}
+
+// manifestTrashEntryPathSpec describes a file holding the entry of a deleted
+// object in the trash of a repository, as JSON. Entries are named after the
+// time of the deletion so that they sort in order.
+type manifestTrashEntryPathSpec struct {
+	name string
+	id   string
+}
+
+func (manifestTrashEntryPathSpec) pathSpec() {}
+
+// manifestReferrersPathSpec describes the directory holding the links to all
+// manifests referring to the given subject.
+type manifestReferrersPathSpec struct {
+	name    string
+	subject digest.Digest
+}
+
+func (manifestReferrersPathSpec) pathSpec() {}
+
+// manifestReferrerLinkPathSpec describes the link to a manifest revision
+// declaring the given subject. The contents of this file should just be the
+// digest of the referring manifest.
+type manifestReferrerLinkPathSpec struct {
+	name     string
+	subject  digest.Digest
+	revision digest.Digest
+}
+
+func (manifestReferrerLinkPathSpec) pathSpec() {}
+
 // layersPathSpec contains the path for the layers inside a repo
 type layersPathSpec struct {
 	name string
@@ -393,6 +630,41 @@ type blobDataPathSpec struct {
 
 func (blobDataPathSpec) pathSpec() {}
 
+// blobEncodedDataPathSpec contains the path for the data of a pre-compressed
+// variant of a blob in the given content encoding. The file is not named
+// "data" so that it is not mistaken for a blob when enumerating.
+type blobEncodedDataPathSpec struct {
+	digest   digest.Digest
+	encoding string
+}
+
+func (blobEncodedDataPathSpec) pathSpec() {}
+
+// blobEncodedLinkPathSpec contains the path for the file holding the digest
+// of a pre-compressed variant of a blob in the given content encoding.
+type blobEncodedLinkPathSpec struct {
+	digest   digest.Digest
+	encoding string
+}
+
+func (blobEncodedLinkPathSpec) pathSpec() {}
+
+// blobTOCPathSpec contains the path for the file describing the table of
+// contents of a seekable layer, such as an eStargz or zstd:chunked one.
+type blobTOCPathSpec struct {
+	digest digest.Digest
+}
+
+func (blobTOCPathSpec) pathSpec() {}
+
+// blobTOCChunksPathSpec contains the path for the file holding the offsets
+// of the chunks of a seekable layer, read from its table of contents.
+type blobTOCChunksPathSpec struct {
+	digest digest.Digest
+}
+
+func (blobTOCChunksPathSpec) pathSpec() {}
+
 // uploadDataPathSpec defines the path parameters of the data file for
 // uploads.
 type uploadDataPathSpec struct {
@@ -430,12 +702,133 @@ type uploadHashStatePathSpec struct {
 
 func (uploadHashStatePathSpec) pathSpec() {}
 
+// uploadChunkPathSpec defines the path parameters for the file holding a
+// chunk of an upload received out of order, starting at a specific byte
+// offset. If `list` is set, then the path mapper will generate a list prefix
+// for all the chunks held for the upload identified by the name and id.
+type uploadChunkPathSpec struct {
+	name   string
+	id     string
+	offset int64
+	list   bool
+}
+
+func (uploadChunkPathSpec) pathSpec() {}
+
+// uploadSecretPathSpec describes the path of the secret signing the state of
+// the blob uploads, shared by the registry instances using the storage.
+type uploadSecretPathSpec struct{}
+
+func (uploadSecretPathSpec) pathSpec() {}
+
+// uploadPurgeRunPathSpec describes the file recording the last run of an
+// upload purging policy, shared by the registry instances using the storage.
+// The contents of this file are the time the policy last ran.
+type uploadPurgeRunPathSpec struct {
+	policy string
+}
+
+func (uploadPurgeRunPathSpec) pathSpec() {}
+
+// repositoryFrozenPathSpec describes the file marking a repository as frozen.
+// The contents of this file are the time the repository was frozen.
+type repositoryFrozenPathSpec struct {
+	name string
+}
+
+func (repositoryFrozenPathSpec) pathSpec() {}
+
+// repositoryAliasPathSpec describes the file redirecting the old name of a
+// renamed repository to its new name. The contents of this file are the new
+// name and the expiration time of the alias, encoded as JSON.
+type repositoryAliasPathSpec struct {
+	name string
+}
+
+func (repositoryAliasPathSpec) pathSpec() {}
+
 // repositoriesRootPathSpec returns the root of repositories
 type repositoriesRootPathSpec struct {
 }
 
 func (repositoriesRootPathSpec) pathSpec() {}
 
+// catalogIndexPathSpec returns the root of the catalog index.
+type catalogIndexPathSpec struct{}
+
+func (catalogIndexPathSpec) pathSpec() {}
+
+// catalogIndexSeparator replaces the path separators of repository names in
+// the entries of the catalog index, keeping each shard flat. Repository names
+// cannot contain two consecutive dots.
+const catalogIndexSeparator = ".."
+
+// catalogIndexShardLength is the number of leading characters of the
+// repository names identifying their shard of the catalog index.
+const catalogIndexShardLength = 2
+
+// catalogIndexShard returns the shard of the catalog index holding the named
+// repository: the hexadecimal encoding of the leading characters of the name,
+// with the path separator encoded first as it sorts first in the catalog. The
+// shards sort in the order of the catalog.
+func catalogIndexShard(name string) string {
+	if len(name) > catalogIndexShardLength {
+		name = name[:catalogIndexShardLength]
+	}
+	return hex.EncodeToString([]byte(strings.ReplaceAll(name, "/", "\x00")))
+}
+
+// catalogIndexShardPathSpec describes a shard of the catalog index, holding
+// the entries of the repositories whose name starts with the same characters.
+type catalogIndexShardPathSpec struct {
+	shard string
+}
+
+func (catalogIndexShardPathSpec) pathSpec() {}
+
+// catalogIndexEntryPathSpec describes the empty entry of a repository in the
+// catalog index.
+type catalogIndexEntryPathSpec struct {
+	name string
+}
+
+func (catalogIndexEntryPathSpec) pathSpec() {}
+
+// catalogIndexCompletePathSpec describes the file marking that the catalog
+// index lists every repository, written once the index is built.
+type catalogIndexCompletePathSpec struct{}
+
+func (catalogIndexCompletePathSpec) pathSpec() {}
+
+// lockPathSpec describes the lease of a lock held in the storage. The
+// contents of this file are the token of the holder of the lease and its
+// expiry.
+type lockPathSpec struct {
+	key string
+}
+
+func (lockPathSpec) pathSpec() {}
+
+// gcMarksPathSpec returns the root of the online garbage collection mark log.
+type gcMarksPathSpec struct{}
+
+func (gcMarksPathSpec) pathSpec() {}
+
+// gcMarkPathSpec describes the mark log entry of a blob. The contents of this
+// file are the time the blob was last referenced.
+type gcMarkPathSpec struct {
+	digest digest.Digest
+}
+
+func (gcMarkPathSpec) pathSpec() {}
+
+// gcCheckpointPathSpec describes the checkpoint of the mark phase of an
+// offline garbage collection. The contents of this file are the state of the
+// mark phase, encoded in JSON.
+type gcCheckpointPathSpec struct{}
+
+func (gcCheckpointPathSpec) pathSpec() {}
+
 // digestPathComponents provides a consistent path breakdown for a given
 // digest. For a generic digest, it will be as follows:
 //
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"context"
+	"math"
 	"path"
 	"strings"
 	"time"
@@ -18,6 +19,11 @@ type uploadData struct {
 	startedAt     time.Time
 }
 
+// repository returns the name of the repository of the upload.
+func (ud uploadData) repository(root string) string {
+	return strings.TrimPrefix(path.Dir(path.Dir(ud.containingDir)), root+"/")
+}
+
 func newUploadData() uploadData {
 	return uploadData{
 		containingDir: "",
@@ -31,10 +37,26 @@ func newUploadData() uploadData {
 // encountered are returned
 func PurgeUploads(ctx context.Context, driver storageDriver.StorageDriver, olderThan time.Time, actuallyDelete bool) ([]string, []error) {
 	logrus.Infof("PurgeUploads starting: olderThan=%s, actuallyDelete=%t", olderThan, actuallyDelete)
+	deleted, errors := purgeUploads(ctx, driver, func(string) (time.Time, bool) {
+		return olderThan, true
+	}, actuallyDelete)
+	logrus.Infof("Purge uploads finished.  Num deleted=%d, num errors=%d", len(deleted), len(errors))
+	return deleted, errors
+}
+
+// purgeUploads deletes the upload directories of the repositories started
+// before the time returned by olderThan, unless it returns false.
+func purgeUploads(ctx context.Context, driver storageDriver.StorageDriver, olderThan func(repository string) (time.Time, bool), actuallyDelete bool) ([]string, []error) {
+	root, err := pathFor(repositoriesRootPathSpec{})
+	if err != nil {
+		return nil, []error{err}
+	}
+
 	uploadData, errors := getOutstandingUploads(ctx, driver)
 	var deleted []string
 	for _, uploadData := range uploadData {
-		if uploadData.startedAt.Before(olderThan) {
+		olderThan, ok := olderThan(uploadData.repository(root))
+		if ok && uploadData.startedAt.Before(olderThan) {
 			var err error
 			logrus.Infof("Upload files in %s have older date (%s) than purge date (%s).  Removing upload directory.",
 				uploadData.containingDir, uploadData.startedAt, olderThan)
@@ -48,9 +70,128 @@ func PurgeUploads(ctx context.Context, driver storageDriver.StorageDriver, older
 			}
 		}
 	}
+	return deleted, errors
+}
+
+// UploadPurgePolicy sets how long the uploads of some repositories are kept,
+// and how often they are purged.
+type UploadPurgePolicy struct {
+	// Name identifies the policy in the storage, where its last run is
+	// recorded. It must be a valid path component.
+	Name string
+	// Match returns whether the policy applies to a repository. A nil Match
+	// applies to all repositories.
+	Match func(repository string) bool
+	// Age is the age of the uploads the policy purges.
+	Age time.Duration
+	// Interval is the interval between the runs of the policy.
+	Interval time.Duration
+}
+
+// UploadPurger purges the uploads of the repositories according to the
+// first policy applying to each of them. The last run of each policy is
+// recorded in the storage, so that the registry instances sharing it take
+// turns rather than all purging at the same time, and do not purge again
+// after a restart until the interval of the policy has elapsed.
+type UploadPurger struct {
+	driver   storageDriver.StorageDriver
+	policies []UploadPurgePolicy
+	dryRun   bool
+
+	// lastRuns records the runs of the policies when they are not written
+	// to the storage, in dry run mode.
+	lastRuns map[string]time.Time
+}
+
+// NewUploadPurger returns an UploadPurger applying the policies in order.
+func NewUploadPurger(driver storageDriver.StorageDriver, policies []UploadPurgePolicy, dryRun bool) *UploadPurger {
+	return &UploadPurger{
+		driver:   driver,
+		policies: policies,
+		dryRun:   dryRun,
+		lastRuns: make(map[string]time.Time),
+	}
+}
+
+// Purge runs the policies which are due, and returns the delay until the
+// next one is.
+func (up *UploadPurger) Purge(ctx context.Context) (time.Duration, error) {
+	now := time.Now()
+	due := make([]bool, len(up.policies))
+	anyDue := false
+	next := time.Duration(math.MaxInt64)
+	for i, policy := range up.policies {
+		lastRun, err := up.lastRun(ctx, policy)
+		if err != nil {
+			return 0, err
+		}
+		if wait := lastRun.Add(policy.Interval).Sub(now); wait > 0 {
+			if wait < next {
+				next = wait
+			}
+			continue
+		}
+
+		// the run is recorded before purging, so that other instances
+		// skip it
+		if err := up.recordRun(ctx, policy, now); err != nil {
+			return 0, err
+		}
+		due[i], anyDue = true, true
+		if policy.Interval < next {
+			next = policy.Interval
+		}
+	}
+	if !anyDue {
+		return next, nil
+	}
 
+	logrus.Infof("PurgeUploads starting: actuallyDelete=%t", !up.dryRun)
+	deleted, errors := purgeUploads(ctx, up.driver, func(repository string) (time.Time, bool) {
+		for i, policy := range up.policies {
+			if policy.Match == nil || policy.Match(repository) {
+				return now.Add(-policy.Age), due[i]
+			}
+		}
+		return time.Time{}, false
+	}, !up.dryRun)
 	logrus.Infof("Purge uploads finished.  Num deleted=%d, num errors=%d", len(deleted), len(errors))
-	return deleted, errors
+	return next, nil
+}
+
+// lastRun returns the time the policy last ran, by any registry instance.
+func (up *UploadPurger) lastRun(ctx context.Context, policy UploadPurgePolicy) (time.Time, error) {
+	lastRun := up.lastRuns[policy.Name]
+
+	runPath, err := pathFor(uploadPurgeRunPathSpec{policy: policy.Name})
+	if err != nil {
+		return time.Time{}, err
+	}
+	content, err := up.driver.GetContent(ctx, runPath)
+	if err != nil {
+		if _, ok := err.(storageDriver.PathNotFoundError); ok {
+			return lastRun, nil
+		}
+		return time.Time{}, err
+	}
+	if t, err := time.Parse(time.RFC3339Nano, string(content)); err == nil && t.After(lastRun) {
+		lastRun = t
+	}
+	return lastRun, nil
+}
+
+// recordRun records that the policy ran at the given time.
+func (up *UploadPurger) recordRun(ctx context.Context, policy UploadPurgePolicy, t time.Time) error {
+	up.lastRuns[policy.Name] = t
+	if up.dryRun {
+		return nil
+	}
+
+	runPath, err := pathFor(uploadPurgeRunPathSpec{policy: policy.Name})
+	if err != nil {
+		return err
+	}
+	return up.driver.PutContent(ctx, runPath, []byte(t.UTC().Format(time.RFC3339Nano)))
 }
 
 // getOutstandingUploads walks the upload directory, collecting files
@@ -93,7 +234,7 @@ func getOutstandingUploads(ctx context.Context, driver storageDriver.StorageDriv
 			ud.containingDir = filePath
 		}
 		if file == "startedat" {
-			if t, err := readStartedAtFile(driver, filePath); err == nil {
+			if t, err := readStartedAtFile(ctx, driver, filePath); err == nil {
 				ud.startedAt = t
 			} else {
 				errors = pushError(errors, filePath, err)
@@ -125,9 +266,8 @@ func uuidFromPath(path string) (string, bool) {
 }
 
 // readStartedAtFile reads the date from an upload's startedAtFile
-func readStartedAtFile(driver storageDriver.StorageDriver, path string) (time.Time, error) {
-	// todo:(richardscothern) - pass in a context
-	startedAtBytes, err := driver.GetContent(context.Background(), path)
+func readStartedAtFile(ctx context.Context, driver storageDriver.StorageDriver, path string) (time.Time, error) {
+	startedAtBytes, err := driver.GetContent(ctx, path)
 	if err != nil {
 		return time.Now(), err
 	}
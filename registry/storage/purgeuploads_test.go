@@ -164,3 +164,78 @@ func TestPurgeMissingStartedAt(t *testing.T) {
 		t.Errorf("Files unexpectedly deleted: %s", deleted)
 	}
 }
+
+func countUploads(ctx context.Context, t *testing.T, d driver.StorageDriver) map[string]int {
+	root, err := pathFor(repositoriesRootPathSpec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploads, errs := getOutstandingUploads(ctx, d)
+	if len(errs) != 0 {
+		t.Fatalf("Unexpected errors: %q", errs)
+	}
+	counts := make(map[string]int)
+	for _, upload := range uploads {
+		counts[upload.repository(root)]++
+	}
+	return counts
+}
+
+func TestUploadPurgerPolicies(t *testing.T) {
+	twoHoursAgo := time.Now().Add(-2 * time.Hour)
+	fs, ctx := testUploadFS(t, 2, "ci/build", twoHoursAgo)
+	addUploads(ctx, t, fs, uuid.Generate().String(), "library/app", twoHoursAgo)
+
+	policies := []UploadPurgePolicy{
+		{
+			Name:     "ci",
+			Match:    func(repository string) bool { return strings.HasPrefix(repository, "ci/") },
+			Age:      time.Hour,
+			Interval: time.Hour,
+		},
+		{
+			Name:     "default",
+			Age:      24 * time.Hour,
+			Interval: 24 * time.Hour,
+		},
+	}
+	next, err := NewUploadPurger(fs, policies, false).Purge(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if next != time.Hour {
+		t.Errorf("Unexpected delay until the next purge: %s", next)
+	}
+	if counts := countUploads(ctx, t, fs); counts["ci/build"] != 0 || counts["library/app"] != 1 {
+		t.Errorf("Unexpected remaining uploads: %v", counts)
+	}
+
+	// another instance sharing the storage waits for the interval of the
+	// policies to elapse
+	addUploads(ctx, t, fs, uuid.Generate().String(), "ci/build", twoHoursAgo)
+	next, err = NewUploadPurger(fs, policies, false).Purge(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if next <= 0 || next > time.Hour {
+		t.Errorf("Unexpected delay until the next purge: %s", next)
+	}
+	if counts := countUploads(ctx, t, fs); counts["ci/build"] != 1 {
+		t.Errorf("Unexpected remaining uploads: %v", counts)
+	}
+
+	// the policy runs once its interval elapsed
+	runPath, err := pathFor(uploadPurgeRunPathSpec{policy: "ci"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.PutContent(ctx, runPath, []byte(twoHoursAgo.UTC().Format(time.RFC3339Nano))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewUploadPurger(fs, policies, false).Purge(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if counts := countUploads(ctx, t, fs); counts["ci/build"] != 0 || counts["library/app"] != 1 {
+		t.Errorf("Unexpected remaining uploads: %v", counts)
+	}
+}
@@ -0,0 +1,196 @@
+package storage
+
+import (
+	"context"
+	"path"
+	"sort"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+)
+
+var _ distribution.ManifestReferrers = &manifestStore{}
+
+// manifestSubject returns the subject declared by the manifest, if any.
+func manifestSubject(manifest distribution.Manifest) *distribution.Descriptor {
+	switch m := manifest.(type) {
+	case *ocischema.DeserializedManifest:
+		return m.Subject
+	case *manifestlist.DeserializedManifestList:
+		return m.Subject
+	}
+	return nil
+}
+
+// ManifestArtifactType returns the artifact type of the manifest, falling
+// back to the config media type for image manifests.
+func ManifestArtifactType(manifest distribution.Manifest) string {
+	switch m := manifest.(type) {
+	case *ocischema.DeserializedManifest:
+		if m.ArtifactType != "" {
+			return m.ArtifactType
+		}
+		return m.Config.MediaType
+	case *manifestlist.DeserializedManifestList:
+		return m.ArtifactType
+	}
+	return ""
+}
+
+// manifestAnnotations returns the annotations of the manifest, if any.
+func manifestAnnotations(manifest distribution.Manifest) map[string]string {
+	switch m := manifest.(type) {
+	case *ocischema.DeserializedManifest:
+		return m.Annotations
+	case *manifestlist.DeserializedManifestList:
+		return m.Annotations
+	}
+	return nil
+}
+
+// linkReferrer records the manifest identified by dgst in the referrers
+// index of its subject. The subject is not required to exist.
+func (ms *manifestStore) linkReferrer(ctx context.Context, subject digest.Digest, dgst digest.Digest) error {
+	referrerLinkPath, err := pathFor(manifestReferrerLinkPathSpec{
+		name:     ms.repository.Named().Name(),
+		subject:  subject,
+		revision: dgst,
+	})
+	if err != nil {
+		return err
+	}
+
+	return ms.blobStore.link(ctx, referrerLinkPath, dgst)
+}
+
+// unlinkReferrer removes the manifest identified by dgst from the referrers
+// index of its subject.
+func (ms *manifestStore) unlinkReferrer(ctx context.Context, subject digest.Digest, dgst digest.Digest) error {
+	referrerLinkPath, err := pathFor(manifestReferrerLinkPathSpec{
+		name:     ms.repository.Named().Name(),
+		subject:  subject,
+		revision: dgst,
+	})
+	if err != nil {
+		return err
+	}
+
+	// remove the revision directory holding the link
+	if err := ms.blobStore.driver.Delete(ctx, path.Dir(referrerLinkPath)); err != nil {
+		switch err.(type) {
+		case storagedriver.PathNotFoundError:
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// Referrers returns the descriptors of the manifests declaring subject as
+// their subject, sorted by digest. Links to manifests which are no longer
+// available in the repository are ignored. ErrRepositoryUnknown is returned
+// if the repository has no manifests.
+func (ms *manifestStore) Referrers(ctx context.Context, subject digest.Digest, artifactType string) ([]distribution.Descriptor, error) {
+	dcontext.GetLogger(ms.ctx).Debug("(*manifestStore).Referrers")
+
+	revisionsPath, err := pathFor(manifestRevisionsPathSpec{
+		name: ms.repository.Named().Name(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := ms.blobStore.driver.Stat(ctx, revisionsPath); err != nil {
+		switch err.(type) {
+		case storagedriver.PathNotFoundError:
+			return nil, distribution.ErrRepositoryUnknown{Name: ms.repository.Named().Name()}
+		}
+		return nil, err
+	}
+
+	referrersPath, err := pathFor(manifestReferrersPathSpec{
+		name:    ms.repository.Named().Name(),
+		subject: subject,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	algorithms, err := ms.blobStore.driver.List(ctx, referrersPath)
+	if err != nil {
+		switch err.(type) {
+		case storagedriver.PathNotFoundError:
+			return []distribution.Descriptor{}, nil
+		}
+		return nil, err
+	}
+
+	referrers := []distribution.Descriptor{}
+	for _, algorithm := range algorithms {
+		revisions, err := ms.blobStore.driver.List(ctx, algorithm)
+		if err != nil {
+			switch err.(type) {
+			case storagedriver.PathNotFoundError:
+				continue
+			}
+			return nil, err
+		}
+
+		for _, revision := range revisions {
+			dgst, err := ms.blobStore.readlink(ctx, path.Join(revision, "link"))
+			if err != nil {
+				switch err.(type) {
+				case storagedriver.PathNotFoundError:
+					continue
+				}
+				return nil, err
+			}
+
+			desc, err := ms.referrerDescriptor(ctx, dgst)
+			if err != nil {
+				switch err.(type) {
+				case distribution.ErrManifestUnknownRevision:
+					// dangling link left behind by a deleted manifest
+					continue
+				}
+				return nil, err
+			}
+
+			if artifactType != "" && desc.ArtifactType != artifactType {
+				continue
+			}
+			referrers = append(referrers, desc)
+		}
+	}
+
+	sort.Slice(referrers, func(i, j int) bool {
+		return referrers[i].Digest < referrers[j].Digest
+	})
+
+	return referrers, nil
+}
+
+// referrerDescriptor builds the descriptor of a referring manifest as
+// expected in a referrers response.
+func (ms *manifestStore) referrerDescriptor(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
+	manifest, err := ms.Get(ctx, dgst)
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+
+	mediaType, payload, err := manifest.Payload()
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+
+	return distribution.Descriptor{
+		MediaType:    mediaType,
+		Size:         int64(len(payload)),
+		Digest:       dgst,
+		ArtifactType: ManifestArtifactType(manifest),
+		Annotations:  manifestAnnotations(manifest),
+	}, nil
+}
@@ -2,12 +2,20 @@ package storage
 
 import (
 	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
 	"regexp"
+	"strings"
+	"time"
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/reference"
 	"github.com/distribution/distribution/v3/registry/storage/cache"
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/lock"
+	"github.com/distribution/distribution/v3/registry/validation"
 	"github.com/docker/libtrust"
 )
 
@@ -24,6 +32,16 @@ type registry struct {
 	schema1SigningKey            libtrust.PrivateKey
 	blobDescriptorServiceFactory distribution.BlobDescriptorServiceFactory
 	manifestURLs                 manifestURLs
+	manifestValidators           []validation.ManifestValidator
+	blobEncoder                  *blobEncoder
+	tocIndexer                   *blobTOCIndexer
+	markLog                      *markLog
+	catalogIndex                 *catalogIndex
+	trash                        *trash
+	locker                       lock.Locker
+	uploadLocks                  keyedMutex // locks of the uploads without a locker
+	tagLocks                     keyedMutex // locks of the tags within this instance
+	sharedRoots                  []string   // root directories sharing their blob data
 	driver                       storagedriver.StorageDriver
 }
 
@@ -43,6 +61,106 @@ func EnableRedirect(registry *registry) error {
 	return nil
 }
 
+// RedirectExpiry is a functional option for NewRegistry. It sets how long
+// the URLs blobs are redirected to remain valid, overriding the default of
+// the storage driver.
+func RedirectExpiry(expiry time.Duration) RegistryOption {
+	return func(registry *registry) error {
+		if expiry < 0 {
+			return fmt.Errorf("invalid redirect expiry: %v", expiry)
+		}
+		registry.blobServer.redirectExpiry = expiry
+		return nil
+	}
+}
+
+// ReadBufferSize is a functional option for NewRegistry. It sets the size of
+// the buffer of the blobs served directly rather than through a redirect,
+// which is also how far ahead close ranges of a blob are read.
+func ReadBufferSize(size int) RegistryOption {
+	return func(registry *registry) error {
+		if size <= 0 {
+			return fmt.Errorf("invalid read buffer size: %d", size)
+		}
+		registry.blobServer.readBufferSize = size
+		return nil
+	}
+}
+
+// BlobSendfile is a functional option for NewRegistry. It causes the blobs
+// served directly rather than through a redirect to be delegated to the web
+// server fronting the registry, with the given header, either
+// X-Accel-Redirect or X-Sendfile, set to their path in the storage appended to
+// prefix.
+func BlobSendfile(header, prefix string) RegistryOption {
+	return func(registry *registry) error {
+		header = http.CanonicalHeaderKey(header)
+		if header != XAccelRedirect && header != XSendfile {
+			return fmt.Errorf("invalid sendfile header %q: %s or %s expected", header, XAccelRedirect, XSendfile)
+		}
+		registry.blobServer.sendfileHeader = header
+		registry.blobServer.sendfilePrefix = strings.TrimSuffix(prefix, "/")
+		return nil
+	}
+}
+
+// RedirectBaseURL is a functional option for NewRegistry. It replaces the
+// scheme and host of the URLs blobs are redirected to, so that blobs are
+// served through a CDN fronting the storage backend.
+func RedirectBaseURL(baseURL *url.URL) RegistryOption {
+	return func(registry *registry) error {
+		if baseURL.Scheme == "" || baseURL.Host == "" {
+			return fmt.Errorf("invalid redirect base URL %q: a scheme and a host are required", baseURL)
+		}
+		registry.blobServer.redirectBaseURL = baseURL
+		return nil
+	}
+}
+
+// EnableBlobEncodings is a functional option for NewRegistry. It causes
+// pre-compressed variants of pushed blobs to be generated in the background
+// in each of the given content encodings, listed in order of preference, and
+// served to clients sending a matching Accept-Encoding header. Blobs
+// compressed already are served as is.
+func EnableBlobEncodings(encodings ...string) RegistryOption {
+	return func(registry *registry) error {
+		for _, encoding := range encodings {
+			if err := validateBlobEncoding(encoding); err != nil {
+				return err
+			}
+		}
+		if len(encodings) == 0 {
+			return nil
+		}
+
+		registry.blobEncoder = newBlobEncoder(registry.driver, encodings)
+		registry.blobServer.encoder = registry.blobEncoder
+		return nil
+	}
+}
+
+// EnableBlobTOC is a functional option for NewRegistry. It records the
+// position of the table of contents of the eStargz and zstd:chunked layers
+// referenced by the manifests pushed, and serves it in the headers of the
+// blob responses, so lazy-pulling clients fetch it without reading the
+// footer of the layer first.
+func EnableBlobTOC(registry *registry) error {
+	registry.tocIndexer = &blobTOCIndexer{driver: registry.driver}
+	registry.blobServer.tocIndexer = registry.tocIndexer
+	return nil
+}
+
+// BlobCacheControl is a functional option for NewRegistry. It sets the
+// Cache-Control header of blob responses, optionally overridden for blobs
+// of the media types in the mediaTypes map.
+func BlobCacheControl(cacheControl CacheControl, mediaTypes map[string]CacheControl) RegistryOption {
+	return func(registry *registry) error {
+		registry.blobServer.cacheControl = cacheControl
+		registry.blobServer.mediaTypeCacheControl = mediaTypes
+		return nil
+	}
+}
+
 // EnableDelete is a functional option for NewRegistry. It enables deletion on
 // the registry.
 func EnableDelete(registry *registry) error {
@@ -50,6 +168,68 @@ func EnableDelete(registry *registry) error {
 	return nil
 }
 
+// EnableSoftDelete is a functional option for NewRegistry. It records the
+// manifests, tags and blobs deleted from repositories in their trash, from
+// which they can be restored until they are older than retention. Garbage
+// collections keep the content of the trash until it expires.
+func EnableSoftDelete(retention time.Duration) RegistryOption {
+	return func(registry *registry) error {
+		if retention <= 0 {
+			return fmt.Errorf("invalid soft delete retention: %v", retention)
+		}
+		registry.trash = &trash{
+			driver:    registry.driver,
+			retention: retention,
+		}
+		return nil
+	}
+}
+
+// EnableMarkLog is a functional option for NewRegistry. It records when
+// blobs are referenced, which is required to run OnlineMarkAndSweep while
+// the registry accepts pushes.
+func EnableMarkLog(registry *registry) error {
+	registry.markLog = &markLog{
+		driver: registry.driver,
+	}
+	return nil
+}
+
+// ShareBlobData is a functional option for NewRegistry. It lets the blobs
+// committed under a root directory, as set by WithRootDirectory, share the
+// data of the same blobs stored under the other root directories rather than
+// storing it again, such as the root directories of tenants pushing the same
+// base layers. The data is only shared by the storage drivers able to link
+// objects, such as the filesystem driver with hardlinks: with the others,
+// the data of each root directory is stored independently.
+func ShareBlobData(roots ...string) RegistryOption {
+	return func(registry *registry) error {
+		for _, root := range roots {
+			registry.sharedRoots = append(registry.sharedRoots, path.Clean("/"+root))
+		}
+		return nil
+	}
+}
+
+// Locks is a functional option for NewRegistry. It serializes the updates of
+// the tags of a repository, the deletion of its manifests and its marking by
+// the garbage collector with the locks of locker, shared by the registry
+// instances writing to the same storage.
+func Locks(locker lock.Locker) RegistryOption {
+	return func(registry *registry) error {
+		registry.locker = locker
+		return nil
+	}
+}
+
+// EnableCatalogIndex is a functional option for NewRegistry. It maintains
+// an index of the repositories, from which ListRepositories lists them
+// without walking the storage.
+func EnableCatalogIndex(registry *registry) error {
+	registry.catalogIndex = newCatalogIndex(registry.driver)
+	return nil
+}
+
 // EnableSchema1 is a functional option for NewRegistry. It enables pushing of
 // schema1 manifests.
 func EnableSchema1(registry *registry) error {
@@ -80,6 +260,15 @@ func ManifestURLsDenyRegexp(r *regexp.Regexp) RegistryOption {
 	}
 }
 
+// ManifestValidators returns a functional option for NewRegistry. The
+// validators are called in order on each manifest before it is stored.
+func ManifestValidators(validators ...validation.ManifestValidator) RegistryOption {
+	return func(registry *registry) error {
+		registry.manifestValidators = append(registry.manifestValidators, validators...)
+		return nil
+	}
+}
+
 // Schema1SigningKey returns a functional option for NewRegistry. It sets the
 // key for signing  all schema1 manifests.
 func Schema1SigningKey(key libtrust.PrivateKey) RegistryOption {
@@ -139,6 +328,9 @@ func NewRegistry(ctx context.Context, driver storagedriver.StorageDriver, option
 			driver:  driver,
 			statter: statter,
 			pathFn:  bs.path,
+			cacheControl: CacheControl{
+				MaxAge: blobCacheControlMaxAge,
+			},
 		},
 		statter:                statter,
 		resumableDigestEnabled: true,
@@ -229,6 +421,7 @@ func (repo *repository) Manifests(ctx context.Context, options ...distribution.M
 
 	blobStore := &linkedBlobStore{
 		ctx:                  ctx,
+		registry:             repo.registry,
 		blobStore:            repo.blobStore,
 		repository:           repo,
 		deleteEnabled:        repo.registry.deleteEnabled,
@@ -326,5 +519,24 @@ func (repo *repository) Blobs(ctx context.Context) distribution.BlobStore {
 		linkDirectoryPathSpec:  layersPathSpec{name: repo.name.Name()},
 		deleteEnabled:          repo.registry.deleteEnabled,
 		resumableDigestEnabled: repo.resumableDigestEnabled,
+		trash:                  repo.registry.trash,
+	}
+}
+
+// lockRepository acquires the lock of a repository, if the registry has a
+// locker, and returns the function releasing it.
+func (reg *registry) lockRepository(ctx context.Context, name string) (func(), error) {
+	if reg.locker == nil {
+		return func() {}, nil
+	}
+	return reg.locker.Lock(ctx, "repositories/"+name)
+}
+
+// lockRepository acquires the lock of a repository of a registry of this
+// package. Other namespaces are not locked.
+func lockRepository(ctx context.Context, ns distribution.Namespace, name string) (func(), error) {
+	if reg, ok := ns.(*registry); ok {
+		return reg.lockRepository(ctx, name)
 	}
+	return func() {}, nil
 }
@@ -0,0 +1,236 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+)
+
+var _ distribution.RepositoryRenamer = &registry{}
+
+// repositoryAlias is the content of the alias file of a renamed repository.
+type repositoryAlias struct {
+	Target    string    `json:"target"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// renamedPaths are the paths of a repository moved when it is renamed. The
+// uploads in progress are left behind, to be purged.
+var renamedPaths = []string{"_manifests", "_layers", "_frozen"}
+
+// Rename moves the manifests, tags, layer links and frozen state of the
+// repository from to the repository to, file by file as storage drivers only
+// move files. The blobs themselves are not moved. Both repositories are
+// locked during the move, which is not atomic: a failed rename may be
+// resumed by renaming the repository again once the cause is fixed.
+// Repositories nested under the name of from are left untouched.
+func (reg *registry) Rename(ctx context.Context, from, to reference.Named, aliasTTL time.Duration) error {
+	if from.Name() == to.Name() {
+		return distribution.ErrRepositoryExists{Name: to.Name()}
+	}
+
+	// the repositories are locked in the order of their names, so that
+	// concurrent renames can't deadlock
+	names := []string{from.Name(), to.Name()}
+	sort.Strings(names)
+	for _, name := range names {
+		unlock, err := reg.lockRepository(ctx, name)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	root, err := pathFor(repositoriesRootPathSpec{})
+	if err != nil {
+		return err
+	}
+	fromDir, toDir := path.Join(root, from.Name()), path.Join(root, to.Name())
+
+	exists := func(dir string) (bool, error) {
+		for _, p := range []string{"_manifests", "_layers"} {
+			if _, err := reg.driver.Stat(ctx, path.Join(dir, p)); err == nil {
+				return true, nil
+			} else if _, ok := err.(driver.PathNotFoundError); !ok {
+				return false, err
+			}
+		}
+		return false, nil
+	}
+	if found, err := exists(toDir); err != nil {
+		return err
+	} else if found {
+		return distribution.ErrRepositoryExists{Name: to.Name()}
+	}
+	if found, err := exists(fromDir); err != nil {
+		return err
+	} else if !found {
+		return distribution.ErrRepositoryUnknown{Name: from.Name()}
+	}
+
+	// an online garbage collection running would find the content of the
+	// repository under neither name
+	if reg.markLog != nil {
+		if err := reg.markRepository(ctx, from); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range []reference.Named{from, to} {
+		if err := reg.clearRepositoryDescriptorCache(ctx, name); err != nil {
+			return err
+		}
+	}
+
+	for _, p := range renamedPaths {
+		if err := moveTree(ctx, reg.driver, path.Join(fromDir, p), path.Join(toDir, p)); err != nil {
+			return err
+		}
+	}
+
+	// the alias left by a previous rename of the new name is dropped
+	toAliasPath, err := pathFor(repositoryAliasPathSpec{name: to.Name()})
+	if err != nil {
+		return err
+	}
+	if err := reg.driver.Delete(ctx, toAliasPath); err != nil {
+		if _, ok := err.(driver.PathNotFoundError); !ok {
+			return err
+		}
+	}
+
+	if reg.catalogIndex != nil {
+		if err := reg.catalogIndex.rename(ctx, from.Name(), to.Name()); err != nil {
+			return err
+		}
+	}
+
+	if aliasTTL > 0 {
+		content, err := json.Marshal(repositoryAlias{
+			Target:    to.Name(),
+			ExpiresAt: time.Now().Add(aliasTTL).UTC(),
+		})
+		if err != nil {
+			return err
+		}
+		aliasPath, err := pathFor(repositoryAliasPathSpec{name: from.Name()})
+		if err != nil {
+			return err
+		}
+		return reg.driver.PutContent(ctx, aliasPath, content)
+	}
+
+	// Drivers backed by a filesystem keep the emptied directory around.
+	children, err := reg.driver.List(ctx, fromDir)
+	if err == nil && len(children) == 0 {
+		if err := reg.driver.Delete(ctx, fromDir); err != nil {
+			if _, ok := err.(driver.PathNotFoundError); !ok {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Alias returns the repository name was renamed to, while the alias left by
+// the rename has not expired.
+func (reg *registry) Alias(ctx context.Context, name reference.Named) (reference.Named, error) {
+	aliasPath, err := pathFor(repositoryAliasPathSpec{name: name.Name()})
+	if err != nil {
+		return nil, err
+	}
+	content, err := reg.driver.GetContent(ctx, aliasPath)
+	if err != nil {
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var alias repositoryAlias
+	if err := json.Unmarshal(content, &alias); err != nil {
+		return nil, err
+	}
+	if !time.Now().Before(alias.ExpiresAt) {
+		return nil, nil
+	}
+	return reference.WithName(alias.Target)
+}
+
+// markRepository records the layers and manifests of the repository in the
+// mark log.
+func (reg *registry) markRepository(ctx context.Context, name reference.Named) error {
+	repo, err := reg.Repository(ctx, name)
+	if err != nil {
+		return err
+	}
+	mark := func(dgst digest.Digest) error {
+		return reg.markLog.mark(ctx, dgst)
+	}
+
+	if enumerator, ok := repo.Blobs(ctx).(distribution.BlobEnumerator); ok {
+		if err := enumerator.Enumerate(ctx, mark); err != nil {
+			if _, ok := err.(driver.PathNotFoundError); !ok {
+				return err
+			}
+		}
+	}
+	manifests, err := repo.Manifests(ctx)
+	if err != nil {
+		return err
+	}
+	if enumerator, ok := manifests.(distribution.ManifestEnumerator); ok {
+		if err := enumerator.Enumerate(ctx, mark); err != nil {
+			if _, ok := err.(driver.PathNotFoundError); !ok {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// moveTree moves the file at src, or the files under it, to dst.
+func moveTree(ctx context.Context, d driver.StorageDriver, src, dst string) error {
+	fi, err := d.Stat(ctx, src)
+	if err != nil {
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			return nil
+		}
+		return err
+	}
+	if !fi.IsDir() {
+		return d.Move(ctx, src, dst)
+	}
+
+	// the files are listed before being moved, as walks don't support
+	// the removal of the files walked
+	var files []string
+	if err := d.Walk(ctx, src, func(fi driver.FileInfo) error {
+		if !fi.IsDir() {
+			files = append(files, fi.Path())
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := d.Move(ctx, file, path.Join(dst, strings.TrimPrefix(file, src))); err != nil {
+			return err
+		}
+	}
+
+	if err := d.Delete(ctx, src); err != nil {
+		if _, ok := err.(driver.PathNotFoundError); !ok {
+			return err
+		}
+	}
+	return nil
+}
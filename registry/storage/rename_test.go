@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+)
+
+func TestRenameRepository(t *testing.T) {
+	ctx := context.Background()
+	registry := createRegistry(t, inmemory.New())
+	renamer := registry.(distribution.RepositoryRenamer)
+
+	repo := makeRepository(t, registry, "foo/old")
+	image := uploadRandomSchema2Image(t, repo)
+	if err := repo.Tags(ctx).Tag(ctx, "latest", distribution.Descriptor{Digest: image.manifestDigest}); err != nil {
+		t.Fatal(err)
+	}
+	uploadRandomSchema2Image(t, makeRepository(t, registry, "foo/taken"))
+
+	named := func(name string) reference.Named {
+		n, err := reference.WithName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	if _, ok := renamer.Rename(ctx, named("foo/old"), named("foo/taken"), 0).(distribution.ErrRepositoryExists); !ok {
+		t.Fatal("expected ErrRepositoryExists renaming to an existing repository")
+	}
+	if _, ok := renamer.Rename(ctx, named("foo/unknown"), named("foo/other"), 0).(distribution.ErrRepositoryUnknown); !ok {
+		t.Fatal("expected ErrRepositoryUnknown renaming an unknown repository")
+	}
+
+	if err := renamer.Rename(ctx, named("foo/old"), named("foo/new"), time.Hour); err != nil {
+		t.Fatalf("unexpected error renaming repository: %v", err)
+	}
+
+	renamed := makeRepository(t, registry, "foo/new")
+	if d, err := renamed.Tags(ctx).Get(ctx, "latest"); err != nil || d.Digest != image.manifestDigest {
+		t.Fatalf("tag was not renamed: %v, %v", d, err)
+	}
+	if _, err := makeManifestService(t, renamed).Get(ctx, image.manifestDigest); err != nil {
+		t.Fatalf("manifest was not renamed: %v", err)
+	}
+	for dgst := range image.layers {
+		if _, err := renamed.Blobs(ctx).Stat(ctx, dgst); err != nil {
+			t.Fatalf("layer %s was not renamed: %v", dgst, err)
+		}
+	}
+	if exists, _ := makeManifestService(t, repo).Exists(ctx, image.manifestDigest); exists {
+		t.Fatal("manifest exists under the old name")
+	}
+	if _, err := repo.Tags(ctx).Get(ctx, "latest"); err == nil {
+		t.Fatal("tag exists under the old name")
+	}
+
+	target, err := renamer.Alias(ctx, named("foo/old"))
+	if err != nil || target == nil || target.Name() != "foo/new" {
+		t.Fatalf("unexpected alias of the old name: %v, %v", target, err)
+	}
+
+	// renaming back drops the alias left by the first rename
+	if err := renamer.Rename(ctx, named("foo/new"), named("foo/old"), 0); err != nil {
+		t.Fatalf("unexpected error renaming repository back: %v", err)
+	}
+	for _, name := range []string{"foo/old", "foo/new"} {
+		if target, err := renamer.Alias(ctx, named(name)); err != nil || target != nil {
+			t.Fatalf("unexpected alias of %s: %v, %v", name, target, err)
+		}
+	}
+	if d, err := repo.Tags(ctx).Get(ctx, "latest"); err != nil || d.Digest != image.manifestDigest {
+		t.Fatalf("tag was not renamed back: %v, %v", d, err)
+	}
+}
@@ -0,0 +1,409 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+)
+
+// RetentionPolicy sets which tags and untagged manifests of some repositories
+// are removed. The content they reference is left to the garbage collection.
+type RetentionPolicy struct {
+	// Match reports whether the policy applies to a repository. A nil Match
+	// applies to all of them.
+	Match func(repository string) bool
+	// MatchTag reports whether KeepLast and MaxAge apply to a tag. A nil
+	// MatchTag applies to all of them. The other tags are always kept.
+	MatchTag func(tag string) bool
+	// KeepLast is the number of most recently tagged matching tags which are
+	// kept whatever their age.
+	KeepLast int
+	// MaxAge is the age past which the matching tags, beyond the KeepLast
+	// most recent ones, are removed. If zero, all the tags beyond the
+	// KeepLast most recent ones are, unless KeepLast is zero as well.
+	MaxAge time.Duration
+	// UntaggedMaxAge is the age past which the untagged manifests are
+	// removed, unless a tagged manifest references them or they are
+	// referrers of a kept manifest. If zero, untagged manifests are kept.
+	UntaggedMaxAge time.Duration
+	// IndependentArtifactTypes lists the artifact types of the manifests
+	// which are retained on their own even though they have a subject.
+	// The other manifests attached to a subject present in the repository,
+	// such as signatures, SBOMs or attestations, follow their subject:
+	// their tags are neither counted nor aged, and they are removed along
+	// with their subject.
+	IndependentArtifactTypes []string
+}
+
+// removesTags reports whether the policy removes tags.
+func (p RetentionPolicy) removesTags() bool {
+	return p.KeepLast > 0 || p.MaxAge > 0
+}
+
+// independent reports whether the manifests of an artifact type are retained
+// on their own rather than along with their subject.
+func (p RetentionPolicy) independent(artifactType string) bool {
+	for _, t := range p.IndependentArtifactTypes {
+		if t == artifactType {
+			return true
+		}
+	}
+	return false
+}
+
+// attachedTo returns the subject a manifest follows the retention of, if
+// any.
+func (p RetentionPolicy) attachedTo(manifest distribution.Manifest) *distribution.Descriptor {
+	subject := manifestSubject(manifest)
+	if subject == nil || p.independent(ManifestArtifactType(manifest)) {
+		return nil
+	}
+	return subject
+}
+
+// RetentionListener is notified of the tags and manifests removed by the
+// retention policies.
+type RetentionListener interface {
+	TagDeleted(repo reference.Named, tag string) error
+	ManifestDeleted(repo reference.Named, dgst digest.Digest) error
+}
+
+// RetentionOpts contains options for the retention policies.
+type RetentionOpts struct {
+	// DryRun only logs the tags and manifests which would be removed.
+	DryRun bool
+	// Listener, if set, is notified of the removals.
+	Listener RetentionListener
+}
+
+// retainedTag is a tag of a repository and the time it was last tagged.
+type retainedTag struct {
+	name     string
+	digest   digest.Digest
+	taggedAt time.Time
+}
+
+// ApplyRetention applies to every repository of the registry the first
+// policy matching it. Tags are untagged and manifests deleted, so the
+// manifests and blobs which are no longer referenced are removed by the next
+// garbage collection, and deleting manifests requires deletion to be enabled.
+//
+// The age of a tag is the time it was last tagged, and the age of a manifest
+// the time it was pushed. Frozen repositories are left untouched.
+func ApplyRetention(ctx context.Context, storageDriver driver.StorageDriver, registry distribution.Namespace, policies []RetentionPolicy, opts RetentionOpts) error {
+	repositoryEnumerator, ok := registry.(distribution.RepositoryEnumerator)
+	if !ok {
+		return fmt.Errorf("unable to convert Namespace to RepositoryEnumerator")
+	}
+
+	// the repositories are enumerated before any removal, which may
+	// otherwise interfere with the enumeration
+	var names []string
+	err := repositoryEnumerator.Enumerate(ctx, func(repoName string) error {
+		names = append(names, repoName)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to enumerate repositories: %v", err)
+	}
+
+	for _, repoName := range names {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		for _, policy := range policies {
+			if policy.Match != nil && !policy.Match(repoName) {
+				continue
+			}
+			if err := applyRetentionPolicy(ctx, storageDriver, registry, repoName, policy, opts); err != nil {
+				return fmt.Errorf("failed to apply retention policy to %s: %v", repoName, err)
+			}
+			break
+		}
+	}
+	return nil
+}
+
+func applyRetentionPolicy(ctx context.Context, storageDriver driver.StorageDriver, registry distribution.Namespace, repoName string, policy RetentionPolicy, opts RetentionOpts) error {
+	named, err := reference.WithName(repoName)
+	if err != nil {
+		return fmt.Errorf("failed to parse repo name %s: %v", repoName, err)
+	}
+	repository, err := registry.Repository(ctx, named)
+	if err != nil {
+		return fmt.Errorf("failed to construct repository: %v", err)
+	}
+	log := dcontext.GetLogger(ctx)
+	now := time.Now()
+
+	// nothing is removed from the frozen repositories
+	if freezer, ok := repository.(distribution.RepositoryFreezer); ok {
+		frozen, err := freezer.Frozen(ctx)
+		if err != nil {
+			return err
+		}
+		if frozen {
+			log.Debugf("skipping retention of frozen repository %s", repoName)
+			return nil
+		}
+	}
+
+	tags, err := retainedTags(ctx, storageDriver, repository)
+	if err != nil {
+		return err
+	}
+	manifestService, err := repository.Manifests(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to construct manifest service: %v", err)
+	}
+
+	// the tags of the manifests attached to a subject present in the
+	// repository follow the retention of their subject
+	attached := make(map[string]bool)
+	attachedTags := make(map[digest.Digest][]string)
+	for _, tag := range tags {
+		manifest, err := manifestService.Get(ctx, tag.digest)
+		if err != nil {
+			return fmt.Errorf("failed to retrieve manifest of tag %s: %v", tag.name, err)
+		}
+		subject := policy.attachedTo(manifest)
+		if subject == nil {
+			continue
+		}
+		exists, err := manifestService.Exists(ctx, subject.Digest)
+		if err != nil {
+			return fmt.Errorf("failed to check subject of tag %s: %v", tag.name, err)
+		}
+		if exists {
+			attached[tag.name] = true
+			attachedTags[tag.digest] = append(attachedTags[tag.digest], tag.name)
+		}
+	}
+
+	// the most recently tagged tags come first
+	var candidates []retainedTag
+	if policy.removesTags() {
+		for _, tag := range tags {
+			if attached[tag.name] {
+				continue
+			}
+			if policy.MatchTag == nil || policy.MatchTag(tag.name) {
+				candidates = append(candidates, tag)
+			}
+		}
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return candidates[i].taggedAt.After(candidates[j].taggedAt)
+		})
+	}
+	removed := make(map[string]bool)
+	for i, tag := range candidates {
+		if i < policy.KeepLast {
+			continue
+		}
+		if policy.MaxAge > 0 && now.Sub(tag.taggedAt) <= policy.MaxAge {
+			continue
+		}
+		removed[tag.name] = true
+		if opts.DryRun {
+			log.Infof("retention: tag %s:%s eligible for deletion", repoName, tag.name)
+			continue
+		}
+		if err := repository.Tags(ctx).Untag(ctx, tag.name); err != nil {
+			return fmt.Errorf("failed to untag %s: %v", tag.name, err)
+		}
+		log.Infof("retention: deleted tag %s:%s", repoName, tag.name)
+		if opts.Listener != nil {
+			if err := opts.Listener.TagDeleted(named, tag.name); err != nil {
+				log.Errorf("error dispatching tag deleted to listener: %v", err)
+			}
+		}
+	}
+
+	if policy.UntaggedMaxAge <= 0 {
+		return nil
+	}
+
+	var roots []digest.Digest
+	for _, tag := range tags {
+		if !removed[tag.name] && !attached[tag.name] {
+			roots = append(roots, tag.digest)
+		}
+	}
+	return removeUntagged(ctx, storageDriver, repository, manifestService, policy, roots, attachedTags, now.Add(-policy.UntaggedMaxAge), opts)
+}
+
+// retainedTags returns the tags of a repository, along with the time they
+// were last tagged, which is when their current link was written.
+func retainedTags(ctx context.Context, storageDriver driver.StorageDriver, repository distribution.Repository) ([]retainedTag, error) {
+	tagService := repository.Tags(ctx)
+	names, err := tagService.All(ctx)
+	if err != nil {
+		if _, ok := err.(distribution.ErrRepositoryUnknown); ok {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to retrieve tags: %v", err)
+	}
+
+	var tags []retainedTag
+	for _, name := range names {
+		desc, err := tagService.Get(ctx, name)
+		if err != nil {
+			if _, ok := err.(distribution.ErrTagUnknown); ok {
+				// the tag was removed meanwhile
+				continue
+			}
+			return nil, fmt.Errorf("failed to retrieve tag %s: %v", name, err)
+		}
+		currentPath, err := pathFor(manifestTagCurrentPathSpec{
+			name: repository.Named().Name(),
+			tag:  name,
+		})
+		if err != nil {
+			return nil, err
+		}
+		fi, err := storageDriver.Stat(ctx, currentPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat tag %s: %v", name, err)
+		}
+		tags = append(tags, retainedTag{name: name, digest: desc.Digest, taggedAt: fi.ModTime()})
+	}
+	return tags, nil
+}
+
+// removeUntagged deletes the manifests pushed before the given time which
+// are neither roots nor referenced by a kept manifest, nor attached to one.
+// The manifests attached to a deleted manifest are deleted along with it,
+// whatever their age, once untagged.
+func removeUntagged(ctx context.Context, storageDriver driver.StorageDriver, repository distribution.Repository, manifestService distribution.ManifestService, policy RetentionPolicy, roots []digest.Digest, attachedTags map[digest.Digest][]string, before time.Time, opts RetentionOpts) error {
+	manifestEnumerator, ok := manifestService.(distribution.ManifestEnumerator)
+	if !ok {
+		return fmt.Errorf("unable to convert ManifestService into ManifestEnumerator")
+	}
+
+	var digests []digest.Digest
+	manifests := make(map[digest.Digest]distribution.Manifest)
+	referrers := make(map[digest.Digest][]digest.Digest)
+	err := manifestEnumerator.Enumerate(ctx, func(dgst digest.Digest) error {
+		manifest, err := manifestService.Get(ctx, dgst)
+		if err != nil {
+			return fmt.Errorf("failed to retrieve manifest for digest %v: %v", dgst, err)
+		}
+		digests = append(digests, dgst)
+		manifests[dgst] = manifest
+		if subject := policy.attachedTo(manifest); subject != nil {
+			referrers[subject.Digest] = append(referrers[subject.Digest], dgst)
+		}
+		return nil
+	})
+	if _, ok := err.(driver.PathNotFoundError); !ok && err != nil {
+		return err
+	}
+
+	kept := make(map[digest.Digest]struct{})
+	var keep func(dgst digest.Digest)
+	keep = func(dgst digest.Digest) {
+		if _, ok := kept[dgst]; ok {
+			return
+		}
+		kept[dgst] = struct{}{}
+		if manifest, ok := manifests[dgst]; ok {
+			for _, desc := range manifest.References() {
+				if _, ok := manifests[desc.Digest]; ok {
+					keep(desc.Digest)
+				}
+			}
+		}
+		for _, referrer := range referrers[dgst] {
+			keep(referrer)
+		}
+	}
+	for _, dgst := range roots {
+		keep(dgst)
+	}
+
+	log := dcontext.GetLogger(ctx)
+	repoName := repository.Named().Name()
+	deleted := make(map[digest.Digest]struct{})
+	var remove func(dgst digest.Digest) error
+	remove = func(dgst digest.Digest) error {
+		if _, ok := deleted[dgst]; ok {
+			return nil
+		}
+		deleted[dgst] = struct{}{}
+		// the attached manifests go first, so that none is left without its
+		// subject should a deletion fail
+		for _, referrer := range referrers[dgst] {
+			if _, ok := kept[referrer]; ok {
+				continue
+			}
+			if err := remove(referrer); err != nil {
+				return err
+			}
+		}
+
+		for _, tag := range attachedTags[dgst] {
+			if opts.DryRun {
+				log.Infof("retention: tag %s:%s eligible for deletion", repoName, tag)
+				continue
+			}
+			if err := repository.Tags(ctx).Untag(ctx, tag); err != nil {
+				return fmt.Errorf("failed to untag %s: %v", tag, err)
+			}
+			log.Infof("retention: deleted tag %s:%s", repoName, tag)
+			if opts.Listener != nil {
+				if err := opts.Listener.TagDeleted(repository.Named(), tag); err != nil {
+					log.Errorf("error dispatching tag deleted to listener: %v", err)
+				}
+			}
+		}
+
+		if opts.DryRun {
+			log.Infof("retention: manifest %s@%s eligible for deletion", repoName, dgst)
+			return nil
+		}
+		if err := manifestService.Delete(ctx, dgst); err != nil {
+			return fmt.Errorf("failed to delete manifest %s: %v", dgst, err)
+		}
+		log.Infof("retention: deleted manifest %s@%s", repoName, dgst)
+		if opts.Listener != nil {
+			if err := opts.Listener.ManifestDeleted(repository.Named(), dgst); err != nil {
+				log.Errorf("error dispatching manifest deleted to listener: %v", err)
+			}
+		}
+		return nil
+	}
+
+	for _, dgst := range digests {
+		if _, ok := kept[dgst]; ok {
+			continue
+		}
+		// attached manifests are only removed along with their subject
+		if subject := policy.attachedTo(manifests[dgst]); subject != nil {
+			if _, ok := manifests[subject.Digest]; ok {
+				continue
+			}
+		}
+		revisionPath, err := manifestRevisionLinkPath(repoName, dgst)
+		if err != nil {
+			return err
+		}
+		fi, err := storageDriver.Stat(ctx, revisionPath)
+		if err != nil {
+			return fmt.Errorf("failed to stat manifest %s: %v", dgst, err)
+		}
+		if !fi.ModTime().Before(before) {
+			continue
+		}
+		if err := remove(dgst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,265 @@
+package storage
+
+import (
+	"context"
+	"path"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+)
+
+// retentionRecorder records the removals of the retention policies.
+type retentionRecorder struct {
+	tags      []string
+	manifests []digest.Digest
+}
+
+func (r *retentionRecorder) TagDeleted(repo reference.Named, tag string) error {
+	r.tags = append(r.tags, repo.Name()+":"+tag)
+	return nil
+}
+
+func (r *retentionRecorder) ManifestDeleted(repo reference.Named, dgst digest.Digest) error {
+	r.manifests = append(r.manifests, dgst)
+	return nil
+}
+
+// tagImages uploads and tags an image for each tag, in order, so that they
+// are tagged at distinct times.
+func tagImages(t *testing.T, repo distribution.Repository, tags ...string) map[string]digest.Digest {
+	ctx := context.Background()
+	digests := make(map[string]digest.Digest)
+	for _, tag := range tags {
+		im := uploadRandomSchema2Image(t, repo)
+		if err := repo.Tags(ctx).Tag(ctx, tag, distribution.Descriptor{Digest: im.manifestDigest}); err != nil {
+			t.Fatalf("failed to tag manifest: %v", err)
+		}
+		digests[tag] = im.manifestDigest
+		time.Sleep(10 * time.Millisecond)
+	}
+	return digests
+}
+
+func TestRetentionKeepLast(t *testing.T) {
+	ctx := context.Background()
+	inmemoryDriver := inmemory.New()
+
+	registry := createRegistry(t, inmemoryDriver)
+	repo := makeRepository(t, registry, "retention/app")
+	digests := tagImages(t, repo, "v1", "v2", "latest", "v3", "v4")
+	signature := uploadReferrer(t, repo, digests["v4"])
+	untagged := uploadRandomSchema2Image(t, repo)
+	untaggedSignature := uploadReferrer(t, repo, untagged.manifestDigest)
+	other := makeRepository(t, registry, "other")
+	tagImages(t, other, "v1", "v2")
+
+	policies := []RetentionPolicy{{
+		Match:          func(repository string) bool { return repository == "retention/app" },
+		MatchTag:       func(tag string) bool { ok, _ := path.Match("v*", tag); return ok },
+		KeepLast:       2,
+		UntaggedMaxAge: time.Nanosecond,
+	}}
+
+	// nothing is removed in dry-run mode
+	recorder := &retentionRecorder{}
+	if err := ApplyRetention(ctx, inmemoryDriver, registry, policies, RetentionOpts{DryRun: true, Listener: recorder}); err != nil {
+		t.Fatalf("unexpected error applying retention: %v", err)
+	}
+	if tags, _ := repo.Tags(ctx).All(ctx); len(tags) != 5 {
+		t.Fatalf("unexpected tags after dry run: %v", tags)
+	}
+	if len(recorder.tags) != 0 || len(recorder.manifests) != 0 {
+		t.Fatalf("unexpected removals notified in dry run: %v, %v", recorder.tags, recorder.manifests)
+	}
+
+	if err := ApplyRetention(ctx, inmemoryDriver, registry, policies, RetentionOpts{Listener: recorder}); err != nil {
+		t.Fatalf("unexpected error applying retention: %v", err)
+	}
+
+	tags, err := repo.Tags(ctx).All(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error listing tags: %v", err)
+	}
+	if expected := []string{"latest", "v3", "v4"}; !equalStrings(tags, expected) {
+		t.Errorf("unexpected tags: %v != %v", tags, expected)
+	}
+	if tags, _ := other.Tags(ctx).All(ctx); len(tags) != 2 {
+		t.Errorf("unexpected tags of a repository matching no policy: %v", tags)
+	}
+	sort.Strings(recorder.tags)
+	if expected := []string{"retention/app:v1", "retention/app:v2"}; !equalStrings(recorder.tags, expected) {
+		t.Errorf("unexpected tags notified: %v != %v", recorder.tags, expected)
+	}
+
+	manifests := allManifests(t, makeManifestService(t, repo))
+	for _, dgst := range []digest.Digest{digests["latest"], digests["v3"], digests["v4"], signature} {
+		if _, ok := manifests[dgst]; !ok {
+			t.Errorf("manifest %s was deleted", dgst)
+		}
+	}
+	removed := []digest.Digest{digests["v1"], digests["v2"], untagged.manifestDigest, untaggedSignature}
+	for _, dgst := range removed {
+		if _, ok := manifests[dgst]; ok {
+			t.Errorf("manifest %s was not deleted", dgst)
+		}
+	}
+	if len(recorder.manifests) != len(removed) {
+		t.Errorf("unexpected manifests notified: %v", recorder.manifests)
+	}
+}
+
+func TestRetentionMaxAge(t *testing.T) {
+	ctx := context.Background()
+	inmemoryDriver := inmemory.New()
+
+	registry := createRegistry(t, inmemoryDriver)
+	repo := makeRepository(t, registry, "retention")
+	digests := tagImages(t, repo, "old", "older")
+	time.Sleep(200 * time.Millisecond)
+	tagImages(t, repo, "new")
+	untagged := uploadRandomSchema2Image(t, repo)
+
+	policies := []RetentionPolicy{{
+		KeepLast:       1,
+		MaxAge:         100 * time.Millisecond,
+		UntaggedMaxAge: time.Hour,
+	}}
+	if err := ApplyRetention(ctx, inmemoryDriver, registry, policies, RetentionOpts{}); err != nil {
+		t.Fatalf("unexpected error applying retention: %v", err)
+	}
+
+	tags, err := repo.Tags(ctx).All(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error listing tags: %v", err)
+	}
+	if expected := []string{"new"}; !equalStrings(tags, expected) {
+		t.Errorf("unexpected tags: %v != %v", tags, expected)
+	}
+
+	// untagged manifests pushed within their maximum age are kept
+	manifests := allManifests(t, makeManifestService(t, repo))
+	for _, dgst := range []digest.Digest{digests["old"], digests["older"], untagged.manifestDigest} {
+		if _, ok := manifests[dgst]; !ok {
+			t.Errorf("manifest %s was deleted", dgst)
+		}
+	}
+}
+
+func TestRetentionFrozen(t *testing.T) {
+	ctx := context.Background()
+	inmemoryDriver := inmemory.New()
+
+	registry := createRegistry(t, inmemoryDriver)
+	repo := makeRepository(t, registry, "retention/frozen")
+	tagImages(t, repo, "v1", "v2")
+	if err := repo.(distribution.RepositoryFreezer).SetFrozen(ctx, true); err != nil {
+		t.Fatalf("unexpected error freezing repository: %v", err)
+	}
+
+	policies := []RetentionPolicy{{KeepLast: 1}}
+	if err := ApplyRetention(ctx, inmemoryDriver, registry, policies, RetentionOpts{}); err != nil {
+		t.Fatalf("unexpected error applying retention: %v", err)
+	}
+	if tags, _ := repo.Tags(ctx).All(ctx); len(tags) != 2 {
+		t.Errorf("unexpected tags of a frozen repository: %v", tags)
+	}
+
+	if err := repo.(distribution.RepositoryFreezer).SetFrozen(ctx, false); err != nil {
+		t.Fatalf("unexpected error unfreezing repository: %v", err)
+	}
+	if err := ApplyRetention(ctx, inmemoryDriver, registry, policies, RetentionOpts{}); err != nil {
+		t.Fatalf("unexpected error applying retention: %v", err)
+	}
+	if tags, _ := repo.Tags(ctx).All(ctx); len(tags) != 1 {
+		t.Errorf("unexpected tags of an unfrozen repository: %v", tags)
+	}
+}
+
+func TestRetentionAttachedArtifacts(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name        string
+		independent []string
+		tags        []string
+		deleted     []string
+	}{
+		{
+			// the signature follows its subject, and does not hold a slot
+			name:    "attached",
+			tags:    []string{"v2", "v3"},
+			deleted: []string{"v1", "signature"},
+		},
+		{
+			name:        "independent",
+			independent: []string{"application/vnd.example.signature"},
+			tags:        []string{"signature", "v3"},
+			deleted:     []string{"v1", "v2"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inmemoryDriver := inmemory.New()
+			registry := createRegistry(t, inmemoryDriver)
+			repo := makeRepository(t, registry, "retention/attached")
+			digests := tagImages(t, repo, "v1", "v2", "v3")
+
+			signature := uploadReferrer(t, repo, digests["v1"])
+			signatureTag := "sha256-" + digests["v1"].Encoded() + ".sig"
+			if err := repo.Tags(ctx).Tag(ctx, signatureTag, distribution.Descriptor{Digest: signature}); err != nil {
+				t.Fatalf("failed to tag signature: %v", err)
+			}
+			digests["signature"] = signature
+			time.Sleep(10 * time.Millisecond)
+
+			policies := []RetentionPolicy{{
+				KeepLast:                 2,
+				UntaggedMaxAge:           time.Millisecond,
+				IndependentArtifactTypes: tc.independent,
+			}}
+			if err := ApplyRetention(ctx, inmemoryDriver, registry, policies, RetentionOpts{}); err != nil {
+				t.Fatalf("unexpected error applying retention: %v", err)
+			}
+
+			tags, err := repo.Tags(ctx).All(ctx)
+			if err != nil {
+				t.Fatalf("unexpected error listing tags: %v", err)
+			}
+			for i, tag := range tc.tags {
+				if tag == "signature" {
+					tc.tags[i] = signatureTag
+				}
+			}
+			sort.Strings(tc.tags)
+			if !equalStrings(tags, tc.tags) {
+				t.Errorf("unexpected tags: %v != %v", tags, tc.tags)
+			}
+
+			manifests := allManifests(t, makeManifestService(t, repo))
+			if len(manifests) != 4-len(tc.deleted) {
+				t.Errorf("unexpected number of manifests left: %d", len(manifests))
+			}
+			for _, name := range tc.deleted {
+				if _, ok := manifests[digests[name]]; ok {
+					t.Errorf("manifest %s was not deleted", name)
+				}
+			}
+		})
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"path"
+	"strings"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+// rootDirectoryKey is the context key of the root directory of the storage
+// operations.
+type rootDirectoryKey struct{}
+
+// WithRootDirectory returns a context confining the storage operations made
+// with it through a driver returned by NewContextRootedDriver to dir, such as
+// the directory of a tenant within a storage backend shared by several. The
+// content stored under distinct root directories is fully isolated: a
+// registry sees and garbage collects the content of the root directory of
+// its context only.
+func WithRootDirectory(ctx context.Context, dir string) context.Context {
+	return context.WithValue(ctx, rootDirectoryKey{}, path.Clean("/"+dir))
+}
+
+// RootDirectory returns the root directory of the storage operations made
+// with the context, "/" if none was set.
+func RootDirectory(ctx context.Context) string {
+	if dir, ok := ctx.Value(rootDirectoryKey{}).(string); ok {
+		return dir
+	}
+	return "/"
+}
+
+// NewContextRootedDriver returns a driver storing the content under the root
+// directory of the context of each operation, as set by WithRootDirectory.
+// The paths of the operations made without one are left untouched.
+func NewContextRootedDriver(driver storagedriver.StorageDriver) storagedriver.StorageDriver {
+	return &contextRootedDriver{StorageDriver: driver}
+}
+
+// contextRootedDriver prefixes the paths of the operations of the driver it
+// wraps with the root directory of their context.
+type contextRootedDriver struct {
+	storagedriver.StorageDriver
+}
+
+var _ storagedriver.Linker = &contextRootedDriver{}
+
+// rooted returns the path within the root directory of the context.
+func rooted(ctx context.Context, p string) string {
+	dir := RootDirectory(ctx)
+	if dir == "/" {
+		return p
+	}
+	return path.Join(dir, p)
+}
+
+// unrooted returns the path relative to the root directory of the context of
+// a path returned by the wrapped driver.
+func unrooted(ctx context.Context, p string) string {
+	dir := RootDirectory(ctx)
+	if dir == "/" {
+		return p
+	}
+	if p == dir {
+		return "/"
+	}
+	return strings.TrimPrefix(p, dir)
+}
+
+func (d *contextRootedDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	return d.StorageDriver.GetContent(ctx, rooted(ctx, path))
+}
+
+func (d *contextRootedDriver) PutContent(ctx context.Context, path string, content []byte) error {
+	return d.StorageDriver.PutContent(ctx, rooted(ctx, path), content)
+}
+
+func (d *contextRootedDriver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	return d.StorageDriver.Reader(ctx, rooted(ctx, path), offset)
+}
+
+func (d *contextRootedDriver) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	return d.StorageDriver.Writer(ctx, rooted(ctx, path), append)
+}
+
+func (d *contextRootedDriver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	fi, err := d.StorageDriver.Stat(ctx, rooted(ctx, path))
+	if err != nil {
+		return nil, err
+	}
+	return rootedFileInfo{FileInfo: fi, path: path}, nil
+}
+
+func (d *contextRootedDriver) List(ctx context.Context, path string) ([]string, error) {
+	children, err := d.StorageDriver.List(ctx, rooted(ctx, path))
+	if err != nil {
+		return nil, err
+	}
+	for i, child := range children {
+		children[i] = unrooted(ctx, child)
+	}
+	return children, nil
+}
+
+func (d *contextRootedDriver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	return d.StorageDriver.Move(ctx, rooted(ctx, sourcePath), rooted(ctx, destPath))
+}
+
+func (d *contextRootedDriver) Delete(ctx context.Context, path string) error {
+	return d.StorageDriver.Delete(ctx, rooted(ctx, path))
+}
+
+func (d *contextRootedDriver) URLFor(ctx context.Context, path string, options map[string]interface{}) (string, error) {
+	return d.StorageDriver.URLFor(ctx, rooted(ctx, path), options)
+}
+
+func (d *contextRootedDriver) Walk(ctx context.Context, path string, f storagedriver.WalkFn) error {
+	return d.StorageDriver.Walk(ctx, rooted(ctx, path), func(fi storagedriver.FileInfo) error {
+		return f(rootedFileInfo{FileInfo: fi, path: unrooted(ctx, fi.Path())})
+	})
+}
+
+// Link links the paths within the root directory, if the wrapped driver
+// supports it.
+func (d *contextRootedDriver) Link(ctx context.Context, sourcePath string, destPath string) error {
+	if linker, ok := d.StorageDriver.(storagedriver.Linker); ok {
+		return linker.Link(ctx, rooted(ctx, sourcePath), rooted(ctx, destPath))
+	}
+	return storagedriver.ErrUnsupportedMethod{DriverName: d.Name()}
+}
+
+// linkFromRoot links the path within the root directory root to the same
+// path within the root directory of ctx, if the wrapped driver supports it.
+func (d *contextRootedDriver) linkFromRoot(ctx context.Context, root string, p string) error {
+	if linker, ok := d.StorageDriver.(storagedriver.Linker); ok {
+		return linker.Link(ctx, rooted(WithRootDirectory(ctx, root), p), rooted(ctx, p))
+	}
+	return storagedriver.ErrUnsupportedMethod{DriverName: d.Name()}
+}
+
+// rootedFileInfo reports the path of a file relative to the root directory.
+type rootedFileInfo struct {
+	storagedriver.FileInfo
+	path string
+}
+
+func (fi rootedFileInfo) Path() string {
+	return fi.path
+}
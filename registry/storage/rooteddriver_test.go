@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/reference"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/filesystem"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestContextRootedDriver(t *testing.T) {
+	ctx := context.Background()
+	backend := inmemory.New()
+	driver := NewContextRootedDriver(backend)
+
+	acme := WithRootDirectory(ctx, "/tenants/acme")
+	if err := driver.PutContent(acme, "/a/b", []byte("acme")); err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.PutContent(ctx, "/a/b", []byte("default")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		ctx      context.Context
+		path     string
+		expected string
+	}{
+		{ctx: acme, path: "/a/b", expected: "acme"},
+		{ctx: ctx, path: "/a/b", expected: "default"},
+		{ctx: ctx, path: "/tenants/acme/a/b", expected: "acme"},
+	} {
+		content, err := driver.GetContent(tc.ctx, tc.path)
+		if err != nil {
+			t.Fatalf("unexpected error reading %s: %v", tc.path, err)
+		}
+		if string(content) != tc.expected {
+			t.Errorf("unexpected content of %s: %q != %q", tc.path, content, tc.expected)
+		}
+	}
+
+	if fi, err := driver.Stat(acme, "/a/b"); err != nil || fi.Path() != "/a/b" {
+		t.Fatalf("unexpected stat of the rooted path: %v, %v", fi, err)
+	}
+	if children, err := driver.List(acme, "/a"); err != nil || len(children) != 1 || children[0] != "/a/b" {
+		t.Fatalf("unexpected children of the rooted path: %v, %v", children, err)
+	}
+	var walked []string
+	err := driver.Walk(acme, "/", func(fi storagedriver.FileInfo) error {
+		walked = append(walked, fi.Path())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(walked)
+	if expected := []string{"/a", "/a/b"}; !equalStrings(walked, expected) {
+		t.Fatalf("unexpected walked paths: %v != %v", walked, expected)
+	}
+
+	if err := driver.Delete(acme, "/a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := driver.Stat(ctx, "/a/b"); err != nil {
+		t.Fatalf("the content outside the root directory was deleted: %v", err)
+	}
+}
+
+func TestRegistryRootDirectory(t *testing.T) {
+	ctx := context.Background()
+	backend := inmemory.New()
+	registry := createRegistry(t, NewContextRootedDriver(backend))
+	acme := WithRootDirectory(ctx, "/tenants/acme")
+
+	name, _ := reference.WithName("app")
+	repo, err := registry.Repository(acme, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc, err := repo.Blobs(acme).Put(acme, "application/octet-stream", []byte("acme layer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the repository of the same name outside of the root directory does
+	// not have the blob, nor can the registry find it there
+	repo, err = registry.Repository(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Blobs(ctx).Stat(ctx, desc.Digest); err != distribution.ErrBlobUnknown {
+		t.Fatalf("expected the blob to be unknown outside of the root directory, got %v", err)
+	}
+	if _, err := registry.BlobStatter().Stat(ctx, desc.Digest); err != distribution.ErrBlobUnknown {
+		t.Fatalf("expected the blob to be unknown to the registry outside of the root directory, got %v", err)
+	}
+	if _, err := backend.Stat(ctx, "/tenants/acme/docker/registry/v2/repositories/app"); err != nil {
+		t.Fatalf("expected the repository to be stored in the root directory: %v", err)
+	}
+}
+
+func TestRegistryShareBlobData(t *testing.T) {
+	for _, hardlinks := range []bool{true, false} {
+		ctx := context.Background()
+		root := t.TempDir()
+		backend, err := filesystem.FromParameters(map[string]interface{}{
+			"rootdirectory": root,
+			"hardlinks":     hardlinks,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		registry := createRegistry(t, NewContextRootedDriver(backend), ShareBlobData("/", "/tenants/acme", "/tenants/other"))
+
+		content := []byte("shared layer")
+		desc := distribution.Descriptor{Digest: digest.FromBytes(content), Size: int64(len(content))}
+		name, _ := reference.WithName("app")
+		var dataPaths []string
+		for _, dir := range []string{"/tenants/acme", "/tenants/other"} {
+			tenant := WithRootDirectory(ctx, dir)
+			repo, err := registry.Repository(tenant, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := addBlob(tenant, repo.Blobs(tenant), desc, bytes.NewReader(content)); err != nil {
+				t.Fatalf("unexpected error adding the blob to %s: %v", dir, err)
+			}
+			if p, err := repo.Blobs(tenant).Get(tenant, desc.Digest); err != nil || !bytes.Equal(p, content) {
+				t.Fatalf("unexpected content of the blob of %s: %q, %v", dir, p, err)
+			}
+
+			blobPath, err := pathFor(blobDataPathSpec{digest: desc.Digest})
+			if err != nil {
+				t.Fatal(err)
+			}
+			dataPaths = append(dataPaths, filepath.Join(root, dir, blobPath))
+		}
+
+		acme, err := os.Stat(dataPaths[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, err := os.Stat(dataPaths[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if shared := os.SameFile(acme, other); shared != hardlinks && runtime.GOOS != "windows" {
+			t.Errorf("unexpected sharing of the blob data with hardlinks %v: %v", hardlinks, shared)
+		}
+	}
+}
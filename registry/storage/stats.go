@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+)
+
+// RegistryStats are aggregate statistics of the content of a registry.
+type RegistryStats struct {
+	// Repositories is the number of repositories.
+	Repositories int64 `json:"repositories"`
+	// Manifests is the number of manifests of the repositories, a manifest
+	// pushed to several repositories counting once for each.
+	Manifests int64 `json:"manifests"`
+	// Tags is the number of tags of the repositories.
+	Tags int64 `json:"tags"`
+	// Blobs is the number of unique blobs of the blob store, manifests
+	// included.
+	Blobs int64 `json:"blobs"`
+	// LogicalSize is the total size of the layers and manifests of the
+	// repositories, as if each repository stored its own copy of them.
+	LogicalSize int64 `json:"logicalSize"`
+	// DeduplicatedSize is the total size of the blobs of the blob store,
+	// each stored once whatever the number of repositories linking it.
+	DeduplicatedSize int64 `json:"deduplicatedSize"`
+}
+
+// ComputeStats walks the repositories and the blob store of the registry to
+// compute its statistics. It can run while the registry serves requests, the
+// statistics then being an approximation of the content pushed or deleted in
+// the meantime.
+func ComputeStats(ctx context.Context, storageDriver driver.StorageDriver, registry distribution.Namespace) (*RegistryStats, error) {
+	repositoryEnumerator, ok := registry.(distribution.RepositoryEnumerator)
+	if !ok {
+		return nil, fmt.Errorf("unable to convert Namespace to RepositoryEnumerator")
+	}
+
+	stats := &RegistryStats{}
+	// the sizes of the blobs are stat'ed once, though linked by several
+	// repositories
+	sizes := make(map[digest.Digest]int64)
+	size := func(dgst digest.Digest) (int64, error) {
+		if s, ok := sizes[dgst]; ok {
+			return s, nil
+		}
+		s, err := blobSize(ctx, storageDriver, dgst)
+		if err != nil {
+			return 0, err
+		}
+		sizes[dgst] = s
+		return s, nil
+	}
+
+	err := registry.Blobs().Enumerate(ctx, func(dgst digest.Digest) error {
+		s, err := size(dgst)
+		if err != nil {
+			return err
+		}
+		stats.Blobs++
+		stats.DeduplicatedSize += s
+		return nil
+	})
+	if _, ok := err.(driver.PathNotFoundError); !ok && err != nil {
+		return nil, fmt.Errorf("failed to enumerate blobs: %v", err)
+	}
+
+	var names []string
+	err = repositoryEnumerator.Enumerate(ctx, func(repoName string) error {
+		names = append(names, repoName)
+		return nil
+	})
+	if _, ok := err.(driver.PathNotFoundError); !ok && err != nil {
+		return nil, fmt.Errorf("failed to enumerate repositories: %v", err)
+	}
+	for _, repoName := range names {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if err := repositoryStats(ctx, registry, repoName, stats, size); err != nil {
+			return nil, fmt.Errorf("failed to compute the statistics of repository %s: %v", repoName, err)
+		}
+	}
+	return stats, nil
+}
+
+// repositoryStats adds the manifests, tags and linked blobs of a repository
+// to stats.
+func repositoryStats(ctx context.Context, registry distribution.Namespace, repoName string, stats *RegistryStats, size func(digest.Digest) (int64, error)) error {
+	named, err := reference.WithName(repoName)
+	if err != nil {
+		return err
+	}
+	repository, err := registry.Repository(ctx, named)
+	if err != nil {
+		return err
+	}
+	stats.Repositories++
+
+	addSize := func(dgst digest.Digest) error {
+		s, err := size(dgst)
+		if err != nil {
+			return err
+		}
+		stats.LogicalSize += s
+		return nil
+	}
+
+	manifestService, err := repository.Manifests(ctx)
+	if err != nil {
+		return err
+	}
+	if enumerator, ok := manifestService.(distribution.ManifestEnumerator); ok {
+		err := enumerator.Enumerate(ctx, func(dgst digest.Digest) error {
+			stats.Manifests++
+			return addSize(dgst)
+		})
+		if _, ok := err.(driver.PathNotFoundError); !ok && err != nil {
+			return err
+		}
+	}
+
+	if enumerator, ok := repository.Blobs(ctx).(distribution.BlobEnumerator); ok {
+		err := enumerator.Enumerate(ctx, addSize)
+		if _, ok := err.(driver.PathNotFoundError); !ok && err != nil {
+			return err
+		}
+	}
+
+	tags, err := repository.Tags(ctx).All(ctx)
+	if err != nil {
+		if _, ok := err.(distribution.ErrRepositoryUnknown); ok {
+			return nil
+		}
+		return fmt.Errorf("failed to retrieve tags: %v", err)
+	}
+	stats.Tags += int64(len(tags))
+	return nil
+}
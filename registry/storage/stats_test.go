@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"context"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+)
+
+func TestComputeStats(t *testing.T) {
+	ctx := context.Background()
+	inmemoryDriver := inmemory.New()
+	registry := createRegistry(t, inmemoryDriver)
+
+	stats, err := ComputeStats(ctx, inmemoryDriver, registry)
+	if err != nil {
+		t.Fatalf("unexpected error computing the statistics of an empty registry: %v", err)
+	}
+	if *stats != (RegistryStats{}) {
+		t.Fatalf("unexpected statistics of an empty registry: %+v", stats)
+	}
+
+	app := makeRepository(t, registry, "stats/app")
+	image := uploadRandomSchema2Image(t, app)
+	if err := app.Tags(ctx).Tag(ctx, "latest", distribution.Descriptor{Digest: image.manifestDigest}); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Tags(ctx).Tag(ctx, "v1", distribution.Descriptor{Digest: image.manifestDigest}); err != nil {
+		t.Fatal(err)
+	}
+
+	single, err := ComputeStats(ctx, inmemoryDriver, registry)
+	if err != nil {
+		t.Fatalf("unexpected error computing statistics: %v", err)
+	}
+	if single.Repositories != 1 || single.Manifests != 1 || single.Tags != 2 {
+		t.Fatalf("unexpected statistics: %+v", single)
+	}
+	// the blobs are the layers, the config and the manifest
+	if single.Blobs != int64(len(image.layers))+2 {
+		t.Fatalf("unexpected number of blobs: %+v", single)
+	}
+	if single.LogicalSize != single.DeduplicatedSize || single.DeduplicatedSize == 0 {
+		t.Fatalf("unexpected sizes of a single repository: %+v", single)
+	}
+
+	// a blob pushed to two repositories is stored once, as is the empty
+	// config of the images
+	other := makeRepository(t, registry, "stats/other")
+	uploadRandomSchema2Image(t, other)
+	shared := []byte("shared between repositories")
+	for _, repo := range []distribution.Repository{app, other} {
+		if _, err := repo.Blobs(ctx).Put(ctx, "application/octet-stream", shared); err != nil {
+			t.Fatalf("unexpected error putting blob: %v", err)
+		}
+	}
+
+	stats, err = ComputeStats(ctx, inmemoryDriver, registry)
+	if err != nil {
+		t.Fatalf("unexpected error computing statistics: %v", err)
+	}
+	if stats.Repositories != 2 || stats.Manifests != 2 || stats.Tags != 2 || stats.Blobs != 2*single.Blobs {
+		t.Fatalf("unexpected statistics: %+v", stats)
+	}
+	if stats.LogicalSize-stats.DeduplicatedSize != int64(len(shared)) {
+		t.Fatalf("unexpected sizes: %+v", stats)
+	}
+}
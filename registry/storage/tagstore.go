@@ -2,15 +2,27 @@ package storage
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"path"
 	"sort"
+	"time"
 
 	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/auth"
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/tracing"
 	"github.com/opencontainers/go-digest"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-var _ distribution.TagService = &tagStore{}
+var (
+	_ distribution.TagService         = &tagStore{}
+	_ distribution.TagHistoryProvider = &tagStore{}
+)
 
 // tagStore provides methods to manage manifest tags in a backend storage driver.
 // This implementation uses the same on-disk layout as the (now deleted) tag
@@ -58,6 +70,20 @@ func (ts *tagStore) All(ctx context.Context) ([]string, error) {
 // Tag tags the digest with the given tag, updating the the store to point at
 // the current tag. The digest must point to a manifest.
 func (ts *tagStore) Tag(ctx context.Context, tag string, desc distribution.Descriptor) error {
+	return ts.TagIf(ctx, tag, desc, nil)
+}
+
+// TagIf tags the digest with the given tag if check accepts the manifest the
+// tag currently points at. The tag is locked from the check to the update,
+// within this registry instance and, with a locker, across instances.
+func (ts *tagStore) TagIf(ctx context.Context, tag string, desc distribution.Descriptor, check func(current digest.Digest) error) error {
+	defer ts.lockTag(tag)()
+	unlock, err := ts.repository.registry.lockRepository(ctx, ts.repository.Named().Name())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	currentPath, err := pathFor(manifestTagCurrentPathSpec{
 		name: ts.repository.Named().Name(),
 		tag:  tag,
@@ -67,6 +93,18 @@ func (ts *tagStore) Tag(ctx context.Context, tag string, desc distribution.Descr
 		return err
 	}
 
+	previous, err := ts.blobStore.readlink(ctx, currentPath)
+	if err != nil {
+		if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+			return err
+		}
+	}
+	if check != nil {
+		if err := check(previous); err != nil {
+			return err
+		}
+	}
+
 	lbs := ts.linkedBlobStore(ctx, tag)
 
 	// Link into the index
@@ -75,11 +113,25 @@ func (ts *tagStore) Tag(ctx context.Context, tag string, desc distribution.Descr
 	}
 
 	// Overwrite the current link
-	return ts.blobStore.link(ctx, currentPath, desc.Digest)
+	if err := ts.blobStore.link(ctx, currentPath, desc.Digest); err != nil {
+		return err
+	}
+
+	if previous != desc.Digest {
+		ts.appendHistory(ctx, tag, distribution.TagEvent{
+			Action:   distribution.TagEventActionTag,
+			Digest:   desc.Digest,
+			Previous: previous,
+		})
+	}
+	return nil
 }
 
 // resolve the current revision for name and tag.
 func (ts *tagStore) Get(ctx context.Context, tag string) (distribution.Descriptor, error) {
+	ctx, span := tracing.StartSpan(ctx, "tagStore.Get", attribute.String("tag", tag))
+	defer span.End()
+
 	currentPath, err := pathFor(manifestTagCurrentPathSpec{
 		name: ts.repository.Named().Name(),
 		tag:  tag,
@@ -102,8 +154,21 @@ func (ts *tagStore) Get(ctx context.Context, tag string) (distribution.Descripto
 	return distribution.Descriptor{Digest: revision}, nil
 }
 
+// lockTag acquires the lock of a tag within this registry instance, and
+// returns the function releasing it.
+func (ts *tagStore) lockTag(tag string) func() {
+	return ts.repository.registry.tagLocks.lock(ts.repository.Named().Name() + ":" + tag)
+}
+
 // Untag removes the tag association
 func (ts *tagStore) Untag(ctx context.Context, tag string) error {
+	defer ts.lockTag(tag)()
+	unlock, err := ts.repository.registry.lockRepository(ctx, ts.repository.Named().Name())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	tagPath, err := pathFor(manifestTagPathSpec{
 		name: ts.repository.Named().Name(),
 		tag:  tag,
@@ -112,7 +177,131 @@ func (ts *tagStore) Untag(ctx context.Context, tag string) error {
 		return err
 	}
 
-	return ts.blobStore.driver.Delete(ctx, tagPath)
+	// the current revision is only needed for the history, the tag may
+	// have been partially removed before
+	currentPath, err := pathFor(manifestTagCurrentPathSpec{
+		name: ts.repository.Named().Name(),
+		tag:  tag,
+	})
+	if err != nil {
+		return err
+	}
+	previous, _ := ts.blobStore.readlink(ctx, currentPath)
+
+	// Record the deletion in the trash, unless the manifest of the tag was
+	// deleted, in which case the tag was recorded with the manifest.
+	var trashID string
+	if t := ts.repository.trash; t != nil && previous != "" {
+		revisionPath, err := manifestRevisionLinkPath(ts.repository.Named().Name(), previous)
+		if err != nil {
+			return err
+		}
+		if _, err := ts.blobStore.readlink(ctx, revisionPath); err == nil {
+			trashID, err = t.add(ctx, ts.repository.Named().Name(), distribution.TrashEntry{
+				Kind:   distribution.TrashEntryTag,
+				Digest: previous,
+				Tag:    tag,
+			})
+			if err != nil {
+				return err
+			}
+		} else if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+			return err
+		}
+	}
+
+	if err := ts.blobStore.driver.Delete(ctx, tagPath); err != nil {
+		if trashID != "" {
+			if err := ts.repository.trash.remove(ctx, ts.repository.Named().Name(), trashID); err != nil {
+				dcontext.GetLogger(ctx).Errorf("error removing trash entry of tag %s: %v", tag, err)
+			}
+		}
+		return err
+	}
+
+	ts.appendHistory(ctx, tag, distribution.TagEvent{
+		Action:   distribution.TagEventActionUntag,
+		Previous: previous,
+	})
+	return nil
+}
+
+// History returns the events of the tag, from the oldest to the most recent
+// one. Tags moved before the history was introduced have no events until
+// they are moved again.
+func (ts *tagStore) History(ctx context.Context, tag string) ([]distribution.TagEvent, error) {
+	historyPath, err := pathFor(manifestTagHistoryPathSpec{
+		name: ts.repository.Named().Name(),
+		tag:  tag,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := ts.blobStore.driver.List(ctx, historyPath)
+	if err != nil {
+		switch err.(type) {
+		case storagedriver.PathNotFoundError:
+			return nil, nil
+		default:
+			return nil, err
+		}
+	}
+
+	// entries are named after the time of the event
+	sort.Strings(entries)
+
+	events := make([]distribution.TagEvent, 0, len(entries))
+	for _, entry := range entries {
+		content, err := ts.blobStore.driver.GetContent(ctx, entry)
+		if err != nil {
+			return nil, err
+		}
+
+		var event distribution.TagEvent
+		if err := json.Unmarshal(content, &event); err != nil {
+			return nil, fmt.Errorf("invalid tag history entry %s: %v", entry, err)
+		}
+		events = append(events, event)
+	}
+
+	return events, nil
+}
+
+// appendHistory records an event in the history of the tag. Entries are
+// never rewritten, each event is saved to its own file so that concurrent
+// changes of the tag don't overwrite each other. The tag has already been
+// changed, so failures are only logged.
+func (ts *tagStore) appendHistory(ctx context.Context, tag string, event distribution.TagEvent) {
+	event.Actor = dcontext.GetStringValue(ctx, auth.UserNameKey)
+	event.Timestamp = time.Now().UTC()
+
+	if err := ts.writeHistoryEntry(ctx, tag, event); err != nil {
+		dcontext.GetLogger(ctx).Errorf("error recording %s event of tag %s:%s: %v", event.Action, ts.repository.Named().Name(), tag, err)
+	}
+}
+
+func (ts *tagStore) writeHistoryEntry(ctx context.Context, tag string, event distribution.TagEvent) error {
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return err
+	}
+
+	entryPath, err := pathFor(manifestTagHistoryEntryPathSpec{
+		name:  ts.repository.Named().Name(),
+		tag:   tag,
+		entry: fmt.Sprintf("%020d-%s", event.Timestamp.UnixNano(), hex.EncodeToString(id[:])),
+	})
+	if err != nil {
+		return err
+	}
+
+	content, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	return ts.blobStore.driver.PutContent(ctx, entryPath, content)
 }
 
 // linkedBlobStore returns the linkedBlobStore for the named tag, allowing one
@@ -2,13 +2,17 @@ package storage
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"reflect"
+	"sync"
 	"testing"
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/manifest"
 	"github.com/distribution/distribution/v3/manifest/schema2"
 	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/auth"
 	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
 	digest "github.com/opencontainers/go-digest"
 )
@@ -91,6 +95,49 @@ func TestTagStoreTag(t *testing.T) {
 	}
 }
 
+// TestTagStoreTagIf ensures that concurrent conditional tags do not clobber
+// each other.
+func TestTagStoreTagIf(t *testing.T) {
+	env := testTagStore(t)
+	tagger := env.ts.(distribution.TagConditionalTagger)
+	ctx := env.ctx
+
+	errExists := errors.New("tag exists")
+	createOnly := func(current digest.Digest) error {
+		if current != "" {
+			return errExists
+		}
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			d := distribution.Descriptor{Digest: digest.FromString(fmt.Sprint(i))}
+			errs <- tagger.TagIf(ctx, "latest", d, createOnly)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	var created int
+	for err := range errs {
+		switch err {
+		case nil:
+			created++
+		case errExists:
+		default:
+			t.Fatalf("unexpected error tagging: %v", err)
+		}
+	}
+	if created != 1 {
+		t.Fatalf("expected the tag to be created once, got %d", created)
+	}
+}
+
 func TestTagStoreUnTag(t *testing.T) {
 	env := testTagStore(t)
 	tags := env.ts
@@ -314,3 +361,64 @@ func digestMap(dgsts []digest.Digest) map[digest.Digest]struct{} {
 	}
 	return set
 }
+
+func TestTagHistory(t *testing.T) {
+	env := testTagStore(t)
+	tagStore := env.ts
+	ctx := context.WithValue(env.ctx, auth.UserNameKey, "alice")
+
+	history, ok := tagStore.(distribution.TagHistoryProvider)
+	if !ok {
+		t.Fatal("tagStore does not implement TagHistoryProvider interface")
+	}
+
+	events, err := history.History(ctx, "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 0 {
+		t.Fatalf("expected no events for an unknown tag, got %v", events)
+	}
+
+	desc0 := distribution.Descriptor{Digest: "sha256:0000000000000000000000000000000000000000000000000000000000000000"}
+	desc1 := distribution.Descriptor{Digest: "sha256:1111111111111111111111111111111111111111111111111111111111111111"}
+	for _, desc := range []distribution.Descriptor{desc0, desc0, desc1} {
+		if err := tagStore.Tag(ctx, "prod", desc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tagStore.Untag(ctx, "prod"); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err = history.History(ctx, "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// tagging the current digest again does not move the tag
+	expected := []distribution.TagEvent{
+		{Action: distribution.TagEventActionTag, Digest: desc0.Digest},
+		{Action: distribution.TagEventActionTag, Digest: desc1.Digest, Previous: desc0.Digest},
+		{Action: distribution.TagEventActionUntag, Previous: desc1.Digest},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events, got %v", len(expected), events)
+	}
+	for i, event := range events {
+		if event.Timestamp.IsZero() {
+			t.Errorf("event %d has no timestamp", i)
+		}
+		if i > 0 && event.Timestamp.Before(events[i-1].Timestamp) {
+			t.Errorf("event %d is out of order", i)
+		}
+		if event.Actor != "alice" {
+			t.Errorf("unexpected actor of event %d: %q", i, event.Actor)
+		}
+		event.Timestamp = expected[i].Timestamp
+		event.Actor = ""
+		if event != expected[i] {
+			t.Errorf("unexpected event %d: %v, expected %v", i, event, expected[i])
+		}
+	}
+}
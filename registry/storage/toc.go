@@ -0,0 +1,538 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+)
+
+// Formats of the seekable layers whose table of contents is indexed.
+const (
+	TOCFormatEstargz     = "estargz"
+	TOCFormatZstdChunked = "zstd:chunked"
+)
+
+// The layer annotations describing the table of contents of seekable layers.
+const (
+	// estargzTOCDigestAnnotation is the digest of the TOC of an eStargz
+	// layer, whose position is read from the footer of the layer.
+	estargzTOCDigestAnnotation = "containerd.io/snapshot/stargz/toc.digest"
+	// zstdChunkedManifestChecksumAnnotation is the digest of the TOC of a
+	// zstd:chunked layer.
+	zstdChunkedManifestChecksumAnnotation = "io.github.containers.zstd-chunked.manifest-checksum"
+	// zstdChunkedManifestPositionAnnotation is the position of the TOC of a
+	// zstd:chunked layer, as offset:length:uncompressed length:type.
+	zstdChunkedManifestPositionAnnotation = "io.github.containers.zstd-chunked.manifest-position"
+)
+
+// The headers describing the table of contents of a seekable blob.
+const (
+	// HeaderTOCDigest is the digest of the table of contents.
+	HeaderTOCDigest = "Docker-Content-TOC-Digest"
+	// HeaderTOCRange is the range of the table of contents in the blob, in
+	// the format of the Range header, so that clients fetch it with a single
+	// request rather than reading the footer of the blob first.
+	HeaderTOCRange = "Docker-Content-TOC-Range"
+	// HeaderTOCFormat is the format of the blob, estargz or zstd:chunked.
+	HeaderTOCFormat = "Docker-Content-TOC-Format"
+	// HeaderTOCChunks is the number of chunks of the blob listed in the
+	// table of contents, which can be fetched with a Range header in the
+	// chunks unit.
+	HeaderTOCChunks = "Docker-Content-TOC-Chunks"
+)
+
+// estargzFooterSize is the size of the footer of eStargz layers, an empty
+// gzip member whose extra field holds the offset of the TOC.
+const estargzFooterSize = 51
+
+// estargzTOCName is the name of the TOC in the tar archive of the TOC
+// member of eStargz layers.
+const estargzTOCName = "stargz.index.json"
+
+// maxTOCSize is the size past which tables of contents are not indexed, as
+// the one of containers/storage.
+const maxTOCSize = 50 << 20
+
+// chunkOffsetSize is the size of each offset of the chunks file, a big
+// endian integer, so that the offsets of a chunk are read at a fixed
+// position.
+const chunkOffsetSize = 8
+
+// chunksRangeUnit is the unit of the Range headers fetching chunks by their
+// index in the table of contents.
+const chunksRangeUnit = "chunks="
+
+// blobTOC describes the table of contents of a seekable blob.
+type blobTOC struct {
+	Format string        `json:"format"`
+	Digest digest.Digest `json:"digest"`
+	Offset int64         `json:"offset"`
+	Length int64         `json:"length"`
+	// Chunks is the number of chunks whose offsets are recorded.
+	Chunks int64 `json:"chunks,omitempty"`
+}
+
+// setHeaders sets the headers describing the table of contents.
+func (toc blobTOC) setHeaders(h http.Header) {
+	h.Set(HeaderTOCDigest, toc.Digest.String())
+	h.Set(HeaderTOCRange, fmt.Sprintf("bytes=%d-%d", toc.Offset, toc.Offset+toc.Length-1))
+	h.Set(HeaderTOCFormat, toc.Format)
+	if toc.Chunks > 0 {
+		h.Set(HeaderTOCChunks, strconv.FormatInt(toc.Chunks, 10))
+	}
+}
+
+// tocEntries holds the entries of an eStargz or zstd:chunked table of
+// contents, of which only the positions of the chunks are read.
+type tocEntries struct {
+	Entries []struct {
+		Type      string `json:"type"`
+		Size      int64  `json:"size"`
+		Offset    int64  `json:"offset"`
+		EndOffset int64  `json:"endOffset"`
+	} `json:"entries"`
+}
+
+// blobTOCIndexer records the position of the table of contents of the
+// seekable layers referenced by the manifests pushed. It is stored next to
+// the blob data, so it is removed along with the blob.
+type blobTOCIndexer struct {
+	driver storagedriver.StorageDriver
+}
+
+// index records the table of contents of the layers of a manifest which
+// have not been indexed yet.
+func (ti *blobTOCIndexer) index(ctx context.Context, manifest distribution.Manifest) error {
+	for _, desc := range manifest.References() {
+		if len(desc.Annotations) == 0 {
+			continue
+		}
+		if _, err := ti.toc(ctx, desc.Digest); err == nil {
+			continue
+		} else if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+			return err
+		}
+
+		toc, ok, err := ti.locate(ctx, desc)
+		if err != nil {
+			return fmt.Errorf("layer %s: %v", desc.Digest, err)
+		}
+		if !ok {
+			continue
+		}
+		// the annotations are set by the clients, while the record is
+		// shared by the repositories of the blob: the TOC is only indexed
+		// if the range of the blob holds it
+		offsets, err := ti.verify(ctx, desc.Digest, toc)
+		if err != nil {
+			return fmt.Errorf("layer %s: %v", desc.Digest, err)
+		}
+		if len(offsets) > 1 {
+			if err := ti.putChunks(ctx, desc.Digest, offsets); err != nil {
+				return err
+			}
+			toc.Chunks = int64(len(offsets) - 1)
+		}
+		if err := ti.putTOC(ctx, desc.Digest, toc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verify reads the table of contents of a blob, checks it hashes to its
+// digest and returns the offsets of the chunks it lists: the start of each
+// chunk, followed by the end of the last one.
+func (ti *blobTOCIndexer) verify(ctx context.Context, dgst digest.Digest, toc blobTOC) ([]int64, error) {
+	if toc.Length > maxTOCSize {
+		return nil, fmt.Errorf("table of contents larger than %d bytes", maxTOCSize)
+	}
+	if !toc.Digest.Algorithm().Available() {
+		return nil, fmt.Errorf("unsupported table of contents digest %s", toc.Digest)
+	}
+	path, err := pathFor(blobDataPathSpec{digest: dgst})
+	if err != nil {
+		return nil, err
+	}
+	rc, err := ti.driver.Reader(ctx, path, toc.Offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	content := make([]byte, toc.Length)
+	if _, err := io.ReadFull(rc, content); err != nil {
+		return nil, err
+	}
+
+	var decoded []byte
+	switch toc.Format {
+	case TOCFormatEstargz:
+		// the digest is the one of the TOC itself, in the tar archive of
+		// the gzip member
+		decoded, err = readEstargzTOC(content)
+		if err != nil {
+			return nil, err
+		}
+		if toc.Digest != toc.Digest.Algorithm().FromBytes(decoded) {
+			return nil, fmt.Errorf("table of contents does not match digest %s", toc.Digest)
+		}
+	case TOCFormatZstdChunked:
+		// the digest is the one of the compressed TOC
+		if toc.Digest != toc.Digest.Algorithm().FromBytes(content) {
+			return nil, fmt.Errorf("table of contents does not match digest %s", toc.Digest)
+		}
+		decoded, err = readZstdChunkedTOC(content)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown table of contents format %q", toc.Format)
+	}
+
+	var entries tocEntries
+	if err := json.Unmarshal(decoded, &entries); err != nil {
+		return nil, fmt.Errorf("invalid table of contents: %v", err)
+	}
+	return chunkOffsets(entries, toc), nil
+}
+
+// chunkOffsets returns the sorted offsets of the chunks listed in entries,
+// followed by the end of the last chunk: the start of the TOC for eStargz,
+// the end of the last entry for zstd:chunked.
+func chunkOffsets(entries tocEntries, toc blobTOC) []int64 {
+	end := toc.Offset
+	if toc.Format == TOCFormatZstdChunked {
+		end = 0
+		for _, entry := range entries.Entries {
+			if entry.EndOffset > end && entry.EndOffset <= toc.Offset {
+				end = entry.EndOffset
+			}
+		}
+	}
+
+	seen := make(map[int64]struct{})
+	var offsets []int64
+	for _, entry := range entries.Entries {
+		// the empty files have no chunk, and their offset is unset
+		switch {
+		case entry.Type != "reg" && entry.Type != "chunk":
+			continue
+		case toc.Format == TOCFormatZstdChunked && entry.EndOffset <= entry.Offset:
+			continue
+		case toc.Format == TOCFormatEstargz && entry.Type == "reg" && entry.Size == 0:
+			continue
+		}
+		if entry.Offset < 0 || entry.Offset >= end {
+			continue
+		}
+		if _, ok := seen[entry.Offset]; ok {
+			continue
+		}
+		seen[entry.Offset] = struct{}{}
+		offsets = append(offsets, entry.Offset)
+	}
+	if len(offsets) == 0 {
+		return nil
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	return append(offsets, end)
+}
+
+// readEstargzTOC returns the TOC held in the gzip member of an eStargz
+// layer.
+func readEstargzTOC(member []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(member))
+	if err != nil {
+		return nil, fmt.Errorf("invalid table of contents: %v", err)
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("invalid table of contents: missing %s", estargzTOCName)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid table of contents: %v", err)
+		}
+		if hdr.Name != estargzTOCName {
+			continue
+		}
+		if hdr.Size > maxTOCSize {
+			return nil, fmt.Errorf("table of contents larger than %d bytes", maxTOCSize)
+		}
+		return io.ReadAll(tr)
+	}
+}
+
+// readZstdChunkedTOC returns the TOC of a zstd:chunked layer, compressed
+// as a zstd frame.
+func readZstdChunkedTOC(compressed []byte) ([]byte, error) {
+	zr, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxTOCSize))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	decoded, err := zr.DecodeAll(compressed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid table of contents: %v", err)
+	}
+	return decoded, nil
+}
+
+// locate returns the table of contents of the layer described by desc, and
+// false if it is not a seekable layer or is not in the blob store.
+func (ti *blobTOCIndexer) locate(ctx context.Context, desc distribution.Descriptor) (blobTOC, bool, error) {
+	if value, ok := desc.Annotations[zstdChunkedManifestChecksumAnnotation]; ok {
+		toc := blobTOC{Format: TOCFormatZstdChunked}
+		dgst, err := digest.Parse(value)
+		if err != nil {
+			return blobTOC{}, false, fmt.Errorf("invalid %s annotation: %v", zstdChunkedManifestChecksumAnnotation, err)
+		}
+		toc.Digest = dgst
+		toc.Offset, toc.Length, err = parseZstdChunkedPosition(desc.Annotations[zstdChunkedManifestPositionAnnotation])
+		if err != nil {
+			return blobTOC{}, false, fmt.Errorf("invalid %s annotation: %v", zstdChunkedManifestPositionAnnotation, err)
+		}
+		size, ok, err := ti.size(ctx, desc.Digest)
+		if err != nil || !ok {
+			return blobTOC{}, false, err
+		}
+		if toc.Offset+toc.Length > size {
+			return blobTOC{}, false, fmt.Errorf("table of contents past the end of the layer")
+		}
+		return toc, true, nil
+	}
+
+	if value, ok := desc.Annotations[estargzTOCDigestAnnotation]; ok {
+		toc := blobTOC{Format: TOCFormatEstargz}
+		dgst, err := digest.Parse(value)
+		if err != nil {
+			return blobTOC{}, false, fmt.Errorf("invalid %s annotation: %v", estargzTOCDigestAnnotation, err)
+		}
+		toc.Digest = dgst
+		size, ok, err := ti.size(ctx, desc.Digest)
+		if err != nil || !ok {
+			return blobTOC{}, false, err
+		}
+		if size < estargzFooterSize {
+			return blobTOC{}, false, fmt.Errorf("layer too small for an eStargz footer")
+		}
+		path, err := pathFor(blobDataPathSpec{digest: desc.Digest})
+		if err != nil {
+			return blobTOC{}, false, err
+		}
+		rc, err := ti.driver.Reader(ctx, path, size-estargzFooterSize)
+		if err != nil {
+			return blobTOC{}, false, err
+		}
+		defer rc.Close()
+		footer := make([]byte, estargzFooterSize)
+		if _, err := io.ReadFull(rc, footer); err != nil {
+			return blobTOC{}, false, err
+		}
+		toc.Offset, err = parseEstargzFooter(footer)
+		if err != nil {
+			return blobTOC{}, false, err
+		}
+		if toc.Offset >= size-estargzFooterSize {
+			return blobTOC{}, false, fmt.Errorf("table of contents past the end of the layer")
+		}
+		// the TOC is the gzip member between its offset and the footer
+		toc.Length = size - estargzFooterSize - toc.Offset
+		return toc, true, nil
+	}
+
+	return blobTOC{}, false, nil
+}
+
+// size returns the size of the data of a blob, and false if it is not in
+// the blob store, as is the case of the foreign layers.
+func (ti *blobTOCIndexer) size(ctx context.Context, dgst digest.Digest) (int64, bool, error) {
+	path, err := pathFor(blobDataPathSpec{digest: dgst})
+	if err != nil {
+		return 0, false, err
+	}
+	fi, err := ti.driver.Stat(ctx, path)
+	switch err.(type) {
+	case nil:
+		return fi.Size(), true, nil
+	case storagedriver.PathNotFoundError:
+		return 0, false, nil
+	}
+	return 0, false, err
+}
+
+// toc returns the table of contents recorded for a blob, or a
+// PathNotFoundError if there is none.
+func (ti *blobTOCIndexer) toc(ctx context.Context, dgst digest.Digest) (blobTOC, error) {
+	path, err := pathFor(blobTOCPathSpec{digest: dgst})
+	if err != nil {
+		return blobTOC{}, err
+	}
+	content, err := ti.driver.GetContent(ctx, path)
+	if err != nil {
+		return blobTOC{}, err
+	}
+	var toc blobTOC
+	if err := json.Unmarshal(content, &toc); err != nil {
+		return blobTOC{}, fmt.Errorf("invalid table of contents of blob %s: %v", dgst, err)
+	}
+	return toc, nil
+}
+
+// putChunks records the offsets of the chunks of a blob.
+func (ti *blobTOCIndexer) putChunks(ctx context.Context, dgst digest.Digest, offsets []int64) error {
+	path, err := pathFor(blobTOCChunksPathSpec{digest: dgst})
+	if err != nil {
+		return err
+	}
+	content := make([]byte, chunkOffsetSize*len(offsets))
+	for i, offset := range offsets {
+		binary.BigEndian.PutUint64(content[chunkOffsetSize*i:], uint64(offset))
+	}
+	return ti.driver.PutContent(ctx, path, content)
+}
+
+// chunkRange returns the byte range of the chunks first to last of a blob,
+// reading only their offsets from the chunks file.
+func (ti *blobTOCIndexer) chunkRange(ctx context.Context, dgst digest.Digest, first, last int64) (int64, int64, error) {
+	path, err := pathFor(blobTOCChunksPathSpec{digest: dgst})
+	if err != nil {
+		return 0, 0, err
+	}
+	readOffset := func(index int64) (int64, error) {
+		rc, err := ti.driver.Reader(ctx, path, chunkOffsetSize*index)
+		if err != nil {
+			return 0, err
+		}
+		defer rc.Close()
+		var b [chunkOffsetSize]byte
+		if _, err := io.ReadFull(rc, b[:]); err != nil {
+			return 0, err
+		}
+		return int64(binary.BigEndian.Uint64(b[:])), nil
+	}
+	start, err := readOffset(first)
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := readOffset(last + 1)
+	if err != nil {
+		return 0, 0, err
+	}
+	return start, end - 1, nil
+}
+
+// chunkRanges translates a Range header in the chunks unit, such as
+// "chunks=0-3,7-7", to the byte ranges of the chunks of a blob. It returns
+// false if the header is not in the chunks unit or is not satisfiable.
+func (ti *blobTOCIndexer) chunkRanges(ctx context.Context, dgst digest.Digest, toc blobTOC, header string) (string, bool, error) {
+	if toc.Chunks == 0 || !strings.HasPrefix(header, chunksRangeUnit) {
+		return "", false, nil
+	}
+	var ranges []string
+	for _, spec := range strings.Split(strings.TrimPrefix(header, chunksRangeUnit), ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		firstValue, lastValue, ok := strings.Cut(spec, "-")
+		if !ok {
+			return "", false, nil
+		}
+		first, err := strconv.ParseInt(firstValue, 10, 64)
+		if err != nil || first < 0 || first >= toc.Chunks {
+			return "", false, nil
+		}
+		last := toc.Chunks - 1
+		if lastValue != "" {
+			if last, err = strconv.ParseInt(lastValue, 10, 64); err != nil || last < first {
+				return "", false, nil
+			}
+			if last >= toc.Chunks {
+				last = toc.Chunks - 1
+			}
+		}
+		start, end, err := ti.chunkRange(ctx, dgst, first, last)
+		if err != nil {
+			return "", false, err
+		}
+		ranges = append(ranges, fmt.Sprintf("%d-%d", start, end))
+	}
+	if len(ranges) == 0 {
+		return "", false, nil
+	}
+	return "bytes=" + strings.Join(ranges, ","), true, nil
+}
+
+func (ti *blobTOCIndexer) putTOC(ctx context.Context, dgst digest.Digest, toc blobTOC) error {
+	dcontext.GetLogger(ctx).Debugf("(*blobTOCIndexer).putTOC %s %s", dgst, toc.Format)
+	path, err := pathFor(blobTOCPathSpec{digest: dgst})
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(toc)
+	if err != nil {
+		return err
+	}
+	return ti.driver.PutContent(ctx, path, content)
+}
+
+// parseEstargzFooter returns the offset of the TOC held in the extra field
+// of the footer of an eStargz layer, a subfield with the ID "SG" whose
+// payload is the offset in 16 hexadecimal digits followed by "STARGZ".
+func parseEstargzFooter(footer []byte) (int64, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(footer))
+	if err != nil {
+		return 0, fmt.Errorf("invalid eStargz footer: %v", err)
+	}
+	defer zr.Close()
+
+	extra := zr.Header.Extra
+	if len(extra) < 4 || extra[0] != 'S' || extra[1] != 'G' || int(binary.LittleEndian.Uint16(extra[2:4])) != len(extra)-4 {
+		return 0, fmt.Errorf("invalid eStargz footer: missing SG extra field")
+	}
+	payload := string(extra[4:])
+	if len(payload) != 22 || !strings.HasSuffix(payload, "STARGZ") {
+		return 0, fmt.Errorf("invalid eStargz footer: invalid SG extra field")
+	}
+	offset, err := strconv.ParseInt(payload[:16], 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid eStargz footer: %v", err)
+	}
+	return offset, nil
+}
+
+// parseZstdChunkedPosition returns the offset and length of the TOC of a
+// zstd:chunked layer from the value of its position annotation.
+func parseZstdChunkedPosition(position string) (int64, int64, error) {
+	fields := strings.Split(position, ":")
+	if len(fields) != 4 {
+		return 0, 0, fmt.Errorf("expected offset:length:uncompressed length:type, got %q", position)
+	}
+	offset, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || offset < 0 {
+		return 0, 0, fmt.Errorf("invalid offset %q", fields[0])
+	}
+	length, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || length <= 0 {
+		return 0, 0, fmt.Errorf("invalid length %q", fields[1])
+	}
+	return offset, length, nil
+}
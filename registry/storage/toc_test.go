@@ -0,0 +1,238 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// estargzFooter returns the footer of an eStargz layer whose TOC starts at
+// the given offset: an empty gzip member with the offset in its extra field,
+// compressed as a stored block.
+func estargzFooter(offset int64) []byte {
+	payload := fmt.Sprintf("%016xSTARGZ", offset)
+	extra := []byte{'S', 'G', 0, 0}
+	binary.LittleEndian.PutUint16(extra[2:], uint16(len(payload)))
+	extra = append(extra, payload...)
+
+	footer := []byte{0x1f, 0x8b, 8, 4, 0, 0, 0, 0, 0, 0xff, 0, 0}
+	binary.LittleEndian.PutUint16(footer[10:], uint16(len(extra)))
+	footer = append(footer, extra...)
+	footer = append(footer, 1, 0, 0, 0xff, 0xff)
+	return append(footer, 0, 0, 0, 0, 0, 0, 0, 0)
+}
+
+func TestParseEstargzFooter(t *testing.T) {
+	if size := len(estargzFooter(0)); size != estargzFooterSize {
+		t.Fatalf("unexpected footer size %d", size)
+	}
+
+	offset, err := parseEstargzFooter(estargzFooter(0x12345))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != 0x12345 {
+		t.Errorf("expected offset %d, got %d", 0x12345, offset)
+	}
+
+	if _, err := parseEstargzFooter(bytes.Repeat([]byte{0}, estargzFooterSize)); err == nil {
+		t.Error("expected error parsing invalid footer")
+	}
+}
+
+// estargzTOCMember returns the gzip member holding the TOC of an eStargz
+// layer, a tar archive of the TOC.
+func estargzTOCMember(t *testing.T, toc []byte) []byte {
+	var member bytes.Buffer
+	zw := gzip.NewWriter(&member)
+	tw := tar.NewWriter(zw)
+	if err := tw.WriteHeader(&tar.Header{Name: estargzTOCName, Mode: 0o644, Size: int64(len(toc))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(toc); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return member.Bytes()
+}
+
+// TestServeBlobTOC ensures the table of contents of the seekable layers is
+// verified and indexed on manifest push, and served in the blob headers.
+func TestServeBlobTOC(t *testing.T) {
+	ctx := context.Background()
+	registry := createRegistry(t, inmemory.New(), EnableBlobTOC)
+	repo := makeRepository(t, registry, "test")
+	manifestService := makeManifestService(t, repo)
+	bs := repo.Blobs(ctx)
+
+	config, err := bs.Put(ctx, v1.MediaTypeImageConfig, []byte("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunkA := bytes.Repeat([]byte("a"), 100)
+	chunkB := bytes.Repeat([]byte("b"), 200)
+	estargzTOC := []byte(`{"version":1,"entries":[{"name":"dir/","type":"dir"},{"name":"dir/a","type":"reg","size":100,"offset":0},{"name":"dir/b","type":"reg","size":200,"offset":100},{"name":"dir/empty","type":"reg"}]}`)
+	tocMember := estargzTOCMember(t, estargzTOC)
+	estargz := append(append(append(append([]byte{}, chunkA...), chunkB...), tocMember...), estargzFooter(300)...)
+	estargzLayer, err := bs.Put(ctx, v1.MediaTypeImageLayerGzip, estargz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	estargzLayer.Annotations = map[string]string{
+		estargzTOCDigestAnnotation: digest.FromBytes(estargzTOC).String(),
+	}
+
+	zstdChunkedTOC := []byte(`{"version":1,"entries":[{"type":"reg","name":"a","size":250,"offset":0,"endOffset":250},{"type":"reg","name":"b","size":350,"offset":250,"endOffset":600}]}`)
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressedTOC := encoder.EncodeAll(zstdChunkedTOC, nil)
+	zstdChunked := append(append(bytes.Repeat([]byte("c"), 600), compressedTOC...), bytes.Repeat([]byte("f"), 40)...)
+	zstdChunkedLayer, err := bs.Put(ctx, "application/vnd.oci.image.layer.v1.tar+zstd", zstdChunked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zstdChunkedLayer.Annotations = map[string]string{
+		zstdChunkedManifestChecksumAnnotation: digest.FromBytes(compressedTOC).String(),
+		zstdChunkedManifestPositionAnnotation: fmt.Sprintf("600:%d:%d:1", len(compressedTOC), len(zstdChunkedTOC)),
+	}
+
+	plainLayer, err := bs.Put(ctx, v1.MediaTypeImageLayerGzip, []byte("plain"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the annotations of these layers do not match their content
+	forgedLayer, err := bs.Put(ctx, v1.MediaTypeImageLayerGzip, append(append([]byte("forged"), tocMember...), estargzFooter(6)...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	forgedLayer.Annotations = map[string]string{
+		estargzTOCDigestAnnotation: digest.FromString("forged").String(),
+	}
+	misplacedLayer, err := bs.Put(ctx, "application/vnd.oci.image.layer.v1.tar+zstd", zstdChunked[10:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	misplacedLayer.Annotations = zstdChunkedLayer.Annotations
+
+	for _, layers := range [][]distribution.Descriptor{
+		{estargzLayer, zstdChunkedLayer, plainLayer},
+		{forgedLayer},
+		{misplacedLayer},
+	} {
+		m, err := ocischema.FromStruct(ocischema.Manifest{
+			Versioned: manifest.Versioned{
+				SchemaVersion: 2,
+				MediaType:     v1.MediaTypeImageManifest,
+			},
+			Config: config,
+			Layers: layers,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := manifestService.Put(ctx, m); err != nil {
+			t.Fatalf("unexpected error putting manifest: %v", err)
+		}
+	}
+
+	for _, tc := range []struct {
+		layer  distribution.Descriptor
+		digest string
+		rng    string
+		format string
+		chunks string
+	}{
+		{
+			layer:  estargzLayer,
+			digest: digest.FromBytes(estargzTOC).String(),
+			rng:    fmt.Sprintf("bytes=300-%d", 300+len(tocMember)-1),
+			format: TOCFormatEstargz,
+			chunks: "2",
+		},
+		{
+			layer:  zstdChunkedLayer,
+			digest: digest.FromBytes(compressedTOC).String(),
+			rng:    fmt.Sprintf("bytes=600-%d", 600+len(compressedTOC)-1),
+			format: TOCFormatZstdChunked,
+			chunks: "2",
+		},
+		{
+			layer: plainLayer,
+		},
+		{
+			layer: forgedLayer,
+		},
+		{
+			layer: misplacedLayer,
+		},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodHead, "/", nil)
+		if err := bs.ServeBlob(ctx, w, r, tc.layer.Digest); err != nil {
+			t.Fatalf("unexpected error serving blob: %v", err)
+		}
+		if got := w.Header().Get(HeaderTOCDigest); got != tc.digest {
+			t.Errorf("%s: expected TOC digest %q, got %q", tc.layer.Digest, tc.digest, got)
+		}
+		if got := w.Header().Get(HeaderTOCRange); got != tc.rng {
+			t.Errorf("%s: expected TOC range %q, got %q", tc.layer.Digest, tc.rng, got)
+		}
+		if got := w.Header().Get(HeaderTOCFormat); got != tc.format {
+			t.Errorf("%s: expected TOC format %q, got %q", tc.layer.Digest, tc.format, got)
+		}
+		if got := w.Header().Get(HeaderTOCChunks); got != tc.chunks {
+			t.Errorf("%s: expected %q chunks, got %q", tc.layer.Digest, tc.chunks, got)
+		}
+	}
+
+	// the chunks are fetched by their index
+	for _, tc := range []struct {
+		layer    distribution.Descriptor
+		rng      string
+		status   int
+		expected []byte
+	}{
+		{estargzLayer, "chunks=1-1", http.StatusPartialContent, chunkB},
+		{estargzLayer, "chunks=0-", http.StatusPartialContent, append(append([]byte{}, chunkA...), chunkB...)},
+		{zstdChunkedLayer, "chunks=1-1", http.StatusPartialContent, zstdChunked[250:600]},
+		{estargzLayer, "chunks=2-2", http.StatusRequestedRangeNotSatisfiable, nil},
+		{plainLayer, "chunks=0-0", http.StatusRequestedRangeNotSatisfiable, nil},
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Range", tc.rng)
+		if err := bs.ServeBlob(ctx, w, r, tc.layer.Digest); err != nil {
+			t.Fatalf("unexpected error serving blob: %v", err)
+		}
+		if w.Code != tc.status {
+			t.Errorf("%s %s: expected status %d, got %d", tc.layer.Digest, tc.rng, tc.status, w.Code)
+			continue
+		}
+		if tc.expected != nil && !bytes.Equal(w.Body.Bytes(), tc.expected) {
+			t.Errorf("%s %s: unexpected body %q", tc.layer.Digest, tc.rng, w.Body.Bytes())
+		}
+	}
+}
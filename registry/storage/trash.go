@@ -0,0 +1,320 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/auth"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+)
+
+var _ distribution.RepositoryTrash = &repository{}
+
+// trashEntryIDRegexp matches the identifiers of the trash entries, which are
+// the names of their files.
+var trashEntryIDRegexp = regexp.MustCompile(`^[0-9]{20}-[0-9a-f]{16}$`)
+
+// trash records the manifests, tags and blobs deleted from the repositories
+// when soft deletion is enabled. Deleted objects are unlinked from their
+// repository as usual, and their content is kept by the garbage collections
+// until the entry expires, so that they can be restored by linking them
+// again.
+type trash struct {
+	driver    storagedriver.StorageDriver
+	retention time.Duration
+}
+
+// add records the deletion of an object from the named repository,
+// returning the identifier of the entry.
+func (t *trash) add(ctx context.Context, name string, entry distribution.TrashEntry) (string, error) {
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", err
+	}
+
+	entry.Actor = dcontext.GetStringValue(ctx, auth.UserNameKey)
+	entry.DeletedAt = time.Now().UTC()
+	entry.ExpiresAt = entry.DeletedAt.Add(t.retention)
+	entry.ID = fmt.Sprintf("%020d-%s", entry.DeletedAt.UnixNano(), hex.EncodeToString(id[:]))
+
+	entryPath, err := pathFor(manifestTrashEntryPathSpec{name: name, id: entry.ID})
+	if err != nil {
+		return "", err
+	}
+
+	content, err := json.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+
+	if err := t.driver.PutContent(ctx, entryPath, content); err != nil {
+		return "", err
+	}
+	return entry.ID, nil
+}
+
+// entries returns the entries of the trash of the named repository, from the
+// oldest to the most recent one.
+func (t *trash) entries(ctx context.Context, name string) ([]distribution.TrashEntry, error) {
+	trashPath, err := pathFor(manifestTrashPathSpec{name: name})
+	if err != nil {
+		return nil, err
+	}
+
+	paths, err := t.driver.List(ctx, trashPath)
+	if err != nil {
+		switch err.(type) {
+		case storagedriver.PathNotFoundError:
+			return nil, nil
+		default:
+			return nil, err
+		}
+	}
+
+	// entries are named after the time of the deletion
+	sort.Strings(paths)
+
+	entries := make([]distribution.TrashEntry, 0, len(paths))
+	for _, p := range paths {
+		entry, err := t.read(ctx, p)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// get returns the entry of the trash of the named repository with the given
+// identifier.
+func (t *trash) get(ctx context.Context, name, id string) (distribution.TrashEntry, error) {
+	entryPath, err := t.entryPath(name, id)
+	if err != nil {
+		return distribution.TrashEntry{}, err
+	}
+
+	entry, err := t.read(ctx, entryPath)
+	if err != nil {
+		switch err.(type) {
+		case storagedriver.PathNotFoundError:
+			return distribution.TrashEntry{}, distribution.ErrTrashEntryUnknown
+		default:
+			return distribution.TrashEntry{}, err
+		}
+	}
+	return entry, nil
+}
+
+// remove removes the entry from the trash of the named repository.
+func (t *trash) remove(ctx context.Context, name, id string) error {
+	entryPath, err := t.entryPath(name, id)
+	if err != nil {
+		return err
+	}
+
+	if err := t.driver.Delete(ctx, entryPath); err != nil {
+		switch err.(type) {
+		case storagedriver.PathNotFoundError:
+			return distribution.ErrTrashEntryUnknown
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *trash) entryPath(name, id string) (string, error) {
+	if !trashEntryIDRegexp.MatchString(id) {
+		return "", distribution.ErrTrashEntryUnknown
+	}
+	return pathFor(manifestTrashEntryPathSpec{name: name, id: id})
+}
+
+func (t *trash) read(ctx context.Context, entryPath string) (distribution.TrashEntry, error) {
+	content, err := t.driver.GetContent(ctx, entryPath)
+	if err != nil {
+		return distribution.TrashEntry{}, err
+	}
+
+	var entry distribution.TrashEntry
+	if err := json.Unmarshal(content, &entry); err != nil {
+		return distribution.TrashEntry{}, fmt.Errorf("invalid trash entry %s: %v", entryPath, err)
+	}
+
+	// the retention may have changed since the deletion
+	entry.ExpiresAt = entry.DeletedAt.Add(t.retention)
+	return entry, nil
+}
+
+// Trash returns the entries of the trash of the repository.
+func (repo *repository) Trash(ctx context.Context) ([]distribution.TrashEntry, error) {
+	if repo.trash == nil {
+		return nil, distribution.ErrUnsupported
+	}
+	return repo.trash.entries(ctx, repo.name.Name())
+}
+
+// Restore links the deleted manifest, tag or blob into the repository
+// again, and removes its entry from the trash. The tags deleted along with a
+// manifest are only restored if they were not pushed again since, while a
+// restored tag is moved back to the manifest it pointed to.
+func (repo *repository) Restore(ctx context.Context, id string) error {
+	if repo.trash == nil {
+		return distribution.ErrUnsupported
+	}
+
+	entry, err := repo.trash.get(ctx, repo.name.Name(), id)
+	if err != nil {
+		return err
+	}
+
+	switch entry.Kind {
+	case distribution.TrashEntryManifest:
+		err = repo.restoreManifest(ctx, entry.Digest, entry.Tags)
+	case distribution.TrashEntryTag:
+		err = repo.restoreManifest(ctx, entry.Digest, nil)
+		if err == nil {
+			err = repo.Tags(ctx).Tag(ctx, entry.Tag, distribution.Descriptor{Digest: entry.Digest})
+		}
+	case distribution.TrashEntryBlob:
+		err = repo.restoreBlob(ctx, entry.Digest)
+	default:
+		err = fmt.Errorf("unknown kind of trash entry %s: %q", id, entry.Kind)
+	}
+	if err != nil {
+		return err
+	}
+
+	dcontext.GetLogger(ctx).Infof("restored %s %s from the trash of %s", entry.Kind, entry.Digest, repo.name.Name())
+	return repo.trash.remove(ctx, repo.name.Name(), id)
+}
+
+// Purge removes the entry from the trash of the repository.
+func (repo *repository) Purge(ctx context.Context, id string) error {
+	if repo.trash == nil {
+		return distribution.ErrUnsupported
+	}
+	return repo.trash.remove(ctx, repo.name.Name(), id)
+}
+
+// restoreManifest links the manifest into the repository again, unless it
+// still is, along with its referrer link, and restores the given tags which
+// do not exist.
+func (repo *repository) restoreManifest(ctx context.Context, dgst digest.Digest, tags []string) error {
+	desc, err := repo.blobStore.statter.Stat(ctx, dgst)
+	if err != nil {
+		return err
+	}
+
+	manifests, err := repo.Manifests(ctx)
+	if err != nil {
+		return err
+	}
+	ms := manifests.(*manifestStore)
+
+	if _, err := ms.blobStore.Stat(ctx, dgst); err == distribution.ErrBlobUnknown {
+		if err := ms.blobStore.linkBlob(ctx, desc); err != nil {
+			return err
+		}
+
+		manifest, err := ms.Get(ctx, dgst)
+		if err != nil {
+			return err
+		}
+		if subject := manifestSubject(manifest); subject != nil {
+			if err := ms.linkReferrer(ctx, subject.Digest, dgst); err != nil {
+				return err
+			}
+		}
+	} else if err != nil {
+		return err
+	}
+
+	tagService := repo.Tags(ctx)
+	for _, tag := range tags {
+		if _, err := tagService.Get(ctx, tag); err == nil {
+			continue
+		} else if _, ok := err.(distribution.ErrTagUnknown); !ok {
+			return err
+		}
+		if err := tagService.Tag(ctx, tag, desc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreBlob links the blob into the repository again.
+func (repo *repository) restoreBlob(ctx context.Context, dgst digest.Digest) error {
+	desc, err := repo.blobStore.statter.Stat(ctx, dgst)
+	if err != nil {
+		return err
+	}
+	return repo.Blobs(ctx).(*linkedBlobStore).linkBlob(ctx, desc)
+}
+
+// trashedContent returns the manifests and blobs referenced by the entries
+// of the trash of the repository which did not expire at the given time,
+// which must be kept by garbage collections, and the identifiers of the
+// expired entries.
+func trashedContent(ctx context.Context, r distribution.Repository, now time.Time) ([]digest.Digest, []string, error) {
+	repo, ok := r.(*repository)
+	if !ok || repo.trash == nil {
+		return nil, nil, nil
+	}
+
+	entries, err := repo.trash.entries(ctx, repo.name.Name())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		digests []digest.Digest
+		expired []string
+		ms      *manifestStore
+	)
+	for _, entry := range entries {
+		if now.After(entry.ExpiresAt) {
+			expired = append(expired, entry.ID)
+			continue
+		}
+
+		digests = append(digests, entry.Digest)
+		if entry.Kind == distribution.TrashEntryBlob {
+			continue
+		}
+
+		// the manifest is no longer linked, it is read from the blob store
+		content, err := repo.blobStore.Get(ctx, entry.Digest)
+		if err != nil {
+			if err == distribution.ErrBlobUnknown {
+				continue
+			}
+			return nil, nil, err
+		}
+		if ms == nil {
+			manifests, err := repo.Manifests(ctx)
+			if err != nil {
+				return nil, nil, err
+			}
+			ms = manifests.(*manifestStore)
+		}
+		manifest, err := ms.unmarshal(ctx, entry.Digest, content)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read trashed manifest %s: %v", entry.Digest, err)
+		}
+		for _, descriptor := range manifest.References() {
+			digests = append(digests, descriptor.Digest)
+		}
+	}
+	return digests, expired, nil
+}
@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+)
+
+func TestSoftDeleteRestore(t *testing.T) {
+	ctx := context.Background()
+	registry := createRegistry(t, inmemory.New(), EnableSoftDelete(time.Hour))
+	repo := makeRepository(t, registry, "foo/trash")
+	trash := repo.(distribution.RepositoryTrash)
+	manifests := makeManifestService(t, repo)
+	tags := repo.Tags(ctx)
+
+	image := uploadRandomSchema2Image(t, repo)
+	desc := distribution.Descriptor{Digest: image.manifestDigest}
+	for _, tag := range []string{"latest", "stable"} {
+		if err := tags.Tag(ctx, tag, desc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// deleting a tag
+	if err := tags.Untag(ctx, "stable"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := trash.Trash(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Kind != distribution.TrashEntryTag || entries[0].Tag != "stable" || entries[0].Digest != image.manifestDigest {
+		t.Fatalf("unexpected trash entries after deleting a tag: %+v", entries)
+	}
+	if expiry := entries[0].ExpiresAt.Sub(entries[0].DeletedAt); expiry != time.Hour {
+		t.Fatalf("unexpected expiry of trash entry: %v", expiry)
+	}
+	if err := trash.Restore(ctx, entries[0].ID); err != nil {
+		t.Fatalf("unexpected error restoring tag: %v", err)
+	}
+	if d, err := tags.Get(ctx, "stable"); err != nil || d.Digest != image.manifestDigest {
+		t.Fatalf("tag was not restored: %v, %v", d, err)
+	}
+	if err := trash.Restore(ctx, entries[0].ID); err != distribution.ErrTrashEntryUnknown {
+		t.Fatalf("unexpected error restoring a restored entry: %v", err)
+	}
+
+	// deleting the manifest, then its tags as the API does
+	if err := manifests.Delete(ctx, image.manifestDigest); err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range []string{"latest", "stable"} {
+		if err := tags.Untag(ctx, tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err = trash.Trash(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Kind != distribution.TrashEntryManifest || len(entries[0].Tags) != 2 {
+		t.Fatalf("unexpected trash entries after deleting a manifest: %+v", entries)
+	}
+	if exists, _ := manifests.Exists(ctx, image.manifestDigest); exists {
+		t.Fatal("deleted manifest exists")
+	}
+
+	if err := trash.Restore(ctx, entries[0].ID); err != nil {
+		t.Fatalf("unexpected error restoring manifest: %v", err)
+	}
+	if _, err := manifests.Get(ctx, image.manifestDigest); err != nil {
+		t.Fatalf("manifest was not restored: %v", err)
+	}
+	all, err := tags.All(ctx)
+	if err != nil || len(all) != 2 {
+		t.Fatalf("tags were not restored: %v, %v", all, err)
+	}
+
+	// deleting a layer
+	blobs := repo.Blobs(ctx)
+	layer := getAnyKey(image.layers)
+	if err := blobs.Delete(ctx, layer); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := blobs.Stat(ctx, layer); err != distribution.ErrBlobUnknown {
+		t.Fatalf("deleted layer exists: %v", err)
+	}
+	entries, err = trash.Trash(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Kind != distribution.TrashEntryBlob || entries[0].Digest != layer {
+		t.Fatalf("unexpected trash entries after deleting a layer: %+v", entries)
+	}
+	if err := trash.Restore(ctx, entries[0].ID); err != nil {
+		t.Fatalf("unexpected error restoring layer: %v", err)
+	}
+	if _, err := blobs.Stat(ctx, layer); err != nil {
+		t.Fatalf("layer was not restored: %v", err)
+	}
+
+	// purging an entry
+	if err := tags.Untag(ctx, "latest"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err = trash.Trash(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := trash.Purge(ctx, entries[0].ID); err != nil {
+		t.Fatalf("unexpected error purging entry: %v", err)
+	}
+	if entries, err := trash.Trash(ctx); err != nil || len(entries) != 0 {
+		t.Fatalf("unexpected trash entries after purge: %v, %v", entries, err)
+	}
+	if err := trash.Purge(ctx, "../../tags/stable"); err != distribution.ErrTrashEntryUnknown {
+		t.Fatalf("unexpected error purging an invalid entry: %v", err)
+	}
+}
+
+func TestSoftDeleteGarbageCollection(t *testing.T) {
+	ctx := context.Background()
+	inmemoryDriver := inmemory.New()
+
+	for _, tc := range []struct {
+		retention time.Duration
+		kept      bool
+	}{
+		{retention: time.Hour, kept: true},
+		{retention: time.Nanosecond, kept: false},
+	} {
+		registry := createRegistry(t, inmemoryDriver, EnableSoftDelete(tc.retention))
+		repo := makeRepository(t, registry, "foo/trashgc")
+		manifests := makeManifestService(t, repo)
+
+		image := uploadRandomSchema2Image(t, repo)
+		if err := manifests.Delete(ctx, image.manifestDigest); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+
+		if err := MarkAndSweep(ctx, inmemoryDriver, registry, GCOpts{Quiet: true}); err != nil {
+			t.Fatalf("failed mark and sweep: %v", err)
+		}
+
+		blobs := allBlobs(t, registry)
+		if _, ok := blobs[image.manifestDigest]; ok != tc.kept {
+			t.Fatalf("retention %v: unexpected presence of the manifest: %t", tc.retention, ok)
+		}
+		for layer := range image.layers {
+			if _, ok := blobs[layer]; ok != tc.kept {
+				t.Fatalf("retention %v: unexpected presence of layer %s: %t", tc.retention, layer, ok)
+			}
+		}
+
+		entries, err := repo.(distribution.RepositoryTrash).Trash(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kept := len(entries) == 1; kept != tc.kept {
+			t.Fatalf("retention %v: unexpected trash entries: %+v", tc.retention, entries)
+		}
+
+		if tc.kept {
+			if err := repo.(distribution.RepositoryTrash).Restore(ctx, entries[0].ID); err != nil {
+				t.Fatalf("unexpected error restoring manifest: %v", err)
+			}
+			if _, err := manifests.Get(ctx, image.manifestDigest); err != nil {
+				t.Fatalf("manifest was not restored: %v", err)
+			}
+			if err := manifests.Delete(ctx, image.manifestDigest); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
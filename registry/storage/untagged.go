@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"context"
+	"sort"
+
+	"github.com/distribution/distribution/v3"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+)
+
+var _ distribution.UntaggedManifestLister = &manifestStore{}
+
+// Untagged returns the manifests of the repository which are neither tagged
+// nor referenced by a tagged manifest, such as the images of a tagged index,
+// in the order of their digests. Only the tags and the revisions of the
+// repository are read, along with the tagged manifests and the untagged ones.
+func (ms *manifestStore) Untagged(ctx context.Context) ([]distribution.UntaggedManifest, error) {
+	repoName := ms.repository.Named().Name()
+
+	// the references of the manifests which are revisions of the
+	// repository are manifests, the others are blobs
+	var revisions []digest.Digest
+	isRevision := make(map[digest.Digest]struct{})
+	err := ms.Enumerate(ctx, func(dgst digest.Digest) error {
+		revisions = append(revisions, dgst)
+		isRevision[dgst] = struct{}{}
+		return nil
+	})
+	if _, ok := err.(storagedriver.PathNotFoundError); !ok && err != nil {
+		return nil, err
+	}
+
+	tagService := ms.repository.Tags(ctx)
+	tags, err := tagService.All(ctx)
+	if err != nil {
+		if _, ok := err.(distribution.ErrRepositoryUnknown); !ok {
+			return nil, err
+		}
+	}
+
+	tagged := make(map[digest.Digest]struct{})
+	var markTagged func(dgst digest.Digest) error
+	markTagged = func(dgst digest.Digest) error {
+		if _, ok := tagged[dgst]; ok {
+			return nil
+		}
+		tagged[dgst] = struct{}{}
+		if _, ok := isRevision[dgst]; !ok {
+			return nil
+		}
+		manifest, err := ms.Get(ctx, dgst)
+		if err != nil {
+			if _, ok := err.(distribution.ErrManifestUnknownRevision); ok {
+				return nil
+			}
+			return err
+		}
+		for _, desc := range manifest.References() {
+			if err := markTagged(desc.Digest); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, tag := range tags {
+		desc, err := tagService.Get(ctx, tag)
+		if err != nil {
+			if _, ok := err.(distribution.ErrTagUnknown); ok {
+				// the tag was removed meanwhile
+				continue
+			}
+			return nil, err
+		}
+		if err := markTagged(desc.Digest); err != nil {
+			return nil, err
+		}
+	}
+
+	var digests []digest.Digest
+	for _, dgst := range revisions {
+		if _, ok := tagged[dgst]; !ok {
+			digests = append(digests, dgst)
+		}
+	}
+	sort.Slice(digests, func(i, j int) bool {
+		return digests[i] < digests[j]
+	})
+
+	untagged := make([]distribution.UntaggedManifest, 0, len(digests))
+	for _, dgst := range digests {
+		revisionPath, err := manifestRevisionLinkPath(repoName, dgst)
+		if err != nil {
+			return nil, err
+		}
+		fi, err := ms.repository.driver.Stat(ctx, revisionPath)
+		if err != nil {
+			if _, ok := err.(storagedriver.PathNotFoundError); ok {
+				// deleted meanwhile
+				continue
+			}
+			return nil, err
+		}
+		manifest, err := ms.Get(ctx, dgst)
+		if err != nil {
+			if _, ok := err.(distribution.ErrManifestUnknownRevision); ok {
+				continue
+			}
+			return nil, err
+		}
+		mediaType, _, err := manifest.Payload()
+		if err != nil {
+			return nil, err
+		}
+
+		m := distribution.UntaggedManifest{
+			Digest:    dgst,
+			MediaType: mediaType,
+			Created:   fi.ModTime(),
+		}
+		if subject := manifestSubject(manifest); subject != nil {
+			m.Subject = subject.Digest
+		}
+		untagged = append(untagged, m)
+	}
+	return untagged, nil
+}
@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"context"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest"
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// TestUntagged ensures the images of a tagged index are not listed as
+// untagged, unlike the manifests no tag references.
+func TestUntagged(t *testing.T) {
+	ctx := context.Background()
+	registry := createRegistry(t, inmemory.New())
+	repo := makeRepository(t, registry, "untagged")
+	manifestService := makeManifestService(t, repo)
+
+	lister, ok := manifestService.(distribution.UntaggedManifestLister)
+	if !ok {
+		t.Fatal("manifest service does not list untagged manifests")
+	}
+	untagged, err := lister.Untagged(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error listing untagged manifests of an empty repository: %v", err)
+	}
+	if len(untagged) != 0 {
+		t.Fatalf("unexpected untagged manifests %v", untagged)
+	}
+
+	putImage := func(config string) distribution.Descriptor {
+		configDesc, err := repo.Blobs(ctx).Put(ctx, v1.MediaTypeImageConfig, []byte(config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := ocischema.FromStruct(ocischema.Manifest{
+			Versioned: manifest.Versioned{
+				SchemaVersion: 2,
+				MediaType:     v1.MediaTypeImageManifest,
+			},
+			Config: configDesc,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dgst, err := manifestService.Put(ctx, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, payload, _ := m.Payload()
+		return distribution.Descriptor{MediaType: v1.MediaTypeImageManifest, Digest: dgst, Size: int64(len(payload))}
+	}
+
+	image := putImage(`{"v":1}`)
+	leftover := putImage(`{"v":2}`)
+
+	index, err := manifestlist.FromDescriptorsWithMediaType([]manifestlist.ManifestDescriptor{{Descriptor: image}}, v1.MediaTypeImageIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexDigest, err := manifestService.Put(ctx, index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Tags(ctx).Tag(ctx, "latest", distribution.Descriptor{Digest: indexDigest}); err != nil {
+		t.Fatal(err)
+	}
+
+	untagged, err = lister.Untagged(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error listing untagged manifests: %v", err)
+	}
+	if len(untagged) != 1 || untagged[0].Digest != leftover.Digest {
+		t.Fatalf("expected %s only to be untagged, got %v", leftover.Digest, untagged)
+	}
+	if untagged[0].MediaType != v1.MediaTypeImageManifest || untagged[0].Created.IsZero() {
+		t.Errorf("unexpected untagged manifest %+v", untagged[0])
+	}
+	if untagged[0].Subject != digest.Digest("") {
+		t.Errorf("unexpected subject %s", untagged[0].Subject)
+	}
+}
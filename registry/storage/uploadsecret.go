@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/lock"
+)
+
+// uploadSecretSize is the number of random bytes of a generated upload
+// secret.
+const uploadSecretSize = 32
+
+// UploadSecret returns the secret signing the state of the blob uploads,
+// which is saved with the driver so that the registry instances sharing the
+// storage accept the uploads started on each other, and across restarts. The
+// secret is generated the first time it is requested, under the lock of
+// locker if it is not nil. Without a locker, a generated secret is read back
+// after a delay and the one stored is adopted, so that the instances
+// generating it concurrently settle on the last one saved.
+func UploadSecret(ctx context.Context, d driver.StorageDriver, locker lock.Locker) (string, error) {
+	secretPath, err := pathFor(uploadSecretPathSpec{})
+	if err != nil {
+		return "", err
+	}
+
+	if locker != nil {
+		unlock, err := locker.Lock(ctx, "upload-secret")
+		if err != nil {
+			return "", err
+		}
+		defer unlock()
+	}
+
+	secret, err := d.GetContent(ctx, secretPath)
+	if err == nil && len(secret) > 0 {
+		return string(secret), nil
+	}
+	if _, ok := err.(driver.PathNotFoundError); err != nil && !ok {
+		return "", err
+	}
+
+	var secretBytes [uploadSecretSize]byte
+	if _, err := rand.Read(secretBytes[:]); err != nil {
+		return "", err
+	}
+	if err := d.PutContent(ctx, secretPath, []byte(hex.EncodeToString(secretBytes[:]))); err != nil {
+		return "", err
+	}
+	if locker != nil {
+		return hex.EncodeToString(secretBytes[:]), nil
+	}
+
+	// adopt the secret of another instance which saved its own meanwhile
+	time.Sleep(leaseSettleDelay)
+	secret, err = d.GetContent(ctx, secretPath)
+	if err != nil {
+		return "", err
+	}
+	return string(secret), nil
+}
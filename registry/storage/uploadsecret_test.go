@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/distribution/v3/registry/storage/lock"
+)
+
+func TestUploadSecret(t *testing.T) {
+	ctx := context.Background()
+	d := inmemory.New()
+
+	secret, err := UploadSecret(ctx, d, nil)
+	if err != nil {
+		t.Fatalf("unexpected error generating upload secret: %v", err)
+	}
+	if len(secret) != 2*uploadSecretSize {
+		t.Fatalf("unexpected upload secret %q", secret)
+	}
+
+	// the saved secret is used once generated
+	again, err := UploadSecret(ctx, d, nil)
+	if err != nil {
+		t.Fatalf("unexpected error reading upload secret: %v", err)
+	}
+	if again != secret {
+		t.Fatalf("upload secret changed from %q to %q", secret, again)
+	}
+
+	other, err := UploadSecret(ctx, inmemory.New(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error generating upload secret: %v", err)
+	}
+	if other == secret {
+		t.Fatal("expected another storage to have another upload secret")
+	}
+}
+
+// TestUploadSecretConcurrent checks that the instances generating the upload
+// secret concurrently agree on it, with or without a locker.
+func TestUploadSecretConcurrent(t *testing.T) {
+	for name, newLocker := range map[string]func(d *inmemory.Driver) lock.Locker{
+		"none":  func(*inmemory.Driver) lock.Locker { return nil },
+		"lease": func(d *inmemory.Driver) lock.Locker { return NewLeaseLocker(d, time.Second) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			d := inmemory.New()
+			locker := newLocker(d)
+
+			secrets := make([]string, 5)
+			var wg sync.WaitGroup
+			for i := range secrets {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					secret, err := UploadSecret(ctx, d, locker)
+					if err != nil {
+						t.Errorf("unexpected error generating upload secret: %v", err)
+					}
+					secrets[i] = secret
+				}(i)
+			}
+			wg.Wait()
+
+			stored, err := UploadSecret(ctx, d, locker)
+			if err != nil {
+				t.Fatalf("unexpected error reading upload secret: %v", err)
+			}
+			for _, secret := range secrets {
+				if secret != stored {
+					t.Fatalf("upload secret %q differs from the stored one %q", secret, stored)
+				}
+			}
+		})
+	}
+}
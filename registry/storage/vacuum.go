@@ -4,7 +4,9 @@ import (
 	"context"
 	"path"
 
+	"github.com/distribution/distribution/v3"
 	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/storage/cache"
 	"github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/opencontainers/go-digest"
 )
@@ -22,10 +24,22 @@ func NewVacuum(ctx context.Context, driver driver.StorageDriver) Vacuum {
 	}
 }
 
+// registryVacuum creates a Vacuum removing content from the storage of the
+// registry, which also invalidates the descriptors the registry caches for
+// the removed blobs.
+func registryVacuum(ctx context.Context, driver driver.StorageDriver, ns distribution.Namespace) Vacuum {
+	v := NewVacuum(ctx, driver)
+	if reg, ok := ns.(*registry); ok {
+		v.descriptorCache = reg.blobDescriptorCacheProvider
+	}
+	return v
+}
+
 // Vacuum removes content from the filesystem
 type Vacuum struct {
-	driver driver.StorageDriver
-	ctx    context.Context
+	driver          driver.StorageDriver
+	ctx             context.Context
+	descriptorCache cache.BlobDescriptorCacheProvider
 }
 
 // RemoveBlob removes a blob from the filesystem
@@ -47,6 +61,12 @@ func (v Vacuum) RemoveBlob(dgst string) error {
 		return err
 	}
 
+	if v.descriptorCache != nil {
+		if err := v.descriptorCache.Clear(v.ctx, d); err != nil && err != distribution.ErrBlobUnknown {
+			dcontext.GetLogger(v.ctx).Warnf("error clearing cached descriptor of blob %s: %v", d, err)
+		}
+	}
+
 	return nil
 }
 
@@ -54,6 +74,23 @@ func (v Vacuum) RemoveBlob(dgst string) error {
 func (v Vacuum) RemoveManifest(name string, dgst digest.Digest, tags []string) error {
 	// remove a tag manifest reference, in case of not found continue to next one
 	for _, tag := range tags {
+		// remove the tag itself when it currently points to the manifest
+		currentPath, err := pathFor(manifestTagCurrentPathSpec{name: name, tag: tag})
+		if err != nil {
+			return err
+		}
+		current, err := v.driver.GetContent(v.ctx, currentPath)
+		if err == nil && digest.Digest(current) == dgst {
+			tagPath, err := pathFor(manifestTagPathSpec{name: name, tag: tag})
+			if err != nil {
+				return err
+			}
+			dcontext.GetLogger(v.ctx).Infof("deleting manifest tag: %s", tagPath)
+			if err := v.driver.Delete(v.ctx, tagPath); err != nil {
+				return err
+			}
+			continue
+		}
 
 		tagsPath, err := pathFor(manifestTagIndexEntryPathSpec{name: name, revision: dgst, tag: tag})
 		if err != nil {
@@ -84,6 +121,34 @@ func (v Vacuum) RemoveManifest(name string, dgst digest.Digest, tags []string) e
 	return v.driver.Delete(v.ctx, manifestPath)
 }
 
+// RemoveReferrer removes a manifest from the referrers index of its subject
+func (v Vacuum) RemoveReferrer(name string, subject, dgst digest.Digest) error {
+	referrerLinkPath, err := pathFor(manifestReferrerLinkPathSpec{name: name, subject: subject, revision: dgst})
+	if err != nil {
+		return err
+	}
+	dcontext.GetLogger(v.ctx).Infof("deleting referrer link: %s", referrerLinkPath)
+	err = v.driver.Delete(v.ctx, path.Dir(referrerLinkPath))
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		return nil
+	}
+	return err
+}
+
+// RemoveTrashEntry removes an expired entry from the trash of a repository
+func (v Vacuum) RemoveTrashEntry(name, id string) error {
+	entryPath, err := pathFor(manifestTrashEntryPathSpec{name: name, id: id})
+	if err != nil {
+		return err
+	}
+	dcontext.GetLogger(v.ctx).Infof("deleting trash entry: %s", entryPath)
+	err = v.driver.Delete(v.ctx, entryPath)
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		return nil
+	}
+	return err
+}
+
 // RemoveRepository removes a repository directory from the
 // filesystem
 func (v Vacuum) RemoveRepository(repoName string) error {
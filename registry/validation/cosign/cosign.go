@@ -0,0 +1,273 @@
+// Package cosign implements a manifest validator admitting the tag pushes to
+// protected repositories only for manifests signed with cosign
+// (https://github.com/sigstore/cosign), either with one of the configured
+// public keys, or without key by a certificate issued by one of the configured
+// Fulcio roots. In-toto attestations signed with one of the public keys may
+// also be accepted.
+//
+// The signatures are looked up where cosign stores them, in the tag named
+// after the digest of the manifest, such as sha256-<hex>.sig, and among the
+// referrers of the manifest. The manifest must thus be pushed by digest, then
+// signed, before being tagged.
+//
+// It is enabled with the validation.manifests.validators section of the
+// configuration:
+//
+//	validation:
+//	  manifests:
+//	    validators:
+//	      - name: cosign
+//	        options:
+//	          repositories: [prod/*]
+//	          publickeys: [/etc/registry/cosign.pub]
+package cosign
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/registry/validation"
+	"github.com/opencontainers/go-digest"
+)
+
+// Media types and annotations of the signatures and attestations of cosign.
+const (
+	mediaTypeSimpleSigning = "application/vnd.dev.cosign.simplesigning.v1+json"
+	mediaTypeDSSE          = "application/vnd.dsse.envelope.v1+json"
+
+	annotationSignature   = "dev.cosignproject.cosign/signature"
+	annotationCertificate = "dev.sigstore.cosign/certificate"
+	annotationChain       = "dev.sigstore.cosign/chain"
+	annotationBundle      = "dev.sigstore.cosign/bundle"
+)
+
+// signatureTag matches the tags cosign stores signatures, attestations and
+// SBOMs in, which are pushed unsigned.
+var signatureTag = regexp.MustCompile(`^[a-z0-9]+-[a-f0-9]+\.(sig|att|sbom)$`)
+
+func init() {
+	validation.Register("cosign", newValidator)
+}
+
+// validator rejects the tag pushes of unsigned manifests to the protected
+// repositories.
+type validator struct {
+	repositories configuration.RepositoryMatchers
+	keys         []crypto.PublicKey
+	keyless      *keyless
+	attestations bool
+}
+
+func newValidator(ctx context.Context, options map[string]interface{}) (validation.ManifestValidator, error) {
+	repositories, err := stringList(options, "repositories")
+	if err != nil {
+		return nil, err
+	}
+	matchers, err := configuration.NewRepositoryMatchers(repositories)
+	if err != nil {
+		return nil, fmt.Errorf("cosign: %v", err)
+	}
+
+	v := &validator{repositories: matchers}
+
+	keyFiles, err := stringList(options, "publickeys")
+	if err != nil {
+		return nil, err
+	}
+	for _, keyFile := range keyFiles {
+		key, err := loadPublicKey(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cosign: %v", err)
+		}
+		v.keys = append(v.keys, key)
+	}
+
+	rootFiles, err := stringList(options, "fulcioroots")
+	if err != nil {
+		return nil, err
+	}
+	if len(rootFiles) > 0 {
+		v.keyless, err = newKeyless(options, rootFiles)
+		if err != nil {
+			return nil, fmt.Errorf("cosign: %v", err)
+		}
+	}
+
+	if len(v.keys) == 0 && v.keyless == nil {
+		return nil, errors.New("cosign: publickeys or fulcioroots are required")
+	}
+
+	switch attestations := options["attestations"].(type) {
+	case nil:
+	case bool:
+		v.attestations = attestations
+	default:
+		return nil, fmt.Errorf("cosign: invalid attestations option: %#v", attestations)
+	}
+	return v, nil
+}
+
+// ValidateManifest rejects the manifests pushed with a tag to a protected
+// repository which are not signed.
+func (v *validator) ValidateManifest(ctx context.Context, repository distribution.Repository, tag string, manifest distribution.Manifest) error {
+	if tag == "" || signatureTag.MatchString(tag) || !v.protects(repository.Named().Name()) {
+		return nil
+	}
+
+	_, payload, err := manifest.Payload()
+	if err != nil {
+		return err
+	}
+	dgst := digest.FromBytes(payload)
+
+	signatures, err := findSignatureManifests(ctx, repository, dgst)
+	if err != nil {
+		return err
+	}
+	for _, signature := range signatures {
+		for _, layer := range signature.Layers {
+			var err error
+			switch layer.MediaType {
+			case mediaTypeSimpleSigning:
+				err = v.verifySignature(ctx, repository, layer, dgst)
+			case mediaTypeDSSE:
+				if !v.attestations {
+					continue
+				}
+				err = v.verifyAttestation(ctx, repository, layer, dgst)
+			default:
+				continue
+			}
+			if err == nil {
+				return nil
+			}
+			dcontext.GetLogger(ctx).Debugf("cosign: invalid signature %s of %s: %v", layer.Digest, dgst, err)
+		}
+	}
+	return fmt.Errorf("manifest %s has no valid cosign signature", dgst)
+}
+
+// protects returns whether the repository requires signed manifests.
+func (v *validator) protects(name string) bool {
+	return len(v.repositories) == 0 || v.repositories.MatchAny(name)
+}
+
+// findSignatureManifests returns the manifests which may hold signatures of
+// the manifest with the given digest: those of the signature and attestation
+// tags of cosign, and the OCI manifests referring to it.
+func findSignatureManifests(ctx context.Context, repository distribution.Repository, dgst digest.Digest) ([]*ocischema.DeserializedManifest, error) {
+	manifests, err := repository.Manifests(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []digest.Digest
+	tags := repository.Tags(ctx)
+	for _, suffix := range []string{".sig", ".att"} {
+		desc, err := tags.Get(ctx, dgst.Algorithm().String()+"-"+dgst.Encoded()+suffix)
+		switch err.(type) {
+		case nil:
+			candidates = append(candidates, desc.Digest)
+		case distribution.ErrTagUnknown:
+		default:
+			return nil, err
+		}
+	}
+	if referrers, ok := manifests.(distribution.ManifestReferrers); ok {
+		descriptors, err := referrers.Referrers(ctx, dgst, "")
+		// the repository is unknown until its first manifest is pushed
+		if _, unknown := err.(distribution.ErrRepositoryUnknown); err != nil && err != distribution.ErrUnsupported && !unknown {
+			return nil, err
+		}
+		for _, desc := range descriptors {
+			candidates = append(candidates, desc.Digest)
+		}
+	}
+
+	var signatures []*ocischema.DeserializedManifest
+	for _, candidate := range candidates {
+		m, err := manifests.Get(ctx, candidate)
+		if err != nil {
+			return nil, err
+		}
+		if oci, ok := m.(*ocischema.DeserializedManifest); ok {
+			signatures = append(signatures, oci)
+		}
+	}
+	return signatures, nil
+}
+
+// stringList returns the list of strings of an option.
+func stringList(options map[string]interface{}, name string) ([]string, error) {
+	switch v := options[name].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []string:
+		return v, nil
+	case []interface{}:
+		list := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("cosign: invalid %s option: %#v", name, v)
+			}
+			list = append(list, s)
+		}
+		return list, nil
+	default:
+		return nil, fmt.Errorf("cosign: invalid %s option: %#v", name, v)
+	}
+}
+
+// loadPublicKey reads a PEM encoded public key.
+func loadPublicKey(file string) (crypto.PublicKey, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM encoded public key in %s", file)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key in %s: %v", file, err)
+	}
+	return key, nil
+}
+
+// loadCertificates reads PEM encoded certificates.
+func loadCertificates(content []byte) ([]*x509.Certificate, error) {
+	var certificates []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certificates = append(certificates, certificate)
+	}
+	if len(certificates) == 0 {
+		return nil, errors.New("no PEM encoded certificate")
+	}
+	return certificates, nil
+}
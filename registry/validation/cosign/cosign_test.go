@@ -0,0 +1,409 @@
+package cosign
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func newRepository(t *testing.T, name string) distribution.Repository {
+	ctx := context.Background()
+	registry, err := storage.NewRegistry(ctx, inmemory.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	named, err := reference.WithName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repository, err := registry.Repository(ctx, named)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repository
+}
+
+// putImage pushes an image manifest by digest.
+func putImage(t *testing.T, repository distribution.Repository) (distribution.Manifest, digest.Digest) {
+	ctx := context.Background()
+	config := []byte(fmt.Sprintf(`{"created":%q}`, time.Now().Format(time.RFC3339Nano)))
+	m, err := ocischema.NewManifestBuilder(repository.Blobs(ctx), config, nil).Build(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifests, err := repository.Manifests(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dgst, err := manifests.Put(ctx, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, dgst
+}
+
+// putSignature pushes a signature manifest of cosign holding a layer with the
+// given media type, content and annotations. It is tagged after the digest of
+// the subject, or refers to it when tag is false.
+func putSignature(t *testing.T, repository distribution.Repository, subject digest.Digest, mediaType string, content []byte, annotations map[string]string, tag bool) {
+	ctx := context.Background()
+	layer, err := repository.Blobs(ctx).Put(ctx, mediaType, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer.MediaType = mediaType
+	layer.Annotations = annotations
+
+	config, err := repository.Blobs(ctx).Put(ctx, v1.MediaTypeImageConfig, []byte("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.MediaType = v1.MediaTypeImageConfig
+
+	m := ocischema.Manifest{
+		Versioned: ocischema.SchemaVersion,
+		Config:    config,
+		Layers:    []distribution.Descriptor{layer},
+	}
+	if !tag {
+		m.Subject = &distribution.Descriptor{MediaType: v1.MediaTypeImageManifest, Digest: subject}
+	}
+	signature, err := ocischema.FromStruct(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifests, err := repository.Manifests(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dgst, err := manifests.Put(ctx, signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag {
+		suffix := ".sig"
+		if mediaType == mediaTypeDSSE {
+			suffix = ".att"
+		}
+		desc := distribution.Descriptor{MediaType: v1.MediaTypeImageManifest, Digest: dgst}
+		if err := repository.Tags(ctx).Tag(ctx, subject.Algorithm().String()+"-"+subject.Encoded()+suffix, desc); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// simpleSigningPayload returns the payload cosign signs for the digest.
+func simpleSigningPayload(dgst digest.Digest) []byte {
+	return []byte(fmt.Sprintf(`{"critical":{"identity":{"docker-reference":"registry/prod/app"},"image":{"docker-manifest-digest":%q},"type":"cosign container image signature"},"optional":null}`, dgst))
+}
+
+func sign(t *testing.T, key *ecdsa.PrivateKey, payload []byte) []byte {
+	sum := sha256.Sum256(payload)
+	signature, err := ecdsa.SignASN1(rand.Reader, key, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signature
+}
+
+func newKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// writePublicKey writes the PEM encoded public key to a file.
+func writePublicKey(t *testing.T, key crypto.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.CreateTemp(t.TempDir(), "*.pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := pem.Encode(file, &pem.Block{Type: "PUBLIC KEY", Bytes: der}); err != nil {
+		t.Fatal(err)
+	}
+	return file.Name()
+}
+
+func encodeCertificate(certificate []byte) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate}))
+}
+
+func TestValidateSignatures(t *testing.T) {
+	ctx := context.Background()
+	key, other := newKey(t), newKey(t)
+	v, err := newValidator(ctx, map[string]interface{}{
+		"repositories": []interface{}{"prod/*", "regexp:release/v[0-9]+"},
+		"publickeys":   []interface{}{writePublicKey(t, &key.PublicKey)},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating the validator: %v", err)
+	}
+
+	// unprotected repositories and pushes by digest are not checked
+	repository := newRepository(t, "dev/app")
+	m, _ := putImage(t, repository)
+	if err := v.ValidateManifest(ctx, repository, "latest", m); err != nil {
+		t.Fatalf("unexpected error pushing to an unprotected repository: %v", err)
+	}
+	repository = newRepository(t, "prod/app")
+	m, dgst := putImage(t, repository)
+	if err := v.ValidateManifest(ctx, repository, "", m); err != nil {
+		t.Fatalf("unexpected error pushing by digest: %v", err)
+	}
+	if err := v.ValidateManifest(ctx, repository, "sha256-"+dgst.Encoded()+".sig", m); err != nil {
+		t.Fatalf("unexpected error pushing a signature tag: %v", err)
+	}
+
+	for _, name := range []string{"prod/app", "release/v1"} {
+		repository := newRepository(t, name)
+		m, _ := putImage(t, repository)
+		if err := v.ValidateManifest(ctx, repository, "latest", m); err == nil {
+			t.Fatalf("%s: expected an error pushing an unsigned manifest", name)
+		}
+	}
+
+	// signature of another manifest
+	_, otherDigest := putImage(t, repository)
+	payload := simpleSigningPayload(otherDigest)
+	putSignature(t, repository, dgst, mediaTypeSimpleSigning, payload, map[string]string{
+		annotationSignature: base64.StdEncoding.EncodeToString(sign(t, key, payload)),
+	}, true)
+	if err := v.ValidateManifest(ctx, repository, "latest", m); err == nil {
+		t.Fatal("expected an error pushing a manifest signed for another digest")
+	}
+
+	// signature with an untrusted key
+	payload = simpleSigningPayload(dgst)
+	putSignature(t, repository, dgst, mediaTypeSimpleSigning, payload, map[string]string{
+		annotationSignature: base64.StdEncoding.EncodeToString(sign(t, other, payload)),
+	}, false)
+	if err := v.ValidateManifest(ctx, repository, "latest", m); err == nil {
+		t.Fatal("expected an error pushing a manifest signed with an untrusted key")
+	}
+
+	// signatures are found in the referrers and in the signature tag
+	putSignature(t, repository, dgst, mediaTypeSimpleSigning, payload, map[string]string{
+		annotationSignature: base64.StdEncoding.EncodeToString(sign(t, key, payload)),
+	}, false)
+	if err := v.ValidateManifest(ctx, repository, "latest", m); err != nil {
+		t.Fatalf("unexpected error pushing a manifest signed in its referrers: %v", err)
+	}
+	m, dgst = putImage(t, repository)
+	payload = simpleSigningPayload(dgst)
+	putSignature(t, repository, dgst, mediaTypeSimpleSigning, payload, map[string]string{
+		annotationSignature: base64.StdEncoding.EncodeToString(sign(t, key, payload)),
+	}, true)
+	if err := v.ValidateManifest(ctx, repository, "latest", m); err != nil {
+		t.Fatalf("unexpected error pushing a manifest signed in its signature tag: %v", err)
+	}
+}
+
+func TestValidateAttestations(t *testing.T) {
+	ctx := context.Background()
+	key := newKey(t)
+	options := map[string]interface{}{
+		"publickeys": []interface{}{writePublicKey(t, &key.PublicKey)},
+	}
+
+	repository := newRepository(t, "prod/app")
+	m, dgst := putImage(t, repository)
+	statement := []byte(fmt.Sprintf(`{"_type":"https://in-toto.io/Statement/v0.1","predicateType":"https://slsa.dev/provenance/v0.2","subject":[{"name":"prod/app","digest":{"sha256":%q}}],"predicate":{}}`, dgst.Encoded()))
+	payloadType := "application/vnd.in-toto+json"
+	pae := []byte(fmt.Sprintf("DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(statement), statement))
+	envelope, err := json.Marshal(map[string]interface{}{
+		"payloadType": payloadType,
+		"payload":     base64.StdEncoding.EncodeToString(statement),
+		"signatures":  []map[string]string{{"keyid": "", "sig": base64.StdEncoding.EncodeToString(sign(t, key, pae))}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	putSignature(t, repository, dgst, mediaTypeDSSE, envelope, nil, true)
+
+	v, err := newValidator(ctx, options)
+	if err != nil {
+		t.Fatalf("unexpected error creating the validator: %v", err)
+	}
+	if err := v.ValidateManifest(ctx, repository, "latest", m); err == nil {
+		t.Fatal("expected an error pushing an attested manifest without accepting attestations")
+	}
+
+	options["attestations"] = true
+	v, err = newValidator(ctx, options)
+	if err != nil {
+		t.Fatalf("unexpected error creating the validator: %v", err)
+	}
+	if err := v.ValidateManifest(ctx, repository, "latest", m); err != nil {
+		t.Fatalf("unexpected error pushing an attested manifest: %v", err)
+	}
+
+	// the statement must attest the manifest
+	m, _ = putImage(t, repository)
+	if err := v.ValidateManifest(ctx, repository, "latest", m); err == nil {
+		t.Fatal("expected an error pushing an unattested manifest")
+	}
+}
+
+func TestValidateKeyless(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+
+	// a Fulcio root, issuing a short-lived certificate to the signer
+	rootKey := newKey(t)
+	rootTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fulcio"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	rootDER, err := x509.CreateCertificate(rand.Reader, rootTemplate, rootTemplate, &rootKey.PublicKey, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := x509.ParseCertificate(rootDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootFile := filepath.Join(t.TempDir(), "fulcio.pem")
+	if err := os.WriteFile(rootFile, []byte(encodeCertificate(rootDER)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	signerKey := newKey(t)
+	certificateDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber:   big.NewInt(2),
+		NotBefore:      now.Add(-time.Minute),
+		NotAfter:       now.Add(10 * time.Minute),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		EmailAddresses: []string{"release@example.com"},
+	}, root, &signerKey.PublicKey, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rekorKey := newKey(t)
+	options := map[string]interface{}{
+		"fulcioroots":    []interface{}{rootFile},
+		"rekorpublickey": writePublicKey(t, &rekorKey.PublicKey),
+		"identities":     []interface{}{".*@example\\.com"},
+	}
+
+	repository := newRepository(t, "prod/app")
+	m, dgst := putImage(t, repository)
+	payload := simpleSigningPayload(dgst)
+	signature := sign(t, signerKey, payload)
+
+	// the transparency log entry of the signature
+	sum := sha256.Sum256(payload)
+	body, err := json.Marshal(map[string]interface{}{
+		"apiVersion": "0.0.1",
+		"kind":       "hashedrekord",
+		"spec": map[string]interface{}{
+			"data":      map[string]interface{}{"hash": map[string]string{"algorithm": "sha256", "value": hex.EncodeToString(sum[:])}},
+			"signature": map[string]interface{}{"content": signature},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := rekorPayload{
+		Body:           base64.StdEncoding.EncodeToString(body),
+		IntegratedTime: now.Unix(),
+		LogID:          "c0d23d6ad406973f9559f3ba2d1ca01f84147d8ffc5b8445c224f98b9591801d",
+		LogIndex:       42,
+	}
+	canonical, err := json.Marshal(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle, err := json.Marshal(rekorBundle{SignedEntryTimestamp: sign(t, rekorKey, canonical), Payload: entry})
+	if err != nil {
+		t.Fatal(err)
+	}
+	putSignature(t, repository, dgst, mediaTypeSimpleSigning, payload, map[string]string{
+		annotationSignature:   base64.StdEncoding.EncodeToString(signature),
+		annotationCertificate: encodeCertificate(certificateDER),
+		annotationChain:       encodeCertificate(rootDER),
+		annotationBundle:      string(bundle),
+	}, true)
+
+	v, err := newValidator(ctx, options)
+	if err != nil {
+		t.Fatalf("unexpected error creating the validator: %v", err)
+	}
+	if err := v.ValidateManifest(ctx, repository, "latest", m); err != nil {
+		t.Fatalf("unexpected error pushing a manifest signed without key: %v", err)
+	}
+
+	options["identities"] = []interface{}{"ci@example\\.com"}
+	v, err = newValidator(ctx, options)
+	if err != nil {
+		t.Fatalf("unexpected error creating the validator: %v", err)
+	}
+	if err := v.ValidateManifest(ctx, repository, "latest", m); err == nil {
+		t.Fatal("expected an error pushing a manifest signed by an untrusted identity")
+	}
+
+	// the transparency log entry must be signed by the configured key
+	options["identities"] = nil
+	options["rekorpublickey"] = writePublicKey(t, &newKey(t).PublicKey)
+	v, err = newValidator(ctx, options)
+	if err != nil {
+		t.Fatalf("unexpected error creating the validator: %v", err)
+	}
+	if err := v.ValidateManifest(ctx, repository, "latest", m); err == nil {
+		t.Fatal("expected an error pushing a manifest with an untrusted transparency log entry")
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	ctx := context.Background()
+	publicKey := writePublicKey(t, &newKey(t).PublicKey)
+	for _, options := range []map[string]interface{}{
+		{},
+		{"publickeys": []interface{}{filepath.Join(t.TempDir(), "missing.pub")}},
+		{"publickeys": []interface{}{publicKey}, "repositories": []interface{}{"regexp:("}},
+		{"publickeys": []interface{}{publicKey}, "repositories": []interface{}{"prod/["}},
+		{"publickeys": []interface{}{publicKey}, "attestations": "yes"},
+		{"publickeys": []interface{}{publicKey}, "repositories": 1},
+		{"fulcioroots": []interface{}{publicKey}, "rekorpublickey": publicKey},
+	} {
+		if _, err := newValidator(ctx, options); err == nil {
+			t.Errorf("expected an error for options %v", options)
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package cosign
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/opencontainers/go-digest"
+)
+
+// maxPayloadSize is the maximum size of the signature payloads and
+// attestation envelopes fetched to be verified.
+const maxPayloadSize = 1 << 20
+
+// keyless verifies the signatures made with the short-lived certificates of
+// Fulcio, recorded in the Rekor transparency log.
+type keyless struct {
+	roots      *x509.CertPool
+	rekorKey   crypto.PublicKey
+	identities []*regexp.Regexp
+}
+
+func newKeyless(options map[string]interface{}, rootFiles []string) (*keyless, error) {
+	k := &keyless{roots: x509.NewCertPool()}
+	for _, rootFile := range rootFiles {
+		content, err := os.ReadFile(rootFile)
+		if err != nil {
+			return nil, err
+		}
+		certificates, err := loadCertificates(content)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fulcio roots in %s: %v", rootFile, err)
+		}
+		for _, certificate := range certificates {
+			k.roots.AddCert(certificate)
+		}
+	}
+
+	rekorKey, ok := options["rekorpublickey"].(string)
+	if !ok || rekorKey == "" {
+		return nil, errors.New("rekorpublickey is required with fulcioroots")
+	}
+	key, err := loadPublicKey(rekorKey)
+	if err != nil {
+		return nil, err
+	}
+	k.rekorKey = key
+
+	identities, err := stringList(options, "identities")
+	if err != nil {
+		return nil, err
+	}
+	for _, identity := range identities {
+		re, err := regexp.Compile("^(?:" + identity + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid identity %q: %v", identity, err)
+		}
+		k.identities = append(k.identities, re)
+	}
+	return k, nil
+}
+
+// simpleSigning is the payload signed by cosign, identifying the manifest.
+type simpleSigning struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+	} `json:"critical"`
+}
+
+// verifySignature verifies a simple signing layer of a signature manifest.
+func (v *validator) verifySignature(ctx context.Context, repository distribution.Repository, layer distribution.Descriptor, dgst digest.Digest) error {
+	payload, err := fetchPayload(ctx, repository, layer)
+	if err != nil {
+		return err
+	}
+	var signed simpleSigning
+	if err := json.Unmarshal(payload, &signed); err != nil {
+		return fmt.Errorf("invalid payload: %v", err)
+	}
+	if signed.Critical.Image.DockerManifestDigest != dgst.String() {
+		return fmt.Errorf("payload signs %q", signed.Critical.Image.DockerManifestDigest)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(layer.Annotations[annotationSignature])
+	if err != nil || len(signature) == 0 {
+		return errors.New("missing signature annotation")
+	}
+
+	for _, key := range v.keys {
+		if verify(key, payload, signature) == nil {
+			return nil
+		}
+	}
+	if v.keyless != nil && layer.Annotations[annotationCertificate] != "" {
+		return v.keyless.verify(layer.Annotations, payload, signature)
+	}
+	return errors.New("signature does not match any public key")
+}
+
+// dsseEnvelope is the envelope of the in-toto attestations.
+type dsseEnvelope struct {
+	PayloadType string `json:"payloadType"`
+	Payload     string `json:"payload"`
+	Signatures  []struct {
+		Sig string `json:"sig"`
+	} `json:"signatures"`
+}
+
+// inTotoStatement is the part of the in-toto statements identifying their
+// subjects.
+type inTotoStatement struct {
+	Subject []struct {
+		Digest map[string]string `json:"digest"`
+	} `json:"subject"`
+}
+
+// verifyAttestation verifies a DSSE envelope layer of an attestation
+// manifest.
+func (v *validator) verifyAttestation(ctx context.Context, repository distribution.Repository, layer distribution.Descriptor, dgst digest.Digest) error {
+	content, err := fetchPayload(ctx, repository, layer)
+	if err != nil {
+		return err
+	}
+	var envelope dsseEnvelope
+	if err := json.Unmarshal(content, &envelope); err != nil {
+		return fmt.Errorf("invalid envelope: %v", err)
+	}
+	payload, err := base64.StdEncoding.DecodeString(envelope.Payload)
+	if err != nil {
+		return fmt.Errorf("invalid envelope payload: %v", err)
+	}
+
+	var statement inTotoStatement
+	if err := json.Unmarshal(payload, &statement); err != nil {
+		return fmt.Errorf("invalid statement: %v", err)
+	}
+	subject := false
+	for _, s := range statement.Subject {
+		if s.Digest[dgst.Algorithm().String()] == dgst.Encoded() {
+			subject = true
+			break
+		}
+	}
+	if !subject {
+		return errors.New("statement does not attest the manifest")
+	}
+
+	// the pre-authentication encoding of the envelope is signed
+	pae := []byte("DSSEv1 " + strconv.Itoa(len(envelope.PayloadType)) + " " + envelope.PayloadType + " " + strconv.Itoa(len(payload)) + " ")
+	pae = append(pae, payload...)
+	for _, s := range envelope.Signatures {
+		signature, err := base64.StdEncoding.DecodeString(s.Sig)
+		if err != nil {
+			continue
+		}
+		for _, key := range v.keys {
+			if verify(key, pae, signature) == nil {
+				return nil
+			}
+		}
+	}
+	return errors.New("attestation does not match any public key")
+}
+
+// rekorBundle is the proof of inclusion in the transparency log attached to
+// keyless signatures.
+type rekorBundle struct {
+	SignedEntryTimestamp []byte
+	Payload              rekorPayload
+}
+
+// rekorPayload is the log entry signed by Rekor. Its fields are sorted, so
+// that it is marshaled to the canonical JSON Rekor signed.
+type rekorPayload struct {
+	Body           string `json:"body"`
+	IntegratedTime int64  `json:"integratedTime"`
+	LogID          string `json:"logID"`
+	LogIndex       int64  `json:"logIndex"`
+}
+
+// hashedRekord is the body of the log entries of signatures.
+type hashedRekord struct {
+	Kind string `json:"kind"`
+	Spec struct {
+		Data struct {
+			Hash struct {
+				Algorithm string `json:"algorithm"`
+				Value     string `json:"value"`
+			} `json:"hash"`
+		} `json:"data"`
+		Signature struct {
+			Content []byte `json:"content"`
+		} `json:"signature"`
+	} `json:"spec"`
+}
+
+// verify verifies a signature made with the certificate of the annotations,
+// which must be recorded in the transparency log and issued by a Fulcio root
+// when it was.
+func (k *keyless) verify(annotations map[string]string, payload, signature []byte) error {
+	var bundle rekorBundle
+	if err := json.Unmarshal([]byte(annotations[annotationBundle]), &bundle); err != nil {
+		return fmt.Errorf("invalid or missing transparency log bundle: %v", err)
+	}
+	entry, err := json.Marshal(bundle.Payload)
+	if err != nil {
+		return err
+	}
+	if err := verify(k.rekorKey, entry, bundle.SignedEntryTimestamp); err != nil {
+		return fmt.Errorf("invalid transparency log entry: %v", err)
+	}
+
+	body, err := base64.StdEncoding.DecodeString(bundle.Payload.Body)
+	if err != nil {
+		return fmt.Errorf("invalid transparency log entry: %v", err)
+	}
+	var rekord hashedRekord
+	if err := json.Unmarshal(body, &rekord); err != nil {
+		return fmt.Errorf("invalid transparency log entry: %v", err)
+	}
+	sum := sha256.Sum256(payload)
+	if rekord.Kind != "hashedrekord" || rekord.Spec.Data.Hash.Algorithm != "sha256" || rekord.Spec.Data.Hash.Value != hex.EncodeToString(sum[:]) || !bytes.Equal(rekord.Spec.Signature.Content, signature) {
+		return errors.New("transparency log entry does not record the signature")
+	}
+
+	certificates, err := loadCertificates([]byte(annotations[annotationCertificate]))
+	if err != nil {
+		return fmt.Errorf("invalid certificate: %v", err)
+	}
+	certificate := certificates[0]
+	intermediates := x509.NewCertPool()
+	if chain := annotations[annotationChain]; chain != "" {
+		certificates, err := loadCertificates([]byte(chain))
+		if err != nil {
+			return fmt.Errorf("invalid certificate chain: %v", err)
+		}
+		for _, c := range certificates {
+			intermediates.AddCert(c)
+		}
+	}
+	if _, err := certificate.Verify(x509.VerifyOptions{
+		Roots:         k.roots,
+		Intermediates: intermediates,
+		CurrentTime:   time.Unix(bundle.Payload.IntegratedTime, 0),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}); err != nil {
+		return fmt.Errorf("untrusted certificate: %v", err)
+	}
+	if !k.matchIdentity(certificate) {
+		return fmt.Errorf("untrusted certificate identity %v %v", certificate.EmailAddresses, certificate.URIs)
+	}
+
+	return verify(certificate.PublicKey, payload, signature)
+}
+
+// matchIdentity returns whether the subject alternative names of the
+// certificate include one of the trusted identities.
+func (k *keyless) matchIdentity(certificate *x509.Certificate) bool {
+	if len(k.identities) == 0 {
+		return true
+	}
+	names := append([]string(nil), certificate.EmailAddresses...)
+	for _, uri := range certificate.URIs {
+		names = append(names, uri.String())
+	}
+	for _, identity := range k.identities {
+		for _, name := range names {
+			if identity.MatchString(name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// fetchPayload returns the content of a signature layer.
+func fetchPayload(ctx context.Context, repository distribution.Repository, layer distribution.Descriptor) ([]byte, error) {
+	if layer.Size > maxPayloadSize {
+		return nil, fmt.Errorf("payload of %d bytes is too large", layer.Size)
+	}
+	return repository.Blobs(ctx).Get(ctx, layer.Digest)
+}
+
+// verify verifies the signature of the payload with the public key, hashed
+// with sha256 but for ed25519 keys.
+func verify(key crypto.PublicKey, payload, signature []byte) error {
+	sum := sha256.Sum256(payload)
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, sum[:], signature) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], signature)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, payload, signature) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported public key %T", key)
+	}
+}
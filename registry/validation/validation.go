@@ -0,0 +1,67 @@
+// Package validation provides the extension point validating the manifests
+// pushed to the registry, so that operators can enforce their own policies,
+// such as rejecting some tags or requiring annotations, without modifying
+// the registry.
+//
+// A validator is registered under a name by an init function of the package
+// implementing it:
+//
+//	func init() {
+//		validation.Register("nolatest", func(ctx context.Context, options map[string]interface{}) (validation.ManifestValidator, error) {
+//			return &noLatest{}, nil
+//		})
+//	}
+//
+// and enabled with its options in the validation.manifests.validators
+// section of the configuration.
+package validation
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/distribution/distribution/v3"
+)
+
+// ManifestValidator validates the manifests pushed to the registry, before
+// they are stored.
+type ManifestValidator interface {
+	// ValidateManifest returns an error if the manifest must not be pushed
+	// to the repository. tag is the tag the manifest is pushed with, or
+	// empty if it is pushed by digest. The repository may be used to fetch
+	// the blobs referenced by the manifest, such as the image configuration.
+	ValidateManifest(ctx context.Context, repository distribution.Repository, tag string, manifest distribution.Manifest) error
+}
+
+// InitFunc is the type of a ManifestValidator factory function and is used
+// to register the constructor of the different validators.
+type InitFunc func(ctx context.Context, options map[string]interface{}) (ManifestValidator, error)
+
+var validators map[string]InitFunc
+
+// Register is used to register an InitFunc for a ManifestValidator with the
+// given name.
+func Register(name string, initFunc InitFunc) error {
+	if validators == nil {
+		validators = make(map[string]InitFunc)
+	}
+	if _, exists := validators[name]; exists {
+		return fmt.Errorf("name already registered: %s", name)
+	}
+
+	validators[name] = initFunc
+
+	return nil
+}
+
+// Get constructs a ManifestValidator with the given options using the named
+// backend.
+func Get(ctx context.Context, name string, options map[string]interface{}) (ManifestValidator, error) {
+	if validators != nil {
+		if initFunc, exists := validators[name]; exists {
+			return initFunc(ctx, options)
+		}
+	}
+
+	return nil, fmt.Errorf("no manifest validator registered with name: %s", name)
+}
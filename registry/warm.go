@@ -0,0 +1,69 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// warmedImage describes the content of an image pulled through the cache by
+// the warm admin route, or the error warming it.
+type warmedImage struct {
+	Reference    string        `json:"reference"`
+	Digest       digest.Digest `json:"digest,omitempty"`
+	Manifests    int           `json:"manifests"`
+	Blobs        int           `json:"blobs"`
+	FetchedBlobs int           `json:"fetchedBlobs"`
+	FetchedBytes int64         `json:"fetchedBytes"`
+	Error        string        `json:"error,omitempty"`
+}
+
+// warmCache requests the registry at registryURL to pull the images of
+// references through its cache, authenticating as its admin when
+// challenged, and returns the warmed images.
+func warmCache(ctx context.Context, registryURL string, creds adminCredentials, references []string, concurrency int) ([]warmedImage, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"references":  references,
+		"concurrency": concurrency,
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := adminRequest(ctx, registryURL, creds, http.MethodPost, "/admin/warm", body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	var response struct {
+		Images []warmedImage `json:"images"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, err
+	}
+	return response.Images, nil
+}
+
+// writeWarmedImages writes a line per warmed image, and returns whether all
+// the images were warmed.
+func writeWarmedImages(w io.Writer, images []warmedImage) bool {
+	warmed := true
+	for _, image := range images {
+		if image.Error != "" {
+			fmt.Fprintf(w, "%s: %s\n", image.Reference, image.Error)
+			warmed = false
+			continue
+		}
+		fmt.Fprintf(w, "%s: %s, %d manifests, %d blobs, %d fetched (%d bytes)\n", image.Reference, image.Digest, image.Manifests, image.Blobs, image.FetchedBlobs, image.FetchedBytes)
+	}
+	return warmed
+}
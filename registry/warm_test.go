@@ -0,0 +1,63 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestWarmCache(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/prefix/admin/warm" || r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if username, password, ok := r.BasicAuth(); !ok || username != "admin" || password != "secret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var request struct {
+			References  []string `json:"references"`
+			Concurrency int      `json:"concurrency"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Concurrency != 4 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		images := []warmedImage{}
+		for _, ref := range request.References {
+			images = append(images, warmedImage{Reference: ref, Digest: "sha256:aaaa", Manifests: 1, Blobs: 2, FetchedBlobs: 1, FetchedBytes: 100})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"images": images})
+	}))
+	defer server.Close()
+
+	images, err := warmCache(context.Background(), server.URL+"/prefix/", adminCredentials{username: "admin", password: "secret"}, []string{"foo/bar"}, 4)
+	if err != nil {
+		t.Fatalf("unexpected error warming the cache: %v", err)
+	}
+	expected := []warmedImage{{Reference: "foo/bar", Digest: "sha256:aaaa", Manifests: 1, Blobs: 2, FetchedBlobs: 1, FetchedBytes: 100}}
+	if !reflect.DeepEqual(images, expected) {
+		t.Fatalf("unexpected warmed images: %+v", images)
+	}
+
+	if _, err := warmCache(context.Background(), server.URL+"/prefix", adminCredentials{username: "admin"}, []string{"foo/bar"}, 4); err == nil {
+		t.Fatal("expected an error with wrong credentials")
+	}
+
+	var buf bytes.Buffer
+	if !writeWarmedImages(&buf, expected) {
+		t.Fatal("expected the images to be warmed")
+	}
+	if buf.String() != "foo/bar: sha256:aaaa, 1 manifests, 2 blobs, 1 fetched (100 bytes)\n" {
+		t.Errorf("unexpected output: %q", buf.String())
+	}
+	if writeWarmedImages(&buf, []warmedImage{{Reference: "foo/baz", Error: "unknown"}}) {
+		t.Fatal("expected an image to fail")
+	}
+}
@@ -2,6 +2,7 @@ package distribution
 
 import (
 	"context"
+	"time"
 
 	"github.com/opencontainers/go-digest"
 )
@@ -35,3 +36,45 @@ type TagManifestsProvider interface {
 	// includes currently linked digest. There is no ordering guaranteed
 	ManifestDigests(ctx context.Context, tag string) ([]digest.Digest, error)
 }
+
+// TagConditionalTagger is implemented by the tag services which check the
+// manifest a tag references and move the tag atomically, so that concurrent
+// updates of the tag do not clobber each other.
+type TagConditionalTagger interface {
+	// TagIf tags desc with the given tag if check accepts the digest the
+	// tag references, empty if the tag does not exist. The error returned
+	// by check is returned as is.
+	TagIf(ctx context.Context, tag string, desc Descriptor, check func(current digest.Digest) error) error
+}
+
+// Tag event actions.
+const (
+	TagEventActionTag   = "tag"
+	TagEventActionUntag = "untag"
+)
+
+// TagEvent records a change of the manifest a tag points to.
+type TagEvent struct {
+	// Action is TagEventActionTag when the tag was pointed to Digest, or
+	// TagEventActionUntag when the tag was deleted.
+	Action string `json:"action"`
+
+	// Digest is the manifest the tag points to after the event.
+	Digest digest.Digest `json:"digest,omitempty"`
+
+	// Previous is the manifest the tag pointed to before the event, if any.
+	Previous digest.Digest `json:"previous,omitempty"`
+
+	// Actor is the name of the user who moved the tag, if authenticated.
+	Actor string `json:"actor,omitempty"`
+
+	// Timestamp is the time of the event.
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// TagHistoryProvider provides access to the log of the changes of tags.
+type TagHistoryProvider interface {
+	// History returns the events of the tag, from the oldest to the most
+	// recent one. The history survives the deletion of the tag.
+	History(ctx context.Context, tag string) ([]TagEvent, error)
+}